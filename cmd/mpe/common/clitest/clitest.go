@@ -0,0 +1,66 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package clitest provides the fixtures shared by the tests of the mpe subcommands.
+package clitest
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestData returns the path of a file in the mpe test directory, wherever the test runs from.
+func TestData(name string) string {
+	_, thisFile, _, ok := runtime.Caller(0)
+	if !ok {
+		// Fallback to the path relative to the subcommand packages
+		return filepath.Join("../../test", name)
+	}
+	// thisFile is cmd/mpe/common/clitest/clitest.go
+	return filepath.Join(filepath.Dir(thisFile), "../../test", name)
+}
+
+// CopyTestData copies a file from the mpe test directory into dir, returning the path of the copy.
+func CopyTestData(t testing.TB, dir, name string) string {
+	data, err := os.ReadFile(TestData(name))
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+// WriteModified writes a copy of a file from the mpe test directory with the first occurrence
+// of from replaced by to, returning the path of the copy.
+func WriteModified(t testing.TB, name, from, to string) string {
+	data, err := os.ReadFile(TestData(name))
+	require.NoError(t, err)
+	require.Contains(t, string(data), from)
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), from, to, 1)), 0600))
+	return path
+}
+
+// CaptureStdout returns what f writes to stdout, along with the error f returns.
+func CaptureStdout(f func() error) (string, error) {
+	originalStdout := os.Stdout
+	defer func() {
+		os.Stdout = originalStdout
+	}()
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	runErr := f()
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	out, _ := io.ReadAll(r)
+	return string(out), runErr
+}
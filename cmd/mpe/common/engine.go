@@ -7,11 +7,15 @@ import (
 	"os"
 	"strings"
 
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
 	"github.com/manetu/policyengine/pkg/core"
 	"github.com/manetu/policyengine/pkg/core/accesslog"
 	"github.com/manetu/policyengine/pkg/core/backend/local"
+	"github.com/manetu/policyengine/pkg/core/config"
 	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
 	"github.com/manetu/policyengine/pkg/policydomain/registry"
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/urfave/cli/v3"
@@ -49,44 +53,177 @@ func GetRegoVersionFromOPAFlags(noOPAFlags bool, opaFlagsStr string) ast.RegoVer
 
 // NewCliPolicyEngine creates a new PolicyEngine instance configured from CLI command flags.
 // It sets up the registry, access logging, backend, and compiler options based on the provided command.
-func NewCliPolicyEngine(cmd *cli.Command, stdout io.Writer) (core.PolicyEngine, error) {
+// Any extra options are applied after those.
+func NewCliPolicyEngine(cmd *cli.Command, stdout io.Writer, extra ...options.EngineOptionsFunc) (core.PolicyEngine, error) {
+	opts, err := GetAccessLogOptions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return NewCliPolicyEngineWithOptions(cmd, stdout, opts, extra...)
+}
+
+// GetAccessLogOptions determines the access log options from the global --pretty-log and
+// --log-format flags, and the audit configuration, including the CloudEvents attributes and
+// the CEF and LEEF field mapping. The --log-format flag takes precedence
+// over the audit.format configuration.
+func GetAccessLogOptions(cmd *cli.Command) (accesslog.AccessLogOptions, error) {
 	opts := accesslog.AccessLogOptions{
 		PrettyPrint: cmd.Root().Bool("pretty-log"),
 	}
-	return NewCliPolicyEngineWithOptions(cmd, stdout, opts)
+
+	if err := config.Load(); err != nil {
+		return opts, err
+	}
+
+	format := config.VConfig.GetString(config.AuditFormat)
+	if cmd.Root().IsSet("log-format") {
+		format = cmd.Root().String("log-format")
+	}
+	format = strings.ToLower(strings.TrimSpace(format))
+
+	switch format {
+	case "", "json":
+	case "cloudevents":
+		opts.CloudEvents = &accesslog.CloudEventsOptions{
+			Source: config.VConfig.GetString(config.AuditCloudEventsSource),
+			Type:   config.VConfig.GetString(config.AuditCloudEventsType),
+		}
+	case "cef", "leef":
+		encoder, err := getSIEMEncoder(accesslog.SIEMFormat(format))
+		if err != nil {
+			return opts, err
+		}
+		opts.Encoder = encoder
+	default:
+		return opts, fmt.Errorf("unsupported access log format '%s': must be 'json', 'cloudevents', 'cef', or 'leef'", format)
+	}
+	return opts, nil
+}
+
+// getSIEMEncoder creates a CEF or LEEF encoder from the audit.siem configuration
+func getSIEMEncoder(format accesslog.SIEMFormat) (accesslog.Encoder, error) {
+	opts := accesslog.DefaultSIEMOptions(format)
+	if config.VConfig.IsSet(config.AuditSIEMVendor) {
+		opts.Vendor = config.VConfig.GetString(config.AuditSIEMVendor)
+	}
+	if config.VConfig.IsSet(config.AuditSIEMProduct) {
+		opts.Product = config.VConfig.GetString(config.AuditSIEMProduct)
+	}
+	if config.VConfig.IsSet(config.AuditSIEMSeverityGrant) {
+		opts.GrantSeverity = config.VConfig.GetInt(config.AuditSIEMSeverityGrant)
+	}
+	if config.VConfig.IsSet(config.AuditSIEMSeverityDeny) {
+		opts.DenySeverity = config.VConfig.GetInt(config.AuditSIEMSeverityDeny)
+	}
+
+	fields, err := config.GetSIEMFields()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s configuration: %w", config.AuditSIEMFields, err)
+	}
+	if len(fields) > 0 {
+		opts.Fields = make([]accesslog.SIEMField, 0, len(fields))
+		for _, f := range fields {
+			opts.Fields = append(opts.Fields, accesslog.SIEMField{Key: f.Key, Field: f.Field, Label: f.Label})
+		}
+	}
+
+	return accesslog.NewSIEMEncoder(opts)
 }
 
 // NewCliPolicyEngineWithOptions creates a new PolicyEngine instance with explicit access log options.
 // This is useful when callers need to override the default options from CLI flags.
-func NewCliPolicyEngineWithOptions(cmd *cli.Command, stdout io.Writer, accessLogOpts accesslog.AccessLogOptions) (core.PolicyEngine, error) {
-	// Enable trace logging if requested (global flag from root command)
-	traceEnabled := cmd.Root().Bool("trace")
+func NewCliPolicyEngineWithOptions(cmd *cli.Command, stdout io.Writer, accessLogOpts accesslog.AccessLogOptions, extra ...options.EngineOptionsFunc) (core.PolicyEngine, error) {
+	return NewCliPolicyEngineWithAccessLog(cmd, accesslog.NewIoWriterFactoryWithOptions(stdout, accessLogOpts), extra...)
+}
 
-	bundles := cmd.StringSlice("bundle")
+// NewCliPolicyEngineWithAccessLog creates a new PolicyEngine instance that emits access records to
+// the given factory. This is useful when callers need to interpose on the access log, such as
+// correlating decisions with external telemetry.
+func NewCliPolicyEngineWithAccessLog(cmd *cli.Command, accessLog accesslog.Factory, extra ...options.EngineOptionsFunc) (core.PolicyEngine, error) {
+	return NewBundlePolicyEngine(cmd, cmd.StringSlice("bundle"), accessLog, extra...)
+}
+
+// NewBundlePolicyEngine creates a new PolicyEngine instance for an explicit set of bundles,
+// taking all other configuration from the CLI command flags. This is useful when a command
+// loads more than one set of bundles, such as comparing two versions of a domain.
+func NewBundlePolicyEngine(cmd *cli.Command, bundles []string, accessLog accesslog.Factory, extra ...options.EngineOptionsFunc) (core.PolicyEngine, error) {
+	r, err := LoadRegistry(bundles)
+	if err != nil {
+		return nil, err
+	}
+	return NewRegistryPolicyEngine(cmd, r, accessLog, extra...)
+}
+
+// LoadRegistry loads the domains of a set of bundles, which may be directories or glob
+// patterns, building any PolicyDomainReference files among them.
+func LoadRegistry(bundles []string) (*registry.Registry, error) {
+	models, err := LoadModels(bundles)
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewRegistryFromModels(models)
+}
+
+// LoadModels parses the domains of a set of bundles like [LoadRegistry], without validating
+// them, such as to stage them with [registry.Registry.Stage].
+func LoadModels(bundles []string) ([]*policydomain.IntermediateModel, error) {
 	if len(bundles) == 0 {
 		return nil, fmt.Errorf("at least one bundle must be specified")
 	}
 
-	// Auto-build any PolicyDomainReference files
-	bundles, err := AutoBuildReferenceFiles(bundles)
+	// Expand directories and glob patterns, including references so they can be built
+	bundles, err := registry.ExpandPaths(bundles, registry.KindPolicyDomain, build.KindPolicyDomainReference)
 	if err != nil {
 		return nil, err
 	}
 
-	r, err := registry.NewRegistry(bundles)
+	// Auto-build any PolicyDomainReference files
+	bundles, err = AutoBuildReferenceFiles(bundles)
 	if err != nil {
 		return nil, err
 	}
 
+	var models []*policydomain.IntermediateModel
+	for _, bundle := range bundles {
+		instances, err := parsers.LoadAll(bundle)
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, instances...)
+	}
+	return models, nil
+}
+
+// NewRegistryPolicyEngine creates a new PolicyEngine instance for the domains of a registry,
+// taking all other configuration from the CLI command flags. Creating the engine compiles the
+// policies of the registry, which callers may then evaluate directly.
+func NewRegistryPolicyEngine(cmd *cli.Command, r *registry.Registry, accessLog accesslog.Factory, extra ...options.EngineOptionsFunc) (core.PolicyEngine, error) {
+	if err := config.Load(); err != nil {
+		return nil, err
+	}
+	precedence := config.VConfig.GetStringSlice(config.BundlesPrecedence)
+
+	engineOpts := []options.EngineOptionsFunc{
+		options.WithAccessLog(accessLog),
+		options.WithBackend(local.NewFactory(r, local.WithDomainPrecedence(precedence...))),
+		options.WithCompilerOptions(CompilerOptions(cmd)...),
+	}
+	return core.NewPolicyEngine(append(engineOpts, extra...)...)
+}
+
+// CompilerOptions returns the compiler options of the CLI command flags: the Rego version of
+// the OPA flags, and tracing from the global --trace and --trace-filter flags. Options added
+// to them take precedence, since [options.WithCompilerOptions] replaces the list.
+func CompilerOptions(cmd *cli.Command) []opa.CompilerOptionFunc {
 	// Get Rego version from OPA flags (CLI flags and environment variables)
 	noOPAFlags := cmd.Bool("no-opa-flags")
 	opaFlags := cmd.String("opa-flags")
 	regoVersion := GetRegoVersionFromOPAFlags(noOPAFlags, opaFlags)
 
-	// Build compiler options
+	// Enable trace logging if requested (global flag from root command)
 	compilerOpts := []opa.CompilerOptionFunc{
 		opa.WithRegoVersion(regoVersion),
-		opa.WithDefaultTracing(traceEnabled),
+		opa.WithDefaultTracing(cmd.Root().Bool("trace")),
 	}
 
 	// Add trace filter if specified
@@ -94,9 +231,5 @@ func NewCliPolicyEngineWithOptions(cmd *cli.Command, stdout io.Writer, accessLog
 	if len(traceFilter) > 0 {
 		compilerOpts = append(compilerOpts, opa.WithTraceFilter(traceFilter))
 	}
-
-	return core.NewPolicyEngine(
-		options.WithAccessLog(accesslog.NewIoWriterFactoryWithOptions(stdout, accessLogOpts)),
-		options.WithBackend(local.NewFactory(r)),
-		options.WithCompilerOptions(compilerOpts...))
+	return compilerOpts
 }
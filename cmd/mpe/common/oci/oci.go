@@ -0,0 +1,368 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package oci implements the parts of the OCI distribution API that mpe uses to fetch and
+// publish artifacts in container registries: manifests and blobs, verified by digest.
+//
+// Registries are accessed anonymously, answering Bearer token challenges as the registry
+// requests. For private registries, credentials are read from the MPE_REGISTRY_USERNAME and
+// MPE_REGISTRY_PASSWORD environment variables.
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Media types of OCI manifests and the empty config of artifacts
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeEmpty    = "application/vnd.oci.empty.v1+json"
+)
+
+// AnnotationTitle is the annotation holding the file name of a layer
+const AnnotationTitle = "org.opencontainers.image.title"
+
+// MaxSize bounds the size of a manifest or blob fetched from a registry
+const MaxSize = 64 << 20
+
+// Descriptor identifies a blob by its digest.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is an OCI image manifest.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Reference is a parsed artifact reference, such as ghcr.io/acme/bundles:1.0.
+type Reference struct {
+	Host       string // Registry host, with its port if any
+	Repository string // Repository within the registry
+	Reference  string // Tag, or digest such as sha256:<hex>
+}
+
+// ParseReference parses an artifact reference of the form registry/repository[:tag|@digest],
+// optionally prefixed by oci://. The tag defaults to "latest".
+func ParseReference(ref string) (Reference, error) {
+	invalid := fmt.Errorf("invalid OCI reference '%s', expected registry/repository[:tag|@digest]", ref)
+
+	rest := strings.TrimPrefix(ref, "oci://")
+	if strings.Contains(rest, "://") {
+		return Reference{}, invalid
+	}
+	host, rest, ok := strings.Cut(rest, "/")
+	if !ok || host == "" || rest == "" {
+		return Reference{}, invalid
+	}
+
+	r := Reference{Host: host, Repository: rest, Reference: "latest"}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		r.Repository, r.Reference = rest[:i], rest[i+1:]
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 {
+		r.Repository, r.Reference = rest[:i], rest[i+1:]
+	}
+	if r.Repository == "" || r.Reference == "" {
+		return Reference{}, invalid
+	}
+	return r, nil
+}
+
+// String formats the reference as registry/repository:tag or registry/repository@digest.
+func (r Reference) String() string {
+	if IsDigest(r.Reference) {
+		return r.Host + "/" + r.Repository + "@" + r.Reference
+	}
+	return r.Host + "/" + r.Repository + ":" + r.Reference
+}
+
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// IsDigest reports whether s is a sha256 digest, such as sha256:<64 hex digits>.
+func IsDigest(s string) bool {
+	return digestPattern.MatchString(s)
+}
+
+// Digest returns the sha256 digest of data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// VerifyDigest checks data against a digest.
+func VerifyDigest(data []byte, digest string) error {
+	if !IsDigest(digest) {
+		return fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	if actual := Digest(data); actual != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+	return nil
+}
+
+// Client accesses registries.
+type Client struct {
+	// HTTP performs the requests.
+	HTTP *http.Client
+
+	// PlainHTTP contacts registries over HTTP instead of HTTPS.
+	PlainHTTP bool
+}
+
+// Repository returns the repository of ref. A Repository keeps the authorization granted by
+// the registry, and is not safe for concurrent use.
+func (c *Client) Repository(ref Reference) *Repository {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Repository{client: client, base: fmt.Sprintf("%s://%s/v2/%s", scheme, ref.Host, ref.Repository)}
+}
+
+// Repository performs the requests against a repository of a registry.
+type Repository struct {
+	client        *http.Client
+	base          string
+	authorization string
+}
+
+// GetManifest fetches the manifest of a tag or digest, verifying it against the digest if any.
+func (r *Repository) GetManifest(ctx context.Context, reference string) (*Manifest, []byte, error) {
+	resp, err := r.do(ctx, http.MethodGet, r.base+"/manifests/"+reference, nil, http.Header{
+		"Accept": {MediaTypeManifest + ", application/vnd.docker.distribution.manifest.v2+json"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readOK(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if IsDigest(reference) {
+		if err := VerifyDigest(data, reference); err != nil {
+			return nil, nil, fmt.Errorf("manifest: %w", err)
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &manifest, data, nil
+}
+
+// GetBlob fetches a blob, verifying it against its digest.
+func (r *Repository) GetBlob(ctx context.Context, digest string) ([]byte, error) {
+	if !IsDigest(digest) {
+		return nil, fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	resp, err := r.do(ctx, http.MethodGet, r.base+"/blobs/"+digest, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readOK(resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyDigest(data, digest); err != nil {
+		return nil, fmt.Errorf("blob: %w", err)
+	}
+	return data, nil
+}
+
+// PushBlob uploads data, unless the repository already holds it, and returns its descriptor.
+func (r *Repository) PushBlob(ctx context.Context, mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{MediaType: mediaType, Digest: Digest(data), Size: int64(len(data))}
+
+	resp, err := r.do(ctx, http.MethodHead, r.base+"/blobs/"+desc.Digest, nil, nil)
+	if err != nil {
+		return desc, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return desc, nil
+	}
+
+	// monolithic upload: open a session, then complete it with the content
+	resp, err = r.do(ctx, http.MethodPost, r.base+"/blobs/uploads/", nil, nil)
+	if err != nil {
+		return desc, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return desc, fmt.Errorf("starting upload: registry returned %s", resp.Status)
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return desc, fmt.Errorf("invalid upload location: %w", err)
+	}
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+
+	resp, err = r.do(ctx, http.MethodPut, location.String(), data, http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return desc, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return desc, fmt.Errorf("uploading %s: registry returned %s", desc.Digest, resp.Status)
+	}
+	return desc, nil
+}
+
+// PushManifest uploads a manifest under a tag, and returns its digest.
+func (r *Repository) PushManifest(ctx context.Context, tag string, manifest *Manifest) (string, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.do(ctx, http.MethodPut, r.base+"/manifests/"+url.PathEscape(tag), data, http.Header{"Content-Type": {MediaTypeManifest}})
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("uploading manifest: registry returned %s", resp.Status)
+	}
+	return Digest(data), nil
+}
+
+// do performs a request, authenticating and retrying once if the registry challenges it
+func (r *Repository) do(ctx context.Context, method, target string, body []byte, header http.Header) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if r.authorization != "" {
+			req.Header.Set("Authorization", r.authorization)
+		}
+		return r.client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	// the challenge may ask for a broader scope, such as push after pull
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+	if err := r.authenticate(ctx, challenge); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate answers a Basic or Bearer challenge of the registry
+func (r *Repository) authenticate(ctx context.Context, challenge string) error {
+	username, password := os.Getenv("MPE_REGISTRY_USERNAME"), os.Getenv("MPE_REGISTRY_PASSWORD")
+	scheme, params, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return fmt.Errorf("registry requires credentials: set MPE_REGISTRY_USERNAME and MPE_REGISTRY_PASSWORD")
+		}
+		r.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry returned 401 Unauthorized")
+	}
+
+	values := make(map[string]string)
+	for _, m := range challengeParam.FindAllStringSubmatch(params, -1) {
+		values[m[1]] = m[2]
+	}
+	if values["realm"] == "" {
+		return fmt.Errorf("registry challenge has no realm")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, values["realm"], nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if values[key] != "" {
+			q.Set(key, values[key])
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting registry token: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("requesting registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxSize)).Decode(&token); err != nil {
+		return fmt.Errorf("invalid registry token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// readOK reads the body of a successful response, up to MaxSize
+func readOK(resp *http.Response) ([]byte, error) {
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxSize {
+		return nil, fmt.Errorf("exceeds %d bytes", MaxSize)
+	}
+	return data, nil
+}
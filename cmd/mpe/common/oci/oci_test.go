@@ -0,0 +1,54 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package oci
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		ref      string
+		expected Reference
+		str      string
+	}{
+		{ref: "ghcr.io/acme/libs:1.0", expected: Reference{Host: "ghcr.io", Repository: "acme/libs", Reference: "1.0"}, str: "ghcr.io/acme/libs:1.0"},
+		{ref: "oci://localhost:5000/libs", expected: Reference{Host: "localhost:5000", Repository: "libs", Reference: "latest"}, str: "localhost:5000/libs:latest"},
+		{ref: "ghcr.io/acme/libs@" + digest, expected: Reference{Host: "ghcr.io", Repository: "acme/libs", Reference: digest}, str: "ghcr.io/acme/libs@" + digest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			ref, err := ParseReference(tt.ref)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, ref)
+			assert.Equal(t, tt.str, ref.String())
+		})
+	}
+
+	for _, ref := range []string{"libs", "https://ghcr.io/acme/libs", "ghcr.io/", "ghcr.io/acme/libs:", "ghcr.io/acme/libs@"} {
+		_, err := ParseReference(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	data := []byte("{}")
+	assert.Equal(t, "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", Digest(data))
+	assert.NoError(t, VerifyDigest(data, Digest(data)))
+
+	err := VerifyDigest([]byte("[]"), Digest(data))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+
+	err = VerifyDigest(data, "md5:abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported digest")
+}
@@ -0,0 +1,110 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/urfave/cli/v3"
+)
+
+// Formats of the OPA trace selected with the global --trace-format flag
+const (
+	// TraceText is the text printed by OPA, written to stderr by the engine itself
+	TraceText = "text"
+	// TraceJSON writes a JSON object per decision, with the events of each policy traced
+	TraceJSON = "json"
+	// TraceFolded writes the folded stacks of each decision, for flame graph tools
+	TraceFolded = "folded"
+)
+
+// Tracer collects the OPA trace of each decision and writes it in the format selected with
+// the global --trace-format flag, to the file of --trace-output or to a default writer.
+type Tracer struct {
+	format string
+	out    io.Writer
+	file   *os.File
+	// Indent indents the JSON of a decision, which is otherwise written on a single line
+	Indent bool
+}
+
+// NewTracer returns the Tracer of the global trace flags, writing to out unless --trace-output
+// is set. It returns nil when the trace format is text, which the engine prints itself.
+func NewTracer(cmd *cli.Command, out io.Writer) (*Tracer, error) {
+	root := cmd.Root()
+	format := root.String("trace-format")
+	output := root.String("trace-output")
+
+	switch format {
+	case "", TraceText:
+		if output != "" {
+			return nil, fmt.Errorf("--trace-output requires --trace-format %s or %s", TraceJSON, TraceFolded)
+		}
+		return nil, nil
+	case TraceJSON, TraceFolded:
+	default:
+		return nil, fmt.Errorf("invalid --trace-format '%s': expected %s, %s, or %s", format, TraceText, TraceJSON, TraceFolded)
+	}
+
+	t := &Tracer{format: format, out: out}
+	if output != "" {
+		file, err := os.Create(output) // #nosec G304 -- CLI tool intentionally writes user-provided paths
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace output: %w", err)
+		}
+		t.out, t.file = file, file
+	}
+	return t, nil
+}
+
+// Format returns the format the tracer writes.
+func (t *Tracer) Format() string {
+	return t.format
+}
+
+// Begin returns a context collecting the trace of a decision made with it.
+func (t *Tracer) Begin(ctx context.Context) (context.Context, *opa.TraceLog) {
+	log := &opa.TraceLog{}
+	return opa.WithTraceLog(ctx, log), log
+}
+
+// Write writes the trace of a decision. The name identifies the decision, such as the test
+// that made it, and may be empty.
+func (t *Tracer) Write(name string, log *opa.TraceLog) error {
+	if t.format == TraceFolded {
+		var prefix []string
+		if name != "" {
+			prefix = append(prefix, name)
+		}
+		return log.WriteFolded(t.out, prefix...)
+	}
+
+	decision := struct {
+		Decision string             `json:"decision,omitempty"`
+		Policies []*opa.PolicyTrace `json:"policies"`
+	}{name, log.Policies()}
+	if decision.Policies == nil {
+		decision.Policies = []*opa.PolicyTrace{}
+	}
+
+	enc := json.NewEncoder(t.out)
+	if t.Indent {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(decision)
+}
+
+// Close closes the file of --trace-output, if any.
+func (t *Tracer) Close() error {
+	if t == nil || t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
@@ -0,0 +1,113 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+// runWithTracer runs a command with the global trace flags, passing its tracer to fn
+func runWithTracer(t *testing.T, out *bytes.Buffer, fn func(*Tracer), args ...string) error {
+	cmd := &cli.Command{
+		Name: "mpe",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "trace-format", Value: TraceText},
+			&cli.StringFlag{Name: "trace-output"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			tracer, err := NewTracer(cmd, out)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = tracer.Close() }()
+			fn(tracer)
+			return nil
+		},
+	}
+	return cmd.Run(context.Background(), append([]string{"mpe"}, args...))
+}
+
+// tracedLog returns the trace log of a traced evaluation of a policy
+func tracedLog(t *testing.T) *opa.TraceLog {
+	instance, err := opa.NewCompiler(opa.WithDefaultTracing(true)).Compile("mrn:iam:policy:test", opa.Modules{
+		"mrn:iam:policy:test": "package authz\ndefault allow = false\nallow { input.user == \"admin\" }\n",
+	})
+	require.NoError(t, err)
+
+	log := &opa.TraceLog{}
+	_, perr := instance.Evaluate(opa.WithTraceLog(context.Background(), log), "x = data.authz.allow", map[string]interface{}{"user": "admin"})
+	require.Nil(t, perr)
+	return log
+}
+
+func TestNewTracer(t *testing.T) {
+	var out bytes.Buffer
+	var tracer *Tracer
+	require.NoError(t, runWithTracer(t, &out, func(tr *Tracer) { tracer = tr }))
+	assert.Nil(t, tracer, "the text format is printed by the engine")
+
+	err := runWithTracer(t, &out, func(*Tracer) {}, "--trace-format", "xml")
+	assert.ErrorContains(t, err, "invalid --trace-format 'xml'")
+
+	err = runWithTracer(t, &out, func(*Tracer) {}, "--trace-output", filepath.Join(t.TempDir(), "trace"))
+	assert.ErrorContains(t, err, "--trace-output requires --trace-format json or folded")
+}
+
+func TestTracer_JSON(t *testing.T) {
+	var out bytes.Buffer
+	log := tracedLog(t)
+	require.NoError(t, runWithTracer(t, &out, func(tracer *Tracer) {
+		require.Equal(t, TraceJSON, tracer.Format())
+		require.NoError(t, tracer.Write("first", log))
+		require.NoError(t, tracer.Write("", &opa.TraceLog{}))
+	}, "--trace-format", "json"))
+
+	// a decision per line
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var first struct {
+		Decision string `json:"decision"`
+		Policies []struct {
+			Policy   string                 `json:"policy"`
+			Bindings map[string]interface{} `json:"bindings"`
+			Events   []map[string]interface{}
+		} `json:"policies"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "first", first.Decision)
+	require.Len(t, first.Policies, 1)
+	assert.Equal(t, "mrn:iam:policy:test", first.Policies[0].Policy)
+	assert.Equal(t, map[string]interface{}{"x": true}, first.Policies[0].Bindings)
+	assert.NotEmpty(t, first.Policies[0].Events)
+
+	assert.JSONEq(t, `{"policies": []}`, lines[1])
+}
+
+func TestTracer_FoldedOutput(t *testing.T) {
+	var out bytes.Buffer
+	file := filepath.Join(t.TempDir(), "trace.folded")
+	log := tracedLog(t)
+	require.NoError(t, runWithTracer(t, &out, func(tracer *Tracer) {
+		require.NoError(t, tracer.Write("admin-can-read", log))
+	}, "--trace-format", "folded", "--trace-output", file))
+
+	assert.Empty(t, out.String(), "the trace is written to the output file")
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "admin-can-read;mrn:iam:policy:test;query ")
+	assert.Contains(t, string(data), "admin-can-read;mrn:iam:policy:test;query;data.authz.allow:3 ")
+}
@@ -0,0 +1,127 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package watch re-runs mpe commands as the files they read change, for a fast edit-run loop
+// while authoring policies.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Default timing of a [Watcher]
+const (
+	// DefaultInterval is how often watched files are checked for changes
+	DefaultInterval = 250 * time.Millisecond
+	// DefaultDebounce is how long watched files must stay unchanged before a change is acted
+	// on, so that saving several files at once runs once
+	DefaultDebounce = 300 * time.Millisecond
+)
+
+// Watcher runs a function, then runs it again each time a file it depends on changes, for
+// an edit-run loop. Files are polled rather than subscribed to, so that editors that save by
+// replacing a file, and network or container filesystems, are followed alike.
+type Watcher struct {
+	// Files returns the files to watch. It is called after each run, so that the files
+	// watched follow those the run depended on.
+	Files func() []string
+	// Run is called once when watching starts and again after each change.
+	Run func()
+	// Interval and Debounce default to DefaultInterval and DefaultDebounce.
+	Interval time.Duration
+	Debounce time.Duration
+	// Out receives the change notices, os.Stdout by default.
+	Out io.Writer
+}
+
+// fileState is what polling compares to detect a change to a file
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func snapshot(files []string) map[string]fileState {
+	states := make(map[string]fileState, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			states[file] = fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+		} else {
+			states[file] = fileState{}
+		}
+	}
+	return states
+}
+
+// changed returns the files whose state differs between two snapshots, sorted
+func changed(before, after map[string]fileState) []string {
+	var files []string
+	for file, state := range after {
+		if before[file] != state {
+			files = append(files, file)
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// Watch runs and watches until the context is done.
+func (w *Watcher) Watch(ctx context.Context) error {
+	interval, debounce, out := w.Interval, w.Debounce, w.Out
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+
+	w.Run()
+	files := w.Files()
+	last := snapshot(files)
+	fmt.Fprintf(out, "\nWatching %d file(s) for changes...\n", len(files))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pending []string
+	var changedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			current := snapshot(files)
+			if diff := changed(last, current); len(diff) > 0 {
+				for _, file := range diff {
+					if !slices.Contains(pending, file) {
+						pending = append(pending, file)
+					}
+				}
+				last, changedAt = current, now
+				continue
+			}
+			if len(pending) == 0 || now.Sub(changedAt) < debounce {
+				continue
+			}
+
+			slices.Sort(pending)
+			fmt.Fprintf(out, "\n--- %s changed, re-running (%s) ---\n\n", strings.Join(pending, ", "), now.Format(time.TimeOnly))
+			pending = nil
+
+			w.Run()
+			files = w.Files()
+			last = snapshot(files)
+			fmt.Fprintf(out, "\nWatching %d file(s) for changes...\n", len(files))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package watch
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a buffer safe to write from the watcher while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	domain := filepath.Join(dir, "domain.yml")
+	rego := filepath.Join(dir, "main.rego")
+	require.NoError(t, os.WriteFile(domain, []byte("kind: PolicyDomainReference\n"), 0600))
+
+	runs := make(chan struct{}, 10)
+	out := &syncBuffer{}
+	w := &Watcher{
+		Files:    func() []string { return []string{domain, rego} },
+		Run:      func() { runs <- struct{}{} },
+		Interval: 5 * time.Millisecond,
+		Debounce: 50 * time.Millisecond,
+		Out:      out,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Watch(ctx) }()
+
+	waitRun := func() {
+		t.Helper()
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the watcher did not run")
+		}
+	}
+
+	// the first run is immediate
+	waitRun()
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), "Watching 2 file(s)") }, 5*time.Second, 5*time.Millisecond)
+
+	// creating a missing file and changing another in quick succession runs once
+	require.NoError(t, os.WriteFile(rego, []byte("package authz\n"), 0600))
+	require.NoError(t, os.WriteFile(domain, []byte("kind: PolicyDomainReference\nmetadata: {}\n"), 0600))
+	waitRun()
+	assert.Contains(t, out.String(), "changed, re-running")
+	assert.Contains(t, out.String(), domain+", "+rego)
+
+	select {
+	case <-runs:
+		t.Fatal("a burst of changes ran more than once")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// removing a file is a change too
+	require.NoError(t, os.Remove(rego))
+	waitRun()
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watcher did not stop")
+	}
+}
@@ -10,12 +10,26 @@ import (
 	"log"
 	"os"
 
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/analyze"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/audit"
 	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/bundle"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/diff"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/format"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/generate"
 	"github.com/manetu/policyengine/cmd/mpe/subcommands/lint"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/lsp"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/migrate"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/repl"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/replay"
 	"github.com/manetu/policyengine/cmd/mpe/subcommands/serve"
 	"github.com/manetu/policyengine/cmd/mpe/subcommands/test"
 	"github.com/manetu/policyengine/cmd/mpe/version"
 	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/revocation"
+	"github.com/manetu/policyengine/pkg/decisionpoint"
+	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
 	"github.com/urfave/cli/v3"
 )
 
@@ -36,11 +50,36 @@ func main() {
 				Name:  "trace-filter",
 				Usage: "Filter trace output to policies matching these regex patterns (can be specified multiple times). Only effective when --trace is enabled.",
 			},
+			&cli.StringFlag{
+				Name:  "trace-format",
+				Usage: "Set the format of trace output: 'text' as printed by OPA, 'json' for an object per decision with the events of each policy, or 'folded' for the folded stacks of flame graph tools. Only effective when --trace is enabled.",
+				Value: "text",
+			},
+			&cli.StringFlag{
+				Name:  "trace-output",
+				Usage: "Write 'json' or 'folded' trace output to `FILE` rather than stderr",
+			},
 			&cli.BoolFlag{
 				Name:  "pretty-log",
 				Usage: "Enable indented multi-line JSON output for access logs",
 				Value: false,
 			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Usage: "Set the format of access logs: 'json', 'cloudevents' to wrap each record in a CloudEvents envelope, or 'cef' or 'leef' for SIEM products. Takes precedence over the audit.format configuration.",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "Set the log level of each module, e.g. '.:info;accesslog:debug'. Takes precedence over MPE_LOG_LEVEL and the log.level configuration.",
+				Action: func(ctx context.Context, command *cli.Command, s string) error {
+					if err := logging.ValidateLogLevels(s); err != nil {
+						return err
+					}
+					config.Init()
+					config.VConfig.Set(config.LogLevel, s)
+					return logging.UpdateLogLevels(s)
+				},
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -63,7 +102,15 @@ func main() {
 							&cli.StringSliceFlag{
 								Name:    "bundle",
 								Aliases: []string{"b"},
-								Usage:   "Load PolicyDomain bundle from `FILE`.  Can be specified multiple times.",
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
+							},
+							&cli.BoolFlag{
+								Name:  "debug",
+								Usage: "Step through the evaluation of the policies, reading debugger commands from stdin. Stops at the first step unless --break is set.",
+							},
+							&cli.StringSliceFlag{
+								Name:  "break",
+								Usage: "With --debug, stop at `LOCATION`: a policy MRN and line (e.g. mrn:iam:policy:main:12), a line of any policy, or a rule (e.g. allow).  Can be specified multiple times.",
 							},
 						},
 						Action: test.ExecuteDecision,
@@ -81,7 +128,7 @@ func main() {
 							&cli.StringSliceFlag{
 								Name:    "bundle",
 								Aliases: []string{"b"},
-								Usage:   "Load PolicyDomain bundle from `FILE`. Can be specified multiple times.",
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
 							},
 							&cli.StringSliceFlag{
 								Name:  "test",
@@ -102,7 +149,7 @@ func main() {
 							&cli.StringSliceFlag{
 								Name:    "bundle",
 								Aliases: []string{"b"},
-								Usage:   "Load PolicyDomain bundle from `FILE`.  Can be specified multiple times.",
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
 							},
 							&cli.StringFlag{
 								Name:    "name",
@@ -113,6 +160,11 @@ func main() {
 								Name:  "opa-flags",
 								Usage: "Additional flags to pass to Rego mapper execution (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
 							},
+							&cli.StringFlag{
+								Name:  "mapper-output",
+								Usage: "Evaluate the mapper's `NAME` output, data.mapper.NAME, instead of porc, the PORC",
+								Value: "porc",
+							},
 							&cli.BoolFlag{
 								Name:  "no-opa-flags",
 								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
@@ -132,7 +184,7 @@ func main() {
 							&cli.StringSliceFlag{
 								Name:    "bundle",
 								Aliases: []string{"b"},
-								Usage:   "Load PolicyDomain bundle from `FILE`.  Can be specified multiple times.",
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
 							},
 							&cli.StringFlag{
 								Name:    "name",
@@ -143,6 +195,19 @@ func main() {
 								Name:  "opa-flags",
 								Usage: "Additional flags to pass to Rego mapper execution (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
 							},
+							&cli.StringFlag{
+								Name:  "mapper-output",
+								Usage: "Evaluate the mapper's `NAME` output, data.mapper.NAME, as the PORC instead of porc",
+								Value: "porc",
+							},
+							&cli.StringFlag{
+								Name:  "expect",
+								Usage: "Compare the decision, PORC fields, and response headers with the golden `FILE`, exiting non-zero with a report of their differences",
+							},
+							&cli.BoolFlag{
+								Name:  "update-golden",
+								Usage: "Write the outcome to the --expect file instead of comparing it, keeping the PORC fields and headers that it lists",
+							},
 							&cli.BoolFlag{
 								Name:  "no-opa-flags",
 								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
@@ -150,6 +215,202 @@ func main() {
 						},
 						Action: test.ExecuteEnvoy,
 					},
+					{
+						Name:  "scenario",
+						Usage: "Runs a scenario: a sequence of Envoy or PORC requests against its bundles, asserting their decisions, PORCs, and access records",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "file",
+								Aliases:  []string{"f"},
+								Usage:    "Load the scenario from YAML `FILE`",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "opa-flags",
+								Usage: "Additional flags to pass to Rego mapper execution (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+							},
+							&cli.BoolFlag{
+								Name:  "no-opa-flags",
+								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+							},
+						},
+						Action: test.ExecuteScenario,
+					},
+					{
+						Name:  "profile",
+						Usage: "Profiles a single policy, reporting the time and evaluation counts of its expressions to pinpoint hot rules",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:    "bundle",
+								Aliases: []string{"b"},
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
+							},
+							&cli.StringFlag{
+								Name:     "policy",
+								Usage:    "The `MRN` of the policy to profile",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:    "input",
+								Aliases: []string{"i"},
+								Usage:   "Load the PORC the policy evaluates from 'FILE', or use '-' for stdin",
+							},
+							&cli.StringFlag{
+								Name:    "name",
+								Aliases: []string{"n"},
+								Usage:   "Domain name to use when more than one bundle declares the policy",
+							},
+							&cli.IntFlag{
+								Name:  "count",
+								Usage: "Evaluate the policy `N` times for both timing and profiling",
+								Value: 100,
+							},
+							&cli.IntFlag{
+								Name:  "top",
+								Usage: "Report the `N` most expensive lines of the policy, or all with 0",
+								Value: 10,
+							},
+							&cli.StringFlag{
+								Name:  "sort",
+								Usage: "Order lines by 'time', 'evals', or 'redos'",
+								Value: "time",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Report format: 'text' or 'json'",
+								Value:   "text",
+							},
+							&cli.StringFlag{
+								Name:  "opa-flags",
+								Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+							},
+							&cli.BoolFlag{
+								Name:  "no-opa-flags",
+								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+							},
+						},
+						Action: test.ExecuteProfile,
+					},
+				},
+			},
+			{
+				Name:  "generate",
+				Usage: "Generate test inputs",
+				Commands: []*cli.Command{
+					{
+						Name:  "envoy-input",
+						Usage: "Prints the attributes of an Envoy ext_authz check, as a mapper receives them, for 'mpe test mapper' and 'mpe test envoy'",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "method",
+								Usage: "The HTTP `METHOD` of the request",
+								Value: "GET",
+							},
+							&cli.StringFlag{
+								Name:  "path",
+								Usage: "The `PATH` of the request, with its query, if any",
+								Value: "/",
+							},
+							&cli.StringFlag{
+								Name:  "host",
+								Usage: "The `HOST` of the request",
+								Value: "localhost",
+							},
+							&cli.StringFlag{
+								Name:  "scheme",
+								Usage: "The `SCHEME` of the request",
+								Value: "https",
+							},
+							&cli.StringFlag{
+								Name:  "protocol",
+								Usage: "The `PROTOCOL` of the request",
+								Value: "HTTP/1.1",
+							},
+							&cli.StringSliceFlag{
+								Name:    "header",
+								Aliases: []string{"H"},
+								Usage:   "Add the `'NAME: VALUE'` header to the request. Can be specified multiple times.",
+							},
+							&cli.StringFlag{
+								Name:  "jwt",
+								Usage: "Add a bearer token from `FILE`, either a JWT or the JSON object of its claims, which is encoded as an unsigned JWT",
+							},
+							&cli.StringFlag{
+								Name:  "body",
+								Usage: "The `BODY` of the request, as passed with with_request_body",
+							},
+							&cli.StringFlag{
+								Name:  "request-id",
+								Usage: "The `ID` of the request, which is generated by default",
+							},
+							&cli.StringFlag{
+								Name:  "source",
+								Usage: "The `PRINCIPAL` of the downstream peer, such as a SPIFFE ID (default: the URI SAN of --source-cert)",
+							},
+							&cli.StringFlag{
+								Name:  "source-address",
+								Usage: "The `HOST:PORT` of the downstream peer",
+								Value: "10.0.0.2:51234",
+							},
+							&cli.StringFlag{
+								Name:  "source-cert",
+								Usage: "The PEM certificate of the downstream peer in `FILE`, as passed for mTLS connections",
+							},
+							&cli.StringFlag{
+								Name:  "destination",
+								Usage: "The `PRINCIPAL` of the service receiving the request, such as a SPIFFE ID",
+								Value: "spiffe://cluster.local/ns/default/sa/service",
+							},
+							&cli.StringFlag{
+								Name:  "destination-address",
+								Usage: "The `HOST:PORT` of the service receiving the request",
+								Value: "10.0.0.3:8080",
+							},
+							&cli.StringSliceFlag{
+								Name:  "context-extension",
+								Usage: "Add the `KEY=VALUE` context extension of the route. Can be specified multiple times.",
+							},
+							&cli.StringSliceFlag{
+								Name:  "metadata",
+								Usage: "Add the `NAMESPACE=JSON` filter metadata to the metadata context. Can be specified multiple times.",
+							},
+						},
+						Action: generate.ExecuteEnvoyInput,
+					},
+					{
+						Name:  "jwt",
+						Usage: "Prints a JWT with the claims of a file, signed with a private key, for 'mpe generate envoy-input --jwt' and end-to-end tests",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "claims",
+								Aliases:  []string{"c"},
+								Usage:    "Load the claims of the token from YAML or JSON `FILE`",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "sign",
+								Usage: "Sign the token with the PEM private key in `FILE`: RSA, ECDSA, or Ed25519. The token is unsigned if not specified",
+							},
+							&cli.StringFlag{
+								Name:  "alg",
+								Usage: "The signature `ALGORITHM`, such as RS256 or PS256 (default: implied by the type of the key)",
+							},
+							&cli.StringFlag{
+								Name:  "kid",
+								Usage: "The `ID` of the key in the header of the token and the JWKS (default: the thumbprint of the key)",
+							},
+							&cli.StringFlag{
+								Name:  "jwks",
+								Usage: "Write the JSON Web Key Set of the public key to `FILE`, to verify the token",
+							},
+							&cli.DurationFlag{
+								Name:  "expires",
+								Usage: "Set the iat claim to now, and the exp claim to `DURATION` later",
+							},
+						},
+						Action: generate.ExecuteJWT,
+					},
 				},
 			},
 			{
@@ -161,6 +422,26 @@ func main() {
 						Usage: "The TCP port to serve on.",
 						Value: 9000,
 					},
+					&cli.StringFlag{
+						Name:    "listen",
+						Usage:   "Serve on `ADDRESS` instead of --port: 'tcp://HOST:PORT', 'unix:///PATH' for a Unix domain socket, or 'systemd:[NAME]' for a socket passed by systemd socket activation.",
+						Sources: cli.EnvVars("MPE_SERVE_LISTEN"),
+					},
+					&cli.StringFlag{
+						Name:    "admin-listen",
+						Usage:   "Serve the admin API, which changes log levels and Rego tracing at runtime and reports saturation metrics, on `ADDRESS` (same forms as --listen). Disabled by default; keep it off untrusted networks.",
+						Sources: cli.EnvVars("MPE_SERVE_ADMIN_LISTEN"),
+					},
+					&cli.BoolFlag{
+						Name:    "pprof",
+						Usage:   "Serve the Go runtime profiles of net/http/pprof under /debug/pprof/ on the admin API. Requires --admin-listen.",
+						Sources: cli.EnvVars("MPE_SERVE_PPROF"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "endpoint",
+						Usage:   "Serve a decision API on an address, as `PROTOCOL=ADDRESS` where PROTOCOL is 'generic' or 'envoy' and ADDRESS is in any --listen form, e.g. 'envoy=:9001'. Can be specified multiple times to serve several protocols or addresses from one engine; replaces --protocol, --listen, and --port.",
+						Sources: cli.EnvVars("MPE_SERVE_ENDPOINT"),
+					},
 					&cli.StringFlag{
 						Name:    "protocol",
 						Aliases: []string{"p"},
@@ -176,7 +457,7 @@ func main() {
 					&cli.StringSliceFlag{
 						Name:    "bundle",
 						Aliases: []string{"b"},
-						Usage:   "Load PolicyDomain bundle from `FILE`.  Can be specified multiple times.",
+						Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
 					},
 					&cli.StringFlag{
 						Name:    "name",
@@ -191,6 +472,172 @@ func main() {
 						Name:  "no-opa-flags",
 						Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
 					},
+					&cli.BoolFlag{
+						Name:  "envoy-als",
+						Usage: "Accept Envoy Access Log Service (ALS) streams and emit merged audit records correlated by request-id. Only valid with '--protocol envoy' or an envoy --endpoint.",
+					},
+					&cli.DurationFlag{
+						Name:  "envoy-als-ttl",
+						Usage: "How long to hold a decision or ALS entry while waiting for its counterpart before emitting it uncorrelated.",
+						Value: envoy.DefaultCorrelationTTL,
+					},
+					&cli.StringFlag{
+						Name:    "mapper-output",
+						Usage:   "Evaluate the mapper's `NAME` output, data.mapper.NAME, as the PORC of each Envoy check instead of porc. Only valid with '--protocol envoy' or an envoy --endpoint.",
+						Value:   "porc",
+						Sources: cli.EnvVars("MPE_SERVE_MAPPER_OUTPUT"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "mapper-metadata",
+						Usage:   "Add the mapper's `NAME` output to the dynamic metadata of allowed Envoy checks, such as a rate limit key. Can be specified multiple times. Only valid with '--protocol envoy' or an envoy --endpoint.",
+						Sources: cli.EnvVars("MPE_SERVE_MAPPER_METADATA"),
+					},
+					&cli.StringFlag{
+						Name:    "tls-cert",
+						Usage:   "Serve over TLS using the PEM certificate in `FILE`. Requires --tls-key.",
+						Sources: cli.EnvVars("MPE_SERVE_TLS_CERT"),
+					},
+					&cli.StringFlag{
+						Name:    "tls-key",
+						Usage:   "PEM private key `FILE` of the TLS certificate.",
+						Sources: cli.EnvVars("MPE_SERVE_TLS_KEY"),
+					},
+					&cli.StringFlag{
+						Name:    "tls-client-ca",
+						Usage:   "Require client certificates signed by a CA in the PEM bundle `FILE` (mutual TLS).",
+						Sources: cli.EnvVars("MPE_SERVE_TLS_CLIENT_CA"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "tls-client-san",
+						Usage:   "Only accept client certificates with this subject alternative name (DNS name, email, IP, or URI such as a SPIFFE ID). Can be specified multiple times. Requires --tls-client-ca.",
+						Sources: cli.EnvVars("MPE_SERVE_TLS_CLIENT_SAN"),
+					},
+					&cli.DurationFlag{
+						Name:    "tls-reload-interval",
+						Usage:   "How often the TLS files are checked for changes, so that rotated certificates take effect without a restart.",
+						Value:   decisionpoint.DefaultReloadInterval,
+						Sources: cli.EnvVars("MPE_SERVE_TLS_RELOAD_INTERVAL"),
+					},
+					&cli.IntFlag{
+						Name:    "max-concurrent",
+						Usage:   "Evaluate at most `N` decisions at once, queueing or rejecting the excess so that a traffic spike does not inflate latency. Unlimited when 0.",
+						Sources: cli.EnvVars("MPE_SERVE_MAX_CONCURRENT"),
+					},
+					&cli.IntFlag{
+						Name:    "queue-size",
+						Usage:   "How many decision requests may wait for a slot when --max-concurrent are in progress. Requests beyond it are rejected immediately.",
+						Sources: cli.EnvVars("MPE_SERVE_QUEUE_SIZE"),
+					},
+					&cli.DurationFlag{
+						Name:    "queue-timeout",
+						Usage:   "How long a queued decision request waits for a slot before it is rejected.",
+						Value:   decisionpoint.DefaultQueueTimeout,
+						Sources: cli.EnvVars("MPE_SERVE_QUEUE_TIMEOUT"),
+					},
+					&cli.StringFlag{
+						Name:    "overload-action",
+						Usage:   "How rejected requests are answered: 'unavailable' (HTTP 503 or gRPC UNAVAILABLE, leaving the choice to the enforcement point) or 'deny' (fail closed).",
+						Value:   string(decisionpoint.OverloadUnavailable),
+						Sources: cli.EnvVars("MPE_SERVE_OVERLOAD_ACTION"),
+					},
+					&cli.DurationFlag{
+						Name:    "health-interval",
+						Usage:   "How often to check the health of the backend, reporting the server not ready while it fails. Disabled when 0.",
+						Value:   decisionpoint.DefaultHealthInterval,
+						Sources: cli.EnvVars("MPE_SERVE_HEALTH_INTERVAL"),
+					},
+					&cli.DurationFlag{
+						Name:    "health-timeout",
+						Usage:   "How long a backend health check may take before it fails.",
+						Value:   decisionpoint.DefaultHealthTimeout,
+						Sources: cli.EnvVars("MPE_SERVE_HEALTH_TIMEOUT"),
+					},
+					&cli.StringFlag{
+						Name:    "record-fixtures",
+						Usage:   "Record a sample of the decisions, anonymized, as fixtures for 'mpe replay' and 'mpe test decisions' in `DIR`.",
+						Sources: cli.EnvVars("MPE_SERVE_RECORD_FIXTURES"),
+					},
+					&cli.StringFlag{
+						Name:    "sample",
+						Usage:   "The `RATE` of decisions recorded by --record-fixtures, as a percentage such as 0.1% or a fraction such as 0.001.",
+						Value:   "1%",
+						Sources: cli.EnvVars("MPE_SERVE_SAMPLE"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "record-hash",
+						Usage:   "Hash the PORC field at `PATH` in recorded fixtures, such as principal.sub. May be repeated.",
+						Value:   serve.DefaultRecordHash,
+						Sources: cli.EnvVars("MPE_SERVE_RECORD_HASH"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "record-strip",
+						Usage:   "Remove the PORC field at `PATH` from recorded fixtures, such as principal.email. May be repeated.",
+						Sources: cli.EnvVars("MPE_SERVE_RECORD_STRIP"),
+					},
+					&cli.StringFlag{
+						Name:    "record-hash-key",
+						Usage:   "Hash the fields of --record-hash with HMAC-SHA256 using the secret `KEY`.",
+						Sources: cli.EnvVars("MPE_SERVE_RECORD_HASH_KEY"),
+					},
+					&cli.StringFlag{
+						Name:    "rollout-source",
+						Usage:   "Coordinate the bundle revision served with the other replicas through the rollout target at `ADDRESS`: 'file:///PATH' for a JSON file such as a mounted ConfigMap key, or 'etcd://HOST:PORT/KEY' for an etcd key. The {revision} placeholder in --bundle paths is replaced by the revision served.",
+						Sources: cli.EnvVars("MPE_SERVE_ROLLOUT_SOURCE"),
+					},
+					&cli.DurationFlag{
+						Name:    "rollout-interval",
+						Usage:   "How often to fetch the rollout target of --rollout-source.",
+						Value:   decisionpoint.DefaultRolloutInterval,
+						Sources: cli.EnvVars("MPE_SERVE_ROLLOUT_INTERVAL"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "canary-bundle",
+						Usage:   "Roll out the PolicyDomain bundles of `FILE`, a directory, or a glob pattern as a canary, serving a fraction of the decisions.  Can be specified multiple times.",
+						Sources: cli.EnvVars("MPE_SERVE_CANARY_BUNDLE"),
+					},
+					&cli.StringFlag{
+						Name:    "canary-split",
+						Usage:   "The `RATE` of decisions served by --canary-bundle, as a percentage such as 5% or a fraction such as 0.05.",
+						Value:   "0%",
+						Sources: cli.EnvVars("MPE_SERVE_CANARY_SPLIT"),
+					},
+					&cli.StringFlag{
+						Name:    "canary-header",
+						Usage:   "Let requests select the bundles serving them with the request header `NAME`, set to 'canary' or 'stable'.",
+						Sources: cli.EnvVars("MPE_SERVE_CANARY_HEADER"),
+					},
+					&cli.StringFlag{
+						Name:    "canary-rollback",
+						Usage:   "Roll the canary back once the `RATE` of its decisions that differ from the stable bundles exceeds this, such as 1%.",
+						Sources: cli.EnvVars("MPE_SERVE_CANARY_ROLLBACK"),
+					},
+					&cli.IntFlag{
+						Name:    "canary-min-comparisons",
+						Usage:   "Compare `N` canary decisions with the stable bundles before --canary-rollback applies.",
+						Value:   decisionpoint.DefaultCanaryMinComparisons,
+						Sources: cli.EnvVars("MPE_SERVE_CANARY_MIN_COMPARISONS"),
+					},
+					&cli.StringFlag{
+						Name:    "revocation-url",
+						Usage:   "Deny tokens and sessions revoked in the revocation list whose bloom filter is served at `URL`.",
+						Sources: cli.EnvVars("MPE_SERVE_REVOCATION_URL"),
+					},
+					&cli.StringFlag{
+						Name:    "revocation-token",
+						Usage:   "Send `TOKEN` as a bearer token when fetching --revocation-url.",
+						Sources: cli.EnvVars("MPE_SERVE_REVOCATION_TOKEN"),
+					},
+					&cli.DurationFlag{
+						Name:    "revocation-interval",
+						Usage:   "How often to fetch --revocation-url.",
+						Value:   revocation.DefaultSyncInterval,
+						Sources: cli.EnvVars("MPE_SERVE_REVOCATION_INTERVAL"),
+					},
+					&cli.DurationFlag{
+						Name:    "revocation-max-age",
+						Usage:   "Deny every token once --revocation-url could not be fetched for this long. Disabled when 0.",
+						Sources: cli.EnvVars("MPE_SERVE_REVOCATION_MAX_AGE"),
+					},
 				},
 				Action: serve.Execute,
 			},
@@ -216,9 +663,342 @@ func main() {
 						Name:  "regal",
 						Usage: "Run Regal linting instead of standard validation. Uses the bundled Regal library to check embedded Rego code against Regal's rule set.",
 					},
+					&cli.StringFlag{
+						Name:  "capabilities",
+						Usage: "OPA capabilities JSON file declaring custom built-in functions registered by the embedding application. Calls to the declared built-ins are accepted and type-checked.",
+					},
+					&cli.BoolFlag{
+						Name:  "watch",
+						Usage: "Lint again each time a file, or a .rego or data file a PolicyDomainReference references, changes, until interrupted.",
+					},
 				},
 				Action: lint.Execute,
 			},
+			{
+				Name:  "lsp",
+				Usage: "Run a language server for PolicyDomain YAML over stdin/stdout, for editor integration",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "opa-flags",
+						Usage: "Additional flags to pass to 'opa check' command (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+					},
+					&cli.BoolFlag{
+						Name:  "no-opa-flags",
+						Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+					},
+					&cli.StringFlag{
+						Name:  "capabilities",
+						Usage: "OPA capabilities JSON file declaring custom built-in functions registered by the embedding application.",
+					},
+				},
+				Action: lsp.Execute,
+			},
+			{
+				Name:  "fmt",
+				Usage: "Format PolicyDomain YAML files in canonical form",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "PolicyDomain YAML file, directory, or glob pattern to format. Files are rewritten in place. Can be specified multiple times.",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "check",
+						Usage: "Report files that are not formatted without modifying them, exiting with an error if any are found. Useful in CI.",
+					},
+					&cli.StringFlag{
+						Name:  "opa-flags",
+						Usage: "OPA flags selecting the Rego version of embedded policies (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+					},
+					&cli.BoolFlag{
+						Name:  "no-opa-flags",
+						Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+					},
+				},
+				Action: format.Execute,
+			},
+			{
+				Name:      "diff",
+				Usage:     "Show the semantic differences between two versions of PolicyDomain bundles",
+				ArgsUsage: "<old> <new>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "input",
+						Aliases: []string{"i"},
+						Usage:   "Decision test suite (as used by 'mpe test decisions') to evaluate against both versions, reporting decisions that changed",
+					},
+					&cli.StringFlag{
+						Name:  "opa-flags",
+						Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+					},
+					&cli.BoolFlag{
+						Name:  "no-opa-flags",
+						Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+					},
+				},
+				Action: diff.Execute,
+			},
+			{
+				Name:  "replay",
+				Usage: "Re-evaluate the PORC of recorded AccessRecords against PolicyDomain bundles and report decisions that changed",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "records",
+						Aliases:  []string{"r"},
+						Usage:    "Load AccessRecords from `FILE`, as a JSON array or a stream of JSON objects such as the stdout access log, or use '-' for stdin",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:    "bundle",
+						Aliases: []string{"b"},
+						Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
+					},
+					&cli.BoolFlag{
+						Name:  "resolve-resources",
+						Usage: "Resolve each record's resource MRN with the bundles, instead of reusing the resource recorded in the PORC",
+					},
+					&cli.BoolFlag{
+						Name:  "fail-on-drift",
+						Usage: "Exit with an error if any decision changed. Useful in CI.",
+					},
+					&cli.StringFlag{
+						Name:  "opa-flags",
+						Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+					},
+					&cli.BoolFlag{
+						Name:  "no-opa-flags",
+						Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+					},
+				},
+				Action: replay.Execute,
+			},
+			{
+				Name:  "audit",
+				Usage: "Inspect the decisions kept in an access record journal",
+				Commands: []*cli.Command{
+					{
+						Name:  "query",
+						Usage: "Print the access records of a journal matching a set of filters, oldest first",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "journal",
+								Aliases: []string{"j"},
+								Usage:   "Read the journal in `FILE` (default: the audit.journal.path configuration)",
+							},
+							&cli.StringFlag{
+								Name:  "since",
+								Usage: "Select records from `TIME`, a duration before now such as 1h or an RFC 3339 time",
+							},
+							&cli.StringFlag{
+								Name:  "until",
+								Usage: "Select records before `TIME`, a duration before now such as 10m or an RFC 3339 time",
+							},
+							&cli.StringSliceFlag{
+								Name:  "decision",
+								Usage: "Select records with `DECISION`, GRANT or DENY. Can be specified multiple times.",
+							},
+							&cli.StringFlag{
+								Name:  "principal",
+								Usage: "Select records whose principal's subject matches `PATTERN`, such as 'alice' or 'svc-*'",
+							},
+							&cli.StringFlag{
+								Name:  "operation",
+								Usage: "Select records whose operation matches `PATTERN`, such as 'api:documents:*'",
+							},
+							&cli.StringFlag{
+								Name:  "resource",
+								Usage: "Select records whose resource matches `PATTERN`",
+							},
+							&cli.IntFlag{
+								Name:    "limit",
+								Aliases: []string{"n"},
+								Usage:   "Print only the `N` most recent records selected (0 prints every one)",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Set the output format: 'text' for a table, or 'json' for an AccessRecord per line, as read by 'mpe replay'",
+								Value:   "text",
+							},
+						},
+						Action: audit.ExecuteQuery,
+					},
+				},
+			},
+			{
+				Name:  "repl",
+				Usage: "Interactively edit a PORC and inspect the decision, phase outcomes, merged annotations, and OPA trace",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "bundle",
+						Aliases:  []string{"b"},
+						Usage:    "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "input",
+						Aliases: []string{"i"},
+						Usage:   "Load the initial PORC from a JSON `FILE`",
+					},
+					&cli.StringFlag{
+						Name:  "opa-flags",
+						Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+					},
+					&cli.BoolFlag{
+						Name:  "no-opa-flags",
+						Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+					},
+				},
+				Action: repl.Execute,
+			},
+			{
+				Name:  "analyze",
+				Usage: "Analyze the decisions PolicyDomain bundles would make",
+				Commands: []*cli.Command{
+					{
+						Name:  "access",
+						Usage: "Report the roles, groups, and scopes whose holders would be granted an operation on a resource, for audits and access certification",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:    "bundle",
+								Aliases: []string{"b"},
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
+							},
+							&cli.StringFlag{
+								Name:     "resource",
+								Aliases:  []string{"r"},
+								Usage:    "The `MRN` of the resource to analyze, resolved with the bundles",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "operation",
+								Usage:    "The `OPERATION` to analyze, e.g. api:documents:read",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "principal",
+								Usage: "Claims, as a `JSON` object, given to every principal analyzed, e.g. '{\"sub\": \"auditor\", \"mclearance\": \"HIGH\"}'",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Report format: 'text' or 'json'",
+								Value:   "text",
+							},
+							&cli.StringFlag{
+								Name:  "opa-flags",
+								Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+							},
+							&cli.BoolFlag{
+								Name:  "no-opa-flags",
+								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+							},
+						},
+						Action: analyze.ExecuteAccess,
+					},
+					{
+						Name:  "impact",
+						Usage: "Classify the changes between two versions of PolicyDomain bundles by blast radius, and report the fixtures whose decision flips",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:     "base",
+								Usage:    "Load the base PolicyDomain bundles from `FILE`, a directory, or a glob pattern.  Can be specified multiple times.",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:     "head",
+								Usage:    "Load the head PolicyDomain bundles from `FILE`, a directory, or a glob pattern.  Can be specified multiple times.",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:  "fixtures",
+								Usage: "Load fixtures from `PATH`, a PORC or decision test suite file, or a directory searched for them.  Can be specified multiple times.",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Report format: 'markdown', for pull request comments, 'text', or 'json'",
+								Value:   "markdown",
+							},
+							&cli.BoolFlag{
+								Name:  "fail-on-flip",
+								Usage: "Exit with an error if any fixture's decision flipped. Useful in CI.",
+							},
+							&cli.StringFlag{
+								Name:  "opa-flags",
+								Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+							},
+							&cli.BoolFlag{
+								Name:  "no-opa-flags",
+								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+							},
+						},
+						Action: analyze.ExecuteImpact,
+					},
+					{
+						Name:  "selectors",
+						Usage: "Report how often each operation selector routed the operations of a corpus, to find dead selectors and mistyped patterns",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:    "bundle",
+								Aliases: []string{"b"},
+								Usage:   "Load PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times.",
+							},
+							&cli.StringSliceFlag{
+								Name:  "operations",
+								Usage: "Load operations from `FILE`, one per line or as access records in JSON lines, or use '-' for stdin.  Can be specified multiple times.",
+							},
+							&cli.StringSliceFlag{
+								Name:  "fixtures",
+								Usage: "Load the operations of fixtures from `PATH`, a PORC or decision test suite file, or a directory searched for them.  Can be specified multiple times.",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Report format: 'text' or 'json'",
+								Value:   "text",
+							},
+							&cli.BoolFlag{
+								Name:  "fail-on-unused",
+								Usage: "Exit with an error if any selector routed no operation. Useful in CI.",
+							},
+							&cli.StringFlag{
+								Name:  "opa-flags",
+								Usage: "Additional flags for OPA (default: --v0-compatible). Can also be set via MPE_CLI_OPA_FLAGS environment variable.",
+							},
+							&cli.BoolFlag{
+								Name:  "no-opa-flags",
+								Usage: "Disable all OPA flags (overrides --opa-flags and MPE_CLI_OPA_FLAGS).",
+							},
+						},
+						Action: analyze.ExecuteSelectors,
+					},
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Migrate PolicyDomain YAML files to a newer apiVersion",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "PolicyDomain YAML file, directory, or glob pattern to migrate. Files are rewritten in place unless --output is given. Can be specified multiple times.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Target apiVersion (v1alpha4 or v1beta1)",
+						Value: "v1beta1",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output file path (only valid when migrating a single file)",
+					},
+				},
+				Action: migrate.Execute,
+			},
 			{
 				Name:  "build",
 				Usage: "Build PolicyDomain YAML from PolicyDomainReference (with external .rego files)",
@@ -232,11 +1012,68 @@ func main() {
 					&cli.StringFlag{
 						Name:    "output",
 						Aliases: []string{"o"},
-						Usage:   "Output file path (only valid when building a single file). If not specified, generates '<input>-built.yml'",
+						Usage:   "Output file path (only valid when building a single file). If not specified, generates '<input>-built.yml'. With --embed, the output directory (default 'decisiond')",
+					},
+					&cli.BoolFlag{
+						Name:  "embed",
+						Usage: "Generate a Go main package that embeds the built bundles and serves them, for shipping policies as a single self-contained binary",
+					},
+					&cli.StringFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Default domain name for the embedded server when multiple bundles are provided (only valid with --embed)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "values",
+						Usage: "Render the files as Go templates with the values of YAML `FILE`.  Can be specified multiple times, later files taking precedence.",
+					},
+					&cli.StringSliceFlag{
+						Name:  "set",
+						Usage: "Render the files as Go templates with `KEY=VALUE`, where a dotted key sets a nested value, overriding --values.  Can be specified multiple times.",
+					},
+					&cli.BoolFlag{
+						Name:  "watch",
+						Usage: "Build again each time a file, a file it includes, a .rego or data file it references, or a values file changes, until interrupted.",
 					},
 				},
 				Action: build.Execute,
 			},
+			{
+				Name:      "push",
+				Usage:     "Publish PolicyDomain bundles to an OCI registry as a single artifact",
+				ArgsUsage: "oci://<registry>/<repository>:<tag>",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "bundle",
+						Aliases:  []string{"b"},
+						Usage:    "Push PolicyDomain bundles from `FILE`, a directory, or a glob pattern (e.g. policies/**/*.yml).  Can be specified multiple times, in order of precedence.",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "plain-http",
+						Usage: "Contact the registry over HTTP instead of HTTPS",
+					},
+				},
+				Action: bundle.ExecutePush,
+			},
+			{
+				Name:      "pull",
+				Usage:     "Fetch PolicyDomain bundles published with 'mpe push' from an OCI registry",
+				ArgsUsage: "oci://<registry>/<repository>:<tag>|@<digest>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Directory to write the bundles to",
+						Value:   ".",
+					},
+					&cli.BoolFlag{
+						Name:  "plain-http",
+						Usage: "Contact the registry over HTTP instead of HTTPS",
+					},
+				},
+				Action: bundle.ExecutePull,
+			},
 			{
 				Name:  "version",
 				Usage: "Print the version of mpe",
@@ -0,0 +1,228 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package analyze implements offline analyses of PolicyDomain bundles, answering questions
+// about the decisions the declared policies would make without recording any of them.
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/urfave/cli/v3"
+)
+
+// Kinds of the entities that may be granted access
+const (
+	KindRole  = "role"
+	KindGroup = "group"
+	KindScope = "scope"
+)
+
+// Grant is an entity whose holders would be granted the operation on the resource
+type Grant struct {
+	Kind    string   `json:"kind"`
+	Mrn     string   `json:"mrn"`
+	Domains []string `json:"domains"`
+}
+
+// Report is the outcome of an access analysis
+type Report struct {
+	Resource  string  `json:"resource"`
+	Operation string  `json:"operation"`
+	Grants    []Grant `json:"grants"`
+
+	// Roles, Groups, and Scopes count the entities analyzed
+	Roles  int `json:"roles"`
+	Groups int `json:"groups"`
+	Scopes int `json:"scopes"`
+}
+
+// ExecuteAccess runs the access analysis, reporting the roles, groups, and scopes declared in
+// the bundles whose holders would be granted the operation on the resource.
+func ExecuteAccess(ctx context.Context, cmd *cli.Command) error {
+	bundles, domains, err := loadBundles(cmd.StringSlice("bundle"))
+	if err != nil {
+		return err
+	}
+
+	format := cmd.String("output")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s': must be 'text' or 'json'", format)
+	}
+
+	claims := map[string]interface{}{}
+	if principal := cmd.String("principal"); principal != "" {
+		if err := json.Unmarshal([]byte(principal), &claims); err != nil {
+			return fmt.Errorf("invalid --principal: %w", err)
+		}
+	}
+
+	pe, err := common.NewBundlePolicyEngine(cmd, bundles, accesslog.NewNullFactory())
+	if err != nil {
+		return fmt.Errorf("failed to load bundles: %w", err)
+	}
+
+	report, err := Access(ctx, pe, domains, claims, cmd.String("resource"), cmd.String("operation"))
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	printReport(report)
+	return nil
+}
+
+// Access decides the operation on the resource for a principal holding each role, each group,
+// and each scope declared in the domains, and returns those that would be granted.
+//
+// The principal carries the given claims and the entity analyzed, and nothing else. A scope
+// only restricts what the principal's roles grant, so each scope is analyzed for a principal
+// holding every role found to grant access; when no role does, no scope can either.
+func Access(ctx context.Context, pe core.PolicyEngine, domains registry.DomainMap, claims map[string]interface{}, resource, operation string) (*Report, error) {
+	roles := declared(domains, func(d *policydomain.IntermediateModel) []string { return slices.Collect(maps.Keys(d.Roles)) })
+	groups := declared(domains, func(d *policydomain.IntermediateModel) []string { return slices.Collect(maps.Keys(d.Groups)) })
+	scopes := declared(domains, func(d *policydomain.IntermediateModel) []string { return slices.Collect(maps.Keys(d.Scopes)) })
+
+	report := &Report{
+		Resource:  resource,
+		Operation: operation,
+		Grants:    []Grant{},
+		Roles:     len(roles),
+		Groups:    len(groups),
+		Scopes:    len(scopes),
+	}
+
+	decide := func(attributes map[string]interface{}) (bool, error) {
+		principal := maps.Clone(claims)
+		maps.Copy(principal, attributes)
+		return pe.Authorize(ctx, map[string]interface{}{
+			"principal": principal,
+			"operation": operation,
+			"resource":  resource,
+		}, options.SetProbeMode(true))
+	}
+
+	analyze := func(kind string, entities []entity, attributes func(mrn string) map[string]interface{}) error {
+		for _, e := range entities {
+			allowed, err := decide(attributes(e.mrn))
+			if err != nil {
+				return fmt.Errorf("failed to analyze %s '%s': %w", kind, e.mrn, err)
+			}
+			if allowed {
+				report.Grants = append(report.Grants, Grant{Kind: kind, Mrn: e.mrn, Domains: e.domains})
+			}
+		}
+		return nil
+	}
+
+	if err := analyze(KindRole, roles, func(mrn string) map[string]interface{} {
+		return map[string]interface{}{"mroles": []string{mrn}}
+	}); err != nil {
+		return nil, err
+	}
+
+	var granting []string
+	for _, g := range report.Grants {
+		granting = append(granting, g.Mrn)
+	}
+
+	if err := analyze(KindGroup, groups, func(mrn string) map[string]interface{} {
+		return map[string]interface{}{"mgroups": []string{mrn}}
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(granting) > 0 {
+		if err := analyze(KindScope, scopes, func(mrn string) map[string]interface{} {
+			return map[string]interface{}{"mroles": granting, "scopes": []string{mrn}}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// loadBundles expands bundle paths, builds any PolicyDomainReference files they contain, and
+// loads the domains of the bundles
+func loadBundles(paths []string) ([]string, registry.DomainMap, error) {
+	bundles, err := registry.ExpandPaths(paths, registry.KindPolicyDomain, build.KindPolicyDomainReference)
+	if err != nil {
+		return nil, nil, err
+	}
+	bundles, err = common.AutoBuildReferenceFiles(bundles)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, nil, fmt.Errorf("at least one bundle must be specified")
+	}
+
+	reg, err := registry.NewRegistry(bundles)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load bundles: %w", err)
+	}
+	return bundles, reg.GetDomains(), nil
+}
+
+// entity is an MRN and the domains declaring it
+type entity struct {
+	mrn     string
+	domains []string
+}
+
+// declared returns, sorted by MRN, the entities that list returns for each domain
+func declared(domains registry.DomainMap, list func(*policydomain.IntermediateModel) []string) []entity {
+	found := map[string][]string{}
+	for _, name := range slices.Sorted(maps.Keys(domains)) {
+		for _, mrn := range list(domains[name]) {
+			found[mrn] = append(found[mrn], name)
+		}
+	}
+
+	entities := make([]entity, 0, len(found))
+	for _, mrn := range slices.Sorted(maps.Keys(found)) {
+		entities = append(entities, entity{mrn: mrn, domains: found[mrn]})
+	}
+	return entities
+}
+
+func printReport(report *Report) {
+	fmt.Printf("Granted '%s' on '%s':\n", report.Operation, report.Resource)
+	for _, g := range report.Grants {
+		fmt.Printf("  %-5s %s (domain '%s')\n", g.Kind, g.Mrn, strings.Join(g.Domains, "', '"))
+	}
+
+	counts := map[string]int{}
+	for _, g := range report.Grants {
+		counts[g.Kind]++
+	}
+
+	fmt.Println("---")
+	fmt.Printf("%d of %d role(s), %d of %d group(s), %d of %d scope(s) grant access\n",
+		counts[KindRole], report.Roles, counts[KindGroup], report.Groups, counts[KindScope], report.Scopes)
+	if counts[KindRole] == 0 && report.Scopes > 0 {
+		fmt.Println("No role grants access, so no scope was analyzed")
+	}
+}
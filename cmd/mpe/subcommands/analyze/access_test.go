@@ -0,0 +1,133 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func runAccess(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "access",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "bundle", Aliases: []string{"b"}},
+			&cli.StringFlag{Name: "resource", Aliases: []string{"r"}},
+			&cli.StringFlag{Name: "operation"},
+			&cli.StringFlag{Name: "principal"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: "text"},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+		},
+		Action: ExecuteAccess,
+	}
+	root := &cli.Command{
+		Name:     "mpe",
+		Flags:    []cli.Flag{&cli.BoolFlag{Name: "trace"}, &cli.StringSliceFlag{Name: "trace-filter"}},
+		Commands: []*cli.Command{{Name: "analyze", Commands: []*cli.Command{cmd}}},
+	}
+	return root.Run(ctx, append([]string{"mpe", "analyze", "access"}, args...))
+}
+
+func analyzeJSON(t *testing.T, args ...string) *Report {
+	t.Helper()
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runAccess(context.Background(), append(args, "-o", "json")...)
+	})
+	require.NoError(t, err)
+
+	var report Report
+	require.NoError(t, json.Unmarshal([]byte(out), &report))
+	return &report
+}
+
+func TestExecuteAccess(t *testing.T) {
+	consolidated := []string{"consolidated"}
+
+	for _, tc := range []struct {
+		operation string
+		grants    []Grant
+	}{
+		// the read-only scope grants *:get, but not *:delete
+		{"vault:document:get", []Grant{
+			{Kind: KindRole, Mrn: "mrn:iam:role:admin", Domains: consolidated},
+			{Kind: KindGroup, Mrn: "mrn:iam:group:admin", Domains: consolidated},
+			{Kind: KindScope, Mrn: "mrn:iam:scope:api", Domains: consolidated},
+			{Kind: KindScope, Mrn: "mrn:iam:scope:read-api", Domains: consolidated},
+		}},
+		{"vault:document:delete", []Grant{
+			{Kind: KindRole, Mrn: "mrn:iam:role:admin", Domains: consolidated},
+			{Kind: KindGroup, Mrn: "mrn:iam:group:admin", Domains: consolidated},
+			{Kind: KindScope, Mrn: "mrn:iam:scope:api", Domains: consolidated},
+		}},
+	} {
+		t.Run(tc.operation, func(t *testing.T) {
+			report := analyzeJSON(t, "-b", clitest.TestData("consolidated.yml"), "-r", "mrn:app:document:1", "--operation", tc.operation)
+			assert.Equal(t, tc.operation, report.Operation)
+			assert.Equal(t, tc.grants, report.Grants)
+			assert.Equal(t, 2, report.Roles)
+			assert.Equal(t, 1, report.Groups)
+			assert.Equal(t, 2, report.Scopes)
+		})
+	}
+}
+
+func TestExecuteAccess_Text(t *testing.T) {
+	out, err := clitest.CaptureStdout(func() error {
+		return runAccess(context.Background(), "-b", clitest.TestData("consolidated.yml"), "-r", "mrn:app:document:1", "--operation", "vault:document:delete")
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "Granted 'vault:document:delete' on 'mrn:app:document:1':")
+	assert.Contains(t, out, "  role  mrn:iam:role:admin (domain 'consolidated')")
+	assert.Contains(t, out, "  group mrn:iam:group:admin (domain 'consolidated')")
+	assert.Contains(t, out, "1 of 2 role(s), 1 of 1 group(s), 1 of 2 scope(s) grant access")
+}
+
+func TestExecuteAccess_Principal(t *testing.T) {
+	// the claims are given to every principal analyzed
+	const resource = "mrn:app:document:1"
+	report := analyzeJSON(t, "-b", clitest.TestData("consolidated.yml"), "-r", resource, "--operation", "vault:document:get",
+		"--principal", `{"sub": "auditor"}`)
+	assert.Len(t, report.Grants, 4)
+
+	err := runAccess(context.Background(), "-b", clitest.TestData("consolidated.yml"), "-r", resource, "--operation", "vault:document:get",
+		"--principal", `["auditor"]`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid --principal")
+}
+
+func TestExecuteAccess_NoRoleGrants(t *testing.T) {
+	bundle := clitest.WriteModified(t, "consolidated.yml",
+		"policy: *allow-all\n      annotations:\n        - name: foo",
+		"policy: *no-access\n      annotations:\n        - name: foo")
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runAccess(context.Background(), "-b", bundle, "-r", "mrn:app:document:1", "--operation", "vault:document:get")
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "0 of 2 role(s), 0 of 1 group(s), 0 of 2 scope(s) grant access")
+	assert.Contains(t, out, "No role grants access, so no scope was analyzed")
+}
+
+func TestExecuteAccess_Errors(t *testing.T) {
+	err := runAccess(context.Background(), "-r", "mrn:app:document:1", "--operation", "vault:document:get")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "at least one bundle must be specified")
+
+	err = runAccess(context.Background(), "-b", clitest.TestData("consolidated.yml"), "-r", "mrn:app:document:1", "--operation", "vault:document:get", "-o", "yaml")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported output format 'yaml'")
+
+	err = runAccess(context.Background(), "-b", filepath.Join(t.TempDir(), "missing.yml"), "-r", "mrn:app:document:1", "--operation", "vault:document:get")
+	require.Error(t, err)
+}
@@ -0,0 +1,311 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/test"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	pdiff "github.com/manetu/policyengine/pkg/policydomain/diff"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is a PORC whose decision is compared between the base and head bundles
+type Fixture struct {
+	Name string
+	PORC map[string]interface{}
+}
+
+// Flip is a fixture whose decision differs between the base and head bundles
+type Flip struct {
+	Fixture string `json:"fixture"`
+	Base    string `json:"base"`
+	Head    string `json:"head"`
+}
+
+// ImpactReport is the outcome of an impact analysis
+type ImpactReport struct {
+	Changes  []pdiff.Impact `json:"changes"`
+	Fixtures int            `json:"fixtures"`
+	Flips    []Flip         `json:"flips"`
+}
+
+// ExecuteImpact runs the impact analysis, classifying each change from the base to the head
+// bundles by its blast radius, and reporting the fixtures whose decision flips.
+func ExecuteImpact(ctx context.Context, cmd *cli.Command) error {
+	format := cmd.String("output")
+	if format != "markdown" && format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s': must be 'markdown', 'text', or 'json'", format)
+	}
+
+	baseBundles, baseDomains, err := loadBundles(cmd.StringSlice("base"))
+	if err != nil {
+		return fmt.Errorf("base: %w", err)
+	}
+	headBundles, headDomains, err := loadBundles(cmd.StringSlice("head"))
+	if err != nil {
+		return fmt.Errorf("head: %w", err)
+	}
+
+	report := &ImpactReport{
+		Changes: pdiff.Assess(pdiff.Compare(baseDomains, headDomains), baseDomains, headDomains),
+		Flips:   []Flip{},
+	}
+
+	failed := 0
+	if paths := cmd.StringSlice("fixtures"); len(paths) > 0 {
+		fixtures, err := LoadFixtures(paths)
+		if err != nil {
+			return err
+		}
+		if len(fixtures) == 0 {
+			return fmt.Errorf("no fixtures found")
+		}
+
+		base, err := common.NewBundlePolicyEngine(cmd, baseBundles, accesslog.NewNullFactory())
+		if err != nil {
+			return fmt.Errorf("failed to load base bundles: %w", err)
+		}
+		head, err := common.NewBundlePolicyEngine(cmd, headBundles, accesslog.NewNullFactory())
+		if err != nil {
+			return fmt.Errorf("failed to load head bundles: %w", err)
+		}
+
+		report.Fixtures = len(fixtures)
+		for _, f := range fixtures {
+			flip, err := compareFixture(ctx, base, head, f)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: ERROR (%v)\n", f.Name, err)
+				failed++
+				continue
+			}
+			if flip != nil {
+				report.Flips = append(report.Flips, *flip)
+			}
+		}
+	}
+
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case "text":
+		printImpactText(report)
+	default:
+		printImpactMarkdown(report)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to evaluate %d fixture(s)", failed)
+	}
+	if len(report.Flips) > 0 && cmd.Bool("fail-on-flip") {
+		return fmt.Errorf("%d decision(s) flipped", len(report.Flips))
+	}
+	return nil
+}
+
+// compareFixture decides a fixture with both engines, returning the flip if the decisions differ
+func compareFixture(ctx context.Context, base, head core.PolicyEngine, f Fixture) (*Flip, error) {
+	// each engine decides its own copy of the PORC, since deciding a map records the principal's
+	// annotations in it
+	porc, err := json.Marshal(f.PORC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal PORC: %w", err)
+	}
+
+	before, err := base.Authorize(ctx, string(porc))
+	if err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+	after, err := head.Authorize(ctx, string(porc))
+	if err != nil {
+		return nil, fmt.Errorf("head: %w", err)
+	}
+
+	if before == after {
+		return nil, nil
+	}
+	return &Flip{Fixture: f.Name, Base: decision(before), Head: decision(after)}, nil
+}
+
+// LoadFixtures reads the fixtures in files and directories, searched recursively for JSON and
+// YAML files. Each file holds a PORC, named after the file, or a decision test suite, as used by
+// 'mpe test decisions', whose tests are named after the file and the test.
+func LoadFixtures(paths []string) ([]Fixture, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixtures: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(d.Name(), ".") && p != path {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() && slices.Contains([]string{".json", ".yaml", ".yml"}, strings.ToLower(filepath.Ext(p))) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixtures: %w", err)
+		}
+	}
+
+	var fixtures []Fixture
+	for _, file := range files {
+		loaded, err := loadFixtureFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load fixture '%s': %w", file, err)
+		}
+		fixtures = append(fixtures, loaded...)
+	}
+	return fixtures, nil
+}
+
+func loadFixtureFile(file string) ([]Fixture, error) {
+	data, err := os.ReadFile(file) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	if _, ok := doc["tests"]; ok {
+		suite, err := test.LoadTestSuite(file)
+		if err != nil {
+			return nil, err
+		}
+		fixtures := make([]Fixture, 0, len(suite.Tests))
+		for _, tc := range suite.Tests {
+			fixtures = append(fixtures, Fixture{Name: file + ":" + tc.Name, PORC: tc.PORC})
+		}
+		return fixtures, nil
+	}
+
+	if _, ok := doc["operation"]; !ok {
+		return nil, fmt.Errorf("neither a PORC nor a decision test suite")
+	}
+	return []Fixture{{Name: file, PORC: doc}}, nil
+}
+
+// changeSymbols prefix changes as 'mpe diff' does
+var changeSymbols = map[pdiff.ChangeType]string{pdiff.Added: "+", pdiff.Removed: "-", pdiff.Modified: "~"}
+
+// affected describes the operations or roles an impact reaches
+func affected(all bool, items []string, quote string) string {
+	switch {
+	case all:
+		return "all"
+	case len(items) == 0:
+		return "none"
+	}
+
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = quote + item + quote
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// summary counts the changes of each radius, widest first
+func summary(report *ImpactReport) string {
+	counts := map[pdiff.Radius]int{}
+	for _, c := range report.Changes {
+		counts[c.Radius]++
+	}
+
+	var parts []string
+	for _, r := range []pdiff.Radius{pdiff.RadiusHigh, pdiff.RadiusMedium, pdiff.RadiusLow, pdiff.RadiusNone} {
+		if counts[r] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[r], r))
+		}
+	}
+
+	s := fmt.Sprintf("%d change(s)", len(report.Changes))
+	if len(parts) > 0 {
+		s += " (" + strings.Join(parts, ", ") + ")"
+	}
+	if report.Fixtures > 0 {
+		s += fmt.Sprintf(", %d of %d fixture decision(s) flipped", len(report.Flips), report.Fixtures)
+	}
+	return s
+}
+
+func printImpactText(report *ImpactReport) {
+	for _, c := range report.Changes {
+		fmt.Printf("%-6s %s %s '%s' (domain '%s'): operations %s; roles %s\n", c.Radius, changeSymbols[c.Type], c.Kind, c.ID, c.Domain,
+			affected(c.AllOperations, c.Operations, "'"), affected(c.AllRoles, c.Roles, "'"))
+	}
+	for _, f := range report.Flips {
+		fmt.Printf("%s: %s → %s\n", f.Fixture, f.Base, f.Head)
+	}
+
+	fmt.Println("---")
+	fmt.Println(summary(report))
+}
+
+// printImpactMarkdown prints the report as GitHub-flavored Markdown, for a pull request comment
+func printImpactMarkdown(report *ImpactReport) {
+	fmt.Println("### Policy impact")
+	fmt.Println()
+	fmt.Println(summary(report))
+
+	if len(report.Changes) > 0 {
+		fmt.Println()
+		fmt.Println("| Radius | Change | Domain | Operations | Roles |")
+		fmt.Println("|--------|--------|--------|------------|-------|")
+		for _, c := range report.Changes {
+			fmt.Printf("| %s | %s %s `%s` | %s | %s | %s |\n", c.Radius, changeSymbols[c.Type], c.Kind, c.ID, c.Domain,
+				affected(c.AllOperations, c.Operations, "`"), affected(c.AllRoles, c.Roles, "`"))
+		}
+	}
+
+	if len(report.Flips) > 0 {
+		fmt.Println()
+		fmt.Println("#### Decision flips")
+		fmt.Println()
+		fmt.Println("| Fixture | Base | Head |")
+		fmt.Println("|---------|------|------|")
+		for _, f := range report.Flips {
+			fmt.Printf("| `%s` | %s | %s |\n", f.Fixture, f.Base, f.Head)
+		}
+	}
+}
+
+func decision(allow bool) string {
+	if allow {
+		return "GRANT"
+	}
+	return "DENY"
+}
@@ -0,0 +1,149 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	pdiff "github.com/manetu/policyengine/pkg/policydomain/diff"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func runImpact(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "impact",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "base"},
+			&cli.StringSliceFlag{Name: "head"},
+			&cli.StringSliceFlag{Name: "fixtures"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: "markdown"},
+			&cli.BoolFlag{Name: "fail-on-flip"},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+		},
+		Action: ExecuteImpact,
+	}
+	root := &cli.Command{
+		Name:     "mpe",
+		Flags:    []cli.Flag{&cli.BoolFlag{Name: "trace"}, &cli.StringSliceFlag{Name: "trace-filter"}},
+		Commands: []*cli.Command{{Name: "analyze", Commands: []*cli.Command{cmd}}},
+	}
+	return root.Run(ctx, append([]string{"mpe", "analyze", "impact"}, args...))
+}
+
+// fixtures returns a directory holding a decision test suite and a PORC
+func fixtures(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range []string{"example-decision-tests.yaml", "example-porc-input.json"} {
+		clitest.CopyTestData(t, dir, name)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a fixture"), 0600))
+	return dir
+}
+
+// adminDenied revokes the admin role's access
+func adminDenied(t *testing.T) string {
+	return clitest.WriteModified(t, "consolidated.yml",
+		"policy: *allow-all\n      annotations:\n        - name: foo",
+		"policy: *no-access\n      annotations:\n        - name: foo")
+}
+
+func TestExecuteImpact_JSON(t *testing.T) {
+	dir := fixtures(t)
+	out, err := clitest.CaptureStdout(func() error {
+		return runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", adminDenied(t), "--fixtures", dir, "-o", "json")
+	})
+	require.NoError(t, err)
+
+	var report ImpactReport
+	require.NoError(t, json.Unmarshal([]byte(out), &report))
+
+	require.Len(t, report.Changes, 1)
+	assert.Equal(t, "mrn:iam:role:admin", report.Changes[0].ID)
+	assert.Equal(t, pdiff.RadiusMedium, report.Changes[0].Radius)
+	assert.True(t, report.Changes[0].AllOperations)
+	assert.Equal(t, []string{"mrn:iam:role:admin"}, report.Changes[0].Roles)
+
+	assert.Equal(t, 9, report.Fixtures)
+	assert.Contains(t, report.Flips, Flip{Fixture: filepath.Join(dir, "example-decision-tests.yaml") + ":admin-can-access", Base: "GRANT", Head: "DENY"})
+	assert.Contains(t, report.Flips, Flip{Fixture: filepath.Join(dir, "example-porc-input.json"), Base: "GRANT", Head: "DENY"})
+	for _, f := range report.Flips {
+		assert.NotContains(t, f.Fixture, "unauthenticated-denied")
+	}
+}
+
+func TestExecuteImpact_Markdown(t *testing.T) {
+	out, err := clitest.CaptureStdout(func() error {
+		return runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", adminDenied(t),
+			"--fixtures", clitest.TestData("example-decision-tests.yaml"))
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "### Policy impact")
+	assert.Contains(t, out, "1 change(s) (1 medium), ")
+	assert.Contains(t, out, "| medium | ~ role `mrn:iam:role:admin` | consolidated | all | `mrn:iam:role:admin` |")
+	assert.Contains(t, out, "#### Decision flips")
+	assert.Contains(t, out, "example-decision-tests.yaml:admin-can-access` | GRANT | DENY |")
+}
+
+func TestExecuteImpact_Text(t *testing.T) {
+	out, err := clitest.CaptureStdout(func() error {
+		return runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", adminDenied(t), "-o", "text")
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "medium ~ role 'mrn:iam:role:admin' (domain 'consolidated'): operations all; roles 'mrn:iam:role:admin'")
+	assert.Contains(t, out, "1 change(s) (1 medium)\n")
+}
+
+func TestExecuteImpact_NoChanges(t *testing.T) {
+	out, err := clitest.CaptureStdout(func() error {
+		return runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", clitest.TestData("consolidated.yml"),
+			"--fixtures", clitest.TestData("example-decision-tests.yaml"), "--fail-on-flip")
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "0 change(s), 0 of 8 fixture decision(s) flipped")
+	assert.NotContains(t, out, "| Radius |")
+}
+
+func TestExecuteImpact_FailOnFlip(t *testing.T) {
+	_, err := clitest.CaptureStdout(func() error {
+		return runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", adminDenied(t),
+			"--fixtures", clitest.TestData("example-decision-tests.yaml"), "--fail-on-flip")
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "decision(s) flipped")
+}
+
+func TestExecuteImpact_Errors(t *testing.T) {
+	err := runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", clitest.TestData("consolidated.yml"), "-o", "html")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported output format 'html'")
+
+	err = runImpact(context.Background(), "--base", filepath.Join(t.TempDir(), "missing.yml"), "--head", clitest.TestData("consolidated.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "base:")
+
+	err = runImpact(context.Background(), "--base", clitest.TestData("consolidated.yml"), "--head", clitest.TestData("consolidated.yml"), "--fixtures", t.TempDir())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no fixtures found")
+}
+
+func TestLoadFixtures_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"principal": {}}`), 0600))
+
+	_, err := LoadFixtures([]string{path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "neither a PORC nor a decision test suite")
+
+	_, err = LoadFixtures([]string{filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
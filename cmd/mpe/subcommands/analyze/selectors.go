@@ -0,0 +1,259 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package analyze
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/urfave/cli/v3"
+)
+
+// SelectorCoverage is the number of operations of a corpus that a selector routed
+type SelectorCoverage struct {
+	Domain    string `json:"domain"`
+	Operation string `json:"operation"`
+	Selector  string `json:"selector"`
+	Hits      int    `json:"hits"`
+	// Shadowed counts the operations that the selector matches, but that an earlier selector
+	// routed
+	Shadowed int `json:"shadowed"`
+}
+
+// UnmatchedOperation is an operation of a corpus that no selector routes
+type UnmatchedOperation struct {
+	Operation string `json:"operation"`
+	Count     int    `json:"count"`
+}
+
+// SelectorReport is the outcome of a selector coverage analysis
+type SelectorReport struct {
+	Operations int                  `json:"operations"`
+	Distinct   int                  `json:"distinct"`
+	Selectors  []SelectorCoverage   `json:"selectors"`
+	Unmatched  []UnmatchedOperation `json:"unmatched"`
+}
+
+// ExecuteSelectors runs the selector coverage analysis, routing each operation of a corpus of
+// operation lists, access logs, and fixtures as the engine would, and reporting how often each
+// selector of the bundles routed one, so that dead selectors and mistyped patterns stand out.
+func ExecuteSelectors(ctx context.Context, cmd *cli.Command) error {
+	format := cmd.String("output")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s': must be 'text' or 'json'", format)
+	}
+
+	var corpus []string
+	for _, path := range cmd.StringSlice("operations") {
+		operations, err := LoadOperations(path)
+		if err != nil {
+			return err
+		}
+		corpus = append(corpus, operations...)
+	}
+	if paths := cmd.StringSlice("fixtures"); len(paths) > 0 {
+		fixtures, err := LoadFixtures(paths)
+		if err != nil {
+			return err
+		}
+		for _, f := range fixtures {
+			if operation, ok := f.PORC["operation"].(string); ok {
+				corpus = append(corpus, operation)
+			}
+		}
+	}
+	if len(corpus) == 0 {
+		return fmt.Errorf("no operations found: specify --operations or --fixtures")
+	}
+
+	bundles, _, err := loadBundles(cmd.StringSlice("bundle"))
+	if err != nil {
+		return err
+	}
+	pe, err := common.NewBundlePolicyEngine(cmd, bundles, accesslog.NewNullFactory())
+	if err != nil {
+		return fmt.Errorf("failed to load bundles: %w", err)
+	}
+
+	report, err := Selectors(ctx, pe.GetBackend(), corpus)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	} else {
+		printSelectorReport(os.Stdout, report)
+	}
+
+	if unused := report.unused(); len(unused) > 0 && cmd.Bool("fail-on-unused") {
+		return fmt.Errorf("%d selector(s) never hit", len(unused))
+	}
+	return nil
+}
+
+// Selectors routes each operation of corpus with the backend, counting the operations that
+// each selector routed, in the order that the backend tries them, and those that none did
+func Selectors(ctx context.Context, be backend.Service, corpus []string) (*SelectorReport, error) {
+	lister, ok := be.(backend.OperationLister)
+	if !ok {
+		return nil, fmt.Errorf("the backend does not list its operations")
+	}
+	routes, perr := lister.ListOperations(ctx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	report := &SelectorReport{Operations: len(corpus), Selectors: []SelectorCoverage{}, Unmatched: []UnmatchedOperation{}}
+	index := map[string]int{} // of the coverage of each selector, by domain, operation, and selector
+	for _, route := range routes {
+		for _, selector := range route.Selectors {
+			index[route.Domain+"\x00"+route.Mrn+"\x00"+selector.String()] = len(report.Selectors)
+			report.Selectors = append(report.Selectors, SelectorCoverage{Domain: route.Domain, Operation: route.Mrn, Selector: selector.String()})
+		}
+	}
+
+	counts := map[string]int{}
+	for _, operation := range corpus {
+		counts[operation]++
+	}
+	report.Distinct = len(counts)
+
+	for _, operation := range slices.Sorted(maps.Keys(counts)) {
+		count := counts[operation]
+		ref, perr := be.GetOperation(ctx, operation)
+		if perr != nil {
+			report.Unmatched = append(report.Unmatched, UnmatchedOperation{Operation: operation, Count: count})
+			continue
+		}
+
+		// the selectors of the routing domain after the one that routed the operation never see it
+		unqualified := strings.TrimPrefix(operation, ref.Domain+"/")
+		winner := index[ref.Domain+"\x00"+ref.Mrn+"\x00"+ref.Selector]
+		report.Selectors[winner].Hits += count
+		for _, route := range routes {
+			if route.Domain != ref.Domain {
+				continue
+			}
+			for _, selector := range route.Selectors {
+				i := index[route.Domain+"\x00"+route.Mrn+"\x00"+selector.String()]
+				if i != winner && selector.MatchString(unqualified) {
+					report.Selectors[i].Shadowed += count
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(report.Unmatched, func(a, b UnmatchedOperation) int { return b.Count - a.Count })
+	return report, nil
+}
+
+// unused returns the selectors that routed no operation
+func (r *SelectorReport) unused() []SelectorCoverage {
+	var unused []SelectorCoverage
+	for _, s := range r.Selectors {
+		if s.Hits == 0 {
+			unused = append(unused, s)
+		}
+	}
+	return unused
+}
+
+// LoadOperations reads a corpus of operations from a file, or stdin if path is '-': either one
+// operation per line, or access records as JSON lines, such as those of 'mpe serve', wrapped in
+// CloudEvents envelopes or not. Blank lines and lines starting with '#' are skipped.
+func LoadOperations(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			return nil, fmt.Errorf("failed to read operations: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		r = f
+	}
+
+	var operations []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "{") {
+			operations = append(operations, line)
+			continue
+		}
+
+		var record struct {
+			Operation string `json:"operation"`
+			Data      struct {
+				Operation string `json:"operation"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid access record: %w", path, n, err)
+		}
+		operation := record.Operation
+		if operation == "" {
+			operation = record.Data.Operation
+		}
+		if operation == "" {
+			return nil, fmt.Errorf("%s:%d: the access record has no operation", path, n)
+		}
+		operations = append(operations, operation)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read operations: %w", err)
+	}
+	return operations, nil
+}
+
+func printSelectorReport(out io.Writer, report *SelectorReport) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HITS\tSHADOWED\tDOMAIN\tOPERATION\tSELECTOR")
+	for _, s := range report.Selectors {
+		_, _ = fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", s.Hits, s.Shadowed, s.Domain, s.Operation, s.Selector)
+	}
+	_ = w.Flush()
+
+	unused := report.unused()
+	if len(unused) > 0 {
+		_, _ = fmt.Fprintln(out, "\nNever hit:")
+		for _, s := range unused {
+			shadowed := ""
+			if s.Shadowed > 0 {
+				shadowed = fmt.Sprintf(", shadowed %d time(s) by earlier selectors", s.Shadowed)
+			}
+			_, _ = fmt.Fprintf(out, "  %s (operation '%s', domain '%s'%s)\n", s.Selector, s.Operation, s.Domain, shadowed)
+		}
+	}
+	if len(report.Unmatched) > 0 {
+		_, _ = fmt.Fprintln(out, "\nMatched by no selector:")
+		for _, u := range report.Unmatched {
+			_, _ = fmt.Fprintf(out, "  %s (%d time(s))\n", u.Operation, u.Count)
+		}
+	}
+
+	_, _ = fmt.Fprintln(out, "---")
+	_, _ = fmt.Fprintf(out, "%d operation(s), %d distinct; %d of %d selector(s) hit; %d operation(s) matched by no selector\n",
+		report.Operations, report.Distinct, len(report.Selectors)-len(unused), len(report.Selectors), len(report.Unmatched))
+}
@@ -0,0 +1,139 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func runSelectors(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "selectors",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "bundle", Aliases: []string{"b"}},
+			&cli.StringSliceFlag{Name: "operations"},
+			&cli.StringSliceFlag{Name: "fixtures"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: "text"},
+			&cli.BoolFlag{Name: "fail-on-unused"},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+		},
+		Action: ExecuteSelectors,
+	}
+	root := &cli.Command{
+		Name:     "mpe",
+		Flags:    []cli.Flag{&cli.BoolFlag{Name: "trace"}, &cli.StringSliceFlag{Name: "trace-filter"}},
+		Commands: []*cli.Command{{Name: "analyze", Commands: []*cli.Command{cmd}}},
+	}
+	return root.Run(ctx, append([]string{"mpe", "analyze", "selectors"}, args...))
+}
+
+// operations writes a corpus of operations, as a list and as access records, returning its path
+func operations(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "operations.txt")
+	require.NoError(t, os.WriteFile(path, []byte(`# operations of the users API
+api:users:read
+api:users:read
+
+vualt:secret:read
+{"operation": "api:users:delete", "decision": "GRANT"}
+{"specversion": "1.0", "data": {"operation": "api:groups:read"}}
+`), 0o600))
+	return path
+}
+
+func TestExecuteSelectors_JSON(t *testing.T) {
+	output, err := clitest.CaptureStdout(func() error {
+		return runSelectors(context.Background(), "-b", clitest.TestData("selectors.yml"), "--operations", operations(t), "-o", "json")
+	})
+	require.NoError(t, err)
+
+	var report SelectorReport
+	require.NoError(t, json.Unmarshal([]byte(output), &report))
+	assert.Equal(t, 5, report.Operations)
+	assert.Equal(t, 4, report.Distinct)
+	assert.Equal(t, []SelectorCoverage{
+		{Domain: "selectors", Operation: "users", Selector: "^api:users:.*$", Hits: 3},
+		{Domain: "selectors", Operation: "users", Selector: "^api:user:read$"},
+		{Domain: "selectors", Operation: "reads", Selector: "^api:.*:read$", Hits: 1, Shadowed: 2},
+		{Domain: "selectors", Operation: "vault", Selector: "^vualt:.*$", Hits: 1},
+	}, report.Selectors)
+	assert.Empty(t, report.Unmatched)
+}
+
+func TestExecuteSelectors_Text(t *testing.T) {
+	corpus := filepath.Join(t.TempDir(), "operations.txt")
+	require.NoError(t, os.WriteFile(corpus, []byte("api:users:read\nvault:secret:read\nvault:secret:read\n"), 0o600))
+
+	output, err := clitest.CaptureStdout(func() error {
+		return runSelectors(context.Background(), "-b", clitest.TestData("selectors.yml"), "--operations", corpus)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, output, "HITS  SHADOWED  DOMAIN     OPERATION  SELECTOR\n1     0         selectors  users      ^api:users:.*$\n")
+	assert.Contains(t, output, "Never hit:\n  ^api:user:read$ (operation 'users', domain 'selectors')\n")
+	assert.Contains(t, output, "  ^api:.*:read$ (operation 'reads', domain 'selectors', shadowed 1 time(s) by earlier selectors)\n")
+	assert.Contains(t, output, "Matched by no selector:\n  vault:secret:read (2 time(s))\n")
+	assert.Contains(t, output, "3 operation(s), 2 distinct; 1 of 4 selector(s) hit; 1 operation(s) matched by no selector\n")
+}
+
+func TestExecuteSelectors_Fixtures(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "read.json"), []byte(`{"principal": {}, "operation": "api:groups:read", "resource": "mrn:test"}`), 0o600))
+
+	output, err := clitest.CaptureStdout(func() error {
+		return runSelectors(context.Background(), "-b", clitest.TestData("selectors.yml"), "--fixtures", dir, "-o", "json")
+	})
+	require.NoError(t, err)
+
+	var report SelectorReport
+	require.NoError(t, json.Unmarshal([]byte(output), &report))
+	assert.Equal(t, 1, report.Operations)
+	assert.Equal(t, 1, report.Selectors[2].Hits)
+}
+
+func TestExecuteSelectors_FailOnUnused(t *testing.T) {
+	var err error
+	_, _ = clitest.CaptureStdout(func() error {
+		err = runSelectors(context.Background(), "-b", clitest.TestData("selectors.yml"), "--operations", operations(t), "--fail-on-unused")
+		return err
+	})
+	assert.ErrorContains(t, err, "1 selector(s) never hit")
+}
+
+func TestExecuteSelectors_Errors(t *testing.T) {
+	bundle := clitest.TestData("selectors.yml")
+
+	err := runSelectors(context.Background(), "-b", bundle)
+	assert.ErrorContains(t, err, "no operations found")
+
+	err = runSelectors(context.Background(), "-b", bundle, "--operations", operations(t), "-o", "yaml")
+	assert.ErrorContains(t, err, "unsupported output format 'yaml'")
+
+	err = runSelectors(context.Background(), "-b", bundle, "--operations", filepath.Join(t.TempDir(), "missing.txt"))
+	assert.ErrorContains(t, err, "failed to read operations")
+}
+
+func TestLoadOperations_Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "invalid.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("api:users:read\n{not json\n"), 0o600))
+	_, err := LoadOperations(path)
+	assert.ErrorContains(t, err, "invalid.jsonl:2: invalid access record")
+
+	path = filepath.Join(dir, "no-operation.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte(`{"decision": "GRANT"}`), 0o600))
+	_, err = LoadOperations(path)
+	assert.ErrorContains(t, err, "no-operation.jsonl:1: the access record has no operation")
+}
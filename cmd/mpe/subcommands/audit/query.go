@@ -0,0 +1,141 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/config"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ExecuteQuery runs the 'audit query' command, printing the access records of a journal that
+// match the filters given as flags, oldest first.
+func ExecuteQuery(_ context.Context, cmd *cli.Command) error {
+	format := cmd.String("output")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s': must be 'text' or 'json'", format)
+	}
+
+	if err := config.Load(); err != nil {
+		return err
+	}
+	path := cmd.String("journal")
+	if path == "" {
+		path = config.VConfig.GetString(config.AuditJournalPath)
+	}
+	if path == "" {
+		return fmt.Errorf("no journal: set --journal or %s", config.AuditJournalPath)
+	}
+
+	query, err := parseQuery(cmd, time.Now())
+	if err != nil {
+		return err
+	}
+
+	out := cmd.Root().Writer
+	var w *tabwriter.Writer
+	if format == "text" {
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tDECISION\tSUBJECT\tOPERATION\tRESOURCE")
+	}
+
+	count := 0
+	err = accesslog.ReadJournal(path, query, accesslog.DefaultJournalOptions(path).LockTimeout, func(record *events.AccessRecord) error {
+		count++
+		if w != nil {
+			printRecord(w, record)
+			return nil
+		}
+		data, err := protojson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if w != nil {
+		_ = w.Flush()
+		fmt.Fprintf(out, "---\n%d record(s)\n", count)
+	}
+	return nil
+}
+
+// parseQuery builds the query selected by the flags, resolving durations relative to now
+func parseQuery(cmd *cli.Command, now time.Time) (accesslog.JournalQuery, error) {
+	query := accesslog.JournalQuery{
+		Subject:   cmd.String("principal"),
+		Operation: cmd.String("operation"),
+		Resource:  cmd.String("resource"),
+		Limit:     int(cmd.Int("limit")),
+	}
+	if query.Limit < 0 {
+		return query, fmt.Errorf("--limit must not be negative")
+	}
+
+	var err error
+	if query.Since, err = parseTime(cmd.String("since"), now); err != nil {
+		return query, fmt.Errorf("--since: %w", err)
+	}
+	if query.Until, err = parseTime(cmd.String("until"), now); err != nil {
+		return query, fmt.Errorf("--until: %w", err)
+	}
+
+	for _, d := range cmd.StringSlice("decision") {
+		decision, ok := events.AccessRecord_Decision_value[strings.ToUpper(d)]
+		if !ok || decision == int32(events.AccessRecord_UNSPECIFIED) {
+			return query, fmt.Errorf("invalid decision '%s': must be 'GRANT' or 'DENY'", d)
+		}
+		query.Decisions = append(query.Decisions, events.AccessRecord_Decision(decision))
+	}
+
+	return query, query.Validate()
+}
+
+// parseTime parses a time given as a duration before now, such as "1h", or in RFC 3339
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s': must be a duration such as 1h or a time such as 2024-01-15T10:30:00Z", value)
+	}
+	return t, nil
+}
+
+func printRecord(w io.Writer, record *events.AccessRecord) {
+	timestamp := "-"
+	if ts := record.GetMetadata().GetTimestamp(); ts != nil {
+		timestamp = ts.AsTime().UTC().Format(time.RFC3339)
+	}
+	decision := record.Decision.String()
+	if record.Override != nil {
+		decision += " (override)"
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", timestamp, decision, orDash(record.GetPrincipal().GetSubject()), orDash(record.Operation), orDash(record.Resource))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// runQuery runs 'mpe audit query' with args, returning its output
+func runQuery(t *testing.T, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := &cli.Command{
+		Name:   "mpe",
+		Writer: &out,
+		Commands: []*cli.Command{
+			{
+				Name: "audit",
+				Commands: []*cli.Command{
+					{
+						Name: "query",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "journal", Aliases: []string{"j"}},
+							&cli.StringFlag{Name: "since"},
+							&cli.StringFlag{Name: "until"},
+							&cli.StringSliceFlag{Name: "decision"},
+							&cli.StringFlag{Name: "principal"},
+							&cli.StringFlag{Name: "operation"},
+							&cli.StringFlag{Name: "resource"},
+							&cli.IntFlag{Name: "limit", Aliases: []string{"n"}},
+							&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: "text"},
+						},
+						Action: ExecuteQuery,
+					},
+				},
+			},
+		},
+	}
+	err := cmd.Run(context.Background(), append([]string{"mpe", "audit", "query"}, args...))
+	return out.String(), err
+}
+
+// writeJournal journals a GRANT for alice two hours ago, and a DENY for bob a minute ago,
+// returning the path of the journal
+func writeJournal(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	s, err := accesslog.NewJournalingStream(&accesslog.NullStream{}, accesslog.DefaultJournalOptions(path))
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, s.Send(&events.AccessRecord{
+		Metadata:  &events.AccessRecord_Metadata{Timestamp: timestamppb.New(now.Add(-2 * time.Hour))},
+		Principal: &events.AccessRecord_Principal{Subject: "alice"},
+		Operation: "api:documents:read",
+		Resource:  "mrn:app:document:1",
+		Decision:  events.AccessRecord_GRANT,
+	}))
+	require.NoError(t, s.Send(&events.AccessRecord{
+		Metadata:  &events.AccessRecord_Metadata{Timestamp: timestamppb.New(now.Add(-time.Minute))},
+		Principal: &events.AccessRecord_Principal{Subject: "bob"},
+		Operation: "api:documents:delete",
+		Resource:  "mrn:app:document:2",
+		Decision:  events.AccessRecord_DENY,
+	}))
+	s.Close()
+	return path
+}
+
+func TestExecuteQuery(t *testing.T) {
+	path := writeJournal(t)
+
+	output, err := runQuery(t, "--journal", path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	require.Len(t, lines, 5, output)
+	assert.Regexp(t, `^TIME\s+DECISION\s+SUBJECT\s+OPERATION\s+RESOURCE$`, lines[0])
+	assert.Regexp(t, `GRANT\s+alice\s+api:documents:read\s+mrn:app:document:1$`, lines[1])
+	assert.Regexp(t, `DENY\s+bob\s+api:documents:delete\s+mrn:app:document:2$`, lines[2])
+	assert.Equal(t, "2 record(s)", lines[4])
+
+	output, err = runQuery(t, "--journal", path, "--since", "1h")
+	require.NoError(t, err)
+	assert.NotContains(t, output, "alice")
+	assert.Contains(t, output, "bob")
+
+	output, err = runQuery(t, "--journal", path, "--decision", "grant", "--principal", "a*")
+	require.NoError(t, err)
+	assert.Contains(t, output, "alice")
+	assert.Contains(t, output, "1 record(s)")
+
+	output, err = runQuery(t, "--journal", path, "--operation", "*:delete", "-o", "json")
+	require.NoError(t, err)
+	record := &events.AccessRecord{}
+	require.NoError(t, protojson.Unmarshal([]byte(output), record), "json output is an AccessRecord per line")
+	assert.Equal(t, "bob", record.GetPrincipal().GetSubject())
+
+	output, err = runQuery(t, "--journal", path, "-n", "1", "-o", "json")
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(output, "\n"))
+	assert.Contains(t, output, "bob", "the limit keeps the most recent records")
+}
+
+func TestExecuteQuery_Errors(t *testing.T) {
+	path := writeJournal(t)
+
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--journal", path, "--since", "yesterday"}, "--since: invalid time 'yesterday'"},
+		{[]string{"--journal", path, "--until", "2024-13-01"}, "--until: invalid time"},
+		{[]string{"--journal", path, "--decision", "MAYBE"}, "invalid decision 'MAYBE'"},
+		{[]string{"--journal", path, "--principal", "["}, "invalid pattern"},
+		{[]string{"--journal", path, "--limit", "-1"}, "--limit must not be negative"},
+		{[]string{"--journal", path, "-o", "yaml"}, "unsupported output format 'yaml'"},
+		{[]string{"--journal", filepath.Join(t.TempDir(), "missing.db")}, "open journal"},
+		{nil, "no journal"},
+	} {
+		_, err := runQuery(t, tc.args...)
+		assert.ErrorContains(t, err, tc.expected, tc.args)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	ts, err := parseTime("90m", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-90*time.Minute), ts)
+
+	ts, err = parseTime("2024-01-15T10:30:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC), ts)
+
+	ts, err = parseTime("", now)
+	require.NoError(t, err)
+	assert.True(t, ts.IsZero())
+}
@@ -5,12 +5,20 @@
 package build
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/manetu/policyengine/cmd/mpe/common/watch"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
 	"github.com/urfave/cli/v3"
 	"gopkg.in/yaml.v3"
 )
@@ -30,7 +38,59 @@ func Execute(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("no files specified, use --file/-f to specify PolicyDomainReference YAML files to build")
 	}
 
+	if !cmd.Bool("watch") {
+		return build(cmd, files)
+	}
+
+	w := &watch.Watcher{
+		Files: func() []string {
+			// values that fail to load are reported by the build; the files are then watched unrendered
+			opts, _ := buildOptions(cmd)
+			watched := slices.Clone(cmd.StringSlice("values"))
+			for _, file := range files {
+				watched = append(watched, References(file, opts...)...)
+			}
+			return watched
+		},
+		Run: func() {
+			if err := build(cmd, files); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+	return w.Watch(ctx)
+}
+
+// buildOptions returns the options of a build from its flags, loading any template values
+func buildOptions(cmd *cli.Command) ([]Option, error) {
+	if !cmd.IsSet("values") && !cmd.IsSet("set") {
+		return nil, nil
+	}
+	values, err := LoadValues(cmd.StringSlice("values"), cmd.StringSlice("set"))
+	if err != nil {
+		return nil, err
+	}
+	return []Option{WithValues(values)}, nil
+}
+
+// build builds the files once, as Execute does without --watch
+func build(cmd *cli.Command, files []string) error {
 	outputFile := cmd.String("output")
+	opts, err := buildOptions(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Bool("embed") {
+		result, err := Embed(files, outputFile, cmd.String("name"), opts...)
+		printEmbedResult(result)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Generated %s; build it with: cd %s && go mod tidy && CGO_ENABLED=0 go build\n", result.OutputDir, result.OutputDir)
+		return nil
+	}
 
 	// If multiple files but single output specified, that's an error
 	if len(files) > 1 && outputFile != "" {
@@ -42,7 +102,7 @@ func Execute(ctx context.Context, cmd *cli.Command) error {
 
 	// Build all files
 	for _, file := range files {
-		result := File(file, outputFile)
+		result := File(file, outputFile, opts...)
 		results = append(results, result)
 		if !result.Success {
 			hasErrors = true
@@ -87,8 +147,10 @@ func printResults(results []Result) {
 	}
 }
 
-// File builds a single policy domain file, reading rego_filename references and converting to PolicyDomain.
-func File(inputFile, outputFile string) Result {
+// File builds a single policy domain file, overlaying the domains it includes, reading rego_filename and value_filename references, and converting to PolicyDomain.
+func File(inputFile, outputFile string, opts ...Option) Result {
+	o := newOptions(opts)
+
 	result := Result{
 		InputFile: inputFile,
 		Success:   false,
@@ -105,27 +167,70 @@ func File(inputFile, outputFile string) Result {
 		return result
 	}
 
-	var rootNode yaml.Node
-	if err := yaml.Unmarshal(inputData, &rootNode); err != nil {
-		result.Error = fmt.Errorf("failed to parse YAML: %w", err)
-		return result
+	if o.values != nil {
+		rendered, err := render(inputFile, string(inputData), o.values)
+		if err != nil {
+			result.Error = err
+			return result
+		}
+		inputData = []byte(rendered)
 	}
 
-	if err := processYAMLNode(&rootNode, ""); err != nil {
-		result.Error = err
-		return result
-	}
+	// each document of a multi-document file is built
+	var rootNodes []*yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(inputData))
+	for {
+		var rootNode yaml.Node
+		err := decoder.Decode(&rootNode)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			result.Error = fmt.Errorf("failed to parse YAML: %w", err)
+			return result
+		}
+		if isEmptyDocument(&rootNode) {
+			continue
+		}
 
-	if err := ensurePolicyDomainKind(&rootNode); err != nil {
-		result.Error = err
-		return result
+		if err := applyIncludes(&rootNode, nil, o); err != nil {
+			result.Error = err
+			return result
+		}
+
+		if err := processYAMLNode(&rootNode, ""); err != nil {
+			result.Error = err
+			return result
+		}
+
+		if err := ensurePolicyDomainKind(&rootNode); err != nil {
+			result.Error = err
+			return result
+		}
+		rootNodes = append(rootNodes, &rootNode)
 	}
 
-	outputData, err := yaml.Marshal(&rootNode)
-	if err != nil {
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	for _, rootNode := range rootNodes {
+		if err := encoder.Encode(rootNode); err != nil {
+			result.Error = fmt.Errorf("failed to marshal output YAML: %w", err)
+			return result
+		}
+	}
+	if err := encoder.Close(); err != nil {
 		result.Error = fmt.Errorf("failed to marshal output YAML: %w", err)
 		return result
 	}
+	outputData := output.Bytes()
+
+	// a template may render a document that is valid YAML but not a valid domain
+	if o.values != nil {
+		if _, err := parsers.LoadAllFromBytes(outputFile, outputData); err != nil {
+			result.Error = fmt.Errorf("rendered domain is invalid: %w", err)
+			return result
+		}
+	}
 
 	if err := os.WriteFile(outputFile, outputData, 0600); err != nil {
 		result.Error = fmt.Errorf("failed to write output file: %w", err)
@@ -136,12 +241,21 @@ func File(inputFile, outputFile string) Result {
 	return result
 }
 
+// isEmptyDocument reports whether a document is empty, such as one only holding comments
+// between '---' markers
+func isEmptyDocument(node *yaml.Node) bool {
+	return len(node.Content) == 0 || (node.Content[0].Tag == "!!null" && node.Content[0].Value == "")
+}
+
 func generateOutputFilename(inputFile string) string {
 	ext := filepath.Ext(inputFile)
 	nameWithoutExt := strings.TrimSuffix(inputFile, ext)
 	return nameWithoutExt + "-built" + ext
 }
 
+// KindPolicyDomainReference is the document kind of PolicyDomainReference files.
+const KindPolicyDomainReference = "PolicyDomainReference"
+
 // IsPolicyDomainReference checks if a YAML file is a PolicyDomainReference by examining its kind field.
 func IsPolicyDomainReference(filePath string) (bool, error) {
 	data, err := os.ReadFile(filePath) // #nosec G304 -- CLI tool intentionally reads user-provided paths
@@ -157,7 +271,7 @@ func IsPolicyDomainReference(filePath string) (bool, error) {
 		return false, fmt.Errorf("failed to parse YAML: %w", err)
 	}
 
-	return doc.Kind == "PolicyDomainReference", nil
+	return doc.Kind == KindPolicyDomainReference, nil
 }
 
 // regoRequiredParents defines the YAML keys whose child items must have 'rego' or 'rego_filename'.
@@ -206,6 +320,13 @@ func processMappingNode(node *yaml.Node, parentKey string) error {
 	hasRegoFilename := false
 	var regoFilenameIndex int
 	var regoFilenameValue string
+	hasRegoSHA256 := false
+	var regoSHA256Index int
+	hasValue := false
+	hasValueFilename := false
+	var valueFilenameIndex int
+	hasSource := false
+	var sourceIndex int
 
 	for i := 0; i < len(node.Content); i += 2 {
 		keyNode := node.Content[i]
@@ -221,9 +342,27 @@ func processMappingNode(node *yaml.Node, parentKey string) error {
 				if valueNode.Kind == yaml.ScalarNode {
 					regoFilenameValue = valueNode.Value
 				}
+			case "rego_sha256":
+				hasRegoSHA256 = true
+				regoSHA256Index = i
+			case "value":
+				hasValue = true
+			case "value_filename":
+				hasValueFilename = true
+				valueFilenameIndex = i
+			case "source":
+				if parentKey == "policy-libraries" {
+					hasSource = true
+					sourceIndex = i
+				}
 			}
 		}
 
+		// data document values are content, not PolicyDomain structure
+		if parentKey == "data" && keyNode.Value == "value" {
+			continue
+		}
+
 		// Pass the current key as parentKey so children know their context
 		currentKey := ""
 		if keyNode.Kind == yaml.ScalarNode {
@@ -237,18 +376,41 @@ func processMappingNode(node *yaml.Node, parentKey string) error {
 	if hasRego && hasRegoFilename {
 		return fmt.Errorf("cannot specify both 'rego' and 'rego_filename' in the same block")
 	}
+	if hasRegoSHA256 && !hasRegoFilename {
+		return fmt.Errorf("cannot specify 'rego_sha256' without 'rego_filename'")
+	}
+	if hasSource && (hasRego || hasRegoFilename) {
+		return fmt.Errorf("cannot specify 'source' with 'rego' or 'rego_filename' in the same block")
+	}
 
 	// If this node is inside a rego-bearing section, it must have rego or rego_filename
-	if regoRequiredParents[parentKey] && !hasRego && !hasRegoFilename {
+	if regoRequiredParents[parentKey] && !hasRego && !hasRegoFilename && !hasSource {
 		return fmt.Errorf("missing 'rego' or 'rego_filename' in '%s' entry", parentKey)
 	}
 
+	if hasSource {
+		if err := inlineLibrarySource(node, sourceIndex); err != nil {
+			return err
+		}
+	}
+
+	if parentKey == "data" {
+		if hasValue && hasValueFilename {
+			return fmt.Errorf("cannot specify both 'value' and 'value_filename' in the same block")
+		}
+		if hasValueFilename {
+			if err := inlineDataFile(node, valueFilenameIndex); err != nil {
+				return err
+			}
+		}
+	}
+
 	if hasRegoFilename {
 		if regoFilenameValue == "" {
 			return fmt.Errorf("rego_filename cannot be empty")
 		}
 
-		regoContent, err := readRegoFile(regoFilenameValue)
+		regoContent, err := readReferencedFile(regoFilenameValue)
 		if err != nil {
 			return fmt.Errorf("failed to read rego file '%s': %w", regoFilenameValue, err)
 		}
@@ -256,6 +418,14 @@ func processMappingNode(node *yaml.Node, parentKey string) error {
 		keyNode := node.Content[regoFilenameIndex]
 		keyNode.Value = "rego"
 
+		if hasRegoSHA256 {
+			digest, err := verifyRegoFile(regoFilenameValue, regoContent, node.Content[regoSHA256Index+1])
+			if err != nil {
+				return err
+			}
+			keyNode.HeadComment = fmt.Sprintf("verified %s (sha256:%s)", regoFilenameValue, digest)
+		}
+
 		valueNode := node.Content[regoFilenameIndex+1]
 
 		trimmed := strings.TrimRight(regoContent, "\n")
@@ -265,12 +435,61 @@ func processMappingNode(node *yaml.Node, parentKey string) error {
 			valueNode.Value = ""
 		}
 		valueNode.Style = yaml.LiteralStyle
+
+		// the checksum is for the build to verify; the built domain references no file
+		if hasRegoSHA256 {
+			node.Content = slices.Delete(node.Content, regoSHA256Index, regoSHA256Index+2)
+		}
 	}
 
 	return nil
 }
 
-func readRegoFile(filename string) (string, error) {
+// inlineDataFile replaces the value_filename key at index of a data document with the
+// parsed content of the JSON or YAML file it names
+func inlineDataFile(node *yaml.Node, index int) error {
+	filenameNode := node.Content[index+1]
+	if filenameNode.Kind != yaml.ScalarNode || filenameNode.Value == "" {
+		return fmt.Errorf("value_filename cannot be empty")
+	}
+
+	content, err := readReferencedFile(filenameNode.Value)
+	if err != nil {
+		return fmt.Errorf("failed to read data file '%s': %w", filenameNode.Value, err)
+	}
+
+	// JSON is a subset of YAML, so both are parsed the same way
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &document); err != nil {
+		return fmt.Errorf("failed to parse data file '%s': %w", filenameNode.Value, err)
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		return fmt.Errorf("data file '%s' is empty", filenameNode.Value)
+	}
+
+	node.Content[index].Value = "value"
+	node.Content[index+1] = document.Content[0]
+
+	return nil
+}
+
+// verifyRegoFile checks the content of a rego file against the rego_sha256 of its entity,
+// returning its digest
+func verifyRegoFile(filename, content string, expectedNode *yaml.Node) (string, error) {
+	expected := strings.TrimPrefix(expectedNode.Value, "sha256:")
+	if expectedNode.Kind != yaml.ScalarNode || !digestPattern.MatchString(expected) {
+		return "", fmt.Errorf("invalid rego_sha256 '%s' for rego file '%s', expected 64 lowercase hex digits", expectedNode.Value, filename)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+	if digest != expected {
+		return "", fmt.Errorf("rego file '%s': sha256 mismatch: expected %s, got %s", filename, expected, digest)
+	}
+	return digest, nil
+}
+
+func readReferencedFile(filename string) (string, error) {
 	// Support both absolute and relative paths (relative to CWD)
 	var filePath string
 	if filepath.IsAbs(filename) {
@@ -310,7 +529,8 @@ func ensurePolicyDomainKind(node *yaml.Node) error {
 		valueNode := rootMapping.Content[i+1]
 
 		if keyNode.Kind == yaml.ScalarNode && keyNode.Value == "kind" {
-			if valueNode.Kind == yaml.ScalarNode {
+			// the items of a list are PolicyDomain documents already
+			if valueNode.Kind == yaml.ScalarNode && valueNode.Value != "PolicyDomainList" {
 				valueNode.Value = "PolicyDomain"
 			}
 			return nil
@@ -5,10 +5,14 @@
 package build
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers/v1beta1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -287,3 +291,160 @@ spec:
 	assert.Contains(t, outputStr, "package authz")
 	assert.Contains(t, outputStr, "default allow = false")
 }
+
+func TestBuildFile_DataValueFilename(t *testing.T) {
+	tmpDir := t.TempDir()
+	jsonPath := filepath.Join(tmpDir, "countries.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`["CA", "US"]`), 0600))
+	yamlPath := filepath.Join(tmpDir, "levels.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte("public: 0\nsecret: 2\n"), 0600))
+
+	inputFile := createTempFileWithContent(t, `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: test
+spec:
+  data:
+    - name: countries
+      value_filename: "`+jsonPath+`"
+    - name: levels
+      value_filename: "`+yamlPath+`"
+    - name: inline
+      value:
+        policies:
+          - name: not-a-policy
+`)
+
+	result := File(inputFile, "")
+	require.NoError(t, result.Error)
+	defer func() { _ = os.Remove(result.OutputFile) }()
+
+	model, err := v1beta1.Load(result.OutputFile)
+	require.NoError(t, err)
+	require.Len(t, model.Data, 3)
+	assert.Equal(t, []interface{}{"CA", "US"}, model.Data[0].Value)
+	assert.Equal(t, map[string]interface{}{"public": 0, "secret": 2}, model.Data[1].Value)
+	assert.Equal(t, map[string]interface{}{"policies": []interface{}{map[string]interface{}{"name": "not-a-policy"}}}, model.Data[2].Value)
+}
+
+func TestBuildFile_DataValueFilenameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+		error string
+	}{
+		{"both", "value: 1\n      value_filename: data.json", "cannot specify both 'value' and 'value_filename'"},
+		{"empty", `value_filename: ""`, "value_filename cannot be empty"},
+		{"missing", "value_filename: /nonexistent/data.json", "failed to read data file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputFile := createTempFileWithContent(t, `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: test
+spec:
+  data:
+    - name: document
+      `+tt.entry+`
+`)
+			result := File(inputFile, "")
+			require.Error(t, result.Error)
+			assert.Contains(t, result.Error.Error(), tt.error)
+		})
+	}
+}
+
+// TestBuildFile_MultipleDocuments tests that each document of a multi-document file is built
+func TestBuildFile_MultipleDocuments(t *testing.T) {
+	alpha, err := os.ReadFile(filepath.Join("test", "alpha-ref.yml"))
+	require.NoError(t, err)
+
+	list := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainList
+items:
+  - apiVersion: iamlite.manetu.io/v1beta1
+    kind: PolicyDomain
+    metadata:
+      name: listed
+    spec:
+      policies:
+        - mrn: "mrn:iam:policy:allow-all"
+          name: allow-all
+          rego: |
+            package authz
+            default allow = true
+`
+	inputFile := createTempFileWithContent(t, "---\n"+string(alpha)+"---\n# nothing\n---\n"+list)
+
+	result := File(inputFile, "")
+	require.True(t, result.Success, "Build should succeed: %v", result.Error)
+	defer func() { _ = os.Remove(result.OutputFile) }()
+
+	outputData, err := os.ReadFile(result.OutputFile)
+	require.NoError(t, err)
+	outputStr := string(outputData)
+
+	assert.NotContains(t, outputStr, "rego_filename")
+	assert.NotContains(t, outputStr, "kind: PolicyDomainReference")
+	assert.Contains(t, outputStr, "kind: PolicyDomainList")
+
+	models, err := parsers.LoadAllFromBytes(result.OutputFile, outputData)
+	require.NoError(t, err)
+	require.Len(t, models, 2)
+	assert.Equal(t, "alpha", models[0].Name)
+	assert.Equal(t, "listed", models[1].Name)
+}
+
+func TestBuildFile_RegoSHA256(t *testing.T) {
+	regoFile := filepath.Join(t.TempDir(), "main.rego")
+	require.NoError(t, os.WriteFile(regoFile, []byte("package authz\ndefault allow = 1\n"), 0600))
+	const digest = "d6c48a6eb8bb0ef8e6ac8e9e1de1d94da5ab72e0d1d7abcf3ea9b1a6bc4d3e7f"
+	actual := sha256.Sum256([]byte("package authz\ndefault allow = 1\n"))
+	valid := hex.EncodeToString(actual[:])
+
+	tests := []struct {
+		name  string
+		entry string
+		error string
+	}{
+		{"match", "rego_filename: \"" + regoFile + "\"\n      rego_sha256: " + valid, ""},
+		{"prefixed", "rego_sha256: sha256:" + valid + "\n      rego_filename: \"" + regoFile + "\"", ""},
+		{"mismatch", "rego_filename: \"" + regoFile + "\"\n      rego_sha256: " + digest, "sha256 mismatch: expected " + digest + ", got " + valid},
+		{"invalid", "rego_filename: \"" + regoFile + "\"\n      rego_sha256: ABC", "invalid rego_sha256 'ABC'"},
+		{"inline", "rego: package authz\n      rego_sha256: " + valid, "cannot specify 'rego_sha256' without 'rego_filename'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputFile := createTempFileWithContent(t, `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: test
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:main"
+      name: main
+      `+tt.entry+`
+`)
+			result := File(inputFile, "")
+			if tt.error != "" {
+				require.Error(t, result.Error)
+				assert.Contains(t, result.Error.Error(), tt.error)
+				return
+			}
+			require.NoError(t, result.Error)
+			defer func() { _ = os.Remove(result.OutputFile) }()
+
+			output, err := os.ReadFile(result.OutputFile)
+			require.NoError(t, err)
+			assert.NotContains(t, string(output), "rego_sha256")
+			assert.Contains(t, string(output), "# verified "+regoFile+" (sha256:"+valid+")")
+
+			model, err := v1beta1.Load(result.OutputFile)
+			require.NoError(t, err)
+			assert.Equal(t, "package authz\ndefault allow = 1\n", model.Policies["mrn:iam:policy:main"].Rego)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"bytes"
+	_ "embed" // embed is used to carry the generated main template
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/manetu/policyengine/cmd/mpe/version"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+)
+
+//go:embed templates/main.go.tmpl
+var mainTemplate string
+
+const (
+	defaultEmbedOutput = "decisiond"
+	bundlesDir         = "bundles"
+	modulePath         = "github.com/manetu/policyengine"
+)
+
+// semver matches release versions that can be pinned in the generated go.mod
+var semver = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?$`)
+
+// EmbedResult represents the outcome of an embed operation.
+type EmbedResult struct {
+	OutputDir string
+	Bundles   []Result
+}
+
+type mainParams struct {
+	Name   string
+	Domain string
+}
+
+// Embed builds each input file and generates a Go main package in outputDir that embeds
+// the resulting PolicyDomain bundles and serves them, so the policies can be shipped as a
+// single self-contained binary.
+//
+// The bundles are validated together before any code is generated. The generated package
+// contains main.go, go.mod, and a bundles directory; build it with:
+//
+//	cd <outputDir> && go mod tidy && CGO_ENABLED=0 go build
+func Embed(files []string, outputDir string, domain string, opts ...Option) (EmbedResult, error) {
+	if outputDir == "" {
+		outputDir = defaultEmbedOutput
+	}
+	result := EmbedResult{OutputDir: outputDir}
+
+	if err := os.MkdirAll(filepath.Join(outputDir, bundlesDir), 0750); err != nil {
+		return result, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	bundlePaths := make([]string, 0, len(files))
+	for i, file := range files {
+		// prefix with the position so the embedded binary preserves command-line precedence
+		name := fmt.Sprintf("%03d-%s", i, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))) + ".yml"
+		r := File(file, filepath.Join(outputDir, bundlesDir, name), opts...)
+		result.Bundles = append(result.Bundles, r)
+		if !r.Success {
+			return result, fmt.Errorf("build failed for %s: %w", file, r.Error)
+		}
+		bundlePaths = append(bundlePaths, r.OutputFile)
+	}
+
+	if _, err := registry.NewRegistry(bundlePaths); err != nil {
+		return result, fmt.Errorf("embedded bundles failed validation: %w", err)
+	}
+
+	src, err := generateMain(mainParams{Name: filepath.Base(outputDir), Domain: domain})
+	if err != nil {
+		return result, err
+	}
+
+	if err := os.WriteFile(filepath.Join(outputDir, "main.go"), src, 0600); err != nil {
+		return result, fmt.Errorf("failed to write main.go: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(outputDir, "go.mod"), generateGoMod(filepath.Base(outputDir)), 0600); err != nil {
+		return result, fmt.Errorf("failed to write go.mod: %w", err)
+	}
+
+	return result, nil
+}
+
+func generateMain(params mainParams) ([]byte, error) {
+	tmpl, err := template.New("main").Parse(mainTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return nil, fmt.Errorf("failed to generate main.go: %w", err)
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+func generateGoMod(name string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "module %s\n\ngo 1.26\n", name)
+
+	// pin the engine to the version of mpe that built the bundles; dev builds resolve via 'go mod tidy'
+	if v := version.GetVersion(); semver.MatchString(v) {
+		fmt.Fprintf(&buf, "\nrequire %s %s\n", modulePath, v)
+	}
+
+	return buf.Bytes()
+}
+
+func printEmbedResult(result EmbedResult) {
+	fmt.Println("Embed Results:")
+	fmt.Println()
+	for _, r := range result.Bundles {
+		if r.Success {
+			fmt.Printf("✓ %s → %s\n", r.InputFile, r.OutputFile)
+		} else {
+			fmt.Printf("✗ %s\n", r.InputFile)
+			fmt.Printf("  Error: %s\n", r.Error)
+		}
+	}
+	fmt.Println()
+}
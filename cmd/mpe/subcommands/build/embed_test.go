@@ -0,0 +1,78 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbed_HappyPath(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "decisiond")
+
+	result, err := Embed([]string{"test/alpha-ref.yml", "test/beta-ref.yml"}, outputDir, "beta")
+	require.NoError(t, err)
+	assert.Equal(t, outputDir, result.OutputDir)
+	require.Len(t, result.Bundles, 2)
+
+	// bundles are prefixed to preserve command-line order
+	assert.FileExists(t, filepath.Join(outputDir, "bundles", "000-alpha-ref.yml"))
+	assert.FileExists(t, filepath.Join(outputDir, "bundles", "001-beta-ref.yml"))
+
+	bundle, err := os.ReadFile(filepath.Join(outputDir, "bundles", "001-beta-ref.yml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(bundle), "kind: PolicyDomain\n")
+	assert.NotContains(t, string(bundle), "rego_filename")
+
+	src, err := os.ReadFile(filepath.Join(outputDir, "main.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(src), "//go:embed bundles/*.yml")
+	assert.Contains(t, string(src), `flag.String("name", "beta",`)
+	assert.Contains(t, string(src), "// decisiond is a self-contained policy decision point")
+
+	_, err = parser.ParseFile(token.NewFileSet(), "main.go", src, parser.AllErrors)
+	assert.NoError(t, err)
+
+	mod, err := os.ReadFile(filepath.Join(outputDir, "go.mod"))
+	require.NoError(t, err)
+	assert.Contains(t, string(mod), "module decisiond\n")
+	// dev builds are not pinned
+	assert.NotContains(t, string(mod), "require")
+}
+
+func TestEmbed_PinsReleaseVersion(t *testing.T) {
+	saved := version.Version
+	version.Version = "v1.2.3"
+	defer func() { version.Version = saved }()
+
+	assert.Contains(t, string(generateGoMod("decisiond")), "require github.com/manetu/policyengine v1.2.3\n")
+}
+
+func TestEmbed_BuildError(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "decisiond")
+
+	result, err := Embed([]string{"test/error-missing-rego.yml"}, outputDir, "")
+	require.Error(t, err)
+	require.Len(t, result.Bundles, 1)
+	assert.False(t, result.Bundles[0].Success)
+	assert.NoFileExists(t, filepath.Join(outputDir, "main.go"))
+}
+
+func TestEmbed_ValidationError(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "decisiond")
+
+	// beta depends on alpha, so embedding it alone must fail validation
+	_, err := Embed([]string{"test/beta-ref.yml"}, outputDir, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "validation")
+	assert.NoFileExists(t, filepath.Join(outputDir, "main.go"))
+}
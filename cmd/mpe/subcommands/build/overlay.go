@@ -0,0 +1,294 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeKey names the base domains a PolicyDomainReference overlays
+const includeKey = "include"
+
+// patchKey marks an entity or section of an overlay with a patch directive
+const patchKey = "$patch"
+
+// Patch directives
+const (
+	// patchDelete removes the entity or section from the base
+	patchDelete = "delete"
+	// patchReplace replaces the entity or section of the base instead of merging with it
+	patchReplace = "replace"
+)
+
+// exclusiveKeys groups the keys that describe the same content of an entity: an overlay
+// setting one replaces any other the base holds and the overlay does not, so that a policy
+// from the base may be overlaid with a rego_filename of its own without the base's checksum
+var exclusiveKeys = [][]string{
+	{"rego", "rego_filename", "rego_sha256", "source"},
+	{"value", "value_filename"},
+}
+
+// applyIncludes replaces a document that includes base domains with the bases, in order,
+// overlaid with the rest of the document. Included files may include others in turn.
+//
+// Paths are resolved as rego_filename references are, relative to the current working
+// directory. The stack holds the absolute paths of the files being included, to detect
+// cycles. Included files are rendered with the values of the build, if any.
+func applyIncludes(doc *yaml.Node, stack []string, o *options) error {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	overlay := doc.Content[0]
+
+	index := mappingIndex(overlay, includeKey)
+	if index < 0 {
+		return nil
+	}
+	paths, err := includePaths(overlay.Content[index+1])
+	if err != nil {
+		return err
+	}
+	overlay.Content = slices.Delete(overlay.Content, index, index+2)
+
+	var base *yaml.Node
+	for _, path := range paths {
+		included, err := loadInclude(path, stack, o)
+		if err != nil {
+			return err
+		}
+		if base == nil {
+			base = included
+		} else {
+			base = mergeNodes(base, included, "")
+		}
+	}
+
+	doc.Content[0] = mergeNodes(base, overlay, "")
+	return nil
+}
+
+// includePaths returns the paths of an include, given as a path or a list of paths
+func includePaths(node *yaml.Node) ([]string, error) {
+	var paths []string
+	switch node.Kind {
+	case yaml.ScalarNode:
+		paths = []string{node.Value}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("'%s' must be a path or a list of paths", includeKey)
+			}
+			paths = append(paths, item.Value)
+		}
+	default:
+		return nil, fmt.Errorf("'%s' must be a path or a list of paths", includeKey)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			return nil, fmt.Errorf("'%s' path cannot be empty", includeKey)
+		}
+	}
+	return paths, nil
+}
+
+// loadInclude reads an included file, a PolicyDomain or PolicyDomainReference holding a single
+// domain, and applies its own includes
+func loadInclude(path string, stack []string, o *options) (*yaml.Node, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve include '%s': %w", path, err)
+	}
+	if slices.Contains(stack, abs) {
+		return nil, fmt.Errorf("include cycle: '%s' includes itself", path)
+	}
+
+	content, err := readReferencedFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include '%s': %w", path, err)
+	}
+	if o.values != nil {
+		if content, err = render(path, content, o.values); err != nil {
+			return nil, fmt.Errorf("include '%s': %w", path, err)
+		}
+	}
+
+	var docs []*yaml.Node
+	decoder := yaml.NewDecoder(strings.NewReader(content))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse include '%s': %w", path, err)
+		}
+		if isEmptyDocument(&doc) {
+			continue
+		}
+		docs = append(docs, &doc)
+	}
+	if len(docs) != 1 || docs[0].Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("include '%s' must hold a single domain", path)
+	}
+
+	if err := applyIncludes(docs[0], append(slices.Clone(stack), abs), o); err != nil {
+		return nil, fmt.Errorf("include '%s': %w", path, err)
+	}
+	return docs[0].Content[0], nil
+}
+
+// mergeNodes overlays a node onto a base node, returning the result. Mappings are merged key
+// by key, and sequences of entities are merged entity by entity, matched by their 'mrn', or
+// their 'name' when they have none; entities only in the overlay are appended. Anything else
+// in the overlay, such as a scalar, a selector, or a list of roles, replaces the base.
+//
+// An entity or section of the overlay holding '$patch: delete' is removed from the result,
+// and one holding '$patch: replace' replaces the base without merging with it.
+func mergeNodes(base, overlay *yaml.Node, key string) *yaml.Node {
+	switch {
+	case base == nil:
+		return stripPatch(overlay)
+	case patchDirective(overlay) == patchReplace:
+		return stripPatch(overlay)
+	case base.Kind == yaml.MappingNode && overlay.Kind == yaml.MappingNode && key != "value":
+		return mergeMappings(base, overlay)
+	case base.Kind == yaml.SequenceNode && overlay.Kind == yaml.SequenceNode && isEntitySequence(base) && isEntitySequence(overlay):
+		return mergeEntities(base, overlay)
+	default:
+		return stripPatch(overlay)
+	}
+}
+
+func mergeMappings(base, overlay *yaml.Node) *yaml.Node {
+	result := *base
+	result.Content = slices.Clone(base.Content)
+
+	for i := 0; i < len(overlay.Content); i += 2 {
+		k, v := overlay.Content[i], overlay.Content[i+1]
+		if k.Value == patchKey {
+			continue
+		}
+
+		index := mappingIndex(&result, k.Value)
+		if patchDirective(v) == patchDelete {
+			if index >= 0 {
+				result.Content = slices.Delete(result.Content, index, index+2)
+			}
+			continue
+		}
+
+		if index < 0 {
+			for _, group := range exclusiveKeys {
+				if !slices.Contains(group, k.Value) {
+					continue
+				}
+				for _, other := range group {
+					if j := mappingIndex(&result, other); j >= 0 && mappingIndex(overlay, other) < 0 {
+						result.Content = slices.Delete(result.Content, j, j+2)
+					}
+				}
+			}
+			result.Content = append(result.Content, k, mergeNodes(nil, v, k.Value))
+			continue
+		}
+		result.Content[index+1] = mergeNodes(result.Content[index+1], v, k.Value)
+	}
+	return &result
+}
+
+func mergeEntities(base, overlay *yaml.Node) *yaml.Node {
+	result := *base
+	result.Content = slices.Clone(base.Content)
+
+	for _, item := range overlay.Content {
+		index := slices.IndexFunc(result.Content, func(candidate *yaml.Node) bool {
+			return sameEntity(candidate, item)
+		})
+		switch {
+		case patchDirective(item) == patchDelete:
+			if index >= 0 {
+				result.Content = slices.Delete(result.Content, index, index+1)
+			}
+		case index >= 0:
+			result.Content[index] = mergeNodes(result.Content[index], item, "")
+		default:
+			result.Content = append(result.Content, stripPatch(item))
+		}
+	}
+	return &result
+}
+
+// entityID returns the field identifying an entity and its value
+func entityID(node *yaml.Node) (string, string) {
+	for _, field := range []string{"mrn", "name"} {
+		if i := mappingIndex(node, field); i >= 0 && node.Content[i+1].Kind == yaml.ScalarNode {
+			return field, node.Content[i+1].Value
+		}
+	}
+	return "", ""
+}
+
+func sameEntity(a, b *yaml.Node) bool {
+	fa, va := entityID(a)
+	fb, vb := entityID(b)
+	return fa != "" && fa == fb && va == vb
+}
+
+// isEntitySequence reports whether every item of a sequence is an entity with an identity
+func isEntitySequence(node *yaml.Node) bool {
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return false
+		}
+		if field, _ := entityID(item); field == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// patchDirective returns the '$patch' directive of a mapping, if any
+func patchDirective(node *yaml.Node) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	if i := mappingIndex(node, patchKey); i >= 0 {
+		return node.Content[i+1].Value
+	}
+	return ""
+}
+
+// stripPatch returns a node without its '$patch' directive
+func stripPatch(node *yaml.Node) *yaml.Node {
+	i := mappingIndex(node, patchKey)
+	if node.Kind != yaml.MappingNode || i < 0 {
+		return node
+	}
+	result := *node
+	result.Content = slices.Delete(slices.Clone(node.Content), i, i+2)
+	return &result
+}
+
+// mappingIndex returns the index of a key of a mapping, or -1
+func mappingIndex(node *yaml.Node, key string) int {
+	if node.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Kind == yaml.ScalarNode && node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,221 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/policydomain/parsers/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const baseDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: base
+spec:
+  data:
+    - name: limits
+      value:
+        max: 10
+        min: 1
+  policies:
+    - mrn: "mrn:iam:policy:allow"
+      name: allow
+      rego: |
+        package authz
+        default allow = 1
+    - mrn: "mrn:iam:policy:deny"
+      name: deny
+      rego: |
+        package authz
+        default allow = -1
+    - mrn: "mrn:iam:policy:debug"
+      name: debug
+      rego: |
+        package authz
+        default allow = 1
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      name: reader
+      policy: "mrn:iam:policy:allow"
+      annotations:
+        - name: tier
+          value: basic
+        - name: region
+          value: us
+  operations:
+    - name: debug
+      selector:
+        - "debug:.*"
+      policy: "mrn:iam:policy:debug"
+    - name: all
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:allow"
+`
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestBuildFile_Include(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yml", baseDomain)
+	regoFile := writeFile(t, dir, "prod.rego", "package authz\ndefault allow = -1\n")
+
+	input := writeFile(t, dir, "prod.yml", `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+include: "`+base+`"
+metadata:
+  name: prod
+spec:
+  data:
+    - name: limits
+      value:
+        max: 100
+  policies:
+    - mrn: "mrn:iam:policy:debug"
+      $patch: delete
+    - mrn: "mrn:iam:policy:allow"
+      rego_filename: "`+regoFile+`"
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      annotations:
+        - name: region
+          value: eu
+    - mrn: "mrn:iam:role:admin"
+      name: admin
+      policy: "mrn:iam:policy:allow"
+  operations:
+    - name: debug
+      $patch: delete
+    - name: all
+      selector:
+        - "api:.*"
+      policy: "mrn:iam:policy:deny"
+`)
+
+	result := File(input, "")
+	require.NoError(t, result.Error)
+
+	out, err := os.ReadFile(result.OutputFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "include")
+	assert.NotContains(t, string(out), "$patch")
+	assert.Contains(t, string(out), "kind: PolicyDomain\n")
+
+	model, err := v1beta1.Load(result.OutputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "prod", model.Name)
+
+	require.Len(t, model.Policies, 2)
+	assert.NotContains(t, model.Policies, "mrn:iam:policy:debug")
+	assert.Equal(t, "package authz\ndefault allow = -1\n", model.Policies["mrn:iam:policy:allow"].Rego)
+
+	require.Len(t, model.Roles, 2)
+	reader := model.Roles["mrn:iam:role:reader"]
+	assert.Equal(t, "mrn:iam:policy:allow", reader.Policy)
+	assert.Equal(t, "basic", reader.Annotations["tier"].Value)
+	assert.Equal(t, "eu", reader.Annotations["region"].Value)
+	assert.Contains(t, model.Roles, "mrn:iam:role:admin")
+
+	require.Len(t, model.Operations, 1)
+	assert.Equal(t, "all", model.Operations[0].IDSpec.ID)
+	assert.Equal(t, "mrn:iam:policy:deny", model.Operations[0].Policy)
+	assert.True(t, model.Operations[0].Selectors[0].MatchString("api:docs:read"))
+	assert.False(t, model.Operations[0].Selectors[0].MatchString("debug:trace"))
+
+	// data values are replaced, not merged
+	require.Len(t, model.Data, 1)
+	assert.Equal(t, map[string]interface{}{"max": 100}, model.Data[0].Value)
+
+	// the base is untouched
+	baseData, err := os.ReadFile(base)
+	require.NoError(t, err)
+	assert.Equal(t, baseDomain, string(baseData))
+}
+
+func TestBuildFile_IncludeChain(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yml", baseDomain)
+	extra := writeFile(t, dir, "extra.yml", `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: extra
+spec:
+  scopes:
+    - mrn: "mrn:iam:scope:read"
+      name: read
+      policy: "mrn:iam:policy:allow"
+`)
+	stage := writeFile(t, dir, "stage.yml", `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+include:
+  - "`+base+`"
+  - "`+extra+`"
+metadata:
+  name: stage
+spec:
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      $patch: replace
+      name: reader
+      policy: "mrn:iam:policy:deny"
+`)
+	input := writeFile(t, dir, "stage-eu.yml", `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+include: "`+stage+`"
+metadata:
+  name: stage-eu
+spec: {}
+`)
+
+	result := File(input, "")
+	require.NoError(t, result.Error)
+
+	model, err := v1beta1.Load(result.OutputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "stage-eu", model.Name)
+	assert.Len(t, model.Policies, 3)
+	assert.Contains(t, model.Scopes, "mrn:iam:scope:read")
+
+	reader := model.Roles["mrn:iam:role:reader"]
+	assert.Equal(t, "mrn:iam:policy:deny", reader.Policy)
+	assert.Empty(t, reader.Annotations, "a replaced entity keeps nothing of the base")
+}
+
+func TestBuildFile_IncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "cycle-a.yml", "kind: PolicyDomainReference\ninclude: \""+filepath.Join(dir, "cycle-b.yml")+"\"\n")
+	writeFile(t, dir, "cycle-b.yml", "kind: PolicyDomainReference\ninclude: \""+filepath.Join(dir, "cycle-a.yml")+"\"\n")
+	multiple := writeFile(t, dir, "multiple.yml", baseDomain+"---\n"+baseDomain)
+
+	tests := []struct {
+		name    string
+		include string
+		error   string
+	}{
+		{"missing", "/nonexistent/base.yml", "failed to read include"},
+		{"empty", `""`, "path cannot be empty"},
+		{"mapping", "{path: base.yml}", "must be a path or a list of paths"},
+		{"cycle", filepath.Join(dir, "cycle-a.yml"), "include cycle"},
+		{"multiple", multiple, "must hold a single domain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := writeFile(t, t.TempDir(), "input.yml", "kind: PolicyDomainReference\ninclude: "+tt.include+"\n")
+			result := File(input, "")
+			require.Error(t, result.Error)
+			assert.Contains(t, result.Error.Error(), tt.error)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// referenceKeys are the keys whose values name files a build reads
+var referenceKeys = map[string]bool{
+	"rego_filename":  true,
+	"value_filename": true,
+}
+
+// References returns the file and the files building it reads: the files it includes, in
+// turn, and the rego and data files they reference, each once. Paths are as written in the
+// files, relative to the current working directory.
+//
+// A file that cannot be read or parsed contributes only itself, so that a file being edited
+// is still reported while it is invalid. Library sources are not files and are not reported.
+func References(file string, opts ...Option) []string {
+	o := newOptions(opts)
+	files := []string{}
+	collectReferences(file, o, &files)
+	return files
+}
+
+func collectReferences(file string, o *options, files *[]string) {
+	if slices.Contains(*files, file) {
+		return
+	}
+	*files = append(*files, file)
+
+	content, err := readReferencedFile(file)
+	if err != nil {
+		return
+	}
+	if o.values != nil {
+		if content, err = render(file, content, o.values); err != nil {
+			return
+		}
+	}
+
+	decoder := yaml.NewDecoder(strings.NewReader(content))
+	for {
+		var doc yaml.Node
+		// the end of the file, or an error, ends the references found
+		if err := decoder.Decode(&doc); err != nil {
+			return
+		}
+		if isEmptyDocument(&doc) {
+			continue
+		}
+
+		var includes []string
+		if i := mappingIndex(doc.Content[0], includeKey); i >= 0 {
+			includes, _ = includePaths(doc.Content[0].Content[i+1])
+		}
+
+		walkReferences(&doc, func(path string) {
+			if !slices.Contains(*files, path) {
+				*files = append(*files, path)
+			}
+		})
+
+		for _, include := range includes {
+			collectReferences(include, o, files)
+		}
+	}
+}
+
+// walkReferences calls found with each file a node references
+func walkReferences(node *yaml.Node, found func(string)) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			// values are content, not PolicyDomain structure
+			if key.Value == "value" {
+				continue
+			}
+			if referenceKeys[key.Value] && value.Kind == yaml.ScalarNode && value.Value != "" {
+				found(value.Value)
+				continue
+			}
+			walkReferences(value, found)
+		}
+		return
+	}
+	for _, child := range node.Content {
+		walkReferences(child, found)
+	}
+}
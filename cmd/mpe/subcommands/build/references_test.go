@@ -0,0 +1,55 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferences(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.rego")
+	main := filepath.Join(dir, "main.rego")
+	data := filepath.Join(dir, "data.json")
+	base := writeFile(t, dir, "base.yml", `kind: PolicyDomainReference
+spec:
+  policy-libraries:
+    - mrn: "mrn:iam:library:lib"
+      rego_filename: "`+lib+`"
+  policies:
+    - mrn: "mrn:iam:policy:main"
+      rego_filename: "`+main+`"
+`)
+	input := writeFile(t, dir, "app.yml", `kind: PolicyDomainReference
+include: "`+base+`"
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:main"
+      rego_filename: "`+main+`"
+  data:
+    - name: countries
+      value_filename: "`+data+`"
+    - name: content
+      value:
+        rego_filename: not-a-reference.rego
+`)
+
+	assert.Equal(t, []string{input, main, data, base, lib}, References(input))
+}
+
+func TestReferences_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	invalid := writeFile(t, dir, "invalid.yml", "kind: [unclosed\n")
+	missing := filepath.Join(dir, "missing.yml")
+	templated := writeFile(t, dir, "templated.yml", "kind: PolicyDomainReference\ninclude: \"{{ .Values.base }}\"\n")
+
+	assert.Equal(t, []string{invalid}, References(invalid))
+	assert.Equal(t, []string{missing}, References(missing))
+	assert.Equal(t, []string{templated, missing}, References(templated, WithValues(map[string]interface{}{"base": missing})))
+	assert.Equal(t, []string{templated}, References(templated, WithValues(map[string]interface{}{})))
+}
@@ -0,0 +1,229 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/oci"
+	"gopkg.in/yaml.v3"
+)
+
+// LibrarySource locates the Rego of a policy library outside of the PolicyDomainReference,
+// in a git repository or an OCI artifact, declared as the 'source' of a library:
+//
+//	policy-libraries:
+//	  - mrn: "mrn:iam:library:utils"
+//	    source:
+//	      git: https://github.com/acme/policy-libraries.git
+//	      ref: v1.4.2
+//	      path: utils/utils.rego
+//	      sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+type LibrarySource struct {
+	Git    string `yaml:"git"`    // URL of a git repository
+	Ref    string `yaml:"ref"`    // Branch, tag, or commit of the repository; HEAD if empty
+	OCI    string `yaml:"oci"`    // OCI artifact, such as ghcr.io/acme/libraries:1.4.2 or ...@sha256:<digest>
+	Path   string `yaml:"path"`   // File within the repository, or title of the artifact layer
+	SHA256 string `yaml:"sha256"` // Optional hex digest that the Rego must match
+}
+
+// maxSourceSize bounds the size of a fetched library
+const maxSourceSize = 8 << 20
+
+// SourceFetcher fetches the Rego of library sources.
+type SourceFetcher struct {
+	// Client performs the requests to OCI registries.
+	Client *http.Client
+
+	// PlainHTTP contacts OCI registries over HTTP instead of HTTPS.
+	PlainHTTP bool
+
+	// Timeout bounds each fetch.
+	Timeout time.Duration
+}
+
+// sources fetches the library sources of the files being built
+var sources = &SourceFetcher{
+	Client:  &http.Client{Timeout: time.Minute},
+	Timeout: 2 * time.Minute,
+}
+
+var (
+	commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Fetch returns the Rego of a library source, verified against its sha256 if any, and a
+// description of where it came from.
+func (f *SourceFetcher) Fetch(ctx context.Context, src LibrarySource) (rego []byte, origin string, err error) {
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+
+	expected := strings.TrimPrefix(src.SHA256, "sha256:")
+	if expected != "" && !digestPattern.MatchString(expected) {
+		return nil, "", fmt.Errorf("invalid sha256 '%s', expected 64 lowercase hex digits", src.SHA256)
+	}
+
+	switch {
+	case src.Git != "" && src.OCI != "":
+		return nil, "", fmt.Errorf("source cannot specify both 'git' and 'oci'")
+	case src.Git != "":
+		rego, origin, err = f.fetchGit(ctx, src)
+	case src.OCI != "":
+		rego, origin, err = f.fetchOCI(ctx, src)
+	default:
+		return nil, "", fmt.Errorf("source must specify 'git' or 'oci'")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(rego)
+	digest := hex.EncodeToString(sum[:])
+	if expected != "" && digest != expected {
+		return nil, "", fmt.Errorf("%s: sha256 mismatch: expected %s, got %s", origin, expected, digest)
+	}
+
+	return rego, fmt.Sprintf("%s (sha256:%s)", origin, digest), nil
+}
+
+// fetchGit reads the file at path from a shallow fetch of the ref of a git repository
+func (f *SourceFetcher) fetchGit(ctx context.Context, src LibrarySource) ([]byte, string, error) {
+	if src.Path == "" {
+		return nil, "", fmt.Errorf("git source '%s' requires a 'path'", src.Git)
+	}
+	if strings.HasPrefix(src.Git, "-") || strings.HasPrefix(src.Ref, "-") {
+		return nil, "", fmt.Errorf("invalid git source '%s'", src.Git)
+	}
+	ref := src.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	dir, err := os.MkdirTemp("", "mpe-source-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...) // #nosec G204 -- CLI tool intentionally fetches user-declared sources
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("git %s: %s", args[0], msg)
+			}
+			return nil, fmt.Errorf("git %s: %w", args[0], err)
+		}
+		return out, nil
+	}
+
+	if _, err := git("init", "-q"); err != nil {
+		return nil, "", err
+	}
+	if _, err := git("fetch", "-q", "--depth", "1", "--", src.Git, ref); err != nil {
+		return nil, "", fmt.Errorf("fetching '%s' of %s: %w", ref, src.Git, err)
+	}
+	out, err := git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	commit := strings.TrimSpace(string(out))
+	if commitPattern.MatchString(ref) && commit != ref {
+		return nil, "", fmt.Errorf("fetching '%s' of %s: resolved to commit %s", ref, src.Git, commit)
+	}
+
+	rego, err := git("show", "FETCH_HEAD:"+src.Path)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading '%s' of %s: %w", src.Path, src.Git, err)
+	}
+
+	return rego, fmt.Sprintf("%s %s@%s, commit %s", src.Git, src.Path, ref, commit), nil
+}
+
+// fetchOCI reads the layer of an OCI artifact titled path, or its only layer if path is empty,
+// verifying the manifest and layer against their digests
+func (f *SourceFetcher) fetchOCI(ctx context.Context, src LibrarySource) ([]byte, string, error) {
+	ref, err := oci.ParseReference(src.OCI)
+	if err != nil {
+		return nil, "", err
+	}
+	repository := (&oci.Client{HTTP: f.Client, PlainHTTP: f.PlainHTTP}).Repository(ref)
+
+	manifest, _, err := repository.GetManifest(ctx, ref.Reference)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching manifest of %s: %w", src.OCI, err)
+	}
+
+	var digest string
+	for _, layer := range manifest.Layers {
+		if src.Path == "" && len(manifest.Layers) == 1 || src.Path != "" && layer.Annotations[oci.AnnotationTitle] == src.Path {
+			digest = layer.Digest
+			break
+		}
+	}
+	if digest == "" {
+		if src.Path == "" {
+			return nil, "", fmt.Errorf("%s has %d layers, specify the 'path' of one", src.OCI, len(manifest.Layers))
+		}
+		return nil, "", fmt.Errorf("%s has no layer titled '%s'", src.OCI, src.Path)
+	}
+
+	rego, err := repository.GetBlob(ctx, digest)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching layer %s of %s: %w", digest, src.OCI, err)
+	}
+	if len(rego) > maxSourceSize {
+		return nil, "", fmt.Errorf("layer %s of %s exceeds %d bytes", digest, src.OCI, maxSourceSize)
+	}
+
+	origin := src.OCI
+	if src.Path != "" {
+		origin += " " + src.Path
+	}
+	return rego, origin, nil
+}
+
+// inlineLibrarySource replaces the source key at index of a policy library with the rego it
+// fetches, annotated with its origin
+func inlineLibrarySource(node *yaml.Node, index int) error {
+	var src LibrarySource
+	if err := node.Content[index+1].Decode(&src); err != nil {
+		return fmt.Errorf("invalid library source: %w", err)
+	}
+
+	rego, origin, err := sources.Fetch(context.Background(), src)
+	if err != nil {
+		return fmt.Errorf("failed to fetch library source: %w", err)
+	}
+
+	keyNode := node.Content[index]
+	keyNode.Value = "rego"
+	keyNode.HeadComment = "fetched from " + origin
+
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.LiteralStyle}
+	if trimmed := strings.TrimRight(string(rego), "\n"); trimmed != "" {
+		valueNode.Value = trimmed + "\n"
+	}
+	node.Content[index+1] = valueNode
+
+	return nil
+}
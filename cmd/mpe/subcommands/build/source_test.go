@@ -0,0 +1,212 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/oci"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sourceRego = "package utils\n\nro_operations := {\"*:read\", \"*:list\"}\n"
+
+func digestOf(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// createLibraryRepo creates a git repository holding libs/utils.rego, tagged v1.0.0
+func createLibraryRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "libs"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "libs", "utils.rego"), []byte(sourceRego), 0600))
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "utils"},
+		{"tag", "v1.0.0"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	return dir
+}
+
+func TestBuildFile_GitSource(t *testing.T) {
+	repo := createLibraryRepo(t)
+
+	reference := func(sha string) string {
+		return fmt.Sprintf(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: shared
+spec:
+  policy-libraries:
+    - mrn: "mrn:iam:library:utils"
+      name: utils
+      source:
+        git: %s
+        ref: v1.0.0
+        path: libs/utils.rego
+        sha256: %s
+`, repo, sha)
+	}
+
+	inputFile := createTempFileWithContent(t, reference(digestOf(sourceRego)))
+	result := File(inputFile, filepath.Join(t.TempDir(), "built.yml"))
+	require.True(t, result.Success, "%v", result.Error)
+
+	output, err := os.ReadFile(result.OutputFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "kind: PolicyDomain\n")
+	assert.Contains(t, string(output), "rego: |\n            package utils\n")
+	assert.Contains(t, string(output), "# fetched from "+repo+" libs/utils.rego@v1.0.0, commit ")
+	assert.NotContains(t, string(output), "source:")
+
+	inputFile = createTempFileWithContent(t, reference(digestOf("tampered")))
+	result = File(inputFile, filepath.Join(t.TempDir(), "built.yml"))
+	require.False(t, result.Success)
+	assert.Contains(t, result.Error.Error(), "sha256 mismatch")
+}
+
+func TestBuildFile_SourceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    string
+		expected string
+	}{
+		{
+			name:     "with rego",
+			entry:    "      source:\n        git: https://example.com/libs.git\n        path: utils.rego\n      rego: |\n        package utils\n",
+			expected: "cannot specify 'source' with 'rego' or 'rego_filename'",
+		},
+		{
+			name:     "no location",
+			entry:    "      source:\n        path: utils.rego\n",
+			expected: "source must specify 'git' or 'oci'",
+		},
+		{
+			name:     "git without path",
+			entry:    "      source:\n        git: https://example.com/libs.git\n",
+			expected: "requires a 'path'",
+		},
+		{
+			name:     "invalid digest",
+			entry:    "      source:\n        oci: registry.example.com/libs:1.0\n        sha256: abc\n",
+			expected: "invalid sha256 'abc'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputFile := createTempFileWithContent(t, `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: shared
+spec:
+  policy-libraries:
+    - mrn: "mrn:iam:library:utils"
+`+tt.entry)
+			result := File(inputFile, filepath.Join(t.TempDir(), "built.yml"))
+			require.False(t, result.Success)
+			assert.Contains(t, result.Error.Error(), tt.expected)
+		})
+	}
+}
+
+// newTestRegistry serves an OCI artifact acme/libs:1.0.0 with a single layer titled utils.rego,
+// requiring a bearer token, and returns the server and the manifest digest. The manifest is
+// served for any digest, as a tampered registry would.
+func newTestRegistry(t *testing.T, blob string) (*httptest.Server, string) {
+	layerDigest := "sha256:" + digestOf(sourceRego)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers": []map[string]interface{}{{
+			"mediaType":   "application/vnd.oci.image.layer.v1.tar",
+			"digest":      layerDigest,
+			"size":        len(sourceRego),
+			"annotations": map[string]string{oci.AnnotationTitle: "utils.rego"},
+		}},
+	})
+	require.NoError(t, err)
+	manifestDigest := "sha256:" + digestOf(string(manifest))
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.Equal(t, "repository:acme/libs:pull", r.URL.Query().Get("scope"))
+			_, _ = w.Write([]byte(`{"token": "secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:acme/libs:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/acme/libs/manifests/1.0.0", strings.HasPrefix(r.URL.Path, "/v2/acme/libs/manifests/sha256:"):
+			_, _ = w.Write(manifest)
+		case r.URL.Path == "/v2/acme/libs/blobs/"+layerDigest:
+			_, _ = w.Write([]byte(blob))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, manifestDigest
+}
+
+func TestSourceFetcher_OCI(t *testing.T) {
+	srv, manifestDigest := newTestRegistry(t, sourceRego)
+	host := strings.TrimPrefix(srv.URL, "https://")
+	fetcher := &SourceFetcher{Client: srv.Client()}
+
+	rego, origin, err := fetcher.Fetch(context.Background(), LibrarySource{OCI: host + "/acme/libs:1.0.0", Path: "utils.rego"})
+	require.NoError(t, err)
+	assert.Equal(t, sourceRego, string(rego))
+	assert.Equal(t, fmt.Sprintf("%s/acme/libs:1.0.0 utils.rego (sha256:%s)", host, digestOf(sourceRego)), origin)
+
+	// the only layer is selected without a path, and a digest reference pins the manifest
+	rego, _, err = fetcher.Fetch(context.Background(), LibrarySource{OCI: host + "/acme/libs@" + manifestDigest, SHA256: digestOf(sourceRego)})
+	require.NoError(t, err)
+	assert.Equal(t, sourceRego, string(rego))
+
+	_, _, err = fetcher.Fetch(context.Background(), LibrarySource{OCI: host + "/acme/libs@sha256:" + digestOf("other")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+
+	_, _, err = fetcher.Fetch(context.Background(), LibrarySource{OCI: host + "/acme/libs:1.0.0", Path: "helpers.rego"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has no layer titled 'helpers.rego'")
+
+	_, _, err = fetcher.Fetch(context.Background(), LibrarySource{OCI: host + "/acme/libs:2.0.0"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404 Not Found")
+
+	// a registry serving content that does not match the manifest is rejected
+	tampered, _ := newTestRegistry(t, "package utils\n\nro_operations := {\"*\"}\n")
+	fetcher = &SourceFetcher{Client: tampered.Client()}
+	_, _, err = fetcher.Fetch(context.Background(), LibrarySource{OCI: strings.TrimPrefix(tampered.URL, "https://") + "/acme/libs:1.0.0"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+}
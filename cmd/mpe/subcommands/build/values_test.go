@@ -0,0 +1,162 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/policydomain/parsers/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadValues(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yml", "env: dev\nrealm:\n  name: acme\n  prefix: dev\nreplicas: 1\n")
+	prod := writeFile(t, dir, "prod.yml", "env: prod\nrealm:\n  prefix: prod\n")
+
+	values, err := LoadValues([]string{base, prod}, []string{"realm.name=globex", "region=eu", "note=a=b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"env":      "prod",
+		"realm":    map[string]interface{}{"name": "globex", "prefix": "prod"},
+		"replicas": 1,
+		"region":   "eu",
+		"note":     "a=b",
+	}, values)
+}
+
+func TestLoadValues_Errors(t *testing.T) {
+	list := writeFile(t, t.TempDir(), "list.yml", "- a\n- b\n")
+
+	tests := []struct {
+		name        string
+		files       []string
+		assignments []string
+		error       string
+	}{
+		{"missing file", []string{"/nonexistent/values.yml"}, nil, "failed to read values file"},
+		{"not a mapping", []string{list}, nil, "failed to parse values file"},
+		{"no equals", nil, []string{"env"}, "must be key=value"},
+		{"empty key", nil, []string{"=prod"}, "must be key=value"},
+		{"empty field", nil, []string{"realm..name=acme"}, "must be key=value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadValues(tt.files, tt.assignments)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.error)
+		})
+	}
+}
+
+const templatedDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: app-{{ .Values.env }}
+spec:
+  data:
+    - name: realm
+      value: {{ .Values.realm.name | quote }}
+  policies:
+    - mrn: "mrn:iam:policy:allow"
+      name: allow
+      rego: |
+        package authz
+        default allow = 1
+  roles:
+    - mrn: "mrn:iam:{{ .Values.realm.name | lower }}:role:reader"
+      name: reader
+      policy: "mrn:iam:policy:allow"
+`
+
+func TestBuildFile_Values(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "app.yml", templatedDomain)
+
+	result := File(input, "", WithValues(map[string]interface{}{
+		"env":   "prod",
+		"realm": map[string]interface{}{"name": "Acme"},
+	}))
+	require.NoError(t, result.Error)
+
+	model, err := v1beta1.Load(result.OutputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "app-prod", model.Name)
+	assert.Equal(t, "Acme", model.Data[0].Value)
+	assert.Contains(t, model.Roles, "mrn:iam:acme:role:reader")
+
+	// the source is untouched
+	source, err := os.ReadFile(input)
+	require.NoError(t, err)
+	assert.Equal(t, templatedDomain, string(source))
+}
+
+func TestBuildFile_ValuesInclude(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yml", templatedDomain)
+	input := writeFile(t, dir, "stage.yml", `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+include: "`+base+`"
+metadata:
+  name: {{ .Values.env }}-override
+`)
+
+	result := File(input, "", WithValues(map[string]interface{}{
+		"env":   "stage",
+		"realm": map[string]interface{}{"name": "globex"},
+	}))
+	require.NoError(t, result.Error)
+
+	model, err := v1beta1.Load(result.OutputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "stage-override", model.Name)
+	assert.Contains(t, model.Roles, "mrn:iam:globex:role:reader")
+}
+
+func TestBuildFile_ValuesErrors(t *testing.T) {
+	values := map[string]interface{}{"env": "prod", "realm": map[string]interface{}{"name": "acme"}}
+
+	tests := []struct {
+		name    string
+		content string
+		error   string
+	}{
+		{"missing value", templatedDomain + "# {{ .Values.region }}\n", "failed to render template"},
+		{"bad template", templatedDomain + "# {{ .Values.env \n", "failed to parse template"},
+		{"invalid domain", "apiVersion: iamlite.manetu.io/v1beta1\nkind: PolicyDomainReference\nmetadata:\n  name: {{ .Values.env }}\nspec:\n  roles: {{ .Values.env }}\n", "rendered domain is invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := writeFile(t, t.TempDir(), "app.yml", tt.content)
+			result := File(input, "", WithValues(values))
+			require.Error(t, result.Error)
+			assert.Contains(t, result.Error.Error(), tt.error)
+		})
+	}
+}
+
+// TestBuildFile_WithoutValues tests that files are not rendered unless values are given
+func TestBuildFile_WithoutValues(t *testing.T) {
+	input := writeFile(t, t.TempDir(), "app.yml", `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: literal
+spec:
+  data:
+    - name: greeting
+      value: "{{ hello }}"
+`)
+
+	result := File(input, "")
+	require.NoError(t, result.Error)
+
+	model, err := v1beta1.Load(result.OutputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "{{ hello }}", model.Data[0].Value)
+}
@@ -0,0 +1,210 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/oci"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFile(name string) string {
+	return filepath.Join("../../test", name)
+}
+
+// memoryRegistry is a minimal OCI distribution registry that keeps its content in memory
+type memoryRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+}
+
+func newMemoryRegistry(t *testing.T) (*memoryRegistry, string) {
+	reg := &memoryRegistry{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	return reg, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func (m *memoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, path, _ := strings.Cut(r.URL.Path, "/v2/acme/policies/")
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && path == "blobs/uploads/":
+		w.Header().Set("Location", "/v2/acme/policies/blobs/uploads/1")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && path == "blobs/uploads/1":
+		digest := r.URL.Query().Get("digest")
+		if oci.VerifyDigest(body, digest) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.blobs[digest] = body
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "blobs/"):
+		blob, ok := m.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(blob)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "manifests/"):
+		m.manifests[strings.TrimPrefix(path, "manifests/")] = body
+		m.manifests[oci.Digest(body)] = body
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "manifests/"):
+		manifest, ok := m.manifests[strings.TrimPrefix(path, "manifests/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(manifest)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	reg, host := newMemoryRegistry(t)
+	opts := Options{PlainHTTP: true}
+	files := []string{testFile("consolidated.yml"), testFile("v1beta1-annotations.yml")}
+
+	ref, digest, err := Push(context.Background(), "oci://"+host+"/acme/policies:1.0", files, opts)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/acme/policies:1.0", ref.String())
+
+	var manifest oci.Manifest
+	require.NoError(t, json.Unmarshal(reg.manifests["1.0"], &manifest))
+	assert.Equal(t, ArtifactType, manifest.ArtifactType)
+	assert.Equal(t, oci.MediaTypeEmpty, manifest.Config.MediaType)
+	require.Len(t, manifest.Layers, 2)
+	assert.Equal(t, "000-consolidated.yml", manifest.Layers[0].Annotations[oci.AnnotationTitle])
+	assert.Equal(t, "001-v1beta1-annotations.yml", manifest.Layers[1].Annotations[oci.AnnotationTitle])
+	assert.Equal(t, "iamlite.manetu.io/v1beta1", manifest.Layers[1].Annotations[AnnotationSchemaVersion])
+	assert.Len(t, manifest.Layers[0].Annotations[AnnotationFingerprint], 64)
+	assert.NotEmpty(t, manifest.Annotations[AnnotationCreated])
+
+	for _, source := range []string{host + "/acme/policies:1.0", "oci://" + host + "/acme/policies@" + digest} {
+		dir := filepath.Join(t.TempDir(), "bundles")
+		bundles, pulled, err := Pull(context.Background(), source, dir, opts)
+		require.NoError(t, err)
+		assert.Equal(t, digest, pulled)
+		require.Len(t, bundles, 2)
+		assert.Equal(t, filepath.Join(dir, "000-consolidated.yml"), bundles[0].File)
+		assert.Equal(t, manifest.Layers[0].Annotations[AnnotationDomain], bundles[0].Domain)
+
+		original, err := os.ReadFile(files[0])
+		require.NoError(t, err)
+		written, err := os.ReadFile(bundles[0].File)
+		require.NoError(t, err)
+		assert.Equal(t, original, written)
+	}
+}
+
+func TestPushPull_MultipleDocuments(t *testing.T) {
+	reg, host := newMemoryRegistry(t)
+	opts := Options{PlainHTTP: true}
+
+	consolidated, err := os.ReadFile(testFile("consolidated.yml"))
+	require.NoError(t, err)
+	annotations, err := os.ReadFile(testFile("v1beta1-annotations.yml"))
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "bundle.yml")
+	require.NoError(t, os.WriteFile(file, []byte(string(consolidated)+"---\n"+string(annotations)), 0600))
+
+	// each domain is a layer of its own
+	_, _, err = Push(context.Background(), "oci://"+host+"/acme/policies:1.0", []string{file}, opts)
+	require.NoError(t, err)
+
+	var manifest oci.Manifest
+	require.NoError(t, json.Unmarshal(reg.manifests["1.0"], &manifest))
+	require.Len(t, manifest.Layers, 2)
+	assert.Equal(t, "000-bundle-1.yml", manifest.Layers[0].Annotations[oci.AnnotationTitle])
+	assert.Equal(t, "001-bundle-2.yml", manifest.Layers[1].Annotations[oci.AnnotationTitle])
+	assert.Equal(t, "iamlite.manetu.io/v1beta1", manifest.Layers[1].Annotations[AnnotationSchemaVersion])
+
+	bundles, _, err := Pull(context.Background(), host+"/acme/policies:1.0", t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, bundles, 2)
+	written, err := os.ReadFile(bundles[1].File)
+	require.NoError(t, err)
+	assert.Equal(t, annotations, written)
+}
+
+func TestPushErrors(t *testing.T) {
+	_, host := newMemoryRegistry(t)
+	opts := Options{PlainHTTP: true}
+
+	_, _, err := Push(context.Background(), "oci://"+host+"/acme/policies@sha256:"+strings.Repeat("0", 64), []string{testFile("consolidated.yml")}, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "use a tag")
+
+	_, _, err = Push(context.Background(), "oci://"+host+"/acme/policies:1.0", nil, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no bundles specified")
+
+	_, _, err = Push(context.Background(), "oci://"+host+"/acme/policies:1.0", []string{testFile("broken-beta.yml")}, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bundles failed validation")
+}
+
+func TestPullErrors(t *testing.T) {
+	reg, host := newMemoryRegistry(t)
+	opts := Options{PlainHTTP: true}
+
+	_, _, err := Push(context.Background(), host+"/acme/policies:1.0", []string{testFile("consolidated.yml")}, opts)
+	require.NoError(t, err)
+	var manifest oci.Manifest
+	require.NoError(t, json.Unmarshal(reg.manifests["1.0"], &manifest))
+
+	// publishes a variation of the pushed manifest under tag
+	publish := func(tag string, mutate func(*oci.Manifest)) {
+		var m oci.Manifest
+		require.NoError(t, json.Unmarshal(reg.manifests["1.0"], &m))
+		mutate(&m)
+		data, err := json.Marshal(&m)
+		require.NoError(t, err)
+		reg.manifests[tag] = data
+	}
+	publish("image", func(m *oci.Manifest) { m.ArtifactType = "application/vnd.oci.image.config.v1+json" })
+	publish("traversal", func(m *oci.Manifest) { m.Layers[0].Annotations[oci.AnnotationTitle] = "../escape.yml" })
+	publish("fingerprint", func(m *oci.Manifest) { m.Layers[0].Annotations[AnnotationFingerprint] = strings.Repeat("0", 64) })
+
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{tag: "image", expected: "is not a PolicyEngine bundle"},
+		{tag: "traversal", expected: "has invalid title '../escape.yml'"},
+		{tag: "fingerprint", expected: "fingerprint of '000-consolidated.yml'"},
+		{tag: "missing", expected: "404 Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			dir := t.TempDir()
+			_, _, err := Pull(context.Background(), host+"/acme/policies:"+tt.tag, dir, opts)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package bundle
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/oci"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/urfave/cli/v3"
+)
+
+// PulledBundle is a PolicyDomain file written by [Pull].
+type PulledBundle struct {
+	File          string
+	Domain        string
+	Fingerprint   string
+	SchemaVersion string
+}
+
+// ExecutePull runs the pull command with the provided context and CLI command.
+func ExecutePull(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("expected one artifact reference, such as oci://registry.example.com/policies:1.0")
+	}
+
+	outputDir := cmd.String("output")
+	if outputDir == "" {
+		outputDir = "."
+	}
+
+	bundles, digest, err := Pull(ctx, cmd.Args().First(), outputDir, Options{PlainHTTP: cmd.Bool("plain-http")})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bundles {
+		fmt.Printf("✓ %s (domain %s, %s, fingerprint %s)\n", b.File, b.Domain, b.SchemaVersion, b.Fingerprint)
+	}
+	fmt.Printf("\nPulled %d bundle(s) from %s\n", len(bundles), digest)
+	return nil
+}
+
+// Pull fetches the bundle artifact of source, verifies each PolicyDomain against its digest and
+// fingerprint, and writes them to outputDir. The files are validated together before any is
+// written. Returns the written bundles, in precedence order, and the digest of the manifest.
+func Pull(ctx context.Context, source, outputDir string, opts Options) ([]PulledBundle, string, error) {
+	ref, err := oci.ParseReference(source)
+	if err != nil {
+		return nil, "", err
+	}
+	repository := opts.client().Repository(ref)
+
+	manifest, raw, err := repository.GetManifest(ctx, ref.Reference)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching manifest of %s: %w", ref, err)
+	}
+	if manifest.ArtifactType != ArtifactType {
+		return nil, "", fmt.Errorf("%s is not a PolicyEngine bundle (artifact type '%s')", ref, manifest.ArtifactType)
+	}
+
+	contents := make([][]byte, len(manifest.Layers))
+	bundles := make([]PulledBundle, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		title := layer.Annotations[oci.AnnotationTitle]
+		if title == "" || title != filepath.Base(title) || title == "." || title == ".." {
+			return nil, "", fmt.Errorf("%s: layer %s has invalid title '%s'", ref, layer.Digest, title)
+		}
+		if layer.MediaType != MediaTypeDomain {
+			return nil, "", fmt.Errorf("%s: layer '%s' has unexpected media type '%s'", ref, title, layer.MediaType)
+		}
+
+		data, err := repository.GetBlob(ctx, layer.Digest)
+		if err != nil {
+			return nil, "", fmt.Errorf("fetching '%s' of %s: %w", title, ref, err)
+		}
+		domain, err := parsers.LoadFromBytes(title, data)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: failed to parse '%s': %w", ref, title, err)
+		}
+		fingerprint := hex.EncodeToString(domain.Fingerprint)
+		if expected := layer.Annotations[AnnotationFingerprint]; expected != fingerprint {
+			return nil, "", fmt.Errorf("%s: fingerprint of '%s' is %s, annotated %s", ref, title, fingerprint, expected)
+		}
+
+		contents[i] = data
+		bundles[i] = PulledBundle{
+			File:          filepath.Join(outputDir, title),
+			Domain:        domain.Name,
+			Fingerprint:   fingerprint,
+			SchemaVersion: layer.Annotations[AnnotationSchemaVersion],
+		}
+	}
+
+	// validate in a scratch directory, so that a broken bundle does not replace a working one
+	scratch, err := os.MkdirTemp("", "mpe-pull-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = os.RemoveAll(scratch) }()
+	var paths []string
+	for i, b := range bundles {
+		path := filepath.Join(scratch, filepath.Base(b.File))
+		if err := os.WriteFile(path, contents[i], 0600); err != nil {
+			return nil, "", err
+		}
+		paths = append(paths, path)
+	}
+	if _, err := registry.NewRegistry(paths); err != nil {
+		return nil, "", fmt.Errorf("%s failed validation: %w", ref, err)
+	}
+
+	if err := os.MkdirAll(outputDir, 0750); err != nil {
+		return nil, "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	for i, b := range bundles {
+		if err := os.WriteFile(b.File, contents[i], 0600); err != nil {
+			return nil, "", fmt.Errorf("failed to write '%s': %w", b.File, err)
+		}
+	}
+
+	return bundles, oci.Digest(raw), nil
+}
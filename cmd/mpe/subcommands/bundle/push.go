@@ -0,0 +1,170 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package bundle implements the push and pull subcommands, which distribute PolicyDomain
+// bundles as OCI artifacts through container registries, so that the registry's access
+// control governs who may publish and consume policies.
+//
+// A bundle artifact has an empty config and one layer per PolicyDomain, in precedence order.
+// Each layer is annotated with the name, fingerprint, and schema version of its domain.
+package bundle
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/common/oci"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Media types and annotations of bundle artifacts
+const (
+	ArtifactType    = "application/vnd.manetu.policyengine.bundle.v1"
+	MediaTypeDomain = "application/vnd.manetu.policyengine.domain.v1+yaml"
+
+	AnnotationDomain        = "io.manetu.policyengine.domain"
+	AnnotationDomains       = "io.manetu.policyengine.domains"
+	AnnotationFingerprint   = "io.manetu.policyengine.fingerprint"
+	AnnotationSchemaVersion = "io.manetu.policyengine.schema-version"
+	AnnotationCreated       = "org.opencontainers.image.created"
+)
+
+// emptyConfig is the content of the empty config blob of artifacts
+var emptyConfig = []byte("{}")
+
+// Options configures access to the registry.
+type Options struct {
+	// HTTP performs the requests; http.DefaultClient if nil.
+	HTTP *http.Client
+
+	// PlainHTTP contacts the registry over HTTP instead of HTTPS.
+	PlainHTTP bool
+}
+
+func (o Options) client() *oci.Client {
+	return &oci.Client{HTTP: o.HTTP, PlainHTTP: o.PlainHTTP}
+}
+
+// ExecutePush runs the push command with the provided context and CLI command.
+func ExecutePush(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 1 {
+		return fmt.Errorf("expected one artifact reference, such as oci://registry.example.com/policies:1.0")
+	}
+
+	files, err := registry.ExpandPaths(cmd.StringSlice("bundle"))
+	if err != nil {
+		return err
+	}
+	files, err = common.AutoBuildReferenceFiles(files)
+	if err != nil {
+		return err
+	}
+
+	ref, digest, err := Push(ctx, cmd.Args().First(), files, Options{PlainHTTP: cmd.Bool("plain-http")})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		fmt.Printf("✓ %s\n", file)
+	}
+	fmt.Printf("\nPushed %d bundle(s) to %s@%s\n", len(files), ref, digest)
+	return nil
+}
+
+// Push validates the PolicyDomain files together and publishes them as a bundle artifact
+// under the tag of target, returning the parsed reference and the digest of the manifest.
+func Push(ctx context.Context, target string, files []string, opts Options) (oci.Reference, string, error) {
+	ref, err := oci.ParseReference(target)
+	if err != nil {
+		return ref, "", err
+	}
+	if oci.IsDigest(ref.Reference) {
+		return ref, "", fmt.Errorf("cannot push to digest reference '%s', use a tag", target)
+	}
+	if len(files) == 0 {
+		return ref, "", fmt.Errorf("no bundles specified, use --bundle/-b to specify PolicyDomain files to push")
+	}
+
+	if _, err := registry.NewRegistry(files); err != nil {
+		return ref, "", fmt.Errorf("bundles failed validation: %w", err)
+	}
+
+	repository := opts.client().Repository(ref)
+
+	config, err := repository.PushBlob(ctx, oci.MediaTypeEmpty, emptyConfig)
+	if err != nil {
+		return ref, "", fmt.Errorf("pushing config to %s: %w", ref, err)
+	}
+
+	manifest := &oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeManifest,
+		ArtifactType:  ArtifactType,
+		Config:        config,
+		Annotations: map[string]string{
+			AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	var names []string
+	for _, file := range files {
+		data, err := os.ReadFile(file) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			return ref, "", err
+		}
+		// each domain of a file holding several is a layer of its own
+		docs, err := parsers.SplitDocuments(data)
+		if err != nil {
+			return ref, "", fmt.Errorf("failed to parse '%s': %w", file, err)
+		}
+
+		for j, doc := range docs {
+			domain, err := parsers.LoadFromBytes(file, doc.Data)
+			if err != nil {
+				return ref, "", fmt.Errorf("failed to parse '%s': %w", file, err)
+			}
+			var header parsers.Preamble
+			if err := yaml.Unmarshal(doc.Data, &header); err != nil {
+				return ref, "", fmt.Errorf("failed to parse '%s': %w", file, err)
+			}
+
+			layer, err := repository.PushBlob(ctx, MediaTypeDomain, doc.Data)
+			if err != nil {
+				return ref, "", fmt.Errorf("pushing '%s' to %s: %w", file, ref, err)
+			}
+			title := filepath.Base(file)
+			if len(docs) > 1 {
+				ext := filepath.Ext(title)
+				title = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(title, ext), j+1, ext)
+			}
+			// prefix with the position so that pulled files keep their precedence
+			layer.Annotations = map[string]string{
+				oci.AnnotationTitle:     fmt.Sprintf("%03d-%s", len(manifest.Layers), title),
+				AnnotationDomain:        domain.Name,
+				AnnotationFingerprint:   hex.EncodeToString(domain.Fingerprint),
+				AnnotationSchemaVersion: header.APIVersion,
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+			names = append(names, domain.Name)
+		}
+	}
+	manifest.Annotations[AnnotationDomains] = strings.Join(names, ",")
+
+	digest, err := repository.PushManifest(ctx, ref.Reference, manifest)
+	if err != nil {
+		return ref, "", fmt.Errorf("pushing manifest to %s: %w", ref, err)
+	}
+	return ref, digest, nil
+}
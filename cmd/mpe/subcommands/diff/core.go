@@ -0,0 +1,187 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package diff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/test"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	pdiff "github.com/manetu/policyengine/pkg/policydomain/diff"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/urfave/cli/v3"
+)
+
+// Execute runs the diff command, printing the semantic differences between two versions
+// of a set of PolicyDomain bundles. With --input, the decision test suite is evaluated
+// against both versions and any decisions that changed are reported.
+func Execute(ctx context.Context, cmd *cli.Command) error {
+	args := cmd.Args().Slice()
+	if len(args) != 2 {
+		return fmt.Errorf("expected two bundles to compare, e.g. 'mpe diff old.yml new.yml'")
+	}
+	oldPath, newPath := args[0], args[1]
+
+	oldBundles, err := resolveBundles(oldPath)
+	if err != nil {
+		return err
+	}
+	newBundles, err := resolveBundles(newPath)
+	if err != nil {
+		return err
+	}
+
+	oldDomains, err := loadDomains(oldBundles)
+	if err != nil {
+		return err
+	}
+	newDomains, err := loadDomains(newBundles)
+	if err != nil {
+		return err
+	}
+
+	changes := pdiff.Compare(oldDomains, newDomains)
+	printChanges(changes)
+
+	if input := cmd.String("input"); input != "" {
+		return diffDecisions(ctx, cmd, input, oldBundles, newBundles)
+	}
+
+	return nil
+}
+
+// resolveBundles expands a bundle path and builds any PolicyDomainReference files it contains
+func resolveBundles(path string) ([]string, error) {
+	bundles, err := registry.ExpandPaths([]string{path}, registry.KindPolicyDomain, build.KindPolicyDomainReference)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.AutoBuildReferenceFiles(bundles)
+}
+
+func loadDomains(bundles []string) (map[string]*policydomain.IntermediateModel, error) {
+	domains := make(map[string]*policydomain.IntermediateModel, len(bundles))
+	for _, bundle := range bundles {
+		loaded, err := parsers.LoadAll(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load '%s': %w", bundle, err)
+		}
+		for _, domain := range loaded {
+			if _, ok := domains[domain.Name]; ok {
+				return nil, fmt.Errorf("duplicate policy domain '%s' in '%s'", domain.Name, bundle)
+			}
+			domains[domain.Name] = domain
+		}
+	}
+
+	return domains, nil
+}
+
+func printChanges(changes []pdiff.Change) {
+	for _, c := range changes {
+		switch c.Type {
+		case pdiff.Added:
+			fmt.Printf("+ %s '%s' (domain '%s')\n", c.Kind, c.ID, c.Domain)
+		case pdiff.Removed:
+			fmt.Printf("- %s '%s' (domain '%s')\n", c.Kind, c.ID, c.Domain)
+		case pdiff.Modified:
+			fmt.Printf("~ %s '%s' (domain '%s')\n", c.Kind, c.ID, c.Domain)
+		}
+		for _, detail := range c.Details {
+			fmt.Printf("    %s\n", detail)
+		}
+		if c.RegoDiff != "" {
+			for _, line := range strings.Split(strings.TrimRight(c.RegoDiff, "\n"), "\n") {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+
+	fmt.Println("---")
+	if len(changes) == 0 {
+		fmt.Println("No semantic differences")
+		return
+	}
+	fmt.Printf("%d change(s)\n", len(changes))
+}
+
+// diffDecisions evaluates a decision test suite against both versions and reports changed decisions
+func diffDecisions(ctx context.Context, cmd *cli.Command, input string, oldBundles, newBundles []string) error {
+	suite, err := test.LoadTestSuite(input)
+	if err != nil {
+		return fmt.Errorf("failed to load test suite: %w", err)
+	}
+	if len(suite.Tests) == 0 {
+		return fmt.Errorf("no tests found in test suite")
+	}
+
+	oldEngine, err := policyEngine(cmd, oldBundles)
+	if err != nil {
+		return fmt.Errorf("failed to load old bundles: %w", err)
+	}
+	newEngine, err := policyEngine(cmd, newBundles)
+	if err != nil {
+		return fmt.Errorf("failed to load new bundles: %w", err)
+	}
+
+	fmt.Println()
+	fmt.Println("Decision changes:")
+
+	changed, failed := 0, 0
+	for _, tc := range suite.Tests {
+		porcJSON, err := json.Marshal(tc.PORC)
+		if err != nil {
+			fmt.Printf("%s: ERROR (failed to marshal PORC: %v)\n", tc.Name, err)
+			failed++
+			continue
+		}
+
+		before, err := oldEngine.Authorize(ctx, string(porcJSON))
+		if err != nil {
+			fmt.Printf("%s: ERROR (old: %v)\n", tc.Name, err)
+			failed++
+			continue
+		}
+		after, err := newEngine.Authorize(ctx, string(porcJSON))
+		if err != nil {
+			fmt.Printf("%s: ERROR (new: %v)\n", tc.Name, err)
+			failed++
+			continue
+		}
+
+		if before != after {
+			fmt.Printf("%s: %s → %s (expected %s)\n", tc.Name, decision(before), decision(after), decision(tc.Result.Allow))
+			changed++
+		}
+	}
+
+	fmt.Println("---")
+	fmt.Printf("%d of %d decision(s) changed\n", changed, len(suite.Tests))
+
+	if failed > 0 {
+		return fmt.Errorf("failed to evaluate %d test(s)", failed)
+	}
+	return nil
+}
+
+func policyEngine(cmd *cli.Command, bundles []string) (core.PolicyEngine, error) {
+	return common.NewBundlePolicyEngine(cmd, bundles, accesslog.NewNullFactory())
+}
+
+func decision(allow bool) string {
+	if allow {
+		return "GRANT"
+	}
+	return "DENY"
+}
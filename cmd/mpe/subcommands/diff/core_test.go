@@ -0,0 +1,85 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package diff
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func runDiff(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "diff",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "input", Aliases: []string{"i"}},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+		},
+		Action: Execute,
+	}
+	root := &cli.Command{
+		Name:     "mpe",
+		Flags:    []cli.Flag{&cli.BoolFlag{Name: "trace"}, &cli.StringSliceFlag{Name: "trace-filter"}},
+		Commands: []*cli.Command{cmd},
+	}
+	return root.Run(ctx, append([]string{"mpe", "diff"}, args...))
+}
+
+func TestExecute_NoDifferences(t *testing.T) {
+	out, err := clitest.CaptureStdout(func() error {
+		return runDiff(context.Background(), clitest.TestData("consolidated.yml"), clitest.TestData("consolidated.yml"))
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "No semantic differences")
+}
+
+func TestExecute_Differences(t *testing.T) {
+	modified := clitest.WriteModified(t, "consolidated.yml",
+		"policy: *allow-all\n      annotations:\n        - name: foo",
+		"policy: *no-access\n      annotations:\n        - name: foo")
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runDiff(context.Background(), clitest.TestData("consolidated.yml"), modified)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "~ role 'mrn:iam:role:admin'")
+	assert.Contains(t, out, "policy: mrn:iam:policy:allow-all → mrn:iam:policy:no-access")
+}
+
+func TestExecute_DecisionChanges(t *testing.T) {
+	modified := clitest.WriteModified(t, "consolidated.yml",
+		"policy: *allow-all\n      annotations:\n        - name: foo",
+		"policy: *no-access\n      annotations:\n        - name: foo")
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runDiff(context.Background(), "-i", clitest.TestData("example-decision-tests.yaml"), clitest.TestData("consolidated.yml"), modified)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "admin-can-access: GRANT → DENY (expected GRANT)")
+	assert.NotContains(t, out, "unauthenticated-denied")
+}
+
+func TestExecute_WrongArgumentCount(t *testing.T) {
+	err := runDiff(context.Background(), clitest.TestData("consolidated.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected two bundles")
+}
+
+func TestExecute_MissingBundle(t *testing.T) {
+	err := runDiff(context.Background(), clitest.TestData("consolidated.yml"), filepath.Join(t.TempDir(), "missing.yml"))
+	require.Error(t, err)
+}
+
+func TestLoadDomains_Duplicate(t *testing.T) {
+	_, err := loadDomains([]string{clitest.TestData("consolidated.yml"), clitest.TestData("consolidated.yml")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate policy domain")
+}
@@ -0,0 +1,80 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package format
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
+	pformat "github.com/manetu/policyengine/pkg/policydomain/format"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/urfave/cli/v3"
+)
+
+// Execute runs the fmt command, rewriting PolicyDomain YAML files in canonical form.
+// With --check, files are left untouched and the command fails if any would change.
+func Execute(_ context.Context, cmd *cli.Command) error {
+	files, err := registry.ExpandPaths(cmd.StringSlice("file"), registry.KindPolicyDomain, build.KindPolicyDomainReference)
+	if err != nil {
+		return err
+	}
+
+	check := cmd.Bool("check")
+	opts := pformat.Options{
+		RegoVersion: common.GetRegoVersionFromOPAFlags(cmd.Bool("no-opa-flags"), cmd.String("opa-flags")),
+	}
+
+	var changed, failed int
+	for _, file := range files {
+		data, err := os.ReadFile(file) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			fmt.Printf("✗ %s\n  Error: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		formatted, err := pformat.Format(data, opts)
+		if err != nil {
+			fmt.Printf("✗ %s\n  Error: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		if bytes.Equal(data, formatted) {
+			continue
+		}
+		changed++
+
+		if check {
+			fmt.Printf("✗ %s: needs formatting\n", file)
+			continue
+		}
+
+		if err := os.WriteFile(file, formatted, 0600); err != nil {
+			fmt.Printf("✗ %s\n  Error: %v\n", file, err)
+			failed++
+			continue
+		}
+		fmt.Printf("✓ %s: formatted\n", file)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("formatting failed: %d error(s)", failed)
+	}
+	if check && changed > 0 {
+		return fmt.Errorf("%d of %d file(s) need formatting, run 'mpe fmt' to fix", changed, len(files))
+	}
+
+	if check {
+		fmt.Printf("All %d file(s) are formatted\n", len(files))
+	} else {
+		fmt.Printf("Formatted %d of %d file(s)\n", changed, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package format
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func runFmt(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "fmt",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "file", Aliases: []string{"f"}},
+			&cli.BoolFlag{Name: "check"},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+		},
+		Action: Execute,
+	}
+	return cmd.Run(ctx, append([]string{"fmt"}, args...))
+}
+
+func TestExecute_CheckThenFormat(t *testing.T) {
+	dir := t.TempDir()
+	path := clitest.CopyTestData(t, dir, "alpha.yml")
+	original, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	err = runFmt(context.Background(), "--check", "-f", path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "need formatting")
+
+	unchanged, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, original, unchanged, "--check must not modify files")
+
+	require.NoError(t, runFmt(context.Background(), "-f", path))
+	require.NoError(t, runFmt(context.Background(), "--check", "-f", path))
+}
+
+func TestExecute_Directory(t *testing.T) {
+	dir := t.TempDir()
+	clitest.CopyTestData(t, dir, "alpha.yml")
+	clitest.CopyTestData(t, dir, "consolidated.yml")
+
+	require.NoError(t, runFmt(context.Background(), "-f", dir))
+	require.NoError(t, runFmt(context.Background(), "--check", "-f", dir))
+}
+
+func TestExecute_InvalidRego(t *testing.T) {
+	dir := t.TempDir()
+	path := clitest.CopyTestData(t, dir, "bad-rego.yml")
+
+	err := runFmt(context.Background(), "-f", path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "formatting failed")
+}
+
+func TestExecute_MissingFile(t *testing.T) {
+	err := runFmt(context.Background(), "-f", filepath.Join(t.TempDir(), "missing.yml"))
+	require.Error(t, err)
+}
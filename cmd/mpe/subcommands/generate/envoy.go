@@ -0,0 +1,302 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package generate
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/google/uuid"
+	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// EnvoyInputOptions describe the request of an Envoy ext_authz check
+type EnvoyInputOptions struct {
+	Method   string
+	Path     string // the path of the request, with its query, if any
+	Host     string
+	Scheme   string
+	Protocol string
+	Headers  []string // as 'Name: value'
+	Body     string
+	Token    string // the bearer token of the authorization header, if any
+
+	RequestID string // generated if empty
+
+	Source             string // the principal of the downstream peer, such as a SPIFFE ID
+	SourceAddress      string
+	SourceCertificate  []byte // the PEM certificate of the downstream peer, if mTLS
+	Destination        string
+	DestinationAddress string
+
+	ContextExtensions []string // as 'KEY=VALUE'
+	Metadata          []string // filter metadata, as 'NAMESPACE=JSON'
+}
+
+// ExecuteEnvoyInput runs the 'generate envoy-input' command, printing the attributes of an Envoy
+// ext_authz check as the mapper of 'mpe serve' receives them, for 'mpe test mapper' or
+// 'mpe test envoy'.
+func ExecuteEnvoyInput(_ context.Context, cmd *cli.Command) error {
+	opts := EnvoyInputOptions{
+		Method:             cmd.String("method"),
+		Path:               cmd.String("path"),
+		Host:               cmd.String("host"),
+		Scheme:             cmd.String("scheme"),
+		Protocol:           cmd.String("protocol"),
+		Headers:            cmd.StringSlice("header"),
+		Body:               cmd.String("body"),
+		RequestID:          cmd.String("request-id"),
+		Source:             cmd.String("source"),
+		SourceAddress:      cmd.String("source-address"),
+		Destination:        cmd.String("destination"),
+		DestinationAddress: cmd.String("destination-address"),
+		ContextExtensions:  cmd.StringSlice("context-extension"),
+		Metadata:           cmd.StringSlice("metadata"),
+	}
+
+	if path := cmd.String("jwt"); path != "" {
+		data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			return fmt.Errorf("failed to read JWT: %w", err)
+		}
+		if opts.Token, err = EncodeToken(data); err != nil {
+			return fmt.Errorf("invalid JWT %s: %w", path, err)
+		}
+	}
+
+	if path := cmd.String("source-cert"); path != "" {
+		data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			return fmt.Errorf("failed to read certificate: %w", err)
+		}
+		opts.SourceCertificate = data
+	}
+
+	attrs, err := NewEnvoyAttributes(opts)
+	if err != nil {
+		return err
+	}
+
+	input, err := envoy.MapperInput(attrs)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(input, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// EncodeToken returns the bearer token of a JWT file: either a token, or the JSON object of
+// its claims, which is encoded as an unsigned token. Mappers decode tokens without verifying
+// them, since Envoy's jwt_authn filter does so before the check.
+func EncodeToken(data []byte) (string, error) {
+	text := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(text, "{") {
+		if strings.Count(text, ".") != 2 {
+			return "", fmt.Errorf("neither a token nor a JSON object of claims")
+		}
+		return text, nil
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &claims); err != nil {
+		return "", err
+	}
+	return unsignedToken(claims)
+}
+
+// unsignedToken returns a token with claims whose algorithm is "none"
+func unsignedToken(claims map[string]interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".", nil
+}
+
+// NewEnvoyAttributes returns the attributes that Envoy sends with the check of a request, with
+// the headers that Envoy adds, such as the pseudo-headers and x-request-id
+func NewEnvoyAttributes(opts EnvoyInputOptions) (*authv3.AttributeContext, error) {
+	if !strings.HasPrefix(opts.Path, "/") {
+		return nil, fmt.Errorf("invalid path '%s': must start with '/'", opts.Path)
+	}
+
+	requestID := opts.RequestID
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+
+	headers := map[string]string{
+		":authority":        opts.Host,
+		":method":           opts.Method,
+		":path":             opts.Path,
+		":scheme":           opts.Scheme,
+		"x-forwarded-proto": opts.Scheme,
+		"x-request-id":      requestID,
+	}
+	if opts.Token != "" {
+		headers["authorization"] = "Bearer " + opts.Token
+	}
+	if opts.Body != "" {
+		headers["content-length"] = strconv.Itoa(len(opts.Body))
+	}
+	for _, header := range opts.Headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header '%s': must be 'Name: value'", header)
+		}
+		// Envoy lowercases the names of the headers it passes
+		headers[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+
+	_, query, _ := strings.Cut(opts.Path, "?")
+	size := int64(-1)
+	if opts.Body != "" {
+		size = int64(len(opts.Body))
+	}
+
+	source, err := newPeer(opts.Source, opts.SourceAddress, opts.SourceCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source: %w", err)
+	}
+	destination, err := newPeer(opts.Destination, opts.DestinationAddress, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %w", err)
+	}
+
+	extensions, err := parseAssignments(opts.ContextExtensions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid context extension: %w", err)
+	}
+	metadata, err := parseMetadata(opts.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	return &authv3.AttributeContext{
+		Source:      source,
+		Destination: destination,
+		Request: &authv3.AttributeContext_Request{
+			Time: timestamppb.Now(),
+			Http: &authv3.AttributeContext_HttpRequest{
+				Id:       requestID,
+				Method:   opts.Method,
+				Headers:  headers,
+				Path:     opts.Path,
+				Host:     opts.Host,
+				Scheme:   opts.Scheme,
+				Query:    query,
+				Size:     size,
+				Protocol: opts.Protocol,
+				Body:     opts.Body,
+			},
+		},
+		ContextExtensions:    extensions,
+		MetadataContext:      &corev3.Metadata{FilterMetadata: metadata},
+		RouteMetadataContext: &corev3.Metadata{},
+	}, nil
+}
+
+// newPeer returns a peer of a check, whose principal is taken from the URI SAN of its
+// certificate unless given
+func newPeer(principal, address string, certificate []byte) (*authv3.AttributeContext_Peer, error) {
+	peer := &authv3.AttributeContext_Peer{Principal: principal}
+
+	if address != "" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		portValue, err := strconv.ParseUint(port, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port '%s'", port)
+		}
+		peer.Address = &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+			Address:       host,
+			PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(portValue)},
+		}}}
+	}
+
+	if len(certificate) > 0 {
+		block, _ := pem.Decode(certificate)
+		if block == nil {
+			return nil, fmt.Errorf("certificate is not PEM encoded")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if peer.Principal == "" && len(cert.URIs) > 0 {
+			peer.Principal = cert.URIs[0].String()
+		}
+		// Envoy passes the URL-encoded PEM of the peer's certificate
+		peer.Certificate = url.PathEscape(string(pem.EncodeToMemory(block)))
+	}
+
+	return peer, nil
+}
+
+// parseAssignments parses 'KEY=VALUE' assignments
+func parseAssignments(assignments []string) (map[string]string, error) {
+	values := make(map[string]string, len(assignments))
+	for _, assignment := range assignments {
+		key, value, ok := strings.Cut(assignment, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("'%s' must be 'KEY=VALUE'", assignment)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// parseMetadata parses 'NAMESPACE=JSON' filter metadata, merging the objects of a namespace
+func parseMetadata(assignments []string) (map[string]*structpb.Struct, error) {
+	metadata := make(map[string]*structpb.Struct, len(assignments))
+	for _, assignment := range assignments {
+		namespace, document, ok := strings.Cut(assignment, "=")
+		if !ok || namespace == "" {
+			return nil, fmt.Errorf("'%s' must be 'NAMESPACE=JSON'", assignment)
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(document), &fields); err != nil {
+			return nil, fmt.Errorf("'%s' is not a JSON object: %w", namespace, err)
+		}
+		if existing, ok := metadata[namespace]; ok {
+			for key, value := range existing.AsMap() {
+				if _, ok := fields[key]; !ok {
+					fields[key] = value
+				}
+			}
+		}
+
+		s, err := structpb.NewStruct(fields)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", namespace, err)
+		}
+		metadata[namespace] = s
+	}
+	return metadata, nil
+}
@@ -0,0 +1,165 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package generate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeToken(t *testing.T) {
+	token, err := EncodeToken([]byte(`{"sub": "alice", "mroles": ["mrn:iam:role:admin"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJtcm9sZXMiOlsibXJuOmlhbTpyb2xlOmFkbWluIl0sInN1YiI6ImFsaWNlIn0.", token)
+
+	// tokens are passed as they are
+	token, err = EncodeToken([]byte("aaa.bbb.ccc\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "aaa.bbb.ccc", token)
+
+	_, err = EncodeToken([]byte("not a token"))
+	assert.Error(t, err)
+	_, err = EncodeToken([]byte("{not json"))
+	assert.Error(t, err)
+}
+
+func TestNewEnvoyAttributes(t *testing.T) {
+	attrs, err := NewEnvoyAttributes(EnvoyInputOptions{
+		Method:             "POST",
+		Path:               "/pets?limit=10",
+		Host:               "petstore.example.com",
+		Scheme:             "https",
+		Protocol:           "HTTP/2",
+		Headers:            []string{"X-Tenant-ID: acme", "Content-Type:application/json"},
+		Body:               `{"name": "rex"}`,
+		Token:              "aaa.bbb.ccc",
+		RequestID:          "req-1",
+		Destination:        "spiffe://cluster.local/ns/default/sa/petstore",
+		DestinationAddress: "10.0.0.3:8080",
+		ContextExtensions:  []string{"service=petstore"},
+		Metadata:           []string{`envoy.filters.http.jwt_authn={"tenant": "acme"}`, `envoy.filters.http.jwt_authn={"tier": "gold"}`},
+	})
+	require.NoError(t, err)
+
+	http := attrs.GetRequest().GetHttp()
+	assert.Equal(t, "req-1", http.GetId())
+	assert.Equal(t, "/pets?limit=10", http.GetPath())
+	assert.Equal(t, "limit=10", http.GetQuery())
+	assert.Equal(t, int64(15), http.GetSize())
+	assert.Equal(t, map[string]string{
+		":authority":        "petstore.example.com",
+		":method":           "POST",
+		":path":             "/pets?limit=10",
+		":scheme":           "https",
+		"x-forwarded-proto": "https",
+		"x-request-id":      "req-1",
+		"authorization":     "Bearer aaa.bbb.ccc",
+		"content-length":    "15",
+		"x-tenant-id":       "acme",
+		"content-type":      "application/json",
+	}, http.GetHeaders())
+
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/petstore", attrs.GetDestination().GetPrincipal())
+	assert.Equal(t, uint32(8080), attrs.GetDestination().GetAddress().GetSocketAddress().GetPortValue())
+	assert.Equal(t, map[string]string{"service": "petstore"}, attrs.GetContextExtensions())
+	assert.Equal(t, map[string]interface{}{"tenant": "acme", "tier": "gold"}, attrs.GetMetadataContext().GetFilterMetadata()["envoy.filters.http.jwt_authn"].AsMap())
+
+	// a request id is generated, and there is no body
+	attrs, err = NewEnvoyAttributes(EnvoyInputOptions{Method: "GET", Path: "/"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, attrs.GetRequest().GetHttp().GetId())
+	assert.Equal(t, int64(-1), attrs.GetRequest().GetHttp().GetSize())
+}
+
+func TestNewEnvoyAttributes_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     EnvoyInputOptions
+		expected string
+	}{
+		{"relative path", EnvoyInputOptions{Path: "pets"}, "invalid path 'pets'"},
+		{"header", EnvoyInputOptions{Path: "/", Headers: []string{"x-tenant=acme"}}, "invalid header 'x-tenant=acme'"},
+		{"address", EnvoyInputOptions{Path: "/", SourceAddress: "10.0.0.2"}, "invalid source"},
+		{"context extension", EnvoyInputOptions{Path: "/", ContextExtensions: []string{"service"}}, "invalid context extension"},
+		{"metadata", EnvoyInputOptions{Path: "/", Metadata: []string{"ns=[1]"}}, "invalid metadata"},
+		{"certificate", EnvoyInputOptions{Path: "/", SourceCertificate: []byte("not a certificate")}, "certificate is not PEM encoded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEnvoyAttributes(tt.opts)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestNewEnvoyAttributes_SourceCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	spiffe, err := url.Parse("spiffe://cluster.local/ns/default/sa/client")
+	require.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), URIs: []*url.URL{spiffe}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	attrs, err := NewEnvoyAttributes(EnvoyInputOptions{Path: "/", SourceCertificate: certificate})
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/client", attrs.GetSource().GetPrincipal())
+
+	decoded, err := url.PathUnescape(attrs.GetSource().GetCertificate())
+	require.NoError(t, err)
+	assert.Equal(t, string(certificate), decoded)
+
+	// a principal that is given is kept
+	attrs, err = NewEnvoyAttributes(EnvoyInputOptions{Path: "/", Source: "spiffe://other", SourceCertificate: certificate})
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://other", attrs.GetSource().GetPrincipal())
+}
+
+func TestNewEnvoyAttributes_Mapper(t *testing.T) {
+	token, err := EncodeToken([]byte(`{"sub": "alice"}`))
+	require.NoError(t, err)
+	attrs, err := NewEnvoyAttributes(EnvoyInputOptions{Method: "GET", Path: "/pets", Token: token, Destination: "spiffe://cluster.local/ns/default/sa/petstore"})
+	require.NoError(t, err)
+	input, err := envoy.MapperInput(attrs)
+	require.NoError(t, err)
+
+	// the input is read as it would be by a mapper deployed with mpe serve
+	compiled, err := opa.NewCompiler(opa.WithRegoVersion(ast.RegoV1)).Compile("mapper", opa.Modules{"mapper.rego": `package mapper
+
+http := input.request.http
+claims := io.jwt.decode(split(http.headers.authorization, "Bearer ")[1])[1]
+
+porc := {
+	"principal": claims,
+	"operation": sprintf("%s:http:%s", [split(input.destination.principal, "/")[6], lower(http.method)]),
+	"resource": http.path,
+}
+`})
+	require.NoError(t, err)
+	porc, perr := (&model.Mapper{Ast: compiled}).Evaluate(context.Background(), input)
+	require.Nil(t, perr)
+	assert.Equal(t, map[string]interface{}{
+		"principal": map[string]interface{}{"sub": "alice"},
+		"operation": "petstore:http:get",
+		"resource":  "/pets",
+	}, porc)
+}
@@ -0,0 +1,235 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package generate
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// SigningKey is a private key that signs test tokens, along with the algorithm and key ID that
+// they carry in their header
+type SigningKey struct {
+	key       jwk.Key
+	algorithm jwa.SignatureAlgorithm
+}
+
+// ExecuteJWT runs the 'generate jwt' command, printing a token with the claims of a YAML or JSON
+// file, signed with a PEM private key, or unsigned if none is given. The public key is written
+// as a JWKS if requested, for mappers and tests that verify tokens.
+func ExecuteJWT(_ context.Context, cmd *cli.Command) error {
+	path := cmd.String("claims")
+	claims, err := LoadClaims(path)
+	if err != nil {
+		return err
+	}
+
+	if expires := cmd.Duration("expires"); expires > 0 {
+		now := time.Now().Unix()
+		claims["iat"] = now
+		claims["exp"] = now + int64(expires/time.Second)
+	}
+
+	keyPath := cmd.String("sign")
+	if keyPath == "" {
+		if cmd.String("jwks") != "" {
+			return fmt.Errorf("--jwks requires --sign")
+		}
+		token, err := unsignedToken(claims)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	}
+
+	data, err := os.ReadFile(keyPath) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := NewSigningKey(data, cmd.String("alg"), cmd.String("kid"))
+	if err != nil {
+		return fmt.Errorf("invalid signing key %s: %w", keyPath, err)
+	}
+
+	token, err := key.Sign(claims)
+	if err != nil {
+		return err
+	}
+
+	if jwksPath := cmd.String("jwks"); jwksPath != "" {
+		jwks, err := key.JWKS()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(jwksPath, append(jwks, '\n'), 0o600); err != nil {
+			return fmt.Errorf("failed to write JWKS: %w", err)
+		}
+	}
+
+	fmt.Println(token)
+	return nil
+}
+
+// LoadClaims reads the claims of a token from a YAML or JSON file
+func LoadClaims(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return nil, fmt.Errorf("failed to read claims: %w", err)
+	}
+
+	var claims map[string]interface{}
+	if err := yaml.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse claims %s: %w", path, err)
+	}
+	if claims == nil {
+		return nil, fmt.Errorf("claims %s must be an object", path)
+	}
+	return claims, nil
+}
+
+// NewSigningKey returns the signing key of a PEM private key: RSA, ECDSA, or Ed25519. The
+// algorithm defaults to the one that the key type implies, such as RS256 for RSA, and the key
+// ID to the RFC 7638 thumbprint of the key, so that the same key always has the same ID.
+func NewSigningKey(data []byte, algorithm string, kid string) (*SigningKey, error) {
+	raw, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithm == "" {
+		if algorithm, err = defaultAlgorithm(raw); err != nil {
+			return nil, err
+		}
+	}
+	alg, ok := jwa.LookupSignatureAlgorithm(algorithm)
+	if !ok || alg == jwa.NoSignature() {
+		return nil, fmt.Errorf("unsupported algorithm '%s'", algorithm)
+	}
+
+	key, err := jwk.Import(raw)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		kid = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.AlgorithmKey, alg); err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{key: key, algorithm: alg}, nil
+}
+
+// Sign returns a signed token with claims, whose header carries the key ID
+func (k *SigningKey) Sign(claims map[string]interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, "JWT"); err != nil {
+		return "", err
+	}
+	if err := headers.Set(jws.KeyIDKey, k.KeyID()); err != nil {
+		return "", err
+	}
+
+	token, err := jws.Sign(payload, jws.WithKey(k.algorithm, k.key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token with %s: %w", k.algorithm, err)
+	}
+	return string(token), nil
+}
+
+// KeyID returns the ID of the key, as carried by the tokens that it signs
+func (k *SigningKey) KeyID() string {
+	kid, _ := k.key.KeyID()
+	return kid
+}
+
+// JWKS returns the JSON Web Key Set of the public key, which verifies the tokens that k signs
+func (k *SigningKey) JWKS() ([]byte, error) {
+	public, err := jwk.PublicKeyOf(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if err := public.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+		return nil, err
+	}
+
+	set := jwk.NewSet()
+	if err := set.AddKey(public); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(set, "", "  ")
+}
+
+// parsePrivateKey parses a PEM private key, in PKCS #8, or in the PKCS #1 or SEC 1 encodings
+// of OpenSSL
+func parsePrivateKey(data []byte) (any, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key is not PEM encoded")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block '%s': must be a private key", block.Type)
+	}
+}
+
+// defaultAlgorithm returns the signature algorithm that the type of a private key implies
+func defaultAlgorithm(key any) (string, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return "RS256", nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return "EdDSA", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+}
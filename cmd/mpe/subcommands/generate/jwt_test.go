@@ -0,0 +1,184 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package generate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeKey(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func testKeys(t *testing.T) map[string][]byte {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	return map[string][]byte{
+		"RS256": encodeKey("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		"ES384": encodeKey("EC PRIVATE KEY", ecDER),
+		"EdDSA": encodeKey("PRIVATE KEY", edDER),
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	claims := map[string]interface{}{"sub": "alice", "mroles": []interface{}{"mrn:iam:role:editor"}}
+
+	for alg, data := range testKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			key, err := NewSigningKey(data, "", "")
+			require.NoError(t, err)
+			assert.NotEmpty(t, key.KeyID())
+
+			// the key ID is the thumbprint, so that it is stable
+			again, err := NewSigningKey(data, "", "")
+			require.NoError(t, err)
+			assert.Equal(t, key.KeyID(), again.KeyID())
+
+			token, err := key.Sign(claims)
+			require.NoError(t, err)
+
+			data, err := key.JWKS()
+			require.NoError(t, err)
+			set, err := jwk.Parse(data)
+			require.NoError(t, err)
+			require.Equal(t, 1, set.Len())
+			public, _ := set.Key(0)
+			kid, _ := public.KeyID()
+			assert.Equal(t, key.KeyID(), kid)
+
+			msg, err := jws.Parse([]byte(token))
+			require.NoError(t, err)
+			headers := msg.Signatures()[0].ProtectedHeaders()
+			headerKid, _ := headers.KeyID()
+			headerAlg, _ := headers.Algorithm()
+			assert.Equal(t, key.KeyID(), headerKid)
+			assert.Equal(t, alg, headerAlg.String())
+
+			payload, err := jws.Verify([]byte(token), jws.WithKeySet(set))
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"sub": "alice", "mroles": ["mrn:iam:role:editor"]}`, string(payload))
+		})
+	}
+}
+
+func TestNewSigningKey_Options(t *testing.T) {
+	data := testKeys(t)["RS256"]
+
+	key, err := NewSigningKey(data, "PS512", "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, "test-key", key.KeyID())
+	_, err = key.Sign(map[string]interface{}{"sub": "alice"})
+	require.NoError(t, err)
+
+	for _, alg := range []string{"none", "XX256"} {
+		_, err = NewSigningKey(data, alg, "")
+		assert.ErrorContains(t, err, "unsupported algorithm")
+	}
+
+	// the algorithm must suit the key
+	key, err = NewSigningKey(data, "ES256", "")
+	require.NoError(t, err)
+	_, err = key.Sign(map[string]interface{}{"sub": "alice"})
+	assert.Error(t, err)
+}
+
+func TestNewSigningKey_Invalid(t *testing.T) {
+	_, err := NewSigningKey([]byte("not a key"), "", "")
+	assert.ErrorContains(t, err, "not PEM encoded")
+
+	_, err = NewSigningKey(encodeKey("CERTIFICATE", []byte("der")), "", "")
+	assert.ErrorContains(t, err, "must be a private key")
+
+	_, err = NewSigningKey(encodeKey("PRIVATE KEY", []byte("der")), "", "")
+	assert.Error(t, err)
+}
+
+func TestLoadClaims(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "claims.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("sub: alice\nmroles:\n  - mrn:iam:role:editor\nmannotations:\n  tier: gold\n"), 0o600))
+	claims, err := LoadClaims(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"sub":          "alice",
+		"mroles":       []interface{}{"mrn:iam:role:editor"},
+		"mannotations": map[string]interface{}{"tier": "gold"},
+	}, claims)
+
+	path = filepath.Join(dir, "claims.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"sub": "bob"}`), 0o600))
+	claims, err = LoadClaims(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"sub": "bob"}, claims)
+
+	path = filepath.Join(dir, "list.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("- sub\n"), 0o600))
+	_, err = LoadClaims(path)
+	assert.Error(t, err)
+
+	_, err = LoadClaims(filepath.Join(dir, "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to read claims")
+}
+
+func TestSigningKey_Mapper(t *testing.T) {
+	key, err := NewSigningKey(testKeys(t)["RS256"], "", "")
+	require.NoError(t, err)
+	token, err := key.Sign(map[string]interface{}{"sub": "alice", "mroles": []interface{}{"mrn:iam:role:editor"}})
+	require.NoError(t, err)
+	jwks, err := key.JWKS()
+	require.NoError(t, err)
+
+	attrs, err := NewEnvoyAttributes(EnvoyInputOptions{Method: "GET", Path: "/pets", Token: token})
+	require.NoError(t, err)
+	input, err := envoy.MapperInput(attrs)
+	require.NoError(t, err)
+
+	// a mapper that verifies tokens against the JWKS extracts the principal from the claims
+	compiled, err := opa.NewCompiler(opa.WithRegoVersion(ast.RegoV1)).Compile("mapper", opa.Modules{"mapper.rego": fmt.Sprintf(`package mapper
+
+jwks := %s
+
+token := split(input.request.http.headers.authorization, "Bearer ")[1]
+verified := io.jwt.decode_verify(token, {"cert": jwks})
+
+porc := {"principal": verified[2]} if verified[0]
+`, "`"+string(jwks)+"`")})
+	require.NoError(t, err)
+	porc, perr := (&model.Mapper{Ast: compiled}).Evaluate(context.Background(), input)
+	require.Nil(t, perr)
+	assert.Equal(t, map[string]interface{}{
+		"principal": map[string]interface{}{"sub": "alice", "mroles": []interface{}{"mrn:iam:role:editor"}},
+	}, porc)
+}
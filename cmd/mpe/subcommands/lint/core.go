@@ -12,8 +12,11 @@ import (
 	"strings"
 
 	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/common/watch"
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
 	"github.com/manetu/policyengine/pkg/policydomain/lint"
 	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/urfave/cli/v3"
 )
 
@@ -24,6 +27,29 @@ func Execute(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("no files specified, use --file/-f to specify YAML files to lint")
 	}
 
+	if !cmd.Bool("watch") {
+		return run(ctx, cmd, files)
+	}
+
+	w := &watch.Watcher{
+		Files: func() []string {
+			var watched []string
+			for _, file := range files {
+				watched = append(watched, build.References(file)...)
+			}
+			return watched
+		},
+		Run: func() {
+			if err := run(ctx, cmd, files); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+	return w.Watch(ctx)
+}
+
+// run lints the files once, as Execute does without --watch
+func run(ctx context.Context, cmd *cli.Command, files []string) error {
 	// Filter to supported file types up-front
 	var yamlFiles []string
 	for _, file := range files {
@@ -59,6 +85,15 @@ func Execute(ctx context.Context, cmd *cli.Command) error {
 		EnableRegal: cmd.Bool("regal"),
 	}
 
+	// Declarations for custom built-ins registered by the embedding application
+	if capabilities := cmd.String("capabilities"); capabilities != "" {
+		caps, err := ast.LoadCapabilitiesFile(capabilities)
+		if err != nil {
+			return fmt.Errorf("failed to load capabilities from %s: %w", capabilities, err)
+		}
+		opts.Builtins = caps.Builtins
+	}
+
 	if opts.EnableRegal {
 		fmt.Println("Running Regal linting...")
 		fmt.Println()
@@ -163,6 +198,20 @@ func printDiagnostic(d lint.Diagnostic) {
 		fmt.Printf("  OPA Check Error: %s\n", d.Message)
 		fmt.Println()
 
+	case lint.SourceShadow:
+		fmt.Printf("⚠ %s (%s '%s' at line %d)\n", file, d.Entity.Type, d.Entity.ID, d.Location.Start.Line)
+		fmt.Printf("  Warning: %s\n", d.Message)
+		fmt.Println()
+
+	case lint.SourceAmbiguity:
+		if d.Location.Start.Line > 0 {
+			fmt.Printf("⚠ %s (%s '%s' at line %d)\n", file, d.Entity.Type, d.Entity.ID, d.Location.Start.Line)
+		} else {
+			fmt.Printf("⚠ %s (%s '%s')\n", file, d.Entity.Type, d.Entity.ID)
+		}
+		fmt.Printf("  Warning: %s\n", d.Message)
+		fmt.Println()
+
 	case lint.SourceRegal:
 		if d.Location.Start.Line > 0 {
 			fmt.Printf("✗ %s (Regal: %s in %s '%s' at line %d)\n",
@@ -192,28 +241,30 @@ func regalTitle(d lint.Diagnostic) string {
 
 // printFileSuccesses prints ✓ lines for each Rego entity in a file that had no errors.
 func printFileSuccesses(file string) {
-	from, err := parsers.Load(file)
+	domains, err := parsers.LoadAll(file)
 	if err != nil {
 		fmt.Printf("✓ %s: Valid YAML\n", file)
 		return
 	}
-	for libID, library := range from.PolicyLibraries {
-		if strings.TrimSpace(library.Rego) != "" {
-			fmt.Printf("✓ %s: Valid Rego in library '%s'\n", file, libID)
+	for _, from := range domains {
+		for libID, library := range from.PolicyLibraries {
+			if strings.TrimSpace(library.Rego) != "" {
+				fmt.Printf("✓ %s: Valid Rego in library '%s'\n", file, libID)
+			}
 		}
-	}
-	for policyID, policy := range from.Policies {
-		if strings.TrimSpace(policy.Rego) != "" {
-			fmt.Printf("✓ %s: Valid Rego in policy '%s'\n", file, policyID)
+		for policyID, policy := range from.Policies {
+			if strings.TrimSpace(policy.Rego) != "" {
+				fmt.Printf("✓ %s: Valid Rego in policy '%s'\n", file, policyID)
+			}
 		}
-	}
-	for i, mapper := range from.Mappers {
-		if strings.TrimSpace(mapper.Rego) != "" {
-			mapperID := mapper.IDSpec.ID
-			if mapperID == "" {
-				mapperID = fmt.Sprintf("mapper[%d]", i)
+		for i, mapper := range from.Mappers {
+			if strings.TrimSpace(mapper.Rego) != "" {
+				mapperID := mapper.IDSpec.ID
+				if mapperID == "" {
+					mapperID = fmt.Sprintf("mapper[%d]", i)
+				}
+				fmt.Printf("✓ %s: Valid Rego in mapper '%s'\n", file, mapperID)
 			}
-			fmt.Printf("✓ %s: Valid Rego in mapper '%s'\n", file, mapperID)
 		}
 	}
 }
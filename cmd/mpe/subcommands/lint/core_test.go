@@ -289,6 +289,7 @@ func executeCmd(ctx context.Context, args []string) error {
 			&cli.StringFlag{Name: "opa-flags"},
 			&cli.BoolFlag{Name: "no-opa-flags"},
 			&cli.BoolFlag{Name: "regal"},
+			&cli.StringFlag{Name: "capabilities"},
 		},
 		Action: Execute,
 	}
@@ -348,6 +349,39 @@ func TestExecute_OpaFlagsEnvVar(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestExecute_Capabilities(t *testing.T) {
+	f := createTempFileWithContent(t, `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: custom-builtins
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:classified"
+      rego: |
+        package authz
+        default allow = false
+        allow { classification.compare(input.principal.mannotations.clearance, "secret") >= 0 }
+`)
+	err := executeCmd(context.Background(), []string{"--file", f})
+	require.Error(t, err)
+
+	caps := filepath.Join(t.TempDir(), "capabilities.json")
+	require.NoError(t, os.WriteFile(caps, []byte(`{
+  "builtins": [
+    {
+      "name": "classification.compare",
+      "decl": {"type": "function", "args": [{"type": "any"}, {"type": "string"}], "result": {"type": "number"}}
+    }
+  ]
+}`), 0600))
+	err = executeCmd(context.Background(), []string{"--file", f, "--capabilities", caps})
+	require.NoError(t, err)
+
+	err = executeCmd(context.Background(), []string{"--file", f, "--capabilities", filepath.Join(t.TempDir(), "missing.json")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load capabilities")
+}
+
 // ---------------------------------------------------------------------------
 // Execute() — error paths that exercise printDiagnostic branches
 // ---------------------------------------------------------------------------
@@ -0,0 +1,296 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/policydomain/lint"
+	"gopkg.in/yaml.v3"
+)
+
+// prepared is a document made ready to lint
+type prepared struct {
+	// text is the lintable text, line for line the document
+	text string
+	// diagnostics are the problems found preparing it
+	diagnostics []Diagnostic
+	// files maps the 1-based lines whose Rego was read from a file to the file
+	files map[int]string
+	// yamlOnly is set for documents whose content depends on files merged or fetched at
+	// build time, which are only checked for YAML syntax
+	yamlOnly bool
+	// domains are the names of the domains it declares
+	domains []string
+	// policy is set for documents of a PolicyDomain kind; other YAML is not checked
+	policy bool
+}
+
+// policyKinds are the kinds of the documents the server checks
+var policyKinds = map[string]bool{"PolicyDomain": true, "PolicyDomainReference": true, "PolicyDomainList": true}
+
+// prepare makes a document lintable. The .rego and data files a PolicyDomainReference
+// references are inlined on the lines referencing them, and its kind is read as
+// PolicyDomain, so that the positions of the diagnostics hold for the document as written.
+// Relative paths are resolved against dir, as 'mpe build' resolves them against the
+// directory it is run from.
+func prepare(text, dir string) prepared {
+	p := prepared{files: map[int]string{}}
+	lines := strings.Split(text, "\n")
+
+	for _, root := range parseDocuments(text) {
+		for _, domain := range domainRoots(root) {
+			if metadata := value(domain, "metadata"); metadata != nil {
+				p.domains = append(p.domains, scalar(metadata, "name"))
+			}
+		}
+
+		kind := value(root, "kind")
+		if kind != nil && policyKinds[kind.Value] {
+			p.policy = true
+		}
+		if kind == nil || kind.Value != "PolicyDomainReference" {
+			continue
+		}
+		if value(root, "include") != nil {
+			p.yamlOnly = true
+		}
+		replace(lines, kind, kind, "PolicyDomain")
+
+		p.inline(lines, value(root, "spec"), "", dir)
+	}
+
+	p.text = strings.Join(lines, "\n")
+	return p
+}
+
+// inline replaces the rego_filename and value_filename references under a node with the
+// content of the files they reference
+func (p *prepared) inline(lines []string, node *yaml.Node, parentKey, dir string) {
+	if node == nil {
+		return
+	}
+	if node.Kind != yaml.MappingNode {
+		for _, child := range node.Content {
+			p.inline(lines, child, parentKey, dir)
+		}
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		switch {
+		case k.Value == "value":
+			// data document values are content, not PolicyDomain structure
+		case k.Value == "source" && parentKey == "policy-libraries":
+			p.yamlOnly = true
+		case (k.Value == "rego_filename" || k.Value == "value_filename") && v.Kind == yaml.ScalarNode && k.Line == v.Line:
+			p.inlineFile(lines, k, v, dir)
+		default:
+			p.inline(lines, v, k.Value, dir)
+		}
+	}
+}
+
+func (p *prepared) inlineFile(lines []string, k, v *yaml.Node, dir string) {
+	file := v.Value
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	content, err := os.ReadFile(file) // #nosec G304 -- the language server reads the files the edited domain references
+	if err != nil {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Range:    nodeRange(v),
+			Severity: severityError,
+			Source:   "mpe",
+			Message:  fmt.Sprintf("failed to read '%s': %v", v.Value, err),
+		})
+		return
+	}
+
+	if k.Value == "rego_filename" {
+		replace(lines, k, v, "rego: "+quote(string(content)))
+		p.files[k.Line] = v.Value
+		return
+	}
+
+	var data interface{}
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Range:    nodeRange(v),
+			Severity: severityError,
+			Source:   "mpe",
+			Message:  fmt.Sprintf("failed to parse '%s': %v", v.Value, err),
+		})
+		return
+	}
+	replace(lines, k, v, "value: "+quote(data))
+}
+
+// replace rewrites a line from the start of a node to the end of another on the same line
+func replace(lines []string, from, to *yaml.Node, replacement string) {
+	line := from.Line - 1
+	if line < 0 || line >= len(lines) {
+		return
+	}
+	runes := []rune(lines[line])
+	start, end := from.Column-1, nodeRange(to).End.Character
+	if start < 0 || end > len(runes) || start > end {
+		return
+	}
+	lines[line] = string(runes[:start]) + replacement + string(runes[end:])
+}
+
+// quote renders a value as single-line JSON, which YAML reads as the same value
+func quote(v interface{}) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return `""`
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// yamlErrorLine finds the line of a YAML syntax error
+var yamlErrorLine = regexp.MustCompile(`line (\d+):`)
+
+// diagnose lints a document along with the documents of the workspace declaring the other
+// domains it may reference, and returns the diagnostics of the document
+func (s *Server) diagnose(ctx context.Context, uri string) []Diagnostic {
+	text := s.text(uri)
+	doc := prepare(text, s.root())
+	diagnostics := append([]Diagnostic{}, doc.diagnostics...)
+	if !doc.policy && len(parseDocuments(text)) > 0 {
+		return diagnostics
+	}
+
+	if doc.yamlOnly {
+		decoder := yaml.NewDecoder(strings.NewReader(text))
+		for {
+			var node yaml.Node
+			err := decoder.Decode(&node)
+			if errors.Is(err, io.EOF) {
+				return diagnostics
+			}
+			if err != nil {
+				line := 0
+				if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+					line, _ = strconv.Atoi(m[1])
+					line--
+				}
+				return append(diagnostics, Diagnostic{
+					Range:    Range{Start: Position{Line: line}, End: Position{Line: line + 1}},
+					Severity: severityError,
+					Source:   string(lint.SourceYAML),
+					Message:  err.Error(),
+				})
+			}
+		}
+	}
+
+	// each other domain is linted from the first document declaring it, so that a domain and
+	// its built copy do not collide
+	contents := map[string]string{uri: doc.text}
+	claimed := map[string]bool{}
+	for _, name := range doc.domains {
+		claimed[name] = true
+	}
+	for _, other := range s.uris() {
+		if other == uri {
+			continue
+		}
+		p := prepare(s.text(other), s.root())
+		if p.yamlOnly || len(p.domains) == 0 || anyClaimed(claimed, p.domains) {
+			continue
+		}
+		for _, name := range p.domains {
+			claimed[name] = true
+		}
+		contents[other] = p.text
+	}
+
+	result, err := lint.LintFromStrings(ctx, contents, s.opts)
+	if err != nil {
+		return append(diagnostics, Diagnostic{Severity: severityError, Source: "mpe", Message: err.Error()})
+	}
+
+	lines := strings.Split(text, "\n")
+	declared := map[string]Range{}
+	for _, e := range declarations(uri, text) {
+		declared[e.mrn] = e.rng
+	}
+	for _, d := range result.Diagnostics {
+		if d.Location.File != uri {
+			continue
+		}
+		diagnostic := convert(d, lines, doc.files)
+		// a diagnostic without a position, such as a failed compilation, is reported on the
+		// MRN of its entity
+		if d.Location.Start.Line == 0 {
+			if r, ok := declared[d.Entity.ID]; ok {
+				diagnostic.Range = r
+			}
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics
+}
+
+func anyClaimed(claimed map[string]bool, names []string) bool {
+	for _, name := range names {
+		if claimed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// convert returns the protocol diagnostic of a lint diagnostic. A diagnostic of Rego read
+// from a file is reported on the line referencing the file, with its line in the file.
+func convert(d lint.Diagnostic, lines []string, files map[int]string) Diagnostic {
+	message := d.Message
+	line, column := d.Location.Start.Line-1, d.Location.Start.Column-1
+	if file, ok := files[d.RegoOffset]; ok && d.RegoOffset > 0 {
+		if d.Location.Start.Line >= d.RegoOffset {
+			message = fmt.Sprintf("%s (%s:%d)", message, file, d.Location.Start.Line-d.RegoOffset+1)
+		}
+		line, column = d.RegoOffset-1, 0
+	}
+	line = max(line, 0)
+	column = max(column, 0)
+
+	end := Position{Line: line, Character: column}
+	if d.Location.End.Line > 0 && d.Location.End.Line-1 >= line {
+		end = Position{Line: d.Location.End.Line - 1, Character: max(d.Location.End.Column-1, 0)}
+	} else if line < len(lines) {
+		end.Character = max(len([]rune(lines[line])), column)
+	}
+
+	severity := severityInfo
+	switch d.Severity {
+	case lint.SeverityError:
+		severity = severityError
+	case lint.SeverityWarning:
+		severity = severityWarning
+	}
+
+	return Diagnostic{
+		Range:    Range{Start: Position{Line: line, Character: column}, End: end},
+		Severity: severity,
+		Source:   string(d.Source),
+		Message:  message,
+	}
+}
@@ -0,0 +1,119 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lsp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/policydomain/lint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepare(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.rego"), []byte("package authz\n\ndefault allow = 1\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.yml"), []byte("regions:\n  - us\n"), 0600))
+
+	text := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: app
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:main"
+      name: main
+      rego_filename: main.rego
+  data:
+    - name: regions
+      value_filename: data.yml
+---
+apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: other
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:other"
+      name: other
+      rego_filename: missing.rego
+`
+	p := prepare(text, dir)
+	lines := strings.Split(p.text, "\n")
+
+	// the document keeps its lines, with the files inlined on the lines referencing them
+	require.Len(t, lines, strings.Count(text, "\n")+1)
+	assert.Equal(t, "kind: PolicyDomain", lines[1])
+	assert.Equal(t, `      rego: "package authz\n\ndefault allow = 1\n"`, lines[8])
+	assert.Equal(t, `      value: {"regions":["us"]}`, lines[11])
+	assert.Equal(t, "kind: PolicyDomain", lines[14])
+	assert.Equal(t, map[int]string{9: "main.rego"}, p.files)
+	assert.Equal(t, []string{"app", "other"}, p.domains)
+	assert.False(t, p.yamlOnly)
+
+	// a file that cannot be read is reported on the line of the second document referencing it
+	require.Len(t, p.diagnostics, 1)
+	assert.Equal(t, 21, p.diagnostics[0].Range.Start.Line)
+	assert.Contains(t, p.diagnostics[0].Message, "failed to read 'missing.rego'")
+
+	assert.True(t, p.policy)
+	assert.True(t, prepare("kind: PolicyDomainReference\ninclude: base.yml\n", dir).yamlOnly)
+	assert.False(t, prepare("kind: ConfigMap\n", dir).policy)
+}
+
+func TestDiagnose_RegoFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.rego"), []byte("package authz\n\nallow { 1 = }\n"), 0600))
+
+	text := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: app
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:main"
+      name: main
+      rego_filename: main.rego
+`
+	uri := pathURI(filepath.Join(dir, "app.yml"))
+	s := NewServer(strings.NewReader(""), &strings.Builder{}, lint.DefaultOptions())
+	s.roots = []string{dir}
+	s.open[uri] = text
+
+	// a Rego error in the file is reported on the line referencing the file, with its line in the file
+	diagnostics := s.diagnose(context.Background(), uri)
+	require.NotEmpty(t, diagnostics)
+	for _, d := range diagnostics {
+		assert.Equal(t, severityError, d.Severity)
+		if strings.HasPrefix(d.Message, "rego compilation failed") {
+			// the compilation failure has no position of its own
+			assert.Equal(t, 6, d.Range.Start.Line)
+			continue
+		}
+		assert.Equal(t, 8, d.Range.Start.Line)
+		assert.Contains(t, d.Message, "(main.rego:3)")
+	}
+}
+
+func TestDiagnose_YAMLOnly(t *testing.T) {
+	uri := "file:///work/app.yml"
+	s := NewServer(strings.NewReader(""), &strings.Builder{}, lint.DefaultOptions())
+	s.open[uri] = "kind: PolicyDomainReference\ninclude: base.yml\nspec:\n  roles: [\n"
+
+	diagnostics := s.diagnose(context.Background(), uri)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, string(lint.SourceYAML), diagnostics[0].Source)
+
+	s.open[uri] = "kind: PolicyDomainReference\ninclude: base.yml\n"
+	assert.Empty(t, s.diagnose(context.Background(), uri))
+
+	// YAML that is not a PolicyDomain is not checked
+	s.open[uri] = "apiVersion: v1\nkind: ConfigMap\n"
+	assert.Empty(t, s.diagnose(context.Background(), uri))
+}
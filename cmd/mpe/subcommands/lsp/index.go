@@ -0,0 +1,268 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lsp
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sectionKinds names the entities of each spec section that declares them by MRN
+var sectionKinds = map[string]string{
+	"policy-libraries": "policy library",
+	"policyLibraries":  "policy library",
+	"policies":         "policy",
+	"roles":            "role",
+	"groups":           "group",
+	"resource-groups":  "resource group",
+	"resourceGroups":   "resource group",
+	"scopes":           "scope",
+	"operations":       "operation",
+	"resources":        "resource",
+	"mappers":          "mapper",
+}
+
+// detailFields are the fields of an entity shown when hovering over it, in order
+var detailFields = []string{"version", "default", "policy", "roles", "groups", "group", "dependencies", "selector", "rego_filename"}
+
+// entity is an entity declared with an MRN in a document
+type entity struct {
+	kind        string
+	mrn         string
+	name        string
+	description string
+	domain      string
+	uri         string
+	// rng is the range of the entity's MRN
+	rng     Range
+	details []string
+}
+
+// parseDocuments returns the root nodes of the documents of a text, up to the first that
+// fails to parse
+func parseDocuments(text string) []*yaml.Node {
+	var roots []*yaml.Node
+	decoder := yaml.NewDecoder(strings.NewReader(text))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			return roots
+		}
+		if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+			roots = append(roots, doc.Content[0])
+		}
+	}
+}
+
+// domainRoots returns the domains of a document: the document itself, or the items of a
+// PolicyDomainList
+func domainRoots(root *yaml.Node) []*yaml.Node {
+	if scalar(root, "kind") != "PolicyDomainList" {
+		return []*yaml.Node{root}
+	}
+	var items []*yaml.Node
+	if list := value(root, "items"); list != nil {
+		for _, item := range list.Content {
+			if item.Kind == yaml.MappingNode {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// declarations returns the entities the documents of a text declare
+func declarations(uri, text string) []entity {
+	var entities []entity
+	for _, root := range parseDocuments(text) {
+		for _, domain := range domainRoots(root) {
+			name := ""
+			if metadata := value(domain, "metadata"); metadata != nil {
+				name = scalar(metadata, "name")
+			}
+
+			spec := value(domain, "spec")
+			if spec == nil || spec.Kind != yaml.MappingNode {
+				continue
+			}
+			for i := 0; i+1 < len(spec.Content); i += 2 {
+				kind, ok := sectionKinds[spec.Content[i].Value]
+				if !ok || spec.Content[i+1].Kind != yaml.SequenceNode {
+					continue
+				}
+				for _, item := range spec.Content[i+1].Content {
+					mrn := value(item, "mrn")
+					if mrn == nil || mrn.Kind != yaml.ScalarNode || mrn.Value == "" {
+						continue
+					}
+					entities = append(entities, entity{
+						kind:        kind,
+						mrn:         mrn.Value,
+						name:        scalar(item, "name"),
+						description: scalar(item, "description"),
+						domain:      name,
+						uri:         uri,
+						rng:         nodeRange(mrn),
+						details:     details(item),
+					})
+				}
+			}
+		}
+	}
+	return entities
+}
+
+// details describes the fields of an entity shown when hovering over it
+func details(item *yaml.Node) []string {
+	var lines []string
+	for _, field := range detailFields {
+		v := value(item, field)
+		if v == nil {
+			continue
+		}
+		switch v.Kind {
+		case yaml.ScalarNode:
+			lines = append(lines, fmt.Sprintf("**%s**: `%s`", field, v.Value))
+		case yaml.SequenceNode:
+			var items []string
+			for _, element := range v.Content {
+				if element.Kind == yaml.ScalarNode {
+					items = append(items, "`"+element.Value+"`")
+				}
+			}
+			if len(items) > 0 {
+				lines = append(lines, fmt.Sprintf("**%s**: %s", field, strings.Join(items, ", ")))
+			}
+		}
+	}
+	return lines
+}
+
+// scalarAt returns the scalar of a text at a position, if any
+func scalarAt(text string, pos Position) *yaml.Node {
+	var found *yaml.Node
+	var walk func(*yaml.Node)
+	walk = func(n *yaml.Node) {
+		if found != nil {
+			return
+		}
+		if n.Kind == yaml.ScalarNode {
+			r := nodeRange(n)
+			if r.Start.Line == pos.Line && r.Start.Character <= pos.Character && pos.Character < r.End.Character {
+				found = n
+			}
+			return
+		}
+		for _, child := range n.Content {
+			walk(child)
+		}
+	}
+	for _, root := range parseDocuments(text) {
+		walk(root)
+	}
+	return found
+}
+
+// parseReference returns the domain, if any, and the MRN that a value references, such as
+// 'mrn:iam:policy:main', 'other-domain/mrn:iam:library:utils', or a dependency with a
+// version constraint such as 'mrn:iam:library:utils@^1.2'
+func parseReference(v string) (domain, mrn string, ok bool) {
+	if i := strings.Index(v, "/mrn:"); i >= 0 {
+		domain, v = v[:i], v[i+1:]
+	}
+	if !strings.HasPrefix(v, "mrn:") {
+		return "", "", false
+	}
+	mrn, _, _ = strings.Cut(v, "@")
+	return domain, mrn, true
+}
+
+// resolve returns the entities declaring an MRN. Without a domain, those of the domain the
+// reference is made from are preferred.
+func resolve(entities []entity, domain, mrn, from string) []entity {
+	var matches, local []entity
+	for _, e := range entities {
+		if e.mrn != mrn || (domain != "" && e.domain != domain) {
+			continue
+		}
+		matches = append(matches, e)
+		if e.domain == from {
+			local = append(local, e)
+		}
+	}
+	if domain == "" && len(local) > 0 {
+		return local
+	}
+	return matches
+}
+
+// domainAt returns the name of the domain declared around a line of a text
+func domainAt(text string, line int) string {
+	name := ""
+	for _, root := range parseDocuments(text) {
+		for _, domain := range domainRoots(root) {
+			if domain.Line-1 > line {
+				return name
+			}
+			if metadata := value(domain, "metadata"); metadata != nil {
+				name = scalar(metadata, "name")
+			}
+		}
+	}
+	return name
+}
+
+// hoverText documents an entity in Markdown
+func hoverText(e entity) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s** `%s`", e.kind, e.mrn)
+	if e.name != "" {
+		fmt.Fprintf(&b, " (%s)", e.name)
+	}
+	if e.description != "" {
+		fmt.Fprintf(&b, "\n\n%s", e.description)
+	}
+	if len(e.details) > 0 {
+		fmt.Fprintf(&b, "\n\n%s", strings.Join(e.details, "  \n"))
+	}
+	fmt.Fprintf(&b, "\n\n_Declared in domain '%s', %s:%d_", e.domain, path.Base(e.uri), e.rng.Start.Line+1)
+	return b.String()
+}
+
+// nodeRange returns the range of a node, including the quotes of a quoted scalar. Lines and
+// columns are counted in characters, which matches the UTF-16 offsets of the protocol for
+// text in the Basic Multilingual Plane.
+func nodeRange(n *yaml.Node) Range {
+	start := Position{Line: n.Line - 1, Character: n.Column - 1}
+	width := len([]rune(n.Value))
+	if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		width += 2
+	}
+	return Range{Start: start, End: Position{Line: start.Line, Character: start.Character + width}}
+}
+
+// value returns the value of a key of a mapping, or nil
+func value(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalar returns the scalar value of a key of a mapping, or ""
+func scalar(m *yaml.Node, key string) string {
+	if v := value(m, key); v != nil && v.Kind == yaml.ScalarNode {
+		return v.Value
+	}
+	return ""
+}
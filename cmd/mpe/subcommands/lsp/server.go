@@ -0,0 +1,342 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package lsp implements 'mpe lsp', a minimal language server for PolicyDomain YAML. It
+// reports lint diagnostics as documents are edited, resolves MRN references to their
+// declarations across the files of the workspace, and documents entities on hover.
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
+	"github.com/manetu/policyengine/cmd/mpe/version"
+	"github.com/manetu/policyengine/pkg/policydomain/lint"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/urfave/cli/v3"
+)
+
+// Server is a language server for PolicyDomain YAML, speaking the Language Server Protocol
+// over a pair of streams. Requests are handled one at a time, in the order received.
+type Server struct {
+	in   *bufio.Reader
+	out  io.Writer
+	opts lint.Options
+
+	roots []string
+	// open holds the text of the documents open in the editor, workspace the text of the
+	// PolicyDomain files of the workspace as saved, by URI
+	open      map[string]string
+	workspace map[string]string
+	shutdown  bool
+}
+
+// NewServer creates a [Server] reading requests from in and writing responses to out,
+// linting with opts.
+func NewServer(in io.Reader, out io.Writer, opts lint.Options) *Server {
+	return &Server{
+		in:        bufio.NewReader(in),
+		out:       out,
+		opts:      opts,
+		open:      map[string]string{},
+		workspace: map[string]string{},
+	}
+}
+
+// Execute runs the language server on stdin and stdout.
+func Execute(ctx context.Context, cmd *cli.Command) error {
+	opts := lint.DefaultOptions()
+	switch {
+	case cmd.Bool("no-opa-flags"):
+		opts.OPAFlags, opts.DisableOPA = "", true
+	case cmd.String("opa-flags") != "":
+		opts.OPAFlags = cmd.String("opa-flags")
+	case os.Getenv("MPE_CLI_OPA_FLAGS") != "":
+		opts.OPAFlags = os.Getenv("MPE_CLI_OPA_FLAGS")
+	}
+
+	// Declarations for custom built-ins registered by the embedding application
+	if capabilities := cmd.String("capabilities"); capabilities != "" {
+		caps, err := ast.LoadCapabilitiesFile(capabilities)
+		if err != nil {
+			return fmt.Errorf("failed to load capabilities from %s: %w", capabilities, err)
+		}
+		opts.Builtins = caps.Builtins
+	}
+
+	return NewServer(os.Stdin, os.Stdout, opts).Serve(ctx)
+}
+
+// Serve handles requests until the client asks the server to exit or closes the input.
+func (s *Server) Serve(ctx context.Context) error {
+	for {
+		body, err := readMessage(s.in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.replyError(json.RawMessage("null"), codeParseError, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, rpcErr := s.handle(ctx, msg)
+		if msg.ID == nil {
+			continue
+		}
+		if rpcErr != nil {
+			err = s.replyError(*msg.ID, rpcErr.Code, rpcErr.Message)
+		} else {
+			err = writeMessage(s.out, response{JSONRPC: "2.0", ID: *msg.ID, Result: result})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+}
+
+func (s *Server) replyError(id json.RawMessage, code int, message string) error {
+	return writeMessage(s.out, errorResponse{JSONRPC: "2.0", ID: id, Error: rpcError{Code: code, Message: message}})
+}
+
+// handle handles a request or notification, returning the result of a request
+func (s *Server) handle(ctx context.Context, msg message) (interface{}, *rpcError) {
+	if s.shutdown && msg.ID != nil {
+		return nil, &rpcError{Code: codeInvalidRequest, Message: "the server is shutting down"}
+	}
+
+	decode := func(v interface{}) *rpcError {
+		if err := json.Unmarshal(msg.Params, v); err != nil {
+			return &rpcError{Code: codeInvalidParams, Message: err.Error()}
+		}
+		return nil
+	}
+
+	switch msg.Method {
+	case "initialize":
+		var params initializeParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		for _, folder := range params.WorkspaceFolders {
+			s.roots = append(s.roots, uriPath(folder.URI))
+		}
+		if len(s.roots) == 0 && params.RootURI != "" {
+			s.roots = []string{uriPath(params.RootURI)}
+		}
+		s.scan()
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   map[string]interface{}{"openClose": true, "change": 1, "save": true},
+				"definitionProvider": true,
+				"hoverProvider":      true,
+			},
+			"serverInfo": map[string]string{"name": "mpe", "version": version.GetVersion()},
+		}, nil
+
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		s.open[params.TextDocument.URI] = params.TextDocument.Text
+		s.publish(ctx, params.TextDocument.URI)
+
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		// changes are full documents, as the server asks for
+		if n := len(params.ContentChanges); n > 0 {
+			s.open[params.TextDocument.URI] = params.ContentChanges[n-1].Text
+			s.publish(ctx, params.TextDocument.URI)
+		}
+
+	case "textDocument/didSave":
+		// a saved file may declare a domain others reference, or a referenced .rego file may
+		// have changed, so every open document is checked again
+		s.scan()
+		for _, uri := range slices.Sorted(maps.Keys(s.open)) {
+			s.publish(ctx, uri)
+		}
+
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		delete(s.open, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return s.definition(params), nil
+
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		if hover := s.hover(params); hover != nil {
+			return hover, nil
+		}
+		return nil, nil
+
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		// nothing to do
+
+	default:
+		if msg.ID != nil {
+			return nil, &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("method '%s' is not supported", msg.Method)}
+		}
+	}
+	return nil, nil
+}
+
+// definition returns the declarations of the MRN at a position
+func (s *Server) definition(params textDocumentPositionParams) []Location {
+	locations := []Location{}
+	for _, e := range s.lookup(params) {
+		locations = append(locations, Location{URI: e.uri, Range: e.rng})
+	}
+	return locations
+}
+
+// hover documents the entity whose MRN is at a position
+func (s *Server) hover(params textDocumentPositionParams) *Hover {
+	entities := s.lookup(params)
+	if len(entities) == 0 {
+		return nil
+	}
+
+	var sections []string
+	for _, e := range entities {
+		sections = append(sections, hoverText(e))
+	}
+	node := scalarAt(s.text(params.TextDocument.URI), params.Position)
+	r := nodeRange(node)
+	return &Hover{Contents: MarkupContent{Kind: "markdown", Value: strings.Join(sections, "\n\n---\n\n")}, Range: &r}
+}
+
+// lookup returns the entities declaring the MRN at a position
+func (s *Server) lookup(params textDocumentPositionParams) []entity {
+	text := s.text(params.TextDocument.URI)
+	node := scalarAt(text, params.Position)
+	if node == nil {
+		return nil
+	}
+	domain, mrn, ok := parseReference(node.Value)
+	if !ok {
+		return nil
+	}
+
+	var entities []entity
+	for _, uri := range s.uris() {
+		entities = append(entities, declarations(uri, s.text(uri))...)
+	}
+	return resolve(entities, domain, mrn, domainAt(text, params.Position.Line))
+}
+
+// publish sends the diagnostics of a document to the client
+func (s *Server) publish(ctx context.Context, uri string) {
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: s.diagnose(ctx, uri)})
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	// a client that stopped reading will close the input too, which ends Serve
+	_ = writeMessage(s.out, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// scan reads the PolicyDomain and PolicyDomainReference files of the workspace
+func (s *Server) scan() {
+	s.workspace = map[string]string{}
+	for _, root := range s.roots {
+		files, err := registry.ExpandPaths([]string{root}, registry.KindPolicyDomain, build.KindPolicyDomainReference)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			content, err := os.ReadFile(file) // #nosec G304 -- the language server reads the files of the workspace it serves
+			if err != nil {
+				continue
+			}
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				continue
+			}
+			s.workspace[pathURI(abs)] = string(content)
+		}
+	}
+}
+
+// text returns the text of a document, as edited if it is open
+func (s *Server) text(uri string) string {
+	if text, ok := s.open[uri]; ok {
+		return text
+	}
+	return s.workspace[uri]
+}
+
+// uris returns the URIs of the open and workspace documents, sorted
+func (s *Server) uris() []string {
+	uris := slices.Collect(maps.Keys(s.workspace))
+	for uri := range s.open {
+		if _, ok := s.workspace[uri]; !ok {
+			uris = append(uris, uri)
+		}
+	}
+	slices.Sort(uris)
+	return uris
+}
+
+// root returns the directory relative paths are resolved against: the first workspace
+// folder, or the current directory
+func (s *Server) root() string {
+	if len(s.roots) > 0 {
+		return s.roots[0]
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,222 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/policydomain/lint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const libraryDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: shared
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:shared"
+      name: shared
+      description: Grants everything to everyone
+      rego: |
+        package authz
+        default allow = 1
+`
+
+const appDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomainReference
+metadata:
+  name: app
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:main"
+      name: main
+      rego_filename: main.rego
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      name: reader
+      description: Reads documents
+      policy: "mrn:iam:policy:main"
+    - mrn: "mrn:iam:role:admin"
+      name: admin
+      policy: "shared/mrn:iam:policy:shared"
+    - mrn: "mrn:iam:role:broken"
+      name: broken
+      policy: "mrn:iam:policy:missing"
+`
+
+// client drives a server over a pair of pipes
+type client struct {
+	t      *testing.T
+	w      io.Writer
+	r      *bufio.Reader
+	nextID int
+}
+
+func newClient(t *testing.T, opts lint.Options) (*client, chan error) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(inR, outW, opts).Serve(context.Background())
+		_ = outW.Close()
+	}()
+	t.Cleanup(func() { _ = inW.Close() })
+
+	return &client{t: t, w: inW, r: bufio.NewReader(outR)}, done
+}
+
+func (c *client) send(v interface{}) {
+	require.NoError(c.t, writeMessage(c.w, v))
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// request sends a request and returns its response, skipping any notification
+func (c *client) request(method string, params interface{}) map[string]json.RawMessage {
+	c.nextID++
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method, "params": params})
+	for {
+		msg := c.read()
+		if _, ok := msg["id"]; ok {
+			return msg
+		}
+	}
+}
+
+// diagnostics returns the next diagnostics published
+func (c *client) diagnostics() publishDiagnosticsParams {
+	for {
+		msg := c.read()
+		if string(msg["method"]) != `"textDocument/publishDiagnostics"` {
+			continue
+		}
+		var params publishDiagnosticsParams
+		require.NoError(c.t, json.Unmarshal(msg["params"], &params))
+		return params
+	}
+}
+
+func (c *client) read() map[string]json.RawMessage {
+	body, err := readMessage(c.r)
+	require.NoError(c.t, err)
+	var msg map[string]json.RawMessage
+	require.NoError(c.t, json.Unmarshal(body, &msg))
+	return msg
+}
+
+// position returns the position of the nth occurrence of s in text, plus an offset
+func position(text, s string, n, offset int) Position {
+	index := -1
+	for i := 0; i < n; i++ {
+		index += 1 + strings.Index(text[index+1:], s)
+	}
+	before := text[:index]
+	line := strings.Count(before, "\n")
+	return Position{Line: line, Character: len(before) - strings.LastIndex(before, "\n") - 1 + offset}
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "shared.yml"), []byte(libraryDomain), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.rego"), []byte("package authz\ndefault allow = 1\n"), 0600))
+	appPath := filepath.Join(dir, "app.yml")
+	require.NoError(t, os.WriteFile(appPath, []byte(appDomain), 0600))
+	appURI := pathURI(appPath)
+	sharedURI := pathURI(filepath.Join(dir, "shared.yml"))
+
+	opts := lint.DefaultOptions()
+	opts.DisableOPA = true
+	c, done := newClient(t, opts)
+
+	init := c.request("initialize", map[string]interface{}{"rootUri": pathURI(dir)})
+	assert.Contains(t, string(init["result"]), `"definitionProvider":true`)
+	c.notify("initialized", map[string]interface{}{})
+
+	// the broken reference is reported, and the rego_filename is resolved
+	c.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": appURI, "text": appDomain}})
+	published := c.diagnostics()
+	assert.Equal(t, appURI, published.URI)
+	require.Len(t, published.Diagnostics, 1, "%+v", published.Diagnostics)
+	assert.Contains(t, published.Diagnostics[0].Message, "mrn:iam:policy:missing")
+	assert.Equal(t, position(appDomain, "mrn:iam:policy:missing", 1, 0).Line, published.Diagnostics[0].Range.Start.Line)
+
+	// fixing it clears the diagnostics
+	fixed := strings.Replace(appDomain, "mrn:iam:policy:missing", "mrn:iam:policy:main", 1)
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": appURI},
+		"contentChanges": []map[string]interface{}{{"text": fixed}},
+	})
+	assert.Empty(t, c.diagnostics().Diagnostics)
+
+	// a reference resolves to its declaration in the same document
+	resp := c.request("textDocument/definition", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": appURI},
+		"position":     position(fixed, "mrn:iam:policy:main", 2, 3),
+	})
+	var locations []Location
+	require.NoError(t, json.Unmarshal(resp["result"], &locations))
+	require.Len(t, locations, 1)
+	assert.Equal(t, appURI, locations[0].URI)
+	assert.Equal(t, position(fixed, `"mrn:iam:policy:main"`, 1, 0), locations[0].Range.Start)
+
+	// and across the files of the workspace
+	resp = c.request("textDocument/definition", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": appURI},
+		"position":     position(fixed, "mrn:iam:policy:shared", 1, 0),
+	})
+	require.NoError(t, json.Unmarshal(resp["result"], &locations))
+	require.Len(t, locations, 1)
+	assert.Equal(t, sharedURI, locations[0].URI)
+	assert.Equal(t, 6, locations[0].Range.Start.Line)
+
+	// hovering documents the entity
+	resp = c.request("textDocument/hover", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": appURI},
+		"position":     position(fixed, "mrn:iam:policy:shared", 1, 0),
+	})
+	var hover Hover
+	require.NoError(t, json.Unmarshal(resp["result"], &hover))
+	assert.Equal(t, "markdown", hover.Contents.Kind)
+	assert.Contains(t, hover.Contents.Value, "**policy** `mrn:iam:policy:shared` (shared)")
+	assert.Contains(t, hover.Contents.Value, "Grants everything to everyone")
+	assert.Contains(t, hover.Contents.Value, "domain 'shared', shared.yml:7")
+
+	// hovering anything but an MRN shows nothing
+	resp = c.request("textDocument/hover", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": appURI},
+		"position":     position(fixed, "reader", 2, 0),
+	})
+	assert.Equal(t, "null", string(resp["result"]))
+
+	resp = c.request("textDocument/formatting", map[string]interface{}{})
+	assert.Contains(t, string(resp["error"]), `"code":-32601`)
+
+	c.notify("textDocument/didClose", map[string]interface{}{"textDocument": map[string]interface{}{"uri": appURI}})
+	assert.Empty(t, c.diagnostics().Diagnostics)
+
+	resp = c.request("shutdown", nil)
+	assert.Equal(t, "null", string(resp["result"]))
+	c.notify("exit", nil)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not exit")
+	}
+}
@@ -0,0 +1,90 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/build"
+	pmigrate "github.com/manetu/policyengine/pkg/policydomain/migrate"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/urfave/cli/v3"
+)
+
+// Execute runs the migrate command, converting PolicyDomain YAML files to a newer apiVersion.
+// Files are rewritten in place unless --output is given. Content that cannot be migrated
+// automatically is left unchanged and reported.
+func Execute(_ context.Context, cmd *cli.Command) error {
+	to, err := pmigrate.ParseVersion(cmd.String("to"))
+	if err != nil {
+		return err
+	}
+
+	files, err := registry.ExpandPaths(cmd.StringSlice("file"), registry.KindPolicyDomain, build.KindPolicyDomainReference)
+	if err != nil {
+		return err
+	}
+
+	output := cmd.String("output")
+	if len(files) > 1 && output != "" {
+		return fmt.Errorf("cannot specify --output when migrating multiple files")
+	}
+
+	var migrated, failed, issues int
+	for _, file := range files {
+		data, err := os.ReadFile(file) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			fmt.Printf("✗ %s\n  Error: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		result, err := pmigrate.Migrate(data, to)
+		if err != nil {
+			fmt.Printf("✗ %s\n  Error: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		target := file
+		if output != "" {
+			target = output
+		}
+
+		if result.From == result.To {
+			fmt.Printf("✓ %s: already %s\n", file, result.To)
+			if target == file {
+				continue
+			}
+		} else {
+			fmt.Printf("✓ %s: %s → %s\n", file, result.From, result.To)
+			migrated++
+		}
+
+		for _, issue := range result.Issues {
+			fmt.Printf("⚠ %s:%d: %s\n", file, issue.Line, issue.Message)
+		}
+		issues += len(result.Issues)
+
+		if err := os.WriteFile(target, result.Data, 0600); err != nil {
+			fmt.Printf("✗ %s\n  Error: %v\n", target, err)
+			failed++
+		}
+	}
+
+	fmt.Println("---")
+	fmt.Printf("Migrated %d of %d file(s)", migrated, len(files))
+	if issues > 0 {
+		fmt.Printf("; %d item(s) need manual migration", issues)
+	}
+	fmt.Println()
+
+	if failed > 0 {
+		return fmt.Errorf("migration failed: %d error(s)", failed)
+	}
+	return nil
+}
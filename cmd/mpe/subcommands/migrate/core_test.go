@@ -0,0 +1,91 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package migrate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func runMigrate(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "migrate",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "file", Aliases: []string{"f"}},
+			&cli.StringFlag{Name: "to", Value: "v1beta1"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}},
+		},
+		Action: Execute,
+	}
+	return cmd.Run(ctx, append([]string{"migrate"}, args...))
+}
+
+func TestExecute_InPlace(t *testing.T) {
+	path := clitest.CopyTestData(t, t.TempDir(), "consolidated.yml")
+
+	require.NoError(t, runMigrate(context.Background(), "-f", path))
+
+	model, err := parsers.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 42, model.Roles["mrn:iam:role:admin"].Annotations["foo"].Value)
+
+	// migrating again is a no-op
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, runMigrate(context.Background(), "-f", path))
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestExecute_Output(t *testing.T) {
+	dir := t.TempDir()
+	path := clitest.CopyTestData(t, dir, "consolidated.yml")
+	original, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	output := filepath.Join(dir, "migrated.yml")
+	require.NoError(t, runMigrate(context.Background(), "-f", path, "--to", "v1alpha4", "-o", output))
+
+	unchanged, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, original, unchanged)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "apiVersion: iamlite.manetu.io/v1alpha4")
+}
+
+func TestExecute_OutputWithMultipleFiles(t *testing.T) {
+	dir := t.TempDir()
+	clitest.CopyTestData(t, dir, "consolidated.yml")
+	clitest.CopyTestData(t, dir, "alpha.yml")
+
+	err := runMigrate(context.Background(), "-f", dir, "-o", filepath.Join(dir, "out.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot specify --output")
+}
+
+func TestExecute_Downgrade(t *testing.T) {
+	path := clitest.CopyTestData(t, t.TempDir(), "v1beta1-annotations.yml")
+
+	err := runMigrate(context.Background(), "-f", path, "--to", "v1alpha4")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "migration failed")
+}
+
+func TestExecute_UnsupportedVersion(t *testing.T) {
+	err := runMigrate(context.Background(), "-f", "unused.yml", "--to", "v2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported PolicyDomain API Version")
+}
@@ -0,0 +1,236 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package repl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const help = `Commands:
+  {...}                  Replace the PORC with a JSON object, which may span lines
+  :set <path> <value>    Set a field of the PORC, such as ':set principal.mroles ["mrn:iam:role:admin"]'.
+                         The value is read as JSON, or as a string when it is not JSON.
+  :unset <path>          Remove a field of the PORC
+  :load <file>           Replace the PORC with the JSON object of a file
+  :watch <file>          Load a file, and again each time it changes; ':watch off' stops watching
+  :show                  Print the PORC
+  :eval                  Decide the PORC again
+  :trace [<pattern>...]  Trace the policies whose MRN matches a pattern, or every policy; ':trace off' stops tracing
+  :reload                Reload the bundles, such as after editing a policy
+  :history               List the PORCs decided during the session
+  :recall <n>            Restore the PORC of history entry n and decide it
+  :help                  Print this help
+  :quit                  Exit
+`
+
+// execute runs a command entered at the prompt, returning true when the session should end
+func (s *session) execute(ctx context.Context, line string) bool {
+	name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+
+	// watching is started and stopped outside the lock, which the watch takes for its runs
+	if name == ":watch" {
+		switch args {
+		case "":
+			s.write("usage: :watch <file> | :watch off\n")
+		case "off":
+			s.stopWatch()
+		default:
+			s.startWatch(ctx, args)
+		}
+		return false
+	}
+
+	quit := false
+	s.locked(func() {
+		var err error
+		switch name {
+		case "":
+		case ":quit", ":exit", ":q":
+			quit = true
+		case ":help", ":h":
+			fmt.Fprint(s.out, help)
+		case ":show":
+			err = s.show()
+		case ":set":
+			err = s.set(ctx, args)
+		case ":unset":
+			err = s.unset(ctx, args)
+		case ":load":
+			if args == "" {
+				err = fmt.Errorf("usage: :load <file>")
+			} else if err = s.loadFile(args); err == nil {
+				s.evaluate(ctx)
+			}
+		case ":eval":
+			s.evaluate(ctx)
+		case ":trace":
+			err = s.trace(args)
+		case ":reload":
+			if err = s.load(); err == nil {
+				fmt.Fprintln(s.out, "Reloaded bundles")
+			}
+		case ":history":
+			s.listHistory()
+		case ":recall":
+			err = s.recall(ctx, args)
+		default:
+			err = fmt.Errorf("unknown command '%s', type :help for the commands", name)
+		}
+		if err != nil {
+			fmt.Fprintf(s.out, "error: %v\n", err)
+		}
+	})
+	return quit
+}
+
+func (s *session) show() error {
+	data, err := json.MarshalIndent(s.porc, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.out, string(data))
+	return nil
+}
+
+// set sets a field of the PORC to a JSON value, or to a string
+func (s *session) set(ctx context.Context, args string) error {
+	path, raw, _ := strings.Cut(args, " ")
+	raw = strings.TrimSpace(raw)
+	if path == "" || raw == "" {
+		return fmt.Errorf("usage: :set <path> <value>")
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		value = raw
+	}
+	if err := setPath(s.porc, path, value); err != nil {
+		return err
+	}
+	s.evaluate(ctx)
+	return nil
+}
+
+func (s *session) unset(ctx context.Context, path string) error {
+	if path == "" {
+		return fmt.Errorf("usage: :unset <path>")
+	}
+	if err := unsetPath(s.porc, path); err != nil {
+		return err
+	}
+	s.evaluate(ctx)
+	return nil
+}
+
+// trace sets the policies traced, and reloads the engine to trace them
+func (s *session) trace(args string) error {
+	tracing, filter := s.tracing, s.traceFilter
+	switch args {
+	case "off":
+		s.tracing, s.traceFilter = false, nil
+	case "":
+		s.tracing, s.traceFilter = true, nil
+	default:
+		s.tracing, s.traceFilter = true, strings.Fields(args)
+	}
+
+	if err := s.load(); err != nil {
+		s.tracing, s.traceFilter = tracing, filter
+		return err
+	}
+
+	switch {
+	case !s.tracing:
+		fmt.Fprintln(s.out, "Tracing off")
+	case len(s.traceFilter) == 0:
+		fmt.Fprintln(s.out, "Tracing every policy")
+	default:
+		fmt.Fprintf(s.out, "Tracing policies matching %s\n", strings.Join(s.traceFilter, ", "))
+	}
+	return nil
+}
+
+func (s *session) listHistory() {
+	if len(s.history) == 0 {
+		fmt.Fprintln(s.out, "No PORC decided yet")
+		return
+	}
+	for i, e := range s.history {
+		fmt.Fprintf(s.out, "%3d  %-5s  %s\n", i+1, e.decision, e.porc)
+	}
+}
+
+// recall restores the PORC of a history entry and decides it
+func (s *session) recall(ctx context.Context, args string) error {
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 1 || n > len(s.history) {
+		return fmt.Errorf("usage: :recall <n>, where n is an entry of :history")
+	}
+
+	var porc map[string]interface{}
+	if err := json.Unmarshal([]byte(s.history[n-1].porc), &porc); err != nil {
+		return err
+	}
+	s.porc = porc
+	s.evaluate(ctx)
+	return nil
+}
+
+// setPath sets the field of an object at a dotted path, creating the objects along it
+func setPath(m map[string]interface{}, path string, value interface{}) error {
+	keys, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys[:len(keys)-1] {
+		switch next := m[key].(type) {
+		case map[string]interface{}:
+			m = next
+		case nil:
+			created := map[string]interface{}{}
+			m[key] = created
+			m = created
+		default:
+			return fmt.Errorf("'%s' is not an object", strings.Join(keys[:i+1], "."))
+		}
+	}
+	m[keys[len(keys)-1]] = value
+	return nil
+}
+
+// unsetPath removes the field of an object at a dotted path
+func unsetPath(m map[string]interface{}, path string) error {
+	keys, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys[:len(keys)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' is not an object", strings.Join(keys[:i+1], "."))
+		}
+		m = next
+	}
+	if _, ok := m[keys[len(keys)-1]]; !ok {
+		return fmt.Errorf("'%s' is not set", path)
+	}
+	delete(m, keys[len(keys)-1])
+	return nil
+}
+
+func splitPath(path string) ([]string, error) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("invalid path '%s'", path)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,340 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package repl implements 'mpe repl', an interactive session for debugging decisions. The
+// author edits a PORC a command at a time and sees, after each change, the decision, the
+// outcome of each phase, the annotations merged into the PORC, and the OPA trace of selected
+// policies.
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/cmd/mpe/common/watch"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/options"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	prompt         = "mpe> "
+	continuePrompt = "...> "
+	// maxLine bounds a line of input, such as a PORC pasted on one line
+	maxLine = 4 << 20
+)
+
+// session is the state of a REPL: the PORC being edited, and the engine deciding it
+type session struct {
+	cmd *cli.Command
+	out io.Writer
+
+	// mu serializes the commands read from the prompt with the runs of a watched file
+	mu      sync.Mutex
+	pe      core.PolicyEngine
+	records *accesslog.ChannelFactory
+	porc    map[string]interface{}
+	// tracing enables the OPA trace of the policies matching traceFilter, or of every
+	// policy when it is empty
+	tracing     bool
+	traceFilter []string
+	// tracer collects the trace when --trace-format selects a structured format, writing
+	// it to traced unless --trace-output is set
+	tracer  *common.Tracer
+	traced  bytes.Buffer
+	history []entry
+	// watching is the file watched, if any; it is only used by the prompt
+	watching *watching
+}
+
+// entry is a PORC decided during the session
+type entry struct {
+	porc     string
+	decision string
+}
+
+type watching struct {
+	file   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Execute runs the repl command, reading commands from stdin until it ends or ':quit' is
+// entered.
+func Execute(ctx context.Context, cmd *cli.Command) error {
+	s, err := newSession(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.tracer.Close() }()
+
+	if input := cmd.String("input"); input != "" {
+		if err := s.loadFile(input); err != nil {
+			return err
+		}
+		s.evaluate(ctx)
+	}
+
+	fmt.Fprintln(s.out, "Type :help for the commands, :quit to exit.")
+	return s.run(ctx, os.Stdin)
+}
+
+func newSession(cmd *cli.Command, out io.Writer) (*session, error) {
+	s := &session{
+		cmd:         cmd,
+		out:         out,
+		porc:        map[string]interface{}{},
+		tracing:     cmd.Root().Bool("trace"),
+		traceFilter: cmd.Root().StringSlice("trace-filter"),
+	}
+	tracer, err := common.NewTracer(cmd, &s.traced)
+	if err != nil {
+		return nil, err
+	}
+	if tracer != nil {
+		tracer.Indent = true
+		s.tracer = tracer
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load creates the engine deciding the PORC, with the tracing of the session
+func (s *session) load() error {
+	records := accesslog.NewChannelFactory(1)
+	compilerOpts := append(common.CompilerOptions(s.cmd),
+		opa.WithDefaultTracing(s.tracing),
+		opa.WithTraceFilter(s.traceFilter),
+	)
+
+	pe, err := common.NewCliPolicyEngineWithAccessLog(s.cmd, records, options.WithCompilerOptions(compilerOpts...))
+	if err != nil {
+		return fmt.Errorf("failed to load bundles: %w", err)
+	}
+	s.pe, s.records = pe, records
+	return nil
+}
+
+// run reads and executes commands until the input ends or ':quit' is entered
+func (s *session) run(ctx context.Context, in io.Reader) error {
+	defer s.stopWatch()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+
+	// a PORC entered as JSON may span lines, and is read until it is complete
+	var pending strings.Builder
+	s.write(prompt)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if pending.Len() > 0 || strings.HasPrefix(strings.TrimSpace(line), "{") {
+			pending.WriteString(line)
+			pending.WriteString("\n")
+			porc, complete, err := parsePORC(pending.String())
+			if !complete {
+				s.write(continuePrompt)
+				continue
+			}
+			pending.Reset()
+			s.locked(func() {
+				if err != nil {
+					fmt.Fprintf(s.out, "error: %v\n", err)
+					return
+				}
+				s.porc = porc
+				s.evaluate(ctx)
+			})
+			s.write(prompt)
+			continue
+		}
+
+		if quit := s.execute(ctx, line); quit {
+			return nil
+		}
+		s.write(prompt)
+	}
+	return scanner.Err()
+}
+
+// parsePORC parses a PORC entered as JSON, reporting whether the text is complete
+func parsePORC(text string) (map[string]interface{}, bool, error) {
+	var porc map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &porc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) && syntaxErr.Error() == "unexpected end of JSON input" {
+			return nil, false, nil
+		}
+		return nil, true, fmt.Errorf("invalid PORC: %w", err)
+	}
+	if porc == nil {
+		return nil, true, fmt.Errorf("invalid PORC: expected an object")
+	}
+	return porc, true, nil
+}
+
+// loadFile replaces the PORC with the JSON object of a file
+func (s *session) loadFile(file string) error {
+	data, err := os.ReadFile(file) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return fmt.Errorf("failed to read PORC: %w", err)
+	}
+	porc, _, err := parsePORC(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	s.porc = porc
+	return nil
+}
+
+// evaluate decides the PORC and prints the outcome. It records the PORC in the history
+// unless it is the last one decided.
+func (s *session) evaluate(ctx context.Context) {
+	data, err := json.Marshal(s.porc)
+	if err != nil {
+		fmt.Fprintf(s.out, "error: %v\n", err)
+		return
+	}
+
+	// drop any record left by an earlier decision
+	select {
+	case <-s.records.C():
+	default:
+	}
+
+	var decision *core.Decision
+	var log *opa.TraceLog
+	decide := func() {
+		decision, err = s.pe.Decide(ctx, string(data), options.SetPhaseResults(true))
+	}
+	trace := ""
+	switch {
+	case s.tracing && s.tracer != nil:
+		ctx, log = s.tracer.Begin(ctx)
+		decide()
+	case s.tracing:
+		trace = captureStdout(decide)
+	default:
+		decide()
+	}
+	if log != nil {
+		if werr := s.tracer.Write("", log); werr != nil {
+			fmt.Fprintf(s.out, "error: failed to write trace: %v\n", werr)
+		}
+		trace = s.traced.String()
+		s.traced.Reset()
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "error: %v\n", err)
+		return
+	}
+
+	// the access log is written before Decide returns
+	var record *events.AccessRecord
+	select {
+	case record = <-s.records.C():
+	default:
+	}
+
+	printDecision(s.out, decision, record, trace)
+
+	outcome := decisionText(decision.Allow)
+	if n := len(s.history); n == 0 || s.history[n-1].porc != string(data) {
+		s.history = append(s.history, entry{porc: string(data), decision: outcome})
+	}
+}
+
+// startWatch loads a file as the PORC, then again each time it changes
+func (s *session) startWatch(ctx context.Context, file string) {
+	s.stopWatch()
+
+	var err error
+	s.locked(func() {
+		if err = s.loadFile(file); err != nil {
+			fmt.Fprintf(s.out, "error: %v\n", err)
+			return
+		}
+		s.evaluate(ctx)
+	})
+	if err != nil {
+		return
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	w := &watching{file: file, cancel: cancel, done: make(chan struct{})}
+	s.watching = w
+
+	first := true
+	watcher := &watch.Watcher{
+		Files: func() []string { return []string{file} },
+		Run: func() {
+			// the file was decided as the watch started
+			if first {
+				first = false
+				return
+			}
+			s.locked(func() {
+				if err := s.loadFile(file); err != nil {
+					fmt.Fprintf(s.out, "error: %v\n", err)
+					return
+				}
+				s.evaluate(wctx)
+			})
+		},
+		Out: lockedWriter{s},
+	}
+	go func() {
+		defer close(w.done)
+		_ = watcher.Watch(wctx)
+	}()
+}
+
+// stopWatch stops watching the file watched, if any
+func (s *session) stopWatch() {
+	if s.watching == nil {
+		return
+	}
+	s.watching.cancel()
+	<-s.watching.done
+	s.watching = nil
+}
+
+func (s *session) locked(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+func (s *session) write(text string) {
+	s.locked(func() {
+		_, _ = io.WriteString(s.out, text)
+	})
+}
+
+// lockedWriter writes to the output of a session between its commands
+type lockedWriter struct {
+	s *session
+}
+
+func (w lockedWriter) Write(p []byte) (n int, err error) {
+	w.s.locked(func() {
+		n, err = w.s.out.Write(p)
+	})
+	return n, err
+}
@@ -0,0 +1,276 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package repl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+const testDomain = `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: repl-test
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:operation"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:clearance"
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          input.principal.mannotations.level == "high"
+        }
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      policy: "mrn:iam:policy:clearance"
+      annotations:
+        - name: team
+          value: '"docs"'
+
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+      default: true
+
+  operations:
+    - name: all
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:operation"
+`
+
+const testPORC = `{"principal": {"sub": "alice", "mroles": ["mrn:iam:role:reader"]}, "operation": "api:docs:read", "resource": "mrn:app:doc:1"}`
+
+// syncBuffer is the output of a session that a test reads while a watch writes to it
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// runSession runs a session on the test domain, reading commands from in, with any
+// additional arguments such as the trace flags
+func runSession(t *testing.T, in io.Reader, out io.Writer, args ...string) error {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "domain.yml")
+	require.NoError(t, os.WriteFile(bundle, []byte(testDomain), 0600))
+
+	cmd := &cli.Command{
+		Name: "repl",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "bundle", Aliases: []string{"b"}},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+			&cli.StringFlag{Name: "trace-format"},
+			&cli.StringFlag{Name: "trace-output"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			s, err := newSession(cmd, out)
+			if err != nil {
+				return err
+			}
+			return s.run(ctx, in)
+		},
+	}
+	return cmd.Run(context.Background(), append([]string{"repl", "--bundle", bundle}, args...))
+}
+
+func TestSession(t *testing.T) {
+	input := strings.Join([]string{
+		testPORC,
+		`:set principal.mannotations.level "high"`,
+		":history",
+		":recall 1",
+		":unset principal.mroles",
+		":show",
+		":set resource.id mrn:app:doc:2",
+		":unset principal.missing",
+		":recall 9",
+		":bogus",
+		":quit",
+		":show",
+	}, "\n")
+
+	var out bytes.Buffer
+	require.NoError(t, runSession(t, strings.NewReader(input), &out))
+	output := out.String()
+
+	// the PORC is denied without the clearance, and granted with it
+	decisions := strings.Split(output, "Decision: ")
+	require.Len(t, decisions, 5, output)
+	assert.True(t, strings.HasPrefix(decisions[1], "DENY"), decisions[1])
+	assert.Regexp(t, `identity\s+mrn:iam:role:reader\s+mrn:iam:policy:clearance\s+DENY`, decisions[1])
+	assert.Regexp(t, `principal\s+team\s+"docs"`, decisions[1])
+
+	assert.True(t, strings.HasPrefix(decisions[2], "GRANT"), decisions[2])
+	assert.Regexp(t, `operation\s+api:docs:read\s+mrn:iam:policy:operation\s+GRANT`, decisions[2])
+	assert.Regexp(t, `identity\s+mrn:iam:role:reader\s+mrn:iam:policy:clearance\s+GRANT`, decisions[2])
+	assert.Regexp(t, `principal\s+level\s+"high"`, decisions[2])
+	assert.Regexp(t, `principal\s+team\s+"docs"`, decisions[2])
+
+	// the history lists both PORCs, and the first is recalled
+	assert.Contains(t, decisions[2], `  1  DENY   {"operation":"api:docs:read"`)
+	assert.Contains(t, decisions[2], `  2  GRANT  {"operation":"api:docs:read"`)
+	assert.True(t, strings.HasPrefix(decisions[3], "DENY"), decisions[3])
+
+	// without roles, the PORC is denied without evaluating the clearance
+	assert.True(t, strings.HasPrefix(decisions[4], "DENY"), decisions[4])
+	assert.NotContains(t, decisions[4], "mrn:iam:policy:clearance")
+	assert.Contains(t, decisions[4], `"sub": "alice"`)
+	assert.NotContains(t, decisions[4], `"mroles"`)
+
+	assert.Contains(t, output, "error: 'resource' is not an object")
+	assert.Contains(t, output, "error: 'principal.missing' is not set")
+	assert.Contains(t, output, "error: usage: :recall <n>")
+	assert.Contains(t, output, "error: unknown command ':bogus'")
+	assert.Equal(t, 1, strings.Count(output, `"sub": "alice"`), "commands after :quit are not run")
+}
+
+func TestSession_MultiLinePORC(t *testing.T) {
+	input := "{\n  \"principal\": {\"sub\": \"alice\",\n    \"mroles\": [\"mrn:iam:role:reader\"], \"mannotations\": {\"level\": \"high\"}},\n  \"operation\": \"api:docs:read\", \"resource\": \"mrn:app:doc:1\"\n}\n{\"principal\": ]\n"
+
+	var out bytes.Buffer
+	require.NoError(t, runSession(t, strings.NewReader(input), &out))
+	assert.Contains(t, out.String(), continuePrompt)
+	assert.Contains(t, out.String(), "Decision: GRANT")
+	assert.Contains(t, out.String(), "error: invalid PORC")
+}
+
+func TestSession_Trace(t *testing.T) {
+	input := strings.Join([]string{
+		":trace mrn:iam:policy:clearance",
+		testPORC,
+		":trace off",
+		":eval",
+	}, "\n")
+
+	var out bytes.Buffer
+	require.NoError(t, runSession(t, strings.NewReader(input), &out))
+	output := out.String()
+
+	assert.Contains(t, output, "Tracing policies matching mrn:iam:policy:clearance")
+	assert.Contains(t, output, "Tracing off")
+
+	decisions := strings.Split(output, "Decision: ")
+	require.Len(t, decisions, 3, output)
+	assert.Contains(t, decisions[1], "Trace:")
+	assert.Contains(t, decisions[1], "mrn:iam:policy:clearance")
+	assert.NotContains(t, decisions[1], "mrn:iam:policy:allow-all:", "only the selected policies are traced")
+	assert.NotContains(t, decisions[2], "Trace:")
+}
+
+func TestSession_TraceJSON(t *testing.T) {
+	input := strings.Join([]string{
+		":trace mrn:iam:policy:clearance",
+		testPORC,
+	}, "\n")
+
+	var out bytes.Buffer
+	require.NoError(t, runSession(t, strings.NewReader(input), &out, "--trace-format", "json"))
+	output := out.String()
+
+	_, trace, found := strings.Cut(output, "Trace:\n")
+	require.True(t, found, output)
+	var decoded struct {
+		Policies []struct {
+			Policy   string                 `json:"policy"`
+			Bindings map[string]interface{} `json:"bindings"`
+		} `json:"policies"`
+	}
+	require.NoError(t, json.NewDecoder(strings.NewReader(trace)).Decode(&decoded))
+	require.Len(t, decoded.Policies, 1, "only the selected policies are traced")
+	assert.Equal(t, "mrn:iam:policy:clearance", decoded.Policies[0].Policy)
+	assert.Equal(t, map[string]interface{}{"x": false}, decoded.Policies[0].Bindings)
+}
+
+func TestSession_Watch(t *testing.T) {
+	porc := filepath.Join(t.TempDir(), "porc.json")
+	require.NoError(t, os.WriteFile(porc, []byte(testPORC), 0600))
+
+	in, w := io.Pipe()
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() { done <- runSession(t, in, out) }()
+
+	_, err := io.WriteString(w, ":watch "+porc+"\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), "Decision: DENY") }, 10*time.Second, 10*time.Millisecond)
+
+	// saving the file decides it again
+	granted := strings.Replace(testPORC, `"sub": "alice"`, `"sub": "alice", "mannotations": {"level": "high"}`, 1)
+	require.NoError(t, os.WriteFile(porc, []byte(granted), 0600))
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), "Decision: GRANT") }, 10*time.Second, 10*time.Millisecond)
+	assert.Contains(t, out.String(), "changed, re-running")
+
+	_, err = io.WriteString(w, ":watch off\n:history\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, <-done)
+	assert.Contains(t, out.String(), "  2  GRANT")
+}
+
+func TestParsePORC(t *testing.T) {
+	porc, complete, err := parsePORC(`{"operation": "a:b:c"}`)
+	require.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, "a:b:c", porc["operation"])
+
+	_, complete, err = parsePORC("{\"operation\":\n")
+	require.NoError(t, err)
+	assert.False(t, complete)
+
+	_, complete, err = parsePORC(`{"operation": ]`)
+	assert.True(t, complete)
+	assert.Error(t, err)
+
+	_, _, err = parsePORC("null")
+	assert.Error(t, err)
+}
+
+func TestSetPath(t *testing.T) {
+	m := map[string]interface{}{"resource": "mrn:app:doc:1"}
+	require.NoError(t, setPath(m, "principal.mannotations.level", "high"))
+	assert.Equal(t, map[string]interface{}{"mannotations": map[string]interface{}{"level": "high"}}, m["principal"])
+
+	assert.EqualError(t, setPath(m, "resource.id", "x"), "'resource' is not an object")
+	assert.EqualError(t, setPath(m, "principal..sub", "x"), "invalid path 'principal..sub'")
+
+	require.NoError(t, unsetPath(m, "principal.mannotations.level"))
+	assert.Equal(t, map[string]interface{}{"mannotations": map[string]interface{}{}}, m["principal"])
+	assert.EqualError(t, unsetPath(m, "principal.sub"), "'principal.sub' is not set")
+	assert.EqualError(t, unsetPath(m, "context.x"), "'context' is not an object")
+}
@@ -0,0 +1,153 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package repl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/types"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+func decisionText(allow bool) string {
+	if allow {
+		return "GRANT"
+	}
+	return "DENY"
+}
+
+// printDecision prints the outcome of a decision: the decision and any reason it bypassed
+// the policies, the outcome of each phase, the annotations merged into the PORC, the
+// obligations of the granting policies, and the trace
+func printDecision(out io.Writer, decision *core.Decision, record *events.AccessRecord, trace string) {
+	fmt.Fprintf(out, "\nDecision: %s%s\n", decisionText(decision.Allow), bypassReason(record))
+
+	if len(decision.Phases) > 0 {
+		fmt.Fprintln(out, "\nPhases:")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, p := range decision.Phases {
+			policy := p.Policy
+			if policy == "" {
+				policy = "-"
+			}
+			outcome := decisionText(p.Allow)
+			if p.ReasonCode != "" && p.ReasonCode != types.ReasonPolicyOutcome {
+				outcome = fmt.Sprintf("%s\t%s %s", outcome, p.ReasonCode, p.Reason)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", p.Phase, p.ID, policy, strings.TrimSpace(outcome))
+		}
+		_ = w.Flush()
+	}
+
+	if record != nil {
+		printAnnotations(out, record.GetPorc())
+	}
+
+	if len(decision.Obligations) > 0 {
+		if data, err := json.MarshalIndent(decision.Obligations, "  ", "  "); err == nil {
+			fmt.Fprintf(out, "\nObligations:\n  %s\n", data)
+		}
+	}
+
+	if trace = strings.TrimSpace(trace); trace != "" {
+		fmt.Fprintf(out, "\nTrace:\n%s\n", trace)
+	}
+	fmt.Fprintln(out)
+}
+
+// bypassReason describes why a decision bypassed the policies, if it did
+func bypassReason(record *events.AccessRecord) string {
+	switch {
+	case record == nil:
+		return ""
+	case record.GetOverride() != nil:
+		return fmt.Sprintf(" (override %s)", record.GetOverride().GetId())
+	}
+	switch reason := record.GetOverrideReason().(type) {
+	case *events.AccessRecord_GrantReason:
+		return fmt.Sprintf(" (%s)", reason.GrantReason)
+	case *events.AccessRecord_DenyReason:
+		return fmt.Sprintf(" (%s)", reason.DenyReason)
+	}
+	return ""
+}
+
+// printAnnotations prints the principal and resource annotations of the PORC as realized
+// by the engine, after merging those of the roles, groups, scopes, and resource group
+func printAnnotations(out io.Writer, porc string) {
+	var realized map[string]interface{}
+	if err := json.Unmarshal([]byte(porc), &realized); err != nil {
+		return
+	}
+
+	principal, _ := realized["principal"].(map[string]interface{})
+	resource, _ := realized["resource"].(map[string]interface{})
+	sections := []struct {
+		name        string
+		annotations map[string]interface{}
+	}{
+		{"principal", asMap(principal["mannotations"])},
+		{"resource", asMap(resource["annotations"])},
+	}
+
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, section := range sections {
+		for _, key := range slices.Sorted(maps.Keys(section.annotations)) {
+			value, err := json.Marshal(section.annotations[key])
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", section.name, key, value)
+		}
+	}
+	_ = w.Flush()
+
+	if b.Len() > 0 {
+		fmt.Fprintf(out, "\nAnnotations:\n%s", b.String())
+	}
+}
+
+func asMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// captureStdout runs a function and returns what it printed to stdout, where the engine
+// prints the OPA trace
+func captureStdout(fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		fn()
+		return ""
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	var b bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(&b, r)
+	}()
+
+	func() {
+		defer func() { os.Stdout = stdout }()
+		fn()
+	}()
+	_ = w.Close()
+	<-done
+	_ = r.Close()
+	return b.String()
+}
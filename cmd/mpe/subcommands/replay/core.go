@@ -0,0 +1,191 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Execute runs the replay command, re-evaluating the PORC of each stored AccessRecord against
+// a set of PolicyDomain bundles and reporting every decision that differs from the recorded one.
+func Execute(ctx context.Context, cmd *cli.Command) error {
+	records, err := loadRecords(cmd.String("records"))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no access records found in '%s'", cmd.String("records"))
+	}
+
+	pe, err := common.NewCliPolicyEngineWithAccessLog(cmd, accesslog.NewNullFactory())
+	if err != nil {
+		return fmt.Errorf("failed to load bundles: %w", err)
+	}
+
+	changed, skipped, failed := 0, 0, 0
+	for i, record := range records {
+		id := recordID(i, record)
+
+		// the decision of an override, or a record without its PORC, says nothing about the policies
+		if record.Porc == "" || record.Override != nil || record.Decision == events.AccessRecord_UNSPECIFIED {
+			skipped++
+			continue
+		}
+
+		porc, err := replayInput(record, cmd.Bool("resolve-resources"))
+		if err != nil {
+			fmt.Printf("%s: ERROR (invalid PORC: %v)\n", id, err)
+			failed++
+			continue
+		}
+
+		allow, err := pe.Authorize(ctx, porc)
+		if err != nil {
+			fmt.Printf("%s: ERROR (%v)\n", id, err)
+			failed++
+			continue
+		}
+
+		after := events.AccessRecord_DENY
+		if allow {
+			after = events.AccessRecord_GRANT
+		}
+		if after != record.Decision {
+			fmt.Printf("%s: %s → %s (subject '%s', operation '%s', resource '%s')\n",
+				id, record.Decision, after, record.GetPrincipal().GetSubject(), record.Operation, record.Resource)
+			changed++
+		}
+	}
+
+	replayed := len(records) - skipped - failed
+	fmt.Println("---")
+	fmt.Printf("%d of %d decision(s) changed", changed, replayed)
+	if skipped > 0 {
+		fmt.Printf(", %d record(s) skipped", skipped)
+	}
+	fmt.Println()
+
+	if failed > 0 {
+		return fmt.Errorf("failed to replay %d record(s)", failed)
+	}
+	if changed > 0 && cmd.Bool("fail-on-drift") {
+		return fmt.Errorf("%d decision(s) changed", changed)
+	}
+	return nil
+}
+
+// replayInput returns the PORC to re-evaluate. The recorded PORC holds the resource as it was
+// resolved when the decision was made; with resolve, the resource MRN is passed instead so that
+// the bundles resolve it again.
+func replayInput(record *events.AccessRecord, resolve bool) (map[string]interface{}, error) {
+	var porc map[string]interface{}
+	if err := json.Unmarshal([]byte(record.Porc), &porc); err != nil {
+		return nil, err
+	}
+	if resolve && record.Resource != "" {
+		porc["resource"] = record.Resource
+	}
+	return porc, nil
+}
+
+func recordID(i int, record *events.AccessRecord) string {
+	if id := record.GetMetadata().GetId(); id != "" {
+		return id
+	}
+	return fmt.Sprintf("record %d", i+1)
+}
+
+// loadRecords reads access records from a file, or from stdin when path is "-".
+//
+// The records may be a JSON array, or a stream of JSON objects such as the output of the
+// stdout access log, in either its compact or its pretty-printed form.
+func loadRecords(path string) ([]*events.AccessRecord, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access records: %w", err)
+	}
+
+	var raws []json.RawMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, fmt.Errorf("failed to parse access records: %w", err)
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var raw json.RawMessage
+			err := decoder.Decode(&raw)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse access record %d: %w", len(raws)+1, err)
+			}
+			raws = append(raws, raw)
+		}
+	}
+
+	records := make([]*events.AccessRecord, 0, len(raws))
+	for i, raw := range raws {
+		record, err := parseRecord(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse access record %d: %w", i+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseRecord decodes an AccessRecord whose porc is either a JSON string, as in the protobuf
+// encoding, or an object, as written by the stdout access log. Records wrapped in a CloudEvents
+// envelope are unwrapped.
+func parseRecord(raw json.RawMessage) (*events.AccessRecord, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	if data, ok := fields["data"]; ok && fields["specversion"] != nil {
+		return parseRecord(data)
+	}
+
+	var porc string
+	if p, ok := fields["porc"]; ok {
+		if err := json.Unmarshal(p, &porc); err != nil {
+			porc = string(p)
+		}
+		delete(fields, "porc")
+	}
+
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &events.AccessRecord{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(rest, record); err != nil {
+		return nil, err
+	}
+	record.Porc = porc
+	return record, nil
+}
@@ -0,0 +1,215 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package replay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/common/clitest"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/options"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func runReplay(ctx context.Context, args ...string) error {
+	cmd := &cli.Command{
+		Name: "replay",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "records", Aliases: []string{"r"}},
+			&cli.StringSliceFlag{Name: "bundle", Aliases: []string{"b"}},
+			&cli.BoolFlag{Name: "resolve-resources"},
+			&cli.BoolFlag{Name: "fail-on-drift"},
+			&cli.StringFlag{Name: "opa-flags"},
+			&cli.BoolFlag{Name: "no-opa-flags"},
+		},
+		Action: Execute,
+	}
+	root := &cli.Command{
+		Name:     "mpe",
+		Flags:    []cli.Flag{&cli.BoolFlag{Name: "trace"}, &cli.StringSliceFlag{Name: "trace-filter"}},
+		Commands: []*cli.Command{cmd},
+	}
+	return root.Run(ctx, append([]string{"mpe", "replay"}, args...))
+}
+
+var requests = []struct{ role, operation string }{
+	{"mrn:iam:role:admin", "platform:admin:update"}, // GRANT by bypass rule
+	{"mrn:iam:role:monitor", "platform:health"},     // GRANT by bypass rule
+	{"mrn:iam:role:reader", "platform:doc:read"},    // DENY
+}
+
+// recordTraffic writes the access log of the requests evaluated against bypass.yml
+func recordTraffic(t *testing.T, opts accesslog.AccessLogOptions) string {
+	var buf bytes.Buffer
+	pe, err := core.NewLocalPolicyEngine([]string{clitest.TestData("bypass.yml")},
+		options.WithAccessLog(accesslog.NewIoWriterFactoryWithOptions(&buf, opts)))
+	require.NoError(t, err)
+
+	for _, r := range requests {
+		porc := fmt.Sprintf(`{"principal": {"sub": "alice", "mroles": ["%s"]}, "operation": "%s", "resource": "mrn:app:doc:1"}`, r.role, r.operation)
+		_, err := pe.Authorize(context.Background(), porc)
+		require.NoError(t, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0600))
+	return path
+}
+
+func TestExecute_NoDrift(t *testing.T) {
+	for _, opts := range []accesslog.AccessLogOptions{
+		{},
+		{PrettyPrint: true},
+		{CloudEvents: &accesslog.CloudEventsOptions{}},
+	} {
+		records := recordTraffic(t, opts)
+
+		out, err := clitest.CaptureStdout(func() error {
+			return runReplay(context.Background(), "-r", records, "-b", clitest.TestData("bypass.yml"), "--fail-on-drift")
+		})
+		require.NoError(t, err)
+		assert.Contains(t, out, "0 of 3 decision(s) changed")
+	}
+}
+
+func TestExecute_Drift(t *testing.T) {
+	records := recordTraffic(t, accesslog.AccessLogOptions{})
+	modified := clitest.WriteModified(t, "bypass.yml", `- "platform:health"`, `- "platform:status"`)
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runReplay(context.Background(), "-r", records, "-b", modified)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "GRANT → DENY (subject 'alice', operation 'platform:health', resource 'mrn:app:doc:1')")
+	assert.Contains(t, out, "1 of 3 decision(s) changed")
+
+	_, err = clitest.CaptureStdout(func() error {
+		return runReplay(context.Background(), "-r", records, "-b", modified, "--fail-on-drift")
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 decision(s) changed")
+}
+
+func TestExecute_ArrayAndSkippedRecords(t *testing.T) {
+	porc := `{"principal": {"sub": "alice", "mroles": ["mrn:iam:role:admin"]}, "operation": "platform:admin:update", "resource": "mrn:app:doc:1"}`
+	records := []*events.AccessRecord{
+		{Metadata: &events.AccessRecord_Metadata{Id: "changed"}, Decision: events.AccessRecord_DENY, Porc: porc},
+		{Metadata: &events.AccessRecord_Metadata{Id: "redacted"}, Decision: events.AccessRecord_DENY},
+		{Metadata: &events.AccessRecord_Metadata{Id: "override"}, Decision: events.AccessRecord_DENY, Porc: porc,
+			SystemOverride: true, Override: &events.AccessRecord_Override{Id: "deny-alice"}},
+	}
+
+	var encoded []string
+	for _, r := range records {
+		data, err := protojson.Marshal(r)
+		require.NoError(t, err)
+		encoded = append(encoded, string(data))
+	}
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, []byte("["+strings.Join(encoded, ",")+"]"), 0600))
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runReplay(context.Background(), "-r", path, "-b", clitest.TestData("bypass.yml"))
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "changed: DENY → GRANT")
+	assert.NotContains(t, out, "redacted:")
+	assert.NotContains(t, out, "override:")
+	assert.Contains(t, out, "1 of 1 decision(s) changed, 2 record(s) skipped")
+}
+
+const resourcesDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: resources
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:deny-all"
+      rego: |
+        package authz
+        default allow = false
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      policy: "mrn:iam:policy:allow-all"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+      default: true
+    - mrn: "mrn:iam:resource-group:restricted"
+      policy: "mrn:iam:policy:deny-all"
+  resources:
+    - name: secrets
+      selector:
+        - "mrn:app:secret:.*"
+      group: "mrn:iam:resource-group:restricted"
+  operations:
+    - name: all
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestExecute_ResolveResources(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "resources.yml")
+	require.NoError(t, os.WriteFile(bundle, []byte(resourcesDomain), 0600))
+
+	// the secret was recorded as a member of the default group, before the secrets resource was declared
+	porc := `{"principal": {"sub": "alice", "mroles": ["mrn:iam:role:reader"]}, "operation": "app:secret:read", "resource": {"id": "mrn:app:secret:1", "group": "mrn:iam:resource-group:default"}}`
+	data, err := protojson.Marshal(&events.AccessRecord{Decision: events.AccessRecord_GRANT, Resource: "mrn:app:secret:1", Porc: porc})
+	require.NoError(t, err)
+	records := filepath.Join(dir, "records.json")
+	require.NoError(t, os.WriteFile(records, data, 0600))
+
+	out, err := clitest.CaptureStdout(func() error {
+		return runReplay(context.Background(), "-r", records, "-b", bundle)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "0 of 1 decision(s) changed")
+
+	out, err = clitest.CaptureStdout(func() error {
+		return runReplay(context.Background(), "-r", records, "-b", bundle, "--resolve-resources")
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "record 1: GRANT → DENY")
+	assert.Contains(t, out, "1 of 1 decision(s) changed")
+}
+
+func TestExecute_Errors(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.json")
+	require.NoError(t, os.WriteFile(empty, []byte("\n"), 0600))
+	err := runReplay(context.Background(), "-r", empty, "-b", clitest.TestData("bypass.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no access records found")
+
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"decision": "GRANT"} {"decision": `), 0600))
+	err = runReplay(context.Background(), "-r", invalid, "-b", clitest.TestData("bypass.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse access record 2")
+
+	err = runReplay(context.Background(), "-r", filepath.Join(t.TempDir(), "missing.json"), "-b", clitest.TestData("bypass.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to read access records")
+}
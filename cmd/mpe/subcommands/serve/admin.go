@@ -0,0 +1,390 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
+	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/revocation"
+	"github.com/manetu/policyengine/pkg/decisionpoint"
+)
+
+// logControl is the response of the /loglevel admin endpoint
+type logControl struct {
+	Levels map[string]string `json:"levels"`
+	Trace  logging.TraceMode `json:"trace"`
+}
+
+// canaryControl is the response of the /canary admin endpoint
+type canaryControl struct {
+	Split      float64 `json:"split"`
+	RolledBack bool    `json:"rolledBack"`
+	Compared   uint64  `json:"compared"`
+	Diverged   uint64  `json:"diverged"`
+}
+
+// adminOptions holds the services reported and controlled through the admin API, any of
+// which may be nil when not in use
+type adminOptions struct {
+	approvals   approver
+	limiter     *decisionpoint.Limiter
+	health      *decisionpoint.HealthMonitor
+	decisions   *accesslog.DecisionMetrics
+	sampling    *accesslog.SamplingCounters
+	canary      *decisionpoint.Canary
+	revocations *revocation.Counter
+	rollout     *decisionpoint.Rollout
+	// profiling serves the runtime profiles along with the admin API
+	profiling bool
+}
+
+// approver records the approvals of pending approval requests, such as a policy engine
+type approver interface {
+	Approve(id, approver string) (approval.Request, error)
+	ListApprovals() []approval.Request
+}
+
+// newAdminHandler returns the runtime administration API:
+//   - GET /loglevel: the level of each logging module and the Rego trace mode
+//   - PUT /loglevel: changes them, given levels such as "accesslog:debug" and/or a trace mode
+//   - GET /metrics: the saturation of the limiter, the health of the backend, the decision
+//     counters, the access log sampling, and the canary rollout, in the Prometheus text format
+//   - GET /canary: the split of the canary rollout, and whether it was rolled back
+//   - PUT /canary: changes the split, such as "25%", lifting a rollback
+//   - GET /approvals: the approval requests that have not expired
+//   - POST /approvals/{id}: records the approval of a request, given its approver
+//   - GET /rollout: the bundle revision served and staged under a coordinated rollout
+func newAdminHandler(opts adminOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rollout", func(w http.ResponseWriter, r *http.Request) {
+		if opts.rollout == nil {
+			http.Error(w, "no rollout is coordinated", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, opts.rollout.Stats())
+	})
+	mux.HandleFunc("GET /approvals", func(w http.ResponseWriter, r *http.Request) {
+		if opts.approvals == nil {
+			http.Error(w, "approvals are not available", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, opts.approvals.ListApprovals())
+	})
+	mux.HandleFunc("POST /approvals/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if opts.approvals == nil {
+			http.Error(w, "approvals are not available", http.StatusNotFound)
+			return
+		}
+		var request struct {
+			Approver string `json:"approver"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		approved, err := opts.approvals.Approve(r.PathValue("id"), request.Approver)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, approved)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeMetrics(w, opts)
+	})
+	mux.HandleFunc("GET /canary", func(w http.ResponseWriter, r *http.Request) {
+		if opts.canary == nil {
+			http.Error(w, "no canary is rolled out", http.StatusNotFound)
+			return
+		}
+		writeCanaryControl(w, opts.canary)
+	})
+	mux.HandleFunc("PUT /canary", func(w http.ResponseWriter, r *http.Request) {
+		if opts.canary == nil {
+			http.Error(w, "no canary is rolled out", http.StatusNotFound)
+			return
+		}
+		var request struct {
+			Split string `json:"split"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		split, err := ParseRate(request.Split)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := opts.canary.SetSplit(split); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeCanaryControl(w, opts.canary)
+	})
+	mux.HandleFunc("GET /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		writeLogControl(w)
+	})
+	mux.HandleFunc("PUT /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Levels string            `json:"levels"`
+			Trace  logging.TraceMode `json:"trace"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := setLogControl(request.Levels, request.Trace); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeLogControl(w)
+	})
+	return mux
+}
+
+// setLogControl validates both settings before applying either
+func setLogControl(levels string, trace logging.TraceMode) error {
+	if levels == "" && trace == "" {
+		return errors.New("specify levels, trace, or both")
+	}
+	if levels != "" {
+		if err := logging.ValidateLogLevels(levels); err != nil {
+			return err
+		}
+	}
+	if trace != "" {
+		if err := logging.SetTraceMode(trace); err != nil {
+			return err
+		}
+		logger.Infof(agent, "admin", "Rego trace mode set to %s", trace)
+	}
+	if levels != "" {
+		if err := logging.UpdateLogLevels(levels); err != nil {
+			return err
+		}
+		logger.Infof(agent, "admin", "log levels set to %s", levels)
+	}
+	return nil
+}
+
+func writeLogControl(w http.ResponseWriter) {
+	writeJSON(w, logControl{Levels: logging.GetLogLevels(), Trace: logging.GetTraceMode()})
+}
+
+func writeCanaryControl(w http.ResponseWriter, canary *decisionpoint.Canary) {
+	stats := canary.Stats()
+	writeJSON(w, canaryControl{Split: stats.Split, RolledBack: stats.RolledBack, Compared: stats.Compared, Diverged: stats.Diverged})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeMetrics writes the limiter statistics, backend health, decision counters, access log
+// sampling, and canary rollout in the Prometheus text exposition format
+func writeMetrics(w http.ResponseWriter, opts adminOptions) {
+	stats, health := opts.limiter.Stats(), opts.health.Stats()
+	healthy := 0
+	if health.Healthy {
+		healthy = 1
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"mpe_decisions_active", "gauge", "Decisions being evaluated.", stats.Active},
+		{"mpe_decisions_queued", "gauge", "Decision requests waiting for a slot.", stats.Queued},
+		{"mpe_decisions_max_concurrent", "gauge", "Configured limit of decisions evaluated at once, 0 if unlimited.", stats.MaxConcurrent},
+		{"mpe_decisions_queue_size", "gauge", "Configured limit of decision requests waiting for a slot.", stats.QueueSize},
+		{"mpe_decisions_admitted_total", "counter", "Decision requests given a slot.", stats.Admitted},
+		{"mpe_decisions_rejected_total", "counter", "Decision requests turned away because the queue was full.", stats.Rejected},
+		{"mpe_decisions_timed_out_total", "counter", "Decision requests turned away because no slot freed up in time.", stats.TimedOut},
+		{"mpe_backend_healthy", "gauge", "Whether the last backend health check passed, 1 if the backend is not checked.", healthy},
+		{"mpe_backend_health_checks_total", "counter", "Backend health checks run.", health.Checks},
+		{"mpe_backend_health_failures_total", "counter", "Backend health checks that failed.", health.Failures},
+	}
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+
+	if opts.canary != nil {
+		writeCanaryMetrics(w, opts.canary.Stats())
+	}
+
+	if opts.revocations != nil {
+		writeRevocationMetrics(w, opts.revocations)
+	}
+
+	if opts.sampling != nil {
+		writeSamplingMetrics(w, opts.sampling.Stats())
+	}
+
+	decisions := opts.decisions
+	if decisions == nil {
+		return
+	}
+	_, _ = fmt.Fprint(w, "# HELP mpe_decisions_total Decisions written to the access log, including those dropped by sampling.\n# TYPE mpe_decisions_total counter\n")
+	labels := decisions.Labels()
+	for _, c := range decisions.Counts() {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = fmt.Sprintf("%s=%s", label, strconv.Quote(c.Values[i]))
+		}
+		_, _ = fmt.Fprintf(w, "mpe_decisions_total{%s} %d\n", strings.Join(pairs, ","), c.Count)
+	}
+}
+
+// writeSamplingMetrics reports the access records that sampling and rate limiting kept and dropped
+func writeSamplingMetrics(w http.ResponseWriter, stats accesslog.SamplingStats) {
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"mpe_accesslog_records_emitted_total", "counter", "Access records written to the access log.", stats.Emitted},
+		{"mpe_accesslog_records_sampled_total", "counter", "Access records dropped by sampling.", stats.Sampled},
+		{"mpe_accesslog_records_rate_limited_total", "counter", "Access records dropped by the access log rate limit.", stats.RateLimited},
+	}
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// writeRevocationMetrics reports the revocation checks of the decisions, and the synchronization
+// of the revocation list
+func writeRevocationMetrics(w http.ResponseWriter, revocations *revocation.Counter) {
+	checks := revocations.Stats()
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"mpe_revocation_checks_total", "counter", "Tokens checked against the revocation list.", checks.Checks},
+		{"mpe_revocation_hits_total", "counter", "Tokens denied because they or their session were revoked.", checks.Hits},
+		{"mpe_revocation_errors_total", "counter", "Revocation checks that failed, denying the token.", checks.Errors},
+	}
+	if synced, ok := revocations.Checker.(*revocation.Synced); ok {
+		stats := synced.Stats()
+		var lastSync float64
+		if !stats.LastSync.IsZero() {
+			lastSync = float64(stats.LastSync.UnixNano()) / 1e9
+		}
+		metrics = append(metrics, []struct {
+			name, kind, help string
+			value            interface{}
+		}{
+			{"mpe_revocation_keys", "gauge", "Revoked tokens and sessions in the last revocation list fetched.", stats.Keys},
+			{"mpe_revocation_syncs_total", "counter", "Fetches of the revocation list that succeeded.", stats.Syncs},
+			{"mpe_revocation_sync_failures_total", "counter", "Fetches of the revocation list that failed.", stats.Failures},
+			{"mpe_revocation_last_sync_timestamp_seconds", "gauge", "When the revocation list was last fetched, 0 if never.", lastSync},
+		}...)
+	}
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// writeCanaryMetrics compares the decisions served by each variant of the canary rollout
+func writeCanaryMetrics(w http.ResponseWriter, stats decisionpoint.CanaryStats) {
+	rolledBack := 0
+	if stats.RolledBack {
+		rolledBack = 1
+	}
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"mpe_canary_split", "gauge", "Fraction of decisions routed to the canary bundles.", stats.Split},
+		{"mpe_canary_rolled_back", "gauge", "Whether the canary was rolled back for diverging from the stable bundles.", rolledBack},
+		{"mpe_canary_compared_total", "counter", "Canary decisions compared with the stable bundles since the split was set.", stats.Compared},
+		{"mpe_canary_diverged_total", "counter", "Compared canary decisions that differed from the stable bundles.", stats.Diverged},
+	}
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+
+	variants := []struct {
+		name  decisionpoint.CanaryVariant
+		stats decisionpoint.CanaryVariantStats
+	}{
+		{decisionpoint.CanaryStable, stats.Stable},
+		{decisionpoint.CanaryCanary, stats.Canary},
+	}
+	counters := []struct {
+		name, help string
+		value      func(decisionpoint.CanaryVariantStats) interface{}
+	}{
+		{"mpe_canary_decisions_total", "Decisions served by each variant of the canary rollout.", func(s decisionpoint.CanaryVariantStats) interface{} { return s.Decisions }},
+		{"mpe_canary_grants_total", "Decisions granted by each variant of the canary rollout.", func(s decisionpoint.CanaryVariantStats) interface{} { return s.Grants }},
+		{"mpe_canary_errors_total", "Decisions failed by each variant of the canary rollout.", func(s decisionpoint.CanaryVariantStats) interface{} { return s.Errors }},
+		{"mpe_canary_decision_seconds_total", "Time taken by the decisions of each variant of the canary rollout.", func(s decisionpoint.CanaryVariantStats) interface{} { return s.Latency.Seconds() }},
+	}
+	for _, c := range counters {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, v := range variants {
+			_, _ = fmt.Fprintf(w, "%s{variant=%q} %v\n", c.name, v.name, c.value(v.stats))
+		}
+	}
+}
+
+// withProfiling adds the Go runtime profiles of net/http/pprof to the handler under /debug/pprof/,
+// such as /debug/pprof/heap and /debug/pprof/profile?seconds=30
+func withProfiling(handler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/", handler)
+	return mux
+}
+
+// startAdmin serves the admin API on the address, which takes any form accepted by decisionpoint.Listen,
+// along with the runtime profiles if profiling is set
+func startAdmin(address string, opts adminOptions) (*http.Server, error) {
+	listener, err := decisionpoint.Listen(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start admin server: %w", err)
+	}
+
+	handler := newAdminHandler(opts)
+	if opts.profiling {
+		handler = withProfiling(handler)
+		logger.Warn(agent, "admin", "Serving runtime profiles on the admin API under /debug/pprof/")
+	}
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf(agent, "admin", "admin server failed: %v", err)
+		}
+	}()
+	logger.Infof(agent, "admin", "Serving admin API on %s", listener.Addr())
+	return server, nil
+}
+
+// reloadLogging restores the configured log levels and trace mode, discarding any changes made
+// through the admin API
+func reloadLogging() {
+	if err := config.ReloadLogLevels(); err != nil {
+		logger.Errorf(agent, "reload", "failed to reload log levels: %v", err)
+		return
+	}
+	_ = logging.SetTraceMode(logging.TraceDefault)
+	logger.Info(agent, "reload", "Reloaded log levels from configuration")
+}
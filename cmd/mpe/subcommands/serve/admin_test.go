@@ -0,0 +1,322 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
+	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/revocation"
+	"github.com/manetu/policyengine/pkg/decisionpoint"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func request(t *testing.T, handler http.Handler, method, body string) (int, logControl) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, "/loglevel", strings.NewReader(body)))
+
+	var state logControl
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	}
+	return rec.Code, state
+}
+
+func TestAdmin_LogLevel(t *testing.T) {
+	defer func() {
+		_ = logging.UpdateLogLevels(".:info")
+		_ = logging.SetTraceMode(logging.TraceDefault)
+	}()
+	handler := newAdminHandler(adminOptions{})
+
+	code, state := request(t, handler, http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, logging.TraceDefault, state.Trace)
+	assert.Contains(t, state.Levels, ".")
+
+	code, state = request(t, handler, http.MethodPut, `{"levels": "accesslog:debug", "trace": "on"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "debug", state.Levels["accesslog"])
+	assert.Equal(t, logging.TraceOn, state.Trace)
+
+	// an invalid request changes nothing
+	for _, body := range []string{`{"levels": "accesslog:loud", "trace": "off"}`, `{"levels": ".:info", "trace": "loud"}`, `{}`, `{`} {
+		code, _ = request(t, handler, http.MethodPut, body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	_, state = request(t, handler, http.MethodGet, "")
+	assert.Equal(t, "debug", state.Levels["accesslog"])
+	assert.Equal(t, logging.TraceOn, state.Trace)
+
+	code, _ = request(t, handler, http.MethodDelete, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestAdmin_Metrics(t *testing.T) {
+	limiter, err := decisionpoint.NewLimiter(decisionpoint.LimiterOptions{MaxConcurrent: 1})
+	require.NoError(t, err)
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+	_, err = limiter.Acquire(context.Background())
+	require.ErrorIs(t, err, decisionpoint.ErrOverloaded)
+
+	decisions, err := accesslog.NewDecisionMetrics(accesslog.MetricsOptions{Operation: accesslog.MetricsLabelOptions{Allow: []string{"api:documents"}}})
+	require.NoError(t, err)
+	decisions.Observe(&events.AccessRecord{Decision: events.AccessRecord_GRANT, Operation: "api:documents:read"})
+	decisions.Observe(&events.AccessRecord{Decision: events.AccessRecord_DENY, Operation: "api:users:read"})
+
+	health, err := decisionpoint.NewHealthMonitor(func(context.Context) error { return errors.New("connection refused") }, decisionpoint.HealthOptions{})
+	require.NoError(t, err)
+	require.Error(t, health.Check(context.Background()))
+
+	sampling := &accesslog.SamplingCounters{}
+	inner, err := accesslog.NewIoWriterFactory(io.Discard).NewStream()
+	require.NoError(t, err)
+	stream := accesslog.NewSamplingStream(inner, accesslog.SamplingOptions{GrantRate: 0.0, DenyRate: 1.0, Counters: sampling})
+	require.NoError(t, stream.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+	require.NoError(t, stream.Send(&events.AccessRecord{Decision: events.AccessRecord_DENY}))
+
+	rec := httptest.NewRecorder()
+	newAdminHandler(adminOptions{limiter: limiter, health: health, decisions: decisions, sampling: sampling}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_decisions_active gauge\nmpe_decisions_active 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_decisions_max_concurrent 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_decisions_admitted_total 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_decisions_rejected_total 1\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_decisions_total counter\n"+
+		"mpe_decisions_total{decision=\"DENY\",operation=\"other\"} 1\n"+
+		"mpe_decisions_total{decision=\"GRANT\",operation=\"api:documents\"} 1\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_backend_healthy gauge\nmpe_backend_healthy 0\n")
+	assert.Contains(t, rec.Body.String(), "mpe_backend_health_checks_total 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_backend_health_failures_total 1\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_accesslog_records_emitted_total counter\nmpe_accesslog_records_emitted_total 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_accesslog_records_sampled_total 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_accesslog_records_rate_limited_total 0\n")
+
+	// without a limiter, the decisions are unbounded, and without a health monitor, the backend is healthy
+	rec = httptest.NewRecorder()
+	newAdminHandler(adminOptions{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "mpe_decisions_max_concurrent 0\n")
+	assert.Contains(t, rec.Body.String(), "mpe_backend_healthy 1\n")
+	assert.NotContains(t, rec.Body.String(), "mpe_accesslog")
+}
+
+func TestAdmin_RevocationMetrics(t *testing.T) {
+	list := revocation.NewMemory()
+	list.RevokeToken("t1", time.Time{})
+	srv := httptest.NewServer(revocation.Handler(list, 0))
+	defer srv.Close()
+
+	source, err := revocation.NewHTTPSource(revocation.HTTPOptions{URL: srv.URL})
+	require.NoError(t, err)
+	synced, err := revocation.NewSynced(revocation.SyncOptions{Source: source})
+	require.NoError(t, err)
+	require.NoError(t, synced.Sync(context.Background()))
+
+	revocations := revocation.NewCounter(synced)
+	_, _ = revocations.Revoked(context.Background(), revocation.Token{ID: "t1"})
+	_, _ = revocations.Revoked(context.Background(), revocation.Token{ID: "t2"})
+
+	rec := httptest.NewRecorder()
+	newAdminHandler(adminOptions{revocations: revocations}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_revocation_checks_total counter\nmpe_revocation_checks_total 2\n")
+	assert.Contains(t, rec.Body.String(), "mpe_revocation_hits_total 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_revocation_errors_total 0\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_revocation_keys gauge\nmpe_revocation_keys 1\n")
+	assert.Contains(t, rec.Body.String(), "mpe_revocation_syncs_total 1\n")
+
+	// without a revocation checker, no revocation metrics are reported
+	rec = httptest.NewRecorder()
+	newAdminHandler(adminOptions{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotContains(t, rec.Body.String(), "mpe_revocation")
+}
+
+func TestAdmin_Canary(t *testing.T) {
+	canary, err := decisionpoint.NewCanary(nil, nil, decisionpoint.CanaryOptions{Split: 0.05})
+	require.NoError(t, err)
+	handler := newAdminHandler(adminOptions{canary: canary})
+
+	send := func(method, body string) (int, canaryControl) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/canary", strings.NewReader(body)))
+		var state canaryControl
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+		}
+		return rec.Code, state
+	}
+
+	code, state := send(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, canaryControl{Split: 0.05}, state)
+
+	code, state = send(http.MethodPut, `{"split": "25%"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0.25, state.Split)
+	assert.Equal(t, 0.25, canary.Stats().Split)
+
+	for _, body := range []string{`{"split": "150%"}`, `{"split": "lots"}`, `{`} {
+		code, _ = send(http.MethodPut, body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_canary_split gauge\nmpe_canary_split 0.25\n")
+	assert.Contains(t, rec.Body.String(), "mpe_canary_rolled_back 0\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE mpe_canary_decisions_total counter\n"+
+		"mpe_canary_decisions_total{variant=\"stable\"} 0\n"+
+		"mpe_canary_decisions_total{variant=\"canary\"} 0\n")
+
+	// without a canary, there is no rollout to report or change
+	handler = newAdminHandler(adminOptions{})
+	code, _ = send(http.MethodGet, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotContains(t, rec.Body.String(), "mpe_canary")
+}
+
+func TestAdmin_Rollout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"revision": "v43"}`), 0600))
+	source, err := decisionpoint.NewRolloutSource(path)
+	require.NoError(t, err)
+	rollout, err := decisionpoint.NewRollout(decisionpoint.RolloutOptions{
+		Source: source,
+		Stage: func(context.Context, string) (func() error, error) {
+			return func() error { return nil }, nil
+		},
+		Revision: "v42",
+	})
+	require.NoError(t, err)
+	require.NoError(t, rollout.Sync(context.Background()))
+
+	rec := httptest.NewRecorder()
+	newAdminHandler(adminOptions{rollout: rollout}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rollout", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var stats decisionpoint.RolloutStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, "v43", stats.Revision)
+	assert.Equal(t, "v43", stats.Target.Revision)
+
+	rec = httptest.NewRecorder()
+	newAdminHandler(adminOptions{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rollout", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestReloadLogging(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(config.ConfigPathEnv, dir)
+	t.Setenv(config.ConfigFileNameEnv, "mpe-config")
+	t.Setenv("MPE_LOG_LEVEL", "")
+	config.ResetConfig()
+	defer func() {
+		config.ResetConfig()
+		_ = logging.UpdateLogLevels(".:info")
+		_ = logging.SetTraceMode(logging.TraceDefault)
+	}()
+
+	require.NoError(t, setLogControl("accesslog:debug", logging.TraceOn))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mpe-config.yaml"), []byte("log:\n  level: \".:warn\"\n"), 0600))
+	reloadLogging()
+
+	levels := logging.GetLogLevels()
+	assert.Equal(t, "warn", levels["."])
+	assert.Equal(t, "warn", levels["accesslog"])
+	assert.Equal(t, logging.TraceDefault, logging.GetTraceMode())
+}
+
+// storeApprover records approvals in a store, as a policy engine does
+type storeApprover struct {
+	*approval.Store
+}
+
+func (a storeApprover) Approve(id, approver string) (approval.Request, error) {
+	return a.Store.Approve(id, approver, time.Now())
+}
+
+func (a storeApprover) ListApprovals() []approval.Request {
+	return a.List()
+}
+
+func TestAdmin_Approvals(t *testing.T) {
+	store := approval.NewStore(0)
+	pending, _ := store.Open("alice", "admin:tenant:delete", "mrn:app:tenant:1", 1, time.Now())
+	handler := newAdminHandler(adminOptions{approvals: storeApprover{store}})
+
+	send := func(method, path, body string) (int, []byte) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code, rec.Body.Bytes()
+	}
+
+	code, body := send(http.MethodGet, "/approvals", "")
+	assert.Equal(t, http.StatusOK, code)
+	var listed []approval.Request
+	require.NoError(t, json.Unmarshal(body, &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, pending.ID, listed[0].ID)
+	assert.Empty(t, listed[0].Approvers)
+
+	for _, body := range []string{`{"approver": "alice"}`, `{}`, `{`} {
+		code, _ = send(http.MethodPost, "/approvals/"+pending.ID, body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	code, _ = send(http.MethodPost, "/approvals/unknown", `{"approver": "bob"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body = send(http.MethodPost, "/approvals/"+pending.ID, `{"approver": "bob"}`)
+	assert.Equal(t, http.StatusOK, code)
+	var approved approval.Request
+	require.NoError(t, json.Unmarshal(body, &approved))
+	assert.Equal(t, []string{"bob"}, approved.Approvers)
+	assert.True(t, approved.Approved())
+
+	// without a policy engine, there are no approvals to list or record
+	handler = newAdminHandler(adminOptions{})
+	code, _ = send(http.MethodGet, "/approvals", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = send(http.MethodPost, "/approvals/"+pending.ID, `{"approver": "bob"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAdmin_Profiling(t *testing.T) {
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// profiles are only served when enabled
+	handler := newAdminHandler(adminOptions{})
+	assert.Equal(t, http.StatusNotFound, get(handler, "/debug/pprof/").Code)
+
+	handler = withProfiling(handler)
+	rec := get(handler, "/debug/pprof/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "heap")
+	assert.Equal(t, http.StatusOK, get(handler, "/debug/pprof/heap?debug=1").Code)
+
+	// the admin API is still served
+	assert.Equal(t, http.StatusOK, get(handler, "/loglevel").Code)
+}
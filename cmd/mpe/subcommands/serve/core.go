@@ -6,14 +6,25 @@ package serve
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/manetu/policyengine/cmd/mpe/common"
 	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
+	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/revocation"
 	"github.com/manetu/policyengine/pkg/decisionpoint"
 	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
-	"github.com/manetu/policyengine/pkg/decisionpoint/generic"
 	"github.com/urfave/cli/v3"
 )
 
@@ -21,33 +32,194 @@ var logger = logging.GetLogger("policyengine")
 
 const agent string = "serve"
 
-// Execute runs the serve command, starting a decision point server based on the configured protocol.
-// It supports both "generic" and "envoy" protocols and gracefully shuts down on interrupt signals.
+// Execute runs the serve command, starting a decision point server for each configured endpoint.
+// It supports both "generic" and "envoy" protocols, which may be served at once by a single engine,
+// and gracefully shuts down on interrupt signals.
 func Execute(ctx context.Context, cmd *cli.Command) error {
-	port := cmd.Int("port")
+	if cmd.IsSet("listen") && cmd.IsSet("port") {
+		return fmt.Errorf("--listen and --port are mutually exclusive")
+	}
+
+	endpoints, err := getEndpoints(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Bool("envoy-als") && !hasProtocol(endpoints, "envoy") {
+		return fmt.Errorf("--envoy-als requires --protocol envoy or an envoy --endpoint")
+	}
+
+	if (cmd.IsSet("mapper-output") || cmd.IsSet("mapper-metadata")) && !hasProtocol(endpoints, "envoy") {
+		return fmt.Errorf("--mapper-output and --mapper-metadata require --protocol envoy or an envoy --endpoint")
+	}
+
+	if cmd.Bool("pprof") && cmd.String("admin-listen") == "" {
+		return fmt.Errorf("--pprof requires --admin-listen")
+	}
+
+	tlsConfig, err := getTLSConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	metrics, err := getDecisionMetrics()
+	if err != nil {
+		return err
+	}
 
-	pe, err := common.NewCliPolicyEngine(cmd, os.Stdout)
+	accessLogOpts, err := common.GetAccessLogOptions(cmd)
 	if err != nil {
 		return err
 	}
+	var (
+		accessLog  accesslog.Factory = accesslog.NewIoWriterFactoryWithOptions(os.Stdout, accessLogOpts)
+		correlator *envoy.Correlator
+	)
+	if cmd.Bool("envoy-als") {
+		correlator = envoy.NewCorrelator(accessLog, os.Stdout, accessLogOpts, cmd.Duration("envoy-als-ttl"))
+		accessLog = correlator
+	}
+	// a request approved while served by one variant of a canary may be redeemed by the other
+	approvals := approval.NewStore(0)
+	// the access records of every engine, such as those of a canary rollout, are counted together
+	sampling := &accesslog.SamplingCounters{}
+	engineOpts := []options.EngineOptionsFunc{
+		options.WithDecisionMetrics(metrics),
+		options.WithSamplingCounters(sampling),
+		options.WithApprovalStore(approvals),
+	}
 
-	var server decisionpoint.Server
-	switch cmd.String("protocol") {
-	case "generic":
-		server, err = generic.CreateServer(pe, port)
-	case "envoy":
-		server, err = envoy.CreateServer(pe, port, cmd.String("name"))
+	revocations, err := getRevocations(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if revocations != nil {
+		engineOpts = append(engineOpts, options.WithRevocationChecker(revocations))
+		revocationCtx, stopRevocations := context.WithCancel(ctx)
+		defer stopRevocations()
+		go revocations.Checker.(*revocation.Synced).Run(revocationCtx)
 	}
+
+	pe, rollout, err := getRollout(ctx, cmd, accessLog, engineOpts)
 	if err != nil {
 		return err
 	}
 
+	canary, err := getCanary(cmd, pe, accessLog, engineOpts)
+	if err != nil {
+		return err
+	}
+	if canary != nil {
+		pe = canary
+	}
+
+	recorder, err := getRecorder(cmd)
+	if err != nil {
+		return err
+	}
+	if recorder != nil {
+		sub := pe.Subscribe(recordBuffer)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			recorder.Run(sub)
+		}()
+		defer func() {
+			sub.Close()
+			<-done
+			_ = recorder.Close()
+			logger.Infof(agent, "recorder", "recorded %d decision(s) in %s", recorder.Recorded(), cmd.String("record-fixtures"))
+		}()
+	}
+
+	smokeTests, err := getSmokeTests()
+	if err != nil {
+		return err
+	}
+
+	limiter, err := getLimiter(cmd)
+	if err != nil {
+		return err
+	}
+
+	// serve the health probes while the bundles compile, but report ready only once they have
+	readiness := decisionpoint.NewReadiness("compiling bundles")
+
+	// every endpoint shares the engine, limiter, and readiness, so that they decide alike and
+	// are ready together
+	server, err := startServers(ctx, pe, endpoints, serverOptions{
+		port:       cmd.Int("port"),
+		domain:     cmd.String("name"),
+		tls:        tlsConfig,
+		readiness:  readiness,
+		limiter:    limiter,
+		correlator: correlator,
+		mapper:     cmd.String("mapper-output"),
+		metadata:   cmd.StringSlice("mapper-metadata"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := prepare(ctx, pe, readiness, smokeTests); err != nil {
+		_ = server.Stop(ctx)
+		return err
+	}
+
+	health, err := getHealthMonitor(cmd, pe, readiness)
+	if err != nil {
+		_ = server.Stop(ctx)
+		return err
+	}
+	healthCtx, stopHealth := context.WithCancel(ctx)
+	defer stopHealth()
+	go health.Run(healthCtx)
+
+	if rollout != nil {
+		rolloutCtx, stopRollout := context.WithCancel(ctx)
+		defer stopRollout()
+		go rollout.Run(rolloutCtx)
+	}
+
+	var admin *http.Server
+	if address := cmd.String("admin-listen"); address != "" {
+		admin, err = startAdmin(address, adminOptions{
+			approvals:   pe,
+			limiter:     limiter,
+			health:      health,
+			decisions:   metrics,
+			sampling:    sampling,
+			canary:      canary,
+			revocations: revocations,
+			rollout:     rollout,
+			profiling:   cmd.Bool("pprof"),
+		})
+		if err != nil {
+			_ = server.Stop(ctx)
+			return err
+		}
+	}
+
+	// SIGHUP restores the configured log levels, such as after editing log.level in the configuration file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			reloadLogging()
+		}
+	}()
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 	logger.Info(agent, "shutdown", "Shutting down server...")
 
+	stopHealth()
+	if admin != nil {
+		_ = admin.Shutdown(ctx)
+	}
 	err = server.Stop(ctx)
 	if err != nil {
 		return err
@@ -56,3 +228,298 @@ func Execute(ctx context.Context, cmd *cli.Command) error {
 	logger.Info(agent, "shutdown", "Server exited gracefully.")
 	return nil
 }
+
+// prepare compiles every policy and runs the smoke tests, marking the decision point ready if
+// they pass. A failed smoke test leaves the decision point running but not ready, so that it
+// receives no traffic while the failure is investigated.
+func prepare(ctx context.Context, pe core.PolicyEngine, readiness *decisionpoint.Readiness, smokeTests []decisionpoint.SmokeTest) error {
+	if err := pe.WarmUp(ctx); err != nil {
+		return err
+	}
+
+	if len(smokeTests) > 0 {
+		readiness.SetNotReady("running smoke tests")
+		if err := decisionpoint.RunSmokeTests(ctx, pe, smokeTests); err != nil {
+			readiness.SetNotReady(err.Error())
+			logger.Errorf(agent, "readiness", "not ready: %v", err)
+			return nil
+		}
+	}
+
+	readiness.SetReady()
+	logger.Infof(agent, "readiness", "ready: bundles compiled and %d smoke test(s) passed", len(smokeTests))
+	return nil
+}
+
+// getSmokeTests returns the smoke tests of the readiness.smoketests configuration
+func getSmokeTests() ([]decisionpoint.SmokeTest, error) {
+	entries, err := config.GetSmokeTests()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s configuration: %w", config.ReadinessSmokeTests, err)
+	}
+
+	tests := make([]decisionpoint.SmokeTest, 0, len(entries))
+	for i, entry := range entries {
+		if entry.PORC == nil {
+			return nil, fmt.Errorf("%s[%d]: missing porc", config.ReadinessSmokeTests, i)
+		}
+		tests = append(tests, decisionpoint.SmokeTest{Name: entry.Name, PORC: entry.PORC, Allow: entry.Allow})
+	}
+	return tests, nil
+}
+
+// getDecisionMetrics returns the decision counters, labeled as selected by the metrics.decisions configuration
+func getDecisionMetrics() (*accesslog.DecisionMetrics, error) {
+	if err := config.Load(); err != nil {
+		return nil, err
+	}
+	label := func(allow, buckets string) accesslog.MetricsLabelOptions {
+		return accesslog.MetricsLabelOptions{
+			Allow:   config.VConfig.GetStringSlice(allow),
+			Buckets: config.VConfig.GetInt(buckets),
+		}
+	}
+	metrics, err := accesslog.NewDecisionMetrics(accesslog.MetricsOptions{
+		Realm:     label(config.MetricsRealmAllow, config.MetricsRealmBuckets),
+		Operation: label(config.MetricsOperationAllow, config.MetricsOperationBuckets),
+		Principal: label(config.MetricsPrincipalAllow, config.MetricsPrincipalBuckets),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics.decisions configuration: %w", err)
+	}
+	return metrics, nil
+}
+
+// getTLSConfig returns the TLS configuration selected by the --tls flags, or nil to serve in plaintext
+func getTLSConfig(cmd *cli.Command) (*tls.Config, error) {
+	opts := decisionpoint.TLSOptions{
+		CertFile:       cmd.String("tls-cert"),
+		KeyFile:        cmd.String("tls-key"),
+		ClientCAFile:   cmd.String("tls-client-ca"),
+		ClientSANs:     cmd.StringSlice("tls-client-san"),
+		ReloadInterval: cmd.Duration("tls-reload-interval"),
+	}
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		if opts.ClientCAFile != "" || len(opts.ClientSANs) > 0 {
+			return nil, fmt.Errorf("--tls-client-ca and --tls-client-san require --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+
+	return decisionpoint.NewTLSConfig(opts)
+}
+
+// getHealthMonitor returns the monitor of the backend's health selected by --health-interval,
+// or nil if the backend is not checked
+func getHealthMonitor(cmd *cli.Command, pe core.PolicyEngine, readiness *decisionpoint.Readiness) (*decisionpoint.HealthMonitor, error) {
+	interval := cmd.Duration("health-interval")
+	if interval == 0 {
+		return nil, nil
+	}
+
+	return decisionpoint.NewHealthMonitor(pe.Health, decisionpoint.HealthOptions{
+		Interval:  interval,
+		Timeout:   cmd.Duration("health-timeout"),
+		Readiness: readiness,
+	})
+}
+
+// recordBuffer is the number of decisions buffered for sampling by the fixtures recorder
+const recordBuffer = 1024
+
+// getRecorder returns the fixtures recorder selected by --record-fixtures, or nil if decisions are
+// not recorded
+func getRecorder(cmd *cli.Command) (*Recorder, error) {
+	dir := cmd.String("record-fixtures")
+	if dir == "" {
+		if cmd.IsSet("sample") || cmd.IsSet("record-hash") || cmd.IsSet("record-strip") || cmd.IsSet("record-hash-key") {
+			return nil, fmt.Errorf("--sample, --record-hash, --record-strip, and --record-hash-key require --record-fixtures")
+		}
+		return nil, nil
+	}
+
+	rate, err := ParseRate(cmd.String("sample"))
+	if err != nil {
+		return nil, fmt.Errorf("--sample: %w", err)
+	}
+
+	opts := RecorderOptions{
+		Dir:  dir,
+		Rate: rate,
+		Redaction: accesslog.RedactionOptions{
+			Strip: cmd.StringSlice("record-strip"),
+			Hash:  cmd.StringSlice("record-hash"),
+		},
+	}
+	if key := cmd.String("record-hash-key"); key != "" {
+		opts.Redaction.HashKey = []byte(key)
+	}
+	return NewRecorder(opts)
+}
+
+// getCanary returns the canary rollout selected by --canary-bundle, serving decisions from the
+// stable engine and one loaded from the canary bundles, or nil if no canary is rolled out
+func getCanary(cmd *cli.Command, stable core.PolicyEngine, accessLog accesslog.Factory, engineOpts []options.EngineOptionsFunc) (*decisionpoint.Canary, error) {
+	bundles := cmd.StringSlice("canary-bundle")
+	if len(bundles) == 0 {
+		if cmd.IsSet("canary-split") || cmd.IsSet("canary-header") || cmd.IsSet("canary-rollback") || cmd.IsSet("canary-min-comparisons") {
+			return nil, fmt.Errorf("--canary-split, --canary-header, --canary-rollback, and --canary-min-comparisons require --canary-bundle")
+		}
+		return nil, nil
+	}
+
+	split, err := ParseRate(cmd.String("canary-split"))
+	if err != nil {
+		return nil, fmt.Errorf("--canary-split: %w", err)
+	}
+	var threshold float64
+	if rollback := cmd.String("canary-rollback"); rollback != "" {
+		if threshold, err = ParseRate(rollback); err != nil {
+			return nil, fmt.Errorf("--canary-rollback: %w", err)
+		}
+	}
+
+	canary, err := common.NewBundlePolicyEngine(cmd, bundles, accessLog, engineOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load canary bundles: %w", err)
+	}
+
+	return decisionpoint.NewCanary(stable, canary, decisionpoint.CanaryOptions{
+		Split:             split,
+		Header:            cmd.String("canary-header"),
+		RollbackThreshold: threshold,
+		MinComparisons:    int(cmd.Int("canary-min-comparisons")),
+	})
+}
+
+// getRevocations returns the revocation checker selected by --revocation-url, counting its checks,
+// or nil if tokens are not checked. The revocation list is fetched once before serving, so that
+// no revoked token is granted because the list is not synchronized yet.
+func getRevocations(ctx context.Context, cmd *cli.Command) (*revocation.Counter, error) {
+	address := cmd.String("revocation-url")
+	if address == "" {
+		if cmd.IsSet("revocation-token") || cmd.IsSet("revocation-interval") || cmd.IsSet("revocation-max-age") {
+			return nil, fmt.Errorf("--revocation-token, --revocation-interval, and --revocation-max-age require --revocation-url")
+		}
+		return nil, nil
+	}
+
+	source, err := revocation.NewHTTPSource(revocation.HTTPOptions{URL: address, Token: cmd.String("revocation-token")})
+	if err != nil {
+		return nil, fmt.Errorf("--revocation-url: %w", err)
+	}
+	synced, err := revocation.NewSynced(revocation.SyncOptions{
+		Source:   source,
+		Interval: cmd.Duration("revocation-interval"),
+		MaxAge:   cmd.Duration("revocation-max-age"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := synced.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to fetch revocation list: %w", err)
+	}
+	logger.Infof(agent, "revocation", "fetched revocation list of %d key(s) from %s", synced.Stats().Keys, address)
+
+	return revocation.NewCounter(synced), nil
+}
+
+// getLimiter returns the limiter selected by --max-concurrent, or nil if decisions are unbounded
+func getLimiter(cmd *cli.Command) (*decisionpoint.Limiter, error) {
+	maxConcurrent := cmd.Int("max-concurrent")
+	if maxConcurrent == 0 {
+		if cmd.IsSet("queue-size") || cmd.IsSet("queue-timeout") || cmd.IsSet("overload-action") {
+			return nil, fmt.Errorf("--queue-size, --queue-timeout, and --overload-action require --max-concurrent")
+		}
+		return nil, nil
+	}
+
+	return decisionpoint.NewLimiter(decisionpoint.LimiterOptions{
+		MaxConcurrent: maxConcurrent,
+		QueueSize:     cmd.Int("queue-size"),
+		QueueTimeout:  cmd.Duration("queue-timeout"),
+		Action:        decisionpoint.OverloadAction(cmd.String("overload-action")),
+	})
+}
+
+// revisionPlaceholder is replaced by the revision to serve in the --bundle paths of a coordinated rollout
+const revisionPlaceholder = "{revision}"
+
+// getRollout returns the policy engine serving the --bundle paths, and the rollout selected by
+// --rollout-source that keeps it serving the same revision as the other replicas, or nil if
+// revisions are not coordinated. The rollout target is fetched once before serving, so that a
+// replica starting during a rollout serves the same revision as the others.
+func getRollout(ctx context.Context, cmd *cli.Command, accessLog accesslog.Factory, engineOpts []options.EngineOptionsFunc) (core.PolicyEngine, *decisionpoint.Rollout, error) {
+	address := cmd.String("rollout-source")
+	if address == "" {
+		if cmd.IsSet("rollout-interval") {
+			return nil, nil, fmt.Errorf("--rollout-interval requires --rollout-source")
+		}
+		pe, err := common.NewCliPolicyEngineWithAccessLog(cmd, accessLog, engineOpts...)
+		return pe, nil, err
+	}
+
+	source, err := decisionpoint.NewRolloutSource(address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("--rollout-source: %w", err)
+	}
+	target, err := source.Fetch(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch rollout target: %w", err)
+	}
+
+	bundles := cmd.StringSlice("bundle")
+	revision := target.Serving(time.Now())
+	paths, err := revisionBundles(bundles, revision)
+	if err != nil {
+		return nil, nil, err
+	}
+	reg, err := common.LoadRegistry(paths)
+	if err != nil {
+		return nil, nil, fmt.Errorf("revision %s: %w", revision, err)
+	}
+	pe, err := common.NewRegistryPolicyEngine(cmd, reg, accessLog, engineOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("revision %s: %w", revision, err)
+	}
+	logger.Infof(agent, "rollout", "serving revision %s of %s", revision, address)
+
+	rollout, err := decisionpoint.NewRollout(decisionpoint.RolloutOptions{
+		Source: source,
+		Stage: func(ctx context.Context, revision string) (func() error, error) {
+			paths, err := revisionBundles(bundles, revision)
+			if err != nil {
+				return nil, err
+			}
+			models, err := common.LoadModels(paths)
+			if err != nil {
+				return nil, err
+			}
+			staged, err := reg.Stage(models)
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return reg.Swap(staged) }, nil
+		},
+		Revision: revision,
+		Interval: cmd.Duration("rollout-interval"),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pe, rollout, nil
+}
+
+// revisionBundles returns the bundle paths of a revision, replacing the {revision} placeholder
+// in each. Revisions naming other directories than their own are rejected.
+func revisionBundles(bundles []string, revision string) ([]string, error) {
+	if revision == "." || revision == ".." || strings.ContainsAny(revision, `/\`) {
+		return nil, fmt.Errorf("invalid revision '%s': must not be a path", revision)
+	}
+
+	paths := make([]string, len(bundles))
+	for i, bundle := range bundles {
+		paths[i] = strings.ReplaceAll(bundle, revisionPlaceholder, revision)
+	}
+	return paths, nil
+}
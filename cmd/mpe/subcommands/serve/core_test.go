@@ -0,0 +1,23 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevisionBundles(t *testing.T) {
+	paths, err := revisionBundles([]string{"/bundles/{revision}/*.yml", "/etc/mpe/base.yml"}, "v43")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/bundles/v43/*.yml", "/etc/mpe/base.yml"}, paths)
+
+	for _, revision := range []string{"..", ".", "../v43", `v43\..`} {
+		_, err := revisionBundles([]string{"/bundles/{revision}"}, revision)
+		assert.Error(t, err, revision)
+	}
+}
@@ -0,0 +1,159 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/decisionpoint"
+	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
+	"github.com/manetu/policyengine/pkg/decisionpoint/generic"
+	"github.com/urfave/cli/v3"
+)
+
+// protocols are the decision APIs that may be served
+var protocols = []string{"generic", "envoy"}
+
+// Endpoint is a decision API served on an address
+type Endpoint struct {
+	// Protocol is the decision API, one of "generic" or "envoy"
+	Protocol string
+	// Address is in any form accepted by [decisionpoint.Listen], or empty to listen on the port
+	Address string
+}
+
+func (e Endpoint) String() string {
+	return e.Protocol + "=" + e.Address
+}
+
+// ParseEndpoint parses an endpoint in the form "PROTOCOL=ADDRESS", such as "envoy=:9001" or
+// "generic=unix:///var/run/mpe.sock"
+func ParseEndpoint(s string) (Endpoint, error) {
+	protocol, address, ok := strings.Cut(s, "=")
+	if !ok || address == "" {
+		return Endpoint{}, fmt.Errorf("invalid endpoint '%s': must be PROTOCOL=ADDRESS", s)
+	}
+	if !slices.Contains(protocols, protocol) {
+		return Endpoint{}, fmt.Errorf("invalid endpoint '%s': unsupported protocol '%s'", s, protocol)
+	}
+	return Endpoint{Protocol: protocol, Address: address}, nil
+}
+
+// getEndpoints returns the endpoints selected by --endpoint, or the single one selected by
+// --protocol and either --listen or --port
+func getEndpoints(cmd *cli.Command) ([]Endpoint, error) {
+	values := cmd.StringSlice("endpoint")
+	if len(values) == 0 {
+		return []Endpoint{{Protocol: cmd.String("protocol"), Address: cmd.String("listen")}}, nil
+	}
+	if cmd.IsSet("protocol") || cmd.IsSet("listen") || cmd.IsSet("port") {
+		return nil, fmt.Errorf("--endpoint is mutually exclusive with --protocol, --listen, and --port")
+	}
+
+	endpoints := make([]Endpoint, 0, len(values))
+	for _, value := range values {
+		endpoint, err := ParseEndpoint(value)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(endpoints, func(e Endpoint) bool { return e.Address == endpoint.Address }) {
+			return nil, fmt.Errorf("invalid endpoint '%s': address '%s' is already served", value, endpoint.Address)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// hasProtocol reports whether any of the endpoints serves the protocol
+func hasProtocol(endpoints []Endpoint, protocol string) bool {
+	return slices.ContainsFunc(endpoints, func(e Endpoint) bool { return e.Protocol == protocol })
+}
+
+// serverOptions are the options common to the servers of every endpoint
+type serverOptions struct {
+	port       int
+	domain     string
+	tls        *tls.Config
+	readiness  *decisionpoint.Readiness
+	limiter    *decisionpoint.Limiter
+	correlator *envoy.Correlator
+	mapper     string   // the mapper output that envoy servers evaluate as the PORC
+	metadata   []string // the mapper outputs that envoy servers return as dynamic metadata
+}
+
+// startServers starts a server for each endpoint, all deciding with the same engine. If any fails
+// to start, those already started are stopped.
+func startServers(ctx context.Context, pe core.PolicyEngine, endpoints []Endpoint, opts serverOptions) (decisionpoint.Servers, error) {
+	servers := make(decisionpoint.Servers, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		server, err := startServer(pe, endpoint, opts)
+		if err != nil {
+			_ = servers.Stop(ctx)
+			return nil, fmt.Errorf("endpoint %s: %w", endpoint, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// startServer starts the server of the endpoint's protocol on its address
+func startServer(pe core.PolicyEngine, endpoint Endpoint, opts serverOptions) (decisionpoint.Server, error) {
+	var listener net.Listener
+	if endpoint.Address != "" {
+		var err error
+		if listener, err = decisionpoint.Listen(endpoint.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	switch endpoint.Protocol {
+	case "generic":
+		var serverOpts []generic.ServerOption
+		if opts.tls != nil {
+			serverOpts = append(serverOpts, generic.WithTLS(opts.tls))
+		}
+		if listener != nil {
+			serverOpts = append(serverOpts, generic.WithListener(listener))
+		}
+		serverOpts = append(serverOpts, generic.WithReadiness(opts.readiness))
+		if opts.limiter != nil {
+			serverOpts = append(serverOpts, generic.WithLimiter(opts.limiter))
+		}
+		return generic.CreateServer(pe, opts.port, serverOpts...)
+	case "envoy":
+		var serverOpts []envoy.ServerOption
+		if opts.correlator != nil {
+			serverOpts = append(serverOpts, envoy.WithAccessLogService(opts.correlator))
+		}
+		if opts.tls != nil {
+			serverOpts = append(serverOpts, envoy.WithTLS(opts.tls))
+		}
+		if listener != nil {
+			serverOpts = append(serverOpts, envoy.WithListener(listener))
+		}
+		serverOpts = append(serverOpts, envoy.WithReadiness(opts.readiness))
+		if opts.limiter != nil {
+			serverOpts = append(serverOpts, envoy.WithLimiter(opts.limiter))
+		}
+		if opts.mapper != "" {
+			serverOpts = append(serverOpts, envoy.WithMapperOutput(opts.mapper))
+		}
+		if len(opts.metadata) > 0 {
+			serverOpts = append(serverOpts, envoy.WithMapperMetadata(opts.metadata...))
+		}
+		return envoy.CreateServer(pe, opts.port, opts.domain, serverOpts...)
+	}
+
+	if listener != nil {
+		_ = listener.Close()
+	}
+	return nil, fmt.Errorf("unsupported protocol: %s", endpoint.Protocol)
+}
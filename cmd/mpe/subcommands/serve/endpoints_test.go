@@ -0,0 +1,148 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/internal/core/test"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/decisionpoint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	endpoint, err := ParseEndpoint("envoy=:9001")
+	require.NoError(t, err)
+	assert.Equal(t, Endpoint{Protocol: "envoy", Address: ":9001"}, endpoint)
+
+	endpoint, err = ParseEndpoint("generic=unix:///var/run/mpe.sock")
+	require.NoError(t, err)
+	assert.Equal(t, Endpoint{Protocol: "generic", Address: "unix:///var/run/mpe.sock"}, endpoint)
+
+	for _, s := range []string{"envoy", "envoy=", ":9001", "grpc=:9001"} {
+		_, err := ParseEndpoint(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// endpoints runs the serve command's endpoint selection with the arguments
+func endpoints(t *testing.T, args ...string) ([]Endpoint, error) {
+	var (
+		result []Endpoint
+		err    error
+	)
+	cmd := &cli.Command{
+		Name: "serve",
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "port", Value: 9000},
+			&cli.StringFlag{Name: "listen"},
+			&cli.StringFlag{Name: "protocol", Value: "generic"},
+			&cli.StringSliceFlag{Name: "endpoint"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			result, err = getEndpoints(cmd)
+			return nil
+		},
+	}
+	require.NoError(t, cmd.Run(context.Background(), append([]string{"serve"}, args...)))
+	return result, err
+}
+
+func TestGetEndpoints(t *testing.T) {
+	result, err := endpoints(t)
+	require.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Protocol: "generic"}}, result, "the port is served when no address is given")
+
+	result, err = endpoints(t, "--protocol", "envoy", "--listen", "unix:///var/run/mpe.sock")
+	require.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Protocol: "envoy", Address: "unix:///var/run/mpe.sock"}}, result)
+
+	result, err = endpoints(t, "--endpoint", "generic=:9000", "--endpoint", "envoy=:9001")
+	require.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Protocol: "generic", Address: ":9000"}, {Protocol: "envoy", Address: ":9001"}}, result)
+
+	_, err = endpoints(t, "--endpoint", "generic=:9000", "--endpoint", "envoy=:9000")
+	assert.ErrorContains(t, err, "already served")
+
+	_, err = endpoints(t, "--endpoint", "envoy=:9001", "--port", "9000")
+	assert.ErrorContains(t, err, "mutually exclusive")
+
+	_, err = endpoints(t, "--endpoint", "envoy")
+	assert.ErrorContains(t, err, "PROTOCOL=ADDRESS")
+}
+
+func TestStartServers(t *testing.T) {
+	require.NoError(t, test.SetupTestConfig())
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, true)
+
+	pe, err := core.NewPolicyEngine(options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	// keep the paths short, as socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "mpe")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	httpPath := filepath.Join(dir, "http.sock")
+	grpcPath := filepath.Join(dir, "grpc.sock")
+
+	readiness := decisionpoint.NewReadiness("compiling bundles")
+	readiness.SetReady()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	servers, err := startServers(ctx, pe, []Endpoint{
+		{Protocol: "generic", Address: "unix://" + httpPath},
+		{Protocol: "envoy", Address: "unix://" + grpcPath},
+	}, serverOptions{readiness: readiness})
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+
+	// both protocols are served at once
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", httpPath)
+		},
+	}}
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://mpe/readyz")
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn, err := grpc.NewClient("unix://"+grpcPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	resp, err := healthv1.NewHealthClient(conn).Check(ctx, &healthv1.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthv1.HealthCheckResponse_SERVING, resp.Status)
+
+	assert.NoError(t, servers.Stop(ctx))
+
+	// an endpoint that fails to start stops the others
+	_, err = startServers(ctx, pe, []Endpoint{
+		{Protocol: "generic", Address: "unix://" + httpPath},
+		{Protocol: "envoy", Address: "http://localhost:9001"},
+	}, serverOptions{readiness: readiness})
+	assert.ErrorContains(t, err, "endpoint envoy=http://localhost:9001")
+}
@@ -0,0 +1,245 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/test"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Files written by a [Recorder] in its directory
+const (
+	// RecordsFile holds the recorded access records, one JSON object per line, for 'mpe replay'
+	RecordsFile = "records.json"
+	// SuiteFile holds the recorded decisions as a test suite, for 'mpe test decisions'
+	SuiteFile = "decisions.yml"
+)
+
+// DefaultRecordHash lists the PORC fields hashed by default before a decision is recorded.
+// Both fields are hashed with the same function, so a policy comparing the resource owner to
+// the principal's subject decides the same way on the recorded PORC.
+var DefaultRecordHash = []string{"principal.sub", "resource.owner"}
+
+// RecorderOptions configures a [Recorder].
+type RecorderOptions struct {
+	// Dir is the directory the fixtures are written to. It is created if it does not exist.
+	Dir string
+	// Rate is the fraction of decisions recorded, between 0 and 1.
+	Rate float64
+	// Redaction anonymizes the PORC of each decision before it is recorded.
+	Redaction accesslog.RedactionOptions
+}
+
+// Recorder samples the decisions of a running engine and writes their anonymized PORCs and
+// outcomes as fixtures: an access record stream for 'mpe replay', and a decision test suite for
+// 'mpe test decisions' and 'mpe analyze impact'.
+//
+// Recordings append to the files of a previous run in the same directory. Recorder is safe for
+// concurrent use.
+type Recorder struct {
+	rate     float64
+	random   func() float64
+	redactor *accesslog.FieldRedactor
+
+	mu       sync.Mutex
+	records  *os.File
+	suite    *os.File
+	recorded int
+}
+
+// NewRecorder creates a [Recorder], opening its files in opts.Dir.
+//
+// Returns an error if the rate is out of range, a redaction path is invalid, or the files cannot
+// be opened.
+func NewRecorder(opts RecorderOptions) (*Recorder, error) {
+	if opts.Rate < 0 || opts.Rate > 1 {
+		return nil, fmt.Errorf("invalid sampling rate %g: must be between 0 and 1", opts.Rate)
+	}
+
+	redactor, err := accesslog.NewFieldRedactor(opts.Redaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create fixtures directory: %w", err)
+	}
+
+	records, err := openAppend(filepath.Join(opts.Dir, RecordsFile))
+	if err != nil {
+		return nil, err
+	}
+	suite, err := openAppend(filepath.Join(opts.Dir, SuiteFile))
+	if err != nil {
+		_ = records.Close()
+		return nil, err
+	}
+
+	// a new suite needs its header; an existing one is appended to
+	if info, err := suite.Stat(); err == nil && info.Size() == 0 {
+		_, err = suite.WriteString("tests:\n")
+		if err != nil {
+			_ = records.Close()
+			_ = suite.Close()
+			return nil, fmt.Errorf("failed to write fixtures: %w", err)
+		}
+	}
+
+	return &Recorder{
+		rate:     opts.Rate,
+		random:   rand.Float64,
+		redactor: redactor,
+		records:  records,
+		suite:    suite,
+	}, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600) // #nosec G304 -- CLI tool intentionally writes user-provided paths
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fixtures: %w", err)
+	}
+	return f, nil
+}
+
+// Run records the sampled records of the subscription until it is closed.
+func (r *Recorder) Run(sub *accesslog.Subscription) {
+	for record := range sub.C() {
+		if err := r.Record(record); err != nil {
+			logger.Warnf(agent, "recorder", "failed to record decision: %v", err)
+		}
+	}
+	if dropped := sub.Dropped(); dropped > 0 {
+		logger.Warnf(agent, "recorder", "%d decision(s) arrived faster than they could be sampled and were skipped", dropped)
+	}
+}
+
+// Record writes the record as fixtures if it is sampled. Records without a PORC, or decided by
+// an override rather than the policies, are never recorded, since replaying them would test
+// nothing.
+//
+// The record is not modified; the fixtures are written from an anonymized copy.
+func (r *Recorder) Record(record *events.AccessRecord) error {
+	if record.Porc == "" || record.Override != nil || record.Decision == events.AccessRecord_UNSPECIFIED {
+		return nil
+	}
+	if r.random() >= r.rate {
+		return nil
+	}
+
+	anonymized, ok := proto.Clone(record).(*events.AccessRecord)
+	if !ok {
+		return fmt.Errorf("failed to copy record")
+	}
+	if err := r.redactor.Redact(anonymized); err != nil {
+		return err
+	}
+
+	line, err := protojson.Marshal(anonymized)
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	var porc map[string]interface{}
+	if err := json.Unmarshal([]byte(anonymized.Porc), &porc); err != nil {
+		return fmt.Errorf("failed to parse PORC: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.recorded++
+	tc := test.TestCase{
+		Name:        fixtureName(anonymized, r.recorded),
+		Description: fmt.Sprintf("%s '%s' on '%s'", anonymized.Decision, anonymized.Operation, anonymized.Resource),
+		PORC:        porc,
+		Result:      test.TestResult{Allow: anonymized.Decision == events.AccessRecord_GRANT},
+	}
+	if ts := anonymized.GetMetadata().GetTimestamp(); ts != nil {
+		tc.Description += ", recorded " + ts.AsTime().Format(time.RFC3339)
+	}
+	entry, err := yaml.Marshal([]test.TestCase{tc})
+	if err != nil {
+		return fmt.Errorf("failed to encode fixture: %w", err)
+	}
+
+	if _, err := r.records.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write fixtures: %w", err)
+	}
+	if _, err := r.suite.WriteString(indent(string(entry))); err != nil {
+		return fmt.Errorf("failed to write fixtures: %w", err)
+	}
+	return nil
+}
+
+// Recorded returns the number of decisions recorded.
+func (r *Recorder) Recorded() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.recorded
+}
+
+// Close closes the fixture files.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.records.Close()
+	if serr := r.suite.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// fixtureName names a fixture after its record's ID, which stays unique across runs appending
+// to the same suite
+func fixtureName(record *events.AccessRecord, n int) string {
+	if id := record.GetMetadata().GetId(); id != "" {
+		return id
+	}
+	return fmt.Sprintf("recorded-%d-%d", time.Now().Unix(), n)
+}
+
+// indent nests a YAML sequence under the suite's tests key
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if line != "" && line != "\n" {
+			lines[i] = "  " + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// ParseRate parses a rate, such as the sampling rate of recorded decisions, given as a
+// percentage, such as "0.1%", or as a fraction, such as "0.001".
+func ParseRate(s string) (float64, error) {
+	value, percent := strings.CutSuffix(strings.TrimSpace(s), "%")
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+	if percent {
+		rate /= 100
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid rate '%s': must be between 0 and 100%%", s)
+	}
+	return rate, nil
+}
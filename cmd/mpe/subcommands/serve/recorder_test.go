@@ -0,0 +1,197 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package serve
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/policyengine/cmd/mpe/subcommands/test"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		rate float64
+		err  bool
+	}{
+		{"0.1%", 0.001, false},
+		{"100%", 1, false},
+		{" 5% ", 0.05, false},
+		{"0.25", 0.25, false},
+		{"0", 0, false},
+		{"150%", 0, true},
+		{"2", 0, true},
+		{"-1%", 0, true},
+		{"often", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			rate, err := ParseRate(tt.in)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.rate, rate, 1e-12)
+		})
+	}
+}
+
+func accessRecord(id string, decision events.AccessRecord_Decision, porc string) *events.AccessRecord {
+	return &events.AccessRecord{
+		Metadata:  &events.AccessRecord_Metadata{Id: id},
+		Principal: &events.AccessRecord_Principal{Subject: "alice", Realm: "acme"},
+		Operation: "api:docs:read",
+		Resource:  "mrn:doc:1",
+		Decision:  decision,
+		Porc:      porc,
+	}
+}
+
+func readRecords(t *testing.T, dir string) []*events.AccessRecord {
+	f, err := os.Open(filepath.Join(dir, RecordsFile))
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	var records []*events.AccessRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &events.AccessRecord{}
+		require.NoError(t, protojson.Unmarshal(scanner.Bytes(), record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestRecorder(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "fixtures")
+	const porc = `{"principal":{"sub":"alice","mrealm":"acme","mroles":["mrn:iam:role:reader"],"email":"alice@example.com"},` +
+		`"operation":"api:docs:read","resource":{"id":"mrn:doc:1","owner":"alice","group":"mrn:iam:resource-group:docs"},"context":{}}`
+
+	r, err := NewRecorder(RecorderOptions{
+		Dir:       dir,
+		Rate:      1,
+		Redaction: accesslog.RedactionOptions{Hash: DefaultRecordHash, Strip: []string{"principal.email"}},
+	})
+	require.NoError(t, err)
+
+	granted := accessRecord("r1", events.AccessRecord_GRANT, porc)
+	require.NoError(t, r.Record(granted))
+	require.NoError(t, r.Record(accessRecord("r2", events.AccessRecord_DENY, porc)))
+
+	// records that would replay nothing are skipped
+	require.NoError(t, r.Record(accessRecord("r3", events.AccessRecord_GRANT, "")))
+	require.NoError(t, r.Record(accessRecord("r4", events.AccessRecord_UNSPECIFIED, porc)))
+	overridden := accessRecord("r5", events.AccessRecord_DENY, porc)
+	overridden.Override = &events.AccessRecord_Override{}
+	require.NoError(t, r.Record(overridden))
+
+	assert.Equal(t, 2, r.Recorded())
+	require.NoError(t, r.Close())
+
+	// the shared record is untouched
+	assert.Equal(t, porc, granted.Porc)
+	assert.Equal(t, "alice", granted.Principal.Subject)
+
+	records := readRecords(t, dir)
+	require.Len(t, records, 2)
+	assert.Equal(t, "r1", records[0].Metadata.Id)
+	assert.Equal(t, events.AccessRecord_GRANT, records[0].Decision)
+	assert.Contains(t, records[0].Principal.Subject, "sha256:")
+	assert.NotContains(t, records[0].Porc, "alice")
+
+	suite, err := test.LoadTestSuite(filepath.Join(dir, SuiteFile))
+	require.NoError(t, err)
+	require.Len(t, suite.Tests, 2)
+	assert.Equal(t, "r1", suite.Tests[0].Name)
+	assert.True(t, suite.Tests[0].Result.Allow)
+	assert.False(t, suite.Tests[1].Result.Allow)
+
+	principal := suite.Tests[0].PORC["principal"].(map[string]interface{})
+	resource := suite.Tests[0].PORC["resource"].(map[string]interface{})
+	assert.NotContains(t, principal, "email")
+	assert.Equal(t, "acme", principal["mrealm"])
+	assert.Equal(t, principal["sub"], resource["owner"], "the owner is hashed as the subject is")
+	assert.Equal(t, "mrn:doc:1", resource["id"])
+}
+
+func TestRecorder_Appends(t *testing.T) {
+	dir := t.TempDir()
+	const porc = `{"principal":{"sub":"alice"},"operation":"api:docs:read","resource":"mrn:doc:1"}`
+
+	for _, id := range []string{"first", "second"} {
+		r, err := NewRecorder(RecorderOptions{Dir: dir, Rate: 1})
+		require.NoError(t, err)
+		require.NoError(t, r.Record(accessRecord(id, events.AccessRecord_GRANT, porc)))
+		require.NoError(t, r.Close())
+	}
+
+	suite, err := test.LoadTestSuite(filepath.Join(dir, SuiteFile))
+	require.NoError(t, err)
+	require.Len(t, suite.Tests, 2)
+	assert.Equal(t, "first", suite.Tests[0].Name)
+	assert.Equal(t, "second", suite.Tests[1].Name)
+	assert.Len(t, readRecords(t, dir), 2)
+}
+
+func TestRecorder_Sampling(t *testing.T) {
+	r, err := NewRecorder(RecorderOptions{Dir: t.TempDir(), Rate: 0.25})
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+
+	draws := []float64{0.1, 0.5, 0.24, 0.25, 0.9}
+	r.random = func() float64 {
+		v := draws[0]
+		draws = draws[1:]
+		return v
+	}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, r.Record(accessRecord("", events.AccessRecord_GRANT, `{"operation":"api:docs:read"}`)))
+	}
+	assert.Equal(t, 2, r.Recorded())
+}
+
+func TestRecorder_Run(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(RecorderOptions{Dir: dir, Rate: 1})
+	require.NoError(t, err)
+
+	broadcast := accesslog.NewBroadcastFactory(accesslog.NewNullFactory())
+	stream, err := broadcast.NewStream()
+	require.NoError(t, err)
+
+	sub := broadcast.Subscribe(10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(sub)
+	}()
+
+	require.NoError(t, stream.Send(accessRecord("live", events.AccessRecord_DENY, `{"operation":"api:docs:read"}`)))
+	sub.Close()
+	<-done
+	require.NoError(t, r.Close())
+
+	records := readRecords(t, dir)
+	require.Len(t, records, 1)
+	assert.Equal(t, "live", records[0].Metadata.Id)
+}
+
+func TestNewRecorder_Invalid(t *testing.T) {
+	_, err := NewRecorder(RecorderOptions{Dir: t.TempDir(), Rate: 2})
+	assert.Error(t, err)
+
+	_, err = NewRecorder(RecorderOptions{Dir: t.TempDir(), Rate: 1, Redaction: accesslog.RedactionOptions{Hash: []string{"principal..sub"}}})
+	assert.Error(t, err)
+}
@@ -6,6 +6,7 @@ package test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/urfave/cli/v3"
@@ -36,11 +37,17 @@ func ExecuteDecision(ctx context.Context, cmd *cli.Command) error {
 	}
 	defer engine.close()
 
-	return engine.executeDecision(ctx, getInputExpression(cmd.String("input")))
+	_, err = engine.executeDecision(ctx, getInputExpression(cmd.String("input")))
+	return err
 }
 
 // ExecuteEnvoy executes an end-to-end mapper + decision pipeline and prints the output
 func ExecuteEnvoy(ctx context.Context, cmd *cli.Command) error {
+	expect := cmd.String("expect")
+	if cmd.Bool("update-golden") && expect == "" {
+		return fmt.Errorf("--update-golden requires --expect")
+	}
+
 	engine, err := newEngine(cmd)
 	if err != nil {
 		return err
@@ -52,5 +59,14 @@ func ExecuteEnvoy(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
-	return engine.executeDecision(ctx, porc)
+	decision, err := engine.executeDecision(ctx, porc)
+	if err != nil || expect == "" {
+		return err
+	}
+
+	var porcData map[string]any
+	if err := json.Unmarshal([]byte(porc), &porcData); err != nil {
+		return fmt.Errorf("the mapper did not produce a PORC object: %w", err)
+	}
+	return assertGolden(engine.stdout, expect, newGolden(porcData, decision), cmd.Bool("update-golden"))
 }
@@ -6,6 +6,7 @@ package test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -209,6 +210,7 @@ func buildTestCommand(action cli.ActionFunc) *cli.Command {
 							&cli.StringFlag{Name: "name", Aliases: []string{"n"}},
 							&cli.StringFlag{Name: "opa-flags"},
 							&cli.BoolFlag{Name: "no-opa-flags"},
+							&cli.StringFlag{Name: "mapper-output", Value: "porc"},
 						},
 						Action: action,
 					},
@@ -220,6 +222,9 @@ func buildTestCommand(action cli.ActionFunc) *cli.Command {
 							&cli.StringFlag{Name: "name", Aliases: []string{"n"}},
 							&cli.StringFlag{Name: "opa-flags"},
 							&cli.BoolFlag{Name: "no-opa-flags"},
+							&cli.StringFlag{Name: "mapper-output", Value: "porc"},
+							&cli.StringFlag{Name: "expect"},
+							&cli.BoolFlag{Name: "update-golden"},
 						},
 						Action: action,
 					},
@@ -245,6 +250,24 @@ func TestExecuteMapper_WithConsolidatedBundle(t *testing.T) {
 	assert.NoError(t, err, "ExecuteMapper should succeed with consolidated bundle and envoy input")
 }
 
+// TestExecuteMapper_Output tests selecting another output of the mapper by name
+func TestExecuteMapper_Output(t *testing.T) {
+	bundleFile := testDataPath("consolidated.yml")
+	inputFile := testDataPath("envoy.json")
+
+	cmd := buildTestCommand(ExecuteMapper)
+	err := cmd.Run(context.Background(), []string{"mpe", "test", "mapper", "-i", inputFile, "-b", bundleFile, "--mapper-output", "service"})
+	assert.NoError(t, err, "ExecuteMapper should evaluate the service output")
+
+	cmd = buildTestCommand(ExecuteMapper)
+	err = cmd.Run(context.Background(), []string{"mpe", "test", "mapper", "-i", inputFile, "-b", bundleFile, "--mapper-output", "undefined_output"})
+	assert.Error(t, err, "ExecuteMapper should fail with an undefined output")
+
+	cmd = buildTestCommand(ExecuteEnvoy)
+	err = cmd.Run(context.Background(), []string{"mpe", "test", "envoy", "-i", inputFile, "-b", bundleFile, "--mapper-output", "data.mapper.porc"})
+	assert.ErrorContains(t, err, "invalid mapper output")
+}
+
 // TestExecuteMapper_MissingBundle tests mapper command with missing bundle
 func TestExecuteMapper_MissingBundle(t *testing.T) {
 	inputFile := testDataPath("envoy.json")
@@ -317,6 +340,38 @@ func TestExecuteEnvoy_WithConsolidatedBundle(t *testing.T) {
 	assert.NoError(t, err, "ExecuteEnvoy should succeed with consolidated bundle and envoy input")
 }
 
+// TestExecuteEnvoy_Golden tests asserting the full pipeline against a golden file
+func TestExecuteEnvoy_Golden(t *testing.T) {
+	bundleFile := testDataPath("consolidated.yml")
+	inputFile := testDataPath("envoy.json")
+	golden := filepath.Join(t.TempDir(), "expected.json")
+
+	run := func(extra ...string) error {
+		args := append([]string{"mpe", "test", "envoy", "-i", inputFile, "-b", bundleFile, "--expect", golden}, extra...)
+		cmd := buildTestCommand(ExecuteEnvoy)
+		cmd.ExitErrHandler = func(context.Context, *cli.Command, error) {} // report failures rather than exit
+		return cmd.Run(context.Background(), args)
+	}
+
+	// the golden file is written, then matches
+	require.NoError(t, run("--update-golden"))
+	expected, err := LoadGolden(golden)
+	require.NoError(t, err)
+	assert.Contains(t, expected.PORC, "operation")
+	assert.NotContains(t, expected.PORC, "context")
+	assert.NoError(t, run())
+
+	// a different expectation fails
+	expected.PORC["operation"] = "petstore:http:delete"
+	data, err := json.Marshal(expected)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(golden, data, 0o600))
+	assert.Error(t, run())
+
+	err = buildTestCommand(ExecuteEnvoy).Run(context.Background(), []string{"mpe", "test", "envoy", "-i", inputFile, "-b", bundleFile, "--update-golden"})
+	assert.ErrorContains(t, err, "--update-golden requires --expect")
+}
+
 // TestExecuteEnvoy_MissingBundle tests envoy command with missing bundle
 func TestExecuteEnvoy_MissingBundle(t *testing.T) {
 	inputFile := testDataPath("envoy.json")
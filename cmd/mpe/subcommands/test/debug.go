@@ -0,0 +1,498 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/topdown"
+)
+
+const debugPrompt = "(debug) "
+
+const debugHelp = `Commands:
+  c, continue          Run to the next breakpoint
+  s, step              Stop at the next step, entering the rules referred to
+  n, next              Stop at the next step of this rule, stepping over the rules referred to
+  o, out               Run until the rule returns
+  p, print <path>      Print a variable or the input, such as 'p input.principal.mroles'
+  l, locals            Print the variables bound so far
+  bt, stack            Print the rules being evaluated
+  b, break [<loc>]     Add a breakpoint, or list them
+  d, delete <n>        Delete breakpoint n
+  q, quit              Run the decision to completion without stopping
+  h, help              Print this help
+`
+
+// stepMode is how a debugger resumes the evaluation
+type stepMode int
+
+const (
+	modeContinue stepMode = iota
+	modeStep
+	modeNext
+	modeOut
+)
+
+// breakpoint pauses the evaluation at a line of a policy, or on entering a rule
+type breakpoint struct {
+	id int
+	// file is the policy or library of the line, or empty for any
+	file string
+	line int
+	rule string
+}
+
+// parseBreakpoint parses a location: a policy MRN and line such as mrn:iam:policy:main:12,
+// a line of any policy, or a rule such as allow or data.authz.allow
+func parseBreakpoint(loc string) (breakpoint, error) {
+	loc = strings.TrimSpace(loc)
+	if loc == "" {
+		return breakpoint{}, fmt.Errorf("expected a location, such as mrn:iam:policy:main:12 or allow")
+	}
+	file, lineText := "", loc
+	if i := strings.LastIndex(loc, ":"); i >= 0 {
+		file, lineText = loc[:i], loc[i+1:]
+	}
+	if line, err := strconv.Atoi(lineText); err == nil {
+		if line < 1 {
+			return breakpoint{}, fmt.Errorf("invalid line in '%s'", loc)
+		}
+		return breakpoint{file: file, line: line}, nil
+	}
+	if strings.Contains(loc, ":") {
+		return breakpoint{}, fmt.Errorf("invalid location '%s': expected <policy>:<line>", loc)
+	}
+	return breakpoint{rule: loc}, nil
+}
+
+func (b breakpoint) String() string {
+	switch {
+	case b.rule != "":
+		return fmt.Sprintf("%d  rule %s", b.id, b.rule)
+	case b.file == "":
+		return fmt.Sprintf("%d  line %d of any policy", b.id, b.line)
+	default:
+		return fmt.Sprintf("%d  %s:%d", b.id, b.file, b.line)
+	}
+}
+
+func (b breakpoint) matches(evt *topdown.Event) bool {
+	if b.rule != "" {
+		rule, ok := evt.Node.(*ast.Rule)
+		if !ok || evt.Op != topdown.EnterOp {
+			return false
+		}
+		path := ast.RulePath(rule)
+		return path == b.rule || strings.HasSuffix(path, "."+b.rule)
+	}
+	if evt.Location == nil || evt.Location.Row != b.line || evt.Location.File == "" {
+		return false
+	}
+	if evt.Op != topdown.EnterOp && evt.Op != topdown.EvalOp {
+		return false
+	}
+	return b.file == "" || b.file == evt.Location.File
+}
+
+// frame is a query entered during the evaluation of a policy
+type frame struct {
+	name     string
+	location *ast.Location
+	parent   uint64
+}
+
+// debugger implements [opa.Debugger] for 'mpe test decision --debug', pausing the evaluation
+// of the policies of a decision at breakpoints and stepping through it with commands read
+// from in.
+type debugger struct {
+	in  *bufio.Scanner
+	out io.Writer
+
+	// mu serializes the evaluations of the policies, which a decision may run concurrently
+	mu          sync.Mutex
+	breakpoints []breakpoint
+	lastID      int
+	mode        stepMode
+	// depth is the depth of the step stopped at, which next and out compare to
+	depth int
+	// detached runs the decision to completion, once quit or the end of input
+	detached bool
+
+	// the state of the evaluation of the current policy
+	policy string
+	input  interface{}
+	depths map[uint64]int
+	frames map[uint64]frame
+	evt    *topdown.Event
+	// stopped is the query and line stopped at by a breakpoint, which the steps that follow
+	// on that line do not stop at again
+	stopped struct {
+		query uint64
+		row   int
+	}
+}
+
+var _ opa.Debugger = (*debugger)(nil)
+
+// newDebugger returns a debugger with breakpoints at locs, which stops at the first step
+// when there are none
+func newDebugger(in io.Reader, out io.Writer, locs []string) (*debugger, error) {
+	d := &debugger{in: bufio.NewScanner(in), out: out, mode: modeStep}
+	for _, loc := range locs {
+		if _, err := d.addBreakpoint(loc); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.breakpoints) > 0 {
+		d.mode = modeContinue
+	}
+	return d, nil
+}
+
+func (d *debugger) addBreakpoint(loc string) (breakpoint, error) {
+	b, err := parseBreakpoint(loc)
+	if err != nil {
+		return b, err
+	}
+	d.lastID++
+	b.id = d.lastID
+	d.breakpoints = append(d.breakpoints, b)
+	return b, nil
+}
+
+// Begin holds the debugger for the evaluation of a policy until End.
+func (d *debugger) Begin(policy, query string, input interface{}) topdown.QueryTracer {
+	d.mu.Lock()
+	if d.detached {
+		return nil
+	}
+
+	d.policy, d.input = policy, input
+	d.depths, d.frames = map[uint64]int{}, map[uint64]frame{}
+	d.stopped.query, d.stopped.row = 0, 0
+	// stepping out of or over the end of a policy stops at the start of the next one
+	if d.mode == modeNext || d.mode == modeOut {
+		d.mode = modeStep
+	}
+	fmt.Fprintf(d.out, "\nEvaluating %s: %s\n", policy, query)
+	return d
+}
+
+// End reports the result of the evaluation of a policy, and releases the debugger.
+func (d *debugger) End(policy string, bindings map[string]interface{}, err error) {
+	defer d.mu.Unlock()
+	if d.detached {
+		return
+	}
+	d.evt = nil
+	if err != nil {
+		fmt.Fprintf(d.out, "%s: error: %v\n", policy, err)
+		return
+	}
+	for _, name := range slices.Sorted(maps.Keys(bindings)) {
+		fmt.Fprintf(d.out, "%s: %s = %s\n", policy, name, jsonText(bindings[name]))
+	}
+}
+
+func (d *debugger) Enabled() bool {
+	return !d.detached
+}
+
+func (d *debugger) Config() topdown.TraceConfig {
+	return topdown.TraceConfig{PlugLocalVars: true}
+}
+
+// TraceEvent stops at a step of the evaluation when the mode or a breakpoint says to, and
+// runs the commands entered until the evaluation resumes
+func (d *debugger) TraceEvent(evt topdown.Event) {
+	if d.detached {
+		return
+	}
+
+	depth := d.depths[evt.QueryID]
+	if depth == 0 {
+		depth = d.depths[evt.ParentID] + 1
+		d.depths[evt.QueryID] = depth
+	}
+	if _, ok := d.frames[evt.QueryID]; !ok && evt.Op == topdown.EnterOp {
+		d.frames[evt.QueryID] = frame{name: frameName(&evt), location: evt.Location, parent: evt.ParentID}
+	}
+
+	// a step elsewhere, such as the next iteration of a loop, may stop at the line again
+	again := evt.Location != nil && evt.QueryID == d.stopped.query && evt.Location.Row == d.stopped.row
+	if !again {
+		d.stopped.query, d.stopped.row = 0, 0
+	}
+
+	// the steps binding and indexing are details of the steps that stop
+	switch evt.Op {
+	case topdown.EnterOp, topdown.EvalOp, topdown.ExitOp, topdown.FailOp, topdown.NoteOp, topdown.FailedAssertionOp:
+	default:
+		return
+	}
+
+	var hit *breakpoint
+	for i := range d.breakpoints {
+		if d.breakpoints[i].matches(&evt) {
+			hit = &d.breakpoints[i]
+			break
+		}
+	}
+	if again {
+		hit = nil
+	}
+
+	stop := hit != nil
+	switch d.mode {
+	case modeStep:
+		stop = true
+	case modeNext:
+		stop = stop || depth <= d.depth
+	case modeOut:
+		stop = stop || depth < d.depth
+	}
+	if !stop {
+		return
+	}
+
+	d.evt, d.depth = &evt, depth
+	d.stopped.query, d.stopped.row = 0, 0
+	if hit != nil {
+		if evt.Location != nil {
+			d.stopped.query, d.stopped.row = evt.QueryID, evt.Location.Row
+		}
+		fmt.Fprintf(d.out, "Breakpoint %d, ", hit.id)
+	}
+	d.printStep()
+	d.prompt()
+}
+
+// printStep prints the step stopped at, and the rule it belongs to
+func (d *debugger) printStep() {
+	loc := d.policy
+	if d.evt.Location != nil && d.evt.Location.File != "" {
+		loc = fmt.Sprintf("%s:%d", d.evt.Location.File, d.evt.Location.Row)
+	}
+	if rule := d.rule(); rule != "" {
+		loc += " (" + rule + ")"
+	}
+	fmt.Fprintln(d.out, loc)
+
+	step := fmt.Sprintf("  %s %s", d.evt.Op, opa.EventNode(*d.evt))
+	if d.evt.Message != "" {
+		step += " " + d.evt.Message
+	}
+	fmt.Fprintln(d.out, step)
+}
+
+// rule returns the rule whose evaluation the step stopped at belongs to, if any
+func (d *debugger) rule() string {
+	seen := map[uint64]bool{}
+	for q := d.evt.QueryID; !seen[q]; q = d.frames[q].parent {
+		seen[q] = true
+		f, ok := d.frames[q]
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(f.name, "data.") {
+			return f.name
+		}
+	}
+	return ""
+}
+
+// prompt runs the commands entered until one resumes the evaluation
+func (d *debugger) prompt() {
+	for {
+		fmt.Fprint(d.out, debugPrompt)
+		if !d.in.Scan() {
+			// without more commands, the decision completes
+			fmt.Fprintln(d.out)
+			d.detached = true
+			return
+		}
+		name, args, _ := strings.Cut(strings.TrimSpace(d.in.Text()), " ")
+		args = strings.TrimSpace(args)
+
+		switch name {
+		case "":
+		case "c", "continue":
+			d.mode = modeContinue
+			return
+		case "s", "step":
+			d.mode = modeStep
+			return
+		case "n", "next":
+			d.mode = modeNext
+			return
+		case "o", "out":
+			d.mode = modeOut
+			return
+		case "q", "quit":
+			d.detached = true
+			return
+		case "p", "print":
+			d.print(args)
+		case "l", "locals":
+			d.printLocals()
+		case "bt", "stack":
+			d.printStack()
+		case "b", "break":
+			if args == "" {
+				d.printBreakpoints()
+			} else if b, err := d.addBreakpoint(args); err != nil {
+				fmt.Fprintf(d.out, "error: %v\n", err)
+			} else {
+				fmt.Fprintf(d.out, "Breakpoint %s\n", b)
+			}
+		case "d", "delete":
+			d.deleteBreakpoint(args)
+		case "h", "help":
+			fmt.Fprint(d.out, debugHelp)
+		default:
+			fmt.Fprintf(d.out, "error: unknown command '%s', type h for the commands\n", name)
+		}
+	}
+}
+
+// print prints the value at a dotted path into a variable or the input
+func (d *debugger) print(path string) {
+	if path == "" {
+		fmt.Fprintln(d.out, "error: usage: p <path>")
+		return
+	}
+	keys := strings.Split(path, ".")
+
+	var value interface{}
+	if keys[0] == "input" {
+		value = d.input
+		if v, ok := value.(ast.Value); ok {
+			value = nativeOf(v)
+		}
+	} else {
+		locals := opa.EventLocals(*d.evt)
+		v, ok := locals[keys[0]]
+		if !ok {
+			fmt.Fprintf(d.out, "error: '%s' is not bound\n", keys[0])
+			return
+		}
+		value = v
+	}
+
+	// round-trip the value so that structs of the input are walked like JSON
+	if data, err := json.Marshal(value); err == nil {
+		_ = json.Unmarshal(data, &value)
+	}
+	for i, key := range keys[1:] {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(v) {
+				fmt.Fprintf(d.out, "error: '%s' has no element %s\n", strings.Join(keys[:i+1], "."), key)
+				return
+			}
+			value = v[n]
+		default:
+			value = nil
+		}
+		if value == nil {
+			fmt.Fprintf(d.out, "%s is undefined\n", path)
+			return
+		}
+	}
+	fmt.Fprintln(d.out, jsonText(value))
+}
+
+func (d *debugger) printLocals() {
+	locals := opa.EventLocals(*d.evt)
+	if len(locals) == 0 {
+		fmt.Fprintln(d.out, "No variables bound")
+		return
+	}
+	for _, name := range slices.Sorted(maps.Keys(locals)) {
+		fmt.Fprintf(d.out, "  %s = %s\n", name, jsonText(locals[name]))
+	}
+}
+
+// printStack prints the queries entered down to the step stopped at, innermost first
+func (d *debugger) printStack() {
+	seen := map[uint64]bool{}
+	for q := d.evt.QueryID; !seen[q]; q = d.frames[q].parent {
+		seen[q] = true
+		f, ok := d.frames[q]
+		if !ok {
+			break
+		}
+		loc := d.policy
+		if f.location != nil && f.location.File != "" {
+			loc = fmt.Sprintf("%s:%d", f.location.File, f.location.Row)
+		}
+		fmt.Fprintf(d.out, "  %s  %s\n", f.name, loc)
+	}
+}
+
+func (d *debugger) printBreakpoints() {
+	if len(d.breakpoints) == 0 {
+		fmt.Fprintln(d.out, "No breakpoints")
+		return
+	}
+	for _, b := range d.breakpoints {
+		fmt.Fprintf(d.out, "  %s\n", b)
+	}
+}
+
+func (d *debugger) deleteBreakpoint(args string) {
+	id, err := strconv.Atoi(args)
+	if err == nil {
+		for i, b := range d.breakpoints {
+			if b.id == id {
+				d.breakpoints = slices.Delete(d.breakpoints, i, i+1)
+				fmt.Fprintf(d.out, "Deleted breakpoint %d\n", id)
+				return
+			}
+		}
+	}
+	fmt.Fprintln(d.out, "error: usage: d <n>, where n is a breakpoint listed by b")
+}
+
+// frameName names the query entered by an event: the rule evaluated, or the body of the
+// query, comprehension, or negation
+func frameName(evt *topdown.Event) string {
+	if rule, ok := evt.Node.(*ast.Rule); ok {
+		return ast.RulePath(rule)
+	}
+	if evt.ParentID == 0 && evt.QueryID == 0 {
+		return "query"
+	}
+	return "body"
+}
+
+func nativeOf(v ast.Value) interface{} {
+	if native, err := ast.JSON(v); err == nil {
+		return native
+	}
+	return v.String()
+}
+
+func jsonText(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
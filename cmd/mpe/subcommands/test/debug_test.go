@@ -0,0 +1,116 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const debugPolicy = `package authz
+default allow = false
+allow {
+  is_admin
+}
+is_admin {
+  role := input.principal.mroles[_]
+  role == "mrn:iam:role:admin"
+}
+`
+
+// debugEvaluation evaluates the debug policy under a debugger reading commands, returning
+// the debugger's output and the decision
+func debugEvaluation(t *testing.T, commands string, breaks ...string) (string, interface{}) {
+	instance, err := opa.NewCompiler().Compile("mrn:iam:policy:admin", opa.Modules{"mrn:iam:policy:admin": debugPolicy})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	d, err := newDebugger(strings.NewReader(commands), &out, breaks)
+	require.NoError(t, err)
+
+	input := map[string]interface{}{
+		"principal": map[string]interface{}{"mroles": []interface{}{"mrn:iam:role:reader", "mrn:iam:role:admin"}},
+	}
+	result, perr := instance.Evaluate(opa.WithDebugger(context.Background(), d), "x = data.authz.allow", input)
+	require.Nil(t, perr)
+	return out.String(), result.Bindings["x"]
+}
+
+func TestDebugger_Breakpoint(t *testing.T) {
+	output, allow := debugEvaluation(t, strings.Join([]string{
+		"p role",
+		"l",
+		"bt",
+		"p input.principal.mroles.1",
+		"p input.principal.missing",
+		"p other",
+		"c",
+		"p role",
+		"c",
+	}, "\n"), "mrn:iam:policy:admin:8")
+	assert.Equal(t, true, allow)
+
+	stops := strings.Split(output, "Breakpoint 1, ")
+	require.Len(t, stops, 3, "the breakpoint stops at each iteration of the loop: %s", output)
+	assert.True(t, strings.HasPrefix(stops[1], "mrn:iam:policy:admin:8 (data.authz.is_admin)\n  Eval role = \"mrn:iam:role:admin\"\n"), stops[1])
+	assert.Contains(t, stops[1], "(debug) \"mrn:iam:role:reader\"\n")
+	assert.Contains(t, stops[1], "  role = \"mrn:iam:role:reader\"\n")
+	assert.Contains(t, stops[1], "  data.authz.is_admin  mrn:iam:policy:admin:6\n  data.authz.allow  mrn:iam:policy:admin:3\n  query  mrn:iam:policy:admin\n")
+	assert.Contains(t, stops[1], "(debug) \"mrn:iam:role:admin\"\n")
+	assert.Contains(t, stops[1], "input.principal.missing is undefined")
+	assert.Contains(t, stops[1], "error: 'other' is not bound")
+	assert.Contains(t, stops[2], "(debug) \"mrn:iam:role:admin\"\n")
+	assert.Contains(t, output, "mrn:iam:policy:admin: x = true")
+}
+
+func TestDebugger_Step(t *testing.T) {
+	output, allow := debugEvaluation(t, "s\ns\ns\nn\nb allow\nb\nd 1\nd 9\no\nq\n")
+	assert.Equal(t, true, allow)
+
+	assert.Contains(t, output, "Evaluating mrn:iam:policy:admin: x = data.authz.allow\nmrn:iam:policy:admin\n  Enter x = data.authz.allow\n")
+	assert.Contains(t, output, "mrn:iam:policy:admin:3 (data.authz.allow)\n  Enter data.authz.allow\n")
+	assert.Contains(t, output, "mrn:iam:policy:admin:4 (data.authz.allow)\n  Eval data.authz.is_admin\n")
+	// next steps over the evaluation of is_admin
+	assert.NotContains(t, output, "Enter data.authz.is_admin")
+	assert.Contains(t, output, "Breakpoint 1  rule allow\n")
+	assert.Contains(t, output, "  1  rule allow\n")
+	assert.Contains(t, output, "Deleted breakpoint 1\n")
+	assert.Contains(t, output, "error: usage: d <n>")
+}
+
+func TestDebugger_EndOfInput(t *testing.T) {
+	// without commands, the debugger lets the evaluation complete
+	output, allow := debugEvaluation(t, "", "is_admin")
+	assert.Equal(t, true, allow)
+	assert.Contains(t, output, "Breakpoint 1, mrn:iam:policy:admin:6 (data.authz.is_admin)\n  Enter data.authz.is_admin\n")
+	assert.Equal(t, 1, strings.Count(output, debugPrompt))
+}
+
+func TestParseBreakpoint(t *testing.T) {
+	b, err := parseBreakpoint("mrn:iam:policy:main:12")
+	require.NoError(t, err)
+	assert.Equal(t, breakpoint{file: "mrn:iam:policy:main", line: 12}, b)
+
+	b, err = parseBreakpoint("12")
+	require.NoError(t, err)
+	assert.Equal(t, breakpoint{line: 12}, b)
+
+	b, err = parseBreakpoint("data.authz.allow")
+	require.NoError(t, err)
+	assert.Equal(t, breakpoint{rule: "data.authz.allow"}, b)
+
+	_, err = parseBreakpoint("mrn:iam:policy:main")
+	assert.ErrorContains(t, err, "expected <policy>:<line>")
+	_, err = parseBreakpoint("mrn:iam:policy:main:0")
+	assert.Error(t, err)
+	_, err = parseBreakpoint(" ")
+	assert.Error(t, err)
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 
 	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/urfave/cli/v3"
 	"gopkg.in/yaml.v3"
 )
@@ -39,7 +40,7 @@ type TestSuite struct {
 func ExecuteDecisions(ctx context.Context, cmd *cli.Command) error {
 	// Read and parse the test file
 	inputPath := cmd.String("input")
-	testSuite, err := loadTestSuite(inputPath)
+	testSuite, err := LoadTestSuite(inputPath)
 	if err != nil {
 		return fmt.Errorf("failed to load test suite: %w", err)
 	}
@@ -68,6 +69,15 @@ func ExecuteDecisions(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
+	// a trace in a structured format is written per test, named after it
+	var tracer *common.Tracer
+	if cmd.Root().Bool("trace") {
+		if tracer, err = common.NewTracer(cmd, os.Stderr); err != nil {
+			return err
+		}
+		defer func() { _ = tracer.Close() }()
+	}
+
 	// Run tests and collect results
 	passed := 0
 	failed := 0
@@ -82,7 +92,17 @@ func ExecuteDecisions(ctx context.Context, cmd *cli.Command) error {
 		}
 
 		// Execute the decision
-		allowed, err := pe.Authorize(ctx, string(porcJSON))
+		tctx := ctx
+		var log *opa.TraceLog
+		if tracer != nil {
+			tctx, log = tracer.Begin(ctx)
+		}
+		allowed, err := pe.Authorize(tctx, string(porcJSON))
+		if log != nil {
+			if werr := tracer.Write(tc.Name, log); werr != nil {
+				return fmt.Errorf("failed to write trace: %w", werr)
+			}
+		}
 		if err != nil {
 			fmt.Printf("%s: ERROR (%v)\n", tc.Name, err)
 			failed++
@@ -111,8 +131,8 @@ func ExecuteDecisions(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
-// loadTestSuite reads and parses a test suite from a YAML file
-func loadTestSuite(path string) (*TestSuite, error) {
+// LoadTestSuite reads and parses a test suite from a YAML file
+func LoadTestSuite(path string) (*TestSuite, error) {
 	data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
 	if err != nil {
 		return nil, fmt.Errorf("failed to read test file: %w", err)
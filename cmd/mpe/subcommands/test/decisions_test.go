@@ -6,8 +6,10 @@ package test
 
 import (
 	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,6 +26,8 @@ func buildDecisionsTestCommand(action cli.ActionFunc) *cli.Command {
 				Name:  "trace",
 				Value: false,
 			},
+			&cli.StringFlag{Name: "trace-format"},
+			&cli.StringFlag{Name: "trace-output"},
 		},
 		Commands: []*cli.Command{
 			{
@@ -77,7 +81,7 @@ func TestLoadTestSuite(t *testing.T) {
 	require.NoError(t, tmpfile.Close())
 
 	// Load the test suite
-	suite, err := loadTestSuite(tmpfile.Name())
+	suite, err := LoadTestSuite(tmpfile.Name())
 	require.NoError(t, err)
 	require.NotNil(t, suite)
 
@@ -95,7 +99,7 @@ func TestLoadTestSuite(t *testing.T) {
 
 // TestLoadTestSuite_FileNotFound tests error handling for missing files
 func TestLoadTestSuite_FileNotFound(t *testing.T) {
-	_, err := loadTestSuite("nonexistent-file.yaml")
+	_, err := LoadTestSuite("nonexistent-file.yaml")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to read test file")
 }
@@ -110,7 +114,7 @@ func TestLoadTestSuite_InvalidYAML(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, tmpfile.Close())
 
-	_, err = loadTestSuite(tmpfile.Name())
+	_, err = LoadTestSuite(tmpfile.Name())
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to parse test file")
 }
@@ -288,3 +292,36 @@ func TestExecuteDecisions_NoMatchingTests(t *testing.T) {
 	assert.Error(t, err, "ExecuteDecisions should fail when no tests match the filter")
 	assert.Contains(t, err.Error(), "no tests match", "Error should mention no tests match")
 }
+
+// TestExecuteDecisions_TraceOutput tests that --trace-format json writes a trace per test
+func TestExecuteDecisions_TraceOutput(t *testing.T) {
+	bundleFile := decisionsTestDataPath("consolidated.yml")
+	inputFile := decisionsTestDataPath("example-decision-tests.yaml")
+	traceFile := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	cmd := buildDecisionsTestCommand(ExecuteDecisions)
+	args := []string{"mpe", "--trace", "--trace-format", "json", "--trace-output", traceFile,
+		"test", "decisions", "-i", inputFile, "-b", bundleFile, "--test", "admin-*"}
+
+	err := cmd.Run(context.Background(), args)
+	if err != nil {
+		_, ok := err.(cli.ExitCoder)
+		require.True(t, ok, "Unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(traceFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.NotEmpty(t, lines)
+	for _, line := range lines {
+		var trace struct {
+			Decision string `json:"decision"`
+			Policies []struct {
+				Policy string `json:"policy"`
+			} `json:"policies"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &trace))
+		assert.True(t, strings.HasPrefix(trace.Decision, "admin-"), trace.Decision)
+		assert.NotEmpty(t, trace.Policies)
+	}
+}
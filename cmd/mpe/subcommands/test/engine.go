@@ -5,13 +5,18 @@
 package test
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/manetu/policyengine/cmd/mpe/common"
 	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/options"
 	"github.com/urfave/cli/v3"
 )
 
@@ -20,24 +25,59 @@ type engine struct {
 	pe     core.PolicyEngine
 	cmd    *cli.Command
 	trace  bool
-	stdout *os.File
+	// tracer collects the trace of the decision when its format is not text
+	tracer *common.Tracer
+	// debugger steps through the policies of the decision with --debug
+	debugger *debugger
+	stdout   *os.File
+	mapper   *model.Mapper // set once executeMapper has produced the PORC
 }
 
 func newEngine(cmd *cli.Command) (*engine, error) {
 	// Save original stdout for JSON output
 	originalStdout := os.Stdout
 
-	pe, err := common.NewCliPolicyEngine(cmd, originalStdout)
+	// the access record is replaced by the report of a golden file, unless tracing
+	var accessLogWriter io.Writer = originalStdout
+	if cmd.String("expect") != "" {
+		accessLogWriter = io.Discard
+		if cmd.Root().Bool("trace") {
+			accessLogWriter = os.Stderr
+		}
+	}
+
+	pe, err := common.NewCliPolicyEngine(cmd, accessLogWriter)
 	if err != nil {
 		return nil, err
 	}
 
+	trace := cmd.Root().Bool("trace")
+	var tracer *common.Tracer
+	if trace {
+		if tracer, err = common.NewTracer(cmd, os.Stderr); err != nil {
+			return nil, err
+		}
+	}
+
+	var dbg *debugger
+	if cmd.Bool("debug") {
+		// the debugger reads its commands from stdin, and writes beside the trace
+		if input := cmd.String("input"); input == "" || input == "-" {
+			return nil, fmt.Errorf("--debug reads commands from stdin, so --input must name a file")
+		}
+		if dbg, err = newDebugger(os.Stdin, os.Stderr, cmd.StringSlice("break")); err != nil {
+			return nil, fmt.Errorf("invalid --break: %w", err)
+		}
+	}
+
 	return &engine{
-		domain: cmd.String("name"),
-		pe:     pe,
-		cmd:    cmd,
-		trace:  cmd.Root().Bool("trace"),
-		stdout: originalStdout,
+		domain:   cmd.String("name"),
+		pe:       pe,
+		cmd:      cmd,
+		trace:    trace,
+		tracer:   tracer,
+		debugger: dbg,
+		stdout:   originalStdout,
 	}, nil
 }
 
@@ -56,7 +96,7 @@ func (e *engine) executeMapper(ctx context.Context) (string, error) {
 		return "", fmt.Errorf("failed to parse Envoy input JSON: %w", err)
 	}
 
-	porcData, perr := mapper.Evaluate(ctx, envoyInputData)
+	porcData, perr := mapper.EvaluateOutput(ctx, envoyInputData, cmp.Or(e.cmd.String("mapper-output"), model.DefaultMapperOutput))
 	if perr != nil {
 		return "", fmt.Errorf("failed to evaluate mapper Rego: %w", perr)
 	}
@@ -65,23 +105,40 @@ func (e *engine) executeMapper(ctx context.Context) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal PORC to JSON: %w", err)
 	}
+	e.mapper = mapper
 
 	return string(porcJSON), nil
 }
 
-func (e *engine) executeDecision(ctx context.Context, input string) error {
+func (e *engine) executeDecision(ctx context.Context, input string) (*core.Decision, error) {
 	if e.trace {
 		os.Stdout = os.Stderr
 	}
 
-	if _, err := e.pe.Authorize(ctx, input); err != nil {
-		return err
+	var authzOpts []options.AuthzOptionsFunc
+	if e.mapper != nil {
+		authzOpts = append(authzOpts, options.SetMapper(e.mapper.Domain, e.mapper.ID))
+	}
+	var log *opa.TraceLog
+	if e.tracer != nil {
+		ctx, log = e.tracer.Begin(ctx)
+	}
+	if e.debugger != nil {
+		ctx = opa.WithDebugger(ctx, e.debugger)
+	}
+	decision, err := e.pe.Decide(ctx, input, authzOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if log != nil {
+		return decision, e.tracer.Write("", log)
 	}
-	return nil
+	return decision, nil
 }
 
 func (e *engine) close() {
 	if e.trace {
 		os.Stdout = e.stdout
 	}
+	_ = e.tracer.Close()
 }
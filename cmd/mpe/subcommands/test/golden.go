@@ -0,0 +1,153 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/decisionpoint/envoy"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/urfave/cli/v3"
+)
+
+// Golden is the expected outcome of an Envoy request, as asserted by 'mpe test envoy --expect':
+// the decision, fields of the PORC that the mapper produced, and headers of the check response.
+// Only the PORC fields and headers that it lists are compared, so that a golden file can ignore
+// those that vary between runs, such as the raw input in the context.
+type Golden struct {
+	Decision string            `json:"decision"`
+	PORC     map[string]any    `json:"porc,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// newGolden returns the outcome of a decision on porc
+func newGolden(porc map[string]any, decision *core.Decision) *Golden {
+	result := events.AccessRecord_DENY
+	if decision.Allow {
+		result = events.AccessRecord_GRANT
+	}
+
+	return &Golden{
+		Decision: result.String(),
+		PORC:     porc,
+		Headers:  envoy.CheckHeaders(decision.Allow, decision.Cache),
+	}
+}
+
+// LoadGolden reads a golden file written by 'mpe test envoy --update-golden', or by hand
+func LoadGolden(path string) (*Golden, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return nil, fmt.Errorf("failed to read golden file: %w", err)
+	}
+
+	var golden Golden
+	if err := json.Unmarshal(data, &golden); err != nil {
+		return nil, fmt.Errorf("failed to parse golden file %s: %w", path, err)
+	}
+	return &golden, nil
+}
+
+// Diff returns a description of each difference of actual from the expected outcome g, in
+// field order, or none if actual matches
+func (g *Golden) Diff(actual *Golden) []string {
+	var diffs []string
+	if g.Decision != actual.Decision {
+		diffs = append(diffs, fmt.Sprintf("decision:\n  expected: %s\n  actual:   %s", g.Decision, actual.Decision))
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(g.PORC)) {
+		value, ok := actual.PORC[key]
+		if !ok || !reflect.DeepEqual(g.PORC[key], value) {
+			diffs = append(diffs, fmt.Sprintf("porc.%s:\n  expected: %s\n  actual:   %s", key, encodeValue(g.PORC[key], true), encodeValue(value, ok)))
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(g.Headers)) {
+		value, ok := actual.Headers[key]
+		if !ok || g.Headers[key] != value {
+			diffs = append(diffs, fmt.Sprintf("headers.%s:\n  expected: %s\n  actual:   %s", key, encodeValue(g.Headers[key], true), encodeValue(value, ok)))
+		}
+	}
+
+	return diffs
+}
+
+// encodeValue returns value as compact JSON, or <undefined> if it is not defined
+func encodeValue(value any, defined bool) string {
+	if !defined {
+		return "<undefined>"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// selectFields returns the outcome actual, limited to the PORC fields and headers that g lists.
+// A golden file that lists no PORC fields selects all of them except the context, which holds
+// the raw input, and one that lists no headers selects all of them.
+func (g *Golden) selectFields(actual *Golden) *Golden {
+	selected := &Golden{Decision: actual.Decision, PORC: map[string]any{}, Headers: map[string]string{}}
+
+	for key, value := range actual.PORC {
+		if _, ok := g.PORC[key]; ok || (len(g.PORC) == 0 && key != "context") {
+			selected.PORC[key] = value
+		}
+	}
+	for key, value := range actual.Headers {
+		if _, ok := g.Headers[key]; ok || len(g.Headers) == 0 {
+			selected.Headers[key] = value
+		}
+	}
+
+	return selected
+}
+
+// assertGolden compares the outcome actual with the golden file at path, writing a report to w,
+// or rewrites the golden file with it if update is set. Returns an exit error if they differ.
+func assertGolden(w io.Writer, path string, actual *Golden, update bool) error {
+	expected, err := LoadGolden(path)
+	if update && errors.Is(err, fs.ErrNotExist) {
+		expected, err = &Golden{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if update {
+		data, err := json.MarshalIndent(expected.selectFields(actual), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+			return fmt.Errorf("failed to write golden file: %w", err)
+		}
+		_, _ = fmt.Fprintf(w, "%s: UPDATED\n", path)
+		return nil
+	}
+
+	diffs := expected.Diff(actual)
+	if len(diffs) == 0 {
+		_, _ = fmt.Fprintf(w, "%s: PASS\n", path)
+		return nil
+	}
+
+	_, _ = fmt.Fprintf(w, "%s: FAIL\n", path)
+	for _, diff := range diffs {
+		_, _ = fmt.Fprintln(w, diff)
+	}
+	return cli.Exit("", 1)
+}
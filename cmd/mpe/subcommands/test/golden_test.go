@@ -0,0 +1,106 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func TestNewGolden(t *testing.T) {
+	porc := map[string]any{"operation": "petstore:http:get"}
+
+	golden := newGolden(porc, &core.Decision{Allow: true, Cache: model.CacheHint{TTL: time.Minute, Revision: 2}})
+	assert.Equal(t, "GRANT", golden.Decision)
+	assert.Equal(t, porc, golden.PORC)
+	assert.Equal(t, "60", golden.Headers["x-ext-authz-cache-ttl"])
+	assert.Equal(t, "2", golden.Headers["x-ext-authz-bundle-revision"])
+
+	golden = newGolden(porc, &core.Decision{})
+	assert.Equal(t, "DENY", golden.Decision)
+	assert.Equal(t, map[string]string{"x-ext-authz-check-result": "denied"}, golden.Headers)
+}
+
+func TestGoldenDiff(t *testing.T) {
+	actual := &Golden{
+		Decision: "GRANT",
+		PORC:     map[string]any{"operation": "read", "resource": map[string]any{"id": "doc"}, "context": map[string]any{"raw": true}},
+		Headers:  map[string]string{"x-ext-authz-check-result": "allowed", "x-ext-authz-cache-ttl": "0"},
+	}
+
+	// only the listed fields and headers are compared
+	expected := &Golden{
+		Decision: "GRANT",
+		PORC:     map[string]any{"operation": "read", "resource": map[string]any{"id": "doc"}},
+		Headers:  map[string]string{"x-ext-authz-check-result": "allowed"},
+	}
+	assert.Empty(t, expected.Diff(actual))
+
+	expected = &Golden{
+		Decision: "DENY",
+		PORC:     map[string]any{"operation": "write", "principal": map[string]any{"sub": "alice"}},
+		Headers:  map[string]string{"x-ext-authz-check-result": "denied"},
+	}
+	assert.Equal(t, []string{
+		"decision:\n  expected: DENY\n  actual:   GRANT",
+		"porc.operation:\n  expected: \"write\"\n  actual:   \"read\"",
+		"porc.principal:\n  expected: {\"sub\":\"alice\"}\n  actual:   <undefined>",
+		"headers.x-ext-authz-check-result:\n  expected: \"denied\"\n  actual:   \"allowed\"",
+	}, expected.Diff(actual))
+}
+
+func TestGoldenSelectFields(t *testing.T) {
+	actual := &Golden{
+		Decision: "GRANT",
+		PORC:     map[string]any{"operation": "read", "resource": "doc", "context": map[string]any{"raw": true}},
+		Headers:  map[string]string{"x-ext-authz-check-result": "allowed", "x-ext-authz-cache-ttl": "0"},
+	}
+
+	// a new golden file selects everything but the context
+	selected := (&Golden{}).selectFields(actual)
+	assert.Equal(t, map[string]any{"operation": "read", "resource": "doc"}, selected.PORC)
+	assert.Equal(t, actual.Headers, selected.Headers)
+
+	// an existing one keeps its selection
+	selected = (&Golden{PORC: map[string]any{"operation": "write", "principal": nil}, Headers: map[string]string{"x-ext-authz-cache-ttl": "30"}}).selectFields(actual)
+	assert.Equal(t, map[string]any{"operation": "read"}, selected.PORC)
+	assert.Equal(t, map[string]string{"x-ext-authz-cache-ttl": "0"}, selected.Headers)
+}
+
+func TestAssertGolden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expected.json")
+	actual := &Golden{Decision: "GRANT", PORC: map[string]any{"operation": "read"}, Headers: map[string]string{"x-ext-authz-check-result": "allowed"}}
+
+	var out bytes.Buffer
+	_, err := LoadGolden(path)
+	require.Error(t, err)
+	require.NoError(t, assertGolden(&out, path, actual, true))
+	assert.Equal(t, path+": UPDATED\n", out.String())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"decision": "GRANT", "porc": {"operation": "read"}, "headers": {"x-ext-authz-check-result": "allowed"}}`, string(data))
+
+	out.Reset()
+	require.NoError(t, assertGolden(&out, path, actual, false))
+	assert.Equal(t, path+": PASS\n", out.String())
+
+	out.Reset()
+	actual.Decision = "DENY"
+	err = assertGolden(&out, path, actual, false)
+	var exit cli.ExitCoder
+	require.ErrorAs(t, err, &exit)
+	assert.Equal(t, 1, exit.ExitCode())
+	assert.Equal(t, path+": FAIL\ndecision:\n  expected: GRANT\n  actual:   DENY\n", out.String())
+}
@@ -0,0 +1,278 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/open-policy-agent/opa/v1/profiler"
+	"github.com/urfave/cli/v3"
+)
+
+// profileSorts are the orders of the --sort flag, by the statistic they sort on
+var profileSorts = map[string]func(a, b ExprProfile) bool{
+	"time":  func(a, b ExprProfile) bool { return a.TimeNs > b.TimeNs },
+	"evals": func(a, b ExprProfile) bool { return a.NumEval > b.NumEval },
+	"redos": func(a, b ExprProfile) bool { return a.NumRedo > b.NumRedo },
+}
+
+// ProfileReport is the outcome of profiling a single policy with 'mpe test profile'
+type ProfileReport struct {
+	Policy      string        `json:"policy"`
+	Domain      string        `json:"domain"`
+	Runs        int           `json:"runs"`
+	Result      interface{}   `json:"result"`
+	Timing      ProfileTiming `json:"timing"`
+	Expressions []ExprProfile `json:"expressions"`
+}
+
+// ProfileTiming is the distribution of the time taken by the untraced evaluations of a policy
+type ProfileTiming struct {
+	Min  time.Duration `json:"min_ns"`
+	Mean time.Duration `json:"mean_ns"`
+	P50  time.Duration `json:"p50_ns"`
+	P90  time.Duration `json:"p90_ns"`
+	P99  time.Duration `json:"p99_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+// ExprProfile is the cost of the expressions on one line of a policy, per evaluation of the policy
+type ExprProfile struct {
+	Location   string `json:"location"`
+	Expression string `json:"expression"`
+	TimeNs     int64  `json:"time_ns"`
+	NumEval    int    `json:"num_eval"`
+	NumRedo    int    `json:"num_redo"`
+	NumGenExpr int    `json:"num_gen_expr"`
+}
+
+// ExecuteProfile evaluates a single policy of a bundle repeatedly against an input, reporting
+// the time each evaluation takes and the expressions it spends that time on.
+func ExecuteProfile(ctx context.Context, cmd *cli.Command) error {
+	format := cmd.String("output")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s': must be 'text' or 'json'", format)
+	}
+	less, ok := profileSorts[cmd.String("sort")]
+	if !ok {
+		return fmt.Errorf("unsupported sort '%s': must be 'time', 'evals', or 'redos'", cmd.String("sort"))
+	}
+	runs := int(cmd.Int("count"))
+	if runs < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+
+	r, err := common.LoadRegistry(cmd.StringSlice("bundle"))
+	if err != nil {
+		return err
+	}
+	// creating the engine compiles the policies of the registry
+	if _, err := common.NewRegistryPolicyEngine(cmd, r, accesslog.NewNullFactory()); err != nil {
+		return err
+	}
+
+	domain, policy, err := findPolicy(r.GetDomains(), cmd.String("policy"), cmd.String("name"))
+	if err != nil {
+		return err
+	}
+
+	var input interface{}
+	if err := json.Unmarshal([]byte(getInputExpression(cmd.String("input"))), &input); err != nil {
+		return fmt.Errorf("invalid input: %w", err)
+	}
+
+	report, err := profilePolicy(ctx, policy, input, runs)
+	if err != nil {
+		return err
+	}
+	report.Policy, report.Domain = cmd.String("policy"), domain
+	sort.SliceStable(report.Expressions, func(i, j int) bool { return less(report.Expressions[i], report.Expressions[j]) })
+	if top := int(cmd.Int("top")); top > 0 && len(report.Expressions) > top {
+		report.Expressions = report.Expressions[:top]
+	}
+
+	out := cmd.Root().Writer
+	if format == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	}
+	printProfileText(out, report)
+	return nil
+}
+
+// findPolicy returns the compiled policy with an MRN, and the domain declaring it, restricted to
+// the named domain if any. Unless restricted, the MRN must be declared by a single domain.
+func findPolicy(domains registry.DomainMap, mrn, name string) (string, *opa.Ast, error) {
+	if mrn == "" {
+		return "", nil, fmt.Errorf("--policy is required")
+	}
+
+	var found []string
+	for domainName, domain := range domains {
+		if name != "" && domainName != name {
+			continue
+		}
+		if _, ok := domain.Policies[mrn]; ok {
+			found = append(found, domainName)
+		}
+	}
+	sort.Strings(found)
+
+	switch {
+	case name != "" && domains[name] == nil:
+		return "", nil, fmt.Errorf("domain '%s' not found", name)
+	case len(found) == 0:
+		return "", nil, fmt.Errorf("policy '%s' not found", mrn)
+	case len(found) > 1:
+		return "", nil, fmt.Errorf("policy '%s' is declared by domains %s: select one with --name", mrn, strings.Join(found, ", "))
+	}
+
+	policy := domains[found[0]].Policies[mrn]
+	if policy.Ast == nil {
+		return "", nil, fmt.Errorf("policy '%s' is not compiled", mrn)
+	}
+	return found[0], policy.Ast, nil
+}
+
+// profilePolicy evaluates a policy runs times untraced to time it, then runs times under OPA's
+// profiler, returning the timing and the cost of each line of the policy per evaluation
+func profilePolicy(ctx context.Context, policy *opa.Ast, input interface{}, runs int) (*ProfileReport, error) {
+	// the first evaluation prepares the query, so it is left out of the timing
+	result, perr := policy.Evaluate(ctx, model.PolicyQuery, input, opa.WithTrace(false))
+	if perr != nil {
+		return nil, perr
+	}
+
+	durations := make([]time.Duration, runs)
+	for i := range durations {
+		start := time.Now()
+		if _, perr := policy.Evaluate(ctx, model.PolicyQuery, input, opa.WithTrace(false)); perr != nil {
+			return nil, perr
+		}
+		durations[i] = time.Since(start)
+	}
+
+	// each evaluation has a profiler of its own, since a profiler charges the time between two
+	// evaluations to the last expression of the first
+	totals := map[string]*ExprProfile{}
+	for i := 0; i < runs; i++ {
+		p := profiler.New()
+		if _, perr := policy.Evaluate(ctx, model.PolicyQuery, input, opa.WithTrace(false), opa.WithQueryTracer(p)); perr != nil {
+			return nil, perr
+		}
+		for _, stat := range p.ReportTopNResults(-1, []string{"file", "line"}) {
+			// the query evaluating the policy has no file of its own
+			location := "query"
+			if stat.Location.File != "" {
+				location = fmt.Sprintf("%s:%d", stat.Location.File, stat.Location.Row)
+			}
+			total, ok := totals[location]
+			if !ok {
+				total = &ExprProfile{Location: location, Expression: strings.Join(strings.Fields(string(stat.Location.Text)), " ")}
+				totals[location] = total
+			}
+			total.TimeNs += stat.ExprTimeNs
+			total.NumEval += stat.NumEval
+			total.NumRedo += stat.NumRedo
+			total.NumGenExpr += stat.NumGenExpr
+		}
+	}
+
+	report := &ProfileReport{
+		Runs:        runs,
+		Result:      result.Bindings["x"],
+		Timing:      timing(durations),
+		Expressions: make([]ExprProfile, 0, len(totals)),
+	}
+	for _, total := range totals {
+		report.Expressions = append(report.Expressions, ExprProfile{
+			Location:   total.Location,
+			Expression: total.Expression,
+			TimeNs:     total.TimeNs / int64(runs),
+			NumEval:    total.NumEval / runs,
+			NumRedo:    total.NumRedo / runs,
+			NumGenExpr: total.NumGenExpr / runs,
+		})
+	}
+	sort.Slice(report.Expressions, func(i, j int) bool { return report.Expressions[i].Location < report.Expressions[j].Location })
+	return report, nil
+}
+
+// timing returns the distribution of a set of durations, using the nearest-rank percentiles
+func timing(durations []time.Duration) ProfileTiming {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	percentile := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return ProfileTiming{
+		Min:  sorted[0],
+		Mean: sum / time.Duration(len(sorted)),
+		P50:  percentile(0.50),
+		P90:  percentile(0.90),
+		P99:  percentile(0.99),
+		Max:  sorted[len(sorted)-1],
+	}
+}
+
+func printProfileText(out io.Writer, report *ProfileReport) {
+	result, _ := json.Marshal(report.Result)
+	fmt.Fprintf(out, "Policy:  %s (domain %s)\n", report.Policy, report.Domain)
+	fmt.Fprintf(out, "Result:  x = %s\n", result)
+	fmt.Fprintf(out, "Runs:    %d\n", report.Runs)
+	t := report.Timing
+	fmt.Fprintf(out, "Timing:  min %s  mean %s  p50 %s  p90 %s  p99 %s  max %s\n\n",
+		round(t.Min), round(t.Mean), round(t.P50), round(t.P90), round(t.P99), round(t.Max))
+
+	if len(report.Expressions) == 0 {
+		fmt.Fprintln(out, "No expressions evaluated")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVALS\tREDOS\tGEN\tLOCATION\tEXPRESSION")
+	for _, e := range report.Expressions {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", round(time.Duration(e.TimeNs)), e.NumEval, e.NumRedo, e.NumGenExpr, e.Location, truncate(e.Expression, 60))
+	}
+	_ = w.Flush()
+	fmt.Fprintln(out, "\nTime and counts are per evaluation of the policy.")
+}
+
+// round shortens a duration to a readable precision
+func round(d time.Duration) time.Duration {
+	if d >= time.Millisecond {
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(10 * time.Nanosecond)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -0,0 +1,153 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+// runProfile runs 'mpe test profile' with args, returning its output
+func runProfile(t *testing.T, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := &cli.Command{
+		Name:   "mpe",
+		Writer: &out,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "trace"},
+		},
+		Commands: []*cli.Command{
+			{
+				Name: "test",
+				Commands: []*cli.Command{
+					{
+						Name: "profile",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{Name: "bundle", Aliases: []string{"b"}},
+							&cli.StringFlag{Name: "policy"},
+							&cli.StringFlag{Name: "input", Aliases: []string{"i"}},
+							&cli.StringFlag{Name: "name", Aliases: []string{"n"}},
+							&cli.IntFlag{Name: "count", Value: 100},
+							&cli.IntFlag{Name: "top", Value: 10},
+							&cli.StringFlag{Name: "sort", Value: "time"},
+							&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: "text"},
+							&cli.StringFlag{Name: "opa-flags"},
+							&cli.BoolFlag{Name: "no-opa-flags"},
+						},
+						Action: ExecuteProfile,
+					},
+				},
+			},
+		},
+	}
+	err := cmd.Run(context.Background(), append([]string{"mpe", "test", "profile"}, args...))
+	return out.String(), err
+}
+
+// profileInput writes a PORC for the profiled policy, returning its path
+func profileInput(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "porc.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"principal": {}, "operation": "api:test:read", "resource": {"id": "mrn:test:1"}}`), 0600))
+	return path
+}
+
+func TestExecuteProfile(t *testing.T) {
+	bundle := decisionsTestDataPath("consolidated.yml")
+
+	output, err := runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:mainapi", "-i", profileInput(t), "--count", "5", "-o", "json")
+	require.NoError(t, err)
+
+	var report ProfileReport
+	require.NoError(t, json.Unmarshal([]byte(output), &report))
+	assert.Equal(t, "mrn:iam:policy:mainapi", report.Policy)
+	assert.Equal(t, "consolidated", report.Domain)
+	assert.Equal(t, 5, report.Runs)
+	assert.EqualValues(t, -1, report.Result, "a principal without a JWT is denied")
+	assert.LessOrEqual(t, report.Timing.Min, report.Timing.P50)
+	assert.LessOrEqual(t, report.Timing.P50, report.Timing.Max)
+	require.NotEmpty(t, report.Expressions)
+	assert.LessOrEqual(t, len(report.Expressions), 10)
+	for i := 1; i < len(report.Expressions); i++ {
+		assert.GreaterOrEqual(t, report.Expressions[i-1].TimeNs, report.Expressions[i].TimeNs, "lines are sorted by time")
+	}
+
+	output, err = runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:mainapi", "-i", profileInput(t), "--count", "2", "--top", "1")
+	require.NoError(t, err)
+	assert.Contains(t, output, "Policy:  mrn:iam:policy:mainapi (domain consolidated)\n")
+	assert.Contains(t, output, "Result:  x = -1\n")
+	assert.Contains(t, output, "TIME")
+	assert.Contains(t, output, "EXPRESSION")
+}
+
+func TestExecuteProfile_Errors(t *testing.T) {
+	bundle := decisionsTestDataPath("consolidated.yml")
+	input := profileInput(t)
+
+	_, err := runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:missing", "-i", input)
+	assert.ErrorContains(t, err, "policy 'mrn:iam:policy:missing' not found")
+
+	_, err = runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:mainapi", "-i", input, "--name", "other")
+	assert.ErrorContains(t, err, "domain 'other' not found")
+
+	_, err = runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:mainapi", "-i", input, "-o", "yaml")
+	assert.ErrorContains(t, err, "unsupported output format 'yaml'")
+
+	_, err = runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:mainapi", "-i", input, "--sort", "name")
+	assert.ErrorContains(t, err, "unsupported sort 'name'")
+
+	_, err = runProfile(t, "-b", bundle, "--policy", "mrn:iam:policy:mainapi", "-i", input, "--count", "0")
+	assert.ErrorContains(t, err, "--count must be at least 1")
+}
+
+func TestProfilePolicy(t *testing.T) {
+	instance, err := opa.NewCompiler().Compile("mrn:iam:policy:admin", opa.Modules{"mrn:iam:policy:admin": debugPolicy})
+	require.NoError(t, err)
+
+	input := map[string]interface{}{
+		"principal": map[string]interface{}{"mroles": []interface{}{"mrn:iam:role:reader", "mrn:iam:role:admin"}},
+	}
+	report, err := profilePolicy(context.Background(), instance, input, 3)
+	require.NoError(t, err)
+	assert.Equal(t, true, report.Result)
+
+	lines := map[string]ExprProfile{}
+	for _, e := range report.Expressions {
+		lines[e.Location] = e
+	}
+	require.Contains(t, lines, "query")
+	require.Contains(t, lines, "mrn:iam:policy:admin:8")
+	// counts are per evaluation: the comparison is evaluated once for each role
+	assert.Equal(t, 2, lines["mrn:iam:policy:admin:8"].NumEval)
+	assert.Equal(t, `role == "mrn:iam:role:admin"`, lines["mrn:iam:policy:admin:8"].Expression)
+}
+
+func TestTiming(t *testing.T) {
+	var durations []time.Duration
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, ProfileTiming{
+		Min:  time.Millisecond,
+		Mean: 50500 * time.Microsecond,
+		P50:  50 * time.Millisecond,
+		P90:  90 * time.Millisecond,
+		P99:  99 * time.Millisecond,
+		Max:  100 * time.Millisecond,
+	}, timing(durations))
+
+	single := timing([]time.Duration{time.Second})
+	assert.Equal(t, time.Second, single.P50)
+	assert.Equal(t, time.Second, single.P99)
+}
@@ -0,0 +1,345 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/manetu/policyengine/cmd/mpe/common"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/options"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is an end-to-end behavior contract, run by 'mpe test scenario': the bundles that an
+// in-process engine loads, and a sequence of requests with the outcomes expected of them
+type Scenario struct {
+	Name    string         `yaml:"name"`
+	Bundles []string       `yaml:"bundles"`
+	Domain  string         `yaml:"domain"` // the domain of the mapper, when several bundles define one
+	Steps   []ScenarioStep `yaml:"steps"`
+
+	dir string // the directory of the scenario file, which relative paths are resolved from
+}
+
+// ScenarioStep is a request of a scenario: either the input of an Envoy check, which the mapper
+// maps to a PORC, or a PORC. Either may be given inline, or as the path of a JSON or YAML file.
+type ScenarioStep struct {
+	Name         string              `yaml:"name"`
+	Envoy        any                 `yaml:"envoy"`
+	PORC         any                 `yaml:"porc"`
+	MapperOutput string              `yaml:"mapper-output"`
+	Expect       ScenarioExpectation `yaml:"expect"`
+}
+
+// ScenarioExpectation is the outcome expected of a step. Like a [Golden] file, only the PORC
+// fields, headers, and access record fields that it lists are compared. Record fields are
+// dotted paths into the access record as it is logged, such as principal.subject, in which
+// numbers index lists, such as references.0.decision.
+type ScenarioExpectation struct {
+	Decision string            `yaml:"decision"`
+	PORC     map[string]any    `yaml:"porc"`
+	Headers  map[string]string `yaml:"headers"`
+	Record   map[string]any    `yaml:"record"`
+}
+
+// ExecuteScenario runs the steps of a scenario file in order against an engine loading its
+// bundles, reporting each step that does not have the expected outcome
+func ExecuteScenario(ctx context.Context, cmd *cli.Command) error {
+	scenario, err := LoadScenario(cmd.String("file"))
+	if err != nil {
+		return err
+	}
+
+	var tracer *common.Tracer
+	if cmd.Root().Bool("trace") {
+		if tracer, err = common.NewTracer(cmd, os.Stderr); err != nil {
+			return err
+		}
+		defer func() { _ = tracer.Close() }()
+	}
+
+	return runScenario(ctx, cmd, cmd.Root().Writer, scenario, tracer)
+}
+
+// LoadScenario reads and validates a scenario file, resolving its paths from its directory
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+
+	var scenario Scenario
+	if err := yaml.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %s: %w", path, err)
+	}
+	scenario.dir = filepath.Dir(path)
+
+	if len(scenario.Bundles) == 0 {
+		return nil, fmt.Errorf("scenario %s lists no bundles", path)
+	}
+	if len(scenario.Steps) == 0 {
+		return nil, fmt.Errorf("scenario %s has no steps", path)
+	}
+	for i := range scenario.Bundles {
+		scenario.Bundles[i] = scenario.resolve(scenario.Bundles[i])
+	}
+
+	names := map[string]bool{}
+	for i := range scenario.Steps {
+		step := &scenario.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		if names[step.Name] {
+			return nil, fmt.Errorf("scenario %s has more than one step named '%s'", path, step.Name)
+		}
+		names[step.Name] = true
+
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+	}
+
+	return &scenario, nil
+}
+
+// validate checks that a step has one request and an expected decision, and normalizes its
+// expected values to their JSON form, as that of the outcome
+func (s *ScenarioStep) validate() error {
+	if (s.Envoy == nil) == (s.PORC == nil) {
+		return fmt.Errorf("must have either envoy or porc")
+	}
+	if s.Envoy == nil && (s.MapperOutput != "" || len(s.Expect.PORC) > 0 || len(s.Expect.Headers) > 0) {
+		return fmt.Errorf("mapper-output, and expected porc and headers, require envoy")
+	}
+	if s.MapperOutput != "" {
+		if err := model.ValidateMapperOutput(s.MapperOutput); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := events.AccessRecord_Decision_value[s.Expect.Decision]; !ok || s.Expect.Decision == events.AccessRecord_UNSPECIFIED.String() {
+		return fmt.Errorf("invalid expected decision '%s': must be GRANT, DENY, or PENDING", s.Expect.Decision)
+	}
+
+	var err error
+	if s.Expect.PORC, err = normalize(s.Expect.PORC); err != nil {
+		return err
+	}
+	s.Expect.Record, err = normalize(s.Expect.Record)
+	return err
+}
+
+// resolve returns a path of the scenario, relative to its directory unless absolute
+func (s *Scenario) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.dir, path)
+}
+
+// load returns the request of a step: a value given inline, or read from the file it names
+func (s *Scenario) load(value any) (map[string]any, error) {
+	if path, ok := value.(string); ok {
+		data, err := os.ReadFile(s.resolve(path)) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("failed to parse request %s: %w", path, err)
+		}
+	}
+
+	object, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("the request is not an object")
+	}
+	return normalize(object)
+}
+
+// runScenario runs the steps of scenario, writing a report to w. Returns an exit error if any
+// step failed.
+func runScenario(ctx context.Context, cmd *cli.Command, w io.Writer, scenario *Scenario, tracer *common.Tracer) error {
+	// the access record of each decision is captured as it is logged, for its assertions
+	var records bytes.Buffer
+	pe, err := common.NewBundlePolicyEngine(cmd, scenario.Bundles, accesslog.NewIoWriterFactory(&records))
+	if err != nil {
+		return err
+	}
+
+	if scenario.Name != "" {
+		_, _ = fmt.Fprintf(w, "%s\n\n", scenario.Name)
+	}
+
+	passed := 0
+	for _, step := range scenario.Steps {
+		records.Reset()
+
+		sctx := ctx
+		var log *opa.TraceLog
+		if tracer != nil {
+			sctx, log = tracer.Begin(ctx)
+		}
+		actual, err := scenario.run(sctx, pe, step)
+		if log != nil {
+			if werr := tracer.Write(step.Name, log); werr != nil {
+				return fmt.Errorf("failed to write trace: %w", werr)
+			}
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "%s: ERROR (%v)\n", step.Name, err)
+			continue
+		}
+
+		record := lastRecord(records.Bytes())
+		if decision, ok := record["decision"].(string); ok {
+			actual.Decision = decision // such as PENDING, which the decision does not carry
+		}
+
+		expected := &Golden{Decision: step.Expect.Decision, PORC: step.Expect.PORC, Headers: step.Expect.Headers}
+		diffs := append(expected.Diff(actual), diffRecord(step.Expect.Record, record)...)
+		if len(diffs) == 0 {
+			_, _ = fmt.Fprintf(w, "%s: PASS\n", step.Name)
+			passed++
+			continue
+		}
+
+		_, _ = fmt.Fprintf(w, "%s: FAIL\n", step.Name)
+		for _, diff := range diffs {
+			_, _ = fmt.Fprintln(w, diff)
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "\n%d/%d steps passed\n", passed, len(scenario.Steps))
+	if passed < len(scenario.Steps) {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+// run decides the request of a step, mapping an Envoy input to its PORC first
+func (s *Scenario) run(ctx context.Context, pe core.PolicyEngine, step ScenarioStep) (*Golden, error) {
+	var authzOpts []options.AuthzOptionsFunc
+
+	var porc map[string]any
+	if step.Envoy != nil {
+		input, err := s.load(step.Envoy)
+		if err != nil {
+			return nil, err
+		}
+		mapper, perr := pe.GetBackend().GetMapper(ctx, s.Domain)
+		if perr != nil {
+			return nil, perr
+		}
+		output, perr := mapper.EvaluateOutput(ctx, input, cmp.Or(step.MapperOutput, model.DefaultMapperOutput))
+		if perr != nil {
+			return nil, fmt.Errorf("failed to evaluate mapper Rego: %w", perr)
+		}
+		object, ok := output.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("the mapper did not produce a PORC object")
+		}
+		if porc, err = normalize(object); err != nil {
+			return nil, err
+		}
+		authzOpts = append(authzOpts, options.SetMapper(mapper.Domain, mapper.ID))
+	} else {
+		var err error
+		if porc, err = s.load(step.PORC); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(porc)
+	if err != nil {
+		return nil, err
+	}
+	decision, err := pe.Decide(ctx, string(data), authzOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	actual := newGolden(porc, decision)
+	if step.Envoy == nil {
+		actual.PORC, actual.Headers = nil, nil // there is no check response
+	}
+	return actual, nil
+}
+
+// normalize returns value as decoded from its JSON encoding, so that it compares equal with
+// values decoded from JSON, such as whole numbers read from YAML
+func normalize[T any](value T) (T, error) {
+	var normalized T
+	data, err := json.Marshal(value)
+	if err != nil {
+		return normalized, err
+	}
+	err = json.Unmarshal(data, &normalized)
+	return normalized, err
+}
+
+// lastRecord returns the last access record logged in data, or nil if there is none
+func lastRecord(data []byte) map[string]any {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+		return nil
+	}
+	return record
+}
+
+// diffRecord returns a description of each field of record that differs from expected, in
+// path order
+func diffRecord(expected map[string]any, record map[string]any) []string {
+	var diffs []string
+	for _, path := range slices.Sorted(maps.Keys(expected)) {
+		value, ok := recordField(record, path)
+		if !ok || !reflect.DeepEqual(expected[path], value) {
+			diffs = append(diffs, fmt.Sprintf("record.%s:\n  expected: %s\n  actual:   %s", path, encodeValue(expected[path], true), encodeValue(value, ok)))
+		}
+	}
+	return diffs
+}
+
+// recordField returns the value at a dotted path of a record, or false if it is not defined
+func recordField(record map[string]any, path string) (any, bool) {
+	var value any = record
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,161 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+// runScenarioCommand runs 'mpe test scenario' with args, returning its output
+func runScenarioCommand(args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := &cli.Command{
+		Name:   "mpe",
+		Writer: &out,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "trace"},
+		},
+		Commands: []*cli.Command{
+			{
+				Name: "test",
+				Commands: []*cli.Command{
+					{
+						Name: "scenario",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "file", Aliases: []string{"f"}},
+							&cli.StringFlag{Name: "opa-flags"},
+							&cli.BoolFlag{Name: "no-opa-flags"},
+						},
+						Action: ExecuteScenario,
+					},
+				},
+			},
+		},
+		ExitErrHandler: func(context.Context, *cli.Command, error) {}, // report failures rather than exit
+	}
+	err := cmd.Run(context.Background(), append([]string{"mpe", "test", "scenario"}, args...))
+	return out.String(), err
+}
+
+// writeScenario writes a scenario beside the test data, whose paths it names, returning its path
+func writeScenario(t *testing.T, content string) string {
+	path := filepath.Join(testDataPath(""), "scenario-"+filepath.Base(t.Name())+".yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Cleanup(func() { _ = os.Remove(path) })
+	return path
+}
+
+func TestExecuteScenario(t *testing.T) {
+	output, err := runScenarioCommand("-f", testDataPath("example-scenario.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, `Petstore behavior contract
+
+anonymous-favicon-denied: PASS
+admin-granted: PASS
+inline-porc-denied: PASS
+
+3/3 steps passed
+`, output)
+}
+
+func TestExecuteScenario_Failures(t *testing.T) {
+	path := writeScenario(t, `bundles: [consolidated.yml]
+steps:
+  - name: wrong-operation
+    envoy: envoy.json
+    expect:
+      decision: DENY
+      porc:
+        operation: petstore:http:post
+  - name: wrong-decision
+    porc: example-porc-input.json
+    expect:
+      decision: DENY
+      record:
+        principal.subject: bar
+        references.9.id: mrn:iam:role:admin
+  - name: missing-request
+    porc: missing.json
+    expect:
+      decision: GRANT
+`)
+
+	output, err := runScenarioCommand("-f", path)
+	assert.Error(t, err)
+	assert.Equal(t, `wrong-operation: FAIL
+porc.operation:
+  expected: "petstore:http:post"
+  actual:   "petstore:http:get"
+wrong-decision: FAIL
+decision:
+  expected: DENY
+  actual:   GRANT
+record.principal.subject:
+  expected: "bar"
+  actual:   "foo"
+record.references.9.id:
+  expected: "mrn:iam:role:admin"
+  actual:   <undefined>
+missing-request: ERROR (failed to read request: open `+testDataPath("missing.json")+`: no such file or directory)
+
+0/3 steps passed
+`, output)
+}
+
+func TestLoadScenario_Invalid(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"steps: [{porc: {}, expect: {decision: GRANT}}]", "lists no bundles"},
+		{"bundles: [consolidated.yml]", "has no steps"},
+		{"bundles: [a.yml]\nsteps: [{name: a, porc: {}, expect: {decision: GRANT}}, {name: a, porc: {}, expect: {decision: GRANT}}]", "more than one step named 'a'"},
+		{"bundles: [a.yml]\nsteps: [{expect: {decision: GRANT}}]", "step 'step-1': must have either envoy or porc"},
+		{"bundles: [a.yml]\nsteps: [{envoy: {}, porc: {}, expect: {decision: GRANT}}]", "must have either envoy or porc"},
+		{"bundles: [a.yml]\nsteps: [{porc: {}, expect: {decision: GRANT, headers: {a: b}}}]", "require envoy"},
+		{"bundles: [a.yml]\nsteps: [{envoy: {}, mapper-output: a-b, expect: {decision: GRANT}}]", "invalid mapper output"},
+		{"bundles: [a.yml]\nsteps: [{porc: {}, expect: {decision: allow}}]", "invalid expected decision 'allow'"},
+		{"bundles: [a.yml]\nsteps: [{porc: {}}]", "invalid expected decision ''"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "scenario.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+		_, err := LoadScenario(path)
+		assert.ErrorContains(t, err, tt.err, tt.content)
+	}
+
+	_, err := LoadScenario(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to read scenario")
+}
+
+func TestRecordField(t *testing.T) {
+	record := map[string]any{
+		"principal":  map[string]any{"subject": "alice"},
+		"references": []any{map[string]any{"id": "a"}},
+	}
+
+	value, ok := recordField(record, "principal.subject")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", value)
+	value, ok = recordField(record, "references.0.id")
+	assert.True(t, ok)
+	assert.Equal(t, "a", value)
+
+	for _, path := range []string{"principal.realm", "references.1.id", "references.x", "principal.subject.x"} {
+		_, ok = recordField(record, path)
+		assert.False(t, ok, path)
+	}
+	_, ok = recordField(nil, "decision")
+	assert.False(t, ok)
+}
@@ -10,6 +10,9 @@ import MenuBookIcon from '@mui/icons-material/MenuBook';
 import CloudUploadIcon from '@mui/icons-material/CloudUpload';
 import BuildIcon from '@mui/icons-material/Build';
 import FactCheckIcon from '@mui/icons-material/FactCheck';
+import FormatAlignLeftIcon from '@mui/icons-material/FormatAlignLeft';
+import CompareArrowsIcon from '@mui/icons-material/CompareArrows';
+import UpgradeIcon from '@mui/icons-material/Upgrade';
 import ScienceIcon from '@mui/icons-material/Science';
 import DnsIcon from '@mui/icons-material/Dns';
 import InfoIcon from '@mui/icons-material/Info';
@@ -49,6 +52,9 @@ import ScaleIcon from '@mui/icons-material/Scale';
 import PublishIcon from '@mui/icons-material/Publish';
 import UpdateIcon from '@mui/icons-material/Update';
 import DevicesIcon from '@mui/icons-material/Devices';
+import ManageSearchIcon from '@mui/icons-material/ManageSearch';
+import HistoryIcon from '@mui/icons-material/History';
+import InputIcon from '@mui/icons-material/Input';
 
 const iconMap: Record<string, React.ElementType> = {
   // Navigation & Sections
@@ -62,8 +68,18 @@ const iconMap: Record<string, React.ElementType> = {
   // CLI Commands
   'build': BuildIcon,
   'lint': FactCheckIcon,
+  'fmt': FormatAlignLeftIcon,
+  'diff': CompareArrowsIcon,
+  'analyze': ManageSearchIcon,
+  'migrate': UpgradeIcon,
+  'push': PublishIcon,
+  'pull': FileDownloadIcon,
   'test': ScienceIcon,
   'serve': DnsIcon,
+  'lsp': CodeIcon,
+  'repl': TerminalIcon,
+  'audit': HistoryIcon,
+  'generate': InputIcon,
   'version': InfoIcon,
   'terminal': TerminalIcon,
 
@@ -7,6 +7,7 @@ package accesslog
 import (
 	"github.com/manetu/policyengine/pkg/core/accesslog"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 // ChannelFactory factory for ChannelStream
@@ -29,9 +30,10 @@ func (f *ChannelFactory) NewStream() (accesslog.Stream, error) {
 	return &ChannelStream{ch: f.ch}, nil
 }
 
-// Send emulates the production of a kafka event by sending an access record to the channel.
+// Send emulates the production of a kafka event by sending a clone of an access record to the
+// channel, as the engine reuses the record.
 func (s *ChannelStream) Send(m *events.AccessRecord) error {
-	s.ch <- m
+	s.ch <- proto.Clone(m).(*events.AccessRecord)
 
 	return nil
 }
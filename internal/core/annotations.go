@@ -8,7 +8,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"sync"
 
 	"github.com/manetu/policyengine/pkg/common"
 	"github.com/manetu/policyengine/pkg/core/model"
@@ -17,6 +16,7 @@ import (
 /**********************************************************************************************************************************
  In general errors while fetching annotations could be of any kind. E.g.,  network failure, bad syntax. These annotations
  will be removed and policy evaluation will proceed without them. Policies that require these annotations should fail evaluation.
+ Panics while fetching are recovered and treated as errors; the phases fetching the same entities then DENY.
 **********************************************************************************************************************************/
 
 func (pe *PolicyEngine) getScopesAnnotations(ctx context.Context, scopes []string) []model.RichAnnotations {
@@ -27,56 +27,48 @@ func (pe *PolicyEngine) getScopesAnnotations(ctx context.Context, scopes []strin
 	annotations := make([]model.RichAnnotations, len(scopes))
 	errs := make([]*common.PolicyError, len(scopes))
 
-	var wg sync.WaitGroup
-	wg.Add(len(scopes))
-
-	for i, mrn := range scopes {
-		go func(i int, scopeMrn string) {
-			defer wg.Done()
-
-			scope, err := pe.backend.GetScope(ctx, scopeMrn)
-			if err != nil {
-				//annotations for this scope will remain nil
-				logger.Debugf(agent, "getScopesAnnotations", "%s (err-%s)", scopeMrn, err)
-				errs[i] = err
-				return
+	pe.limits.fanOut(len(scopes), func(i int) {
+		defer func() {
+			if r := recover(); r != nil {
+				errs[i] = internalError(r)
 			}
+		}()
+
+		scopeMrn := scopes[i]
+		scope, err := pe.backend.GetScope(ctx, scopeMrn)
+		if err != nil {
+			//annotations for this scope will remain nil
+			logger.WithContext(ctx).Debugf(agent, "getScopesAnnotations", "%s (err-%s)", scopeMrn, err)
+			errs[i] = err
+			return
+		}
 
-			annotations[i] = scope.Annotations
-		}(i, mrn)
-	}
-	wg.Wait()
+		annotations[i] = scope.Annotations
+	})
 
 	return annotations
 }
 
 // in addition to annotations for a group, also fetch its roles to be consolidated with independent roles into a consolidated
-// annotations set for the roles
+// annotations set for the roles. Nested groups follow the groups that contain them, so the outer groups take precedence.
 func (pe *PolicyEngine) getGroupsAnnotations(ctx context.Context, groups []string) ([][]string, []model.RichAnnotations) {
 	if len(groups) == 0 {
 		return nil, nil
 	}
 
-	roles := make([][]string, len(groups))
-	annotations := make([]model.RichAnnotations, len(groups))
-
-	var wg sync.WaitGroup
-	wg.Add(len(groups))
+	expanded := pe.expandGroups(ctx, groups)
+	roles := make([][]string, len(expanded))
+	annotations := make([]model.RichAnnotations, len(expanded))
 
-	for i, mrn := range groups {
-		go func(j int, groupMrn string) {
-			defer wg.Done()
-			group, err := pe.backend.GetGroup(ctx, groupMrn)
-			if err != nil {
-				//roles and annotations for this group will remain nil
-				logger.Debugf(agent, "getGroupsAnnotations", "%s (err-%s)", groupMrn, err)
-				return
-			}
-			roles[j] = group.Roles
-			annotations[j] = group.Annotations
-		}(i, mrn)
+	for i, g := range expanded {
+		if g.err != nil || g.group == nil {
+			//roles and annotations for this group will remain nil
+			logger.WithContext(ctx).Debugf(agent, "getGroupsAnnotations", "%s (err-%s)", g.mrn, g.err)
+			continue
+		}
+		roles[i] = g.group.Roles
+		annotations[i] = g.group.Annotations
 	}
-	wg.Wait()
 
 	return roles, annotations
 }
@@ -88,24 +80,23 @@ func (pe *PolicyEngine) getRolesAnnotations(ctx context.Context, roles []string)
 
 	annotations := make([]model.RichAnnotations, len(roles))
 
-	var wg sync.WaitGroup
-	wg.Add(len(roles))
-
-	for i, mrn := range roles {
-		go func(j int, roleMrn string) {
-			defer wg.Done()
-
-			role, err := pe.backend.GetRole(ctx, roleMrn)
-			if err != nil {
-				//annotations for this role will remain nil
-				logger.Debugf(agent, "getRolesAnnotations", "%s (err-%s)", roleMrn, err)
-				return
+	pe.limits.fanOut(len(roles), func(j int) {
+		defer func() {
+			if r := recover(); r != nil {
+				_ = internalError(r) // annotations for this role will remain nil
 			}
+		}()
+
+		roleMrn := roles[j]
+		role, err := pe.backend.GetRole(ctx, roleMrn)
+		if err != nil {
+			//annotations for this role will remain nil
+			logger.WithContext(ctx).Debugf(agent, "getRolesAnnotations", "%s (err-%s)", roleMrn, err)
+			return
+		}
 
-			annotations[j] = role.Annotations
-		}(i, mrn)
-	}
-	wg.Wait()
+		annotations[j] = role.Annotations
+	})
 
 	return annotations
 }
@@ -119,7 +110,9 @@ func (pe *PolicyEngine) getRolesAnnotations(ctx context.Context, roles []string)
 //   - higher: annotations from higher-priority source (e.g., group)
 //   - defaultStrategy: the default merge strategy to use when none specified
 //
-// Returns the merged RichAnnotations.
+// Returns the merged RichAnnotations. Neither lower nor higher is modified: entries and values that
+// are merged are copied, and the others are shared with the result, so that annotations of the
+// PORC and of the backend's models are used without copying them.
 func mergeRichAnnotations(lower, higher model.RichAnnotations, defaultStrategy string) model.RichAnnotations {
 	if lower == nil && higher == nil {
 		return make(model.RichAnnotations)
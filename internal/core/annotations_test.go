@@ -362,3 +362,24 @@ func TestMergeRichAnnotationsWithStrategies(t *testing.T) {
 		assert.Equal(t, 4, len(tags))
 	})
 }
+
+func TestMergeRichAnnotations_Unmodified(t *testing.T) {
+	lower := model.RichAnnotations{
+		"tags":   {Value: []interface{}{"a"}},
+		"limits": {Value: map[string]interface{}{"read": 1.0}},
+	}
+	higher := model.RichAnnotations{
+		"tags":   {Value: []interface{}{"b"}},
+		"limits": {Value: map[string]interface{}{"write": 2.0}},
+	}
+
+	result := mergeRichAnnotations(lower, higher, model.DefaultMergeStrategy)
+	assert.Equal(t, []interface{}{"b", "a"}, result["tags"].Value)
+	assert.Equal(t, map[string]interface{}{"read": 1.0, "write": 2.0}, result["limits"].Value)
+
+	// neither input is modified, as the annotations of the PORC and of the models are not copied
+	assert.Equal(t, []interface{}{"a"}, lower["tags"].Value)
+	assert.Equal(t, map[string]interface{}{"read": 1.0}, lower["limits"].Value)
+	assert.Equal(t, []interface{}{"b"}, higher["tags"].Value)
+	assert.Equal(t, map[string]interface{}{"write": 2.0}, higher["limits"].Value)
+}
@@ -485,6 +485,7 @@ func (b *Backend) GetMapper(ctx context.Context, domainName string) (*model.Mapp
 	// Use empty domain name for mock (domainName parameter is ignored in mock mode)
 	return &model.Mapper{
 		Domain: "",
+		ID:     mapperName.(string),
 		Ast:    ast,
 	}, nil
 }
@@ -0,0 +1,174 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core
+
+import (
+	"context"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/types"
+)
+
+// operationRef is the document whose values the candidate operations are drawn from
+const operationRef = "input.operation"
+
+// ListPermittedOperations returns, sorted, the operations that would be granted to the principal
+// on the resource.
+//
+// Only candidate operations are considered: those the selectors of the listed operations name
+// literally, and those that the policies of the operations, the principal's roles and scopes, and
+// the resource's group compare input.operation to, as found by partially evaluating them. Each
+// candidate routed by an operation is then decided in probe mode, so that it is not audited.
+// Backends that do not implement backend.OperationLister list no operations.
+func (pe *PolicyEngine) ListPermittedOperations(ctx context.Context, principalMap map[string]interface{}, res interface{}, authOptions *options.AuthzOptions) ([]string, error) {
+	log := logger.WithContext(ctx)
+
+	lister, ok := pe.backend.(backend.OperationLister)
+	if !ok {
+		log.Debug(agent, "ListPermittedOperations", "backend does not list operations")
+		return nil, nil
+	}
+
+	lookupCtx := ctx
+	if authOptions.Tenant != "" {
+		lookupCtx = backend.WithTenant(ctx, authOptions.Tenant)
+	}
+
+	routes, perr := lister.ListOperations(lookupCtx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	candidates := make(map[string]struct{})
+	policies := pe.candidatePolicies(lookupCtx, principalMap, res)
+	for _, route := range routes {
+		for _, selector := range route.Selectors {
+			if op, ok := literalOperation(selector); ok {
+				candidates[op] = struct{}{}
+			}
+		}
+		policies = append(policies, route.Policy)
+	}
+
+	for _, policy := range policies {
+		if policy == nil || policy.Ast == nil {
+			continue
+		}
+		ops, err := policy.Ast.Candidates(ctx, model.PolicyQuery, operationRef)
+		if err != nil {
+			// the policy fails to evaluate as well, and cannot grant its operations
+			log.Debugf(agent, "ListPermittedOperations", "partial evaluation of %s failed: %+v", policy.Mrn, err)
+			continue
+		}
+		for _, op := range ops {
+			candidates[op] = struct{}{}
+		}
+	}
+
+	// operations no selector routes are denied in phase1
+	ops := slices.DeleteFunc(slices.Sorted(maps.Keys(candidates)), func(op string) bool {
+		return !routed(routes, op)
+	})
+	log.Debugf(agent, "ListPermittedOperations", "deciding %d candidate operations", len(ops))
+
+	probe := *authOptions
+	probe.Probe = true
+	probe.PhaseResults = false
+
+	granted := make([]bool, len(ops))
+	pe.limits.fanOut(len(ops), func(j int) {
+		// authorize records the principal's annotations in its map
+		porc := types.PORC{
+			principal: maps.Clone(principalMap),
+			operation: ops[j],
+			resource:  res,
+			"context": map[string]interface{}{},
+		}
+		granted[j], _, _, _, _ = pe.Authorize(ctx, porc, &probe)
+	})
+
+	permitted := make([]string, 0, len(ops))
+	for i, op := range ops {
+		if granted[i] {
+			permitted = append(permitted, op)
+		}
+	}
+	return permitted, nil
+}
+
+// candidatePolicies returns the policies that may name the operations the principal is granted
+// on the resource: those of the principal's roles, including the roles of its groups, of its
+// scopes, and of the resource's group. Policies that cannot be fetched are skipped, since they
+// cannot grant anything either.
+func (pe *PolicyEngine) candidatePolicies(ctx context.Context, principalMap map[string]interface{}, res interface{}) []*model.Policy {
+	var policies []*model.Policy
+	add := func(ref *model.PolicyReference, perr *common.PolicyError) {
+		if perr == nil && ref != nil {
+			policies = append(policies, ref.Policy)
+		}
+	}
+
+	roles := toStringSlice(principalMap[Mroles])
+	for _, g := range pe.expandGroups(ctx, toStringSlice(principalMap[Mgroups])) {
+		if g.err == nil && g.group != nil {
+			roles = append(roles, g.group.Roles...)
+		}
+	}
+	slices.Sort(roles)
+	for _, role := range slices.Compact(roles) {
+		add(pe.backend.GetRole(ctx, role))
+	}
+
+	for _, scope := range toStringSlice(principalMap[Scopes]) {
+		add(pe.backend.GetScope(ctx, scope))
+	}
+
+	var group string
+	switch r := res.(type) {
+	case string:
+		if found, perr := pe.backend.GetResource(ctx, r); perr == nil {
+			group = found.Group
+		}
+	case map[string]interface{}:
+		group, _ = r["group"].(string)
+	}
+	if group != "" {
+		add(pe.backend.GetResourceGroup(ctx, group))
+	}
+
+	return policies
+}
+
+// literalOperation returns the operation a selector names, if it matches a literal, such as
+// ^api:docs:read$
+func literalOperation(selector *regexp.Regexp) (string, bool) {
+	expr := strings.TrimSuffix(strings.TrimPrefix(selector.String(), "^"), "$")
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", false
+	}
+
+	op, complete := re.LiteralPrefix()
+	return op, complete && op != ""
+}
+
+// routed reports whether any selector of the operations matches op
+func routed(routes []*model.OperationRoute, op string) bool {
+	for _, route := range routes {
+		for _, selector := range route.Selectors {
+			if selector.MatchString(op) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+//
+// Copyright © Manetu Inc.  All rights reserved.
+//
+
+package core
+
+import (
+	"context"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/model"
+)
+
+// resolvedGroup is a group of the principal, either assigned directly or nested in one that is
+type resolvedGroup struct {
+	mrn   string
+	group *model.Group
+	err   *common.PolicyError
+}
+
+// expandGroups resolves the given groups and, recursively, the groups nested in them.
+//
+// Groups are returned in breadth-first order, so that directly assigned groups precede the
+// groups they contain. Each group is resolved once, which also stops cyclic nesting. The groups
+// of each level are fetched concurrently, within the engine's fan-out limit, and a group that
+// fails to resolve is returned with its error.
+func (pe *PolicyEngine) expandGroups(ctx context.Context, mrns []string) []resolvedGroup {
+	var result []resolvedGroup
+	seen := make(map[string]struct{})
+
+	for level := mrns; len(level) > 0; {
+		var pending []string
+		for _, mrn := range level {
+			if _, ok := seen[mrn]; !ok {
+				seen[mrn] = struct{}{}
+				pending = append(pending, mrn)
+			}
+		}
+
+		resolved := make([]resolvedGroup, len(pending))
+		pe.limits.fanOut(len(pending), func(j int) {
+			groupMrn := pending[j]
+			defer func() {
+				if r := recover(); r != nil {
+					resolved[j] = resolvedGroup{mrn: groupMrn, err: internalError(r)}
+				}
+			}()
+			group, err := pe.backend.GetGroup(ctx, groupMrn)
+			resolved[j] = resolvedGroup{mrn: groupMrn, group: group, err: err}
+		})
+
+		level = nil
+		for _, r := range resolved {
+			if r.err == nil && r.group != nil {
+				level = append(level, r.group.Groups...)
+			}
+		}
+		result = append(result, resolved...)
+	}
+
+	return result
+}
@@ -0,0 +1,52 @@
+//
+// Copyright © Manetu Inc.  All rights reserved.
+//
+
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// groupsBackend serves groups from a map, leaving the rest of backend.Service unimplemented
+type groupsBackend struct {
+	backend.Service
+	groups map[string][]string
+}
+
+func (b *groupsBackend) GetGroup(_ context.Context, mrn string) (*model.Group, *common.PolicyError) {
+	nested, ok := b.groups[mrn]
+	if !ok {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "group not found")
+	}
+	return &model.Group{Mrn: mrn, Groups: nested}, nil
+}
+
+func TestExpandGroups(t *testing.T) {
+	pe := &PolicyEngine{backend: &groupsBackend{groups: map[string][]string{
+		"a": {"b", "c"},
+		"b": {"d", "missing"},
+		"c": {"d", "a"}, // cycle back to a
+		"d": nil,
+	}}}
+
+	var mrns []string
+	var failed []string
+	for _, g := range pe.expandGroups(context.Background(), []string{"a"}) {
+		mrns = append(mrns, g.mrn)
+		if g.err != nil {
+			failed = append(failed, g.mrn)
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "missing"}, mrns)
+	assert.Equal(t, []string{"missing"}, failed)
+
+	assert.Empty(t, pe.expandGroups(context.Background(), nil))
+}
@@ -0,0 +1,93 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/override"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+/* A principal carrying an act claim is the subject of a request made on its behalf by the
+ * actor the claim describes, such as a service calling another on behalf of a user. An actor
+ * may itself act on behalf of a prior actor, given by the act claim nested in its own, as
+ * tokens are exchanged along a chain of services.
+ *
+ * Policies see the claim as input.principal.act. Before any of them is evaluated, the request
+ * is denied unless an impersonation rule of the backend permits every actor of the chain to
+ * act on behalf of the principal for the operation. A deny-listed actor acts for no one, while
+ * a break-glass override grants only the requests of its own subject, not those it acts in.
+ */
+
+// principalActors returns the actors of the act claim of a principal, the current actor
+// first, and whether the claim is well formed
+func principalActors(claim interface{}) ([]*events.AccessRecord_Impersonation_Actor, bool) {
+	var actors []*events.AccessRecord_Impersonation_Actor
+	for claim != nil {
+		act, ok := claim.(map[string]interface{})
+		if !ok {
+			return actors, false
+		}
+
+		actor := &events.AccessRecord_Impersonation_Actor{Roles: toStringSlice(act[Mroles])}
+		actor.Subject, _ = act[Sub].(string)
+		actor.Realm, _ = act[Mrealm].(string)
+		if actor.Subject == "" {
+			return actors, false
+		}
+		actors = append(actors, actor)
+
+		claim = act[Act]
+	}
+	return actors, len(actors) > 0
+}
+
+// checkImpersonation records the actors of the act claim of a principal in the access record,
+// and returns why they may not make the request on behalf of the principal, empty if they may,
+// along with the deny override of the actor that may not, if that is why
+func (pe *PolicyEngine) checkImpersonation(ctx context.Context, ar *events.AccessRecord, claim interface{}, op string) (string, *override.Override, *common.PolicyError) {
+	actors, ok := principalActors(claim)
+	ar.Impersonation = &events.AccessRecord_Impersonation{Actors: actors}
+	if !ok {
+		return "impersonation: malformed act claim", nil, nil
+	}
+
+	now := time.Now()
+	for _, actor := range actors {
+		if o := pe.overrides.Match(actor.Subject, actor.Realm, now); o != nil && o.Type == override.Deny {
+			return fmt.Sprintf("impersonation: actor %s is deny-listed", actor.Subject), o, nil
+		}
+	}
+
+	provider, ok := pe.backend.(backend.ImpersonationRuleProvider)
+	if !ok {
+		return fmt.Sprintf("impersonation: actor %s may not act for %s", actors[0].Subject, ar.Principal.Subject), nil, nil
+	}
+	rules, perr := provider.GetImpersonationRules(ctx)
+	if perr != nil {
+		return "", nil, perr
+	}
+
+	var reason string
+	for _, actor := range actors {
+		for _, rule := range rules {
+			if rule.Permits(ar.Principal.Subject, op, actor.Roles) {
+				actor.Rule = rule.Domain + "/" + rule.Name
+				break
+			}
+		}
+		if actor.Rule == "" && reason == "" {
+			reason = fmt.Sprintf("impersonation: actor %s may not act for %s", actor.Subject, ar.Principal.Subject)
+		}
+	}
+
+	ar.Impersonation.Permitted = reason == ""
+	return reason, nil, nil
+}
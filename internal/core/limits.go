@@ -0,0 +1,94 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/manetu/policyengine/pkg/common"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+/* A decision fans out over the principal's roles in phase2 and scopes in phase4, evaluating a
+ * policy for each, and over their groups and annotations when fetching them. A limiter bounds
+ * both how many items of one fan-out are processed at once, so that a token with hundreds of
+ * scopes does not spawn hundreds of goroutines, and how many policies the engine evaluates at
+ * once across all decisions.
+ *
+ * Only the evaluations of phase2 and phase4 hold an evaluation slot, and never while waiting
+ * for another, so that fan-outs nested in one another, such as the decisions of
+ * ListPermittedOperations, cannot deadlock.
+ */
+
+// limiter bounds the concurrency of the fan-outs of decisions. A nil limiter bounds nothing.
+type limiter struct {
+	fanout int           // most items of one fan-out processed at once, unbounded if zero
+	slots  chan struct{} // held by each policy evaluation across decisions, nil if unbounded
+}
+
+// newLimiter returns a limiter of at most concurrency policy evaluations across decisions and
+// fanout items of each fan-out at once, either of which is unbounded if zero or less
+func newLimiter(concurrency, fanout int) *limiter {
+	l := &limiter{fanout: max(fanout, 0)}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// fanOut calls fn for each index below n, at most the limiter's fanout of them at once, and
+// returns once all have returned. Indexes are taken in order by a pool of workers, rather than
+// a goroutine each, and a single index is processed without a goroutine. fn must recover its
+// own panics.
+func (l *limiter) fanOut(n int, fn func(i int)) {
+	workers := n
+	if l != nil && l.fanout > 0 {
+		workers = min(n, l.fanout)
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// acquire takes an evaluation slot, waiting for one to be released if all are held, and
+// fails if the decision is cancelled first. Each successful acquire must be followed by a
+// release.
+func (l *limiter) acquire(ctx context.Context) *common.PolicyError {
+	if l == nil || l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return common.WrapError(events.AccessRecord_BundleReference_EVALUATION_ERROR, "evaluation not started: "+ctx.Err().Error(), ctx.Err())
+	}
+}
+
+// release returns an evaluation slot taken by acquire
+func (l *limiter) release() {
+	if l == nil || l.slots == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,110 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_FanOut(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  *limiter
+		n       int
+		bounded int // most calls expected at once
+	}{
+		{"nil limiter", nil, 50, 50},
+		{"unbounded", newLimiter(0, 0), 50, 50},
+		{"bounded", newLimiter(0, 4), 50, 4},
+		{"sequential", newLimiter(0, 1), 10, 1},
+		{"fewer items than workers", newLimiter(0, 16), 3, 3},
+		{"none", newLimiter(0, 4), 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := make([]int32, tt.n)
+			var running, peak atomic.Int32
+			tt.limits.fanOut(tt.n, func(i int) {
+				now := running.Add(1)
+				for p := peak.Load(); now > p && !peak.CompareAndSwap(p, now); p = peak.Load() {
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&calls[i], 1)
+				running.Add(-1)
+			})
+
+			for i, c := range calls {
+				assert.Equal(t, int32(1), c, "index %d", i)
+			}
+			assert.LessOrEqual(t, int(peak.Load()), tt.bounded)
+			if tt.bounded == 1 {
+				assert.Equal(t, int32(1), peak.Load())
+			}
+		})
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	l := newLimiter(2, 0)
+	ctx := context.Background()
+	require.Nil(t, l.acquire(ctx))
+	require.Nil(t, l.acquire(ctx))
+
+	// a third evaluation waits until a slot is released
+	acquired := make(chan *common.PolicyError)
+	go func() { acquired <- l.acquire(ctx) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more slots than the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release()
+	assert.Nil(t, <-acquired)
+
+	// and fails if its request is cancelled first
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := l.acquire(cancelled)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, common.ErrEvaluation))
+	assert.True(t, errors.Is(err, common.ErrTimeout))
+
+	l.release()
+	l.release()
+	assert.Empty(t, l.slots)
+
+	// without a bound, acquire never waits
+	var unbounded *limiter
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, unbounded.acquire(ctx))
+	}
+	unbounded.release()
+	assert.Nil(t, newLimiter(0, 4).acquire(cancelled))
+}
+
+func TestExpandGroups_Fanout(t *testing.T) {
+	groups := map[string][]string{"root": nil}
+	for _, g := range []string{"a", "b", "c", "d", "e"} {
+		groups["root"] = append(groups["root"], g)
+		groups[g] = nil
+	}
+	pe := &PolicyEngine{backend: &groupsBackend{groups: groups}, limits: newLimiter(0, 2)}
+
+	var mrns []string
+	for _, g := range pe.expandGroups(context.Background(), []string{"root"}) {
+		assert.Nil(t, g.err)
+		mrns = append(mrns, g.mrn)
+	}
+	assert.Equal(t, []string{"root", "a", "b", "c", "d", "e"}, mrns)
+}
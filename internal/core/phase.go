@@ -5,6 +5,11 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/model"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
@@ -14,10 +19,88 @@ import (
  * is the anded result from the individual phases
  */
 type phase struct {
-	bundles  []*events.AccessRecord_BundleReference
-	duration uint64 // total phase duration in nanoseconds
+	bundles     []*events.AccessRecord_BundleReference
+	obligations model.Obligations // obligations of the policies that granted the phase
+	duration    uint64            // total phase duration in nanoseconds
+	denied      bool              // a deny policy denied the request, overriding every GRANT
+}
+
+// phaseDuration summarizes the timing of a phase. Policies evaluated concurrently each contribute
+// their full evaluation time, so the evaluation time may exceed the phase's overall time.
+func phaseDuration(id events.AccessRecord_BundleReference_Phase, p *phase) *events.AccessRecord_Duration_Phase {
+	d := &events.AccessRecord_Duration_Phase{Phase: id, Overall: p.duration}
+	for _, b := range p.bundles {
+		if len(b.Policies) == 0 || b.Policies[0].GetMrn() == "" {
+			continue // not evaluated, e.g. because the policy could not be found
+		}
+		d.Evaluation += b.Duration
+		d.Policies++
+	}
+	return d
+}
+
+// guard recovers a panic in the evaluation of the phase, recording it as an INTERNAL_ERROR bundle
+// reference for id rather than let it crash the process. Defer it in the phase's goroutine.
+func (p *phase) guard(id events.AccessRecord_BundleReference_Phase, ref string) {
+	if r := recover(); r != nil {
+		p.append(buildBundleReference(internalError(r), nil, id, ref, events.AccessRecord_DENY, 0))
+	}
+}
+
+// failed reports whether the evaluation of the phase panicked
+func (p *phase) failed() bool {
+	for _, b := range p.bundles {
+		if b.ReasonCode == events.AccessRecord_BundleReference_INTERNAL_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateDenyPolicies evaluates the deny policies of the entity ref, returning their bundle
+// references and whether any of them denied the request. A deny policy that fails to evaluate
+// denies the request too, with the reason code of its failure rather than EXPLICIT_DENY.
+func evaluateDenyPolicies(ctx context.Context, id events.AccessRecord_BundleReference_Phase, ref string, policies []*model.Policy, input map[string]interface{}) ([]*events.AccessRecord_BundleReference, bool) {
+	var (
+		refs   []*events.AccessRecord_BundleReference
+		denied bool
+	)
+	for _, policy := range policies {
+		evalStart := time.Now()
+		allow, perr := policy.EvaluateBool(ctx, input)
+		br := buildBundleReference(perr, policy, id, ref, events.AccessRecord_GRANT, safeNanos(time.Since(evalStart)))
+		if perr == nil && !allow {
+			br.Decision = events.AccessRecord_DENY
+			br.ReasonCode = events.AccessRecord_BundleReference_EXPLICIT_DENY
+			br.Reason = fmt.Sprintf("explicit deny by %s", policy.Mrn)
+		}
+		if br.Decision == events.AccessRecord_DENY {
+			denied = true
+		}
+		refs = append(refs, br)
+	}
+	return refs, denied
 }
 
 func (p *phase) append(r *events.AccessRecord_BundleReference) {
 	p.bundles = append(p.bundles, r)
 }
+
+// oblige records the obligations of a granting policy. When policies return the same obligation,
+// the first one recorded is kept.
+func (p *phase) oblige(obligations model.Obligations) {
+	p.obligations = mergeObligations(p.obligations, obligations)
+}
+
+// mergeObligations adds the obligations in src that are not already in dst, returning dst
+func mergeObligations(dst model.Obligations, src model.Obligations) model.Obligations {
+	for k, v := range src {
+		if dst == nil {
+			dst = make(model.Obligations, len(src))
+		}
+		if _, ok := dst[k]; !ok {
+			dst[k] = v
+		}
+	}
+	return dst
+}
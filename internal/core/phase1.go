@@ -6,9 +6,11 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
 	"github.com/manetu/policyengine/pkg/core/model"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
@@ -23,20 +25,44 @@ import (
  *    3. other operations might require a JWT
  * Tri-state allows phase1 to make all the decisions (GRANT/DENY) or let the other phases
  * decide.
+ *
+ * Backends implementing backend.BypassRuleProvider may also declare bypass rules that
+ * GRANT operations to privileged roles (e.g. anti-lockout for administrators) without
+ * evaluating the operation's policy at all. The operation is still resolved first, so that
+ * its context schema is enforced and its approvals gate the GRANT of a bypass rule too.
  ************************************************************************************/
 
 type phase1 struct {
 	phase
-	result int
+	result    int
+	operation *model.PolicyReference // the operation that op resolved to, if any
 }
 
-func getPolicyForOperation(ctx context.Context, pe *PolicyEngine, mrn string) (*model.Policy, *common.PolicyError) {
-	op, err := pe.backend.GetOperation(ctx, mrn)
-	if err != nil {
-		return nil, err
+// findBypassRule returns the first bypass rule that grants op to the principal, or nil. Errors
+// fetching the rules are not fatal: the decision falls back to the operation's policy.
+func findBypassRule(ctx context.Context, pe *PolicyEngine, principalMap map[string]interface{}, op string) *model.BypassRule {
+	provider, ok := pe.backend.(backend.BypassRuleProvider)
+	if !ok {
+		return nil
 	}
 
-	return op.Policy, nil
+	rules, perr := provider.GetBypassRules(ctx)
+	if perr != nil {
+		logger.WithContext(ctx).Debugf(agent, "authorize", "[phase1] bypass rules unavailable (err-%s)", perr)
+		return nil
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	roles := toStringSlice(principalMap[Mroles])
+	for _, rule := range rules {
+		if rule.Matches(op, roles) {
+			return rule
+		}
+	}
+
+	return nil
 }
 
 // phase1 returns a tri-state result - -1, 0 or > 0.
@@ -46,7 +72,9 @@ func getPolicyForOperation(ctx context.Context, pe *PolicyEngine, mrn string) (*
 //	for the entire policy evaluation. Rest of the phases are ignored.
 //
 // Value 0 is an leaves the result to be computed from the evaluation of other phases.
-func (p1 *phase1) exec(ctx context.Context, pe *PolicyEngine, input map[string]interface{}, op string) events.AccessRecord_Decision {
+func (p1 *phase1) exec(ctx context.Context, pe *PolicyEngine, principalMap map[string]interface{}, input map[string]interface{}, op string) events.AccessRecord_Decision {
+	log := logger.WithContext(ctx)
+
 	phaseStart := time.Now()
 	defer func() {
 		p1.duration = safeNanos(time.Since(phaseStart))
@@ -55,6 +83,7 @@ func (p1 *phase1) exec(ctx context.Context, pe *PolicyEngine, input map[string]i
 	var (
 		result       events.AccessRecord_Decision
 		perr         *common.PolicyError
+		invalid      *common.PolicyError
 		policy       *model.Policy
 		evalDuration uint64
 	)
@@ -62,25 +91,53 @@ func (p1 *phase1) exec(ctx context.Context, pe *PolicyEngine, input map[string]i
 	result = events.AccessRecord_UNSPECIFIED
 	bundleResult := events.AccessRecord_DENY
 
-	policy, perr = getPolicyForOperation(ctx, pe, op)
+	// the operation is resolved before the bypass rules, whose GRANTs its approvals also gate
+	p1.operation, perr = pe.backend.GetOperation(ctx, op)
+	if p1.operation != nil && perr == nil {
+		// policies may rely on the context matching the operation's schema, so neither they
+		// nor the bypass rules grant otherwise
+		invalid = pe.validateContext(ctx, p1.operation, input)
+	}
+
+	// an operation that cannot be resolved does not lock out the roles of bypass rules
+	if invalid == nil {
+		if rule := findBypassRule(ctx, pe, principalMap, op); rule != nil {
+			log.Debugf(agent, "authorize", "[phase1] bypass rule %s/%s granted %s", rule.Domain, rule.Name, rule.Reason)
+
+			p1.result = int(rule.Reason)
+			br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_GRANT, 0)
+			br.Reason = fmt.Sprintf("bypass rule %s/%s", rule.Domain, rule.Name)
+			p1.append(br)
+
+			return events.AccessRecord_GRANT
+		}
+	} else {
+		perr = invalid
+	}
+
+	if p1.operation != nil {
+		policy = p1.operation.Policy
+	}
 	if perr != nil || policy == nil {
-		logger.Debugf(agent, "authorize", "[phase1] no main policy (err-%s)", perr)
+		log.Debugf(agent, "authorize", "[phase1] main policy not evaluated (err-%s)", perr)
 
 		p1.result = -1
 		result = events.AccessRecord_DENY
 	} else {
-		logger.Debugf(agent, "authorize", "[phase1] got policy: %+v", policy)
+		log.Debugf(agent, "authorize", "[phase1] got policy: %+v", policy)
+
+		var obligations model.Obligations
 
 		evalStart := time.Now()
-		p1.result, perr = policy.EvaluateInt(ctx, input)
+		p1.result, obligations, perr = policy.EvaluateIntWithObligations(ctx, input)
 		evalDuration = safeNanos(time.Since(evalStart))
 
 		if perr != nil {
 			result = events.AccessRecord_DENY
-			logger.Debugf(agent, "authorize", "[phase1] failed(err-%s)", perr)
+			log.Debugf(agent, "authorize", "[phase1] failed(err-%s)", perr)
 		} else {
-			if logger.IsDebugEnabled() {
-				logger.Debugf(agent, "authorize", "[phase1] result: %d", p1.result)
+			if log.IsDebugEnabled() {
+				log.Debugf(agent, "authorize", "[phase1] result: %d", p1.result)
 			}
 
 			if p1.result > 0 {
@@ -91,6 +148,10 @@ func (p1 *phase1) exec(ctx context.Context, pe *PolicyEngine, input map[string]i
 			} else {
 				bundleResult = events.AccessRecord_GRANT
 			}
+
+			if bundleResult == events.AccessRecord_GRANT {
+				p1.oblige(obligations)
+			}
 		}
 	}
 
@@ -8,7 +8,6 @@ import (
 	"context"
 	"maps"
 	"slices"
-	"sync"
 	"time"
 
 	"github.com/manetu/policyengine/pkg/common"
@@ -19,20 +18,26 @@ import (
 /************************************************************************************
  * Phase2 is the "identity" phase where decision depends on the roles, groups and other
  * aspects of identity derived from the PORC. The policies corresponding to the identity
- * are used to evaluate the request in the context of the PORC.
+ * are used to evaluate the request in the context of the PORC. Any one role's GRANT
+ * suffices, unless the operation requires more of them (see model.IdentityRequirement),
+ * for which the phase counts the roles evaluated and those that granted.
  *************************************************************************************/
 
 type phase2 struct {
 	phase
+	roles   int // roles of the principal evaluated, including the roles of its groups
+	granted int // roles whose policy granted
 }
 
 func (p2 *phase2) exec(ctx context.Context, pe *PolicyEngine, principalMap map[string]interface{}, input map[string]interface{}) bool {
+	log := logger.WithContext(ctx)
+
 	phaseStart := time.Now()
 	defer func() {
 		p2.duration = safeNanos(time.Since(phaseStart))
 	}()
 
-	logger.Trace(agent, "authorize", "proceeding to phase2")
+	log.Trace(agent, "authorize", "proceeding to phase2")
 
 	var policies []*model.Policy
 
@@ -43,65 +48,77 @@ func (p2 *phase2) exec(ctx context.Context, pe *PolicyEngine, principalMap map[s
 
 	groups := toStringSlice(principalMap[Mgroups])
 	if len(groups) > 0 {
-		logger.Tracef(agent, "authorize", "[phase2] input groups %+v", groups)
+		log.Tracef(agent, "authorize", "[phase2] input groups %+v", groups)
 		// if fetching a group fails, record it but keep going. If there are no roles,
 		// we will DENY phase2. We just need one GRANT from the processing of policies
-		// for any one of roles
-		for _, groupMrn := range groups {
-			group, perr := pe.backend.GetGroup(ctx, groupMrn)
-			if perr != nil {
-				logger.Tracef(agent, "authorize", "[phase2] get rolebundle failed for group %s", groupMrn)
-				p2.append(buildBundleReference(perr, nil, events.AccessRecord_BundleReference_IDENTITY, groupMrn, events.AccessRecord_DENY, 0))
-			} else {
-				for _, r := range group.Roles {
+		// for any one of roles. Nested groups contribute their roles as well.
+		for _, g := range pe.expandGroups(ctx, groups) {
+			if g.err != nil {
+				log.Tracef(agent, "authorize", "[phase2] get rolebundle failed for group %s", g.mrn)
+				p2.append(buildBundleReference(g.err, nil, events.AccessRecord_BundleReference_IDENTITY, g.mrn, events.AccessRecord_DENY, 0))
+			} else if g.group != nil {
+				for _, r := range g.group.Roles {
 					roleMap[r] = struct{}{}
 				}
 			}
 		}
 	}
 
-	logger.Tracef(agent, "authorize", "[phase2] processing rolemap %+v", roleMap)
+	log.Tracef(agent, "authorize", "[phase2] processing rolemap %+v", roleMap)
 
-	rs := slices.Collect(maps.Keys(roleMap))
+	// sorted so that obligations are merged in a stable order
+	rs := slices.Sorted(maps.Keys(roleMap))
 
 	policies = make([]*model.Policy, len(rs))
 	decs := make([]bool, len(rs))
+	obligations := make([]model.Obligations, len(rs))
 	errs := make([]*common.PolicyError, len(rs))
 	durations := make([]uint64, len(rs))
+	denyRefs := make([][]*events.AccessRecord_BundleReference, len(rs))
+	denied := make([]bool, len(rs))
 
 	// ------------ begin processing policies concurrently ---------------
 	numRoles := len(rs)
-
-	wg := sync.WaitGroup{}
-	wg.Add(numRoles)
+	p2.roles = numRoles
 
 	// check other apis OR with realm policies
-	for ind, roleMrn := range rs {
-		go func(i int, roleMrn string) {
-			defer wg.Done()
-
-			role, err := pe.backend.GetRole(ctx, roleMrn)
-			if err != nil {
-				// errors will be logged below and decs[i] will default to false
-				errs[i] = err
-				return
+	pe.limits.fanOut(numRoles, func(i int) {
+		defer func() {
+			if r := recover(); r != nil {
+				errs[i] = internalError(r)
 			}
+		}()
+
+		roleMrn := rs[i]
+		role, err := pe.backend.GetRole(ctx, roleMrn)
+		if err != nil {
+			// errors will be logged below and decs[i] will default to false
+			errs[i] = err
+			return
+		}
 
-			policies[i] = role.Policy
-			evalStart := time.Now()
-			decs[i], errs[i] = role.Policy.EvaluateBool(ctx, input)
-			durations[i] = safeNanos(time.Since(evalStart))
-		}(ind, roleMrn)
-	}
+		// the role is fetched before a slot is taken, so that slots are held by evaluations only
+		if errs[i] = pe.limits.acquire(ctx); errs[i] != nil {
+			return
+		}
+		defer pe.limits.release()
 
-	wg.Wait()
+		policies[i] = role.Policy
+		evalStart := time.Now()
+		decs[i], obligations[i], errs[i] = role.Policy.EvaluateBoolWithObligations(ctx, input)
+		durations[i] = safeNanos(time.Since(evalStart))
+
+		// deny policies are evaluated apart from the role's policy, so that the GRANT of
+		// another role cannot override them
+		denyRefs[i], denied[i] = evaluateDenyPolicies(ctx, events.AccessRecord_BundleReference_IDENTITY, roleMrn, role.DenyPolicies, input)
+	})
 
 	//log results from phase2 for each role
 	for i := 0; i < numRoles; i++ {
 		if errs[i] != nil {
-			logger.Debugf(agent, "authorize", "[phase2] failed for role [%s](err-%s)", rs[i], errs[i])
+			log.Debugf(agent, "authorize", "[phase2] failed for role [%s](err-%s)", rs[i], errs[i])
 		} else {
-			logger.Debugf(agent, "authorize", "[phase2] result for role [%s](result-%t)", rs[i], decs[i])
+			log.Debugf(agent, "authorize", "[phase2] result for role [%s](result-%t)", rs[i], decs[i])
 		}
 	}
 
@@ -110,12 +127,22 @@ func (p2 *phase2) exec(ctx context.Context, pe *PolicyEngine, principalMap map[s
 	for i := 0; i < numRoles; i++ {
 		desc := events.AccessRecord_DENY
 		if decs[i] {
-			logger.Debugf(agent, "authorize", "[phase2] succeeded for role [%s]", rs[i])
+			log.Debugf(agent, "authorize", "[phase2] succeeded for role [%s]", rs[i])
 			result = true
+			p2.granted++
 			desc = events.AccessRecord_GRANT
+			p2.oblige(obligations[i])
 		}
 
 		p2.append(buildBundleReference(errs[i], policies[i], events.AccessRecord_BundleReference_IDENTITY, rs[i], desc, durations[i]))
+
+		for _, br := range denyRefs[i] {
+			p2.append(br)
+		}
+		if denied[i] {
+			log.Debugf(agent, "authorize", "[phase2] explicitly denied by role [%s]", rs[i])
+			p2.denied = true
+		}
 	}
 
 	return result
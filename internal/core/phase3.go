@@ -6,23 +6,32 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/consent"
 	"github.com/manetu/policyengine/pkg/core/model"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
 /********************************************************************************************
- * Phase3 evaluates policies related to resource in the PORC context.
+ * Phase3 evaluates policies related to resource in the PORC context. A resource group whose
+ * network rule does not admit the request denies without evaluating its policy, and one with
+ * an owner rule grants the owner of the resource without evaluating its policy. A consent-gated
+ * resource granted by its policy also requires the consent of its owner. The deny policies of
+ * the resource group are evaluated in every case, and their DENY overrides any GRANT.
  ********************************************************************************************/
 type phase3 struct {
 	phase
+	consentChecked bool // whether the consent of the resource's owner was checked
 }
 
 // phase3 is executed only if prior resource resolution is successful. ie, either group is provided in PORC or resource
 // MRN is used to fully resolve the resource in "input"
 func (p3 *phase3) exec(ctx context.Context, pe *PolicyEngine, input map[string]interface{}) bool {
+	log := logger.WithContext(ctx)
+
 	phaseStart := time.Now()
 	defer func() {
 		p3.duration = safeNanos(time.Since(phaseStart))
@@ -36,19 +45,58 @@ func (p3 *phase3) exec(ctx context.Context, pe *PolicyEngine, input map[string]i
 	)
 
 	// ResourceGroup policy check
-	logger.Tracef(agent, "authorize", "[phase3] Resource: %+v", input[resource])
+	log.Tracef(agent, "authorize", "[phase3] Resource: %+v", input[resource])
 
 	res := input[resource].(*model.Resource)
+	principalMap, _ := input[principal].(map[string]interface{})
 	rg, perr := pe.backend.GetResourceGroup(ctx, res.Group)
+	var denyRefs []*events.AccessRecord_BundleReference
+	if perr == nil {
+		denyRefs, p3.denied = evaluateDenyPolicies(ctx, events.AccessRecord_BundleReference_RESOURCE, res.Group, rg.DenyPolicies, input)
+		if p3.denied {
+			log.Debugf(agent, "authorize", "[phase3] explicitly denied by resource group %s", rg.Mrn)
+		}
+		// recorded after the references of the group's policy or owner rule
+		defer func() {
+			for _, br := range denyRefs {
+				p3.append(br)
+			}
+		}()
+	}
+
+	var networkReason string
+	if perr == nil {
+		networkReason, perr = admitNetwork(ctx, rg.Mrn, rg.Network)
+	}
+
 	if perr != nil {
-		logger.Debugf(agent, "authorize", "[phase3] error getting group for resource %s (err: %+v)", res.ID, perr)
+		log.Debugf(agent, "authorize", "[phase3] error getting group for resource %s (err: %+v)", res.ID, perr)
+	} else if networkReason != "" {
+		log.Debugf(agent, "authorize", "[phase3] not admitted by resource group %s: %s", rg.Mrn, networkReason)
+
+		br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_RESOURCE, res.Group, events.AccessRecord_DENY, 0)
+		br.Reason = networkReason
+		p3.append(br)
+
+		return false
+	} else if rg.Owner.Owns(principalMap, res.Owner) {
+		log.Debugf(agent, "authorize", "[phase3] owner %s granted by resource group %s", res.Owner, rg.Mrn)
+
+		br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_RESOURCE, res.Group, events.AccessRecord_GRANT, 0)
+		br.Reason = fmt.Sprintf("owner rule %s", rg.Mrn)
+		p3.append(br)
+
+		return true
 	} else {
 		policy = rg.Policy
 		evalStart := time.Now()
-		result, perr = rg.Policy.EvaluateBool(ctx, input)
+		var obligations model.Obligations
+		result, obligations, perr = rg.Policy.EvaluateBoolWithObligations(ctx, input)
 		evalDuration = safeNanos(time.Since(evalStart))
 		if perr != nil {
-			logger.Debugf(agent, "authorize", "[phase3] phase3 failed(err-%s)", perr)
+			log.Debugf(agent, "authorize", "[phase3] phase3 failed(err-%s)", perr)
+		} else if result {
+			p3.oblige(obligations)
 		}
 	}
 
@@ -58,5 +106,59 @@ func (p3 *phase3) exec(ctx context.Context, pe *PolicyEngine, input map[string]i
 	}
 	p3.append(buildBundleReference(perr, policy, events.AccessRecord_BundleReference_RESOURCE, res.Group, desc, evalDuration))
 
+	if result && !p3.denied && consent.Required(res.Annotations[consent.Annotation].Value) {
+		result = p3.checkConsent(ctx, pe, res, principalMap, input)
+	}
+
 	return result
 }
+
+// checkConsent asks the consent checker whether the owner of a consent-gated resource consented
+// to the request, recording the check as a reference to the resource
+func (p3 *phase3) checkConsent(ctx context.Context, pe *PolicyEngine, res *model.Resource, principalMap map[string]interface{}, input map[string]interface{}) bool {
+	log := logger.WithContext(ctx)
+
+	p3.consentChecked = true
+	start := time.Now()
+	br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_RESOURCE, res.ID, events.AccessRecord_DENY, 0)
+	defer func() {
+		br.Duration = safeNanos(time.Since(start))
+		p3.append(br)
+	}()
+
+	if pe.consent == nil {
+		log.Debugf(agent, "authorize", "[phase3] no consent checker for consent-gated resource %s", res.ID)
+		br.ReasonCode = events.AccessRecord_BundleReference_NOTFOUND_ERROR
+		br.Reason = "consent required, but no consent checker is configured"
+		return false
+	}
+
+	request := consent.Request{
+		Subject:  res.Owner,
+		Resource: res.ID,
+		Purposes: getDeclaredPurposes(input),
+	}
+	request.Principal, _ = principalMap[Sub].(string)
+	request.Operation, _ = input[operation].(string)
+	if err := request.Validate(); err != nil {
+		br.ReasonCode = events.AccessRecord_BundleReference_INVALPARAM_ERROR
+		br.Reason = err.Error()
+		return false
+	}
+
+	granted, err := pe.consent.Check(ctx, request)
+	if err != nil {
+		log.Debugf(agent, "authorize", "[phase3] consent check for resource %s failed: %+v", res.ID, err)
+		br.ReasonCode = events.AccessRecord_BundleReference_NETWORK_ERROR
+		br.Reason = fmt.Sprintf("consent %s: %s", pe.consent.Name(), err)
+		return false
+	}
+
+	if granted {
+		br.Decision = events.AccessRecord_GRANT
+		br.Reason = fmt.Sprintf("consent %s: granted by %s", pe.consent.Name(), res.Owner)
+	} else {
+		br.Reason = fmt.Sprintf("consent %s: not granted by %s", pe.consent.Name(), res.Owner)
+	}
+	return granted
+}
@@ -6,7 +6,6 @@ package core
 
 import (
 	"context"
-	"sync"
 	"time"
 
 	"github.com/manetu/policyengine/pkg/common"
@@ -15,7 +14,8 @@ import (
 )
 
 /********************************************************************************************
- * Phase4 evaluates policies related to scopes in the PORC context.
+ * Phase4 evaluates policies related to scopes in the PORC context. A scope whose network rule
+ * does not admit the request denies without evaluating its policy.
  ********************************************************************************************/
 
 const (
@@ -27,16 +27,18 @@ type phase4 struct {
 }
 
 func (p4 *phase4) exec(ctx context.Context, pe *PolicyEngine, principalMap map[string]interface{}, input map[string]interface{}) bool {
+	log := logger.WithContext(ctx)
+
 	phaseStart := time.Now()
 	defer func() {
 		p4.duration = safeNanos(time.Since(phaseStart))
 	}()
 
-	logger.Trace(agent, "authorize", "proceeding to phase4")
+	log.Trace(agent, "authorize", "proceeding to phase4")
 	scs := []string{}
 	for _, s := range toStringSlice(principalMap[Scopes]) {
 		if s == apiScope {
-			logger.Trace(agent, "authorize", "[phase4] found api scope...auth allowed")
+			log.Trace(agent, "authorize", "[phase4] found api scope...auth allowed")
 			//NOTE: we are NOT adding a bundleReference for this
 			return true
 		}
@@ -45,51 +47,62 @@ func (p4 *phase4) exec(ctx context.Context, pe *PolicyEngine, principalMap map[s
 	}
 
 	if len(scs) == 0 {
-		logger.Trace(agent, "authorize", "[phase4] no scopes")
+		log.Trace(agent, "authorize", "[phase4] no scopes")
 		//NOTE: we are NOT adding a bundleReference for this
 		return true
 	}
 
-	logger.Tracef(agent, "authorize", "[phase4] processing scopes %+v", scs)
+	log.Tracef(agent, "authorize", "[phase4] processing scopes %+v", scs)
 
 	numScopes := len(scs)
 
 	policies := make([]*model.Policy, numScopes)
 	decs := make([]bool, numScopes)
+	obligations := make([]model.Obligations, numScopes)
 	errs := make([]*common.PolicyError, numScopes)
 	durations := make([]uint64, numScopes)
+	reasons := make([]string, numScopes) // why a scope's network rule did not admit the request
 
 	// ------------ begin processing policies concurrently ---------------
-	wg := sync.WaitGroup{}
-	wg.Add(numScopes)
-
 	// check other apis OR with realm policies
-	for ind, s := range scs {
-		go func(i int, scopeMrn string) {
-			defer wg.Done()
-
-			scope, err := pe.backend.GetScope(ctx, scopeMrn)
-			if err != nil {
-				// errors will be logged below and decs[i] will default to false
-				errs[i] = err
-				return
+	pe.limits.fanOut(numScopes, func(i int) {
+		defer func() {
+			if r := recover(); r != nil {
+				errs[i] = internalError(r)
 			}
+		}()
+
+		scopeMrn := scs[i]
+		scope, err := pe.backend.GetScope(ctx, scopeMrn)
+		if err != nil {
+			// errors will be logged below and decs[i] will default to false
+			errs[i] = err
+			return
+		}
 
-			policies[i] = scope.Policy
-			evalStart := time.Now()
-			decs[i], errs[i] = scope.Policy.EvaluateBool(ctx, input)
-			durations[i] = safeNanos(time.Since(evalStart))
-		}(ind, s)
-	}
+		if reasons[i], errs[i] = admitNetwork(ctx, scope.Mrn, scope.Network); reasons[i] != "" || errs[i] != nil {
+			return
+		}
+
+		if errs[i] = pe.limits.acquire(ctx); errs[i] != nil {
+			return
+		}
+		defer pe.limits.release()
 
-	wg.Wait()
+		policies[i] = scope.Policy
+		evalStart := time.Now()
+		decs[i], obligations[i], errs[i] = scope.Policy.EvaluateBoolWithObligations(ctx, input)
+		durations[i] = safeNanos(time.Since(evalStart))
+	})
 
 	//log results from phase4 for each role
 	for i := 0; i < numScopes; i++ {
 		if errs[i] != nil {
-			logger.Debugf(agent, "authorize", "[phase4] failed for scope [%s](err-%s)", scs[i], errs[i])
+			log.Debugf(agent, "authorize", "[phase4] failed for scope [%s](err-%s)", scs[i], errs[i])
+		} else if reasons[i] != "" {
+			log.Debugf(agent, "authorize", "[phase4] not admitted by scope [%s]: %s", scs[i], reasons[i])
 		} else {
-			logger.Debugf(agent, "authorize", "[phase4] result for scope [%s](result-%t)", scs[i], decs[i])
+			log.Debugf(agent, "authorize", "[phase4] result for scope [%s](result-%t)", scs[i], decs[i])
 		}
 	}
 
@@ -97,12 +110,17 @@ func (p4 *phase4) exec(ctx context.Context, pe *PolicyEngine, principalMap map[s
 	for i := 0; i < numScopes; i++ {
 		desc := events.AccessRecord_DENY
 		if decs[i] {
-			logger.Debugf(agent, "authorize", "[phase4] succeeded for scope [%s]", scs[i])
+			log.Debugf(agent, "authorize", "[phase4] succeeded for scope [%s]", scs[i])
 			result = true
 			desc = events.AccessRecord_GRANT
+			p4.oblige(obligations[i])
 		}
 
-		p4.append(buildBundleReference(errs[i], policies[i], events.AccessRecord_BundleReference_SCOPE, scs[i], desc, durations[i]))
+		br := buildBundleReference(errs[i], policies[i], events.AccessRecord_BundleReference_SCOPE, scs[i], desc, durations[i])
+		if reasons[i] != "" {
+			br.Reason = reasons[i]
+		}
+		p4.append(br)
 	}
 
 	return result
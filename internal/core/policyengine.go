@@ -6,22 +6,32 @@ package core
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"math"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/manetu/policyengine/internal/logging"
 	"github.com/manetu/policyengine/pkg/common"
 	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
 	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/calendar"
 	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/consent"
+	"github.com/manetu/policyengine/pkg/core/geo"
 	"github.com/manetu/policyengine/pkg/core/model"
 	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/override"
+	"github.com/manetu/policyengine/pkg/core/revocation"
+	"github.com/manetu/policyengine/pkg/core/risk"
 	"github.com/manetu/policyengine/pkg/core/types"
-	"github.com/mohae/deepcopy"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
@@ -29,16 +39,38 @@ import (
 
 const (
 	auditNotPhase1 = math.MaxInt
+
+	// accessRecordSchemaVersion is reported in the metadata of every AccessRecord
+	accessRecordSchemaVersion = 2
 )
 
 // PolicyEngine is an object holding data for optimization
 type PolicyEngine struct {
-	audit    accesslog.Stream
-	backend  backend.Service
-	compiler *opa.Compiler
+	audit       accesslog.Stream
+	broadcaster *accesslog.BroadcastFactory
+	redactor    accesslog.Redactor
+	backend     backend.Service
+	compiler    *opa.Compiler
+
+	overrides *override.Store
+	consent   consent.Checker     // checks the consent of data subjects, nil if none
+	revoked   revocation.Checker  // checks whether principals' tokens were revoked, nil if none
+	locator   geo.Locator         // locates the client addresses of requests, nil if none
+	calendars *calendar.Calendars // business calendars of realms, nil if none
+
+	risk        risk.Provider // scores the risk of requests, nil if none
+	riskTimeout time.Duration // longest time the risk provider may take
+	riskDefault float64       // score given when the risk provider fails
+
+	approvals        *approval.Store
+	approvalNotifier approval.Notifier // told of each approval request opened, nil if none
 
 	includeAllBundles bool
 	auditEnv          map[string]string // cached environment variables for AccessRecord metadata
+	cacheTTL          time.Duration     // longest time a GRANT may be reused, zero if never
+	limits            *limiter          // bounds the evaluations and fan-outs of decisions
+
+	bundleRecord atomic.Pointer[events.AccessRecord_Bundle] // cached per bundle revision
 }
 
 var logger = logging.GetLogger("policyengine")
@@ -49,6 +81,12 @@ const (
 	operation string = "operation"
 	principal string = "principal"
 
+	porcContext   string = "context"
+	purpose       string = "purpose"
+	approvalToken string = "approval"
+	clientIP      string = "ip"
+	clientGeo     string = "geo"
+
 	// Sub ...
 	Sub string = "sub"
 	// Mrealm ...
@@ -61,15 +99,64 @@ const (
 	Mgroups string = "mgroups"
 	// Mannotations ...
 	Mannotations string = "mannotations"
+	// Act ...
+	Act string = "act"
 )
 
 // NewPolicyEngine returns an PE instance.
+//
+// Engines may be constructed concurrently. The options are not modified, so they may be
+// shared, and engines whose compilers are configured alike share the compiled policies
+// of identical domains.
 func NewPolicyEngine(engineOptions *options.EngineOptions) (*PolicyEngine, error) {
 
-	engineOptions.CompilerOptions = append(engineOptions.CompilerOptions, opa.WithUnsafeBuiltins(getUnsafeBuiltins()))
-	compiler := opa.NewCompiler(engineOptions.CompilerOptions...)
+	// copy the caller's options rather than append to them, as their backing array may be shared
+	compilerOptions := make([]opa.CompilerOptionFunc, 0, len(engineOptions.CompilerOptions)+4)
+	compilerOptions = append(compilerOptions, engineOptions.CompilerOptions...)
+	compilerOptions = append(compilerOptions, opa.WithUnsafeBuiltins(getUnsafeBuiltins()))
+	compilerOptions = append(compilerOptions, opa.WithBuiltins(opa.NetworkBuiltins()...))
+	compilerOptions = append(compilerOptions, opa.WithBuiltins(opa.CalendarBuiltins()...))
+	if len(engineOptions.Builtins) > 0 {
+		compilerOptions = append(compilerOptions, opa.WithBuiltins(engineOptions.Builtins...))
+	}
+	compiler := opa.NewCompiler(compilerOptions...)
 
-	al, err := engineOptions.AccessLogFactory.NewStream()
+	alFactory := engineOptions.AccessLogFactory
+	if spool := getSpoolOptions(); spool.Dir != "" {
+		alFactory = accesslog.NewSpoolingFactory(alFactory, spool)
+	}
+	// sample when configured to, or to count the records when asked to, even if all are kept
+	sampling := getSamplingOptions()
+	sampling.Counters = engineOptions.SamplingCounters
+	if !sampling.IsPassthrough() || sampling.Counters != nil {
+		alFactory = accesslog.NewSamplingFactory(alFactory, sampling)
+	}
+	// count decisions before sampling, so that the counters see every one
+	if engineOptions.DecisionMetrics != nil {
+		alFactory = accesslog.NewMetricsFactory(alFactory, engineOptions.DecisionMetrics)
+	}
+	// journal every decision, whatever the sampling, so that none is missing from a query
+	if journal := getJournalOptions(); journal.Path != "" {
+		alFactory = accesslog.NewJournalingFactory(alFactory, journal)
+	}
+	// subscribers also see every decision, whatever the sampling
+	broadcaster := accesslog.NewBroadcastFactory(alFactory)
+	alFactory = broadcaster
+
+	al, err := alFactory.NewStream()
+	if err != nil {
+		return nil, err
+	}
+
+	redactor := engineOptions.AuditRedactor
+	if redaction := getRedactionOptions(); redactor == nil && !redaction.IsEmpty() {
+		redactor, err = accesslog.NewFieldRedactor(redaction)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	overrides, err := getOverrides()
 	if err != nil {
 		return nil, err
 	}
@@ -79,12 +166,68 @@ func NewPolicyEngine(engineOptions *options.EngineOptions) (*PolicyEngine, error
 		return nil, err
 	}
 
+	approvals := engineOptions.ApprovalStore
+	if approvals == nil {
+		approvals = approval.NewStore(0)
+	}
+
+	locator := engineOptions.GeoLocator
+	if path := config.VConfig.GetString(config.GeoDatabase); locator == nil && path != "" {
+		db, err := geo.OpenMaxMind(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof(agent, "NewPolicyEngine", "locating requests with %s database %s", db.Type(), path)
+		locator = db
+	}
+
+	calendars := engineOptions.Calendars
+	if calendars == nil {
+		calendars, err = getCalendars()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	riskTimeout := config.VConfig.GetDuration(config.RiskTimeout)
+	if riskTimeout <= 0 {
+		riskTimeout = risk.DefaultTimeout
+	}
+
+	cacheTTL := engineOptions.DecisionCacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = config.VConfig.GetDuration(config.DecisionCacheTTL)
+	}
+
+	concurrency := engineOptions.EvaluationConcurrency
+	if concurrency == 0 {
+		concurrency = config.VConfig.GetInt(config.EvaluationConcurrency)
+	}
+	fanout := engineOptions.EvaluationFanout
+	if fanout == 0 {
+		fanout = config.VConfig.GetInt(config.EvaluationFanout)
+	}
+
 	return &PolicyEngine{
 		audit:             al,
+		broadcaster:       broadcaster,
+		redactor:          redactor,
 		backend:           be,
 		compiler:          compiler,
+		overrides:         overrides,
+		consent:           engineOptions.ConsentChecker,
+		revoked:           engineOptions.RevocationChecker,
+		locator:           locator,
+		calendars:         calendars,
+		risk:              engineOptions.RiskProvider,
+		riskTimeout:       riskTimeout,
+		riskDefault:       config.VConfig.GetFloat64(config.RiskDefault),
+		approvals:         approvals,
+		approvalNotifier:  engineOptions.ApprovalNotifier,
 		includeAllBundles: config.VConfig.GetBool(config.IncludeAllBundles), // default is to debug all bundles
 		auditEnv:          config.GetAuditEnv(),
+		cacheTTL:          cacheTTL,
+		limits:            newLimiter(concurrency, fanout),
 	}, nil
 }
 
@@ -135,29 +278,75 @@ func (pe *PolicyEngine) setOverrideReason(record *events.AccessRecord, result in
 	return auditReason
 }
 
-func (pe *PolicyEngine) auditDecision(aos *options.AuthzOptions, record *events.AccessRecord, resource string, reason string, porc map[string]interface{}, logonly bool, result int) {
+func (pe *PolicyEngine) auditDecision(ctx context.Context, aos *options.AuthzOptions, record *events.AccessRecord, resource string, reason string, porc map[string]interface{}, logonly bool, result int) {
+	log := logger.WithContext(ctx)
+
 	auditReason := pe.setOverrideReason(record, result)
 
-	if logger.IsDebugEnabled() {
+	if log.IsDebugEnabled() {
 		if result != auditNotPhase1 {
-			logger.Debugf(agent, "auditDecision", "resource: %s, reason: %s, options: %+v, result: %s", resource, reason, aos, auditReason)
+			log.Debugf(agent, "auditDecision", "resource: %s, reason: %s, options: %+v, result: %s", resource, reason, aos, auditReason)
 		} else {
-			logger.Debugf(agent, "auditDecision", "resource: %s, reason: %s, options: %+v", resource, reason, aos)
+			log.Debugf(agent, "auditDecision", "resource: %s, reason: %s, options: %+v", resource, reason, aos)
 		}
-		logger.Debug(agent, "auditDecision", "access record:")
+		log.Debug(agent, "auditDecision", "access record:")
 		common.PrettyPrint(record)
-		logger.Debug(agent, "auditDecision", "porc used:")
+		log.Debug(agent, "auditDecision", "porc used:")
 		common.PrettyPrint(porc)
 	}
 
 	if pe.audit != nil && !aos.Probe && !logonly {
+		pe.redact(record)
 		err := pe.audit.Send(record)
 		if err != nil {
-			logger.Errorf(agent, "auditDecision", "unable to send message for accesslog %+v", err)
+			log.Errorf(agent, "auditDecision", "unable to send message for accesslog %+v", err)
 		}
 	}
 }
 
+// redact applies the configured redactor to a record. If redaction fails, the PORC and principal
+// are removed instead, so that sensitive fields are never emitted unredacted.
+func (pe *PolicyEngine) redact(record *events.AccessRecord) {
+	if pe.redactor == nil {
+		return
+	}
+
+	if err := pe.redactor.Redact(record); err != nil {
+		logger.Errorf(agent, "redact", "unable to redact access record, removing PORC and principal: %+v", err)
+		record.Porc = ""
+		record.Principal = &events.AccessRecord_Principal{}
+	}
+}
+
+// getBundleRecord returns the AccessRecord representation of the backend's current bundle, or nil if
+// the backend does not identify its bundle. The record is rebuilt only when the revision changes.
+func (pe *PolicyEngine) getBundleRecord() *events.AccessRecord_Bundle {
+	info := pe.GetBundleInfo()
+	if info == nil {
+		return nil
+	}
+
+	if cached := pe.bundleRecord.Load(); cached != nil && cached.Revision == info.Revision {
+		return cached
+	}
+
+	record := &events.AccessRecord_Bundle{
+		Revision: info.Revision,
+		Domains:  make([]*events.AccessRecord_Bundle_Domain, 0, len(info.Domains)),
+	}
+	hash := sha256.New()
+	for _, d := range info.Domains {
+		record.Domains = append(record.Domains, &events.AccessRecord_Bundle_Domain{Name: d.Name, Fingerprint: d.Fingerprint})
+		hash.Write([]byte(d.Name))
+		hash.Write([]byte{0})
+		hash.Write(d.Fingerprint)
+	}
+	record.Fingerprint = hash.Sum(nil)
+	pe.bundleRecord.Store(record)
+
+	return record
+}
+
 func (pe *PolicyEngine) appendReferences(ar *events.AccessRecord, phases ...*phase) {
 	for _, p := range phases {
 		ar.References = append(ar.References, p.bundles...)
@@ -173,22 +362,31 @@ func (pe *PolicyEngine) fetchAnnotations(ctx context.Context, principalMap map[s
 	var (
 		annots map[string]interface{}
 	)
+	// the merges copy on write, so the caller's annotations are never modified
 	if a, ok := principalMap[Mannotations].(map[string]interface{}); ok {
-		annots = deepcopy.Copy(a).(map[string]interface{})
+		annots = a
 	} else if principalMap[Mannotations] != nil {
-		logger.Debugf(agent, "fetchAnnotations", "invalid annotation %+v", principalMap[Mannotations])
+		logger.WithContext(ctx).Debugf(agent, "fetchAnnotations", "invalid annotation %+v", principalMap[Mannotations])
 	}
 
 	return pe.GetAnnotations(ctx, annots, scopes, groups, roles)
 }
 
 func (pe *PolicyEngine) resolveResource(ctx context.Context, mrn string) (*model.Resource, *common.PolicyError) {
-	logger.Debugf(agent, "resolveResource", "mrn: %s", mrn)
+	log := logger.WithContext(ctx)
+
+	log.Debugf(agent, "resolveResource", "mrn: %s", mrn)
 
 	// Get resource with RichAnnotations
 	res, err := pe.backend.GetResource(ctx, mrn)
 	if err != nil {
-		logger.Debugf(agent, "resolveResource", "error getting resource: %+v", err)
+		log.Debugf(agent, "resolveResource", "error getting resource: %+v", err)
+		return nil, err
+	}
+
+	// the attributes of the resource may assign it to another group than its MRN did
+	if err := pe.assignResourceGroup(ctx, res); err != nil {
+		log.Debugf(agent, "resolveResource", "error assigning resource group: %+v", err)
 		return nil, err
 	}
 
@@ -196,21 +394,92 @@ func (pe *PolicyEngine) resolveResource(ctx context.Context, mrn string) (*model
 	// If resource group lookup fails, continue with just the resource's annotations
 	rg, rgErr := pe.backend.GetResourceGroup(ctx, res.Group)
 	if rgErr != nil {
-		logger.Debugf(agent, "resolveResource", "resource group not found, using resource annotations only: %+v", rgErr)
+		log.Debugf(agent, "resolveResource", "resource group not found, using resource annotations only: %+v", rgErr)
 		// Resource already has RichAnnotations, return as-is
 		return res, nil
 	}
 
 	// MergeStrategy annotations: resource-group (lower priority) with resource (higher priority)
 	res.Annotations = mergeAnnotations(rg.Annotations, res.Annotations)
+	// the purposes of the resource replace those of its group
+	if len(res.AllowedPurposes) == 0 {
+		res.AllowedPurposes = rg.AllowedPurposes
+	}
 	return res, nil
 }
 
-// Authorize is the main function that calls opa
-func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOptions *options.AuthzOptions) bool {
+// assignResourceGroup assigns a resource to the group its attributes select, if the backend
+// assigns groups by attributes and they select one
+func (pe *PolicyEngine) assignResourceGroup(ctx context.Context, res *model.Resource) *common.PolicyError {
+	a, ok := pe.backend.(backend.ResourceGroupAssigner)
+	if !ok {
+		return nil
+	}
+
+	group, err := a.AssignResourceGroup(ctx, res)
+	if err != nil {
+		return err
+	}
+	if group != "" {
+		logger.WithContext(ctx).Debugf(agent, "assignResourceGroup", "resource %s assigned to group %s by its attributes", res.ID, group)
+		res.Group = group
+	}
+	return nil
+}
+
+// groupPurposes returns the allowed purposes of a resource group, or none if it cannot be found.
+// A group that cannot be found denies the request in phase3, where its failure is also audited.
+func (pe *PolicyEngine) groupPurposes(ctx context.Context, group string) (purposes []string) {
+	if group == "" {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			logger.WithContext(ctx).Debugf(agent, "groupPurposes", "resource group lookup panicked: %v", r)
+			purposes = nil
+		}
+	}()
+
+	rg, err := pe.backend.GetResourceGroup(ctx, group)
+	if err != nil {
+		return nil
+	}
+	return rg.AllowedPurposes
+}
+
+// Authorize is the main function that calls opa. A GRANT also returns the obligations of the
+// granting policies, merged in phase order. Every decision returns a hint of how long it may be
+// reused, and, if requested, the outcome of each phase. Decisions of operations that require
+// approval also return the approval request that is pending or was redeemed. A panic while
+// deciding DENYs the request rather than crash the process.
+func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOptions *options.AuthzOptions) (allow bool, obligations model.Obligations, hint model.CacheHint, phases []types.PhaseResult, request *approval.Request) {
+	// authorize recovers panics in the evaluation, so that they are audited; this recovers any
+	// raised before the decision can be audited, such as while resolving the resource
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf(agent, "Authorize", "recovered from panic: %v\n%s", r, debug.Stack())
+			allow, obligations, hint, phases, request = false, nil, model.CacheHint{}, nil, nil
+		}
+	}()
+
+	allow, obligations = pe.authorize(ctx, input, authOptions, &hint, &phases, &request)
+	return allow, obligations, hint, phases, request
+}
+
+func (pe *PolicyEngine) authorize(ctx context.Context, input types.PORC, authOptions *options.AuthzOptions, hint *model.CacheHint, phases *[]types.PhaseResult, request **approval.Request) (bool, model.Obligations) {
 	overallStart := time.Now()
-	logger.Debug(agent, "authorize", "Enter")
-	defer logger.Debug(agent, "authorize", "Exit")
+
+	// the messages logged while deciding, including by the backend, carry the ID of the record
+	recordID := uuid.New().String()
+	ctx = logging.NewContext(ctx, logging.RecordID, recordID, logging.CorrelationID, authOptions.CorrelationID)
+	log := logger.WithContext(ctx)
+
+	log.Debug(agent, "authorize", "Enter")
+	defer log.Debug(agent, "authorize", "Exit")
+
+	if authOptions.Tenant != "" {
+		ctx = backend.WithTenant(ctx, authOptions.Tenant)
+	}
 
 	//principal is expected in the input (and not from phase1 policy processor)
 	principalMap := map[string]interface{}{}
@@ -222,10 +491,10 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 
 	if len(principalMap) == 0 {
 		//do not add annotations if there was no principalMap (no JWT)
-		logger.Debugf(agent, "authorize", "annotations not obtained: ...not adding to empty principal")
+		log.Debugf(agent, "authorize", "annotations not obtained: ...not adding to empty principal")
 	} else {
 		principalMap[Mannotations] = pe.fetchAnnotations(ctx, principalMap)
-		logger.Debugf(agent, "authorize", "annotations obtained: %+v", principalMap[Mannotations])
+		log.Debugf(agent, "authorize", "annotations obtained: %+v", principalMap[Mannotations])
 	}
 
 	var (
@@ -236,13 +505,13 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 	switch input[resource].(type) {
 	case string:
 		resMrn = input[resource].(string)
-		logger.Tracef(agent, "authorize", "calling getResource, mrn: %s", resMrn)
+		log.Tracef(agent, "authorize", "calling getResource, mrn: %s", resMrn)
 		input[resource], resErr = pe.resolveResource(ctx, resMrn)
 		if resErr != nil {
-			logger.Debugf(agent, "authorize", "[phase3] error getting resource: %+v", resErr)
+			log.Debugf(agent, "authorize", "[phase3] error getting resource: %+v", resErr)
 			input[resource] = &model.Resource{ID: resMrn}
 		} else {
-			logger.Debugf(agent, "authorize", "input resource updated: %+v", input[resource])
+			log.Debugf(agent, "authorize", "input resource updated: %+v", input[resource])
 		}
 	default:
 		r, _ := input[resource].(map[string]interface{})
@@ -258,35 +527,85 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 		}
 		classification, _ := r["classification"].(string)
 
-		input[resource] = &model.Resource{
-			ID:             resMrn,
-			Owner:          owner,
-			Group:          group,
-			Annotations:    model.FromAnnotations(annots),
-			Classification: classification,
+		res := &model.Resource{
+			ID:              resMrn,
+			Owner:           owner,
+			Group:           group,
+			Annotations:     model.FromAnnotations(annots),
+			Classification:  classification,
+			Compartments:    stringList(r["compartments"]),
+			AllowedPurposes: stringList(r["allowed_purposes"]),
+		}
+		// a resource without a group is assigned one by its attributes
+		if group == "" {
+			resErr = pe.assignResourceGroup(ctx, res)
 		}
+		if len(res.AllowedPurposes) == 0 {
+			res.AllowedPurposes = pe.groupPurposes(ctx, res.Group)
+		}
+		input[resource] = res
 	}
 
 	op, _ := input[operation].(string)
 
-	ar := &events.AccessRecord{
-		Principal:  &events.AccessRecord_Principal{},
-		Operation:  op,
-		Resource:   resMrn,
-		References: []*events.AccessRecord_BundleReference{},
-		Metadata: &events.AccessRecord_Metadata{
-			Timestamp: timestamppb.New(time.Now()),
-			Id:        uuid.New().String(),
-			Env:       pe.auditEnv,
-		},
+	// the record is released once audited, see pool.go
+	ar := acquireAccessRecord()
+	ar.Operation = op
+	ar.Resource = resMrn
+	ar.Metadata.Timestamp = timestamppb.New(time.Now())
+	ar.Metadata.Id = recordID
+	ar.Metadata.Env = pe.auditEnv
+	ar.Metadata.CorrelationId = authOptions.CorrelationID
+	ar.Metadata.SchemaVersion = accessRecordSchemaVersion
+	ar.Metadata.EngineVersion = engineVersion()
+	ar.Bundle = pe.getBundleRecord()
+
+	if authOptions.MapperDomain != "" || authOptions.MapperID != "" {
+		ar.Mapper = &events.AccessRecord_Mapper{Domain: authOptions.MapperDomain, Id: authOptions.MapperID}
 	}
 
 	ar.Principal.Subject, _ = principalMap[Sub].(string)
 	ar.Principal.Realm, _ = principalMap[Mrealm].(string)
 
-	if logger.IsDebugEnabled() {
-		logger.Debugf(agent, "authorize", "principalMap: %+v", principalMap)
-		logger.Debugf(agent, "authorize", "got access record: %+v", ar)
+	declaredPurposes := getDeclaredPurposes(input)
+	allowedPurposes := input[resource].(*model.Resource).AllowedPurposes
+	if len(declaredPurposes) > 0 || len(allowedPurposes) > 0 {
+		ar.Purpose = &events.AccessRecord_Purpose{Declared: declaredPurposes, Allowed: allowedPurposes}
+	}
+
+	// outbound calls made by policies through policyengine.fetch are audited with the decision
+	fetches := &opa.FetchLog{}
+	ctx = opa.WithFetchLog(ctx, fetches)
+
+	// as are policies reading the time, whose decisions are not cacheable
+	clock := &opa.ClockReads{}
+	ctx = opa.WithClockReads(ctx, clock)
+
+	// and checks delegated to external authorization services, as references of their own phase
+	externals := &opa.ExternalLog{}
+	ctx = opa.WithExternalLog(ctx, externals)
+
+	// as are those consulting the network origin of the request, through built-ins or network rules
+	network := pe.requestNetwork(input)
+	ctx = opa.WithNetwork(ctx, network)
+
+	// the business calendar of the principal's realm is given to policies, whose reads of it are clock reads
+	if cal := pe.calendars.For(ar.Principal.Realm); cal != nil {
+		input[opa.CalendarInput] = cal.At(time.Now())
+		ctx = opa.WithCalendar(ctx, cal)
+	}
+
+	// the risk of the request is scored before any policy is evaluated, and recorded with the decision
+	if pe.risk != nil {
+		ar.Risk = pe.assessRisk(ctx, input)
+	}
+
+	// consent may be withdrawn at any time, so decisions that checked it are not cacheable either
+	var consentChecked bool
+
+	if log.IsDebugEnabled() {
+		log.Debugf(agent, "authorize", "principalMap: %+v", principalMap)
+		log.Debugf(agent, "authorize", "got access record: %+v", ar)
 	}
 
 	auditDecision := struct {
@@ -294,21 +613,32 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 		reason       string
 	}{}
 
-	// Initialize duration tracking
-	ar.Duration = &events.AccessRecord_Duration{
-		Phases: make(map[uint32]uint64),
-	}
-
 	// -------------------------- NOTE: all returns audited -----------------
 	defer func() {
+		// a panic outside the phases DENYs, with the unnamed results left at false and nil
+		if r := recover(); r != nil {
+			ar.References = append(ar.References, buildBundleReference(internalError(r), nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_DENY, 0))
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = auditNotPhase1
+			auditDecision.reason = "internal error"
+		}
+
 		// Capture overall duration just before sending audit (excluding audit send time)
 		ar.Duration.Overall = safeNanos(time.Since(overallStart))
-		pe.auditDecision(authOptions, ar, resMrn, auditDecision.reason, input, false, auditDecision.phase1Result)
+		ar.Fetches = fetches.Calls()
+		owned := len(ar.References)
+		ar.References = append(ar.References, externals.References()...)
+		*hint = pe.cacheHint(ar, principalMap, clock.Read() || network.Read() || consentChecked)
+		if authOptions.PhaseResults {
+			*phases = phaseResults(ar.References)
+		}
+		pe.auditDecision(ctx, authOptions, ar, resMrn, auditDecision.reason, input, false, auditDecision.phase1Result)
+		releaseAccessRecord(ar, owned)
 	}()
 
 	realizedPorc, err := json.Marshal(input)
 	if err != nil {
-		logger.Errorf(agent, "authorize", "failed to marshal fully realized PORC:\n, %+v", input)
+		log.Errorf(agent, "authorize", "failed to marshal fully realized PORC:\n, %+v", input)
 
 		perr := &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_INVALPARAM_ERROR, Reason: err.Error()}
 
@@ -318,11 +648,91 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 		auditDecision.reason = "failed to marshal PORC"
 		auditDecision.phase1Result = auditNotPhase1
 
-		return false
+		return false, nil
 	}
 
 	ar.Porc = string(realizedPorc)
 
+	// a revoked token is denied whatever the overrides and policies would decide
+	if token := principalToken(principalMap); pe.revoked != nil && !token.IsEmpty() {
+		revoked, err := pe.revoked.Revoked(ctx, token)
+		switch {
+		case err != nil:
+			log.Warnf(agent, "authorize", "revocation check of principal '%s' failed: %+v", ar.Principal.Subject, err)
+
+			perr := &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_NETWORK_ERROR, Reason: fmt.Sprintf("revocation %s: %s", pe.revoked.Name(), err)}
+			ar.References = append(ar.References, buildBundleReference(perr, nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_DENY, 0))
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = auditNotPhase1
+			auditDecision.reason = "revocation check failed"
+
+			return false, nil
+		case revoked:
+			br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_DENY, 0)
+			br.Reason = fmt.Sprintf("revocation %s: token revoked", pe.revoked.Name())
+			ar.References = append(ar.References, br)
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = -int(events.AccessRecord_REVOKED)
+			auditDecision.reason = "token revoked"
+
+			return false, nil
+		}
+	}
+
+	// as is a request its actors may not make on behalf of the principal
+	if claim := principalMap[Act]; claim != nil {
+		reason, denied, perr := pe.checkImpersonation(ctx, ar, claim, op)
+		switch {
+		case perr != nil:
+			log.Warnf(agent, "authorize", "impersonation rules of principal '%s' unavailable: %+v", ar.Principal.Subject, perr)
+
+			ar.References = append(ar.References, buildBundleReference(perr, nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_DENY, 0))
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = auditNotPhase1
+			auditDecision.reason = "impersonation rules unavailable"
+
+			return false, nil
+		case denied != nil:
+			ar.Override = overrideRecord(denied)
+			br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_DENY, 0)
+			br.Reason = reason
+			ar.References = append(ar.References, br)
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = -int(events.AccessRecord_DENY_LISTED)
+			auditDecision.reason = "actor denied by override"
+
+			return false, nil
+		case reason != "":
+			br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_SYSTEM, op, events.AccessRecord_DENY, 0)
+			br.Reason = reason
+			ar.References = append(ar.References, br)
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = -int(events.AccessRecord_IMPERSONATION_DENIED)
+			auditDecision.reason = "impersonation denied"
+
+			return false, nil
+		}
+	}
+
+	// a deny-list or break-glass override decides the request before any policy is evaluated
+	if o := pe.overrides.Match(ar.Principal.Subject, ar.Principal.Realm, time.Now()); o != nil {
+		ar.Override = overrideRecord(o)
+
+		if o.Type == override.Deny {
+			ar.Decision = events.AccessRecord_DENY
+			auditDecision.phase1Result = -int(events.AccessRecord_DENY_LISTED)
+			auditDecision.reason = "denied by override"
+
+			return false, nil
+		}
+
+		ar.Decision = events.AccessRecord_GRANT
+		auditDecision.phase1Result = int(events.AccessRecord_BREAK_GLASS)
+		auditDecision.reason = "granted by break-glass override"
+
+		return true, nil
+	}
+
 	var (
 		phasesWg sync.WaitGroup
 	)
@@ -335,7 +745,8 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 	p1 := &phase1{}
 	go func() {
 		defer phasesWg.Done()
-		phase1Result = p1.exec(ctx, pe, input, op)
+		defer p1.guard(events.AccessRecord_BundleReference_SYSTEM, op)
+		phase1Result = p1.exec(ctx, pe, principalMap, input, op)
 	}()
 
 	var (
@@ -344,6 +755,7 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 	p2 := &phase2{}
 	go func() {
 		defer phasesWg.Done()
+		defer p2.guard(events.AccessRecord_BundleReference_IDENTITY, "")
 		phase2Result = p2.exec(ctx, pe, principalMap, input)
 	}()
 
@@ -353,6 +765,7 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 	p3 := &phase3{}
 	go func() {
 		defer phasesWg.Done()
+		defer p3.guard(events.AccessRecord_BundleReference_RESOURCE, resMrn)
 		// Resource resolution failure will cause evaluation to terminate post phase 1
 		// and will add the required DENY bundle (which is needed for audit).
 		// The result itself would be DENY and phase 3 won't be evaluated. No need to execute
@@ -368,18 +781,46 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 	p4 := &phase4{}
 	go func() {
 		defer phasesWg.Done()
+		defer p4.guard(events.AccessRecord_BundleReference_SCOPE, "")
 		phase4Result = p4.exec(ctx, pe, principalMap, input)
 	}()
 
 	phasesWg.Wait()
+	consentChecked = p3.consentChecked
 
 	// Collect per-phase durations
 	ar.Duration.Phases[uint32(events.AccessRecord_BundleReference_SYSTEM)] = p1.duration
 	ar.Duration.Phases[uint32(events.AccessRecord_BundleReference_IDENTITY)] = p2.duration
 	ar.Duration.Phases[uint32(events.AccessRecord_BundleReference_RESOURCE)] = p3.duration
 	ar.Duration.Phases[uint32(events.AccessRecord_BundleReference_SCOPE)] = p4.duration
+	ar.Duration.Breakdown = []*events.AccessRecord_Duration_Phase{
+		phaseDuration(events.AccessRecord_BundleReference_SYSTEM, &p1.phase),
+		phaseDuration(events.AccessRecord_BundleReference_IDENTITY, &p2.phase),
+		phaseDuration(events.AccessRecord_BundleReference_RESOURCE, &p3.phase),
+		phaseDuration(events.AccessRecord_BundleReference_SCOPE, &p4.phase),
+	}
+
+	if op := p1.operation; op != nil {
+		ar.OperationMatch = &events.AccessRecord_OperationMatch{Domain: op.Domain, Id: op.Mrn, Selector: op.Selector}
+	}
 
-	logger.Debug(agent, "authorize", "phases completed...begin evaulation")
+	log.Debug(agent, "authorize", "phases completed...begin evaulation")
+
+	// a phase that panicked cannot be trusted to have decided correctly, so the request is denied
+	if p1.failed() || p2.failed() || p3.failed() || p4.failed() {
+		pe.appendReferences(ar, &p1.phase, &p2.phase, &p3.phase, &p4.phase)
+		ar.Decision = events.AccessRecord_DENY
+		auditDecision.phase1Result = auditNotPhase1
+		auditDecision.reason = "internal error"
+
+		return false, nil
+	}
+
+	// an operation may require more of the principal's roles than one to GRANT
+	identityRequired := p1.operation != nil && p1.operation.Identity.Conjunctive()
+	if identityRequired {
+		phase2Result = pe.requireRoles(ar, p1.operation.Identity, p2)
+	}
 
 	// include execution records for audit and display purposes
 	if pe.includeAllBundles {
@@ -388,6 +829,32 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 		pe.appendReferences(ar, &p1.phase)
 	}
 
+	// an operation that requires approval is granted only with an approved request
+	approve := func(obligations model.Obligations) (bool, model.Obligations) {
+		allow, obligations := pe.requireApproval(ctx, ar, p1.operation, input, authOptions.Probe, obligations, request)
+		if !allow {
+			auditDecision.phase1Result = auditNotPhase1
+			auditDecision.reason = "pending approval"
+		}
+		return allow, obligations
+	}
+
+	// purpose limitation is enforced whatever the policies decided, including a phase1 GRANT, and
+	// however the phases combine
+	if phase1Result != events.AccessRecord_DENY && !model.PurposeAllowed(declaredPurposes, allowedPurposes) {
+		log.Debugf(agent, "authorize", "purposes %v not allowed for resource %s, which allows %v", declaredPurposes, resMrn, allowedPurposes)
+
+		ar.Decision = events.AccessRecord_DENY
+		auditDecision.phase1Result = auditNotPhase1
+		auditDecision.reason = "purpose not allowed"
+
+		br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_RESOURCE, resMrn, events.AccessRecord_DENY, 0)
+		br.Reason = purposeDenial(declaredPurposes, allowedPurposes)
+		ar.References = append(ar.References, br)
+
+		return false, nil
+	}
+
 	// start with phase1Result ... potentially events.AccessRecord_UNSPECIFIED
 	ar.Decision = phase1Result
 
@@ -399,12 +866,12 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 		auditDecision.phase1Result = p1.result
 		auditDecision.reason = "authorized in phase1"
 
-		return true
+		return approve(p1.obligations)
 	case events.AccessRecord_DENY:
 		auditDecision.phase1Result = p1.result
 		auditDecision.reason = "denied in phase1"
 
-		return false
+		return false, nil
 	}
 
 	// ----------- proceed to POST phase1 evaulation processing ----------
@@ -414,42 +881,219 @@ func (pe *PolicyEngine) Authorize(ctx context.Context, input types.PORC, authOpt
 	ar.Decision = events.AccessRecord_DENY
 
 	if resErr != nil {
-		logger.Tracef(agent, "authorize", "resource error (err-%s). Stopping evaluation post phase1", resErr)
+		log.Tracef(agent, "authorize", "resource error (err-%s). Stopping evaluation post phase1", resErr)
 
 		auditDecision.reason = "error getting resource"
 
 		ar.References = append(ar.References, buildBundleReference(resErr, nil, events.AccessRecord_BundleReference_RESOURCE, resMrn, events.AccessRecord_DENY, 0))
 
-		return false
+		return false, nil
+	}
+
+	// an explicit deny overrides the GRANT of every phase, however the phases combine
+	if p2.denied || p3.denied {
+		log.Debugf(agent, "authorize", "explicitly denied for resource %s", resMrn)
+
+		auditDecision.reason = "explicit deny"
+		if !pe.includeAllBundles {
+			pe.appendReferences(ar, &p2.phase, &p3.phase, &p4.phase)
+		}
+
+		return false, nil
+	}
+
+	defaults := pe.getDomainDefaults(ctx, op)
+	if defaults != nil {
+		ar.Defaults = &events.AccessRecord_Defaults{
+			Domain:    defaults.Domain,
+			Decision:  defaults.Decision,
+			Combining: defaults.Combining,
+		}
+
+		// a principal without roles or groups has no identity policy to evaluate, which the
+		// operation's requirement of roles denies rather than the default decides
+		if len(p2.bundles) == 0 && !identityRequired {
+			phase2Result = defaults.Decision == events.AccessRecord_GRANT
+		}
+
+		if defaults.Combining == events.AccessRecord_ANY {
+			if !pe.includeAllBundles {
+				pe.appendReferences(ar, &p2.phase, &p3.phase, &p4.phase)
+			}
+			allow, obligations := pe.combineAny(ar, defaults, p1, []bool{phase2Result, phase3Result, phase4Result}, &p2.phase, &p3.phase, &p4.phase)
+			if !allow {
+				return false, nil
+			}
+			return approve(obligations)
+		}
 	}
 
 	if !pe.includeAllBundles {
 		pe.appendReferences(ar, &p2.phase)
 	}
 	if !phase2Result {
-		return false
+		return false, nil
 	}
 
 	if !pe.includeAllBundles {
 		pe.appendReferences(ar, &p3.phase)
 	}
 	if !phase3Result {
-		return false
+		return false, nil
 	}
 
 	if !pe.includeAllBundles {
 		pe.appendReferences(ar, &p4.phase)
 	}
 	if !phase4Result {
-		return false
+		return false, nil
 	}
 
 	//everything passed
 	ar.Decision = events.AccessRecord_GRANT
 
-	logger.Debugf(agent, "authorize", "authorized principal: %+v", principalMap)
+	log.Debugf(agent, "authorize", "authorized principal: %+v", principalMap)
+
+	obligations := p1.obligations
+	for _, p := range []*phase{&p2.phase, &p3.phase, &p4.phase} {
+		obligations = mergeObligations(obligations, p.obligations)
+	}
+
+	return approve(obligations)
+}
+
+// requireRoles applies the identity requirement of an operation to the GRANTs of the principal's
+// roles in phase2, which it records in the access record, and returns the outcome of the phase.
+// A phase that does not meet the requirement is given a bundle reference saying why.
+func (pe *PolicyEngine) requireRoles(ar *events.AccessRecord, requirement model.IdentityRequirement, p2 *phase2) bool {
+	ar.Identity = &events.AccessRecord_Identity{
+		All:     requirement.All,
+		Minimum: uint32(max(requirement.Minimum, 1)), // #nosec G115 -- validated not to be negative
+		Roles:   uint32(p2.roles),                    // #nosec G115 -- bounded by the roles of a principal
+		Granted: uint32(p2.granted),                  // #nosec G115 -- bounded by the roles of a principal
+	}
+	if requirement.Met(p2.granted, p2.roles) {
+		return true
+	}
 
-	return true
+	required := fmt.Sprintf("at least %d required", max(requirement.Minimum, 1))
+	if requirement.All {
+		required = "all required"
+		if requirement.Minimum > 1 {
+			required = fmt.Sprintf("all, and at least %d, required", requirement.Minimum)
+		}
+	}
+	br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_IDENTITY, ar.Operation, events.AccessRecord_DENY, 0)
+	br.Reason = fmt.Sprintf("identity requirement: %d of %d role(s) granted, %s", p2.granted, p2.roles, required)
+	p2.append(br)
+	return false
+}
+
+// requireApproval gates the GRANT of an operation that requires approval. The request is granted
+// if it presents, as context.approval, an approved request of the same subject for the same
+// operation and resource, which is redeemed. Otherwise it is PENDING on the subject's pending
+// request, or on a new one of which the notifier is told. Probes neither redeem nor open requests.
+func (pe *PolicyEngine) requireApproval(ctx context.Context, ar *events.AccessRecord, operation *model.PolicyReference, input types.PORC, probe bool, obligations model.Obligations, request **approval.Request) (bool, model.Obligations) {
+	if operation == nil || operation.RequiresApproval <= 0 {
+		return true, obligations
+	}
+
+	log := logger.WithContext(ctx)
+	subject, now := ar.Principal.Subject, time.Now()
+
+	if token := getApprovalToken(input); token != "" {
+		redeem := pe.approvals.Redeem
+		if probe {
+			redeem = pe.approvals.Check
+		}
+		if r, ok := redeem(token, subject, ar.Operation, ar.Resource, now); ok {
+			log.Debugf(agent, "requireApproval", "approval request %s approved by %v", r.ID, r.Approvers)
+			ar.Approval = approvalRecord(r)
+			*request = &r
+			return true, obligations
+		}
+		log.Debugf(agent, "requireApproval", "approval request %s is not approved for this request", token)
+	}
+
+	ar.Decision = events.AccessRecord_PENDING
+	if probe {
+		ar.Approval = &events.AccessRecord_Approval{Required: uint32(operation.RequiresApproval)} // #nosec G115 -- validated not to be negative
+		return false, nil
+	}
+
+	r, opened := pe.approvals.Open(subject, ar.Operation, ar.Resource, operation.RequiresApproval, now)
+	ar.Approval = approvalRecord(r)
+	*request = &r
+	if opened && pe.approvalNotifier != nil {
+		if err := pe.approvalNotifier.Notify(ctx, r); err != nil {
+			log.Errorf(agent, "requireApproval", "unable to notify approval request %s: %+v", r.ID, err)
+		}
+	}
+
+	return false, nil
+}
+
+// cacheHint determines how long a decision may be reused. Only GRANTs that depend on nothing but
+// the PORC and the bundle may be, and for no longer than the principal's token remains valid.
+// Volatile GRANTs, which read the time or checked consent, are never reused, and neither are
+// break-glass GRANTs, so that every use is audited, or GRANTs redeeming an approval, which are
+// granted once.
+func (pe *PolicyEngine) cacheHint(ar *events.AccessRecord, principalMap map[string]interface{}, volatile bool) model.CacheHint {
+	hint := model.CacheHint{Revision: ar.GetBundle().GetRevision()}
+	if pe.cacheTTL <= 0 || ar.Decision != events.AccessRecord_GRANT || ar.Override != nil || ar.Approval != nil || len(ar.Fetches) > 0 || volatile {
+		return hint
+	}
+
+	hint.TTL = pe.cacheTTL
+	if exp, ok := tokenExpiry(principalMap); ok {
+		hint.TTL = max(min(hint.TTL, time.Until(exp)), 0)
+	}
+	return hint
+}
+
+// getDomainDefaults returns the decision strategy of the domain routing op, or nil for the
+// standard strategy. Errors are not fatal: they have already denied the request in phase1.
+func (pe *PolicyEngine) getDomainDefaults(ctx context.Context, op string) *model.DomainDefaults {
+	p, ok := pe.backend.(backend.DomainDefaultsProvider)
+	if !ok {
+		return nil
+	}
+
+	defaults, perr := p.GetDomainDefaults(ctx, op)
+	if perr != nil {
+		logger.WithContext(ctx).Debugf(agent, "authorize", "domain defaults unavailable (err-%s)", perr)
+		return nil
+	}
+
+	return defaults
+}
+
+// combineAny GRANTs if any phase that evaluated a policy granted. When no phase evaluated a
+// policy, the domain's default decision applies.
+func (pe *PolicyEngine) combineAny(ar *events.AccessRecord, defaults *model.DomainDefaults, p1 *phase1, results []bool, phases ...*phase) (bool, model.Obligations) {
+	evaluated, granted := false, false
+	obligations := p1.obligations
+	for i, p := range phases {
+		if len(p.bundles) == 0 {
+			continue
+		}
+		evaluated = true
+		if results[i] {
+			granted = true
+			obligations = mergeObligations(obligations, p.obligations)
+		}
+	}
+	if !evaluated {
+		granted = defaults.Decision == events.AccessRecord_GRANT
+	}
+
+	if !granted {
+		return false, nil
+	}
+
+	ar.Decision = events.AccessRecord_GRANT
+
+	return true, obligations
 }
 
 // GetBackend returns the backend service used by this policy engine.
@@ -457,6 +1101,84 @@ func (pe *PolicyEngine) GetBackend() backend.Service {
 	return pe.backend
 }
 
+// GetBundleInfo returns the revision and domain fingerprints of the bundle served by the backend,
+// or nil if the backend does not implement backend.BundleInfoProvider.
+func (pe *PolicyEngine) GetBundleInfo() *model.BundleInfo {
+	if p, ok := pe.backend.(backend.BundleInfoProvider); ok {
+		return p.GetBundleInfo()
+	}
+
+	return nil
+}
+
+// WarmUp prepares the backend's policies for evaluation, if the backend implements
+// backend.WarmUpper. Other backends prepare policies on first use.
+func (pe *PolicyEngine) WarmUp(ctx context.Context) error {
+	if w, ok := pe.backend.(backend.WarmUpper); ok {
+		return w.WarmUp(ctx)
+	}
+
+	return nil
+}
+
+// Health checks the backend, if it implements backend.HealthChecker. Other backends
+// are always healthy.
+func (pe *PolicyEngine) Health(ctx context.Context) error {
+	if h, ok := pe.backend.(backend.HealthChecker); ok {
+		return h.Health(ctx)
+	}
+
+	return nil
+}
+
+// Subscribe opens a subscription to the access records of the following decisions.
+func (pe *PolicyEngine) Subscribe(size int) *accesslog.Subscription {
+	return pe.broadcaster.Subscribe(size)
+}
+
+// AddOverride registers a deny-list or break-glass override and returns it with its ID assigned.
+func (pe *PolicyEngine) AddOverride(o override.Override) (override.Override, error) {
+	o, err := pe.overrides.Add(o)
+	if err != nil {
+		return override.Override{}, err
+	}
+
+	logger.Infof(agent, "AddOverride", "registered %s override %s for subject '%s' until %s (created by: '%s', justification: '%s')",
+		o.Type, o.ID, o.Subject, o.Expires.Format(time.RFC3339), o.CreatedBy, o.Justification)
+	return o, nil
+}
+
+// RemoveOverride revokes an override, returning false if it is not registered.
+func (pe *PolicyEngine) RemoveOverride(id string) bool {
+	removed := pe.overrides.Remove(id)
+	if removed {
+		logger.Infof(agent, "RemoveOverride", "revoked override %s", id)
+	}
+	return removed
+}
+
+// ListOverrides returns the registered overrides that have not expired.
+func (pe *PolicyEngine) ListOverrides() []override.Override {
+	return pe.overrides.List()
+}
+
+// Approve records the approval of a pending approval request and returns the request.
+func (pe *PolicyEngine) Approve(id, approver string) (approval.Request, error) {
+	r, err := pe.approvals.Approve(id, approver, time.Now())
+	if err != nil {
+		return approval.Request{}, err
+	}
+
+	logger.Infof(agent, "Approve", "'%s' approved request %s of '%s' for %s on %s (%d of %d approvals)",
+		approver, r.ID, r.Subject, r.Operation, r.Resource, len(r.Approvers), r.Required)
+	return r, nil
+}
+
+// ListApprovals returns the approval requests that have not expired.
+func (pe *PolicyEngine) ListApprovals() []approval.Request {
+	return pe.approvals.List()
+}
+
 // IsAllBundles returns whether the policy engine is configured to include all bundles (needed for debugging).
 func (pe *PolicyEngine) IsAllBundles() bool {
 	return pe.includeAllBundles
@@ -0,0 +1,83 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core
+
+import (
+	"sync"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+/* Every decision builds an access record and a bundle reference per policy evaluated, which are
+ * discarded once the record is sent. They are reused across decisions through pools, relying on
+ * the contract of accesslog.Stream: a stream must not retain a record once Send returns, and
+ * clones it if it needs to.
+ *
+ * A record owns the bundle references built by buildBundleReference in its References, each of
+ * which is appended once, and releases them with itself. The references of external checks are
+ * built by the built-ins making them, and the bundle record is shared by every decision of a
+ * revision, so neither is released.
+ */
+
+var (
+	recordPool    = sync.Pool{New: func() interface{} { return new(events.AccessRecord) }}
+	referencePool = sync.Pool{New: func() interface{} { return new(events.AccessRecord_BundleReference) }}
+)
+
+// acquireAccessRecord returns an empty access record with its principal, metadata, and duration
+func acquireAccessRecord() *events.AccessRecord {
+	ar := recordPool.Get().(*events.AccessRecord)
+	if ar.Principal == nil {
+		ar.Principal = &events.AccessRecord_Principal{}
+		ar.Metadata = &events.AccessRecord_Metadata{}
+		ar.Duration = &events.AccessRecord_Duration{Phases: make(map[uint32]uint64)}
+	}
+	return ar
+}
+
+// releaseAccessRecord returns the record and the first owned of its bundle references to their
+// pools. Neither may be used once released.
+func releaseAccessRecord(ar *events.AccessRecord, owned int) {
+	for _, br := range ar.References[:owned] {
+		releaseBundleReference(br)
+	}
+
+	// the messages of every record are kept, along with the capacity of its references
+	refs := ar.References
+	clear(refs)
+	principal, metadata, duration := ar.Principal, ar.Metadata, ar.Duration
+	if principal == nil || metadata == nil || duration == nil {
+		return // replaced while deciding, such as by a redactor
+	}
+	phases := duration.Phases
+
+	ar.Reset()
+	principal.Reset()
+	metadata.Reset()
+	duration.Reset()
+	clear(phases)
+
+	duration.Phases = phases
+	ar.Principal, ar.Metadata, ar.Duration, ar.References = principal, metadata, duration, refs[:0]
+	recordPool.Put(ar)
+}
+
+// acquireBundleReference returns an empty bundle reference with a single policy reference
+func acquireBundleReference() *events.AccessRecord_BundleReference {
+	br := referencePool.Get().(*events.AccessRecord_BundleReference)
+	if len(br.Policies) == 0 {
+		br.Policies = []*events.AccessRecord_PolicyReference{{}}
+	}
+	return br
+}
+
+func releaseBundleReference(br *events.AccessRecord_BundleReference) {
+	policies := br.Policies
+	policies[0].Reset()
+
+	br.Reset()
+	br.Policies = policies
+	referencePool.Put(br)
+}
@@ -0,0 +1,58 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core
+
+import (
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/model"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseAccessRecord(t *testing.T) {
+	ar := acquireAccessRecord()
+	ar.Operation = "api:documents:read"
+	ar.Principal.Subject = "alice"
+	ar.Metadata.Id = "record-1"
+	ar.Duration.Phases[1] = 42
+	ar.Decision = events.AccessRecord_GRANT
+
+	policy := &model.Policy{Mrn: "mrn:iam:policy:allow"}
+	owned := buildBundleReference(common.NewError(events.AccessRecord_BundleReference_EVALUATION_ERROR, "failed"), policy, events.AccessRecord_BundleReference_SYSTEM, "api:documents:read", events.AccessRecord_GRANT, 7)
+	assert.Equal(t, events.AccessRecord_DENY, owned.Decision)
+	assert.Equal(t, "mrn:iam:policy:allow", owned.Policies[0].Mrn)
+	external := &events.AccessRecord_BundleReference{Id: "external", Phase: events.AccessRecord_BundleReference_EXTERNAL}
+	ar.References = append(ar.References, owned, external)
+
+	releaseAccessRecord(ar, 1)
+
+	// a released record is empty, but keeps its messages
+	require.NotNil(t, ar.Principal)
+	require.NotNil(t, ar.Metadata)
+	require.NotNil(t, ar.Duration)
+	assert.Empty(t, ar.Operation)
+	assert.Empty(t, ar.Principal.Subject)
+	assert.Empty(t, ar.Metadata.Id)
+	assert.Empty(t, ar.Duration.Phases)
+	assert.NotNil(t, ar.Duration.Phases)
+	assert.Empty(t, ar.References)
+	assert.Equal(t, events.AccessRecord_UNSPECIFIED, ar.Decision)
+
+	// as are the references it owned, and only those
+	assert.Empty(t, owned.Id)
+	assert.Equal(t, events.AccessRecord_UNSPECIFIED, owned.Decision)
+	require.Len(t, owned.Policies, 1)
+	assert.Empty(t, owned.Policies[0].Mrn)
+	assert.Equal(t, "external", external.Id)
+
+	// a reference built without a policy has an empty policy reference
+	br := buildBundleReference(nil, nil, events.AccessRecord_BundleReference_RESOURCE, "mrn:app:document:1", events.AccessRecord_GRANT, 0)
+	assert.Equal(t, events.AccessRecord_GRANT, br.Decision)
+	require.Len(t, br.Policies, 1)
+	assert.Empty(t, br.Policies[0].Mrn)
+}
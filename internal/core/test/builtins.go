@@ -0,0 +1,43 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package test
+
+import (
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	backendtesting "github.com/manetu/policyengine/pkg/core/backend/testing"
+	"github.com/manetu/policyengine/pkg/core/options"
+)
+
+// BuiltinRole is the role held by the principals of BuiltinPORC, whose policy grants
+const BuiltinRole = "mrn:iam:role:user"
+
+// NewBuiltinPolicyEngine - instantiates a PE whose decisions are made by rego alone, as the
+// policy of the default resource group, for unit-testing the built-ins that rego calls. Every
+// operation defers to the other phases and BuiltinRole grants. Access records are discarded
+// unless opts, applied after the built-ins, configure an access log.
+func NewBuiltinPolicyEngine(rego string, opts ...options.EngineOptionsFunc) (core.PolicyEngine, error) {
+	b := backendtesting.New().
+		WithPolicyRego("mrn:iam:policy:operate", backendtesting.DeferRego).
+		WithPolicyRego("mrn:iam:policy:allow", backendtesting.AllowAllRego).
+		WithPolicyRego("mrn:iam:policy:resource", rego).
+		WithOperation(".*", "mrn:iam:policy:operate").
+		WithRole(BuiltinRole, "mrn:iam:policy:allow").
+		WithResourceGroup("mrn:iam:resource-group:default", "mrn:iam:policy:resource", backendtesting.Default())
+
+	return core.NewPolicyEngine(append([]options.EngineOptionsFunc{
+		options.WithBackend(b),
+		options.WithAccessLog(accesslog.NewNullFactory()),
+	}, opts...)...)
+}
+
+// BuiltinPORC returns a PORC of sub, holding BuiltinRole, reading resource
+func BuiltinPORC(sub, resource string) map[string]interface{} {
+	return map[string]interface{}{
+		"principal": map[string]interface{}{"sub": sub, "mroles": []string{BuiltinRole}},
+		"operation": "api:docs:read",
+		"resource":  resource,
+	}
+}
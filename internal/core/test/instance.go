@@ -48,15 +48,16 @@ func SetupTestConfig() error {
 }
 
 // NewTestPolicyEngine - instantiates a PE suitable for unit-testing.
-// It uses the test configuration from the testdata directory.
-func NewTestPolicyEngine(depth int) (core.PolicyEngine, chan *events.AccessRecord, error) {
+// It uses the test configuration from the testdata directory, and any additional options are
+// applied after the channel access log.
+func NewTestPolicyEngine(depth int, opts ...options.EngineOptionsFunc) (core.PolicyEngine, chan *events.AccessRecord, error) {
 	if err := SetupTestConfig(); err != nil {
 		return nil, nil, err
 	}
 
 	ch := make(chan *events.AccessRecord, depth)
 	engine, err := core.NewPolicyEngine(
-		options.WithAccessLog(accesslog.NewChannelLogger(ch)),
+		append([]options.EngineOptionsFunc{options.WithAccessLog(accesslog.NewChannelLogger(ch))}, opts...)...,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -5,13 +5,31 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
+	"github.com/manetu/policyengine/pkg/core/calendar"
 	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/geo"
 	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/override"
+	"github.com/manetu/policyengine/pkg/core/revocation"
+	"github.com/manetu/policyengine/pkg/core/risk"
+	"github.com/manetu/policyengine/pkg/core/types"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // safeNanos converts a time.Duration to uint64 nanoseconds safely,
@@ -20,6 +38,88 @@ func safeNanos(d time.Duration) uint64 {
 	return uint64(max(0, d.Nanoseconds())) // #nosec G115 -- guarded by max(0, ...)
 }
 
+// engineVersion is the module version of the policy engine, which is "(devel)" when
+// it is built from a working copy without version control information
+var engineVersion = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+})
+
+const modulePath = "github.com/manetu/policyengine"
+
+// getDeclaredPurposes returns the purposes a request declares in context.purpose, a string or
+// a list of strings
+func getDeclaredPurposes(input types.PORC) []string {
+	c, _ := input[porcContext].(map[string]interface{})
+	if p, ok := c[purpose].(string); ok {
+		if p == "" {
+			return nil
+		}
+		return []string{p}
+	}
+	return stringList(c[purpose])
+}
+
+// getApprovalToken returns the ID of the approval request the input presents as context.approval
+func getApprovalToken(input types.PORC) string {
+	c, _ := input[porcContext].(map[string]interface{})
+	token, _ := c[approvalToken].(string)
+	return token
+}
+
+// overrideRecord records the override that decided a request in the access record
+func overrideRecord(o *override.Override) *events.AccessRecord_Override {
+	return &events.AccessRecord_Override{
+		Id:            o.ID,
+		Justification: o.Justification,
+		CreatedBy:     o.CreatedBy,
+		Expires:       timestamppb.New(o.Expires),
+	}
+}
+
+// approvalRecord records an approval request in the access record
+func approvalRecord(r approval.Request) *events.AccessRecord_Approval {
+	return &events.AccessRecord_Approval{
+		RequestId: r.ID,
+		Required:  uint32(r.Required), // #nosec G115 -- validated not to be negative
+		Approvers: r.Approvers,
+	}
+}
+
+// purposeDenial describes why the declared purposes of a request do not permit it
+func purposeDenial(declared, allowed []string) string {
+	if len(declared) == 0 {
+		return fmt.Sprintf("no purpose declared, resource allows %s", strings.Join(allowed, ", "))
+	}
+	return fmt.Sprintf("purpose %s not allowed, resource allows %s", strings.Join(declared, ", "), strings.Join(allowed, ", "))
+}
+
+// stringList returns the strings of a JSON array, ignoring any other values
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	var list []string
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
 func getUnsafeBuiltins() map[string]struct{} {
 	builtins := strings.Split(config.VConfig.GetString(config.UnsafeBuiltIns), ",")
 	m := make(map[string]struct{})
@@ -30,21 +130,84 @@ func getUnsafeBuiltins() map[string]struct{} {
 	return m
 }
 
-func buildBundleReference(policyError *common.PolicyError, policy *model.Policy, phase events.AccessRecord_BundleReference_Phase, id string, result events.AccessRecord_Decision, duration uint64) *events.AccessRecord_BundleReference {
-	var policies []*events.AccessRecord_PolicyReference
+func getSamplingOptions() accesslog.SamplingOptions {
+	return accesslog.SamplingOptions{
+		GrantRate:          config.VConfig.GetFloat64(config.AuditSamplingGrant),
+		DenyRate:           config.VConfig.GetFloat64(config.AuditSamplingDeny),
+		AlwaysLogOverrides: config.VConfig.GetBool(config.AuditSamplingOverrides),
+		RateLimit:          config.VConfig.GetInt(config.AuditRateLimit),
+		Burst:              config.VConfig.GetInt(config.AuditRateLimitBurst),
+	}
+}
 
-	event := &events.AccessRecord_PolicyReference{}
-	if policy != nil {
-		event.Mrn = policy.Mrn
-		event.Fingerprint = policy.Fingerprint
+func getSpoolOptions() accesslog.SpoolOptions {
+	opts := accesslog.DefaultSpoolOptions(config.VConfig.GetString(config.AuditSpoolDir))
+	opts.MaxBytes = config.VConfig.GetInt64(config.AuditSpoolMaxBytes)
+	return opts
+}
+
+func getJournalOptions() accesslog.JournalOptions {
+	opts := accesslog.DefaultJournalOptions(config.VConfig.GetString(config.AuditJournalPath))
+	opts.Retention = config.VConfig.GetDuration(config.AuditJournalRetention)
+	return opts
+}
+
+func getRedactionOptions() accesslog.RedactionOptions {
+	opts := accesslog.RedactionOptions{
+		Strip: config.VConfig.GetStringSlice(config.AuditRedactionStrip),
+		Hash:  config.VConfig.GetStringSlice(config.AuditRedactionHash),
+	}
+	if key := config.VConfig.GetString(config.AuditRedactionKey); key != "" {
+		opts.HashKey = []byte(key)
 	}
-	policies = append(policies, event)
+	return opts
+}
 
-	br := &events.AccessRecord_BundleReference{
-		Id:       id,
-		Policies: policies,
-		Phase:    phase,
-		Duration: duration,
+// getOverrides registers the configured overrides in a new store. Entries that have
+// already expired are skipped.
+func getOverrides() (*override.Store, error) {
+	entries, err := config.GetOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s configuration: %w", config.Overrides, err)
+	}
+
+	store := override.NewStore()
+	now := time.Now()
+	for i, entry := range entries {
+		expires, err := time.Parse(time.RFC3339, entry.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: invalid expires '%s': %w", config.Overrides, i, entry.Expires, err)
+		}
+		if !expires.After(now) {
+			logger.Warnf(agent, "getOverrides", "%s[%d]: override for '%s' expired at %s, skipping", config.Overrides, i, entry.Subject, entry.Expires)
+			continue
+		}
+
+		_, err = store.Add(override.Override{
+			ID:            entry.ID,
+			Type:          override.Type(entry.Type),
+			Subject:       entry.Subject,
+			Realm:         entry.Realm,
+			Justification: entry.Justification,
+			CreatedBy:     entry.CreatedBy,
+			Expires:       expires,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", config.Overrides, i, err)
+		}
+	}
+
+	return store, nil
+}
+
+func buildBundleReference(policyError *common.PolicyError, policy *model.Policy, phase events.AccessRecord_BundleReference_Phase, id string, result events.AccessRecord_Decision, duration uint64) *events.AccessRecord_BundleReference {
+	br := acquireBundleReference()
+	br.Id = id
+	br.Phase = phase
+	br.Duration = duration
+	if policy != nil {
+		br.Policies[0].Mrn = policy.Mrn
+		br.Policies[0].Fingerprint = policy.Fingerprint
 	}
 
 	// error trumps everything
@@ -59,6 +222,45 @@ func buildBundleReference(policyError *common.PolicyError, policy *model.Policy,
 	return br
 }
 
+// phaseResults converts the bundle references of an access record into the phase results of the
+// public API
+func phaseResults(refs []*events.AccessRecord_BundleReference) []types.PhaseResult {
+	results := make([]types.PhaseResult, 0, len(refs))
+	for _, br := range refs {
+		r := types.PhaseResult{
+			Phase:      phaseNames[br.Phase],
+			ID:         br.Id,
+			Allow:      br.Decision == events.AccessRecord_GRANT,
+			ReasonCode: types.ReasonCode(br.ReasonCode.String()),
+			Reason:     br.Reason,
+			Duration:   time.Duration(min(br.Duration, math.MaxInt64)), // #nosec G115 -- clamped to MaxInt64
+		}
+		for _, p := range br.Policies {
+			if p.Mrn != "" {
+				r.Policy = p.Mrn
+				break
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+var phaseNames = map[events.AccessRecord_BundleReference_Phase]types.Phase{
+	events.AccessRecord_BundleReference_SYSTEM:   types.PhaseOperation,
+	events.AccessRecord_BundleReference_IDENTITY: types.PhaseIdentity,
+	events.AccessRecord_BundleReference_RESOURCE: types.PhaseResource,
+	events.AccessRecord_BundleReference_SCOPE:    types.PhaseScope,
+	events.AccessRecord_BundleReference_EXTERNAL: types.PhaseExternal,
+}
+
+// internalError converts a value recovered from a panic into an INTERNAL_ERROR, logging the stack
+// trace of the panic. Call it from the deferred function that recovered the value.
+func internalError(recovered interface{}) *common.PolicyError {
+	logger.Errorf(agent, "authorize", "recovered from panic: %v\n%s", recovered, debug.Stack())
+	return common.NewError(events.AccessRecord_BundleReference_INTERNAL_ERROR, fmt.Sprintf("internal error: %v", recovered))
+}
+
 // toStringSlice converts various slice types to []string for PORC array field handling.
 // Supports []any (from json.Unmarshal) and []string (from direct Go construction).
 func toStringSlice(v any) []string {
@@ -80,3 +282,160 @@ func toStringSlice(v any) []string {
 		return []string{}
 	}
 }
+
+// tokenExpiry returns the time given by the principal's exp claim, in seconds since the epoch
+func tokenExpiry(principalMap map[string]interface{}) (time.Time, bool) {
+	var exp float64
+	switch v := principalMap["exp"].(type) {
+	case float64:
+		exp = v
+	case int:
+		exp = float64(v)
+	case int64:
+		exp = float64(v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		exp = f
+	default:
+		return time.Time{}, false
+	}
+
+	sec, frac := math.Modf(exp)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// principalToken identifies the principal's token by its jti and sid claims
+func principalToken(principalMap map[string]interface{}) revocation.Token {
+	t := revocation.Token{}
+	t.ID, _ = principalMap["jti"].(string)
+	t.Session, _ = principalMap["sid"].(string)
+	t.Subject, _ = principalMap[Sub].(string)
+	return t
+}
+
+// requestNetwork returns the network origin of a request, from the client address and location
+// the input gives as context.ip and context.geo. Unparsable values are ignored.
+func (pe *PolicyEngine) requestNetwork(input types.PORC) *opa.Network {
+	c, _ := input[porcContext].(map[string]interface{})
+
+	var client netip.Addr
+	if ip, ok := c[clientIP].(string); ok {
+		client, _ = netip.ParseAddr(ip)
+	}
+	var location *geo.Location
+	if l, ok := geo.ParseLocation(c[clientGeo]); ok {
+		location = &l
+	}
+	return opa.NewNetwork(client, location, pe.locator)
+}
+
+// admitNetwork checks the network rule of the scope or resource group mrn against the network origin
+// of the request, returning why the request is not admitted, empty if it is
+func admitNetwork(ctx context.Context, mrn string, rule *model.NetworkRule) (string, *common.PolicyError) {
+	ok, why, err := rule.Admits(opa.NetworkFrom(ctx))
+	switch {
+	case err != nil:
+		return "", &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_NETWORK_ERROR, Reason: fmt.Sprintf("network rule %s: %s", mrn, err)}
+	case !ok:
+		return fmt.Sprintf("network rule %s: %s", mrn, why), nil
+	}
+	return "", nil
+}
+
+// getCalendars builds the business calendars of realms from the calendars configuration, nil if
+// there are none
+func getCalendars() (*calendar.Calendars, error) {
+	entries, err := config.GetCalendars()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s configuration: %w", config.Calendars, err)
+	}
+
+	calendars := &calendar.Calendars{Realms: make(map[string]*calendar.Calendar)}
+	for i, entry := range entries {
+		cal, err := calendar.New(calendar.Options{
+			Timezone: entry.Timezone,
+			Hours:    entry.Hours,
+			Days:     entry.Days,
+			Holidays: entry.Holidays,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s configuration, entry %d: %w", config.Calendars, i, err)
+		}
+
+		switch _, dup := calendars.Realms[entry.Realm]; {
+		case entry.Realm == "" && calendars.Default != nil:
+			return nil, fmt.Errorf("invalid %s configuration, entry %d: more than one default calendar", config.Calendars, i)
+		case entry.Realm == "":
+			calendars.Default = cal
+		case dup:
+			return nil, fmt.Errorf("invalid %s configuration, entry %d: duplicate realm '%s'", config.Calendars, i, entry.Realm)
+		default:
+			calendars.Realms[entry.Realm] = cal
+		}
+	}
+
+	if calendars.IsEmpty() {
+		return nil, nil
+	}
+	return calendars, nil
+}
+
+// assessRisk asks the risk provider to score the request, giving policies the score, or the default
+// if the provider failed, as context.risk
+func (pe *PolicyEngine) assessRisk(ctx context.Context, input types.PORC) *events.AccessRecord_Risk {
+	a := risk.Assess(ctx, pe.risk, input, pe.riskTimeout, pe.riskDefault)
+	if a.Err != nil {
+		logger.WithContext(ctx).Warnf(agent, "authorize", "risk provider '%s' failed, using default score %g: %+v", a.Provider, a.Score, a.Err)
+	}
+
+	// the request's own context is copied, rather than modified, as it may belong to the caller. A
+	// context that is not an object is left for the operation's schema, if any, to reject.
+	c, ok := input[porcContext].(map[string]interface{})
+	switch {
+	case ok:
+		c = maps.Clone(c)
+	case input[porcContext] == nil:
+		c = make(map[string]interface{})
+	}
+	if c != nil {
+		c[risk.ContextKey] = a.Score
+		input[porcContext] = c
+	}
+
+	r := &events.AccessRecord_Risk{Score: a.Score, Provider: a.Provider, Defaulted: a.Defaulted}
+	if a.Err != nil {
+		r.Error = a.Err.Error()
+	}
+	return r
+}
+
+// validateContext checks the context of the request against the schema of its operation, if any. The
+// risk score the engine adds to the context is not part of the request, so it is not checked.
+func (pe *PolicyEngine) validateContext(ctx context.Context, operation *model.PolicyReference, input types.PORC) *common.PolicyError {
+	if operation.ContextSchema == nil {
+		return nil
+	}
+
+	c, ok := input[porcContext].(map[string]interface{})
+	switch {
+	case input[porcContext] == nil:
+		c = map[string]interface{}{}
+	case !ok:
+		return &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_INVALPARAM_ERROR, Reason: fmt.Sprintf("context of operation %s: must be an object", operation.Mrn)}
+	case pe.risk != nil:
+		c = maps.Clone(c)
+		delete(c, risk.ContextKey)
+	}
+
+	violations, err := operation.ContextSchema.Validate(ctx, c)
+	switch {
+	case err != nil:
+		return &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("context of operation %s: %s", operation.Mrn, err)}
+	case len(violations) > 0:
+		return &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_INVALPARAM_ERROR, Reason: fmt.Sprintf("context of operation %s: %s", operation.Mrn, strings.Join(violations, "; "))}
+	}
+	return nil
+}
@@ -7,7 +7,9 @@ package core
 import (
 	"testing"
 
+	"github.com/manetu/policyengine/pkg/core/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestToStringSlice(t *testing.T) {
@@ -75,3 +77,39 @@ func TestToStringSlice(t *testing.T) {
 		})
 	}
 }
+
+func TestGetCalendars(t *testing.T) {
+	config.ResetConfig()
+	defer config.VConfig.Set(config.Calendars, nil)
+
+	config.VConfig.Set(config.Calendars, nil)
+	calendars, err := getCalendars()
+	require.NoError(t, err)
+	assert.Nil(t, calendars)
+
+	config.VConfig.Set(config.Calendars, []map[string]interface{}{
+		{"timezone": "America/New_York"},
+		{"realm": "emea", "timezone": "Europe/London"},
+	})
+	calendars, err = getCalendars()
+	require.NoError(t, err)
+	assert.Equal(t, "America/New_York", calendars.For("apac").Location().String())
+	assert.Equal(t, "Europe/London", calendars.For("emea").Location().String())
+
+	for _, tt := range []struct {
+		name    string
+		entries []map[string]interface{}
+		err     string
+	}{
+		{"invalid entry", []map[string]interface{}{{"timezone": "UTC"}, {"realm": "emea", "hours": "9-5"}}, "invalid calendars configuration, entry 1: invalid hours '9-5'"},
+		{"two defaults", []map[string]interface{}{{"timezone": "UTC"}, {"timezone": "Europe/Paris"}}, "entry 1: more than one default calendar"},
+		{"duplicate realm", []map[string]interface{}{{"realm": "emea"}, {"realm": "emea"}}, "entry 1: duplicate realm 'emea'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config.VConfig.Set(config.Calendars, tt.entries)
+			_, err := getCalendars()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package httpjson holds the plumbing shared by the clients of external services, such as
+// the consent, relationship and revocation services, that exchange JSON over HTTP.
+package httpjson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseURL validates the URL of a service, returning it in its normalized form.
+//
+// Returns an error if the URL is not an absolute http or https URL.
+func ParseURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL '%s', expected an absolute http or https URL", raw)
+	}
+	return u.String(), nil
+}
+
+// BaseURL validates the base URL of a service, returning it without a trailing slash so
+// that paths may be appended.
+func BaseURL(raw string) (string, error) {
+	u, err := ParseURL(raw)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(u, "/"), nil
+}
+
+// Post sends request as JSON to endpoint, with token as a bearer token if set, and decodes
+// the JSON response into response. The response body is read up to limit bytes.
+//
+// Returns an error if the request fails, the status is not 2xx, or the response exceeds
+// limit or is not valid JSON.
+func Post(ctx context.Context, client *http.Client, endpoint, token string, request, response interface{}, limit int) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	Authorize(req, token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := ReadResponse(resp, limit)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, response)
+}
+
+// Authorize sets token as the bearer token of req, unless it is empty.
+func Authorize(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// ReadResponse reads the body of resp up to limit bytes, leaving it to the caller to close.
+//
+// Returns an error if the body exceeds limit or the status is not 2xx, quoting the body
+// of the response in the latter case.
+func ReadResponse(resp *http.Response, limit int) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > limit {
+		return nil, fmt.Errorf("response exceeds %d bytes", limit)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+	return raw, nil
+}
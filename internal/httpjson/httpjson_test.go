@@ -0,0 +1,83 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package httpjson
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURL(t *testing.T) {
+	u, err := ParseURL("https://consent:8443/v1/check")
+	require.NoError(t, err)
+	assert.Equal(t, "https://consent:8443/v1/check", u)
+
+	u, err = BaseURL("http://openfga:8080/")
+	require.NoError(t, err)
+	assert.Equal(t, "http://openfga:8080", u)
+
+	for _, raw := range []string{"", "openfga:8080", "ftp://openfga", "http://", "://x"} {
+		_, err := BaseURL(raw)
+		require.Error(t, err, raw)
+		assert.Contains(t, err.Error(), "expected an absolute http or https URL")
+	}
+}
+
+func TestPost(t *testing.T) {
+	var auth string
+	var request map[string]interface{}
+	status, response := http.StatusOK, `{"allowed": true}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	var result struct {
+		Allowed bool `json:"allowed"`
+	}
+	require.NoError(t, Post(ctx, nil, srv.URL, "secret", map[string]string{"user": "alice"}, &result, 64))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, "Bearer secret", auth)
+	assert.Equal(t, map[string]interface{}{"user": "alice"}, request)
+
+	require.NoError(t, Post(ctx, srv.Client(), srv.URL, "", nil, &result, 64))
+	assert.Empty(t, auth)
+
+	for _, tc := range []struct {
+		name     string
+		status   int
+		response string
+		limit    int
+		err      string
+	}{
+		{"status", http.StatusForbidden, "denied\n", 64, "status 403: denied"},
+		{"oversized", http.StatusOK, `{"allowed": true, "pad": "` + strings.Repeat("x", 64) + `"}`, 64, "response exceeds 64 bytes"},
+		{"limit", http.StatusOK, `{"allowed": true, "pad": "` + strings.Repeat("x", 64) + `"}`, 1 << 10, ""},
+		{"malformed", http.StatusOK, `{"allowed":`, 64, "unexpected end of JSON input"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, response = tc.status, tc.response
+			err := Post(ctx, nil, srv.URL, "", nil, &result, tc.limit)
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"context"
+)
+
+// Keys of the fields that correlate the messages logged while serving a request.
+const (
+	// RecordID is the ID of the access record of a decision.
+	RecordID = "record_id"
+	// CorrelationID is the caller's ID for the request, also carried by its access record.
+	CorrelationID = "correlation_id"
+)
+
+type fieldsKey struct{}
+
+// NewContext returns a copy of ctx carrying the given key-value pairs, in addition to
+// those ctx already carries. Loggers obtained with [Logger.WithContext] add them to
+// each message, so that the messages of concurrent requests can be told apart. Pairs
+// with an empty value are ignored.
+func NewContext(ctx context.Context, keysAndValues ...string) context.Context {
+	parent := Fields(ctx)
+	fields := make([]interface{}, 0, len(parent)+len(keysAndValues))
+	fields = append(fields, parent...)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i+1] != "" {
+			fields = append(fields, keysAndValues[i], keysAndValues[i+1])
+		}
+	}
+	if len(fields) == len(parent) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// Fields returns the key-value pairs carried by ctx, or nil if there are none.
+func Fields(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsKey{}).([]interface{})
+	return fields
+}
+
+// WithContext returns a logger adding the fields carried by ctx (see [NewContext]) to
+// each message, after those of l. It shares the level and output of l, so it is cheap
+// to obtain for each request. Returns l if ctx carries no fields.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	fields := Fields(ctx)
+	if len(fields) == 0 {
+		return l
+	}
+
+	if len(l.fields) > 0 {
+		fields = append(append(make([]interface{}, 0, len(l.fields)+len(fields)), l.fields...), fields...)
+	}
+
+	root := l.root()
+	return &Logger{module: root.module, parent: root, fields: fields}
+}
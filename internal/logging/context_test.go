@@ -0,0 +1,58 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, Fields(ctx))
+	assert.Equal(t, ctx, NewContext(ctx, CorrelationID, ""), "empty values are ignored")
+
+	ctx = NewContext(ctx, RecordID, "r1")
+	child := NewContext(ctx, CorrelationID, "c1")
+	assert.Equal(t, []interface{}{RecordID, "r1"}, Fields(ctx))
+	assert.Equal(t, []interface{}{RecordID, "r1", CorrelationID, "c1"}, Fields(child))
+}
+
+func TestLogger_WithContext(t *testing.T) {
+	logger := newLogger("testmodule")
+	var buffer bytes.Buffer
+	logger.SetOut(&buffer)
+	logger.SetLevel(slog.LevelInfo)
+
+	assert.Same(t, logger, logger.WithContext(context.Background()))
+
+	ctx := NewContext(context.Background(), RecordID, "r1", CorrelationID, "c1")
+	contextual := logger.WithContext(ctx)
+	assert.Same(t, contextual.root(), logger.WithContext(ctx).root(), "contextual loggers log through the module's logger")
+
+	contextual.Debug("tester", "test", "hidden")
+	assert.Empty(t, buffer.Bytes())
+
+	contextual.Info("tester", "test", "message")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &entry))
+	assert.Equal(t, "message", entry["msg"])
+	assert.Equal(t, "r1", entry[RecordID])
+	assert.Equal(t, "c1", entry[CorrelationID])
+	assert.Equal(t, "testmodule", entry[module])
+
+	// the level of the module applies to its contextual loggers
+	buffer.Reset()
+	logger.SetLevel(slog.LevelDebug)
+	assert.True(t, contextual.IsDebugEnabled())
+	contextual.Debug("tester", "test", "shown")
+	assert.Contains(t, buffer.String(), "shown")
+}
@@ -0,0 +1,95 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// TraceMode controls Rego evaluation tracing at runtime.
+type TraceMode string
+
+const (
+	// TraceDefault leaves tracing as configured when the policies were compiled.
+	TraceDefault TraceMode = "default"
+	// TraceOn traces every evaluation, subject to any configured trace filter.
+	TraceOn TraceMode = "on"
+	// TraceOff disables tracing.
+	TraceOff TraceMode = "off"
+)
+
+var traceMode atomic.Value
+
+// SetTraceMode overrides Rego evaluation tracing for the running process.
+//
+// Returns an error if mode is not one of [TraceDefault], [TraceOn], or [TraceOff].
+func SetTraceMode(mode TraceMode) error {
+	switch mode {
+	case TraceDefault, TraceOn, TraceOff:
+		traceMode.Store(mode)
+		return nil
+	default:
+		return fmt.Errorf("invalid trace mode '%s': must be one of default, on, or off", mode)
+	}
+}
+
+// GetTraceMode returns the current trace mode.
+func GetTraceMode() TraceMode {
+	if mode, ok := traceMode.Load().(TraceMode); ok {
+		return mode
+	}
+	return TraceDefault
+}
+
+// GetLogLevels returns the level of each module that has a logger, along with the
+// default level for other modules under the "." key.
+func GetLogLevels() map[string]string {
+	once.Do(func() {
+		initManager()
+	})
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	levels := map[string]string{".": levelName(manager.defLevel)}
+	for module, logger := range manager.loggers {
+		levels[module] = levelName(logger.Level())
+	}
+	return levels
+}
+
+// ValidateLogLevels checks a string of the form accepted by [UpdateLogLevels], which
+// otherwise ignores malformed entries and unknown levels.
+func ValidateLogLevels(logstr string) error {
+	logstr = stripWhitespace(logstr)
+	if logstr == "" {
+		return fmt.Errorf("no log levels specified")
+	}
+
+	for _, l := range strings.Split(logstr, ";") {
+		if l == "" {
+			continue
+		}
+		parts := strings.Split(l, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid log level entry '%s': must be MODULE:LEVEL", l)
+		}
+		switch strings.ToLower(parts[1]) {
+		case "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace":
+		default:
+			return fmt.Errorf("invalid log level '%s' for module '%s'", parts[1], parts[0])
+		}
+	}
+	return nil
+}
+
+func stripWhitespace(s string) string {
+	for _, ws := range []string{" ", "\t", "\n"} {
+		s = strings.ReplaceAll(s, ws, "")
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLogLevels(t *testing.T) {
+	resetForTesting()
+
+	GetLogger("accesslog")
+	require.NoError(t, UpdateLogLevels(".:warn;backend.local:debug"))
+
+	levels := GetLogLevels()
+	assert.Equal(t, "warn", levels["."])
+	assert.Equal(t, "warn", levels["accesslog"])
+	assert.Equal(t, "debug", levels["backend.local"])
+
+	// modules without an explicit level follow a new default
+	require.NoError(t, UpdateLogLevels(".:error"))
+	levels = GetLogLevels()
+	assert.Equal(t, "error", levels["accesslog"])
+	assert.Equal(t, "error", levels["backend.local"])
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	for _, valid := range []string{".:info", "policyengine:debug; accesslog:trace", " .:WARNING ;"} {
+		assert.NoError(t, ValidateLogLevels(valid), valid)
+	}
+
+	tests := []struct {
+		logstr  string
+		message string
+	}{
+		{"", "no log levels specified"},
+		{"debug", "must be MODULE:LEVEL"},
+		{":debug", "must be MODULE:LEVEL"},
+		{"a:b:c", "must be MODULE:LEVEL"},
+		{"accesslog:verbose", "invalid log level 'verbose' for module 'accesslog'"},
+	}
+	for _, tt := range tests {
+		err := ValidateLogLevels(tt.logstr)
+		require.Error(t, err, tt.logstr)
+		assert.Contains(t, err.Error(), tt.message)
+	}
+}
+
+func TestTraceMode(t *testing.T) {
+	defer func() { _ = SetTraceMode(TraceDefault) }()
+
+	assert.Equal(t, TraceDefault, GetTraceMode())
+	require.NoError(t, SetTraceMode(TraceOn))
+	assert.Equal(t, TraceOn, GetTraceMode())
+	require.NoError(t, SetTraceMode(TraceOff))
+	assert.Equal(t, TraceOff, GetTraceMode())
+
+	err := SetTraceMode("verbose")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid trace mode 'verbose'")
+	assert.Equal(t, TraceOff, GetTraceMode())
+}
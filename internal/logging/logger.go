@@ -5,24 +5,38 @@
 package logging
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"runtime"
 	"sync"
-
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
+	"time"
 )
 
 //lint:file-ignore U1001 Ignore all unused code, it's external
 
-// Logger is a wrapper around zap.Logger
+// Levels beyond those of log/slog. Trace messages are logged at [slog.LevelDebug], so that
+// enabling debug also enables trace, as it always has.
+const (
+	LevelTrace = slog.LevelDebug
+	LevelFatal = slog.Level(12)
+	LevelPanic = slog.Level(16)
+)
+
+// Logger is a structured, leveled logger for a module, writing through a [slog.Handler]
 type Logger struct {
-	mu     sync.RWMutex
-	module string
-	logger *zap.Logger
-	sugar  *zap.SugaredLogger
-	level  zapcore.Level
-	writer io.Writer // For compatibility with tests and viper
+	mu       sync.RWMutex
+	module   string
+	level    slog.LevelVar
+	handler  slog.Handler
+	sampling SamplingOptions
+	writer   io.Writer // For compatibility with tests and viper
+
+	// set on the loggers returned by WithContext, which log through the module's logger
+	parent *Logger
+	fields []interface{}
 }
 
 const (
@@ -31,48 +45,104 @@ const (
 	defActor  = "sys"
 	defAction = "unk"
 	module    = "module"
+	caller    = "caller"
+	timestamp = "ts"
 )
 
 // internal function to create a logger without tracking. Application should
 // call GetLogger() to retrieved a configured logger.
 func newLogger(module string) *Logger {
-	// Configure encoder
-	encoderConfig := zap.NewProductionEncoderConfig()
-	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	encoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
-
-	// Determine formatter from environment
-	var encoder zapcore.Encoder
-	logFormatter := os.Getenv("MPE_LOG_FORMATTER")
-	switch logFormatter {
+	l := &Logger{module: module}
+	l.level.Set(slog.LevelInfo)
+	l.handler = l.newHandler()
+	return l
+}
+
+// newHandler builds the handler writing to the logger's output, in the format selected by
+// MPE_LOG_FORMATTER and sampled as configured. The caller must hold the lock, if the
+// logger is shared.
+func (l *Logger) newHandler() slog.Handler {
+	var output io.Writer = os.Stderr
+	if l.writer != nil {
+		output = l.writer
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       &l.level,
+		AddSource:   os.Getenv("MPE_LOG_REPORT_CALLER") != "",
+		ReplaceAttr: replaceAttr,
+	}
+
+	var handler slog.Handler
+	switch os.Getenv("MPE_LOG_FORMATTER") {
 	case "text":
-		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+		handler = slog.NewTextHandler(output, opts)
 	default:
-		encoder = zapcore.NewJSONEncoder(encoderConfig)
+		handler = slog.NewJSONHandler(output, opts)
 	}
 
-	// Determine if we should report caller
-	reportCaller := os.Getenv("MPE_LOG_REPORT_CALLER") != ""
+	return newSamplingHandler(handler, l.sampling)
+}
 
-	// Create core
-	core := zapcore.NewCore(encoder, zapcore.AddSync(os.Stderr), zapcore.InfoLevel)
+// replaceAttr keeps the field and level names of the log format that preceded slog
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
 
-	// Build logger
-	options := []zap.Option{
-		zap.AddCallerSkip(1), // Skip this wrapper function
+	switch a.Key {
+	case slog.TimeKey:
+		a.Key = timestamp
+	case slog.LevelKey:
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(levelName(level))
+		}
+	case slog.SourceKey:
+		if source, ok := a.Value.Any().(*slog.Source); ok {
+			a = slog.String(caller, fmt.Sprintf("%s:%d", shortPath(source.File), source.Line))
+		}
 	}
-	if reportCaller {
-		options = append(options, zap.AddCaller())
+	return a
+}
+
+// levelName returns the name of a level as accepted by UpdateLogLevels
+func levelName(level slog.Level) string {
+	switch {
+	case level >= LevelPanic:
+		return "panic"
+	case level >= LevelFatal:
+		return "fatal"
+	case level >= slog.LevelError:
+		return "error"
+	case level >= slog.LevelWarn:
+		return "warn"
+	case level >= slog.LevelInfo:
+		return "info"
+	default:
+		return "debug"
 	}
+}
 
-	logger := zap.New(core, options...)
+// shortPath trims a source file to its directory and name
+func shortPath(file string) string {
+	slashes := 0
+	for i := len(file) - 1; i >= 0; i-- {
+		if file[i] == '/' {
+			slashes++
+			if slashes == 2 {
+				return file[i+1:]
+			}
+		}
+	}
+	return file
+}
 
-	return &Logger{
-		module: module,
-		logger: logger,
-		sugar:  logger.Sugar(),
-		level:  zapcore.InfoLevel,
+// root returns the module's logger, which holds the level and output of a contextual logger
+func (l *Logger) root() *Logger {
+	if l.parent != nil {
+		return l.parent
 	}
+	return l
 }
 
 // IsDebugEnabled returns true if the current logging level is debug or higher.
@@ -85,68 +155,32 @@ func newLogger(module string) *Logger {
 //	         logger.Debugf()
 //	     }
 func (l *Logger) IsDebugEnabled() bool {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.level <= zapcore.DebugLevel
+	return l.IsLevelEnabled(slog.LevelDebug)
 }
 
 // IsTraceEnabled ...
 func (l *Logger) IsTraceEnabled() bool {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.level <= zapcore.DebugLevel // zap doesn't have trace, use debug
+	return l.IsLevelEnabled(LevelTrace)
 }
 
 // SetLevel sets the logging level
-func (l *Logger) SetLevel(level zapcore.Level) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	l.level = level
-	// Recreate the logger with the new level
-	encoderConfig := zap.NewProductionEncoderConfig()
-	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	encoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
-
-	var encoder zapcore.Encoder
-	logFormatter := os.Getenv("MPE_LOG_FORMATTER")
-	switch logFormatter {
-	case "text":
-		encoder = zapcore.NewConsoleEncoder(encoderConfig)
-	default:
-		encoder = zapcore.NewJSONEncoder(encoderConfig)
-	}
-
-	reportCaller := os.Getenv("MPE_LOG_REPORT_CALLER") != ""
-
-	// Use custom writer if set, otherwise use stderr
-	var output io.Writer = os.Stderr
-	if l.writer != nil {
-		output = l.writer
-	}
-
-	core := zapcore.NewCore(encoder, zapcore.AddSync(output), level)
-
-	options := []zap.Option{
-		zap.AddCallerSkip(1),
-	}
-	if reportCaller {
-		options = append(options, zap.AddCaller())
-	}
+func (l *Logger) SetLevel(level slog.Level) {
+	l.root().level.Set(level)
+}
 
-	l.logger = zap.New(core, options...)
-	l.sugar = l.logger.Sugar()
+// Level returns the logging level
+func (l *Logger) Level() slog.Level {
+	return l.root().level.Level()
 }
 
 // IsLevelEnabled checks if a level is enabled
-func (l *Logger) IsLevelEnabled(level zapcore.Level) bool {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.level <= level
+func (l *Logger) IsLevelEnabled(level slog.Level) bool {
+	return level >= l.root().level.Level()
 }
 
 // Out is for compatibility with tests and viper - returns the output writer
 func (l *Logger) Out() io.Writer {
+	l = l.root()
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	if l.writer != nil {
@@ -157,239 +191,219 @@ func (l *Logger) Out() io.Writer {
 
 // SetOut sets the output writer (for tests)
 func (l *Logger) SetOut(w io.Writer) {
+	l = l.root()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	l.writer = w
-	// Recreate logger with custom writer
-	encoderConfig := zap.NewProductionEncoderConfig()
-	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	encoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
-
-	var encoder zapcore.Encoder
-	logFormatter := os.Getenv("MPE_LOG_FORMATTER")
-	switch logFormatter {
-	case "text":
-		encoder = zapcore.NewConsoleEncoder(encoderConfig)
-	default:
-		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	l.handler = l.newHandler()
+}
+
+// setSampling samples the logger's messages as configured
+func (l *Logger) setSampling(opts SamplingOptions) {
+	l = l.root()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sampling = opts
+	l.handler = l.newHandler()
+}
+
+// getHandler returns the handler with proper read locking
+func (l *Logger) getHandler() slog.Handler {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.handler
+}
+
+// Handler returns a [slog.Handler] writing through the logger, such as to create a
+// [slog.Logger] for a library that logs with log/slog. Its records carry the module and
+// the fields of the logger, and are filtered by the module's level. The handler writes to
+// the output the logger had when Handler was called.
+func (l *Logger) Handler() slog.Handler {
+	attrs := []slog.Attr{slog.String(module, l.root().module)}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		attrs = append(attrs, slog.Any(fmt.Sprint(l.fields[i]), l.fields[i+1]))
 	}
+	return l.root().getHandler().WithAttrs(attrs)
+}
 
-	reportCaller := os.Getenv("MPE_LOG_REPORT_CALLER") != ""
-	core := zapcore.NewCore(encoder, zapcore.AddSync(w), l.level)
+// Slog returns a [slog.Logger] writing through the logger (see [Logger.Handler])
+func (l *Logger) Slog() *slog.Logger {
+	return slog.New(l.Handler())
+}
 
-	options := []zap.Option{
-		zap.AddCallerSkip(1),
+// log writes a message at level, if enabled. The message is only formatted once the level
+// is known to be enabled. skip is the number of frames between the caller of the logging
+// method and log, so that the caller is reported.
+func (l *Logger) log(skip int, level slog.Level, actorID, actionID string, format *string, args []interface{}) {
+	root := l.root()
+	if !root.IsLevelEnabled(level) {
+		return
 	}
-	if reportCaller {
-		options = append(options, zap.AddCaller())
+
+	var msg string
+	if format != nil {
+		msg = fmt.Sprintf(*format, args...)
+	} else {
+		msg = fmt.Sprint(args...)
 	}
 
-	l.logger = zap.New(core, options...)
-	l.sugar = l.logger.Sugar()
-}
+	var pcs [1]uintptr
+	runtime.Callers(skip+2, pcs[:]) // skip runtime.Callers and log
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.AddAttrs(slog.String(actor, actorID), slog.String(action, actionID), slog.String(module, root.module))
+	if len(l.fields) > 0 {
+		r.Add(l.fields...)
+	}
+	_ = root.getHandler().Handle(context.Background(), r)
 
-// getSugar returns the sugared logger with proper read locking
-func (l *Logger) getSugar() *zap.SugaredLogger {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.sugar
+	switch {
+	case level >= LevelPanic:
+		panic(msg)
+	case level >= LevelFatal:
+		os.Exit(1)
+	}
 }
 
 // Fatal logs fatal message
 func (l *Logger) Fatal(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Fatal(args...)
+	l.log(1, LevelFatal, actorID, actionID, nil, args)
 }
 
 // Fatalf logs fatal message
 func (l *Logger) Fatalf(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Fatalf(format, args...)
+	l.log(1, LevelFatal, actorID, actionID, &format, args)
 }
 
 // Panic logs panic message
 func (l *Logger) Panic(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Panic(args...)
+	l.log(1, LevelPanic, actorID, actionID, nil, args)
 }
 
 // Panicf logs panic message
 func (l *Logger) Panicf(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Panicf(format, args...)
+	l.log(1, LevelPanic, actorID, actionID, &format, args)
 }
 
 // Trace log trace message
 func (l *Logger) Trace(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Debug(args...)
+	l.log(1, LevelTrace, actorID, actionID, nil, args)
 }
 
 // Tracef log trace message
 func (l *Logger) Tracef(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Debugf(format, args...)
+	l.log(1, LevelTrace, actorID, actionID, &format, args)
 }
 
 // Debug log debug message
 func (l *Logger) Debug(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Debug(args...)
+	l.log(1, slog.LevelDebug, actorID, actionID, nil, args)
 }
 
 // Debugf log debug message
 func (l *Logger) Debugf(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Debugf(format, args...)
+	l.log(1, slog.LevelDebug, actorID, actionID, &format, args)
 }
 
 // Info logs info message
 func (l *Logger) Info(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Info(args...)
+	l.log(1, slog.LevelInfo, actorID, actionID, nil, args)
 }
 
 // Infof logs info message
 func (l *Logger) Infof(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Infof(format, args...)
+	l.log(1, slog.LevelInfo, actorID, actionID, &format, args)
 }
 
 // Warn logs warning message
 func (l *Logger) Warn(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Warn(args...)
+	l.log(1, slog.LevelWarn, actorID, actionID, nil, args)
 }
 
 // Warnf logs warning message
 func (l *Logger) Warnf(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Warnf(format, args...)
+	l.log(1, slog.LevelWarn, actorID, actionID, &format, args)
 }
 
 // Error logs error message
 func (l *Logger) Error(actorID, actionID string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Error(args...)
+	l.log(1, slog.LevelError, actorID, actionID, nil, args)
 }
 
 // Errorf logs error message
 func (l *Logger) Errorf(actorID, actionID string, format string, args ...interface{}) {
-	l.getSugar().With(
-		zap.String(actor, actorID),
-		zap.String(action, actionID),
-		zap.String(module, l.module),
-	).Errorf(format, args...)
+	l.log(1, slog.LevelError, actorID, actionID, &format, args)
 }
 
 // Below are functions using default actor and action
 
 // SysFatal logs fatal message with default actor and action
 func (l *Logger) SysFatal(args ...interface{}) {
-	l.Fatal(defActor, defAction, args...)
+	l.log(1, LevelFatal, defActor, defAction, nil, args)
 }
 
 // SysFatalf logs fatal message with default actor and action
 func (l *Logger) SysFatalf(format string, args ...interface{}) {
-	l.Fatalf(defActor, defAction, format, args...)
+	l.log(1, LevelFatal, defActor, defAction, &format, args)
 }
 
 // SysPanic logs panic message with default actor and action
 func (l *Logger) SysPanic(args ...interface{}) {
-	l.Panic(defActor, defAction, args...)
+	l.log(1, LevelPanic, defActor, defAction, nil, args)
 }
 
 // SysPanicf logs panic message with default actor and action
 func (l *Logger) SysPanicf(format string, args ...interface{}) {
-	l.Panicf(defActor, defAction, format, args...)
+	l.log(1, LevelPanic, defActor, defAction, &format, args)
 }
 
 // SysTrace logs trace message with default actor and action
 func (l *Logger) SysTrace(args ...interface{}) {
-	l.Trace(defActor, defAction, args...)
+	l.log(1, LevelTrace, defActor, defAction, nil, args)
 }
 
 // SysTracef logs trace message with default actor and action
 func (l *Logger) SysTracef(format string, args ...interface{}) {
-	l.Tracef(defActor, defAction, format, args...)
+	l.log(1, LevelTrace, defActor, defAction, &format, args)
 }
 
 // SysDebug logs debug message with default actor and action
 func (l *Logger) SysDebug(args ...interface{}) {
-	l.Debug(defActor, defAction, args...)
+	l.log(1, slog.LevelDebug, defActor, defAction, nil, args)
 }
 
 // SysDebugf logs debug message with default actor and action
 func (l *Logger) SysDebugf(format string, args ...interface{}) {
-	l.Debugf(defActor, defAction, format, args...)
+	l.log(1, slog.LevelDebug, defActor, defAction, &format, args)
 }
 
 // SysInfo logs info message with default actor and action
 func (l *Logger) SysInfo(args ...interface{}) {
-	l.Info(defActor, defAction, args...)
+	l.log(1, slog.LevelInfo, defActor, defAction, nil, args)
 }
 
 // SysInfof logs info message with default actor and action
 func (l *Logger) SysInfof(format string, args ...interface{}) {
-	l.Infof(defActor, defAction, format, args...)
+	l.log(1, slog.LevelInfo, defActor, defAction, &format, args)
 }
 
 // SysWarn logs warning message with default actor and action
 func (l *Logger) SysWarn(args ...interface{}) {
-	l.Warn(defActor, defAction, args...)
+	l.log(1, slog.LevelWarn, defActor, defAction, nil, args)
 }
 
 // SysWarnf logs warning message with default actor and action
 func (l *Logger) SysWarnf(format string, args ...interface{}) {
-	l.Warnf(defActor, defAction, format, args...)
+	l.log(1, slog.LevelWarn, defActor, defAction, &format, args)
 }
 
 // SysError logs error message with default actor and action
 func (l *Logger) SysError(args ...interface{}) {
-	l.Error(defActor, defAction, args...)
+	l.log(1, slog.LevelError, defActor, defAction, nil, args)
 }
 
 // SysErrorf logs error message with default actor and action
 func (l *Logger) SysErrorf(format string, args ...interface{}) {
-	l.Errorf(defActor, defAction, format, args...)
+	l.log(1, slog.LevelError, defActor, defAction, &format, args)
 }
@@ -6,10 +6,12 @@ package logging
 
 import (
 	"bytes"
+	"encoding/json"
+	"log/slog"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"go.uber.org/zap/zapcore"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLogging(t *testing.T) {
@@ -17,12 +19,12 @@ func TestLogging(t *testing.T) {
 	logger := newLogger("testmodule")
 	var buffer bytes.Buffer
 	logger.SetOut(&buffer)
-	logger.SetLevel(zapcore.InfoLevel)
+	logger.SetLevel(slog.LevelInfo)
 
 	// As default, the logging level must be at info
-	assert.Equal(t, logger.IsLevelEnabled(zapcore.InfoLevel), true)
+	assert.Equal(t, logger.IsLevelEnabled(slog.LevelInfo), true)
 	// Debug should be off
-	assert.Equal(t, logger.IsLevelEnabled(zapcore.DebugLevel), false)
+	assert.Equal(t, logger.IsLevelEnabled(slog.LevelDebug), false)
 
 	// Note: We'll handle panic separately below
 
@@ -81,8 +83,8 @@ func TestSysLogging(t *testing.T) {
 	logger.SetOut(&buffer)
 
 	// Change logging level to error and test
-	logger.SetLevel(zapcore.ErrorLevel)
-	assert.Equal(t, logger.IsLevelEnabled(zapcore.ErrorLevel), true)
+	logger.SetLevel(slog.LevelError)
+	assert.Equal(t, logger.IsLevelEnabled(slog.LevelError), true)
 
 	// trap panic log
 	defer func() {
@@ -95,9 +97,9 @@ func TestSysLogging(t *testing.T) {
 	}()
 
 	// debug, info, and warning levels should be off
-	assert.Equal(t, logger.IsLevelEnabled(zapcore.DebugLevel), false)
-	assert.Equal(t, logger.IsLevelEnabled(zapcore.InfoLevel), false)
-	assert.Equal(t, logger.IsLevelEnabled(zapcore.WarnLevel), false)
+	assert.Equal(t, logger.IsLevelEnabled(slog.LevelDebug), false)
+	assert.Equal(t, logger.IsLevelEnabled(slog.LevelInfo), false)
+	assert.Equal(t, logger.IsLevelEnabled(slog.LevelWarn), false)
 
 	logger.SysDebug("debug message")
 	logger.SysDebugf("debug message %s", "hello")
@@ -131,3 +133,52 @@ func TestSysLogging(t *testing.T) {
 	}()
 	logger.SysPanic("panic message")
 }
+
+func TestLogger_Format(t *testing.T) {
+	t.Setenv("MPE_LOG_REPORT_CALLER", "1")
+	logger := newLogger("testmodule")
+	var buffer bytes.Buffer
+	logger.SetOut(&buffer)
+
+	logger.Warnf("tester", "123abc", "warning %d", 1)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &entry))
+	assert.Equal(t, "warn", entry["level"])
+	assert.Equal(t, "warning 1", entry["msg"])
+	assert.Equal(t, "tester", entry[actor])
+	assert.Equal(t, "123abc", entry[action])
+	assert.Equal(t, "testmodule", entry[module])
+	assert.NotEmpty(t, entry[timestamp])
+	assert.Regexp(t, `^logging/logger_test\.go:\d+$`, entry[caller], "the caller of the logging method is reported")
+
+	buffer.Reset()
+	logger.SysError("failed")
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &entry))
+	assert.Regexp(t, `^logging/logger_test\.go:\d+$`, entry[caller])
+
+	t.Setenv("MPE_LOG_FORMATTER", "text")
+	logger.SetOut(&buffer)
+	buffer.Reset()
+	logger.Info("tester", "123abc", "info message")
+	assert.Contains(t, buffer.String(), `msg="info message" actor=tester action=123abc module=testmodule`)
+}
+
+func TestLogger_Slog(t *testing.T) {
+	logger := newLogger("testmodule")
+	var buffer bytes.Buffer
+	logger.SetOut(&buffer)
+
+	slogger := logger.Slog().With("plugin", "bundle")
+	slogger.Debug("hidden")
+	assert.Empty(t, buffer.Bytes(), "the module's level applies")
+
+	logger.SetLevel(slog.LevelDebug)
+	slogger.Debug("shown", "attempt", 2)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &entry))
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, "shown", entry["msg"])
+	assert.Equal(t, "testmodule", entry[module])
+	assert.Equal(t, "bundle", entry["plugin"])
+	assert.Equal(t, float64(2), entry["attempt"])
+}
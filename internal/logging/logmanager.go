@@ -7,16 +7,16 @@ package logging
 //lint:file-ignore U1001 Ignore all unused code, it's external
 
 import (
+	"log/slog"
 	"strings"
 	"sync"
-
-	"go.uber.org/zap/zapcore"
 )
 
 // LogManager keeps track of all instantiated loggers
 type LogManager struct {
 	loggers  map[string]*Logger
-	defLevel zapcore.Level
+	defLevel slog.Level
+	sampling SamplingOptions
 }
 
 // Manager's singleton variables
@@ -59,6 +59,7 @@ func GetLogger(module string) *Logger {
 	// Create new logger with default level
 	aLogger = newLogger(module)
 	aLogger.SetLevel(manager.defLevel)
+	aLogger.setSampling(manager.sampling)
 	manager.loggers[module] = aLogger
 
 	return aLogger
@@ -67,27 +68,30 @@ func GetLogger(module string) *Logger {
 func initManager() {
 	manager = &LogManager{
 		loggers:  make(map[string]*Logger),
-		defLevel: zapcore.InfoLevel,
+		defLevel: slog.LevelInfo,
+		sampling: samplingFromEnv(),
 	}
 }
 
-// parseLevel converts a string level to zapcore.Level
-func parseLevel(levelStr string) (zapcore.Level, error) {
+// parseLevel converts a string level to slog.Level
+func parseLevel(levelStr string) (slog.Level, error) {
 	switch strings.ToLower(levelStr) {
 	case "panic":
-		return zapcore.PanicLevel, nil
+		return LevelPanic, nil
 	case "fatal":
-		return zapcore.FatalLevel, nil
+		return LevelFatal, nil
 	case "error":
-		return zapcore.ErrorLevel, nil
+		return slog.LevelError, nil
 	case "warn", "warning":
-		return zapcore.WarnLevel, nil
+		return slog.LevelWarn, nil
 	case "info":
-		return zapcore.InfoLevel, nil
-	case "debug", "trace":
-		return zapcore.DebugLevel, nil
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
 	default:
-		return zapcore.InfoLevel, nil // Return InfoLevel as default, no error
+		return slog.LevelInfo, nil // Return InfoLevel as default, no error
 	}
 }
 
@@ -99,18 +103,14 @@ func UpdateLogLevels(logstr string) error {
 		initManager()
 	})
 
-	// Strip whitespace
-	ws := []string{" ", "\t", "\n"}
-	for _, s := range ws {
-		logstr = strings.ReplaceAll(logstr, s, "")
-	}
+	logstr = stripWhitespace(logstr)
 
 	mu.Lock()
 	defer mu.Unlock()
 
 	// Track which modules have explicit levels set
 	explicitModules := make(map[string]bool)
-	var defaultLevel zapcore.Level
+	var defaultLevel slog.Level
 	hasDefault := false
 
 	logs := strings.Split(logstr, ";")
@@ -141,6 +141,7 @@ func UpdateLogLevels(logstr string) error {
 			if logger == nil {
 				// Create logger if it doesn't exist
 				logger = newLogger(module)
+				logger.setSampling(manager.sampling)
 				manager.loggers[module] = logger
 			}
 			logger.SetLevel(level)
@@ -160,3 +161,20 @@ func UpdateLogLevels(logstr string) error {
 
 	return nil
 }
+
+// SetSampling limits the volume of repeated messages logged by every module, replacing the
+// options read from MPE_LOG_SAMPLING_INITIAL and MPE_LOG_SAMPLING_THEREAFTER. Zero options
+// disable sampling.
+func SetSampling(opts SamplingOptions) {
+	once.Do(func() {
+		initManager()
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	manager.sampling = opts
+	for _, logger := range manager.loggers {
+		logger.setSampling(opts)
+	}
+}
@@ -6,10 +6,10 @@ package logging
 
 import (
 	"fmt"
+	"log/slog"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"go.uber.org/zap/zapcore"
 )
 
 func TestGetLogger(t *testing.T) {
@@ -19,8 +19,8 @@ func TestGetLogger(t *testing.T) {
 	// Get logger - should create with default level
 	l := GetLogger("testmodule")
 	assert.NotNil(t, l)
-	assert.Equal(t, l.IsLevelEnabled(zapcore.InfoLevel), true)
-	assert.Equal(t, l.IsLevelEnabled(zapcore.DebugLevel), false)
+	assert.Equal(t, l.IsLevelEnabled(slog.LevelInfo), true)
+	assert.Equal(t, l.IsLevelEnabled(slog.LevelDebug), false)
 }
 
 func TestUpdateConfigFromString(t *testing.T) {
@@ -33,17 +33,17 @@ func TestUpdateConfigFromString(t *testing.T) {
 
 	// Test module1 should be debug
 	l1 := GetLogger("module1")
-	assert.Equal(t, l1.IsLevelEnabled(zapcore.DebugLevel), true)
+	assert.Equal(t, l1.IsLevelEnabled(slog.LevelDebug), true)
 
 	// Test module2 should be warn
 	l2 := GetLogger("module2")
-	assert.Equal(t, l2.IsLevelEnabled(zapcore.WarnLevel), true)
-	assert.Equal(t, l2.IsLevelEnabled(zapcore.InfoLevel), false)
+	assert.Equal(t, l2.IsLevelEnabled(slog.LevelWarn), true)
+	assert.Equal(t, l2.IsLevelEnabled(slog.LevelInfo), false)
 
 	// Test undeclared module should get default (info)
 	l3 := GetLogger("undeclaredModule")
-	assert.Equal(t, l3.IsLevelEnabled(zapcore.InfoLevel), true)
-	assert.Equal(t, l3.IsLevelEnabled(zapcore.DebugLevel), false)
+	assert.Equal(t, l3.IsLevelEnabled(slog.LevelInfo), true)
+	assert.Equal(t, l3.IsLevelEnabled(slog.LevelDebug), false)
 
 	// Update default level to debug
 	err = UpdateLogLevels(".:debug")
@@ -51,10 +51,10 @@ func TestUpdateConfigFromString(t *testing.T) {
 
 	// New undeclared module should get debug
 	l4 := GetLogger("undeclaredModule2")
-	assert.Equal(t, l4.IsLevelEnabled(zapcore.DebugLevel), true)
+	assert.Equal(t, l4.IsLevelEnabled(slog.LevelDebug), true)
 
 	// Existing undeclared module should also be updated to debug
-	assert.Equal(t, l3.IsLevelEnabled(zapcore.DebugLevel), true)
+	assert.Equal(t, l3.IsLevelEnabled(slog.LevelDebug), true)
 }
 
 func TestUpdateConfigFromStringWithWhitespace(t *testing.T) {
@@ -66,23 +66,23 @@ func TestUpdateConfigFromStringWithWhitespace(t *testing.T) {
 	assert.NoError(t, err)
 
 	l1 := GetLogger("mod1")
-	assert.Equal(t, l1.IsLevelEnabled(zapcore.DebugLevel), true)
+	assert.Equal(t, l1.IsLevelEnabled(slog.LevelDebug), true)
 
 	l2 := GetLogger("mod2")
-	assert.Equal(t, l2.IsLevelEnabled(zapcore.ErrorLevel), true)
-	assert.Equal(t, l2.IsLevelEnabled(zapcore.WarnLevel), false)
+	assert.Equal(t, l2.IsLevelEnabled(slog.LevelError), true)
+	assert.Equal(t, l2.IsLevelEnabled(slog.LevelWarn), false)
 }
 
 func TestTraceLevelMapsToDebug(t *testing.T) {
 	// Reset manager for clean test
 	resetForTesting()
 
-	// Set trace level - should map to debug since zap doesn't support trace
+	// Set trace level - trace messages are logged at debug level
 	err := UpdateLogLevels(".:trace")
 	assert.NoError(t, err)
 
 	l := GetLogger("testmodule")
-	assert.Equal(t, true, l.IsLevelEnabled(zapcore.DebugLevel))
+	assert.Equal(t, true, l.IsLevelEnabled(slog.LevelDebug))
 	assert.Equal(t, true, l.IsTraceEnabled())
 }
 
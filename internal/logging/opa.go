@@ -0,0 +1,122 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	opalogging "github.com/open-policy-agent/opa/v1/logging"
+	"github.com/open-policy-agent/opa/v1/topdown/print"
+)
+
+// OPALogger bridges the logs of the OPA runtime to a module's [Logger]. It implements the
+// OPA logger interface, for OPA components that accept one, and the print hook of the Rego
+// evaluator, so that the output of print() statements in policies is logged at debug
+// level with the fields of the decision that evaluated them.
+type OPALogger struct {
+	logger *Logger
+	action string
+}
+
+var (
+	_ opalogging.Logger            = (*OPALogger)(nil)
+	_ opalogging.LoggerWithContext = (*OPALogger)(nil)
+	_ print.Hook                   = (*OPALogger)(nil)
+)
+
+// NewOPALogger returns an [OPALogger] writing through logger
+func NewOPALogger(logger *Logger) *OPALogger {
+	return &OPALogger{logger: logger, action: "runtime"}
+}
+
+// Debug logs a debug message
+func (o *OPALogger) Debug(format string, a ...interface{}) {
+	o.logger.log(1, slog.LevelDebug, "opa", o.action, &format, a)
+}
+
+// Info logs an info message
+func (o *OPALogger) Info(format string, a ...interface{}) {
+	o.logger.log(1, slog.LevelInfo, "opa", o.action, &format, a)
+}
+
+// Warn logs a warning message
+func (o *OPALogger) Warn(format string, a ...interface{}) {
+	o.logger.log(1, slog.LevelWarn, "opa", o.action, &format, a)
+}
+
+// Error logs an error message
+func (o *OPALogger) Error(format string, a ...interface{}) {
+	o.logger.log(1, slog.LevelError, "opa", o.action, &format, a)
+}
+
+// WithFields returns a logger adding fields to each message
+func (o *OPALogger) WithFields(fields map[string]interface{}) opalogging.Logger {
+	if len(fields) == 0 {
+		return o
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	merged := make([]interface{}, 0, len(o.logger.fields)+2*len(keys))
+	merged = append(merged, o.logger.fields...)
+	for _, k := range keys {
+		merged = append(merged, k, fields[k])
+	}
+	return &OPALogger{logger: &Logger{module: o.logger.root().module, parent: o.logger.root(), fields: merged}, action: o.action}
+}
+
+// WithContext returns a logger adding the fields carried by ctx (see [NewContext])
+func (o *OPALogger) WithContext(ctx context.Context) opalogging.Logger {
+	return o.withContext(ctx)
+}
+
+func (o *OPALogger) withContext(ctx context.Context) *OPALogger {
+	logger := o.logger.WithContext(ctx)
+	if logger == o.logger {
+		return o
+	}
+	return &OPALogger{logger: logger, action: o.action}
+}
+
+// GetLevel returns the level of the module
+func (o *OPALogger) GetLevel() opalogging.Level {
+	switch level := o.logger.Level(); {
+	case level <= slog.LevelDebug:
+		return opalogging.Debug
+	case level <= slog.LevelInfo:
+		return opalogging.Info
+	case level <= slog.LevelWarn:
+		return opalogging.Warn
+	default:
+		return opalogging.Error
+	}
+}
+
+// SetLevel sets the level of the module
+func (o *OPALogger) SetLevel(level opalogging.Level) {
+	switch level {
+	case opalogging.Debug:
+		o.logger.SetLevel(slog.LevelDebug)
+	case opalogging.Info:
+		o.logger.SetLevel(slog.LevelInfo)
+	case opalogging.Warn:
+		o.logger.SetLevel(slog.LevelWarn)
+	default:
+		o.logger.SetLevel(slog.LevelError)
+	}
+}
+
+// Print logs the output of a print() statement in a policy at debug level
+func (o *OPALogger) Print(pctx print.Context, msg string) error {
+	format := "%s: %s"
+	o.withContext(pctx.Context).logger.log(1, slog.LevelDebug, "opa", "print", &format, []interface{}{pctx.Location, msg})
+	return nil
+}
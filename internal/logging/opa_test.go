@@ -0,0 +1,60 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	opalogging "github.com/open-policy-agent/opa/v1/logging"
+	"github.com/open-policy-agent/opa/v1/topdown/print"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOPALogger(t *testing.T) {
+	logger := newLogger("opa")
+	var buffer bytes.Buffer
+	logger.SetOut(&buffer)
+	bridge := NewOPALogger(logger)
+
+	assert.Equal(t, opalogging.Info, bridge.GetLevel())
+	bridge.SetLevel(opalogging.Debug)
+	assert.Equal(t, slog.LevelDebug, logger.Level(), "the bridge sets the level of the module")
+
+	last := func() map[string]interface{} {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(buffer.Bytes(), &entry))
+		buffer.Reset()
+		return entry
+	}
+
+	bridge.WithFields(map[string]interface{}{"plugin": "bundle"}).Warn("download failed: %s", "timeout")
+	entry := last()
+	assert.Equal(t, "warn", entry["level"])
+	assert.Equal(t, "download failed: timeout", entry["msg"])
+	assert.Equal(t, "bundle", entry["plugin"])
+	assert.Equal(t, "opa", entry[module])
+
+	ctx := NewContext(context.Background(), RecordID, "r1")
+	withFields := bridge.WithFields(map[string]interface{}{"plugin": "bundle"})
+	withFields.(opalogging.LoggerWithContext).WithContext(ctx).Error("failed")
+	entry = last()
+	assert.Equal(t, "bundle", entry["plugin"])
+	assert.Equal(t, "r1", entry[RecordID])
+
+	require.NoError(t, bridge.Print(print.Context{Context: ctx}, "hello"))
+	entry = last()
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, "print", entry[action])
+	assert.Equal(t, "r1", entry[RecordID])
+
+	bridge.SetLevel(opalogging.Info)
+	bridge.Debug("hidden")
+	assert.Empty(t, buffer.Bytes())
+}
@@ -0,0 +1,122 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSamplingTick is the period over which repeated messages are counted, unless
+// configured otherwise.
+const DefaultSamplingTick = time.Second
+
+// samplingCounters is the number of counters among which messages are hashed, which bounds the
+// memory of a sampler whatever the number of distinct messages.
+const samplingCounters = 4096
+
+// SamplingOptions limits the volume of repeated messages. Within each tick, the first
+// Initial messages with a given level and text are logged, then every Thereafter-th one.
+// Messages at fatal and panic levels are never sampled.
+type SamplingOptions struct {
+	// Initial is the number of identical messages logged in each tick before sampling
+	// begins. Sampling is disabled if Initial is zero.
+	Initial int
+	// Thereafter logs every Thereafter-th message once Initial is reached, or none if zero.
+	Thereafter int
+	// Tick is the period over which messages are counted, [DefaultSamplingTick] if zero.
+	Tick time.Duration
+}
+
+// IsEnabled returns true if the options sample messages.
+func (o SamplingOptions) IsEnabled() bool {
+	return o.Initial > 0
+}
+
+// samplingFromEnv reads the sampling options from MPE_LOG_SAMPLING_INITIAL and
+// MPE_LOG_SAMPLING_THEREAFTER. Invalid values disable sampling.
+func samplingFromEnv() SamplingOptions {
+	initial, err := strconv.Atoi(os.Getenv("MPE_LOG_SAMPLING_INITIAL"))
+	if err != nil || initial < 0 {
+		return SamplingOptions{}
+	}
+	thereafter, err := strconv.Atoi(os.Getenv("MPE_LOG_SAMPLING_THEREAFTER"))
+	if err != nil || thereafter < 0 {
+		thereafter = 0
+	}
+	return SamplingOptions{Initial: initial, Thereafter: thereafter}
+}
+
+type samplingCounter struct {
+	resetAt atomic.Int64 // end of the counter's tick, in Unix nanoseconds
+	count   atomic.Uint64
+}
+
+// samplingHandler is a slog.Handler dropping the repeated messages that exceed its options
+type samplingHandler struct {
+	slog.Handler
+	opts     SamplingOptions
+	counters *[samplingCounters]samplingCounter
+}
+
+// newSamplingHandler wraps handler to sample its messages, or returns it if opts are disabled
+func newSamplingHandler(handler slog.Handler, opts SamplingOptions) slog.Handler {
+	if !opts.IsEnabled() {
+		return handler
+	}
+	if opts.Tick <= 0 {
+		opts.Tick = DefaultSamplingTick
+	}
+	return &samplingHandler{Handler: handler, opts: opts, counters: new([samplingCounters]samplingCounter)}
+}
+
+// Handle passes the record to the wrapped handler unless it is sampled out
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= LevelFatal || h.sample(r.Level, r.Message, r.Time) {
+		return h.Handler.Handle(ctx, r)
+	}
+	return nil
+}
+
+// sample counts the message and returns true if it is to be logged
+func (h *samplingHandler) sample(level slog.Level, msg string, now time.Time) bool {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte{byte(level)})
+	_, _ = hash.Write([]byte(msg))
+	counter := &h.counters[hash.Sum32()%samplingCounters]
+
+	n := counter.inc(now.UnixNano(), h.opts.Tick)
+	if n <= uint64(h.opts.Initial) {
+		return true
+	}
+	return h.opts.Thereafter > 0 && (n-uint64(h.opts.Initial))%uint64(h.opts.Thereafter) == 0
+}
+
+// inc counts a message at now and returns the count within the current tick
+func (c *samplingCounter) inc(now int64, tick time.Duration) uint64 {
+	resetAt := c.resetAt.Load()
+	if now >= resetAt {
+		if c.resetAt.CompareAndSwap(resetAt, now+int64(tick)) {
+			c.count.Store(1)
+			return 1
+		}
+	}
+	return c.count.Add(1)
+}
+
+// WithAttrs returns a sampling handler sharing the counters of h
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), opts: h.opts, counters: h.counters}
+}
+
+// WithGroup returns a sampling handler sharing the counters of h
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), opts: h.opts, counters: h.counters}
+}
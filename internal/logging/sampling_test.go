@@ -0,0 +1,87 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampling(t *testing.T) {
+	logger := newLogger("sampled")
+	var buffer bytes.Buffer
+	logger.SetOut(&buffer)
+	logger.setSampling(SamplingOptions{Initial: 2, Thereafter: 3, Tick: time.Hour})
+
+	for i := 0; i < 10; i++ {
+		logger.Info("tester", "test", "repeated")
+	}
+	logger.Info("tester", "test", "distinct")
+	logger.Warn("tester", "test", "repeated")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	count := func(s string) int {
+		n := 0
+		for _, line := range lines {
+			if strings.Contains(line, s) {
+				n++
+			}
+		}
+		return n
+	}
+	// the first 2, then the 5th and 8th
+	assert.Equal(t, 4, count(`"level":"info","msg":"repeated"`))
+	assert.Equal(t, 1, count(`"msg":"distinct"`))
+	assert.Equal(t, 1, count(`"level":"warn","msg":"repeated"`), "levels are counted apart")
+
+	// a sampled logger keeps its sampling when its output changes
+	buffer.Reset()
+	logger.SetOut(&buffer)
+	for i := 0; i < 3; i++ {
+		logger.Info("tester", "test", "repeated")
+	}
+	assert.Equal(t, 2, strings.Count(buffer.String(), "repeated"))
+}
+
+func TestSampling_Tick(t *testing.T) {
+	h := newSamplingHandler(nil, SamplingOptions{Initial: 1, Tick: time.Second}).(*samplingHandler)
+	now := time.Now()
+	assert.True(t, h.sample(LevelTrace, "message", now))
+	assert.False(t, h.sample(LevelTrace, "message", now.Add(500*time.Millisecond)), "thereafter none")
+	assert.True(t, h.sample(LevelTrace, "message", now.Add(time.Second)), "counts reset each tick")
+}
+
+func TestSamplingFromEnv(t *testing.T) {
+	t.Setenv("MPE_LOG_SAMPLING_INITIAL", "100")
+	t.Setenv("MPE_LOG_SAMPLING_THEREAFTER", "10")
+	assert.Equal(t, SamplingOptions{Initial: 100, Thereafter: 10}, samplingFromEnv())
+
+	t.Setenv("MPE_LOG_SAMPLING_INITIAL", "many")
+	assert.False(t, samplingFromEnv().IsEnabled())
+
+	assert.Nil(t, newSamplingHandler(nil, SamplingOptions{}), "disabled options return the handler unwrapped")
+}
+
+func TestSetSampling(t *testing.T) {
+	resetForTesting()
+	defer SetSampling(SamplingOptions{})
+
+	existing := GetLogger("existing")
+	SetSampling(SamplingOptions{Initial: 1})
+	created := GetLogger("created")
+
+	for _, l := range []*Logger{existing, created} {
+		var buffer bytes.Buffer
+		l.SetOut(&buffer)
+		l.Info("tester", "test", "repeated")
+		l.Info("tester", "test", "repeated")
+		require.Equal(t, 1, strings.Count(buffer.String(), "repeated"), l.module)
+	}
+}
@@ -10,14 +10,72 @@
 // The [PolicyError] type provides structured error information for
 // authorization failures, including reason codes suitable for access
 // log records.
+//
+// Each reason code corresponds to an error kind, such as [ErrNotFound] or
+// [ErrNetwork], that callers can test for with [errors.Is] instead of
+// matching the text of the reason:
+//
+//	role, perr := be.GetRole(ctx, mrn)
+//	switch {
+//	case perr == nil:
+//	    // use role
+//	case errors.Is(perr, common.ErrNotFound):
+//	    // the role does not exist
+//	case errors.Is(perr, common.ErrTimeout):
+//	    // the backend did not answer in time; retry later
+//	}
+//
+// Use [errors.As] to recover the [PolicyError] itself, and [ReasonCodeOf] to
+// classify any error for an access record.
 package common
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
+// Error kinds, for use with [errors.Is].
+//
+// Every [PolicyError] is its reason code's kind: a PolicyError with
+// NOTFOUND_ERROR is [ErrNotFound], and so on. [ErrTimeout] is not a reason
+// code of its own; a PolicyError is a timeout when its Cause is
+// [context.DeadlineExceeded] or ErrTimeout, whatever its reason code.
+var (
+	// ErrNotFound indicates a referenced entity, such as a role or policy, does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrCompilation indicates a policy or mapper failed to compile.
+	ErrCompilation = errors.New("compilation error")
+	// ErrNetwork indicates a network error prevented the resolution of a policy.
+	ErrNetwork = errors.New("network error")
+	// ErrEvaluation indicates the policy evaluator reported an error.
+	ErrEvaluation = errors.New("evaluation error")
+	// ErrInvalidParam indicates an invalid parameter or identifier, such as a malformed PORC.
+	ErrInvalidParam = errors.New("invalid parameter")
+	// ErrInternal indicates an internal failure of the engine, such as a recovered panic.
+	ErrInternal = errors.New("internal error")
+	// ErrTimeout indicates an operation did not complete before its deadline.
+	ErrTimeout = errors.New("timeout")
+	// ErrUnknown indicates an unclassified error.
+	ErrUnknown = errors.New("unknown error")
+)
+
+// kinds maps reason codes to their error kinds, in the order [ReasonCodeOf] tests them
+var kinds = []struct {
+	code events.AccessRecord_BundleReference_ReasonCode
+	kind error
+}{
+	{events.AccessRecord_BundleReference_NOTFOUND_ERROR, ErrNotFound},
+	{events.AccessRecord_BundleReference_COMPILATION_ERROR, ErrCompilation},
+	{events.AccessRecord_BundleReference_NETWORK_ERROR, ErrNetwork},
+	{events.AccessRecord_BundleReference_EVALUATION_ERROR, ErrEvaluation},
+	{events.AccessRecord_BundleReference_INVALPARAM_ERROR, ErrInvalidParam},
+	{events.AccessRecord_BundleReference_INTERNAL_ERROR, ErrInternal},
+	{events.AccessRecord_BundleReference_UNKNOWN_ERROR, ErrUnknown},
+}
+
 // PolicyError represents an error encountered during policy evaluation.
 //
 // PolicyError provides structured error information that can be included
@@ -31,6 +89,8 @@ type PolicyError struct {
 	ReasonCode events.AccessRecord_BundleReference_ReasonCode
 	// Reason is a human-readable description of the error.
 	Reason string
+	// Cause is the underlying error, if any. It is available through [errors.Unwrap].
+	Cause error
 }
 
 // Error implements the error interface, returning a formatted string
@@ -39,6 +99,20 @@ func (e *PolicyError) Error() string {
 	return fmt.Sprintf("%s(code-%s)", e.Reason, e.ReasonCode)
 }
 
+// Unwrap returns the underlying cause of the error, or nil.
+func (e *PolicyError) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether the error is of the given kind, such as [ErrNotFound].
+func (e *PolicyError) Is(target error) bool {
+	if target == KindOf(e.ReasonCode) {
+		return true
+	}
+
+	return target == ErrTimeout && errors.Is(e.Cause, context.DeadlineExceeded)
+}
+
 // NewError creates a new [PolicyError] with the specified reason code and message.
 //
 // Common reason codes include:
@@ -49,3 +123,77 @@ func (e *PolicyError) Error() string {
 func NewError(code events.AccessRecord_BundleReference_ReasonCode, msg string) *PolicyError {
 	return &PolicyError{ReasonCode: code, Reason: msg}
 }
+
+// WrapError creates a new [PolicyError] with the specified reason code and message,
+// caused by err.
+//
+// Example: report a database timeout as a network error that is also a timeout:
+//
+//	if err != nil {
+//	    return nil, common.WrapError(events.AccessRecord_BundleReference_NETWORK_ERROR, "role lookup failed", err)
+//	}
+func WrapError(code events.AccessRecord_BundleReference_ReasonCode, msg string, err error) *PolicyError {
+	return &PolicyError{ReasonCode: code, Reason: msg, Cause: err}
+}
+
+// AsPolicyError converts any error to a [PolicyError].
+//
+// If err is or wraps a PolicyError, that PolicyError is returned. Otherwise a
+// new PolicyError caused by err is returned, with the reason code given by
+// [ReasonCodeOf]. Returns nil if err is nil.
+func AsPolicyError(err error) *PolicyError {
+	if err == nil {
+		return nil
+	}
+
+	var perr *PolicyError
+	if errors.As(err, &perr) {
+		return perr
+	}
+
+	return WrapError(ReasonCodeOf(err), err.Error(), err)
+}
+
+// KindOf returns the error kind for a reason code, such as [ErrNotFound] for
+// NOTFOUND_ERROR, or nil for POLICY_OUTCOME and EXPLICIT_DENY, which are not errors.
+func KindOf(code events.AccessRecord_BundleReference_ReasonCode) error {
+	if code == events.AccessRecord_BundleReference_POLICY_OUTCOME || code == events.AccessRecord_BundleReference_EXPLICIT_DENY {
+		return nil
+	}
+	for _, k := range kinds {
+		if k.code == code {
+			return k.kind
+		}
+	}
+
+	return ErrUnknown
+}
+
+// ReasonCodeOf classifies an error for an access record.
+//
+// A [PolicyError] has its own reason code, and an error wrapping one of the
+// error kinds has that kind's reason code. Timeouts, including
+// [context.DeadlineExceeded], are reported as NETWORK_ERROR, since they
+// usually come from a backend that did not answer in time. Returns
+// POLICY_OUTCOME for a nil error, and UNKNOWN_ERROR for any other error.
+func ReasonCodeOf(err error) events.AccessRecord_BundleReference_ReasonCode {
+	if err == nil {
+		return events.AccessRecord_BundleReference_POLICY_OUTCOME
+	}
+
+	var perr *PolicyError
+	if errors.As(err, &perr) {
+		return perr.ReasonCode
+	}
+
+	for _, k := range kinds {
+		if errors.Is(err, k.kind) {
+			return k.code
+		}
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return events.AccessRecord_BundleReference_NETWORK_ERROR
+	}
+
+	return events.AccessRecord_BundleReference_UNKNOWN_ERROR
+}
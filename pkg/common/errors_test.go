@@ -0,0 +1,112 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyErrorIs(t *testing.T) {
+	tests := []struct {
+		code events.AccessRecord_BundleReference_ReasonCode
+		kind error
+	}{
+		{events.AccessRecord_BundleReference_NOTFOUND_ERROR, ErrNotFound},
+		{events.AccessRecord_BundleReference_COMPILATION_ERROR, ErrCompilation},
+		{events.AccessRecord_BundleReference_NETWORK_ERROR, ErrNetwork},
+		{events.AccessRecord_BundleReference_EVALUATION_ERROR, ErrEvaluation},
+		{events.AccessRecord_BundleReference_INVALPARAM_ERROR, ErrInvalidParam},
+		{events.AccessRecord_BundleReference_INTERNAL_ERROR, ErrInternal},
+		{events.AccessRecord_BundleReference_UNKNOWN_ERROR, ErrUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			err := NewError(tt.code, "role not found 3: mrn:iam:role:admin")
+			assert.ErrorIs(t, err, tt.kind)
+			assert.Equal(t, tt.kind, KindOf(tt.code))
+			assert.Equal(t, tt.code, ReasonCodeOf(err))
+
+			// kinds are exclusive
+			for _, other := range tests {
+				if other.kind != tt.kind {
+					assert.NotErrorIs(t, err, other.kind)
+				}
+			}
+			assert.NotErrorIs(t, err, ErrTimeout)
+
+			// wrapped errors keep their kind
+			wrapped := fmt.Errorf("lookup failed: %w", err)
+			assert.ErrorIs(t, wrapped, tt.kind)
+			assert.Equal(t, tt.code, ReasonCodeOf(wrapped))
+		})
+	}
+}
+
+func TestPolicyErrorCause(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := WrapError(events.AccessRecord_BundleReference_NETWORK_ERROR, "role lookup failed", cause)
+
+	assert.Equal(t, "role lookup failed(code-NETWORK_ERROR)", err.Error())
+	assert.ErrorIs(t, err, cause)
+	assert.ErrorIs(t, err, ErrNetwork)
+	assert.Equal(t, cause, errors.Unwrap(err))
+
+	var perr *PolicyError
+	assert.ErrorAs(t, fmt.Errorf("decision failed: %w", err), &perr)
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, perr.ReasonCode)
+}
+
+func TestPolicyErrorTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	err := WrapError(events.AccessRecord_BundleReference_NETWORK_ERROR, "role lookup failed", ctx.Err())
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, ErrNetwork)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = WrapError(events.AccessRecord_BundleReference_EVALUATION_ERROR, "evaluation took too long", fmt.Errorf("budget: %w", ErrTimeout))
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, ErrEvaluation)
+
+	// cancellation is not a timeout
+	err = WrapError(events.AccessRecord_BundleReference_NETWORK_ERROR, "role lookup failed", context.Canceled)
+	assert.NotErrorIs(t, err, ErrTimeout)
+}
+
+func TestKindOf(t *testing.T) {
+	assert.Nil(t, KindOf(events.AccessRecord_BundleReference_POLICY_OUTCOME))
+	assert.Nil(t, KindOf(events.AccessRecord_BundleReference_EXPLICIT_DENY))
+	assert.Equal(t, ErrUnknown, KindOf(events.AccessRecord_BundleReference_ReasonCode(42)))
+}
+
+func TestReasonCodeOf(t *testing.T) {
+	assert.Equal(t, events.AccessRecord_BundleReference_POLICY_OUTCOME, ReasonCodeOf(nil))
+	assert.Equal(t, events.AccessRecord_BundleReference_NOTFOUND_ERROR, ReasonCodeOf(fmt.Errorf("role %s: %w", "admin", ErrNotFound)))
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, ReasonCodeOf(context.DeadlineExceeded))
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, ReasonCodeOf(ErrTimeout))
+	assert.Equal(t, events.AccessRecord_BundleReference_UNKNOWN_ERROR, ReasonCodeOf(errors.New("boom")))
+}
+
+func TestAsPolicyError(t *testing.T) {
+	assert.Nil(t, AsPolicyError(nil))
+
+	original := NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "role not found")
+	assert.Same(t, original, AsPolicyError(fmt.Errorf("wrapped: %w", original)))
+
+	cause := fmt.Errorf("query: %w", context.DeadlineExceeded)
+	perr := AsPolicyError(cause)
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, perr.ReasonCode)
+	assert.Equal(t, "query: context deadline exceeded", perr.Reason)
+	assert.ErrorIs(t, perr, ErrTimeout)
+}
@@ -0,0 +1,111 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// ChannelOption is a functional option for configuring a [ChannelFactory].
+type ChannelOption func(*ChannelFactory)
+
+// WithBlockingSend makes [ChannelStream.Send] wait for room in the channel rather
+// than drop the record, so that no record is lost. Decisions then wait for the
+// consumer, so use it in tests rather than in production.
+func WithBlockingSend() ChannelOption {
+	return func(f *ChannelFactory) {
+		f.block = true
+	}
+}
+
+// ChannelFactory creates [ChannelStream] instances sending access records to a
+// channel, so that an application embedding the engine can consume its decisions
+// in-process.
+type ChannelFactory struct {
+	ch    chan *events.AccessRecord
+	block bool
+
+	dropped   atomic.Uint64
+	closeOnce sync.Once
+}
+
+// ChannelStream sends access records to the channel of a [ChannelFactory].
+//
+// ChannelStream is safe for concurrent use.
+type ChannelStream struct {
+	factory *ChannelFactory
+}
+
+// NewChannelFactory creates a [ChannelFactory] whose streams send records to a
+// channel buffering up to size records. By default, records that find the buffer
+// full are dropped and counted by [ChannelFactory.Dropped], so that a slow consumer
+// never delays decisions:
+//
+//	factory := accesslog.NewChannelFactory(1024)
+//	pe, _ := core.NewPolicyEngine(options.WithAccessLog(factory))
+//	go func() {
+//	    for record := range factory.C() {
+//	        fmt.Println(record.Decision)
+//	    }
+//	}()
+func NewChannelFactory(size int, opts ...ChannelOption) *ChannelFactory {
+	if size < 0 {
+		size = 0
+	}
+	f := &ChannelFactory{ch: make(chan *events.AccessRecord, size)}
+	for _, o := range opts {
+		o(f)
+	}
+
+	return f
+}
+
+// C returns the channel receiving the records. It is closed when a stream of the
+// factory is closed.
+func (f *ChannelFactory) C() <-chan *events.AccessRecord {
+	return f.ch
+}
+
+// Dropped returns the number of records dropped because the channel was full.
+func (f *ChannelFactory) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+// NewStream creates a [ChannelStream].
+func (f *ChannelFactory) NewStream() (Stream, error) {
+	return &ChannelStream{factory: f}, nil
+}
+
+// Send sends a clone of the record to the channel, as the engine reuses the record,
+// dropping it if the channel is full unless the factory was created [WithBlockingSend].
+//
+// This method always returns nil.
+func (s *ChannelStream) Send(record *events.AccessRecord) error {
+	f := s.factory
+	record = proto.Clone(record).(*events.AccessRecord)
+	if f.block {
+		f.ch <- record
+		return nil
+	}
+
+	select {
+	case f.ch <- record:
+	default:
+		f.dropped.Add(1)
+	}
+	return nil
+}
+
+// Close closes the channel, once records are no longer sent.
+func (s *ChannelStream) Close() {
+	s.factory.closeOnce.Do(func() {
+		close(s.factory.ch)
+	})
+}
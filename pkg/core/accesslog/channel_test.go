@@ -0,0 +1,63 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"testing"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelFactory(t *testing.T) {
+	factory := NewChannelFactory(2)
+	stream, err := factory.NewStream()
+	require.NoError(t, err)
+
+	for _, op := range []string{"a", "b", "c"} {
+		assert.NoError(t, stream.Send(&events.AccessRecord{Operation: op}))
+	}
+	assert.Equal(t, uint64(1), factory.Dropped(), "records beyond the buffer are dropped")
+
+	stream.Close()
+	stream.Close()
+
+	var ops []string
+	for record := range factory.C() {
+		ops = append(ops, record.Operation)
+	}
+	assert.Equal(t, []string{"a", "b"}, ops)
+}
+
+func TestChannelFactory_Blocking(t *testing.T) {
+	factory := NewChannelFactory(0, WithBlockingSend())
+	stream, err := factory.NewStream()
+	require.NoError(t, err)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for _, op := range []string{"a", "b"} {
+			_ = stream.Send(&events.AccessRecord{Operation: op})
+		}
+		stream.Close()
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("send did not wait for the consumer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var ops []string
+	for record := range factory.C() {
+		ops = append(ops, record.Operation)
+	}
+	<-sent
+	assert.Equal(t, []string{"a", "b"}, ops)
+	assert.Equal(t, uint64(0), factory.Dropped())
+}
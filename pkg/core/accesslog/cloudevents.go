@@ -0,0 +1,83 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+const (
+	// CloudEventsSpecVersion is the version of the CloudEvents specification
+	// that [CloudEvent] envelopes conform to.
+	CloudEventsSpecVersion = "1.0"
+
+	// DefaultCloudEventsSource is the source attribute used when
+	// [CloudEventsOptions].Source is empty.
+	DefaultCloudEventsSource = "/manetu/policyengine"
+
+	// DefaultCloudEventsType is the type attribute used when
+	// [CloudEventsOptions].Type is empty.
+	DefaultCloudEventsType = "io.manetu.policyengine.accessrecord.v1"
+)
+
+// CloudEventsOptions configures the CloudEvents envelope that wraps each
+// access record when set in [AccessLogOptions].
+type CloudEventsOptions struct {
+	// Source identifies the context in which decisions are made, such as
+	// "/clusters/prod/namespaces/payments". Defaults to [DefaultCloudEventsSource].
+	Source string
+
+	// Type identifies the kind of event for routing and filtering.
+	// Defaults to [DefaultCloudEventsType].
+	Type string
+}
+
+// CloudEvent is a CloudEvents 1.0 envelope in the structured JSON format,
+// suitable for event routers such as Knative Eventing or Azure Event Grid.
+//
+// The id is taken from the record's metadata, so that an event delivered more
+// than once can be recognized, and the subject is the record's resource.
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time,omitempty"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// NewCloudEvent wraps data, the JSON representation of record, in a [CloudEvent].
+//
+// Records without an id, such as those created outside the policy engine, are
+// assigned a random one.
+func NewCloudEvent(record *events.AccessRecord, data interface{}, opts CloudEventsOptions) *CloudEvent {
+	ce := &CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              record.GetMetadata().GetId(),
+		Source:          opts.Source,
+		Type:            opts.Type,
+		Subject:         record.GetResource(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	if ce.ID == "" {
+		ce.ID = uuid.NewString()
+	}
+	if ce.Source == "" {
+		ce.Source = DefaultCloudEventsSource
+	}
+	if ce.Type == "" {
+		ce.Type = DefaultCloudEventsType
+	}
+	if ts := record.GetMetadata().GetTimestamp(); ts != nil {
+		ce.Time = ts.AsTime().Format(time.RFC3339Nano)
+	}
+	return ce
+}
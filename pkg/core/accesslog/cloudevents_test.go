@@ -0,0 +1,75 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestIoWriterStream_CloudEvents(t *testing.T) {
+	ts := time.Date(2026, 10, 16, 12, 30, 0, 500, time.UTC)
+	record := &events.AccessRecord{
+		Metadata: &events.AccessRecord_Metadata{
+			Id:        "7c1f2a4e-0d1b-4f8e-9a53-2f6b1c9d8e01",
+			Timestamp: timestamppb.New(ts),
+		},
+		Operation: "platform:resource:read",
+		Resource:  "mrn:app:doc:1",
+		Decision:  events.AccessRecord_GRANT,
+		Porc:      `{"principal":{"sub":"alice"}}`,
+	}
+
+	buf := &bytes.Buffer{}
+	s := newStream(buf, AccessLogOptions{CloudEvents: &CloudEventsOptions{
+		Source: "/clusters/prod/payments",
+		Type:   "com.example.audit",
+	}})
+	require.NoError(t, s.Send(record))
+
+	var ce map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &ce))
+	assert.Equal(t, "1.0", ce["specversion"])
+	assert.Equal(t, "7c1f2a4e-0d1b-4f8e-9a53-2f6b1c9d8e01", ce["id"])
+	assert.Equal(t, "/clusters/prod/payments", ce["source"])
+	assert.Equal(t, "com.example.audit", ce["type"])
+	assert.Equal(t, "mrn:app:doc:1", ce["subject"])
+	assert.Equal(t, "2026-10-16T12:30:00.0000005Z", ce["time"])
+	assert.Equal(t, "application/json", ce["datacontenttype"])
+
+	data, ok := ce["data"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, "platform:resource:read", data["operation"])
+	assert.Equal(t, "GRANT", data["decision"])
+	assert.Equal(t, map[string]interface{}{"principal": map[string]interface{}{"sub": "alice"}}, data["porc"])
+}
+
+func TestIoWriterStream_CloudEventsPrettyPrint(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := newStream(buf, AccessLogOptions{PrettyPrint: true, CloudEvents: &CloudEventsOptions{}})
+	require.NoError(t, s.Send(&events.AccessRecord{Operation: "read"}))
+
+	assert.Contains(t, buf.String(), "\n  \"specversion\": \"1.0\"")
+	assert.Contains(t, buf.String(), "\n    \"operation\": \"read\"")
+}
+
+func TestNewCloudEvent_Defaults(t *testing.T) {
+	ce := NewCloudEvent(&events.AccessRecord{}, nil, CloudEventsOptions{})
+	assert.Equal(t, DefaultCloudEventsSource, ce.Source)
+	assert.Equal(t, DefaultCloudEventsType, ce.Type)
+	assert.NotEmpty(t, ce.ID, "records without an id are assigned one")
+	assert.Empty(t, ce.Time)
+	assert.Empty(t, ce.Subject)
+
+	other := NewCloudEvent(&events.AccessRecord{}, nil, CloudEventsOptions{})
+	assert.NotEqual(t, ce.ID, other.ID)
+}
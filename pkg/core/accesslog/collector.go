@@ -0,0 +1,446 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/manetu/policyengine/internal/logging"
+	collectorv1 "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/collector/v1"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+var logger = logging.GetLogger("policyengine.accesslog")
+
+const agent = "accesslog"
+
+var (
+	// ErrBufferFull is returned by a [CollectorStream] that can neither buffer nor spool a record.
+	ErrBufferFull = errors.New("access log buffer is full")
+	// ErrStreamClosed is returned when sending to a [CollectorStream] that has been closed.
+	ErrStreamClosed = errors.New("access log stream is closed")
+)
+
+// CollectorOptions configures a stream created with [NewCollectorFactory].
+//
+// Records are held in a memory buffer of BufferSize records until the collector acknowledges
+// them, with no more than Window of them sent but unacknowledged at a time. When the buffer
+// fills, because the collector is slow or unavailable, records are spooled to SpoolDir, up to
+// MaxSpoolBytes, and sent once the collector catches up. Without a SpoolDir, or once the spool
+// is full, records that do not fit are dropped.
+type CollectorOptions struct {
+	// Address is the gRPC target of the collector, such as "collector.example.com:9443".
+	Address string
+	// DialOptions are passed to grpc.NewClient. Defaults to an insecure connection when empty.
+	DialOptions []grpc.DialOption
+	// StreamID identifies the stream to the collector across reconnects. Defaults to a random ID.
+	StreamID string
+	// BufferSize is the number of records held in memory awaiting acknowledgement.
+	BufferSize int
+	// Window is the maximum number of records sent but not yet acknowledged.
+	Window int
+	// SpoolDir is the directory in which to spool records that overflow the buffer. Records
+	// left in it by a previous stream are sent first. Empty disables spooling.
+	SpoolDir string
+	// MaxSpoolBytes caps the size of the spool (0 = unlimited).
+	MaxSpoolBytes int64
+	// MinBackoff is the delay before the first attempt to reconnect to the collector.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, which doubles after each failure.
+	MaxBackoff time.Duration
+	// FlushTimeout is how long Close waits for the collector to acknowledge the records
+	// still buffered or spooled. Records that are not acknowledged in time are left in the
+	// spool, when there is one, and are otherwise lost.
+	FlushTimeout time.Duration
+}
+
+// DefaultCollectorOptions returns options for streaming to the collector at address, with
+// spooling disabled.
+func DefaultCollectorOptions(address string) CollectorOptions {
+	return CollectorOptions{
+		Address:       address,
+		BufferSize:    4096,
+		Window:        256,
+		MaxSpoolBytes: 256 << 20,
+		MinBackoff:    100 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+		FlushTimeout:  5 * time.Second,
+	}
+}
+
+// CollectorStats reports the counters maintained by a [CollectorStream].
+type CollectorStats struct {
+	// Acknowledged is the number of records acknowledged by the collector.
+	Acknowledged uint64
+	// Spooled is the number of records written to the spool.
+	Spooled uint64
+	// Dropped is the number of records that could neither be buffered nor spooled.
+	Dropped uint64
+	// Reconnects is the number of times the stream to the collector was re-established.
+	Reconnects uint64
+}
+
+// CollectorFactory creates [CollectorStream] instances.
+type CollectorFactory struct {
+	options CollectorOptions
+}
+
+// CollectorStream streams access records to a remote collector implementing the
+// AccessLogCollector gRPC service.
+//
+// Each record is given a sequence number, and the collector acknowledges records as it
+// persists them. When the stream to the collector breaks, it is re-established with
+// exponential backoff and resumes after the last record the collector acknowledged, so
+// records are delivered at least once and in order.
+//
+// CollectorStream is safe for concurrent use. Send never waits on the collector.
+type CollectorStream struct {
+	options CollectorOptions
+	conn    *grpc.ClientConn
+	client  collectorv1.AccessLogCollectorClient
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	flushed chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []collectorRecord // unacknowledged records, oldest first
+	sent    int               // records at the head of the queue sent on the current stream
+	nextSeq uint64
+	spool   *spool
+	closing bool
+
+	acknowledged atomic.Uint64
+	spooled      atomic.Uint64
+	dropped      atomic.Uint64
+	reconnects   atomic.Uint64
+}
+
+type collectorRecord struct {
+	seq       uint64
+	record    *events.AccessRecord
+	fromSpool bool
+}
+
+// NewCollectorFactory creates a [Factory] that streams access records to a remote collector.
+//
+// Example: stream to a collector over TLS, spooling up to 1GiB while it is unavailable:
+//
+//	opts := accesslog.DefaultCollectorOptions("collector.example.com:9443")
+//	opts.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+//	opts.SpoolDir = "/var/spool/mpe"
+//	opts.MaxSpoolBytes = 1 << 30
+//	pe, _ := core.NewPolicyEngine(options.WithAccessLog(accesslog.NewCollectorFactory(opts)))
+func NewCollectorFactory(opts CollectorOptions) Factory {
+	return &CollectorFactory{options: opts}
+}
+
+// NewStream connects to the collector, which need not be available yet, and opens the spool.
+func (f *CollectorFactory) NewStream() (Stream, error) {
+	return NewCollectorStream(f.options)
+}
+
+// NewCollectorStream creates a [CollectorStream] with the given options, filling in
+// defaults for any left unset.
+func NewCollectorStream(opts CollectorOptions) (*CollectorStream, error) {
+	if opts.Address == "" {
+		return nil, errors.New("collector address is required")
+	}
+	defaults := DefaultCollectorOptions(opts.Address)
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaults.BufferSize
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaults.Window
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaults.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaults.MaxBackoff, opts.MinBackoff)
+	}
+	if opts.FlushTimeout <= 0 {
+		opts.FlushTimeout = defaults.FlushTimeout
+	}
+	if opts.StreamID == "" {
+		opts.StreamID = uuid.NewString()
+	}
+	dialOptions := opts.DialOptions
+	if len(dialOptions) == 0 {
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+
+	s := &CollectorStream{
+		options: opts,
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+		nextSeq: 1,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if opts.SpoolDir != "" {
+		sp, err := openSpool(opts.SpoolDir, opts.MaxSpoolBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.spool = sp
+		s.refill()
+	}
+
+	conn, err := grpc.NewClient(opts.Address, dialOptions...)
+	if err != nil {
+		if s.spool != nil {
+			s.spool.close()
+		}
+		return nil, fmt.Errorf("failed to create collector client: %w", err)
+	}
+	s.conn = conn
+	s.client = collectorv1.NewAccessLogCollectorClient(conn)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go s.run()
+	return s, nil
+}
+
+// Send buffers the record for delivery, or spools it if the buffer is full.
+//
+// Returns [ErrBufferFull] or [ErrSpoolFull] if the record is dropped.
+func (s *CollectorStream) Send(record *events.AccessRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return ErrStreamClosed
+	}
+
+	// once records are spooled, later ones follow them so that order is kept
+	if (s.spool == nil || s.spool.empty()) && len(s.queue) < s.options.BufferSize {
+		s.queue = append(s.queue, collectorRecord{seq: s.nextSeq, record: proto.Clone(record).(*events.AccessRecord)})
+		s.nextSeq++
+		s.cond.Broadcast()
+		return nil
+	}
+
+	if s.spool == nil {
+		s.dropped.Add(1)
+		return ErrBufferFull
+	}
+	data, err := proto.Marshal(record)
+	if err == nil {
+		err = s.spool.append(data)
+	}
+	if err != nil {
+		s.dropped.Add(1)
+		return err
+	}
+	s.spooled.Add(1)
+	return nil
+}
+
+// Close waits up to the flush timeout for the collector to acknowledge outstanding records,
+// then disconnects. Records that remain are written to the spool, if there is one.
+func (s *CollectorStream) Close() {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	s.checkFlushed()
+	s.mu.Unlock()
+
+	select {
+	case <-s.flushed:
+	case <-time.After(s.options.FlushTimeout):
+	}
+	s.cancel()
+	<-s.done
+	_ = s.conn.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lost := 0
+	for _, r := range s.queue {
+		if r.fromSpool {
+			continue // still in its spool segment
+		}
+		if s.spool == nil {
+			lost++
+			continue
+		}
+		data, err := proto.Marshal(r.record)
+		if err == nil {
+			err = s.spool.append(data)
+		}
+		if err != nil {
+			lost++
+		}
+	}
+	if s.spool != nil {
+		s.spool.close()
+	}
+	if lost > 0 {
+		s.dropped.Add(uint64(lost))
+		logger.Warnf(agent, "close", "%d access record(s) were not acknowledged by the collector and are lost", lost)
+	}
+}
+
+// Stats returns a snapshot of the stream's counters.
+func (s *CollectorStream) Stats() CollectorStats {
+	return CollectorStats{
+		Acknowledged: s.acknowledged.Load(),
+		Spooled:      s.spooled.Load(),
+		Dropped:      s.dropped.Load(),
+		Reconnects:   s.reconnects.Load(),
+	}
+}
+
+// run maintains the stream to the collector until the CollectorStream is closed
+func (s *CollectorStream) run() {
+	defer close(s.done)
+
+	backoff := s.options.MinBackoff
+	for {
+		resumed, err := s.session()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if resumed {
+			backoff = s.options.MinBackoff
+		}
+		logger.Warnf(agent, "stream", "stream to collector %s failed, reconnecting in %s: %v", s.options.Address, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, s.options.MaxBackoff)
+		s.reconnects.Add(1)
+	}
+}
+
+// session streams records until the stream breaks, reporting whether it got as far as
+// resuming from the collector's acknowledgement
+func (s *CollectorStream) session() (bool, error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	stream, err := s.client.Stream(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err := stream.Send(&collectorv1.StreamRequest{StreamId: s.options.StreamID}); err != nil {
+		return false, err
+	}
+	resume, err := stream.Recv()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.sent = 0
+	s.acknowledge(resume.GetAcknowledged())
+	s.mu.Unlock()
+
+	broken := false
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			response, err := stream.Recv()
+			s.mu.Lock()
+			if err != nil {
+				broken = true
+				s.cond.Broadcast()
+				s.mu.Unlock()
+				errc <- err
+				return
+			}
+			s.acknowledge(response.GetAcknowledged())
+			s.mu.Unlock()
+		}
+	}()
+
+	for {
+		s.mu.Lock()
+		for !broken && (s.sent >= len(s.queue) || s.sent >= s.options.Window) {
+			s.cond.Wait()
+		}
+		if broken {
+			s.mu.Unlock()
+			return true, <-errc
+		}
+		r := s.queue[s.sent]
+		s.sent++
+		s.mu.Unlock()
+
+		if err := stream.Send(&collectorv1.StreamRequest{StreamId: s.options.StreamID, Sequence: r.seq, Record: r.record}); err != nil {
+			cancel()
+			return true, <-errc
+		}
+	}
+}
+
+// acknowledge drops the records up to and including seq from the queue, refilling it from
+// the spool. The caller must hold s.mu.
+func (s *CollectorStream) acknowledge(seq uint64) {
+	n := 0
+	for n < len(s.queue) && s.queue[n].seq <= seq {
+		n++
+	}
+	if n > 0 {
+		s.queue = s.queue[n:]
+		s.sent = max(s.sent-n, 0)
+		s.acknowledged.Add(uint64(n))
+	}
+	if s.spool != nil {
+		s.spool.release(seq)
+		s.refill()
+	}
+	s.checkFlushed()
+	s.cond.Broadcast()
+}
+
+// refill moves spooled records into the queue while it has room. The caller must hold s.mu.
+func (s *CollectorStream) refill() {
+	for len(s.queue) < s.options.BufferSize && !s.spool.empty() {
+		data, err := s.spool.read(s.nextSeq)
+		if err != nil {
+			logger.Errorf(agent, "spool", "failed to read access log spool: %v", err)
+			return
+		}
+		record := &events.AccessRecord{}
+		if err := proto.Unmarshal(data, record); err != nil {
+			logger.Errorf(agent, "spool", "discarding corrupt spooled access record: %v", err)
+			s.dropped.Add(1)
+			continue
+		}
+		s.queue = append(s.queue, collectorRecord{seq: s.nextSeq, record: record, fromSpool: true})
+		s.nextSeq++
+	}
+}
+
+// checkFlushed signals Close once everything has been acknowledged. The caller must hold s.mu.
+func (s *CollectorStream) checkFlushed() {
+	if !s.closing || len(s.queue) > 0 || (s.spool != nil && !s.spool.empty()) {
+		return
+	}
+	select {
+	case <-s.flushed:
+	default:
+		close(s.flushed)
+	}
+}
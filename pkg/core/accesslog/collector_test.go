@@ -0,0 +1,274 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	collectorv1 "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/collector/v1"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testCollector keeps the records of each stream in sequence, acknowledging them unless held
+type testCollector struct {
+	collectorv1.UnimplementedAccessLogCollectorServer
+
+	mu         sync.Mutex
+	acked      map[string]uint64
+	operations []string
+	received   int
+	hold       bool
+	breakAt    int
+	kick       chan struct{}
+}
+
+func newTestCollector() *testCollector {
+	return &testCollector{acked: map[string]uint64{}, kick: make(chan struct{}, 1)}
+}
+
+func (c *testCollector) Stream(stream grpc.BidiStreamingServer[collectorv1.StreamRequest, collectorv1.StreamResponse]) error {
+	hello, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	id := hello.GetStreamId()
+	c.mu.Lock()
+	resume := c.acked[id]
+	c.mu.Unlock()
+	if err := stream.Send(&collectorv1.StreamResponse{Acknowledged: resume}); err != nil {
+		return err
+	}
+
+	requests := make(chan *collectorv1.StreamRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			requests <- request
+		}
+	}()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-c.kick:
+		case request := <-requests:
+			c.mu.Lock()
+			c.received++
+			if request.GetSequence() == c.acked[id]+1 {
+				c.acked[id] = request.GetSequence()
+				c.operations = append(c.operations, request.GetRecord().GetOperation())
+			}
+			broken := c.breakAt > 0 && c.received == c.breakAt
+			c.mu.Unlock()
+			if broken {
+				return status.Error(codes.Unavailable, "connection lost")
+			}
+		}
+
+		c.mu.Lock()
+		hold, ack := c.hold, c.acked[id]
+		c.mu.Unlock()
+		if !hold {
+			if err := stream.Send(&collectorv1.StreamResponse{Acknowledged: ack}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *testCollector) setHold(hold bool) {
+	c.mu.Lock()
+	c.hold = hold
+	c.mu.Unlock()
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (c *testCollector) snapshot() ([]string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.operations...), c.received
+}
+
+// serveCollector serves c on address, or on a new loopback port when address is empty
+func serveCollector(t *testing.T, c *testCollector, address string) (string, func()) {
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	collectorv1.RegisterAccessLogCollectorServer(server, c)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), server.Stop
+}
+
+func unusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	return address
+}
+
+func testCollectorOptions(address string) CollectorOptions {
+	opts := DefaultCollectorOptions(address)
+	opts.MinBackoff = 10 * time.Millisecond
+	opts.MaxBackoff = 50 * time.Millisecond
+	return opts
+}
+
+func sendOperations(t *testing.T, s Stream, from, to int) []string {
+	var operations []string
+	for i := from; i < to; i++ {
+		operation := fmt.Sprintf("op-%d", i)
+		require.NoError(t, s.Send(&events.AccessRecord{Operation: operation}))
+		operations = append(operations, operation)
+	}
+	return operations
+}
+
+func TestCollectorStream_DeliversInOrder(t *testing.T) {
+	c := newTestCollector()
+	address, _ := serveCollector(t, c, "")
+
+	s, err := NewCollectorFactory(testCollectorOptions(address)).NewStream()
+	require.NoError(t, err)
+	expected := sendOperations(t, s, 0, 100)
+	s.Close()
+
+	operations, _ := c.snapshot()
+	assert.Equal(t, expected, operations)
+	assert.Equal(t, CollectorStats{Acknowledged: 100}, s.(*CollectorStream).Stats())
+	assert.ErrorIs(t, s.Send(&events.AccessRecord{}), ErrStreamClosed)
+}
+
+func TestCollectorStream_Window(t *testing.T) {
+	c := newTestCollector()
+	c.setHold(true)
+	address, _ := serveCollector(t, c, "")
+
+	opts := testCollectorOptions(address)
+	opts.Window = 3
+	s, err := NewCollectorStream(opts)
+	require.NoError(t, err)
+	expected := sendOperations(t, s, 0, 10)
+
+	time.Sleep(100 * time.Millisecond)
+	_, received := c.snapshot()
+	assert.Equal(t, 3, received, "no more than the window is sent without acknowledgement")
+
+	c.setHold(false)
+	s.Close()
+	operations, _ := c.snapshot()
+	assert.Equal(t, expected, operations)
+}
+
+func TestCollectorStream_ResumesAfterReconnect(t *testing.T) {
+	c := newTestCollector()
+	c.breakAt = 5
+	c.setHold(true)
+	address, _ := serveCollector(t, c, "")
+
+	s, err := NewCollectorStream(testCollectorOptions(address))
+	require.NoError(t, err)
+	expected := sendOperations(t, s, 0, 20)
+	require.Eventually(t, func() bool {
+		return s.Stats().Reconnects > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c.setHold(false)
+	s.Close()
+	operations, received := c.snapshot()
+	assert.Equal(t, expected, operations)
+	assert.Equal(t, 20, received, "the collector acknowledged the first five records on resuming")
+	assert.Equal(t, uint64(20), s.Stats().Acknowledged)
+}
+
+func TestCollectorStream_SpoolsWhileUnavailable(t *testing.T) {
+	address := unusedAddress(t)
+	dir := t.TempDir()
+
+	opts := testCollectorOptions(address)
+	opts.BufferSize = 4
+	opts.SpoolDir = dir
+	s, err := NewCollectorStream(opts)
+	require.NoError(t, err)
+	expected := sendOperations(t, s, 0, 50)
+	assert.Equal(t, uint64(46), s.Stats().Spooled)
+	assert.NotEmpty(t, spoolFiles(t, dir))
+
+	c := newTestCollector()
+	serveCollector(t, c, address)
+	expected = append(expected, sendOperations(t, s, 50, 60)...)
+	s.Close()
+
+	operations, _ := c.snapshot()
+	assert.Equal(t, expected, operations)
+	assert.Empty(t, spoolFiles(t, dir))
+	assert.Zero(t, s.Stats().Dropped)
+}
+
+func TestCollectorStream_CloseKeepsUndeliveredRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := testCollectorOptions(unusedAddress(t))
+	opts.BufferSize = 4
+	opts.SpoolDir = dir
+	opts.FlushTimeout = 50 * time.Millisecond
+	s, err := NewCollectorStream(opts)
+	require.NoError(t, err)
+	expected := sendOperations(t, s, 0, 10)
+	s.Close()
+	assert.Zero(t, s.Stats().Dropped)
+
+	// a new stream sends what the last one could not
+	c := newTestCollector()
+	address, _ := serveCollector(t, c, "")
+	opts.Address = address
+	opts.FlushTimeout = 5 * time.Second
+	s, err = NewCollectorStream(opts)
+	require.NoError(t, err)
+	s.Close()
+
+	operations, _ := c.snapshot()
+	assert.ElementsMatch(t, expected, operations)
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestCollectorStream_DropsWhenFull(t *testing.T) {
+	opts := testCollectorOptions(unusedAddress(t))
+	opts.BufferSize = 2
+	opts.FlushTimeout = 10 * time.Millisecond
+	s, err := NewCollectorStream(opts)
+	require.NoError(t, err)
+
+	sendOperations(t, s, 0, 2)
+	assert.ErrorIs(t, s.Send(&events.AccessRecord{}), ErrBufferFull)
+	s.Close()
+	assert.Equal(t, uint64(3), s.Stats().Dropped)
+
+	_, err = NewCollectorStream(CollectorOptions{})
+	assert.Error(t, err)
+}
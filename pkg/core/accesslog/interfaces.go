@@ -16,6 +16,44 @@
 //   - [NewStdoutFactory]: Writes JSON records to stdout (default for development)
 //   - [NewIoWriterFactory]: Writes JSON records to any io.Writer
 //   - [NewNullFactory]: Discards all records (useful for testing or benchmarks)
+//   - [NewCollectorFactory]: Streams records to a remote collector over gRPC,
+//     spooling them to disk while it is unavailable
+//   - [NewChannelFactory]: Sends records to a buffered channel, for applications
+//     consuming decisions in-process
+//
+// Writers can wrap each record in a CloudEvents envelope for event routers by
+// setting [AccessLogOptions].CloudEvents.
+// An [Encoder], such as the CEF and LEEF encoders of [NewSIEMEncoder], renders
+// records in formats other than JSON.
+//
+// # Spooling
+//
+// [NewSpoolingFactory] wraps any factory with a write-ahead spool on disk, so that
+// records survive an unavailable sink, and a restart, until they are delivered.
+//
+// # Metrics
+//
+// [NewMetricsFactory] counts the decision of every record in a [DecisionMetrics], by labels
+// whose values are bounded by allowlists and hash buckets, for export to a monitoring system.
+//
+// # Subscriptions
+//
+// [NewBroadcastFactory] wraps any factory so that open [Subscription] instances also
+// receive its records. The policy engine wraps its access log this way, so that
+// applications can consume decisions in-process, alongside the access log, with
+// [core.PolicyEngine.Subscribe]:
+//
+//	sub := pe.Subscribe(1024)
+//	defer sub.Close()
+//	for record := range sub.C() {
+//	    ...
+//	}
+//
+// # Redaction
+//
+// A [Redactor], configured with [options.WithAuditRedactor], can remove or
+// obscure sensitive PORC fields before records are sent. [NewFieldRedactor]
+// strips or hashes fields by path.
 //
 // # Custom Implementations
 //
@@ -0,0 +1,453 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	bbolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// journalBucket is the bucket of the journal holding the records, keyed by time
+var journalBucket = []byte("records")
+
+// journalSeq orders the records of a process journaled in the same nanosecond
+var journalSeq atomic.Uint64
+
+// journalPruneInterval is the least time between two prunings of expired records
+const journalPruneInterval = time.Minute
+
+// JournalOptions configures a journaling stream created with [NewJournalingFactory].
+type JournalOptions struct {
+	// Path is the Bolt database file holding the journal. It is created if it does not exist.
+	Path string
+	// Retention is how long records are kept (0 = forever). Older records are pruned as new
+	// ones are written.
+	Retention time.Duration
+	// LockTimeout is how long a write, or a [ReadJournal], waits for another process
+	// reading or writing the journal.
+	LockTimeout time.Duration
+}
+
+// DefaultJournalOptions returns options for a journal at path, keeping records forever.
+func DefaultJournalOptions(path string) JournalOptions {
+	return JournalOptions{
+		Path:        path,
+		LockTimeout: 5 * time.Second,
+	}
+}
+
+// JournalStats reports the counters of a [JournalingStream].
+type JournalStats struct {
+	// Journaled is the number of records written to the journal.
+	Journaled uint64
+	// Failed is the number of records that could not be written to the journal.
+	Failed uint64
+}
+
+// JournalingFactory creates [JournalingStream] instances wrapping streams produced by
+// another [Factory].
+type JournalingFactory struct {
+	inner   Factory
+	options JournalOptions
+}
+
+// JournalingStream keeps every access record in a journal, an embedded Bolt database on
+// disk, before forwarding it to an underlying [Stream], so that decisions can be queried with
+// [ReadJournal] where no SIEM collects the access log, such as in air-gapped deployments.
+//
+// Send returns once the record is written to the journal. Records sent concurrently are
+// written together in a single transaction, and the journal is open only while it is written,
+// so that other processes, including other streams on the same file, may read or write it in
+// between.
+//
+// JournalingStream is safe for concurrent use.
+type JournalingStream struct {
+	inner   Stream
+	options JournalOptions
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu        sync.Mutex
+	pending   *journalBatch
+	closing   bool
+	lastPrune time.Time
+
+	journaled atomic.Uint64
+	failed    atomic.Uint64
+}
+
+type journalEntry struct {
+	key, value []byte
+}
+
+// journalBatch collects the records written in one transaction, and its outcome
+type journalBatch struct {
+	entries []journalEntry
+	done    chan struct{}
+	err     error
+}
+
+// NewJournalingFactory creates a [Factory] whose streams journal records before delegating
+// them to streams created by inner.
+//
+// Example: keep 30 days of decisions in a local journal:
+//
+//	opts := accesslog.DefaultJournalOptions("/var/lib/mpe/journal.db")
+//	opts.Retention = 30 * 24 * time.Hour
+//	factory := accesslog.NewJournalingFactory(accesslog.NewStdoutFactory(), opts)
+//	pe, _ := core.NewPolicyEngine(options.WithAccessLog(factory))
+func NewJournalingFactory(inner Factory, opts JournalOptions) Factory {
+	return &JournalingFactory{
+		inner:   inner,
+		options: opts,
+	}
+}
+
+// NewStream creates the underlying stream and wraps it in a [JournalingStream].
+func (f *JournalingFactory) NewStream() (Stream, error) {
+	s, err := f.inner.NewStream()
+	if err != nil {
+		return nil, err
+	}
+
+	journaling, err := NewJournalingStream(s, f.options)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return journaling, nil
+}
+
+// NewJournalingStream creates the journal if needed and starts writing records to it,
+// filling in defaults for any options left unset.
+//
+// Returns an error if the journal cannot be opened.
+func NewJournalingStream(inner Stream, opts JournalOptions) (*JournalingStream, error) {
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultJournalOptions(opts.Path).LockTimeout
+	}
+
+	s := &JournalingStream{
+		inner:   inner,
+		options: opts,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// open the journal at once, so that a misconfigured path fails the engine rather than its decisions
+	if err := s.write(nil, false); err != nil {
+		return nil, err
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Send writes the record to the journal, and forwards it to the underlying stream.
+//
+// Returns the error of the underlying stream, or else an error if the record could not be
+// written to the journal.
+func (s *JournalingStream) Send(record *events.AccessRecord) error {
+	jerr := s.journal(record)
+	if err := s.inner.Send(record); err != nil {
+		return err
+	}
+	return jerr
+}
+
+// journal adds the record to the pending batch, and waits for the batch to be written
+func (s *JournalingStream) journal(record *events.AccessRecord) error {
+	value, err := proto.Marshal(record)
+	if err != nil {
+		s.failed.Add(1)
+		return err
+	}
+	ts := time.Now()
+	if t := record.GetMetadata().GetTimestamp(); t != nil {
+		ts = t.AsTime()
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrStreamClosed
+	}
+	if s.pending == nil {
+		s.pending = &journalBatch{done: make(chan struct{})}
+	}
+	batch := s.pending
+	batch.entries = append(batch.entries, journalEntry{key: journalKey(ts, journalSeq.Add(1)), value: value})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	<-batch.done
+	return batch.err
+}
+
+// Close waits for the pending records to be written to the journal, then closes the
+// underlying stream.
+func (s *JournalingStream) Close() {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+	s.inner.Close()
+}
+
+// Stats returns the counters of the stream.
+func (s *JournalingStream) Stats() JournalStats {
+	return JournalStats{
+		Journaled: s.journaled.Load(),
+		Failed:    s.failed.Load(),
+	}
+}
+
+func (s *JournalingStream) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.stop:
+			s.flush()
+			return
+		case <-s.wake:
+			s.flush()
+		}
+	}
+}
+
+// flush writes the pending batch, while the records sent in the meantime form the next one
+func (s *JournalingStream) flush() {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if batch == nil {
+		return
+	}
+
+	prune := s.options.Retention > 0 && time.Since(s.lastPrune) >= journalPruneInterval
+	batch.err = s.write(batch.entries, prune)
+	if batch.err != nil {
+		s.failed.Add(uint64(len(batch.entries)))
+		logger.Warnf(agent, "journal", "failed to write %d access record(s) to the journal: %v", len(batch.entries), batch.err)
+	} else {
+		s.journaled.Add(uint64(len(batch.entries)))
+	}
+	close(batch.done)
+}
+
+// write opens the journal and writes the batch in a single transaction, pruning the expired
+// records if asked
+func (s *JournalingStream) write(batch []journalEntry, prune bool) error {
+	db, err := bbolt.Open(s.options.Path, 0600, &bbolt.Options{Timeout: s.options.LockTimeout})
+	if err != nil {
+		return fmt.Errorf("open journal %s: %w", s.options.Path, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(journalBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			if err := b.Put(e.key, e.value); err != nil {
+				return err
+			}
+		}
+		if prune {
+			return pruneJournal(b, time.Now().Add(-s.options.Retention))
+		}
+		return nil
+	})
+	if err == nil && prune {
+		s.lastPrune = time.Now()
+	}
+	return err
+}
+
+// pruneJournal deletes the records older than cutoff
+func pruneJournal(b *bbolt.Bucket, cutoff time.Time) error {
+	end := journalKey(cutoff, 0)
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalKey orders records by time, then by the order they were sent
+func journalKey(ts time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// JournalQuery selects the records read from a journal with [ReadJournal]. Fields left
+// empty select every record.
+type JournalQuery struct {
+	// Since and Until bound the time of the records, Since inclusive and Until exclusive.
+	Since, Until time.Time
+	// Decisions lists the decisions selected.
+	Decisions []events.AccessRecord_Decision
+	// Subject, Operation, and Resource match the principal's subject, the operation, and the
+	// resource of the records, as glob patterns such as "api:documents:*".
+	Subject, Operation, Resource string
+	// Limit selects only the most recent records matching the query (0 = unlimited).
+	Limit int
+}
+
+// Validate checks that the patterns of the query are well-formed.
+func (q JournalQuery) Validate() error {
+	for _, pattern := range []string{q.Subject, q.Operation, q.Resource} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the query selects the record, regardless of its time and the limit.
+func (q JournalQuery) Matches(record *events.AccessRecord) bool {
+	if len(q.Decisions) > 0 {
+		found := false
+		for _, d := range q.Decisions {
+			found = found || d == record.Decision
+		}
+		if !found {
+			return false
+		}
+	}
+	return match(q.Subject, record.GetPrincipal().GetSubject()) &&
+		match(q.Operation, record.Operation) &&
+		match(q.Resource, record.Resource)
+}
+
+func match(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// ReadJournal calls fn with each record of the journal at path selected by the query, in the
+// order they were journaled, waiting up to timeout for a process writing the journal.
+//
+// Returns an error if the journal does not exist or cannot be read, or the first error of fn.
+func ReadJournal(path string, query JournalQuery, timeout time.Duration, fn func(*events.AccessRecord) error) error {
+	if err := query.Validate(); err != nil {
+		return err
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return fmt.Errorf("open journal %s: %w", path, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	var records []*events.AccessRecord
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(journalBucket)
+		if b == nil {
+			return nil
+		}
+
+		start := []byte(nil)
+		if !query.Since.IsZero() {
+			start = journalKey(query.Since, 0)
+		}
+		var end []byte
+		if !query.Until.IsZero() {
+			end = journalKey(query.Until, 0)
+		}
+		inRange := func(k []byte) bool {
+			return k != nil && (start == nil || bytes.Compare(k, start) >= 0) && (end == nil || bytes.Compare(k, end) < 0)
+		}
+		decode := func(v []byte) (*events.AccessRecord, error) {
+			record := &events.AccessRecord{}
+			if err := proto.Unmarshal(v, record); err != nil {
+				return nil, fmt.Errorf("corrupt journal record: %w", err)
+			}
+			return record, nil
+		}
+
+		c := b.Cursor()
+		if query.Limit <= 0 {
+			k, v := c.First()
+			if start != nil {
+				k, v = c.Seek(start)
+			}
+			for ; inRange(k); k, v = c.Next() {
+				record, err := decode(v)
+				if err != nil {
+					return err
+				}
+				if query.Matches(record) {
+					if err := fn(record); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		// the most recent records are found by reading backwards from the end of the range
+		var k, v []byte
+		if end != nil {
+			if k, _ = c.Seek(end); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+		for ; inRange(k) && len(records) < query.Limit; k, v = c.Prev() {
+			record, err := decode(v)
+			if err != nil {
+				return err
+			}
+			if query.Matches(record) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		if err := fn(records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
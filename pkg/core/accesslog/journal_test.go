@@ -0,0 +1,131 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func journalRecord(ts time.Time, subject, operation string, decision events.AccessRecord_Decision) *events.AccessRecord {
+	return &events.AccessRecord{
+		Metadata:  &events.AccessRecord_Metadata{Timestamp: timestamppb.New(ts)},
+		Principal: &events.AccessRecord_Principal{Subject: subject},
+		Operation: operation,
+		Resource:  "mrn:app:document:" + operation,
+		Decision:  decision,
+	}
+}
+
+func readOperations(t *testing.T, path string, query JournalQuery) []string {
+	var operations []string
+	require.NoError(t, ReadJournal(path, query, time.Second, func(record *events.AccessRecord) error {
+		operations = append(operations, record.GetOperation())
+		return nil
+	}))
+	return operations
+}
+
+func TestJournalingStream_Query(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	inner := &flakyStream{}
+
+	s, err := NewJournalingFactory(&flakyFactory{stream: inner}, DefaultJournalOptions(path)).NewStream()
+	require.NoError(t, err)
+
+	base := time.Now().Add(-time.Hour)
+	grant, deny := events.AccessRecord_GRANT, events.AccessRecord_DENY
+	// records are journaled in the order of their time, not of their arrival
+	require.NoError(t, s.Send(journalRecord(base.Add(2*time.Minute), "alice", "op-2", deny)))
+	require.NoError(t, s.Send(journalRecord(base, "alice", "op-0", grant)))
+	require.NoError(t, s.Send(journalRecord(base.Add(time.Minute), "bob", "op-1", deny)))
+	require.NoError(t, s.Send(journalRecord(base.Add(3*time.Minute), "bob", "op-3", grant)))
+	s.Close()
+
+	assert.Equal(t, []string{"op-2", "op-0", "op-1", "op-3"}, inner.snapshot(), "records are forwarded to the underlying stream")
+	assert.True(t, inner.closed)
+	assert.Equal(t, JournalStats{Journaled: 4}, s.(*JournalingStream).Stats())
+
+	assert.Equal(t, []string{"op-0", "op-1", "op-2", "op-3"}, readOperations(t, path, JournalQuery{}))
+	assert.Equal(t, []string{"op-1", "op-2"}, readOperations(t, path, JournalQuery{Decisions: []events.AccessRecord_Decision{deny}}))
+	assert.Equal(t, []string{"op-1", "op-3"}, readOperations(t, path, JournalQuery{Subject: "bob"}))
+	assert.Equal(t, []string{"op-2"}, readOperations(t, path, JournalQuery{Subject: "a*", Resource: "mrn:app:document:op-[2-9]"}))
+	assert.Equal(t, []string{"op-1", "op-2"}, readOperations(t, path, JournalQuery{Since: base.Add(time.Minute), Until: base.Add(3 * time.Minute)}))
+	assert.Equal(t, []string{"op-2", "op-3"}, readOperations(t, path, JournalQuery{Limit: 2}))
+	assert.Equal(t, []string{"op-0", "op-2"}, readOperations(t, path, JournalQuery{Subject: "alice", Limit: 5}))
+	assert.Equal(t, []string{"op-1", "op-2"}, readOperations(t, path, JournalQuery{Until: base.Add(2*time.Minute + time.Second), Limit: 2}))
+	assert.Empty(t, readOperations(t, path, JournalQuery{Since: base.Add(time.Hour)}))
+
+	assert.ErrorContains(t, ReadJournal(path, JournalQuery{Operation: "["}, time.Second, nil), "invalid pattern")
+	assert.ErrorContains(t, ReadJournal(filepath.Join(t.TempDir(), "missing.db"), JournalQuery{}, time.Second, nil), "open journal")
+}
+
+func TestJournalingStream_ReadWhileOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	opts := DefaultJournalOptions(path)
+
+	s, err := NewJournalingStream(&flakyStream{}, opts)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// a second stream may journal to the same file
+	other, err := NewJournalingStream(&flakyStream{}, opts)
+	require.NoError(t, err)
+	defer other.Close()
+
+	require.NoError(t, s.Send(journalRecord(time.Now(), "alice", "op-0", events.AccessRecord_GRANT)))
+	require.NoError(t, other.Send(journalRecord(time.Now(), "bob", "op-1", events.AccessRecord_GRANT)))
+	assert.Equal(t, []string{"op-0", "op-1"}, readOperations(t, path, JournalQuery{}), "a sent record is readable at once")
+}
+
+func TestJournalingStream_Retention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	opts := DefaultJournalOptions(path)
+	opts.Retention = time.Hour
+
+	s, err := NewJournalingStream(&flakyStream{}, opts)
+	require.NoError(t, err)
+	require.NoError(t, s.Send(journalRecord(time.Now().Add(-2*time.Hour), "alice", "expired", events.AccessRecord_GRANT)))
+	require.NoError(t, s.Send(journalRecord(time.Now(), "alice", "kept", events.AccessRecord_GRANT)))
+	s.Close()
+
+	assert.Equal(t, []string{"kept"}, readOperations(t, path, JournalQuery{}))
+}
+
+func TestJournalingStream_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	inner := &flakyStream{}
+
+	s, err := NewJournalingStream(inner, DefaultJournalOptions(path))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sendOperations(t, s, i*25, (i+1)*25)
+		}(i)
+	}
+	wg.Wait()
+	s.Close()
+
+	assert.Len(t, inner.snapshot(), 200)
+	assert.Len(t, readOperations(t, path, JournalQuery{}), 200)
+	assert.Equal(t, JournalStats{Journaled: 200}, s.Stats())
+	assert.ErrorIs(t, s.Send(&events.AccessRecord{}), ErrStreamClosed)
+}
+
+func TestJournalingStream_InvalidPath(t *testing.T) {
+	_, err := NewJournalingStream(&flakyStream{}, DefaultJournalOptions(filepath.Join(t.TempDir(), "missing", "journal.db")))
+	assert.ErrorContains(t, err, "open journal")
+}
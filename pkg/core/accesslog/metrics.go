@@ -0,0 +1,248 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// Labels of the decision counters maintained by [DecisionMetrics]
+const (
+	MetricsLabelDecision  = "decision"
+	MetricsLabelRealm     = "realm"
+	MetricsLabelOperation = "operation"
+	MetricsLabelPrincipal = "principal"
+)
+
+// Values reported for a label whose value is not allowed, or is empty
+const (
+	MetricsValueOther = "other"
+	MetricsValueNone  = "none"
+)
+
+// MetricsLabelOptions bounds the values that a label of the decision counters may take, so
+// that breaking the counters down by realm, operation, or principal does not create a series
+// for every raw value.
+//
+// An entry of Allow matches a value equal to it, or a value that it prefixes up to a ':'
+// separator, and the value is then reported as the entry: "api:documents" reports both
+// "api:documents:read" and "api:documents:write" as "api:documents". Other values are reported
+// as one of Buckets hash buckets, such as "bucket-3", or as "other" if Buckets is zero.
+//
+// A label with neither Allow entries nor Buckets is not reported.
+type MetricsLabelOptions struct {
+	// Allow lists the values, or prefixes of values, reported as they are.
+	Allow []string
+	// Buckets is the number of hash buckets for the values not allowed.
+	Buckets int
+}
+
+// enabled reports whether the label is reported
+func (o MetricsLabelOptions) enabled() bool {
+	return len(o.Allow) > 0 || o.Buckets > 0
+}
+
+// value returns the reported value of a raw value
+func (o MetricsLabelOptions) value(raw string) string {
+	if raw == "" {
+		return MetricsValueNone
+	}
+
+	// the longest matching entry wins, so that specific entries may refine general ones
+	match := ""
+	for _, entry := range o.Allow {
+		if len(entry) > len(match) && (raw == entry || strings.HasPrefix(raw, entry+":")) {
+			match = entry
+		}
+	}
+	if match != "" {
+		return match
+	}
+
+	if o.Buckets > 0 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(raw))
+		return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(o.Buckets)) // #nosec G115 -- Buckets is positive
+	}
+	return MetricsValueOther
+}
+
+// MetricsOptions configures the labels of the decision counters maintained by
+// [DecisionMetrics]. Counters are always broken down by decision; the realm and subject of the
+// principal, and the operation, are only reported when configured.
+type MetricsOptions struct {
+	Realm     MetricsLabelOptions
+	Operation MetricsLabelOptions
+	Principal MetricsLabelOptions
+}
+
+// DecisionCount is the number of decisions observed with a combination of label values.
+type DecisionCount struct {
+	// Values holds the value of each label, in the order of [DecisionMetrics.Labels].
+	Values []string
+	Count  uint64
+}
+
+// DecisionMetrics counts decisions by a bounded set of labels, for export to a monitoring
+// system such as Prometheus.
+//
+// The number of series is at most the number of decisions times, for each reported label, the
+// number of Allow entries plus the number of buckets plus two. Raw MRNs, subjects, and
+// operations are never reported unless they are allowed.
+//
+// DecisionMetrics is safe for concurrent use.
+type DecisionMetrics struct {
+	options MetricsOptions
+	labels  []string
+
+	mu     sync.RWMutex
+	counts map[string]*decisionCounter
+}
+
+type decisionCounter struct {
+	values []string
+	count  atomic.Uint64
+}
+
+// NewDecisionMetrics creates a [DecisionMetrics] with the given labels.
+//
+// Returns an error if a number of buckets is negative.
+func NewDecisionMetrics(opts MetricsOptions) (*DecisionMetrics, error) {
+	m := &DecisionMetrics{
+		options: opts,
+		labels:  []string{MetricsLabelDecision},
+		counts:  make(map[string]*decisionCounter),
+	}
+	for _, label := range []struct {
+		name    string
+		options MetricsLabelOptions
+	}{
+		{MetricsLabelRealm, opts.Realm},
+		{MetricsLabelOperation, opts.Operation},
+		{MetricsLabelPrincipal, opts.Principal},
+	} {
+		if label.options.Buckets < 0 {
+			return nil, fmt.Errorf("%s buckets must not be negative, got %d", label.name, label.options.Buckets)
+		}
+		if label.options.enabled() {
+			m.labels = append(m.labels, label.name)
+		}
+	}
+	return m, nil
+}
+
+// Labels returns the names of the reported labels.
+func (m *DecisionMetrics) Labels() []string {
+	return append([]string(nil), m.labels...)
+}
+
+// Observe counts the decision of an access record.
+func (m *DecisionMetrics) Observe(record *events.AccessRecord) {
+	if record == nil {
+		return
+	}
+
+	values := make([]string, 0, len(m.labels))
+	values = append(values, record.GetDecision().String())
+	if m.options.Realm.enabled() {
+		values = append(values, m.options.Realm.value(record.GetPrincipal().GetRealm()))
+	}
+	if m.options.Operation.enabled() {
+		values = append(values, m.options.Operation.value(record.GetOperation()))
+	}
+	if m.options.Principal.enabled() {
+		values = append(values, m.options.Principal.value(record.GetPrincipal().GetSubject()))
+	}
+	key := strings.Join(values, "\x00")
+
+	m.mu.RLock()
+	counter, ok := m.counts[key]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if counter, ok = m.counts[key]; !ok {
+			counter = &decisionCounter{values: values}
+			m.counts[key] = counter
+		}
+		m.mu.Unlock()
+	}
+	counter.count.Add(1)
+}
+
+// Counts returns the number of decisions observed for each combination of label values,
+// ordered by their values.
+func (m *DecisionMetrics) Counts() []DecisionCount {
+	m.mu.RLock()
+	counts := make([]DecisionCount, 0, len(m.counts))
+	for _, counter := range m.counts {
+		counts = append(counts, DecisionCount{Values: counter.values, Count: counter.count.Load()})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		return strings.Join(counts[i].Values, "\x00") < strings.Join(counts[j].Values, "\x00")
+	})
+	return counts
+}
+
+// MetricsFactory creates [MetricsStream] instances wrapping streams produced by another [Factory].
+type MetricsFactory struct {
+	inner   Factory
+	metrics *DecisionMetrics
+}
+
+// MetricsStream counts the decision of every access record in a [DecisionMetrics] before
+// forwarding it to an underlying [Stream].
+//
+// MetricsStream is safe for concurrent use.
+type MetricsStream struct {
+	inner   Stream
+	metrics *DecisionMetrics
+}
+
+// NewMetricsFactory creates a [Factory] whose streams count each decision in metrics before
+// delegating to streams created by inner.
+//
+// Example: count decisions by realm and by the first two segments of the operation:
+//
+//	metrics, _ := accesslog.NewDecisionMetrics(accesslog.MetricsOptions{
+//	    Realm:     accesslog.MetricsLabelOptions{Allow: []string{"prod", "staging"}},
+//	    Operation: accesslog.MetricsLabelOptions{Allow: []string{"api:documents", "api:users"}},
+//	})
+//	factory := accesslog.NewMetricsFactory(accesslog.NewStdoutFactory(), metrics)
+func NewMetricsFactory(inner Factory, metrics *DecisionMetrics) Factory {
+	return &MetricsFactory{
+		inner:   inner,
+		metrics: metrics,
+	}
+}
+
+// NewStream creates the underlying stream and wraps it in a [MetricsStream].
+func (f *MetricsFactory) NewStream() (Stream, error) {
+	s, err := f.inner.NewStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetricsStream{inner: s, metrics: f.metrics}, nil
+}
+
+// Send counts the decision of the record and forwards it to the underlying stream.
+func (s *MetricsStream) Send(record *events.AccessRecord) error {
+	s.metrics.Observe(record)
+	return s.inner.Send(record)
+}
+
+// Close closes the underlying stream.
+func (s *MetricsStream) Close() {
+	s.inner.Close()
+}
@@ -0,0 +1,122 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metricsRecord(decision events.AccessRecord_Decision, realm, operation, subject string) *events.AccessRecord {
+	return &events.AccessRecord{
+		Decision:  decision,
+		Operation: operation,
+		Principal: &events.AccessRecord_Principal{Subject: subject, Realm: realm},
+	}
+}
+
+func TestMetricsLabelOptions_Value(t *testing.T) {
+	opts := MetricsLabelOptions{Allow: []string{"api", "api:documents", "prod"}}
+	assert.Equal(t, "prod", opts.value("prod"))
+	assert.Equal(t, "api:documents", opts.value("api:documents:read"))
+	assert.Equal(t, "api", opts.value("api:users:read"))
+	assert.Equal(t, MetricsValueOther, opts.value("production"))
+	assert.Equal(t, MetricsValueOther, opts.value("apis:read"))
+	assert.Equal(t, MetricsValueNone, opts.value(""))
+
+	opts = MetricsLabelOptions{Buckets: 4}
+	bucket := opts.value("mrn:iam:user:alice")
+	assert.Regexp(t, `^bucket-[0-3]$`, bucket)
+	assert.Equal(t, bucket, opts.value("mrn:iam:user:alice"), "buckets are stable")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		seen[opts.value(fmt.Sprintf("mrn:iam:user:%d", i))] = true
+	}
+	assert.Len(t, seen, 4)
+}
+
+func TestDecisionMetrics(t *testing.T) {
+	_, err := NewDecisionMetrics(MetricsOptions{Principal: MetricsLabelOptions{Buckets: -1}})
+	require.Error(t, err)
+
+	m, err := NewDecisionMetrics(MetricsOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{MetricsLabelDecision}, m.Labels())
+	m.Observe(metricsRecord(events.AccessRecord_GRANT, "prod", "api:documents:read", "alice"))
+	m.Observe(metricsRecord(events.AccessRecord_DENY, "prod", "api:documents:read", "bob"))
+	m.Observe(metricsRecord(events.AccessRecord_GRANT, "dev", "api:users:list", "carol"))
+	m.Observe(nil)
+	assert.Equal(t, []DecisionCount{
+		{Values: []string{"DENY"}, Count: 1},
+		{Values: []string{"GRANT"}, Count: 2},
+	}, m.Counts())
+
+	m, err = NewDecisionMetrics(MetricsOptions{
+		Realm:     MetricsLabelOptions{Allow: []string{"prod"}},
+		Operation: MetricsLabelOptions{Allow: []string{"api:documents"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{MetricsLabelDecision, MetricsLabelRealm, MetricsLabelOperation}, m.Labels())
+
+	inner := &countingStream{}
+	s, err := NewMetricsFactory(&staticFactory{stream: inner}, m).NewStream()
+	require.NoError(t, err)
+	for _, r := range []*events.AccessRecord{
+		metricsRecord(events.AccessRecord_GRANT, "prod", "api:documents:read", "alice"),
+		metricsRecord(events.AccessRecord_GRANT, "prod", "api:documents:write", "bob"),
+		metricsRecord(events.AccessRecord_DENY, "dev", "api:users:list", "carol"),
+		metricsRecord(events.AccessRecord_DENY, "", "api:documents:read", "dave"),
+	} {
+		require.NoError(t, s.Send(r))
+	}
+	s.Close()
+
+	assert.Len(t, inner.records, 4)
+	assert.True(t, inner.closed)
+	assert.Equal(t, []DecisionCount{
+		{Values: []string{"DENY", "none", "api:documents"}, Count: 1},
+		{Values: []string{"DENY", "other", "other"}, Count: 1},
+		{Values: []string{"GRANT", "prod", "api:documents"}, Count: 2},
+	}, m.Counts())
+}
+
+func TestDecisionMetrics_Concurrent(t *testing.T) {
+	m, err := NewDecisionMetrics(MetricsOptions{Principal: MetricsLabelOptions{Buckets: 8}})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Observe(metricsRecord(events.AccessRecord_GRANT, "", "", fmt.Sprintf("user-%d-%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var total uint64
+	for _, c := range m.Counts() {
+		total += c.Count
+	}
+	assert.Equal(t, uint64(800), total)
+	assert.LessOrEqual(t, len(m.Counts()), 8)
+}
+
+// staticFactory returns the same stream each time
+type staticFactory struct {
+	stream Stream
+}
+
+func (f *staticFactory) NewStream() (Stream, error) {
+	return f.stream, nil
+}
@@ -0,0 +1,240 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// Redactor removes or obscures sensitive content in an access record before
+// the record is sent to the access log.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+// Redact may modify the record in place. If Redact returns an error, the
+// policy engine removes the PORC and principal from the record before
+// sending it, so that a failed redaction never leaks the data it was meant
+// to protect.
+type Redactor interface {
+	Redact(record *events.AccessRecord) error
+}
+
+// RedactorFunc adapts an ordinary function to the [Redactor] interface.
+//
+// Example: drop the PORC from every record:
+//
+//	redactor := accesslog.RedactorFunc(func(record *events.AccessRecord) error {
+//	    record.Porc = ""
+//	    return nil
+//	})
+type RedactorFunc func(record *events.AccessRecord) error
+
+// Redact calls f(record).
+func (f RedactorFunc) Redact(record *events.AccessRecord) error {
+	return f(record)
+}
+
+// RedactionOptions configures the fields removed or hashed by a redactor
+// created with [NewFieldRedactor].
+//
+// Fields are addressed by dot-separated paths into the PORC, such as
+// "principal.email" or "resource.annotations.ssn". A "*" segment matches
+// every key of an object or every element of an array, so
+// "principal.mannotations.*" addresses every principal annotation.
+// Paths that do not exist in a given PORC are ignored.
+//
+// The access record's principal subject and realm are copies of
+// "principal.sub" and "principal.mrealm", and are redacted along with them.
+//
+// Hashed values are replaced with a string of the form "sha256:<hex>" that
+// is stable across records, so redacted values can still be correlated.
+// Since plain hashes of low-entropy values such as email addresses can be
+// reversed by guessing, setting HashKey is recommended: values are then
+// hashed with HMAC-SHA256 and prefixed "hmac-sha256:" instead.
+type RedactionOptions struct {
+	// Strip lists the paths of fields to remove.
+	Strip []string
+	// Hash lists the paths of fields to replace with a hash of their value.
+	Hash []string
+	// HashKey is an optional secret key for hashing with HMAC-SHA256.
+	HashKey []byte
+}
+
+// IsEmpty reports whether the options redact nothing, in which case a
+// redactor is unnecessary.
+func (o RedactionOptions) IsEmpty() bool {
+	return len(o.Strip) == 0 && len(o.Hash) == 0
+}
+
+type redactAction int
+
+const (
+	redactStrip redactAction = iota
+	redactHash
+)
+
+type redactionRule struct {
+	path   []string
+	action redactAction
+}
+
+// FieldRedactor is a [Redactor] that removes or hashes PORC fields by path.
+//
+// FieldRedactor is safe for concurrent use.
+type FieldRedactor struct {
+	rules   []redactionRule
+	hashKey []byte
+}
+
+// NewFieldRedactor creates a [FieldRedactor] from the given options.
+//
+// Example: hash the subject so decisions can still be correlated per user,
+// and remove the email claim and every resource annotation:
+//
+//	redactor, err := accesslog.NewFieldRedactor(accesslog.RedactionOptions{
+//	    Strip:   []string{"principal.email", "resource.annotations.*"},
+//	    Hash:    []string{"principal.sub"},
+//	    HashKey: key,
+//	})
+//	if err != nil {
+//	    return err
+//	}
+//	pe, _ := core.NewPolicyEngine(options.WithAuditRedactor(redactor))
+//
+// Returns an error if a path is empty or has an empty segment.
+func NewFieldRedactor(opts RedactionOptions) (*FieldRedactor, error) {
+	r := &FieldRedactor{hashKey: opts.HashKey}
+
+	add := func(paths []string, action redactAction) error {
+		for _, path := range paths {
+			segments := strings.Split(path, ".")
+			for _, segment := range segments {
+				if segment == "" {
+					return fmt.Errorf("invalid redaction path '%s'", path)
+				}
+			}
+			r.rules = append(r.rules, redactionRule{path: segments, action: action})
+		}
+		return nil
+	}
+
+	if err := add(opts.Strip, redactStrip); err != nil {
+		return nil, err
+	}
+	if err := add(opts.Hash, redactHash); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Redact applies the redactor's rules to the record's PORC, principal subject,
+// and principal realm.
+//
+// Returns an error if the record's PORC is not a JSON object.
+func (r *FieldRedactor) Redact(record *events.AccessRecord) error {
+	if record.Porc != "" {
+		dec := json.NewDecoder(strings.NewReader(record.Porc))
+		dec.UseNumber() // keep numbers as written
+
+		var porc map[string]interface{}
+		if err := dec.Decode(&porc); err != nil {
+			return fmt.Errorf("failed to parse PORC: %w", err)
+		}
+
+		for _, rule := range r.rules {
+			r.apply(porc, rule.path, rule.action)
+		}
+
+		data, err := json.Marshal(porc)
+		if err != nil {
+			return fmt.Errorf("failed to encode PORC: %w", err)
+		}
+		record.Porc = string(data)
+	}
+
+	if record.Principal != nil {
+		// the record's principal fields are copies of PORC fields, so apply the same rules
+		principal := map[string]interface{}{
+			"principal": map[string]interface{}{
+				"sub":    record.Principal.Subject,
+				"mrealm": record.Principal.Realm,
+			},
+		}
+		for _, rule := range r.rules {
+			r.apply(principal, rule.path, rule.action)
+		}
+
+		fields := principal["principal"].(map[string]interface{})
+		record.Principal.Subject, _ = fields["sub"].(string)
+		record.Principal.Realm, _ = fields["mrealm"].(string)
+	}
+
+	return nil
+}
+
+// apply redacts the fields of value addressed by path, returning the redacted value
+func (r *FieldRedactor) apply(value interface{}, path []string, action redactAction) interface{} {
+	segment, last := path[0], len(path) == 1
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if segment != "*" && segment != key {
+				continue
+			}
+			switch {
+			case !last:
+				v[key] = r.apply(child, path[1:], action)
+			case action == redactStrip:
+				delete(v, key)
+			default:
+				v[key] = r.hash(child)
+			}
+		}
+	case []interface{}:
+		if segment != "*" {
+			return v
+		}
+		if last && action == redactStrip {
+			return []interface{}{}
+		}
+		for i, child := range v {
+			if last {
+				v[i] = r.hash(child)
+			} else {
+				v[i] = r.apply(child, path[1:], action)
+			}
+		}
+	}
+
+	return value
+}
+
+// hash returns the hashed representation of a value. Strings are hashed as-is,
+// and other values by their JSON encoding.
+func (r *FieldRedactor) hash(value interface{}) string {
+	var data []byte
+	if s, ok := value.(string); ok {
+		data = []byte(s)
+	} else {
+		data, _ = json.Marshal(value)
+	}
+
+	if len(r.hashKey) > 0 {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write(data)
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const redactPorc = `{"principal":{"sub":"alice","mrealm":"acme","email":"alice@example.com","mannotations":{"ssn":"123-45-6789","level":3}},` +
+	`"operation":"api:doc:read","resource":{"id":"mrn:doc:1","annotations":{"ssn":"987-65-4321","tags":["a","b"]}},` +
+	`"context":{"items":[{"card":"4111","qty":1},{"card":"5500","qty":2}]}}`
+
+func redactRecord(t *testing.T, opts RedactionOptions) (*events.AccessRecord, map[string]interface{}) {
+	r, err := NewFieldRedactor(opts)
+	require.NoError(t, err)
+
+	record := &events.AccessRecord{
+		Porc:      redactPorc,
+		Principal: &events.AccessRecord_Principal{Subject: "alice", Realm: "acme"},
+	}
+	require.NoError(t, r.Redact(record))
+
+	var porc map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(record.Porc), &porc))
+	return record, porc
+}
+
+func TestFieldRedactor_Strip(t *testing.T) {
+	record, porc := redactRecord(t, RedactionOptions{
+		Strip: []string{"principal.email", "principal.mannotations.ssn", "principal.mrealm"},
+	})
+
+	principal := porc["principal"].(map[string]interface{})
+	assert.NotContains(t, principal, "email")
+	assert.NotContains(t, principal, "mrealm")
+	assert.Equal(t, map[string]interface{}{"level": float64(3)}, principal["mannotations"])
+	assert.Equal(t, "alice", principal["sub"])
+
+	// other fields with the same name are untouched
+	assert.Contains(t, record.Porc, "987-65-4321")
+
+	assert.Equal(t, "alice", record.Principal.Subject)
+	assert.Empty(t, record.Principal.Realm)
+}
+
+func TestFieldRedactor_Hash(t *testing.T) {
+	record, porc := redactRecord(t, RedactionOptions{
+		Hash: []string{"principal.sub", "principal.mannotations.level"},
+	})
+
+	principal := porc["principal"].(map[string]interface{})
+	sub := principal["sub"].(string)
+	assert.Equal(t, "sha256:2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90", sub)
+	assert.Equal(t, sub, record.Principal.Subject)
+	assert.Equal(t, "acme", record.Principal.Realm)
+
+	level := principal["mannotations"].(map[string]interface{})["level"].(string)
+	assert.True(t, strings.HasPrefix(level, "sha256:"))
+
+	// hashing is stable, so records can still be correlated
+	again, _ := redactRecord(t, RedactionOptions{Hash: []string{"principal.sub"}})
+	assert.Equal(t, sub, again.Principal.Subject)
+}
+
+func TestFieldRedactor_HashKey(t *testing.T) {
+	record, _ := redactRecord(t, RedactionOptions{Hash: []string{"principal.sub"}, HashKey: []byte("secret")})
+	assert.True(t, strings.HasPrefix(record.Principal.Subject, "hmac-sha256:"))
+
+	other, _ := redactRecord(t, RedactionOptions{Hash: []string{"principal.sub"}, HashKey: []byte("other")})
+	assert.NotEqual(t, record.Principal.Subject, other.Principal.Subject)
+}
+
+func TestFieldRedactor_Wildcards(t *testing.T) {
+	_, porc := redactRecord(t, RedactionOptions{
+		Strip: []string{"resource.annotations.*", "context.items.*.card"},
+		Hash:  []string{"principal.mannotations.*"},
+	})
+
+	resource := porc["resource"].(map[string]interface{})
+	assert.Empty(t, resource["annotations"])
+
+	items := porc["context"].(map[string]interface{})["items"].([]interface{})
+	require.Len(t, items, 2)
+	for _, item := range items {
+		assert.NotContains(t, item, "card")
+		assert.Contains(t, item, "qty")
+	}
+
+	for _, v := range porc["principal"].(map[string]interface{})["mannotations"].(map[string]interface{}) {
+		assert.True(t, strings.HasPrefix(v.(string), "sha256:"))
+	}
+}
+
+func TestFieldRedactor_StripArrayElements(t *testing.T) {
+	_, porc := redactRecord(t, RedactionOptions{Strip: []string{"resource.annotations.tags.*"}})
+
+	annotations := porc["resource"].(map[string]interface{})["annotations"].(map[string]interface{})
+	assert.Equal(t, []interface{}{}, annotations["tags"])
+}
+
+func TestFieldRedactor_MissingPath(t *testing.T) {
+	record, _ := redactRecord(t, RedactionOptions{Strip: []string{"principal.phone", "resource.id.nested"}})
+	assert.Contains(t, record.Porc, "mrn:doc:1")
+}
+
+func TestFieldRedactor_PreservesNumbers(t *testing.T) {
+	r, err := NewFieldRedactor(RedactionOptions{Strip: []string{"principal.sub"}})
+	require.NoError(t, err)
+
+	record := &events.AccessRecord{Porc: `{"context":{"id":12345678901234567890}}`}
+	require.NoError(t, r.Redact(record))
+	assert.Equal(t, `{"context":{"id":12345678901234567890}}`, record.Porc)
+}
+
+func TestFieldRedactor_InvalidPorc(t *testing.T) {
+	r, err := NewFieldRedactor(RedactionOptions{Strip: []string{"principal.sub"}})
+	require.NoError(t, err)
+
+	err = r.Redact(&events.AccessRecord{Porc: "not json"})
+	require.Error(t, err)
+}
+
+func TestNewFieldRedactor_InvalidPath(t *testing.T) {
+	_, err := NewFieldRedactor(RedactionOptions{Strip: []string{"principal..sub"}})
+	require.Error(t, err)
+
+	_, err = NewFieldRedactor(RedactionOptions{Hash: []string{""}})
+	require.Error(t, err)
+}
+
+func TestRedactionOptions_IsEmpty(t *testing.T) {
+	assert.True(t, RedactionOptions{}.IsEmpty())
+	assert.True(t, RedactionOptions{HashKey: []byte("key")}.IsEmpty())
+	assert.False(t, RedactionOptions{Strip: []string{"principal.email"}}.IsEmpty())
+}
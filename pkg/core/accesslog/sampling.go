@@ -0,0 +1,270 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// SamplingOptions configures which access records are emitted by a
+// sampling stream created with [NewSamplingFactory].
+//
+// Sampling is applied per decision outcome. A rate of 1.0 emits every
+// record, 0.0 emits none, and values in between emit the corresponding
+// fraction of records chosen at random. Records carrying a system override
+// (phase1 bypass) are always emitted when AlwaysLogOverrides is set,
+// regardless of the configured rates and rate limit. Records of decisions
+// made by a deny-list or break-glass override are always emitted, and are
+// not subject to rate limiting either.
+//
+// RateLimit caps the number of records forwarded to the underlying stream
+// per second, with Burst allowing short spikes above the steady-state rate.
+// A RateLimit of zero disables rate limiting.
+type SamplingOptions struct {
+	// GrantRate is the fraction (0.0-1.0) of GRANT decisions to emit.
+	GrantRate float64
+	// DenyRate is the fraction (0.0-1.0) of DENY decisions to emit.
+	DenyRate float64
+	// AlwaysLogOverrides emits system-override records irrespective of
+	// sampling and rate limiting.
+	AlwaysLogOverrides bool
+	// RateLimit is the maximum number of records per second (0 = unlimited).
+	RateLimit int
+	// Burst is the maximum number of records that may be emitted in a single
+	// burst when RateLimit is set. Defaults to RateLimit when zero.
+	Burst int
+	// Counters, if set, also counts the records of the stream, along with those
+	// of the other streams sharing them.
+	Counters *SamplingCounters
+}
+
+// DefaultSamplingOptions returns options that emit every record without
+// rate limiting, which matches the behavior of an unwrapped stream.
+func DefaultSamplingOptions() SamplingOptions {
+	return SamplingOptions{
+		GrantRate:          1.0,
+		DenyRate:           1.0,
+		AlwaysLogOverrides: true,
+	}
+}
+
+// IsPassthrough reports whether the options would emit every record, in
+// which case wrapping a stream is unnecessary.
+func (o SamplingOptions) IsPassthrough() bool {
+	return o.GrantRate >= 1.0 && o.DenyRate >= 1.0 && o.RateLimit <= 0
+}
+
+// SamplingStats reports the counters maintained by a [SamplingStream].
+type SamplingStats struct {
+	// Emitted is the number of records forwarded to the underlying stream.
+	Emitted uint64
+	// Sampled is the number of records dropped by sampling.
+	Sampled uint64
+	// RateLimited is the number of records dropped by the rate limiter.
+	RateLimited uint64
+}
+
+// SamplingCounters accumulates the [SamplingStats] of the sampling streams
+// sharing it, such as those of every engine of a server, so that they may be
+// reported as metrics. The zero value is ready to use.
+//
+// SamplingCounters is safe for concurrent use.
+type SamplingCounters struct {
+	emitted     atomic.Uint64
+	sampled     atomic.Uint64
+	rateLimited atomic.Uint64
+}
+
+// Stats returns a snapshot of the counters.
+func (c *SamplingCounters) Stats() SamplingStats {
+	return SamplingStats{
+		Emitted:     c.emitted.Load(),
+		Sampled:     c.sampled.Load(),
+		RateLimited: c.rateLimited.Load(),
+	}
+}
+
+// SamplingFactory creates [SamplingStream] instances wrapping streams
+// produced by another [Factory].
+type SamplingFactory struct {
+	inner   Factory
+	options SamplingOptions
+}
+
+// SamplingStream forwards a subset of access records to an underlying
+// [Stream] according to its [SamplingOptions].
+//
+// SamplingStream is safe for concurrent use.
+type SamplingStream struct {
+	inner   Stream
+	options SamplingOptions
+	limiter *tokenBucket
+	random  func() float64
+
+	stats    SamplingCounters
+	counters []*SamplingCounters // the stream's own, and the shared ones if any
+}
+
+// NewSamplingFactory creates a [Factory] whose streams apply sampling and
+// rate limiting before delegating to streams created by inner.
+//
+// Example: always log denials and overrides, sample 1% of grants, and never
+// emit more than 1000 records per second:
+//
+//	factory := accesslog.NewSamplingFactory(accesslog.NewStdoutFactory(), accesslog.SamplingOptions{
+//	    GrantRate:          0.01,
+//	    DenyRate:           1.0,
+//	    AlwaysLogOverrides: true,
+//	    RateLimit:          1000,
+//	})
+//	pe, _ := core.NewPolicyEngine(options.WithAccessLog(factory))
+func NewSamplingFactory(inner Factory, opts SamplingOptions) Factory {
+	return &SamplingFactory{
+		inner:   inner,
+		options: opts,
+	}
+}
+
+// NewStream creates the underlying stream and wraps it in a [SamplingStream].
+func (f *SamplingFactory) NewStream() (Stream, error) {
+	s, err := f.inner.NewStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSamplingStream(s, f.options), nil
+}
+
+// NewSamplingStream wraps an existing [Stream] with sampling and rate limiting.
+func NewSamplingStream(inner Stream, opts SamplingOptions) *SamplingStream {
+	s := &SamplingStream{
+		inner:   inner,
+		options: opts,
+		random:  rand.Float64,
+	}
+	s.counters = []*SamplingCounters{&s.stats}
+	if opts.Counters != nil {
+		s.counters = append(s.counters, opts.Counters)
+	}
+
+	if opts.RateLimit > 0 {
+		burst := opts.Burst
+		if burst <= 0 {
+			burst = opts.RateLimit
+		}
+		s.limiter = newTokenBucket(opts.RateLimit, burst, time.Now)
+	}
+
+	return s
+}
+
+// exempt reports whether a record is emitted whatever the sampling rates and
+// rate limit
+func (s *SamplingStream) exempt(record *events.AccessRecord) bool {
+	return record.Override != nil || (s.options.AlwaysLogOverrides && record.SystemOverride)
+}
+
+func (s *SamplingStream) keep(record *events.AccessRecord) bool {
+	if record == nil {
+		return false
+	}
+
+	if s.exempt(record) {
+		return true
+	}
+
+	rate := s.options.DenyRate
+	if record.Decision == events.AccessRecord_GRANT {
+		rate = s.options.GrantRate
+	}
+
+	switch {
+	case rate >= 1.0:
+		return true
+	case rate <= 0.0:
+		return false
+	default:
+		return s.random() < rate
+	}
+}
+
+// Send forwards the record to the underlying stream if it survives sampling
+// and rate limiting. Dropped records are counted but do not produce an error,
+// since dropping is the intended behavior rather than a delivery failure.
+func (s *SamplingStream) Send(record *events.AccessRecord) error {
+	if !s.keep(record) {
+		for _, c := range s.counters {
+			c.sampled.Add(1)
+		}
+		return nil
+	}
+
+	if s.limiter != nil && !s.exempt(record) && !s.limiter.allow() {
+		for _, c := range s.counters {
+			c.rateLimited.Add(1)
+		}
+		return nil
+	}
+
+	for _, c := range s.counters {
+		c.emitted.Add(1)
+	}
+	return s.inner.Send(record)
+}
+
+// Close closes the underlying stream.
+func (s *SamplingStream) Close() {
+	s.inner.Close()
+}
+
+// Stats returns a snapshot of the stream's emission counters.
+func (s *SamplingStream) Stats() SamplingStats {
+	return s.stats.Stats()
+}
+
+// tokenBucket is a minimal token-bucket rate limiter refilled continuously
+// at rate tokens per second up to capacity.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+func newTokenBucket(rate int, capacity int, now func() time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:     float64(rate),
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		last:     now(),
+		now:      now,
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.now()
+	elapsed := t.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = min(b.capacity, b.tokens+elapsed*b.rate)
+		b.last = t
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
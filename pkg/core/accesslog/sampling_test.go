@@ -0,0 +1,193 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStream struct {
+	records []*events.AccessRecord
+	closed  bool
+}
+
+func (c *countingStream) Send(record *events.AccessRecord) error {
+	c.records = append(c.records, record)
+	return nil
+}
+
+func (c *countingStream) Close() {
+	c.closed = true
+}
+
+func TestSamplingOptions_IsPassthrough(t *testing.T) {
+	assert.True(t, DefaultSamplingOptions().IsPassthrough())
+	assert.False(t, SamplingOptions{GrantRate: 0.5, DenyRate: 1.0}.IsPassthrough())
+	assert.False(t, SamplingOptions{GrantRate: 1.0, DenyRate: 1.0, RateLimit: 10}.IsPassthrough())
+}
+
+func TestSamplingStream_SamplesGrantsKeepsDenies(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, SamplingOptions{GrantRate: 0.0, DenyRate: 1.0})
+
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_DENY}))
+
+	assert.Len(t, inner.records, 1)
+	assert.Equal(t, events.AccessRecord_DENY, inner.records[0].Decision)
+	assert.Equal(t, SamplingStats{Emitted: 1, Sampled: 1}, s.Stats())
+}
+
+func TestSamplingStream_AlwaysLogOverrides(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, SamplingOptions{GrantRate: 0.0, DenyRate: 0.0, AlwaysLogOverrides: true})
+
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT, SystemOverride: true}))
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+
+	assert.Len(t, inner.records, 1)
+	assert.True(t, inner.records[0].SystemOverride)
+}
+
+func TestSamplingStream_AlwaysLogOverrides_RateLimit(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, SamplingOptions{GrantRate: 1.0, DenyRate: 1.0, AlwaysLogOverrides: true, RateLimit: 1})
+
+	now := time.Unix(1000, 0)
+	s.limiter = newTokenBucket(1, 1, func() time.Time { return now })
+
+	// saturate the bucket
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+	}
+	require.Len(t, inner.records, 1)
+
+	// system overrides are still emitted
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT, SystemOverride: true}))
+	require.Len(t, inner.records, 2)
+	assert.True(t, inner.records[1].SystemOverride)
+	assert.Equal(t, SamplingStats{Emitted: 2, RateLimited: 2}, s.Stats())
+
+	// but only when AlwaysLogOverrides is set
+	s.options.AlwaysLogOverrides = false
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT, SystemOverride: true}))
+	assert.Len(t, inner.records, 2)
+}
+
+func TestSamplingStream_FractionalRate(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, SamplingOptions{GrantRate: 0.5, DenyRate: 1.0})
+
+	// alternate the random source deterministically between 0.25 and 0.75
+	n := 0
+	s.random = func() float64 {
+		n++
+		if n%2 == 0 {
+			return 0.75
+		}
+		return 0.25
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+	}
+
+	assert.Len(t, inner.records, 5)
+	assert.Equal(t, uint64(5), s.Stats().Sampled)
+}
+
+func TestSamplingStream_NilRecord(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, DefaultSamplingOptions())
+
+	assert.NoError(t, s.Send(nil))
+	assert.Empty(t, inner.records)
+}
+
+func TestSamplingStream_RateLimit(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, SamplingOptions{GrantRate: 1.0, DenyRate: 1.0, RateLimit: 2})
+
+	now := time.Unix(1000, 0)
+	s.limiter = newTokenBucket(2, 2, func() time.Time { return now })
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_DENY}))
+	}
+	assert.Len(t, inner.records, 2)
+	assert.Equal(t, uint64(3), s.Stats().RateLimited)
+
+	// half a second refills one token
+	now = now.Add(500 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_DENY}))
+	}
+	assert.Len(t, inner.records, 3)
+	assert.Equal(t, uint64(5), s.Stats().RateLimited)
+}
+
+func TestSamplingStream_PrincipalOverrides(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, SamplingOptions{GrantRate: 0.0, DenyRate: 0.0, RateLimit: 1})
+
+	now := time.Unix(1000, 0)
+	s.limiter = newTokenBucket(1, 1, func() time.Time { return now })
+
+	// neither sampling nor the rate limit drop deny-list and break-glass decisions
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Send(&events.AccessRecord{
+			Decision:       events.AccessRecord_DENY,
+			SystemOverride: true,
+			Override:       &events.AccessRecord_Override{Id: "o1"},
+		}))
+	}
+	require.NoError(t, s.Send(&events.AccessRecord{Decision: events.AccessRecord_DENY, SystemOverride: true}))
+
+	assert.Len(t, inner.records, 3)
+	assert.Equal(t, SamplingStats{Emitted: 3, Sampled: 1}, s.Stats())
+}
+
+func TestSamplingStream_SharedCounters(t *testing.T) {
+	counters := &SamplingCounters{}
+	first := NewSamplingStream(&countingStream{}, SamplingOptions{GrantRate: 0.0, DenyRate: 1.0, Counters: counters})
+	second := NewSamplingStream(&countingStream{}, SamplingOptions{GrantRate: 1.0, DenyRate: 1.0, Counters: counters})
+
+	require.NoError(t, first.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+	require.NoError(t, first.Send(&events.AccessRecord{Decision: events.AccessRecord_DENY}))
+	require.NoError(t, second.Send(&events.AccessRecord{Decision: events.AccessRecord_GRANT}))
+
+	// each stream reports its own records, and the counters those of both
+	assert.Equal(t, SamplingStats{Emitted: 1, Sampled: 1}, first.Stats())
+	assert.Equal(t, SamplingStats{Emitted: 1}, second.Stats())
+	assert.Equal(t, SamplingStats{Emitted: 2, Sampled: 1}, counters.Stats())
+}
+
+func TestSamplingStream_Close(t *testing.T) {
+	inner := &countingStream{}
+	s := NewSamplingStream(inner, DefaultSamplingOptions())
+	s.Close()
+	assert.True(t, inner.closed)
+}
+
+func TestSamplingFactory_NewStream(t *testing.T) {
+	buf := &bytes.Buffer{}
+	factory := NewSamplingFactory(NewIoWriterFactory(buf), SamplingOptions{GrantRate: 0.0, DenyRate: 1.0})
+
+	stream, err := factory.NewStream()
+	require.NoError(t, err)
+	assert.IsType(t, &SamplingStream{}, stream)
+
+	require.NoError(t, stream.Send(&events.AccessRecord{Operation: "granted", Decision: events.AccessRecord_GRANT}))
+	require.NoError(t, stream.Send(&events.AccessRecord{Operation: "denied", Decision: events.AccessRecord_DENY}))
+
+	assert.NotContains(t, buf.String(), "granted")
+	assert.Contains(t, buf.String(), "denied")
+}
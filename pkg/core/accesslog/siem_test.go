@@ -0,0 +1,129 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func siemRecord() *events.AccessRecord {
+	return &events.AccessRecord{
+		Metadata: &events.AccessRecord_Metadata{
+			Id:            "7c1f2a4e",
+			CorrelationId: "req-1",
+			Timestamp:     timestamppb.New(time.Date(2026, 10, 16, 12, 30, 0, 250e6, time.UTC)),
+			EngineVersion: "v1.4.0",
+		},
+		Principal: &events.AccessRecord_Principal{Subject: "alice", Realm: "employees"},
+		Operation: "api:doc:read",
+		Resource:  "mrn:app:doc:a=b|c",
+		Decision:  events.AccessRecord_DENY,
+		Porc:      `{"principal":{"email":"alice@example.com","groups":["a","b"]}}`,
+	}
+}
+
+func TestSIEMEncoder_CEF(t *testing.T) {
+	e, err := NewSIEMEncoder(DefaultSIEMOptions(FormatCEF))
+	require.NoError(t, err)
+
+	out, err := e.Encode(siemRecord())
+	require.NoError(t, err)
+	assert.Equal(t, `CEF:0|Manetu|PolicyEngine|v1.4.0|DENY|Access denied|6|`+
+		`rt=1792153800250 externalId=7c1f2a4e suser=alice cs1=employees cs1Label=realm act=api:doc:read `+
+		`cs2=mrn:app:doc:a\=b|c cs2Label=resource outcome=DENY cs3=req-1 cs3Label=correlationId`, string(out))
+}
+
+func TestSIEMEncoder_LEEF(t *testing.T) {
+	e, err := NewSIEMEncoder(DefaultSIEMOptions(FormatLEEF))
+	require.NoError(t, err)
+
+	record := siemRecord()
+	record.Decision = events.AccessRecord_GRANT
+	record.Metadata.CorrelationId = ""
+	out, err := e.Encode(record)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"LEEF:2.0|Manetu|PolicyEngine|v1.4.0|GRANT|x09|sev=3",
+		"devTime=Oct 16 2026 12:30:00.250 UTC",
+		"externalId=7c1f2a4e",
+		"usrName=alice",
+		"realm=employees",
+		"action=api:doc:read",
+		"resource=mrn:app:doc:a=b|c",
+		"outcome=GRANT",
+	}, "\t"), string(out))
+}
+
+func TestSIEMEncoder_FieldMapping(t *testing.T) {
+	opts := DefaultSIEMOptions(FormatCEF)
+	opts.Vendor = "Ex|ample"
+	opts.Version = "2.0"
+	opts.DenySeverity = 9
+	opts.Fields = []SIEMField{
+		{Key: "suser", Field: "principal.subject"},
+		{Key: "cs1", Field: "porc.principal.email", Label: "email"},
+		{Key: "cs2", Field: "porc.principal.groups", Label: "groups"},
+		{Key: "cs3", Field: "porc.principal.missing", Label: "missing"},
+		{Key: "msg", Field: "porc"},
+	}
+	e, err := NewSIEMEncoder(opts)
+	require.NoError(t, err)
+
+	out, err := e.Encode(siemRecord())
+	require.NoError(t, err)
+	assert.Equal(t, `CEF:0|Ex\|ample|PolicyEngine|2.0|DENY|Access denied|9|`+
+		`suser=alice cs1=alice@example.com cs1Label=email cs2=["a","b"] cs2Label=groups `+
+		`msg={"principal":{"email":"alice@example.com","groups":["a","b"]}}`, string(out))
+}
+
+func TestSIEMEncoder_Escaping(t *testing.T) {
+	assert.Equal(t, `a\\b\=c\nd\re`, escapeCEFValue("a\\b=c\nd\re"))
+	assert.Equal(t, `a\|b\\c d`, escapeHeader("a|b\\c\nd"))
+	assert.Equal(t, "a b c d", escapeLEEFValue("a\tb\nc\rd"))
+}
+
+func TestNewSIEMEncoder_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*SIEMOptions)
+		errMsg string
+	}{
+		{"format", func(o *SIEMOptions) { o.Format = "syslog" }, "unsupported SIEM format 'syslog'"},
+		{"severity", func(o *SIEMOptions) { o.DenySeverity = 11 }, "invalid SIEM severity 11"},
+		{"key", func(o *SIEMOptions) { o.Fields = []SIEMField{{Key: "bad key", Field: "operation"}} }, "invalid SIEM key 'bad key'"},
+		{"field", func(o *SIEMOptions) { o.Fields = []SIEMField{{Key: "act"}} }, "SIEM key 'act' has no field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultSIEMOptions(FormatCEF)
+			tt.modify(&opts)
+			_, err := NewSIEMEncoder(opts)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestIoWriterStream_Encoder(t *testing.T) {
+	e, err := NewSIEMEncoder(DefaultSIEMOptions(FormatCEF))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	s := newStream(buf, AccessLogOptions{PrettyPrint: true, Encoder: e})
+	require.NoError(t, s.Send(siemRecord()))
+	require.NoError(t, s.Send(siemRecord()))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "CEF:0|"))
+}
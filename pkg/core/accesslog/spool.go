@@ -0,0 +1,264 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	spoolSuffix       = ".spool"
+	spoolSegmentBytes = 4 << 20
+	spoolRecordLimit  = 64 << 20
+)
+
+// ErrSpoolFull is returned when a record does not fit within the configured spool size.
+var ErrSpoolFull = errors.New("access log spool is full")
+
+// spool persists records, in order, to segment files in a directory.
+//
+// Records are read back in the order they were appended, each tagged with the sequence it
+// is given on the stream. A segment is only deleted once every record read from it has been
+// acknowledged, so records survive a restart until the collector has them; those that were
+// in flight are sent again. The segment being appended to is sealed before it is read, and
+// a new one started, so that reads never race with partial writes.
+//
+// spool is not safe for concurrent use.
+type spool struct {
+	dir      string
+	maxBytes int64
+	size     int64
+	unread   int
+	next     uint64
+
+	segments []*spoolSegment // unread segments, oldest first
+	drained  []*spoolSegment // segments fully read, awaiting acknowledgement
+	writer   *os.File
+	reader   *bufio.Reader
+	file     *os.File
+}
+
+type spoolSegment struct {
+	path    string
+	size    int64
+	records int
+	read    int
+	lastSeq uint64
+}
+
+// openSpool opens the spool in dir, creating the directory if needed, and recovers any
+// segments left behind by a previous stream.
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	s := &spool{dir: dir, maxBytes: maxBytes}
+	var names []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), spoolSuffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		names = append(names, entry.Name())
+		s.next = max(s.next, n+1)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		segment, err := recoverSegment(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if segment.records == 0 {
+			_ = os.Remove(segment.path)
+			continue
+		}
+		s.segments = append(s.segments, segment)
+		s.size += segment.size
+		s.unread += segment.records
+	}
+	return s, nil
+}
+
+// recoverSegment counts the records of a segment, truncating a partial record left by a crash
+func recoverSegment(path string) (*spoolSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	segment := &spoolSegment{path: path}
+	r := bufio.NewReader(f)
+	for {
+		data, err := readSpoolRecord(r)
+		if err != nil {
+			break
+		}
+		segment.records++
+		segment.size += int64(spoolRecordSize(len(data)))
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() != segment.size {
+		if err := os.Truncate(path, segment.size); err != nil {
+			return nil, fmt.Errorf("failed to truncate spool segment: %w", err)
+		}
+	}
+	return segment, nil
+}
+
+// append writes a record to the newest segment, starting a new one as needed.
+//
+// Returns [ErrSpoolFull] if the record would take the spool beyond its maximum size.
+func (s *spool) append(data []byte) error {
+	n := spoolRecordSize(len(data))
+	if s.maxBytes > 0 && s.size+int64(n) > s.maxBytes {
+		return ErrSpoolFull
+	}
+
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= spoolSegmentBytes {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 0, n)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	buf = append(buf, data...)
+	if _, err := s.writer.Write(buf); err != nil {
+		return fmt.Errorf("failed to write spool segment: %w", err)
+	}
+
+	segment := s.segments[len(s.segments)-1]
+	segment.size += int64(n)
+	segment.records++
+	s.size += int64(n)
+	s.unread++
+	return nil
+}
+
+func (s *spool) startSegment() error {
+	s.seal()
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.next, spoolSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	s.next++
+	s.writer = f
+	s.segments = append(s.segments, &spoolSegment{path: path})
+	return nil
+}
+
+// seal stops appending to the newest segment
+func (s *spool) seal() {
+	if s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+}
+
+// empty reports whether every appended record has been read
+func (s *spool) empty() bool {
+	return s.unread == 0
+}
+
+// read returns the oldest unread record, recording that it was given sequence seq.
+func (s *spool) read(seq uint64) ([]byte, error) {
+	for s.unread > 0 {
+		segment := s.segments[0]
+		if s.file == nil {
+			if len(s.segments) == 1 {
+				s.seal()
+			}
+			f, err := os.Open(segment.path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open spool segment: %w", err)
+			}
+			s.file = f
+			s.reader = bufio.NewReader(f)
+		}
+
+		data, err := readSpoolRecord(s.reader)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read spool segment: %w", err)
+		}
+		if err == nil {
+			segment.read++
+			segment.lastSeq = seq
+			s.unread--
+		}
+		if err != nil || segment.read == segment.records {
+			// a segment is sealed before it is read, so nothing more will be appended to it
+			_ = s.file.Close()
+			s.file = nil
+			s.reader = nil
+			s.segments = s.segments[1:]
+			s.drained = append(s.drained, segment)
+			s.unread -= segment.records - segment.read
+		}
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// release deletes the fully read segments whose records have all been acknowledged
+func (s *spool) release(acknowledged uint64) {
+	for len(s.drained) > 0 && s.drained[0].lastSeq <= acknowledged {
+		segment := s.drained[0]
+		_ = os.Remove(segment.path)
+		s.size -= segment.size
+		s.drained = s.drained[1:]
+	}
+}
+
+// close releases the open files, leaving unacknowledged records on disk for the next stream
+func (s *spool) close() {
+	s.seal()
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+func spoolRecordSize(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n)) + n
+}
+
+func readSpoolRecord(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > spoolRecordLimit {
+		return nil, fmt.Errorf("corrupt spool record of %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,106 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spoolFiles(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	return matches
+}
+
+func TestSpool_ReadsInOrderAndReleasesOnAcknowledgement(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 0)
+	require.NoError(t, err)
+	assert.True(t, s.empty())
+
+	require.NoError(t, s.append([]byte("one")))
+	require.NoError(t, s.append([]byte("two")))
+
+	data, err := s.read(1)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+
+	// appending while reading starts a new segment rather than extending the one being read
+	require.NoError(t, s.append([]byte("three")))
+	assert.Len(t, spoolFiles(t, dir), 2)
+
+	for seq, want := range []string{"two", "three"} {
+		data, err := s.read(uint64(seq + 2))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+	assert.True(t, s.empty())
+	_, err = s.read(4)
+	assert.ErrorIs(t, err, io.EOF)
+
+	s.release(1)
+	assert.Len(t, spoolFiles(t, dir), 2, "a segment is kept until all of its records are acknowledged")
+	s.release(2)
+	assert.Len(t, spoolFiles(t, dir), 1)
+	s.release(3)
+	assert.Empty(t, spoolFiles(t, dir))
+	assert.Zero(t, s.size)
+	s.close()
+}
+
+func TestSpool_RecoversUnacknowledgedRecords(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	_, err = s.read(1)
+	require.NoError(t, err)
+	s.close()
+
+	// simulate a crash part way through writing a record
+	f, err := os.OpenFile(spoolFiles(t, dir)[0], os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{10, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = openSpool(dir, 0)
+	require.NoError(t, err)
+	defer s.close()
+	for i := 0; i < 3; i++ {
+		data, err := s.read(uint64(i + 1))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record-%d", i), string(data))
+	}
+	assert.True(t, s.empty())
+
+	require.NoError(t, s.append([]byte("after")))
+	data, err := s.read(4)
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(data))
+}
+
+func TestSpool_MaxBytes(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 10)
+	require.NoError(t, err)
+	defer s.close()
+
+	require.NoError(t, s.append([]byte("12345678")))
+	assert.ErrorIs(t, s.append([]byte("x")), ErrSpoolFull)
+
+	_, err = s.read(1)
+	require.NoError(t, err)
+	s.release(1)
+	assert.NoError(t, s.append([]byte("x")), "acknowledged records no longer count toward the limit")
+}
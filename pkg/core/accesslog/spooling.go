@@ -0,0 +1,292 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// SpoolOptions configures a spooling stream created with [NewSpoolingFactory].
+type SpoolOptions struct {
+	// Dir is the directory holding the spool. Records left in it by a previous stream are
+	// delivered first.
+	Dir string
+	// MaxBytes caps the size of the spool (0 = unlimited). Records that do not fit are dropped.
+	MaxBytes int64
+	// MinBackoff is the delay before retrying a record the underlying stream failed to accept.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between retries, which doubles after each failure.
+	MaxBackoff time.Duration
+	// FlushTimeout is how long Close waits for the spool to drain. Records not delivered in
+	// time stay in the spool for the next stream.
+	FlushTimeout time.Duration
+}
+
+// DefaultSpoolOptions returns options for a spool in dir.
+func DefaultSpoolOptions(dir string) SpoolOptions {
+	return SpoolOptions{
+		Dir:          dir,
+		MaxBytes:     256 << 20,
+		MinBackoff:   100 * time.Millisecond,
+		MaxBackoff:   30 * time.Second,
+		FlushTimeout: 5 * time.Second,
+	}
+}
+
+// SpoolStats reports the counters and backlog of a [SpoolingStream].
+type SpoolStats struct {
+	// Spooled is the number of records written to the spool.
+	Spooled uint64
+	// Delivered is the number of records accepted by the underlying stream.
+	Delivered uint64
+	// Dropped is the number of records that did not fit in the spool.
+	Dropped uint64
+	// Retries is the number of times the underlying stream failed to accept a record.
+	Retries uint64
+	// Pending is the number of records in the spool awaiting delivery.
+	Pending int
+	// Bytes is the size of the spool on disk.
+	Bytes int64
+}
+
+// SpoolingFactory creates [SpoolingStream] instances wrapping streams produced
+// by another [Factory].
+type SpoolingFactory struct {
+	inner   Factory
+	options SpoolOptions
+}
+
+// SpoolingStream writes each access record to a spool on disk before delivering it
+// to an underlying [Stream] from a background goroutine.
+//
+// Send returns as soon as the record is spooled, so an unavailable or slow sink never
+// holds up decisions. A record the underlying stream fails to accept is retried, with
+// exponential backoff, until it succeeds; records are removed from the spool only once
+// delivered, and those left when the process stops are delivered by the next stream
+// opened on the same directory. Records are therefore delivered at least once: a record
+// delivered just before the process stopped may be delivered again.
+//
+// SpoolingStream is safe for concurrent use.
+type SpoolingStream struct {
+	inner   Stream
+	options SpoolOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	spool   *spool
+	nextSeq uint64
+	pending int
+	closing bool
+
+	spooled   atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	retries   atomic.Uint64
+}
+
+// NewSpoolingFactory creates a [Factory] whose streams spool records to disk before
+// delegating them to streams created by inner.
+//
+// Example: keep up to 1GiB of records while the sink is unavailable:
+//
+//	opts := accesslog.DefaultSpoolOptions("/var/spool/mpe")
+//	opts.MaxBytes = 1 << 30
+//	factory := accesslog.NewSpoolingFactory(sink, opts)
+//	pe, _ := core.NewPolicyEngine(options.WithAccessLog(factory))
+func NewSpoolingFactory(inner Factory, opts SpoolOptions) Factory {
+	return &SpoolingFactory{
+		inner:   inner,
+		options: opts,
+	}
+}
+
+// NewStream creates the underlying stream and wraps it in a [SpoolingStream].
+func (f *SpoolingFactory) NewStream() (Stream, error) {
+	s, err := f.inner.NewStream()
+	if err != nil {
+		return nil, err
+	}
+
+	spooling, err := NewSpoolingStream(s, f.options)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return spooling, nil
+}
+
+// NewSpoolingStream opens the spool and starts delivering its records to inner, filling
+// in defaults for any options left unset.
+func NewSpoolingStream(inner Stream, opts SpoolOptions) (*SpoolingStream, error) {
+	defaults := DefaultSpoolOptions(opts.Dir)
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaults.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaults.MaxBackoff, opts.MinBackoff)
+	}
+	if opts.FlushTimeout <= 0 {
+		opts.FlushTimeout = defaults.FlushTimeout
+	}
+
+	sp, err := openSpool(opts.Dir, opts.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SpoolingStream{
+		inner:   inner,
+		options: opts,
+		done:    make(chan struct{}),
+		spool:   sp,
+		nextSeq: 1,
+		pending: sp.unread,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.pending > 0 {
+		logger.Infof(agent, "spool", "replaying %d spooled access record(s) from %s", s.pending, opts.Dir)
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Send writes the record to the spool.
+//
+// Returns [ErrSpoolFull], or an error writing the spool, if the record is dropped.
+func (s *SpoolingStream) Send(record *events.AccessRecord) error {
+	data, err := proto.Marshal(record)
+	if err != nil {
+		s.dropped.Add(1)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return ErrStreamClosed
+	}
+	if err := s.spool.append(data); err != nil {
+		s.dropped.Add(1)
+		return err
+	}
+	s.pending++
+	s.spooled.Add(1)
+	s.cond.Broadcast()
+	return nil
+}
+
+// Close waits up to the flush timeout for the spool to drain, then closes the
+// underlying stream.
+func (s *SpoolingStream) Close() {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(s.options.FlushTimeout):
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spool.close()
+	s.inner.Close()
+	if s.pending > 0 {
+		logger.Warnf(agent, "close", "%d access record(s) remain in the spool at %s", s.pending, s.options.Dir)
+	}
+}
+
+// Stats returns a snapshot of the stream's counters and backlog.
+func (s *SpoolingStream) Stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SpoolStats{
+		Spooled:   s.spooled.Load(),
+		Delivered: s.delivered.Load(),
+		Dropped:   s.dropped.Load(),
+		Retries:   s.retries.Load(),
+		Pending:   s.pending,
+		Bytes:     s.spool.size,
+	}
+}
+
+// run delivers spooled records to the underlying stream until the spool is drained after
+// Close, or the flush timeout expires
+func (s *SpoolingStream) run() {
+	defer close(s.done)
+
+	var record *events.AccessRecord
+	backoff := s.options.MinBackoff
+	for {
+		s.mu.Lock()
+		for record == nil && s.spool.empty() && !s.closing {
+			s.cond.Wait()
+		}
+		if record == nil && s.spool.empty() {
+			s.mu.Unlock()
+			return
+		}
+		if record == nil {
+			data, err := s.spool.read(s.nextSeq)
+			if err != nil {
+				s.mu.Unlock()
+				logger.Errorf(agent, "spool", "failed to read access log spool: %v", err)
+				return
+			}
+			record = &events.AccessRecord{}
+			if err := proto.Unmarshal(data, record); err != nil {
+				logger.Errorf(agent, "spool", "discarding corrupt spooled access record: %v", err)
+				record = nil
+				s.pending--
+				s.spool.release(s.nextSeq)
+				s.nextSeq++
+				s.mu.Unlock()
+				continue
+			}
+		}
+		s.mu.Unlock()
+
+		if err := s.inner.Send(record); err != nil {
+			s.retries.Add(1)
+			logger.Warnf(agent, "spool", "access log stream failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, s.options.MaxBackoff)
+			continue
+		}
+		backoff = s.options.MinBackoff
+		record = nil
+		s.delivered.Add(1)
+
+		s.mu.Lock()
+		s.pending--
+		s.spool.release(s.nextSeq)
+		s.nextSeq++
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,150 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStream fails while down, and otherwise keeps the operation of each record
+type flakyStream struct {
+	mu         sync.Mutex
+	down       bool
+	failures   int
+	operations []string
+	closed     bool
+}
+
+func (f *flakyStream) Send(record *events.AccessRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down || f.failures > 0 {
+		f.failures = max(f.failures-1, 0)
+		return errors.New("sink unavailable")
+	}
+	f.operations = append(f.operations, record.GetOperation())
+	return nil
+}
+
+func (f *flakyStream) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+}
+
+func (f *flakyStream) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyStream) snapshot() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.operations...)
+}
+
+type flakyFactory struct {
+	stream *flakyStream
+}
+
+func (f *flakyFactory) NewStream() (Stream, error) {
+	return f.stream, nil
+}
+
+func testSpoolOptions(dir string) SpoolOptions {
+	opts := DefaultSpoolOptions(dir)
+	opts.MinBackoff = time.Millisecond
+	opts.MaxBackoff = 10 * time.Millisecond
+	return opts
+}
+
+func TestSpoolingStream_RetriesUntilDelivered(t *testing.T) {
+	dir := t.TempDir()
+	inner := &flakyStream{failures: 3}
+
+	s, err := NewSpoolingFactory(&flakyFactory{stream: inner}, testSpoolOptions(dir)).NewStream()
+	require.NoError(t, err)
+	expected := sendOperations(t, s, 0, 50)
+	s.Close()
+
+	assert.Equal(t, expected, inner.snapshot())
+	assert.True(t, inner.closed)
+	assert.Empty(t, spoolFiles(t, dir))
+	assert.Equal(t, SpoolStats{Spooled: 50, Delivered: 50, Retries: 3}, s.(*SpoolingStream).Stats())
+	assert.ErrorIs(t, s.Send(&events.AccessRecord{}), ErrStreamClosed)
+}
+
+func TestSpoolingStream_ReplaysOnRestart(t *testing.T) {
+	dir := t.TempDir()
+	inner := &flakyStream{down: true}
+
+	opts := testSpoolOptions(dir)
+	opts.FlushTimeout = 50 * time.Millisecond
+	s, err := NewSpoolingStream(inner, opts)
+	require.NoError(t, err)
+
+	start := time.Now()
+	expected := sendOperations(t, s, 0, 20)
+	assert.Less(t, time.Since(start), time.Second, "an unavailable sink does not hold up Send")
+
+	require.Eventually(t, func() bool {
+		return s.Stats().Retries > 0
+	}, 5*time.Second, 5*time.Millisecond)
+	stats := s.Stats()
+	assert.Equal(t, 20, stats.Pending)
+	assert.Positive(t, stats.Bytes)
+	s.Close()
+	assert.Empty(t, inner.snapshot())
+	assert.NotEmpty(t, spoolFiles(t, dir))
+
+	inner = &flakyStream{}
+	s, err = NewSpoolingStream(inner, testSpoolOptions(dir))
+	require.NoError(t, err)
+	expected = append(expected, sendOperations(t, s, 20, 30)...)
+	s.Close()
+
+	assert.Equal(t, expected, inner.snapshot())
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestSpoolingStream_RecoversAfterOutage(t *testing.T) {
+	inner := &flakyStream{down: true}
+	s, err := NewSpoolingStream(inner, testSpoolOptions(t.TempDir()))
+	require.NoError(t, err)
+
+	expected := sendOperations(t, s, 0, 10)
+	inner.setDown(false)
+	require.Eventually(t, func() bool {
+		return s.Stats().Pending == 0
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, expected, inner.snapshot())
+	s.Close()
+}
+
+func TestSpoolingStream_DropsWhenFull(t *testing.T) {
+	inner := &flakyStream{down: true}
+
+	opts := testSpoolOptions(t.TempDir())
+	opts.MaxBytes = 64
+	opts.FlushTimeout = 10 * time.Millisecond
+	s, err := NewSpoolingStream(inner, opts)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var sendErr error
+	for i := 0; i < 10 && sendErr == nil; i++ {
+		sendErr = s.Send(&events.AccessRecord{Operation: "platform:resource:read"})
+	}
+	assert.ErrorIs(t, sendErr, ErrSpoolFull)
+	assert.Equal(t, uint64(1), s.Stats().Dropped)
+}
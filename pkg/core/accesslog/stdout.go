@@ -19,6 +19,20 @@ type AccessLogOptions struct {
 	// PrettyPrint enables indented multi-line JSON output.
 	// When false (default), output is compact single-line JSON.
 	PrettyPrint bool
+
+	// CloudEvents, when set, wraps each record in a CloudEvents envelope
+	// (see [CloudEvent]). When nil (default), records are written as is.
+	CloudEvents *CloudEventsOptions
+
+	// Encoder, when set, renders each record in place of the JSON encoding,
+	// such as the CEF or LEEF formats of a [NewSIEMEncoder]. PrettyPrint and
+	// CloudEvents do not apply.
+	Encoder Encoder
+}
+
+// Encoder renders an access record as a single line of text.
+type Encoder interface {
+	Encode(record *events.AccessRecord) ([]byte, error)
 }
 
 // IoWriterFactory creates [Stream] instances that write to an [io.Writer].
@@ -107,38 +121,45 @@ func newStream(w io.Writer, opts AccessLogOptions) Stream {
 // improved readability. Output format is controlled by AccessLogOptions:
 // - PrettyPrint=false (default): compact single-line JSON
 // - PrettyPrint=true: indented multi-line JSON
+// - CloudEvents set: the record is the data of a CloudEvents envelope
+// - Encoder set: the record is written in the encoder's format instead of JSON
 //
 // Write errors are silently ignored as stdout writes rarely fail, and the
 // policy engine should not fail authorization decisions due to logging issues.
 func (s *IoWriterStream) Send(record *events.AccessRecord) error {
+	if s.options.Encoder != nil {
+		output, err := s.options.Encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(s.writer, string(output))
+		return nil
+	}
+
 	// Marshal protobuf to JSON bytes
 	jsonBytes, err := s.codec.Marshal(record)
 	if err != nil {
 		return err
 	}
 
-	// Unmarshal to generic map so we can manipulate the porc field
-	var data map[string]interface{}
-	if err := json.Unmarshal(jsonBytes, &data); err != nil {
+	data, err := recordMap(jsonBytes)
+	if err != nil {
 		// Fall back to original output if we can't parse
 		_, _ = fmt.Fprintln(s.writer, string(jsonBytes))
 		return nil
 	}
 
-	// Expand porc field from JSON string to object if present
-	if porcStr, ok := data["porc"].(string); ok {
-		var porcData interface{}
-		if err := json.Unmarshal([]byte(porcStr), &porcData); err == nil {
-			data["porc"] = porcData
-		}
+	var out interface{} = data
+	if s.options.CloudEvents != nil {
+		out = NewCloudEvent(record, data, *s.options.CloudEvents)
 	}
 
 	// Re-encode with appropriate formatting
 	var output []byte
 	if s.options.PrettyPrint {
-		output, err = json.MarshalIndent(data, "", "  ")
+		output, err = json.MarshalIndent(out, "", "  ")
 	} else {
-		output, err = json.Marshal(data)
+		output, err = json.Marshal(out)
 	}
 	if err != nil {
 		// Fall back to original output if re-encoding fails
@@ -155,3 +176,20 @@ func (s *IoWriterStream) Send(record *events.AccessRecord) error {
 // The underlying writer is not closed by this method; the caller is responsible
 // for closing the writer if needed (except for stdout, which should not be closed).
 func (s *IoWriterStream) Close() {}
+
+// recordMap decodes the JSON encoding of a record into a generic map, expanding the porc field
+// from its JSON string representation into an object when possible
+func recordMap(jsonBytes []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &data); err != nil {
+		return nil, err
+	}
+
+	if porcStr, ok := data["porc"].(string); ok {
+		var porcData interface{}
+		if err := json.Unmarshal([]byte(porcStr), &porcData); err == nil {
+			data["porc"] = porcData
+		}
+	}
+	return data, nil
+}
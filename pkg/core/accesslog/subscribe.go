@@ -0,0 +1,144 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// BroadcastFactory creates [BroadcastStream] instances that forward every access
+// record to a stream created by another [Factory], and to each open [Subscription].
+//
+// Subscriptions may be opened and closed at any time, so that an application can
+// observe the decisions of a running engine, such as to display them live or to
+// assert on them in a test, without replacing its access log.
+type BroadcastFactory struct {
+	inner Factory
+
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	count         atomic.Int32 // len(subscriptions), read without the lock
+}
+
+// BroadcastStream forwards records to an underlying [Stream] and to the
+// subscriptions of its [BroadcastFactory].
+//
+// BroadcastStream is safe for concurrent use.
+type BroadcastStream struct {
+	inner   Stream
+	factory *BroadcastFactory
+}
+
+// Subscription receives the access records sent after it was opened with
+// [BroadcastFactory.Subscribe], until it is closed.
+//
+// Records are shared with the access log and the other subscribers, and must not
+// be modified.
+type Subscription struct {
+	ch      chan *events.AccessRecord
+	factory *BroadcastFactory
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// NewBroadcastFactory creates a [BroadcastFactory] whose streams delegate to streams
+// created by inner.
+//
+// The policy engine wraps its access log in a BroadcastFactory, so applications
+// usually subscribe with [core.PolicyEngine.Subscribe] rather than create one.
+func NewBroadcastFactory(inner Factory) *BroadcastFactory {
+	return &BroadcastFactory{
+		inner:         inner,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe opens a [Subscription] buffering up to size records. Records sent while
+// the buffer is full are dropped for this subscription and counted by
+// [Subscription.Dropped], so that a slow subscriber never delays decisions.
+//
+// Close the subscription when it is no longer needed.
+func (f *BroadcastFactory) Subscribe(size int) *Subscription {
+	if size < 0 {
+		size = 0
+	}
+	s := &Subscription{ch: make(chan *events.AccessRecord, size), factory: f}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscriptions[s] = struct{}{}
+	f.count.Add(1)
+	return s
+}
+
+// NewStream creates the underlying stream and wraps it in a [BroadcastStream].
+func (f *BroadcastFactory) NewStream() (Stream, error) {
+	s, err := f.inner.NewStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BroadcastStream{inner: s, factory: f}, nil
+}
+
+// Send forwards the record to the underlying stream, then a clone of it to each
+// subscription, as the engine reuses the record.
+//
+// Returns the error of the underlying stream; subscriptions never fail.
+func (s *BroadcastStream) Send(record *events.AccessRecord) error {
+	err := s.inner.Send(record)
+
+	f := s.factory
+	if f.count.Load() == 0 {
+		return err
+	}
+
+	record = proto.Clone(record).(*events.AccessRecord)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for sub := range f.subscriptions {
+		select {
+		case sub.ch <- record:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+	return err
+}
+
+// Close closes the underlying stream. Subscriptions stay open until they are closed.
+func (s *BroadcastStream) Close() {
+	s.inner.Close()
+}
+
+// C returns the channel receiving the records. It is closed by [Subscription.Close].
+func (s *Subscription) C() <-chan *events.AccessRecord {
+	return s.ch
+}
+
+// Dropped returns the number of records dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription and closes its channel, after which the records
+// still buffered can be drained. Closing a subscription more than once is harmless.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		f := s.factory
+		f.mu.Lock()
+		delete(f.subscriptions, s)
+		f.count.Add(-1)
+		f.mu.Unlock()
+
+		close(s.ch)
+	})
+}
@@ -0,0 +1,84 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package accesslog
+
+import (
+	"sync"
+	"testing"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drain(sub *Subscription) []string {
+	var ops []string
+	for record := range sub.C() {
+		ops = append(ops, record.Operation)
+	}
+	return ops
+}
+
+func TestBroadcastFactory(t *testing.T) {
+	inner := NewChannelFactory(10)
+	factory := NewBroadcastFactory(inner)
+	stream, err := factory.NewStream()
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Send(&events.AccessRecord{Operation: "before"}))
+
+	a := factory.Subscribe(10)
+	b := factory.Subscribe(1)
+	require.NoError(t, stream.Send(&events.AccessRecord{Operation: "first"}))
+	require.NoError(t, stream.Send(&events.AccessRecord{Operation: "second"}))
+
+	b.Close()
+	b.Close()
+	require.NoError(t, stream.Send(&events.AccessRecord{Operation: "third"}))
+	stream.Close()
+
+	select {
+	case <-a.C():
+	default:
+		t.Fatal("the records of the subscription were lost")
+	}
+	a.Close()
+
+	assert.Equal(t, []string{"second", "third"}, drain(a), "subscriptions outlive the stream")
+	assert.Equal(t, uint64(0), a.Dropped())
+	assert.Equal(t, []string{"first"}, drain(b))
+	assert.Equal(t, uint64(1), b.Dropped(), "records beyond the buffer are dropped")
+
+	var ops []string
+	for record := range inner.C() {
+		ops = append(ops, record.Operation)
+	}
+	assert.Equal(t, []string{"before", "first", "second", "third"}, ops, "the underlying stream receives every record")
+}
+
+func TestBroadcastFactory_Concurrent(t *testing.T) {
+	factory := NewBroadcastFactory(NewNullFactory())
+	stream, err := factory.NewStream()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = stream.Send(&events.AccessRecord{})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				factory.Subscribe(5).Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(0), factory.count.Load())
+}
@@ -0,0 +1,115 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	betesting "github.com/manetu/policyengine/pkg/core/backend/testing"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/stretchr/testify/require"
+)
+
+// annotationCounts are the numbers of annotations on each of the principal, its role, and the
+// resource group of the allocation benchmarks and budgets
+var annotationCounts = []int{0, 16, 64}
+
+// allocBudgets are the allocations a single Authorize may make with each of annotationCounts
+// annotations, measured with the null access log. They are about 25% above the allocations
+// measured when they were set, so that a change growing them markedly fails
+// TestAuthorize_AllocationBudget. Lower them when a change reduces the allocations, and raise
+// them only for a change that is worth the cost; see the performance notes of the Go library
+// documentation.
+var allocBudgets = map[int]float64{
+	0:  925,
+	16: 3550,
+	64: 11300,
+}
+
+// newAllocEngine returns an engine deciding with annotations annotations on the principal, its
+// role, and the resource group, and a PORC granted by it
+func newAllocEngine(tb testing.TB, annotations int) (core.PolicyEngine, string) {
+	role, group := []betesting.Option{}, []betesting.Option{betesting.Default()}
+	mannotations := make(map[string]interface{}, annotations)
+	for i := 0; i < annotations; i++ {
+		key := fmt.Sprintf("key%d", i)
+		role = append(role, betesting.Annotation(key, fmt.Sprintf("role-%d", i)))
+		group = append(group, betesting.Annotation(key, []interface{}{"group", i}))
+		mannotations[key] = map[string]interface{}{"value": i}
+	}
+
+	const allow = "mrn:iam:policy:allow"
+	b := betesting.New().
+		WithPolicyRego(allow, betesting.AllowAllRego).
+		WithPolicyRego("mrn:iam:policy:operate", betesting.DeferRego).
+		WithOperation("^api:documents:.*", "mrn:iam:policy:operate").
+		WithRole("mrn:iam:role:editor", allow, role...).
+		WithResourceGroup("mrn:iam:resource-group:default", allow, group...)
+
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(tb, err)
+
+	porc, err := json.Marshal(map[string]interface{}{
+		"principal": map[string]interface{}{"sub": "alice", "mrealm": "acme", "mroles": []string{"mrn:iam:role:editor"}, "mannotations": mannotations},
+		"operation": "api:documents:read",
+		"resource":  "mrn:app:document:1",
+	})
+	require.NoError(tb, err)
+
+	allowed, err := pe.Authorize(context.Background(), string(porc))
+	require.NoError(tb, err)
+	require.True(tb, allowed)
+	return pe, string(porc)
+}
+
+// BenchmarkAuthorize_Annotations measures the time and allocations of a decision as the
+// annotations of the principal, its role, and the resource group grow
+func BenchmarkAuthorize_Annotations(b *testing.B) {
+	for _, n := range annotationCounts {
+		b.Run(fmt.Sprintf("annotations=%d", n), func(b *testing.B) {
+			pe, porc := newAllocEngine(b, n)
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := pe.Authorize(ctx, porc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestAuthorize_AllocationBudget fails when a decision allocates more than its budget in
+// allocBudgets
+func TestAuthorize_AllocationBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocation budgets are not checked in short mode")
+	}
+	if raceEnabled {
+		t.Skip("the race detector adds allocations")
+	}
+
+	for _, n := range annotationCounts {
+		t.Run(fmt.Sprintf("annotations=%d", n), func(t *testing.T) {
+			pe, porc := newAllocEngine(t, n)
+			ctx := context.Background()
+
+			allocs := testing.AllocsPerRun(50, func() {
+				_, _ = pe.Authorize(ctx, porc)
+			})
+			t.Logf("%.0f allocations per decision with %d annotations (budget %.0f)", allocs, n, allocBudgets[n])
+			if allocs > allocBudgets[n] {
+				t.Errorf("Authorize made %.0f allocations with %d annotations, above its budget of %.0f", allocs, n, allocBudgets[n])
+			}
+		})
+	}
+}
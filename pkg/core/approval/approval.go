@@ -0,0 +1,230 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package approval provides dual-control approval of sensitive operations.
+//
+// An operation declared with requires-approval in its policy domain is granted only
+// once enough other principals have approved the request:
+//
+//	operations:
+//	  - name: delete-tenant
+//	    selector: ["admin:tenant:delete"]
+//	    policy: "mrn:iam:policy:admin"
+//	    requires-approval: 2
+//
+// When the policies grant such an operation, the engine decides it PENDING rather
+// than GRANT, opens a [Request] for the subject, operation, and resource, and hands
+// it to the [Notifier] given with options.WithApprovalNotifier, so that approvers
+// can be asked. Approvers record their approval through the policy engine:
+//
+//	r, err := pe.Approve(requestID, "bob@example.com")
+//
+// Once the request has as many approvers as the operation requires, the subject
+// repeats the request with the request's ID as context.approval, and the policies
+// granting it are enough. An approved request is redeemed by the first GRANT it
+// enables, so that each approval enables a single operation.
+//
+// # Auditing
+//
+// Every decision of an operation that requires approval records the request's ID,
+// the number of approvers required, and those who approved it in the access record.
+// Such decisions are never reported as cacheable (see model.CacheHint).
+package approval
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultTTL is how long a [Request] may be approved and redeemed when no TTL is configured.
+const DefaultTTL = time.Hour
+
+// Request is a request of a subject to perform an operation that requires approval.
+//
+// Fields:
+//   - ID: Identifies the request, presented as context.approval once approved
+//   - Subject: The principal's sub claim
+//   - Operation: The operation requested
+//   - Resource: The MRN of the resource of the operation
+//   - Required: The number of approvers the operation requires
+//   - Approvers: The subjects who approved the request, in order
+//   - Created: When the request was opened
+//   - Expires: When the request can no longer be approved or redeemed
+type Request struct {
+	ID        string    `json:"id"`
+	Subject   string    `json:"subject"`
+	Operation string    `json:"operation"`
+	Resource  string    `json:"resource"`
+	Required  int       `json:"required"`
+	Approvers []string  `json:"approvers,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Approved reports whether the request has as many approvers as it requires.
+func (r *Request) Approved() bool {
+	return len(r.Approvers) >= r.Required
+}
+
+// matches reports whether the request is for the subject's operation on the resource
+// and has not expired at the given time.
+func (r *Request) matches(subject, operation, resource string, now time.Time) bool {
+	return r.Subject == subject && r.Operation == operation && r.Resource == resource && r.Expires.After(now)
+}
+
+// Notifier is told of each [Request] opened, such as to ask its approvers.
+//
+// Implementations must be safe for concurrent use, and should return promptly, as
+// they are called while deciding the request. A failure is logged and does not
+// change the decision.
+type Notifier interface {
+	Notify(ctx context.Context, request Request) error
+}
+
+// NotifierFunc adapts a function to a [Notifier].
+type NotifierFunc func(ctx context.Context, request Request) error
+
+// Notify implements [Notifier].
+func (f NotifierFunc) Notify(ctx context.Context, request Request) error {
+	return f(ctx, request)
+}
+
+// Store holds the approval requests of a policy engine.
+//
+// Store is safe for concurrent use. Expired and redeemed requests are removed as new
+// requests are opened.
+type Store struct {
+	mu       sync.RWMutex
+	ttl      time.Duration
+	requests map[string]*Request
+}
+
+// NewStore creates an empty [Store] whose requests expire after ttl, [DefaultTTL] if
+// not positive.
+func NewStore(ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{ttl: ttl, requests: make(map[string]*Request)}
+}
+
+// Open returns the pending request of the subject for the operation on the resource,
+// opening one requiring the given number of approvers if there is none. The second
+// result is true if the request was opened.
+func (s *Store) Open(subject, operation, resource string, required int, now time.Time) (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, r := range s.requests {
+		if !r.Expires.After(now) {
+			delete(s.requests, id)
+			continue
+		}
+		if r.matches(subject, operation, resource, now) {
+			return r.clone(), false
+		}
+	}
+
+	r := &Request{
+		ID:        uuid.New().String(),
+		Subject:   subject,
+		Operation: operation,
+		Resource:  resource,
+		Required:  required,
+		Created:   now,
+		Expires:   now.Add(s.ttl),
+	}
+	s.requests[r.ID] = r
+	return r.clone(), true
+}
+
+// Approve records the approval of the request with the given ID by approver, and
+// returns the request.
+//
+// Returns an error if the request does not exist or has expired, or if the approver
+// is its subject or has already approved it.
+func (s *Store) Approve(id, approver string, now time.Time) (Request, error) {
+	if approver == "" {
+		return Request{}, fmt.Errorf("approval of request '%s' requires an approver", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.requests[id]
+	if !ok || !r.Expires.After(now) {
+		return Request{}, fmt.Errorf("approval request '%s' does not exist or has expired", id)
+	}
+	if approver == r.Subject {
+		return Request{}, fmt.Errorf("'%s' cannot approve their own request '%s'", approver, id)
+	}
+	if slices.Contains(r.Approvers, approver) {
+		return Request{}, fmt.Errorf("'%s' has already approved request '%s'", approver, id)
+	}
+	r.Approvers = append(r.Approvers, approver)
+
+	return r.clone(), nil
+}
+
+// Check returns the request with the given ID if it is approved and was opened for the
+// subject's operation on the resource.
+func (s *Store) Check(id, subject, operation, resource string, now time.Time) (Request, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.requests[id]
+	if !ok || !r.matches(subject, operation, resource, now) || !r.Approved() {
+		return Request{}, false
+	}
+	return r.clone(), true
+}
+
+// Redeem removes and returns the request with the given ID if it is approved and was
+// opened for the subject's operation on the resource. A request is redeemed once.
+func (s *Store) Redeem(id, subject, operation, resource string, now time.Time) (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.requests[id]
+	if !ok || !r.matches(subject, operation, resource, now) || !r.Approved() {
+		return Request{}, false
+	}
+	delete(s.requests, id)
+	return r.clone(), true
+}
+
+// List returns the requests that have not expired, ordered by creation.
+func (s *Store) List() []Request {
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Request, 0, len(s.requests))
+	for _, r := range s.requests {
+		if r.Expires.After(now) {
+			result = append(result, r.clone())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Created.Equal(result[j].Created) {
+			return result[i].Created.Before(result[j].Created)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// clone copies the request, so that callers never share its approvers
+func (r *Request) clone() Request {
+	c := *r
+	c.Approvers = slices.Clone(r.Approvers)
+	return c
+}
@@ -0,0 +1,134 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package approval
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_OpenReusesPending(t *testing.T) {
+	s := NewStore(0)
+	now := time.Now()
+
+	r, opened := s.Open("alice", "admin:delete", "mrn:app:tenant:1", 2, now)
+	require.True(t, opened)
+	assert.NotEmpty(t, r.ID)
+	assert.Equal(t, 2, r.Required)
+	assert.Equal(t, now.Add(DefaultTTL), r.Expires)
+
+	again, opened := s.Open("alice", "admin:delete", "mrn:app:tenant:1", 2, now.Add(time.Minute))
+	assert.False(t, opened)
+	assert.Equal(t, r, again)
+
+	other, opened := s.Open("alice", "admin:delete", "mrn:app:tenant:2", 2, now)
+	assert.True(t, opened)
+	assert.NotEqual(t, r.ID, other.ID)
+
+	// an expired request is replaced
+	later, opened := s.Open("alice", "admin:delete", "mrn:app:tenant:1", 2, now.Add(2*DefaultTTL))
+	assert.True(t, opened)
+	assert.NotEqual(t, r.ID, later.ID)
+}
+
+func TestStore_Approve(t *testing.T) {
+	s := NewStore(time.Minute)
+	now := time.Now()
+	r, _ := s.Open("alice", "admin:delete", "mrn:app:tenant:1", 2, now)
+
+	tests := []struct {
+		name     string
+		id       string
+		approver string
+		at       time.Time
+		errMsg   string
+	}{
+		{"missing approver", r.ID, "", now, "requires an approver"},
+		{"unknown request", "unknown", "bob", now, "does not exist or has expired"},
+		{"own request", r.ID, "alice", now, "cannot approve their own request"},
+		{"expired request", r.ID, "bob", now.Add(time.Hour), "does not exist or has expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Approve(tt.id, tt.approver, tt.at)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+
+	approved, err := s.Approve(r.ID, "bob", now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, approved.Approvers)
+	assert.False(t, approved.Approved())
+
+	_, err = s.Approve(r.ID, "bob", now)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has already approved")
+
+	approved, err = s.Approve(r.ID, "carol", now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob", "carol"}, approved.Approvers)
+	assert.True(t, approved.Approved())
+
+	// the returned request does not share the store's approvers
+	approved.Approvers[0] = "mallory"
+	assert.Equal(t, []string{"bob", "carol"}, s.List()[0].Approvers)
+}
+
+func TestStore_Redeem(t *testing.T) {
+	s := NewStore(time.Minute)
+	now := time.Now()
+	r, _ := s.Open("alice", "admin:delete", "mrn:app:tenant:1", 1, now)
+
+	_, ok := s.Check(r.ID, "alice", "admin:delete", "mrn:app:tenant:1", now)
+	assert.False(t, ok, "not yet approved")
+	_, ok = s.Redeem(r.ID, "alice", "admin:delete", "mrn:app:tenant:1", now)
+	assert.False(t, ok, "not yet approved")
+
+	_, err := s.Approve(r.ID, "bob", now)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name                         string
+		subject, operation, resource string
+		at                           time.Time
+	}{
+		{"other subject", "mallory", "admin:delete", "mrn:app:tenant:1", now},
+		{"other operation", "alice", "admin:read", "mrn:app:tenant:1", now},
+		{"other resource", "alice", "admin:delete", "mrn:app:tenant:2", now},
+		{"expired", "alice", "admin:delete", "mrn:app:tenant:1", now.Add(time.Hour)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := s.Redeem(r.ID, tt.subject, tt.operation, tt.resource, tt.at)
+			assert.False(t, ok)
+		})
+	}
+
+	checked, ok := s.Check(r.ID, "alice", "admin:delete", "mrn:app:tenant:1", now)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"bob"}, checked.Approvers)
+
+	redeemed, ok := s.Redeem(r.ID, "alice", "admin:delete", "mrn:app:tenant:1", now)
+	assert.True(t, ok)
+	assert.Equal(t, r.ID, redeemed.ID)
+
+	_, ok = s.Redeem(r.ID, "alice", "admin:delete", "mrn:app:tenant:1", now)
+	assert.False(t, ok, "a request is redeemed once")
+	assert.Empty(t, s.List())
+}
+
+func TestStore_List(t *testing.T) {
+	s := NewStore(time.Hour)
+	now := time.Now()
+
+	second, _ := s.Open("bob", "admin:delete", "mrn:app:tenant:1", 1, now.Add(time.Second))
+	first, _ := s.Open("alice", "admin:delete", "mrn:app:tenant:1", 1, now)
+	s.Open("carol", "admin:delete", "mrn:app:tenant:1", 1, now.Add(-2*time.Hour))
+
+	assert.Equal(t, []Request{first, second}, s.List())
+}
@@ -0,0 +1,478 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package cache provides a backend that caches the lookups of another backend.
+//
+// Remote backends, such as those backed by a database or a gRPC service, would
+// otherwise be consulted on every authorization request, even though the same
+// principals present the same roles and groups over and over. The caching
+// backend remembers the roles, groups, scopes, and resource groups returned by
+// the wrapped backend for a configurable time to live (TTL).
+//
+// Resources, operations, and mappers are always looked up in the wrapped
+// backend, since they are matched by pattern rather than identified by MRN.
+//
+// # Negative Caching
+//
+// Lookups that fail because the entity does not exist (NOTFOUND_ERROR) are
+// cached too, for a shorter TTL (see [WithNegativeTTL]), so that a burst of
+// requests carrying the same unknown role does not reach the wrapped backend
+// once per request. Other failures are never cached.
+//
+// # Metrics
+//
+// [Factory.Stats] reports the number of lookups served from the cache and from
+// the wrapped backend, from which the hit rate can be exported to a metrics
+// system:
+//
+//	stats := factory.Stats()
+//	hitRate.Set(stats.HitRate())
+//
+// # Usage
+//
+//	factory := cache.NewFactory(remote.NewFactory(cfg), cache.WithTTL(30*time.Second))
+//	pe, err := core.NewPolicyEngine(options.WithBackend(factory))
+//
+// # Invalidation
+//
+// Entries expire after the TTL. When an entity changes in the wrapped backend,
+// call [Factory.Invalidate] with its MRN, or [Factory.InvalidateAll], to drop
+// the cached copy immediately:
+//
+//	factory.Invalidate("mrn:iam:role:admin")
+//
+// If the wrapped backend implements [backend.BundleInfoProvider], the cache is
+// also cleared whenever the bundle revision changes, such as after
+// [registry.Registry.UpdateDomain].
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+const (
+	// DefaultTTL is the time an entry is cached unless configured with [WithTTL].
+	DefaultTTL = time.Minute
+
+	// DefaultNegativeTTL is the time a NOTFOUND result is cached unless configured with
+	// [WithNegativeTTL].
+	DefaultNegativeTTL = 5 * time.Second
+
+	// DefaultMaxEntries is the number of entries cached unless configured with [WithMaxEntries].
+	DefaultMaxEntries = 10000
+)
+
+// entity kinds, which scope cache entries since MRNs are only unique per kind
+const (
+	kindRole          = "role"
+	kindGroup         = "group"
+	kindScope         = "scope"
+	kindResourceGroup = "resource-group"
+)
+
+// Factory creates caching [Backend] instances around another [backend.Factory].
+//
+// The cache is owned by the factory, so [Factory.Invalidate] applies to every
+// backend it creates.
+type Factory struct {
+	inner       backend.Factory
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	now         func() time.Time
+
+	hits         atomic.Uint64
+	negativeHits atomic.Uint64
+	misses       atomic.Uint64
+
+	mu         sync.Mutex
+	entries    map[string]map[entryKey]entry // MRN -> entries for each kind and tenant
+	size       int
+	generation uint64 // advanced by every invalidation
+	revision   uint64 // bundle revision the entries were fetched from
+}
+
+// Option is a functional option for configuring a [Factory].
+type Option func(*Factory)
+
+// WithTTL sets how long lookups are cached. A TTL of zero or less caches
+// entries until they are invalidated.
+func WithTTL(ttl time.Duration) Option {
+	return func(f *Factory) {
+		f.ttl = ttl
+	}
+}
+
+// WithNegativeTTL sets how long NOTFOUND results are cached. A TTL of zero or less
+// disables negative caching.
+//
+// Keep the negative TTL short: an entity created in the wrapped backend is not
+// found through the cache until its NOTFOUND result expires or is invalidated.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(f *Factory) {
+		f.negativeTTL = ttl
+	}
+}
+
+// WithMaxEntries bounds the number of cached entries. When the cache is full,
+// expired entries are removed, and lookups are not cached until there is room.
+func WithMaxEntries(maxEntries int) Option {
+	return func(f *Factory) {
+		f.maxEntries = maxEntries
+	}
+}
+
+type entryKey struct {
+	kind   string
+	tenant string
+}
+
+type entry struct {
+	value   interface{}
+	err     *common.PolicyError // set for a cached NOTFOUND result
+	expires time.Time           // zero if the entry does not expire
+}
+
+// Stats reports the lookups handled by a [Factory] since it was created.
+type Stats struct {
+	// Hits counts lookups answered with a cached entity.
+	Hits uint64
+	// NegativeHits counts lookups answered with a cached NOTFOUND result.
+	NegativeHits uint64
+	// Misses counts lookups passed to the wrapped backend.
+	Misses uint64
+}
+
+// HitRate returns the fraction of lookups answered from the cache, including
+// NOTFOUND results, or zero if there have been no lookups.
+func (s Stats) HitRate() float64 {
+	total := s.Hits + s.NegativeHits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.NegativeHits) / float64(total)
+}
+
+// NegativeHitRate returns the fraction of lookups answered with a cached NOTFOUND
+// result, or zero if there have been no lookups.
+func (s Stats) NegativeHitRate() float64 {
+	total := s.Hits + s.NegativeHits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.NegativeHits) / float64(total)
+}
+
+// NewFactory creates a [Factory] that caches the lookups of the backends created by inner.
+func NewFactory(inner backend.Factory, opts ...Option) *Factory {
+	f := &Factory{
+		inner:       inner,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		maxEntries:  DefaultMaxEntries,
+		now:         time.Now,
+		entries:     make(map[string]map[entryKey]entry),
+	}
+	for _, o := range opts {
+		o(f)
+	}
+
+	return f
+}
+
+// NewBackend creates the wrapped backend and returns a [Backend] caching its lookups.
+//
+// Returns an error if the wrapped backend cannot be created.
+func (f *Factory) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
+	inner, err := f.inner.NewBackend(compiler)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{inner: inner, cache: f}, nil
+}
+
+// Invalidate drops the cached entries for an MRN, for every entity kind and tenant.
+func (f *Factory) Invalidate(mrn string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.size -= len(f.entries[mrn])
+	delete(f.entries, mrn)
+	f.generation++
+}
+
+// InvalidateAll drops every cached entry.
+func (f *Factory) InvalidateAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.clear()
+}
+
+// Len returns the number of cached entries, including any that have expired
+// but not yet been removed.
+func (f *Factory) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.size
+}
+
+// Stats returns the number of lookups served from the cache and from the wrapped backend.
+func (f *Factory) Stats() Stats {
+	return Stats{
+		Hits:         f.hits.Load(),
+		NegativeHits: f.negativeHits.Load(),
+		Misses:       f.misses.Load(),
+	}
+}
+
+func (f *Factory) clear() {
+	f.entries = make(map[string]map[entryKey]entry)
+	f.size = 0
+	f.generation++
+}
+
+// get returns the cached entry for an entity, and the cache generation to pass to put
+// when the entity must be fetched
+func (f *Factory) get(mrn string, key entryKey, revision uint64) (entry, uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if revision != f.revision {
+		f.clear()
+		f.revision = revision
+	}
+
+	e, ok := f.entries[mrn][key]
+	if !ok {
+		return entry{}, f.generation, false
+	}
+	if !e.expires.IsZero() && !f.now().Before(e.expires) {
+		f.remove(mrn, key)
+		return entry{}, f.generation, false
+	}
+
+	return e, f.generation, true
+}
+
+// put caches a fetched entry for the given TTL, unless the cache was invalidated since the
+// fetch began
+func (f *Factory) put(mrn string, key entryKey, e entry, ttl time.Duration, generation uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if generation != f.generation {
+		return // the value may predate the invalidation
+	}
+
+	if _, ok := f.entries[mrn][key]; !ok {
+		if f.size >= f.maxEntries {
+			f.removeExpired()
+			if f.size >= f.maxEntries {
+				return
+			}
+		}
+		if f.entries[mrn] == nil {
+			f.entries[mrn] = make(map[entryKey]entry)
+		}
+		f.size++
+	}
+
+	if ttl > 0 {
+		e.expires = f.now().Add(ttl)
+	}
+	f.entries[mrn][key] = e
+}
+
+func (f *Factory) remove(mrn string, key entryKey) {
+	delete(f.entries[mrn], key)
+	if len(f.entries[mrn]) == 0 {
+		delete(f.entries, mrn)
+	}
+	f.size--
+}
+
+func (f *Factory) removeExpired() {
+	now := f.now()
+	for mrn, entries := range f.entries {
+		for key, e := range entries {
+			if !e.expires.IsZero() && !now.Before(e.expires) {
+				f.remove(mrn, key)
+			}
+		}
+	}
+}
+
+// Backend implements [backend.Service] by caching the lookups of another backend.
+//
+// Backend also implements [backend.BundleInfoProvider], [backend.WarmUpper],
+// [backend.HealthChecker], [backend.BypassRuleProvider], [backend.ImpersonationRuleProvider],
+// [backend.OperationLister], [backend.DomainDefaultsProvider], and
+// [backend.ResourceGroupAssigner] when the wrapped backend does.
+type Backend struct {
+	inner backend.Service
+	cache *Factory
+}
+
+// lookup returns a cached entity, or fetches and caches it. Lookups are cached per tenant,
+// since backends with tenancy support restrict what each tenant can see.
+func lookup[T any](ctx context.Context, b *Backend, kind string, mrn string, fetch func(context.Context, string) (*T, *common.PolicyError)) (*T, *common.PolicyError) {
+	key := entryKey{kind: kind, tenant: backend.TenantFromContext(ctx)}
+
+	var revision uint64
+	if info := b.GetBundleInfo(); info != nil {
+		revision = info.Revision
+	}
+
+	cached, generation, ok := b.cache.get(mrn, key, revision)
+	switch {
+	case ok && cached.err != nil:
+		b.cache.negativeHits.Add(1)
+		copied := *cached.err // callers may modify the error
+		return nil, &copied
+	case ok:
+		b.cache.hits.Add(1)
+		return cached.value.(*T), nil
+	}
+
+	b.cache.misses.Add(1)
+	value, err := fetch(ctx, mrn)
+	switch {
+	case err == nil:
+		b.cache.put(mrn, key, entry{value: value}, b.cache.ttl, generation)
+	case err.ReasonCode == events.AccessRecord_BundleReference_NOTFOUND_ERROR && b.cache.negativeTTL > 0:
+		copied := *err
+		b.cache.put(mrn, key, entry{err: &copied}, b.cache.negativeTTL, generation)
+	}
+
+	return value, err
+}
+
+// GetRole implements [backend.Service], caching the result.
+func (b *Backend) GetRole(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, kindRole, mrn, b.inner.GetRole)
+}
+
+// GetGroup implements [backend.Service], caching the result.
+func (b *Backend) GetGroup(ctx context.Context, mrn string) (*model.Group, *common.PolicyError) {
+	return lookup(ctx, b, kindGroup, mrn, b.inner.GetGroup)
+}
+
+// GetScope implements [backend.Service], caching the result.
+func (b *Backend) GetScope(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, kindScope, mrn, b.inner.GetScope)
+}
+
+// GetResourceGroup implements [backend.Service], caching the result.
+func (b *Backend) GetResourceGroup(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, kindResourceGroup, mrn, b.inner.GetResourceGroup)
+}
+
+// GetResource implements [backend.Service] by delegating to the wrapped backend.
+func (b *Backend) GetResource(ctx context.Context, mrn string) (*model.Resource, *common.PolicyError) {
+	return b.inner.GetResource(ctx, mrn)
+}
+
+// GetOperation implements [backend.Service] by delegating to the wrapped backend.
+func (b *Backend) GetOperation(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return b.inner.GetOperation(ctx, mrn)
+}
+
+// GetMapper implements [backend.Service] by delegating to the wrapped backend.
+func (b *Backend) GetMapper(ctx context.Context, domainName string) (*model.Mapper, *common.PolicyError) {
+	return b.inner.GetMapper(ctx, domainName)
+}
+
+// GetBundleInfo implements [backend.BundleInfoProvider] by delegating to the wrapped
+// backend, returning nil if it does not identify its bundle.
+func (b *Backend) GetBundleInfo() *model.BundleInfo {
+	if p, ok := b.inner.(backend.BundleInfoProvider); ok {
+		return p.GetBundleInfo()
+	}
+
+	return nil
+}
+
+// WarmUp implements [backend.WarmUpper] by delegating to the wrapped backend, if it
+// supports warming up.
+func (b *Backend) WarmUp(ctx context.Context) error {
+	if w, ok := b.inner.(backend.WarmUpper); ok {
+		return w.WarmUp(ctx)
+	}
+
+	return nil
+}
+
+// Health implements [backend.HealthChecker] by delegating to the wrapped backend,
+// reporting healthy if it cannot be checked.
+func (b *Backend) Health(ctx context.Context) error {
+	if h, ok := b.inner.(backend.HealthChecker); ok {
+		return h.Health(ctx)
+	}
+
+	return nil
+}
+
+// GetBypassRules implements [backend.BypassRuleProvider] by delegating to the wrapped
+// backend, returning no rules if it does not serve any.
+func (b *Backend) GetBypassRules(ctx context.Context) ([]*model.BypassRule, *common.PolicyError) {
+	if p, ok := b.inner.(backend.BypassRuleProvider); ok {
+		return p.GetBypassRules(ctx)
+	}
+
+	return nil, nil
+}
+
+// GetImpersonationRules implements [backend.ImpersonationRuleProvider] by delegating to the
+// wrapped backend, returning no rules if it does not serve any.
+func (b *Backend) GetImpersonationRules(ctx context.Context) ([]*model.ImpersonationRule, *common.PolicyError) {
+	if p, ok := b.inner.(backend.ImpersonationRuleProvider); ok {
+		return p.GetImpersonationRules(ctx)
+	}
+
+	return nil, nil
+}
+
+// ListOperations implements [backend.OperationLister] by delegating to the wrapped backend,
+// returning no operations if it does not list them.
+func (b *Backend) ListOperations(ctx context.Context) ([]*model.OperationRoute, *common.PolicyError) {
+	if l, ok := b.inner.(backend.OperationLister); ok {
+		return l.ListOperations(ctx)
+	}
+
+	return nil, nil
+}
+
+// GetDomainDefaults implements [backend.DomainDefaultsProvider] by delegating to the wrapped
+// backend, returning nil if it does not serve domain defaults.
+func (b *Backend) GetDomainDefaults(ctx context.Context, operation string) (*model.DomainDefaults, *common.PolicyError) {
+	if p, ok := b.inner.(backend.DomainDefaultsProvider); ok {
+		return p.GetDomainDefaults(ctx, operation)
+	}
+
+	return nil, nil
+}
+
+// AssignResourceGroup implements [backend.ResourceGroupAssigner] by delegating to the wrapped
+// backend, assigning no group if it does not assign groups. Assignments are not cached, since
+// they depend on the attributes of each resource.
+func (b *Backend) AssignResourceGroup(ctx context.Context, resource *model.Resource) (string, *common.PolicyError) {
+	if a, ok := b.inner.(backend.ResourceGroupAssigner); ok {
+		return a.AssignResourceGroup(ctx, resource)
+	}
+
+	return "", nil
+}
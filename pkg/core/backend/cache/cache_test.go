@@ -0,0 +1,382 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBackend is a backend.Service that counts its lookups
+type countingBackend struct {
+	lookups  atomic.Int64
+	revision atomic.Uint64
+	warmups  atomic.Int64
+	down     atomic.Bool
+}
+
+func (c *countingBackend) reference(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	c.lookups.Add(1)
+	switch mrn {
+	case "mrn:iam:role:missing":
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "not found")
+	case "mrn:iam:role:unreachable":
+		return nil, common.NewError(events.AccessRecord_BundleReference_NETWORK_ERROR, "connection refused")
+	}
+	return &model.PolicyReference{Mrn: mrn, Annotations: model.RichAnnotations{"tenant": {Value: backend.TenantFromContext(ctx)}}}, nil
+}
+
+func (c *countingBackend) GetRole(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return c.reference(ctx, mrn)
+}
+
+func (c *countingBackend) GetGroup(_ context.Context, mrn string) (*model.Group, *common.PolicyError) {
+	c.lookups.Add(1)
+	return &model.Group{Mrn: mrn}, nil
+}
+
+func (c *countingBackend) GetScope(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return c.reference(ctx, mrn)
+}
+
+func (c *countingBackend) GetResourceGroup(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return c.reference(ctx, mrn)
+}
+
+func (c *countingBackend) GetResource(_ context.Context, mrn string) (*model.Resource, *common.PolicyError) {
+	c.lookups.Add(1)
+	return &model.Resource{ID: mrn}, nil
+}
+
+func (c *countingBackend) GetOperation(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return c.reference(ctx, mrn)
+}
+
+func (c *countingBackend) GetMapper(_ context.Context, domainName string) (*model.Mapper, *common.PolicyError) {
+	c.lookups.Add(1)
+	return &model.Mapper{Domain: domainName}, nil
+}
+
+func (c *countingBackend) GetBundleInfo() *model.BundleInfo {
+	return &model.BundleInfo{Revision: c.revision.Load()}
+}
+
+func (c *countingBackend) WarmUp(context.Context) error {
+	c.warmups.Add(1)
+	return nil
+}
+
+func (c *countingBackend) Health(context.Context) error {
+	if c.down.Load() {
+		return errors.New("policy store unreachable")
+	}
+	return nil
+}
+
+type countingFactory struct {
+	backend *countingBackend
+}
+
+func (f *countingFactory) NewBackend(*opa.Compiler) (backend.Service, error) {
+	return f.backend, nil
+}
+
+// fakeClock is a controllable time source
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestBackend(t *testing.T, opts ...Option) (*Factory, backend.Service, *countingBackend, *fakeClock) {
+	inner := &countingBackend{}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+
+	factory := NewFactory(&countingFactory{backend: inner}, opts...)
+	factory.now = clock.Now
+
+	be, err := factory.NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+
+	return factory, be, inner, clock
+}
+
+func TestCachedLookups(t *testing.T) {
+	_, be, inner, _ := newTestBackend(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		role, err := be.GetRole(ctx, "mrn:iam:role:admin")
+		require.Nil(t, err)
+		assert.Equal(t, "mrn:iam:role:admin", role.Mrn)
+
+		group, err := be.GetGroup(ctx, "mrn:iam:group:admins")
+		require.Nil(t, err)
+		assert.Equal(t, "mrn:iam:group:admins", group.Mrn)
+
+		_, err = be.GetScope(ctx, "mrn:iam:scope:api")
+		require.Nil(t, err)
+		_, err = be.GetResourceGroup(ctx, "mrn:iam:resource-group:default")
+		require.Nil(t, err)
+	}
+	assert.Equal(t, int64(4), inner.lookups.Load())
+
+	// the same MRN is cached separately for each kind
+	_, err := be.GetScope(ctx, "mrn:iam:role:admin")
+	require.Nil(t, err)
+	assert.Equal(t, int64(5), inner.lookups.Load())
+}
+
+func TestUncachedLookups(t *testing.T) {
+	_, be, inner, _ := newTestBackend(t)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := be.GetResource(ctx, "mrn:app:document:1")
+		require.Nil(t, err)
+		_, err = be.GetOperation(ctx, "api:documents:read")
+		require.Nil(t, err)
+		_, err = be.GetMapper(ctx, "")
+		require.Nil(t, err)
+
+		// failures other than NOTFOUND are not cached
+		_, err = be.GetRole(ctx, "mrn:iam:role:unreachable")
+		require.NotNil(t, err)
+		assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, err.ReasonCode)
+	}
+	assert.Equal(t, int64(8), inner.lookups.Load())
+}
+
+func TestNegativeCaching(t *testing.T) {
+	factory, be, inner, clock := newTestBackend(t, WithNegativeTTL(2*time.Second))
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := be.GetRole(ctx, "mrn:iam:role:missing")
+		require.NotNil(t, err)
+		assert.Equal(t, events.AccessRecord_BundleReference_NOTFOUND_ERROR, err.ReasonCode)
+		assert.Equal(t, "not found", err.Reason)
+
+		// the cached error is not shared with callers
+		err.Reason = "modified"
+	}
+	assert.Equal(t, int64(1), inner.lookups.Load())
+
+	// NOTFOUND results expire after the negative TTL, while entities use the regular TTL
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	clock.Advance(2 * time.Second)
+	_, _ = be.GetRole(ctx, "mrn:iam:role:missing")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	assert.Equal(t, int64(3), inner.lookups.Load())
+
+	// NOTFOUND results can be invalidated, such as when the entity is created
+	factory.Invalidate("mrn:iam:role:missing")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:missing")
+	assert.Equal(t, int64(4), inner.lookups.Load())
+}
+
+func TestNegativeCachingDisabled(t *testing.T) {
+	_, be, inner, _ := newTestBackend(t, WithNegativeTTL(0))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := be.GetRole(ctx, "mrn:iam:role:missing")
+		require.NotNil(t, err)
+	}
+	assert.Equal(t, int64(3), inner.lookups.Load())
+}
+
+func TestStats(t *testing.T) {
+	factory, be, _, _ := newTestBackend(t)
+	ctx := context.Background()
+
+	assert.Equal(t, Stats{}, factory.Stats())
+	assert.Zero(t, factory.Stats().HitRate())
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")   // miss
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")   // hit
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")   // hit
+	_, _ = be.GetRole(ctx, "mrn:iam:role:missing") // miss
+	_, _ = be.GetRole(ctx, "mrn:iam:role:missing") // negative hit
+	_, _ = be.GetResource(ctx, "mrn:app:document:1")
+
+	stats := factory.Stats()
+	assert.Equal(t, Stats{Hits: 2, NegativeHits: 1, Misses: 2}, stats)
+	assert.InDelta(t, 0.6, stats.HitRate(), 1e-9)
+	assert.InDelta(t, 0.2, stats.NegativeHitRate(), 1e-9)
+}
+
+func TestTTL(t *testing.T) {
+	_, be, inner, clock := newTestBackend(t, WithTTL(10*time.Second))
+	ctx := context.Background()
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	clock.Advance(9 * time.Second)
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	assert.Equal(t, int64(1), inner.lookups.Load())
+
+	clock.Advance(time.Second)
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	assert.Equal(t, int64(2), inner.lookups.Load())
+}
+
+func TestNoExpiry(t *testing.T) {
+	_, be, inner, clock := newTestBackend(t, WithTTL(0))
+	ctx := context.Background()
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	clock.Advance(24 * time.Hour)
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	assert.Equal(t, int64(1), inner.lookups.Load())
+}
+
+func TestTenantIsolation(t *testing.T) {
+	_, be, inner, _ := newTestBackend(t)
+
+	acme, err := be.GetRole(backend.WithTenant(context.Background(), "acme"), "mrn:iam:role:admin")
+	require.Nil(t, err)
+	globex, err := be.GetRole(backend.WithTenant(context.Background(), "globex"), "mrn:iam:role:admin")
+	require.Nil(t, err)
+
+	assert.Equal(t, "acme", acme.Annotations["tenant"].Value)
+	assert.Equal(t, "globex", globex.Annotations["tenant"].Value)
+	assert.Equal(t, int64(2), inner.lookups.Load())
+}
+
+func TestInvalidate(t *testing.T) {
+	factory, be, inner, _ := newTestBackend(t)
+	ctx := context.Background()
+	acme := backend.WithTenant(ctx, "acme")
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	_, _ = be.GetRole(acme, "mrn:iam:role:admin")
+	_, _ = be.GetScope(ctx, "mrn:iam:role:admin")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:reader")
+	assert.Equal(t, 4, factory.Len())
+
+	// every kind and tenant of the MRN is dropped
+	factory.Invalidate("mrn:iam:role:admin")
+	assert.Equal(t, 1, factory.Len())
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:reader")
+	assert.Equal(t, int64(5), inner.lookups.Load())
+
+	factory.InvalidateAll()
+	assert.Equal(t, 0, factory.Len())
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:reader")
+	assert.Equal(t, int64(6), inner.lookups.Load())
+}
+
+// TestInvalidateDuringLookup verifies that a lookup in flight when its entry is invalidated
+// does not cache the value it fetched, which may be stale
+func TestInvalidateDuringLookup(t *testing.T) {
+	factory, be, inner, _ := newTestBackend(t)
+	cached := be.(*Backend)
+
+	fetch := func(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+		factory.Invalidate(mrn)
+		return inner.GetRole(ctx, mrn)
+	}
+	_, err := lookup(context.Background(), cached, kindRole, "mrn:iam:role:admin", fetch)
+	require.Nil(t, err)
+	assert.Equal(t, 0, factory.Len())
+}
+
+func TestRevisionChange(t *testing.T) {
+	factory, be, inner, _ := newTestBackend(t)
+	ctx := context.Background()
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	assert.Equal(t, int64(1), inner.lookups.Load())
+
+	inner.revision.Add(1)
+	_, _ = be.GetRole(ctx, "mrn:iam:role:admin")
+	assert.Equal(t, int64(2), inner.lookups.Load())
+	assert.Equal(t, 1, factory.Len())
+}
+
+func TestMaxEntries(t *testing.T) {
+	factory, be, inner, clock := newTestBackend(t, WithMaxEntries(2), WithTTL(time.Minute))
+	ctx := context.Background()
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:a")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:b")
+	_, _ = be.GetRole(ctx, "mrn:iam:role:c") // not cached, the cache is full
+	assert.Equal(t, 2, factory.Len())
+
+	_, _ = be.GetRole(ctx, "mrn:iam:role:c")
+	assert.Equal(t, int64(4), inner.lookups.Load())
+
+	// expired entries make room
+	clock.Advance(time.Minute)
+	_, _ = be.GetRole(ctx, "mrn:iam:role:c")
+	assert.Equal(t, 1, factory.Len())
+}
+
+func TestDelegation(t *testing.T) {
+	_, be, inner, _ := newTestBackend(t)
+	inner.revision.Store(42)
+
+	assert.Equal(t, uint64(42), be.(backend.BundleInfoProvider).GetBundleInfo().Revision)
+	assert.NoError(t, be.(backend.WarmUpper).WarmUp(context.Background()))
+	assert.Equal(t, int64(1), inner.warmups.Load())
+
+	assert.NoError(t, be.(backend.HealthChecker).Health(context.Background()))
+	inner.down.Store(true)
+	assert.EqualError(t, be.(backend.HealthChecker).Health(context.Background()), "policy store unreachable")
+
+	// the wrapped backend does not list operations
+	operations, perr := be.(backend.OperationLister).ListOperations(context.Background())
+	assert.Nil(t, perr)
+	assert.Empty(t, operations)
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	factory, be, _, _ := newTestBackend(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				role, err := be.GetRole(ctx, "mrn:iam:role:admin")
+				assert.Nil(t, err)
+				assert.Equal(t, "mrn:iam:role:admin", role.Mrn)
+				if j%10 == 0 {
+					factory.Invalidate("mrn:iam:role:admin")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,510 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package federated provides a backend that routes lookups to several other
+// backends.
+//
+// A policy engine is given a single [backend.Factory], yet the policy data of a
+// deployment may live in several places: roles and groups in a remote identity
+// service, resources and operations in local YAML files. The federated backend
+// combines such backends, sending each lookup to the first route that matches
+// its kind and its MRN prefix or policy domain.
+//
+// # Usage
+//
+//	factory, err := federated.NewFactory(
+//	    federated.NewRoute("iam", iam.NewFactory(cfg),
+//	        federated.MatchKinds(federated.KindRole, federated.KindGroup),
+//	        federated.WithCache(cache.WithTTL(30*time.Second)),
+//	        federated.OnError(federated.FallbackNotFound)),
+//	    federated.NewRoute("local", local.NewFactory(reg)),
+//	)
+//	pe, err := core.NewPolicyEngine(options.WithBackend(factory))
+//
+// # Matching
+//
+// A route matches a lookup if its kinds, if any, include the kind of the lookup,
+// and its MRN prefixes or policy domains, if any, match the looked up MRN. A
+// route with neither prefixes nor domains matches any MRN, so a catch-all route
+// usually comes last. Lookups that match no route fail with NOTFOUND_ERROR.
+//
+// # Error Policies
+//
+// By default, the error of the first matching route is returned. With
+// [OnError], a route may instead pass the lookup to the next matching route
+// when it fails, or only when the entity is not found, so that one backend can
+// override another.
+//
+// # Optional Interfaces
+//
+// The federated backend implements [backend.BundleInfoProvider],
+// [backend.WarmUpper], [backend.HealthChecker], [backend.BypassRuleProvider],
+// [backend.ImpersonationRuleProvider], [backend.OperationLister],
+// [backend.DomainDefaultsProvider], and [backend.ResourceGroupAssigner], combining
+// the routes that implement them.
+package federated
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/backend/cache"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// Kind identifies the kind of entity a lookup retrieves.
+type Kind string
+
+// Kinds of lookups, one per method of [backend.Service]
+const (
+	KindRole          Kind = "role"
+	KindGroup         Kind = "group"
+	KindScope         Kind = "scope"
+	KindResource      Kind = "resource"
+	KindResourceGroup Kind = "resource-group"
+	KindOperation     Kind = "operation"
+	KindMapper        Kind = "mapper"
+)
+
+// ErrorPolicy selects what a route does when a lookup fails.
+type ErrorPolicy string
+
+const (
+	// Fail returns the error of the route. This is the default.
+	Fail ErrorPolicy = "fail"
+
+	// Fallback passes any failed lookup to the next matching route.
+	Fallback ErrorPolicy = "fallback"
+
+	// FallbackNotFound passes lookups of entities the route does not know to the
+	// next matching route, and returns other errors.
+	FallbackNotFound ErrorPolicy = "fallback-notfound"
+)
+
+// Route sends the lookups it matches to a backend. Create routes with [NewRoute].
+type Route struct {
+	name     string
+	factory  backend.Factory
+	kinds    []Kind
+	prefixes []string
+	domains  []string
+	onError  ErrorPolicy
+	cache    *cache.Factory
+	cacheOpt []cache.Option
+	cached   bool
+}
+
+// RouteOption is a functional option for configuring a [Route].
+type RouteOption func(*Route)
+
+// MatchKinds restricts the route to lookups of the given kinds.
+func MatchKinds(kinds ...Kind) RouteOption {
+	return func(r *Route) {
+		r.kinds = append(r.kinds, kinds...)
+	}
+}
+
+// MatchPrefix restricts the route to MRNs that start with one of the prefixes,
+// such as "mrn:iam:role:". For mapper lookups, the prefixes apply to the domain
+// name.
+func MatchPrefix(prefixes ...string) RouteOption {
+	return func(r *Route) {
+		r.prefixes = append(r.prefixes, prefixes...)
+	}
+}
+
+// MatchDomain restricts the route to MRNs qualified with one of the policy
+// domains, such as "billing/mrn:iam:role:editor", and to the mappers of those
+// domains.
+func MatchDomain(domains ...string) RouteOption {
+	return func(r *Route) {
+		r.domains = append(r.domains, domains...)
+	}
+}
+
+// OnError sets what the route does when a lookup fails.
+func OnError(policy ErrorPolicy) RouteOption {
+	return func(r *Route) {
+		r.onError = policy
+	}
+}
+
+// WithCache caches the lookups of the route, as a [cache.Factory] configured
+// with opts would.
+func WithCache(opts ...cache.Option) RouteOption {
+	return func(r *Route) {
+		r.cached = true
+		r.cacheOpt = append(r.cacheOpt, opts...)
+	}
+}
+
+// NewRoute creates a [Route] named name that sends the lookups it matches to the
+// backends created by factory.
+func NewRoute(name string, factory backend.Factory, opts ...RouteOption) *Route {
+	r := &Route{name: name, factory: factory, onError: Fail}
+	for _, o := range opts {
+		o(r)
+	}
+
+	if r.cached {
+		r.cache = cache.NewFactory(factory, r.cacheOpt...)
+		r.factory = r.cache
+	}
+
+	return r
+}
+
+// Name returns the name of the route.
+func (r *Route) Name() string {
+	return r.name
+}
+
+// servesKind reports whether the route serves lookups of the kind, for some keys
+func (r *Route) servesKind(kind Kind) bool {
+	if len(r.kinds) == 0 {
+		return true
+	}
+	for _, k := range r.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the route serves a lookup of the kind for the key
+func (r *Route) matches(kind Kind, key string) bool {
+	if !r.servesKind(kind) {
+		return false
+	}
+
+	if len(r.prefixes) == 0 && len(r.domains) == 0 {
+		return true
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	for _, domain := range r.domains {
+		if key == domain || strings.HasPrefix(key, domain+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fallsBack reports whether a failed lookup is passed to the next matching route
+func (r *Route) fallsBack(err *common.PolicyError) bool {
+	switch r.onError {
+	case Fallback:
+		return true
+	case FallbackNotFound:
+		return err.ReasonCode == events.AccessRecord_BundleReference_NOTFOUND_ERROR
+	default:
+		return false
+	}
+}
+
+// Factory creates federated [Backend] instances, creating a backend for each of
+// its routes.
+type Factory struct {
+	routes []*Route
+}
+
+// NewFactory creates a [Factory] that sends each lookup to the first of the
+// routes that matches it.
+//
+// Returns an error if there are no routes, a route has no name or no factory,
+// two routes share a name, or an error policy is unknown.
+func NewFactory(routes ...*Route) (*Factory, error) {
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("at least one route is required")
+	}
+
+	names := make(map[string]bool, len(routes))
+	for i, r := range routes {
+		switch {
+		case r == nil || r.name == "":
+			return nil, fmt.Errorf("route #%d: missing name", i+1)
+		case r.factory == nil:
+			return nil, fmt.Errorf("route '%s': missing backend factory", r.name)
+		case names[r.name]:
+			return nil, fmt.Errorf("route '%s': duplicate name", r.name)
+		}
+		switch r.onError {
+		case Fail, Fallback, FallbackNotFound:
+		default:
+			return nil, fmt.Errorf("route '%s': unsupported error policy '%s', must be one of '%s', '%s', or '%s'", r.name, r.onError, Fail, Fallback, FallbackNotFound)
+		}
+		names[r.name] = true
+	}
+
+	return &Factory{routes: routes}, nil
+}
+
+// Cache returns the cache of the named route, to invalidate its entries or read
+// its statistics, or nil if the route is not cached or does not exist.
+func (f *Factory) Cache(name string) *cache.Factory {
+	for _, r := range f.routes {
+		if r.name == name {
+			return r.cache
+		}
+	}
+	return nil
+}
+
+// NewBackend creates the backend of every route and returns a [Backend] routing
+// lookups to them.
+//
+// Returns an error if the backend of a route cannot be created.
+func (f *Factory) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
+	b := &Backend{routes: make([]route, 0, len(f.routes))}
+	for _, r := range f.routes {
+		service, err := r.factory.NewBackend(compiler)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s': %w", r.name, err)
+		}
+		b.routes = append(b.routes, route{Route: r, service: service})
+	}
+
+	return b, nil
+}
+
+type route struct {
+	*Route
+	service backend.Service
+}
+
+// Backend implements [backend.Service] by routing each lookup to the backend of
+// the first matching route.
+type Backend struct {
+	routes []route
+}
+
+// lookup fetches an entity from the matching routes, in order, until one succeeds or
+// fails without falling back
+func lookup[T any](ctx context.Context, b *Backend, kind Kind, key string, fetch func(backend.Service, context.Context, string) (*T, *common.PolicyError)) (*T, *common.PolicyError) {
+	var last *common.PolicyError
+	for _, r := range b.routes {
+		if !r.matches(kind, key) {
+			continue
+		}
+
+		value, err := fetch(r.service, ctx, key)
+		if err == nil {
+			return value, nil
+		}
+		last = err
+		if !r.fallsBack(err) {
+			break
+		}
+	}
+
+	if last == nil {
+		last = common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, fmt.Sprintf("no backend route for %s '%s'", kind, key))
+	}
+	return nil, last
+}
+
+// GetRole implements [backend.Service] by routing the lookup.
+func (b *Backend) GetRole(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, KindRole, mrn, backend.Service.GetRole)
+}
+
+// GetGroup implements [backend.Service] by routing the lookup.
+func (b *Backend) GetGroup(ctx context.Context, mrn string) (*model.Group, *common.PolicyError) {
+	return lookup(ctx, b, KindGroup, mrn, backend.Service.GetGroup)
+}
+
+// GetScope implements [backend.Service] by routing the lookup.
+func (b *Backend) GetScope(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, KindScope, mrn, backend.Service.GetScope)
+}
+
+// GetResource implements [backend.Service] by routing the lookup.
+func (b *Backend) GetResource(ctx context.Context, mrn string) (*model.Resource, *common.PolicyError) {
+	return lookup(ctx, b, KindResource, mrn, backend.Service.GetResource)
+}
+
+// GetResourceGroup implements [backend.Service] by routing the lookup.
+func (b *Backend) GetResourceGroup(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, KindResourceGroup, mrn, backend.Service.GetResourceGroup)
+}
+
+// GetOperation implements [backend.Service] by routing the lookup.
+func (b *Backend) GetOperation(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return lookup(ctx, b, KindOperation, mrn, backend.Service.GetOperation)
+}
+
+// GetMapper implements [backend.Service] by routing the lookup by domain name.
+func (b *Backend) GetMapper(ctx context.Context, domainName string) (*model.Mapper, *common.PolicyError) {
+	return lookup(ctx, b, KindMapper, domainName, backend.Service.GetMapper)
+}
+
+// GetBundleInfo implements [backend.BundleInfoProvider], combining the domains of
+// every route that identifies its bundle. The revision is the sum of theirs, so
+// that it advances whenever any of them does. Returns nil if no route identifies
+// its bundle.
+func (b *Backend) GetBundleInfo() *model.BundleInfo {
+	var (
+		info  *model.BundleInfo
+		names = make(map[string]bool)
+	)
+	for _, r := range b.routes {
+		p, ok := r.service.(backend.BundleInfoProvider)
+		if !ok {
+			continue
+		}
+		child := p.GetBundleInfo()
+		if child == nil {
+			continue
+		}
+		if info == nil {
+			info = &model.BundleInfo{}
+		}
+		info.Revision += child.Revision
+		for _, domain := range child.Domains {
+			if !names[domain.Name] {
+				names[domain.Name] = true
+				info.Domains = append(info.Domains, domain)
+			}
+		}
+	}
+
+	if info != nil {
+		sort.Slice(info.Domains, func(i, j int) bool { return info.Domains[i].Name < info.Domains[j].Name })
+	}
+	return info
+}
+
+// WarmUp implements [backend.WarmUpper] by warming up every route that supports it.
+//
+// Returns an error if any of them fails to warm up.
+func (b *Backend) WarmUp(ctx context.Context) error {
+	for _, r := range b.routes {
+		if w, ok := r.service.(backend.WarmUpper); ok {
+			if err := w.WarmUp(ctx); err != nil {
+				return fmt.Errorf("route '%s': %w", r.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Health implements [backend.HealthChecker] by checking every route that can be
+// checked.
+//
+// Returns the errors of the unhealthy routes, joined.
+func (b *Backend) Health(ctx context.Context) error {
+	var errs []error
+	for _, r := range b.routes {
+		if h, ok := r.service.(backend.HealthChecker); ok {
+			if err := h.Health(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("route '%s': %w", r.name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// GetBypassRules implements [backend.BypassRuleProvider] by combining the rules of
+// every route that serves them, in route order.
+func (b *Backend) GetBypassRules(ctx context.Context) ([]*model.BypassRule, *common.PolicyError) {
+	var rules []*model.BypassRule
+	for _, r := range b.routes {
+		if p, ok := r.service.(backend.BypassRuleProvider); ok {
+			routeRules, err := p.GetBypassRules(ctx)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, routeRules...)
+		}
+	}
+
+	return rules, nil
+}
+
+// GetImpersonationRules implements [backend.ImpersonationRuleProvider] by combining the
+// rules of every route that serves them, in route order.
+func (b *Backend) GetImpersonationRules(ctx context.Context) ([]*model.ImpersonationRule, *common.PolicyError) {
+	var rules []*model.ImpersonationRule
+	for _, r := range b.routes {
+		if p, ok := r.service.(backend.ImpersonationRuleProvider); ok {
+			routeRules, err := p.GetImpersonationRules(ctx)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, routeRules...)
+		}
+	}
+
+	return rules, nil
+}
+
+// ListOperations implements [backend.OperationLister] by combining the operations of
+// every route serving operation lookups, in route order.
+func (b *Backend) ListOperations(ctx context.Context) ([]*model.OperationRoute, *common.PolicyError) {
+	var operations []*model.OperationRoute
+	for _, r := range b.routes {
+		if !r.servesKind(KindOperation) {
+			continue
+		}
+		if l, ok := r.service.(backend.OperationLister); ok {
+			routeOperations, err := l.ListOperations(ctx)
+			if err != nil {
+				return nil, err
+			}
+			operations = append(operations, routeOperations...)
+		}
+	}
+
+	return operations, nil
+}
+
+// AssignResourceGroup implements [backend.ResourceGroupAssigner] by asking the
+// routes that match the resource, in order, returning the first group assigned.
+func (b *Backend) AssignResourceGroup(ctx context.Context, resource *model.Resource) (string, *common.PolicyError) {
+	for _, r := range b.routes {
+		if !r.matches(KindResource, resource.ID) {
+			continue
+		}
+		if a, ok := r.service.(backend.ResourceGroupAssigner); ok {
+			group, err := a.AssignResourceGroup(ctx, resource)
+			if err != nil || group != "" {
+				return group, err
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// GetDomainDefaults implements [backend.DomainDefaultsProvider] by asking the
+// routes that match the operation, in order, returning the first defaults found.
+func (b *Backend) GetDomainDefaults(ctx context.Context, operation string) (*model.DomainDefaults, *common.PolicyError) {
+	for _, r := range b.routes {
+		if !r.matches(KindOperation, operation) {
+			continue
+		}
+		if p, ok := r.service.(backend.DomainDefaultsProvider); ok {
+			defaults, err := p.GetDomainDefaults(ctx, operation)
+			if err != nil || defaults != nil {
+				return defaults, err
+			}
+		}
+	}
+
+	return nil, nil
+}
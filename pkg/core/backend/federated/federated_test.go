@@ -0,0 +1,390 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package federated
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/backend/local"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubBackend is a backend.Service that knows a fixed set of MRNs and counts its lookups
+type stubBackend struct {
+	name        string
+	known       map[string]bool
+	unreachable bool
+	lookups     atomic.Int64
+
+	info       *model.BundleInfo
+	healthErr  error
+	warmups    atomic.Int64
+	rules      []*model.BypassRule
+	operations []*model.OperationRoute
+}
+
+func newStub(name string, known ...string) *stubBackend {
+	s := &stubBackend{name: name, known: make(map[string]bool)}
+	for _, mrn := range known {
+		s.known[mrn] = true
+	}
+	return s
+}
+
+func (s *stubBackend) find(mrn string) *common.PolicyError {
+	s.lookups.Add(1)
+	switch {
+	case s.unreachable:
+		return common.NewError(events.AccessRecord_BundleReference_NETWORK_ERROR, s.name+" unreachable")
+	case !s.known[mrn]:
+		return common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, mrn+" not found in "+s.name)
+	}
+	return nil
+}
+
+func (s *stubBackend) reference(mrn string) (*model.PolicyReference, *common.PolicyError) {
+	if err := s.find(mrn); err != nil {
+		return nil, err
+	}
+	return &model.PolicyReference{Mrn: mrn, Annotations: model.RichAnnotations{"backend": {Value: s.name}}}, nil
+}
+
+func (s *stubBackend) GetRole(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return s.reference(mrn)
+}
+
+func (s *stubBackend) GetGroup(_ context.Context, mrn string) (*model.Group, *common.PolicyError) {
+	if err := s.find(mrn); err != nil {
+		return nil, err
+	}
+	return &model.Group{Mrn: mrn}, nil
+}
+
+func (s *stubBackend) GetScope(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return s.reference(mrn)
+}
+
+func (s *stubBackend) GetResource(_ context.Context, mrn string) (*model.Resource, *common.PolicyError) {
+	if err := s.find(mrn); err != nil {
+		return nil, err
+	}
+	return &model.Resource{ID: mrn}, nil
+}
+
+func (s *stubBackend) GetResourceGroup(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return s.reference(mrn)
+}
+
+func (s *stubBackend) GetOperation(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return s.reference(mrn)
+}
+
+func (s *stubBackend) GetMapper(_ context.Context, domainName string) (*model.Mapper, *common.PolicyError) {
+	if err := s.find(domainName); err != nil {
+		return nil, err
+	}
+	return &model.Mapper{Domain: domainName}, nil
+}
+
+func (s *stubBackend) GetBundleInfo() *model.BundleInfo {
+	return s.info
+}
+
+func (s *stubBackend) WarmUp(context.Context) error {
+	s.warmups.Add(1)
+	return nil
+}
+
+func (s *stubBackend) Health(context.Context) error {
+	return s.healthErr
+}
+
+func (s *stubBackend) GetBypassRules(context.Context) ([]*model.BypassRule, *common.PolicyError) {
+	return s.rules, nil
+}
+
+func (s *stubBackend) ListOperations(context.Context) ([]*model.OperationRoute, *common.PolicyError) {
+	if s.unreachable {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NETWORK_ERROR, s.name+" unreachable")
+	}
+	return s.operations, nil
+}
+
+type stubFactory struct {
+	backend backend.Service
+}
+
+func (f *stubFactory) NewBackend(*opa.Compiler) (backend.Service, error) {
+	return f.backend, nil
+}
+
+func newTestBackend(t *testing.T, routes ...*Route) (*Factory, backend.Service) {
+	factory, err := NewFactory(routes...)
+	require.NoError(t, err)
+	be, err := factory.NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	return factory, be
+}
+
+func annotation(ref *model.PolicyReference) interface{} {
+	return ref.Annotations["backend"].Value
+}
+
+func TestNewFactory(t *testing.T) {
+	stub := &stubFactory{backend: newStub("stub")}
+
+	for name, routes := range map[string][]*Route{
+		"no routes":       nil,
+		"missing name":    {NewRoute("", stub)},
+		"missing factory": {NewRoute("a", nil)},
+		"duplicate name":  {NewRoute("a", stub), NewRoute("a", stub)},
+		"error policy":    {NewRoute("a", stub, OnError("retry"))},
+	} {
+		_, err := NewFactory(routes...)
+		assert.Error(t, err, name)
+	}
+
+	f, err := NewFactory(NewRoute("a", &failingFactory{}))
+	require.NoError(t, err)
+	_, err = f.NewBackend(opa.NewCompiler())
+	assert.EqualError(t, err, "route 'a': connection refused")
+}
+
+type failingFactory struct{}
+
+func (f *failingFactory) NewBackend(*opa.Compiler) (backend.Service, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRoute_Matches(t *testing.T) {
+	all := NewRoute("all", &stubFactory{})
+	assert.True(t, all.matches(KindRole, "mrn:iam:role:admin"))
+	assert.True(t, all.matches(KindMapper, ""))
+
+	roles := NewRoute("roles", &stubFactory{}, MatchKinds(KindRole, KindGroup))
+	assert.True(t, roles.matches(KindGroup, "mrn:iam:group:admins"))
+	assert.False(t, roles.matches(KindScope, "mrn:iam:scope:api"))
+
+	prefix := NewRoute("prefix", &stubFactory{}, MatchPrefix("mrn:iam:role:remote-"))
+	assert.True(t, prefix.matches(KindRole, "mrn:iam:role:remote-admin"))
+	assert.False(t, prefix.matches(KindRole, "mrn:iam:role:admin"))
+
+	domain := NewRoute("domain", &stubFactory{}, MatchDomain("billing"), MatchKinds(KindRole, KindMapper))
+	assert.True(t, domain.matches(KindRole, "billing/mrn:iam:role:editor"))
+	assert.True(t, domain.matches(KindMapper, "billing"))
+	assert.False(t, domain.matches(KindRole, "mrn:iam:role:editor"))
+	assert.False(t, domain.matches(KindRole, "billing-eu/mrn:iam:role:editor"))
+	assert.False(t, domain.matches(KindScope, "billing/mrn:iam:scope:api"))
+}
+
+func TestRouting(t *testing.T) {
+	iam := newStub("iam", "mrn:iam:role:admin", "mrn:iam:group:admins")
+	yaml := newStub("yaml", "mrn:iam:role:admin", "mrn:iam:role:viewer", "mrn:iam:scope:api", "mrn:app:doc:1", "mrn:iam:resource-group:default", "api:read", "billing")
+
+	_, be := newTestBackend(t,
+		NewRoute("iam", &stubFactory{backend: iam}, MatchKinds(KindRole, KindGroup), OnError(FallbackNotFound)),
+		NewRoute("yaml", &stubFactory{backend: yaml}),
+	)
+	ctx := context.Background()
+
+	role, err := be.GetRole(ctx, "mrn:iam:role:admin")
+	require.Nil(t, err)
+	assert.Equal(t, "iam", annotation(role), "the first matching route wins")
+
+	role, err = be.GetRole(ctx, "mrn:iam:role:viewer")
+	require.Nil(t, err)
+	assert.Equal(t, "yaml", annotation(role), "NOTFOUND falls back to the next route")
+
+	group, err := be.GetGroup(ctx, "mrn:iam:group:admins")
+	require.Nil(t, err)
+	assert.Equal(t, "mrn:iam:group:admins", group.Mrn)
+
+	scope, err := be.GetScope(ctx, "mrn:iam:scope:api")
+	require.Nil(t, err)
+	assert.Equal(t, "yaml", annotation(scope))
+	assert.Equal(t, int64(3), iam.lookups.Load(), "scopes are not routed to iam")
+
+	_, err = be.GetResource(ctx, "mrn:app:doc:1")
+	assert.Nil(t, err)
+	_, err = be.GetResourceGroup(ctx, "mrn:iam:resource-group:default")
+	assert.Nil(t, err)
+	_, err = be.GetOperation(ctx, "api:read")
+	assert.Nil(t, err)
+	_, err = be.GetMapper(ctx, "billing")
+	assert.Nil(t, err)
+
+	// a network error is not a NOTFOUND, so it does not fall back
+	iam.unreachable = true
+	_, err = be.GetRole(ctx, "mrn:iam:role:viewer")
+	require.NotNil(t, err)
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, err.ReasonCode)
+}
+
+func TestRouting_ErrorPolicies(t *testing.T) {
+	ctx := context.Background()
+	primary := newStub("primary", "mrn:iam:role:admin")
+	primary.unreachable = true
+	secondary := newStub("secondary", "mrn:iam:role:admin")
+
+	_, be := newTestBackend(t,
+		NewRoute("primary", &stubFactory{backend: primary}),
+		NewRoute("secondary", &stubFactory{backend: secondary}),
+	)
+	_, err := be.GetRole(ctx, "mrn:iam:role:admin")
+	require.NotNil(t, err)
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, err.ReasonCode, "failures are returned by default")
+	assert.Equal(t, int64(0), secondary.lookups.Load())
+
+	_, be = newTestBackend(t,
+		NewRoute("primary", &stubFactory{backend: primary}, OnError(Fallback)),
+		NewRoute("secondary", &stubFactory{backend: secondary}),
+	)
+	role, err := be.GetRole(ctx, "mrn:iam:role:admin")
+	require.Nil(t, err)
+	assert.Equal(t, "secondary", annotation(role), "any failure falls back")
+
+	// the last error is returned when every route fails
+	_, be = newTestBackend(t,
+		NewRoute("primary", &stubFactory{backend: primary}, OnError(Fallback)),
+		NewRoute("secondary", &stubFactory{backend: secondary}),
+	)
+	_, err = be.GetRole(ctx, "mrn:iam:role:missing")
+	require.NotNil(t, err)
+	assert.Equal(t, events.AccessRecord_BundleReference_NOTFOUND_ERROR, err.ReasonCode)
+
+	// lookups that match no route are not found
+	_, be = newTestBackend(t, NewRoute("roles", &stubFactory{backend: secondary}, MatchKinds(KindRole)))
+	_, err = be.GetScope(ctx, "mrn:iam:scope:api")
+	require.NotNil(t, err)
+	assert.Equal(t, events.AccessRecord_BundleReference_NOTFOUND_ERROR, err.ReasonCode)
+	assert.Contains(t, err.Reason, "no backend route for scope 'mrn:iam:scope:api'")
+}
+
+func TestRouting_Cache(t *testing.T) {
+	iam := newStub("iam", "mrn:iam:role:admin")
+	yaml := newStub("yaml")
+	factory, be := newTestBackend(t,
+		NewRoute("iam", &stubFactory{backend: iam}, MatchKinds(KindRole), WithCache()),
+		NewRoute("yaml", &stubFactory{backend: yaml}),
+	)
+	assert.Nil(t, factory.Cache("yaml"))
+	assert.Nil(t, factory.Cache("unknown"))
+	require.NotNil(t, factory.Cache("iam"))
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := be.GetRole(ctx, "mrn:iam:role:admin")
+		require.Nil(t, err)
+	}
+	assert.Equal(t, int64(1), iam.lookups.Load())
+	assert.Equal(t, uint64(2), factory.Cache("iam").Stats().Hits)
+
+	factory.Cache("iam").Invalidate("mrn:iam:role:admin")
+	_, err := be.GetRole(ctx, "mrn:iam:role:admin")
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), iam.lookups.Load())
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	a := newStub("a")
+	a.info = &model.BundleInfo{Revision: 2, Domains: []model.DomainInfo{{Name: "zeta"}, {Name: "shared", Fingerprint: []byte("a")}}}
+	a.rules = []*model.BypassRule{{Name: "a"}}
+	b := newStub("b")
+	b.info = &model.BundleInfo{Revision: 3, Domains: []model.DomainInfo{{Name: "alpha"}, {Name: "shared", Fingerprint: []byte("b")}}}
+	b.rules = []*model.BypassRule{{Name: "b"}}
+
+	_, be := newTestBackend(t, NewRoute("a", &stubFactory{backend: a}), NewRoute("b", &stubFactory{backend: b}))
+
+	info := be.(backend.BundleInfoProvider).GetBundleInfo()
+	require.NotNil(t, info)
+	assert.Equal(t, uint64(5), info.Revision)
+	assert.Equal(t, []model.DomainInfo{{Name: "alpha"}, {Name: "shared", Fingerprint: []byte("a")}, {Name: "zeta"}}, info.Domains)
+
+	require.NoError(t, be.(backend.WarmUpper).WarmUp(ctx))
+	assert.Equal(t, int64(1), a.warmups.Load())
+	assert.Equal(t, int64(1), b.warmups.Load())
+
+	rules, err := be.(backend.BypassRuleProvider).GetBypassRules(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []*model.BypassRule{{Name: "a"}, {Name: "b"}}, rules)
+
+	assert.NoError(t, be.(backend.HealthChecker).Health(ctx))
+	b.healthErr = errors.New("connection refused")
+	assert.EqualError(t, be.(backend.HealthChecker).Health(ctx), "route 'b': connection refused")
+
+	defaults, err := be.(backend.DomainDefaultsProvider).GetDomainDefaults(ctx, "api:read")
+	assert.Nil(t, err)
+	assert.Nil(t, defaults)
+
+	a.info, b.info = nil, nil
+	assert.Nil(t, be.(backend.BundleInfoProvider).GetBundleInfo())
+}
+
+func TestListOperations(t *testing.T) {
+	ctx := context.Background()
+	iam := newStub("iam")
+	iam.operations = []*model.OperationRoute{{Mrn: "iam"}}
+	a := newStub("a")
+	a.operations = []*model.OperationRoute{{Mrn: "a"}}
+	b := newStub("b")
+	b.operations = []*model.OperationRoute{{Mrn: "b1"}, {Mrn: "b2"}}
+
+	_, be := newTestBackend(t,
+		NewRoute("iam", &stubFactory{backend: iam}, MatchKinds(KindRole)),
+		NewRoute("a", &stubFactory{backend: a}, MatchKinds(KindRole, KindOperation)),
+		NewRoute("b", &stubFactory{backend: b}),
+	)
+
+	// routes not serving operation lookups are not listed
+	operations, perr := be.(backend.OperationLister).ListOperations(ctx)
+	require.Nil(t, perr)
+	assert.Equal(t, []*model.OperationRoute{{Mrn: "a"}, {Mrn: "b1"}, {Mrn: "b2"}}, operations)
+
+	b.unreachable = true
+	_, perr = be.(backend.OperationLister).ListOperations(ctx)
+	require.NotNil(t, perr)
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, perr.ReasonCode)
+}
+
+func TestLocalBackend(t *testing.T) {
+	reg, err := registry.NewRegistry([]string{"../../../../cmd/mpe/test/consolidated.yml"})
+	require.NoError(t, err)
+
+	// a remote role store overrides the roles it knows, and the YAML domain serves the rest
+	iam := newStub("iam", "mrn:iam:role:admin")
+	_, be := newTestBackend(t,
+		NewRoute("iam", &stubFactory{backend: iam}, MatchPrefix("mrn:iam:role:"), OnError(FallbackNotFound)),
+		NewRoute("local", local.NewFactory(reg)),
+	)
+	ctx := context.Background()
+
+	role, perr := be.GetRole(ctx, "mrn:iam:role:admin")
+	require.Nil(t, perr)
+	assert.Equal(t, "iam", annotation(role))
+
+	role, perr = be.GetRole(ctx, "mrn:iam:role:no-access")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:role:no-access", role.Mrn)
+
+	group, perr := be.GetGroup(ctx, "mrn:iam:group:admin")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:group:admin", group.Mrn)
+
+	info := be.(backend.BundleInfoProvider).GetBundleInfo()
+	require.NotNil(t, info)
+	assert.Equal(t, "consolidated", info.Domains[0].Name)
+	require.NoError(t, be.(backend.WarmUpper).WarmUp(ctx))
+}
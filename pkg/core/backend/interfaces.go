@@ -13,6 +13,11 @@
 //
 // The following backend implementations are available:
 //   - [local]: Loads policies from local YAML files via a [registry.Registry]
+//   - [cache]: Caches the role, group, scope, and resource group lookups of
+//     another backend
+//   - [federated]: Routes lookups to several backends by entity kind, MRN
+//     prefix, or policy domain
+//   - [testing]: Serves policies and entities declared in Go, for unit tests
 //   - Mock backend (internal): Returns empty data, useful for testing
 //
 // # Implementing a Custom Backend
@@ -131,3 +136,121 @@ type Service interface {
 	// that has one (error if multiple domains have mappers).
 	GetMapper(ctx context.Context, domainName string) (*model.Mapper, *common.PolicyError)
 }
+
+// BundleInfoProvider is an optional interface implemented by backends that can
+// identify the exact policy bundle they serve.
+//
+// When the configured backend implements BundleInfoProvider, the policy engine
+// records the bundle revision and domain fingerprints in every AccessRecord.
+type BundleInfoProvider interface {
+	// GetBundleInfo returns the current bundle revision and domain fingerprints.
+	GetBundleInfo() *model.BundleInfo
+}
+
+// WarmUpper is an optional interface implemented by backends that can prepare
+// their policies for evaluation ahead of the first authorization request.
+//
+// The policy engine calls WarmUp from [core.PolicyEngine.WarmUp].
+type WarmUpper interface {
+	// WarmUp prepares every policy and mapper the backend serves.
+	//
+	// Returns an error if any of them cannot be prepared.
+	WarmUp(ctx context.Context) error
+}
+
+// HealthChecker is an optional interface implemented by backends that depend on a
+// remote service, such as a policy store, whose availability can be checked.
+//
+// The policy engine calls Health from [core.PolicyEngine.Health]. A decision point
+// may call it periodically and report itself degraded while it fails, so that
+// traffic is routed to replicas whose backend is reachable.
+type HealthChecker interface {
+	// Health checks that the backend can serve policy data.
+	//
+	// Returns an error describing the failure if it cannot. Implementations
+	// should honor the deadline of the context.
+	Health(ctx context.Context) error
+}
+
+// BypassRuleProvider is an optional interface implemented by backends that
+// serve declarative SYSTEM phase bypass rules, such as anti-lockout grants for
+// administrator roles.
+//
+// When the configured backend implements BypassRuleProvider, the policy engine
+// grants a request in the SYSTEM phase if any rule matches its operation and
+// principal roles, before evaluating the operation's policy.
+type BypassRuleProvider interface {
+	// GetBypassRules returns the bypass rules visible to the request, in the
+	// order they should be tried.
+	GetBypassRules(ctx context.Context) ([]*model.BypassRule, *common.PolicyError)
+}
+
+// ImpersonationRuleProvider is an optional interface implemented by backends
+// that serve impersonation rules, which permit the actors of requests to act on
+// behalf of their principals, such as a service calling on behalf of a user.
+//
+// A request whose principal carries an act claim is denied unless a rule
+// permits each of its actors, so a backend that does not implement
+// ImpersonationRuleProvider denies every such request.
+type ImpersonationRuleProvider interface {
+	// GetImpersonationRules returns the impersonation rules visible to the
+	// request, in the order they should be tried.
+	GetImpersonationRules(ctx context.Context) ([]*model.ImpersonationRule, *common.PolicyError)
+}
+
+// OperationLister is an optional interface implemented by backends that can
+// enumerate the operations they route.
+//
+// When the configured backend implements OperationLister, the policy engine
+// draws the operations it considers in [core.PolicyEngine.ListPermittedOperations]
+// from their selectors and policies. Other backends list no operations.
+type OperationLister interface {
+	// ListOperations returns the operations visible to the request, in the order
+	// their selectors are tried.
+	ListOperations(ctx context.Context) ([]*model.OperationRoute, *common.PolicyError)
+}
+
+// DomainDefaultsProvider is an optional interface implemented by backends whose
+// policy domains can declare their own decision strategy.
+//
+// When the configured backend implements DomainDefaultsProvider and the SYSTEM
+// phase defers the decision, the policy engine combines the outcomes of the
+// other phases as the operation's domain specifies.
+type DomainDefaultsProvider interface {
+	// GetDomainDefaults returns the defaults of the domain that routes the
+	// operation, or nil if that domain uses the standard strategy of DENY
+	// and ALL.
+	GetDomainDefaults(ctx context.Context, operation string) (*model.DomainDefaults, *common.PolicyError)
+}
+
+// ResourceGroupAssigner is an optional interface implemented by backends whose
+// policy domains can assign resources to groups by their attributes, such as
+// their classification or annotations.
+//
+// When the configured backend implements ResourceGroupAssigner, the policy engine
+// asks it for the group of every resource once its attributes are known, unless
+// the PORC names the resource's group.
+type ResourceGroupAssigner interface {
+	// AssignResourceGroup returns the group the attributes of the resource assign
+	// it to, or "" if they assign it to none.
+	AssignResourceGroup(ctx context.Context, resource *model.Resource) (string, *common.PolicyError)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context that scopes backend lookups to the given tenant.
+//
+// The policy engine attaches the tenant supplied via options.SetTenant before
+// consulting the backend. Backends that support multi-tenancy use
+// [TenantFromContext] to restrict lookups to the domains registered for that
+// tenant; backends without tenancy support ignore it.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant attached by [WithTenant], or an empty
+// string if the context carries no tenant.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
@@ -25,6 +25,52 @@
 //	    options.WithBackend(local.NewFactory(registry)),
 //	)
 //
+// # Multi-Tenancy
+//
+// A single backend can serve several tenants while keeping their policies
+// isolated. Register the domains visible to each tenant with [WithTenant]:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithBackend(local.NewFactory(registry,
+//	        local.WithTenant("acme", "acme", "shared"),
+//	        local.WithTenant("globex", "globex", "shared"),
+//	    )),
+//	)
+//	allowed, _ := pe.Authorize(ctx, porc, options.SetTenant("acme"))
+//
+// Once any tenant is registered, every lookup must carry a registered tenant
+// and only searches that tenant's domains. Requests without a tenant, or with
+// an unknown tenant, fail their lookups and are therefore denied.
+//
+// # Domain Precedence
+//
+// Requests refer to roles, groups, resource groups, and scopes by MRN alone. When
+// more than one visible domain defines the same MRN, or declares a default
+// resource group, the domains are searched in a fixed order and the first
+// definition wins. By default the order is by domain name; [WithDomainPrecedence]
+// searches the listed domains first:
+//
+//	factory := local.NewFactory(registry, local.WithDomainPrecedence("overrides", "base"))
+//
+// The policy of a role, resource group, or scope is always taken from the domain
+// defining it, so the same policy MRN may be defined by several domains.
+// [registry.Registry.GetAmbiguities] lists the MRNs defined more than once, which
+// are also logged as warnings when the backend is created.
+//
+// # Qualified References
+//
+// To choose a definition deliberately, qualify the MRN of a role, group,
+// resource group, or scope with the name of the domain defining it, in the same
+// "domain/mrn" form that policy domains use for cross-domain references:
+//
+//	"mroles": ["billing/mrn:iam:role:editor"]
+//
+// A qualified MRN is only looked up in the named domain, regardless of
+// precedence, and is not found if that domain is not visible to the tenant.
+// Operations may be qualified in the same way to route them through the named
+// domain when several domains match them. A prefix that does not name a loaded
+// domain is treated as part of the MRN.
+//
 // # Policy Compilation
 //
 // When [Backend] is created via [Factory.NewBackend], all policies and
@@ -36,6 +82,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/manetu/policyengine/internal/logging"
 	"github.com/manetu/policyengine/pkg/common"
@@ -54,7 +107,38 @@ var actor = "backend.local"
 
 // Factory creates [Backend] instances from a [registry.Registry].
 type Factory struct {
-	reg *registry.Registry
+	reg        *registry.Registry
+	tenants    map[string][]string
+	precedence []string
+}
+
+// FactoryOption is a functional option for configuring a [Factory].
+type FactoryOption func(*Factory)
+
+// WithTenant registers the policy domains visible to a tenant, enabling tenancy mode.
+//
+// See the package documentation for the isolation semantics.
+func WithTenant(tenant string, domains ...string) FactoryOption {
+	return func(f *Factory) {
+		if f.tenants == nil {
+			f.tenants = make(map[string][]string)
+		}
+		f.tenants[tenant] = append(f.tenants[tenant], domains...)
+	}
+}
+
+// WithDomainPrecedence sets the domains searched first, in order, for an MRN defined by more
+// than one domain. The remaining domains are searched in name order.
+//
+// See the package documentation for the lookups affected.
+func WithDomainPrecedence(domains ...string) FactoryOption {
+	return func(f *Factory) {
+		for _, domain := range domains {
+			if !slices.Contains(f.precedence, domain) {
+				f.precedence = append(f.precedence, domain)
+			}
+		}
+	}
 }
 
 // Backend implements [backend.Service] using policy domain data from a registry.
@@ -66,14 +150,30 @@ type Backend struct {
 	policyCompiler *opa.Compiler
 	mapperCompiler *opa.Compiler
 	reg            *registry.Registry
+	tenants        map[string][]string
+	precedence     []string
+
+	indexMu sync.RWMutex // guards indexes
+	indexes map[*policydomain.IntermediateModel]*domainIndex
+}
+
+// domainIndex indexes the selectors of a domain, so that lookups stay fast as domains grow
+type domainIndex struct {
+	operations *policydomain.SelectorIndex
+	resources  *policydomain.SelectorIndex // of the resources that are not conditional
 }
 
 // NewFactory creates a [backend.Factory] for the local backend.
 //
 // The registry must be fully loaded and validated before calling NewFactory.
 // Use [registry.NewRegistry] to create the registry from policy domain paths.
-func NewFactory(reg *registry.Registry) backend.Factory {
-	return &Factory{reg: reg}
+func NewFactory(reg *registry.Registry, opts ...FactoryOption) backend.Factory {
+	f := &Factory{reg: reg}
+	for _, o := range opts {
+		o(f)
+	}
+
+	return f
 }
 
 // NewBackend creates a [Backend] and compiles all policies in the registry.
@@ -82,8 +182,22 @@ func NewFactory(reg *registry.Registry) backend.Factory {
 // A separate mapper compiler is created with default capabilities since mappers
 // may need access to built-ins that are restricted for policies.
 //
-// Returns an error if any policy or mapper fails to compile.
+// Returns an error if any policy or mapper fails to compile, or if a tenant
+// or the domain precedence references a domain that is not in the registry.
 func (f *Factory) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
+	for tenant, domains := range f.tenants {
+		for _, domain := range domains {
+			if _, ok := f.reg.GetDomains()[domain]; !ok {
+				return nil, fmt.Errorf("tenant '%s' references unknown domain '%s'", tenant, domain)
+			}
+		}
+	}
+	for _, domain := range f.precedence {
+		if _, ok := f.reg.GetDomains()[domain]; !ok {
+			return nil, fmt.Errorf("domain precedence references unknown domain '%s'", domain)
+		}
+	}
+
 	// Create a separate OPA compiler for mappers, since they don't want/need unsafe builtin exclusions like the policy compiler does
 	mapperCompiler := compiler.Clone(opa.WithDefaultCapabilities())
 
@@ -93,13 +207,53 @@ func (f *Factory) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
 		return nil, err
 	}
 
+	for _, ambiguity := range f.reg.GetAmbiguities() {
+		logger.Warnf(actor, "NewBackend", "%s", ambiguity.Error())
+	}
+
 	return &Backend{
 		policyCompiler: compiler,
 		mapperCompiler: mapperCompiler,
 		reg:            f.reg,
+		tenants:        f.tenants,
+		precedence:     f.precedence,
 	}, nil
 }
 
+// WarmUp implements [backend.WarmUpper] by preparing the queries of every policy and mapper in
+// the registry, and indexing the selectors of every domain. Queries are already prepared when
+// policies are compiled, so WarmUp only does work for queries that were dropped or never prepared.
+func (b *Backend) WarmUp(ctx context.Context) error {
+	for domainName, domain := range b.reg.GetDomains() {
+		b.index(domain)
+
+		for mrn, policy := range domain.Policies {
+			if policy.Ast == nil {
+				return fmt.Errorf("domain %s: policy %s has no compiled AST", domainName, mrn)
+			}
+			if err := policy.Ast.Prepare(ctx, model.PolicyQuery); err != nil {
+				return fmt.Errorf("domain %s: policy %s: %w", domainName, mrn, err)
+			}
+		}
+
+		for _, mapper := range domain.Mappers {
+			if mapper.Ast == nil {
+				return fmt.Errorf("domain %s: mapper %s has no compiled AST", domainName, mapper.IDSpec.ID)
+			}
+			if err := mapper.Ast.Prepare(ctx, model.MapperQuery); err != nil {
+				return fmt.Errorf("domain %s: mapper %s: %w", domainName, mapper.IDSpec.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetBundleInfo implements [backend.BundleInfoProvider] using the registry's revision and domain fingerprints.
+func (b *Backend) GetBundleInfo() *model.BundleInfo {
+	return b.reg.GetBundleInfo()
+}
+
 func newTestBackend(compiler *opa.Compiler, reg *registry.Registry) *Backend {
 	return &Backend{
 		policyCompiler: compiler,
@@ -108,6 +262,125 @@ func newTestBackend(compiler *opa.Compiler, reg *registry.Registry) *Backend {
 	}
 }
 
+// getDomains returns the domains visible to the tenant carried by ctx. Without tenancy
+// configured, all registry domains are visible.
+func (b *Backend) getDomains(ctx context.Context) (registry.DomainMap, *common.PolicyError) {
+	all := b.reg.GetDomains()
+	if len(b.tenants) == 0 {
+		return all, nil
+	}
+
+	tenant := backend.TenantFromContext(ctx)
+	if tenant == "" {
+		return nil, common.NewError(events.AccessRecord_BundleReference_INVALPARAM_ERROR, "tenant required")
+	}
+
+	names, ok := b.tenants[tenant]
+	if !ok {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, fmt.Sprintf("unknown tenant '%s'", tenant))
+	}
+
+	domains := make(registry.DomainMap, len(names))
+	for _, name := range names {
+		if domain, ok := all[name]; ok {
+			domains[name] = domain
+		}
+	}
+
+	return domains, nil
+}
+
+// searchOrder returns the names of the domains in the order they are searched: the domains
+// of the precedence, followed by the others in name order
+func (b *Backend) searchOrder(domains registry.DomainMap) []string {
+	names := make([]string, 0, len(domains))
+	for _, name := range b.precedence {
+		if _, ok := domains[name]; ok {
+			names = append(names, name)
+		}
+	}
+	first := len(names)
+	for name := range domains {
+		if !slices.Contains(b.precedence, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[first:])
+
+	return names
+}
+
+// splitReference splits a reference qualified with the name of a loaded domain, such as
+// "base/mrn:iam:role:editor", into the domain and the MRN. Other references, including MRNs
+// containing "/" whose prefix names no domain, are returned whole with no domain.
+func (b *Backend) splitReference(reference string) (string, string) {
+	if i := strings.Index(reference, "/"); i > 0 {
+		if _, ok := b.reg.GetDomains()[reference[:i]]; ok {
+			return reference[:i], reference[i+1:]
+		}
+	}
+	return "", reference
+}
+
+// findDomain returns the domain defining the entity named by reference, as reported by defines,
+// and the entity's unqualified MRN. A qualified reference is only looked up in the domain it
+// names, if visible, and an unqualified one in the visible domains in search order.
+func (b *Backend) findDomain(domains registry.DomainMap, reference string, defines func(*policydomain.IntermediateModel, string) bool) (string, string, bool) {
+	name, mrn := b.splitReference(reference)
+	if name != "" {
+		domain, ok := domains[name]
+		return name, mrn, ok && defines(domain, mrn)
+	}
+
+	for _, name := range b.searchOrder(domains) {
+		if defines(domains[name], mrn) {
+			return name, mrn, true
+		}
+	}
+	return "", mrn, false
+}
+
+// index returns the index of the selectors of a domain, building it when the domain is first
+// looked up. Indexes of domains that the registry replaced since are dropped.
+func (b *Backend) index(domain *policydomain.IntermediateModel) *domainIndex {
+	b.indexMu.RLock()
+	x, ok := b.indexes[domain]
+	b.indexMu.RUnlock()
+	if ok {
+		return x
+	}
+
+	operations := make([][]*regexp.Regexp, len(domain.Operations))
+	for i, operation := range domain.Operations {
+		operations[i] = operation.Selectors
+	}
+	resources := make([][]*regexp.Regexp, len(domain.Resources))
+	for i, resource := range domain.Resources {
+		// conditional resources are assigned their group once their attributes are known
+		if !resource.IsConditional() {
+			resources[i] = resource.Selectors
+		}
+	}
+	x = &domainIndex{
+		operations: policydomain.NewSelectorIndex(operations),
+		resources:  policydomain.NewSelectorIndex(resources),
+	}
+
+	b.indexMu.Lock()
+	defer b.indexMu.Unlock()
+	if b.indexes == nil {
+		b.indexes = make(map[*policydomain.IntermediateModel]*domainIndex)
+	}
+	current := b.reg.GetDomains()
+	for indexed := range b.indexes {
+		if current[indexed.Name] != indexed {
+			delete(b.indexes, indexed)
+		}
+	}
+	b.indexes[domain] = x
+	return x
+}
+
 func toRichAnnotations(input map[string]policydomain.Annotation) (model.RichAnnotations, *common.PolicyError) {
 	if input == nil {
 		return nil, nil
@@ -140,82 +413,138 @@ func toRichAnnotations(input map[string]policydomain.Annotation) (model.RichAnno
 	return output, nil
 }
 
-func (b *Backend) policyRefExport(ref *policydomain.PolicyReference) (*model.PolicyReference, *common.PolicyError) {
+// policyRefExport converts a role, resource group, or scope defined by domainName, resolving its
+// policy in that domain
+func (b *Backend) policyRefExport(ctx context.Context, domains registry.DomainMap, domainName string, ref *policydomain.PolicyReference) (*model.PolicyReference, *common.PolicyError) {
 	annotations, err := toRichAnnotations(ref.Annotations)
 	if err != nil {
 		return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
 	}
 
-	policy, err := b.getPolicy(ref.Policy)
+	policy, err := b.getPolicy(ctx, domains, domainName, ref.Policy)
 	if err != nil {
 		return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
 	}
 
+	var denyPolicies []*model.Policy
+	for _, mrn := range ref.DenyPolicies {
+		deny, err := b.getPolicy(ctx, domains, domainName, mrn)
+		if err != nil {
+			return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
+		}
+		denyPolicies = append(denyPolicies, deny)
+	}
+
+	var owner *model.OwnerRule
+	if ref.Owner != nil {
+		owner = &model.OwnerRule{Claim: ref.Owner.Claim}
+	}
+
+	// the rule was validated when the domain was loaded
+	var network *model.NetworkRule
+	if ref.Network != nil {
+		network = &model.NetworkRule{Countries: ref.Network.Countries}
+		for _, cidr := range ref.Network.CIDRs {
+			if p, err := netip.ParsePrefix(cidr); err == nil {
+				network.Networks = append(network.Networks, p.Masked())
+			}
+		}
+	}
+
 	return &model.PolicyReference{
-		Mrn:         ref.IDSpec.ID,
-		Policy:      policy,
-		Annotations: annotations,
+		Mrn:             ref.IDSpec.ID,
+		Policy:          policy,
+		DenyPolicies:    denyPolicies,
+		Annotations:     annotations,
+		Owner:           owner,
+		Network:         network,
+		AllowedPurposes: ref.AllowedPurposes,
 	}, nil
 }
 
-// getPolicy retrieves a policy by MRN from the cached intermediate model.
-// Policies are pre-compiled during backend initialization, so this is a simple lookup.
-func (b *Backend) getPolicy(mrn string) (*model.Policy, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "getPolicy: mrn %v", mrn)
+// getPolicy retrieves a policy referenced from domainName from the cached intermediate model.
+// A qualified reference is resolved in the domain it names, and an unqualified one in
+// domainName before searching the visible domains in order. Policies are pre-compiled during backend
+// initialization, so this is a simple lookup.
+func (b *Backend) getPolicy(ctx context.Context, domains registry.DomainMap, domainName, reference string) (*model.Policy, *common.PolicyError) {
+	logger.WithContext(ctx).Tracef(actor, "Get", "getPolicy: mrn %v", reference)
 
-	// Search all domains for the policy
-	for _, domainModel := range b.reg.GetDomains() {
-		if policy, ok := domainModel.Policies[mrn]; ok {
-			// Policy is already compiled at backend initialization time
-			if policy.Ast == nil {
-				return nil, common.NewError(events.AccessRecord_BundleReference_COMPILATION_ERROR,
-					fmt.Sprintf("policy %s has no compiled AST", mrn))
-			}
+	resolver := validation.NewReferenceResolver(registry.NewDomainMapAdapter(domains))
+	target, mrn, err := resolver.ParseReference(reference, domainName)
+	if err != nil {
+		return nil, common.NewError(events.AccessRecord_BundleReference_INVALPARAM_ERROR, err.Error())
+	}
 
-			return &model.Policy{
-				Mrn:         policy.IDSpec.ID,
-				Fingerprint: policy.IDSpec.Fingerprint,
-				Ast:         policy.Ast,
-			}, nil
+	var policy policydomain.Policy
+	ok := false
+	if domain, visible := domains[target]; visible {
+		policy, ok = domain.Policies[mrn]
+	}
+	if !ok && target == domainName {
+		for _, name := range b.searchOrder(domains) {
+			if policy, ok = domains[name].Policies[mrn]; ok {
+				break
+			}
 		}
 	}
+	if !ok {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "policy not found")
+	}
+
+	// Policy is already compiled at backend initialization time
+	if policy.Ast == nil {
+		return nil, common.NewError(events.AccessRecord_BundleReference_COMPILATION_ERROR,
+			fmt.Sprintf("policy %s has no compiled AST", mrn))
+	}
 
-	return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "policy not found")
+	return &model.Policy{
+		Mrn:         policy.IDSpec.ID,
+		Fingerprint: policy.IDSpec.Fingerprint,
+		Ast:         policy.Ast,
+	}, nil
 }
 
 // GetResource retrieves a resource by MRN with RichAnnotations for merge support.
 // First checks for matches in PolicyDomain::Resources definition (v1alpha4+),
 // then falls back to using the ResourceGroup designated with default=true.
+// Domains are searched in precedence order.
 // RichAnnotations automatically flatten to plain values when serialized to JSON for OPA.
 func (b *Backend) GetResource(ctx context.Context, mrn string) (*model.Resource, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "GetResource: %v", mrn)
+	logger.WithContext(ctx).Tracef(actor, "Get", "GetResource: %v", mrn)
+
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	order := b.searchOrder(domains)
 
 	// First, search all domains for a Resource that matches the MRN using selectors
-	for _, domainModel := range b.reg.GetDomains() {
-		for _, resource := range domainModel.Resources {
-			for _, selector := range resource.Selectors {
-				if selector.MatchString(mrn) {
-					// Found a matching resource definition
-					richAnnotations, err := toRichAnnotations(resource.Annotations)
-					if err != nil {
-						return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
-					}
-
-					return &model.Resource{
-						ID:          mrn,
-						Group:       resource.Group,
-						Annotations: richAnnotations,
-					}, nil
-				}
+	for _, name := range order {
+		if i, _, ok := b.index(domains[name]).resources.Match(mrn); ok {
+			// Found a matching resource definition
+			resource := domains[name].Resources[i]
+			richAnnotations, err := toRichAnnotations(resource.Annotations)
+			if err != nil {
+				return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
 			}
+
+			return &model.Resource{
+				ID:              mrn,
+				Group:           resource.Group,
+				Annotations:     richAnnotations,
+				Classification:  resource.Classification,
+				Compartments:    resource.Compartments,
+				AllowedPurposes: resource.AllowedPurposes,
+			}, nil
 		}
 	}
 
 	// No explicit resource match found, fall back to default resource group
 	var defaultResourceGroup string
-	for _, domainModel := range b.reg.GetDomains() {
-		for rgMrn, rg := range domainModel.ResourceGroups {
-			if rg.Default {
+	for _, name := range order {
+		for _, rgMrn := range slices.Sorted(maps.Keys(domains[name].ResourceGroups)) {
+			if domains[name].ResourceGroups[rgMrn].Default {
 				defaultResourceGroup = rgMrn
 				break
 			}
@@ -235,95 +564,135 @@ func (b *Backend) GetResource(ctx context.Context, mrn string) (*model.Resource,
 	}, nil
 }
 
-// GetResourceGroup retrieves a resource group by MRN from any domain
-func (b *Backend) GetResourceGroup(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "GetResourceGroup: %v", mrn)
+// AssignResourceGroup implements [backend.ResourceGroupAssigner] using the conditional resources
+// of the visible domains, in search order. Classifications are compared with the levels of the
+// domain declaring the condition.
+func (b *Backend) AssignResourceGroup(ctx context.Context, resource *model.Resource) (string, *common.PolicyError) {
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return "", perr
+	}
 
-	// Search all domains for the resource group
-	var rgRef *policydomain.PolicyReference
-	found := false
+	for _, name := range b.searchOrder(domains) {
+		domain := domains[name]
+		for i := range domain.Resources {
+			r := &domain.Resources[i]
+			if !r.IsConditional() || (len(r.Selectors) > 0 && !r.MatchesID(resource.ID)) {
+				continue
+			}
+			if conditionsHold(r.Conditions, resource, domain.Classifications.Levels) {
+				logger.WithContext(ctx).Tracef(actor, "Get", "resource %s assigned to %s by %s", resource.ID, r.Group, r.IDSpec.ID)
+				return r.Group, nil
+			}
+		}
+	}
 
-	for _, domainModel := range b.reg.GetDomains() {
-		if ref, ok := domainModel.ResourceGroups[mrn]; ok {
-			rgRef = &ref
-			found = true
-			break
+	return "", nil
+}
+
+// conditionsHold reports whether every condition holds for the attributes of a resource
+func conditionsHold(conditions []policydomain.Condition, resource *model.Resource, levels []string) bool {
+	for _, c := range conditions {
+		var value interface{}
+		switch {
+		case c.Attribute == policydomain.ConditionClassification && resource.Classification != "":
+			value = resource.Classification
+		case c.Attribute == policydomain.ConditionOwner && resource.Owner != "":
+			value = resource.Owner
+		case strings.HasPrefix(c.Attribute, policydomain.ConditionAnnotations):
+			if entry, ok := resource.Annotations[strings.TrimPrefix(c.Attribute, policydomain.ConditionAnnotations)]; ok {
+				value = entry.Value
+			}
 		}
+		if !c.Holds(value, levels) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetResourceGroup retrieves a resource group by MRN, which may be qualified with the name of
+// the domain defining it
+func (b *Backend) GetResourceGroup(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	logger.WithContext(ctx).Tracef(actor, "Get", "GetResourceGroup: %v", mrn)
+
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
 	}
 
-	if !found {
+	domainName, id, ok := b.findDomain(domains, mrn, func(domain *policydomain.IntermediateModel, id string) bool {
+		_, ok := domain.ResourceGroups[id]
+		return ok
+	})
+	if !ok {
 		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "resource group not found")
 	}
 
-	return b.policyRefExport(rgRef)
+	rgRef := domains[domainName].ResourceGroups[id]
+	return b.policyRefExport(ctx, domains, domainName, &rgRef)
 }
 
-// GetRole retrieves a role by MRN from any domain
+// GetRole retrieves a role by MRN, which may be qualified with the name of the domain defining it
 func (b *Backend) GetRole(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "GetRole: %v", mrn)
-
-	// Search all domains for the role
-	var roleRef *policydomain.PolicyReference
-	found := false
+	logger.WithContext(ctx).Tracef(actor, "Get", "GetRole: %v", mrn)
 
-	for _, domainModel := range b.reg.GetDomains() {
-		if ref, ok := domainModel.Roles[mrn]; ok {
-			roleRef = &ref
-			found = true
-			break
-		}
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
 	}
 
-	if !found {
+	domainName, id, ok := b.findDomain(domains, mrn, func(domain *policydomain.IntermediateModel, id string) bool {
+		_, ok := domain.Roles[id]
+		return ok
+	})
+	if !ok {
 		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "role not found")
 	}
 
-	return b.policyRefExport(roleRef)
+	roleRef := domains[domainName].Roles[id]
+	return b.policyRefExport(ctx, domains, domainName, &roleRef)
 }
 
-// GetScope retrieves a scope by MRN from any domain
+// GetScope retrieves a scope by MRN, which may be qualified with the name of the domain defining it
 func (b *Backend) GetScope(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "GetScope: %v", mrn)
-
-	// Search all domains for the scope
-	var scopeRef *policydomain.PolicyReference
-	found := false
+	logger.WithContext(ctx).Tracef(actor, "Get", "GetScope: %v", mrn)
 
-	for _, domainModel := range b.reg.GetDomains() {
-		if ref, ok := domainModel.Scopes[mrn]; ok {
-			scopeRef = &ref
-			found = true
-			break
-		}
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
 	}
 
-	if !found {
+	domainName, id, ok := b.findDomain(domains, mrn, func(domain *policydomain.IntermediateModel, id string) bool {
+		_, ok := domain.Scopes[id]
+		return ok
+	})
+	if !ok {
 		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "scope not found")
 	}
 
-	return b.policyRefExport(scopeRef)
+	scopeRef := domains[domainName].Scopes[id]
+	return b.policyRefExport(ctx, domains, domainName, &scopeRef)
 }
 
-// GetGroup retrieves a group by MRN from any domain
+// GetGroup retrieves a group by MRN, which may be qualified with the name of the domain defining it
 func (b *Backend) GetGroup(ctx context.Context, mrn string) (*model.Group, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "GetGroup: %v", mrn)
+	logger.WithContext(ctx).Tracef(actor, "Get", "GetGroup: %v", mrn)
 
-	// Search all domains for the group
-	var group *policydomain.Group
-	found := false
-
-	for _, domainModel := range b.reg.GetDomains() {
-		if g, ok := domainModel.Groups[mrn]; ok {
-			group = &g
-			found = true
-			break
-		}
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
 	}
 
-	if !found {
+	domainName, id, ok := b.findDomain(domains, mrn, func(domain *policydomain.IntermediateModel, id string) bool {
+		_, ok := domain.Groups[id]
+		return ok
+	})
+	if !ok {
 		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "group not found")
 	}
 
+	group := domains[domainName].Groups[id]
 	annotations, err := toRichAnnotations(group.Annotations)
 	if err != nil {
 		return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
@@ -331,57 +700,264 @@ func (b *Backend) GetGroup(ctx context.Context, mrn string) (*model.Group, *comm
 	return &model.Group{
 		Mrn:         group.IDSpec.ID,
 		Roles:       group.Roles,
+		Groups:      group.Groups,
 		Annotations: annotations,
 	}, nil
 }
 
-// GetOperation retrieves an operation by MRN and returns its associated policy reference.
+// routeOperation returns the domain whose operations route the requested operation, and the
+// operation without any domain qualifier. A qualified operation, such as "billing/api:invoice:read",
+// is only routed by the domain it names; an unqualified one must be routed by exactly one domain.
+func (b *Backend) routeOperation(domains registry.DomainMap, mrn string) (string, string, *common.PolicyError) {
+	name, op := b.splitReference(mrn)
+	if name == "" {
+		var found []string
+		for candidate, domain := range domains {
+			if _, _, ok := b.index(domain).operations.Match(op); ok {
+				found = append(found, candidate)
+			}
+		}
+		if len(found) != 1 {
+			return "", "", common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "operation not found")
+		}
+		return found[0], op, nil
+	}
+
+	if _, ok := domains[name]; !ok {
+		return "", "", common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, fmt.Sprintf("domain '%s' not visible", name))
+	}
+	return name, op, nil
+}
+
+// GetOperation retrieves an operation by MRN, which may be qualified with the name of the domain
+// routing it, and returns its associated policy reference.
 func (b *Backend) GetOperation(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
-	logger.Tracef(actor, "Get", "GetOperation: %v", mrn)
+	logger.WithContext(ctx).Tracef(actor, "Get", "GetOperation: %v", mrn)
+
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
+	}
 
-	// Use common library to find object across domains
-	domainMapAdapter := registry.NewDomainMapAdapter(b.reg.GetDomains())
+	// Use common library to resolve references across domains
+	domainMapAdapter := registry.NewDomainMapAdapter(domains)
 	resolver := validation.NewReferenceResolver(domainMapAdapter)
 
-	foundDomainName, _, err := resolver.FindObjectAcrossDomains(mrn, "operation")
-	if err != nil {
-		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "operation not found")
+	foundDomainName, op, perr := b.routeOperation(domains, mrn)
+	if perr != nil {
+		return nil, perr
 	}
 
 	// Convert back to domain.Model for compatibility with existing logic
-	domain := b.reg.GetDomains()[foundDomainName]
-
-	// Find the matching operation in that domain
-	for _, operation := range domain.Operations {
-		for _, selector := range operation.Selectors {
-			if selector.MatchString(mrn) {
-				// Use common library for reference resolution
-				targetDomain, _, policyID, err := resolver.ResolveReference(operation.Policy, foundDomainName, "policy")
-				if err != nil {
-					return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
-				}
+	domain := domains[foundDomainName]
 
-				// Convert back to access the policy
-				targetDomainModel := b.reg.GetDomains()[targetDomain]
-				policy, ok := targetDomainModel.Policies[policyID]
-				if !ok {
-					return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, "internal model corruption")
-				}
+	// Find the first matching operation in that domain
+	i, j, ok := b.index(domain).operations.Match(op)
+	if !ok {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "operation not found")
+	}
+	operation := domain.Operations[i]
+
+	// Use common library for reference resolution
+	targetDomain, _, policyID, err := resolver.ResolveReference(operation.Policy, foundDomainName, "policy")
+	if err != nil {
+		return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
+	}
 
-				policyModel, perr := b.getPolicy(policy.IDSpec.ID)
-				if perr != nil {
-					return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, err.Error())
+	// Convert back to access the policy
+	targetDomainModel, ok := domains[targetDomain]
+	if !ok {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, fmt.Sprintf("domain '%s' not visible", targetDomain))
+	}
+	if _, ok := targetDomainModel.Policies[policyID]; !ok {
+		return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR, "internal model corruption")
+	}
+
+	policyModel, perr := b.getPolicy(ctx, domains, targetDomain, policyID)
+	if perr != nil {
+		return nil, perr
+	}
+
+	return &model.PolicyReference{
+		Mrn:              operation.IDSpec.ID,
+		Policy:           policyModel,
+		Domain:           foundDomainName,
+		Selector:         operation.Selectors[j].String(),
+		RequiresApproval: operation.RequiresApproval,
+		ContextSchema:    operation.ContextSchema,
+		Identity: model.IdentityRequirement{
+			All:     operation.Identity.Combining == "all",
+			Minimum: operation.Identity.Minimum,
+		},
+	}, nil
+}
+
+// ListOperations implements [backend.OperationLister] using the operations of the domains
+// visible to the request, in search order and then as written.
+func (b *Backend) ListOperations(ctx context.Context) ([]*model.OperationRoute, *common.PolicyError) {
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	var operations []*model.OperationRoute
+	for _, name := range b.searchOrder(domains) {
+		for _, operation := range domains[name].Operations {
+			policy, perr := b.getPolicy(ctx, domains, name, operation.Policy)
+			if perr != nil {
+				return nil, perr
+			}
+
+			operations = append(operations, &model.OperationRoute{
+				Mrn:       operation.IDSpec.ID,
+				Domain:    name,
+				Selectors: operation.Selectors,
+				Policy:    policy,
+			})
+		}
+	}
+
+	return operations, nil
+}
+
+// GetBypassRules implements [backend.BypassRuleProvider] using the bypass rules of the domains
+// visible to the request, ordered by domain name and then as written.
+func (b *Backend) GetBypassRules(ctx context.Context) ([]*model.BypassRule, *common.PolicyError) {
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	var names []string
+	for name, domain := range domains {
+		if len(domain.BypassRules) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	resolver := validation.NewReferenceResolver(registry.NewDomainMapAdapter(domains))
+
+	var rules []*model.BypassRule
+	for _, name := range names {
+		for _, rule := range domains[name].BypassRules {
+			reason, ok := events.AccessRecord_BypassGrantReason_value[rule.Reason]
+			if !ok || reason == 0 || reason == int32(events.AccessRecord_BREAK_GLASS) {
+				return nil, common.NewError(events.AccessRecord_BundleReference_UNKNOWN_ERROR,
+					fmt.Sprintf("bypass rule %s has invalid reason '%s'", rule.Name, rule.Reason))
+			}
+
+			// principals carry unqualified role MRNs
+			roles := make([]string, 0, len(rule.Roles))
+			for _, role := range rule.Roles {
+				if _, mrn, err := resolver.ParseReference(role, name); err == nil {
+					roles = append(roles, mrn)
 				}
+			}
 
-				return &model.PolicyReference{
-					Mrn:    operation.IDSpec.ID,
-					Policy: policyModel,
-				}, nil
+			rules = append(rules, &model.BypassRule{
+				Name:       rule.Name,
+				Domain:     name,
+				Reason:     events.AccessRecord_BypassGrantReason(reason),
+				Roles:      roles,
+				Operations: rule.Operations,
+			})
+		}
+	}
+
+	return rules, nil
+}
+
+// GetImpersonationRules implements [backend.ImpersonationRuleProvider] using the impersonation
+// rules of the domains visible to the request, ordered by domain name and then as written.
+func (b *Backend) GetImpersonationRules(ctx context.Context) ([]*model.ImpersonationRule, *common.PolicyError) {
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	var names []string
+	for name, domain := range domains {
+		if len(domain.ImpersonationRules) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	resolver := validation.NewReferenceResolver(registry.NewDomainMapAdapter(domains))
+
+	var rules []*model.ImpersonationRule
+	for _, name := range names {
+		for _, rule := range domains[name].ImpersonationRules {
+			// actors carry unqualified role MRNs
+			roles := make([]string, 0, len(rule.Roles))
+			for _, role := range rule.Roles {
+				if _, mrn, err := resolver.ParseReference(role, name); err == nil {
+					roles = append(roles, mrn)
+				}
 			}
+
+			rules = append(rules, &model.ImpersonationRule{
+				Name:       rule.Name,
+				Domain:     name,
+				Roles:      roles,
+				Subjects:   rule.Subjects,
+				Operations: rule.Operations,
+			})
+		}
+	}
+
+	return rules, nil
+}
+
+// GetDomainDefaults implements [backend.DomainDefaultsProvider] using the defaults of the visible
+// domain that routes the operation.
+func (b *Backend) GetDomainDefaults(ctx context.Context, operation string) (*model.DomainDefaults, *common.PolicyError) {
+	domains, perr := b.getDomains(ctx)
+	if perr != nil {
+		return nil, perr
+	}
+
+	declared := false
+	for _, domain := range domains {
+		if !domain.Defaults.IsZero() {
+			declared = true
+			break
 		}
 	}
+	if !declared {
+		return nil, nil
+	}
+
+	name, _, perr := b.routeOperation(domains, operation)
+	if perr != nil {
+		return nil, perr
+	}
+
+	defaults := domains[name].Defaults
+	if defaults.IsZero() {
+		return nil, nil
+	}
+
+	result := &model.DomainDefaults{
+		Domain:    name,
+		Decision:  events.AccessRecord_DENY,
+		Combining: events.AccessRecord_ALL,
+	}
+	if defaults.Decision == "allow" {
+		result.Decision = events.AccessRecord_GRANT
+	}
+	if defaults.Combining == "any" {
+		result.Combining = events.AccessRecord_ANY
+	}
 
-	return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "operation not found")
+	return result, nil
 }
 
 // exportMapper converts a cached intermediate mapper to a frontend model mapper.
@@ -394,6 +970,7 @@ func (b *Backend) exportMapper(domainName string, mapper *policydomain.Mapper) (
 
 	return &model.Mapper{
 		Domain: domainName,
+		ID:     mapper.IDSpec.ID,
 		Ast:    mapper.Ast,
 	}, nil
 }
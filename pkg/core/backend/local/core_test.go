@@ -6,12 +6,19 @@ package local
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
 	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
 	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -50,6 +57,25 @@ func createBackend(domainPaths []string) (*Backend, error) {
 	return newTestBackend(compiler, reg), nil
 }
 
+func TestWarmUp(t *testing.T) {
+	be, err := createBackend([]string{createTempFileFromTestData(t, "consolidated.yml")})
+	assert.Nil(t, err)
+
+	assert.NoError(t, be.WarmUp(context.Background()))
+
+	// a policy without a compiled AST cannot be warmed up
+	for _, domain := range be.reg.GetDomains() {
+		for mrn, policy := range domain.Policies {
+			policy.Ast = nil
+			domain.Policies[mrn] = policy
+			break
+		}
+	}
+	err = be.WarmUp(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "has no compiled AST")
+}
+
 func TestGetMapper_SingleDomain(t *testing.T) {
 	// Test with consolidated.yml which has a mapper
 	consolidatedFile := createTempFileFromTestData(t, "consolidated.yml")
@@ -1034,3 +1060,687 @@ func TestMixedApiVersions(t *testing.T) {
 		assert.Equal(t, "MAXIMUM", res.Annotations["classification"].Value, "v1alpha4 annotation should be decoded")
 	})
 }
+
+func createTenantBackend(t *testing.T, opts ...FactoryOption) (backend.Service, error) {
+	reg, err := registry.NewRegistry([]string{
+		createTempFileFromTestData(t, "consolidated.yml"),
+		createTempFileFromTestData(t, "valid-alpha.yml"),
+	})
+	require.NoError(t, err)
+
+	return NewFactory(reg, opts...).NewBackend(opa.NewCompiler())
+}
+
+func TestTenantIsolation(t *testing.T) {
+	be, err := createTenantBackend(t,
+		WithTenant("acme", "consolidated"),
+		WithTenant("globex", "alpha"),
+	)
+	require.NoError(t, err)
+
+	t.Run("visible domain", func(t *testing.T) {
+		role, perr := be.GetRole(backend.WithTenant(context.Background(), "acme"), "mrn:iam:role:no-access")
+		require.Nil(t, perr)
+		assert.Equal(t, "mrn:iam:policy:no-access", role.Policy.Mrn)
+	})
+
+	t.Run("other tenant's domain", func(t *testing.T) {
+		_, perr := be.GetRole(backend.WithTenant(context.Background(), "globex"), "mrn:iam:role:no-access")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "role not found")
+	})
+
+	t.Run("unknown tenant", func(t *testing.T) {
+		_, perr := be.GetRole(backend.WithTenant(context.Background(), "initech"), "mrn:iam:role:admin")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "unknown tenant 'initech'")
+	})
+
+	t.Run("missing tenant", func(t *testing.T) {
+		_, perr := be.GetOperation(context.Background(), "api:test:read")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "tenant required")
+	})
+}
+
+func TestTenantIsolation_Disabled(t *testing.T) {
+	be, err := createTenantBackend(t)
+	require.NoError(t, err)
+
+	// without tenancy configured, the tenant is ignored
+	role, perr := be.GetRole(backend.WithTenant(context.Background(), "acme"), "mrn:iam:role:no-access")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:role:no-access", role.Mrn)
+}
+
+func TestTenantIsolation_UnknownDomain(t *testing.T) {
+	_, err := createTenantBackend(t, WithTenant("acme", "missing"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown domain 'missing'")
+}
+
+func TestGetBypassRules(t *testing.T) {
+	reg, err := registry.NewRegistry([]string{
+		createTempFileFromTestData(t, "consolidated.yml"),
+		createTempFileFromTestData(t, "bypass.yml"),
+	})
+	require.NoError(t, err)
+
+	be, err := NewFactory(reg,
+		WithTenant("acme", "consolidated", "bypass"),
+		WithTenant("globex", "consolidated"),
+	).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	provider := be.(backend.BypassRuleProvider)
+
+	rules, perr := provider.GetBypassRules(backend.WithTenant(context.Background(), "acme"))
+	require.Nil(t, perr)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "admin-anti-lockout", rules[0].Name)
+	assert.Equal(t, "bypass", rules[0].Domain)
+	assert.Equal(t, events.AccessRecord_ANTI_LOCKOUT, rules[0].Reason)
+	assert.True(t, rules[0].Matches("platform:admin:update", []string{"mrn:iam:role:admin"}))
+	assert.False(t, rules[0].Matches("platform:doc:read", []string{"mrn:iam:role:admin"}))
+	assert.False(t, rules[0].Matches("platform:admin:update", []string{"mrn:iam:role:reader"}))
+	assert.Equal(t, events.AccessRecord_PUBLIC, rules[1].Reason)
+
+	// rules are isolated per tenant like every other lookup
+	rules, perr = provider.GetBypassRules(backend.WithTenant(context.Background(), "globex"))
+	require.Nil(t, perr)
+	assert.Empty(t, rules)
+
+	_, perr = provider.GetBypassRules(context.Background())
+	require.NotNil(t, perr)
+	assert.Contains(t, perr.Error(), "tenant required")
+}
+
+func TestGetImpersonationRules(t *testing.T) {
+	reg, err := registry.NewRegistry([]string{
+		createTempFileFromTestData(t, "consolidated.yml"),
+		createTempFileFromTestData(t, "impersonation.yml"),
+	})
+	require.NoError(t, err)
+
+	be, err := NewFactory(reg,
+		WithTenant("acme", "consolidated", "impersonation"),
+		WithTenant("globex", "consolidated"),
+	).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	provider := be.(backend.ImpersonationRuleProvider)
+
+	rules, perr := provider.GetImpersonationRules(backend.WithTenant(context.Background(), "acme"))
+	require.Nil(t, perr)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "on-behalf-of", rules[0].Name)
+	assert.Equal(t, "impersonation", rules[0].Domain)
+	service := []string{"mrn:iam:role:service"}
+	assert.True(t, rules[0].Permits("alice@example.com", "api:documents:read", service))
+	assert.False(t, rules[0].Permits("alice@example.org", "api:documents:read", service))
+	assert.False(t, rules[0].Permits("alice@example.com", "api:admin:update", service))
+	assert.False(t, rules[0].Permits("alice@example.com", "api:documents:read", []string{"mrn:iam:role:user"}))
+	assert.True(t, rules[1].Permits("anyone", "any:operation", []string{"mrn:iam:role:gateway"}))
+
+	// rules are isolated per tenant like every other lookup
+	rules, perr = provider.GetImpersonationRules(backend.WithTenant(context.Background(), "globex"))
+	require.Nil(t, perr)
+	assert.Empty(t, rules)
+
+	_, perr = provider.GetImpersonationRules(context.Background())
+	require.NotNil(t, perr)
+	assert.Contains(t, perr.Error(), "tenant required")
+}
+
+func TestGetDomainDefaults(t *testing.T) {
+	writeDomain := func(name, prefix, defaults string) string {
+		path := filepath.Join(t.TempDir(), name+".yml")
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: %[1]s
+spec:
+%[3]s
+  policies:
+    - mrn: "mrn:iam:policy:%[2]s"
+      rego: |
+        package authz
+        default allow = 0
+  operations:
+    - name: %[2]s
+      selector:
+        - "%[2]s:.*"
+      policy: "mrn:iam:policy:%[2]s"
+`, name, prefix, defaults)), 0600))
+		return path
+	}
+
+	reg, err := registry.NewRegistry([]string{
+		writeDomain("defaults", "open", "  defaults:\n    combining: any"),
+		writeDomain("standard", "std", ""),
+	})
+	require.NoError(t, err)
+	be, err := NewFactory(reg).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	provider := be.(backend.DomainDefaultsProvider)
+
+	defaults, perr := provider.GetDomainDefaults(context.Background(), "open:doc:read")
+	require.Nil(t, perr)
+	require.NotNil(t, defaults)
+	assert.Equal(t, "defaults", defaults.Domain)
+	assert.Equal(t, events.AccessRecord_DENY, defaults.Decision)
+	assert.Equal(t, events.AccessRecord_ANY, defaults.Combining)
+
+	// domains without defaults use the standard strategy
+	defaults, perr = provider.GetDomainDefaults(context.Background(), "std:doc:read")
+	require.Nil(t, perr)
+	assert.Nil(t, defaults)
+
+	_, perr = provider.GetDomainDefaults(context.Background(), "unrouted:doc:read")
+	require.NotNil(t, perr)
+}
+
+// newSharedMRNRegistry loads the domains "base" and "team", which define the same role, group,
+// scope, and policy MRNs, and a default resource group and an operation each. The policy grants
+// in "team" and denies in "base".
+func newSharedMRNRegistry(t *testing.T) *registry.Registry {
+	writeDomain := func(name, allow string) string {
+		path := filepath.Join(t.TempDir(), name+".yml")
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: %[1]s
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:editor"
+      rego: |
+        package authz
+        default allow = %[2]s
+  roles:
+    - mrn: "mrn:iam:role:editor"
+      name: editor
+      policy: "mrn:iam:policy:editor"
+  groups:
+    - mrn: "mrn:iam:group:editors"
+      name: editors
+      roles:
+        - "mrn:iam:role:editor"
+  scopes:
+    - mrn: "mrn:iam:scope:edit"
+      name: edit
+      policy: "mrn:iam:policy:editor"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:%[1]s"
+      name: %[1]s
+      default: true
+      policy: "mrn:iam:policy:editor"
+  operations:
+    - name: docs
+      selector:
+        - "docs:.*"
+      policy: "mrn:iam:policy:editor"
+`, name, allow)), 0600))
+		return path
+	}
+
+	reg, err := registry.NewRegistry([]string{
+		writeDomain("team", "true"),
+		writeDomain("base", "false"),
+	})
+	require.NoError(t, err)
+	return reg
+}
+
+func TestDomainPrecedence(t *testing.T) {
+	reg := newSharedMRNRegistry(t)
+
+	fingerprint := func(domain string) []byte {
+		return reg.GetDomains()[domain].Policies["mrn:iam:policy:editor"].IDSpec.Fingerprint
+	}
+	require.NotEqual(t, fingerprint("base"), fingerprint("team"))
+
+	ctx := context.Background()
+	lookup := func(t *testing.T, be backend.Service, want string) {
+		for i := 0; i < 10; i++ {
+			role, perr := be.GetRole(ctx, "mrn:iam:role:editor")
+			require.Nil(t, perr)
+			assert.Equal(t, fingerprint(want), role.Policy.Fingerprint)
+
+			scope, perr := be.GetScope(ctx, "mrn:iam:scope:edit")
+			require.Nil(t, perr)
+			assert.Equal(t, fingerprint(want), scope.Policy.Fingerprint)
+
+			resource, perr := be.GetResource(ctx, "mrn:app:document:1")
+			require.Nil(t, perr)
+			assert.Equal(t, "mrn:iam:resource-group:"+want, resource.Group)
+
+			group, perr := be.GetGroup(ctx, "mrn:iam:group:editors")
+			require.Nil(t, perr)
+			assert.Equal(t, []string{"mrn:iam:role:editor"}, group.Roles)
+		}
+	}
+
+	t.Run("name order", func(t *testing.T) {
+		be, err := NewFactory(reg).NewBackend(opa.NewCompiler())
+		require.NoError(t, err)
+		lookup(t, be, "base")
+	})
+
+	t.Run("configured precedence", func(t *testing.T) {
+		be, err := NewFactory(reg, WithDomainPrecedence("team")).NewBackend(opa.NewCompiler())
+		require.NoError(t, err)
+		lookup(t, be, "team")
+	})
+
+	t.Run("policy resolved in the defining domain", func(t *testing.T) {
+		be, err := NewFactory(reg,
+			WithDomainPrecedence("team"),
+			WithTenant("acme", "base"),
+		).NewBackend(opa.NewCompiler())
+		require.NoError(t, err)
+
+		role, perr := be.GetRole(backend.WithTenant(ctx, "acme"), "mrn:iam:role:editor")
+		require.Nil(t, perr)
+		assert.Equal(t, fingerprint("base"), role.Policy.Fingerprint)
+	})
+
+	t.Run("unknown domain", func(t *testing.T) {
+		_, err := NewFactory(reg, WithDomainPrecedence("missing")).NewBackend(opa.NewCompiler())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown domain 'missing'")
+	})
+}
+
+func TestQualifiedReferences(t *testing.T) {
+	reg := newSharedMRNRegistry(t)
+	fingerprint := func(domain string) []byte {
+		return reg.GetDomains()[domain].Policies["mrn:iam:policy:editor"].IDSpec.Fingerprint
+	}
+
+	be, err := NewFactory(reg).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for _, domain := range []string{"base", "team"} {
+		t.Run(domain, func(t *testing.T) {
+			role, perr := be.GetRole(ctx, domain+"/mrn:iam:role:editor")
+			require.Nil(t, perr)
+			assert.Equal(t, "mrn:iam:role:editor", role.Mrn)
+			assert.Equal(t, fingerprint(domain), role.Policy.Fingerprint)
+
+			scope, perr := be.GetScope(ctx, domain+"/mrn:iam:scope:edit")
+			require.Nil(t, perr)
+			assert.Equal(t, fingerprint(domain), scope.Policy.Fingerprint)
+
+			rg, perr := be.GetResourceGroup(ctx, domain+"/mrn:iam:resource-group:"+domain)
+			require.Nil(t, perr)
+			assert.Equal(t, fingerprint(domain), rg.Policy.Fingerprint)
+
+			group, perr := be.GetGroup(ctx, domain+"/mrn:iam:group:editors")
+			require.Nil(t, perr)
+			assert.Equal(t, "mrn:iam:group:editors", group.Mrn)
+
+			op, perr := be.GetOperation(ctx, domain+"/docs:read")
+			require.Nil(t, perr)
+			assert.Equal(t, domain, op.Domain)
+			assert.Equal(t, fingerprint(domain), op.Policy.Fingerprint)
+		})
+	}
+
+	t.Run("unqualified operation routed by several domains", func(t *testing.T) {
+		_, perr := be.GetOperation(ctx, "docs:read")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "operation not found")
+	})
+
+	t.Run("entity not in the named domain", func(t *testing.T) {
+		_, perr := be.GetResourceGroup(ctx, "team/mrn:iam:resource-group:base")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "resource group not found")
+	})
+
+	t.Run("prefix naming no domain", func(t *testing.T) {
+		_, perr := be.GetRole(ctx, "other/mrn:iam:role:editor")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "role not found")
+	})
+
+	t.Run("domain of another tenant", func(t *testing.T) {
+		tenanted, err := NewFactory(reg, WithTenant("acme", "base")).NewBackend(opa.NewCompiler())
+		require.NoError(t, err)
+		acme := backend.WithTenant(ctx, "acme")
+
+		role, perr := tenanted.GetRole(acme, "base/mrn:iam:role:editor")
+		require.Nil(t, perr)
+		assert.Equal(t, fingerprint("base"), role.Policy.Fingerprint)
+
+		_, perr = tenanted.GetRole(acme, "team/mrn:iam:role:editor")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "role not found")
+
+		_, perr = tenanted.GetOperation(acme, "team/docs:read")
+		require.NotNil(t, perr)
+		assert.Contains(t, perr.Error(), "domain 'team' not visible")
+	})
+}
+
+func TestListOperations(t *testing.T) {
+	reg := newSharedMRNRegistry(t)
+	fingerprint := func(domain string) []byte {
+		return reg.GetDomains()[domain].Policies["mrn:iam:policy:editor"].IDSpec.Fingerprint
+	}
+	ctx := context.Background()
+
+	be, err := NewFactory(reg, WithDomainPrecedence("team")).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+
+	operations, perr := be.(backend.OperationLister).ListOperations(ctx)
+	require.Nil(t, perr)
+	require.Len(t, operations, 2)
+	for i, domain := range []string{"team", "base"} {
+		assert.Equal(t, domain, operations[i].Domain)
+		assert.Equal(t, "docs", operations[i].Mrn)
+		assert.Equal(t, fingerprint(domain), operations[i].Policy.Fingerprint)
+		require.Len(t, operations[i].Selectors, 1)
+		assert.True(t, operations[i].Selectors[0].MatchString("docs:read"))
+	}
+
+	tenanted, err := NewFactory(reg, WithTenant("acme", "base")).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+
+	operations, perr = tenanted.(backend.OperationLister).ListOperations(backend.WithTenant(ctx, "acme"))
+	require.Nil(t, perr)
+	require.Len(t, operations, 1)
+	assert.Equal(t, "base", operations[0].Domain)
+}
+
+func TestAssignResourceGroup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conditional.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: conditional
+spec:
+  classifications:
+    levels: [LOW, MODERATE, HIGH]
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      default: true
+      policy: "mrn:iam:policy:allow-all"
+    - mrn: "mrn:iam:resource-group:restricted"
+      policy: "mrn:iam:policy:allow-all"
+    - mrn: "mrn:iam:resource-group:finance"
+      policy: "mrn:iam:policy:allow-all"
+  resources:
+    - name: restricted
+      group: "mrn:iam:resource-group:restricted"
+      when:
+        - "classification >= MODERATE"
+        - "owner != \"system\""
+    - name: finance
+      selector:
+        - "mrn:app:ledger:.*"
+      group: "mrn:iam:resource-group:finance"
+      when:
+        - "annotations.department == \"finance\""
+        - "annotations.tier < 3"
+`), 0600))
+
+	be, err := createBackend([]string{path})
+	require.NoError(t, err)
+
+	// conditional entries never match a resource by its MRN alone
+	res, perr := be.GetResource(context.Background(), "mrn:app:ledger:1")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:resource-group:default", res.Group)
+
+	tests := []struct {
+		name     string
+		resource model.Resource
+		group    string
+	}{
+		{"classified", model.Resource{ID: "mrn:app:doc:1", Classification: "HIGH", Owner: "alice"}, "mrn:iam:resource-group:restricted"},
+		{"below level", model.Resource{ID: "mrn:app:doc:1", Classification: "LOW"}, ""},
+		{"unknown level", model.Resource{ID: "mrn:app:doc:1", Classification: "SECRET"}, ""},
+		{"excluded owner", model.Resource{ID: "mrn:app:doc:1", Classification: "HIGH", Owner: "system"}, ""},
+		{"annotated", model.Resource{ID: "mrn:app:ledger:1", Annotations: model.RichAnnotations{
+			"department": {Value: "finance"},
+			"tier":       {Value: float64(2)},
+		}}, "mrn:iam:resource-group:finance"},
+		{"missing annotation", model.Resource{ID: "mrn:app:ledger:1", Annotations: model.RichAnnotations{
+			"department": {Value: "finance"},
+		}}, ""},
+		{"unselected", model.Resource{ID: "mrn:app:doc:1", Annotations: model.RichAnnotations{
+			"department": {Value: "finance"},
+			"tier":       {Value: 1},
+		}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, perr := be.AssignResourceGroup(context.Background(), &tt.resource)
+			require.Nil(t, perr)
+			assert.Equal(t, tt.group, group)
+		})
+	}
+}
+
+func TestGetOperation_RequiresApproval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approval.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: approval
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  operations:
+    - name: admin
+      selector: ["admin:.*"]
+      policy: "mrn:iam:policy:allow-all"
+      requires-approval: 2
+    - name: api
+      selector: [".*"]
+      policy: "mrn:iam:policy:allow-all"
+`), 0600))
+
+	be, err := createBackend([]string{path})
+	require.NoError(t, err)
+
+	op, perr := be.GetOperation(context.Background(), "admin:tenant:delete")
+	require.Nil(t, perr)
+	assert.Equal(t, 2, op.RequiresApproval)
+
+	op, perr = be.GetOperation(context.Background(), "api:documents:read")
+	require.Nil(t, perr)
+	assert.Zero(t, op.RequiresApproval)
+}
+
+func TestGetOperation_Identity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: identity
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  operations:
+    - name: wire
+      selector: ["bank:wire:.*"]
+      policy: "mrn:iam:policy:allow-all"
+      identity:
+        combining: all
+        minimum: 2
+    - name: api
+      selector: [".*"]
+      policy: "mrn:iam:policy:allow-all"
+`), 0600))
+
+	be, err := createBackend([]string{path})
+	require.NoError(t, err)
+
+	op, perr := be.GetOperation(context.Background(), "bank:wire:send")
+	require.Nil(t, perr)
+	assert.Equal(t, model.IdentityRequirement{All: true, Minimum: 2}, op.Identity)
+
+	op, perr = be.GetOperation(context.Background(), "api:documents:read")
+	require.Nil(t, perr)
+	assert.False(t, op.Identity.Conjunctive())
+}
+
+func TestGetOperation_ContextSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: payments
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  operations:
+    - name: transfer
+      selector: ["api:transfer:.*"]
+      policy: "mrn:iam:policy:allow-all"
+      context-schema:
+        type: object
+        required: [amount]
+        properties:
+          amount: {type: number}
+    - name: api
+      selector: [".*"]
+      policy: "mrn:iam:policy:allow-all"
+`), 0600))
+
+	be, err := createBackend([]string{path})
+	require.NoError(t, err)
+
+	op, perr := be.GetOperation(context.Background(), "api:transfer:create")
+	require.Nil(t, perr)
+	require.NotNil(t, op.ContextSchema)
+	violations, err := op.ContextSchema.Validate(context.Background(), map[string]interface{}{"amount": "ten"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"amount: Invalid type. Expected: number, given: string"}, violations)
+
+	op, perr = be.GetOperation(context.Background(), "api:documents:read")
+	require.Nil(t, perr)
+	assert.Nil(t, op.ContextSchema)
+}
+
+// selectorDomain is a domain with the given operations and resources, each declared as a name
+// and a selector
+func selectorDomain(t testing.TB, operations, resources [][2]string) []byte {
+	var sb strings.Builder
+	sb.WriteString(`apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: catalog
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      default: true
+      policy: "mrn:iam:policy:allow-all"
+    - mrn: "mrn:iam:resource-group:stores"
+      policy: "mrn:iam:policy:allow-all"
+  operations:
+`)
+	for _, operation := range operations {
+		fmt.Fprintf(&sb, "    - name: %s\n      selector: [%q]\n      policy: \"mrn:iam:policy:allow-all\"\n", operation[0], operation[1])
+	}
+	sb.WriteString("  resources:\n")
+	for _, resource := range resources {
+		fmt.Fprintf(&sb, "    - name: %s\n      selector: [%q]\n      group: \"mrn:iam:resource-group:stores\"\n", resource[0], resource[1])
+	}
+	return []byte(sb.String())
+}
+
+func TestSelectorIndex_FollowsUpdates(t *testing.T) {
+	load := func(operations, resources [][2]string) *policydomain.IntermediateModel {
+		domain, err := parsers.LoadFromBytes("catalog.yml", selectorDomain(t, operations, resources))
+		require.NoError(t, err)
+		return domain
+	}
+	reg, err := registry.NewRegistryFromModels([]*policydomain.IntermediateModel{load(
+		[][2]string{{"exact", "exact:api:users:read"}, {"users", "glob:api:users:*"}, {"all", ".*"}},
+		[][2]string{{"files", "glob:mrn:files:**"}},
+	)})
+	require.NoError(t, err)
+	be, err := NewFactory(reg).NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for operation, expected := range map[string]string{"api:users:read": "exact", "api:users:list": "users", "api:users:a:b": "all"} {
+		op, perr := be.GetOperation(ctx, operation)
+		require.Nil(t, perr, operation)
+		assert.Equal(t, expected, op.Mrn, operation)
+	}
+	op, perr := be.GetOperation(ctx, "api:users:list")
+	require.Nil(t, perr)
+	assert.Equal(t, "^api:users:[^:/\\n]*$", op.Selector)
+	resource, perr := be.GetResource(ctx, "mrn:files:reports/q1.pdf")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:resource-group:stores", resource.Group)
+
+	require.NoError(t, reg.UpdateDomain("catalog", load([][2]string{{"users", "api:users:.*"}}, nil)))
+
+	op, perr = be.GetOperation(ctx, "api:users:read")
+	require.Nil(t, perr)
+	assert.Equal(t, "users", op.Mrn)
+	_, perr = be.GetOperation(ctx, "api:groups:read")
+	assert.NotNil(t, perr)
+	resource, perr = be.GetResource(ctx, "mrn:files:reports/q1.pdf")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:resource-group:default", resource.Group)
+	assert.Len(t, be.(*Backend).indexes, 1)
+}
+
+func BenchmarkGetOperation(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		operations := make([][2]string, n)
+		resources := make([][2]string, n)
+		for i := range operations {
+			operations[i] = [2]string{fmt.Sprintf("service%d", i), fmt.Sprintf("api:service%d:.*", i)}
+			resources[i] = [2]string{fmt.Sprintf("store%d", i), fmt.Sprintf("glob:mrn:store%d:**", i)}
+		}
+		domain, err := parsers.LoadFromBytes("catalog.yml", selectorDomain(b, operations, resources))
+		require.NoError(b, err)
+		reg, err := registry.NewRegistryFromModels([]*policydomain.IntermediateModel{domain})
+		require.NoError(b, err)
+		be, err := NewFactory(reg).NewBackend(opa.NewCompiler())
+		require.NoError(b, err)
+		ctx := context.Background()
+		operation := fmt.Sprintf("api:service%d:read", n-1)
+		mrn := fmt.Sprintf("mrn:store%d:objects/1", n-1)
+
+		b.Run(fmt.Sprintf("operations=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, perr := be.GetOperation(ctx, operation); perr != nil {
+					b.Fatal(perr)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("resources=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, perr := be.GetResource(ctx, mrn); perr != nil {
+					b.Fatal(perr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,532 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package testing provides an in-memory backend for the unit tests of
+// applications that embed the policy engine.
+//
+// A [Builder] declares policies, roles, groups, scopes, resource groups,
+// resources, operations, and a mapper in Go, without PolicyDomain files or the
+// mock.domain configuration keys of the engine's internal mock backend:
+//
+//	be := testing.New().
+//	    WithPolicyRego("mrn:iam:policy:allow", testing.AllowAllRego).
+//	    WithPolicyRego("mrn:iam:policy:api", testing.DeferRego).
+//	    WithOperation("^api:.*", "mrn:iam:policy:api").
+//	    WithRole("mrn:iam:role:editor", "mrn:iam:policy:allow").
+//	    WithResourceGroup("mrn:iam:resource-group:default", "mrn:iam:policy:allow", testing.Default())
+//	pe, err := core.NewPolicyEngine(options.WithBackend(be))
+//
+// # Write-Through
+//
+// The Builder is itself the [backend.Factory], and the backends it creates read
+// its current declarations on every lookup. Declarations added or replaced after
+// the engine is created apply to the following decisions, so a test can change
+// a role's policy between two assertions without building a new engine.
+//
+// # Errors
+//
+// Policies and the mapper are compiled when they are looked up, and a Rego
+// error fails the lookup with COMPILATION_ERROR, as it would in a real backend.
+// Call [core.PolicyEngine.WarmUp] to compile every declaration up front. An
+// invalid operation selector is reported by NewBackend.
+package testing
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// Rego of common policies
+const (
+	// AllowAllRego is a policy that grants every request.
+	AllowAllRego = "package authz\ndefault allow = true\n"
+
+	// DenyAllRego is a policy that denies every request.
+	DenyAllRego = "package authz\ndefault allow = false\n"
+
+	// DeferRego is an operation policy that leaves every decision to the other
+	// phases, rather than granting or denying it in the SYSTEM phase.
+	DeferRego = "package authz\ndefault allow = 0\n"
+)
+
+// Option is a functional option for configuring an entity declared with a [Builder].
+// Options that do not apply to the kind of the entity are ignored.
+type Option func(*entity)
+
+// entity holds the declaration of a role, group, scope, resource group, resource, or operation
+type entity struct {
+	mrn            string
+	policy         string
+	annotations    model.RichAnnotations
+	isDefault      bool
+	roles          []string
+	groups         []string
+	group          string
+	owner          string
+	ownerRule      *model.OwnerRule
+	network        *model.NetworkRule
+	classification string
+	purposes       []string
+	denyPolicies   []string
+	approvals      int
+	contextSchema  *opa.Schema
+	identity       model.IdentityRequirement
+	selector       *regexp.Regexp
+}
+
+// Annotation sets an annotation of the entity to a value, which must be
+// representable as JSON.
+func Annotation(key string, value interface{}) Option {
+	return func(e *entity) {
+		if e.annotations == nil {
+			e.annotations = model.RichAnnotations{}
+		}
+		e.annotations[key] = model.AnnotationEntry{Value: value}
+	}
+}
+
+// Default makes a resource group the group of every resource that is not declared.
+func Default() Option {
+	return func(e *entity) {
+		e.isDefault = true
+	}
+}
+
+// Owner sets the owner of a resource.
+func Owner(owner string) Option {
+	return func(e *entity) {
+		e.owner = owner
+	}
+}
+
+// GrantOwners makes a resource group grant the owners of its resources without
+// evaluating its policy. The principal's claim, "sub" if empty, is compared to the
+// owner of the resource.
+func GrantOwners(claim string) Option {
+	return func(e *entity) {
+		e.ownerRule = &model.OwnerRule{Claim: claim}
+	}
+}
+
+// Network makes a scope or resource group admit only requests whose client is within
+// any of the CIDRs, if any, and located in any of the countries, if any.
+func Network(cidrs []string, countries []string) Option {
+	return func(e *entity) {
+		e.network = &model.NetworkRule{Countries: countries}
+		for _, cidr := range cidrs {
+			e.network.Networks = append(e.network.Networks, netip.MustParsePrefix(cidr).Masked())
+		}
+	}
+}
+
+// Classification sets the classification of a resource.
+func Classification(classification string) Option {
+	return func(e *entity) {
+		e.classification = classification
+	}
+}
+
+// AllowedPurposes restricts the purposes a resource, or the resources of a resource group,
+// may be accessed for.
+func AllowedPurposes(purposes ...string) Option {
+	return func(e *entity) {
+		e.purposes = append(e.purposes, purposes...)
+	}
+}
+
+// DenyPolicies attaches deny policies to a role or resource group. A DENY from any of
+// them denies the requests the entity applies to, whatever the other policies grant.
+func DenyPolicies(policies ...string) Option {
+	return func(e *entity) {
+		e.denyPolicies = append(e.denyPolicies, policies...)
+	}
+}
+
+// RequiresApproval makes the GRANTs of an operation require the approval of n other
+// principals.
+func RequiresApproval(n int) Option {
+	return func(e *entity) {
+		e.approvals = n
+	}
+}
+
+// RequiresRoles makes the identity phase of an operation GRANT only when at least minimum
+// of the principal's roles GRANT, and, if all is set, every one of them does.
+func RequiresRoles(all bool, minimum int) Option {
+	return func(e *entity) {
+		e.identity = model.IdentityRequirement{All: all, Minimum: minimum}
+	}
+}
+
+// ContextSchema makes an operation deny requests whose context does not match the JSON
+// Schema. It panics if the schema is invalid.
+func ContextSchema(schema map[string]interface{}) Option {
+	s, err := opa.NewSchema(schema)
+	if err != nil {
+		panic(err)
+	}
+	return func(e *entity) {
+		e.contextSchema = s
+	}
+}
+
+// Subgroups sets the groups nested in a group.
+func Subgroups(groups ...string) Option {
+	return func(e *entity) {
+		e.groups = append(e.groups, groups...)
+	}
+}
+
+// Builder declares the contents of an in-memory backend, and creates backends
+// serving them. Create a Builder with [New].
+//
+// Builder is safe for concurrent use, including while its backends serve lookups.
+type Builder struct {
+	mu             sync.RWMutex
+	policies       map[string]string
+	roles          map[string]*entity
+	groups         map[string]*entity
+	scopes         map[string]*entity
+	resourceGroups map[string]*entity
+	resources      map[string]*entity
+	operations     []*entity
+	mapper         string
+	err            error
+}
+
+// New creates an empty [Builder].
+func New() *Builder {
+	return &Builder{
+		policies:       make(map[string]string),
+		roles:          make(map[string]*entity),
+		groups:         make(map[string]*entity),
+		scopes:         make(map[string]*entity),
+		resourceGroups: make(map[string]*entity),
+		resources:      make(map[string]*entity),
+	}
+}
+
+func newEntity(mrn, policy string, opts []Option) *entity {
+	e := &entity{mrn: mrn, policy: policy}
+	for _, o := range opts {
+		o(e)
+	}
+	return e
+}
+
+// WithPolicyRego declares the policy mrn with the given Rego, replacing any
+// previous declaration.
+func (b *Builder) WithPolicyRego(mrn, rego string) *Builder {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.policies[mrn] = rego
+	return b
+}
+
+// WithRole declares the role mrn, evaluated with the given policy.
+func (b *Builder) WithRole(mrn, policy string, opts ...Option) *Builder {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roles[mrn] = newEntity(mrn, policy, opts)
+	return b
+}
+
+// WithGroup declares the group mrn, granting the given roles.
+func (b *Builder) WithGroup(mrn string, roles []string, opts ...Option) *Builder {
+	e := newEntity(mrn, "", opts)
+	e.roles = roles
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[mrn] = e
+	return b
+}
+
+// WithScope declares the scope mrn, evaluated with the given policy.
+func (b *Builder) WithScope(mrn, policy string, opts ...Option) *Builder {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scopes[mrn] = newEntity(mrn, policy, opts)
+	return b
+}
+
+// WithResourceGroup declares the resource group mrn, evaluated with the given
+// policy. Use the [Default] option to make it the group of undeclared resources,
+// and [GrantOwners] to grant the owners of its resources.
+func (b *Builder) WithResourceGroup(mrn, policy string, opts ...Option) *Builder {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resourceGroups[mrn] = newEntity(mrn, policy, opts)
+	return b
+}
+
+// WithResource declares the resource mrn as a member of the given resource group.
+func (b *Builder) WithResource(mrn, group string, opts ...Option) *Builder {
+	e := newEntity(mrn, "", opts)
+	e.group = group
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resources[mrn] = e
+	return b
+}
+
+// WithOperation declares the operations matching the selector, a regular
+// expression, as evaluated with the given policy. Operations are matched
+// against the selectors in the order they were declared.
+func (b *Builder) WithOperation(selector, policy string, opts ...Option) *Builder {
+	e := newEntity(selector, policy, opts)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	re, err := regexp.Compile(selector)
+	if err != nil {
+		b.err = errors.Join(b.err, fmt.Errorf("operation selector '%s': %w", selector, err))
+		return b
+	}
+	e.selector = re
+	b.operations = append(b.operations, e)
+	return b
+}
+
+// WithMapper declares the mapper of the backend, with the given Rego.
+func (b *Builder) WithMapper(rego string) *Builder {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mapper = rego
+	return b
+}
+
+// NewBackend implements [backend.Factory], creating a backend that serves the
+// declarations of the Builder, including those made afterwards.
+//
+// Returns an error if an operation selector is not a valid regular expression.
+func (b *Builder) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
+	b.mu.RLock()
+	err := b.err
+	b.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{
+		builder:        b,
+		compiler:       compiler,
+		mapperCompiler: compiler.Clone(opa.WithDefaultCapabilities()),
+	}, nil
+}
+
+// Backend implements [backend.Service] and [backend.WarmUpper] by serving the
+// declarations of a [Builder].
+type Backend struct {
+	builder        *Builder
+	compiler       *opa.Compiler
+	mapperCompiler *opa.Compiler
+}
+
+func notFound(kind, mrn string) *common.PolicyError {
+	return common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, fmt.Sprintf("%s not found: %s", kind, mrn))
+}
+
+// getPolicy compiles the policy mrn
+func (b *Backend) getPolicy(mrn string) (*model.Policy, *common.PolicyError) {
+	b.builder.mu.RLock()
+	rego, ok := b.builder.policies[mrn]
+	b.builder.mu.RUnlock()
+	if !ok {
+		return nil, notFound("policy", mrn)
+	}
+
+	ast, err := b.compiler.Compile(mrn, opa.Modules{mrn: rego})
+	if err != nil {
+		return nil, common.WrapError(events.AccessRecord_BundleReference_COMPILATION_ERROR, fmt.Sprintf("compilation failed: %s", mrn), err)
+	}
+
+	fingerprint := sha256.Sum256([]byte(rego))
+	return &model.Policy{Mrn: mrn, Fingerprint: fingerprint[:], Ast: ast}, nil
+}
+
+// reference looks up an entity bound to a policy
+func (b *Backend) reference(kind string, entities map[string]*entity, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	b.builder.mu.RLock()
+	e, ok := entities[mrn]
+	b.builder.mu.RUnlock()
+	if !ok {
+		return nil, notFound(kind, mrn)
+	}
+
+	policy, err := b.getPolicy(e.policy)
+	if err != nil {
+		return nil, err
+	}
+	var denyPolicies []*model.Policy
+	for _, p := range e.denyPolicies {
+		deny, err := b.getPolicy(p)
+		if err != nil {
+			return nil, err
+		}
+		denyPolicies = append(denyPolicies, deny)
+	}
+	return &model.PolicyReference{Mrn: mrn, Policy: policy, DenyPolicies: denyPolicies, Annotations: e.annotations, Owner: e.ownerRule, Network: e.network, AllowedPurposes: e.purposes}, nil
+}
+
+// GetRole implements [backend.Service].
+func (b *Backend) GetRole(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return b.reference("role", b.builder.roles, mrn)
+}
+
+// GetGroup implements [backend.Service].
+func (b *Backend) GetGroup(_ context.Context, mrn string) (*model.Group, *common.PolicyError) {
+	b.builder.mu.RLock()
+	defer b.builder.mu.RUnlock()
+
+	e, ok := b.builder.groups[mrn]
+	if !ok {
+		return nil, notFound("group", mrn)
+	}
+	return &model.Group{Mrn: mrn, Roles: e.roles, Groups: e.groups, Annotations: e.annotations}, nil
+}
+
+// GetScope implements [backend.Service].
+func (b *Backend) GetScope(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return b.reference("scope", b.builder.scopes, mrn)
+}
+
+// GetResource implements [backend.Service]. Resources that are not declared
+// belong to the default resource group, if one is declared.
+func (b *Backend) GetResource(_ context.Context, mrn string) (*model.Resource, *common.PolicyError) {
+	b.builder.mu.RLock()
+	defer b.builder.mu.RUnlock()
+
+	if e, ok := b.builder.resources[mrn]; ok {
+		return &model.Resource{
+			ID:              mrn,
+			Owner:           e.owner,
+			Group:           e.group,
+			Annotations:     e.annotations,
+			Classification:  e.classification,
+			AllowedPurposes: e.purposes,
+		}, nil
+	}
+
+	// the lowest MRN wins, so that the choice does not depend on map order
+	groups := make([]string, 0, len(b.builder.resourceGroups))
+	for group, e := range b.builder.resourceGroups {
+		if e.isDefault {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, common.NewError(events.AccessRecord_BundleReference_NOTFOUND_ERROR, "no matching resource and no default resource group found")
+	}
+	sort.Strings(groups)
+	return &model.Resource{ID: mrn, Group: groups[0]}, nil
+}
+
+// GetResourceGroup implements [backend.Service].
+func (b *Backend) GetResourceGroup(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	return b.reference("resource group", b.builder.resourceGroups, mrn)
+}
+
+// GetOperation implements [backend.Service], returning the first operation whose
+// selector matches.
+func (b *Backend) GetOperation(_ context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	b.builder.mu.RLock()
+	var match *entity
+	for _, e := range b.builder.operations {
+		if e.selector.MatchString(mrn) {
+			match = e
+			break
+		}
+	}
+	b.builder.mu.RUnlock()
+	if match == nil {
+		return nil, notFound("operation", mrn)
+	}
+
+	policy, err := b.getPolicy(match.policy)
+	if err != nil {
+		return nil, err
+	}
+	return &model.PolicyReference{Mrn: mrn, Policy: policy, Annotations: match.annotations, Selector: match.mrn, RequiresApproval: match.approvals, ContextSchema: match.contextSchema,
+		Identity: match.identity}, nil
+}
+
+// ListOperations implements [backend.OperationLister], listing the operations in the
+// order they were declared.
+func (b *Backend) ListOperations(_ context.Context) ([]*model.OperationRoute, *common.PolicyError) {
+	b.builder.mu.RLock()
+	declared := slices.Clone(b.builder.operations)
+	b.builder.mu.RUnlock()
+
+	operations := make([]*model.OperationRoute, 0, len(declared))
+	for _, e := range declared {
+		policy, err := b.getPolicy(e.policy)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, &model.OperationRoute{Mrn: e.mrn, Selectors: []*regexp.Regexp{e.selector}, Policy: policy})
+	}
+	return operations, nil
+}
+
+// GetMapper implements [backend.Service], returning the mapper whatever the
+// domain name.
+func (b *Backend) GetMapper(_ context.Context, domainName string) (*model.Mapper, *common.PolicyError) {
+	b.builder.mu.RLock()
+	rego := b.builder.mapper
+	b.builder.mu.RUnlock()
+	if rego == "" {
+		return nil, notFound("mapper", domainName)
+	}
+
+	const id = "mapper"
+	ast, err := b.mapperCompiler.Compile(id, opa.Modules{id: rego})
+	if err != nil {
+		return nil, common.WrapError(events.AccessRecord_BundleReference_COMPILATION_ERROR, "mapper compilation failed", err)
+	}
+	return &model.Mapper{Domain: domainName, ID: id, Ast: ast}, nil
+}
+
+// WarmUp implements [backend.WarmUpper] by compiling every declared policy and
+// the mapper.
+//
+// Returns an error describing every declaration that fails to compile.
+func (b *Backend) WarmUp(ctx context.Context) error {
+	b.builder.mu.RLock()
+	mrns := make([]string, 0, len(b.builder.policies))
+	for mrn := range b.builder.policies {
+		mrns = append(mrns, mrn)
+	}
+	hasMapper := b.builder.mapper != ""
+	b.builder.mu.RUnlock()
+	sort.Strings(mrns)
+
+	var errs []error
+	for _, mrn := range mrns {
+		if _, err := b.getPolicy(mrn); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if hasMapper {
+		if _, err := b.GetMapper(ctx, ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
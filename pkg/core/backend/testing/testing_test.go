@@ -0,0 +1,882 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package testing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
+	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/calendar"
+	"github.com/manetu/policyengine/pkg/core/consent"
+	"github.com/manetu/policyengine/pkg/core/geo"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/options"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	allow   = "mrn:iam:policy:allow"
+	deny    = "mrn:iam:policy:deny"
+	operate = "mrn:iam:policy:operate"
+)
+
+func newBuilder() *Builder {
+	return New().
+		WithPolicyRego(allow, AllowAllRego).
+		WithPolicyRego(deny, DenyAllRego).
+		WithPolicyRego(operate, DeferRego).
+		WithOperation("^api:documents:.*", operate).
+		WithRole("mrn:iam:role:editor", allow, Annotation("tier", "gold")).
+		WithRole("mrn:iam:role:guest", deny).
+		WithGroup("mrn:iam:group:editors", []string{"mrn:iam:role:editor"}, Subgroups("mrn:iam:group:staff")).
+		WithScope("mrn:iam:scope:api", allow).
+		WithResourceGroup("mrn:iam:resource-group:default", allow, Default()).
+		WithResourceGroup("mrn:iam:resource-group:secret", deny).
+		WithResource("mrn:app:document:secret", "mrn:iam:resource-group:secret", Owner("alice"), Classification("HIGH"))
+}
+
+func TestBackend_Lookups(t *testing.T) {
+	be, err := newBuilder().NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	role, perr := be.GetRole(ctx, "mrn:iam:role:editor")
+	require.Nil(t, perr)
+	assert.Equal(t, allow, role.Policy.Mrn)
+	assert.NotNil(t, role.Policy.Ast)
+	assert.Len(t, role.Policy.Fingerprint, 32)
+	assert.Equal(t, "gold", role.Annotations["tier"].Value)
+
+	group, perr := be.GetGroup(ctx, "mrn:iam:group:editors")
+	require.Nil(t, perr)
+	assert.Equal(t, []string{"mrn:iam:role:editor"}, group.Roles)
+	assert.Equal(t, []string{"mrn:iam:group:staff"}, group.Groups)
+
+	_, perr = be.GetScope(ctx, "mrn:iam:scope:api")
+	assert.Nil(t, perr)
+
+	resource, perr := be.GetResource(ctx, "mrn:app:document:secret")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:resource-group:secret", resource.Group)
+	assert.Equal(t, "alice", resource.Owner)
+	assert.Equal(t, "HIGH", resource.Classification)
+
+	resource, perr = be.GetResource(ctx, "mrn:app:document:1")
+	require.Nil(t, perr)
+	assert.Equal(t, "mrn:iam:resource-group:default", resource.Group, "undeclared resources belong to the default group")
+
+	operation, perr := be.GetOperation(ctx, "api:documents:read")
+	require.Nil(t, perr)
+	assert.Equal(t, "^api:documents:.*", operation.Selector)
+
+	_, perr = be.GetRole(ctx, "mrn:iam:role:missing")
+	assert.NotNil(t, perr)
+	_, perr = be.GetGroup(ctx, "mrn:iam:group:missing")
+	assert.NotNil(t, perr)
+	_, perr = be.GetOperation(ctx, "api:users:read")
+	assert.NotNil(t, perr)
+	_, perr = be.GetMapper(ctx, "default")
+	assert.NotNil(t, perr, "no mapper is declared")
+}
+
+func TestBackend_Errors(t *testing.T) {
+	_, err := New().WithOperation("(", allow).NewBackend(opa.NewCompiler())
+	assert.ErrorContains(t, err, "operation selector '('")
+
+	b := New().
+		WithPolicyRego(allow, "package authz\nallow = {").
+		WithRole("mrn:iam:role:editor", allow).
+		WithRole("mrn:iam:role:dangling", "mrn:iam:policy:missing")
+	be, err := b.NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+
+	_, perr := be.GetRole(context.Background(), "mrn:iam:role:editor")
+	require.NotNil(t, perr)
+	assert.Equal(t, events.AccessRecord_BundleReference_COMPILATION_ERROR, perr.ReasonCode)
+
+	_, perr = be.GetRole(context.Background(), "mrn:iam:role:dangling")
+	require.NotNil(t, perr)
+	assert.Equal(t, events.AccessRecord_BundleReference_NOTFOUND_ERROR, perr.ReasonCode)
+
+	assert.Error(t, be.(backend.WarmUpper).WarmUp(context.Background()))
+	b.WithPolicyRego(allow, AllowAllRego)
+	assert.NoError(t, be.(backend.WarmUpper).WarmUp(context.Background()))
+}
+
+func TestBackend_Mapper(t *testing.T) {
+	be, err := New().WithMapper("package mapper\nporc := {\"operation\": input.op}\n").NewBackend(opa.NewCompiler())
+	require.NoError(t, err)
+
+	mapper, perr := be.GetMapper(context.Background(), "billing")
+	require.Nil(t, perr)
+	assert.Equal(t, "billing", mapper.Domain)
+	assert.NotNil(t, mapper.Ast)
+}
+
+func TestPolicyEngine(t *testing.T) {
+	b := newBuilder()
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+	require.NoError(t, pe.WarmUp(context.Background()))
+
+	porc := func(role, resource string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": []string{role}},
+			"operation": "api:documents:read",
+			"resource":  resource,
+		}
+	}
+	ctx := context.Background()
+
+	allowed, err := pe.Authorize(ctx, porc("mrn:iam:role:editor", "mrn:app:document:1"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = pe.Authorize(ctx, porc("mrn:iam:role:guest", "mrn:app:document:1"))
+	require.NoError(t, err)
+	assert.False(t, allowed, "the guest role's policy denies")
+
+	allowed, err = pe.Authorize(ctx, porc("mrn:iam:role:editor", "mrn:app:document:secret"))
+	require.NoError(t, err)
+	assert.False(t, allowed, "the secret resource group's policy denies")
+
+	// declarations made after the engine was created apply to the following decisions
+	b.WithRole("mrn:iam:role:guest", allow)
+	allowed, err = pe.Authorize(ctx, porc("mrn:iam:role:guest", "mrn:app:document:1"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestPolicyEngine_GrantOwners(t *testing.T) {
+	b := newBuilder().
+		WithResourceGroup("mrn:iam:resource-group:owned", deny, GrantOwners("")).
+		WithResourceGroup("mrn:iam:resource-group:mailbox", deny, GrantOwners("email")).
+		WithResource("mrn:app:document:owned", "mrn:iam:resource-group:owned", Owner("alice")).
+		WithResource("mrn:app:document:orphan", "mrn:iam:resource-group:owned").
+		WithResource("mrn:app:mailbox:alice", "mrn:iam:resource-group:mailbox", Owner("alice@example.com"))
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	porc := func(sub, resource string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": sub, "email": sub + "@example.com", "mroles": []string{"mrn:iam:role:editor"}},
+			"operation": "api:documents:read",
+			"resource":  resource,
+		}
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		sub, resource string
+		allowed       bool
+	}{
+		{"alice", "mrn:app:document:owned", true},
+		{"bob", "mrn:app:document:owned", false},
+		{"alice", "mrn:app:document:orphan", false},
+		{"alice", "mrn:app:mailbox:alice", true},
+		{"bob", "mrn:app:mailbox:alice", false},
+	} {
+		allowed, err := pe.Authorize(ctx, porc(tc.sub, tc.resource))
+		require.NoError(t, err)
+		assert.Equal(t, tc.allowed, allowed, "%s on %s", tc.sub, tc.resource)
+	}
+}
+
+type countryLocator map[netip.Addr]string
+
+func (c countryLocator) Locate(addr netip.Addr) (geo.Location, bool, error) {
+	country, ok := c[addr]
+	return geo.Location{Country: country}, ok, nil
+}
+
+func TestPolicyEngine_NetworkRules(t *testing.T) {
+	const fromHome = "mrn:iam:policy:from-home"
+	b := newBuilder().
+		WithPolicyRego(fromHome, "package authz\ndefault allow = false\nallow { geo.lookup(input.context.ip).country == \"US\" }\n").
+		WithResourceGroup("mrn:iam:resource-group:internal", allow, Network([]string{"10.0.0.0/8"}, nil)).
+		WithResourceGroup("mrn:iam:resource-group:domestic", allow, Network(nil, []string{"US", "CA"})).
+		WithResourceGroup("mrn:iam:resource-group:home", fromHome).
+		WithScope("mrn:iam:scope:office", allow, Network([]string{"10.1.0.0/16", "fd00::/8"}, nil)).
+		WithResource("mrn:app:document:internal", "mrn:iam:resource-group:internal").
+		WithResource("mrn:app:document:domestic", "mrn:iam:resource-group:domestic").
+		WithResource("mrn:app:document:home", "mrn:iam:resource-group:home")
+	locator := countryLocator{netip.MustParseAddr("203.0.113.7"): "US", netip.MustParseAddr("198.51.100.1"): "DE"}
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory), options.WithGeoLocator(locator),
+		options.WithDecisionCacheTTL(time.Minute))
+	require.NoError(t, err)
+
+	porc := func(resource string, context map[string]interface{}, scopes ...string) string {
+		input := map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": []string{"mrn:iam:role:editor"}, "scopes": scopes},
+			"operation": "api:documents:read",
+			"resource":  resource,
+			"context":   context,
+		}
+		data, err := json.Marshal(input)
+		require.NoError(t, err)
+		return string(data)
+	}
+	ip := func(addr string) map[string]interface{} { return map[string]interface{}{"ip": addr} }
+
+	for _, tc := range []struct {
+		name     string
+		porc     string
+		allowed  bool
+		reason   string
+		cacheTTL time.Duration
+	}{
+		{"internal client", porc("mrn:app:document:internal", ip("10.2.3.4")), true, "", 0},
+		{"external client", porc("mrn:app:document:internal", ip("203.0.113.7")), false, "network rule mrn:iam:resource-group:internal: client 203.0.113.7 outside 10.0.0.0/8", 0},
+		{"unknown client", porc("mrn:app:document:internal", nil), false, "network rule mrn:iam:resource-group:internal: client address unknown", 0},
+		{"located client", porc("mrn:app:document:domestic", ip("203.0.113.7")), true, "", 0},
+		{"located elsewhere", porc("mrn:app:document:domestic", ip("198.51.100.1")), false, "network rule mrn:iam:resource-group:domestic: client 198.51.100.1 located in DE, not US, CA", 0},
+		{"located by request", porc("mrn:app:document:domestic", map[string]interface{}{"ip": "192.0.2.1", "geo": map[string]interface{}{"country": "CA"}}), true, "", 0},
+		{"country unknown", porc("mrn:app:document:domestic", ip("192.0.2.1")), false, "network rule mrn:iam:resource-group:domestic: country of client 192.0.2.1 unknown", 0},
+		{"policy locates client", porc("mrn:app:document:home", ip("203.0.113.7")), true, "", 0},
+		{"policy locates client elsewhere", porc("mrn:app:document:home", ip("198.51.100.1")), false, "", 0},
+		{"scope admits", porc("mrn:app:document:1", ip("10.1.2.3"), "mrn:iam:scope:office"), true, "", 0},
+		{"scope does not admit", porc("mrn:app:document:1", ip("10.2.3.4"), "mrn:iam:scope:office"), false, "network rule mrn:iam:scope:office: client 10.2.3.4 outside 10.1.0.0/16, fd00::/8", 0},
+		{"no network rule", porc("mrn:app:document:1", ip("10.2.3.4")), true, "", time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, err := pe.Decide(context.Background(), tc.porc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowed, decision.Allow)
+			assert.Equal(t, tc.cacheTTL, decision.Cache.TTL, "decisions consulting the network origin are not cacheable")
+
+			record := <-factory.C()
+			if tc.reason != "" {
+				assert.True(t, slices.ContainsFunc(record.References, func(ref *events.AccessRecord_BundleReference) bool {
+					return ref.Decision == events.AccessRecord_DENY && ref.Reason == tc.reason
+				}), "%+v", record.References)
+			}
+		})
+	}
+}
+
+func TestPolicyEngine_Calendars(t *testing.T) {
+	const inTokyo = "mrn:iam:policy:in-tokyo"
+	b := newBuilder().
+		WithPolicyRego(inTokyo, "package authz\ndefault allow = false\nallow {\n  input.calendar.timezone == \"Asia/Tokyo\"\n  calendar.now().date == input.calendar.date\n}\n").
+		WithResourceGroup("mrn:iam:resource-group:tokyo", inTokyo).
+		WithResource("mrn:app:document:tokyo", "mrn:iam:resource-group:tokyo")
+	business, err := calendar.New(calendar.Options{Timezone: "America/New_York"})
+	require.NoError(t, err)
+	tokyo, err := calendar.New(calendar.Options{Timezone: "Asia/Tokyo"})
+	require.NoError(t, err)
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory), options.WithDecisionCacheTTL(time.Minute),
+		options.WithCalendars(&calendar.Calendars{Default: business, Realms: map[string]*calendar.Calendar{"apac": tokyo}}))
+	require.NoError(t, err)
+
+	porc := func(realm, resource string) string {
+		data, err := json.Marshal(map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mrealm": realm, "mroles": []string{"mrn:iam:role:editor"}},
+			"operation": "api:documents:read",
+			"resource":  resource,
+		})
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		porc     string
+		allowed  bool
+		timezone string
+		cacheTTL time.Duration
+	}{
+		{"realm calendar", porc("apac", "mrn:app:document:tokyo"), true, "Asia/Tokyo", 0},
+		{"default calendar", porc("emea", "mrn:app:document:tokyo"), false, "America/New_York", 0},
+		{"calendar not read", porc("apac", "mrn:app:document:1"), true, "Asia/Tokyo", time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, err := pe.Decide(context.Background(), tc.porc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowed, decision.Allow)
+			assert.Equal(t, tc.cacheTTL, decision.Cache.TTL, "decisions reading the calendar are not cacheable")
+
+			// the moment given to policies is audited with the PORC
+			record := <-factory.C()
+			var audited map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(record.Porc), &audited))
+			moment, ok := audited["calendar"].(map[string]interface{})
+			require.True(t, ok, "%s", record.Porc)
+			assert.Equal(t, tc.timezone, moment["timezone"])
+		})
+	}
+}
+
+type riskProvider struct {
+	scores map[string]float64
+}
+
+func (p riskProvider) Name() string {
+	return "fraud"
+}
+
+func (p riskProvider) Score(_ context.Context, porc map[string]interface{}) (float64, error) {
+	sub, _ := porc["principal"].(map[string]interface{})["sub"].(string)
+	score, ok := p.scores[sub]
+	if !ok {
+		return 0, errors.New("unknown subject")
+	}
+	return score, nil
+}
+
+func TestPolicyEngine_Risk(t *testing.T) {
+	const lowRisk = "mrn:iam:policy:low-risk"
+	b := newBuilder().
+		WithPolicyRego(lowRisk, "package authz\ndefault allow = false\nallow { input.context.risk <= 70 }\n").
+		WithResourceGroup("mrn:iam:resource-group:sensitive", lowRisk).
+		WithResource("mrn:app:document:sensitive", "mrn:iam:resource-group:sensitive")
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory), options.WithDecisionCacheTTL(time.Minute),
+		options.WithRiskProvider(riskProvider{scores: map[string]float64{"alice": 12, "mallory": 95}}))
+	require.NoError(t, err)
+
+	porc := func(sub, resource string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": sub, "mroles": []string{"mrn:iam:role:editor"}},
+			"operation": "api:documents:read",
+			"resource":  resource,
+			"context":   map[string]interface{}{"risk": 0},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		porc     map[string]interface{}
+		allowed  bool
+		risk     *events.AccessRecord_Risk
+		cacheTTL time.Duration
+	}{
+		{"low risk", porc("alice", "mrn:app:document:sensitive"), true, &events.AccessRecord_Risk{Score: 12, Provider: "fraud"}, 0},
+		{"high risk", porc("mallory", "mrn:app:document:sensitive"), false, &events.AccessRecord_Risk{Score: 95, Provider: "fraud"}, 0},
+		{"risk unknown", porc("eve", "mrn:app:document:sensitive"), false, &events.AccessRecord_Risk{Score: 100, Provider: "fraud", Defaulted: true, Error: "unknown subject"}, 0},
+		{"risk not read", porc("mallory", "mrn:app:document:1"), true, &events.AccessRecord_Risk{Score: 95, Provider: "fraud"}, time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			given := tc.porc["context"].(map[string]interface{})
+			decision, err := pe.Decide(context.Background(), tc.porc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowed, decision.Allow)
+			assert.Equal(t, tc.cacheTTL, decision.Cache.TTL, "decisions reading the risk score are not cacheable")
+			assert.Equal(t, 0, given["risk"], "the score given by the request is replaced, not modified")
+
+			record := <-factory.C()
+			assert.True(t, proto.Equal(tc.risk, record.Risk), "%+v", record.Risk)
+		})
+	}
+}
+
+func TestPolicyEngine_ContextSchema(t *testing.T) {
+	b := newBuilder().
+		WithOperation("^api:transfer:.*", operate, ContextSchema(map[string]interface{}{
+			"type":                 "object",
+			"required":             []interface{}{"amount"},
+			"properties":           map[string]interface{}{"amount": map[string]interface{}{"type": "number"}},
+			"additionalProperties": false,
+		}))
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory),
+		options.WithRiskProvider(riskProvider{scores: map[string]float64{"alice": 12}}))
+	require.NoError(t, err)
+
+	porc := func(context interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": []string{"mrn:iam:role:editor"}},
+			"operation": "api:transfer:create",
+			"resource":  "mrn:app:account:1",
+			"context":   context,
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		porc    map[string]interface{}
+		allowed bool
+		reason  string
+	}{
+		{"valid context", porc(map[string]interface{}{"amount": 10}), true, ""},
+		{"missing field", porc(map[string]interface{}{}), false, "context of operation api:transfer:create: (Root): amount is required"},
+		{"missing context", porc(nil), false, "(Root): amount is required"},
+		{"wrong type", porc(map[string]interface{}{"amount": "ten"}), false, "amount: Invalid type. Expected: number, given: string"},
+		{"unexpected field", porc(map[string]interface{}{"amount": 10, "note": "x"}), false, "Additional property note is not allowed"},
+		{"not an object", porc("amount=10"), false, "must be an object"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, err := pe.Authorize(context.Background(), tc.porc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowed, allowed)
+
+			record := <-factory.C()
+			if tc.reason == "" {
+				return
+			}
+			assert.True(t, slices.ContainsFunc(record.References, func(ref *events.AccessRecord_BundleReference) bool {
+				return ref.Phase == events.AccessRecord_BundleReference_SYSTEM && ref.Decision == events.AccessRecord_DENY &&
+					ref.ReasonCode == events.AccessRecord_BundleReference_INVALPARAM_ERROR && strings.Contains(ref.Reason, tc.reason)
+			}), "%+v", record.References)
+		})
+	}
+}
+
+func TestPolicyEngine_AllowedPurposes(t *testing.T) {
+	b := newBuilder().
+		WithResourceGroup("mrn:iam:resource-group:customers", allow, AllowedPurposes("billing", "support")).
+		WithResource("mrn:app:profile:1", "mrn:iam:resource-group:customers").
+		WithResource("mrn:app:profile:2", "mrn:iam:resource-group:customers", AllowedPurposes("support"))
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory))
+	require.NoError(t, err)
+
+	porc := func(resource string, purpose interface{}) map[string]interface{} {
+		input := map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": []string{"mrn:iam:role:editor"}},
+			"operation": "api:documents:read",
+			"resource":  resource,
+		}
+		if purpose != nil {
+			input["context"] = map[string]interface{}{"purpose": purpose}
+		}
+		return input
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		resource string
+		purpose  interface{}
+		allowed  bool
+	}{
+		{"mrn:app:profile:1", "billing", true},
+		{"mrn:app:profile:1", []interface{}{"marketing", "support"}, true},
+		{"mrn:app:profile:1", "marketing", false},
+		{"mrn:app:profile:1", nil, false},
+		{"mrn:app:profile:2", "billing", false},
+		{"mrn:app:profile:2", "support", true},
+		{"mrn:app:document:1", nil, true},
+		{"mrn:app:document:1", "marketing", true},
+	} {
+		allowed, err := pe.Authorize(ctx, porc(tc.resource, tc.purpose))
+		require.NoError(t, err)
+		assert.Equal(t, tc.allowed, allowed, "%v on %s", tc.purpose, tc.resource)
+
+		record := <-factory.C()
+		if tc.purpose == nil && tc.resource == "mrn:app:document:1" {
+			assert.Nil(t, record.Purpose, "unrestricted requests declaring no purpose record none")
+		} else {
+			require.NotNil(t, record.Purpose)
+		}
+	}
+
+	allowed, err := pe.Authorize(ctx, porc("mrn:app:profile:2", "marketing"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	record := <-factory.C()
+	assert.Equal(t, []string{"marketing"}, record.Purpose.Declared)
+	assert.Equal(t, []string{"support"}, record.Purpose.Allowed)
+	var denial *events.AccessRecord_BundleReference
+	for _, ref := range record.References {
+		if ref.Phase == events.AccessRecord_BundleReference_RESOURCE && ref.Decision == events.AccessRecord_DENY {
+			denial = ref
+		}
+	}
+	require.NotNil(t, denial)
+	assert.Equal(t, "purpose marketing not allowed, resource allows support", denial.Reason)
+
+	// nor does an operation policy granting in phase1 lift the limitation
+	b.WithPolicyRego("mrn:iam:policy:public", "package authz\ndefault allow = 1\n").
+		WithOperation("^api:public:.*", "mrn:iam:policy:public")
+	input := porc("mrn:app:profile:2", "marketing")
+	input["operation"] = "api:public:read"
+	allowed, err = pe.Authorize(ctx, input)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	record = <-factory.C()
+	assert.Equal(t, events.AccessRecord_DENY, record.Decision)
+	assert.False(t, record.SystemOverride)
+
+	input["context"] = map[string]interface{}{"purpose": "support"}
+	allowed, err = pe.Authorize(ctx, input)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.True(t, (<-factory.C()).SystemOverride)
+}
+
+func TestPolicyEngine_DenyPolicies(t *testing.T) {
+	const highRisk = "mrn:iam:policy:high-risk"
+	b := newBuilder().
+		WithPolicyRego(highRisk, "package authz\ndefault allow = true\nallow = false { input.context.risk == \"high\" }\n").
+		WithRole("mrn:iam:role:contractor", deny, DenyPolicies(highRisk)).
+		WithResourceGroup("mrn:iam:resource-group:records", allow, GrantOwners(""), DenyPolicies(highRisk)).
+		WithResource("mrn:app:record:1", "mrn:iam:resource-group:records", Owner("alice"))
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory))
+	require.NoError(t, err)
+
+	porc := func(roles []string, resource, risk string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": roles},
+			"operation": "api:documents:read",
+			"resource":  resource,
+			"context":   map[string]interface{}{"risk": risk},
+		}
+	}
+	both := []string{"mrn:iam:role:editor", "mrn:iam:role:contractor"}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		roles    []string
+		resource string
+		risk     string
+		allowed  bool
+		explicit string // entity whose deny policy denied the request
+	}{
+		{"no deny", both, "mrn:app:document:1", "low", true, ""},
+		{"another role grants", both, "mrn:app:document:1", "high", false, "mrn:iam:role:contractor"},
+		{"role not held", []string{"mrn:iam:role:editor"}, "mrn:app:document:1", "high", true, ""},
+		{"owner rule", []string{"mrn:iam:role:editor"}, "mrn:app:record:1", "low", true, ""},
+		{"overrides owner rule", []string{"mrn:iam:role:editor"}, "mrn:app:record:1", "high", false, "mrn:iam:resource-group:records"},
+	} {
+		allowed, err := pe.Authorize(ctx, porc(tc.roles, tc.resource, tc.risk))
+		require.NoError(t, err)
+		assert.Equal(t, tc.allowed, allowed, tc.name)
+
+		record := <-factory.C()
+		var explicit *events.AccessRecord_BundleReference
+		for _, ref := range record.References {
+			if ref.ReasonCode == events.AccessRecord_BundleReference_EXPLICIT_DENY {
+				explicit = ref
+			}
+		}
+		if tc.explicit == "" {
+			assert.Nil(t, explicit, tc.name)
+			continue
+		}
+		require.NotNil(t, explicit, tc.name)
+		assert.Equal(t, tc.explicit, explicit.Id)
+		assert.Equal(t, highRisk, explicit.Policies[0].Mrn)
+		assert.Equal(t, events.AccessRecord_DENY, explicit.Decision)
+		assert.Equal(t, "explicit deny by "+highRisk, explicit.Reason)
+	}
+}
+
+func TestPolicyEngine_RequiresApproval(t *testing.T) {
+	b := newBuilder().WithOperation("^admin:.*", operate, RequiresApproval(2))
+	factory := accesslog.NewChannelFactory(1)
+	var notified []approval.Request
+	notifier := approval.NotifierFunc(func(_ context.Context, r approval.Request) error {
+		notified = append(notified, r)
+		return nil
+	})
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory), options.WithApprovalNotifier(notifier))
+	require.NoError(t, err)
+
+	porc := func(roles []string, token string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": roles},
+			"operation": "admin:tenant:delete",
+			"resource":  "mrn:app:document:1",
+			"context":   map[string]interface{}{"approval": token},
+		}
+	}
+	editor := []string{"mrn:iam:role:editor"}
+	ctx := context.Background()
+
+	// a request the policies deny is never pending
+	decision, err := pe.Decide(ctx, porc([]string{"mrn:iam:role:guest"}, ""))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	assert.Nil(t, decision.Approval)
+	assert.Equal(t, events.AccessRecord_DENY, (<-factory.C()).Decision)
+
+	// a probe is pending without opening a request
+	decision, err = pe.Decide(ctx, porc(editor, ""), options.SetProbeMode(true))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	assert.Nil(t, decision.Approval)
+	assert.Empty(t, pe.ListApprovals())
+
+	decision, err = pe.Decide(ctx, porc(editor, ""))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	require.NotNil(t, decision.Approval)
+	id := decision.Approval.ID
+	record := <-factory.C()
+	assert.Equal(t, events.AccessRecord_PENDING, record.Decision)
+	assert.Equal(t, &events.AccessRecord_Approval{RequestId: id, Required: 2}, record.Approval)
+	require.Len(t, notified, 1)
+	assert.Equal(t, id, notified[0].ID)
+	assert.Equal(t, "alice", notified[0].Subject)
+	assert.Equal(t, "admin:tenant:delete", notified[0].Operation)
+
+	// the request is pending on the same approval request until it is approved
+	_, err = pe.Approve(id, "alice")
+	assert.ErrorContains(t, err, "cannot approve their own request")
+	_, err = pe.Approve(id, "bob")
+	require.NoError(t, err)
+	decision, err = pe.Decide(ctx, porc(editor, id))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	assert.Equal(t, id, decision.Approval.ID)
+	assert.Equal(t, events.AccessRecord_PENDING, (<-factory.C()).Decision)
+	assert.Len(t, notified, 1, "an approval request is notified once")
+
+	r, err := pe.Approve(id, "carol")
+	require.NoError(t, err)
+	assert.True(t, r.Approved())
+
+	// another request may not redeem the approval
+	other := porc(editor, id)
+	other["resource"] = "mrn:app:document:2"
+	allowed, err := pe.Authorize(ctx, other)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	<-factory.C()
+	require.Len(t, notified, 2)
+	assert.Equal(t, "mrn:app:document:2", notified[1].Resource)
+
+	allowed, err = pe.Authorize(ctx, porc(editor, id), options.SetProbeMode(true))
+	require.NoError(t, err)
+	assert.True(t, allowed, "a probe sees an approved request without redeeming it")
+
+	decision, err = pe.Decide(ctx, porc(editor, id))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Equal(t, []string{"bob", "carol"}, decision.Approval.Approvers)
+	assert.Zero(t, decision.Cache.TTL)
+	record = <-factory.C()
+	assert.Equal(t, events.AccessRecord_GRANT, record.Decision)
+	assert.Equal(t, &events.AccessRecord_Approval{RequestId: id, Required: 2, Approvers: []string{"bob", "carol"}}, record.Approval)
+
+	// an approval grants once
+	allowed, err = pe.Authorize(ctx, porc(editor, id))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, events.AccessRecord_PENDING, (<-factory.C()).Decision)
+	require.Len(t, notified, 3)
+	assert.NotEqual(t, id, notified[2].ID)
+
+	// operations that do not require approval are unaffected
+	decision, err = pe.Decide(ctx, map[string]interface{}{
+		"principal": map[string]interface{}{"sub": "alice", "mroles": editor},
+		"operation": "api:documents:read",
+		"resource":  "mrn:app:document:1",
+	})
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Nil(t, decision.Approval)
+	assert.Nil(t, (<-factory.C()).Approval)
+}
+
+func TestPolicyEngine_IdentityRequirement(t *testing.T) {
+	b := newBuilder().
+		WithRole("mrn:iam:role:auditor", allow).
+		WithGroup("mrn:iam:group:auditors", []string{"mrn:iam:role:auditor"}).
+		WithOperation("^bank:wire:.*", operate, RequiresRoles(true, 0)).
+		WithOperation("^bank:close:.*", operate, RequiresRoles(false, 2))
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory))
+	require.NoError(t, err)
+
+	porc := func(operation string, roles []string, groups ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "alice", "mroles": roles, "mgroups": groups},
+			"operation": operation,
+			"resource":  "mrn:app:document:1",
+		}
+	}
+	editor, auditor, guest := "mrn:iam:role:editor", "mrn:iam:role:auditor", "mrn:iam:role:guest"
+
+	for _, tc := range []struct {
+		name     string
+		porc     map[string]interface{}
+		allowed  bool
+		identity *events.AccessRecord_Identity
+		reason   string
+	}{
+		{"any role suffices", porc("api:documents:read", []string{editor, guest}), true, nil, ""},
+		{"all roles grant", porc("bank:wire:send", []string{editor, auditor}), true,
+			&events.AccessRecord_Identity{All: true, Minimum: 1, Roles: 2, Granted: 2}, ""},
+		{"roles of groups must grant", porc("bank:wire:send", []string{editor}, "mrn:iam:group:auditors"), true,
+			&events.AccessRecord_Identity{All: true, Minimum: 1, Roles: 2, Granted: 2}, ""},
+		{"a role denies", porc("bank:wire:send", []string{editor, guest}), false,
+			&events.AccessRecord_Identity{All: true, Minimum: 1, Roles: 2, Granted: 1}, "identity requirement: 1 of 2 role(s) granted, all required"},
+		{"a role is missing", porc("bank:wire:send", []string{editor, "mrn:iam:role:missing"}), false,
+			&events.AccessRecord_Identity{All: true, Minimum: 1, Roles: 2, Granted: 1}, "identity requirement: 1 of 2 role(s) granted, all required"},
+		{"no roles", porc("bank:wire:send", nil), false,
+			&events.AccessRecord_Identity{All: true, Minimum: 1}, "identity requirement: 0 of 0 role(s) granted, all required"},
+		{"minimum met", porc("bank:close:account", []string{editor, auditor, guest}), true,
+			&events.AccessRecord_Identity{Minimum: 2, Roles: 3, Granted: 2}, ""},
+		{"minimum not met", porc("bank:close:account", []string{editor, guest}), false,
+			&events.AccessRecord_Identity{Minimum: 2, Roles: 2, Granted: 1}, "identity requirement: 1 of 2 role(s) granted, at least 2 required"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, err := pe.Decide(context.Background(), tc.porc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowed, decision.Allow)
+
+			record := <-factory.C()
+			assert.True(t, proto.Equal(tc.identity, record.Identity), "%v", record.Identity)
+			if tc.reason != "" {
+				assert.True(t, slices.ContainsFunc(record.References, func(ref *events.AccessRecord_BundleReference) bool {
+					return ref.Phase == events.AccessRecord_BundleReference_IDENTITY && ref.Decision == events.AccessRecord_DENY && ref.Reason == tc.reason
+				}), "%+v", record.References)
+			}
+		})
+	}
+}
+
+func TestPolicyEngine_ConsentChecker(t *testing.T) {
+	b := newBuilder().
+		WithResourceGroup("mrn:iam:resource-group:patients", allow, Annotation(consent.Annotation, true)).
+		WithResourceGroup("mrn:iam:resource-group:restricted", deny, Annotation(consent.Annotation, true)).
+		WithResource("mrn:app:health:alice", "mrn:iam:resource-group:patients", Owner("alice")).
+		WithResource("mrn:app:health:bob", "mrn:iam:resource-group:patients", Owner("bob")).
+		WithResource("mrn:app:health:orphan", "mrn:iam:resource-group:patients").
+		WithResource("mrn:app:health:public", "mrn:iam:resource-group:patients", Owner("bob"), Annotation(consent.Annotation, false)).
+		WithResource("mrn:app:health:denied", "mrn:iam:resource-group:restricted", Owner("alice"))
+	records := consent.NewMemory()
+	records.Grant("alice", "care")
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(
+		options.WithBackend(b),
+		options.WithAccessLog(factory),
+		options.WithConsentChecker(records),
+		options.WithDecisionCacheTTL(time.Minute),
+	)
+	require.NoError(t, err)
+
+	porc := func(resource, purpose string) map[string]interface{} {
+		return map[string]interface{}{
+			"principal": map[string]interface{}{"sub": "dr-carol", "mroles": []string{"mrn:iam:role:editor"}},
+			"operation": "api:documents:read",
+			"resource":  resource,
+			"context":   map[string]interface{}{"purpose": purpose},
+		}
+	}
+	consentReference := func(record *events.AccessRecord) *events.AccessRecord_BundleReference {
+		for _, ref := range record.References {
+			if ref.Phase == events.AccessRecord_BundleReference_RESOURCE && ref.Id == record.Resource {
+				return ref
+			}
+		}
+		return nil
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		resource, purpose string
+		allowed           bool
+		reason            string
+	}{
+		{"mrn:app:health:alice", "care", true, "consent memory: granted by alice"},
+		{"mrn:app:health:alice", "research", false, "consent memory: not granted by alice"},
+		{"mrn:app:health:bob", "care", false, "consent memory: not granted by bob"},
+		{"mrn:app:health:orphan", "care", false, "resource mrn:app:health:orphan has no owner whose consent could be checked"},
+		{"mrn:app:health:public", "care", true, ""},
+		{"mrn:app:health:denied", "care", false, ""},
+	} {
+		decision, err := pe.Decide(ctx, porc(tc.resource, tc.purpose))
+		require.NoError(t, err)
+		assert.Equal(t, tc.allowed, decision.Allow, "%s for %s", tc.resource, tc.purpose)
+
+		record := <-factory.C()
+		ref := consentReference(record)
+		if tc.reason == "" {
+			assert.Nil(t, ref, "%s needs no consent check", tc.resource)
+			continue
+		}
+		require.NotNil(t, ref)
+		assert.Equal(t, tc.reason, ref.Reason)
+		if tc.allowed {
+			assert.Zero(t, decision.Cache.TTL, "decisions that checked consent are not cacheable")
+		}
+	}
+
+	// revoked consent applies to the following decisions
+	records.Revoke("alice")
+	allowed, err := pe.Authorize(ctx, porc("mrn:app:health:alice", "care"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	<-factory.C()
+
+	// without a checker, consent-gated resources are never granted
+	pe, err = core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory))
+	require.NoError(t, err)
+	allowed, err = pe.Authorize(ctx, porc("mrn:app:health:alice", "care"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	record := <-factory.C()
+	require.NotNil(t, consentReference(record))
+	assert.Equal(t, events.AccessRecord_BundleReference_NOTFOUND_ERROR, consentReference(record).ReasonCode)
+}
+
+func TestPolicyEngine_ListPermittedOperations(t *testing.T) {
+	b := newBuilder().
+		WithPolicyRego("mrn:iam:policy:reader", "package authz\ndefault allow = false\nallow { input.operation == \"api:documents:read\" }\n").
+		WithRole("mrn:iam:role:reader", "mrn:iam:policy:reader").
+		WithOperation("^api:documents:purge$", deny)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	principal := map[string]interface{}{"sub": "alice", "mroles": []string{"mrn:iam:role:reader"}}
+	permitted, err := pe.ListPermittedOperations(context.Background(), principal, "mrn:app:document:1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api:documents:read"}, permitted)
+}
+
+func TestPolicyEngine_EvaluationLimits(t *testing.T) {
+	b := newBuilder()
+	var scopes []string
+	for i := 0; i < 64; i++ {
+		scope := "mrn:iam:scope:s" + strings.Repeat("x", i)
+		b.WithScope(scope, deny)
+		scopes = append(scopes, scope)
+	}
+	const granting = "mrn:iam:scope:granting"
+	b.WithScope(granting, allow)
+
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewPolicyEngine(options.WithBackend(b), options.WithAccessLog(factory),
+		options.WithEvaluationConcurrency(1), options.WithEvaluationFanout(4))
+	require.NoError(t, err)
+
+	data, err := json.Marshal(map[string]interface{}{
+		"principal": map[string]interface{}{"sub": "alice", "mroles": []string{"mrn:iam:role:editor"}, "scopes": append(scopes, granting)},
+		"operation": "api:documents:read",
+		"resource":  "mrn:app:document:1",
+	})
+	require.NoError(t, err)
+	decision, err := pe.Decide(context.Background(), string(data))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+
+	// every scope is still evaluated, and reported in order
+	record := <-factory.C()
+	var evaluated []string
+	for _, ref := range record.References {
+		if ref.Phase == events.AccessRecord_BundleReference_SCOPE {
+			evaluated = append(evaluated, ref.Id)
+		}
+	}
+	assert.Equal(t, append(scopes, granting), evaluated)
+}
@@ -0,0 +1,240 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package calendar gives policies the business calendar of a request's realm, so that
+// policies granting access only during business hours need not parse the wall clock
+// or know the timezone of each realm themselves.
+//
+// A [Calendar] holds a timezone, the business hours of a day, the business days of a
+// week, and holidays. The engine picks the calendar of the principal's realm from
+// [Calendars], given with options.WithCalendars or configured as calendars, and gives
+// policies the [Moment] of the request in it as input.calendar:
+//
+//	{
+//	    "timezone": "America/New_York",
+//	    "date": "2026-10-16",
+//	    "time": "14:05",
+//	    "weekday": "friday",
+//	    "hour": 14,
+//	    "minute": 5,
+//	    "holiday": false,
+//	    "business_day": true,
+//	    "business_hours": true
+//	}
+//
+// Policies may also call the calendar.business_hours, calendar.between, and calendar.now
+// built-ins (see the opa package). Decisions depending on the calendar change with time,
+// so they are never reported as cacheable (see model.CacheHint).
+//
+// # Usage
+//
+//	business, err := calendar.New(calendar.Options{Timezone: "America/New_York"})
+//	pe, err := core.NewPolicyEngine(options.WithCalendars(&calendar.Calendars{Default: business}))
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// timezones are known even where the system has no zoneinfo, as in distroless images
+	_ "time/tzdata"
+)
+
+// DateLayout is the layout of the dates of holidays and moments.
+const DateLayout = "2006-01-02"
+
+// DefaultHours are the business hours of a calendar that does not set them.
+const DefaultHours = "09:00-17:00"
+
+// DefaultDays are the business days of a calendar that does not set them.
+var DefaultDays = []string{"monday", "tuesday", "wednesday", "thursday", "friday"}
+
+// Options configures a [Calendar]. Empty fields take their defaults.
+type Options struct {
+	// Timezone is the IANA name of the calendar's timezone, such as "Europe/London".
+	// Default: UTC.
+	Timezone string
+	// Hours are the business hours of each business day, as "HH:MM-HH:MM", such as
+	// "08:30-17:30". Hours ending earlier than they start span midnight. Default: [DefaultHours].
+	Hours string
+	// Days are the business days of the week, such as "monday". Default: [DefaultDays].
+	Days []string
+	// Holidays are the dates, as "2006-01-02", that are not business days.
+	Holidays []string
+}
+
+// Calendar is the business calendar of a realm. A Calendar is immutable and safe for
+// concurrent use.
+type Calendar struct {
+	location *time.Location
+	start    time.Duration // start of business hours, since midnight
+	end      time.Duration // end of business hours, since midnight
+	days     [7]bool
+	holidays map[string]bool
+}
+
+// New creates a [Calendar].
+//
+// Returns an error if the timezone is unknown, or if the hours, days, or holidays
+// cannot be parsed.
+func New(opts Options) (*Calendar, error) {
+	location, err := time.LoadLocation(opts.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone '%s': %w", opts.Timezone, err)
+	}
+
+	hours := opts.Hours
+	if hours == "" {
+		hours = DefaultHours
+	}
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid hours '%s', expected HH:MM-HH:MM", hours)
+	}
+	start, err := ParseClock(strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hours '%s': %w", hours, err)
+	}
+	end, err := ParseClock(strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hours '%s': %w", hours, err)
+	}
+
+	c := &Calendar{location: location, start: start, end: end, holidays: make(map[string]bool, len(opts.Holidays))}
+
+	days := opts.Days
+	if len(days) == 0 {
+		days = DefaultDays
+	}
+	for _, day := range days {
+		d, err := parseWeekday(day)
+		if err != nil {
+			return nil, err
+		}
+		c.days[d] = true
+	}
+
+	for _, holiday := range opts.Holidays {
+		if _, err := time.Parse(DateLayout, holiday); err != nil {
+			return nil, fmt.Errorf("invalid holiday '%s', expected %s", holiday, DateLayout)
+		}
+		c.holidays[holiday] = true
+	}
+
+	return c, nil
+}
+
+// ParseClock parses a time of day, as "HH:MM", such as "17:30", returning the time since
+// midnight.
+func ParseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day '%s', expected a weekday such as monday", s)
+}
+
+// Location returns the timezone of the calendar.
+func (c *Calendar) Location() *time.Location {
+	return c.location
+}
+
+// Moment is an instant in a [Calendar], as given to policies.
+type Moment struct {
+	Timezone      string `json:"timezone"`
+	Date          string `json:"date"`    // as "2006-01-02"
+	Time          string `json:"time"`    // as "15:04"
+	Weekday       string `json:"weekday"` // such as "monday"
+	Hour          int    `json:"hour"`
+	Minute        int    `json:"minute"`
+	Holiday       bool   `json:"holiday"`
+	BusinessDay   bool   `json:"business_day"`
+	BusinessHours bool   `json:"business_hours"`
+}
+
+// At returns the moment of t in the calendar.
+func (c *Calendar) At(t time.Time) Moment {
+	local := t.In(c.location)
+	date := local.Format(DateLayout)
+	m := Moment{
+		Timezone: c.location.String(),
+		Date:     date,
+		Time:     local.Format("15:04"),
+		Weekday:  strings.ToLower(local.Weekday().String()),
+		Hour:     local.Hour(),
+		Minute:   local.Minute(),
+		Holiday:  c.holidays[date],
+	}
+	m.BusinessDay = c.days[local.Weekday()] && !m.Holiday
+	m.BusinessHours = c.BusinessHours(t)
+	return m
+}
+
+// BusinessHours reports whether t is within the business hours of a business day. Hours
+// spanning midnight belong to the day on which they start.
+func (c *Calendar) BusinessHours(t time.Time) bool {
+	local := t.In(c.location)
+	clock := sinceMidnight(local)
+	if c.start <= c.end {
+		return c.businessDay(local) && clock >= c.start && clock < c.end
+	}
+	// the hours after midnight belong to the previous day
+	if clock < c.end {
+		return c.businessDay(local.AddDate(0, 0, -1))
+	}
+	return c.businessDay(local) && clock >= c.start
+}
+
+// Between reports whether the time of day of t in the calendar's timezone is within
+// [start, end), both since midnight. A window ending earlier than it starts spans midnight.
+func (c *Calendar) Between(t time.Time, start, end time.Duration) bool {
+	clock := sinceMidnight(t.In(c.location))
+	if start <= end {
+		return clock >= start && clock < end
+	}
+	return clock >= start || clock < end
+}
+
+func (c *Calendar) businessDay(local time.Time) bool {
+	return c.days[local.Weekday()] && !c.holidays[local.Format(DateLayout)]
+}
+
+func sinceMidnight(local time.Time) time.Duration {
+	return time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+}
+
+// Calendars holds the calendars of realms. A nil Calendars has none.
+type Calendars struct {
+	// Default is the calendar of realms without one of their own, nil if none.
+	Default *Calendar
+	// Realms are the calendars of realms, by realm.
+	Realms map[string]*Calendar
+}
+
+// For returns the calendar of realm, or nil if there is none.
+func (cs *Calendars) For(realm string) *Calendar {
+	if cs == nil {
+		return nil
+	}
+	if c, ok := cs.Realms[realm]; ok {
+		return c
+	}
+	return cs.Default
+}
+
+// IsEmpty reports whether there are no calendars.
+func (cs *Calendars) IsEmpty() bool {
+	return cs == nil || (cs.Default == nil && len(cs.Realms) == 0)
+}
@@ -0,0 +1,136 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"unknown timezone", Options{Timezone: "Mars/Olympus_Mons"}, "unknown timezone 'Mars/Olympus_Mons'"},
+		{"hours without end", Options{Hours: "09:00"}, "invalid hours '09:00', expected HH:MM-HH:MM"},
+		{"invalid start", Options{Hours: "9am-17:00"}, "invalid hours '9am-17:00': invalid time of day '9am', expected HH:MM"},
+		{"invalid end", Options{Hours: "09:00-25:00"}, "invalid hours '09:00-25:00': invalid time of day '25:00', expected HH:MM"},
+		{"invalid day", Options{Days: []string{"monday", "funday"}}, "invalid day 'funday', expected a weekday such as monday"},
+		{"invalid holiday", Options{Holidays: []string{"12/25/2026"}}, "invalid holiday '12/25/2026', expected 2006-01-02"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.opts)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestCalendar_At(t *testing.T) {
+	c, err := New(Options{Timezone: "America/New_York", Holidays: []string{"2026-11-26"}})
+	require.NoError(t, err)
+	assert.Equal(t, "America/New_York", c.Location().String())
+
+	// 18:05 UTC is 14:05 in New York, in daylight saving time
+	assert.Equal(t, Moment{
+		Timezone:      "America/New_York",
+		Date:          "2026-10-16",
+		Time:          "14:05",
+		Weekday:       "friday",
+		Hour:          14,
+		Minute:        5,
+		BusinessDay:   true,
+		BusinessHours: true,
+	}, c.At(time.Date(2026, 10, 16, 18, 5, 0, 0, time.UTC)))
+
+	// 02:00 UTC on Saturday is still Friday evening in New York
+	m := c.At(time.Date(2026, 10, 17, 2, 0, 0, 0, time.UTC))
+	assert.Equal(t, "2026-10-16", m.Date)
+	assert.Equal(t, "friday", m.Weekday)
+	assert.True(t, m.BusinessDay)
+	assert.False(t, m.BusinessHours)
+
+	m = c.At(time.Date(2026, 11, 26, 15, 0, 0, 0, time.UTC))
+	assert.True(t, m.Holiday)
+	assert.False(t, m.BusinessDay)
+	assert.False(t, m.BusinessHours)
+}
+
+func TestCalendar_BusinessHours(t *testing.T) {
+	c, err := New(Options{Timezone: "Europe/London", Hours: "08:30-17:30", Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}})
+	require.NoError(t, err)
+
+	london := c.Location()
+	for _, tt := range []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"before opening", time.Date(2026, 10, 16, 8, 29, 0, 0, london), false},
+		{"at opening", time.Date(2026, 10, 16, 8, 30, 0, 0, london), true},
+		{"before closing", time.Date(2026, 10, 16, 17, 29, 59, 0, london), true},
+		{"at closing", time.Date(2026, 10, 16, 17, 30, 0, 0, london), false},
+		{"weekend", time.Date(2026, 10, 17, 12, 0, 0, 0, london), false},
+		{"in another timezone", time.Date(2026, 10, 16, 4, 0, 0, 0, time.FixedZone("EDT", -4*60*60)), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, c.BusinessHours(tt.at))
+		})
+	}
+}
+
+func TestCalendar_OvernightHours(t *testing.T) {
+	// the night shift of friday runs into saturday, but none starts on saturday
+	c, err := New(Options{Hours: "22:00-06:00"})
+	require.NoError(t, err)
+
+	assert.True(t, c.BusinessHours(time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, c.BusinessHours(time.Date(2026, 10, 17, 5, 0, 0, 0, time.UTC)))
+	assert.False(t, c.BusinessHours(time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC)))
+	assert.False(t, c.BusinessHours(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)))
+	// nor does monday's shift begin before it starts
+	assert.False(t, c.BusinessHours(time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC)))
+}
+
+func TestCalendar_Between(t *testing.T) {
+	c, err := New(Options{Timezone: "Asia/Tokyo"})
+	require.NoError(t, err)
+
+	clock := func(s string) time.Duration {
+		d, err := ParseClock(s)
+		require.NoError(t, err)
+		return d
+	}
+	// 23:30 in Tokyo
+	at := time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC)
+	assert.True(t, c.Between(at, clock("23:00"), clock("23:45")))
+	assert.False(t, c.Between(at, clock("09:00"), clock("17:00")))
+	assert.True(t, c.Between(at, clock("22:00"), clock("02:00")))
+	assert.False(t, c.Between(at, clock("02:00"), clock("22:00")))
+}
+
+func TestCalendars_For(t *testing.T) {
+	var none *Calendars
+	assert.Nil(t, none.For("acme"))
+	assert.True(t, none.IsEmpty())
+	assert.True(t, (&Calendars{}).IsEmpty())
+
+	def, err := New(Options{})
+	require.NoError(t, err)
+	emea, err := New(Options{Timezone: "Europe/Paris"})
+	require.NoError(t, err)
+
+	cs := &Calendars{Default: def, Realms: map[string]*Calendar{"emea": emea}}
+	assert.False(t, cs.IsEmpty())
+	assert.Same(t, emea, cs.For("emea"))
+	assert.Same(t, def, cs.For("apac"))
+	assert.Same(t, def, cs.For(""))
+	assert.Nil(t, (&Calendars{Realms: map[string]*Calendar{"emea": emea}}).For("apac"))
+}
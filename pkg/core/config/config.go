@@ -47,12 +47,28 @@
 // # Configuration Keys
 //
 // Available configuration options:
-//   - log.level: Log level configuration (default: ".:info")
+//   - log.level: Log level configuration (default: ".:info"), reloadable with [ReloadLogLevels]
 //   - mock.enabled: Use mock backend instead of configured backend
 //   - opa.unsafebuiltins: Comma-separated list of Rego built-ins to disable
 //   - bundles.includeall: Include all policy bundles in access records (default: true)
+//   - bundles.precedence: Domains searched first for an MRN defined by several domains (default: name order)
 //   - audit.env: List of typed entries for access log metadata (supports env, string, k8s-label, k8s-annot)
 //   - audit.k8s.podinfo: Path to Kubernetes Downward API podinfo directory (default: "/etc/podinfo")
+//   - audit.sampling.grant/deny: Fraction of GRANT/DENY decisions emitted to the access log (default: 1.0)
+//   - audit.sampling.overrides: Always emit system-override decisions (default: true)
+//   - audit.ratelimit.rate/burst: Maximum access records per second and burst size (default: 0, unlimited)
+//   - decisions.cache.ttl: Longest time a policy enforcement point may reuse a GRANT (default: 0, not cacheable)
+//   - audit.spool.dir/maxbytes: Directory and size limit of a disk spool in front of the access log (default: disabled)
+//   - audit.journal.path/retention: Bolt database keeping every access record for 'mpe audit query', and how long (default: disabled)
+//   - audit.format: Format of access records written to stdout by the CLI: json, cloudevents, cef, or leef (default: json)
+//   - audit.cloudevents.source/type: Attributes of CloudEvents envelopes
+//   - audit.siem.vendor/product/severity/fields: Header, severities, and field mapping of CEF and LEEF events
+//   - overrides: List of temporary deny-list and break-glass overrides registered at startup
+//   - readiness.smoketests: PORCs a decision point must evaluate as expected before it reports ready
+//   - metrics.decisions.realm/operation/principal: Allowed values and hash buckets of the labels of decision counters
+//   - geo.database: MaxMind DB file locating the addresses of requests for geo.lookup and network rules (default: none)
+//   - calendars: Business calendars (timezone, hours, days, holidays) of realms, given to policies as input.calendar
+//   - risk.timeout/default: Time a risk provider is given to score a request, and the score used when it fails (default: 250ms, 100)
 //
 // [Viper]: https://github.com/spf13/viper
 package config
@@ -95,6 +111,48 @@ type AuditEnvEntry struct {
 	Value string       `mapstructure:"value"`
 }
 
+// OverrideEntry represents a single entry in the overrides configuration.
+//
+// Type is "deny" or "break-glass", and Expires is an RFC 3339 timestamp.
+type OverrideEntry struct {
+	ID            string `mapstructure:"id"`
+	Type          string `mapstructure:"type"`
+	Subject       string `mapstructure:"subject"`
+	Realm         string `mapstructure:"realm"`
+	Justification string `mapstructure:"justification"`
+	CreatedBy     string `mapstructure:"created_by"`
+	Expires       string `mapstructure:"expires"`
+}
+
+// CalendarEntry represents a single entry in the calendars configuration.
+//
+// Realm is empty for the calendar of realms without one of their own. Hours are
+// "HH:MM-HH:MM", Days are weekdays such as "monday", and Holidays are dates such
+// as "2026-12-25".
+type CalendarEntry struct {
+	Realm    string   `mapstructure:"realm"`
+	Timezone string   `mapstructure:"timezone"`
+	Hours    string   `mapstructure:"hours"`
+	Days     []string `mapstructure:"days"`
+	Holidays []string `mapstructure:"holidays"`
+}
+
+// SIEMFieldEntry is an entry of the audit.siem.fields configuration, mapping a
+// field of the access record to a CEF extension or LEEF attribute.
+type SIEMFieldEntry struct {
+	Key   string `mapstructure:"key"`
+	Field string `mapstructure:"field"`
+	Label string `mapstructure:"label"`
+}
+
+// SmokeTestEntry is an entry of the readiness.smoketests configuration: a PORC,
+// given as an object or a JSON string, and the decision it must evaluate to.
+type SmokeTestEntry struct {
+	Name  string      `mapstructure:"name"`
+	PORC  interface{} `mapstructure:"porc"`
+	Allow bool        `mapstructure:"allow"`
+}
+
 // Environment variable and default path constants for configuration loading.
 const (
 	// EnvVarPrefix is the prefix for all policy engine environment variables.
@@ -118,7 +176,12 @@ const (
 
 // Configuration key constants for use with [VConfig].
 const (
-	logLevel string = "log.level"
+	// LogLevel sets the level of each logging module, in the form
+	// "module:level;module:level", where the module "." sets the default.
+	//
+	// Default: ".:info"
+	// Set via environment: MPE_LOG_LEVEL=.:info;accesslog:debug
+	LogLevel string = "log.level"
 
 	// MockEnabled when set to true causes the policy engine to use a mock
 	// backend regardless of any backend configured via [options.WithBackend].
@@ -142,6 +205,15 @@ const (
 	// Set via environment: MPE_BUNDLES_INCLUDEALL=false
 	IncludeAllBundles string = "bundles.includeall"
 
+	// BundlesPrecedence lists the policy domains searched first, in order, for
+	// a role, group, resource group, or scope defined by more than one domain,
+	// and for the default resource group. The remaining domains are searched in
+	// name order. Applies to the local backend created by the mpe CLI.
+	//
+	// Default: empty (name order)
+	// Set via environment: MPE_BUNDLES_PRECEDENCE="overrides base"
+	BundlesPrecedence string = "bundles.precedence"
+
 	// AuditEnv defines a list of typed entries for access log metadata.
 	// Each entry specifies a name (the key in the AccessRecord), a type
 	// (how to resolve the value), and a value (interpreted per type).
@@ -170,6 +242,285 @@ const (
 	// Default: "/etc/podinfo"
 	// Set via environment: MPE_AUDIT_K8S_PODINFO=/custom/path
 	AuditK8sPodinfo string = "audit.k8s.podinfo"
+
+	// AuditSamplingGrant is the fraction (0.0-1.0) of GRANT decisions that
+	// are emitted to the access log.
+	//
+	// Default: 1.0 (emit all grants)
+	// Set via environment: MPE_AUDIT_SAMPLING_GRANT=0.01
+	AuditSamplingGrant string = "audit.sampling.grant"
+
+	// AuditSamplingDeny is the fraction (0.0-1.0) of DENY decisions that
+	// are emitted to the access log.
+	//
+	// Default: 1.0 (emit all denials)
+	// Set via environment: MPE_AUDIT_SAMPLING_DENY=1.0
+	AuditSamplingDeny string = "audit.sampling.deny"
+
+	// AuditSamplingOverrides controls whether decisions made by a phase1
+	// system override are always emitted, bypassing sampling.
+	//
+	// Default: true
+	// Set via environment: MPE_AUDIT_SAMPLING_OVERRIDES=false
+	AuditSamplingOverrides string = "audit.sampling.overrides"
+
+	// AuditRateLimit caps the number of access records emitted per second
+	// to protect downstream sinks under load spikes. Zero disables the limit.
+	//
+	// Default: 0 (unlimited)
+	// Set via environment: MPE_AUDIT_RATELIMIT_RATE=1000
+	AuditRateLimit string = "audit.ratelimit.rate"
+
+	// AuditRateLimitBurst is the number of records that may be emitted in a
+	// burst above [AuditRateLimit]. Defaults to the rate when zero.
+	//
+	// Default: 0
+	// Set via environment: MPE_AUDIT_RATELIMIT_BURST=2000
+	AuditRateLimitBurst string = "audit.ratelimit.burst"
+
+	// AuditRedactionStrip lists dot-separated PORC field paths removed from
+	// access records before they are emitted, such as "principal.email".
+	//
+	// Default: none
+	// Set via environment: MPE_AUDIT_REDACTION_STRIP="principal.email resource.annotations.ssn"
+	AuditRedactionStrip string = "audit.redaction.strip"
+
+	// AuditRedactionHash lists dot-separated PORC field paths whose values
+	// are replaced by a SHA-256 hash in access records.
+	//
+	// Default: none
+	// Set via environment: MPE_AUDIT_REDACTION_HASH=principal.sub
+	AuditRedactionHash string = "audit.redaction.hash"
+
+	// AuditRedactionKey is an optional secret used to hash the fields listed
+	// in [AuditRedactionHash] with HMAC-SHA256.
+	//
+	// Default: none (plain SHA-256)
+	// Set via environment: MPE_AUDIT_REDACTION_KEY=secret
+	AuditRedactionKey string = "audit.redaction.key"
+
+	// AuditSpoolDir enables a write-ahead spool in the given directory. Access
+	// records are written to it before being sent to the access log, so that an
+	// unavailable sink neither holds up decisions nor loses records. Records
+	// left in the spool are sent when the policy engine restarts.
+	//
+	// Default: none (disabled)
+	// Set via environment: MPE_AUDIT_SPOOL_DIR=/var/spool/mpe
+	AuditSpoolDir string = "audit.spool.dir"
+
+	// AuditSpoolMaxBytes caps the size of the spool in [AuditSpoolDir]. Records
+	// that do not fit are dropped.
+	//
+	// Default: 268435456 (256MiB); 0 means unlimited
+	// Set via environment: MPE_AUDIT_SPOOL_MAXBYTES=1073741824
+	AuditSpoolMaxBytes string = "audit.spool.maxbytes"
+
+	// AuditJournalPath enables a journal of access records in the given Bolt
+	// database file, so that decisions can be queried with 'mpe audit query'
+	// where no SIEM collects the access log. Every decision is journaled,
+	// whatever the sampling.
+	//
+	// Default: none (disabled)
+	// Set via environment: MPE_AUDIT_JOURNAL_PATH=/var/lib/mpe/journal.db
+	AuditJournalPath string = "audit.journal.path"
+
+	// AuditJournalRetention is how long records are kept in the journal at
+	// [AuditJournalPath], such as "720h".
+	//
+	// Default: 0 (forever)
+	// Set via environment: MPE_AUDIT_JOURNAL_RETENTION=720h
+	AuditJournalRetention string = "audit.journal.retention"
+
+	// AuditFormat selects how the CLI writes access records to stdout: "json"
+	// writes each record as is, "cloudevents" wraps each record in a
+	// CloudEvents 1.0 envelope for event routers such as Knative or Event Grid,
+	// and "cef" or "leef" render each record as a SIEM event.
+	//
+	// Default: json
+	// Set via environment: MPE_AUDIT_FORMAT=cloudevents
+	AuditFormat string = "audit.format"
+
+	// AuditCloudEventsSource is the source attribute of CloudEvents envelopes
+	// when [AuditFormat] is "cloudevents".
+	//
+	// Default: /manetu/policyengine
+	// Set via environment: MPE_AUDIT_CLOUDEVENTS_SOURCE=/clusters/prod/payments
+	AuditCloudEventsSource string = "audit.cloudevents.source"
+
+	// AuditCloudEventsType is the type attribute of CloudEvents envelopes
+	// when [AuditFormat] is "cloudevents".
+	//
+	// Default: io.manetu.policyengine.accessrecord.v1
+	// Set via environment: MPE_AUDIT_CLOUDEVENTS_TYPE=com.example.audit
+	AuditCloudEventsType string = "audit.cloudevents.type"
+
+	// AuditSIEMVendor and AuditSIEMProduct identify the device in the header
+	// of CEF and LEEF events when [AuditFormat] is "cef" or "leef".
+	//
+	// Default: Manetu, PolicyEngine
+	// Set via environment: MPE_AUDIT_SIEM_VENDOR=Example
+	AuditSIEMVendor  string = "audit.siem.vendor"
+	AuditSIEMProduct string = "audit.siem.product"
+
+	// AuditSIEMSeverityGrant and AuditSIEMSeverityDeny are the severities, from
+	// 0 to 10, of GRANT and DENY decisions in CEF and LEEF events.
+	//
+	// Default: 3, 6
+	// Set via environment: MPE_AUDIT_SIEM_SEVERITY_DENY=8
+	AuditSIEMSeverityGrant string = "audit.siem.severity.grant"
+	AuditSIEMSeverityDeny  string = "audit.siem.severity.deny"
+
+	// AuditSIEMFields maps fields of the access record to the attributes of
+	// CEF and LEEF events, replacing the default mapping.
+	//
+	// Example config:
+	//
+	//	audit:
+	//	  format: cef
+	//	  siem:
+	//	    fields:
+	//	      - key: suser
+	//	        field: principal.subject
+	//	      - key: cs1
+	//	        field: porc.principal.email
+	//	        label: email
+	AuditSIEMFields string = "audit.siem.fields"
+
+	// DecisionCacheTTL is the longest time for which a policy enforcement point
+	// may reuse a GRANT, reported as a hint with every decision. GRANTs that
+	// depend on the time, on external data, or on an override are never
+	// cacheable, and none is cacheable beyond the expiry of the principal's token.
+	//
+	// Default: 0 (decisions are not cacheable)
+	// Set via environment: MPE_DECISIONS_CACHE_TTL=30s
+	DecisionCacheTTL string = "decisions.cache.ttl"
+
+	// Overrides defines temporary per-principal overrides registered when the
+	// policy engine starts. Each entry denies every request of a subject, or
+	// grants it with break-glass access, until it expires. Break-glass entries
+	// require a justification. Entries that have already expired are skipped.
+	//
+	// Example config:
+	//
+	//	overrides:
+	//	  - type: deny
+	//	    subject: mallory@example.com
+	//	    expires: "2026-11-01T00:00:00Z"
+	//	  - type: break-glass
+	//	    subject: alice@example.com
+	//	    realm: prod
+	//	    justification: "INC-1234: restore payments service"
+	//	    created_by: bob@example.com
+	//	    expires: "2026-10-17T12:00:00Z"
+	Overrides string = "overrides"
+
+	// ReadinessSmokeTests defines PORCs that a decision point evaluates after
+	// compiling its bundles. The decision point reports ready only once every
+	// PORC evaluates to its expected decision.
+	//
+	// Example config:
+	//
+	//	readiness:
+	//	  smoketests:
+	//	    - name: admin can update
+	//	      porc:
+	//	        principal: {sub: alice, mroles: ["mrn:iam:role:admin"]}
+	//	        operation: platform:admin:update
+	//	        resource: mrn:app:doc:1
+	//	      allow: true
+	ReadinessSmokeTests string = "readiness.smoketests"
+
+	// MetricsRealmAllow, MetricsOperationAllow, and MetricsPrincipalAllow list
+	// the values, or ':'-separated prefixes of values, that the decision
+	// counters of a decision point report as labels. Other values are reported
+	// as one of a number of hash buckets given by MetricsRealmBuckets,
+	// MetricsOperationBuckets, and MetricsPrincipalBuckets, or as "other". A
+	// label is not reported unless it has allowed values or buckets, which
+	// bounds the number of series however many realms, operations, or
+	// principals there are.
+	//
+	// Example config:
+	//
+	//	metrics:
+	//	  decisions:
+	//	    realm:
+	//	      allow: [prod, staging]
+	//	    operation:
+	//	      allow: ["api:documents", "api:users"]
+	//	      buckets: 16
+	//
+	// Default: none (counters by decision only)
+	// Set via environment: MPE_METRICS_DECISIONS_OPERATION_ALLOW="api:documents api:users"
+	MetricsRealmAllow       string = "metrics.decisions.realm.allow"
+	MetricsRealmBuckets     string = "metrics.decisions.realm.buckets"
+	MetricsOperationAllow   string = "metrics.decisions.operation.allow"
+	MetricsOperationBuckets string = "metrics.decisions.operation.buckets"
+	MetricsPrincipalAllow   string = "metrics.decisions.principal.allow"
+	MetricsPrincipalBuckets string = "metrics.decisions.principal.buckets"
+
+	// GeoDatabase is a MaxMind DB file, such as GeoLite2-City.mmdb, locating
+	// the client addresses of requests for the geo.lookup built-in and the
+	// network rules of scopes and resource groups. It is read once, when the
+	// policy engine is created, and is not used if a locator is given with
+	// options.WithGeoLocator. Without either, only the locations that requests
+	// give in context.geo are known.
+	//
+	// Default: none
+	// Set via environment: MPE_GEO_DATABASE=/var/lib/geoip/GeoLite2-City.mmdb
+	GeoDatabase string = "geo.database"
+
+	// Calendars defines the business calendars of realms, from which the policy
+	// engine gives policies the moment of each request as input.calendar, and
+	// which the calendar.business_hours, calendar.between, and calendar.now
+	// built-ins read. The entry without a realm applies to realms without one of
+	// their own. Hours default to 09:00-17:00, and days to monday through friday.
+	//
+	// Example config:
+	//
+	//	calendars:
+	//	  - timezone: America/New_York
+	//	    hours: "09:00-17:00"
+	//	    holidays: ["2026-11-26", "2026-12-25"]
+	//	  - realm: emea
+	//	    timezone: Europe/London
+	//	    hours: "08:30-17:30"
+	//	    days: [monday, tuesday, wednesday, thursday, friday]
+	Calendars string = "calendars"
+
+	// RiskTimeout is the longest time the risk provider given with
+	// options.WithRiskProvider may take to score a request before the policy
+	// engine gives policies the RiskDefault score instead.
+	//
+	// Default: 250ms
+	// Set via environment: MPE_RISK_TIMEOUT=100ms
+	RiskTimeout string = "risk.timeout"
+
+	// RiskDefault is the score, from 0 to 100, given to policies when the risk
+	// provider fails, returns a score out of range, or does not answer within
+	// RiskTimeout. The highest score makes policies bounding the risk deny when
+	// it cannot be assessed.
+	//
+	// Default: 100
+	// Set via environment: MPE_RISK_DEFAULT=50
+	RiskDefault string = "risk.default"
+
+	// EvaluationConcurrency is the most role and scope policies the policy
+	// engine evaluates at once, across all requests. Evaluations beyond it
+	// wait for one to finish, or fail if their request is cancelled first.
+	// Zero leaves evaluations unbounded.
+	//
+	// Default: 0 (unbounded)
+	// Set via environment: MPE_EVALUATION_CONCURRENCY=64
+	EvaluationConcurrency string = "evaluation.concurrency"
+
+	// EvaluationFanout is the most roles, scopes, or groups of one request that
+	// the policy engine fetches and evaluates at once, so that a principal with
+	// hundreds of them does not start as many evaluations together. Zero
+	// leaves the fan-out unbounded.
+	//
+	// Default: 16
+	// Set via environment: MPE_EVALUATION_FANOUT=8
+	EvaluationFanout string = "evaluation.fanout"
 )
 
 var (
@@ -245,10 +596,21 @@ func doInitialize() {
 	VConfig.AutomaticEnv()
 
 	// set up VConfig defaults
-	VConfig.SetDefault(logLevel, ".:info")
+	VConfig.SetDefault(LogLevel, ".:info")
 	VConfig.SetDefault(UnsafeBuiltIns, "http.send")
 	VConfig.SetDefault(IncludeAllBundles, true)         // includes all bundles in AccessRecord by default.
 	VConfig.SetDefault(AuditK8sPodinfo, "/etc/podinfo") // default Downward API mount path
+	VConfig.SetDefault(AuditSamplingGrant, 1.0)
+	VConfig.SetDefault(AuditSamplingDeny, 1.0)
+	VConfig.SetDefault(AuditSamplingOverrides, true)
+	VConfig.SetDefault(AuditRateLimit, 0)
+	VConfig.SetDefault(AuditRateLimitBurst, 0)
+	VConfig.SetDefault(AuditSpoolMaxBytes, 256<<20)
+	VConfig.SetDefault(AuditFormat, "json")
+	VConfig.SetDefault(RiskTimeout, "250ms")
+	VConfig.SetDefault(RiskDefault, 100.0)
+	VConfig.SetDefault(EvaluationConcurrency, 0)
+	VConfig.SetDefault(EvaluationFanout, 16)
 }
 
 // Load initializes configuration and loads settings from files and environment.
@@ -294,7 +656,7 @@ func Load() error {
 		}
 
 		// Update log levels based on final configuration
-		loglevel := VConfig.GetString(logLevel)
+		loglevel := VConfig.GetString(LogLevel)
 		if err := logging.UpdateLogLevels(loglevel); err != nil {
 			logger.SysErrorf("Failed updating log level %s: %+v", loglevel, err)
 			loadErr = err
@@ -309,6 +671,28 @@ func Load() error {
 	return loadErr
 }
 
+// ReloadLogLevels re-reads the configuration file and applies its log.level setting, so
+// that a running process picks up a change without restarting.
+//
+// The usual precedence applies: a value set with VConfig.Set, such as from a command-line
+// flag, wins over the MPE_LOG_LEVEL environment variable, which wins over the file.
+//
+// Returns an error if the configuration file exists but cannot be read.
+func ReloadLogLevels() error {
+	Init()
+
+	if err := VConfig.ReadInConfig(); err != nil {
+		var configNotFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &configNotFound) {
+			return err
+		}
+	}
+
+	loglevel := VConfig.GetString(LogLevel)
+	logger.SysInfof("Applying log levels %s", loglevel)
+	return logging.UpdateLogLevels(loglevel)
+}
+
 // ResetConfig clears all configuration and reinitializes with defaults.
 //
 // WARNING: This function is intended for testing only. It resets the global
@@ -392,3 +776,47 @@ func GetAuditEnv() map[string]string {
 
 	return result
 }
+
+// GetOverrides returns the entries of the overrides configuration.
+//
+// Returns an error if the configuration is not a list of entries.
+func GetOverrides() ([]OverrideEntry, error) {
+	var entries []OverrideEntry
+	if err := VConfig.UnmarshalKey(Overrides, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// GetCalendars returns the entries of the calendars configuration.
+//
+// Returns an error if the configuration is not a list of entries.
+func GetCalendars() ([]CalendarEntry, error) {
+	var entries []CalendarEntry
+	if err := VConfig.UnmarshalKey(Calendars, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// GetSIEMFields returns the entries of the audit.siem.fields configuration.
+//
+// Returns an error if the configuration is not a list of entries.
+func GetSIEMFields() ([]SIEMFieldEntry, error) {
+	var entries []SIEMFieldEntry
+	if err := VConfig.UnmarshalKey(AuditSIEMFields, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// GetSmokeTests returns the entries of the readiness.smoketests configuration.
+//
+// Returns an error if the configuration is not a list of entries.
+func GetSmokeTests() ([]SmokeTestEntry, error) {
+	var entries []SmokeTestEntry
+	if err := VConfig.UnmarshalKey(ReadinessSmokeTests, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/manetu/policyengine/internal/core/test"
 	"github.com/manetu/policyengine/pkg/core/config"
@@ -32,6 +33,8 @@ func TestConfigDefaults(t *testing.T) {
 	// Check some default values
 	assert.Equal(t, true, config.VConfig.GetBool(config.IncludeAllBundles))
 	assert.Equal(t, "http.send", config.VConfig.GetString(config.UnsafeBuiltIns))
+	assert.Equal(t, 250*time.Millisecond, config.VConfig.GetDuration(config.RiskTimeout))
+	assert.Equal(t, 100.0, config.VConfig.GetFloat64(config.RiskDefault))
 }
 
 func TestConfigWithCustomFilename(t *testing.T) {
@@ -282,3 +285,24 @@ func TestLoadWithMissingConfigFile(t *testing.T) {
 	err := config.Load()
 	assert.NoError(t, err)
 }
+
+func TestGetCalendars(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	defer config.VConfig.Set(config.Calendars, nil)
+
+	entries, err := config.GetCalendars()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	config.VConfig.Set(config.Calendars, []map[string]interface{}{
+		{"timezone": "America/New_York", "holidays": []string{"2026-12-25"}},
+		{"realm": "emea", "timezone": "Europe/London", "hours": "08:30-17:30", "days": []string{"monday", "friday"}},
+	})
+	entries, err = config.GetCalendars()
+	assert.NoError(t, err)
+	assert.Equal(t, []config.CalendarEntry{
+		{Timezone: "America/New_York", Holidays: []string{"2026-12-25"}},
+		{Realm: "emea", Timezone: "Europe/London", Hours: "08:30-17:30", Days: []string{"monday", "friday"}},
+	}, entries)
+}
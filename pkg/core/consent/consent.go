@@ -0,0 +1,90 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package consent lets the consent records of data subjects drive the decisions on
+// their resources, without each policy having to look them up.
+//
+// A resource, or its resource group, is consent-gated when annotated with
+// [Annotation] set to true:
+//
+//	resources:
+//	  - name: health-records
+//	    selector: ["mrn:app:health:.*"]
+//	    group: "mrn:iam:resource-group:patients"
+//	    annotations:
+//	      - name: consent-required
+//	        value: true
+//
+// When the policy of a consent-gated resource's group grants a request in the resource
+// phase, the engine asks the [Checker] given with options.WithConsentChecker whether the
+// resource's owner, its data subject, consented to the access for the purposes the request
+// declares in context.purpose. The request is denied unless they did. The owner of a
+// resource granted by an owner rule needs no consent of their own.
+//
+// # Auditing
+//
+// Every check is recorded in the access record as a bundle reference of the RESOURCE
+// phase, whose id is the resource and whose reason names the checker. A failed check
+// denies the request and is recorded with a NETWORK_ERROR reason code. Consent may be
+// withdrawn at any time, so decisions that checked it are never reported as cacheable
+// (see model.CacheHint).
+//
+// # Usage
+//
+//	records := consent.NewMemory()
+//	records.Grant("alice", "research")
+//	pe, err := core.NewPolicyEngine(options.WithConsentChecker(records))
+package consent
+
+import (
+	"context"
+	"fmt"
+)
+
+// Annotation is the name of the annotation marking a resource, or a resource group, as
+// consent-gated.
+const Annotation = "consent-required"
+
+// Request describes an access to a consent-gated resource.
+type Request struct {
+	// Subject is the data subject whose consent is required, the owner of the resource.
+	Subject string `json:"subject"`
+	// Resource is the MRN of the resource accessed.
+	Resource string `json:"resource"`
+	// Principal is the subject of the principal accessing the resource.
+	Principal string `json:"principal,omitempty"`
+	// Operation is the operation requested.
+	Operation string `json:"operation,omitempty"`
+	// Purposes are the purposes the request declares in context.purpose.
+	Purposes []string `json:"purposes,omitempty"`
+}
+
+// Validate returns an error if the request has no subject or resource.
+func (r Request) Validate() error {
+	if r.Subject == "" {
+		return fmt.Errorf("resource %s has no owner whose consent could be checked", r.Resource)
+	}
+	if r.Resource == "" {
+		return fmt.Errorf("consent request has no resource")
+	}
+	return nil
+}
+
+// Checker checks the consent records of data subjects.
+//
+// Implementations must be safe for concurrent use, and should return promptly when
+// ctx is done.
+type Checker interface {
+	// Name identifies the checker in the access record, such as "http".
+	Name() string
+
+	// Check returns true if the request's subject consented to the access it describes.
+	Check(ctx context.Context, request Request) (bool, error)
+}
+
+// Required reports whether the value of a resource's [Annotation] makes it consent-gated.
+func Required(value interface{}) bool {
+	required, _ := value.(bool)
+	return required
+}
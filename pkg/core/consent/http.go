@@ -0,0 +1,94 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package consent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/manetu/policyengine/internal/httpjson"
+)
+
+// DefaultTimeout limits a check of an [HTTP] checker when no timeout is configured.
+const DefaultTimeout = time.Second
+
+// maxResponseBody is the number of bytes read from the response of a service
+const maxResponseBody = 1 << 20
+
+// HTTPOptions configures the [HTTP] checker created by [NewHTTP].
+type HTTPOptions struct {
+	// URL is the endpoint receiving each [Request], such as http://consent:8080/v1/check.
+	URL string
+	// Token is sent as a bearer token, if set.
+	Token string
+	// Timeout limits each check, [DefaultTimeout] if zero.
+	Timeout time.Duration
+	// Client sends the requests, [http.DefaultClient] if nil.
+	Client *http.Client
+}
+
+// HTTP is a [Checker] calling a consent service over HTTP. Each check POSTs the [Request]
+// as JSON to the service, which answers {"granted": true} if the subject consented.
+// Any other status than 2xx fails the check.
+type HTTP struct {
+	endpoint string
+	token    string
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// NewHTTP creates an [HTTP] checker.
+//
+// Returns an error if the URL is not an absolute http or https URL.
+func NewHTTP(options HTTPOptions) (*HTTP, error) {
+	endpoint, err := httpjson.ParseURL(options.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTP{
+		endpoint: endpoint,
+		token:    options.Token,
+		timeout:  timeout,
+		client:   client,
+	}, nil
+}
+
+// Name implements [Checker].
+func (c *HTTP) Name() string {
+	return "http"
+}
+
+// Check implements [Checker].
+func (c *HTTP) Check(ctx context.Context, request Request) (bool, error) {
+	if err := request.Validate(); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var response struct {
+		Granted *bool `json:"granted"`
+	}
+	if err := httpjson.Post(ctx, c.client, c.endpoint, c.token, request, &response, maxResponseBody); err != nil {
+		return false, err
+	}
+	if response.Granted == nil {
+		return false, fmt.Errorf("response has no 'granted' field")
+	}
+	return *response.Granted, nil
+}
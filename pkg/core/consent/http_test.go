@@ -0,0 +1,124 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package consent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve returns a server recording the body of each request, and answering it with status
+// and response
+func serve(t *testing.T, status int, response string, requests *[]map[string]interface{}) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		body["_path"] = r.URL.Path
+		body["_auth"] = r.Header.Get("Authorization")
+		*requests = append(*requests, body)
+
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTP(t *testing.T) {
+	var requests []map[string]interface{}
+	srv := serve(t, http.StatusOK, `{"granted": true}`, &requests)
+
+	c, err := NewHTTP(HTTPOptions{URL: srv.URL + "/v1/check", Token: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "http", c.Name())
+
+	granted, err := c.Check(context.Background(), Request{
+		Subject:   "alice",
+		Resource:  "mrn:app:health:1",
+		Principal: "dr-bob",
+		Operation: "health:records:read",
+		Purposes:  []string{"care"},
+	})
+	require.NoError(t, err)
+	assert.True(t, granted)
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, map[string]interface{}{
+		"_path":     "/v1/check",
+		"_auth":     "Bearer secret",
+		"subject":   "alice",
+		"resource":  "mrn:app:health:1",
+		"principal": "dr-bob",
+		"operation": "health:records:read",
+		"purposes":  []interface{}{"care"},
+	}, requests[0])
+}
+
+func TestHTTP_Failures(t *testing.T) {
+	request := Request{Subject: "alice", Resource: "mrn:app:health:1"}
+
+	for _, tc := range []struct {
+		name     string
+		status   int
+		response string
+		granted  bool
+		err      string
+	}{
+		{"denied", http.StatusOK, `{"granted": false}`, false, ""},
+		{"status", http.StatusServiceUnavailable, "unavailable\n", false, "status 503: unavailable"},
+		{"malformed", http.StatusOK, `not json`, false, "invalid character"},
+		{"incomplete", http.StatusOK, `{}`, false, "no 'granted' field"},
+		{"oversized", http.StatusOK, `{"granted": true, "pad": "` + strings.Repeat("x", maxResponseBody) + `"}`, false, "exceeds"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests []map[string]interface{}
+			c, err := NewHTTP(HTTPOptions{URL: serve(t, tc.status, tc.response, &requests).URL})
+			require.NoError(t, err)
+
+			granted, err := c.Check(context.Background(), request)
+			assert.Equal(t, tc.granted, granted)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+
+	_, err := NewHTTP(HTTPOptions{URL: "consent:8080"})
+	assert.ErrorContains(t, err, "invalid URL")
+
+	var requests []map[string]interface{}
+	c, err := NewHTTP(HTTPOptions{URL: serve(t, http.StatusOK, `{"granted": true}`, &requests).URL})
+	require.NoError(t, err)
+	_, err = c.Check(context.Background(), Request{Resource: "mrn:app:health:1"})
+	assert.ErrorContains(t, err, "has no owner")
+	assert.Empty(t, requests, "invalid requests are not sent")
+}
+
+func TestHTTP_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, err := NewHTTP(HTTPOptions{URL: srv.URL, Timeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+
+	_, err = c.Check(context.Background(), Request{Subject: "alice", Resource: "mrn:app:health:1"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,92 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package consent
+
+import (
+	"context"
+	"sync"
+)
+
+// anyPurpose keys the consent of a subject given for every purpose
+const anyPurpose = "*"
+
+// Memory is a [Checker] keeping the consent of each data subject in memory, such as for
+// tests or for records loaded at startup.
+//
+// A subject consents either for every purpose, or for specific purposes. A request is
+// consented to if its subject consented for every purpose, or for any purpose the request
+// declares.
+//
+// Memory is safe for concurrent use.
+type Memory struct {
+	mu       sync.RWMutex
+	consents map[string]map[string]struct{} // purposes by subject
+}
+
+// NewMemory creates a [Memory] without any consent.
+func NewMemory() *Memory {
+	return &Memory{consents: make(map[string]map[string]struct{})}
+}
+
+// Name implements [Checker].
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+// Grant records the consent of subject for purposes, or for every purpose if none.
+func (m *Memory) Grant(subject string, purposes ...string) {
+	if len(purposes) == 0 {
+		purposes = []string{anyPurpose}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	granted, ok := m.consents[subject]
+	if !ok {
+		granted = make(map[string]struct{})
+		m.consents[subject] = granted
+	}
+	for _, p := range purposes {
+		granted[p] = struct{}{}
+	}
+}
+
+// Revoke withdraws the consent of subject for purposes, or all of its consent if none.
+// The consent given for every purpose is only withdrawn by revoking all of it.
+func (m *Memory) Revoke(subject string, purposes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(purposes) == 0 {
+		delete(m.consents, subject)
+		return
+	}
+	granted := m.consents[subject]
+	for _, p := range purposes {
+		delete(granted, p)
+	}
+	if len(granted) == 0 {
+		delete(m.consents, subject)
+	}
+}
+
+// Check implements [Checker].
+func (m *Memory) Check(_ context.Context, request Request) (bool, error) {
+	if err := request.Validate(); err != nil {
+		return false, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	granted := m.consents[request.Subject]
+	if _, ok := granted[anyPurpose]; ok {
+		return true, nil
+	}
+	for _, p := range request.Purposes {
+		if _, ok := granted[p]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
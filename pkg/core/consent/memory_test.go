@@ -0,0 +1,56 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package consent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	assert.Equal(t, "memory", m.Name())
+	ctx := context.Background()
+
+	check := func(subject string, purposes ...string) bool {
+		granted, err := m.Check(ctx, Request{Subject: subject, Resource: "mrn:app:health:1", Purposes: purposes})
+		require.NoError(t, err)
+		return granted
+	}
+
+	assert.False(t, check("alice", "research"), "no consent is given by default")
+
+	m.Grant("alice", "research", "care")
+	assert.True(t, check("alice", "research"))
+	assert.True(t, check("alice", "marketing", "care"), "consent for any declared purpose suffices")
+	assert.False(t, check("alice", "marketing"))
+	assert.False(t, check("alice"), "purpose-specific consent requires a declared purpose")
+	assert.False(t, check("bob", "research"))
+
+	m.Revoke("alice", "research")
+	assert.False(t, check("alice", "research"))
+	assert.True(t, check("alice", "care"))
+
+	m.Grant("bob")
+	assert.True(t, check("bob"), "consent given for every purpose")
+	assert.True(t, check("bob", "marketing"))
+	m.Revoke("bob", "marketing")
+	assert.True(t, check("bob", "marketing"), "consent for every purpose is only withdrawn entirely")
+	m.Revoke("bob")
+	assert.False(t, check("bob", "marketing"))
+
+	_, err := m.Check(ctx, Request{Resource: "mrn:app:health:1"})
+	assert.ErrorContains(t, err, "has no owner")
+}
+
+func TestRequired(t *testing.T) {
+	assert.True(t, Required(true))
+	assert.False(t, Required(false))
+	assert.False(t, Required(nil))
+	assert.False(t, Required("true"), "only a boolean annotation gates a resource")
+}
@@ -0,0 +1,76 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package geo locates the network addresses of requests, so that policies and policy
+// domains can condition access on where requests come from.
+//
+// The engine reads the address of the client of a request from the PORC's context.ip,
+// and any location an upstream proxy determined from context.geo:
+//
+//	{
+//	    "principal": {...},
+//	    "operation": "api:documents:read",
+//	    "resource": "mrn:app:document:1",
+//	    "context": {"ip": "203.0.113.7", "geo": {"country": "US"}}
+//	}
+//
+// A [Locator] given with options.WithGeoLocator, such as a [MaxMind] database, locates
+// addresses that the request does not locate itself. Policies call the net.cidr_contains_ctx
+// and geo.lookup built-ins (see the opa package), and scopes and resource groups may
+// declare a network rule admitting only requests from some networks or countries.
+package geo
+
+import (
+	"encoding/json"
+	"net/netip"
+)
+
+// Location is where a network address is located. Unknown fields are empty.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, such as "US".
+	Country string `json:"country,omitempty"`
+	// Continent is the code of the continent, such as "NA".
+	Continent string `json:"continent,omitempty"`
+	// Region is the ISO 3166-2 code of the country's subdivision, such as "CA".
+	Region string `json:"region,omitempty"`
+	// City is the English name of the city.
+	City string `json:"city,omitempty"`
+	// ASN is the number of the autonomous system announcing the address.
+	ASN uint `json:"asn,omitempty"`
+}
+
+// IsZero reports whether nothing is known of the location.
+func (l Location) IsZero() bool {
+	return l == Location{}
+}
+
+// Locator locates network addresses.
+//
+// Implementations must be safe for concurrent use, and should return promptly, as
+// they may be called for every decision.
+type Locator interface {
+	// Locate returns the location of addr, and false if it is not known.
+	Locate(addr netip.Addr) (Location, bool, error)
+}
+
+// ParseLocation converts a location given in a PORC, an object with any of the fields
+// of [Location], such as {"country": "US", "city": "Boston"}. It returns false if the
+// value is not such an object or locates nothing.
+func ParseLocation(v interface{}) (Location, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return Location{}, false
+	}
+
+	// round trip through JSON, ignoring fields of the wrong type rather than failing
+	var l Location
+	for key, value := range m {
+		raw, err := json.Marshal(map[string]interface{}{key: value})
+		if err != nil {
+			continue
+		}
+		_ = json.Unmarshal(raw, &l)
+	}
+	return l, !l.IsZero()
+}
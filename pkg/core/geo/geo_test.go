@@ -0,0 +1,35 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package geo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		location Location
+		ok       bool
+	}{
+		{"country", map[string]interface{}{"country": "US"}, Location{Country: "US"}, true},
+		{"all fields", map[string]interface{}{"country": "US", "continent": "NA", "region": "MA", "city": "Boston", "asn": float64(7922)},
+			Location{Country: "US", Continent: "NA", Region: "MA", City: "Boston", ASN: 7922}, true},
+		{"wrong types are ignored", map[string]interface{}{"country": 1, "city": "Boston"}, Location{City: "Boston"}, true},
+		{"unknown fields only", map[string]interface{}{"planet": "earth"}, Location{}, false},
+		{"not an object", "US", Location{}, false},
+		{"nil", nil, Location{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, ok := ParseLocation(tt.value)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.location, location)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package geo
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMind is a [Locator] reading a MaxMind DB, such as GeoLite2-City, GeoIP2-Country, or
+// GeoLite2-ASN. The database is held in memory, so the file may be replaced while in use.
+type MaxMind struct {
+	reader *maxminddb.Reader
+}
+
+// record is the subset of the MaxMind City, Country, and ASN records a [Location] holds
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// OpenMaxMind loads the MaxMind DB file at path.
+//
+// Returns an error if the file cannot be read or is not a MaxMind DB.
+func OpenMaxMind(path string) (*MaxMind, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- the path is configured by the operator
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geo database: %w", err)
+	}
+	m, err := NewMaxMind(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid geo database %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// NewMaxMind creates a [MaxMind] locator from the contents of a MaxMind DB.
+func NewMaxMind(data []byte) (*MaxMind, error) {
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMind{reader: reader}, nil
+}
+
+// Type returns the type of the database, such as "GeoLite2-City".
+func (m *MaxMind) Type() string {
+	return m.reader.Metadata.DatabaseType
+}
+
+// Locate implements [Locator].
+func (m *MaxMind) Locate(addr netip.Addr) (Location, bool, error) {
+	if !addr.IsValid() {
+		return Location{}, false, nil
+	}
+	addr = addr.Unmap()
+	if addr.Is6() && m.reader.Metadata.IPVersion == 4 {
+		return Location{}, false, nil
+	}
+
+	var r record
+	_, ok, err := m.reader.LookupNetwork(addr.AsSlice(), &r)
+	if err != nil || !ok {
+		return Location{}, false, err
+	}
+
+	l := Location{
+		Country:   r.Country.ISOCode,
+		Continent: r.Continent.Code,
+		City:      r.City.Names["en"],
+		ASN:       r.ASN,
+	}
+	if len(r.Subdivisions) > 0 {
+		l.Region = r.Subdivisions[0].ISOCode
+	}
+	return l, !l.IsZero(), nil
+}
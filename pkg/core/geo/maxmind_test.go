@@ -0,0 +1,182 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package geo
+
+import (
+	"encoding/binary"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mmdb writes an IPv4 MaxMind DB mapping each prefix to its record, with 24-bit records
+func mmdb(t *testing.T, records map[string]map[string]interface{}) []byte {
+	t.Helper()
+
+	// each child is a node index, or -1 if empty, or -2-offset for data at offset
+	type node struct{ child [2]int }
+	nodes := []node{{child: [2]int{-1, -1}}}
+	var data []byte
+	for _, p := range slices.Sorted(maps.Keys(records)) {
+		prefix := netip.MustParsePrefix(p)
+		addr := prefix.Addr().As4()
+		offset := len(data)
+		data = append(data, encode(t, records[p])...)
+
+		n := 0
+		for i := 0; i < prefix.Bits(); i++ {
+			bit := (addr[i/8] >> (7 - i%8)) & 1
+			if i == prefix.Bits()-1 {
+				nodes[n].child[bit] = -2 - offset
+				break
+			}
+			if nodes[n].child[bit] < 0 {
+				nodes = append(nodes, node{child: [2]int{-1, -1}})
+				nodes[n].child[bit] = len(nodes) - 1
+			}
+			n = nodes[n].child[bit]
+		}
+	}
+
+	var db []byte
+	count := len(nodes)
+	for _, n := range nodes {
+		for _, c := range n.child {
+			v := c
+			switch {
+			case c == -1:
+				v = count
+			case c < -1:
+				v = count + 16 + (-2 - c)
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, encode(t, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test-City",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(0),
+		"description":                 map[string]interface{}{"en": "test"},
+	})...)
+	return db
+}
+
+// encode encodes a value in the MaxMind DB data format
+func encode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	control := func(kind, size int) []byte {
+		require.Less(t, size, 29)
+		if kind > 7 {
+			return []byte{byte(size), byte(kind - 7)}
+		}
+		return []byte{byte(kind<<5 | size)}
+	}
+	unsigned := func(kind int, n uint64, width int) []byte {
+		b := binary.BigEndian.AppendUint64(nil, n)[8-width:]
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		return append(control(kind, len(b)), b...)
+	}
+
+	switch x := v.(type) {
+	case string:
+		return append(control(2, len(x)), x...)
+	case uint16:
+		return unsigned(5, uint64(x), 2)
+	case uint32:
+		return unsigned(6, uint64(x), 4)
+	case []interface{}:
+		b := control(11, len(x))
+		for _, e := range x {
+			b = append(b, encode(t, e)...)
+		}
+		return b
+	case map[string]interface{}:
+		b := control(7, len(x))
+		for _, k := range slices.Sorted(maps.Keys(x)) {
+			b = append(b, encode(t, k)...)
+			b = append(b, encode(t, x[k])...)
+		}
+		return b
+	}
+	t.Fatalf("cannot encode %T", v)
+	return nil
+}
+
+func testDatabase(t *testing.T) []byte {
+	return mmdb(t, map[string]map[string]interface{}{
+		"81.2.69.0/24": {
+			"country":      map[string]interface{}{"iso_code": "GB"},
+			"continent":    map[string]interface{}{"code": "EU"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "ENG"}},
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+		},
+		"1.128.0.0/11": {
+			"autonomous_system_number": uint32(1221),
+		},
+	})
+}
+
+func TestMaxMind_Locate(t *testing.T) {
+	m, err := NewMaxMind(testDatabase(t))
+	require.NoError(t, err)
+	assert.Equal(t, "Test-City", m.Type())
+
+	tests := []struct {
+		name     string
+		addr     netip.Addr
+		location Location
+		found    bool
+	}{
+		{"city", netip.MustParseAddr("81.2.69.160"), Location{Country: "GB", Continent: "EU", Region: "ENG", City: "London"}, true},
+		{"mapped", netip.MustParseAddr("::ffff:81.2.69.160"), Location{Country: "GB", Continent: "EU", Region: "ENG", City: "London"}, true},
+		{"asn", netip.MustParseAddr("1.128.0.1"), Location{ASN: 1221}, true},
+		{"unknown", netip.MustParseAddr("10.0.0.1"), Location{}, false},
+		{"ipv6 in ipv4 database", netip.MustParseAddr("2001:db8::1"), Location{}, false},
+		{"invalid", netip.Addr{}, Location{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, found, err := m.Locate(tt.addr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.found, found)
+			assert.Equal(t, tt.location, location)
+		})
+	}
+}
+
+func TestOpenMaxMind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, testDatabase(t), 0o600))
+
+	m, err := OpenMaxMind(path)
+	require.NoError(t, err)
+	_, found, err := m.Locate(netip.MustParseAddr("81.2.69.160"))
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	_, err = OpenMaxMind(filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.ErrorContains(t, err, "failed to read geo database")
+
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o600))
+	_, err = OpenMaxMind(path)
+	assert.ErrorContains(t, err, "invalid geo database")
+}
@@ -14,6 +14,18 @@
 //   - [Policy]: A compiled Rego policy with its AST and metadata
 //   - [PolicyReference]: A reference to a policy with annotations (used by roles, scopes, etc.)
 //   - [Mapper]: A compiled principal mapper for transforming identity claims
+//   - [Obligations]: Structured values a policy returns alongside its decision
+//   - [CacheHint]: How long an enforcement point may reuse a decision
+//
+// SYSTEM phase types:
+//   - [BypassRule]: Grants operations to privileged roles without evaluating their policy
+//   - [ImpersonationRule]: Permits the actors of requests to act on behalf of their subjects
+//
+// Decision strategy types:
+//   - [DomainDefaults]: How a policy domain combines phase outcomes into a decision
+//
+// Bundle identification types:
+//   - [BundleInfo]: The revision and domain fingerprints of the loaded policy bundle
 //
 // Domain entity types:
 //   - [Group]: A collection of roles for batch permission assignment
@@ -29,8 +41,14 @@ package model
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/manetu/policyengine/pkg/core/opa"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
 // Annotations is a key-value map for storing metadata on policy entities.
@@ -158,10 +176,138 @@ type Policy struct {
 // During authorization, the policy engine retrieves PolicyReferences to
 // access both the policy to evaluate and any annotations that should be
 // made available to the policy as input.
+//
+// Operations also record the Domain that defines them and the Selector that
+// matched the requested operation, which are reported in the access record.
+// Resource groups may declare an Owner rule, which grants the owners of their
+// resources without evaluating the policy, and the AllowedPurposes their
+// resources may be accessed for.
+//
+// Roles and resource groups may carry DenyPolicies, evaluated alongside Policy
+// whenever the entity applies to a request. A DENY from any of them denies the
+// request with an EXPLICIT_DENY reason, whatever the other policies granted.
+//
+// Operations may require the approval of RequiresApproval other principals
+// before their GRANTs take effect (see package approval), and may require the
+// context of their requests to match a ContextSchema before any policy is
+// evaluated. They may also set an Identity requirement, under which the GRANT
+// of a single role of the principal no longer suffices in the identity phase.
+//
+// Scopes and resource groups may carry a Network rule, admitting only requests
+// from some networks or countries. The policy of an entity whose rule does not
+// admit a request is not evaluated, and the entity denies.
 type PolicyReference struct {
-	Mrn         string
-	Policy      *Policy
-	Annotations RichAnnotations
+	Mrn              string
+	Policy           *Policy
+	DenyPolicies     []*Policy
+	Annotations      RichAnnotations
+	Domain           string
+	Selector         string
+	Owner            *OwnerRule
+	Network          *NetworkRule
+	AllowedPurposes  []string
+	RequiresApproval int
+	ContextSchema    *opa.Schema
+	Identity         IdentityRequirement
+}
+
+// IdentityRequirement is how many of the principal's roles, including the roles
+// of its groups, must GRANT an operation in the identity phase. A role whose
+// policy fails to evaluate does not GRANT.
+//
+// The zero value requires the GRANT of any one role, as for operations that set
+// no requirement.
+//
+// Fields:
+//   - All: Every role of the principal must GRANT
+//   - Minimum: The least number of roles that must GRANT, one if zero
+type IdentityRequirement struct {
+	All     bool
+	Minimum int
+}
+
+// Conjunctive reports whether the requirement asks for more than the GRANT of
+// any one role.
+func (r IdentityRequirement) Conjunctive() bool {
+	return r.All || r.Minimum > 1
+}
+
+// Met reports whether granted roles, of the principal's roles, meet the requirement.
+func (r IdentityRequirement) Met(granted, roles int) bool {
+	return granted >= max(r.Minimum, 1) && (!r.All || granted == roles)
+}
+
+// DefaultOwnerClaim is the principal claim compared to the owner of a resource by an
+// [OwnerRule] that does not name one.
+const DefaultOwnerClaim = "sub"
+
+// OwnerRule grants a request in the RESOURCE phase when the principal owns the
+// resource, that is, when the principal's Claim equals the resource's Owner.
+// Resources without an owner are never granted by the rule.
+type OwnerRule struct {
+	Claim string
+}
+
+// Owns returns true if principal owns the resource whose owner is given.
+func (r *OwnerRule) Owns(principal map[string]interface{}, owner string) bool {
+	if r == nil || owner == "" {
+		return false
+	}
+
+	claim := r.Claim
+	if claim == "" {
+		claim = DefaultOwnerClaim
+	}
+	value, _ := principal[claim].(string)
+	return value == owner
+}
+
+// NetworkRule admits the requests whose client, given by the PORC's context.ip, is
+// within any of Networks, if any, and is located in any of Countries, if any.
+// Requests whose client address or country is unknown are not admitted.
+type NetworkRule struct {
+	Networks  []netip.Prefix
+	Countries []string // ISO 3166-1 alpha-2 codes, such as "US"
+}
+
+// Admits reports whether the rule admits a request from the network origin n and,
+// if not, why. A nil rule admits every request. An error is returned if the client
+// could not be located.
+func (r *NetworkRule) Admits(n *opa.Network) (bool, string, error) {
+	if r == nil {
+		return true, "", nil
+	}
+
+	client, ok := n.Client()
+	if !ok {
+		return false, "client address unknown", nil
+	}
+
+	if len(r.Networks) > 0 && !slices.ContainsFunc(r.Networks, func(p netip.Prefix) bool { return p.Contains(client) }) {
+		return false, fmt.Sprintf("client %s outside %s", client, joinPrefixes(r.Networks)), nil
+	}
+
+	if len(r.Countries) > 0 {
+		location, found, err := n.Locate(client)
+		switch {
+		case err != nil:
+			return false, "", fmt.Errorf("failed to locate client %s: %w", client, err)
+		case !found || location.Country == "":
+			return false, fmt.Sprintf("country of client %s unknown", client), nil
+		case !slices.Contains(r.Countries, location.Country):
+			return false, fmt.Sprintf("client %s located in %s, not %s", client, location.Country, strings.Join(r.Countries, ", ")), nil
+		}
+	}
+
+	return true, "", nil
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	s := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
 }
 
 // Group represents a named collection of roles for batch permission assignment.
@@ -173,10 +319,12 @@ type PolicyReference struct {
 // Fields:
 //   - Mrn: The Manetu Resource Name uniquely identifying this group
 //   - Roles: MRNs of all roles included in this group
+//   - Groups: MRNs of groups nested in this group, whose roles and annotations members also inherit
 //   - Annotations: Metadata available during policy evaluation with merge strategies
 type Group struct {
 	Mrn         string
 	Roles       []string
+	Groups      []string
 	Annotations RichAnnotations
 }
 
@@ -192,16 +340,36 @@ type Group struct {
 //   - Group: MRN of the resource group this resource belongs to
 //   - Annotations: Custom metadata for policy decisions (with merge strategies)
 //   - Classification: Security level (e.g., "LOW", "MODERATE", "HIGH", "MAXIMUM")
+//   - Compartments: Compartments of the classification lattice that readers must hold
+//   - AllowedPurposes: Purposes the resource may be accessed for, replacing those of its group
 //
 // The JSON tags support PORC encoding/decoding when resources are passed
 // through authorization requests. RichAnnotations marshal to plain values
 // for OPA compatibility while preserving merge strategies internally.
 type Resource struct {
-	ID             string          `json:"id,omitempty"`
-	Owner          string          `json:"owner,omitempty"`
-	Group          string          `json:"group,omitempty"`
-	Annotations    RichAnnotations `json:"annotations,omitempty"`
-	Classification string          `json:"classification,omitempty"`
+	ID              string          `json:"id,omitempty"`
+	Owner           string          `json:"owner,omitempty"`
+	Group           string          `json:"group,omitempty"`
+	Annotations     RichAnnotations `json:"annotations,omitempty"`
+	Classification  string          `json:"classification,omitempty"`
+	Compartments    []string        `json:"compartments,omitempty"`
+	AllowedPurposes []string        `json:"allowed_purposes,omitempty"`
+}
+
+// PurposeAllowed reports whether a request declaring the given purposes may access a
+// resource that may only be accessed for the allowed purposes. Every request may access a
+// resource without allowed purposes, and otherwise the request must declare at least one
+// of them.
+func PurposeAllowed(declared, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, purpose := range declared {
+		if slices.Contains(allowed, purpose) {
+			return true
+		}
+	}
+	return false
 }
 
 // Mapper transforms non-PORC inputs into PORC expressions.
@@ -229,8 +397,157 @@ type Resource struct {
 //
 // Fields:
 //   - Domain: The policy domain this mapper belongs to
+//   - ID: The mapper's ID within its domain
 //   - Ast: The compiled Rego AST for executing the transformation
 type Mapper struct {
 	Domain string
+	ID     string
 	Ast    *opa.Ast
 }
+
+// OperationRoute is an operation declared by a policy domain: the operations its
+// selectors match are evaluated with its policy in the SYSTEM phase.
+//
+// Fields:
+//   - Mrn: The MRN of the operation declaration
+//   - Domain: The policy domain that declares the operation
+//   - Selectors: Patterns matching operation MRNs
+//   - Policy: The operation's policy
+type OperationRoute struct {
+	Mrn       string
+	Domain    string
+	Selectors []*regexp.Regexp
+	Policy    *Policy
+}
+
+// BypassRule grants operations in the SYSTEM phase to principals holding any
+// of its roles, without evaluating the operation's policy.
+//
+// Bypass rules make the system policies that keep administrators from being
+// locked out declarative. A matching rule is a phase1 GRANT, and is recorded
+// in the AccessRecord as a system override with the rule's Reason.
+//
+// Fields:
+//   - Name: The name of the rule, unique within its domain
+//   - Domain: The policy domain that defines the rule
+//   - Reason: The grant reason recorded in the AccessRecord
+//   - Roles: MRNs of the roles granted the bypass
+//   - Operations: Patterns matching operation MRNs; empty matches every operation
+type BypassRule struct {
+	Name       string
+	Domain     string
+	Reason     events.AccessRecord_BypassGrantReason
+	Roles      []string
+	Operations []*regexp.Regexp
+}
+
+// Matches reports whether the rule grants the operation to a principal with the given roles.
+func (r *BypassRule) Matches(operation string, roles []string) bool {
+	if len(r.Operations) > 0 {
+		matched := false
+		for _, selector := range r.Operations {
+			if selector.MatchString(operation) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, role := range roles {
+		for _, granted := range r.Roles {
+			if role == granted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ImpersonationRule permits principals holding any of its roles to act on behalf
+// of other subjects, as the actor of a request's act claim.
+//
+// A request whose principal carries an act claim is denied in the SYSTEM phase,
+// before any policy is evaluated, unless a rule permits each actor of the claim
+// to act for the principal's subject. The AccessRecord records the actors and the
+// rules permitting them.
+//
+// Fields:
+//   - Name: The name of the rule, unique within its domain
+//   - Domain: The policy domain that defines the rule
+//   - Roles: MRNs of the roles of the actors permitted
+//   - Subjects: Patterns matching the subjects acted for; empty matches every subject
+//   - Operations: Patterns matching operation MRNs; empty matches every operation
+type ImpersonationRule struct {
+	Name       string
+	Domain     string
+	Roles      []string
+	Subjects   []*regexp.Regexp
+	Operations []*regexp.Regexp
+}
+
+// Permits reports whether the rule lets an actor with the given roles act on behalf of
+// subject for the operation.
+func (r *ImpersonationRule) Permits(subject, operation string, roles []string) bool {
+	matches := func(selectors []*regexp.Regexp, s string) bool {
+		if len(selectors) == 0 {
+			return true
+		}
+		for _, selector := range selectors {
+			if selector.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+	if !matches(r.Subjects, subject) || !matches(r.Operations, operation) {
+		return false
+	}
+
+	for _, role := range roles {
+		for _, permitted := range r.Roles {
+			if role == permitted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DomainDefaults is the decision strategy of the policy domain that routes a
+// request's operation.
+//
+// Fields:
+//   - Domain: The policy domain that declares the defaults
+//   - Decision: The outcome when no policy applies, GRANT or DENY. The identity
+//     phase of a principal without roles or groups has this outcome, as does a
+//     request that no phase evaluated a policy for under ANY combining.
+//   - Combining: ALL requires the identity, resource, and scope phases to
+//     GRANT; ANY grants when any phase that evaluated a policy GRANTs
+type DomainDefaults struct {
+	Domain    string
+	Decision  events.AccessRecord_Decision
+	Combining events.AccessRecord_Combining
+}
+
+// DomainInfo identifies the exact content of a loaded policy domain.
+type DomainInfo struct {
+	// Name is the policy domain name
+	Name string
+	// Fingerprint is the SHA-256 of the built PolicyDomain YAML
+	Fingerprint []byte
+}
+
+// BundleInfo describes the set of policy domains currently serving decisions.
+//
+// Revision increases monotonically within a process each time the bundle set
+// is loaded or updated, so audit records can distinguish decisions made before
+// and after a hot-reload even when the same domains are involved.
+type BundleInfo struct {
+	Revision uint64
+	Domains  []DomainInfo // sorted by name
+}
@@ -7,9 +7,12 @@ package model
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"net/netip"
 	"testing"
 
 	"github.com/manetu/policyengine/pkg/common"
+	"github.com/manetu/policyengine/pkg/core/geo"
 	"github.com/manetu/policyengine/pkg/core/opa"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 	"github.com/stretchr/testify/assert"
@@ -437,3 +440,169 @@ func TestResource_JSONSerialization(t *testing.T) {
 		assert.Equal(t, "user123", result.Owner)
 	})
 }
+
+func TestEvaluateWithObligations(t *testing.T) {
+	compile := func(source string) *Policy {
+		ast, err := opa.NewCompiler().Compile("test-policy", opa.Modules{"test.rego": source})
+		require.NoError(t, err)
+		return &Policy{Mrn: "mrn:test:policy", Ast: ast}
+	}
+
+	policy := compile(`
+package authz
+allow = {"allow": true, "quota": {"limit": 100, "window": "1m"}}
+`)
+	result, obligations, perr := policy.EvaluateBoolWithObligations(context.Background(), map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.True(t, result)
+	assert.Equal(t, Obligations{"quota": map[string]interface{}{"limit": json.Number("100"), "window": "1m"}}, obligations)
+
+	// EvaluateBool accepts the object form, dropping the obligations
+	result, perr = policy.EvaluateBool(context.Background(), map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.True(t, result)
+
+	policy = compile(`
+package authz
+allow = {"allow": 1, "tier": "gold"}
+`)
+	i, obligations, perr := policy.EvaluateIntWithObligations(context.Background(), map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.Equal(t, 1, i)
+	assert.Equal(t, Obligations{"tier": "gold"}, obligations)
+
+	// plain results carry no obligations
+	policy = compile(`
+package authz
+allow = true
+`)
+	_, obligations, perr = policy.EvaluateBoolWithObligations(context.Background(), map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.Nil(t, obligations)
+}
+
+func TestEvaluateWithObligationsMissingAllow(t *testing.T) {
+	ast, err := opa.NewCompiler().Compile("test-policy", opa.Modules{"test.rego": `
+package authz
+allow = {"quota": 10}
+`})
+	require.NoError(t, err)
+	policy := &Policy{Mrn: "mrn:test:policy", Ast: ast}
+
+	result, perr := policy.EvaluateBool(context.Background(), map[string]interface{}{})
+	assert.False(t, result)
+	require.NotNil(t, perr)
+	assert.Equal(t, events.AccessRecord_BundleReference_UNKNOWN_ERROR, perr.ReasonCode)
+	assert.Contains(t, perr.Reason, "missing 'allow'")
+}
+
+func TestOwnerRule_Owns(t *testing.T) {
+	principal := map[string]interface{}{"sub": "alice", "email": "alice@example.com", "mroles": []string{"reader"}}
+
+	var none *OwnerRule
+	assert.False(t, none.Owns(principal, "alice"), "a nil rule grants no one")
+
+	rule := &OwnerRule{}
+	assert.True(t, rule.Owns(principal, "alice"), "the sub claim is compared by default")
+	assert.False(t, rule.Owns(principal, "bob"))
+	assert.False(t, rule.Owns(principal, ""), "resources without an owner are not owned")
+	assert.False(t, rule.Owns(nil, "alice"))
+
+	rule = &OwnerRule{Claim: "email"}
+	assert.True(t, rule.Owns(principal, "alice@example.com"))
+	assert.False(t, rule.Owns(principal, "alice"))
+
+	rule = &OwnerRule{Claim: "mroles"}
+	assert.False(t, rule.Owns(principal, "reader"), "only string claims are compared")
+}
+
+type countryLocator map[netip.Addr]string
+
+func (c countryLocator) Locate(addr netip.Addr) (geo.Location, bool, error) {
+	if addr == netip.MustParseAddr("192.0.2.66") {
+		return geo.Location{}, false, errors.New("database unavailable")
+	}
+	country, ok := c[addr]
+	return geo.Location{Country: country}, ok, nil
+}
+
+func TestNetworkRule_Admits(t *testing.T) {
+	locator := countryLocator{netip.MustParseAddr("10.1.2.3"): "US", netip.MustParseAddr("203.0.113.7"): "DE"}
+	network := func(addr string) *opa.Network {
+		client, _ := netip.ParseAddr(addr)
+		return opa.NewNetwork(client, nil, locator)
+	}
+
+	var none *NetworkRule
+	admitted, _, err := none.Admits(nil)
+	require.NoError(t, err)
+	assert.True(t, admitted, "a nil rule admits every request")
+
+	rule := &NetworkRule{Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Countries: []string{"US"}}
+	tests := []struct {
+		name     string
+		network  *opa.Network
+		admitted bool
+		reason   string
+	}{
+		{"within network and country", network("10.1.2.3"), true, ""},
+		{"outside network", network("203.0.113.7"), false, "client 203.0.113.7 outside 10.0.0.0/8"},
+		{"outside country", network("10.9.9.9"), false, "country of client 10.9.9.9 unknown"},
+		{"unknown client", network(""), false, "client address unknown"},
+		{"no network origin", nil, false, "client address unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admitted, reason, err := rule.Admits(tt.network)
+			require.NoError(t, err)
+			assert.Equal(t, tt.admitted, admitted)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+
+	countries := &NetworkRule{Countries: []string{"US", "CA"}}
+	admitted, reason, err := countries.Admits(network("203.0.113.7"))
+	require.NoError(t, err)
+	assert.False(t, admitted)
+	assert.Equal(t, "client 203.0.113.7 located in DE, not US, CA", reason)
+
+	_, _, err = countries.Admits(network("192.0.2.66"))
+	assert.ErrorContains(t, err, "failed to locate client 192.0.2.66: database unavailable")
+}
+
+func TestPurposeAllowed(t *testing.T) {
+	assert.True(t, PurposeAllowed(nil, nil), "resources without allowed purposes are unrestricted")
+	assert.True(t, PurposeAllowed([]string{"marketing"}, nil))
+	assert.True(t, PurposeAllowed([]string{"billing"}, []string{"billing", "support"}))
+	assert.True(t, PurposeAllowed([]string{"marketing", "support"}, []string{"billing", "support"}), "any declared purpose may be allowed")
+	assert.False(t, PurposeAllowed([]string{"marketing"}, []string{"billing", "support"}))
+	assert.False(t, PurposeAllowed(nil, []string{"billing"}), "a restricted resource requires a declared purpose")
+}
+
+func TestIdentityRequirement(t *testing.T) {
+	tests := []struct {
+		name        string
+		requirement IdentityRequirement
+		conjunctive bool
+		met         [][2]int // granted and roles that meet the requirement
+		unmet       [][2]int
+	}{
+		{"any", IdentityRequirement{}, false, [][2]int{{1, 1}, {1, 5}}, [][2]int{{0, 0}, {0, 3}}},
+		{"minimum of one", IdentityRequirement{Minimum: 1}, false, [][2]int{{1, 3}}, [][2]int{{0, 3}}},
+		{"minimum", IdentityRequirement{Minimum: 2}, true, [][2]int{{2, 2}, {2, 5}, {3, 5}}, [][2]int{{1, 1}, {1, 5}, {0, 0}}},
+		{"all", IdentityRequirement{All: true}, true, [][2]int{{1, 1}, {3, 3}}, [][2]int{{0, 0}, {2, 3}}},
+		{"all of at least", IdentityRequirement{All: true, Minimum: 2}, true, [][2]int{{2, 2}, {3, 3}}, [][2]int{{1, 1}, {2, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.conjunctive, tt.requirement.Conjunctive())
+			for _, m := range tt.met {
+				assert.True(t, tt.requirement.Met(m[0], m[1]), "%d of %d", m[0], m[1])
+			}
+			for _, m := range tt.unmet {
+				assert.False(t, tt.requirement.Met(m[0], m[1]), "%d of %d", m[0], m[1])
+			}
+		})
+	}
+}
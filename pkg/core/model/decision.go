@@ -0,0 +1,76 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// DecisionKind is the kind of value that a phase expects a policy to decide with.
+type DecisionKind string
+
+const (
+	// BooleanDecision is the GRANT or DENY of the policies of roles, resource groups, and
+	// scopes, and of deny policies. See [Policy.EvaluateBool].
+	BooleanDecision DecisionKind = "boolean"
+
+	// NumberDecision is the tri-level decision of the policies of operations. See
+	// [Policy.EvaluateInt].
+	NumberDecision DecisionKind = "number"
+)
+
+// CheckDecisionType returns an error if a policy whose [PolicyEntrypoint] has type t, as
+// inferred by the compiler, can never decide with any of kinds, either as the value of the
+// entrypoint or as its "allow" key along with [Obligations].
+//
+// A type that the compiler could not infer, such as that of a value read from the input, may
+// hold any kind, and is accepted.
+func CheckDecisionType(t types.Type, kinds ...DecisionKind) error {
+	for _, kind := range kinds {
+		if mayDecide(t, kind, true) {
+			return nil
+		}
+	}
+
+	names := make([]string, len(kinds))
+	for i, kind := range kinds {
+		names[i] = string(kind)
+	}
+	return fmt.Errorf("%s is %s, but must be a %s, or an object with such an allow key", PolicyEntrypoint, types.Sprint(t), strings.Join(names, " or "))
+}
+
+// mayDecide reports whether a value of type t may be a decision of the kind, looking into
+// the allow key of objects if obligations may be attached
+func mayDecide(t types.Type, kind DecisionKind, obligations bool) bool {
+	switch t := t.(type) {
+	case nil:
+		return true
+	case types.Any:
+		if len(t) == 0 {
+			return true // any type
+		}
+		for _, member := range t {
+			if mayDecide(member, kind, obligations) {
+				return true
+			}
+		}
+		return false
+	case types.Boolean:
+		return kind == BooleanDecision
+	case types.Number:
+		return kind == NumberDecision
+	case *types.Object:
+		if !obligations {
+			return false
+		}
+		allow := t.Select("allow")
+		return allow != nil && mayDecide(allow, kind, false)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,56 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package model
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/v1/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDecisionType(t *testing.T) {
+	withAllow := func(allow types.Type) types.Type {
+		return types.NewObject([]*types.StaticProperty{
+			types.NewStaticProperty("allow", allow),
+			types.NewStaticProperty("obligations", types.NewArray(nil, types.A)),
+		}, nil)
+	}
+
+	tests := []struct {
+		name  string
+		typ   types.Type
+		kinds []DecisionKind
+		ok    bool
+	}{
+		{"boolean", types.B, []DecisionKind{BooleanDecision}, true},
+		{"number", types.N, []DecisionKind{NumberDecision}, true},
+		{"boolean or number", types.N, []DecisionKind{BooleanDecision, NumberDecision}, true},
+		{"number for boolean", types.N, []DecisionKind{BooleanDecision}, false},
+		{"any", types.A, []DecisionKind{BooleanDecision}, true},
+		{"not inferred", nil, []DecisionKind{NumberDecision}, true},
+		{"union", types.NewAny(types.S, types.B), []DecisionKind{BooleanDecision}, true},
+		{"string", types.S, []DecisionKind{BooleanDecision, NumberDecision}, false},
+		{"set", types.NewSet(types.S), []DecisionKind{BooleanDecision}, false},
+		{"obligations", withAllow(types.B), []DecisionKind{BooleanDecision}, true},
+		{"obligations of a string", withAllow(types.S), []DecisionKind{BooleanDecision}, false},
+		{"nested obligations", withAllow(withAllow(types.B)), []DecisionKind{BooleanDecision}, false},
+		{"no allow key", types.NewObject([]*types.StaticProperty{types.NewStaticProperty("deny", types.B)}, nil), []DecisionKind{BooleanDecision}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckDecisionType(tt.typ, tt.kinds...)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	err := CheckDecisionType(types.S, BooleanDecision, NumberDecision)
+	assert.EqualError(t, err, "data.authz.allow is string, but must be a boolean or number, or an object with such an allow key")
+}
@@ -8,10 +8,63 @@ package model
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strings"
 
+	"github.com/manetu/policyengine/internal/logging"
 	"github.com/manetu/policyengine/pkg/common"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
+var logger = logging.GetLogger("policyengine.model")
+
+// MapperPackage is the package in which a mapper defines its outputs.
+const MapperPackage = "data.mapper"
+
+// MapperEntrypoint is the rule that every mapper defines, in package mapper, and that
+// [MapperQuery] evaluates.
+const MapperEntrypoint = "data.mapper.porc"
+
+// MapperQuery is the Rego query evaluated to transform input with a mapper.
+const MapperQuery = "porc = " + MapperEntrypoint
+
+// DefaultMapperOutput is the document of a mapper that is evaluated as the PORC, unless
+// another is selected by name.
+const DefaultMapperOutput = "porc"
+
+var mapperOutputName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateMapperOutput returns an error if name cannot be the name of a document that a
+// mapper defines in package mapper, such as audit_context in data.mapper.audit_context.
+func ValidateMapperOutput(name string) error {
+	if !mapperOutputName.MatchString(name) {
+		return fmt.Errorf("invalid mapper output '%s': must be a Rego identifier", name)
+	}
+	return nil
+}
+
+// MapperOutputQuery returns the Rego query evaluated to produce the named document of a
+// mapper, bound to porc. The query of [DefaultMapperOutput] is [MapperQuery].
+func MapperOutputQuery(name string) string {
+	return "porc = " + MapperPackage + "." + name
+}
+
+// mapperOutputsQuery returns the query evaluating each of the named documents of a mapper at
+// once, bound to o0, o1, and so on in order, as an array that is empty if the document is
+// undefined
+func mapperOutputsQuery(names []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "o%d = [v | v := %s.%s]", i, MapperPackage, name)
+	}
+	return b.String()
+}
+
 // Evaluate transforms non-PORC input into a PORC structure.
 //
 // The mapper policy's data.mapper.porc rule is executed with the provided
@@ -35,12 +88,69 @@ import (
 // operation, resource, and context fields.
 //
 // Returns the PORC as interface{} (typically map[string]interface{}),
-// or a [common.PolicyError] if evaluation fails.
-func (p *Mapper) Evaluate(ctx context.Context, input interface{}) (interface{}, *common.PolicyError) {
-	result, err := p.Ast.Evaluate(ctx, "porc = data.mapper.porc", input)
+// or a [common.PolicyError] if evaluation fails. A panic during evaluation is
+// recovered and returned as an INTERNAL_ERROR, with its stack trace logged.
+func (p *Mapper) Evaluate(ctx context.Context, input interface{}) (porc interface{}, perr *common.PolicyError) {
+	return p.EvaluateOutput(ctx, input, DefaultMapperOutput)
+}
+
+// EvaluateOutput transforms input like [Mapper.Evaluate], but with the named document of the
+// mapper, such as data.mapper.authz_input for "authz_input", instead of data.mapper.porc.
+// This lets a single mapper produce the input of several consumers.
+//
+// Returns a [common.PolicyError] if name is invalid, or if the document is undefined for
+// input.
+func (p *Mapper) EvaluateOutput(ctx context.Context, input interface{}, name string) (output interface{}, perr *common.PolicyError) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("mapper", "evaluate", "recovered from panic in mapper %s: %v\n%s", p.ID, r, debug.Stack())
+			output, perr = nil, common.NewError(events.AccessRecord_BundleReference_INTERNAL_ERROR, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	if err := ValidateMapperOutput(name); err != nil {
+		return nil, common.NewError(events.AccessRecord_BundleReference_INVALPARAM_ERROR, err.Error())
+	}
+
+	result, err := p.Ast.Evaluate(ctx, MapperOutputQuery(name), input)
 	if err != nil {
 		return nil, err
 	}
 
 	return result.Bindings["porc"], nil
 }
+
+// EvaluateOutputs evaluates the named documents of the mapper with input in a single
+// evaluation, such as enrichment data that accompanies the PORC. Unlike
+// [Mapper.EvaluateOutput], a document that is undefined for input is not an error, and is
+// simply absent from the outputs.
+func (p *Mapper) EvaluateOutputs(ctx context.Context, input interface{}, names ...string) (outputs map[string]interface{}, perr *common.PolicyError) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("mapper", "evaluate", "recovered from panic in mapper %s: %v\n%s", p.ID, r, debug.Stack())
+			outputs, perr = nil, common.NewError(events.AccessRecord_BundleReference_INTERNAL_ERROR, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	if len(names) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	for _, name := range names {
+		if err := ValidateMapperOutput(name); err != nil {
+			return nil, common.NewError(events.AccessRecord_BundleReference_INVALPARAM_ERROR, err.Error())
+		}
+	}
+
+	result, err := p.Ast.Evaluate(ctx, mapperOutputsQuery(names), input)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs = make(map[string]interface{}, len(names))
+	for i, name := range names {
+		if values, ok := result.Bindings[fmt.Sprintf("o%d", i)].([]interface{}); ok && len(values) > 0 {
+			outputs[name] = values[0]
+		}
+	}
+	return outputs, nil
+}
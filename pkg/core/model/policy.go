@@ -10,18 +10,74 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/manetu/policyengine/pkg/common"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
-func (p *Policy) evaluate(ctx context.Context, input interface{}) (interface{}, *common.PolicyError) {
-	result, err := p.Ast.Evaluate(ctx, "x = data.authz.allow", input)
+// Obligations are structured values returned by a policy alongside its decision, such as a
+// quota that the policy enforcement point should apply to a granted request.
+//
+// A policy returns obligations by defining allow as an object holding the decision under
+// "allow" and each obligation under its own key:
+//
+//	default allow = false
+//
+//	allow = {"allow": true, "quota": {"limit": 100, "window": "1m"}} {
+//	    input.principal.sub != ""
+//	}
+//
+// Numbers in obligations are represented as [json.Number].
+type Obligations map[string]interface{}
+
+// CacheHint advises a policy enforcement point how long it may reuse a decision for identical
+// requests without asking the policy engine again.
+//
+// A TTL of zero means the decision must not be reused. Otherwise, the decision may be reused for
+// up to TTL, but should be discarded early once the policy engine reports a bundle revision other
+// than Revision.
+type CacheHint struct {
+	TTL      time.Duration
+	Revision uint64
+}
+
+// PolicyEntrypoint is the rule that every policy defines, in package authz, and that
+// [PolicyQuery] evaluates.
+const PolicyEntrypoint = "data.authz.allow"
+
+// PolicyQuery is the Rego query evaluated for every policy decision.
+const PolicyQuery = "x = " + PolicyEntrypoint
+
+func (p *Policy) evaluate(ctx context.Context, input interface{}) (interface{}, Obligations, *common.PolicyError) {
+	result, err := p.Ast.Evaluate(ctx, PolicyQuery, input)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return result.Bindings["x"], nil
+	x := result.Bindings["x"]
+	m, ok := x.(map[string]interface{})
+	if !ok {
+		return x, nil, nil
+	}
+
+	decision, ok := m["allow"]
+	if !ok {
+		return nil, nil, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("unexpected evaluation result, missing 'allow': %+v", x)}
+	}
+
+	var obligations Obligations
+	for k, v := range m {
+		if k == "allow" {
+			continue
+		}
+		if obligations == nil {
+			obligations = make(Obligations, len(m)-1)
+		}
+		obligations[k] = v
+	}
+
+	return decision, obligations, nil
 }
 
 // EvaluateBool evaluates the policy and returns a boolean authorization decision.
@@ -37,9 +93,16 @@ func (p *Policy) evaluate(ctx context.Context, input interface{}) (interface{},
 // Returns false with a [common.PolicyError] if evaluation fails or produces
 // a non-boolean result.
 func (p *Policy) EvaluateBool(ctx context.Context, input interface{}) (bool, *common.PolicyError) {
-	x, err := p.evaluate(ctx, input)
+	b, _, err := p.EvaluateBoolWithObligations(ctx, input)
+	return b, err
+}
+
+// EvaluateBoolWithObligations is like [Policy.EvaluateBool], but also returns any
+// [Obligations] the policy attached to its decision.
+func (p *Policy) EvaluateBoolWithObligations(ctx context.Context, input interface{}) (bool, Obligations, *common.PolicyError) {
+	x, obligations, err := p.evaluate(ctx, input)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
 	var (
@@ -48,10 +111,10 @@ func (p *Policy) EvaluateBool(ctx context.Context, input interface{}) (bool, *co
 	)
 
 	if b, ok = x.(bool); !ok { // bad results
-		return false, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("unexpected evaluation result: %+v", x)}
+		return false, nil, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("unexpected evaluation result: %+v", x)}
 	}
 
-	return b, nil
+	return b, obligations, nil
 }
 
 // EvaluateInt evaluates the policy and returns a tri-level integer result.
@@ -69,9 +132,16 @@ func (p *Policy) EvaluateBool(ctx context.Context, input interface{}) (bool, *co
 // Returns -1 with a [common.PolicyError] if evaluation fails or produces
 // a non-numeric result.
 func (p *Policy) EvaluateInt(ctx context.Context, input interface{}) (int, *common.PolicyError) {
-	x, perr := p.evaluate(ctx, input)
+	i, _, err := p.EvaluateIntWithObligations(ctx, input)
+	return i, err
+}
+
+// EvaluateIntWithObligations is like [Policy.EvaluateInt], but also returns any
+// [Obligations] the policy attached to its decision.
+func (p *Policy) EvaluateIntWithObligations(ctx context.Context, input interface{}) (int, Obligations, *common.PolicyError) {
+	x, obligations, perr := p.evaluate(ctx, input)
 	if perr != nil {
-		return -1, perr
+		return -1, nil, perr
 	}
 
 	var (
@@ -80,9 +150,9 @@ func (p *Policy) EvaluateInt(ctx context.Context, input interface{}) (int, *comm
 	)
 
 	if n, ok := x.(json.Number); !ok { // bad results
-		return -1, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("unexpected evaluation result: %+v", x)}
+		return -1, nil, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("unexpected evaluation result: %+v", x)}
 	} else if l, err = n.Int64(); err != nil {
-		return -1, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("cannot extract integer result: %s", err)}
+		return -1, nil, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_UNKNOWN_ERROR, Reason: fmt.Sprintf("cannot extract integer result: %s", err)}
 	}
-	return int(l), nil
+	return int(l), obligations, nil
 }
@@ -0,0 +1,161 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/calendar"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// CalendarInput is the key of the input under which the policy engine gives policies the
+// [calendar.Moment] of the request in its realm's calendar. Policies referring to it read
+// the clock, like those calling time.now_ns.
+const CalendarInput = "calendar"
+
+// BusinessHoursBuiltin is the name of the built-in function that reports whether the request
+// is made within the business hours of its realm.
+const BusinessHoursBuiltin = "calendar.business_hours"
+
+// BetweenBuiltin is the name of the built-in function that reports whether the request is
+// made within a time window of the day, in its realm's timezone.
+const BetweenBuiltin = "calendar.between"
+
+// NowBuiltin is the name of the built-in function that returns the moment of the request in
+// its realm's calendar.
+const NowBuiltin = "calendar.now"
+
+var momentType = types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))
+
+var businessHoursDecl = &rego.Function{
+	Name:        BusinessHoursBuiltin,
+	Description: "Reports whether the request is made within the business hours of a business day of its realm's calendar.",
+	Decl: types.NewFunction(
+		types.Args(),
+		types.Named("result", types.B).Description("true within business hours, undefined if the realm has no calendar"),
+	),
+	Nondeterministic: true,
+}
+
+var betweenDecl = &rego.Function{
+	Name:        BetweenBuiltin,
+	Description: "Reports whether the request is made within a time window of the day, in the timezone of its realm's calendar. A window ending earlier than it starts spans midnight.",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("start", types.S).Description("start of the window, as HH:MM"),
+			types.Named("end", types.S).Description("end of the window, excluded, as HH:MM"),
+		),
+		types.Named("result", types.B).Description("true within the window, undefined if the realm has no calendar"),
+	),
+	Nondeterministic: true,
+}
+
+var nowDecl = &rego.Function{
+	Name:        NowBuiltin,
+	Description: "Returns the moment of the request in its realm's calendar, with its timezone, date, time, weekday, hour, minute, holiday, business_day, and business_hours.",
+	Decl: types.NewFunction(
+		types.Args(),
+		types.Named("moment", momentType).Description("the moment, undefined if the realm has no calendar"),
+	),
+	Nondeterministic: true,
+}
+
+var calendarBuiltins = []*Builtin{
+	{Decl: businessHoursDecl, Impl: businessHours},
+	{Decl: betweenDecl, Impl: between},
+	{Decl: nowDecl, Impl: now},
+}
+
+// CalendarBuiltins returns the [BusinessHoursBuiltin], [BetweenBuiltin], and [NowBuiltin]
+// implementations, which read the calendar of the request's realm from the evaluation context,
+// attached with [WithCalendar]. Without one, they are undefined. The policy engine registers
+// them with every compiler.
+func CalendarBuiltins() []*Builtin {
+	return calendarBuiltins
+}
+
+// CalendarDeclarations returns the capability declarations of [CalendarBuiltins], for tooling
+// that compiles Rego without evaluating it, such as lint.
+func CalendarDeclarations() []*ast.Builtin {
+	decls := make([]*ast.Builtin, len(calendarBuiltins))
+	for i, b := range calendarBuiltins {
+		decls[i] = b.Declaration()
+	}
+	return decls
+}
+
+type calendarKey struct{}
+
+// WithCalendar returns a context whose evaluations see c as the calendar of the request's realm.
+func WithCalendar(ctx context.Context, c *calendar.Calendar) context.Context {
+	return context.WithValue(ctx, calendarKey{}, c)
+}
+
+// CalendarFrom returns the calendar attached to ctx, or nil if none is.
+func CalendarFrom(ctx context.Context) *calendar.Calendar {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(calendarKey{}).(*calendar.Calendar)
+	return c
+}
+
+// evalTime returns the time of the evaluation, the same as time.now_ns
+func evalTime(bctx rego.BuiltinContext) time.Time {
+	if bctx.Time != nil {
+		if n, ok := bctx.Time.Value.(ast.Number); ok {
+			if ns, ok := n.Int64(); ok {
+				return time.Unix(0, ns)
+			}
+		}
+	}
+	return time.Now()
+}
+
+func businessHours(bctx rego.BuiltinContext, _ []*ast.Term) (*ast.Term, error) {
+	c := CalendarFrom(bctx.Context)
+	if c == nil {
+		return nil, nil
+	}
+	return ast.BooleanTerm(c.BusinessHours(evalTime(bctx))), nil
+}
+
+func between(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+	var window [2]time.Duration
+	for i, arg := range args[:2] {
+		s, ok := arg.Value.(ast.String)
+		if !ok {
+			return nil, fmt.Errorf("times of day must be strings, got %s", ast.ValueName(arg.Value))
+		}
+		d, err := calendar.ParseClock(string(s))
+		if err != nil {
+			return nil, err
+		}
+		window[i] = d
+	}
+
+	c := CalendarFrom(bctx.Context)
+	if c == nil {
+		return nil, nil
+	}
+	return ast.BooleanTerm(c.Between(evalTime(bctx), window[0], window[1])), nil
+}
+
+func now(bctx rego.BuiltinContext, _ []*ast.Term) (*ast.Term, error) {
+	c := CalendarFrom(bctx.Context)
+	if c == nil {
+		return nil, nil
+	}
+	v, err := ast.InterfaceToValue(c.At(evalTime(bctx)))
+	if err != nil {
+		return nil, err
+	}
+	return ast.NewTerm(v), nil
+}
@@ -0,0 +1,63 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core/calendar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the built-ins read the time of the evaluation, so the policy checks them against each other
+const calendarPolicy = `package authz
+moment := calendar.now()
+consistent {
+	calendar.business_hours() == moment.business_hours
+	calendar.between("06:00", "18:00") != calendar.between("18:00", "06:00")
+}
+`
+
+func TestCalendarBuiltins(t *testing.T) {
+	policy, err := NewCompiler(WithBuiltins(CalendarBuiltins()...)).Compile("calendar", Modules{"policy.rego": calendarPolicy})
+	require.NoError(t, err)
+
+	cal, err := calendar.New(calendar.Options{Timezone: "Australia/Sydney", Holidays: []string{"2026-12-25"}})
+	require.NoError(t, err)
+	assert.Same(t, cal, CalendarFrom(WithCalendar(context.Background(), cal)))
+
+	reads := &ClockReads{}
+	ctx := WithClockReads(WithCalendar(context.Background(), cal), reads)
+	result, perr := policy.Evaluate(ctx, "x = data.authz.consistent; y = data.authz.moment", map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+	moment, ok := result.Bindings["y"].(map[string]interface{})
+	require.True(t, ok, "%+v", result.Bindings["y"])
+	assert.Equal(t, "Australia/Sydney", moment["timezone"])
+	assert.Contains(t, moment, "business_day")
+	assert.True(t, reads.Read(), "the calendar built-ins read the clock")
+
+	// without a calendar, the built-ins are undefined
+	assert.Nil(t, CalendarFrom(context.Background()))
+	result, perr = policy.Evaluate(context.Background(), "x = object.get(data.authz, \"consistent\", false); y = object.get(data.authz, \"moment\", null)", map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.Equal(t, false, result.Bindings["x"])
+	assert.Nil(t, result.Bindings["y"])
+}
+
+func TestCalendarBuiltins_InvalidWindow(t *testing.T) {
+	// errors leave the call undefined, so the rule takes its default
+	cal, err := calendar.New(calendar.Options{})
+	require.NoError(t, err)
+	policy, err := NewCompiler(WithBuiltins(CalendarBuiltins()...)).Compile("calendar", Modules{
+		"policy.rego": "package authz\ndefault allow = false\nallow { calendar.between(\"9am\", \"17:00\") }\n",
+	})
+	require.NoError(t, err)
+	result, perr := policy.Evaluate(WithCalendar(context.Background(), cal), "x = data.authz.allow", map[string]interface{}{})
+	require.Nil(t, perr)
+	assert.Equal(t, false, result.Bindings["x"])
+}
@@ -0,0 +1,208 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// DominatesBuiltin is the name of the built-in function that compares security labels.
+const DominatesBuiltin = "clearance.dominates"
+
+var labelType = types.NewAny(types.S, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A)))
+
+var dominatesDecl = &rego.Function{
+	Name:        DominatesBuiltin,
+	Description: "Reports whether label a dominates label b in the policy domain's classification lattice.",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("a", labelType).Description("level, or object with level and compartments"),
+			types.Named("b", labelType).Description("level, or object with level and compartments"),
+		),
+		types.Named("result", types.B).Description("true if a's level is at least b's and a has all of b's compartments"),
+	),
+}
+
+// DominatesDeclaration returns the capability declaration of [DominatesBuiltin], for tooling
+// that compiles Rego without a [Lattice], such as lint.
+func DominatesDeclaration() *ast.Builtin {
+	return (&Builtin{Decl: dominatesDecl}).Declaration()
+}
+
+// Lattice is a classification lattice: an ordered list of levels and a set of compartments.
+//
+// A security label combines a level with any number of compartments. Label a dominates label b
+// when a's level is at least b's and a holds every compartment of b, so that, for example, a
+// principal cleared for HIGH with compartment CRYPTO may read a resource labelled MODERATE with
+// CRYPTO, but not one labelled MODERATE with NUCLEAR.
+//
+// The lattice is exposed to policies as [DominatesBuiltin]; register it with [Lattice.Builtin]:
+//
+//	lattice, err := opa.NewLattice([]string{"LOW", "MODERATE", "HIGH"}, []string{"CRYPTO"})
+//	compiler := opa.NewCompiler(opa.WithBuiltins(lattice.Builtin()))
+//
+// Policies pass each label either as a level string or as an object with a level and a list
+// of compartments:
+//
+//	allow {
+//	    clearance.dominates(
+//	        {"level": input.principal.mclearance, "compartments": input.principal.mannotations.compartments},
+//	        {"level": input.resource.classification, "compartments": input.resource.compartments},
+//	    )
+//	}
+//
+// A label with an unknown level or compartment leaves the call undefined.
+type Lattice struct {
+	levels       map[string]int
+	compartments map[string]bool
+}
+
+// Label is a security label: a level of a [Lattice] and a set of its compartments.
+type Label struct {
+	Level        string
+	Compartments []string
+}
+
+// NewLattice creates a [Lattice] from its levels, lowest first, and its compartments.
+//
+// Returns an error if there are no levels or if a name is empty or declared twice.
+func NewLattice(levels, compartments []string) (*Lattice, error) {
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("classification lattice requires at least one level")
+	}
+
+	l := &Lattice{
+		levels:       make(map[string]int, len(levels)),
+		compartments: make(map[string]bool, len(compartments)),
+	}
+	for i, level := range levels {
+		if level == "" {
+			return nil, fmt.Errorf("classification level names cannot be empty")
+		}
+		if _, ok := l.levels[level]; ok {
+			return nil, fmt.Errorf("classification level '%s' is declared twice", level)
+		}
+		l.levels[level] = i
+	}
+	for _, compartment := range compartments {
+		if compartment == "" {
+			return nil, fmt.Errorf("compartment names cannot be empty")
+		}
+		if l.compartments[compartment] {
+			return nil, fmt.Errorf("compartment '%s' is declared twice", compartment)
+		}
+		l.compartments[compartment] = true
+	}
+
+	return l, nil
+}
+
+// Dominates reports whether label a dominates label b.
+//
+// Returns an error if either label has a level or compartment that the lattice does not declare.
+func (l *Lattice) Dominates(a, b Label) (bool, error) {
+	if err := l.check(a); err != nil {
+		return false, err
+	}
+	if err := l.check(b); err != nil {
+		return false, err
+	}
+
+	if l.levels[a.Level] < l.levels[b.Level] {
+		return false, nil
+	}
+
+	held := make(map[string]bool, len(a.Compartments))
+	for _, compartment := range a.Compartments {
+		held[compartment] = true
+	}
+	for _, compartment := range b.Compartments {
+		if !held[compartment] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (l *Lattice) check(label Label) error {
+	if _, ok := l.levels[label.Level]; !ok {
+		return fmt.Errorf("unknown classification level '%s'", label.Level)
+	}
+	for _, compartment := range label.Compartments {
+		if !l.compartments[compartment] {
+			return fmt.Errorf("unknown compartment '%s'", compartment)
+		}
+	}
+	return nil
+}
+
+// Builtin returns the [DominatesBuiltin] implementation bound to this Lattice.
+func (l *Lattice) Builtin() *Builtin {
+	return &Builtin{Decl: dominatesDecl, Impl: l.dominates}
+}
+
+func (l *Lattice) dominates(_ rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+	a, err := labelOperand(args[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	b, err := labelOperand(args[1].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := l.Dominates(a, b)
+	if err != nil {
+		return nil, err
+	}
+	return ast.BooleanTerm(result), nil
+}
+
+// labelOperand converts a level string, or an object with a level and compartments, to a Label
+func labelOperand(value ast.Value) (Label, error) {
+	switch v := value.(type) {
+	case ast.String:
+		return Label{Level: string(v)}, nil
+	case ast.Object:
+		term := v.Get(ast.StringTerm("level"))
+		if term == nil {
+			return Label{}, fmt.Errorf("label must have a string level")
+		}
+		level, ok := term.Value.(ast.String)
+		if !ok {
+			return Label{}, fmt.Errorf("label must have a string level")
+		}
+		label := Label{Level: string(level)}
+
+		compartments := v.Get(ast.StringTerm("compartments"))
+		if compartments == nil {
+			return label, nil
+		}
+		var err error
+		collect := func(t *ast.Term) {
+			if s, ok := t.Value.(ast.String); ok {
+				label.Compartments = append(label.Compartments, string(s))
+			} else {
+				err = fmt.Errorf("compartments must be strings, got %s", ast.ValueName(t.Value))
+			}
+		}
+		switch c := compartments.Value.(type) {
+		case *ast.Array:
+			c.Foreach(collect)
+		case ast.Set:
+			c.Foreach(collect)
+		case ast.Null:
+		default:
+			return Label{}, fmt.Errorf("compartments must be an array or set, got %s", ast.ValueName(c))
+		}
+		return label, err
+	default:
+		return Label{}, fmt.Errorf("label must be a string or an object, got %s", ast.ValueName(value))
+	}
+}
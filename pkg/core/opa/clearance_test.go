@@ -0,0 +1,103 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const clearancePolicy = `package authz
+default allow = false
+allow {
+	clearance.dominates(input.clearance, input.classification)
+}
+`
+
+func TestLatticeDominates(t *testing.T) {
+	lattice, err := NewLattice([]string{"LOW", "MODERATE", "HIGH"}, []string{"CRYPTO", "NUCLEAR"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		a    Label
+		b    Label
+		want bool
+	}{
+		{"higher level", Label{Level: "HIGH"}, Label{Level: "LOW"}, true},
+		{"same level", Label{Level: "MODERATE"}, Label{Level: "MODERATE"}, true},
+		{"lower level", Label{Level: "LOW"}, Label{Level: "HIGH"}, false},
+		{"superset of compartments", Label{Level: "HIGH", Compartments: []string{"CRYPTO", "NUCLEAR"}}, Label{Level: "MODERATE", Compartments: []string{"CRYPTO"}}, true},
+		{"missing compartment", Label{Level: "HIGH", Compartments: []string{"CRYPTO"}}, Label{Level: "MODERATE", Compartments: []string{"NUCLEAR"}}, false},
+		{"no compartments", Label{Level: "HIGH"}, Label{Level: "LOW", Compartments: []string{"CRYPTO"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lattice.Dominates(tt.a, tt.b)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = lattice.Dominates(Label{Level: "SECRET"}, Label{Level: "LOW"})
+	assert.ErrorContains(t, err, "unknown classification level 'SECRET'")
+	_, err = lattice.Dominates(Label{Level: "HIGH"}, Label{Level: "LOW", Compartments: []string{"SIGINT"}})
+	assert.ErrorContains(t, err, "unknown compartment 'SIGINT'")
+}
+
+func TestNewLatticeInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		levels       []string
+		compartments []string
+	}{
+		{nil, []string{"CRYPTO"}},
+		{[]string{"LOW", ""}, nil},
+		{[]string{"LOW", "LOW"}, nil},
+		{[]string{"LOW"}, []string{"CRYPTO", "CRYPTO"}},
+	} {
+		_, err := NewLattice(tt.levels, tt.compartments)
+		assert.Error(t, err, "%v %v", tt.levels, tt.compartments)
+	}
+}
+
+func TestDominatesBuiltin(t *testing.T) {
+	lattice, err := NewLattice([]string{"LOW", "MODERATE", "HIGH"}, []string{"CRYPTO"})
+	require.NoError(t, err)
+	policy, err := NewCompiler(WithBuiltins(lattice.Builtin())).Compile("clearance", Modules{"policy.rego": clearancePolicy})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		clearance      interface{}
+		classification interface{}
+		want           bool
+	}{
+		{"levels", "HIGH", "MODERATE", true},
+		{"labels", map[string]interface{}{"level": "HIGH", "compartments": []interface{}{"CRYPTO"}}, map[string]interface{}{"level": "LOW", "compartments": []interface{}{"CRYPTO"}}, true},
+		{"level and label", "HIGH", map[string]interface{}{"level": "LOW", "compartments": []interface{}{"CRYPTO"}}, false},
+		{"null compartments", map[string]interface{}{"level": "LOW", "compartments": nil}, "LOW", true},
+		{"unknown level", "SECRET", "LOW", false},
+		{"missing level", map[string]interface{}{"compartments": []interface{}{"CRYPTO"}}, "LOW", false},
+		{"invalid compartment", "HIGH", map[string]interface{}{"level": "LOW", "compartments": []interface{}{1}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, perr := policy.Evaluate(context.Background(), "x = data.authz.allow", map[string]interface{}{"clearance": tt.clearance, "classification": tt.classification})
+			require.Nil(t, perr)
+			assert.Equal(t, tt.want, result.Bindings["x"])
+		})
+	}
+}
+
+func TestDominatesDeclaration(t *testing.T) {
+	decl := DominatesDeclaration()
+	assert.Equal(t, DominatesBuiltin, decl.Name)
+	assert.False(t, decl.Nondeterministic)
+}
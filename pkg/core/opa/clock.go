@@ -0,0 +1,82 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/manetu/policyengine/pkg/core/risk"
+	"github.com/open-policy-agent/opa/v1/ast"
+)
+
+// ClockReads records whether the policies evaluated with a context read the current time
+// through time.now_ns, such as to grant access only within a time window, or call a custom
+// built-in declared nondeterministic, such as one querying an external store, or read the
+// business calendar or risk score the engine adds to their input. Their decisions may then
+// change without any change to the request. Attach a ClockReads to the evaluation context
+// with [WithClockReads].
+//
+// A ClockReads is safe for concurrent use.
+type ClockReads struct {
+	read atomic.Bool
+}
+
+type clockReadsKey struct{}
+
+// WithClockReads returns a context that records in reads whether evaluations using it read
+// the current time.
+func WithClockReads(ctx context.Context, reads *ClockReads) context.Context {
+	return context.WithValue(ctx, clockReadsKey{}, reads)
+}
+
+// Read reports whether any policy evaluated so far reads the current time.
+func (c *ClockReads) Read() bool {
+	return c.read.Load()
+}
+
+func recordClockRead(ctx context.Context) {
+	if ctx == nil {
+		return
+	}
+	if c, ok := ctx.Value(clockReadsKey{}).(*ClockReads); ok {
+		c.read.Store(true)
+	}
+}
+
+// volatileInputs are the parts of the input the engine derives from the time of the request,
+// or its risk at that time
+var volatileInputs = []ast.Ref{
+	ast.InputRootRef.Append(ast.StringTerm(CalendarInput)),
+	ast.InputRootRef.Append(ast.StringTerm("context")).Append(ast.StringTerm(risk.ContextKey)),
+}
+
+// readsClock reports whether any compiled module calls time.now_ns or one of the
+// nondeterministic built-ins, or refers to the calendar or risk score given in the input
+func readsClock(compiler *ast.Compiler, builtins []*Builtin) bool {
+	refs := []ast.Ref{ast.NowNanos.Ref()}
+	for _, b := range builtins {
+		if b.Decl.Nondeterministic {
+			refs = append(refs, ast.MustParseRef(b.Decl.Name))
+		}
+	}
+
+	found := false
+	for _, m := range compiler.Modules {
+		ast.WalkRefs(m, func(r ast.Ref) bool {
+			for _, ref := range refs {
+				found = found || r.Equal(ref)
+			}
+			for _, input := range volatileInputs {
+				found = found || r.HasPrefix(input)
+			}
+			return found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
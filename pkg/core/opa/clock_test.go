@@ -0,0 +1,48 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockReads(t *testing.T) {
+	compiler := NewCompiler()
+
+	tests := []struct {
+		name    string
+		modules Modules
+		reads   bool
+	}{
+		{"no clock", Modules{"p.rego": "package authz\ndefault allow = false\nallow { input.user == \"admin\" }"}, false},
+		{"time window", Modules{"p.rego": "package authz\ndefault allow = false\nallow { [h, _, _] := time.clock(time.now_ns()); h >= 9 }"}, true},
+		{"in a library", Modules{
+			"p.rego":   "package authz\nimport data.hours\ndefault allow = false\nallow { hours.open }",
+			"lib.rego": "package hours\nopen { time.now_ns() > 0 }",
+		}, true},
+		{"calendar input", Modules{"p.rego": "package authz\ndefault allow = false\nallow { input.calendar.business_hours }"}, true},
+		{"risk score", Modules{"p.rego": "package authz\ndefault allow = false\nallow { input.context.risk <= 70 }"}, true},
+		{"other context", Modules{"p.rego": "package authz\ndefault allow = false\nallow { input.context.ip == \"10.0.0.1\" }"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := compiler.Compile(tt.name, tt.modules)
+			require.NoError(t, err)
+
+			reads := &ClockReads{}
+			_, perr := p.Evaluate(WithClockReads(context.Background(), reads), "x = data.authz.allow", map[string]interface{}{})
+			require.Nil(t, perr)
+			assert.Equal(t, tt.reads, reads.Read())
+
+			// evaluations without a ClockReads are unaffected
+			_, perr = p.Evaluate(context.Background(), "x = data.authz.allow", map[string]interface{}{})
+			require.Nil(t, perr)
+		})
+	}
+}
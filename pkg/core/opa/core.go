@@ -30,32 +30,68 @@
 //	    // Access allowed
 //	}
 //
+// Static documents can be made available to the policy under data with
+// [Compiler.CompileWithData].
+//
+// Each query is prepared once per [Ast] and reused by later evaluations. Call
+// [Ast.Prepare] to prepare a query ahead of the first evaluation.
+//
+// Identical compilations by compilers of the same configuration share a single
+// [Ast] for as long as any of them is in use, so engines loading the same policy
+// domains, such as one per tenant or test, do not each hold a compiled copy.
+//
 // # Compiler Options
 //
 // Various options control compilation behavior:
 //   - [WithRegoVersion]: Set Rego language version (V0 or V1)
 //   - [WithCapabilities]: Configure OPA capabilities
 //   - [WithUnsafeBuiltins]: Disable specific built-in functions
+//   - [WithBuiltins]: Register custom built-in functions
 //   - [WithDefaultTracing]: Enable evaluation tracing
+//
+// # External Data
+//
+// A [Fetcher] implements the policyengine.fetch built-in, which lets policies
+// read allowlisted URLs without enabling http.send. Calls are recorded in the
+// [FetchLog] attached to the evaluation context with [WithFetchLog].
+//
+// Policies that call time.now_ns are reported to the [ClockReads] attached to
+// the evaluation context with [WithClockReads], as their decisions depend on
+// when they are made.
+//
+// # Security Labels
+//
+// A [Lattice] implements the clearance.dominates built-in, which compares
+// security labels against a domain's ordered classification levels and
+// compartments.
 package opa
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/manetu/policyengine/internal/logging"
 	"github.com/manetu/policyengine/pkg/common"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
-	"github.com/mohae/deepcopy"
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/util"
 )
 
 var logger = logging.GetLogger("opa")
 var agent = "opa"
 
+// printHook logs the output of print() statements in policies
+var printHook = logging.NewOPALogger(logger)
+
 // Builtins is a set of Rego built-in function names.
 //
 // Used with [WithUnsafeBuiltins] to specify which built-in functions should
@@ -65,6 +101,40 @@ var agent = "opa"
 //	compiler := opa.NewCompiler(opa.WithUnsafeBuiltins(unsafe))
 type Builtins map[string]struct{}
 
+// Builtin is a custom Rego built-in function supplied by the embedding application.
+//
+// Decl declares the function's name and type signature, which the compiler uses
+// to type-check calls. Impl is invoked with the evaluated arguments whenever a
+// policy calls the function. Register built-ins with [WithBuiltins]:
+//
+//	parse := &opa.Builtin{
+//	    Decl: &rego.Function{
+//	        Name: "mrn.parse",
+//	        Decl: types.NewFunction(types.Args(types.S), types.A),
+//	    },
+//	    Impl: func(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+//	        ...
+//	    },
+//	}
+//	compiler := opa.NewCompiler(opa.WithBuiltins(parse))
+type Builtin struct {
+	Decl *rego.Function
+	Impl rego.BuiltinDyn
+}
+
+// Declaration returns the capability declaration for the built-in.
+//
+// Declarations allow tooling that compiles Rego without evaluating it, such as
+// lint, to accept calls to the built-in.
+func (b *Builtin) Declaration() *ast.Builtin {
+	return &ast.Builtin{
+		Name:             b.Decl.Name,
+		Description:      b.Decl.Description,
+		Decl:             b.Decl.Decl,
+		Nondeterministic: b.Decl.Nondeterministic,
+	}
+}
+
 // Compiler compiles Rego source code into executable AST objects.
 //
 // Compiler handles the parsing and compilation of Rego policies with
@@ -81,6 +151,9 @@ type Builtins map[string]struct{}
 //	})
 type Compiler struct {
 	options *CompilerOptions
+
+	once sync.Once
+	sum  []byte // fingerprint of the options
 }
 
 // Ast represents a compiled Rego policy ready for evaluation.
@@ -88,11 +161,19 @@ type Compiler struct {
 // Ast contains the compiled OPA abstract syntax tree along with
 // configuration for evaluation (such as tracing). Use [Evaluate]
 // to execute queries against the compiled policy.
+//
+// Ast is safe for concurrent use.
 type Ast struct {
 	name        string
 	compiler    *ast.Compiler
 	trace       bool
 	traceFilter []*regexp.Regexp
+	builtins    []*Builtin
+	print       bool
+	store       storage.Store // data documents, or nil
+	prepared    sync.Map      // query string -> *rego.PreparedEvalQuery
+	candidates  sync.Map      // query and ref -> []string, see Candidates
+	clock       bool          // the policy reads the current time
 }
 
 // Modules maps module names to their Rego source code.
@@ -106,6 +187,15 @@ type Ast struct {
 //	}
 type Modules map[string]string
 
+// Data maps the names of static documents to their values.
+//
+// Each document is available to policies under data.<name>:
+//
+//	data := opa.Data{
+//	    "countries": []interface{}{"CA", "US"},
+//	}
+type Data map[string]interface{}
+
 // CompilerOptions holds configuration for the Rego compiler.
 //
 // Use functional options like [WithRegoVersion] and [WithCapabilities]
@@ -115,6 +205,8 @@ type CompilerOptions struct {
 	capabilities *ast.Capabilities
 	trace        bool
 	traceFilter  []*regexp.Regexp
+	builtins     []*Builtin
+	print        bool
 }
 
 func filter[T any](ss []T, test func(T) bool) (ret []T) {
@@ -177,7 +269,24 @@ func WithDefaultCapabilities() CompilerOptionFunc {
 func WithUnsafeBuiltins(unsafeBuiltins Builtins) CompilerOptionFunc {
 	return func(o *CompilerOptions) {
 		// see: https://github.com/open-policy-agent/opa/security/advisories/GHSA-f524-rf33-2jjr
-		o.capabilities.Builtins = filter(o.capabilities.Builtins, func(builtin *ast.Builtin) bool { _, ok := unsafeBuiltins[builtin.Name]; return !ok })
+		// filter a copy, as the capabilities may be shared by compilers created concurrently
+		capabilities := *o.capabilities
+		capabilities.Builtins = filter(capabilities.Builtins, func(builtin *ast.Builtin) bool { _, ok := unsafeBuiltins[builtin.Name]; return !ok })
+		o.capabilities = &capabilities
+	}
+}
+
+// WithBuiltins registers custom built-in functions with the compiler.
+//
+// Registered built-ins are kept separately from the capabilities, so they remain
+// available after [WithCapabilities], [WithDefaultCapabilities], or
+// [WithUnsafeBuiltins] and are inherited by compilers created with [Compiler.Clone].
+// Calling WithBuiltins more than once adds to the registered set; a built-in
+// replaces any earlier registration with the same name, including a standard
+// OPA built-in.
+func WithBuiltins(builtins ...*Builtin) CompilerOptionFunc {
+	return func(o *CompilerOptions) {
+		o.builtins = append(o.builtins, builtins...)
 	}
 }
 
@@ -194,6 +303,19 @@ func WithDefaultTracing(trace bool) CompilerOptionFunc {
 	}
 }
 
+// WithPrintStatements enables or disables the print() statements of policies.
+//
+// When enabled, the output of print() statements is logged at debug level with the
+// fields of the decision that evaluated them, such as its record ID. When disabled,
+// print() statements are removed during compilation and cost nothing.
+//
+// Defaults to whether debug logging is enabled for the "opa" module.
+func WithPrintStatements(enabled bool) CompilerOptionFunc {
+	return func(o *CompilerOptions) {
+		o.print = enabled
+	}
+}
+
 // WithTraceFilter sets regex patterns for filtering which policies produce trace output.
 //
 // When tracing is enabled, only policies whose MRN matches at least one of the
@@ -244,6 +366,7 @@ func NewCompiler(options ...CompilerOptionFunc) *Compiler {
 		regoVersion:  ast.RegoV0,
 		capabilities: ast.CapabilitiesForThisVersion(),
 		trace:        logger.IsTraceEnabled(),
+		print:        logger.IsDebugEnabled(),
 	}
 	for _, o := range options {
 		o(opts)
@@ -259,11 +382,17 @@ func NewCompiler(options ...CompilerOptionFunc) *Compiler {
 // creating variant compilers, such as one for policies with restricted
 // capabilities and another for mappers with full capabilities.
 func (c *Compiler) Clone(options ...CompilerOptionFunc) *Compiler {
+	// options replace the capabilities' fields rather than modify the values they refer to, so
+	// a shallow copy suffices; a deep copy would lose the type declarations of the built-ins
+	capabilities := *c.options.capabilities
+	capabilities.Builtins = slices.Clone(capabilities.Builtins)
+
 	opts := &CompilerOptions{
 		regoVersion:  c.options.regoVersion,
-		capabilities: deepcopy.Copy(c.options.capabilities).(*ast.Capabilities),
+		capabilities: &capabilities,
 		trace:        c.options.trace,
 		traceFilter:  c.options.traceFilter,
+		builtins:     c.options.builtins,
 	}
 	for _, o := range options {
 		o(opts)
@@ -281,6 +410,28 @@ func (c *Compiler) Clone(options ...CompilerOptionFunc) *Compiler {
 // Returns an error if any module fails to parse or if compilation fails
 // (e.g., due to undefined references or type errors).
 func (c *Compiler) Compile(name string, modules Modules) (*Ast, error) {
+	return c.CompileWithData(name, modules, nil)
+}
+
+// CompileWithData is like [Compiler.Compile], but also loads the given documents
+// into the data tree seen by every evaluation of the resulting [Ast].
+//
+// Returns an error if a document cannot be represented as JSON or if its name is
+// also the first segment of a module's package, as the two would overlap.
+//
+// Compilations are shared across the process: compiling the same name, modules,
+// and data with a compiler of the same configuration, including from another
+// engine, returns the same immutable [Ast] rather than a copy, and concurrent
+// compilations of the same policy compile it once.
+func (c *Compiler) CompileWithData(name string, modules Modules, data Data) (*Ast, error) {
+	key, ok := c.astKey(name, modules, data)
+	if !ok {
+		return c.compile(name, modules, data)
+	}
+	return shared(key, func() (*Ast, error) { return c.compile(name, modules, data) })
+}
+
+func (c *Compiler) compile(name string, modules Modules, data Data) (*Ast, error) {
 	parsed := make(map[string]*ast.Module, len(modules))
 
 	for f, module := range modules {
@@ -289,10 +440,31 @@ func (c *Compiler) Compile(name string, modules Modules) (*Ast, error) {
 		if pm, err = ast.ParseModuleWithOpts(f, module, ast.ParserOptions{RegoVersion: c.options.regoVersion}); err != nil {
 			return nil, err
 		}
+		if root, ok := pm.Package.Path[1].Value.(ast.String); ok {
+			if _, conflict := data[string(root)]; conflict {
+				return nil, fmt.Errorf("data document '%s' conflicts with package %s of module %s", string(root), pm.Package.Path, f)
+			}
+		}
 		parsed[f] = pm
 	}
 
-	compiler := ast.NewCompiler().WithCapabilities(c.options.capabilities)
+	var store storage.Store
+	if len(data) > 0 {
+		var documents interface{} = map[string]interface{}(data)
+		if err := util.RoundTrip(&documents); err != nil {
+			return nil, fmt.Errorf("invalid data document: %w", err)
+		}
+		store = inmem.NewFromObject(documents.(map[string]interface{}))
+	}
+
+	compiler := ast.NewCompiler().WithCapabilities(c.options.capabilities).WithEnablePrintStatements(c.options.print)
+	if len(c.options.builtins) > 0 {
+		decls := make(map[string]*ast.Builtin, len(c.options.builtins))
+		for _, b := range c.options.builtins {
+			decls[b.Decl.Name] = b.Declaration()
+		}
+		compiler = compiler.WithBuiltins(decls)
+	}
 
 	compiler.Compile(parsed)
 
@@ -305,6 +477,10 @@ func (c *Compiler) Compile(name string, modules Modules) (*Ast, error) {
 		compiler:    compiler,
 		trace:       c.options.trace,
 		traceFilter: c.options.traceFilter,
+		builtins:    c.options.builtins,
+		print:       c.options.print,
+		store:       store,
+		clock:       readsClock(compiler, c.options.builtins),
 	}, nil
 }
 
@@ -314,9 +490,17 @@ func (c *Compiler) Compile(name string, modules Modules) (*Ast, error) {
 // If tracing is enabled and no filter is set, returns true.
 // If tracing is enabled and a filter is set, returns true only if the
 // AST's name matches at least one of the filter patterns.
+//
+// A trace mode set at runtime with logging.SetTraceMode takes precedence over p.trace.
 func (p *Ast) shouldTrace() bool {
-	if !p.trace {
+	switch logging.GetTraceMode() {
+	case logging.TraceOn:
+	case logging.TraceOff:
 		return false
+	default:
+		if !p.trace {
+			return false
+		}
 	}
 	if len(p.traceFilter) == 0 {
 		return true
@@ -334,7 +518,8 @@ func (p *Ast) shouldTrace() bool {
 // Use functional options like [WithTrace] when calling [Ast.Evaluate]
 // rather than creating this struct directly.
 type EvalOptions struct {
-	trace bool
+	trace   bool
+	tracers []topdown.QueryTracer
 }
 
 // EvalOptionFunc is a functional option for configuring policy evaluation.
@@ -350,12 +535,73 @@ func WithTrace(trace bool) EvalOptionFunc {
 	}
 }
 
+// WithQueryTracer adds a tracer notified of each step of a single evaluation, such as
+// OPA's profiler. Unlike [WithTrace], it does not print the trace.
+func WithQueryTracer(tracer topdown.QueryTracer) EvalOptionFunc {
+	return func(o *EvalOptions) {
+		o.tracers = append(o.tracers, tracer)
+	}
+}
+
+// Prepare compiles a query against the policy so that it is ready for [Ast.Evaluate].
+//
+// Evaluate prepares each query on first use and reuses it afterwards, so calling
+// Prepare is optional. Backends call it while loading policies to move the cost of
+// preparation, and any query errors, out of the first authorization request.
+// Preparing a query more than once has no effect.
+func (p *Ast) Prepare(ctx context.Context, queryStr string) error {
+	_, err := p.prepare(ctx, queryStr)
+	return err
+}
+
+func (p *Ast) prepare(ctx context.Context, queryStr string) (*rego.PreparedEvalQuery, error) {
+	if pq, ok := p.prepared.Load(queryStr); ok {
+		return pq.(*rego.PreparedEvalQuery), nil
+	}
+
+	options := []func(*rego.Rego){
+		rego.Query(queryStr),
+		rego.Compiler(p.compiler),
+	}
+	for _, b := range p.builtins {
+		options = append(options, rego.FunctionDyn(b.Decl, b.Impl))
+	}
+	if p.store != nil {
+		options = append(options, rego.Store(p.store))
+	}
+	if p.print {
+		options = append(options, rego.EnablePrintStatements(true), rego.PrintHook(printHook))
+	}
+
+	pq, err := rego.New(options...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent callers may race to prepare the same query; keep the first
+	actual, _ := p.prepared.LoadOrStore(queryStr, &pq)
+	return actual.(*rego.PreparedEvalQuery), nil
+}
+
+// evalCause returns the cause of an evaluation error. OPA reports a cancelled
+// evaluation with an error of its own, so the context's error is included to let
+// callers recognize timeouts with errors.Is.
+func evalCause(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return errors.Join(ctxErr, err)
+	}
+	return err
+}
+
 // Evaluate executes a query against the compiled policy AST.
 //
 // The queryStr specifies the Rego query to evaluate, typically binding a
 // variable to a policy rule (e.g., "x = data.authz.allow"). The input
 // provides the data available to the policy via the input document.
 //
+// The query is prepared on first use (see [Ast.Prepare]) and reused by
+// subsequent evaluations.
+//
 // Returns the first result from the query, which includes variable bindings.
 // Returns a [common.PolicyError] if evaluation fails or produces no results.
 //
@@ -367,38 +613,85 @@ func WithTrace(trace bool) EvalOptionFunc {
 //	}
 //	allowed := result.Bindings["x"].(bool)
 func (p *Ast) Evaluate(ctx context.Context, queryStr string, input interface{}, options ...EvalOptionFunc) (rego.Result, *common.PolicyError) {
-	logger.Debug(agent, "Evaluate", "Enter")
-	defer logger.Debug(agent, "Evaluate", "Exit")
+	log := logger.WithContext(ctx)
+
+	log.Debug(agent, "Evaluate", "Enter")
+	defer log.Debug(agent, "Evaluate", "Exit")
 
-	logger.Debugf(agent, "Evaluate", "input to rego: %+v", input)
+	log.Debugf(agent, "Evaluate", "input to rego: %+v", input)
 
 	opts := &EvalOptions{trace: p.shouldTrace()}
 	for _, o := range options {
 		o(opts)
 	}
 
-	// Build the query, then evaluate and deal with the results.
-	query := rego.New(
-		rego.Query(queryStr),
-		rego.Compiler(p.compiler),
-		rego.Input(input),
-		rego.Trace(opts.trace),
-	)
+	if p.clock {
+		recordClockRead(ctx)
+	}
+
+	query, err := p.prepare(ctx, queryStr)
+	if err != nil {
+		log.Debugf(agent, "Evaluate", "queryPrepare %+v", err)
+		return rego.Result{}, common.WrapError(events.AccessRecord_BundleReference_EVALUATION_ERROR, err.Error(), evalCause(ctx, err))
+	}
 
-	results, err := query.Eval(ctx)
+	evalOptions := []rego.EvalOption{rego.EvalInput(input)}
+
+	// a trace is collected as events for the TraceLog of the context, if any, and is
+	// otherwise printed once the evaluation completes
+	var tracer *topdown.BufferTracer
+	var collector *eventTracer
+	traceLog := traceLogFrom(ctx)
+	switch {
+	case opts.trace && traceLog != nil:
+		collector = newEventTracer()
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(collector))
+	case opts.trace:
+		tracer = topdown.NewBufferTracer()
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(tracer))
+	}
+
+	for _, t := range opts.tracers {
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(t))
+	}
+
+	debugger := debuggerFrom(ctx)
+	if debugger != nil {
+		if t := debugger.Begin(p.name, queryStr, input); t != nil {
+			evalOptions = append(evalOptions, rego.EvalQueryTracer(t))
+		}
+	}
+
+	results, err := query.Eval(ctx, evalOptions...)
+	if debugger != nil {
+		var bindings map[string]interface{}
+		if err == nil && len(results) > 0 {
+			bindings = results[0].Bindings
+		}
+		debugger.End(p.name, bindings, err)
+	}
+	if collector != nil {
+		trace := &PolicyTrace{Policy: p.name, Query: queryStr, Events: collector.events}
+		if err != nil {
+			trace.Error = err.Error()
+		} else if len(results) > 0 {
+			trace.Bindings = results[0].Bindings
+		}
+		traceLog.add(trace)
+	}
 	if err != nil {
-		logger.Debugf(agent, "Evaluate", "queryEval %+v", err)
-		return rego.Result{}, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_EVALUATION_ERROR, Reason: err.Error()}
+		log.Debugf(agent, "Evaluate", "queryEval %+v", err)
+		return rego.Result{}, common.WrapError(events.AccessRecord_BundleReference_EVALUATION_ERROR, err.Error(), evalCause(ctx, err))
 	} else if len(results) == 0 { // no results
-		logger.Debugf(agent, "Evaluate", "no opa results: %s, input: %+v", p.name, input)
+		log.Debugf(agent, "Evaluate", "no opa results: %s, input: %+v", p.name, input)
 		return rego.Result{}, &common.PolicyError{ReasonCode: events.AccessRecord_BundleReference_EVALUATION_ERROR, Reason: fmt.Sprintf("no opa results: %s, input: %+v", p.name, input)}
 	}
-	if opts.trace {
+	if tracer != nil {
 		regoTrace := new(strings.Builder)
-		rego.PrintTraceWithLocation(regoTrace, query)
-		logger.Trace(agent, "Evaluate", "rego trace:")
+		topdown.PrettyTraceWithLocation(regoTrace, *tracer)
+		log.Trace(agent, "Evaluate", "rego trace:")
 		fmt.Println(regoTrace.String()) // force internal format
-		logger.Trace(agent, "Evaluate", "query results:")
+		log.Trace(agent, "Evaluate", "query results:")
 		common.PrettyPrint(results)
 	}
 
@@ -6,14 +6,24 @@ package opa
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/common"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 
 	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/profiler"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewCompiler(t *testing.T) {
@@ -104,6 +114,13 @@ allow = true {
 	assert.Nil(t, ast3)
 	assert.Contains(t, err3.Error(), "undefined function http.send")
 
+	// the clone keeps the type declarations of the remaining built-ins
+	_, err = compiler3.Compile("typed-policy", Modules{"typed.rego": `
+package authz
+allow { sprintf("%s", [input.user]) == "admin" }
+`})
+	assert.NoError(t, err)
+
 	// Now Clone again, but override the builtins so that http.send is now allowed
 	compiler4 := compiler.Clone(WithDefaultCapabilities())
 	ast4, err4 := compiler4.Compile("test-policy", modules)
@@ -192,6 +209,29 @@ allow = true {
 	assert.Equal(t, events.AccessRecord_BundleReference_EVALUATION_ERROR, policyErr.ReasonCode)
 }
 
+func TestEvaluateTimeout(t *testing.T) {
+	compiler := NewCompiler()
+
+	// slow enough that evaluation is cancelled rather than completing
+	ast, err := compiler.Compile("test-policy", Modules{
+		"test.rego": `
+package authz
+default allow = false
+allow = true { count([x | x := numbers.range(1, 100000000)[_]]) == 0 }
+`,
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	_, policyErr := ast.Evaluate(ctx, "x = data.authz.allow", nil)
+	require.NotNil(t, policyErr)
+	assert.ErrorIs(t, policyErr, common.ErrEvaluation)
+	assert.ErrorIs(t, policyErr, common.ErrTimeout)
+}
+
 func TestEvaluateWithComplexInput(t *testing.T) {
 	compiler := NewCompiler()
 
@@ -291,6 +331,123 @@ allow = 2 { input.action == "visitor" }
 	}
 }
 
+func mrnClassBuiltin() *Builtin {
+	return &Builtin{
+		Decl: &rego.Function{
+			Name: "mrn.class",
+			Decl: types.NewFunction(types.Args(types.S), types.S),
+		},
+		Impl: func(_ rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+			s, ok := args[0].Value.(ast.String)
+			if !ok {
+				return nil, nil
+			}
+			parts := strings.Split(string(s), ":")
+			if len(parts) < 3 {
+				return nil, nil
+			}
+			return ast.StringTerm(parts[2]), nil
+		},
+	}
+}
+
+func TestCompileWithBuiltins(t *testing.T) {
+	modules := Modules{
+		"test.rego": `
+package authz
+allow = true { mrn.class(input.resource) == "document" }
+`,
+	}
+	input := map[string]interface{}{"resource": "mrn:app:document:1"}
+
+	// Without the built-in the module refers to an undefined function
+	_, err := NewCompiler().Compile("test-policy", modules)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined function mrn.class")
+
+	compiler := NewCompiler(WithUnsafeBuiltins(Builtins{"http.send": {}}), WithBuiltins(mrnClassBuiltin()))
+	a, err := compiler.Compile("test-policy", modules)
+	require.NoError(t, err)
+
+	result, perr := a.Evaluate(context.Background(), "x = data.authz.allow", input)
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+
+	// Clones, including those that reset the capabilities, keep the built-in
+	mapper := compiler.Clone(WithDefaultCapabilities())
+	a, err = mapper.Compile("test-mapper", modules)
+	require.NoError(t, err)
+
+	result, perr = a.Evaluate(context.Background(), "x = data.authz.allow", input)
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+
+	// Type declarations are enforced at compile time
+	_, err = compiler.Compile("test-policy", Modules{
+		"test.rego": `
+package authz
+allow = true { mrn.class(42) == "document" }
+`,
+	})
+	assert.Error(t, err)
+}
+
+func TestBuiltinDeclaration(t *testing.T) {
+	decl := mrnClassBuiltin().Declaration()
+	assert.Equal(t, "mrn.class", decl.Name)
+	assert.Equal(t, types.NewFunction(types.Args(types.S), types.S), decl.Decl)
+}
+
+func TestCompileWithData(t *testing.T) {
+	modules := Modules{
+		"test.rego": `
+package authz
+default allow = false
+allow { input.country == data.countries[_]; data.levels[input.level] >= 1 }
+`,
+	}
+	data := Data{
+		"countries": []interface{}{"CA", "US"},
+		"levels":    map[string]interface{}{"public": 0, "secret": 2},
+	}
+
+	a, err := NewCompiler().CompileWithData("test-policy", modules, data)
+	require.NoError(t, err)
+
+	tests := []struct {
+		input  map[string]interface{}
+		result bool
+	}{
+		{map[string]interface{}{"country": "CA", "level": "secret"}, true},
+		{map[string]interface{}{"country": "MX", "level": "secret"}, false},
+		{map[string]interface{}{"country": "US", "level": "public"}, false},
+	}
+	for _, tt := range tests {
+		result, perr := a.Evaluate(context.Background(), "x = data.authz.allow", tt.input)
+		require.Nil(t, perr)
+		assert.Equal(t, tt.result, result.Bindings["x"], "input %v", tt.input)
+	}
+
+	// without data the documents are undefined
+	a, err = NewCompiler().Compile("test-policy", modules)
+	require.NoError(t, err)
+	result, perr := a.Evaluate(context.Background(), "x = data.authz.allow", tests[0].input)
+	require.Nil(t, perr)
+	assert.Equal(t, false, result.Bindings["x"])
+}
+
+func TestCompileWithDataConflicts(t *testing.T) {
+	modules := Modules{"test.rego": "package authz\ndefault allow = true\n"}
+
+	_, err := NewCompiler().CompileWithData("test-policy", modules, Data{"authz": map[string]interface{}{"allow": false}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data document 'authz' conflicts with package data.authz")
+
+	_, err = NewCompiler().CompileWithData("test-policy", modules, Data{"invalid": make(chan int)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid data document")
+}
+
 func TestWithRegoVersion(t *testing.T) {
 	compiler := NewCompiler(WithRegoVersion(ast.RegoV1))
 	assert.NotNil(t, compiler)
@@ -375,6 +532,52 @@ allow = true { input.user == "admin" }
 		assert.Contains(t, output, "Enter data.authz.allow")
 	})
 
+	t.Run("as runtime trace mode", func(t *testing.T) {
+		defer func() { _ = logging.SetTraceMode(logging.TraceDefault) }()
+
+		untraced, err := NewCompiler().Compile("test-policy", modules)
+		assert.NoError(t, err)
+		traced, err := NewCompiler(WithDefaultTracing(true)).Compile("test-policy", modules)
+		assert.NoError(t, err)
+
+		evaluate := func(instance *Ast) string {
+			return captureStdout(func() {
+				_, policyErr := instance.Evaluate(context.Background(), "data.authz.allow", input)
+				assert.Nil(t, policyErr)
+			})
+		}
+
+		assert.NoError(t, logging.SetTraceMode(logging.TraceOn))
+		assert.Contains(t, evaluate(untraced), "Enter data.authz.allow")
+
+		assert.NoError(t, logging.SetTraceMode(logging.TraceOff))
+		assert.Equal(t, "", evaluate(traced))
+
+		assert.NoError(t, logging.SetTraceMode(logging.TraceDefault))
+		assert.Contains(t, evaluate(traced), "Enter data.authz.allow")
+		assert.Equal(t, "", evaluate(untraced))
+	})
+}
+
+func TestWithQueryTracer(t *testing.T) {
+	instance, err := NewCompiler().Compile("test-policy", Modules{"test.rego": "package authz\ndefault allow = false\nallow { input.user == \"admin\" }\n"})
+	require.NoError(t, err)
+
+	p := profiler.New()
+	output := captureStdout(func() {
+		result, policyErr := instance.Evaluate(context.Background(), "x = data.authz.allow", map[string]interface{}{"user": "admin"}, WithQueryTracer(p))
+		assert.Nil(t, policyErr)
+		assert.Equal(t, true, result.Bindings["x"])
+	})
+	assert.Equal(t, "", output, "a query tracer does not print the trace")
+
+	rows := map[int]bool{}
+	for _, stat := range p.ReportTopNResults(-1, []string{"line"}) {
+		if stat.Location.File == "test.rego" {
+			rows[stat.Location.Row] = stat.NumEval > 0
+		}
+	}
+	assert.Equal(t, map[int]bool{3: true}, rows)
 }
 
 func TestCompileMultipleModules(t *testing.T) {
@@ -432,3 +635,179 @@ func TestFilterFunction(t *testing.T) {
 		assert.Equal(t, []string{"foo", "baz"}, result)
 	})
 }
+
+func TestPrepare(t *testing.T) {
+	compiler := NewCompiler()
+
+	ast, err := compiler.Compile("test-policy", Modules{
+		"test.rego": `
+package authz
+default allow = false
+allow = true { input.user == "admin" }
+`,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, ast.Prepare(context.Background(), "x = data.authz.allow"))
+	first, ok := ast.prepared.Load("x = data.authz.allow")
+	assert.True(t, ok)
+
+	// preparing again, or evaluating, reuses the prepared query
+	assert.NoError(t, ast.Prepare(context.Background(), "x = data.authz.allow"))
+	result, policyErr := ast.Evaluate(context.Background(), "x = data.authz.allow", map[string]interface{}{"user": "admin"})
+	assert.Nil(t, policyErr)
+	assert.Equal(t, true, result.Bindings["x"])
+
+	second, _ := ast.prepared.Load("x = data.authz.allow")
+	assert.Same(t, first, second)
+}
+
+func TestPrintStatements(t *testing.T) {
+	var buffer strings.Builder
+	logger.SetOut(&buffer)
+	logger.SetLevel(slog.LevelDebug)
+	defer func() {
+		logger.SetOut(os.Stderr)
+		logger.SetLevel(slog.LevelInfo)
+	}()
+
+	modules := Modules{"test.rego": `
+package authz
+allow = true { print("checking", input.user); input.user == "admin" }
+`}
+	ctx := logging.NewContext(context.Background(), logging.RecordID, "r1")
+
+	policy, err := NewCompiler(WithPrintStatements(true)).Compile("test-policy", modules)
+	require.NoError(t, err)
+	result, perr := policy.Evaluate(ctx, "x = data.authz.allow", map[string]interface{}{"user": "admin"})
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+
+	var printed map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["action"] == "print" {
+			printed = entry
+		}
+	}
+	require.NotNil(t, printed, "print() output is logged")
+	assert.Equal(t, "test.rego:3: checking admin", printed["msg"])
+	assert.Equal(t, "r1", printed[logging.RecordID])
+
+	// print() statements are removed unless enabled
+	buffer.Reset()
+	policy, err = NewCompiler(WithPrintStatements(false)).Compile("test-policy", modules)
+	require.NoError(t, err)
+	_, perr = policy.Evaluate(ctx, "x = data.authz.allow", map[string]interface{}{"user": "admin"})
+	require.Nil(t, perr)
+	assert.NotContains(t, buffer.String(), "checking")
+}
+
+func TestPrepareInvalidQuery(t *testing.T) {
+	compiler := NewCompiler()
+
+	ast, err := compiler.Compile("test-policy", Modules{
+		"test.rego": `
+package authz
+default allow = false
+`,
+	})
+	assert.NoError(t, err)
+
+	assert.Error(t, ast.Prepare(context.Background(), "x = data.authz.("))
+
+	_, policyErr := ast.Evaluate(context.Background(), "x = data.authz.(", nil)
+	assert.NotNil(t, policyErr)
+	assert.Equal(t, events.AccessRecord_BundleReference_EVALUATION_ERROR, policyErr.ReasonCode)
+
+	_, ok := ast.prepared.Load("x = data.authz.(")
+	assert.False(t, ok)
+}
+
+func TestEvaluateConcurrent(t *testing.T) {
+	compiler := NewCompiler()
+
+	ast, err := compiler.Compile("test-policy", Modules{
+		"test.rego": `
+package authz
+default allow = false
+allow = true { input.user == "admin" }
+`,
+	})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(admin bool) {
+			defer wg.Done()
+			user := "guest"
+			if admin {
+				user = "admin"
+			}
+			result, policyErr := ast.Evaluate(context.Background(), "x = data.authz.allow", map[string]interface{}{"user": user})
+			assert.Nil(t, policyErr)
+			assert.Equal(t, admin, result.Bindings["x"])
+		}(i%2 == 0)
+	}
+	wg.Wait()
+}
+
+const benchmarkPolicy = `
+package authz
+default allow = false
+allow = true { input.principal.sub == "admin" }
+allow = true { input.principal.mroles[_] == "mrn:iam:role:reader" }
+`
+
+var benchmarkInput = map[string]interface{}{
+	"principal": map[string]interface{}{
+		"sub":    "alice",
+		"mroles": []interface{}{"mrn:iam:role:reader"},
+	},
+	"operation": "documents:read",
+}
+
+func compileBenchmarkPolicy(b *testing.B) *Ast {
+	ast, err := NewCompiler().Compile("benchmark", Modules{"benchmark.rego": benchmarkPolicy})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ast
+}
+
+// BenchmarkEvaluate measures a decision using the query prepared when the policy was loaded
+func BenchmarkEvaluate(b *testing.B) {
+	ast := compileBenchmarkPolicy(b)
+	if err := ast.Prepare(context.Background(), "x = data.authz.allow"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, policyErr := ast.Evaluate(context.Background(), "x = data.authz.allow", benchmarkInput); policyErr != nil {
+			b.Fatal(policyErr)
+		}
+	}
+}
+
+// BenchmarkEvaluateUnprepared measures a decision that prepares its query on every call,
+// as a baseline for BenchmarkEvaluate
+func BenchmarkEvaluateUnprepared(b *testing.B) {
+	ast := compileBenchmarkPolicy(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query := rego.New(
+			rego.Query("x = data.authz.allow"),
+			rego.Compiler(ast.compiler),
+			rego.Input(benchmarkInput),
+		)
+		if _, err := query.Eval(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
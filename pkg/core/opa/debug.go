@@ -0,0 +1,44 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+
+	"github.com/open-policy-agent/opa/v1/topdown"
+)
+
+// Debugger follows the evaluation of the policies evaluated with a context, step by step,
+// such as to pause at breakpoints and inspect the variables bound so far. Attach a Debugger
+// to the evaluation context with [WithDebugger].
+//
+// Unlike tracing, a Debugger follows every policy evaluated, and is notified of each step as
+// it is taken rather than once the evaluation completes: the evaluation waits while
+// [topdown.QueryTracer.TraceEvent] is paused. A decision may evaluate several policies
+// concurrently, such as those of the roles of a principal, so a Debugger that pauses should
+// serialize the evaluations between Begin and End.
+type Debugger interface {
+	// Begin is called before a policy is evaluated, with its name, the query evaluated, and
+	// its input. It returns the tracer notified of each step, or nil to let the policy run.
+	Begin(policy, query string, input interface{}) topdown.QueryTracer
+	// End is called once the evaluation of a policy begun completes, with the variables bound
+	// by its first result, or the error that ended it.
+	End(policy string, bindings map[string]interface{}, err error)
+}
+
+type debuggerKey struct{}
+
+// WithDebugger returns a context whose evaluations are followed by debugger.
+func WithDebugger(ctx context.Context, debugger Debugger) context.Context {
+	return context.WithValue(ctx, debuggerKey{}, debugger)
+}
+
+func debuggerFrom(ctx context.Context) Debugger {
+	if ctx == nil {
+		return nil
+	}
+	debugger, _ := ctx.Value(debuggerKey{}).(Debugger)
+	return debugger
+}
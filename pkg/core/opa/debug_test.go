@@ -0,0 +1,69 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDebugger records the evaluations and steps it follows
+type recordingDebugger struct {
+	begun    []string
+	ended    map[string]interface{}
+	err      error
+	ops      []topdown.Op
+	untraced bool
+}
+
+func (d *recordingDebugger) Begin(policy, query string, input interface{}) topdown.QueryTracer {
+	d.begun = append(d.begun, policy+" "+query)
+	if d.untraced {
+		return nil
+	}
+	return d
+}
+
+func (d *recordingDebugger) End(_ string, bindings map[string]interface{}, err error) {
+	d.ended, d.err = bindings, err
+}
+
+func (d *recordingDebugger) Enabled() bool                { return true }
+func (d *recordingDebugger) Config() topdown.TraceConfig  { return topdown.TraceConfig{} }
+func (d *recordingDebugger) TraceEvent(evt topdown.Event) { d.ops = append(d.ops, evt.Op) }
+
+func TestWithDebugger(t *testing.T) {
+	modules := Modules{"test.rego": "package authz\ndefault allow = false\nallow { input.user == \"admin\" }\n"}
+	instance, err := NewCompiler().Compile("mrn:iam:policy:test", modules)
+	require.NoError(t, err)
+
+	d := &recordingDebugger{}
+	ctx := WithDebugger(context.Background(), d)
+	_, perr := instance.Evaluate(ctx, "x = data.authz.allow", map[string]interface{}{"user": "admin"})
+	require.Nil(t, perr)
+	assert.Equal(t, []string{"mrn:iam:policy:test x = data.authz.allow"}, d.begun)
+	assert.Equal(t, map[string]interface{}{"x": true}, d.ended)
+	assert.Contains(t, d.ops, topdown.EnterOp, "the debugger follows the steps of every policy, traced or not")
+
+	// a debugger may let a policy run without following its steps
+	d = &recordingDebugger{untraced: true}
+	_, perr = instance.Evaluate(WithDebugger(context.Background(), d), "x = data.authz.allow", nil)
+	require.Nil(t, perr)
+	assert.Len(t, d.begun, 1)
+	assert.Empty(t, d.ops)
+	assert.Equal(t, map[string]interface{}{"x": false}, d.ended)
+
+	// the error of an evaluation is reported to End
+	failing, err := NewCompiler().Compile("mrn:iam:policy:failing", Modules{"test.rego": "package authz\nallow = 1 { input.n }\nallow = 2 { input.n }\n"})
+	require.NoError(t, err)
+	d = &recordingDebugger{}
+	_, perr = failing.Evaluate(WithDebugger(context.Background(), d), "x = data.authz.allow", map[string]interface{}{"n": true})
+	require.NotNil(t, perr)
+	assert.Error(t, d.err)
+}
@@ -0,0 +1,58 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// EntrypointType returns the type that the compiler inferred for the document at ref, such
+// as data.authz.allow, which is [types.A] if it could not infer one.
+//
+// Returns an error if ref is not a rule of the compiled modules, such as when the package of
+// a policy is misspelled.
+func (p *Ast) EntrypointType(ref string) (types.Type, error) {
+	r, err := ast.ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.compiler.GetRulesExact(r)) == 0 {
+		return nil, fmt.Errorf("%s is not defined", ref)
+	}
+
+	t := p.compiler.TypeEnv.GetByRef(r)
+	if t == nil {
+		return types.A, nil
+	}
+	return t, nil
+}
+
+// Documents returns the sorted names of the documents that the compiled modules define
+// directly under ref, such as the rules porc and audit_context of package mapper for
+// data.mapper.
+func (p *Ast) Documents(ref string) ([]string, error) {
+	r, err := ast.ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, rule := range p.compiler.GetRulesWithPrefix(r) {
+		path := rule.Ref()
+		if len(path) <= len(r) {
+			continue
+		}
+		if name, ok := path[len(r)].Value.(ast.String); ok {
+			names = append(names, string(name))
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
@@ -0,0 +1,74 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntrypointType(t *testing.T) {
+	compiler := NewCompiler()
+
+	tests := []struct {
+		name     string
+		rego     string
+		expected types.Type
+	}{
+		{"boolean", "package authz\ndefault allow = false\nallow { input.user == \"admin\" }", types.B},
+		{"number", "package authz\ndefault allow = 0\nallow = 1 { input.user == \"admin\" }", types.N},
+		{"from input", "package authz\nallow = input.allow", types.A},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := compiler.Compile("test", Modules{"p.rego": tt.rego})
+			require.NoError(t, err)
+
+			typ, err := ast.EntrypointType("data.authz.allow")
+			require.NoError(t, err)
+			assert.Equal(t, types.Sprint(tt.expected), types.Sprint(typ))
+		})
+	}
+
+	t.Run("object", func(t *testing.T) {
+		ast, err := compiler.Compile("test", Modules{"p.rego": "package authz\nallow = {\"allow\": true, \"obligations\": []}"})
+		require.NoError(t, err)
+
+		typ, err := ast.EntrypointType("data.authz.allow")
+		require.NoError(t, err)
+		obj, ok := typ.(*types.Object)
+		require.True(t, ok, types.Sprint(typ))
+		assert.Equal(t, types.Sprint(types.B), types.Sprint(obj.Select("allow")))
+	})
+
+	t.Run("undefined", func(t *testing.T) {
+		ast, err := compiler.Compile("test", Modules{"p.rego": "package authz2\ndefault allow = false"})
+		require.NoError(t, err)
+
+		_, err = ast.EntrypointType("data.authz.allow")
+		require.Error(t, err)
+		assert.Equal(t, "data.authz.allow is not defined", err.Error())
+	})
+}
+
+func TestDocuments(t *testing.T) {
+	ast, err := NewCompiler().Compile("test", Modules{
+		"m.rego": "package mapper\nporc := {\"principal\": input.claims}\naudit_context := {\"path\": input.path}\nrate_key[k] { k := input.tenant }\nrate_key[k] { k := input.user }",
+		"u.rego": "package mapper.util\nhelper = 1",
+	})
+	require.NoError(t, err)
+
+	documents, err := ast.Documents("data.mapper")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"audit_context", "porc", "rate_key", "util"}, documents)
+
+	documents, err = ast.Documents("data.authz")
+	require.NoError(t, err)
+	assert.Empty(t, documents)
+}
@@ -0,0 +1,52 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"sync"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+)
+
+// ExternalLog collects the checks that built-ins delegate to external authorization
+// services while evaluating policies, so that they can be audited as bundle references
+// of the EXTERNAL phase. Attach an ExternalLog to the evaluation context with
+// [WithExternalLog], and record checks with [RecordExternal].
+//
+// An ExternalLog is safe for concurrent use.
+type ExternalLog struct {
+	mu         sync.Mutex
+	references []*events.AccessRecord_BundleReference
+}
+
+type externalLogKey struct{}
+
+// WithExternalLog returns a context that records the external checks of evaluations
+// using it in log.
+func WithExternalLog(ctx context.Context, log *ExternalLog) context.Context {
+	return context.WithValue(ctx, externalLogKey{}, log)
+}
+
+// References returns the checks recorded so far, in the order they completed.
+func (l *ExternalLog) References() []*events.AccessRecord_BundleReference {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.references
+}
+
+// RecordExternal records an external check in the [ExternalLog] of ctx, if any. The
+// phase of the reference is set to EXTERNAL.
+func RecordExternal(ctx context.Context, ref *events.AccessRecord_BundleReference) {
+	if ctx == nil {
+		return
+	}
+	if l, ok := ctx.Value(externalLogKey{}).(*ExternalLog); ok {
+		ref.Phase = events.AccessRecord_BundleReference_EXTERNAL
+		l.mu.Lock()
+		l.references = append(l.references, ref)
+		l.mu.Unlock()
+	}
+}
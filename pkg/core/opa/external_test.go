@@ -0,0 +1,33 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalLog(t *testing.T) {
+	log := &ExternalLog{}
+	ctx := WithExternalLog(context.Background(), log)
+
+	RecordExternal(ctx, &events.AccessRecord_BundleReference{Id: "doc:1#viewer@user:alice", Decision: events.AccessRecord_GRANT})
+	RecordExternal(ctx, &events.AccessRecord_BundleReference{Id: "doc:2#viewer@user:alice", Decision: events.AccessRecord_DENY})
+
+	refs := log.References()
+	require.Len(t, refs, 2)
+	assert.Equal(t, "doc:1#viewer@user:alice", refs[0].Id)
+	assert.Equal(t, events.AccessRecord_BundleReference_EXTERNAL, refs[0].Phase)
+	assert.Equal(t, events.AccessRecord_BundleReference_EXTERNAL, refs[1].Phase)
+
+	// contexts without a log, or no context at all, discard the checks
+	RecordExternal(context.Background(), &events.AccessRecord_BundleReference{})
+	RecordExternal(nil, &events.AccessRecord_BundleReference{}) //nolint:staticcheck // a nil context is tolerated
+	assert.Len(t, log.References(), 2)
+}
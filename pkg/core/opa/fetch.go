@@ -0,0 +1,330 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+	"github.com/open-policy-agent/opa/v1/util"
+)
+
+// FetchBuiltin is the name of the built-in function that fetches allowlisted URLs.
+const FetchBuiltin = "policyengine.fetch"
+
+// DefaultFetchTimeout limits a request made by [FetchBuiltin] when no timeout is configured.
+const DefaultFetchTimeout = 2 * time.Second
+
+const (
+	maxFetchBody         = 1 << 20 // bytes read from a response
+	maxFetchRedirects    = 10
+	maxFetchCacheEntries = 1024
+)
+
+var fetchDecl = &rego.Function{
+	Name:        FetchBuiltin,
+	Description: "Fetches a URL allowed by the policy domain, returning the status code and the decoded JSON body.",
+	Decl: types.NewFunction(
+		types.Args(types.Named("url", types.S).Description("URL to fetch with GET")),
+		types.Named("response", types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))).
+			Description("object with status_code, body (decoded JSON, or null), and raw_body"),
+	),
+	Memoize:          true,
+	Nondeterministic: true,
+}
+
+// FetchDeclaration returns the capability declaration of [FetchBuiltin], for tooling that
+// compiles Rego without a [Fetcher], such as lint.
+func FetchDeclaration() *ast.Builtin {
+	return (&Builtin{Decl: fetchDecl}).Declaration()
+}
+
+// FetchOptions configures a [Fetcher].
+type FetchOptions struct {
+	// Allow lists the URL prefixes that may be fetched. A URL is allowed when its scheme and
+	// host match a prefix and its path is the prefix's path or lies beneath it.
+	Allow []string
+	// Timeout limits each request, including redirects. Zero selects [DefaultFetchTimeout].
+	Timeout time.Duration
+	// CacheTTL is how long successful responses are reused. Zero disables caching.
+	CacheTTL time.Duration
+}
+
+// Fetcher implements [FetchBuiltin] for the policies of a single policy domain.
+//
+// Unlike http.send, which the engine disables by default, a Fetcher only issues GET requests
+// to URLs on its allowlist, bounds each request with a timeout, and caches successful
+// responses. A call to a URL outside the allowlist halts evaluation with an error, while a
+// failed request leaves the call undefined, so that policies can fall back to a default.
+//
+// Each call is reported to the [FetchLog] attached to the evaluation context, if any. Register
+// the built-in with a compiler using [Fetcher.Builtin]:
+//
+//	fetcher, err := opa.NewFetcher("risk", opa.FetchOptions{
+//	    Allow:    []string{"https://risk.example.com/v1/"},
+//	    CacheTTL: time.Minute,
+//	})
+//	compiler := opa.NewCompiler(opa.WithBuiltins(fetcher.Builtin()))
+//
+// A Fetcher is safe for concurrent use.
+type Fetcher struct {
+	domain   string
+	allow    []*url.URL
+	timeout  time.Duration
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]fetchEntry
+}
+
+type fetchEntry struct {
+	response *ast.Term
+	status   int
+	expires  time.Time
+}
+
+// NewFetcher creates a [Fetcher] for the named policy domain.
+//
+// Returns an error if an allowed prefix is not an absolute http or https URL, or if it
+// contains credentials, a query, or a fragment.
+func NewFetcher(domain string, options FetchOptions) (*Fetcher, error) {
+	f := &Fetcher{
+		domain:   domain,
+		timeout:  options.Timeout,
+		cacheTTL: options.CacheTTL,
+		cache:    make(map[string]fetchEntry),
+	}
+	if f.timeout <= 0 {
+		f.timeout = DefaultFetchTimeout
+	}
+
+	for _, prefix := range options.Allow {
+		u, err := url.Parse(prefix)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid fetch URL '%s', expected an absolute http or https URL", prefix)
+		}
+		if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("fetch URL '%s' must not contain credentials, a query, or a fragment", prefix)
+		}
+		f.allow = append(f.allow, u)
+	}
+
+	f.client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if !f.allowed(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL)
+			}
+			return nil
+		},
+	}
+
+	return f, nil
+}
+
+// Builtin returns the [FetchBuiltin] implementation bound to this Fetcher.
+func (f *Fetcher) Builtin() *Builtin {
+	return &Builtin{Decl: fetchDecl, Impl: f.fetch}
+}
+
+// allowed reports whether u matches a prefix of the allowlist. Paths with dot segments are
+// refused, as the server could resolve them outside the prefix.
+func (f *Fetcher) allowed(u *url.URL) bool {
+	if u.User != nil || hasDotSegment(u.Path) {
+		return false
+	}
+	for _, prefix := range f.allow {
+		if !strings.EqualFold(u.Scheme, prefix.Scheme) || !strings.EqualFold(u.Host, prefix.Host) {
+			continue
+		}
+		base := strings.TrimSuffix(prefix.Path, "/")
+		if base == "" || u.Path == base || strings.HasPrefix(u.Path, base+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fetcher) fetch(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+	start := time.Now()
+	call := &events.AccessRecord_Fetch{Domain: f.domain}
+	defer func() {
+		call.Duration = uint64(time.Since(start).Nanoseconds()) // #nosec G115 -- elapsed time is never negative
+		recordFetch(bctx.Context, call)
+	}()
+
+	s, ok := args[0].Value.(ast.String)
+	if !ok {
+		call.Error = "url must be a string"
+		return nil, rego.NewHaltError(fmt.Errorf("url must be a string, got %s", ast.ValueName(args[0].Value)))
+	}
+	call.Url = string(s)
+
+	u, err := url.Parse(call.Url)
+	if err != nil || !f.allowed(u) {
+		call.Error = "not allowed"
+		return nil, rego.NewHaltError(fmt.Errorf("url %s is not allowed by policy domain %s", call.Url, f.domain))
+	}
+
+	if response, status, ok := f.lookup(call.Url); ok {
+		call.Cached = true
+		call.StatusCode = uint32(status) // #nosec G115 -- HTTP status codes are three digits
+		return response, nil
+	}
+
+	response, status, err := f.get(bctx.Context, call.Url)
+	call.StatusCode = uint32(status) // #nosec G115 -- HTTP status codes are three digits
+	if err != nil {
+		call.Error = err.Error()
+		logger.WithContext(bctx.Context).Debugf(agent, "fetch", "domain %s: %s: %+v", f.domain, call.Url, err)
+		return nil, err
+	}
+
+	if status >= 200 && status < 300 {
+		f.store(call.Url, response, status)
+	}
+
+	return response, nil
+}
+
+// get requests target, returning the response as a Rego object
+func (f *Fetcher) get(ctx context.Context, target string) (*ast.Term, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBody+1))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if len(raw) > maxFetchBody {
+		return nil, resp.StatusCode, fmt.Errorf("response exceeds %d bytes", maxFetchBody)
+	}
+
+	body := ast.NullTerm()
+	var decoded interface{}
+	if err := util.UnmarshalJSON(raw, &decoded); err == nil {
+		if v, err := ast.InterfaceToValue(decoded); err == nil {
+			body = ast.NewTerm(v)
+		}
+	}
+
+	return ast.ObjectTerm(
+		ast.Item(ast.StringTerm("status_code"), ast.IntNumberTerm(resp.StatusCode)),
+		ast.Item(ast.StringTerm("body"), body),
+		ast.Item(ast.StringTerm("raw_body"), ast.StringTerm(string(raw))),
+	), resp.StatusCode, nil
+}
+
+func (f *Fetcher) lookup(key string) (*ast.Term, int, bool) {
+	if f.cacheTTL <= 0 {
+		return nil, 0, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.cache[key]
+	if !ok {
+		return nil, 0, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(f.cache, key)
+		return nil, 0, false
+	}
+	return entry.response, entry.status, true
+}
+
+// store caches a response. Expired entries are evicted when the cache is full; if none
+// have expired, the response is not cached.
+func (f *Fetcher) store(key string, response *ast.Term, status int) {
+	if f.cacheTTL <= 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if len(f.cache) >= maxFetchCacheEntries {
+		for key, entry := range f.cache {
+			if now.After(entry.expires) {
+				delete(f.cache, key)
+			}
+		}
+		if len(f.cache) >= maxFetchCacheEntries {
+			return
+		}
+	}
+	f.cache[key] = fetchEntry{response: response, status: status, expires: now.Add(f.cacheTTL)}
+}
+
+// FetchLog collects the [FetchBuiltin] calls made while evaluating policies, so that they
+// can be audited. Attach a FetchLog to the evaluation context with [WithFetchLog].
+//
+// A FetchLog is safe for concurrent use.
+type FetchLog struct {
+	mu    sync.Mutex
+	calls []*events.AccessRecord_Fetch
+}
+
+type fetchLogKey struct{}
+
+// WithFetchLog returns a context that records the [FetchBuiltin] calls of evaluations
+// using it in log.
+func WithFetchLog(ctx context.Context, log *FetchLog) context.Context {
+	return context.WithValue(ctx, fetchLogKey{}, log)
+}
+
+// Calls returns the calls recorded so far, in the order they completed.
+func (l *FetchLog) Calls() []*events.AccessRecord_Fetch {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.calls
+}
+
+func recordFetch(ctx context.Context, call *events.AccessRecord_Fetch) {
+	if ctx == nil {
+		return
+	}
+	if l, ok := ctx.Value(fetchLogKey{}).(*FetchLog); ok {
+		l.mu.Lock()
+		l.calls = append(l.calls, call)
+		l.mu.Unlock()
+	}
+}
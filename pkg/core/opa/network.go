@@ -0,0 +1,227 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/manetu/policyengine/pkg/core/geo"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// CIDRContainsCtxBuiltin is the name of the built-in function that reports whether the client
+// of the request is within any of a set of networks.
+const CIDRContainsCtxBuiltin = "net.cidr_contains_ctx"
+
+// GeoLookupBuiltin is the name of the built-in function that locates a network address.
+const GeoLookupBuiltin = "geo.lookup"
+
+var cidrsType = types.NewAny(types.S, types.NewArray(nil, types.S), types.NewSet(types.S))
+
+var cidrContainsCtxDecl = &rego.Function{
+	Name:        CIDRContainsCtxBuiltin,
+	Description: "Reports whether the client address of the request, given by context.ip, is within any of the networks.",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("cidrs", cidrsType).Description("CIDR, or array or set of CIDRs, such as 10.0.0.0/8"),
+		),
+		types.Named("result", types.B).Description("true if the request has a client address within any of the networks"),
+	),
+	Nondeterministic: true,
+}
+
+var geoLookupDecl = &rego.Function{
+	Name:        GeoLookupBuiltin,
+	Description: "Locates a network address, such as context.ip, returning its country, continent, region, city, and asn, as far as they are known.",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("ip", types.S).Description("IPv4 or IPv6 address"),
+		),
+		types.Named("location", types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))).Description("the location of the address, undefined if unknown"),
+	),
+	Nondeterministic: true,
+}
+
+var networkBuiltins = []*Builtin{
+	{Decl: cidrContainsCtxDecl, Impl: cidrContainsCtx},
+	{Decl: geoLookupDecl, Impl: geoLookup},
+}
+
+// NetworkBuiltins returns the [CIDRContainsCtxBuiltin] and [GeoLookupBuiltin] implementations,
+// which read the network origin of the request from the [Network] attached to the evaluation
+// context with [WithNetwork]. Without one, the request has no client address and no address
+// is located. The policy engine registers them with every compiler.
+func NetworkBuiltins() []*Builtin {
+	return networkBuiltins
+}
+
+// NetworkDeclarations returns the capability declarations of [NetworkBuiltins], for tooling
+// that compiles Rego without evaluating it, such as lint.
+func NetworkDeclarations() []*ast.Builtin {
+	decls := make([]*ast.Builtin, len(networkBuiltins))
+	for i, b := range networkBuiltins {
+		decls[i] = b.Declaration()
+	}
+	return decls
+}
+
+// Network is the network origin of a request: the address of its client, any location the
+// request gives for it, and the [geo.Locator] locating other addresses. The policy engine
+// attaches it to the evaluation context with [WithNetwork], for [NetworkBuiltins] and the
+// network rules of scopes and resource groups.
+//
+// Decisions that consult the network origin depend on more than the principal, operation,
+// and resource, which [Network.Read] reports. A Network is safe for concurrent use.
+type Network struct {
+	client   netip.Addr
+	location *geo.Location
+	locator  geo.Locator
+	read     atomic.Bool
+}
+
+type networkKey struct{}
+
+// NewNetwork creates the [Network] of a request from the address of its client, invalid if
+// unknown, the location the request gives for the client, if any, and the locator of other
+// addresses, if any.
+func NewNetwork(client netip.Addr, location *geo.Location, locator geo.Locator) *Network {
+	return &Network{client: client.Unmap(), location: location, locator: locator}
+}
+
+// WithNetwork returns a context whose evaluations see n as the network origin of the request.
+func WithNetwork(ctx context.Context, n *Network) context.Context {
+	return context.WithValue(ctx, networkKey{}, n)
+}
+
+// NetworkFrom returns the [Network] attached to ctx, or nil if none is.
+func NetworkFrom(ctx context.Context) *Network {
+	if ctx == nil {
+		return nil
+	}
+	n, _ := ctx.Value(networkKey{}).(*Network)
+	return n
+}
+
+// Client returns the address of the client of the request, and false if it is unknown.
+func (n *Network) Client() (netip.Addr, bool) {
+	if n == nil {
+		return netip.Addr{}, false
+	}
+	n.read.Store(true)
+	return n.client, n.client.IsValid()
+}
+
+// Locate returns the location of addr given by the locator, or, for the client's address,
+// by the request if the locator does not know it. It returns false if the location is
+// unknown.
+func (n *Network) Locate(addr netip.Addr) (geo.Location, bool, error) {
+	if n == nil || !addr.IsValid() {
+		return geo.Location{}, false, nil
+	}
+	n.read.Store(true)
+
+	addr = addr.Unmap()
+	if n.locator != nil {
+		l, ok, err := n.locator.Locate(addr)
+		if err != nil || ok {
+			return l, ok, err
+		}
+	}
+	if n.location != nil && addr == n.client {
+		return *n.location, true, nil
+	}
+	return geo.Location{}, false, nil
+}
+
+// Read reports whether the network origin was consulted by any evaluation so far.
+func (n *Network) Read() bool {
+	return n != nil && n.read.Load()
+}
+
+func cidrContainsCtx(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+	var prefixes []netip.Prefix
+	var err error
+	collect := func(t *ast.Term) {
+		s, ok := t.Value.(ast.String)
+		if !ok {
+			err = fmt.Errorf("networks must be strings, got %s", ast.ValueName(t.Value))
+			return
+		}
+		p, perr := netip.ParsePrefix(string(s))
+		if perr != nil {
+			err = fmt.Errorf("invalid network '%s': %w", string(s), perr)
+			return
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	switch v := args[0].Value.(type) {
+	case ast.String:
+		collect(args[0])
+	case *ast.Array:
+		v.Foreach(collect)
+	case ast.Set:
+		v.Foreach(collect)
+	default:
+		return nil, fmt.Errorf("networks must be a string, array, or set, got %s", ast.ValueName(v))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, ok := NetworkFrom(bctx.Context).Client()
+	if !ok {
+		return ast.BooleanTerm(false), nil
+	}
+	for _, p := range prefixes {
+		if p.Contains(client) {
+			return ast.BooleanTerm(true), nil
+		}
+	}
+	return ast.BooleanTerm(false), nil
+}
+
+func geoLookup(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+	s, ok := args[0].Value.(ast.String)
+	if !ok {
+		return nil, fmt.Errorf("address must be a string, got %s", ast.ValueName(args[0].Value))
+	}
+	addr, err := netip.ParseAddr(string(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid address '%s': %w", string(s), err)
+	}
+
+	l, found, err := NetworkFrom(bctx.Context).Locate(addr)
+	if err != nil || !found {
+		// an unknown location leaves the call undefined
+		return nil, err
+	}
+
+	location := map[string]interface{}{}
+	if l.Country != "" {
+		location["country"] = l.Country
+	}
+	if l.Continent != "" {
+		location["continent"] = l.Continent
+	}
+	if l.Region != "" {
+		location["region"] = l.Region
+	}
+	if l.City != "" {
+		location["city"] = l.City
+	}
+	if l.ASN != 0 {
+		location["asn"] = l.ASN
+	}
+	v, err := ast.InterfaceToValue(location)
+	if err != nil {
+		return nil, err
+	}
+	return ast.NewTerm(v), nil
+}
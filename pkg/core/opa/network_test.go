@@ -0,0 +1,111 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core/geo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const networkPolicy = `package authz
+default internal = false
+internal {
+	net.cidr_contains_ctx(["10.0.0.0/8", "fd00::/8"])
+}
+country := geo.lookup(input.ip).country
+`
+
+type fakeLocator map[netip.Addr]geo.Location
+
+func (f fakeLocator) Locate(addr netip.Addr) (geo.Location, bool, error) {
+	if addr == netip.MustParseAddr("192.0.2.66") {
+		return geo.Location{}, false, errors.New("database unavailable")
+	}
+	l, ok := f[addr]
+	return l, ok, nil
+}
+
+func TestNetworkBuiltins(t *testing.T) {
+	policy, err := NewCompiler(WithBuiltins(NetworkBuiltins()...)).Compile("network", Modules{"policy.rego": networkPolicy})
+	require.NoError(t, err)
+
+	locator := fakeLocator{netip.MustParseAddr("203.0.113.7"): {Country: "DE"}}
+	tests := []struct {
+		name     string
+		network  *Network
+		ip       string
+		internal bool
+		country  interface{}
+	}{
+		{"internal client", NewNetwork(netip.MustParseAddr("10.1.2.3"), nil, nil), "10.1.2.3", true, nil},
+		{"mapped internal client", NewNetwork(netip.MustParseAddr("::ffff:10.1.2.3"), nil, nil), "10.1.2.3", true, nil},
+		{"ipv6 internal client", NewNetwork(netip.MustParseAddr("fd12::1"), nil, nil), "fd12::1", true, nil},
+		{"external client", NewNetwork(netip.MustParseAddr("203.0.113.7"), nil, locator), "203.0.113.7", false, "DE"},
+		{"located by request", NewNetwork(netip.MustParseAddr("198.51.100.1"), &geo.Location{Country: "FR"}, locator), "198.51.100.1", false, "FR"},
+		{"locator preferred", NewNetwork(netip.MustParseAddr("203.0.113.7"), &geo.Location{Country: "FR"}, locator), "203.0.113.7", false, "DE"},
+		{"request locates only the client", NewNetwork(netip.MustParseAddr("198.51.100.1"), &geo.Location{Country: "FR"}, nil), "198.51.100.2", false, nil},
+		{"unknown client", NewNetwork(netip.Addr{}, nil, nil), "10.1.2.3", false, nil},
+		{"no network", nil, "10.1.2.3", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.network != nil {
+				ctx = WithNetwork(ctx, tt.network)
+			}
+			result, perr := policy.Evaluate(ctx, "x = data.authz.internal; y = object.get(data.authz, \"country\", null)", map[string]interface{}{"ip": tt.ip})
+			require.Nil(t, perr)
+			assert.Equal(t, tt.internal, result.Bindings["x"])
+			assert.Equal(t, tt.country, result.Bindings["y"])
+			if tt.network != nil {
+				assert.True(t, tt.network.Read())
+			}
+		})
+	}
+}
+
+func TestNetworkBuiltins_Errors(t *testing.T) {
+	// errors leave the call undefined, so the rule takes its default
+	ctx := WithNetwork(context.Background(), NewNetwork(netip.MustParseAddr("10.1.2.3"), nil, fakeLocator{}))
+	for _, tt := range []struct {
+		name string
+		call string
+	}{
+		{"invalid network", `net.cidr_contains_ctx("10.0.0.0/33")`},
+		{"invalid address", `geo.lookup("not an address")`},
+		{"locator error", `geo.lookup("192.0.2.66")`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewCompiler(WithBuiltins(NetworkBuiltins()...)).Compile("network", Modules{"policy.rego": "package authz\ndefault allow = false\nallow { " + tt.call + " }\n"})
+			require.NoError(t, err)
+			result, perr := policy.Evaluate(ctx, "x = data.authz.allow", map[string]interface{}{})
+			require.Nil(t, perr)
+			assert.Equal(t, false, result.Bindings["x"])
+		})
+	}
+}
+
+func TestNetwork_Read(t *testing.T) {
+	var missing *Network
+	assert.False(t, missing.Read())
+	_, ok := missing.Client()
+	assert.False(t, ok)
+
+	n := NewNetwork(netip.MustParseAddr("10.1.2.3"), nil, nil)
+	assert.False(t, n.Read())
+	assert.Same(t, n, NetworkFrom(WithNetwork(context.Background(), n)))
+	assert.Nil(t, NetworkFrom(context.Background()))
+
+	client, ok := n.Client()
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("10.1.2.3"), client)
+	assert.True(t, n.Read())
+}
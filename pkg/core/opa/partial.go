@@ -0,0 +1,128 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"slices"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// Candidates partially evaluates query with the input unknown, and returns, sorted and
+// without duplicates, the strings that the residual policy compares the document at ref,
+// such as input.operation, to, whether by equality, inequality, or membership in a
+// collection.
+//
+// The candidates are values for which the policy may decide differently. They are
+// neither all the values the policy grants, since a policy may grant any value
+// matching a pattern, nor only values it grants: evaluate the query with each one to
+// learn its outcome. Nondeterministic built-ins are not called.
+//
+// The candidates depend only on the policy, so they are computed once per query and
+// ref.
+func (p *Ast) Candidates(ctx context.Context, query string, ref string) ([]string, error) {
+	key := query + "\x00" + ref
+	if c, ok := p.candidates.Load(key); ok {
+		return c.([]string), nil
+	}
+
+	target, err := ast.ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []func(*rego.Rego){
+		rego.Query(query),
+		rego.Compiler(p.compiler),
+		rego.Unknowns([]string{"input"}),
+	}
+	for _, b := range p.builtins {
+		options = append(options, rego.FunctionDyn(b.Decl, b.Impl))
+	}
+	if p.store != nil {
+		options = append(options, rego.Store(p.store))
+	}
+
+	pq, err := rego.New(options...).Partial(ctx)
+	if err != nil {
+		return nil, evalCause(ctx, err)
+	}
+
+	seen := make(map[string]struct{})
+	visit := func(expr *ast.Expr) bool {
+		collectCandidates(expr, target, seen)
+		return false
+	}
+	for _, body := range pq.Queries {
+		ast.WalkExprs(body, visit)
+	}
+	for _, module := range pq.Support {
+		ast.WalkExprs(module, visit)
+	}
+
+	candidates := make([]string, 0, len(seen))
+	for s := range seen {
+		candidates = append(candidates, s)
+	}
+	slices.Sort(candidates)
+
+	actual, _ := p.candidates.LoadOrStore(key, candidates)
+	return actual.([]string), nil
+}
+
+// comparisons are the built-ins whose operands are candidates when one of them is the
+// unknown document
+var comparisons = map[string]bool{
+	ast.Equality.Name:      true,
+	ast.Equal.Name:         true,
+	ast.NotEqual.Name:      true,
+	ast.Member.Name:        true,
+	ast.MemberWithKey.Name: true,
+}
+
+// collectCandidates adds the strings compared to target in expr to seen
+func collectCandidates(expr *ast.Expr, target ast.Ref, seen map[string]struct{}) {
+	terms, ok := expr.Terms.([]*ast.Term)
+	if !ok || len(terms) < 2 || !comparisons[terms[0].String()] {
+		return
+	}
+
+	operands := terms[1:]
+	found := false
+	for _, t := range operands {
+		if ref, ok := t.Value.(ast.Ref); ok && ref.Equal(target) {
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	for _, t := range operands {
+		addStrings(t.Value, seen)
+	}
+}
+
+// addStrings adds a string, or the strings of a collection, to seen
+func addStrings(v ast.Value, seen map[string]struct{}) {
+	switch x := v.(type) {
+	case ast.String:
+		seen[string(x)] = struct{}{}
+	case *ast.Array:
+		x.Foreach(func(t *ast.Term) {
+			if s, ok := t.Value.(ast.String); ok {
+				seen[string(s)] = struct{}{}
+			}
+		})
+	case ast.Set:
+		x.Foreach(func(t *ast.Term) {
+			if s, ok := t.Value.(ast.String); ok {
+				seen[string(s)] = struct{}{}
+			}
+		})
+	}
+}
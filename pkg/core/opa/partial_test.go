@@ -0,0 +1,74 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCandidates(t *testing.T) {
+	compiler := NewCompiler()
+
+	tests := []struct {
+		name       string
+		modules    Modules
+		candidates []string
+	}{
+		{"equality", Modules{"p.rego": `package authz
+default allow = false
+allow { input.operation == "api:docs:read" }
+allow { "api:docs:list" = input.operation; input.principal.sub == "alice" }
+allow { input.operation != "api:docs:delete" }`}, []string{"api:docs:delete", "api:docs:list", "api:docs:read"}},
+		{"membership", Modules{"p.rego": `package authz
+import future.keywords.in
+default allow = false
+writers := {"api:docs:write", "api:docs:update"}
+allow { input.operation in {"api:docs:head"} }
+allow { writers[input.operation] }`}, []string{"api:docs:head", "api:docs:update", "api:docs:write"}},
+		{"tri-level", Modules{"p.rego": `package authz
+default allow = 0
+allow = -1 { input.operation == "api:blocked" }
+allow = 1 { input.operation == "api:open" }`}, []string{"api:blocked", "api:open"}},
+		{"obligations", Modules{"p.rego": `package authz
+default allow = false
+readers := ["api:docs:read", "api:docs:head"]
+allow = {"allow": true, "quota": 10} { input.operation == readers[_] }`}, []string{"api:docs:head", "api:docs:read"}},
+		{"library", Modules{
+			"p.rego":   "package authz\nimport data.ops\ndefault allow = false\nallow { ops.readable }",
+			"lib.rego": "package ops\nreadable { input.operation == \"api:docs:read\" }",
+		}, []string{"api:docs:read"}},
+		{"patterns", Modules{"p.rego": `package authz
+default allow = false
+allow { startswith(input.operation, "api:public:") }
+allow { input.principal.sub == "api:docs:read" }`}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := compiler.Compile(tt.name, tt.modules)
+			require.NoError(t, err)
+
+			candidates, err := p.Candidates(context.Background(), "data.authz.allow", "input.operation")
+			require.NoError(t, err)
+			assert.Equal(t, tt.candidates, candidates)
+
+			// the candidates are computed once
+			again, err := p.Candidates(context.Background(), "data.authz.allow", "input.operation")
+			require.NoError(t, err)
+			assert.Equal(t, candidates, again)
+		})
+	}
+}
+
+func TestCandidatesInvalidRef(t *testing.T) {
+	p, err := NewCompiler().Compile("p", Modules{"p.rego": "package authz\ndefault allow = false"})
+	require.NoError(t, err)
+
+	_, err = p.Candidates(context.Background(), "data.authz.allow", "input[")
+	assert.Error(t, err)
+}
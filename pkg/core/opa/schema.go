@@ -0,0 +1,95 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// Schema is a compiled JSON Schema, validating documents such as the context of the requests
+// for an operation. Schemas are validated with the json.match_schema built-in, so they support
+// the same drafts as policies calling it.
+//
+// A Schema is safe for concurrent use.
+type Schema struct {
+	source string // canonical JSON of the schema
+	query  rego.PreparedEvalQuery
+}
+
+// NewSchema compiles schema, a JSON Schema decoded from JSON or YAML, such as:
+//
+//	map[string]interface{}{
+//	    "type":     "object",
+//	    "required": []interface{}{"reason"},
+//	}
+//
+// Returns an error if schema is not an object or is not a valid JSON Schema.
+func NewSchema(schema interface{}) (*Schema, error) {
+	value, err := ast.InterfaceToValue(schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if _, ok := value.(ast.Object); !ok {
+		return nil, fmt.Errorf("invalid schema: expected an object, got %s", ast.ValueName(value))
+	}
+	term := ast.NewTerm(value)
+
+	ctx := context.Background()
+	rs, err := rego.New(rego.Query(fmt.Sprintf("[valid, reason] := json.verify_schema(%s)", term))).Eval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if len(rs) != 1 {
+		return nil, fmt.Errorf("invalid schema: verification returned %d results", len(rs))
+	}
+	if rs[0].Bindings["valid"] != true {
+		return nil, fmt.Errorf("invalid schema: %v", rs[0].Bindings["reason"])
+	}
+
+	query, err := rego.New(rego.Query(fmt.Sprintf("[valid, errors] := json.match_schema(input, %s)", term))).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	source, err := json.Marshal(schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &Schema{source: string(source), query: query}, nil
+}
+
+// Validate returns why doc, an object, does not match the schema, such as "reason: Invalid
+// type. Expected: string, given: integer", or nil if it does.
+func (s *Schema) Validate(ctx context.Context, doc map[string]interface{}) ([]string, error) {
+	rs, err := s.query.Eval(ctx, rego.EvalInput(doc))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) != 1 {
+		return nil, fmt.Errorf("schema validation returned %d results", len(rs))
+	}
+	if rs[0].Bindings["valid"] == true {
+		return nil, nil
+	}
+
+	errs, _ := rs[0].Bindings["errors"].([]interface{})
+	violations := make([]string, 0, len(errs))
+	for _, e := range errs {
+		if m, ok := e.(map[string]interface{}); ok {
+			violations = append(violations, fmt.Sprint(m["error"]))
+		}
+	}
+	return violations, nil
+}
+
+// String returns the schema as JSON, with its keys sorted.
+func (s *Schema) String() string {
+	return s.source
+}
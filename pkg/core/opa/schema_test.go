@@ -0,0 +1,62 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSchema_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		schema interface{}
+		err    string
+	}{
+		{"not an object", []interface{}{"type"}, "invalid schema: expected an object, got array"},
+		{"unknown type", map[string]interface{}{"type": "strin"}, "invalid schema: jsonschema: has a primitive type that is NOT VALID"},
+		{"invalid keyword", map[string]interface{}{"required": "reason"}, "invalid schema: jsonschema: required must be of an array"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSchema(tt.schema)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestSchema_Validate(t *testing.T) {
+	schema, err := NewSchema(map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"reason"},
+		"properties": map[string]interface{}{
+			"reason": map[string]interface{}{"type": "string", "minLength": 1},
+			"amount": map[string]interface{}{"type": "number", "maximum": 1000},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"properties":{"amount":{"maximum":1000,"type":"number"},"reason":{"minLength":1,"type":"string"}},"required":["reason"],"type":"object"}`, schema.String())
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name       string
+		doc        map[string]interface{}
+		violations []string
+	}{
+		{"valid", map[string]interface{}{"reason": "audit", "amount": 10}, nil},
+		{"missing", map[string]interface{}{}, []string{"(Root): reason is required"}},
+		{"wrong type", map[string]interface{}{"reason": 42}, []string{"reason: Invalid type. Expected: string, given: integer"}},
+		{"several", map[string]interface{}{"amount": 5000}, []string{"(Root): reason is required", "amount: Must be less than or equal to 1000"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := schema.Validate(ctx, tt.doc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.violations, violations)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"maps"
+	"runtime"
+	"slices"
+	"sync"
+	"weak"
+)
+
+// astKey is the fingerprint of a compilation: the compiler's configuration, the name, the
+// modules, and the data documents
+type astKey [sha256.Size]byte
+
+// inflight is a compilation in progress, which concurrent compilations of the same key wait for
+type inflight struct {
+	done chan struct{}
+	ast  *Ast
+	err  error
+}
+
+// sharedASTs holds every compiled [Ast] of the process that is still in use, so that engines
+// compiling the same policies with the same configuration share one immutable copy. Entries are
+// weak, and are removed once no engine refers to their Ast.
+var sharedASTs = struct {
+	sync.Mutex
+	asts    map[astKey]weak.Pointer[Ast]
+	pending map[astKey]*inflight
+}{
+	asts:    make(map[astKey]weak.Pointer[Ast]),
+	pending: make(map[astKey]*inflight),
+}
+
+// shared returns the Ast compiled for key, calling compile at most once for concurrent callers.
+// Failed compilations are not kept.
+func shared(key astKey, compile func() (*Ast, error)) (*Ast, error) {
+	sharedASTs.Lock()
+	if ast := sharedASTs.asts[key].Value(); ast != nil {
+		sharedASTs.Unlock()
+		return ast, nil
+	}
+	if f, ok := sharedASTs.pending[key]; ok {
+		sharedASTs.Unlock()
+		<-f.done
+		return f.ast, f.err
+	}
+	f := &inflight{done: make(chan struct{})}
+	sharedASTs.pending[key] = f
+	sharedASTs.Unlock()
+
+	defer close(f.done)
+	f.ast, f.err = compile()
+
+	sharedASTs.Lock()
+	defer sharedASTs.Unlock()
+	delete(sharedASTs.pending, key)
+	if f.err == nil {
+		sharedASTs.asts[key] = weak.Make(f.ast)
+		runtime.AddCleanup(f.ast, releaseAST, key)
+	}
+	return f.ast, f.err
+}
+
+// releaseAST removes the entry of a collected Ast, unless it has been replaced since
+func releaseAST(key astKey) {
+	sharedASTs.Lock()
+	defer sharedASTs.Unlock()
+	if p, ok := sharedASTs.asts[key]; ok && p.Value() == nil {
+		delete(sharedASTs.asts, key)
+	}
+}
+
+// fingerprint identifies the configuration of the compiler. Built-ins are identified by
+// address, as their implementations cannot be compared; a shared Ast refers to its built-ins,
+// so their addresses cannot be reused while its entry remains.
+func (c *Compiler) fingerprint() []byte {
+	c.once.Do(func() {
+		h := sha256.New()
+		o := c.options
+		fmt.Fprintf(h, "rego:%d\ntrace:%t\nprint:%t\n", o.regoVersion, o.trace, o.print)
+		for _, re := range o.traceFilter {
+			fmt.Fprintf(h, "filter:%s\n", re.String())
+		}
+		if o.capabilities != nil {
+			for _, b := range o.capabilities.Builtins {
+				fmt.Fprintf(h, "capability:%s\n", b.Name)
+			}
+			for _, f := range o.capabilities.Features {
+				fmt.Fprintf(h, "feature:%s\n", f)
+			}
+			for _, k := range o.capabilities.FutureKeywords {
+				fmt.Fprintf(h, "keyword:%s\n", k)
+			}
+			if o.capabilities.AllowNet != nil {
+				fmt.Fprintf(h, "net:%q\n", o.capabilities.AllowNet)
+			}
+		}
+		for _, b := range o.builtins {
+			fmt.Fprintf(h, "builtin:%s@%p\n", b.Decl.Name, b)
+		}
+		c.sum = h.Sum(nil)
+	})
+	return c.sum
+}
+
+// astKey fingerprints a compilation by the compiler, or returns false if the data cannot be
+// represented as JSON, leaving the error to the compilation
+func (c *Compiler) astKey(name string, modules Modules, data Data) (astKey, bool) {
+	h := sha256.New()
+	h.Write(c.fingerprint())
+	writeField(h, name)
+	for _, f := range slices.Sorted(maps.Keys(modules)) {
+		writeField(h, f)
+		writeField(h, modules[f])
+	}
+	for _, d := range slices.Sorted(maps.Keys(data)) {
+		value, err := json.Marshal(data[d])
+		if err != nil {
+			return astKey{}, false
+		}
+		writeField(h, d)
+		writeField(h, string(value))
+	}
+
+	var key astKey
+	h.Sum(key[:0])
+	return key, true
+}
+
+// writeField writes a length-prefixed value, so that adjacent values cannot run together
+func writeField(h hash.Hash, s string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+	h.Write(n[:])
+	h.Write([]byte(s))
+}
@@ -0,0 +1,121 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sharedPolicy = `
+package authz
+default allow = false
+allow { input.user == data.roles.admin }
+`
+
+func TestCompileShared(t *testing.T) {
+	modules := Modules{"test.rego": sharedPolicy}
+	data := Data{"roles": map[string]interface{}{"admin": "alice"}}
+
+	first, err := NewCompiler().CompileWithData("shared", modules, data)
+	require.NoError(t, err)
+
+	// a separate compiler of the same configuration shares the compilation
+	second, err := NewCompiler().CompileWithData("shared", Modules{"test.rego": sharedPolicy}, Data{"roles": map[string]interface{}{"admin": "alice"}})
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+
+	builtin := mrnClassBuiltin()
+	distinct := map[string]func() (*Ast, error){
+		"name": func() (*Ast, error) { return NewCompiler().CompileWithData("other", modules, data) },
+		"data": func() (*Ast, error) {
+			return NewCompiler().CompileWithData("shared", modules, Data{"roles": map[string]interface{}{"admin": "bob"}})
+		},
+		"version": func() (*Ast, error) {
+			return NewCompiler(WithRegoVersion(ast.RegoV1)).CompileWithData("shared", Modules{"test.rego": "package authz\nallow if true\n"}, data)
+		},
+		"tracing": func() (*Ast, error) {
+			return NewCompiler(WithDefaultTracing(true)).CompileWithData("shared", modules, data)
+		},
+		"unsafe": func() (*Ast, error) {
+			return NewCompiler(WithUnsafeBuiltins(Builtins{"http.send": {}})).CompileWithData("shared", modules, data)
+		},
+		"builtin": func() (*Ast, error) {
+			return NewCompiler(WithBuiltins(builtin)).CompileWithData("shared", modules, data)
+		},
+	}
+	for name, compile := range distinct {
+		t.Run(name, func(t *testing.T) {
+			other, err := compile()
+			require.NoError(t, err)
+			assert.NotSame(t, first, other)
+		})
+	}
+
+	// the same built-in is shared, another with the same declaration is not
+	withBuiltin, err := NewCompiler(WithBuiltins(builtin)).CompileWithData("shared", modules, data)
+	require.NoError(t, err)
+	again, err := NewCompiler(WithBuiltins(builtin)).CompileWithData("shared", modules, data)
+	require.NoError(t, err)
+	assert.Same(t, withBuiltin, again)
+	redeclared, err := NewCompiler(WithBuiltins(&Builtin{Decl: builtin.Decl, Impl: builtin.Impl})).CompileWithData("shared", modules, data)
+	require.NoError(t, err)
+	assert.NotSame(t, withBuiltin, redeclared)
+}
+
+func TestCompileSharedConcurrent(t *testing.T) {
+	modules := Modules{"test.rego": sharedPolicy + "\n# concurrent\n"}
+
+	const n = 16
+	asts := make([]*Ast, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := NewCompiler().Compile("concurrent", modules)
+			assert.NoError(t, err)
+			asts[i] = a
+		}()
+	}
+	wg.Wait()
+
+	for _, a := range asts {
+		assert.Same(t, asts[0], a)
+	}
+}
+
+func TestCompileSharedErrors(t *testing.T) {
+	modules := Modules{"test.rego": "package authz\nallow { undefined_function(input) }\n"}
+
+	_, err := NewCompiler().Compile("broken", modules)
+	assert.Error(t, err)
+	_, err = NewCompiler().Compile("broken", modules)
+	assert.Error(t, err, "failed compilations are not kept")
+}
+
+func TestCompileSharedReleased(t *testing.T) {
+	modules := Modules{"test.rego": sharedPolicy + "\n# released\n"}
+	compiler := NewCompiler()
+	key, ok := compiler.astKey("released", modules, nil)
+	require.True(t, ok)
+
+	_, err := compiler.Compile("released", modules)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		sharedASTs.Lock()
+		defer sharedASTs.Unlock()
+		_, ok := sharedASTs.asts[key]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond, "entries are removed once their Ast is unused")
+}
@@ -0,0 +1,344 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/topdown"
+)
+
+// TraceLog collects the OPA trace of the policies evaluated with a context as structured
+// events, instead of the text printed to stdout when tracing is enabled. Which policies are
+// traced is still selected with [WithDefaultTracing], [WithTraceFilter], and [WithTrace].
+// Attach a TraceLog to the evaluation context with [WithTraceLog]; it marshals to JSON, and
+// [TraceLog.WriteFolded] renders it in the folded-stack format of flame graph tools.
+//
+// A TraceLog is safe for concurrent use.
+type TraceLog struct {
+	mu       sync.Mutex
+	policies []*PolicyTrace
+}
+
+// PolicyTrace is the trace of the evaluation of a single policy.
+type PolicyTrace struct {
+	// Policy is the name of the policy, usually its MRN.
+	Policy string `json:"policy"`
+	// Query is the query evaluated, such as "x = data.authz.allow".
+	Query string `json:"query"`
+	// Bindings are the variables bound by the first result of the query, if any.
+	Bindings map[string]interface{} `json:"bindings,omitempty"`
+	// Error is the error that ended the evaluation, if any.
+	Error  string       `json:"error,omitempty"`
+	Events []TraceEvent `json:"events"`
+}
+
+// TraceEvent is a step of the evaluation of a policy, as reported by OPA.
+type TraceEvent struct {
+	// Op is the kind of step, such as "Enter", "Eval", "Exit", "Fail", or "Note".
+	Op string `json:"op"`
+	// Node is the rule, body, or expression the step relates to.
+	Node     string         `json:"node"`
+	Location *TraceLocation `json:"location,omitempty"`
+	// QueryID identifies the query the step belongs to, and ParentID the query that
+	// evaluated it, such as the query referring to the rule being evaluated.
+	QueryID  uint64 `json:"query_id"`
+	ParentID uint64 `json:"parent_id"`
+	// Depth is the nesting of the query, starting at 1.
+	Depth int `json:"depth"`
+	// Message is the text of a Note step, such as the output of trace().
+	Message string `json:"message,omitempty"`
+	// Locals are the values bound to the variables of an expression.
+	Locals map[string]interface{} `json:"locals,omitempty"`
+
+	// frame names the query in a flame graph, and is set on its Enter step
+	frame string
+}
+
+// TraceLocation is the position in a module of the node of a [TraceEvent].
+type TraceLocation struct {
+	File string `json:"file"`
+	Row  int    `json:"row"`
+	Col  int    `json:"col"`
+}
+
+type traceLogKey struct{}
+
+// WithTraceLog returns a context that collects in log the trace of the policies traced by
+// evaluations using it.
+func WithTraceLog(ctx context.Context, log *TraceLog) context.Context {
+	return context.WithValue(ctx, traceLogKey{}, log)
+}
+
+func traceLogFrom(ctx context.Context) *TraceLog {
+	if ctx == nil {
+		return nil
+	}
+	log, _ := ctx.Value(traceLogKey{}).(*TraceLog)
+	return log
+}
+
+// Policies returns the traces collected so far, in the order the policies were evaluated.
+func (l *TraceLog) Policies() []*PolicyTrace {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.policies)
+}
+
+// MarshalJSON encodes the log as an object whose "policies" lists the trace of each policy.
+func (l *TraceLog) MarshalJSON() ([]byte, error) {
+	policies := l.Policies()
+	if policies == nil {
+		policies = []*PolicyTrace{}
+	}
+	return json.Marshal(struct {
+		Policies []*PolicyTrace `json:"policies"`
+	}{policies})
+}
+
+func (l *TraceLog) add(trace *PolicyTrace) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policies = append(l.policies, trace)
+}
+
+// WriteFolded writes the log in the folded-stack format read by flame graph tools such as
+// flamegraph.pl and speedscope: one line per stack of queries, from the policy down to the
+// rule or body evaluated, weighted by the number of evaluation steps taken in it, summed
+// over the evaluations of the policy. Each line is prefixed with prefix, if any, such as the
+// name of the decision traced.
+func (l *TraceLog) WriteFolded(w io.Writer, prefix ...string) error {
+	var head strings.Builder
+	for _, frame := range prefix {
+		head.WriteString(foldedFrame(frame) + ";")
+	}
+	stacks := map[string]int{}
+	for _, trace := range l.Policies() {
+		for stack, steps := range trace.folded() {
+			stacks[stack] += steps
+		}
+	}
+	for _, stack := range slices.Sorted(maps.Keys(stacks)) {
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", head.String(), stack, stacks[stack]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// folded returns the number of steps taken in each stack of queries of the trace
+func (t *PolicyTrace) folded() map[string]int {
+	frames := map[uint64]string{}
+	parents := map[uint64]uint64{}
+	for _, evt := range t.Events {
+		if _, ok := parents[evt.QueryID]; !ok {
+			parents[evt.QueryID] = evt.ParentID
+		}
+		if evt.frame != "" {
+			if _, ok := frames[evt.QueryID]; !ok {
+				frames[evt.QueryID] = evt.frame
+			}
+		}
+	}
+
+	// the stack of a query lists the frames from the policy down to the query
+	memo := map[uint64]string{}
+	stackOf := func(id uint64) string {
+		if stack, ok := memo[id]; ok {
+			return stack
+		}
+		var path []string
+		seen := map[uint64]bool{}
+		for q := id; !seen[q]; q = parents[q] {
+			seen[q] = true
+			frame, ok := frames[q]
+			if !ok {
+				frame = fmt.Sprintf("query %d", q)
+			}
+			path = append(path, foldedFrame(frame))
+			if _, ok := parents[parents[q]]; !ok {
+				break
+			}
+		}
+		path = append(path, foldedFrame(t.Policy))
+		slices.Reverse(path)
+		memo[id] = strings.Join(path, ";")
+		return memo[id]
+	}
+
+	stacks := map[string]int{}
+	for _, evt := range t.Events {
+		stacks[stackOf(evt.QueryID)]++
+	}
+	return stacks
+}
+
+// foldedFrame escapes the separator of the frames of a folded stack
+func foldedFrame(frame string) string {
+	return strings.NewReplacer(";", ",", "\n", " ").Replace(frame)
+}
+
+// eventTracer collects the trace of a single evaluation as [TraceEvent]s
+type eventTracer struct {
+	depths map[uint64]int
+	events []TraceEvent
+}
+
+func newEventTracer() *eventTracer {
+	return &eventTracer{depths: map[uint64]int{}}
+}
+
+func (t *eventTracer) Enabled() bool {
+	return true
+}
+
+func (t *eventTracer) Config() topdown.TraceConfig {
+	return topdown.TraceConfig{PlugLocalVars: true}
+}
+
+func (t *eventTracer) TraceEvent(evt topdown.Event) {
+	// queries are one deeper than the query evaluating them, as in OPA's text trace
+	depth := t.depths[evt.QueryID]
+	if depth == 0 {
+		depth = t.depths[evt.ParentID] + 1
+		t.depths[evt.QueryID] = depth
+	}
+
+	e := TraceEvent{
+		Op:       string(evt.Op),
+		QueryID:  evt.QueryID,
+		ParentID: evt.ParentID,
+		Depth:    depth,
+		Message:  evt.Message,
+	}
+	e.Node = EventNode(evt)
+	if evt.Location != nil {
+		e.Location = &TraceLocation{File: evt.Location.File, Row: evt.Location.Row, Col: evt.Location.Col}
+	}
+	if expr, ok := evt.Node.(*ast.Expr); ok && evt.Locals != nil {
+		e.Locals = exprLocals(expr, evt.Locals, evt.LocalMetadata)
+	}
+	if evt.Op == topdown.EnterOp {
+		e.frame = eventFrame(&e, evt)
+	}
+	t.events = append(t.events, e)
+}
+
+// eventFrame names the query entered by an event: the rule evaluated, or the body of the
+// query, comprehension, or every expression
+func eventFrame(e *TraceEvent, evt topdown.Event) string {
+	name := e.Node
+	if _, ok := evt.Node.(ast.Body); ok {
+		name = "body"
+		if evt.ParentID == 0 {
+			return "query"
+		}
+	}
+	if e.Location != nil && e.Location.Row > 0 {
+		name = fmt.Sprintf("%s:%d", name, e.Location.Row)
+	}
+	return name
+}
+
+// EventNode returns the node of a trace event as written in the policy: the path of a rule,
+// the subject of an Index step, or the text of a body or expression, with the variables the
+// compiler rewrote named as in the policy.
+func EventNode(evt topdown.Event) string {
+	if evt.Ref != nil {
+		return evt.Ref.String()
+	}
+	switch node := evt.Node.(type) {
+	case *ast.Rule:
+		return ast.RulePath(node)
+	case *ast.Expr:
+		return originalVars(node, evt.LocalMetadata).String()
+	case nil:
+		return ""
+	default:
+		return node.String()
+	}
+}
+
+// EventLocals returns the values of the variables bound at a trace event, by their names in
+// the policy. It returns nil unless the tracer plugs local variables into its events.
+func EventLocals(evt topdown.Event) map[string]interface{} {
+	if evt.Locals == nil {
+		return nil
+	}
+	values := map[string]interface{}{}
+	evt.Locals.Iter(func(k, v ast.Value) bool {
+		if name, ok := localName(k, evt.LocalMetadata); ok {
+			values[name] = nativeValue(v)
+		}
+		return false
+	})
+	return values
+}
+
+// localName returns the name in the policy of a variable, unless the compiler generated it
+func localName(k ast.Value, metadata map[ast.Var]topdown.VarMetadata) (string, bool) {
+	v, ok := k.(ast.Var)
+	if !ok {
+		return "", false
+	}
+	if m, ok := metadata[v]; ok {
+		v = m.Name
+	}
+	if v.IsGenerated() || v.IsWildcard() {
+		return "", false
+	}
+	return string(v), true
+}
+
+func nativeValue(v ast.Value) interface{} {
+	if native, err := ast.JSON(v); err == nil {
+		return native
+	}
+	return v.String()
+}
+
+// originalVars returns an expression with the variables the compiler rewrote, such as
+// those declared with :=, named as in the policy
+func originalVars(expr *ast.Expr, metadata map[ast.Var]topdown.VarMetadata) *ast.Expr {
+	if len(metadata) == 0 {
+		return expr
+	}
+	rewritten, err := ast.TransformVars(expr.Copy(), func(v ast.Var) (ast.Value, error) {
+		if m, ok := metadata[v]; ok {
+			return m.Name, nil
+		}
+		return v, nil
+	})
+	if err != nil {
+		return expr
+	}
+	return rewritten.(*ast.Expr)
+}
+
+// exprLocals returns the values bound to the variables of an expression by their names in
+// the policy, leaving out those generated by the compiler
+func exprLocals(expr *ast.Expr, locals *ast.ValueMap, metadata map[ast.Var]topdown.VarMetadata) map[string]interface{} {
+	values := map[string]interface{}{}
+	ast.WalkVars(expr, func(v ast.Var) bool {
+		if name, ok := localName(v, metadata); ok {
+			if value := locals.Get(v); value != nil {
+				values[name] = nativeValue(value)
+			}
+		}
+		return false
+	})
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
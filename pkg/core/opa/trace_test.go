@@ -0,0 +1,115 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceLog(t *testing.T) {
+	modules := Modules{
+		"mrn:iam:policy:admin": `
+package authz
+default allow = false
+allow = true { is_admin }
+is_admin { role := input.roles[_]; role == "admin" }
+`,
+	}
+	input := map[string]interface{}{"roles": []interface{}{"reader", "admin"}}
+
+	instance, err := NewCompiler(WithDefaultTracing(true)).Compile("mrn:iam:policy:admin", modules)
+	require.NoError(t, err)
+
+	log := &TraceLog{}
+	ctx := WithTraceLog(context.Background(), log)
+	output := captureStdout(func() {
+		_, policyErr := instance.Evaluate(ctx, "x = data.authz.allow", input)
+		assert.Nil(t, policyErr)
+	})
+	assert.Equal(t, "", output, "the trace is collected rather than printed")
+
+	policies := log.Policies()
+	require.Len(t, policies, 1)
+	trace := policies[0]
+	assert.Equal(t, "mrn:iam:policy:admin", trace.Policy)
+	assert.Equal(t, "x = data.authz.allow", trace.Query)
+	assert.Equal(t, map[string]interface{}{"x": true}, trace.Bindings)
+	require.NotEmpty(t, trace.Events)
+
+	var entered []string
+	var locals []map[string]interface{}
+	for _, evt := range trace.Events {
+		assert.Positive(t, evt.Depth)
+		if evt.Op == "Enter" {
+			entered = append(entered, evt.Node)
+		}
+		if evt.Op == "Eval" && evt.Locals != nil {
+			locals = append(locals, evt.Locals)
+		}
+	}
+	assert.Contains(t, entered, "data.authz.allow")
+	assert.Contains(t, entered, "data.authz.is_admin")
+	assert.Contains(t, locals, map[string]interface{}{"role": "admin"})
+
+	data, err := json.Marshal(log)
+	require.NoError(t, err)
+	var decoded struct {
+		Policies []struct {
+			Policy string `json:"policy"`
+			Events []struct {
+				Op       string `json:"op"`
+				Location *struct {
+					File string `json:"file"`
+					Row  int    `json:"row"`
+				} `json:"location"`
+			} `json:"events"`
+		} `json:"policies"`
+	}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Len(t, decoded.Policies, 1)
+	assert.Equal(t, "mrn:iam:policy:admin", decoded.Policies[0].Policy)
+	located := false
+	for _, evt := range decoded.Policies[0].Events {
+		located = located || (evt.Location != nil && evt.Location.File == "mrn:iam:policy:admin" && evt.Location.Row == 5)
+	}
+	assert.True(t, located, "events carry the location of their node")
+
+	var folded bytes.Buffer
+	require.NoError(t, log.WriteFolded(&folded, "admin; test"))
+	lines := strings.Split(strings.TrimSpace(folded.String()), "\n")
+	require.NotEmpty(t, lines)
+	total := 0
+	for _, line := range lines {
+		assert.True(t, strings.HasPrefix(line, "admin, test;mrn:iam:policy:admin;query"), line)
+		n, err := strconv.Atoi(line[strings.LastIndex(line, " ")+1:])
+		require.NoError(t, err, line)
+		total += n
+	}
+	assert.Equal(t, len(trace.Events), total, "each step is counted once")
+	assert.Contains(t, folded.String(), "query;data.authz.allow:4;data.authz.is_admin:5 ")
+}
+
+func TestTraceLog_Untraced(t *testing.T) {
+	modules := Modules{"test.rego": "package authz\ndefault allow = true\n"}
+	instance, err := NewCompiler(WithDefaultTracing(true), WithTraceFilter([]string{"other"})).Compile("mrn:iam:policy:test", modules)
+	require.NoError(t, err)
+
+	log := &TraceLog{}
+	_, policyErr := instance.Evaluate(WithTraceLog(context.Background(), log), "data.authz.allow", nil)
+	assert.Nil(t, policyErr)
+	assert.Empty(t, log.Policies(), "policies outside the trace filter are not collected")
+
+	data, err := json.Marshal(log)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"policies": []}`, string(data))
+}
@@ -31,18 +31,41 @@
 // Engine configuration:
 //   - [WithBackend]: Configure the policy storage backend
 //   - [WithAccessLog]: Configure the access log destination
+//   - [WithAuditRedactor]: Redact sensitive fields before records reach the access log
 //   - [WithCompilerOptions]: Configure OPA compiler settings
+//   - [WithBuiltins]: Register custom Rego built-in functions
+//   - [WithDecisionCacheTTL]: Let enforcement points cache GRANTs
+//   - [WithDecisionMetrics]: Count decisions by bounded labels for monitoring
+//   - [WithSamplingCounters]: Count the access records emitted and dropped by sampling
+//   - [WithConsentChecker]: Check data-subject consent for consent-gated resources
+//   - [WithApprovalNotifier]: Be told of requests for operations that require approval
+//   - [WithApprovalStore]: Share approval requests between engines
+//   - [WithRevocationChecker]: Deny principals whose token or session was revoked
+//   - [WithGeoLocator]: Locate the client addresses of requests
+//   - [WithCalendars]: Give policies the business calendars of realms
+//   - [WithRiskProvider]: Give policies the risk score of each request
 //
 // Authorization configuration:
 //   - [SetProbeMode]: Enable/disable probe mode for capability discovery
+//   - [SetCorrelationID]: Tag the access record with an external request identifier
+//   - [SetMapper]: Record the mapper that produced the PORC
+//   - [SetTenant]: Restrict policy lookups to the domains registered for a tenant
 package options
 
 import (
+	"time"
+
 	"github.com/manetu/policyengine/internal/logging"
 	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
 	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/calendar"
 	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/consent"
+	"github.com/manetu/policyengine/pkg/core/geo"
 	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/revocation"
+	"github.com/manetu/policyengine/pkg/core/risk"
 )
 
 var logger = logging.GetLogger("policyengine")
@@ -58,10 +81,39 @@ var agent = "policyengine"
 //   - AccessLogFactory: Creates the stream for audit logging (default: stdout)
 //   - BackendFactory: Creates the policy storage backend (default: mock)
 //   - CompilerOptions: OPA compiler configuration (default: RegoV0, standard capabilities)
+//   - AuditRedactor: Redacts access records before they are sent (default: from configuration)
+//   - Builtins: Custom Rego built-in functions available to policies and mappers (default: none)
+//   - DecisionCacheTTL: Longest time a policy enforcement point may reuse a GRANT (default: from configuration)
+//   - DecisionMetrics: Counts every audited decision (default: none)
+//   - SamplingCounters: Counts the access records emitted and dropped by sampling (default: none)
+//   - ConsentChecker: Checks the consent of data subjects for consent-gated resources (default: none)
+//   - ApprovalNotifier: Told of each approval request opened (default: none)
+//   - ApprovalStore: Holds the approval requests (default: a store of the engine's own)
+//   - RevocationChecker: Checks whether principals' tokens were revoked (default: none)
+//   - GeoLocator: Locates the client addresses of requests (default: the geo.database config, if any)
+//   - Calendars: The business calendars of realms (default: the calendars config, if any)
+//   - RiskProvider: Scores the risk of requests (default: none)
+//   - EvaluationConcurrency: Most policies evaluated at once across requests (default: from configuration)
+//   - EvaluationFanout: Most roles, scopes, or groups of a request processed at once (default: from configuration)
 type EngineOptions struct {
-	AccessLogFactory accesslog.Factory
-	BackendFactory   backend.Factory
-	CompilerOptions  []opa.CompilerOptionFunc
+	AccessLogFactory  accesslog.Factory
+	BackendFactory    backend.Factory
+	CompilerOptions   []opa.CompilerOptionFunc
+	AuditRedactor     accesslog.Redactor
+	Builtins          []*opa.Builtin
+	DecisionCacheTTL  time.Duration
+	DecisionMetrics   *accesslog.DecisionMetrics
+	SamplingCounters  *accesslog.SamplingCounters
+	ConsentChecker    consent.Checker
+	ApprovalNotifier  approval.Notifier
+	ApprovalStore     *approval.Store
+	RevocationChecker revocation.Checker
+	GeoLocator        geo.Locator
+	Calendars         *calendar.Calendars
+	RiskProvider      risk.Provider
+
+	EvaluationConcurrency int
+	EvaluationFanout      int
 }
 
 // EngineOptionsFunc is a functional option for configuring [EngineOptions].
@@ -89,6 +141,33 @@ func WithAccessLog(factory accesslog.Factory) EngineOptionsFunc {
 	}
 }
 
+// WithAuditRedactor configures a redactor applied to every access record
+// before it is sent to the access log.
+//
+// Access records include the full PORC, which may carry JWT claims and PII
+// annotations that should not be retained in audit storage. The redactor
+// may remove or obscure such fields; policies are always evaluated against
+// the unredacted input. Use [accesslog.NewFieldRedactor] to strip or hash
+// fields by path, or implement [accesslog.Redactor] for custom rules.
+//
+// The redactor replaces any rules set through the audit.redaction
+// configuration.
+//
+// Example:
+//
+//	redactor, _ := accesslog.NewFieldRedactor(accesslog.RedactionOptions{
+//	    Strip: []string{"principal.email", "principal.mannotations.ssn"},
+//	    Hash:  []string{"principal.sub"},
+//	})
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithAuditRedactor(redactor),
+//	)
+func WithAuditRedactor(redactor accesslog.Redactor) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.AuditRedactor = redactor
+	}
+}
+
 // WithBackend configures the policy storage backend for the engine.
 //
 // The backend is responsible for loading and serving policy data including
@@ -138,6 +217,251 @@ func WithCompilerOptions(opts ...opa.CompilerOptionFunc) EngineOptionsFunc {
 	}
 }
 
+// WithBuiltins registers custom Rego built-in functions with the policy engine.
+//
+// The built-ins are available to policies, libraries, and mappers alike, in
+// addition to the standard OPA built-ins. They are applied after any
+// [WithCompilerOptions], so they remain available regardless of the configured
+// capabilities or unsafe built-ins. Calling WithBuiltins more than once adds to
+// the registered set.
+//
+// Tooling that compiles Rego without the engine, such as lint, needs the
+// declarations as well; pass [opa.Builtin.Declaration] for each built-in in
+// lint.Options.Builtins.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithBuiltins(&opa.Builtin{
+//	        Decl: &rego.Function{
+//	            Name: "classification.compare",
+//	            Decl: types.NewFunction(types.Args(types.S, types.S), types.N),
+//	        },
+//	        Impl: compareClassifications,
+//	    }),
+//	)
+func WithBuiltins(builtins ...*opa.Builtin) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.Builtins = append(o.Builtins, builtins...)
+	}
+}
+
+// WithDecisionCacheTTL sets the longest time for which a policy enforcement
+// point may reuse a GRANT, which the engine reports as a hint with each
+// decision (see model.CacheHint). The hint is shorter when the principal's
+// token expires sooner, and zero for GRANTs that depend on the time, on
+// external data, or on an override.
+//
+// A TTL of zero leaves the decisions.cache.ttl configuration in effect.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithDecisionCacheTTL(30 * time.Second),
+//	)
+func WithDecisionCacheTTL(ttl time.Duration) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.DecisionCacheTTL = ttl
+	}
+}
+
+// WithDecisionMetrics counts every decision written to the access log in
+// metrics, including the decisions that sampling and rate limiting drop from
+// it. Probes are not counted, as they are not written to the access log.
+//
+// Example:
+//
+//	metrics, _ := accesslog.NewDecisionMetrics(accesslog.MetricsOptions{
+//	    Operation: accesslog.MetricsLabelOptions{Allow: []string{"api:documents"}, Buckets: 8},
+//	})
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithDecisionMetrics(metrics),
+//	)
+//	...
+//	for _, c := range metrics.Counts() {
+//	    fmt.Println(c.Values, c.Count)
+//	}
+func WithDecisionMetrics(metrics *accesslog.DecisionMetrics) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.DecisionMetrics = metrics
+	}
+}
+
+// WithSamplingCounters counts the access records that sampling and rate
+// limiting emit and drop in counters, which may be shared between engines.
+// Records are counted even when no sampling is configured, all of them as
+// emitted.
+//
+// Example:
+//
+//	counters := &accesslog.SamplingCounters{}
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithSamplingCounters(counters),
+//	)
+//	...
+//	fmt.Println(counters.Stats().Sampled)
+func WithSamplingCounters(counters *accesslog.SamplingCounters) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.SamplingCounters = counters
+	}
+}
+
+// WithConsentChecker checks the consent of data subjects with checker when a
+// policy grants access to a resource annotated as consent-gated (see
+// consent.Annotation). Without a checker, such resources are never granted by
+// their policies.
+//
+// Example:
+//
+//	records := consent.NewMemory()
+//	records.Grant("alice", "research")
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithConsentChecker(records),
+//	)
+func WithConsentChecker(checker consent.Checker) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.ConsentChecker = checker
+	}
+}
+
+// WithApprovalNotifier tells notifier of each approval request opened for an
+// operation that requires approval, such as to ask its approvers. Without a
+// notifier, the pending requests are only returned by the decisions and listed
+// by the policy engine.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithApprovalNotifier(approval.NotifierFunc(func(ctx context.Context, r approval.Request) error {
+//	        return chat.Post(approversChannel, fmt.Sprintf("%s requests %s on %s: %s", r.Subject, r.Operation, r.Resource, r.ID))
+//	    })),
+//	)
+func WithApprovalNotifier(notifier approval.Notifier) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.ApprovalNotifier = notifier
+	}
+}
+
+// WithApprovalStore keeps the approval requests of the engine in store, such
+// as to set how long requests may be approved and redeemed, or to share them
+// between engines deciding the same requests. Without a store, each engine
+// keeps its own, whose requests expire after approval.DefaultTTL.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithApprovalStore(approval.NewStore(15 * time.Minute)),
+//	)
+func WithApprovalStore(store *approval.Store) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.ApprovalStore = store
+	}
+}
+
+// WithRevocationChecker consults checker before evaluating any policy, denying
+// principals whose token, identified by its jti claim, or session, identified
+// by its sid claim, was revoked, whatever the policies would decide. A failed
+// check also denies. Principals without either claim are not checked.
+//
+// Example:
+//
+//	revoked := revocation.NewMemory()
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithRevocationChecker(revoked),
+//	)
+//	revoked.RevokeSession(sid, expiry)
+func WithRevocationChecker(checker revocation.Checker) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.RevocationChecker = checker
+	}
+}
+
+// WithGeoLocator locates the client addresses of requests, given by their
+// context.ip, with locator, for the geo.lookup built-in and the network rules
+// of scopes and resource groups. It takes precedence over a MaxMind DB
+// configured with config.GeoDatabase.
+//
+// Example:
+//
+//	locator, err := geo.OpenMaxMind("/var/lib/geoip/GeoLite2-City.mmdb")
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithGeoLocator(locator),
+//	)
+func WithGeoLocator(locator geo.Locator) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.GeoLocator = locator
+	}
+}
+
+// WithCalendars gives policies the moment of each request in the business
+// calendar of its principal's realm, as input.calendar and through the
+// calendar.business_hours, calendar.between, and calendar.now built-ins. It
+// takes precedence over the calendars configured with config.Calendars.
+//
+// Example:
+//
+//	business, err := calendar.New(calendar.Options{Timezone: "America/New_York", Hours: "09:00-17:00"})
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithCalendars(&calendar.Calendars{Default: business}),
+//	)
+func WithCalendars(calendars *calendar.Calendars) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.Calendars = calendars
+	}
+}
+
+// WithRiskProvider asks provider to score the risk of each request before
+// evaluating any policy, and gives policies the score as context.risk, such as
+// to deny sensitive operations to risky requests. A provider that fails, or does
+// not answer within config.RiskTimeout, is given the config.RiskDefault score.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithRiskProvider(fraudService),
+//	)
+func WithRiskProvider(provider risk.Provider) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.RiskProvider = provider
+	}
+}
+
+// WithEvaluationConcurrency bounds the role and scope policies the engine
+// evaluates at once, across all requests. Evaluations beyond the limit wait for
+// one to finish, and fail if their request is cancelled first.
+//
+// A limit of zero leaves the evaluation.concurrency configuration in effect,
+// and a negative limit leaves evaluations unbounded.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithEvaluationConcurrency(4 * runtime.GOMAXPROCS(0)),
+//	)
+func WithEvaluationConcurrency(limit int) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.EvaluationConcurrency = limit
+	}
+}
+
+// WithEvaluationFanout bounds the roles, scopes, and groups of one request that
+// the engine fetches and evaluates at once, so that a principal with hundreds of
+// scopes processes them through a few workers rather than as many goroutines.
+//
+// A limit of zero leaves the evaluation.fanout configuration in effect, and a
+// negative limit leaves the fan-out unbounded.
+//
+// Example:
+//
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithEvaluationFanout(8),
+//	)
+func WithEvaluationFanout(limit int) EngineOptionsFunc {
+	return func(o *EngineOptions) {
+		o.EvaluationFanout = limit
+	}
+}
+
 // AuthzOptions holds configuration for individual authorization calls.
 //
 // AuthzOptions is typically not created directly. Instead, use functional
@@ -145,8 +469,17 @@ func WithCompilerOptions(opts ...opa.CompilerOptionFunc) EngineOptionsFunc {
 //
 // Fields:
 //   - Probe: When true, evaluates policies without logging to the access log
+//   - CorrelationID: Optional identifier recorded in the access record metadata
+//   - Tenant: Optional tenant key used to isolate policy lookups
+//   - MapperDomain, MapperID: Optional mapper that produced the PORC, recorded in the access record
+//   - PhaseResults: When true, the decision reports the outcome of each phase
 type AuthzOptions struct {
-	Probe bool
+	Probe         bool
+	CorrelationID string
+	Tenant        string
+	MapperDomain  string
+	MapperID      string
+	PhaseResults  bool
 }
 
 // AuthzOptionsFunc is a functional option for configuring [AuthzOptions].
@@ -188,3 +521,61 @@ func SetProbeMode(probe bool) AuthzOptionsFunc {
 		o.Probe = probe
 	}
 }
+
+// SetCorrelationID records an external identifier in the access record
+// produced by an authorization call.
+//
+// The identifier is emitted as metadata.correlationId and allows the decision
+// to be joined with telemetry from other systems, such as the x-request-id
+// assigned by an Envoy proxy:
+//
+//	allowed, _ := pe.Authorize(ctx, porc, options.SetCorrelationID(requestID))
+func SetCorrelationID(id string) AuthzOptionsFunc {
+	return func(o *AuthzOptions) {
+		o.CorrelationID = id
+	}
+}
+
+// SetMapper records, in the access record produced by an authorization call,
+// the mapper that translated the original request into the PORC.
+//
+//	mapper, _ := be.GetMapper(ctx, domain)
+//	porc, _ := mapper.Evaluate(ctx, request)
+//	allowed, _ := pe.Authorize(ctx, porc, options.SetMapper(mapper.Domain, mapper.ID))
+func SetMapper(domain, id string) AuthzOptionsFunc {
+	return func(o *AuthzOptions) {
+		o.MapperDomain = domain
+		o.MapperID = id
+	}
+}
+
+// SetTenant scopes an authorization call to a tenant.
+//
+// When the backend is configured for multi-tenancy (see
+// local.WithTenant), role, group, scope, operation, resource, and
+// policy lookups are restricted to the domains registered for the tenant,
+// preventing one tenant's policies from influencing another's decisions.
+// Backends without tenancy configured ignore the tenant.
+//
+//	allowed, _ := pe.Authorize(ctx, porc, options.SetTenant(realm))
+func SetTenant(tenant string) AuthzOptionsFunc {
+	return func(o *AuthzOptions) {
+		o.Tenant = tenant
+	}
+}
+
+// SetPhaseResults requests the outcome of each phase of the decision, returned in
+// [core.Decision] Phases by [core.PolicyEngine.Decide].
+//
+// Each [types.PhaseResult] reports an entity evaluated in a phase, such as a role
+// of the principal, with its decision and reason code, which helps explain a DENY
+// without reading the access log:
+//
+//	d, _ := pe.Decide(ctx, porc, options.SetPhaseResults(true))
+//
+// Phase results are not collected by default, to spare their allocation.
+func SetPhaseResults(enabled bool) AuthzOptionsFunc {
+	return func(o *AuthzOptions) {
+		o.PhaseResults = enabled
+	}
+}
@@ -0,0 +1,210 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package override provides temporary per-principal overrides of policy decisions.
+//
+// An override applies to every request made by one subject, optionally within a
+// single realm, until it expires. It is evaluated before any policy:
+//   - A [Deny] override denies every request of the subject, such as while a
+//     compromised account is being investigated
+//   - A [BreakGlass] override grants every request of the subject, such as to
+//     let an operator recover from an incident. It requires a justification
+//
+// Every decision made by an override produces an access record with
+// system_override set and an override entry carrying the override's id,
+// justification, and expiry.
+//
+// Overrides are registered through the policy engine:
+//
+//	o, err := pe.AddOverride(override.Override{
+//	    Type:          override.BreakGlass,
+//	    Subject:       "alice@example.com",
+//	    Justification: "INC-1234: restore payments service",
+//	    CreatedBy:     "bob@example.com",
+//	    Expires:       time.Now().Add(time.Hour),
+//	})
+//
+// or with the overrides key of the engine configuration.
+package override
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Type identifies the effect of an [Override].
+type Type string
+
+const (
+	// Deny denies every request of the subject.
+	Deny Type = "deny"
+
+	// BreakGlass grants every request of the subject.
+	BreakGlass Type = "break-glass"
+)
+
+// Override is a temporary decision for every request of a subject.
+//
+// Fields:
+//   - ID: Identifies the override. Assigned by [Store.Add] when empty
+//   - Type: [Deny] or [BreakGlass]
+//   - Subject: The principal's sub claim
+//   - Realm: Restricts the override to the principal's mrealm. Empty matches every realm
+//   - Justification: Why the override exists. Required for [BreakGlass]
+//   - CreatedBy: Who registered the override (optional)
+//   - Expires: When the override stops applying
+type Override struct {
+	ID            string
+	Type          Type
+	Subject       string
+	Realm         string
+	Justification string
+	CreatedBy     string
+	Expires       time.Time
+}
+
+// Validate reports whether the override can be registered at the given time.
+func (o *Override) Validate(now time.Time) error {
+	switch o.Type {
+	case Deny, BreakGlass:
+	default:
+		return fmt.Errorf("unknown override type '%s', must be '%s' or '%s'", o.Type, Deny, BreakGlass)
+	}
+	if o.Subject == "" {
+		return fmt.Errorf("override requires a subject")
+	}
+	if o.Type == BreakGlass && o.Justification == "" {
+		return fmt.Errorf("break-glass override for '%s' requires a justification", o.Subject)
+	}
+	if o.Expires.IsZero() {
+		return fmt.Errorf("override for '%s' requires an expiry", o.Subject)
+	}
+	if !o.Expires.After(now) {
+		return fmt.Errorf("override for '%s' expired at %s", o.Subject, o.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// matches reports whether the override applies to the principal at the given time.
+func (o *Override) matches(subject, realm string, now time.Time) bool {
+	return o.Subject == subject && (o.Realm == "" || o.Realm == realm) && o.Expires.After(now)
+}
+
+// Store holds the overrides registered with a policy engine.
+//
+// Store is safe for concurrent use. Expired overrides no longer match and are
+// removed as new overrides are added.
+type Store struct {
+	mu        sync.RWMutex
+	overrides map[string]Override
+}
+
+// NewStore creates an empty [Store].
+func NewStore() *Store {
+	return &Store{overrides: make(map[string]Override)}
+}
+
+// Add registers an override and returns it with its ID assigned.
+//
+// Returns an error if the override is invalid (see [Override.Validate]) or if an
+// override with the same ID is already registered.
+func (s *Store) Add(o Override) (Override, error) {
+	now := time.Now()
+	if err := o.Validate(now); err != nil {
+		return Override{}, err
+	}
+	if o.ID == "" {
+		o.ID = uuid.New().String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, existing := range s.overrides {
+		if !existing.Expires.After(now) {
+			delete(s.overrides, id)
+		}
+	}
+	if _, ok := s.overrides[o.ID]; ok {
+		return Override{}, fmt.Errorf("override '%s' already exists", o.ID)
+	}
+	s.overrides[o.ID] = o
+
+	return o, nil
+}
+
+// Remove revokes the override with the given ID. Returns false if no such
+// override is registered.
+func (s *Store) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.overrides[id]; !ok {
+		return false
+	}
+	delete(s.overrides, id)
+	return true
+}
+
+// List returns the overrides that have not expired, ordered by expiry.
+func (s *Store) List() []Override {
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Override, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		if o.Expires.After(now) {
+			result = append(result, o)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Expires.Equal(result[j].Expires) {
+			return result[i].Expires.Before(result[j].Expires)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Match returns the override that decides requests of the principal at the given
+// time, or nil if none applies.
+//
+// A [Deny] override takes precedence over a [BreakGlass] override. Among overrides
+// of the same type, the one that expires last is returned.
+func (s *Store) Match(subject, realm string, now time.Time) *Override {
+	if subject == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var match *Override
+	for _, o := range s.overrides {
+		if !o.matches(subject, realm, now) {
+			continue
+		}
+		if match == nil || precedes(&o, match) {
+			match = &o
+		}
+	}
+	return match
+}
+
+// precedes reports whether override a decides a request in preference to b.
+func precedes(a, b *Override) bool {
+	if a.Type != b.Type {
+		return a.Type == Deny
+	}
+	if !a.Expires.Equal(b.Expires) {
+		return a.Expires.After(b.Expires)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,98 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package override
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_AddValidates(t *testing.T) {
+	s := NewStore()
+	expires := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		override Override
+		errMsg   string
+	}{
+		{"unknown type", Override{Type: "allow", Subject: "alice", Expires: expires}, "unknown override type 'allow'"},
+		{"missing subject", Override{Type: Deny, Expires: expires}, "requires a subject"},
+		{"break-glass without justification", Override{Type: BreakGlass, Subject: "alice", Expires: expires}, "requires a justification"},
+		{"missing expiry", Override{Type: Deny, Subject: "alice"}, "requires an expiry"},
+		{"expired", Override{Type: Deny, Subject: "alice", Expires: time.Now().Add(-time.Minute)}, "expired at"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Add(tt.override)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+	assert.Empty(t, s.List())
+}
+
+func TestStore_AddRemoveList(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+
+	deny, err := s.Add(Override{Type: Deny, Subject: "mallory", Expires: now.Add(2 * time.Hour)})
+	require.NoError(t, err)
+	assert.NotEmpty(t, deny.ID)
+
+	glass, err := s.Add(Override{ID: "inc-1", Type: BreakGlass, Subject: "alice", Justification: "INC-1", Expires: now.Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Equal(t, "inc-1", glass.ID)
+
+	_, err = s.Add(Override{ID: "inc-1", Type: Deny, Subject: "bob", Expires: now.Add(time.Hour)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already exists")
+
+	// ordered by expiry
+	assert.Equal(t, []Override{glass, deny}, s.List())
+
+	assert.True(t, s.Remove("inc-1"))
+	assert.False(t, s.Remove("inc-1"))
+	assert.Equal(t, []Override{deny}, s.List())
+}
+
+func TestStore_Match(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+
+	_, err := s.Add(Override{ID: "glass", Type: BreakGlass, Subject: "alice", Justification: "INC-1", Expires: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.Add(Override{ID: "realm", Type: Deny, Subject: "bob", Realm: "prod", Expires: now.Add(time.Hour)})
+	require.NoError(t, err)
+
+	m := s.Match("alice", "any", now)
+	require.NotNil(t, m)
+	assert.Equal(t, "glass", m.ID)
+
+	assert.Nil(t, s.Match("carol", "", now))
+	assert.Nil(t, s.Match("", "", now))
+
+	// realm-scoped overrides apply only within their realm
+	assert.Nil(t, s.Match("bob", "dev", now))
+	m = s.Match("bob", "prod", now)
+	require.NotNil(t, m)
+	assert.Equal(t, "realm", m.ID)
+
+	// deny takes precedence over break-glass
+	_, err = s.Add(Override{ID: "deny", Type: Deny, Subject: "alice", Expires: now.Add(30 * time.Minute)})
+	require.NoError(t, err)
+	m = s.Match("alice", "", now)
+	require.NotNil(t, m)
+	assert.Equal(t, "deny", m.ID)
+
+	// expired overrides no longer match
+	m = s.Match("alice", "", now.Add(45*time.Minute))
+	require.NotNil(t, m)
+	assert.Equal(t, "glass", m.ID)
+	assert.Nil(t, s.Match("alice", "", now.Add(2*time.Hour)))
+}
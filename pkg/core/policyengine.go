@@ -47,23 +47,102 @@
 //
 //	allowed, err := pe.Authorize(ctx, porc, options.SetProbeMode(true))
 //
+// # Obligations
+//
+// Policies may attach structured obligations, such as a rate-limit quota, to a
+// GRANT. Use [PolicyEngine.Decide] instead of Authorize to receive them:
+//
+//	decision, err := pe.Decide(ctx, porc)
+//
+// # Overrides
+//
+// Temporary per-principal overrides deny every request of a subject, or grant
+// them with break-glass access, before any policy is evaluated. Each decision
+// they make is recorded in the access log with the override and its expiry:
+//
+//	o, err := pe.AddOverride(override.Override{
+//	    Type:    override.Deny,
+//	    Subject: "mallory@example.com",
+//	    Expires: time.Now().Add(24 * time.Hour),
+//	})
+//
+// See the [override] package for details.
+//
+// # Approvals
+//
+// Operations declared with requires-approval are granted only once other
+// principals have approved the request. Until then, their decisions are PENDING
+// on an approval request, which approvers approve through the engine:
+//
+//	r, err := pe.Approve(decision.Approval.ID, "bob@example.com")
+//
+// See the [approval] package for details.
+//
+// # Revocation
+//
+// A revocation checker denies principals whose token or session was revoked,
+// before overrides or policies are consulted, so that a revoked token is denied
+// immediately rather than when it expires:
+//
+//	pe, err := core.NewPolicyEngine(options.WithRevocationChecker(checker))
+//
+// See the [github.com/manetu/policyengine/pkg/core/revocation] package for details.
+//
+// # Network Origin
+//
+// Requests give the address of their client in context.ip, which policies check with
+// the net.cidr_contains_ctx and geo.lookup built-ins, and scopes and resource groups
+// with their network rules. A locator, or the MaxMind DB of the geo.database
+// configuration, locates the clients:
+//
+//	pe, err := core.NewPolicyEngine(options.WithGeoLocator(locator))
+//
+// See the [github.com/manetu/policyengine/pkg/core/geo] package for details.
+//
+// # Business Calendars
+//
+// Policies granting access only during business hours read the moment of each request
+// in the business calendar of its principal's realm, given as input.calendar and through
+// the calendar.business_hours, calendar.between, and calendar.now built-ins. Calendars
+// are given with [options.WithCalendars], or configured as calendars:
+//
+//	pe, err := core.NewPolicyEngine(options.WithCalendars(&calendar.Calendars{Default: business}))
+//
+// See the [github.com/manetu/policyengine/pkg/core/calendar] package for details.
+//
+// # Risk Scores
+//
+// A risk provider scores each request before any policy is evaluated, giving adaptive
+// policies the score as context.risk and recording it in the access record:
+//
+//	pe, err := core.NewPolicyEngine(options.WithRiskProvider(provider))
+//
+// See the [github.com/manetu/policyengine/pkg/core/risk] package for details.
+//
 // See the [options] package for all available configuration options.
 package core
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/manetu/policyengine/internal/core"
 	"github.com/manetu/policyengine/internal/core/backend/mock"
 	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/common"
 	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/approval"
 	"github.com/manetu/policyengine/pkg/core/backend"
 	"github.com/manetu/policyengine/pkg/core/backend/local"
 	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/model"
 	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/override"
 	"github.com/manetu/policyengine/pkg/core/types"
 	"github.com/manetu/policyengine/pkg/policydomain/registry"
 	"github.com/pkg/errors"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
 var logger = logging.GetLogger("policyengine")
@@ -88,11 +167,105 @@ type PolicyEngine interface {
 	// Returns an error if the PORC is malformed or evaluation fails.
 	Authorize(ctx context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (bool, error)
 
+	// Decide evaluates an authorization request like [PolicyEngine.Authorize],
+	// and also returns the obligations attached to the decision by policies.
+	//
+	// Returns an error if the PORC is malformed.
+	Decide(ctx context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (*Decision, error)
+
+	// ListPermittedOperations returns the operations that would be granted to the
+	// principal on the resource, for example to show only the actions a user can
+	// take.
+	//
+	// Returns an error if the backend cannot list its operations.
+	ListPermittedOperations(ctx context.Context, principal map[string]interface{}, resource interface{}, authzOptions ...options.AuthzOptionsFunc) ([]string, error)
+
+	// WarmUp prepares every policy served by the backend for evaluation, so that
+	// the first authorization requests do not pay for query preparation.
+	//
+	// Calling WarmUp is optional. Returns an error if a policy cannot be
+	// prepared.
+	WarmUp(ctx context.Context) error
+
+	// Health checks that the backend can serve policy data, such as that a
+	// remote policy store is reachable.
+	//
+	// Returns nil for backends that do not implement [backend.HealthChecker].
+	Health(ctx context.Context) error
+
+	// Subscribe opens a subscription receiving the access record of each
+	// following decision, buffering up to size records.
+	//
+	// Close the subscription when it is no longer needed.
+	Subscribe(size int) *accesslog.Subscription
+
 	// GetBackend returns the underlying backend service used for policy retrieval.
 	//
 	// This is useful for advanced use cases where direct access to policy data
 	// is needed, such as debugging or policy introspection.
 	GetBackend() backend.Service
+
+	// GetBundleInfo returns the revision and domain fingerprints of the policy
+	// bundle currently serving decisions.
+	//
+	// The same information is recorded in every AccessRecord, allowing audits to
+	// state exactly which policy version produced a decision. Returns nil if the
+	// backend does not track bundle identity (see [backend.BundleInfoProvider]).
+	GetBundleInfo() *model.BundleInfo
+
+	// AddOverride registers a temporary override that decides every request of a
+	// subject before any policy is evaluated, and returns it with its ID assigned.
+	//
+	// Returns an error if the override is invalid, such as a break-glass
+	// override without a justification (see [override.Override.Validate]).
+	AddOverride(o override.Override) (override.Override, error)
+
+	// RemoveOverride revokes the override with the given ID. Returns false if no
+	// such override is registered.
+	RemoveOverride(id string) bool
+
+	// ListOverrides returns the registered overrides that have not expired,
+	// ordered by expiry.
+	ListOverrides() []override.Override
+
+	// Approve records the approval of the pending approval request with the
+	// given ID by approver, and returns the request.
+	//
+	// Returns an error if the request does not exist or has expired, or if the
+	// approver is the request's subject or has already approved it.
+	Approve(id, approver string) (approval.Request, error)
+
+	// ListApprovals returns the approval requests that have not expired,
+	// ordered by creation.
+	ListApprovals() []approval.Request
+}
+
+// Decision is the outcome of an authorization request returned by [PolicyEngine.Decide].
+//
+// Obligations let policies pass structured values, such as a rate-limit quota, to the
+// policy enforcement point along with a GRANT. Each policy that grants the request may
+// contribute obligations (see [model.Obligations]). When several policies return the same
+// obligation, the first one is kept, in phase order: operation, identity, resource, then
+// scope. Within the identity phase, roles are considered in MRN order, and within the scope
+// phase, scopes are considered in the order the principal lists them.
+//
+// A DENY never carries obligations.
+type Decision struct {
+	// Allow is true if the request is authorized.
+	Allow bool
+	// Obligations holds the obligations of the policies that granted the request.
+	Obligations model.Obligations
+	// Cache advises how long the enforcement point may reuse the decision for identical
+	// requests. Its TTL is zero unless a decision cache TTL is configured (see
+	// [options.WithDecisionCacheTTL]).
+	Cache model.CacheHint
+	// Phases holds the outcome of each entity evaluated, in phase order, when
+	// requested with [options.SetPhaseResults].
+	Phases []types.PhaseResult
+	// Approval holds the approval request of an operation that requires approval:
+	// the request the decision is pending on, or the approved request it redeemed.
+	// It is nil for other operations, and in probe mode.
+	Approval *approval.Request
 }
 
 // PolicyEngineImpl is the default implementation of the [PolicyEngine] interface.
@@ -103,7 +276,7 @@ type PolicyEngine interface {
 //
 // Use [NewPolicyEngine] to create a properly initialized instance.
 type PolicyEngineImpl struct {
-	instance core.PolicyEngine
+	instance *core.PolicyEngine
 }
 
 // NewPolicyEngine creates and initializes a new [PolicyEngine] instance.
@@ -142,7 +315,7 @@ func NewPolicyEngine(engineOptions ...options.EngineOptionsFunc) (PolicyEngine,
 	}
 
 	return &PolicyEngineImpl{
-		instance: *instance,
+		instance: instance,
 	}, nil
 }
 
@@ -195,9 +368,40 @@ func NewLocalPolicyEngine(domainPaths []string, engineOptions ...options.EngineO
 //
 // The authorization decision and any evaluation errors are logged to the
 // configured access log (unless probe mode is enabled).
+//
+// Returns a [common.PolicyError] that is [common.ErrInvalidParam] if the PORC
+// cannot be parsed.
 func (pe *PolicyEngineImpl) Authorize(ctx context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (bool, error) {
-	logger.Debug(agent, "Authorize", "Enter")
-	defer logger.Debug(agent, "Authorize", "Exit")
+	decision, err := pe.Decide(ctx, porc, authzOptions...)
+	if err != nil {
+		return false, err
+	}
+
+	return decision.Allow, nil
+}
+
+// Decide evaluates an authorization request and returns the decision along with
+// any obligations the granting policies attached to it.
+//
+// Policies attach obligations by returning an object from their allow rule:
+//
+//	allow = {"allow": true, "quota": {"limit": 100, "window": "1m"}} {
+//	    input.principal.sub != ""
+//	}
+//
+// The enforcement point can then apply them to the granted request:
+//
+//	decision, err := pe.Decide(ctx, porc)
+//	if err == nil && decision.Allow {
+//	    if quota, ok := decision.Obligations["quota"]; ok {
+//	        enforceQuota(quota)
+//	    }
+//	}
+//
+// See [Decision] for how obligations from multiple policies are combined.
+func (pe *PolicyEngineImpl) Decide(ctx context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (*Decision, error) {
+	logger.Debug(agent, "Decide", "Enter")
+	defer logger.Debug(agent, "Decide", "Exit")
 
 	opts := &options.AuthzOptions{Probe: false}
 	for _, o := range authzOptions {
@@ -206,13 +410,93 @@ func (pe *PolicyEngineImpl) Authorize(ctx context.Context, porc types.AnyPORC, a
 
 	input, err := types.UnmarshalPORC(porc)
 	if err != nil {
-		return false, err
+		return nil, common.WrapError(events.AccessRecord_BundleReference_INVALPARAM_ERROR, fmt.Sprintf("invalid PORC: %s", err), err)
+	}
+
+	authz, obligations, cache, phases, request := pe.instance.Authorize(ctx, input, opts)
+	logger.Debugf(agent, "Decide", "returned from authorize(): %t", authz)
+
+	return &Decision{Allow: authz, Obligations: obligations, Cache: cache, Phases: phases, Approval: request}, nil
+}
+
+// ListPermittedOperations returns, sorted, the operations that would be granted to
+// the principal on the resource, for building UI affordances or reviewing whether a
+// principal holds more access than it needs:
+//
+//	ops, err := pe.ListPermittedOperations(ctx, map[string]interface{}{
+//	    "sub":    "alice@example.com",
+//	    "mroles": []string{"mrn:iam:role:editor"},
+//	}, "mrn:app:document:12345")
+//
+// The resource is an MRN or a resource descriptor, as in a PORC. Operation selectors
+// are regular expressions, so the operations cannot all be enumerated. The engine
+// considers the operations that selectors name literally, such as ^api:docs:read$,
+// and those that the policies of the operations, of the principal's roles and scopes,
+// and of the resource's group compare input.operation to, found by partially
+// evaluating the policies. Each of these operations is then decided in probe mode,
+// with the given options and an empty context, and listed if granted. An operation
+// granted only through a pattern, such as startswith(input.operation, "api:"), is
+// not listed.
+//
+// Operations are listed only from backends that implement [backend.OperationLister],
+// such as the local backend.
+func (pe *PolicyEngineImpl) ListPermittedOperations(ctx context.Context, principal map[string]interface{}, resource interface{}, authzOptions ...options.AuthzOptionsFunc) ([]string, error) {
+	opts := &options.AuthzOptions{}
+	for _, o := range authzOptions {
+		o(opts)
 	}
 
-	authz := pe.instance.Authorize(ctx, input, opts)
-	logger.Debugf(agent, "Authorize", "returned from authorize(): %t", authz)
+	return pe.instance.ListPermittedOperations(ctx, principal, resource, opts)
+}
+
+// WarmUp prepares every policy served by the backend for evaluation.
+//
+// Backends that implement [backend.WarmUpper], such as the local backend, prepare
+// their policies' queries; other backends prepare them on first use. Call WarmUp
+// after loading or updating policies and before serving traffic:
+//
+//	if err := pe.WarmUp(ctx); err != nil {
+//	    log.Fatal(err)
+//	}
+func (pe *PolicyEngineImpl) WarmUp(ctx context.Context) error {
+	return pe.instance.WarmUp(ctx)
+}
+
+// Health checks that the backend can serve policy data.
+//
+// Backends that depend on a remote service implement [backend.HealthChecker];
+// other backends, such as the local backend, are always healthy. Decision points
+// may call Health periodically to report themselves degraded:
+//
+//	if err := pe.Health(ctx); err != nil {
+//	    log.Printf("backend unhealthy: %v", err)
+//	}
+func (pe *PolicyEngineImpl) Health(ctx context.Context) error {
+	return pe.instance.Health(ctx)
+}
+
+// Subscribe opens a subscription receiving the access record of each following
+// decision, so that an application can consume its decisions in-process alongside
+// the configured access log, such as to display them live:
+//
+//	sub := pe.Subscribe(1024)
+//	defer sub.Close()
+//	for record := range sub.C() {
+//	    fmt.Println(record.Principal.Subject, record.Decision)
+//	}
+//
+// Subscribers see every decision, before any sampling of the access log, but not
+// those of probe mode. Records arriving while the buffer is full are dropped and
+// counted by [accesslog.Subscription.Dropped], so that a slow subscriber never
+// delays decisions. Records are shared and must not be modified.
+func (pe *PolicyEngineImpl) Subscribe(size int) *accesslog.Subscription {
+	return pe.instance.Subscribe(size)
+}
 
-	return authz, nil
+// GetBundleInfo returns the revision and domain fingerprints of the policy bundle
+// currently serving decisions, or nil if the backend does not track them.
+func (pe *PolicyEngineImpl) GetBundleInfo() *model.BundleInfo {
+	return pe.instance.GetBundleInfo()
 }
 
 // GetBackend returns the backend service used by this policy engine.
@@ -223,3 +507,61 @@ func (pe *PolicyEngineImpl) Authorize(ctx context.Context, porc types.AnyPORC, a
 func (pe *PolicyEngineImpl) GetBackend() backend.Service {
 	return pe.instance.GetBackend()
 }
+
+// AddOverride registers a temporary deny-list or break-glass override.
+//
+// An override applies to every request of its subject, optionally within one realm,
+// until it expires. It is evaluated before any policy, and each decision it makes
+// produces an access record with system_override set, a DENY_LISTED or BREAK_GLASS
+// reason, and the override's id, justification, and expiry. These records are never
+// dropped by audit sampling or rate limiting:
+//
+//	o, err := pe.AddOverride(override.Override{
+//	    Type:          override.BreakGlass,
+//	    Subject:       "alice@example.com",
+//	    Justification: "INC-1234: restore payments service",
+//	    Expires:       time.Now().Add(time.Hour),
+//	})
+//	...
+//	pe.RemoveOverride(o.ID)
+//
+// A deny override takes precedence over a break-glass override for the same subject.
+func (pe *PolicyEngineImpl) AddOverride(o override.Override) (override.Override, error) {
+	return pe.instance.AddOverride(o)
+}
+
+// RemoveOverride revokes the override with the given ID, returning false if it is
+// not registered.
+func (pe *PolicyEngineImpl) RemoveOverride(id string) bool {
+	return pe.instance.RemoveOverride(id)
+}
+
+// ListOverrides returns the registered overrides that have not expired, ordered by
+// expiry.
+func (pe *PolicyEngineImpl) ListOverrides() []override.Override {
+	return pe.instance.ListOverrides()
+}
+
+// Approve records the approval of a pending approval request by approver.
+//
+// A request for an operation that requires approval is decided PENDING on an
+// approval request, which [Decision.Approval] returns and the notifier given with
+// [options.WithApprovalNotifier] is told of. Once as many principals other than
+// its subject as the operation requires have approved it, the subject repeats the
+// request with the approval request's ID as context.approval:
+//
+//	decision, _ := pe.Decide(ctx, porc) // PENDING
+//	pe.Approve(decision.Approval.ID, "bob@example.com")
+//	pe.Approve(decision.Approval.ID, "carol@example.com")
+//
+//	porc["context"] = map[string]interface{}{"approval": decision.Approval.ID}
+//	allowed, _ := pe.Authorize(ctx, porc) // GRANT, once
+func (pe *PolicyEngineImpl) Approve(id, approver string) (approval.Request, error) {
+	return pe.instance.Approve(id, approver)
+}
+
+// ListApprovals returns the approval requests that have not expired, ordered by
+// creation.
+func (pe *PolicyEngineImpl) ListApprovals() []approval.Request {
+	return pe.instance.ListApprovals()
+}
@@ -5,25 +5,43 @@
 package core_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/manetu/policyengine/internal/core/test"
+	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/common"
 	"github.com/manetu/policyengine/pkg/core"
 	"github.com/manetu/policyengine/pkg/core/accesslog"
 	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/backend/local"
 	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/model"
 	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/override"
+	"github.com/manetu/policyengine/pkg/core/revocation"
 	"github.com/manetu/policyengine/pkg/core/types"
+	"github.com/manetu/policyengine/pkg/policydomain/registry"
 	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	opatypes "github.com/open-policy-agent/opa/v1/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 // setupTestConfig configures the test environment to use the testdata config
@@ -1110,6 +1128,22 @@ func TestNoToken(t *testing.T) {
 	assert.True(t, authz)
 }
 
+func TestAuthorizeMalformedPORC(t *testing.T) {
+	pe, _, err := test.NewTestPolicyEngine(1024)
+	assert.Nil(t, err)
+
+	allowed, err := pe.Authorize(context.Background(), "{not json")
+	assert.False(t, allowed)
+	assert.ErrorIs(t, err, common.ErrInvalidParam)
+
+	var perr *common.PolicyError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, events.AccessRecord_BundleReference_INVALPARAM_ERROR, perr.ReasonCode)
+
+	_, err = pe.Authorize(context.Background(), 42)
+	assert.ErrorIs(t, err, common.ErrInvalidParam)
+}
+
 func TestNoTokenNoPrincipal(t *testing.T) {
 	ctx := context.Background()
 
@@ -1205,6 +1239,50 @@ func TestConcurrentPolicyEngineInit(t *testing.T) {
 	}
 }
 
+// TestConcurrentLocalPolicyEngineInit tests that engines loading the same domains concurrently,
+// from options shared between them, each authorize correctly.
+// Run with: go test -race -run TestConcurrentLocalPolicyEngineInit
+func TestConcurrentLocalPolicyEngineInit(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "consolidated.yml")
+
+	// spare capacity would let engines appending to the options overwrite each other's
+	compilerOpts := make([]opa.CompilerOptionFunc, 0, 8)
+	compilerOpts = append(compilerOpts, opa.WithDefaultTracing(false))
+
+	const numGoroutines = 8
+
+	var wg sync.WaitGroup
+	engines := make([]core.PolicyEngine, numGoroutines)
+	errs := make([]error, numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			engines[idx], errs[idx] = core.NewLocalPolicyEngine([]string{domainFile},
+				options.WithAccessLog(accesslog.NewNullFactory()),
+				options.WithCompilerOptions(compilerOpts...))
+		}(i)
+	}
+	wg.Wait()
+
+	porc := `{
+		"principal": {"sub": "alice@example.com", "mrealm": "test", "aud": "manetu.io", "mroles": ["mrn:iam:role:admin"]},
+		"resource": "mrn:app:document:12345",
+		"operation": "documents:read"
+	}`
+	for i := 0; i < numGoroutines; i++ {
+		require.NoError(t, errs[i], "Engine %d should not have an error", i)
+		allowed, err := engines[i].Authorize(context.Background(), porc)
+		assert.Nil(t, err)
+		assert.True(t, allowed, "Engine %d should grant the admin role", i)
+	}
+}
+
 func TestDisallowHttpSend(t *testing.T) {
 	var (
 		listener net.Listener
@@ -1265,7 +1343,8 @@ type mockAccessLog struct {
 func (m *mockAccessLog) Send(record *events.AccessRecord) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.records = append(m.records, record)
+	// the engine reuses the record once Send returns
+	m.records = append(m.records, proto.Clone(record).(*events.AccessRecord))
 	return nil
 }
 
@@ -1374,6 +1453,24 @@ func TestSetProbeMode(t *testing.T) {
 	}
 }
 
+// TestSetCorrelationID verifies that the correlation id is carried into the access record metadata
+func TestSetCorrelationID(t *testing.T) {
+	ctx := context.Background()
+	porc := "{\"principal\":{\"sub\":\"foo\",\"mrealm\":\"bar\",\"aud\":\"manetu.io\",\"mroles\":[\"USER\"]}}"
+
+	ch, pe := createPE(t, opasimple)
+
+	_, err := pe.Authorize(ctx, porc, options.SetCorrelationID("req-1234"))
+	assert.Nil(t, err)
+	record := <-ch
+	assert.Equal(t, "req-1234", record.Metadata.CorrelationId)
+
+	_, err = pe.Authorize(ctx, porc)
+	assert.Nil(t, err)
+	record = <-ch
+	assert.Empty(t, record.Metadata.CorrelationId)
+}
+
 // TestEngineOptionsMultipleFuncs verifies that multiple option functions can be applied
 func TestEngineOptionsMultipleFuncs(t *testing.T) {
 	setupTestConfig()
@@ -1618,6 +1715,308 @@ func TestNewLocalPolicyEngine_Authorize(t *testing.T) {
 	assert.True(t, allowed, "Admin role should be granted access")
 }
 
+// TestNewLocalPolicyEngine_BundleInfo verifies that bundle fingerprints and revision are reported and audited
+func TestNewLocalPolicyEngine_BundleInfo(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "consolidated.yml")
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	assert.Nil(t, err)
+
+	info := pe.GetBundleInfo()
+	assert.NotNil(t, info)
+	assert.NotZero(t, info.Revision)
+	assert.Len(t, info.Domains, 1)
+	assert.Len(t, info.Domains[0].Fingerprint, 32)
+
+	_, err = pe.Authorize(context.Background(), `{"principal": {"sub": "alice"}, "operation": "documents:read", "resource": "mrn:app:document:1"}`)
+	assert.Nil(t, err)
+
+	records := mockLog.GetRecords()
+	assert.Len(t, records, 1)
+	assert.Equal(t, info.Revision, records[0].Bundle.Revision)
+	assert.Equal(t, info.Domains[0].Name, records[0].Bundle.Domains[0].Name)
+	assert.Equal(t, info.Domains[0].Fingerprint, records[0].Bundle.Domains[0].Fingerprint)
+	assert.Len(t, records[0].Bundle.Fingerprint, 32)
+
+	// a reloaded bundle reports a higher revision
+	reloadedLog := &mockAccessLog{}
+	reloaded, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(&mockAccessLogFactory{stream: reloadedLog}))
+	assert.Nil(t, err)
+	assert.Greater(t, reloaded.GetBundleInfo().Revision, info.Revision)
+	assert.Equal(t, info.Domains, reloaded.GetBundleInfo().Domains)
+
+	// and the same fingerprint for the same bundle set
+	_, err = reloaded.Authorize(context.Background(), `{"principal": {"sub": "alice"}, "operation": "documents:read", "resource": "mrn:app:document:1"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Bundle.Fingerprint, reloadedLog.GetRecords()[0].Bundle.Fingerprint)
+}
+
+// TestAccessRecord_V2Fields verifies the fields added in version 2 of the AccessRecord schema
+func TestAccessRecord_V2Fields(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "consolidated.yml")
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	assert.Nil(t, err)
+
+	porc := `{"principal": {"sub": "alice@example.com", "mrealm": "test", "aud": "manetu.io", "mroles": ["mrn:iam:role:admin"]}, "operation": "documents:read", "resource": "mrn:app:document:12345"}`
+	_, err = pe.Authorize(context.Background(), porc, options.SetMapper("consolidated", "common-mapper"))
+	assert.Nil(t, err)
+	_, err = pe.Authorize(context.Background(), porc)
+	assert.Nil(t, err)
+
+	records := mockLog.GetRecords()
+	assert.Len(t, records, 2)
+	record := records[0]
+
+	assert.Equal(t, uint32(2), record.Metadata.SchemaVersion)
+	assert.NotEmpty(t, record.Metadata.EngineVersion)
+
+	assert.Equal(t, &events.AccessRecord_Mapper{Domain: "consolidated", Id: "common-mapper"}, record.Mapper)
+	assert.Nil(t, records[1].Mapper)
+
+	assert.Equal(t, "consolidated", record.OperationMatch.Domain)
+	assert.Equal(t, "api", record.OperationMatch.Id)
+	assert.Contains(t, record.OperationMatch.Selector, ".*")
+
+	breakdown := record.Duration.Breakdown
+	assert.Len(t, breakdown, 4)
+	for i, phase := range []events.AccessRecord_BundleReference_Phase{
+		events.AccessRecord_BundleReference_SYSTEM,
+		events.AccessRecord_BundleReference_IDENTITY,
+		events.AccessRecord_BundleReference_RESOURCE,
+		events.AccessRecord_BundleReference_SCOPE,
+	} {
+		assert.Equal(t, phase, breakdown[i].Phase)
+		assert.Equal(t, record.Duration.Phases[uint32(phase)], breakdown[i].Overall)
+	}
+	assert.Equal(t, uint32(1), breakdown[0].Policies, "the operation's policy")
+	assert.Equal(t, uint32(1), breakdown[1].Policies, "the admin role's policy")
+	assert.Positive(t, breakdown[0].Evaluation)
+}
+
+// TestNewLocalPolicyEngine_WarmUp verifies that warming up prepares every policy and leaves decisions unchanged
+func TestNewLocalPolicyEngine_WarmUp(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "consolidated.yml")
+
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(accesslog.NewNullFactory()))
+	assert.Nil(t, err)
+
+	assert.NoError(t, pe.WarmUp(context.Background()))
+	// warming up again is harmless
+	assert.NoError(t, pe.WarmUp(context.Background()))
+
+	allowed, err := pe.Authorize(context.Background(), `{"principal": {"sub": "alice@example.com", "mrealm": "test", "aud": "manetu.io", "mroles": ["mrn:iam:role:admin"]}, "operation": "documents:read", "resource": "mrn:app:document:12345"}`)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+}
+
+// TestWarmUp_MockBackend verifies that warming up a backend without WarmUp support is a no-op
+func TestWarmUp_MockBackend(t *testing.T) {
+	pe, _, err := test.NewTestPolicyEngine(1024)
+	assert.Nil(t, err)
+	assert.NoError(t, pe.WarmUp(context.Background()))
+}
+
+// unreachableBackend fails its health checks, to stand in for a remote policy store that is down
+type unreachableBackend struct {
+	backend.Service
+}
+
+func (b *unreachableBackend) Health(context.Context) error {
+	return fmt.Errorf("policy store unreachable")
+}
+
+type unreachableBackendFactory struct {
+	inner backend.Factory
+}
+
+func (f *unreachableBackendFactory) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
+	be, err := f.inner.NewBackend(compiler)
+	if err != nil {
+		return nil, err
+	}
+	return &unreachableBackend{Service: be}, nil
+}
+
+// TestHealth verifies that the engine reports the health of backends that can be checked
+func TestHealth(t *testing.T) {
+	pe, _, err := test.NewTestPolicyEngine(1024)
+	require.NoError(t, err)
+	assert.NoError(t, pe.Health(context.Background()), "backends that cannot be checked are healthy")
+
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	reg, err := registry.NewRegistry([]string{"../../cmd/mpe/test/consolidated.yml"})
+	require.NoError(t, err)
+
+	pe, err = core.NewPolicyEngine(
+		options.WithBackend(&unreachableBackendFactory{inner: local.NewFactory(reg)}),
+		options.WithAccessLog(accesslog.NewNullFactory()),
+	)
+	require.NoError(t, err)
+	assert.EqualError(t, pe.Health(context.Background()), "policy store unreachable")
+}
+
+// TestAuthorize_LogsCarryRecordID verifies that the messages logged while deciding, including by
+// the backend, can be correlated with the decision's access record
+func TestAuthorize_LogsCarryRecordID(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "consolidated.yml")
+	factory := accesslog.NewChannelFactory(1)
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(factory))
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	for _, module := range []string{"policyengine", "policyengine.backend.local"} {
+		l := logging.GetLogger(module)
+		l.SetOut(&buffer)
+		l.SetLevel(slog.LevelDebug)
+		defer func() {
+			l.SetOut(os.Stderr)
+			l.SetLevel(slog.LevelInfo)
+		}()
+	}
+
+	_, err = pe.Authorize(context.Background(),
+		`{"principal": {"sub": "alice@example.com", "mrealm": "test", "mroles": ["mrn:iam:role:admin"]}, "operation": "documents:read", "resource": "mrn:app:document:12345"}`,
+		options.SetCorrelationID("request-1"))
+	require.NoError(t, err)
+	record := <-factory.C()
+
+	modules := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		if entry["action"] == "Decide" {
+			continue // logged before the decision is given its record
+		}
+		assert.Equal(t, record.Metadata.Id, entry[logging.RecordID], line)
+		assert.Equal(t, "request-1", entry[logging.CorrelationID], line)
+		modules[entry["module"].(string)] = true
+	}
+	assert.Equal(t, map[string]bool{"policyengine": true, "policyengine.backend.local": true}, modules)
+}
+
+// TestSubscribe verifies that subscribers receive the access records of decisions alongside the access log
+func TestSubscribe(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "consolidated.yml")
+
+	factory := accesslog.NewChannelFactory(10)
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(factory))
+	require.NoError(t, err)
+
+	porc := `{"principal": {"sub": "alice@example.com", "mrealm": "test", "aud": "manetu.io", "mroles": ["mrn:iam:role:admin"]}, "operation": "documents:read", "resource": "mrn:app:document:12345"}`
+	ctx := context.Background()
+
+	_, err = pe.Authorize(ctx, porc)
+	require.NoError(t, err)
+
+	sub := pe.Subscribe(10)
+	allowed, err := pe.Authorize(ctx, porc)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	_, err = pe.Authorize(ctx, porc, options.SetProbeMode(true))
+	require.NoError(t, err)
+	sub.Close()
+
+	_, err = pe.Authorize(ctx, porc)
+	require.NoError(t, err)
+
+	var records []*events.AccessRecord
+	for record := range sub.C() {
+		records = append(records, record)
+	}
+	require.Len(t, records, 1, "only the decisions made while subscribed, excluding probes, are received")
+	assert.Equal(t, "alice@example.com", records[0].Principal.Subject)
+	assert.Equal(t, events.AccessRecord_GRANT, records[0].Decision)
+	assert.Equal(t, uint64(0), sub.Dropped())
+
+	assert.Len(t, factory.C(), 3, "the access log receives every decision")
+	assert.Equal(t, uint64(0), factory.Dropped())
+}
+
+// TestNewLocalPolicyEngine_Tenant verifies that lookups are restricted to the domains registered for a tenant
+func TestNewLocalPolicyEngine_Tenant(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	mockLog := &mockAccessLog{}
+	r, err := registry.NewRegistry([]string{
+		createTempFileFromTestData(t, "consolidated.yml"),
+		createTempFileFromTestData(t, "valid-alpha.yml"),
+	})
+	assert.Nil(t, err)
+
+	pe, err := core.NewPolicyEngine(
+		options.WithBackend(local.NewFactory(r,
+			local.WithTenant("acme", "consolidated"),
+			local.WithTenant("globex", "alpha"),
+		)),
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}),
+	)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	porc := `{
+		"principal": {
+			"sub": "alice@example.com",
+			"mrealm": "test",
+			"aud": "manetu.io",
+			"mroles": ["mrn:iam:role:admin"]
+		},
+		"resource": "mrn:app:document:12345",
+		"operation": "documents:read"
+	}`
+
+	allowed, err := pe.Authorize(ctx, porc, options.SetTenant("acme"))
+	assert.Nil(t, err)
+	assert.True(t, allowed, "acme should resolve the request from its own domain")
+
+	for tenant, reason := range map[string]string{"initech": "unknown tenant 'initech'", "": "tenant required"} {
+		allowed, err = pe.Authorize(ctx, porc, options.SetTenant(tenant))
+		assert.Nil(t, err)
+		assert.False(t, allowed, "tenant %q should be denied", tenant)
+
+		records := mockLog.GetRecords()
+		var reasons []string
+		for _, ref := range records[len(records)-1].References {
+			reasons = append(reasons, ref.Reason)
+		}
+		assert.Contains(t, reasons, reason)
+	}
+}
+
 // TestNewLocalPolicyEngine_AuthorizeDenied tests authorization denial with local domains
 func TestNewLocalPolicyEngine_AuthorizeDenied(t *testing.T) {
 	setupTestConfig()
@@ -1988,3 +2387,1672 @@ func TestAnnotationHierarchy(t *testing.T) {
 		assert.Equal(t, "role_value", annots["role_only"], "role_only should come from role")
 	})
 }
+
+// TestWithAuditRedactor verifies that access records are redacted before they are sent, while
+// policies still see the original input
+func TestWithAuditRedactor(t *testing.T) {
+	ctx := context.Background()
+	porc := "{\"principal\":{\"sub\":\"foo\",\"mrealm\":\"bar\",\"email\":\"foo@example.com\",\"mroles\":[\"USER\"]}}"
+
+	redactor, err := accesslog.NewFieldRedactor(accesslog.RedactionOptions{
+		Strip: []string{"principal.email"},
+		Hash:  []string{"principal.sub"},
+	})
+	require.NoError(t, err)
+
+	pe, ch, err := test.NewTestPolicyEngine(1024, options.WithAuditRedactor(redactor))
+	require.NoError(t, err)
+
+	_, err = pe.Authorize(ctx, porc)
+	assert.Nil(t, err)
+	record := <-ch
+
+	assert.NotContains(t, record.Porc, "foo@example.com")
+	assert.NotContains(t, record.Porc, "\"foo\"")
+	assert.True(t, strings.HasPrefix(record.Principal.Subject, "sha256:"))
+	assert.Contains(t, record.Porc, record.Principal.Subject)
+	assert.Equal(t, "bar", record.Principal.Realm)
+}
+
+// TestWithAuditRedactorFailure verifies that a record whose redaction fails is sent without its
+// PORC and principal
+func TestWithAuditRedactorFailure(t *testing.T) {
+	ctx := context.Background()
+	porc := "{\"principal\":{\"sub\":\"foo\",\"mrealm\":\"bar\",\"mroles\":[\"USER\"]}}"
+
+	failing := accesslog.RedactorFunc(func(*events.AccessRecord) error {
+		return fmt.Errorf("redaction failed")
+	})
+
+	pe, ch, err := test.NewTestPolicyEngine(1024, options.WithAuditRedactor(failing))
+	require.NoError(t, err)
+
+	_, err = pe.Authorize(ctx, porc)
+	assert.Nil(t, err)
+	record := <-ch
+
+	assert.Empty(t, record.Porc)
+	assert.Empty(t, record.Principal.Subject)
+}
+
+// TestDecide_Obligations verifies that obligations returned by granting policies are merged into the decision
+func TestDecide_Obligations(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "obligations.yml")
+
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(role, op string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["%s"]}, "operation": "%s", "resource": "mrn:app:doc:1"}`, role, op)
+	}
+
+	decision, err := pe.Decide(ctx, porc("mrn:iam:role:reader", "api:doc:read"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	// the operation phase comes first, so its quota is kept
+	assert.Equal(t, model.Obligations{
+		"quota": map[string]interface{}{"limit": json.Number("100"), "window": "1m"},
+		"audit": "full",
+	}, decision.Obligations)
+
+	allowed, err := pe.Authorize(ctx, porc("mrn:iam:role:reader", "api:doc:read"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// a DENY never carries obligations
+	decision, err = pe.Decide(ctx, porc("mrn:iam:role:reader", "api:doc:write"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	assert.Empty(t, decision.Obligations)
+
+	decision, err = pe.Decide(ctx, porc("mrn:iam:role:suspended", "api:doc:read"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	assert.Empty(t, decision.Obligations)
+
+	_, err = pe.Decide(ctx, "not json")
+	require.Error(t, err)
+}
+
+func TestDecide_PhaseResults(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	domainFile := createTempFileFromTestData(t, "obligations.yml")
+
+	pe, err := core.NewLocalPolicyEngine([]string{domainFile}, options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(role string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["%s"]}, "operation": "api:doc:read", "resource": "mrn:app:doc:1"}`, role)
+	}
+	find := func(phases []types.PhaseResult, phase types.Phase) *types.PhaseResult {
+		for i := range phases {
+			if phases[i].Phase == phase {
+				return &phases[i]
+			}
+		}
+		return nil
+	}
+
+	// phase results are only collected when requested
+	decision, err := pe.Decide(ctx, porc("mrn:iam:role:reader"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Nil(t, decision.Phases)
+
+	decision, err = pe.Decide(ctx, porc("mrn:iam:role:reader"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+
+	op := find(decision.Phases, types.PhaseOperation)
+	require.NotNil(t, op)
+	assert.Equal(t, "mrn:iam:policy:operation-quota", op.Policy)
+
+	identity := find(decision.Phases, types.PhaseIdentity)
+	require.NotNil(t, identity)
+	assert.Equal(t, "mrn:iam:role:reader", identity.ID)
+	assert.Equal(t, "mrn:iam:policy:reader", identity.Policy)
+	assert.True(t, identity.Allow)
+	assert.Equal(t, types.ReasonPolicyOutcome, identity.ReasonCode)
+
+	res := find(decision.Phases, types.PhaseResource)
+	require.NotNil(t, res)
+	assert.Equal(t, "mrn:iam:resource-group:default", res.ID)
+	assert.True(t, res.Allow)
+
+	// the phase that denied is reported
+	decision, err = pe.Decide(ctx, porc("mrn:iam:role:suspended"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+
+	identity = find(decision.Phases, types.PhaseIdentity)
+	require.NotNil(t, identity)
+	assert.Equal(t, "mrn:iam:role:suspended", identity.ID)
+	assert.False(t, identity.Allow)
+
+	// an unknown role is reported with its error
+	decision, err = pe.Decide(ctx, porc("mrn:iam:role:unknown"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+
+	identity = find(decision.Phases, types.PhaseIdentity)
+	require.NotNil(t, identity)
+	assert.False(t, identity.Allow)
+	assert.Equal(t, types.ReasonNotFoundError, identity.ReasonCode)
+	assert.NotEmpty(t, identity.Reason)
+}
+
+func TestBypassRules(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(role, op string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["%s"]}, "operation": "%s", "resource": "mrn:app:doc:1"}`, role, op)
+	}
+
+	tests := []struct {
+		name   string
+		role   string
+		op     string
+		reason events.AccessRecord_BypassGrantReason
+		rule   string
+	}{
+		{"anti-lockout", "mrn:iam:role:admin", "platform:admin:update", events.AccessRecord_ANTI_LOCKOUT, "bypass rule bypass/admin-anti-lockout"},
+		{"public", "mrn:iam:role:monitor", "platform:health", events.AccessRecord_PUBLIC, "bypass rule bypass/health"},
+		{"operation not covered", "mrn:iam:role:admin", "platform:doc:read", events.AccessRecord_NOT_GRANTED, ""},
+		{"role not covered", "mrn:iam:role:reader", "platform:admin:update", events.AccessRecord_NOT_GRANTED, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := pe.Authorize(ctx, porc(tt.role, tt.op))
+			require.NoError(t, err)
+
+			records := mockLog.GetRecords()
+			record := records[len(records)-1]
+			phase1Ref := getBundleRef(record, events.AccessRecord_BundleReference_SYSTEM, 0)
+			require.NotNil(t, phase1Ref)
+
+			if tt.reason == events.AccessRecord_NOT_GRANTED {
+				// the role's policy denies everything
+				assert.False(t, allowed)
+				assert.False(t, record.SystemOverride)
+				return
+			}
+
+			assert.True(t, allowed)
+			assert.True(t, record.SystemOverride)
+			assert.Equal(t, tt.reason, record.OverrideReason.(*events.AccessRecord_GrantReason).GrantReason)
+			assert.Equal(t, events.AccessRecord_GRANT, phase1Ref.Decision)
+			assert.Equal(t, events.AccessRecord_BundleReference_POLICY_OUTCOME, phase1Ref.ReasonCode)
+			assert.Equal(t, tt.rule, phase1Ref.Reason)
+		})
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "impersonation.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(act, op string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice@example.com", "mrealm": "test", "mroles": ["mrn:iam:role:user"]%s}, "operation": "%s", "resource": "mrn:app:doc:1"}`, act, op)
+	}
+	service := `, "act": {"sub": "documents-service", "mrealm": "services", "mroles": ["mrn:iam:role:service"]}`
+
+	tests := []struct {
+		name    string
+		act     string
+		op      string
+		allowed bool
+		rules   []string // of the actors, empty if none permits them
+		reason  string
+	}{
+		{"not impersonated", "", "api:documents:read", true, nil, ""},
+		{"permitted", service, "api:documents:read", true, []string{"impersonation/on-behalf-of"}, ""},
+		{"operation not covered", service, "api:admin:update", false, []string{""}, "impersonation: actor documents-service may not act for alice@example.com"},
+		{
+			"actor without roles",
+			`, "act": {"sub": "rogue"}`,
+			"api:documents:read", false, []string{""},
+			"impersonation: actor rogue may not act for alice@example.com",
+		},
+		{
+			"chain",
+			`, "act": {"sub": "documents-service", "mroles": ["mrn:iam:role:service"], "act": {"sub": "edge", "mroles": ["mrn:iam:role:gateway"]}}`,
+			"api:documents:read", true, []string{"impersonation/on-behalf-of", "impersonation/gateway"}, "",
+		},
+		{
+			"prior actor not permitted",
+			`, "act": {"sub": "documents-service", "mroles": ["mrn:iam:role:service"], "act": {"sub": "rogue"}}`,
+			"api:documents:read", false, []string{"impersonation/on-behalf-of", ""},
+			"impersonation: actor rogue may not act for alice@example.com",
+		},
+		{"malformed", `, "act": "documents-service"`, "api:documents:read", false, nil, "impersonation: malformed act claim"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := pe.Authorize(ctx, porc(tt.act, tt.op))
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+
+			records := mockLog.GetRecords()
+			record := records[len(records)-1]
+			if tt.act == "" {
+				assert.Nil(t, record.Impersonation)
+				return
+			}
+
+			require.NotNil(t, record.Impersonation)
+			assert.Equal(t, tt.allowed, record.Impersonation.Permitted)
+			var rules []string
+			for _, actor := range record.Impersonation.Actors {
+				rules = append(rules, actor.Rule)
+			}
+			assert.Equal(t, tt.rules, rules)
+			assert.Equal(t, "alice@example.com", record.Principal.Subject)
+
+			if tt.allowed {
+				assert.False(t, record.SystemOverride)
+				return
+			}
+			assert.True(t, record.SystemOverride)
+			assert.Equal(t, events.AccessRecord_IMPERSONATION_DENIED, record.OverrideReason.(*events.AccessRecord_DenyReason).DenyReason)
+			require.Len(t, record.References, 1, "no policy is evaluated")
+			assert.Equal(t, events.AccessRecord_BundleReference_SYSTEM, record.References[0].Phase)
+			assert.Equal(t, tt.reason, record.References[0].Reason)
+		})
+	}
+
+	// the actor is recorded as the claim gives it
+	_, err = pe.Authorize(ctx, porc(service, "api:documents:read"))
+	require.NoError(t, err)
+	records := mockLog.GetRecords()
+	actor := records[len(records)-1].Impersonation.Actors[0]
+	assert.Equal(t, "documents-service", actor.Subject)
+	assert.Equal(t, "services", actor.Realm)
+	assert.Equal(t, []string{"mrn:iam:role:service"}, actor.Roles)
+
+	// a deny-listed actor acts for no one, wherever it is in the chain
+	expires := time.Now().Add(time.Hour)
+	denied, err := pe.AddOverride(override.Override{Type: override.Deny, Subject: "edge", Expires: expires})
+	require.NoError(t, err)
+	allowed, err := pe.Authorize(ctx, porc(`, "act": {"sub": "documents-service", "mroles": ["mrn:iam:role:service"], "act": {"sub": "edge", "mroles": ["mrn:iam:role:gateway"]}}`, "api:documents:read"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	records = mockLog.GetRecords()
+	record := records[len(records)-1]
+	assert.Equal(t, events.AccessRecord_DENY_LISTED, record.OverrideReason.(*events.AccessRecord_DenyReason).DenyReason)
+	assert.Equal(t, denied.ID, record.Override.Id)
+	require.Len(t, record.References, 1)
+	assert.Equal(t, "impersonation: actor edge is deny-listed", record.References[0].Reason)
+	assert.False(t, record.Impersonation.Permitted)
+
+	// while the break-glass override of an actor grants nothing it acts in
+	assert.True(t, pe.RemoveOverride(denied.ID))
+	_, err = pe.AddOverride(override.Override{Type: override.BreakGlass, Subject: "rogue", Justification: "INC-1", Expires: expires})
+	require.NoError(t, err)
+	allowed, err = pe.Authorize(ctx, porc(`, "act": {"sub": "rogue"}`, "api:documents:read"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	records = mockLog.GetRecords()
+	assert.Equal(t, events.AccessRecord_IMPERSONATION_DENIED, records[len(records)-1].OverrideReason.(*events.AccessRecord_DenyReason).DenyReason)
+
+	// a domain without impersonation rules permits no actor
+	pe, err = core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	require.NoError(t, err)
+	allowed, err = pe.Authorize(ctx, `{"principal": {"sub": "alice", "mroles": ["mrn:iam:role:admin"], "act": {"sub": "svc", "mroles": ["mrn:iam:role:admin"]}}, "operation": "platform:admin:update", "resource": "mrn:app:doc:1"}`)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestBypassRules_OperationGates(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(op, context string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:admin"]}, "operation": "%s", "resource": "mrn:app:doc:1", "context": %s}`, op, context)
+	}
+	lastRecord := func() *events.AccessRecord {
+		records := mockLog.GetRecords()
+		return records[len(records)-1]
+	}
+
+	// the operation's approvals gate the GRANT of a bypass rule
+	decision, err := pe.Decide(ctx, porc("platform:admin:tenant:delete", "{}"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	require.NotNil(t, decision.Approval)
+	record := lastRecord()
+	assert.Equal(t, events.AccessRecord_PENDING, record.Decision)
+	assert.Equal(t, uint32(2), record.Approval.Required)
+	assert.Equal(t, "bypass rule bypass/admin-anti-lockout", getBundleRef(record, events.AccessRecord_BundleReference_SYSTEM, 0).Reason)
+
+	// as its context schema does
+	allowed, err := pe.Authorize(ctx, porc("platform:admin:transfer", `{"amount": "all"}`))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	record = lastRecord()
+	phase1Ref := getBundleRef(record, events.AccessRecord_BundleReference_SYSTEM, 0)
+	require.NotNil(t, phase1Ref)
+	assert.Equal(t, events.AccessRecord_BundleReference_INVALPARAM_ERROR, phase1Ref.ReasonCode)
+
+	allowed, err = pe.Authorize(ctx, porc("platform:admin:transfer", `{"amount": 5}`))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.True(t, lastRecord().SystemOverride)
+}
+
+const defaultsDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: %[1]s
+spec:
+%[2]s
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:reader"
+      rego: |
+        package authz
+        default allow = false
+        allow { endswith(input.operation, ":doc:read") }
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:deny-all"
+      rego: |
+        package authz
+        default allow = false
+  roles:
+    - mrn: "mrn:iam:role:%[3]s-reader"
+      policy: "mrn:iam:policy:reader"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:%[3]s-default"
+      policy: "mrn:iam:policy:deny-all"
+      default: true
+    - mrn: "mrn:iam:resource-group:%[3]s-public"
+      policy: "mrn:iam:policy:allow-all"
+  resources:
+    - name: public
+      selector:
+        - "mrn:%[3]s:public:.*"
+      group: "mrn:iam:resource-group:%[3]s-public"
+  operations:
+    - name: %[3]s
+      selector:
+        - "%[3]s:.*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+// writeDefaultsDomain writes a domain routing the operations with the given prefix
+func writeDefaultsDomain(t *testing.T, name, prefix, defaults string) string {
+	path := filepath.Join(t.TempDir(), name+".yml")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(defaultsDomain, name, defaults, prefix)), 0600))
+	return path
+}
+
+func TestDomainDefaults(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	porc := func(roles, op, resource string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": [%s]}, "operation": "%s", "resource": "%s"}`, roles, op, resource)
+	}
+	reader := `"mrn:iam:role:open-reader"`
+
+	tests := []struct {
+		decision  string
+		combining string
+		roles     string
+		op        string
+		resource  string
+		allowed   bool
+	}{
+		// every phase must GRANT
+		{"deny", "all", reader, "open:doc:read", "mrn:open:public:1", true},
+		{"deny", "all", reader, "open:doc:read", "mrn:open:doc:1", false},
+		{"deny", "all", "", "open:doc:read", "mrn:open:public:1", false},
+		// principals without roles pass the identity phase
+		{"allow", "all", "", "open:doc:read", "mrn:open:public:1", true},
+		{"allow", "all", "", "open:doc:read", "mrn:open:doc:1", false},
+		{"allow", "all", reader, "open:doc:write", "mrn:open:public:1", false},
+		// any phase that evaluated a policy may GRANT
+		{"deny", "any", reader, "open:doc:read", "mrn:open:doc:1", true},
+		{"deny", "any", "", "open:doc:read", "mrn:open:public:1", true},
+		{"deny", "any", "", "open:doc:read", "mrn:open:doc:1", false},
+		{"allow", "any", "", "open:doc:read", "mrn:open:doc:1", false},
+		{"deny", "any", reader, "open:doc:write", "mrn:open:doc:1", false},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s-%s/%s/%s/%s", tt.decision, tt.combining, tt.roles, tt.op, tt.resource)
+		t.Run(name, func(t *testing.T) {
+			defaults := fmt.Sprintf("  defaults:\n    decision: %s\n    combining: %s", tt.decision, tt.combining)
+
+			mockLog := &mockAccessLog{}
+			pe, err := core.NewLocalPolicyEngine([]string{
+				writeDefaultsDomain(t, "defaults", "open", defaults),
+				writeDefaultsDomain(t, "standard", "std", ""),
+			}, options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+			require.NoError(t, err)
+
+			allowed, err := pe.Authorize(context.Background(), porc(tt.roles, tt.op, tt.resource))
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+
+			records := mockLog.GetRecords()
+			record := records[len(records)-1]
+			require.NotNil(t, record.Defaults)
+			assert.Equal(t, "defaults", record.Defaults.Domain)
+			assert.Equal(t, tt.decision == "allow", record.Defaults.Decision == events.AccessRecord_GRANT)
+			assert.Equal(t, tt.combining == "any", record.Defaults.Combining == events.AccessRecord_ANY)
+
+			// domains without defaults keep the standard strategy
+			allowed, err = pe.Authorize(context.Background(), porc(`"mrn:iam:role:std-reader"`, "std:doc:read", "mrn:std:doc:1"))
+			require.NoError(t, err)
+			assert.False(t, allowed)
+			records = mockLog.GetRecords()
+			assert.Nil(t, records[len(records)-1].Defaults)
+		})
+	}
+}
+
+const denyPoliciesDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: deny
+spec:
+  defaults:
+    combining: any
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:trusted-network"
+      rego: |
+        package authz
+        default allow = false
+        allow { input.context.network == "corporate" }
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      policy: "mrn:iam:policy:allow-all"
+      deny-policies:
+        - "mrn:iam:policy:trusted-network"
+    - mrn: "mrn:iam:role:auditor"
+      policy: "mrn:iam:policy:allow-all"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+      default: true
+  operations:
+    - name: all
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestDenyPolicies(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "deny.yml")
+	require.NoError(t, os.WriteFile(path, []byte(denyPoliciesDomain), 0600))
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{path}, options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		roles   string
+		network string
+		allowed bool
+	}{
+		{"trusted network", `"mrn:iam:role:reader"`, "corporate", true},
+		{"untrusted network", `"mrn:iam:role:reader"`, "public", false},
+		// neither another role nor the any combining of the domain overrides the deny
+		{"another role grants", `"mrn:iam:role:reader", "mrn:iam:role:auditor"`, "public", false},
+		{"role without deny policies", `"mrn:iam:role:auditor"`, "public", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			porc := fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": [%s]}, "operation": "app:doc:read", "resource": "mrn:app:doc:1", "context": {"network": "%s"}}`,
+				tt.roles, tt.network)
+			allowed, err := pe.Authorize(context.Background(), porc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+
+			records := mockLog.GetRecords()
+			var explicit []string
+			for _, ref := range records[len(records)-1].References {
+				if ref.ReasonCode == events.AccessRecord_BundleReference_EXPLICIT_DENY {
+					explicit = append(explicit, ref.Id)
+				}
+			}
+			if tt.allowed {
+				assert.Empty(t, explicit)
+			} else {
+				assert.Equal(t, []string{"mrn:iam:role:reader"}, explicit)
+			}
+		})
+	}
+}
+
+const builtinsDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: builtins
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:public-class"
+      rego: |
+        package authz
+        default allow = -1
+        allow = 1 { mrn.class(input.resource.id) == "public" }
+  operations:
+    - name: app
+      selector:
+        - "app:.*"
+      policy: "mrn:iam:policy:public-class"
+`
+
+func TestWithBuiltins(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "builtins.yml")
+	require.NoError(t, os.WriteFile(path, []byte(builtinsDomain), 0600))
+
+	// policies calling an unregistered built-in do not compile
+	_, err := core.NewLocalPolicyEngine([]string{path})
+	require.Error(t, err)
+
+	class := &opa.Builtin{
+		Decl: &rego.Function{
+			Name: "mrn.class",
+			Decl: opatypes.NewFunction(opatypes.Args(opatypes.S), opatypes.S),
+		},
+		Impl: func(_ rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+			s, ok := args[0].Value.(ast.String)
+			if !ok {
+				return nil, nil
+			}
+			parts := strings.Split(string(s), ":")
+			if len(parts) < 3 {
+				return nil, nil
+			}
+			return ast.StringTerm(parts[2]), nil
+		},
+	}
+
+	pe, err := core.NewLocalPolicyEngine([]string{path},
+		options.WithAccessLog(accesslog.NewNullFactory()),
+		options.WithBuiltins(class))
+	require.NoError(t, err)
+
+	porc := `{"principal": {}, "operation": "app:doc:read", "resource": "%s"}`
+	allowed, err := pe.Authorize(context.Background(), fmt.Sprintf(porc, "mrn:app:public:1"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = pe.Authorize(context.Background(), fmt.Sprintf(porc, "mrn:app:secret:1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestWithBuiltinsAccumulates(t *testing.T) {
+	a := &opa.Builtin{Decl: &rego.Function{Name: "a"}}
+	b := &opa.Builtin{Decl: &rego.Function{Name: "b"}}
+
+	opts := &options.EngineOptions{}
+	options.WithBuiltins(a)(opts)
+	options.WithBuiltins(b)(opts)
+	assert.Equal(t, []*opa.Builtin{a, b}, opts.Builtins)
+}
+
+func TestDataDocuments(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "data.yml")},
+		options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	porc := func(country, clearance string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:member"], "mannotations": {"country": "%s", "clearance": "%s"}}, "operation": "data:report:read", "resource": "mrn:data:report:1"}`, country, clearance)
+	}
+
+	tests := []struct {
+		country   string
+		clearance string
+		allowed   bool
+	}{
+		{"CA", "secret", true},
+		{"CA", "internal", false},
+		{"XX", "secret", false},
+	}
+
+	for _, tt := range tests {
+		allowed, err := pe.Authorize(context.Background(), porc(tt.country, tt.clearance))
+		require.NoError(t, err)
+		assert.Equal(t, tt.allowed, allowed, "%s/%s", tt.country, tt.clearance)
+	}
+}
+
+const fetchDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: risk
+spec:
+  fetch:
+    allow:
+      - %[1]s
+    cache_ttl: 1m
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:low-risk"
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          response := policyengine.fetch(sprintf("%[2]s/v1/risk/%%s", [input.principal.sub]))
+          response.body.score < 50
+        }
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  roles:
+    - mrn: "mrn:iam:role:member"
+      policy: "mrn:iam:policy:low-risk"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+      default: true
+  operations:
+    - name: risk
+      selector:
+        - "risk:.*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestFetch(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/risk/alice" {
+			_, _ = w.Write([]byte(`{"score": 10}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"score": 90}`))
+	}))
+	defer server.Close()
+
+	newEngine := func(allow string) (core.PolicyEngine, *mockAccessLog) {
+		path := filepath.Join(t.TempDir(), "risk.yml")
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(fetchDomain, allow, server.URL)), 0600))
+
+		mockLog := &mockAccessLog{}
+		pe, err := core.NewLocalPolicyEngine([]string{path}, options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+		require.NoError(t, err)
+		return pe, mockLog
+	}
+	porc := func(sub string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "%s", "mrealm": "test", "mroles": ["mrn:iam:role:member"]}, "operation": "risk:doc:read", "resource": "mrn:risk:doc:1"}`, sub)
+	}
+
+	pe, mockLog := newEngine(server.URL + "/v1/risk/")
+	for i, tt := range []struct {
+		sub     string
+		allowed bool
+	}{{"alice", true}, {"bob", false}, {"alice", true}} {
+		allowed, err := pe.Authorize(context.Background(), porc(tt.sub))
+		require.NoError(t, err)
+		assert.Equal(t, tt.allowed, allowed, tt.sub)
+
+		records := mockLog.GetRecords()
+		fetches := records[len(records)-1].Fetches
+		require.Len(t, fetches, 1)
+		assert.Equal(t, "risk", fetches[0].Domain)
+		assert.Equal(t, server.URL+"/v1/risk/"+tt.sub, fetches[0].Url)
+		assert.Equal(t, uint32(200), fetches[0].StatusCode)
+		assert.Equal(t, i == 2, fetches[0].Cached)
+	}
+
+	// URLs outside the allowlist are refused, and the policy fails to evaluate
+	pe, mockLog = newEngine(server.URL + "/v2/")
+	allowed, err := pe.Authorize(context.Background(), porc("alice"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	records := mockLog.GetRecords()
+	record := records[len(records)-1]
+	require.Len(t, record.Fetches, 1)
+	assert.Equal(t, "not allowed", record.Fetches[0].Error)
+	assert.Zero(t, record.Fetches[0].StatusCode)
+}
+
+const classifiedDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: vault
+spec:
+  classifications:
+    levels: [LOW, MODERATE, HIGH, MAXIMUM]
+    compartments: [CRYPTO, NUCLEAR]
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:clearance"
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          clearance.dominates(
+            {"level": input.principal.mclearance, "compartments": object.get(input.principal, "compartments", [])},
+            {"level": input.resource.classification, "compartments": object.get(input.resource, "compartments", [])},
+          )
+        }
+  roles:
+    - mrn: "mrn:iam:role:member"
+      policy: "mrn:iam:policy:allow-all"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:clearance"
+      default: true
+  resources:
+    - name: keys
+      selector:
+        - "mrn:vault:key:.*"
+      group: "mrn:iam:resource-group:default"
+      classification: HIGH
+      compartments: [CRYPTO]
+  operations:
+    - name: vault
+      selector:
+        - "vault:.*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestClearance(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "vault.yml")
+	require.NoError(t, os.WriteFile(path, []byte(classifiedDomain), 0600))
+	pe, err := core.NewLocalPolicyEngine([]string{path})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		clearance    string
+		compartments string
+		resource     string
+		allowed      bool
+	}{
+		{"cleared", "MAXIMUM", `["CRYPTO"]`, `"mrn:vault:key:1"`, true},
+		{"level too low", "MODERATE", `["CRYPTO"]`, `"mrn:vault:key:1"`, false},
+		{"missing compartment", "MAXIMUM", `["NUCLEAR"]`, `"mrn:vault:key:1"`, false},
+		{"unknown level", "TOP", `["CRYPTO"]`, `"mrn:vault:key:1"`, false},
+		{"labelled in request", "MODERATE", `["NUCLEAR"]`,
+			`{"id": "mrn:vault:doc:1", "group": "mrn:iam:resource-group:default", "classification": "LOW", "compartments": ["NUCLEAR"]}`, true},
+		{"compartments in request", "MODERATE", `[]`,
+			`{"id": "mrn:vault:doc:1", "group": "mrn:iam:resource-group:default", "classification": "LOW", "compartments": ["NUCLEAR"]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			porc := fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:member"], "mclearance": "%s", "compartments": %s}, "operation": "vault:key:read", "resource": %s}`,
+				tt.clearance, tt.compartments, tt.resource)
+			allowed, err := pe.Authorize(context.Background(), porc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
+
+const conditionalDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: conditional
+spec:
+  classifications:
+    levels: [LOW, HIGH]
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:deny-all"
+      rego: |
+        package authz
+        default allow = false
+  roles:
+    - mrn: "mrn:iam:role:member"
+      policy: "mrn:iam:policy:allow-all"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:deny-all"
+      default: true
+    - mrn: "mrn:iam:resource-group:classified"
+      policy: "mrn:iam:policy:allow-all"
+  resources:
+    - name: secrets
+      selector:
+        - "mrn:app:secret:.*"
+      group: "mrn:iam:resource-group:default"
+      classification: HIGH
+    - name: classified
+      group: "mrn:iam:resource-group:classified"
+      when:
+        - "classification >= HIGH"
+    - name: finance
+      group: "mrn:iam:resource-group:classified"
+      when:
+        - "annotations.department == \"finance\""
+  operations:
+    - name: all
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestConditionalResourceGroups(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "conditional.yml")
+	require.NoError(t, os.WriteFile(path, []byte(conditionalDomain), 0600))
+	pe, err := core.NewLocalPolicyEngine([]string{path})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		resource string
+		allowed  bool
+	}{
+		{"unlabelled", `"mrn:app:doc:1"`, false},
+		{"assigned by classification", `"mrn:app:secret:1"`, true},
+		{"descriptor assigned by classification", `{"id": "mrn:app:doc:1", "classification": "HIGH"}`, true},
+		{"descriptor below level", `{"id": "mrn:app:doc:1", "classification": "LOW"}`, false},
+		{"descriptor assigned by annotation", `{"id": "mrn:app:doc:1", "annotations": {"department": "finance"}}`, true},
+		{"descriptor with group", `{"id": "mrn:app:doc:1", "group": "mrn:iam:resource-group:default", "classification": "HIGH"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			porc := fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:member"]}, "operation": "app:doc:read", "resource": %s}`, tt.resource)
+			allowed, err := pe.Authorize(context.Background(), porc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
+
+const nestedGroupsDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: nested
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:on-call"
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          input.principal.mannotations.team == "platform"
+          input.principal.mannotations.pager == true
+        }
+  roles:
+    - mrn: "mrn:iam:role:on-call"
+      policy: "mrn:iam:policy:on-call"
+  groups:
+    - mrn: "mrn:iam:group:platform"
+      groups:
+        - "mrn:iam:group:engineering"
+      annotations:
+        - name: team
+          value: platform
+    - mrn: "mrn:iam:group:engineering"
+      groups:
+        - "mrn:iam:group:on-call"
+      annotations:
+        - name: team
+          value: engineering
+    - mrn: "mrn:iam:group:on-call"
+      roles:
+        - "mrn:iam:role:on-call"
+      annotations:
+        - name: pager
+          value: true
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+      default: true
+  operations:
+    - name: all
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestNestedGroups(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "nested.yml")
+	require.NoError(t, os.WriteFile(path, []byte(nestedGroupsDomain), 0600))
+	pe, err := core.NewLocalPolicyEngine([]string{path})
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		group   string
+		allowed bool
+	}{
+		// roles and annotations of nested groups apply, while the outermost group's team wins
+		{"mrn:iam:group:platform", true},
+		{"mrn:iam:group:engineering", false},
+		{"mrn:iam:group:on-call", false},
+	} {
+		t.Run(tt.group, func(t *testing.T) {
+			porc := fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mgroups": ["%s"]}, "operation": "svc:page", "resource": "mrn:svc:pager"}`, tt.group)
+			allowed, err := pe.Authorize(context.Background(), porc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	config.VConfig.Set(config.Overrides, []map[string]interface{}{
+		{"id": "deny-bob", "type": "deny", "subject": "bob", "expires": expires.Format(time.RFC3339)},
+		{"type": "deny", "subject": "carol", "expires": "2020-01-01T00:00:00Z"}, // expired, skipped
+	})
+	defer config.VConfig.Set(config.Overrides, nil)
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(sub, role, op string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "%s", "mrealm": "test", "mroles": ["%s"]}, "operation": "%s", "resource": "mrn:app:doc:1"}`, sub, role, op)
+	}
+	lastRecord := func() *events.AccessRecord {
+		records := mockLog.GetRecords()
+		return records[len(records)-1]
+	}
+
+	require.Len(t, pe.ListOverrides(), 1)
+
+	// configured deny override takes precedence over the anti-lockout bypass rule
+	allowed, err := pe.Authorize(ctx, porc("bob", "mrn:iam:role:admin", "platform:admin:update"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	record := lastRecord()
+	assert.True(t, record.SystemOverride)
+	assert.Equal(t, events.AccessRecord_DENY_LISTED, record.OverrideReason.(*events.AccessRecord_DenyReason).DenyReason)
+	require.NotNil(t, record.Override)
+	assert.Equal(t, "deny-bob", record.Override.Id)
+	assert.Equal(t, expires, record.Override.Expires.AsTime())
+	assert.Empty(t, record.References, "no policy is evaluated")
+
+	// expired configuration entries do not apply
+	allowed, err = pe.Authorize(ctx, porc("carol", "mrn:iam:role:admin", "platform:admin:update"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Nil(t, lastRecord().Override)
+
+	// break-glass grants what the reader's policy denies
+	_, err = pe.AddOverride(override.Override{Type: override.BreakGlass, Subject: "alice", Expires: expires})
+	require.Error(t, err, "break-glass requires a justification")
+
+	glass, err := pe.AddOverride(override.Override{
+		Type:          override.BreakGlass,
+		Subject:       "alice",
+		Realm:         "test",
+		Justification: "INC-1234",
+		CreatedBy:     "bob",
+		Expires:       expires,
+	})
+	require.NoError(t, err)
+
+	allowed, err = pe.Authorize(ctx, porc("alice", "mrn:iam:role:reader", "platform:doc:read"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	record = lastRecord()
+	assert.Equal(t, events.AccessRecord_GRANT, record.Decision)
+	assert.True(t, record.SystemOverride)
+	assert.Equal(t, events.AccessRecord_BREAK_GLASS, record.OverrideReason.(*events.AccessRecord_GrantReason).GrantReason)
+	assert.Equal(t, glass.ID, record.Override.Id)
+	assert.Equal(t, "INC-1234", record.Override.Justification)
+	assert.Equal(t, "bob", record.Override.CreatedBy)
+
+	// once revoked, policies decide again
+	assert.True(t, pe.RemoveOverride(glass.ID))
+	allowed, err = pe.Authorize(ctx, porc("alice", "mrn:iam:role:reader", "platform:doc:read"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Nil(t, lastRecord().Override)
+}
+
+func TestRevocation(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	revoked := revocation.NewMemory()
+	checker := revocation.NewCounter(revoked)
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}),
+		options.WithRevocationChecker(checker))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	porc := func(claims string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:admin"]%s}, "operation": "platform:admin:update", "resource": "mrn:app:doc:1"}`, claims)
+	}
+	lastRecord := func() *events.AccessRecord {
+		records := mockLog.GetRecords()
+		return records[len(records)-1]
+	}
+
+	allowed, err := pe.Authorize(ctx, porc(`, "jti": "t1", "sid": "s1"`))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// a revoked token is denied although the policies grant it
+	revoked.RevokeToken("t1", time.Now().Add(time.Hour))
+	allowed, err = pe.Authorize(ctx, porc(`, "jti": "t1", "sid": "s1"`))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	record := lastRecord()
+	assert.Equal(t, events.AccessRecord_DENY, record.Decision)
+	assert.True(t, record.SystemOverride)
+	assert.Equal(t, events.AccessRecord_REVOKED, record.OverrideReason.(*events.AccessRecord_DenyReason).DenyReason)
+	require.Len(t, record.References, 1, "no policy is evaluated")
+	assert.Equal(t, events.AccessRecord_BundleReference_SYSTEM, record.References[0].Phase)
+	assert.Equal(t, "revocation memory: token revoked", record.References[0].Reason)
+
+	// as are the other tokens of a revoked session
+	revoked.RevokeSession("s1", time.Time{})
+	allowed, err = pe.Authorize(ctx, porc(`, "jti": "t2", "sid": "s1"`))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// principals without jti or sid are not checked
+	allowed, err = pe.Authorize(ctx, porc(""))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	assert.Equal(t, revocation.Stats{Checks: 3, Hits: 2}, checker.Stats())
+}
+
+func TestRevocation_CheckFails(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	// a checker that never synchronized fails every check
+	synced, err := revocation.NewSynced(revocation.SyncOptions{Source: &revocation.HTTPSource{}})
+	require.NoError(t, err)
+
+	mockLog := &mockAccessLog{}
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")},
+		options.WithAccessLog(&mockAccessLogFactory{stream: mockLog}),
+		options.WithRevocationChecker(synced))
+	require.NoError(t, err)
+
+	allowed, err := pe.Authorize(context.Background(), `{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:admin"], "jti": "t1"}, "operation": "platform:admin:update", "resource": "mrn:app:doc:1"}`)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	records := mockLog.GetRecords()
+	record := records[len(records)-1]
+	assert.False(t, record.SystemOverride)
+	require.Len(t, record.References, 1)
+	assert.Equal(t, events.AccessRecord_BundleReference_NETWORK_ERROR, record.References[0].ReasonCode)
+	assert.Contains(t, record.References[0].Reason, "revocation synced: "+revocation.ErrNotSynced.Error())
+}
+
+func TestOverrides_InvalidConfig(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	expires := time.Now().Add(time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name    string
+		entry   map[string]interface{}
+		message string
+	}{
+		{"missing justification", map[string]interface{}{"type": "break-glass", "subject": "alice", "expires": expires}, "requires a justification"},
+		{"unknown type", map[string]interface{}{"type": "allow", "subject": "alice", "expires": expires}, "unknown override type"},
+		{"invalid expiry", map[string]interface{}{"type": "deny", "subject": "alice", "expires": "tomorrow"}, "invalid expires 'tomorrow'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.VConfig.Set(config.Overrides, []map[string]interface{}{tt.entry})
+			defer config.VConfig.Set(config.Overrides, nil)
+
+			_, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "bypass.yml")})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "overrides[0]")
+			assert.Contains(t, err.Error(), tt.message)
+		})
+	}
+}
+
+const cacheDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: cache
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:deny-all"
+      rego: |
+        package authz
+        default allow = false
+    - mrn: "mrn:iam:policy:after-epoch"
+      rego: |
+        package authz
+        default allow = false
+        allow { time.now_ns() > 0 }
+  roles:
+    - mrn: "mrn:iam:role:member"
+      policy: "mrn:iam:policy:allow-all"
+    - mrn: "mrn:iam:role:timed"
+      policy: "mrn:iam:policy:after-epoch"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+      default: true
+    - mrn: "mrn:iam:resource-group:secret"
+      policy: "mrn:iam:policy:deny-all"
+  resources:
+    - name: secrets
+      selector:
+        - "mrn:app:secret:.*"
+      group: "mrn:iam:resource-group:secret"
+  operations:
+    - name: app
+      selector:
+        - "app:.*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestDecide_CacheHint(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "cache.yml")
+	require.NoError(t, os.WriteFile(path, []byte(cacheDomain), 0600))
+
+	porc := func(role, resource, exp string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:%s"]%s}, "operation": "app:doc:read", "resource": "%s"}`,
+			role, exp, resource)
+	}
+	expIn := func(d time.Duration) string {
+		return fmt.Sprintf(`, "exp": %d`, time.Now().Add(d).Unix())
+	}
+
+	// decisions are not cacheable by default
+	pe, err := core.NewLocalPolicyEngine([]string{path}, options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+	decision, err := pe.Decide(context.Background(), porc("member", "mrn:app:doc:1", ""))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Zero(t, decision.Cache.TTL)
+	assert.Equal(t, pe.GetBundleInfo().Revision, decision.Cache.Revision)
+
+	pe, err = core.NewLocalPolicyEngine([]string{path}, options.WithAccessLog(accesslog.NewNullFactory()),
+		options.WithDecisionCacheTTL(time.Minute))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		porc    string
+		allowed bool
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"grant", porc("member", "mrn:app:doc:1", ""), true, time.Minute, time.Minute},
+		{"deny", porc("member", "mrn:app:secret:1", ""), false, 0, 0},
+		{"token expires first", porc("member", "mrn:app:doc:1", expIn(30*time.Second)), true, 25 * time.Second, 30 * time.Second},
+		{"token expires later", porc("member", "mrn:app:doc:1", expIn(time.Hour)), true, time.Minute, time.Minute},
+		{"token expired", porc("member", "mrn:app:doc:1", expIn(-time.Second)), true, 0, 0},
+		{"reads the clock", porc("timed", "mrn:app:doc:1", ""), true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := pe.Decide(context.Background(), tt.porc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, decision.Allow)
+			assert.GreaterOrEqual(t, decision.Cache.TTL, tt.min)
+			assert.LessOrEqual(t, decision.Cache.TTL, tt.max)
+			assert.NotZero(t, decision.Cache.Revision)
+		})
+	}
+
+	// every use of break-glass access must reach the access log
+	_, err = pe.AddOverride(override.Override{
+		Type:          override.BreakGlass,
+		Subject:       "alice",
+		Justification: "INC-1",
+		Expires:       time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	decision, err = pe.Decide(context.Background(), porc("member", "mrn:app:secret:1", ""))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Zero(t, decision.Cache.TTL)
+}
+
+// FuzzDecide checks that no PORC, however malformed, can panic the decision path
+func FuzzDecide(f *testing.F) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	pe, err := core.NewLocalPolicyEngine([]string{"../../cmd/mpe/test/consolidated.yml"},
+		options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(f, err)
+
+	f.Add(`{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:admin"]}, "resource": "mrn:app:document:1", "operation": "documents:read"}`)
+	f.Add(`{"principal": {"sub": "alice", "mroles": "mrn:iam:role:admin", "mgroups": [1, null], "scopes": {}}, "resource": {"id": 1, "annotations": []}, "operation": 7}`)
+	f.Add(`{"principal": {"mannotations": "x", "exp": "soon"}, "resource": {"compartments": [1, "a"], "classification": {}}}`)
+	f.Add(`{"principal": null, "resource": null, "operation": null, "context": null}`)
+	f.Add(`{}`)
+	f.Add(`null`)
+
+	f.Fuzz(func(t *testing.T, porc string) {
+		decision, err := pe.Decide(context.Background(), porc)
+		if err == nil && decision == nil {
+			t.Fatalf("no decision and no error for %q", porc)
+		}
+	})
+}
+
+// panicBackend panics in the lookup named by method, to stand in for a faulty backend or policy
+type panicBackend struct {
+	backend.Service
+	method string
+}
+
+func (b *panicBackend) GetOperation(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	if b.method == "GetOperation" {
+		panic("operation lookup failed")
+	}
+	return b.Service.GetOperation(ctx, mrn)
+}
+
+func (b *panicBackend) GetRole(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	if b.method == "GetRole" {
+		panic("role lookup failed")
+	}
+	return b.Service.GetRole(ctx, mrn)
+}
+
+func (b *panicBackend) GetResourceGroup(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	if b.method == "GetResourceGroup" {
+		panic("resource group lookup failed")
+	}
+	return b.Service.GetResourceGroup(ctx, mrn)
+}
+
+func (b *panicBackend) GetScope(ctx context.Context, mrn string) (*model.PolicyReference, *common.PolicyError) {
+	if b.method == "GetScope" {
+		var m map[string]string
+		m["scope"] = mrn // a nil map write, as a real bug would
+	}
+	return b.Service.GetScope(ctx, mrn)
+}
+
+func (b *panicBackend) GetResource(ctx context.Context, mrn string) (*model.Resource, *common.PolicyError) {
+	if b.method == "GetResource" {
+		panic("resource lookup failed")
+	}
+	return b.Service.GetResource(ctx, mrn)
+}
+
+type panicBackendFactory struct {
+	inner  backend.Factory
+	method string
+}
+
+func (f *panicBackendFactory) NewBackend(compiler *opa.Compiler) (backend.Service, error) {
+	be, err := f.inner.NewBackend(compiler)
+	if err != nil {
+		return nil, err
+	}
+	return &panicBackend{Service: be, method: f.method}, nil
+}
+
+func TestAuthorize_RecoversPanics(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	reg, err := registry.NewRegistry([]string{"../../cmd/mpe/test/consolidated.yml"})
+	require.NoError(t, err)
+
+	const grant = `{"principal": {"sub": "alice", "mrealm": "test", "mroles": ["mrn:iam:role:admin"], "scopes": ["mrn:iam:scope:read-api"]}, "resource": %s, "operation": "documents:get"}`
+	const descriptor = `{"id": "mrn:app:document:1", "group": "mrn:iam:resource-group:allow-all"}`
+
+	tests := []struct {
+		method   string
+		resource string
+		audited  bool // panics before the access record is complete cannot be audited
+	}{
+		{method: "", resource: descriptor, audited: true},
+		{method: "GetOperation", resource: descriptor, audited: true},
+		{method: "GetRole", resource: descriptor, audited: true},
+		{method: "GetResourceGroup", resource: descriptor, audited: true},
+		{method: "GetScope", resource: descriptor, audited: true},
+		{method: "GetResource", resource: `"mrn:app:document:1"`},
+	}
+	for _, tt := range tests {
+		name := tt.method
+		if name == "" {
+			name = "NoPanic"
+		}
+		t.Run(name, func(t *testing.T) {
+			log := &mockAccessLog{}
+			pe, err := core.NewPolicyEngine(
+				options.WithBackend(&panicBackendFactory{inner: local.NewFactory(reg), method: tt.method}),
+				options.WithAccessLog(&mockAccessLogFactory{stream: log}),
+			)
+			require.NoError(t, err)
+
+			decision, err := pe.Decide(context.Background(), fmt.Sprintf(grant, tt.resource))
+			require.NoError(t, err)
+
+			if tt.method == "" {
+				assert.True(t, decision.Allow, "the request is granted without a panic")
+				return
+			}
+			assert.False(t, decision.Allow)
+			assert.Zero(t, decision.Cache.TTL)
+
+			records := log.GetRecords()
+			if !tt.audited {
+				assert.Empty(t, records)
+				return
+			}
+			require.Len(t, records, 1)
+			assert.Equal(t, events.AccessRecord_DENY, records[0].Decision)
+
+			var internal []*events.AccessRecord_BundleReference
+			for _, ref := range records[0].References {
+				if ref.ReasonCode == events.AccessRecord_BundleReference_INTERNAL_ERROR {
+					internal = append(internal, ref)
+				}
+			}
+			require.Len(t, internal, 1)
+			assert.Equal(t, events.AccessRecord_DENY, internal[0].Decision)
+			assert.Contains(t, internal[0].Reason, "internal error")
+		})
+	}
+}
+
+func TestDecisionMetrics(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	config.VConfig.Set(config.AuditSamplingGrant, 0.0)
+	config.VConfig.Set(config.AuditSamplingDeny, 0.0)
+	defer config.ResetConfig()
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	metrics, err := accesslog.NewDecisionMetrics(accesslog.MetricsOptions{
+		Realm:     accesslog.MetricsLabelOptions{Allow: []string{"test"}},
+		Operation: accesslog.MetricsLabelOptions{Allow: []string{"data:report"}},
+	})
+	require.NoError(t, err)
+
+	pe, err := core.NewLocalPolicyEngine([]string{createTempFileFromTestData(t, "data.yml")},
+		options.WithAccessLog(accesslog.NewNullFactory()),
+		options.WithDecisionMetrics(metrics))
+	require.NoError(t, err)
+
+	porc := func(realm, country string) string {
+		return fmt.Sprintf(`{"principal": {"sub": "alice", "mrealm": "%s", "mroles": ["mrn:iam:role:member"], "mannotations": {"country": "%s", "clearance": "secret"}}, "operation": "data:report:read", "resource": "mrn:data:report:1"}`, realm, country)
+	}
+	for _, p := range []string{porc("test", "CA"), porc("test", "XX"), porc("acme", "CA")} {
+		_, err := pe.Authorize(context.Background(), p)
+		require.NoError(t, err)
+	}
+	// probes are not counted
+	_, err = pe.Authorize(context.Background(), porc("test", "CA"), options.SetProbeMode(true))
+	require.NoError(t, err)
+
+	// every decision is counted, although sampling drops them all from the access log
+	assert.Equal(t, []string{"decision", "realm", "operation"}, metrics.Labels())
+	assert.Equal(t, []accesslog.DecisionCount{
+		{Values: []string{"DENY", "test", "data:report"}, Count: 1},
+		{Values: []string{"GRANT", "other", "data:report"}, Count: 1},
+		{Values: []string{"GRANT", "test", "data:report"}, Count: 1},
+	}, metrics.Counts())
+}
+
+const entitlementsDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: entitlements
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:operation-default"
+      rego: |
+        package authz
+        default allow = 0
+        allow = -1 { input.operation == "docs:purge" }
+    - mrn: "mrn:iam:policy:admin-only"
+      rego: |
+        package authz
+        import future.keywords.in
+        default allow = 0
+        allow = -1 { not "mrn:iam:role:admin" in input.principal.mroles }
+    - mrn: "mrn:iam:policy:reader"
+      rego: |
+        package authz
+        import future.keywords.in
+        default allow = false
+        allow { input.operation in {"docs:read", "docs:list"} }
+    - mrn: "mrn:iam:policy:editor"
+      rego: |
+        package authz
+        default allow = false
+        allow { input.operation == "docs:write" }
+        allow { input.operation == "docs:purge" }
+        allow { startswith(input.operation, "docs:draft:") }
+    - mrn: "mrn:iam:policy:admin"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:docs"
+      rego: |
+        package authz
+        default allow = true
+        allow = false { input.operation == "docs:write"; input.resource.annotations.locked }
+  roles:
+    - mrn: "mrn:iam:role:reader"
+      policy: "mrn:iam:policy:reader"
+    - mrn: "mrn:iam:role:editor"
+      policy: "mrn:iam:policy:editor"
+    - mrn: "mrn:iam:role:admin"
+      policy: "mrn:iam:policy:admin"
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:docs"
+      policy: "mrn:iam:policy:docs"
+      default: true
+  resources:
+    - name: locked
+      selector:
+        - "mrn:app:doc:locked"
+      group: "mrn:iam:resource-group:docs"
+      annotations:
+        - name: locked
+          value: true
+  operations:
+    - name: audit
+      selector:
+        - "^docs:audit$"
+      policy: "mrn:iam:policy:admin-only"
+    - name: docs
+      selector:
+        - "docs:.*"
+      policy: "mrn:iam:policy:operation-default"
+`
+
+func TestListPermittedOperations(t *testing.T) {
+	setupTestConfig()
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, false)
+	defer config.VConfig.Set(config.MockEnabled, true)
+
+	path := filepath.Join(t.TempDir(), "entitlements.yml")
+	require.NoError(t, os.WriteFile(path, []byte(entitlementsDomain), 0600))
+	records := accesslog.NewChannelFactory(16)
+	pe, err := core.NewLocalPolicyEngine([]string{path}, options.WithAccessLog(records))
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name      string
+		roles     []string
+		resource  interface{}
+		permitted []string
+	}{
+		{"reader", []string{"mrn:iam:role:reader"}, "mrn:app:doc:1", []string{"docs:list", "docs:read"}},
+		// operations granted by a pattern are not candidates, and purge is denied by the operation
+		{"editor", []string{"mrn:iam:role:editor"}, "mrn:app:doc:1", []string{"docs:write"}},
+		{"locked", []string{"mrn:iam:role:editor", "mrn:iam:role:reader"}, "mrn:app:doc:locked", []string{"docs:list", "docs:read"}},
+		{"descriptor", []string{"mrn:iam:role:editor"}, map[string]interface{}{"id": "mrn:app:doc:2", "group": "mrn:iam:resource-group:docs"}, []string{"docs:write"}},
+		// the audit operation is named by its selector, and write by the resource group's policy;
+		// operations no policy names are not candidates, even if granted by default
+		{"admin", []string{"mrn:iam:role:admin"}, "mrn:app:doc:1", []string{"docs:audit", "docs:write"}},
+		{"none", nil, "mrn:app:doc:1", []string{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			principal := map[string]interface{}{"sub": "alice", "mroles": tt.roles}
+			permitted, err := pe.ListPermittedOperations(context.Background(), principal, tt.resource)
+			require.NoError(t, err)
+			assert.Equal(t, tt.permitted, permitted)
+			assert.NotContains(t, principal, "mannotations", "the caller's principal is not modified")
+		})
+	}
+
+	// the decisions are made in probe mode
+	assert.Empty(t, records.C())
+}
+
+func TestListPermittedOperations_NoLister(t *testing.T) {
+	pe, err := core.NewPolicyEngine(options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	permitted, err := pe.ListPermittedOperations(context.Background(), map[string]interface{}{"sub": "alice"}, "mrn:app:doc:1")
+	require.NoError(t, err)
+	assert.Empty(t, permitted)
+}
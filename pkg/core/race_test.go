@@ -0,0 +1,10 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+//go:build race
+
+package core_test
+
+// raceEnabled reports whether the tests run with the race detector
+const raceEnabled = true
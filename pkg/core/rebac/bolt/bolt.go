@@ -0,0 +1,217 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package bolt provides a [rebac.Store] persisting relationship tuples in a Bolt
+// database file, for a single engine process that must keep its tuples across
+// restarts without running a database server.
+//
+// # Usage
+//
+//	store, err := bolt.Open("/var/lib/mpe/rebac.db")
+//	if err != nil {
+//	    return err
+//	}
+//	defer store.Close()
+//
+//	pe, err := core.NewPolicyEngine(options.WithBuiltins(rebac.NewBuiltin(store)))
+//
+// Bolt locks its file, so that a single process can open it at a time. Use the
+// postgres store to share tuples between engines.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/rebac"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// DefaultBucket is the bucket holding the tuples, unless configured otherwise.
+const DefaultBucket = "rebac"
+
+// DefaultTimeout limits how long Open waits for the lock of the file, unless configured
+// otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// separator joins the object, relation, and subject of a key. It cannot appear in MRNs.
+const separator = "\x00"
+
+// Store is a [rebac.Store] persisting tuples in a Bolt database. Tuples are keyed by
+// object, relation, and subject, so that checks read a contiguous range of keys.
+//
+// Store is safe for concurrent use.
+type Store struct {
+	db     *bbolt.DB
+	bucket []byte
+	owned  bool
+}
+
+var _ rebac.Store = (*Store)(nil)
+
+type options struct {
+	bucket  string
+	timeout time.Duration
+}
+
+// Option configures a [Store].
+type Option func(*options)
+
+// WithBucket stores the tuples in the named bucket, [DefaultBucket] by default, such as
+// to share a database with other data.
+func WithBucket(name string) Option {
+	return func(o *options) {
+		o.bucket = name
+	}
+}
+
+// WithTimeout limits how long [Open] waits for the lock of the file, [DefaultTimeout]
+// by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{bucket: DefaultBucket, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Open opens, or creates, the Bolt database at path and returns a [Store] using it.
+// Close the store to release the file.
+func Open(path string, opts ...Option) (*Store, error) {
+	o := newOptions(opts)
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: o.timeout})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	s, err := newStore(db, o)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s.owned = true
+	return s, nil
+}
+
+// New returns a [Store] using a database opened by the caller, who remains responsible
+// for closing it.
+func New(db *bbolt.DB, opts ...Option) (*Store, error) {
+	return newStore(db, newOptions(opts))
+}
+
+func newStore(db *bbolt.DB, o *options) (*Store, error) {
+	if o.bucket == "" {
+		return nil, fmt.Errorf("bucket name cannot be empty")
+	}
+
+	s := &Store{db: db, bucket: []byte(o.bucket)}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create bucket %s: %w", o.bucket, err)
+	}
+	return s, nil
+}
+
+// Close closes the database if the store opened it with [Open].
+func (s *Store) Close() error {
+	if !s.owned {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Write implements [rebac.Store], writing the tuples in a single transaction.
+func (s *Store) Write(_ context.Context, tuples ...rebac.Tuple) error {
+	if err := rebac.ValidateAll(tuples...); err != nil {
+		return err
+	}
+	for _, t := range tuples {
+		if err := checkSeparator(t); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		for _, t := range tuples {
+			if err := b.Put(key(t), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete implements [rebac.Store], deleting the tuples in a single transaction.
+func (s *Store) Delete(_ context.Context, tuples ...rebac.Tuple) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		for _, t := range tuples {
+			if err := b.Delete(key(t)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Read implements [rebac.Store]. Tuples are returned ordered by object, relation, then
+// subject. A filter without an object scans every tuple.
+func (s *Store) Read(_ context.Context, filter rebac.Filter) ([]rebac.Tuple, error) {
+	var prefix []byte
+	if filter.Object != "" {
+		prefix = []byte(filter.Object + separator)
+		if filter.Relation != "" {
+			prefix = append(prefix, filter.Relation+separator...)
+		}
+	}
+
+	var result []rebac.Tuple
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			t, ok := parseKey(k)
+			if ok && filter.Matches(t) {
+				result = append(result, t)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func key(t rebac.Tuple) []byte {
+	return []byte(t.Object + separator + t.Relation + separator + t.Subject)
+}
+
+func parseKey(k []byte) (rebac.Tuple, bool) {
+	parts := strings.Split(string(k), separator)
+	if len(parts) != 3 {
+		return rebac.Tuple{}, false
+	}
+	return rebac.Tuple{Object: parts[0], Relation: parts[1], Subject: parts[2]}, true
+}
+
+func checkSeparator(t rebac.Tuple) error {
+	if strings.Contains(t.Subject+t.Relation+t.Object, separator) {
+		return fmt.Errorf("tuple %s: fields cannot contain NUL characters", t)
+	}
+	return nil
+}
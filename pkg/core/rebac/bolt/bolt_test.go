@@ -0,0 +1,100 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package bolt
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/rebac"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rebac.db")
+
+	s, err := Open(path)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Write(ctx,
+		rebac.Tuple{Subject: "user:bob", Relation: "viewer", Object: "doc:1"},
+		rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"},
+		rebac.Tuple{Subject: "user:alice", Relation: "editor", Object: "doc:1"},
+		rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:10"},
+	))
+
+	// the prefix of an object does not select the objects it starts
+	tuples, err := s.Read(ctx, rebac.Filter{Relation: "viewer", Object: "doc:1"})
+	require.NoError(t, err)
+	assert.Equal(t, []rebac.Tuple{
+		{Subject: "user:alice", Relation: "viewer", Object: "doc:1"},
+		{Subject: "user:bob", Relation: "viewer", Object: "doc:1"},
+	}, tuples)
+
+	tuples, err = s.Read(ctx, rebac.Filter{Object: "doc:1"})
+	require.NoError(t, err)
+	assert.Len(t, tuples, 3)
+
+	tuples, err = s.Read(ctx, rebac.Filter{Subject: "user:alice", Relation: "viewer"})
+	require.NoError(t, err)
+	assert.Equal(t, []rebac.Tuple{
+		{Subject: "user:alice", Relation: "viewer", Object: "doc:1"},
+		{Subject: "user:alice", Relation: "viewer", Object: "doc:10"},
+	}, tuples)
+
+	assert.Error(t, s.Write(ctx, rebac.Tuple{Subject: "user:\x00", Relation: "viewer", Object: "doc:1"}))
+	assert.Error(t, s.Write(ctx, rebac.Tuple{Subject: "user:carol", Relation: "viewer"}))
+
+	require.NoError(t, s.Delete(ctx, rebac.Tuple{Subject: "user:bob", Relation: "viewer", Object: "doc:1"}))
+	require.NoError(t, s.Close())
+
+	// tuples persist across restarts
+	s, err = Open(path)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	allowed, err := rebac.Check(ctx, s, "user:bob", "viewer", "doc:1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = rebac.Check(ctx, s, "user:alice", "viewer", "doc:1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestNew(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "shared.db"), 0600, nil)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	s, err := New(db, WithBucket("relationships"))
+	require.NoError(t, err)
+	require.NoError(t, s.Write(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"}))
+
+	// the caller's database stays open
+	require.NoError(t, s.Close())
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		assert.NotNil(t, tx.Bucket([]byte("relationships")))
+		return nil
+	}))
+
+	_, err = New(db, WithBucket(""))
+	assert.Error(t, err)
+}
+
+func TestOpen_Locked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rebac.db")
+	s, err := Open(path)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	_, err = Open(path, WithTimeout(50*time.Millisecond))
+	assert.Error(t, err)
+}
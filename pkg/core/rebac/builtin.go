@@ -0,0 +1,71 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package rebac
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// CheckBuiltin is the name of the built-in function that checks a relationship.
+const CheckBuiltin = "rebac.check"
+
+var checkDecl = &rego.Function{
+	Name:        CheckBuiltin,
+	Description: "Reports whether subject holds relation on object in the relationship store.",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("subject", types.S).Description("subject, such as user:alice"),
+			types.Named("relation", types.S).Description("relation, such as viewer"),
+			types.Named("object", types.S).Description("object, such as doc:readme"),
+		),
+		types.Named("result", types.B).Description("true if the relationship holds, directly or through usersets"),
+	),
+	Memoize:          true,
+	Nondeterministic: true,
+}
+
+// Declaration returns the capability declaration of [CheckBuiltin], for tooling that
+// compiles Rego without a [Store], such as lint.
+func Declaration() *ast.Builtin {
+	return (&opa.Builtin{Decl: checkDecl}).Declaration()
+}
+
+// NewBuiltin returns the [CheckBuiltin] implementation querying store, to register with
+// the policy engine:
+//
+//	pe, err := core.NewPolicyEngine(options.WithBuiltins(rebac.NewBuiltin(store)))
+//
+// A failure of the store halts the evaluation with an error, which denies the request.
+func NewBuiltin(store Store) *opa.Builtin {
+	return &opa.Builtin{
+		Decl: checkDecl,
+		Impl: func(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+			var operands [3]string
+			for i, arg := range args {
+				s, ok := arg.Value.(ast.String)
+				if !ok {
+					return nil, rego.NewHaltError(fmt.Errorf("%s: operand %d must be a string, got %s", CheckBuiltin, i+1, ast.ValueName(arg.Value)))
+				}
+				operands[i] = string(s)
+			}
+
+			ctx := bctx.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			result, err := Check(ctx, store, operands[0], operands[1], operands[2])
+			if err != nil {
+				return nil, rego.NewHaltError(fmt.Errorf("%s: %w", CheckBuiltin, err))
+			}
+			return ast.BooleanTerm(result), nil
+		},
+	}
+}
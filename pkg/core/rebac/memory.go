@@ -0,0 +1,101 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package rebac
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is a [Store] keeping its tuples in memory, indexed by object and relation.
+//
+// MemoryStore is safe for concurrent use.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	tuples map[objectRelation]map[string]struct{} // subjects by object and relation
+}
+
+type objectRelation struct {
+	object, relation string
+}
+
+// NewMemoryStore creates an empty [MemoryStore].
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tuples: make(map[objectRelation]map[string]struct{})}
+}
+
+// Write implements [Store].
+func (s *MemoryStore) Write(_ context.Context, tuples ...Tuple) error {
+	if err := ValidateAll(tuples...); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tuples {
+		key := objectRelation{t.Object, t.Relation}
+		subjects, ok := s.tuples[key]
+		if !ok {
+			subjects = make(map[string]struct{})
+			s.tuples[key] = subjects
+		}
+		subjects[t.Subject] = struct{}{}
+	}
+	return nil
+}
+
+// Delete implements [Store].
+func (s *MemoryStore) Delete(_ context.Context, tuples ...Tuple) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tuples {
+		key := objectRelation{t.Object, t.Relation}
+		if subjects, ok := s.tuples[key]; ok {
+			delete(subjects, t.Subject)
+			if len(subjects) == 0 {
+				delete(s.tuples, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Read implements [Store]. Tuples are returned ordered by object, relation, then subject.
+func (s *MemoryStore) Read(_ context.Context, filter Filter) ([]Tuple, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []Tuple
+	collect := func(key objectRelation, subjects map[string]struct{}) {
+		for subject := range subjects {
+			t := Tuple{Subject: subject, Relation: key.relation, Object: key.object}
+			if filter.Matches(t) {
+				result = append(result, t)
+			}
+		}
+	}
+
+	if filter.Object != "" && filter.Relation != "" {
+		key := objectRelation{filter.Object, filter.Relation}
+		collect(key, s.tuples[key])
+	} else {
+		for key, subjects := range s.tuples {
+			collect(key, subjects)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Object != b.Object {
+			return a.Object < b.Object
+		}
+		if a.Relation != b.Relation {
+			return a.Relation < b.Relation
+		}
+		return a.Subject < b.Subject
+	})
+	return result, nil
+}
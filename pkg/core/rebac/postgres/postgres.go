@@ -0,0 +1,191 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package postgres provides a [rebac.Store] persisting relationship tuples in a
+// PostgreSQL table, so that several engines share the same relationships.
+//
+// The store uses database/sql and does not depend on a driver; open the database
+// with the driver of your choice, such as pgx:
+//
+//	db, err := sql.Open("pgx", "postgres://mpe@db.example.com/authz")
+//	if err != nil {
+//	    return err
+//	}
+//	store, err := postgres.New(db, postgres.WithTable("rebac_tuples"))
+//	if err != nil {
+//	    return err
+//	}
+//	if err := store.Migrate(ctx); err != nil {
+//	    return err
+//	}
+//
+//	pe, err := core.NewPolicyEngine(options.WithBuiltins(rebac.NewBuiltin(store)))
+//
+// # Schema
+//
+// [Store.Migrate] creates the table if it does not exist:
+//
+//	CREATE TABLE IF NOT EXISTS rebac_tuples (
+//	    object   TEXT NOT NULL,
+//	    relation TEXT NOT NULL,
+//	    subject  TEXT NOT NULL,
+//	    PRIMARY KEY (object, relation, subject)
+//	)
+//
+// The primary key serves the lookups of checks, which select by object and relation.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/core/rebac"
+)
+
+// DefaultTable is the table holding the tuples, unless configured otherwise.
+const DefaultTable = "rebac_tuples"
+
+// tableName accepts plain and schema-qualified identifiers, which are not quoted
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Store is a [rebac.Store] persisting tuples in a PostgreSQL table.
+//
+// Store is safe for concurrent use.
+type Store struct {
+	db    *sql.DB
+	table string
+}
+
+var _ rebac.Store = (*Store)(nil)
+
+type options struct {
+	table string
+}
+
+// Option configures a [Store].
+type Option func(*options)
+
+// WithTable stores the tuples in the named table, [DefaultTable] by default. The name
+// may be qualified with a schema.
+func WithTable(name string) Option {
+	return func(o *options) {
+		o.table = name
+	}
+}
+
+// New returns a [Store] using db, which the caller remains responsible for closing.
+//
+// Returns an error if the table name is not a valid identifier.
+func New(db *sql.DB, opts ...Option) (*Store, error) {
+	o := &options{table: DefaultTable}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if !tableName.MatchString(o.table) {
+		return nil, fmt.Errorf("invalid table name '%s'", o.table)
+	}
+
+	return &Store{db: db, table: o.table}, nil
+}
+
+// Migrate creates the table of the store if it does not exist.
+func (s *Store) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	object   TEXT NOT NULL,
+	relation TEXT NOT NULL,
+	subject  TEXT NOT NULL,
+	PRIMARY KEY (object, relation, subject)
+)`, s.table))
+	if err != nil {
+		return fmt.Errorf("create table %s: %w", s.table, err)
+	}
+	return nil
+}
+
+// Write implements [rebac.Store], writing the tuples in a single transaction.
+func (s *Store) Write(ctx context.Context, tuples ...rebac.Tuple) error {
+	if err := rebac.ValidateAll(tuples...); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (object, relation, subject) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", s.table)
+	return s.exec(ctx, query, tuples)
+}
+
+// Delete implements [rebac.Store], deleting the tuples in a single transaction.
+func (s *Store) Delete(ctx context.Context, tuples ...rebac.Tuple) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE object = $1 AND relation = $2 AND subject = $3", s.table)
+	return s.exec(ctx, query, tuples)
+}
+
+// exec runs query for each tuple in a transaction
+func (s *Store) exec(ctx context.Context, query string, tuples []rebac.Tuple) error {
+	if len(tuples) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, t := range tuples {
+		if _, err := stmt.ExecContext(ctx, t.Object, t.Relation, t.Subject); err != nil {
+			return fmt.Errorf("tuple %s: %w", t, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Read implements [rebac.Store]. Tuples are returned ordered by object, relation, then
+// subject.
+func (s *Store) Read(ctx context.Context, filter rebac.Filter) ([]rebac.Tuple, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	for _, c := range []struct{ column, value string }{
+		{"object", filter.Object},
+		{"relation", filter.Relation},
+		{"subject", filter.Subject},
+	} {
+		if c.value != "" {
+			args = append(args, c.value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", c.column, len(args)))
+		}
+	}
+
+	query := fmt.Sprintf("SELECT object, relation, subject FROM %s", s.table)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY object, relation, subject"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var result []rebac.Tuple
+	for rows.Next() {
+		var t rebac.Tuple
+		if err := rows.Scan(&t.Object, &t.Relation, &t.Subject); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,129 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package postgres
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/manetu/policyengine/pkg/core/rebac"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMock(t *testing.T, opts ...Option) (*Store, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, mock.ExpectationsWereMet())
+		_ = db.Close()
+	})
+
+	s, err := New(db, opts...)
+	require.NoError(t, err)
+	return s, mock
+}
+
+func TestNew_InvalidTable(t *testing.T) {
+	for _, name := range []string{"", "tuples; DROP TABLE x", "a.b.c", "1tuples"} {
+		_, err := New(nil, WithTable(name))
+		assert.Error(t, err, name)
+	}
+
+	_, err := New(nil, WithTable("authz.tuples"))
+	assert.NoError(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	s, mock := newMock(t, WithTable("authz.tuples"))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS authz.tuples (")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	require.NoError(t, s.Migrate(context.Background()))
+}
+
+func TestWrite(t *testing.T) {
+	s, mock := newMock(t)
+	insert := regexp.QuoteMeta("INSERT INTO rebac_tuples (object, relation, subject) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING")
+
+	mock.ExpectBegin()
+	prepared := mock.ExpectPrepare(insert)
+	prepared.ExpectExec().WithArgs("doc:1", "viewer", "user:alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	prepared.ExpectExec().WithArgs("doc:1", "viewer", "team:eng#member").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, s.Write(context.Background(),
+		rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"},
+		rebac.Tuple{Subject: "team:eng#member", Relation: "viewer", Object: "doc:1"},
+	))
+
+	// invalid tuples are rejected before reaching the database
+	assert.Error(t, s.Write(context.Background(), rebac.Tuple{Subject: "user:alice"}))
+}
+
+func TestWrite_Rollback(t *testing.T) {
+	s, mock := newMock(t)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO rebac_tuples").ExpectExec().WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	err := s.Write(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"})
+	assert.ErrorContains(t, err, "connection reset")
+}
+
+func TestDelete(t *testing.T) {
+	s, mock := newMock(t)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(regexp.QuoteMeta("DELETE FROM rebac_tuples WHERE object = $1 AND relation = $2 AND subject = $3")).
+		ExpectExec().WithArgs("doc:1", "viewer", "user:alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, s.Delete(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"}))
+
+	// nothing to delete does not open a transaction
+	require.NoError(t, s.Delete(context.Background()))
+}
+
+func TestRead(t *testing.T) {
+	s, mock := newMock(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT object, relation, subject FROM rebac_tuples WHERE object = $1 AND relation = $2 ORDER BY object, relation, subject")).
+		WithArgs("doc:1", "viewer").
+		WillReturnRows(sqlmock.NewRows([]string{"object", "relation", "subject"}).
+			AddRow("doc:1", "viewer", "team:eng#member"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT object, relation, subject FROM rebac_tuples WHERE object = $1 AND relation = $2 ORDER BY object, relation, subject")).
+		WithArgs("team:eng", "member").
+		WillReturnRows(sqlmock.NewRows([]string{"object", "relation", "subject"}).
+			AddRow("team:eng", "member", "user:alice"))
+
+	allowed, err := rebac.Check(context.Background(), s, "user:alice", "viewer", "doc:1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT object, relation, subject FROM rebac_tuples WHERE subject = $1 ORDER BY object, relation, subject")).
+		WithArgs("user:alice").
+		WillReturnRows(sqlmock.NewRows([]string{"object", "relation", "subject"}).
+			AddRow("doc:1", "viewer", "user:alice").
+			AddRow("doc:2", "editor", "user:alice"))
+
+	tuples, err := s.Read(context.Background(), rebac.Filter{Subject: "user:alice"})
+	require.NoError(t, err)
+	assert.Equal(t, []rebac.Tuple{
+		{Subject: "user:alice", Relation: "viewer", Object: "doc:1"},
+		{Subject: "user:alice", Relation: "editor", Object: "doc:2"},
+	}, tuples)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT object, relation, subject FROM rebac_tuples ORDER BY object, relation, subject")).
+		WillReturnError(errors.New("connection refused"))
+
+	_, err = s.Read(context.Background(), rebac.Filter{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package rebac provides relationship-based access control (ReBAC) as an adjunct to
+// the policy engine's role-based policies.
+//
+// Relationships are stored as tuples of a subject, a relation, and an object, such as
+// ("user:alice", "viewer", "doc:readme"), which records that alice may view the
+// readme. A [Store] persists the tuples, and the [CheckBuiltin] built-in lets policies
+// query them:
+//
+//	allow {
+//	    rebac.check(concat(":", ["user", input.principal.sub]), "viewer", input.resource.id)
+//	}
+//
+// so that a policy can, for example, grant editors by role and everyone else by the
+// documents shared with them.
+//
+// # Usersets
+//
+// The subject of a tuple may be a userset, written object#relation, which relates
+// every subject holding that relation on that object. Sharing a document with a team
+// is then a single tuple:
+//
+//	store.Write(ctx,
+//	    rebac.Tuple{Subject: "user:alice", Relation: "member", Object: "team:eng"},
+//	    rebac.Tuple{Subject: "team:eng#member", Relation: "viewer", Object: "doc:readme"},
+//	)
+//
+// [Check] follows usersets up to [MaxCheckDepth] levels.
+//
+// # Stores
+//
+// [NewMemoryStore] keeps tuples in memory, for tests and for applications that load
+// them at startup. The bolt and postgres subpackages persist them in a Bolt file or a
+// PostgreSQL table. Other stores implement the [Store] interface.
+//
+// # Usage
+//
+//	store := rebac.NewMemoryStore()
+//	pe, err := core.NewPolicyEngine(
+//	    options.WithBuiltins(rebac.NewBuiltin(store)),
+//	)
+//
+// Decisions that call [CheckBuiltin] depend on the tuples, so they are never reported as
+// cacheable (see model.CacheHint).
+package rebac
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MaxCheckDepth limits the number of usersets that [Check] follows from an object, so
+// that cyclic or deeply nested relationships cannot stall a decision.
+const MaxCheckDepth = 8
+
+// Tuple relates a subject to an object.
+type Tuple struct {
+	// Subject is the entity related to the object, such as "user:alice", or a userset,
+	// such as "team:eng#member".
+	Subject string
+	// Relation is the name of the relationship, such as "viewer".
+	Relation string
+	// Object is the entity the subject is related to, such as "doc:readme".
+	Object string
+}
+
+// String formats the tuple as object#relation@subject
+func (t Tuple) String() string {
+	return t.Object + "#" + t.Relation + "@" + t.Subject
+}
+
+// Validate returns an error if a field of the tuple is empty, or if the relation or
+// object contains a '#', which separates the object and relation of a userset.
+func (t Tuple) Validate() error {
+	switch {
+	case t.Subject == "" || t.Relation == "" || t.Object == "":
+		return fmt.Errorf("tuple %s: subject, relation, and object are required", t)
+	case strings.Contains(t.Relation, "#") || strings.Contains(t.Object, "#"):
+		return fmt.Errorf("tuple %s: relation and object cannot contain '#'", t)
+	case strings.Count(t.Subject, "#") > 1:
+		return fmt.Errorf("tuple %s: invalid userset subject", t)
+	}
+	return nil
+}
+
+// Userset returns the object and relation of a userset subject, and false if the
+// subject is not a userset.
+func (t Tuple) Userset() (object, relation string, ok bool) {
+	object, relation, ok = strings.Cut(t.Subject, "#")
+	return object, relation, ok && object != "" && relation != ""
+}
+
+// Filter selects tuples. Empty fields match any value.
+type Filter struct {
+	Subject  string
+	Relation string
+	Object   string
+}
+
+// Matches returns true if the filter selects t
+func (f Filter) Matches(t Tuple) bool {
+	return (f.Subject == "" || f.Subject == t.Subject) &&
+		(f.Relation == "" || f.Relation == t.Relation) &&
+		(f.Object == "" || f.Object == t.Object)
+}
+
+// Store persists relationship tuples.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Write adds the tuples, ignoring those already stored. Returns an error, and
+	// writes none of them, if a tuple is invalid (see [Tuple.Validate]).
+	Write(ctx context.Context, tuples ...Tuple) error
+
+	// Delete removes the tuples, ignoring those not stored.
+	Delete(ctx context.Context, tuples ...Tuple) error
+
+	// Read returns the tuples selected by the filter.
+	Read(ctx context.Context, filter Filter) ([]Tuple, error)
+}
+
+// Check returns true if subject holds relation on object, either directly or through
+// the usersets related to the object, followed up to [MaxCheckDepth] levels.
+func Check(ctx context.Context, store Store, subject, relation, object string) (bool, error) {
+	type node struct{ object, relation string }
+
+	visited := map[node]bool{}
+	level := []node{{object, relation}}
+	for depth := 0; depth <= MaxCheckDepth && len(level) > 0; depth++ {
+		var next []node
+		for _, n := range level {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+
+			tuples, err := store.Read(ctx, Filter{Relation: n.relation, Object: n.object})
+			if err != nil {
+				return false, err
+			}
+			for _, t := range tuples {
+				if t.Subject == subject {
+					return true, nil
+				}
+				if o, r, ok := t.Userset(); ok {
+					next = append(next, node{o, r})
+				}
+			}
+		}
+		level = next
+	}
+
+	return false, nil
+}
+
+// ValidateAll returns the error of the first invalid tuple, if any, for stores that must
+// reject a write before storing any tuple.
+func ValidateAll(tuples ...Tuple) error {
+	for _, t := range tuples {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
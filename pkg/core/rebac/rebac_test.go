@@ -0,0 +1,190 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package rebac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/internal/core/test"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTuple_Validate(t *testing.T) {
+	assert.NoError(t, Tuple{"user:alice", "viewer", "doc:1"}.Validate())
+	assert.NoError(t, Tuple{"team:eng#member", "viewer", "doc:1"}.Validate())
+
+	for _, tuple := range []Tuple{
+		{"", "viewer", "doc:1"},
+		{"user:alice", "", "doc:1"},
+		{"user:alice", "viewer", ""},
+		{"user:alice", "view#er", "doc:1"},
+		{"user:alice", "viewer", "doc#1"},
+		{"team:eng#member#x", "viewer", "doc:1"},
+	} {
+		assert.Error(t, tuple.Validate(), tuple.String())
+	}
+}
+
+func TestTuple_Userset(t *testing.T) {
+	object, relation, ok := Tuple{Subject: "team:eng#member"}.Userset()
+	assert.True(t, ok)
+	assert.Equal(t, "team:eng", object)
+	assert.Equal(t, "member", relation)
+
+	_, _, ok = Tuple{Subject: "user:alice"}.Userset()
+	assert.False(t, ok)
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	require.NoError(t, s.Write(ctx,
+		Tuple{"user:bob", "viewer", "doc:1"},
+		Tuple{"user:alice", "viewer", "doc:1"},
+		Tuple{"user:alice", "editor", "doc:2"},
+	))
+	// writing a tuple twice is harmless
+	require.NoError(t, s.Write(ctx, Tuple{"user:alice", "viewer", "doc:1"}))
+
+	tuples, err := s.Read(ctx, Filter{Relation: "viewer", Object: "doc:1"})
+	require.NoError(t, err)
+	assert.Equal(t, []Tuple{{"user:alice", "viewer", "doc:1"}, {"user:bob", "viewer", "doc:1"}}, tuples)
+
+	tuples, err = s.Read(ctx, Filter{Subject: "user:alice"})
+	require.NoError(t, err)
+	assert.Equal(t, []Tuple{{"user:alice", "viewer", "doc:1"}, {"user:alice", "editor", "doc:2"}}, tuples)
+
+	tuples, err = s.Read(ctx, Filter{})
+	require.NoError(t, err)
+	assert.Len(t, tuples, 3)
+
+	// an invalid tuple fails the whole write
+	assert.Error(t, s.Write(ctx, Tuple{"user:carol", "viewer", "doc:3"}, Tuple{"", "viewer", "doc:3"}))
+	tuples, err = s.Read(ctx, Filter{Object: "doc:3"})
+	require.NoError(t, err)
+	assert.Empty(t, tuples)
+
+	require.NoError(t, s.Delete(ctx, Tuple{"user:bob", "viewer", "doc:1"}, Tuple{"user:nobody", "viewer", "doc:9"}))
+	tuples, err = s.Read(ctx, Filter{Object: "doc:1"})
+	require.NoError(t, err)
+	assert.Equal(t, []Tuple{{"user:alice", "viewer", "doc:1"}}, tuples)
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	require.NoError(t, s.Write(ctx,
+		Tuple{"user:alice", "viewer", "doc:1"},
+		Tuple{"user:bob", "member", "team:eng"},
+		Tuple{"team:eng#member", "viewer", "doc:2"},
+		// a cycle between two teams
+		Tuple{"team:b#member", "member", "team:a"},
+		Tuple{"team:a#member", "member", "team:b"},
+		Tuple{"user:carol", "member", "team:b"},
+	))
+
+	for _, tc := range []struct {
+		subject, relation, object string
+		expected                  bool
+	}{
+		{"user:alice", "viewer", "doc:1", true},
+		{"user:alice", "editor", "doc:1", false},
+		{"user:bob", "viewer", "doc:1", false},
+		{"user:bob", "viewer", "doc:2", true},
+		{"team:eng#member", "viewer", "doc:2", true},
+		{"user:carol", "member", "team:a", true},
+		{"user:dave", "member", "team:a", false},
+	} {
+		allowed, err := Check(ctx, s, tc.subject, tc.relation, tc.object)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, allowed, "%s %s %s", tc.subject, tc.relation, tc.object)
+	}
+}
+
+func TestCheck_MaxDepth(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	// a chain of groups, each a member of the next
+	require.NoError(t, s.Write(ctx, Tuple{"user:alice", "member", "group:0"}))
+	for i := 1; i <= MaxCheckDepth+1; i++ {
+		require.NoError(t, s.Write(ctx, Tuple{fmt.Sprintf("group:%d#member", i-1), "member", fmt.Sprintf("group:%d", i)}))
+	}
+
+	allowed, err := Check(ctx, s, "user:alice", "member", fmt.Sprintf("group:%d", MaxCheckDepth))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = Check(ctx, s, "user:alice", "member", fmt.Sprintf("group:%d", MaxCheckDepth+1))
+	require.NoError(t, err)
+	assert.False(t, allowed, "usersets are followed up to MaxCheckDepth levels")
+}
+
+type failingStore struct {
+	*MemoryStore
+}
+
+func (failingStore) Read(context.Context, Filter) ([]Tuple, error) {
+	return nil, errors.New("store unavailable")
+}
+
+const sharingPolicy = `package authz
+default allow = false
+allow {
+	rebac.check(concat(":", ["user", input.principal.sub]), "viewer", input.resource.id)
+}`
+
+func TestBuiltin(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	pe, err := test.NewBuiltinPolicyEngine(sharingPolicy, options.WithBuiltins(NewBuiltin(store)), options.WithDecisionCacheTTL(time.Minute))
+	require.NoError(t, err)
+
+	allowed, err := pe.Authorize(ctx, test.BuiltinPORC("alice", "doc:1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// tuples written after the engine was created apply to the following decisions
+	require.NoError(t, store.Write(ctx,
+		Tuple{"user:alice", "member", "team:eng"},
+		Tuple{"team:eng#member", "viewer", "doc:1"},
+	))
+
+	decision, err := pe.Decide(ctx, test.BuiltinPORC("alice", "doc:1"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Zero(t, decision.Cache.TTL, "decisions depending on relationships are not cacheable")
+
+	allowed, err = pe.Authorize(ctx, test.BuiltinPORC("bob", "doc:1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	require.NoError(t, store.Delete(ctx, Tuple{"user:alice", "member", "team:eng"}))
+	allowed, err = pe.Authorize(ctx, test.BuiltinPORC("alice", "doc:1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestBuiltin_StoreError(t *testing.T) {
+	pe, err := test.NewBuiltinPolicyEngine(sharingPolicy, options.WithBuiltins(NewBuiltin(failingStore{NewMemoryStore()})))
+	require.NoError(t, err)
+
+	allowed, err := pe.Authorize(context.Background(), test.BuiltinPORC("alice", "doc:1"))
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestDeclaration(t *testing.T) {
+	decl := Declaration()
+	assert.Equal(t, CheckBuiltin, decl.Name)
+	assert.True(t, decl.Nondeterministic)
+}
@@ -0,0 +1,141 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package revocation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// DefaultFalsePositiveRate is the false positive rate of a [Filter] when none is configured.
+const DefaultFalsePositiveRate = 0.001
+
+// filterVersion identifies the binary encoding of a [Filter]
+const filterVersion = 1
+
+// filterHeader is the size of the encoded version, hash count, key count, and bit count
+const filterHeader = 1 + 4 + 8 + 8
+
+// maxFilterBits bounds the size of a decoded filter, 512MiB of bits
+const maxFilterBits = 1 << 32
+
+// maxFilterHashes bounds the hashes per key, which every authorization computes, of a filter.
+// A false positive rate of 2^-64 needs no more.
+const maxFilterHashes = 64
+
+// Filter is a bloom filter of revoked keys, such as [TokenKey] and [SessionKey].
+//
+// A filter never misses a key that was added, but may report a key that was not, at
+// the false positive rate it was created for. Keys are hashed with FNV-128a, so that
+// filters built by any process can be tested by any other. Filter is not safe for
+// concurrent modification; it may be tested concurrently once built.
+type Filter struct {
+	k    uint32   // hashes per key
+	n    uint64   // keys added
+	bits []uint64 // bit set
+}
+
+// NewFilter creates an empty [Filter] sized to hold capacity keys at the given false
+// positive rate, [DefaultFalsePositiveRate] if not within (0, 1).
+func NewFilter(capacity int, fpRate float64) *Filter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultFalsePositiveRate
+	}
+
+	m := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Min(maxFilterHashes, math.Max(1, math.Round(m/float64(capacity)*math.Ln2)))
+	words := (uint64(m) + 63) / 64
+
+	return &Filter{k: uint32(k), bits: make([]uint64, words)}
+}
+
+// Add adds the key to the filter.
+func (f *Filter) Add(key string) {
+	h1, h2 := hashes(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.n++
+}
+
+// Test reports whether the key may have been added to the filter.
+func (f *Filter) Test(key string) bool {
+	if f == nil || len(f.bits) == 0 {
+		return false
+	}
+	h1, h2 := hashes(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of keys added to the filter.
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return int(f.n)
+}
+
+// MarshalBinary encodes the filter, such as to publish it to decision points.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, filterHeader+8*len(f.bits))
+	data[0] = filterVersion
+	binary.BigEndian.PutUint32(data[1:], f.k)
+	binary.BigEndian.PutUint64(data[5:], f.n)
+	binary.BigEndian.PutUint64(data[13:], uint64(len(f.bits))*64)
+	for i, w := range f.bits {
+		binary.BigEndian.PutUint64(data[filterHeader+8*i:], w)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a filter encoded by [Filter.MarshalBinary].
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < filterHeader {
+		return fmt.Errorf("invalid revocation filter: %d bytes is too short", len(data))
+	}
+	if data[0] != filterVersion {
+		return fmt.Errorf("invalid revocation filter: unsupported version %d", data[0])
+	}
+
+	k := binary.BigEndian.Uint32(data[1:])
+	n := binary.BigEndian.Uint64(data[5:])
+	m := binary.BigEndian.Uint64(data[13:])
+	if k == 0 || k > maxFilterHashes || m == 0 || m%64 != 0 || m > maxFilterBits {
+		return fmt.Errorf("invalid revocation filter: %d hashes of %d bits", k, m)
+	}
+	if uint64(len(data)-filterHeader) != m/8 {
+		return fmt.Errorf("invalid revocation filter: expected %d bytes of bits, got %d", m/8, len(data)-filterHeader)
+	}
+
+	bits := make([]uint64, m/64)
+	for i := range bits {
+		bits[i] = binary.BigEndian.Uint64(data[filterHeader+8*i:])
+	}
+	f.k, f.n, f.bits = k, n, bits
+	return nil
+}
+
+// hashes returns the two halves of the FNV-128a hash of the key, combined to derive
+// each of the filter's hashes. The second is odd so that the derived hashes differ.
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
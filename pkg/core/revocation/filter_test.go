@@ -0,0 +1,85 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package revocation
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_NeverMisses(t *testing.T) {
+	f := NewFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(TokenKey(fmt.Sprintf("token-%d", i)))
+	}
+	assert.Equal(t, 1000, f.Len())
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.Test(TokenKey(fmt.Sprintf("token-%d", i))))
+	}
+	assert.False(t, f.Test(SessionKey("token-1")), "sessions and tokens do not share keys")
+}
+
+func TestFilter_FalsePositiveRate(t *testing.T) {
+	f := NewFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(TokenKey(fmt.Sprintf("token-%d", i)))
+	}
+
+	hits := 0
+	for i := 0; i < 10000; i++ {
+		if f.Test(TokenKey(fmt.Sprintf("other-%d", i))) {
+			hits++
+		}
+	}
+	assert.Less(t, hits, 300, "about 1%% of 10000 keys expected, got %d", hits)
+}
+
+func TestFilter_Empty(t *testing.T) {
+	var f *Filter
+	assert.False(t, f.Test(TokenKey("a")))
+	assert.Equal(t, 0, f.Len())
+
+	assert.False(t, NewFilter(0, 0).Test(TokenKey("a")))
+}
+
+func TestFilter_Binary(t *testing.T) {
+	f := NewFilter(10, 0)
+	f.Add(TokenKey("a"))
+	f.Add(SessionKey("b"))
+
+	data, err := f.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded Filter
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, *f, decoded)
+	assert.True(t, decoded.Test(TokenKey("a")))
+	assert.True(t, decoded.Test(SessionKey("b")))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		errMsg string
+	}{
+		{"short", data[:4], "too short"},
+		{"version", append([]byte{9}, data[1:]...), "unsupported version"},
+		{"truncated bits", data[:len(data)-8], "expected"},
+		{"no hashes", append([]byte{1, 0, 0, 0, 0}, data[5:]...), "0 hashes"},
+		{"too many hashes", append([]byte{1, 0xff, 0xff, 0xff, 0xff}, data[5:]...), "4294967295 hashes"},
+		{"more hashes than the bound", append([]byte{1, 0, 0, 0, maxFilterHashes + 1}, data[5:]...), "65 hashes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g Filter
+			err := g.UnmarshalBinary(tt.data)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package revocation
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Memory is a [Checker] holding the revocation list in memory.
+//
+// Tokens and sessions are revoked until a given time, usually the expiry of the token,
+// after which they are removed from the list as others are revoked. Memory is safe for
+// concurrent use.
+type Memory struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time // key => revoked until
+}
+
+// NewMemory creates an empty [Memory] revocation list.
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]time.Time)}
+}
+
+// Name implements [Checker].
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+// RevokeToken revokes the token with the given jti until the given time; the zero time
+// revokes it forever.
+func (m *Memory) RevokeToken(id string, until time.Time) {
+	m.revoke(TokenKey(id), until)
+}
+
+// RevokeSession revokes every token of the session with the given sid until the given
+// time; the zero time revokes them forever.
+func (m *Memory) RevokeSession(id string, until time.Time) {
+	m.revoke(SessionKey(id), until)
+}
+
+func (m *Memory) revoke(key string, until time.Time) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, u := range m.entries {
+		if expired(u, now) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = until
+}
+
+// Revoked implements [Checker].
+func (m *Memory) Revoked(_ context.Context, token Token) (bool, error) {
+	now := time.Now()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range keys(token) {
+		if u, ok := m.entries[key]; ok && !expired(u, now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Filter returns a [Filter] of the entries that have not expired, at the given false
+// positive rate.
+func (m *Memory) Filter(fpRate float64) *Filter {
+	now := time.Now()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f := NewFilter(len(m.entries), fpRate)
+	for k, u := range m.entries {
+		if !expired(u, now) {
+			f.Add(k)
+		}
+	}
+	return f
+}
+
+// Handler serves the [Filter] of the list at the given false positive rate, encoded by
+// [Filter.MarshalBinary], for an [HTTPSource] to fetch. The response carries an ETag,
+// so that a filter that has not changed is not sent again.
+func Handler(m *Memory, fpRate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := m.Filter(fpRate).MarshalBinary()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	})
+}
+
+// keys returns the keys under which the token may have been revoked
+func keys(token Token) []string {
+	var result []string
+	if token.ID != "" {
+		result = append(result, TokenKey(token.ID))
+	}
+	if token.Session != "" {
+		result = append(result, SessionKey(token.Session))
+	}
+	return result
+}
+
+// expired reports whether an entry revoked until the given time has expired
+func expired(until, now time.Time) bool {
+	return !until.IsZero() && !until.After(now)
+}
@@ -0,0 +1,102 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package revocation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory_Revoked(t *testing.T) {
+	m := NewMemory()
+	assert.Equal(t, "memory", m.Name())
+
+	m.RevokeToken("t1", time.Time{})
+	m.RevokeSession("s1", time.Now().Add(time.Hour))
+	m.RevokeToken("t2", time.Now().Add(-time.Second))
+
+	tests := []struct {
+		name    string
+		token   Token
+		revoked bool
+	}{
+		{"revoked token", Token{ID: "t1"}, true},
+		{"revoked session", Token{ID: "other", Session: "s1"}, true},
+		{"expired revocation", Token{ID: "t2"}, false},
+		{"other token", Token{ID: "other", Session: "other"}, false},
+		{"session is not a token", Token{ID: "s1"}, false},
+		{"empty", Token{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := m.Revoked(context.Background(), tt.token)
+			require.NoError(t, err)
+			assert.Equal(t, tt.revoked, revoked)
+		})
+	}
+
+	f := m.Filter(0)
+	assert.Equal(t, 2, f.Len(), "expired revocations are not published")
+	assert.True(t, f.Test(TokenKey("t1")))
+	assert.True(t, f.Test(SessionKey("s1")))
+}
+
+type failing struct{}
+
+func (failing) Name() string { return "failing" }
+
+func (failing) Revoked(context.Context, Token) (bool, error) {
+	return false, errors.New("unavailable")
+}
+
+func TestCounter(t *testing.T) {
+	m := NewMemory()
+	m.RevokeToken("t1", time.Time{})
+
+	c := NewCounter(m)
+	assert.Equal(t, "memory", c.Name())
+	_, _ = c.Revoked(context.Background(), Token{ID: "t1"})
+	_, _ = c.Revoked(context.Background(), Token{ID: "t2"})
+
+	f := NewCounter(failing{})
+	_, err := f.Revoked(context.Background(), Token{ID: "t1"})
+	assert.Error(t, err)
+
+	assert.Equal(t, Stats{Checks: 2, Hits: 1}, c.Stats())
+	assert.Equal(t, Stats{Checks: 1, Errors: 1}, f.Stats())
+}
+
+func TestHandler(t *testing.T) {
+	m := NewMemory()
+	m.RevokeToken("t1", time.Time{})
+	h := Handler(m, 0)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	var f Filter
+	require.NoError(t, f.UnmarshalBinary(rec.Body.Bytes()))
+	assert.True(t, f.Test(TokenKey("t1")))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,271 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package revocation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manetu/policyengine/internal/httpjson"
+	"github.com/manetu/policyengine/internal/logging"
+)
+
+var logger = logging.GetLogger("policyengine.revocation")
+
+const agent = "revocation"
+
+// DefaultSyncInterval is how often a [Synced] checker fetches its filter when no interval
+// is configured.
+const DefaultSyncInterval = 30 * time.Second
+
+// DefaultTimeout limits a fetch of an [HTTPSource] when no timeout is configured.
+const DefaultTimeout = 5 * time.Second
+
+// maxResponseBody is the number of bytes read from the response of a revocation service
+const maxResponseBody = 64 << 20
+
+// ErrNotSynced is returned by a [Synced] checker whose filter was never fetched, or is
+// older than its MaxAge.
+var ErrNotSynced = errors.New("revocation list is not synchronized")
+
+// Source fetches the [Filter] of a revocation list.
+type Source interface {
+	// Fetch returns the current filter.
+	Fetch(ctx context.Context) (*Filter, error)
+}
+
+// HTTPOptions configures the [HTTPSource] created by [NewHTTPSource].
+type HTTPOptions struct {
+	// URL serves the filter, such as the [Handler] of a [Memory] list at
+	// http://revocation:8080/v1/filter.
+	URL string
+	// Token is sent as a bearer token, if set.
+	Token string
+	// Timeout limits each fetch, [DefaultTimeout] if zero.
+	Timeout time.Duration
+	// Client sends the requests, [http.DefaultClient] if nil.
+	Client *http.Client
+}
+
+// HTTPSource is a [Source] fetching the filter encoded by [Filter.MarshalBinary] with a GET
+// request. The filter is only sent again when its ETag changes. Any other status than 2xx
+// or 304 fails the fetch.
+type HTTPSource struct {
+	endpoint string
+	token    string
+	timeout  time.Duration
+	client   *http.Client
+
+	mu     sync.Mutex
+	etag   string
+	filter *Filter
+}
+
+// NewHTTPSource creates an [HTTPSource].
+//
+// Returns an error if the URL is not an absolute http or https URL.
+func NewHTTPSource(options HTTPOptions) (*HTTPSource, error) {
+	endpoint, err := httpjson.ParseURL(options.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTPSource{
+		endpoint: endpoint,
+		token:    options.Token,
+		timeout:  timeout,
+		client:   client,
+	}, nil
+}
+
+// Fetch implements [Source].
+func (s *HTTPSource) Fetch(ctx context.Context) (*Filter, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	httpjson.Authorize(req, s.token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified && s.filter != nil {
+		return s.filter, nil
+	}
+	raw, err := httpjson.ReadResponse(resp, maxResponseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{}
+	if err := f.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	s.etag, s.filter = resp.Header.Get("ETag"), f
+	return f, nil
+}
+
+// SyncOptions configures the [Synced] checker created by [NewSynced].
+type SyncOptions struct {
+	// Source fetches the filter.
+	Source Source
+	// Interval is the time between fetches of [Synced.Run], [DefaultSyncInterval] if zero.
+	Interval time.Duration
+	// MaxAge, if set, fails checks once the last successful fetch is older, so that a
+	// decision point cut off from the revocation list stops granting access. When zero,
+	// the last filter fetched is used for as long as fetches fail.
+	MaxAge time.Duration
+	// Confirm, if set, is asked whether tokens found in the filter were revoked, so that
+	// false positives of the filter do not deny access.
+	Confirm Checker
+}
+
+// SyncStats reports the fetches of a [Synced] checker.
+type SyncStats struct {
+	// Syncs counts the fetches that succeeded.
+	Syncs uint64
+	// Failures counts the fetches that failed.
+	Failures uint64
+	// Keys is the number of keys in the current filter.
+	Keys int
+	// LastSync is when the filter was last fetched, zero if never.
+	LastSync time.Time
+}
+
+// Synced is a [Checker] testing tokens against a bloom [Filter] of the revocation list,
+// fetched from a [Source] at startup and then periodically by [Synced.Run].
+//
+// Checks fail until the filter is first fetched, so that a decision point never grants
+// access to revoked tokens because it has not synchronized yet.
+type Synced struct {
+	opts SyncOptions
+
+	mu       sync.RWMutex
+	filter   *Filter
+	lastSync time.Time
+
+	syncs    atomic.Uint64
+	failures atomic.Uint64
+}
+
+// NewSynced creates a [Synced] checker that has not fetched its filter yet.
+//
+// Returns an error if the source is nil, or the interval or max age is negative.
+func NewSynced(opts SyncOptions) (*Synced, error) {
+	if opts.Source == nil {
+		return nil, fmt.Errorf("revocation source must not be nil")
+	}
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("revocation sync interval must not be negative, got %s", opts.Interval)
+	}
+	if opts.MaxAge < 0 {
+		return nil, fmt.Errorf("revocation max age must not be negative, got %s", opts.MaxAge)
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultSyncInterval
+	}
+
+	return &Synced{opts: opts}, nil
+}
+
+// Name implements [Checker].
+func (s *Synced) Name() string {
+	return "synced"
+}
+
+// Sync fetches the filter once. On failure, the previous filter is kept.
+func (s *Synced) Sync(ctx context.Context) error {
+	f, err := s.opts.Source.Fetch(ctx)
+	if err != nil {
+		s.failures.Add(1)
+		return err
+	}
+
+	s.syncs.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter, s.lastSync = f, time.Now()
+	return nil
+}
+
+// Run fetches the filter every interval until the context is done, logging failures.
+func (s *Synced) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+				logger.Warnf(agent, "sync", "failed to synchronize revocation list: %v", err)
+			}
+		}
+	}
+}
+
+// Revoked implements [Checker].
+func (s *Synced) Revoked(ctx context.Context, token Token) (bool, error) {
+	s.mu.RLock()
+	f, lastSync := s.filter, s.lastSync
+	s.mu.RUnlock()
+
+	if f == nil || (s.opts.MaxAge > 0 && time.Since(lastSync) > s.opts.MaxAge) {
+		return false, ErrNotSynced
+	}
+
+	hit := false
+	for _, key := range keys(token) {
+		if f.Test(key) {
+			hit = true
+			break
+		}
+	}
+	if !hit || s.opts.Confirm == nil {
+		return hit, nil
+	}
+	return s.opts.Confirm.Revoked(ctx, token)
+}
+
+// Stats returns the fetches since the checker was created.
+func (s *Synced) Stats() SyncStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return SyncStats{
+		Syncs:    s.syncs.Load(),
+		Failures: s.failures.Load(),
+		Keys:     s.filter.Len(),
+		LastSync: s.lastSync,
+	}
+}
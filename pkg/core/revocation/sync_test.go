@@ -0,0 +1,190 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package revocation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sourceFunc adapts a function to a Source
+type sourceFunc func(ctx context.Context) (*Filter, error)
+
+func (f sourceFunc) Fetch(ctx context.Context) (*Filter, error) {
+	return f(ctx)
+}
+
+func TestNewHTTPSource_InvalidURL(t *testing.T) {
+	for _, u := range []string{"", "revocation:8080", "ftp://revocation/filter", "http://"} {
+		_, err := NewHTTPSource(HTTPOptions{URL: u})
+		assert.Error(t, err, u)
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	m := NewMemory()
+	m.RevokeToken("t1", time.Time{})
+
+	var requests, modified atomic.Int32
+	h := Handler(m, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") == "" {
+			modified.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	s, err := NewHTTPSource(HTTPOptions{URL: srv.URL, Token: "secret"})
+	require.NoError(t, err)
+
+	f, err := s.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.True(t, f.Test(TokenKey("t1")))
+
+	again, err := s.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, f, again, "an unchanged filter is reused")
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int32(1), modified.Load())
+
+	m.RevokeSession("s1", time.Time{})
+	f, err = s.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.True(t, f.Test(SessionKey("s1")))
+}
+
+func TestHTTPSource_Status(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s, err := NewHTTPSource(HTTPOptions{URL: srv.URL})
+	require.NoError(t, err)
+	_, err = s.Fetch(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 503: unavailable")
+}
+
+func TestNewSynced_Invalid(t *testing.T) {
+	source := sourceFunc(func(context.Context) (*Filter, error) { return NewFilter(1, 0), nil })
+
+	_, err := NewSynced(SyncOptions{})
+	assert.Error(t, err)
+	_, err = NewSynced(SyncOptions{Source: source, Interval: -time.Second})
+	assert.Error(t, err)
+	_, err = NewSynced(SyncOptions{Source: source, MaxAge: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestSynced(t *testing.T) {
+	m := NewMemory()
+	m.RevokeToken("t1", time.Time{})
+
+	fail := false
+	s, err := NewSynced(SyncOptions{Source: sourceFunc(func(context.Context) (*Filter, error) {
+		if fail {
+			return nil, assert.AnError
+		}
+		return m.Filter(0), nil
+	})})
+	require.NoError(t, err)
+	assert.Equal(t, "synced", s.Name())
+
+	_, err = s.Revoked(context.Background(), Token{ID: "t1"})
+	assert.ErrorIs(t, err, ErrNotSynced, "checks fail until synchronized")
+
+	require.NoError(t, s.Sync(context.Background()))
+	revoked, err := s.Revoked(context.Background(), Token{ID: "t1"})
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = s.Revoked(context.Background(), Token{ID: "t2"})
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	// the previous filter is kept when a fetch fails
+	fail = true
+	m.RevokeToken("t2", time.Time{})
+	assert.Error(t, s.Sync(context.Background()))
+	revoked, err = s.Revoked(context.Background(), Token{ID: "t1"})
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.Syncs)
+	assert.Equal(t, uint64(1), stats.Failures)
+	assert.Equal(t, 1, stats.Keys)
+	assert.False(t, stats.LastSync.IsZero())
+}
+
+func TestSynced_MaxAge(t *testing.T) {
+	s, err := NewSynced(SyncOptions{
+		Source: sourceFunc(func(context.Context) (*Filter, error) { return NewFilter(1, 0), nil }),
+		MaxAge: time.Minute,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Sync(context.Background()))
+
+	_, err = s.Revoked(context.Background(), Token{ID: "t1"})
+	assert.NoError(t, err)
+
+	s.lastSync = time.Now().Add(-time.Hour)
+	_, err = s.Revoked(context.Background(), Token{ID: "t1"})
+	assert.ErrorIs(t, err, ErrNotSynced)
+}
+
+func TestSynced_Confirm(t *testing.T) {
+	// a filter reporting every key, as a false positive would
+	all := &Filter{k: 1, bits: []uint64{^uint64(0)}}
+	confirm := NewMemory()
+	confirm.RevokeToken("t1", time.Time{})
+
+	s, err := NewSynced(SyncOptions{
+		Source:  sourceFunc(func(context.Context) (*Filter, error) { return all, nil }),
+		Confirm: confirm,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Sync(context.Background()))
+
+	revoked, err := s.Revoked(context.Background(), Token{ID: "t1"})
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = s.Revoked(context.Background(), Token{ID: "t2"})
+	require.NoError(t, err)
+	assert.False(t, revoked, "false positives are confirmed")
+}
+
+func TestSynced_Run(t *testing.T) {
+	var fetches atomic.Int32
+	s, err := NewSynced(SyncOptions{
+		Source: sourceFunc(func(context.Context) (*Filter, error) {
+			fetches.Add(1)
+			return NewFilter(1, 0), nil
+		}),
+		Interval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return fetches.Load() >= 2 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
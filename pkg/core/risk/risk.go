@@ -0,0 +1,99 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package risk lets policies adapt to the risk of each request, such as denying
+// sensitive operations when a fraud or anomaly detection service rates the request
+// as risky.
+//
+// Before evaluating any policy, the engine asks the [Provider] given with
+// options.WithRiskProvider to score the request, and gives policies the score as
+// input.context.risk, replacing any score the request gave itself:
+//
+//	allow {
+//	    input.context.risk <= 70
+//	}
+//
+// Scores range from [MinScore], no risk, to [MaxScore]. A provider that fails, returns
+// a score out of range, or does not answer within the risk.timeout configured, is given
+// the risk.default score instead, [MaxScore] unless configured, so that policies
+// bounding the risk deny when it cannot be assessed.
+//
+// # Auditing
+//
+// The score is recorded in the risk field of the access record, with the provider that
+// gave it, and with defaulted set and the error when the default was used. Decisions of
+// policies reading the score are never reported as cacheable (see model.CacheHint), as
+// the risk of the same request may change at any time.
+//
+// # Usage
+//
+//	pe, err := core.NewPolicyEngine(options.WithRiskProvider(fraudService))
+package risk
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ContextKey is the key of the context of the PORC under which the engine gives policies
+// the score of the request.
+const ContextKey = "risk"
+
+// The range of scores.
+const (
+	MinScore = 0.0
+	MaxScore = 100.0
+)
+
+// DefaultTimeout limits the time a [Provider] is given to score a request when no
+// timeout is configured.
+const DefaultTimeout = 250 * time.Millisecond
+
+// Provider scores the risk of requests.
+//
+// Implementations must be safe for concurrent use, and should return promptly when
+// ctx is done, as they are called for every decision.
+type Provider interface {
+	// Name identifies the provider in the access record, such as "fraud-service".
+	Name() string
+
+	// Score returns the risk of the request, from MinScore to MaxScore. The PORC must
+	// not be modified.
+	Score(ctx context.Context, porc map[string]interface{}) (float64, error)
+}
+
+// Assessment is the score a [Provider] gave a request, or the default that replaced it.
+type Assessment struct {
+	Score     float64
+	Provider  string
+	Defaulted bool  // the default replaced the provider's score
+	Err       error // why the default replaced the provider's score
+}
+
+// Assess asks provider to score porc within timeout, falling back to def if it fails,
+// returns a score out of range, or does not answer in time.
+func Assess(ctx context.Context, provider Provider, porc map[string]interface{}, timeout time.Duration, def float64) Assessment {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	a := Assessment{Provider: provider.Name()}
+	score, err := provider.Score(ctx, porc)
+	switch {
+	case err != nil:
+		a.Err = err
+	case ctx.Err() != nil:
+		a.Err = fmt.Errorf("no score within %s", timeout)
+	case math.IsNaN(score) || score < MinScore || score > MaxScore:
+		a.Err = fmt.Errorf("score %g out of range [%g, %g]", score, MinScore, MaxScore)
+	default:
+		a.Score = score
+		return a
+	}
+
+	a.Score = def
+	a.Defaulted = true
+	return a
+}
@@ -0,0 +1,86 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package risk
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProvider struct {
+	score float64
+	err   error
+	delay time.Duration
+}
+
+func (f fakeProvider) Name() string {
+	return "fake"
+}
+
+func (f fakeProvider) Score(ctx context.Context, porc map[string]interface{}) (float64, error) {
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		if f.err == nil {
+			return 0, ctx.Err()
+		}
+	}
+	return f.score, f.err
+}
+
+func TestAssess(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		provider  fakeProvider
+		score     float64
+		defaulted bool
+		err       string
+	}{
+		{"scored", fakeProvider{score: 42.5}, 42.5, false, ""},
+		{"lowest", fakeProvider{score: MinScore}, MinScore, false, ""},
+		{"highest", fakeProvider{score: MaxScore}, MaxScore, false, ""},
+		{"failed", fakeProvider{err: errors.New("service unavailable")}, 80, true, "service unavailable"},
+		{"timed out", fakeProvider{score: 10, delay: time.Second}, 80, true, "context deadline exceeded"},
+		{"above range", fakeProvider{score: 101}, 80, true, "score 101 out of range [0, 100]"},
+		{"below range", fakeProvider{score: -1}, 80, true, "score -1 out of range [0, 100]"},
+		{"not a number", fakeProvider{score: math.NaN()}, 80, true, "score NaN out of range [0, 100]"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Assess(context.Background(), tt.provider, map[string]interface{}{}, 20*time.Millisecond, 80)
+			assert.Equal(t, "fake", a.Provider)
+			assert.Equal(t, tt.score, a.Score)
+			assert.Equal(t, tt.defaulted, a.Defaulted)
+			if tt.err == "" {
+				assert.NoError(t, a.Err)
+			} else {
+				assert.EqualError(t, a.Err, tt.err)
+			}
+		})
+	}
+}
+
+// a provider that ignores the deadline is not trusted past it
+type lateProvider struct{}
+
+func (lateProvider) Name() string {
+	return "late"
+}
+
+func (lateProvider) Score(context.Context, map[string]interface{}) (float64, error) {
+	time.Sleep(30 * time.Millisecond)
+	return 10, nil
+}
+
+func TestAssess_Late(t *testing.T) {
+	a := Assess(context.Background(), lateProvider{}, nil, 10*time.Millisecond, MaxScore)
+	assert.True(t, a.Defaulted)
+	assert.Equal(t, MaxScore, a.Score)
+	assert.EqualError(t, a.Err, "no score within 10ms")
+}
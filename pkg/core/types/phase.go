@@ -0,0 +1,82 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package types
+
+import "time"
+
+// Phase identifies a phase of the policy evaluation pipeline.
+type Phase string
+
+// The phases of a decision, in evaluation order.
+const (
+	// PhaseOperation evaluates the operation's policy. Access records name it SYSTEM.
+	PhaseOperation Phase = "operation"
+	// PhaseIdentity evaluates the policies of the principal's roles and groups.
+	PhaseIdentity Phase = "identity"
+	// PhaseResource evaluates the policy of the resource's group.
+	PhaseResource Phase = "resource"
+	// PhaseScope evaluates the policies of the principal's scopes.
+	PhaseScope Phase = "scope"
+	// PhaseExternal is not a phase of the pipeline: its results are the checks that
+	// policies delegated to an external authorization service, such as OpenFGA.
+	PhaseExternal Phase = "external"
+)
+
+// ReasonCode explains the decision of a [PhaseResult]. The codes are those of the
+// reason_code field of access record bundle references.
+type ReasonCode string
+
+// The reason codes of a [PhaseResult].
+const (
+	// ReasonPolicyOutcome means the decision is the outcome of the policy.
+	ReasonPolicyOutcome ReasonCode = "POLICY_OUTCOME"
+	// ReasonCompilationError means the policy failed to compile.
+	ReasonCompilationError ReasonCode = "COMPILATION_ERROR"
+	// ReasonNotFoundError means an entity or policy could not be found.
+	ReasonNotFoundError ReasonCode = "NOTFOUND_ERROR"
+	// ReasonNetworkError means a network error prevented the resolution of a policy.
+	ReasonNetworkError ReasonCode = "NETWORK_ERROR"
+	// ReasonEvaluationError means the policy failed to evaluate.
+	ReasonEvaluationError ReasonCode = "EVALUATION_ERROR"
+	// ReasonInvalidParamError means a parameter or identifier was invalid.
+	ReasonInvalidParamError ReasonCode = "INVALPARAM_ERROR"
+	// ReasonInternalError means the engine failed, such as by a recovered panic.
+	ReasonInternalError ReasonCode = "INTERNAL_ERROR"
+	// ReasonExplicitDeny means a deny policy denied the request, overriding any GRANT.
+	ReasonExplicitDeny ReasonCode = "EXPLICIT_DENY"
+	// ReasonUnknownError means an unspecified error was encountered.
+	ReasonUnknownError ReasonCode = "UNKNOWN_ERROR"
+)
+
+// PhaseResult is the outcome of one entity evaluated in a phase of a decision, such as
+// one of the principal's roles in the identity phase.
+//
+// PhaseResult carries the data of an access record bundle reference, so that embedders
+// can inspect why a request was granted or denied without decoding the access log:
+//
+//	d, _ := pe.Decide(ctx, porc, options.SetPhaseResults(true))
+//	for _, r := range d.Phases {
+//	    if !r.Allow {
+//	        fmt.Printf("%s denied by %s: %s %s\n", r.Phase, r.ID, r.ReasonCode, r.Reason)
+//	    }
+//	}
+type PhaseResult struct {
+	// Phase is the phase that evaluated the entity.
+	Phase Phase
+	// ID is the MRN of the matched entity: the operation, role, group, resource
+	// group, or scope whose policy was evaluated.
+	ID string
+	// Policy is the MRN of the evaluated policy, empty if none was found.
+	Policy string
+	// Allow is true if the entity granted the request.
+	Allow bool
+	// ReasonCode explains the decision; any code but [ReasonPolicyOutcome] and
+	// [ReasonExplicitDeny] is an error.
+	ReasonCode ReasonCode
+	// Reason describes the error, if any.
+	Reason string
+	// Duration is the time spent evaluating the policy.
+	Duration time.Duration
+}
@@ -81,6 +81,8 @@ type AnyPORC interface{}
 // See the PORC documentation for complete field descriptions.
 type PORC map[string]interface{}
 
+var errNotObject = errors.New("PORC must be an object")
+
 // UnmarshalPORC converts an [AnyPORC] value into a [PORC] map.
 //
 // This function handles the type flexibility of AnyPORC:
@@ -91,7 +93,8 @@ type PORC map[string]interface{}
 // This function is called automatically by [core.PolicyEngine.Authorize] and
 // typically does not need to be called directly.
 //
-// Returns an error if the input is a malformed JSON string or an unsupported type.
+// Returns an error if the input is a malformed JSON string, is not a JSON object
+// or map, or is an unsupported type.
 func UnmarshalPORC(input AnyPORC) (PORC, error) {
 
 	switch input := input.(type) {
@@ -102,9 +105,15 @@ func UnmarshalPORC(input AnyPORC) (PORC, error) {
 		if err != nil {
 			return nil, err
 		}
+		if porc == nil {
+			return nil, errNotObject
+		}
 
 		return porc, nil
 	case map[string]interface{}:
+		if input == nil {
+			return nil, errNotObject
+		}
 		return input, nil
 	default:
 		return nil, errors.New("invalid type")
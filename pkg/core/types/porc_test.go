@@ -0,0 +1,48 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalPORC(t *testing.T) {
+	porc, err := UnmarshalPORC(`{"principal": {"sub": "alice"}, "operation": "api:doc:read", "resource": "mrn:app:doc:1"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "api:doc:read", porc["operation"])
+
+	m := map[string]interface{}{"operation": "api:doc:read"}
+	porc, err = UnmarshalPORC(m)
+	require.NoError(t, err)
+	assert.Equal(t, PORC(m), porc)
+
+	for name, input := range map[string]AnyPORC{
+		"malformed": `{"principal":`,
+		"array":     `[]`,
+		"string":    `"porc"`,
+		"null":      `null`,
+		"nil map":   map[string]interface{}(nil),
+		"type":      42,
+	} {
+		_, err := UnmarshalPORC(input)
+		assert.Error(t, err, name)
+	}
+}
+
+func FuzzUnmarshalPORC(f *testing.F) {
+	f.Add(`{"principal": {"sub": "alice", "mroles": ["mrn:iam:role:admin"]}, "operation": "api:doc:read", "resource": "mrn:app:doc:1", "context": {}}`)
+	f.Add(`{"resource": {"id": "mrn:app:doc:1", "annotations": {"a": 1}}}`)
+	f.Add(`null`)
+
+	f.Fuzz(func(t *testing.T, input string) {
+		porc, err := UnmarshalPORC(input)
+		if err == nil && porc == nil {
+			t.Fatalf("no PORC and no error for %q", input)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package zanzibar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core/rebac"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve returns a server recording the path and body of each request, and answering it
+// with status and response
+func serve(t *testing.T, status int, response string, requests *[]map[string]interface{}) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		body["_path"] = r.URL.Path
+		body["_auth"] = r.Header.Get("Authorization")
+		*requests = append(*requests, body)
+
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenFGA(t *testing.T) {
+	var requests []map[string]interface{}
+	srv := serve(t, http.StatusOK, `{"allowed": true, "resolution": ""}`, &requests)
+
+	fga, err := NewOpenFGA(OpenFGAOptions{URL: srv.URL + "/", StoreID: "store1", AuthorizationModelID: "model1", Token: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "openfga", fga.Name())
+
+	allowed, err := fga.Check(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "document:readme"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, map[string]interface{}{
+		"_path":                  "/stores/store1/check",
+		"_auth":                  "Bearer secret",
+		"authorization_model_id": "model1",
+		"tuple_key": map[string]interface{}{
+			"user":     "user:alice",
+			"relation": "viewer",
+			"object":   "document:readme",
+		},
+	}, requests[0])
+}
+
+func TestOpenFGA_Error(t *testing.T) {
+	var requests []map[string]interface{}
+	srv := serve(t, http.StatusBadRequest, `{"code": "validation_error"}`, &requests)
+
+	fga, err := NewOpenFGA(OpenFGAOptions{URL: srv.URL, StoreID: "store1"})
+	require.NoError(t, err)
+
+	_, err = fga.Check(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "document:readme"})
+	assert.ErrorContains(t, err, "status 400")
+}
+
+func TestNewOpenFGA_Invalid(t *testing.T) {
+	_, err := NewOpenFGA(OpenFGAOptions{URL: "openfga:8080", StoreID: "store1"})
+	assert.Error(t, err)
+
+	_, err = NewOpenFGA(OpenFGAOptions{URL: "http://openfga:8080"})
+	assert.Error(t, err)
+}
+
+func TestSpiceDB(t *testing.T) {
+	var requests []map[string]interface{}
+	srv := serve(t, http.StatusOK, `{"permissionship": "PERMISSIONSHIP_HAS_PERMISSION"}`, &requests)
+
+	spice, err := NewSpiceDB(SpiceDBOptions{URL: srv.URL, Token: "key", FullyConsistent: true})
+	require.NoError(t, err)
+	assert.Equal(t, "spicedb", spice.Name())
+
+	allowed, err := spice.Check(context.Background(), rebac.Tuple{Subject: "group:eng#member", Relation: "view", Object: "document:readme"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, map[string]interface{}{
+		"_path":       "/v1/permissions/check",
+		"_auth":       "Bearer key",
+		"consistency": map[string]interface{}{"fullyConsistent": true},
+		"resource":    map[string]interface{}{"objectType": "document", "objectId": "readme"},
+		"permission":  "view",
+		"subject": map[string]interface{}{
+			"object":           map[string]interface{}{"objectType": "group", "objectId": "eng"},
+			"optionalRelation": "member",
+		},
+	}, requests[0])
+}
+
+func TestSpiceDB_Permissionship(t *testing.T) {
+	for _, tc := range []struct {
+		permissionship string
+		allowed        bool
+		err            bool
+	}{
+		{"PERMISSIONSHIP_HAS_PERMISSION", true, false},
+		{"PERMISSIONSHIP_NO_PERMISSION", false, false},
+		{"PERMISSIONSHIP_CONDITIONAL_PERMISSION", false, true},
+	} {
+		var requests []map[string]interface{}
+		srv := serve(t, http.StatusOK, `{"permissionship": "`+tc.permissionship+`"}`, &requests)
+
+		spice, err := NewSpiceDB(SpiceDBOptions{URL: srv.URL})
+		require.NoError(t, err)
+
+		allowed, err := spice.Check(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "view", Object: "document:readme"})
+		assert.Equal(t, tc.err, err != nil, tc.permissionship)
+		assert.Equal(t, tc.allowed, allowed, tc.permissionship)
+	}
+}
+
+func TestSpiceDB_InvalidObject(t *testing.T) {
+	spice, err := NewSpiceDB(SpiceDBOptions{URL: "http://spicedb:8443"})
+	require.NoError(t, err)
+
+	_, err = spice.Check(context.Background(), rebac.Tuple{Subject: "alice", Relation: "view", Object: "document:readme"})
+	assert.ErrorContains(t, err, "expected type:id")
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	var requests []map[string]interface{}
+	srv := serve(t, http.StatusOK, `{"allowed": true, "pad": "`+strings.Repeat("x", maxResponseBody)+`"}`, &requests)
+
+	fga, err := NewOpenFGA(OpenFGAOptions{URL: srv.URL, StoreID: "store1"})
+	require.NoError(t, err)
+
+	_, err = fga.Check(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "document:readme"})
+	assert.ErrorContains(t, err, "exceeds")
+}
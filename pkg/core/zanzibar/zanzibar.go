@@ -0,0 +1,292 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package zanzibar lets policies delegate relationship checks to an external
+// Zanzibar-style authorization service, such as OpenFGA or SpiceDB.
+//
+// A [Bridge] exposes a [Checker] to policies as the [CheckBuiltin] built-in:
+//
+//	allow {
+//	    zanzibar.check(concat(":", ["user", input.principal.sub]), "viewer", input.resource.id)
+//	}
+//
+// Each call is bounded by a timeout and its result is cached, so that a slow or
+// unavailable service cannot stall decisions. A failed check leaves the call
+// undefined, which a policy with a default of false treats as a DENY.
+//
+// # Auditing
+//
+// Every check, including those answered from the cache, is recorded in the access
+// record as a bundle reference of the EXTERNAL phase, whose id is the checked tuple,
+// formatted object#relation@subject, and whose reason names the service. A failed
+// check is recorded with a NETWORK_ERROR reason code.
+//
+// # Usage
+//
+//	fga, err := zanzibar.NewOpenFGA(zanzibar.OpenFGAOptions{
+//	    URL:     "http://openfga.example.com:8080",
+//	    StoreID: "01HV...",
+//	})
+//	bridge := zanzibar.New(fga, zanzibar.WithCacheTTL(10*time.Second))
+//	pe, err := core.NewPolicyEngine(options.WithBuiltins(bridge.Builtin()))
+//
+// Decisions that call [CheckBuiltin] depend on the external service, so they are never
+// reported as cacheable (see model.CacheHint).
+package zanzibar
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manetu/policyengine/internal/logging"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/core/rebac"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var logger = logging.GetLogger("zanzibar")
+var agent = "zanzibar"
+
+// CheckBuiltin is the name of the built-in function that delegates a check.
+const CheckBuiltin = "zanzibar.check"
+
+// DefaultTimeout limits a check when no timeout is configured.
+const DefaultTimeout = time.Second
+
+// maxCacheEntries bounds the number of cached results
+const maxCacheEntries = 4096
+
+// maxResponseBody is the number of bytes read from the response of a service
+const maxResponseBody = 1 << 20
+
+var checkDecl = &rego.Function{
+	Name:        CheckBuiltin,
+	Description: "Reports whether subject holds relation on object, according to an external authorization service.",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("subject", types.S).Description("subject, such as user:alice or team:eng#member"),
+			types.Named("relation", types.S).Description("relation or permission, such as viewer"),
+			types.Named("object", types.S).Description("object, such as document:readme"),
+		),
+		types.Named("result", types.B).Description("true if the relationship holds; undefined if the service failed"),
+	),
+	Memoize:          true,
+	Nondeterministic: true,
+}
+
+// Declaration returns the capability declaration of [CheckBuiltin], for tooling that
+// compiles Rego without a [Bridge], such as lint.
+func Declaration() *ast.Builtin {
+	return (&opa.Builtin{Decl: checkDecl}).Declaration()
+}
+
+// Checker checks a relationship against an authorization service.
+//
+// Implementations must be safe for concurrent use, and should return promptly when
+// ctx is done.
+type Checker interface {
+	// Name identifies the service in the access record, such as "openfga".
+	Name() string
+
+	// Check returns true if the tuple's subject holds its relation on its object.
+	Check(ctx context.Context, tuple rebac.Tuple) (bool, error)
+}
+
+type bridgeOptions struct {
+	timeout  time.Duration
+	cacheTTL time.Duration
+}
+
+// Option configures a [Bridge].
+type Option func(*bridgeOptions)
+
+// WithTimeout limits each check, [DefaultTimeout] by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *bridgeOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithCacheTTL reuses the result of a check for ttl. Zero, the default, disables
+// caching. A relationship revoked in the service may still be granted until its
+// result expires.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *bridgeOptions) {
+		o.cacheTTL = ttl
+	}
+}
+
+// Stats reports the checks handled by a [Bridge] since it was created.
+type Stats struct {
+	// Hits counts checks answered from the cache.
+	Hits uint64
+	// Misses counts checks passed to the service.
+	Misses uint64
+	// Errors counts checks the service failed to answer, including timeouts.
+	Errors uint64
+}
+
+// Bridge exposes a [Checker] to policies as [CheckBuiltin], with a timeout and a cache.
+//
+// A Bridge is safe for concurrent use.
+type Bridge struct {
+	checker  Checker
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[rebac.Tuple]cacheEntry
+
+	hits, misses, errors atomic.Uint64
+}
+
+type cacheEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+// New creates a [Bridge] delegating checks to checker.
+func New(checker Checker, opts ...Option) *Bridge {
+	o := &bridgeOptions{timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.timeout <= 0 {
+		o.timeout = DefaultTimeout
+	}
+
+	return &Bridge{
+		checker:  checker,
+		timeout:  o.timeout,
+		cacheTTL: o.cacheTTL,
+		cache:    make(map[rebac.Tuple]cacheEntry),
+	}
+}
+
+// Builtin returns the [CheckBuiltin] implementation bound to this Bridge.
+func (b *Bridge) Builtin() *opa.Builtin {
+	return &opa.Builtin{Decl: checkDecl, Impl: b.check}
+}
+
+// Stats returns the checks handled so far.
+func (b *Bridge) Stats() Stats {
+	return Stats{Hits: b.hits.Load(), Misses: b.misses.Load(), Errors: b.errors.Load()}
+}
+
+// Check returns whether the relationship holds, from the cache or the service.
+func (b *Bridge) Check(ctx context.Context, tuple rebac.Tuple) (allowed, cached bool, err error) {
+	if allowed, ok := b.lookup(tuple); ok {
+		b.hits.Add(1)
+		return allowed, true, nil
+	}
+	b.misses.Add(1)
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	allowed, err = b.checker.Check(ctx, tuple)
+	if err != nil {
+		b.errors.Add(1)
+		return false, false, err
+	}
+
+	b.store(tuple, allowed)
+	return allowed, false, nil
+}
+
+func (b *Bridge) check(bctx rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+	var operands [3]string
+	for i, arg := range args {
+		s, ok := arg.Value.(ast.String)
+		if !ok {
+			return nil, rego.NewHaltError(fmt.Errorf("%s: operand %d must be a string, got %s", CheckBuiltin, i+1, ast.ValueName(arg.Value)))
+		}
+		operands[i] = string(s)
+	}
+	tuple := rebac.Tuple{Subject: operands[0], Relation: operands[1], Object: operands[2]}
+
+	ctx := bctx.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	start := time.Now()
+	ref := &events.AccessRecord_BundleReference{Id: tuple.String(), Decision: events.AccessRecord_DENY}
+	defer func() {
+		ref.Duration = uint64(time.Since(start).Nanoseconds()) // #nosec G115 -- elapsed time is never negative
+		opa.RecordExternal(ctx, ref)
+	}()
+
+	if err := tuple.Validate(); err != nil {
+		ref.ReasonCode = events.AccessRecord_BundleReference_INVALPARAM_ERROR
+		ref.Reason = err.Error()
+		return nil, rego.NewHaltError(fmt.Errorf("%s: %w", CheckBuiltin, err))
+	}
+
+	allowed, cached, err := b.Check(ctx, tuple)
+	if err != nil {
+		ref.ReasonCode = events.AccessRecord_BundleReference_NETWORK_ERROR
+		ref.Reason = fmt.Sprintf("%s: %s", b.checker.Name(), err)
+		logger.WithContext(ctx).Debugf(agent, "check", "%s %s: %+v", b.checker.Name(), tuple, err)
+		return nil, nil
+	}
+
+	ref.Reason = b.checker.Name()
+	if cached {
+		ref.Reason += " (cached)"
+	}
+	if allowed {
+		ref.Decision = events.AccessRecord_GRANT
+	}
+	return ast.BooleanTerm(allowed), nil
+}
+
+func (b *Bridge) lookup(tuple rebac.Tuple) (bool, bool) {
+	if b.cacheTTL <= 0 {
+		return false, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.cache[tuple]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(b.cache, tuple)
+		return false, false
+	}
+	return entry.allowed, true
+}
+
+// store caches a result. Expired entries are evicted when the cache is full; if none
+// have expired, the result is not cached.
+func (b *Bridge) store(tuple rebac.Tuple, allowed bool) {
+	if b.cacheTTL <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if len(b.cache) >= maxCacheEntries {
+		for key, entry := range b.cache {
+			if now.After(entry.expires) {
+				delete(b.cache, key)
+			}
+		}
+		if len(b.cache) >= maxCacheEntries {
+			return
+		}
+	}
+	b.cache[tuple] = cacheEntry{allowed: allowed, expires: now.Add(b.cacheTTL)}
+}
@@ -0,0 +1,212 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package zanzibar
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manetu/policyengine/internal/core/test"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/rebac"
+	"github.com/manetu/policyengine/pkg/core/types"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChecker answers checks from a set of tuples, or fails or stalls when told to
+type fakeChecker struct {
+	tuples map[rebac.Tuple]bool
+	err    error
+	delay  time.Duration
+	calls  atomic.Int32
+}
+
+func (f *fakeChecker) Name() string {
+	return "fake"
+}
+
+func (f *fakeChecker) Check(ctx context.Context, tuple rebac.Tuple) (bool, error) {
+	f.calls.Add(1)
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return false, f.err
+	}
+	return f.tuples[tuple], nil
+}
+
+const delegatingPolicy = `package authz
+default allow = false
+allow {
+	zanzibar.check(concat(":", ["user", input.principal.sub]), "viewer", input.resource.id)
+}`
+
+func externalResults(d *core.Decision) []types.PhaseResult {
+	var results []types.PhaseResult
+	for _, r := range d.Phases {
+		if r.Phase == types.PhaseExternal {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+func TestBuiltin(t *testing.T) {
+	ctx := context.Background()
+	checker := &fakeChecker{tuples: map[rebac.Tuple]bool{
+		{Subject: "user:alice", Relation: "viewer", Object: "doc:1"}: true,
+	}}
+	pe, err := test.NewBuiltinPolicyEngine(delegatingPolicy, options.WithBuiltins(New(checker).Builtin()), options.WithDecisionCacheTTL(time.Minute))
+	require.NoError(t, err)
+
+	decision, err := pe.Decide(ctx, test.BuiltinPORC("alice", "doc:1"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Zero(t, decision.Cache.TTL, "decisions depending on an external service are not cacheable")
+	assert.Equal(t, []types.PhaseResult{{
+		Phase:      types.PhaseExternal,
+		ID:         "doc:1#viewer@user:alice",
+		Allow:      true,
+		ReasonCode: types.ReasonPolicyOutcome,
+		Reason:     "fake",
+		Duration:   externalResults(decision)[0].Duration,
+	}}, externalResults(decision))
+
+	decision, err = pe.Decide(ctx, test.BuiltinPORC("bob", "doc:1"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+	require.Len(t, externalResults(decision), 1)
+	assert.False(t, externalResults(decision)[0].Allow)
+}
+
+func TestBuiltin_AccessRecord(t *testing.T) {
+	factory := accesslog.NewChannelFactory(1)
+	checker := &fakeChecker{tuples: map[rebac.Tuple]bool{
+		{Subject: "user:alice", Relation: "viewer", Object: "doc:1"}: true,
+	}}
+	pe, err := test.NewBuiltinPolicyEngine(delegatingPolicy, options.WithBuiltins(New(checker).Builtin()), options.WithAccessLog(factory))
+	require.NoError(t, err)
+
+	allowed, err := pe.Authorize(context.Background(), test.BuiltinPORC("alice", "doc:1"))
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	record := <-factory.C()
+	var external []*events.AccessRecord_BundleReference
+	for _, ref := range record.References {
+		if ref.Phase == events.AccessRecord_BundleReference_EXTERNAL {
+			external = append(external, ref)
+		}
+	}
+	require.Len(t, external, 1)
+	assert.Equal(t, "doc:1#viewer@user:alice", external[0].Id)
+	assert.Equal(t, events.AccessRecord_GRANT, external[0].Decision)
+	assert.Equal(t, "fake", external[0].Reason)
+}
+
+func TestBuiltin_Failure(t *testing.T) {
+	checker := &fakeChecker{err: errors.New("connection refused")}
+	pe, err := test.NewBuiltinPolicyEngine(delegatingPolicy, options.WithBuiltins(New(checker).Builtin()))
+	require.NoError(t, err)
+
+	decision, err := pe.Decide(context.Background(), test.BuiltinPORC("alice", "doc:1"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+
+	results := externalResults(decision)
+	require.Len(t, results, 1)
+	assert.False(t, results[0].Allow)
+	assert.Equal(t, types.ReasonNetworkError, results[0].ReasonCode)
+	assert.Equal(t, "fake: connection refused", results[0].Reason)
+}
+
+func TestBuiltin_InvalidTuple(t *testing.T) {
+	pe, err := test.NewBuiltinPolicyEngine(delegatingPolicy, options.WithBuiltins(New(&fakeChecker{}).Builtin()))
+	require.NoError(t, err)
+
+	// objects cannot name a relation
+	decision, err := pe.Decide(context.Background(), test.BuiltinPORC("alice", "doc:1#owner"), options.SetPhaseResults(true))
+	require.NoError(t, err)
+	assert.False(t, decision.Allow)
+
+	results := externalResults(decision)
+	require.Len(t, results, 1)
+	assert.Equal(t, types.ReasonInvalidParamError, results[0].ReasonCode)
+}
+
+func TestBridge_Cache(t *testing.T) {
+	ctx := context.Background()
+	tuple := rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"}
+	checker := &fakeChecker{tuples: map[rebac.Tuple]bool{tuple: true}}
+	bridge := New(checker, WithCacheTTL(50*time.Millisecond))
+
+	allowed, cached, err := bridge.Check(ctx, tuple)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.False(t, cached)
+
+	allowed, cached, err = bridge.Check(ctx, tuple)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.True(t, cached)
+	assert.Equal(t, int32(1), checker.calls.Load())
+
+	time.Sleep(60 * time.Millisecond)
+	_, cached, err = bridge.Check(ctx, tuple)
+	require.NoError(t, err)
+	assert.False(t, cached, "expired results are checked again")
+
+	// failures are not cached
+	checker.err = errors.New("unavailable")
+	failing := rebac.Tuple{Subject: "user:bob", Relation: "viewer", Object: "doc:1"}
+	_, _, err = bridge.Check(ctx, failing)
+	assert.Error(t, err)
+	_, _, err = bridge.Check(ctx, failing)
+	assert.Error(t, err)
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 4, Errors: 2}, bridge.Stats())
+}
+
+func TestBridge_NoCache(t *testing.T) {
+	tuple := rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"}
+	checker := &fakeChecker{}
+	bridge := New(checker)
+
+	for i := 0; i < 2; i++ {
+		_, cached, err := bridge.Check(context.Background(), tuple)
+		require.NoError(t, err)
+		assert.False(t, cached)
+	}
+	assert.Equal(t, int32(2), checker.calls.Load())
+}
+
+func TestBridge_Timeout(t *testing.T) {
+	checker := &fakeChecker{delay: time.Minute}
+	bridge := New(checker, WithTimeout(20*time.Millisecond))
+
+	start := time.Now()
+	_, _, err := bridge.Check(context.Background(), rebac.Tuple{Subject: "user:alice", Relation: "viewer", Object: "doc:1"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, uint64(1), bridge.Stats().Errors)
+}
+
+func TestDeclaration(t *testing.T) {
+	decl := Declaration()
+	assert.Equal(t, CheckBuiltin, decl.Name)
+	assert.True(t, decl.Nondeterministic)
+}
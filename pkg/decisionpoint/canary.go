@@ -0,0 +1,328 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/types"
+)
+
+const canaryAgent string = "canary"
+
+// DefaultCanaryMinComparisons is the number of decisions a [Canary] compares by default before
+// its rollback threshold applies.
+const DefaultCanaryMinComparisons = 100
+
+// CanaryVariant names the bundles serving a decision under a [Canary].
+type CanaryVariant string
+
+const (
+	// CanaryStable is the variant of the bundles in production.
+	CanaryStable CanaryVariant = "stable"
+
+	// CanaryCanary is the variant of the bundles being rolled out.
+	CanaryCanary CanaryVariant = "canary"
+)
+
+// CanaryOptions configures a [Canary].
+type CanaryOptions struct {
+	// Split is the fraction of decisions, between 0 and 1, served by the canary bundles.
+	Split float64
+
+	// Header names a request header whose value, "stable" or "canary", selects the bundles
+	// serving the request regardless of the split. Headers are ignored if empty.
+	Header string
+
+	// RollbackThreshold is the fraction of compared decisions, between 0 and 1, on which the
+	// canary may disagree with the stable bundles before it is rolled back. Zero never rolls
+	// back.
+	RollbackThreshold float64
+
+	// MinComparisons is the number of decisions compared before the rollback threshold
+	// applies (default [DefaultCanaryMinComparisons]).
+	MinComparisons int
+}
+
+// CanaryVariantStats reports the decisions served by one variant of a [Canary].
+type CanaryVariantStats struct {
+	// Decisions counts the decisions served.
+	Decisions uint64
+	// Grants counts the decisions that granted the request.
+	Grants uint64
+	// Errors counts the decisions that failed, such as for a malformed PORC.
+	Errors uint64
+	// Latency is the total time taken by the decisions served.
+	Latency time.Duration
+}
+
+// CanaryStats reports the rollout of a [Canary].
+type CanaryStats struct {
+	// Split is the fraction of decisions routed to the canary bundles.
+	Split float64
+	// RolledBack reports whether the canary was rolled back, serving every decision from the
+	// stable bundles.
+	RolledBack bool
+	// Stable and Canary report the decisions served by each variant.
+	Stable CanaryVariantStats
+	Canary CanaryVariantStats
+	// Compared counts the canary decisions compared with the stable bundles since the split
+	// was last set.
+	Compared uint64
+	// Diverged counts the compared decisions on which the variants disagreed.
+	Diverged uint64
+}
+
+// canaryCounters accumulates the [CanaryVariantStats] of a variant
+type canaryCounters struct {
+	decisions atomic.Uint64
+	grants    atomic.Uint64
+	errors    atomic.Uint64
+	latency   atomic.Int64
+}
+
+func (c *canaryCounters) record(decision *core.Decision, err error, elapsed time.Duration) {
+	c.decisions.Add(1)
+	c.latency.Add(int64(elapsed))
+	switch {
+	case err != nil:
+		c.errors.Add(1)
+	case decision.Allow:
+		c.grants.Add(1)
+	}
+}
+
+func (c *canaryCounters) stats() CanaryVariantStats {
+	return CanaryVariantStats{
+		Decisions: c.decisions.Load(),
+		Grants:    c.grants.Load(),
+		Errors:    c.errors.Load(),
+		Latency:   time.Duration(c.latency.Load()),
+	}
+}
+
+// Canary rolls out a new set of bundles by serving a fraction of the decisions from them, while
+// the stable bundles serve the rest. A request may select its bundles with a header, such as to
+// test the canary before any traffic is split to it.
+//
+// Each decision served by the canary is also decided by the stable bundles in probe mode, so
+// that it is not logged, and the two are compared. Once enough decisions are compared, the
+// canary is rolled back if the fraction that diverged exceeds the rollback threshold: from then
+// on, the stable bundles serve every decision until the split is set again.
+//
+// Canary is a [core.PolicyEngine] that decides with the variant selected, and otherwise defers
+// to the stable engine, such as for its backend and access record subscriptions. Canary is safe
+// for concurrent use.
+type Canary struct {
+	core.PolicyEngine
+	canary core.PolicyEngine
+	opts   CanaryOptions
+	random func() float64
+
+	stable, canaried canaryCounters
+
+	mu         sync.RWMutex
+	split      float64
+	rolledBack bool
+	compared   uint64
+	diverged   uint64
+}
+
+// NewCanary creates a Canary serving decisions from the stable and canary engines.
+//
+// Returns an error if the split or rollback threshold is not between 0 and 1, or the minimum
+// number of comparisons is negative.
+func NewCanary(stable, canary core.PolicyEngine, opts CanaryOptions) (*Canary, error) {
+	if err := validateSplit(opts.Split); err != nil {
+		return nil, err
+	}
+	if opts.RollbackThreshold < 0 || opts.RollbackThreshold > 1 {
+		return nil, fmt.Errorf("invalid canary rollback threshold %g: must be between 0 and 1", opts.RollbackThreshold)
+	}
+	if opts.MinComparisons < 0 {
+		return nil, fmt.Errorf("canary minimum comparisons must not be negative, got %d", opts.MinComparisons)
+	}
+	if opts.MinComparisons == 0 {
+		opts.MinComparisons = DefaultCanaryMinComparisons
+	}
+
+	return &Canary{
+		PolicyEngine: stable,
+		canary:       canary,
+		opts:         opts,
+		random:       rand.Float64,
+		split:        opts.Split,
+	}, nil
+}
+
+func validateSplit(split float64) error {
+	if split < 0 || split > 1 {
+		return fmt.Errorf("invalid canary split %g: must be between 0 and 1", split)
+	}
+	return nil
+}
+
+// Decide decides the request with the variant selected by its header, if any, or else by the
+// split, comparing the decisions of the canary with those of the stable bundles.
+func (c *Canary) Decide(ctx context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (*core.Decision, error) {
+	if c.route(ctx) == CanaryStable {
+		start := time.Now()
+		decision, err := c.PolicyEngine.Decide(ctx, porc, authzOptions...)
+		c.stable.record(decision, err, time.Since(start))
+		return decision, err
+	}
+
+	// each variant decides its own copy of the PORC, since deciding a map records the
+	// principal's annotations in it
+	if m, ok := porc.(map[string]interface{}); ok {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal PORC: %w", err)
+		}
+		porc = string(data)
+	}
+
+	start := time.Now()
+	decision, err := c.canary.Decide(ctx, porc, authzOptions...)
+	c.canaried.record(decision, err, time.Since(start))
+
+	expected, eerr := c.PolicyEngine.Decide(ctx, porc, append(authzOptions, options.SetProbeMode(true))...)
+	c.compare((err == nil) != (eerr == nil) || (err == nil && decision.Allow != expected.Allow))
+
+	return decision, err
+}
+
+// Authorize decides the request like [Canary.Decide].
+func (c *Canary) Authorize(ctx context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (bool, error) {
+	decision, err := c.Decide(ctx, porc, authzOptions...)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allow, nil
+}
+
+// WarmUp prepares the policies of both variants.
+func (c *Canary) WarmUp(ctx context.Context) error {
+	if err := c.PolicyEngine.WarmUp(ctx); err != nil {
+		return err
+	}
+	if err := c.canary.WarmUp(ctx); err != nil {
+		return fmt.Errorf("canary: %w", err)
+	}
+	return nil
+}
+
+// Health checks the backends of both variants.
+func (c *Canary) Health(ctx context.Context) error {
+	if err := c.PolicyEngine.Health(ctx); err != nil {
+		return err
+	}
+	if err := c.canary.Health(ctx); err != nil {
+		return fmt.Errorf("canary: %w", err)
+	}
+	return nil
+}
+
+// route selects the variant serving a request
+func (c *Canary) route(ctx context.Context) CanaryVariant {
+	c.mu.RLock()
+	split, rolledBack := c.split, c.rolledBack
+	c.mu.RUnlock()
+
+	if rolledBack {
+		return CanaryStable
+	}
+	if c.opts.Header != "" {
+		switch variant := CanaryVariant(strings.ToLower(strings.TrimSpace(RequestHeader(ctx, c.opts.Header)))); variant {
+		case CanaryStable, CanaryCanary:
+			return variant
+		}
+	}
+	if split > 0 && c.random() < split {
+		return CanaryCanary
+	}
+	return CanaryStable
+}
+
+// compare counts a compared decision, rolling the canary back if too many have diverged
+func (c *Canary) compare(diverged bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.compared++
+	if diverged {
+		c.diverged++
+	}
+
+	if c.rolledBack || c.opts.RollbackThreshold == 0 || c.compared < uint64(c.opts.MinComparisons) {
+		return
+	}
+	if rate := float64(c.diverged) / float64(c.compared); rate > c.opts.RollbackThreshold {
+		c.rolledBack = true
+		logger.Errorf(canaryAgent, "rollback", "canary rolled back: %d of %d compared decisions diverged (%.2f%%), above the threshold of %.2f%%",
+			c.diverged, c.compared, rate*100, c.opts.RollbackThreshold*100)
+	}
+}
+
+// SetSplit changes the fraction of decisions served by the canary bundles, restarting the
+// comparisons and lifting a rollback.
+//
+// Returns an error if the split is not between 0 and 1.
+func (c *Canary) SetSplit(split float64) error {
+	if err := validateSplit(split); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.split = split
+	c.rolledBack = false
+	c.compared, c.diverged = 0, 0
+	logger.Infof(canaryAgent, "split", "canary split set to %.2f%%", split*100)
+	return nil
+}
+
+// Stats returns the rollout of the canary, and the decisions served by each variant since the
+// Canary was created.
+func (c *Canary) Stats() CanaryStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return CanaryStats{
+		Split:      c.split,
+		RolledBack: c.rolledBack,
+		Stable:     c.stable.stats(),
+		Canary:     c.canaried.stats(),
+		Compared:   c.compared,
+		Diverged:   c.diverged,
+	}
+}
+
+type requestHeadersKey struct{}
+
+// WithRequestHeaders returns a context carrying the headers of the request being decided, looked
+// up by name with get, for decision point components routing on them such as a [Canary].
+func WithRequestHeaders(ctx context.Context, get func(name string) string) context.Context {
+	return context.WithValue(ctx, requestHeadersKey{}, get)
+}
+
+// RequestHeader returns the value of a header of the request being decided, or "" if it has none
+// or the context carries no headers.
+func RequestHeader(ctx context.Context, name string) string {
+	get, ok := ctx.Value(requestHeadersKey{}).(func(string) string)
+	if !ok {
+		return ""
+	}
+	return get(name)
+}
@@ -0,0 +1,198 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEngine decides every request the same way, recording the PORCs it decides and whether
+// they were probes
+type fakeEngine struct {
+	core.PolicyEngine
+	allow  bool
+	err    error
+	porcs  []types.AnyPORC
+	probes int
+}
+
+func (e *fakeEngine) Decide(_ context.Context, porc types.AnyPORC, authzOptions ...options.AuthzOptionsFunc) (*core.Decision, error) {
+	opts := &options.AuthzOptions{}
+	for _, o := range authzOptions {
+		o(opts)
+	}
+	e.porcs = append(e.porcs, porc)
+	if opts.Probe {
+		e.probes++
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return &core.Decision{Allow: e.allow}, nil
+}
+
+func (e *fakeEngine) WarmUp(context.Context) error { return e.err }
+func (e *fakeEngine) Health(context.Context) error { return e.err }
+
+// sequence returns a random source yielding values in turn
+func sequence(values ...float64) func() float64 {
+	i := 0
+	return func() float64 {
+		v := values[i%len(values)]
+		i++
+		return v
+	}
+}
+
+func TestNewCanary(t *testing.T) {
+	_, err := NewCanary(&fakeEngine{}, &fakeEngine{}, CanaryOptions{Split: 1.5})
+	assert.ErrorContains(t, err, "invalid canary split 1.5")
+	_, err = NewCanary(&fakeEngine{}, &fakeEngine{}, CanaryOptions{RollbackThreshold: -0.1})
+	assert.ErrorContains(t, err, "invalid canary rollback threshold")
+	_, err = NewCanary(&fakeEngine{}, &fakeEngine{}, CanaryOptions{MinComparisons: -1})
+	assert.ErrorContains(t, err, "must not be negative")
+
+	c, err := NewCanary(&fakeEngine{}, &fakeEngine{}, CanaryOptions{Split: 0.1})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCanaryMinComparisons, c.opts.MinComparisons)
+	assert.Equal(t, 0.1, c.Stats().Split)
+}
+
+func TestCanary_Split(t *testing.T) {
+	stable, canary := &fakeEngine{allow: false}, &fakeEngine{allow: true}
+	c, err := NewCanary(stable, canary, CanaryOptions{Split: 0.25})
+	require.NoError(t, err)
+	c.random = sequence(0.1, 0.5, 0.9, 0.3)
+
+	var allowed []bool
+	for i := 0; i < 4; i++ {
+		allow, err := c.Authorize(context.Background(), `{"principal": {}}`)
+		require.NoError(t, err)
+		allowed = append(allowed, allow)
+	}
+	assert.Equal(t, []bool{true, false, false, false}, allowed, "only draws below the split go to the canary")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(3), stats.Stable.Decisions)
+	assert.Equal(t, uint64(0), stats.Stable.Grants)
+	assert.Equal(t, uint64(1), stats.Canary.Decisions)
+	assert.Equal(t, uint64(1), stats.Canary.Grants)
+
+	// each canary decision is compared with a probe of the stable bundles
+	assert.Equal(t, 1, stable.probes)
+	assert.Len(t, stable.porcs, 4)
+	assert.Equal(t, uint64(1), stats.Compared)
+	assert.Equal(t, uint64(1), stats.Diverged)
+}
+
+func TestCanary_CopiesPORC(t *testing.T) {
+	stable, canary := &fakeEngine{}, &fakeEngine{}
+	c, err := NewCanary(stable, canary, CanaryOptions{Split: 1})
+	require.NoError(t, err)
+
+	_, err = c.Decide(context.Background(), map[string]interface{}{"operation": "api:documents:read"})
+	require.NoError(t, err)
+	require.Len(t, canary.porcs, 1)
+	assert.Equal(t, `{"operation":"api:documents:read"}`, canary.porcs[0], "both variants decide a copy of the PORC")
+	assert.Equal(t, canary.porcs, stable.porcs)
+}
+
+func TestCanary_Header(t *testing.T) {
+	stable, canary := &fakeEngine{allow: false}, &fakeEngine{allow: true}
+	c, err := NewCanary(stable, canary, CanaryOptions{Header: "X-MPE-Bundle"})
+	require.NoError(t, err)
+
+	decide := func(value string) bool {
+		ctx := WithRequestHeaders(context.Background(), func(name string) string {
+			if name == "X-MPE-Bundle" {
+				return value
+			}
+			return ""
+		})
+		allow, err := c.Authorize(ctx, "{}")
+		require.NoError(t, err)
+		return allow
+	}
+	assert.True(t, decide("canary"))
+	assert.True(t, decide(" Canary "))
+	assert.False(t, decide("stable"))
+	assert.False(t, decide("other"), "unknown values fall back to the split")
+	assert.False(t, decide(""))
+
+	// without a header name, requests cannot select the canary
+	c, err = NewCanary(stable, canary, CanaryOptions{})
+	require.NoError(t, err)
+	ctx := WithRequestHeaders(context.Background(), func(string) string { return "canary" })
+	allow, err := c.Authorize(ctx, "{}")
+	require.NoError(t, err)
+	assert.False(t, allow)
+
+	assert.Equal(t, "", RequestHeader(context.Background(), "X-MPE-Bundle"))
+}
+
+func TestCanary_Rollback(t *testing.T) {
+	stable, canary := &fakeEngine{allow: true}, &fakeEngine{allow: true}
+	c, err := NewCanary(stable, canary, CanaryOptions{Split: 1, RollbackThreshold: 0.2, MinComparisons: 4})
+	require.NoError(t, err)
+
+	decide := func() {
+		_, err := c.Decide(context.Background(), "{}")
+		require.NoError(t, err)
+	}
+
+	// agreeing decisions keep the canary serving
+	decide()
+	decide()
+	canary.allow = false
+	decide()
+	assert.False(t, c.Stats().RolledBack, "the threshold applies only after the minimum comparisons")
+	decide()
+
+	stats := c.Stats()
+	assert.True(t, stats.RolledBack, "2 of 4 decisions diverged")
+	assert.Equal(t, uint64(4), stats.Compared)
+	assert.Equal(t, uint64(2), stats.Diverged)
+
+	// once rolled back, the stable bundles serve every decision, even those selecting the canary
+	c.opts.Header = "X-MPE-Bundle"
+	ctx := WithRequestHeaders(context.Background(), func(string) string { return "canary" })
+	allow, err := c.Authorize(ctx, "{}")
+	require.NoError(t, err)
+	assert.True(t, allow)
+	assert.Equal(t, uint64(4), c.Stats().Canary.Decisions)
+
+	// setting the split lifts the rollback and restarts the comparisons
+	require.NoError(t, c.SetSplit(0.5))
+	stats = c.Stats()
+	assert.False(t, stats.RolledBack)
+	assert.Equal(t, 0.5, stats.Split)
+	assert.Equal(t, uint64(0), stats.Compared)
+	assert.Error(t, c.SetSplit(2))
+}
+
+func TestCanary_Errors(t *testing.T) {
+	stable, canary := &fakeEngine{}, &fakeEngine{err: errors.New("malformed PORC")}
+	c, err := NewCanary(stable, canary, CanaryOptions{Split: 1})
+	require.NoError(t, err)
+
+	_, err = c.Authorize(context.Background(), "{")
+	assert.ErrorContains(t, err, "malformed PORC")
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Canary.Errors)
+	assert.Equal(t, uint64(1), stats.Diverged, "an error where the stable bundles decide is a divergence")
+
+	assert.ErrorContains(t, c.WarmUp(context.Background()), "canary: malformed PORC")
+	assert.ErrorContains(t, c.Health(context.Background()), "canary: malformed PORC")
+	stable.err = errors.New("unreachable")
+	assert.EqualError(t, c.Health(context.Background()), "unreachable")
+}
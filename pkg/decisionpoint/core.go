@@ -22,9 +22,96 @@
 //	pe, _ := core.NewPolicyEngine(options.WithBackend(backend))
 //	server, _ := generic.CreateServer(pe, 8080)
 //	defer server.Stop(ctx)
+//
+// # TLS
+//
+// Both servers listen in plaintext unless given a TLS configuration. Use [NewTLSConfig]
+// to serve over TLS, optionally requiring client certificates, with certificates that are
+// reloaded when they are rotated on disk:
+//
+//	tlsConfig, err := decisionpoint.NewTLSConfig(decisionpoint.TLSOptions{
+//	    CertFile:     "/etc/pdp/tls.crt",
+//	    KeyFile:      "/etc/pdp/tls.key",
+//	    ClientCAFile: "/etc/pdp/ca.crt",
+//	    ClientSANs:   []string{"spiffe://cluster.local/ns/apps/sa/gateway"},
+//	})
+//	server, _ := generic.CreateServer(pe, 8443, generic.WithTLS(tlsConfig))
+//
+// # Listeners
+//
+// Both servers listen on a TCP port unless given a listener. Use [Listen] to serve on a
+// Unix domain socket, or on a socket passed by systemd socket activation:
+//
+//	listener, err := decisionpoint.Listen("unix:///var/run/mpe.sock")
+//	server, _ := envoy.CreateServer(pe, 0, domain, envoy.WithListener(listener))
+//
+// # Overload Protection
+//
+// Both servers evaluate every request as it arrives unless given a [Limiter], which bounds the
+// decisions evaluated at once and rejects the excess, either as unavailable or as DENY:
+//
+//	limiter, err := decisionpoint.NewLimiter(decisionpoint.LimiterOptions{
+//	    MaxConcurrent: 64,
+//	    QueueSize:     256,
+//	    QueueTimeout:  50 * time.Millisecond,
+//	})
+//	server, _ := generic.CreateServer(pe, 8080, generic.WithLimiter(limiter))
+//
+// # Backend Health
+//
+// A decision point backed by a remote policy store should report itself degraded while the
+// store is unreachable. A [HealthMonitor] periodically runs [core.PolicyEngine.Health] and
+// marks the [Readiness] of the servers degraded while it fails:
+//
+//	monitor, err := decisionpoint.NewHealthMonitor(pe.Health, decisionpoint.HealthOptions{
+//	    Interval:  10 * time.Second,
+//	    Readiness: readiness,
+//	})
+//	go monitor.Run(ctx)
+//
+// # Canary Rollout
+//
+// A [Canary] is a [core.PolicyEngine] that serves a fraction of the decisions from a second
+// engine loaded with new bundles, comparing them with the stable engine and rolling back if
+// they diverge too often. Both servers attach the request headers to the context of each
+// decision, so that a request may select its bundles:
+//
+//	canary, err := decisionpoint.NewCanary(stable, next, decisionpoint.CanaryOptions{
+//	    Split:             0.05,
+//	    Header:            "x-mpe-bundle",
+//	    RollbackThreshold: 0.01,
+//	})
+//	server, _ := generic.CreateServer(canary, 8080)
+//
+// # Coordinated Rollouts
+//
+// Replicas of a decision point behind a load balancer follow a shared [RolloutTarget] with a
+// [Rollout], which stages each new revision of the bundles and switches every replica to it
+// at the same time:
+//
+//	source, err := decisionpoint.NewRolloutSource("etcd://etcd:2379/mpe/rollout")
+//	rollout, err := decisionpoint.NewRollout(decisionpoint.RolloutOptions{
+//	    Source:   source,
+//	    Stage:    stage, // loads the bundles of a revision into a staged registry
+//	    Revision: "v42",
+//	})
+//	go rollout.Run(ctx)
+//
+// # Multiple Protocols
+//
+// Any number of servers may share an engine, such as to serve both protocols from one process
+// on separate listeners. [Servers] stops them together:
+//
+//	httpServer, _ := generic.CreateServer(pe, 9000, generic.WithReadiness(readiness))
+//	grpcServer, _ := envoy.CreateServer(pe, 9001, domain, envoy.WithReadiness(readiness))
+//	servers := decisionpoint.Servers{httpServer, grpcServer}
+//	defer servers.Stop(ctx)
 package decisionpoint
 
-import "context"
+import (
+	"context"
+	"errors"
+)
 
 // Server is the interface for PDP servers that can be gracefully stopped.
 //
@@ -35,3 +122,17 @@ type Server interface {
 	// to complete or until the context is cancelled.
 	Stop(context.Context) error
 }
+
+// Servers is a group of PDP servers, typically sharing an engine, that are stopped together.
+type Servers []Server
+
+// Stop gracefully shuts down every server, returning the errors of those that failed to stop.
+func (s Servers) Stop(ctx context.Context) error {
+	var errs []error
+	for _, server := range s {
+		if err := server.Stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
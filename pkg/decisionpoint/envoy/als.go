@@ -0,0 +1,318 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package envoy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	alsv3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultCorrelationTTL is the default time a decision or Envoy access log entry is
+// held while waiting for its counterpart.
+const DefaultCorrelationTTL = 30 * time.Second
+
+// MergedRecord is the audit artifact emitted when an AccessRecord is correlated with
+// an Envoy HTTP access log entry sharing the same request-id.
+type MergedRecord struct {
+	RequestID    string                 `json:"requestId"`
+	AccessRecord map[string]interface{} `json:"accessRecord"`
+	Envoy        map[string]interface{} `json:"envoy"`
+}
+
+type pendingDecision struct {
+	record  *events.AccessRecord
+	expires time.Time
+}
+
+type pendingEntry struct {
+	entry   *accesslogv3.HTTPAccessLogEntry
+	expires time.Time
+}
+
+// Correlator joins policy decisions with Envoy Access Log Service (ALS) entries by request-id.
+//
+// Correlator serves two roles:
+//   - As an [accesslog.Factory], it receives the AccessRecords produced by the policy engine.
+//     Records carrying a correlation id are held until the matching ALS entry arrives.
+//   - As an ALS gRPC server, it receives HTTP access log entries streamed by Envoy.
+//
+// When both halves of a request are present, a [MergedRecord] is written to the configured
+// writer. Decisions that cannot be correlated (no request-id, or no ALS entry before the
+// TTL expires) are forwarded unchanged to the inner access log stream, so every decision is
+// still audited exactly once. Unmatched ALS entries are discarded after the TTL.
+type Correlator struct {
+	alsv3.UnimplementedAccessLogServiceServer
+
+	inner   accesslog.Factory
+	stream  accesslog.Stream
+	writer  io.Writer
+	options accesslog.AccessLogOptions
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	decisions map[string]*pendingDecision
+	entries   map[string]*pendingEntry
+
+	done chan struct{}
+	once sync.Once
+}
+
+type correlatorStream struct {
+	c *Correlator
+}
+
+// NewCorrelator creates a [Correlator] that writes merged records to w and forwards
+// uncorrelated decisions to streams created by inner. A ttl of zero selects
+// [DefaultCorrelationTTL].
+//
+// Example:
+//
+//	correlator := envoy.NewCorrelator(accesslog.NewStdoutFactory(), os.Stdout, accesslog.AccessLogOptions{}, 0)
+//	pe, _ := core.NewPolicyEngine(options.WithAccessLog(correlator))
+//	server, _ := envoy.CreateServer(pe, 9001, "", envoy.WithAccessLogService(correlator))
+func NewCorrelator(inner accesslog.Factory, w io.Writer, opts accesslog.AccessLogOptions, ttl time.Duration) *Correlator {
+	if ttl <= 0 {
+		ttl = DefaultCorrelationTTL
+	}
+
+	return &Correlator{
+		inner:     inner,
+		writer:    w,
+		options:   opts,
+		ttl:       ttl,
+		now:       time.Now,
+		decisions: make(map[string]*pendingDecision),
+		entries:   make(map[string]*pendingEntry),
+		done:      make(chan struct{}),
+	}
+}
+
+// NewStream creates the inner access log stream and starts the eviction loop.
+func (c *Correlator) NewStream() (accesslog.Stream, error) {
+	stream, err := c.inner.NewStream()
+	if err != nil {
+		return nil, err
+	}
+	c.stream = stream
+
+	go c.evictLoop()
+
+	return &correlatorStream{c: c}, nil
+}
+
+// Send implements [accesslog.Stream] for records produced by the policy engine.
+func (s *correlatorStream) Send(record *events.AccessRecord) error {
+	return s.c.addDecision(record)
+}
+
+// Close flushes pending decisions to the inner stream and stops the eviction loop.
+func (s *correlatorStream) Close() {
+	s.c.close()
+}
+
+// StreamAccessLogs implements the Envoy ALS v3 gRPC service.
+func (c *Correlator) StreamAccessLogs(stream alsv3.AccessLogService_StreamAccessLogsServer) error {
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&alsv3.StreamAccessLogsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range msg.GetHttpLogs().GetLogEntry() {
+			if err := c.addEntry(entry); err != nil {
+				logger.Errorf(agent, "StreamAccessLogs", "unable to emit merged record: %+v", err)
+			}
+		}
+	}
+}
+
+func (c *Correlator) addDecision(record *events.AccessRecord) error {
+	id := record.GetMetadata().GetCorrelationId()
+	if id == "" {
+		return c.stream.Send(record)
+	}
+
+	c.mu.Lock()
+	pe, ok := c.entries[id]
+	if ok {
+		delete(c.entries, id)
+	} else {
+		c.decisions[id] = &pendingDecision{
+			// the engine retains ownership of the record once Send returns
+			record:  proto.Clone(record).(*events.AccessRecord),
+			expires: c.now().Add(c.ttl),
+		}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return c.emit(id, record, pe.entry)
+}
+
+func (c *Correlator) addEntry(entry *accesslogv3.HTTPAccessLogEntry) error {
+	id := entry.GetRequest().GetRequestId()
+	if id == "" {
+		logger.Tracef(agent, "addEntry", "ignoring access log entry without request-id")
+		return nil
+	}
+
+	c.mu.Lock()
+	pd, ok := c.decisions[id]
+	if ok {
+		delete(c.decisions, id)
+	} else {
+		c.entries[id] = &pendingEntry{entry: entry, expires: c.now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return c.emit(id, pd.record, entry)
+}
+
+func (c *Correlator) emit(id string, record *events.AccessRecord, entry *accesslogv3.HTTPAccessLogEntry) error {
+	// encoders such as CEF render the access record alone
+	if c.options.Encoder != nil {
+		output, err := c.options.Encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.writer, string(output))
+		return err
+	}
+
+	ar, err := toMap(record)
+	if err != nil {
+		return err
+	}
+
+	// porc is carried as a JSON string; expand it for readability as the IoWriterStream does
+	if porcStr, ok := ar["porc"].(string); ok {
+		var porc interface{}
+		if err := json.Unmarshal([]byte(porcStr), &porc); err == nil {
+			ar["porc"] = porc
+		}
+	}
+
+	env, err := toMap(entry)
+	if err != nil {
+		return err
+	}
+
+	var merged interface{} = &MergedRecord{RequestID: id, AccessRecord: ar, Envoy: env}
+	if c.options.CloudEvents != nil {
+		merged = accesslog.NewCloudEvent(record, merged, *c.options.CloudEvents)
+	}
+
+	var output []byte
+	if c.options.PrettyPrint {
+		output, err = json.MarshalIndent(merged, "", "  ")
+	} else {
+		output, err = json.Marshal(merged)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(c.writer, string(output))
+	return err
+}
+
+func toMap(m proto.Message) (map[string]interface{}, error) {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// evict removes expired entries, forwarding expired decisions to the inner stream.
+func (c *Correlator) evict() {
+	now := c.now()
+	var expired []*events.AccessRecord
+
+	c.mu.Lock()
+	for id, pd := range c.decisions {
+		if now.After(pd.expires) {
+			expired = append(expired, pd.record)
+			delete(c.decisions, id)
+		}
+	}
+	for id, pe := range c.entries {
+		if now.After(pe.expires) {
+			logger.Debugf(agent, "evict", "discarding uncorrelated access log entry for request %s", id)
+			delete(c.entries, id)
+		}
+	}
+	c.mu.Unlock()
+
+	c.forward(expired)
+}
+
+func (c *Correlator) forward(records []*events.AccessRecord) {
+	for _, record := range records {
+		if err := c.stream.Send(record); err != nil {
+			logger.Errorf(agent, "forward", "unable to send message for accesslog %+v", err)
+		}
+	}
+}
+
+func (c *Correlator) evictLoop() {
+	ticker := time.NewTicker(c.ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.evict()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Correlator) close() {
+	c.once.Do(func() {
+		close(c.done)
+
+		c.mu.Lock()
+		pending := make([]*events.AccessRecord, 0, len(c.decisions))
+		for _, pd := range c.decisions {
+			pending = append(pending, pd.record)
+		}
+		c.decisions = make(map[string]*pendingDecision)
+		c.entries = make(map[string]*pendingEntry)
+		c.mu.Unlock()
+
+		c.forward(pending)
+		c.stream.Close()
+	})
+}
@@ -0,0 +1,272 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package envoy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	alsv3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// syncBuffer is a goroutine-safe bytes.Buffer
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestCorrelator(t *testing.T) (*Correlator, accesslog.Stream, *syncBuffer, *syncBuffer) {
+	inner := &syncBuffer{}
+	merged := &syncBuffer{}
+
+	c := NewCorrelator(accesslog.NewIoWriterFactory(inner), merged, accesslog.AccessLogOptions{}, time.Minute)
+	stream, err := c.NewStream()
+	require.NoError(t, err)
+	t.Cleanup(stream.Close)
+
+	return c, stream, inner, merged
+}
+
+func decisionRecord(id string) *events.AccessRecord {
+	return &events.AccessRecord{
+		Metadata:  &events.AccessRecord_Metadata{Id: "record-" + id, CorrelationId: id},
+		Operation: "api:test:read",
+		Decision:  events.AccessRecord_GRANT,
+		Porc:      `{"operation":"api:test:read"}`,
+	}
+}
+
+func logEntry(id string) *accesslogv3.HTTPAccessLogEntry {
+	return &accesslogv3.HTTPAccessLogEntry{
+		Request: &accesslogv3.HTTPRequestProperties{
+			RequestId: id,
+			Path:      "/api/test",
+		},
+		Response: &accesslogv3.HTTPResponseProperties{
+			ResponseCode: wrapperspb.UInt32(200),
+		},
+	}
+}
+
+func parseMerged(t *testing.T, output string) []MergedRecord {
+	var records []MergedRecord
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+		var m MergedRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		records = append(records, m)
+	}
+	return records
+}
+
+func TestCorrelator_DecisionThenEntry(t *testing.T) {
+	c, stream, inner, merged := newTestCorrelator(t)
+
+	require.NoError(t, stream.Send(decisionRecord("req-1")))
+	assert.Empty(t, merged.String())
+
+	require.NoError(t, c.addEntry(logEntry("req-1")))
+
+	records := parseMerged(t, merged.String())
+	require.Len(t, records, 1)
+	assert.Equal(t, "req-1", records[0].RequestID)
+	assert.Equal(t, "GRANT", records[0].AccessRecord["decision"])
+	assert.Equal(t, map[string]interface{}{"operation": "api:test:read"}, records[0].AccessRecord["porc"])
+	assert.Equal(t, "/api/test", records[0].Envoy["request"].(map[string]interface{})["path"])
+	assert.Empty(t, inner.String())
+}
+
+func TestCorrelator_EntryThenDecision(t *testing.T) {
+	c, stream, inner, merged := newTestCorrelator(t)
+
+	require.NoError(t, c.addEntry(logEntry("req-2")))
+	require.NoError(t, stream.Send(decisionRecord("req-2")))
+
+	records := parseMerged(t, merged.String())
+	require.Len(t, records, 1)
+	assert.Equal(t, "req-2", records[0].RequestID)
+	assert.Empty(t, inner.String())
+}
+
+func TestCorrelator_CloudEvents(t *testing.T) {
+	merged := &syncBuffer{}
+	opts := accesslog.AccessLogOptions{CloudEvents: &accesslog.CloudEventsOptions{Type: "com.example.audit"}}
+	c := NewCorrelator(accesslog.NewNullFactory(), merged, opts, time.Minute)
+	stream, err := c.NewStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.NoError(t, stream.Send(decisionRecord("req-3")))
+	require.NoError(t, c.addEntry(logEntry("req-3")))
+
+	var ce struct {
+		ID   string       `json:"id"`
+		Type string       `json:"type"`
+		Data MergedRecord `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(merged.String()), &ce))
+	assert.Equal(t, "record-req-3", ce.ID)
+	assert.Equal(t, "com.example.audit", ce.Type)
+	assert.Equal(t, "req-3", ce.Data.RequestID)
+	assert.Equal(t, "GRANT", ce.Data.AccessRecord["decision"])
+}
+
+func TestCorrelator_Encoder(t *testing.T) {
+	encoder, err := accesslog.NewSIEMEncoder(accesslog.DefaultSIEMOptions(accesslog.FormatCEF))
+	require.NoError(t, err)
+
+	merged := &syncBuffer{}
+	c := NewCorrelator(accesslog.NewNullFactory(), merged, accesslog.AccessLogOptions{Encoder: encoder}, time.Minute)
+	stream, err := c.NewStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.NoError(t, stream.Send(decisionRecord("req-4")))
+	require.NoError(t, c.addEntry(logEntry("req-4")))
+	assert.Equal(t, "CEF:0|Manetu|PolicyEngine||GRANT|Access granted|3|externalId=record-req-4 act=api:test:read outcome=GRANT cs3=req-4 cs3Label=correlationId\n",
+		merged.String())
+}
+
+func TestCorrelator_NoCorrelationID(t *testing.T) {
+	_, stream, inner, merged := newTestCorrelator(t)
+
+	require.NoError(t, stream.Send(decisionRecord("")))
+
+	assert.Contains(t, inner.String(), "api:test:read")
+	assert.Empty(t, merged.String())
+}
+
+func TestCorrelator_Evict(t *testing.T) {
+	c, stream, inner, merged := newTestCorrelator(t)
+
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, stream.Send(decisionRecord("req-3")))
+	require.NoError(t, c.addEntry(logEntry("req-4")))
+
+	c.evict()
+	assert.Empty(t, inner.String())
+
+	now = now.Add(2 * time.Minute)
+	c.evict()
+
+	// the expired decision is emitted uncorrelated and the orphaned entry is dropped
+	assert.Contains(t, inner.String(), "record-req-3")
+	assert.Empty(t, c.entries)
+
+	require.NoError(t, c.addEntry(logEntry("req-3")))
+	assert.Empty(t, merged.String())
+}
+
+func TestCorrelator_CloseFlushesPending(t *testing.T) {
+	_, stream, inner, _ := newTestCorrelator(t)
+
+	require.NoError(t, stream.Send(decisionRecord("req-5")))
+	stream.Close()
+
+	assert.Contains(t, inner.String(), "record-req-5")
+}
+
+func TestEnvoyServer_AccessLogService(t *testing.T) {
+	merged := &syncBuffer{}
+	correlator := NewCorrelator(accesslog.NewNullFactory(), merged, accesslog.AccessLogOptions{}, time.Minute)
+
+	pe := setupTestPolicyEngineWithAccessLog(t, correlator)
+	port := findFreePort(t)
+
+	server, err := CreateServer(pe, port, "", WithAccessLogService(correlator))
+	require.NoError(t, err)
+
+	extAuthzServer := server.(*ExtAuthzServer)
+	actualPort := waitForServer(t, extAuthzServer, 5*time.Second)
+	defer func() { _ = server.Stop(context.Background()) }()
+
+	conn, err := grpc.NewClient(
+		fmt.Sprintf("localhost:%d", actualPort),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = authv3.NewAuthorizationClient(conn).Check(ctx, &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Id:     "envoy-req-1",
+					Host:   "localhost",
+					Path:   "/api/public",
+					Method: "GET",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	als, err := alsv3.NewAccessLogServiceClient(conn).StreamAccessLogs(ctx)
+	require.NoError(t, err)
+	require.NoError(t, als.Send(&alsv3.StreamAccessLogsMessage{
+		LogEntries: &alsv3.StreamAccessLogsMessage_HttpLogs{
+			HttpLogs: &alsv3.StreamAccessLogsMessage_HTTPAccessLogEntries{
+				LogEntry: []*accesslogv3.HTTPAccessLogEntry{logEntry("envoy-req-1")},
+			},
+		},
+	}))
+	_, err = als.CloseAndRecv()
+	require.NoError(t, err)
+
+	records := parseMerged(t, merged.String())
+	require.Len(t, records, 1)
+	assert.Equal(t, "envoy-req-1", records[0].RequestID)
+	metadata := records[0].AccessRecord["metadata"].(map[string]interface{})
+	assert.Equal(t, "envoy-req-1", metadata["correlationId"])
+	assert.Equal(t, map[string]interface{}{"id": "test-mapper"}, records[0].AccessRecord["mapper"])
+}
+
+func TestRequestID(t *testing.T) {
+	withID := &authv3.CheckRequest{Attributes: &authv3.AttributeContext{Request: &authv3.AttributeContext_Request{
+		Http: &authv3.AttributeContext_HttpRequest{Id: "from-id", Headers: map[string]string{requestIDHeader: "from-header"}},
+	}}}
+	assert.Equal(t, "from-id", requestID(withID))
+
+	withHeader := &authv3.CheckRequest{Attributes: &authv3.AttributeContext{Request: &authv3.AttributeContext_Request{
+		Http: &authv3.AttributeContext_HttpRequest{Headers: map[string]string{requestIDHeader: "from-header"}},
+	}}}
+	assert.Equal(t, "from-header", requestID(withHeader))
+
+	assert.Empty(t, requestID(&authv3.CheckRequest{}))
+}
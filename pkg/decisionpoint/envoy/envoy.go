@@ -5,22 +5,37 @@
 package envoy
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	_ "embed" // embed is imported for potential future use with embedded resources
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	alsv3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/manetu/policyengine/internal/logging"
 	"github.com/manetu/policyengine/pkg/core/backend"
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/options"
 	"github.com/manetu/policyengine/pkg/decisionpoint"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	"github.com/manetu/policyengine/pkg/core"
 )
@@ -34,6 +49,13 @@ const (
 	receivedHeader = "x-ext-authz-check-received"
 	resultAllowed  = "allowed"
 	resultDenied   = "denied"
+
+	requestIDHeader = "x-request-id"
+
+	// cacheTTLHeader advises how many seconds a GRANT may be reused, zero if it must not be, and
+	// revisionHeader identifies the bundle revision that made it (see model.CacheHint)
+	cacheTTLHeader = "x-ext-authz-cache-ttl"
+	revisionHeader = "x-ext-authz-bundle-revision"
 )
 
 func returnIfNotTooLong(body string) string {
@@ -51,6 +73,14 @@ type ExtAuthzServer struct {
 	pe         core.PolicyEngine
 	be         backend.Service
 	domain     string
+	als        *Correlator
+	tls        *tls.Config
+	listener   net.Listener
+	readiness  *decisionpoint.Readiness
+	limiter    *decisionpoint.Limiter
+
+	mapperOutput   string   // the mapper output evaluated as the PORC, if not model.DefaultMapperOutput
+	mapperMetadata []string // the mapper outputs added to the dynamic metadata of allowed checks
 
 	// For test only
 	grpcPort chan int
@@ -63,25 +93,71 @@ func logRequest(allow string, request *authv3.CheckRequest) {
 		request.GetAttributes())
 }
 
-func (s *ExtAuthzServer) allow(request *authv3.CheckRequest) *authv3.CheckResponse {
+// dynamicMetadata converts the obligations of a decision, along with any outputs of the mapper
+// selected by [WithMapperMetadata], into the dynamic metadata of a check response, which Envoy
+// makes available to later filters, such as the rate limit filter, under the
+// envoy.filters.http.ext_authz namespace. An obligation takes precedence over a mapper output
+// of the same name. Returns nil if there are neither.
+func dynamicMetadata(obligations model.Obligations, outputs map[string]interface{}) (*structpb.Struct, error) {
+	if len(obligations) == 0 && len(outputs) == 0 {
+		return nil, nil
+	}
+
+	fields := make(map[string]interface{}, len(obligations)+len(outputs))
+	maps.Copy(fields, outputs)
+	maps.Copy(fields, obligations)
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &structpb.Struct{}
+	if err := protojson.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// CheckHeaders returns the headers that the response to a check sets for a decision, other than
+// the echo of the request's attributes, such as for comparison with those expected by a test.
+func CheckHeaders(allow bool, cache model.CacheHint) map[string]string {
+	if !allow {
+		return map[string]string{resultHeader: resultDenied}
+	}
+
+	headers := map[string]string{
+		resultHeader:   resultAllowed,
+		cacheTTLHeader: strconv.FormatInt(int64(cache.TTL/time.Second), 10),
+	}
+	if cache.Revision != 0 {
+		headers[revisionHeader] = strconv.FormatUint(cache.Revision, 10)
+	}
+	return headers
+}
+
+// responseHeaders returns the headers of the response to request, in name order, adding the
+// echo of its attributes to headers
+func responseHeaders(request *authv3.CheckRequest, headers map[string]string) []*corev3.HeaderValueOption {
+	headers[receivedHeader] = returnIfNotTooLong(request.GetAttributes().String())
+
+	options := make([]*corev3.HeaderValueOption, 0, len(headers))
+	for _, key := range slices.Sorted(maps.Keys(headers)) {
+		options = append(options, &corev3.HeaderValueOption{
+			Header: &corev3.HeaderValue{Key: key, Value: headers[key]},
+		})
+	}
+	return options
+}
+
+func (s *ExtAuthzServer) allow(request *authv3.CheckRequest, metadata *structpb.Struct, cache model.CacheHint) *authv3.CheckResponse {
 	logRequest("allowed", request)
+
 	return &authv3.CheckResponse{
+		DynamicMetadata: metadata,
 		HttpResponse: &authv3.CheckResponse_OkResponse{
 			OkResponse: &authv3.OkHttpResponse{
-				Headers: []*corev3.HeaderValueOption{
-					{
-						Header: &corev3.HeaderValue{
-							Key:   resultHeader,
-							Value: resultAllowed,
-						},
-					},
-					{
-						Header: &corev3.HeaderValue{
-							Key:   receivedHeader,
-							Value: returnIfNotTooLong(request.GetAttributes().String()),
-						},
-					},
-				},
+				Headers: responseHeaders(request, CheckHeaders(true, cache)),
 			},
 		},
 		Status: &status.Status{Code: int32(codes.OK)},
@@ -93,39 +169,58 @@ func (s *ExtAuthzServer) deny(request *authv3.CheckRequest) *authv3.CheckRespons
 	return &authv3.CheckResponse{
 		HttpResponse: &authv3.CheckResponse_DeniedResponse{
 			DeniedResponse: &authv3.DeniedHttpResponse{
-				Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
-				Body:   "permission denied",
-				Headers: []*corev3.HeaderValueOption{
-					{
-						Header: &corev3.HeaderValue{
-							Key:   resultHeader,
-							Value: resultDenied,
-						},
-					},
-					{
-						Header: &corev3.HeaderValue{
-							Key:   receivedHeader,
-							Value: returnIfNotTooLong(request.GetAttributes().String()),
-						},
-					},
-				},
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Body:    "permission denied",
+				Headers: responseHeaders(request, CheckHeaders(false, model.CacheHint{})),
 			},
 		},
 		Status: &status.Status{Code: int32(codes.PermissionDenied)},
 	}
 }
 
-// Check implements gRPC v3 check request.
-func (s *ExtAuthzServer) Check(ctx context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
-	attrs := request.GetAttributes()
-
+// MapperInput returns the attributes of a check request as the input of the domain's mapper,
+// such as to generate the input of 'mpe test mapper' for a request.
+func MapperInput(attrs *authv3.AttributeContext) (map[string]interface{}, error) {
 	jattrs, err := json.Marshal(attrs)
 	if err != nil {
 		return nil, err
 	}
 
 	mattrs := make(map[string]interface{})
-	err = json.Unmarshal(jattrs, &mattrs)
+	if err := json.Unmarshal(jattrs, &mattrs); err != nil {
+		return nil, err
+	}
+	return mattrs, nil
+}
+
+// requestID returns the Envoy-assigned request-id, which is also reported in ALS entries.
+func requestID(request *authv3.CheckRequest) string {
+	httpAttrs := request.GetAttributes().GetRequest().GetHttp()
+	if id := httpAttrs.GetId(); id != "" {
+		return id
+	}
+
+	return httpAttrs.GetHeaders()[requestIDHeader]
+}
+
+// Check implements gRPC v3 check request.
+func (s *ExtAuthzServer) Check(ctx context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	release, err := s.limiter.Acquire(ctx)
+	if err != nil {
+		if s.limiter.Action() == decisionpoint.OverloadDeny {
+			return s.deny(request), nil
+		}
+		return nil, grpcstatus.Error(codes.Unavailable, err.Error())
+	}
+	defer release()
+
+	attrs := request.GetAttributes()
+
+	// Envoy lowercases the names of the headers it passes
+	headers := attrs.GetRequest().GetHttp().GetHeaders()
+	ctx = decisionpoint.WithRequestHeaders(ctx, func(name string) string { return headers[strings.ToLower(name)] })
+
+	mattrs, err := MapperInput(attrs)
 	if err != nil {
 		return nil, err
 	}
@@ -135,10 +230,11 @@ func (s *ExtAuthzServer) Check(ctx context.Context, request *authv3.CheckRequest
 		return nil, perr
 	}
 
-	result, perr := mapper.Evaluate(ctx, mattrs)
+	result, perr := mapper.EvaluateOutput(ctx, mattrs, cmp.Or(s.mapperOutput, model.DefaultMapperOutput))
 	if perr != nil {
-		logger.Fatalf(agent, "mapper.evaluate", "error evaluating policy: %v", perr)
-		return nil, perr
+		// requests the mapper cannot translate, such as malformed ones, are denied
+		logger.Errorf(agent, "check", "error evaluating mapper: %v", perr)
+		return s.deny(request), nil
 	}
 
 	porc, err := json.Marshal(result)
@@ -146,32 +242,69 @@ func (s *ExtAuthzServer) Check(ctx context.Context, request *authv3.CheckRequest
 		return nil, err
 	}
 
-	allow, _ := s.pe.Authorize(ctx, string(porc))
-	if allow {
-		return s.allow(request), nil
+	authzOpts := []options.AuthzOptionsFunc{options.SetMapper(mapper.Domain, mapper.ID)}
+	if id := requestID(request); id != "" {
+		authzOpts = append(authzOpts, options.SetCorrelationID(id))
+	}
+
+	decision, err := s.pe.Decide(ctx, string(porc), authzOpts...)
+	if err != nil || !decision.Allow {
+		return s.deny(request), nil
+	}
+
+	// enrichment data is only returned with allowed requests, so it is not evaluated for others
+	outputs, perr := mapper.EvaluateOutputs(ctx, mattrs, s.mapperMetadata...)
+	if perr != nil {
+		logger.Errorf(agent, "check", "unable to evaluate mapper metadata, denying request: %v", perr)
+		return s.deny(request), nil
+	}
+
+	metadata, err := dynamicMetadata(decision.Obligations, outputs)
+	if err != nil {
+		// the PEP cannot enforce obligations it does not receive
+		logger.Errorf(agent, "check", "unable to encode obligations, denying request: %v", err)
+		return s.deny(request), nil
 	}
 
-	return s.deny(request), nil
+	return s.allow(request, metadata, decision.Cache), nil
 }
 
 func (s *ExtAuthzServer) startGRPC(address string, wg *sync.WaitGroup) {
-	logger.Infof(agent, "start", "Starting Envoy External Authorization gRPC server on %s", address)
 	defer func() {
 		wg.Done()
 		logger.SysInfof("Stopped gRPC server")
 	}()
 
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		logger.Fatalf(agent, "net.listen", "Failed to start gRPC server: %v", err)
-		return
+	listener := s.listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			logger.Fatalf(agent, "net.listen", "Failed to start gRPC server: %v", err)
+			return
+		}
+	}
+	logger.Infof(agent, "start", "Starting Envoy External Authorization gRPC server on %s", listener.Addr())
+
+	var serverOpts []grpc.ServerOption
+	if s.tls != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(s.tls)))
 	}
 
-	s.grpcServer = grpc.NewServer()
+	s.grpcServer = grpc.NewServer(serverOpts...)
 	authv3.RegisterAuthorizationServer(s.grpcServer, s)
+	healthv1.RegisterHealthServer(s.grpcServer, &healthServer{readiness: s.readiness})
+	if s.als != nil {
+		alsv3.RegisterAccessLogServiceServer(s.grpcServer, s.als)
+		logger.Infof(agent, "start", "Envoy Access Log Service enabled")
+	}
 
 	// Store the port for test only. Must be after grpcServer is set to avoid race condition.
-	s.grpcPort <- listener.Addr().(*net.TCPAddr).Port
+	port := 0
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	s.grpcPort <- port
 
 	logger.SysInfof("Starting gRPC server at %s", listener.Addr())
 	if err := s.grpcServer.Serve(listener); err != nil {
@@ -187,9 +320,72 @@ func (s *ExtAuthzServer) run(grpcAddr string) {
 	wg.Wait()
 }
 
+// ServerOption is a functional option for configuring an [ExtAuthzServer].
+type ServerOption func(*ExtAuthzServer)
+
+// WithAccessLogService registers the [Correlator] as an Envoy Access Log Service on the
+// same gRPC server, allowing Envoy ALS entries to be merged with policy decisions.
+func WithAccessLogService(c *Correlator) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.als = c
+	}
+}
+
+// WithTLS serves the gRPC endpoints over TLS with the given configuration, such as one
+// created by [decisionpoint.NewTLSConfig].
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.tls = config
+	}
+}
+
+// WithListener serves the gRPC endpoints on an existing listener, such as a Unix domain socket
+// or a socket-activated listener from [decisionpoint.Listen], instead of the TCP port.
+func WithListener(listener net.Listener) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.listener = listener
+	}
+}
+
+// WithReadiness reports the readiness of the decision point through the gRPC health checking
+// protocol. Without it, the server reports serving as soon as it starts.
+func WithReadiness(readiness *decisionpoint.Readiness) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.readiness = readiness
+	}
+}
+
+// WithLimiter bounds the checks evaluated at once. Checks the limiter rejects fail with the
+// UNAVAILABLE status, which Envoy handles according to the failure_mode_allow setting of the
+// ext_authz filter, or are denied if its action is [decisionpoint.OverloadDeny].
+func WithLimiter(limiter *decisionpoint.Limiter) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.limiter = limiter
+	}
+}
+
+// WithMapperOutput evaluates the named output of the domain's mapper as the PORC of each
+// check, such as authz_input for data.mapper.authz_input, instead of
+// [model.DefaultMapperOutput].
+func WithMapperOutput(name string) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.mapperOutput = name
+	}
+}
+
+// WithMapperMetadata adds the named outputs of the domain's mapper, such as a rate_key for the
+// rate limit filter, to the dynamic metadata of allowed checks. Outputs that are undefined
+// for a request are omitted.
+func WithMapperMetadata(names ...string) ServerOption {
+	return func(s *ExtAuthzServer) {
+		s.mapperMetadata = names
+	}
+}
+
 // CreateServer creates and starts a new Envoy External Authorization server.
-// It returns a Server interface that implements the decisionpoint.Server interface.
-func CreateServer(pe core.PolicyEngine, port int, domain string) (decisionpoint.Server, error) {
+// It returns a Server interface that implements the decisionpoint.Server interface,
+// or an error if a mapper output selected by name is invalid.
+func CreateServer(pe core.PolicyEngine, port int, domain string, opts ...ServerOption) (decisionpoint.Server, error) {
 	s := &ExtAuthzServer{
 		grpcPort: make(chan int, 1),
 		pe:       pe,
@@ -197,6 +393,16 @@ func CreateServer(pe core.PolicyEngine, port int, domain string) (decisionpoint.
 		domain:   domain,
 	}
 
+	for _, o := range opts {
+		o(s)
+	}
+
+	for _, name := range append([]string{cmp.Or(s.mapperOutput, model.DefaultMapperOutput)}, s.mapperMetadata...) {
+		if err := model.ValidateMapperOutput(name); err != nil {
+			return nil, err
+		}
+	}
+
 	go s.run(fmt.Sprintf(":%d", port))
 
 	return s, nil
@@ -0,0 +1,36 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package envoy
+
+import (
+	"context"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/manetu/policyengine/pkg/decisionpoint"
+	"google.golang.org/grpc/codes"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthServer implements the gRPC health checking protocol, reporting the server as
+// serving once the decision point is ready. It answers for the server as a whole and for
+// the ext_authz service.
+type healthServer struct {
+	healthv1.UnimplementedHealthServer
+	readiness *decisionpoint.Readiness
+}
+
+func (h *healthServer) Check(_ context.Context, request *healthv1.HealthCheckRequest) (*healthv1.HealthCheckResponse, error) {
+	switch request.GetService() {
+	case "", authv3.Authorization_ServiceDesc.ServiceName:
+	default:
+		return nil, status.Errorf(codes.NotFound, "unknown service '%s'", request.GetService())
+	}
+
+	if ready, _ := h.readiness.Status(); !ready {
+		return &healthv1.HealthCheckResponse{Status: healthv1.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthv1.HealthCheckResponse{Status: healthv1.HealthCheckResponse_SERVING}, nil
+}
@@ -14,9 +14,27 @@ import (
 	strictecho "github.com/oapi-codegen/runtime/strictmiddleware/echo"
 )
 
+// Approval The approval request of an operation that requires approval. A request that is not allowed is pending on it until it is approved. Omitted for other operations.
+type Approval struct {
+	// Approvers Subjects who approved the request.
+	Approvers *[]string `json:"approvers,omitempty"`
+
+	// Id Identifies the approval request, presented as context.approval once approved.
+	Id *string `json:"id,omitempty"`
+
+	// Required Number of approvers the operation requires.
+	Required *int `json:"required,omitempty"`
+}
+
 // Decision defines model for decision.
 type Decision struct {
 	Allow *bool `json:"allow,omitempty"`
+
+	// Approval The approval request of an operation that requires approval. A request that is not allowed is pending on it until it is approved. Omitted for other operations.
+	Approval *Approval `json:"approval,omitempty"`
+
+	// Obligations Obligations attached to a GRANT by the granting policies, such as a quota to enforce. Omitted when there are none.
+	Obligations *map[string]interface{} `json:"obligations,omitempty"`
 }
 
 // DecisionJSONBody defines parameters for Decision.
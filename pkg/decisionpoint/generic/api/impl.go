@@ -32,8 +32,23 @@ func (s Server) Decision(ctx context.Context, request DecisionRequestObject) (De
 	}
 
 	probe := request.Params.Probe != nil && *request.Params.Probe
-	allow, _ := s.pe.Authorize(ctx, string(porc), options.SetProbeMode(probe))
-	return Decision200JSONResponse{
-		Allow: &allow,
-	}, nil
+	decision, err := s.pe.Decide(ctx, string(porc), options.SetProbeMode(probe))
+	if err != nil {
+		allow := false
+		return Decision200JSONResponse{Allow: &allow}, nil
+	}
+
+	response := Decision200JSONResponse{Allow: &decision.Allow}
+	if len(decision.Obligations) > 0 {
+		obligations := map[string]interface{}(decision.Obligations)
+		response.Obligations = &obligations
+	}
+	if r := decision.Approval; r != nil {
+		approvers := r.Approvers
+		if approvers == nil {
+			approvers = []string{}
+		}
+		response.Approval = &Approval{Id: &r.ID, Required: &r.Required, Approvers: &approvers}
+	}
+	return response, nil
 }
@@ -13,6 +13,7 @@
 //   - REST API for authorization requests
 //   - Swagger UI at /swagger-ui/
 //   - OpenAPI specification at /openapi.yaml
+//   - Liveness and readiness probes at /healthz and /readyz
 //
 // # Usage
 //
@@ -26,8 +27,10 @@ package generic
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/manetu/policyengine/pkg/core"
@@ -48,7 +51,47 @@ var schema embed.FS
 // Server wraps an Echo HTTP server configured with the authorization API,
 // Swagger UI, and OpenAPI schema endpoints.
 type Server struct {
-	echo *echo.Echo
+	echo      *echo.Echo
+	tls       *tls.Config
+	listener  net.Listener
+	readiness *decisionpoint.Readiness
+	limiter   *decisionpoint.Limiter
+}
+
+// ServerOption is a functional option for configuring a [Server].
+type ServerOption func(*Server)
+
+// WithTLS serves the API over TLS with the given configuration, such as one created by
+// [decisionpoint.NewTLSConfig].
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tls = config
+	}
+}
+
+// WithListener serves the API on an existing listener, such as a Unix domain socket or a
+// socket-activated listener from [decisionpoint.Listen], instead of the TCP port.
+func WithListener(listener net.Listener) ServerOption {
+	return func(s *Server) {
+		s.listener = listener
+	}
+}
+
+// WithReadiness reports the readiness of the decision point at /readyz. Without it, the
+// server reports ready as soon as it starts.
+func WithReadiness(readiness *decisionpoint.Readiness) ServerOption {
+	return func(s *Server) {
+		s.readiness = readiness
+	}
+}
+
+// WithLimiter bounds the decisions evaluated at once. Requests the limiter rejects are answered
+// with 503 Service Unavailable, or with a DENY decision if its action is
+// [decisionpoint.OverloadDeny].
+func WithLimiter(limiter *decisionpoint.Limiter) ServerOption {
+	return func(s *Server) {
+		s.limiter = limiter
+	}
 }
 
 // CreateServer creates and starts a generic decision point HTTP server.
@@ -58,32 +101,105 @@ type Server struct {
 //   - POST /decision: Authorization decision endpoint
 //   - GET /swagger-ui/*: Swagger UI for API exploration
 //   - GET /openapi.yaml: OpenAPI specification
+//   - GET /healthz: Liveness probe, which succeeds while the server is running
+//   - GET /readyz: Readiness probe, which fails with 503 Service Unavailable until the
+//     decision point is ready (see [WithReadiness])
+//
+// The decisions evaluated at once are unbounded unless configured with [WithLimiter].
+//
+// The server listens in plaintext unless configured with [WithTLS], and on the port unless
+// given a listener with [WithListener].
 //
 // Returns a [decisionpoint.Server] that can be used to stop the server.
 // Use [Server.Stop] to gracefully shut down when done.
-func CreateServer(pe core.PolicyEngine, port int) (decisionpoint.Server, error) {
+func CreateServer(pe core.PolicyEngine, port int, opts ...ServerOption) (decisionpoint.Server, error) {
+	s := &Server{}
+	for _, o := range opts {
+		o(s)
+	}
+
 	e := echo.New()
 	apiServer := api.NewServer(pe)
 
 	api.RegisterHandlers(e, api.NewStrictHandler(
 		apiServer,
-		// add middlewares here if needed
-		[]api.StrictMiddlewareFunc{},
+		[]api.StrictMiddlewareFunc{s.limit, s.headers},
 	))
 
 	e.GET("/swagger-ui/*", echo.WrapHandler(http.FileServer(http.FS(swaggerUI))))
 	e.GET("/openapi.yaml", echo.WrapHandler(http.FileServer(http.FS(schema))))
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]interface{}{"alive": true})
+	})
+	e.GET("/readyz", s.ready)
+
+	address := fmt.Sprintf(":%d", port)
+	if s.listener != nil {
+		if s.tls != nil {
+			e.TLSListener = tls.NewListener(s.listener, s.tls)
+		} else {
+			e.Listener = s.listener
+		}
+	}
 
 	// Start server in goroutine since e.Start() blocks
 	go func() {
-		if err := e.Start(fmt.Sprintf(":%d", port)); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.tls != nil {
+			e.TLSServer.Addr = address
+			e.TLSServer.TLSConfig = s.tls
+			err = e.StartServer(e.TLSServer)
+		} else {
+			err = e.Start(address)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal(err)
 		}
 	}()
 
-	return &Server{
-		echo: e,
-	}, nil
+	s.echo = e
+	return s, nil
+}
+
+// ready reports the readiness of the decision point, with the reason when it is not ready
+func (s *Server) ready(c echo.Context) error {
+	if ready, reason := s.readiness.Status(); !ready {
+		return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"ready": false, "reason": reason})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"ready": true})
+}
+
+// limit admits decision requests through the limiter, answering those it rejects according to its action
+func (s *Server) limit(f api.StrictHandlerFunc, operationID string) api.StrictHandlerFunc {
+	if s.limiter == nil || operationID != "Decision" {
+		return f
+	}
+	return func(c echo.Context, request interface{}) (interface{}, error) {
+		release, err := s.limiter.Acquire(c.Request().Context())
+		if err != nil {
+			if s.limiter.Action() == decisionpoint.OverloadDeny {
+				allow := false
+				return api.Decision200JSONResponse{Allow: &allow}, nil
+			}
+			c.Response().Header().Set("Retry-After", "1")
+			return nil, echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+		}
+		defer release()
+		return f(c, request)
+	}
+}
+
+// headers attaches the headers of decision requests to their context, for components routing
+// on them such as a [decisionpoint.Canary]
+func (s *Server) headers(f api.StrictHandlerFunc, operationID string) api.StrictHandlerFunc {
+	if operationID != "Decision" {
+		return f
+	}
+	return func(c echo.Context, request interface{}) (interface{}, error) {
+		r := c.Request()
+		c.SetRequest(r.WithContext(decisionpoint.WithRequestHeaders(r.Context(), r.Header.Get)))
+		return f(c, request)
+	}
 }
 
 // Stop gracefully shuts down the HTTP server.
@@ -7,10 +7,19 @@ package generic
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,6 +28,7 @@ import (
 	"github.com/manetu/policyengine/pkg/core/accesslog"
 	"github.com/manetu/policyengine/pkg/core/config"
 	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/types"
 	"github.com/manetu/policyengine/pkg/decisionpoint"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -128,6 +138,7 @@ func TestGenericServer_Decision_Allow(t *testing.T) {
 	allow, ok := result["allow"].(bool)
 	assert.True(t, ok, "Response should have 'allow' field")
 	assert.True(t, allow, "Decision should be allowed")
+	assert.NotContains(t, result, "obligations", "The mock policies return no obligations")
 
 	// Cleanup
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -434,3 +445,249 @@ func TestGenericServer_Decision_ProbeDeny(t *testing.T) {
 	err = server.Stop(ctx)
 	assert.NoError(t, err)
 }
+
+// selfSigned creates a certificate for localhost and a pool that trusts it
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestGenericServer_TLS(t *testing.T) {
+	pe := setupTestPolicyEngine(t)
+	port := findFreePort(t)
+	cert, pool := selfSigned(t)
+
+	server, err := CreateServer(pe, port, WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}))
+	require.NoError(t, err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, server.Stop(ctx))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+	var resp *http.Response
+	for i := 0; i < 20; i++ {
+		resp, err = client.Get(fmt.Sprintf("https://localhost:%d/openapi.yaml", port))
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// plaintext requests are not served
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/openapi.yaml", port))
+	if err == nil {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGenericServer_UnixSocket(t *testing.T) {
+	pe := setupTestPolicyEngine(t)
+
+	// keep the path short, as socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "mpe")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "mpe.sock")
+
+	listener, err := decisionpoint.Listen("unix://" + path)
+	require.NoError(t, err)
+
+	server, err := CreateServer(pe, 0, WithListener(listener))
+	require.NoError(t, err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, server.Stop(ctx))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://localhost/openapi.yaml")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestGenericServer_Probes(t *testing.T) {
+	pe := setupTestPolicyEngine(t)
+	port := findFreePort(t)
+	readiness := decisionpoint.NewReadiness("compiling bundles")
+
+	server, err := CreateServer(pe, port, WithReadiness(readiness))
+	require.NoError(t, err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, server.Stop(ctx))
+	}()
+
+	get := func(path string) (int, map[string]interface{}) {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 20; i++ {
+			resp, err = http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	code, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{"ready": false, "reason": "compiling bundles"}, body)
+
+	readiness.SetReady()
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"ready": true}, body)
+
+	readiness.SetNotReady("1 of 1 smoke test(s) failed")
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestGenericServer_Limiter(t *testing.T) {
+	pe := setupTestPolicyEngine(t)
+	porc := []byte(`{"principal": {"sub": "test-user", "mroles": ["mrn:iam:role:superadmin"]}, "operation": "idf:public:list", "resource": {}, "context": {}}`)
+
+	for _, action := range []decisionpoint.OverloadAction{decisionpoint.OverloadUnavailable, decisionpoint.OverloadDeny} {
+		t.Run(string(action), func(t *testing.T) {
+			limiter, err := decisionpoint.NewLimiter(decisionpoint.LimiterOptions{MaxConcurrent: 1, Action: action})
+			require.NoError(t, err)
+			port := findFreePort(t)
+			server, err := CreateServer(pe, port, WithLimiter(limiter))
+			require.NoError(t, err)
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				assert.NoError(t, server.Stop(ctx))
+			}()
+
+			decide := func() (int, map[string]interface{}) {
+				var resp *http.Response
+				for i := 0; i < 20; i++ {
+					resp, err = http.Post(fmt.Sprintf("http://localhost:%d/decision", port), "application/json", bytes.NewReader(porc))
+					if err == nil {
+						break
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+				require.NoError(t, err)
+				defer func() { _ = resp.Body.Close() }()
+
+				var body map[string]interface{}
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+				return resp.StatusCode, body
+			}
+
+			// saturate the only slot
+			release, err := limiter.Acquire(context.Background())
+			require.NoError(t, err)
+
+			code, body := decide()
+			if action == decisionpoint.OverloadDeny {
+				assert.Equal(t, http.StatusOK, code)
+				assert.Equal(t, false, body["allow"])
+			} else {
+				assert.Equal(t, http.StatusServiceUnavailable, code)
+			}
+
+			release()
+			code, body = decide()
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, true, body["allow"])
+			assert.Equal(t, uint64(1), limiter.Stats().Rejected)
+		})
+	}
+}
+
+// bundleEngine grants only the requests selecting the canary bundles by header
+type bundleEngine struct {
+	core.PolicyEngine
+	allow bool
+}
+
+func (e *bundleEngine) Decide(context.Context, types.AnyPORC, ...options.AuthzOptionsFunc) (*core.Decision, error) {
+	return &core.Decision{Allow: e.allow}, nil
+}
+
+func TestGenericServer_CanaryHeader(t *testing.T) {
+	canary, err := decisionpoint.NewCanary(&bundleEngine{}, &bundleEngine{allow: true}, decisionpoint.CanaryOptions{Header: "X-MPE-Bundle"})
+	require.NoError(t, err)
+
+	port := findFreePort(t)
+	server, err := CreateServer(canary, port)
+	require.NoError(t, err)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, server.Stop(ctx))
+	}()
+
+	decide := func(bundle string) bool {
+		var resp *http.Response
+		for i := 0; i < 20; i++ {
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/decision", port), bytes.NewReader([]byte(`{}`)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if bundle != "" {
+				req.Header.Set("X-MPE-Bundle", bundle)
+			}
+			resp, err = http.DefaultClient.Do(req)
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		require.NotNil(t, resp)
+		defer func() { _ = resp.Body.Close() }()
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body["allow"] == true
+	}
+	assert.True(t, decide("canary"))
+	assert.False(t, decide(""))
+}
@@ -0,0 +1,170 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const healthAgent string = "health"
+
+// DefaultHealthInterval is how often a [HealthMonitor] checks the backend by default.
+const DefaultHealthInterval = 10 * time.Second
+
+// DefaultHealthTimeout bounds a single check of a [HealthMonitor] by default.
+const DefaultHealthTimeout = 5 * time.Second
+
+// HealthCheck checks a dependency of the decision point, such as
+// [core.PolicyEngine.Health] checking its backend.
+type HealthCheck func(ctx context.Context) error
+
+// HealthOptions configures a [HealthMonitor].
+type HealthOptions struct {
+	// Interval is the time between checks (default [DefaultHealthInterval]).
+	Interval time.Duration
+
+	// Timeout bounds each check (default [DefaultHealthTimeout]).
+	Timeout time.Duration
+
+	// Readiness, if set, is marked degraded while the checks fail.
+	Readiness *Readiness
+}
+
+// HealthStats reports the checks of a [HealthMonitor].
+type HealthStats struct {
+	// Healthy reports whether the last check passed.
+	Healthy bool
+	// Checks counts the checks run.
+	Checks uint64
+	// Failures counts the checks that failed.
+	Failures uint64
+	// LastError describes the failure of the last check, if it failed.
+	LastError string
+}
+
+// HealthMonitor periodically checks a dependency of the decision point, such as a remote
+// policy store, logging when its status changes and marking the [Readiness] degraded while it
+// is unhealthy, so that load balancers route traffic to replicas whose backend is reachable.
+// A nil HealthMonitor is always healthy.
+type HealthMonitor struct {
+	check HealthCheck
+	opts  HealthOptions
+
+	mu        sync.RWMutex
+	healthy   bool
+	lastError string
+
+	checks   atomic.Uint64
+	failures atomic.Uint64
+}
+
+// NewHealthMonitor creates a HealthMonitor that is healthy until a check fails.
+//
+// Returns an error if the check is nil, or the interval or timeout is negative.
+func NewHealthMonitor(check HealthCheck, opts HealthOptions) (*HealthMonitor, error) {
+	if check == nil {
+		return nil, fmt.Errorf("health check must not be nil")
+	}
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("health check interval must not be negative, got %s", opts.Interval)
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("health check timeout must not be negative, got %s", opts.Timeout)
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultHealthInterval
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultHealthTimeout
+	}
+
+	return &HealthMonitor{check: check, opts: opts, healthy: true}, nil
+}
+
+// Check runs one check, updating the status of the HealthMonitor and its Readiness.
+//
+// Returns the error of the check, if it failed.
+func (m *HealthMonitor) Check(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.opts.Timeout)
+	defer cancel()
+	err := m.check(ctx)
+
+	m.checks.Add(1)
+	if err != nil {
+		m.failures.Add(1)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wasHealthy := m.healthy
+	m.healthy = err == nil
+	m.lastError = ""
+	if err != nil {
+		m.lastError = err.Error()
+	}
+
+	switch {
+	case wasHealthy && err != nil:
+		logger.Warnf(healthAgent, "check", "backend unhealthy: %v", err)
+	case !wasHealthy && err == nil:
+		logger.Info(healthAgent, "check", "backend healthy again")
+	}
+
+	if m.opts.Readiness != nil {
+		if err != nil {
+			m.opts.Readiness.SetDegraded(fmt.Sprintf("backend unhealthy: %v", err))
+		} else {
+			m.opts.Readiness.SetHealthy()
+		}
+	}
+
+	return err
+}
+
+// Run checks the dependency at once, then every interval, until the context is done.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+
+	_ = m.Check(ctx)
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = m.Check(ctx)
+		}
+	}
+}
+
+// Stats returns the status of the last check, and the checks run since the HealthMonitor was
+// created. A nil HealthMonitor reports healthy.
+func (m *HealthMonitor) Stats() HealthStats {
+	if m == nil {
+		return HealthStats{Healthy: true}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return HealthStats{
+		Healthy:   m.healthy,
+		Checks:    m.checks.Load(),
+		Failures:  m.failures.Load(),
+		LastError: m.lastError,
+	}
+}
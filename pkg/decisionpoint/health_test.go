@@ -0,0 +1,97 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHealthMonitor(t *testing.T) {
+	check := func(context.Context) error { return nil }
+
+	monitor, err := NewHealthMonitor(check, HealthOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultHealthInterval, monitor.opts.Interval)
+	assert.Equal(t, DefaultHealthTimeout, monitor.opts.Timeout)
+	assert.True(t, monitor.Stats().Healthy)
+
+	_, err = NewHealthMonitor(nil, HealthOptions{})
+	assert.Error(t, err)
+	_, err = NewHealthMonitor(check, HealthOptions{Interval: -time.Second})
+	assert.Error(t, err)
+	_, err = NewHealthMonitor(check, HealthOptions{Timeout: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestHealthMonitor_Check(t *testing.T) {
+	var down atomic.Bool
+	readiness := NewReadiness("compiling bundles")
+	readiness.SetReady()
+
+	monitor, err := NewHealthMonitor(func(context.Context) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, HealthOptions{Readiness: readiness})
+	require.NoError(t, err)
+
+	require.NoError(t, monitor.Check(context.Background()))
+	ready, _ := readiness.Status()
+	assert.True(t, ready)
+
+	down.Store(true)
+	require.Error(t, monitor.Check(context.Background()))
+	ready, reason := readiness.Status()
+	assert.False(t, ready)
+	assert.Equal(t, "backend unhealthy: connection refused", reason)
+	assert.Equal(t, HealthStats{Healthy: false, Checks: 2, Failures: 1, LastError: "connection refused"}, monitor.Stats())
+
+	down.Store(false)
+	require.NoError(t, monitor.Check(context.Background()))
+	ready, _ = readiness.Status()
+	assert.True(t, ready)
+	assert.Equal(t, HealthStats{Healthy: true, Checks: 3, Failures: 1}, monitor.Stats())
+}
+
+func TestHealthMonitor_Timeout(t *testing.T) {
+	monitor, err := NewHealthMonitor(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, HealthOptions{Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, monitor.Check(context.Background()), context.DeadlineExceeded)
+	assert.False(t, monitor.Stats().Healthy)
+}
+
+func TestHealthMonitor_Run(t *testing.T) {
+	monitor, err := NewHealthMonitor(func(context.Context) error { return nil }, HealthOptions{Interval: time.Millisecond})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		monitor.Run(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return monitor.Stats().Checks >= 3 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestHealthMonitor_Nil(t *testing.T) {
+	var monitor *HealthMonitor
+	assert.NoError(t, monitor.Check(context.Background()))
+	monitor.Run(context.Background())
+	assert.Equal(t, HealthStats{Healthy: true}, monitor.Stats())
+}
@@ -0,0 +1,172 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadAction selects how a decision point answers the requests that a [Limiter] rejects.
+type OverloadAction string
+
+const (
+	// OverloadUnavailable answers rejected requests with 503 Service Unavailable, or the gRPC
+	// UNAVAILABLE status, so that the enforcement point applies its own failure policy.
+	OverloadUnavailable OverloadAction = "unavailable"
+
+	// OverloadDeny answers rejected requests with a DENY decision, failing closed.
+	OverloadDeny OverloadAction = "deny"
+)
+
+// DefaultQueueTimeout is how long a request waits for a slot by default.
+const DefaultQueueTimeout = 100 * time.Millisecond
+
+// ErrOverloaded is returned by [Limiter.Acquire] when the decision point is saturated.
+var ErrOverloaded = errors.New("decision point overloaded")
+
+// LimiterOptions configures a [Limiter].
+type LimiterOptions struct {
+	// MaxConcurrent bounds the decisions evaluated at once.
+	MaxConcurrent int
+
+	// QueueSize bounds the requests waiting for a slot; beyond it, requests are rejected
+	// immediately. Zero rejects every request that finds all slots busy.
+	QueueSize int
+
+	// QueueTimeout bounds how long a request waits for a slot (default [DefaultQueueTimeout]).
+	QueueTimeout time.Duration
+
+	// Action selects the answer to rejected requests (default [OverloadUnavailable]).
+	Action OverloadAction
+}
+
+// LimiterStats reports the saturation of a [Limiter].
+type LimiterStats struct {
+	// Active is the number of decisions being evaluated.
+	Active int64
+	// Queued is the number of requests waiting for a slot.
+	Queued int64
+	// Admitted counts the requests that were given a slot.
+	Admitted uint64
+	// Rejected counts the requests turned away because the queue was full.
+	Rejected uint64
+	// TimedOut counts the requests turned away because no slot freed up in time.
+	TimedOut uint64
+	// MaxConcurrent and QueueSize are the configured limits.
+	MaxConcurrent int
+	QueueSize     int
+}
+
+// Limiter bounds the decisions a decision point evaluates at once, holding excess requests in
+// a bounded queue for a limited time, so that a traffic spike is answered promptly according to
+// the [OverloadAction] rather than by ever growing latency. A nil Limiter admits every request.
+type Limiter struct {
+	slots  chan struct{}
+	opts   LimiterOptions
+	queued atomic.Int64
+
+	admitted atomic.Uint64
+	rejected atomic.Uint64
+	timedOut atomic.Uint64
+}
+
+// NewLimiter creates a Limiter.
+//
+// Returns an error if MaxConcurrent is not positive, QueueSize is negative, or the action is unknown.
+func NewLimiter(opts LimiterOptions) (*Limiter, error) {
+	if opts.MaxConcurrent <= 0 {
+		return nil, fmt.Errorf("max concurrent decisions must be positive, got %d", opts.MaxConcurrent)
+	}
+	if opts.QueueSize < 0 {
+		return nil, fmt.Errorf("queue size must not be negative, got %d", opts.QueueSize)
+	}
+	if opts.QueueTimeout <= 0 {
+		opts.QueueTimeout = DefaultQueueTimeout
+	}
+	switch opts.Action {
+	case "":
+		opts.Action = OverloadUnavailable
+	case OverloadUnavailable, OverloadDeny:
+	default:
+		return nil, fmt.Errorf("unsupported overload action '%s', must be one of '%s' or '%s'", opts.Action, OverloadUnavailable, OverloadDeny)
+	}
+
+	return &Limiter{slots: make(chan struct{}, opts.MaxConcurrent), opts: opts}, nil
+}
+
+// Action returns how rejected requests are answered; [OverloadUnavailable] for a nil Limiter.
+func (l *Limiter) Action() OverloadAction {
+	if l == nil {
+		return OverloadUnavailable
+	}
+	return l.opts.Action
+}
+
+// Acquire waits for a slot to evaluate a decision, and returns the function that releases it.
+//
+// Returns [ErrOverloaded] if the queue is full or no slot frees up within the queue timeout, or
+// the error of the context if it is done first.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), nil
+	default:
+	}
+
+	if l.queued.Add(1) > int64(l.opts.QueueSize) {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return nil, ErrOverloaded
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.opts.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), nil
+	case <-timer.C:
+		l.timedOut.Add(1)
+		return nil, ErrOverloaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Limiter) admit() func() {
+	l.admitted.Add(1)
+	var once atomic.Bool
+	return func() {
+		if once.CompareAndSwap(false, true) {
+			<-l.slots
+		}
+	}
+}
+
+// Stats returns the current saturation of the Limiter, and the requests it handled since it was
+// created. A nil Limiter reports zero.
+func (l *Limiter) Stats() LimiterStats {
+	if l == nil {
+		return LimiterStats{}
+	}
+	return LimiterStats{
+		Active:        int64(len(l.slots)),
+		Queued:        l.queued.Load(),
+		Admitted:      l.admitted.Load(),
+		Rejected:      l.rejected.Load(),
+		TimedOut:      l.timedOut.Load(),
+		MaxConcurrent: l.opts.MaxConcurrent,
+		QueueSize:     l.opts.QueueSize,
+	}
+}
@@ -0,0 +1,89 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLimiter(t *testing.T) {
+	limiter, err := NewLimiter(LimiterOptions{MaxConcurrent: 4})
+	require.NoError(t, err)
+	assert.Equal(t, OverloadUnavailable, limiter.Action())
+	assert.Equal(t, DefaultQueueTimeout, limiter.opts.QueueTimeout)
+
+	for _, opts := range []LimiterOptions{
+		{},
+		{MaxConcurrent: 1, QueueSize: -1},
+		{MaxConcurrent: 1, Action: "allow"},
+	} {
+		_, err := NewLimiter(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	limiter, err := NewLimiter(LimiterOptions{MaxConcurrent: 1, QueueSize: 1, QueueTimeout: time.Second})
+	require.NoError(t, err)
+
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+
+	// a queued request is admitted once the slot is released
+	admitted := make(chan func())
+	go func() {
+		r, err := limiter.Acquire(context.Background())
+		assert.NoError(t, err)
+		admitted <- r
+	}()
+	require.Eventually(t, func() bool { return limiter.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	// the queue is full
+	_, err = limiter.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrOverloaded)
+
+	release()
+	release() // releasing twice frees a single slot
+	second := <-admitted
+
+	stats := limiter.Stats()
+	assert.Equal(t, LimiterStats{Active: 1, Admitted: 2, Rejected: 1, MaxConcurrent: 1, QueueSize: 1}, stats)
+
+	// a cancelled request leaves the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = limiter.Acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int64(0), limiter.Stats().Queued)
+	second()
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	limiter, err := NewLimiter(LimiterOptions{MaxConcurrent: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond, Action: OverloadDeny})
+	require.NoError(t, err)
+	assert.Equal(t, OverloadDeny, limiter.Action())
+
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+
+	_, err = limiter.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrOverloaded)
+	assert.Equal(t, uint64(1), limiter.Stats().TimedOut)
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var limiter *Limiter
+	release, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, LimiterStats{}, limiter.Stats())
+	assert.Equal(t, OverloadUnavailable, limiter.Action())
+}
@@ -0,0 +1,117 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+var listenFdsStart = 3
+
+// Listen creates a listener for a decision point server from an address in one of the forms:
+//
+//   - "tcp://HOST:PORT" or "HOST:PORT": a TCP socket, where HOST may be empty to listen on all interfaces
+//   - "unix:///PATH": a Unix domain socket. A stale socket left by a previous run is replaced,
+//     but one a running server still listens on is an error
+//   - "systemd:" or "systemd:NAME": a socket passed by systemd socket activation, either the
+//     first one or the one whose FileDescriptorName= is NAME
+//
+// Pass the listener to a server with its WithListener option.
+func Listen(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return listenUnix(strings.TrimPrefix(address, "unix://"))
+	case strings.HasPrefix(address, "systemd:"):
+		return activatedListener(strings.TrimPrefix(address, "systemd:"))
+	case strings.Contains(address, "://") && !strings.HasPrefix(address, "tcp://"):
+		return nil, fmt.Errorf("unsupported listen address '%s': must be tcp://, unix://, or systemd:", address)
+	}
+
+	listener, err := net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s': %w", address, err)
+	}
+	return listener, nil
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("unix listen address requires a path, e.g. unix:///var/run/mpe.sock")
+	}
+
+	// remove a socket left behind by a server that did not shut down cleanly, but never another kind of file
+	// nor a socket that a running server still accepts connections on
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("failed to listen on '%s': file exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to listen on '%s': address in use by a running server", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("failed to listen on '%s': unable to tell whether the socket is stale: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket '%s': %w", path, err)
+		}
+	}
+
+	// the socket file is removed again when the listener is closed
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s': %w", path, err)
+	}
+	return listener, nil
+}
+
+// activatedListener returns a socket passed by systemd, following the sd_listen_fds(3) protocol
+func activatedListener(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd socket activation (LISTEN_PID is not set for this process)")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("no sockets passed by systemd socket activation (LISTEN_FDS is not set)")
+	}
+
+	index := 0
+	if name != "" {
+		index = -1
+		for i, n := range strings.Split(os.Getenv("LISTEN_FDNAMES"), ":") {
+			if n == name && i < count {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("no socket named '%s' passed by systemd socket activation", name)
+		}
+	}
+
+	f := os.NewFile(uintptr(listenFdsStart+index), name)
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d passed by systemd socket activation", listenFdsStart+index)
+	}
+	defer func() { _ = f.Close() }()
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d passed by systemd socket activation is not a listening socket: %w",
+			listenFdsStart+index, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,87 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen_TCP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "tcp://127.0.0.1:0"} {
+		listener, err := Listen(address)
+		require.NoError(t, err)
+		assert.Equal(t, "tcp", listener.Addr().Network())
+		require.NoError(t, listener.Close())
+	}
+
+	_, err := Listen("http://127.0.0.1:0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported listen address")
+}
+
+func TestListen_Unix(t *testing.T) {
+	// keep the path short, as socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "mpe")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "mpe.sock")
+
+	listener, err := Listen("unix://" + path)
+	require.NoError(t, err)
+	assert.Equal(t, "unix", listener.Addr().Network())
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+	_ = conn.Close()
+
+	// the socket is removed on close
+	require.NoError(t, listener.Close())
+	assert.NoFileExists(t, path)
+
+	// a stale socket is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+	listener, err = Listen("unix://" + path)
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	// a socket still in use is not
+	live, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	_, err = Listen("unix://" + path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "address in use")
+	assert.FileExists(t, path)
+	require.NoError(t, live.Close())
+
+	// nor are other files
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0600))
+	_, err = Listen("unix://" + path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not a socket")
+
+	_, err = Listen("unix://")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a path")
+}
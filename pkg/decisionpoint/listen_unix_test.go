@@ -0,0 +1,90 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+//go:build unix
+
+package decisionpoint
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// activate passes listeners to the process the way systemd does, starting from their file descriptors
+func activate(t *testing.T, names string, listeners ...net.Listener) {
+	var files []*os.File
+	for _, l := range listeners {
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		files = append(files, f)
+	}
+
+	// the descriptors are owned by the code under test, which closes them, so pass raw duplicates
+	start := -1
+	for i, f := range files {
+		fd, err := syscall.Dup(int(f.Fd()))
+		require.NoError(t, err)
+		if i == 0 {
+			start = fd
+		} else if fd != start+i {
+			t.Skip("could not allocate consecutive file descriptors")
+		}
+	}
+	for _, f := range files {
+		require.NoError(t, f.Close())
+	}
+
+	original := listenFdsStart
+	listenFdsStart = start
+	t.Cleanup(func() { listenFdsStart = original })
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(listeners)))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestListen_Systemd(t *testing.T) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = first.Close() }()
+	second, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = second.Close() }()
+
+	activate(t, "http:grpc", first, second)
+
+	listener, err := Listen("systemd:grpc")
+	require.NoError(t, err)
+	assert.Equal(t, second.Addr().String(), listener.Addr().String())
+	require.NoError(t, listener.Close())
+
+	listener, err = Listen("systemd:")
+	require.NoError(t, err)
+	assert.Equal(t, first.Addr().String(), listener.Addr().String())
+	require.NoError(t, listener.Close())
+
+	_, err = Listen("systemd:admin")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no socket named 'admin'")
+}
+
+func TestListen_SystemdNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	_, err := Listen("systemd:")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "LISTEN_PID is not set for this process")
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	_, err = Listen("systemd:")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "LISTEN_FDS is not set")
+}
@@ -0,0 +1,122 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/manetu/policyengine/pkg/core/types"
+)
+
+// Readiness tracks whether a decision point is ready to receive traffic.
+//
+// A server given a Readiness reports it through its readiness endpoint, so that load
+// balancers and orchestrators such as Kubernetes hold traffic back from a decision point
+// that is still compiling its bundles, failed its smoke tests, or is degraded because its
+// backend is unhealthy. A nil Readiness is always ready.
+type Readiness struct {
+	mu       sync.RWMutex
+	ready    bool
+	reason   string
+	degraded string
+}
+
+// NewReadiness creates a Readiness that is not ready, for the given reason, until [Readiness.SetReady] is called.
+func NewReadiness(reason string) *Readiness {
+	return &Readiness{reason: reason}
+}
+
+// SetReady marks the decision point as ready.
+func (r *Readiness) SetReady() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = true
+	r.reason = ""
+}
+
+// SetNotReady marks the decision point as not ready, for the given reason.
+func (r *Readiness) SetNotReady(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = false
+	r.reason = reason
+}
+
+// SetDegraded marks the decision point as degraded, for the given reason, such as a failing
+// [HealthMonitor] check. A degraded decision point is not ready, even once [Readiness.SetReady]
+// is called, until [Readiness.SetHealthy] is called.
+func (r *Readiness) SetDegraded(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.degraded = reason
+}
+
+// SetHealthy clears the degraded state set by [Readiness.SetDegraded].
+func (r *Readiness) SetHealthy() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.degraded = ""
+}
+
+// Status returns whether the decision point is ready and, if not, why.
+func (r *Readiness) Status() (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.ready && r.degraded != "" {
+		return false, r.degraded
+	}
+	return r.ready, r.reason
+}
+
+// SmokeTest is a PORC that must evaluate to an expected decision before a decision point
+// reports ready.
+type SmokeTest struct {
+	Name  string
+	PORC  types.AnyPORC
+	Allow bool
+}
+
+// RunSmokeTests evaluates each test against the policy engine in probe mode, so that the
+// decisions are not written to the access log.
+//
+// Returns an error describing every test whose decision differs from the expected one, or
+// that fails to evaluate.
+func RunSmokeTests(ctx context.Context, pe core.PolicyEngine, tests []SmokeTest) error {
+	var failures []string
+	for i, test := range tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		allow, err := pe.Authorize(ctx, test.PORC, options.SetProbeMode(true))
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("'%s': %v", name, err))
+		case allow != test.Allow:
+			failures = append(failures, fmt.Sprintf("'%s': expected %s, got %s", name, decision(test.Allow), decision(allow)))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d smoke test(s) failed: %s", len(failures), len(tests), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func decision(allow bool) string {
+	if allow {
+		return "GRANT"
+	}
+	return "DENY"
+}
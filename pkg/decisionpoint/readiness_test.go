@@ -0,0 +1,90 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/manetu/policyengine/internal/core/test"
+	"github.com/manetu/policyengine/pkg/core"
+	"github.com/manetu/policyengine/pkg/core/accesslog"
+	"github.com/manetu/policyengine/pkg/core/config"
+	"github.com/manetu/policyengine/pkg/core/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	var none *Readiness
+	ready, _ := none.Status()
+	assert.True(t, ready, "a nil Readiness is always ready")
+
+	r := NewReadiness("compiling bundles")
+	ready, reason := r.Status()
+	assert.False(t, ready)
+	assert.Equal(t, "compiling bundles", reason)
+
+	r.SetReady()
+	ready, reason = r.Status()
+	assert.True(t, ready)
+	assert.Empty(t, reason)
+
+	r.SetNotReady("smoke tests failed")
+	ready, reason = r.Status()
+	assert.False(t, ready)
+	assert.Equal(t, "smoke tests failed", reason)
+
+	// a degraded decision point is not ready, even once ready
+	r.SetDegraded("backend unhealthy: connection refused")
+	ready, reason = r.Status()
+	assert.False(t, ready)
+	assert.Equal(t, "smoke tests failed", reason)
+
+	r.SetReady()
+	ready, reason = r.Status()
+	assert.False(t, ready)
+	assert.Equal(t, "backend unhealthy: connection refused", reason)
+
+	r.SetHealthy()
+	ready, reason = r.Status()
+	assert.True(t, ready)
+	assert.Empty(t, reason)
+}
+
+func TestRunSmokeTests(t *testing.T) {
+	require.NoError(t, test.SetupTestConfig())
+	config.ResetConfig()
+	config.VConfig.Set(config.MockEnabled, true)
+
+	pe, err := core.NewPolicyEngine(options.WithAccessLog(accesslog.NewNullFactory()))
+	require.NoError(t, err)
+
+	admin := map[string]interface{}{
+		"principal": map[string]interface{}{"sub": "admin", "mroles": []string{"mrn:iam:role:superadmin"}},
+		"operation": "idf:public:list",
+		"resource":  map[string]interface{}{},
+	}
+	user := `{"principal": {"sub": "user", "mroles": ["mrn:iam:role:user"]}, "operation": "platform:admin:create", "resource": {}}`
+
+	passing := []SmokeTest{
+		{Name: "admin can list", PORC: admin, Allow: true},
+		{Name: "user cannot create", PORC: user, Allow: false},
+	}
+	assert.NoError(t, RunSmokeTests(context.Background(), pe, passing))
+	assert.NoError(t, RunSmokeTests(context.Background(), pe, nil))
+
+	failing := []SmokeTest{
+		{Name: "admin can list", PORC: admin, Allow: true},
+		{Name: "user can create", PORC: user, Allow: true},
+		{PORC: `{"principal": `, Allow: true},
+	}
+	err = RunSmokeTests(context.Background(), pe, failing)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 3 smoke test(s) failed")
+	assert.Contains(t, err.Error(), "'user can create': expected GRANT, got DENY")
+	assert.Contains(t, err.Error(), "'#3'")
+	assert.NotContains(t, err.Error(), "admin can list")
+}
@@ -0,0 +1,367 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rolloutAgent string = "rollout"
+
+// DefaultRolloutInterval is how often a [Rollout] fetches its target when no interval is configured.
+const DefaultRolloutInterval = 10 * time.Second
+
+// rolloutTimeout limits each fetch of a rollout target
+const rolloutTimeout = 5 * time.Second
+
+// maxRolloutTarget is the number of bytes read from a rollout target
+const maxRolloutTarget = 64 << 10
+
+// RolloutTarget is the bundle revision that every replica of a decision point should serve,
+// published to all of them through a [RolloutSource], such as:
+//
+//	{"revision": "v43", "previous": "v42", "at": "2026-10-16T12:00:00Z"}
+type RolloutTarget struct {
+	// Revision names the bundles to serve, such as a release tag or commit.
+	Revision string `json:"revision"`
+
+	// At is when replicas switch to the revision, once staged. Replicas switch as soon as
+	// they have staged it if zero.
+	At time.Time `json:"at"`
+
+	// Previous is the revision served until At, such that a replica starting before then
+	// serves the same revision as the others.
+	Previous string `json:"previous,omitempty"`
+}
+
+// Serving returns the revision that replicas serve at a time.
+func (t RolloutTarget) Serving(now time.Time) string {
+	if t.Previous != "" && !t.due(now) {
+		return t.Previous
+	}
+	return t.Revision
+}
+
+func (t RolloutTarget) due(now time.Time) bool {
+	return t.At.IsZero() || !now.Before(t.At)
+}
+
+// RolloutSource fetches the [RolloutTarget] shared by the replicas of a decision point.
+type RolloutSource interface {
+	// Fetch returns the current target.
+	Fetch(ctx context.Context) (RolloutTarget, error)
+}
+
+// NewRolloutSource creates the [RolloutSource] of an address in one of the forms:
+//
+//   - "file:///PATH" or "/PATH": a JSON file, such as a key of a Kubernetes ConfigMap mounted
+//     as a volume, which the kubelet updates in place
+//   - "etcd://HOST:PORT/KEY" or "etcds://HOST:PORT/KEY": a JSON value of an etcd key, read
+//     through the JSON gateway of the etcd v3 API over http or https
+func NewRolloutSource(address string) (RolloutSource, error) {
+	switch {
+	case strings.HasPrefix(address, "file://"):
+		return fileRolloutSource(strings.TrimPrefix(address, "file://")), nil
+	case strings.HasPrefix(address, "/"):
+		return fileRolloutSource(address), nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "etcd" && u.Scheme != "etcds") || u.Host == "" || len(u.Path) <= 1 {
+		return nil, fmt.Errorf("unsupported rollout source '%s': must be file:///PATH or etcd://HOST:PORT/KEY", address)
+	}
+	scheme := "http"
+	if u.Scheme == "etcds" {
+		scheme = "https"
+	}
+	return &etcdRolloutSource{
+		endpoint: scheme + "://" + u.Host + "/v3/kv/range",
+		key:      u.Path,
+		client:   http.DefaultClient,
+	}, nil
+}
+
+// fileRolloutSource reads the target from a file
+type fileRolloutSource string
+
+func (s fileRolloutSource) Fetch(_ context.Context) (RolloutTarget, error) {
+	data, err := os.ReadFile(string(s))
+	if err != nil {
+		return RolloutTarget{}, err
+	}
+	return parseRolloutTarget(data)
+}
+
+// etcdRolloutSource reads the target from the value of an etcd key
+type etcdRolloutSource struct {
+	endpoint string
+	key      string
+	client   *http.Client
+}
+
+func (s *etcdRolloutSource) Fetch(ctx context.Context) (RolloutTarget, error) {
+	ctx, cancel := context.WithTimeout(ctx, rolloutTimeout)
+	defer cancel()
+
+	// the JSON gateway encodes keys and values in base64
+	body, err := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))})
+	if err != nil {
+		return RolloutTarget{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return RolloutTarget{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return RolloutTarget{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRolloutTarget))
+	if err != nil {
+		return RolloutTarget{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return RolloutTarget{}, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+
+	var result struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return RolloutTarget{}, fmt.Errorf("invalid etcd response: %w", err)
+	}
+	if len(result.Kvs) == 0 {
+		return RolloutTarget{}, fmt.Errorf("etcd key '%s' not found", s.key)
+	}
+	value, err := base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+	if err != nil {
+		return RolloutTarget{}, fmt.Errorf("invalid etcd value: %w", err)
+	}
+	return parseRolloutTarget(value)
+}
+
+func parseRolloutTarget(data []byte) (RolloutTarget, error) {
+	var target RolloutTarget
+	if err := json.Unmarshal(data, &target); err != nil {
+		return RolloutTarget{}, fmt.Errorf("invalid rollout target: %w", err)
+	}
+	if target.Revision == "" {
+		return RolloutTarget{}, fmt.Errorf("invalid rollout target: missing revision")
+	}
+	return target, nil
+}
+
+// RolloutStageFunc loads and compiles the bundles of a revision without serving them,
+// returning a function that switches to them.
+type RolloutStageFunc func(ctx context.Context, revision string) (apply func() error, err error)
+
+// RolloutOptions configures a [Rollout].
+type RolloutOptions struct {
+	// Source fetches the target shared by the replicas.
+	Source RolloutSource
+
+	// Stage prepares the bundles of a revision.
+	Stage RolloutStageFunc
+
+	// Revision is the revision served as the Rollout is created.
+	Revision string
+
+	// Interval is how often the target is fetched, [DefaultRolloutInterval] if zero.
+	Interval time.Duration
+}
+
+// RolloutStats reports the state of a [Rollout].
+type RolloutStats struct {
+	// Revision is the revision served.
+	Revision string `json:"revision"`
+	// Staged is the revision staged to be served next, if any.
+	Staged string `json:"staged,omitempty"`
+	// Target is the last target fetched.
+	Target RolloutTarget `json:"target"`
+	// Switched is when the revision served was last switched.
+	Switched time.Time `json:"switched"`
+	// Error describes the last failure to fetch the target or stage its revision, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Rollout keeps every replica of a decision point serving the same bundle revision, so that
+// a load balancer spreading requests across them never mixes decisions of two revisions
+// during a rollout.
+//
+// Each replica polls the shared [RolloutTarget]. A new revision is staged as soon as it is
+// published, compiling its bundles while the previous revision is still served, and
+// switched to at the time of the target. Publishing a time far enough ahead for every
+// replica to stage the revision switches all of them at once, up to their clock skew.
+// A replica that stages the revision late switches as soon as it has.
+//
+// Rollout is safe for concurrent use.
+type Rollout struct {
+	opts RolloutOptions
+	now  func() time.Time
+
+	// syncMu serializes syncs, so that a revision is staged once
+	syncMu sync.Mutex
+
+	mu       sync.Mutex
+	revision string
+	staged   string
+	apply    func() error
+	target   RolloutTarget
+	switched time.Time
+	err      error
+}
+
+// NewRollout creates a Rollout serving the given revision.
+//
+// Returns an error if the source or stage function is nil, or the interval is negative.
+func NewRollout(opts RolloutOptions) (*Rollout, error) {
+	if opts.Source == nil {
+		return nil, fmt.Errorf("rollout source must not be nil")
+	}
+	if opts.Stage == nil {
+		return nil, fmt.Errorf("rollout stage function must not be nil")
+	}
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("rollout interval must not be negative, got %s", opts.Interval)
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultRolloutInterval
+	}
+
+	return &Rollout{opts: opts, now: time.Now, revision: opts.Revision}, nil
+}
+
+// Sync fetches the target once, stages its revision if it is not served or staged yet, and
+// switches to it if it is due. On failure, the revision served is kept.
+func (r *Rollout) Sync(ctx context.Context) error {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	target, err := r.opts.Source.Fetch(ctx)
+	if err != nil {
+		return r.fail(fmt.Errorf("failed to fetch rollout target: %w", err))
+	}
+
+	r.mu.Lock()
+	r.target = target
+	revision, staged := r.revision, r.staged
+	if target.Revision == revision {
+		// any staged revision was abandoned
+		r.staged, r.apply, r.err = "", nil, nil
+	}
+	r.mu.Unlock()
+	if target.Revision == revision {
+		return nil
+	}
+
+	// the revision served is unaffected while the next is staged
+	if target.Revision != staged {
+		apply, err := r.opts.Stage(ctx, target.Revision)
+		if err != nil {
+			return r.fail(fmt.Errorf("failed to stage revision %s: %w", target.Revision, err))
+		}
+		logger.Infof(rolloutAgent, "stage", "staged revision %s", target.Revision)
+
+		r.mu.Lock()
+		r.staged, r.apply = target.Revision, apply
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = nil
+	if !target.due(r.now()) {
+		return nil
+	}
+	return r.switchLocked()
+}
+
+// switchLocked serves the staged revision
+func (r *Rollout) switchLocked() error {
+	if err := r.apply(); err != nil {
+		r.err = fmt.Errorf("failed to switch to revision %s: %w", r.staged, err)
+		return r.err
+	}
+
+	logger.Infof(rolloutAgent, "switch", "switched from revision %s to %s", r.revision, r.staged)
+	r.revision, r.staged, r.apply = r.staged, "", nil
+	r.switched = r.now()
+	return nil
+}
+
+func (r *Rollout) fail(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+	return err
+}
+
+// wait returns how long to wait before syncing again: the interval, or until the staged
+// revision is due if sooner
+func (r *Rollout) wait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wait := r.opts.Interval
+	if r.staged != "" && !r.target.At.IsZero() {
+		wait = min(wait, max(r.target.At.Sub(r.now()), 0))
+	}
+	return wait
+}
+
+// Run syncs every interval, and as a staged revision is due, until the context is done,
+// logging failures.
+func (r *Rollout) Run(ctx context.Context) {
+	timer := time.NewTimer(r.wait())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if err := r.Sync(ctx); err != nil && ctx.Err() == nil {
+				logger.Warnf(rolloutAgent, "sync", "%v", err)
+			}
+			timer.Reset(r.wait())
+		}
+	}
+}
+
+// Revision returns the revision served.
+func (r *Rollout) Revision() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revision
+}
+
+// Stats returns the state of the rollout.
+func (r *Rollout) Stats() RolloutStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := RolloutStats{Revision: r.revision, Staged: r.staged, Target: r.target, Switched: r.switched}
+	if r.err != nil {
+		stats.Error = r.err.Error()
+	}
+	return stats
+}
@@ -0,0 +1,205 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticSource is a RolloutSource returning a fixed target
+type staticSource struct {
+	target RolloutTarget
+	err    error
+}
+
+func (s *staticSource) Fetch(context.Context) (RolloutTarget, error) {
+	return s.target, s.err
+}
+
+func TestRolloutTarget_Serving(t *testing.T) {
+	at := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	target := RolloutTarget{Revision: "v43", Previous: "v42", At: at}
+	assert.Equal(t, "v42", target.Serving(at.Add(-time.Second)))
+	assert.Equal(t, "v43", target.Serving(at))
+
+	// without a previous revision, or a time, the revision is served at once
+	assert.Equal(t, "v43", RolloutTarget{Revision: "v43", At: at}.Serving(at.Add(-time.Second)))
+	assert.Equal(t, "v43", RolloutTarget{Revision: "v43", Previous: "v42"}.Serving(at))
+}
+
+func TestNewRolloutSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"revision": "v43", "at": "2026-10-16T12:00:00Z"}`), 0600))
+
+	for _, address := range []string{path, "file://" + path} {
+		source, err := NewRolloutSource(address)
+		require.NoError(t, err)
+		target, err := source.Fetch(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, RolloutTarget{Revision: "v43", At: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}, target)
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"at": "2026-10-16T12:00:00Z"}`), 0600))
+	source, err := NewRolloutSource(path)
+	require.NoError(t, err)
+	_, err = source.Fetch(context.Background())
+	assert.ErrorContains(t, err, "missing revision")
+
+	for _, address := range []string{"http://etcd:2379/mpe", "etcd://etcd:2379", "etcd:///mpe", "target.json"} {
+		_, err := NewRolloutSource(address)
+		assert.Error(t, err, address)
+	}
+}
+
+func TestEtcdRolloutSource(t *testing.T) {
+	var value string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/kv/range", r.URL.Path)
+		var request struct {
+			Key string `json:"key"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		key, _ := base64.StdEncoding.DecodeString(request.Key)
+		assert.Equal(t, "/mpe/rollout", string(key))
+
+		if value == "" {
+			_, _ = w.Write([]byte(`{"header": {}}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"kvs": []map[string]string{{"key": request.Key, "value": base64.StdEncoding.EncodeToString([]byte(value))}},
+		})
+	}))
+	defer server.Close()
+
+	source, err := NewRolloutSource("etcd://" + strings.TrimPrefix(server.URL, "http://") + "/mpe/rollout")
+	require.NoError(t, err)
+
+	_, err = source.Fetch(context.Background())
+	assert.ErrorContains(t, err, "not found")
+
+	value = `{"revision": "v43", "previous": "v42"}`
+	target, err := source.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, RolloutTarget{Revision: "v43", Previous: "v42"}, target)
+}
+
+// stager records the revisions staged and switched to
+type stager struct {
+	staged   []string
+	switched []string
+	err      error
+}
+
+func (s *stager) stage(_ context.Context, revision string) (func() error, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.staged = append(s.staged, revision)
+	return func() error {
+		s.switched = append(s.switched, revision)
+		return nil
+	}, nil
+}
+
+func TestRollout(t *testing.T) {
+	source := &staticSource{target: RolloutTarget{Revision: "v42"}}
+	stages := &stager{}
+	rollout, err := NewRollout(RolloutOptions{Source: source, Stage: stages.stage, Revision: "v42"})
+	require.NoError(t, err)
+	now := time.Date(2026, 10, 16, 11, 59, 55, 0, time.UTC)
+	rollout.now = func() time.Time { return now }
+
+	// the revision served is the target
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Empty(t, stages.staged)
+
+	// a revision is staged as soon as it is published, but served only once due
+	at := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	source.target = RolloutTarget{Revision: "v43", Previous: "v42", At: at}
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Equal(t, []string{"v43"}, stages.staged)
+	assert.Empty(t, stages.switched)
+	assert.Equal(t, "v42", rollout.Revision())
+	assert.Equal(t, "v43", rollout.Stats().Staged)
+	assert.Equal(t, 5*time.Second, rollout.wait(), "the rollout syncs again as the revision is due")
+
+	// it is staged once
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Equal(t, []string{"v43"}, stages.staged)
+
+	now = at
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Equal(t, []string{"v43"}, stages.switched)
+	assert.Equal(t, "v43", rollout.Revision())
+	stats := rollout.Stats()
+	assert.Empty(t, stats.Staged)
+	assert.Equal(t, at, stats.Switched)
+	assert.Equal(t, DefaultRolloutInterval, rollout.wait())
+
+	// a revision without a time is served as soon as it is staged
+	source.target = RolloutTarget{Revision: "v44"}
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Equal(t, "v44", rollout.Revision())
+}
+
+func TestRollout_Abandoned(t *testing.T) {
+	source := &staticSource{target: RolloutTarget{Revision: "v43", At: time.Now().Add(time.Hour)}}
+	stages := &stager{}
+	rollout, err := NewRollout(RolloutOptions{Source: source, Stage: stages.stage, Revision: "v42"})
+	require.NoError(t, err)
+
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Equal(t, "v43", rollout.Stats().Staged)
+
+	// publishing the revision served again abandons the staged revision
+	source.target = RolloutTarget{Revision: "v42"}
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Empty(t, rollout.Stats().Staged)
+	assert.Empty(t, stages.switched)
+	assert.Equal(t, "v42", rollout.Revision())
+}
+
+func TestRollout_Errors(t *testing.T) {
+	source := &staticSource{err: errors.New("connection refused")}
+	stages := &stager{}
+	rollout, err := NewRollout(RolloutOptions{Source: source, Stage: stages.stage, Revision: "v42"})
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, rollout.Sync(context.Background()), "connection refused")
+	assert.Contains(t, rollout.Stats().Error, "failed to fetch rollout target")
+
+	// the revision served is kept when the next fails to stage
+	source.target, source.err = RolloutTarget{Revision: "v43"}, nil
+	stages.err = errors.New("domain alpha: invalid")
+	assert.ErrorContains(t, rollout.Sync(context.Background()), "failed to stage revision v43")
+	assert.Equal(t, "v42", rollout.Revision())
+
+	stages.err = nil
+	require.NoError(t, rollout.Sync(context.Background()))
+	assert.Equal(t, "v43", rollout.Revision())
+	assert.Empty(t, rollout.Stats().Error)
+
+	_, err = NewRollout(RolloutOptions{Stage: stages.stage})
+	assert.Error(t, err)
+	_, err = NewRollout(RolloutOptions{Source: source})
+	assert.Error(t, err)
+	_, err = NewRollout(RolloutOptions{Source: source, Stage: stages.stage, Interval: -time.Second})
+	assert.Error(t, err)
+}
@@ -0,0 +1,231 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/manetu/policyengine/internal/logging"
+)
+
+var logger = logging.GetLogger("policyengine.decisionpoint")
+
+const agent string = "tls"
+
+// DefaultReloadInterval is how often the certificate files of a [NewTLSConfig] configuration
+// are checked for changes.
+const DefaultReloadInterval = 10 * time.Second
+
+// TLSOptions configures a decision point server to serve over TLS.
+//
+// Fields:
+//   - CertFile: PEM file holding the server certificate, followed by any intermediates
+//   - KeyFile: PEM file holding the server's private key
+//   - ClientCAFile: PEM bundle of the CAs that sign client certificates. When set, clients
+//     must present a certificate signed by one of them (mutual TLS)
+//   - ClientSANs: When set, a client certificate must also carry one of these subject
+//     alternative names: a DNS name, email address, IP address, or URI such as a SPIFFE ID.
+//     Requires ClientCAFile
+//   - ReloadInterval: How often the files are checked for changes (default: [DefaultReloadInterval])
+type TLSOptions struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ClientSANs     []string
+	ReloadInterval time.Duration
+}
+
+// NewTLSConfig creates a server TLS configuration from certificate files.
+//
+// The files are reloaded when they change on disk, so that certificates rotated by tools
+// such as cert-manager take effect for new connections without restarting the server. If a
+// changed file cannot be loaded, for example because it is only partly written, the previous
+// certificates remain in use until the next check.
+//
+// Returns an error if the options are inconsistent or the files cannot be loaded.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key file")
+	}
+	if len(opts.ClientSANs) > 0 && opts.ClientCAFile == "" {
+		return nil, fmt.Errorf("a client SAN allowlist requires a client CA file")
+	}
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = DefaultReloadInterval
+	}
+
+	r := &certReloader{
+		opts: opts,
+		sans: make(map[string]bool, len(opts.ClientSANs)),
+		now:  time.Now,
+	}
+	for _, san := range opts.ClientSANs {
+		r.sans[san] = true
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked = r.now()
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if opts.ClientCAFile != "" {
+		// the chain is verified against the current CA bundle, so that it can be rotated too
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = r.verifyClient
+	}
+
+	return config, nil
+}
+
+// certReloader holds the certificates loaded from the files of a TLSOptions
+type certReloader struct {
+	opts TLSOptions
+	sans map[string]bool
+	now  func() time.Time
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the files, replacing the current certificates only if all of them are valid
+func (r *certReloader) load() error {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS file: %w", err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.opts.ClientCAFile != "" {
+		data, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in client CA file '%s'", r.opts.ClientCAFile)
+		}
+	}
+
+	r.cert = &cert
+	r.clientCA = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether any file was modified since it was loaded
+func (r *certReloader) changed() bool {
+	for i, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the certificates, reloading them if the files changed
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := r.now(); now.Sub(r.checked) >= r.opts.ReloadInterval {
+		r.checked = now
+		if r.changed() {
+			if err := r.load(); err != nil {
+				logger.Warnf(agent, "reload", "keeping previous TLS certificates: %v", err)
+			} else {
+				logger.Infof(agent, "reload", "reloaded TLS certificates from %s", r.opts.CertFile)
+			}
+		}
+	}
+
+	return r.cert, r.clientCA
+}
+
+// verifyClient verifies the client's certificate chain against the client CAs, and its
+// subject alternative names against the allowlist
+func (r *certReloader) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("client certificate required")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	_, pool := r.current()
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("client certificate not trusted: %w", err)
+	}
+
+	if len(r.sans) == 0 || r.allowed(leaf) {
+		return nil
+	}
+	return fmt.Errorf("client certificate '%s' has no allowed subject alternative name", leaf.Subject)
+}
+
+func (r *certReloader) allowed(cert *x509.Certificate) bool {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, name := range names {
+		if r.sans[name] {
+			return true
+		}
+	}
+	return false
+}
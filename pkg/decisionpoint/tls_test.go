@@ -0,0 +1,263 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package decisionpoint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var serial int64
+
+// issue creates a certificate signed by parent, or a self-signed CA when parent is nil
+func issue(t *testing.T, parent *testCert, name string, usage x509.ExtKeyUsage, sans ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, san := range sans {
+		if u, err := url.Parse(san); err == nil && u.Scheme != "" {
+			template.URIs = append(template.URIs, u)
+		} else if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// touch moves the modification time of the files forward, since rewrites within the
+// file system's timestamp resolution would otherwise go unnoticed
+func touch(t *testing.T, files ...string) {
+	later := time.Now().Add(time.Minute)
+	for _, f := range files {
+		require.NoError(t, os.Chtimes(f, later, later))
+	}
+}
+
+type tlsFiles struct {
+	cert, key, ca string
+}
+
+func setup(t *testing.T) (*testCert, *testCert, tlsFiles) {
+	dir := t.TempDir()
+	files := tlsFiles{
+		cert: filepath.Join(dir, "tls.crt"),
+		key:  filepath.Join(dir, "tls.key"),
+		ca:   filepath.Join(dir, "ca.crt"),
+	}
+
+	ca := issue(t, nil, "ca", x509.ExtKeyUsageAny)
+	ca.write(t, files.ca, "")
+	server := issue(t, ca, "pdp", x509.ExtKeyUsageServerAuth, "pdp.example.com")
+	server.write(t, files.cert, files.key)
+	return ca, server, files
+}
+
+// handshake connects a client to a server using the configuration and returns the server's error
+func handshake(t *testing.T, serverConfig *tls.Config, client *tls.Certificate, roots *x509.CertPool) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "pdp.example.com", MinVersion: tls.VersionTLS12}
+	if client != nil {
+		clientConfig.Certificates = []tls.Certificate{*client}
+	}
+
+	go func() {
+		c, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		// complete the exchange so that the server sees the client's certificate
+		_, _ = c.Write([]byte("x"))
+		_, _ = io.Copy(io.Discard, c)
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	s := tls.Server(conn, serverConfig)
+	require.NoError(t, s.SetDeadline(time.Now().Add(5*time.Second)))
+	if err := s.Handshake(); err != nil {
+		return err
+	}
+	_, err = s.Read(make([]byte, 1))
+	return err
+}
+
+func TestNewTLSConfig_Options(t *testing.T) {
+	_, _, files := setup(t)
+
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		message string
+	}{
+		{"missing key", TLSOptions{CertFile: files.cert}, "requires both a certificate and a key file"},
+		{"SANs without CA", TLSOptions{CertFile: files.cert, KeyFile: files.key, ClientSANs: []string{"a"}}, "requires a client CA file"},
+		{"missing file", TLSOptions{CertFile: files.cert + ".missing", KeyFile: files.key}, "failed to read TLS file"},
+		{"key mismatch", TLSOptions{CertFile: files.ca, KeyFile: files.key}, "failed to load TLS certificate"},
+		{"CA without certificates", TLSOptions{CertFile: files.cert, KeyFile: files.key, ClientCAFile: files.key}, "no certificates found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTLSConfig(tt.opts)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.message)
+		})
+	}
+}
+
+func TestNewTLSConfig_ServerOnly(t *testing.T) {
+	ca, _, files := setup(t)
+	config, err := NewTLSConfig(TLSOptions{CertFile: files.cert, KeyFile: files.key})
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	assert.NoError(t, handshake(t, config, nil, roots))
+}
+
+func TestNewTLSConfig_ClientCertificates(t *testing.T) {
+	ca, _, files := setup(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config, err := NewTLSConfig(TLSOptions{
+		CertFile:     files.cert,
+		KeyFile:      files.key,
+		ClientCAFile: files.ca,
+		ClientSANs:   []string{"spiffe://cluster.local/ns/apps/sa/gateway", "10.0.0.1"},
+	})
+	require.NoError(t, err)
+
+	gateway := issue(t, ca, "gateway", x509.ExtKeyUsageClientAuth, "spiffe://cluster.local/ns/apps/sa/gateway").tlsCertificate()
+	byIP := issue(t, ca, "sidecar", x509.ExtKeyUsageClientAuth, "10.0.0.1").tlsCertificate()
+	other := issue(t, ca, "other", x509.ExtKeyUsageClientAuth, "spiffe://cluster.local/ns/apps/sa/other").tlsCertificate()
+	serverUsage := issue(t, ca, "server", x509.ExtKeyUsageServerAuth, "spiffe://cluster.local/ns/apps/sa/gateway").tlsCertificate()
+	untrusted := issue(t, issue(t, nil, "rogue-ca", x509.ExtKeyUsageAny), "gateway", x509.ExtKeyUsageClientAuth,
+		"spiffe://cluster.local/ns/apps/sa/gateway").tlsCertificate()
+
+	assert.NoError(t, handshake(t, config, &gateway, roots))
+	assert.NoError(t, handshake(t, config, &byIP, roots))
+
+	err = handshake(t, config, &other, roots)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no allowed subject alternative name")
+
+	err = handshake(t, config, &untrusted, roots)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "client certificate not trusted")
+
+	err = handshake(t, config, &serverUsage, roots)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "client certificate not trusted")
+
+	assert.Error(t, handshake(t, config, nil, roots))
+}
+
+func TestNewTLSConfig_Reload(t *testing.T) {
+	ca, server, files := setup(t)
+
+	config, err := NewTLSConfig(TLSOptions{CertFile: files.cert, KeyFile: files.key, ClientCAFile: files.ca, ReloadInterval: time.Millisecond})
+	require.NoError(t, err)
+
+	current := func() []byte {
+		cert, err := config.GetCertificate(nil)
+		require.NoError(t, err)
+		return cert.Certificate[0]
+	}
+	assert.Equal(t, server.der, current())
+
+	// a partly written rotation keeps the previous certificate
+	require.NoError(t, os.WriteFile(files.cert, []byte("-----BEGIN CERTIFICATE-----\n"), 0600))
+	touch(t, files.cert)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, server.der, current())
+
+	// a complete rotation takes effect
+	rotated := issue(t, ca, "pdp", x509.ExtKeyUsageServerAuth, "pdp.example.com")
+	rotated.write(t, files.cert, files.key)
+	touch(t, files.cert, files.key)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, rotated.der, current())
+
+	// so does a new client CA
+	newCA := issue(t, nil, "new-ca", x509.ExtKeyUsageAny)
+	newCA.write(t, files.ca, "")
+	touch(t, files.ca)
+	time.Sleep(5 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := issue(t, newCA, "gateway", x509.ExtKeyUsageClientAuth, "gateway").tlsCertificate()
+	assert.NoError(t, handshake(t, config, &client, roots))
+
+	oldClient := issue(t, ca, "gateway", x509.ExtKeyUsageClientAuth, "gateway").tlsCertificate()
+	assert.Error(t, handshake(t, config, &oldClient, roots))
+}
@@ -0,0 +1,168 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package policydomain
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Attributes of a resource that a [Condition] may compare
+const (
+	ConditionClassification = "classification"
+	ConditionOwner          = "owner"
+	ConditionAnnotations    = "annotations."
+)
+
+// conditionOperators are the operators of a [Condition], two-character operators first so
+// that they are found before their prefixes
+var conditionOperators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+// Condition compares an attribute of a resource with a value, such as
+// "classification >= HIGH" or "annotations.department == finance". A conditional
+// [Resource] assigns resources to its group when all of its conditions hold.
+//
+// The attribute is classification, owner, or annotations.<name>. Classifications are
+// ordered by the levels of the domain's [Classifications], annotations by their numeric
+// values, and owners only compare for equality. The value is decoded as JSON if it can
+// be, and is a string otherwise.
+type Condition struct {
+	Attribute string      // Compared attribute of the resource
+	Operator  string      // One of ==, !=, <, <=, >, >=
+	Value     interface{} // Value the attribute is compared with
+	Source    string      // The condition as written
+}
+
+// ParseCondition parses a condition written "<attribute> <operator> <value>".
+func ParseCondition(s string) (Condition, error) {
+	c := Condition{Source: strings.TrimSpace(s)}
+
+	at, op := -1, ""
+	for i := 0; i < len(s) && at < 0; i++ {
+		for _, o := range conditionOperators {
+			if strings.HasPrefix(s[i:], o) {
+				at, op = i, o
+				break
+			}
+		}
+	}
+	if at < 0 {
+		return c, fmt.Errorf("invalid condition '%s': expected <attribute> <operator> <value> with one of %s", c.Source, strings.Join(conditionOperators, ", "))
+	}
+
+	c.Attribute, c.Operator = strings.TrimSpace(s[:at]), op
+	raw := strings.TrimSpace(s[at+len(op):])
+	if raw == "" {
+		return c, fmt.Errorf("invalid condition '%s': missing value", c.Source)
+	}
+	if err := json.Unmarshal([]byte(raw), &c.Value); err != nil {
+		c.Value = raw
+	}
+
+	ordered := op != "==" && op != "!="
+	switch {
+	case c.Attribute == ConditionClassification:
+		if _, ok := c.Value.(string); !ok {
+			return c, fmt.Errorf("invalid condition '%s': classification is compared with a level", c.Source)
+		}
+	case c.Attribute == ConditionOwner:
+		if ordered {
+			return c, fmt.Errorf("invalid condition '%s': owner only compares with == and !=", c.Source)
+		}
+	case strings.HasPrefix(c.Attribute, ConditionAnnotations) && len(c.Attribute) > len(ConditionAnnotations):
+		if _, ok := number(c.Value); ordered && !ok {
+			return c, fmt.Errorf("invalid condition '%s': annotations are ordered by numbers", c.Source)
+		}
+	default:
+		return c, fmt.Errorf("invalid condition '%s': unknown attribute '%s', expected classification, owner, or annotations.<name>", c.Source, c.Attribute)
+	}
+
+	return c, nil
+}
+
+// String returns the condition as written.
+func (c Condition) String() string {
+	return c.Source
+}
+
+// Level returns the classification level the condition compares with, or "" if it does not
+// compare the classification.
+func (c Condition) Level() string {
+	if c.Attribute != ConditionClassification {
+		return ""
+	}
+	level, _ := c.Value.(string)
+	return level
+}
+
+// Holds reports whether the condition holds for the value of its attribute, nil if the
+// resource lacks it. Classifications are ordered by levels, lowest first; an ordered
+// comparison with an unknown level never holds.
+func (c Condition) Holds(value interface{}, levels []string) bool {
+	switch c.Operator {
+	case "==":
+		return equal(value, c.Value)
+	case "!=":
+		return !equal(value, c.Value)
+	}
+
+	var a, b float64
+	if c.Attribute == ConditionClassification {
+		level, _ := value.(string)
+		x, y := slices.Index(levels, level), slices.Index(levels, c.Level())
+		if x < 0 || y < 0 {
+			return false
+		}
+		a, b = float64(x), float64(y)
+	} else {
+		var ok bool
+		if a, ok = number(value); !ok {
+			return false
+		}
+		b, _ = number(c.Value)
+	}
+
+	switch c.Operator {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+// equal compares two values, numbers by their value whatever their type
+func equal(a, b interface{}) bool {
+	x, ok := number(a)
+	y, ok2 := number(b)
+	if ok && ok2 {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number returns the value of a number of any type
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,591 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package diff computes the semantic differences between two versions of a set of
+// policy domains.
+//
+// Unlike a textual diff, the comparison is made between parsed [policydomain.IntermediateModel]
+// instances, so formatting, key order, and the order of map-like sections such as policies
+// or roles do not produce changes. Entities are matched by their MRN (or by name for
+// operations, mappers, resources, and bypass rules), and each change lists the fields that differ.
+// Changes to embedded Rego include a unified diff of the source.
+//
+// # Usage
+//
+//	changes := diff.Compare(oldDomains, newDomains)
+//	for _, c := range changes {
+//	    fmt.Printf("%s %s '%s'\n", c.Type, c.Kind, c.ID)
+//	}
+//
+// [Assess] classifies each change by its blast radius, the operations and roles whose
+// decisions it may affect:
+//
+//	for _, i := range diff.Assess(changes, oldDomains, newDomains) {
+//	    fmt.Printf("%s %s '%s': %s\n", i.Type, i.Kind, i.ID, i.Radius)
+//	}
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// ChangeType classifies a change to an entity.
+type ChangeType string
+
+// Change types
+const (
+	Added    ChangeType = "added"
+	Removed  ChangeType = "removed"
+	Modified ChangeType = "modified"
+)
+
+// Entity kinds, as named in the PolicyDomain YAML.
+const (
+	KindDomain             = "domain"
+	KindAnnotationDefaults = "annotation-defaults"
+	KindDefaults           = "defaults"
+	KindData               = "data"
+	KindFetch              = "fetch"
+	KindClassifications    = "classifications"
+	KindPolicyLibrary      = "policy-library"
+	KindPolicy             = "policy"
+	KindRole               = "role"
+	KindGroup              = "group"
+	KindResourceGroup      = "resource-group"
+	KindScope              = "scope"
+	KindOperation          = "operation"
+	KindMapper             = "mapper"
+	KindResource           = "resource"
+	KindBypassRule         = "bypass-rule"
+	KindImpersonationRule  = "impersonation-rule"
+)
+
+// Change describes one added, removed, or modified entity.
+type Change struct {
+	Domain string     `json:"domain"`
+	Kind   string     `json:"kind"`
+	ID     string     `json:"id"`
+	Type   ChangeType `json:"type"`
+	// Details describes each modified field, e.g. "policy: mrn:a → mrn:b".
+	Details []string `json:"details,omitempty"`
+	// RegoDiff is a unified diff of the embedded Rego, when it changed.
+	RegoDiff string `json:"regoDiff,omitempty"`
+}
+
+// Compare returns the differences from the old to the new set of domains, keyed by domain
+// name. Changes are ordered by domain, then by the order of sections in a PolicyDomain,
+// then by ID.
+func Compare(before, after map[string]*policydomain.IntermediateModel) []Change {
+	var changes []Change
+	for _, name := range unionKeys(before, after) {
+		o, n := before[name], after[name]
+		switch {
+		case o == nil:
+			changes = append(changes, Change{Domain: name, Kind: KindDomain, ID: name, Type: Added})
+		case n == nil:
+			changes = append(changes, Change{Domain: name, Kind: KindDomain, ID: name, Type: Removed})
+		default:
+			changes = append(changes, CompareDomain(o, n)...)
+		}
+	}
+	return changes
+}
+
+// CompareDomain returns the differences between two versions of a single domain.
+func CompareDomain(before, after *policydomain.IntermediateModel) []Change {
+	c := &comparison{domain: after.Name}
+
+	if before.AnnotationDefaults.MergeStrategy != after.AnnotationDefaults.MergeStrategy {
+		c.modified(KindAnnotationDefaults, "merge", []string{
+			fieldChange("merge", before.AnnotationDefaults.MergeStrategy, after.AnnotationDefaults.MergeStrategy),
+		}, "")
+	}
+
+	var defaults []string
+	if before.Defaults.Decision != after.Defaults.Decision {
+		defaults = append(defaults, fieldChange("decision", before.Defaults.Decision, after.Defaults.Decision))
+	}
+	if before.Defaults.Combining != after.Defaults.Combining {
+		defaults = append(defaults, fieldChange("combining", before.Defaults.Combining, after.Defaults.Combining))
+	}
+	c.modified(KindDefaults, "defaults", defaults, "")
+
+	c.compareData(before.Data, after.Data)
+
+	fetch := setChanges("allow", before.Fetch.Allow, after.Fetch.Allow)
+	if before.Fetch.Timeout != after.Fetch.Timeout {
+		fetch = append(fetch, fieldChange("timeout", before.Fetch.Timeout, after.Fetch.Timeout))
+	}
+	if before.Fetch.CacheTTL != after.Fetch.CacheTTL {
+		fetch = append(fetch, fieldChange("cache_ttl", before.Fetch.CacheTTL, after.Fetch.CacheTTL))
+	}
+	c.modified(KindFetch, "fetch", fetch, "")
+
+	var classifications []string
+	if !slices.Equal(before.Classifications.Levels, after.Classifications.Levels) {
+		classifications = append(classifications, fieldChange("levels", before.Classifications.Levels, after.Classifications.Levels))
+	}
+	classifications = append(classifications,
+		setChanges("compartments", before.Classifications.Compartments, after.Classifications.Compartments)...)
+	c.modified(KindClassifications, "classifications", classifications, "")
+
+	c.comparePolicies(KindPolicyLibrary, before.PolicyLibraries, after.PolicyLibraries)
+	c.comparePolicies(KindPolicy, before.Policies, after.Policies)
+	c.compareReferences(KindRole, before.Roles, after.Roles)
+	c.compareGroups(before.Groups, after.Groups)
+	c.compareReferences(KindResourceGroup, before.ResourceGroups, after.ResourceGroups)
+	c.compareReferences(KindScope, before.Scopes, after.Scopes)
+	c.compareOperations(before.Operations, after.Operations)
+	c.compareMappers(before.Mappers, after.Mappers)
+	c.compareResources(before.Resources, after.Resources)
+	c.compareBypassRules(before.BypassRules, after.BypassRules)
+	c.compareImpersonationRules(before.ImpersonationRules, after.ImpersonationRules)
+
+	return c.changes
+}
+
+type comparison struct {
+	domain  string
+	changes []Change
+}
+
+func (c *comparison) add(kind, id string, t ChangeType) {
+	c.changes = append(c.changes, Change{Domain: c.domain, Kind: kind, ID: id, Type: t})
+}
+
+func (c *comparison) modified(kind, id string, details []string, regoDiff string) {
+	if len(details) == 0 {
+		return
+	}
+	c.changes = append(c.changes, Change{
+		Domain:   c.domain,
+		Kind:     kind,
+		ID:       id,
+		Type:     Modified,
+		Details:  details,
+		RegoDiff: regoDiff,
+	})
+}
+
+// compareKeyed reports added and removed entities, calling modified for those in both
+func compareKeyed[T any](c *comparison, kind string, before, after map[string]T, modified func(id string, o, n T)) {
+	for _, id := range unionKeys(before, after) {
+		o, inOld := before[id]
+		n, inNew := after[id]
+		switch {
+		case !inOld:
+			c.add(kind, id, Added)
+		case !inNew:
+			c.add(kind, id, Removed)
+		default:
+			modified(id, o, n)
+		}
+	}
+}
+
+func (c *comparison) comparePolicies(kind string, before, after map[string]policydomain.Policy) {
+	compareKeyed(c, kind, before, after, func(id string, o, n policydomain.Policy) {
+		var details []string
+		if o.Version != n.Version {
+			details = append(details, fieldChange("version", o.Version, n.Version))
+		}
+		details = append(details, setChanges("dependencies", o.Dependencies, n.Dependencies)...)
+
+		regoDiff := ""
+		if o.Rego != n.Rego {
+			details = append(details, "rego changed")
+			regoDiff = unifiedDiff(o.Rego, n.Rego)
+		}
+
+		c.modified(kind, id, details, regoDiff)
+	})
+}
+
+func (c *comparison) compareReferences(kind string, before, after map[string]policydomain.PolicyReference) {
+	compareKeyed(c, kind, before, after, func(id string, o, n policydomain.PolicyReference) {
+		var details []string
+		if o.Policy != n.Policy {
+			details = append(details, fieldChange("policy", o.Policy, n.Policy))
+		}
+		details = append(details, setChanges("deny-policies", o.DenyPolicies, n.DenyPolicies)...)
+		if o.Default != n.Default {
+			details = append(details, fieldChange("default", o.Default, n.Default))
+		}
+		if ownerClaim(o.Owner) != ownerClaim(n.Owner) {
+			details = append(details, fieldChange("owner", ownerClaim(o.Owner), ownerClaim(n.Owner)))
+		}
+		details = append(details, networkChanges(o.Network, n.Network)...)
+		details = append(details, setChanges("allowed-purposes", o.AllowedPurposes, n.AllowedPurposes)...)
+		details = append(details, annotationChanges(o.Annotations, n.Annotations)...)
+
+		c.modified(kind, id, details, "")
+	})
+}
+
+func (c *comparison) compareGroups(before, after map[string]policydomain.Group) {
+	compareKeyed(c, KindGroup, before, after, func(id string, o, n policydomain.Group) {
+		var details []string
+		details = append(details, setChanges("roles", o.Roles, n.Roles)...)
+		details = append(details, setChanges("groups", o.Groups, n.Groups)...)
+		details = append(details, annotationChanges(o.Annotations, n.Annotations)...)
+
+		c.modified(KindGroup, id, details, "")
+	})
+}
+
+func (c *comparison) compareOperations(before, after []policydomain.Operation) {
+	oldByID, oldOrder := indexByID(before, func(o policydomain.Operation) string { return o.IDSpec.ID })
+	newByID, newOrder := indexByID(after, func(o policydomain.Operation) string { return o.IDSpec.ID })
+	moved := movedIDs(oldOrder, newOrder)
+
+	compareKeyed(c, KindOperation, oldByID, newByID, func(id string, o, n policydomain.Operation) {
+		var details []string
+		details = append(details, setChanges("selector", selectorStrings(o.Selectors), selectorStrings(n.Selectors))...)
+		if o.Policy != n.Policy {
+			details = append(details, fieldChange("policy", o.Policy, n.Policy))
+		}
+		if o.RequiresApproval != n.RequiresApproval {
+			details = append(details, fieldChange("requires-approval", strconv.Itoa(o.RequiresApproval), strconv.Itoa(n.RequiresApproval)))
+		}
+		if change := schemaChange(o.ContextSchema, n.ContextSchema); change != "" {
+			details = append(details, "context-schema "+change)
+		}
+		if o.Identity.Combining != n.Identity.Combining {
+			details = append(details, fieldChange("identity combining", o.Identity.Combining, n.Identity.Combining))
+		}
+		if o.Identity.Minimum != n.Identity.Minimum {
+			details = append(details, fieldChange("identity minimum", strconv.Itoa(o.Identity.Minimum), strconv.Itoa(n.Identity.Minimum)))
+		}
+		if moved[id] {
+			// operations are matched in order, so reordering can change routing
+			details = append(details, "order changed")
+		}
+
+		c.modified(KindOperation, id, details, "")
+	})
+}
+
+func (c *comparison) compareMappers(before, after []policydomain.Mapper) {
+	oldByID, _ := indexByID(before, func(m policydomain.Mapper) string { return m.IDSpec.ID })
+	newByID, _ := indexByID(after, func(m policydomain.Mapper) string { return m.IDSpec.ID })
+
+	compareKeyed(c, KindMapper, oldByID, newByID, func(id string, o, n policydomain.Mapper) {
+		var details []string
+		details = append(details, setChanges("selector", selectorStrings(o.Selectors), selectorStrings(n.Selectors))...)
+
+		regoDiff := ""
+		if o.Rego != n.Rego {
+			details = append(details, "rego changed")
+			regoDiff = unifiedDiff(o.Rego, n.Rego)
+		}
+
+		c.modified(KindMapper, id, details, regoDiff)
+	})
+}
+
+func (c *comparison) compareResources(before, after []policydomain.Resource) {
+	oldByID, oldOrder := indexByID(before, func(r policydomain.Resource) string { return r.IDSpec.ID })
+	newByID, newOrder := indexByID(after, func(r policydomain.Resource) string { return r.IDSpec.ID })
+	moved := movedIDs(oldOrder, newOrder)
+
+	compareKeyed(c, KindResource, oldByID, newByID, func(id string, o, n policydomain.Resource) {
+		var details []string
+		details = append(details, setChanges("selector", selectorStrings(o.Selectors), selectorStrings(n.Selectors))...)
+		if o.Group != n.Group {
+			details = append(details, fieldChange("group", o.Group, n.Group))
+		}
+		details = append(details, setChanges("when", conditionStrings(o.Conditions), conditionStrings(n.Conditions))...)
+		if o.Classification != n.Classification {
+			details = append(details, fieldChange("classification", o.Classification, n.Classification))
+		}
+		details = append(details, setChanges("compartments", o.Compartments, n.Compartments)...)
+		details = append(details, setChanges("allowed-purposes", o.AllowedPurposes, n.AllowedPurposes)...)
+		details = append(details, annotationChanges(o.Annotations, n.Annotations)...)
+		if moved[id] {
+			details = append(details, "order changed")
+		}
+
+		c.modified(KindResource, id, details, "")
+	})
+}
+
+func (c *comparison) compareBypassRules(before, after []policydomain.BypassRule) {
+	oldByID, _ := indexByID(before, func(r policydomain.BypassRule) string { return r.Name })
+	newByID, _ := indexByID(after, func(r policydomain.BypassRule) string { return r.Name })
+
+	compareKeyed(c, KindBypassRule, oldByID, newByID, func(id string, o, n policydomain.BypassRule) {
+		var details []string
+		if o.Reason != n.Reason {
+			details = append(details, fieldChange("reason", o.Reason, n.Reason))
+		}
+		details = append(details, setChanges("roles", o.Roles, n.Roles)...)
+		details = append(details, setChanges("operations", selectorStrings(o.Operations), selectorStrings(n.Operations))...)
+
+		c.modified(KindBypassRule, id, details, "")
+	})
+}
+
+func (c *comparison) compareImpersonationRules(before, after []policydomain.ImpersonationRule) {
+	oldByID, _ := indexByID(before, func(r policydomain.ImpersonationRule) string { return r.Name })
+	newByID, _ := indexByID(after, func(r policydomain.ImpersonationRule) string { return r.Name })
+
+	compareKeyed(c, KindImpersonationRule, oldByID, newByID, func(id string, o, n policydomain.ImpersonationRule) {
+		var details []string
+		details = append(details, setChanges("roles", o.Roles, n.Roles)...)
+		details = append(details, setChanges("subjects", selectorStrings(o.Subjects), selectorStrings(n.Subjects))...)
+		details = append(details, setChanges("operations", selectorStrings(o.Operations), selectorStrings(n.Operations))...)
+
+		c.modified(KindImpersonationRule, id, details, "")
+	})
+}
+
+func (c *comparison) compareData(before, after []policydomain.DataDocument) {
+	oldByID, _ := indexByID(before, func(d policydomain.DataDocument) string { return d.Name })
+	newByID, _ := indexByID(after, func(d policydomain.DataDocument) string { return d.Name })
+
+	compareKeyed(c, KindData, oldByID, newByID, func(id string, o, n policydomain.DataDocument) {
+		var details []string
+		if ov, nv := normalizeValue(o.Value), normalizeValue(n.Value); !reflect.DeepEqual(ov, nv) {
+			details = append(details, fmt.Sprintf("value: %s → %s", formatValue(ov), formatValue(nv)))
+		}
+
+		c.modified(KindData, id, details, "")
+	})
+}
+
+// annotationChanges describes added, removed, and modified annotations
+func annotationChanges(before, after map[string]policydomain.Annotation) []string {
+	var details []string
+	for _, name := range unionKeys(before, after) {
+		o, inOld := before[name]
+		n, inNew := after[name]
+		switch {
+		case !inOld:
+			details = append(details, fmt.Sprintf("annotation '%s' added: %s", name, formatValue(n.Value)))
+		case !inNew:
+			details = append(details, fmt.Sprintf("annotation '%s' removed", name))
+		default:
+			if !reflect.DeepEqual(effectiveValue(o.Value), effectiveValue(n.Value)) {
+				details = append(details, fmt.Sprintf("annotation '%s': %s → %s", name, formatValue(o.Value), formatValue(n.Value)))
+			}
+			if o.MergeStrategy != n.MergeStrategy {
+				details = append(details, fmt.Sprintf("annotation '%s' merge: %s", name, changeString(o.MergeStrategy, n.MergeStrategy)))
+			}
+		}
+	}
+	return details
+}
+
+// setChanges describes the items added to and removed from a list whose order is not significant
+func setChanges(field string, before, after []string) []string {
+	oldSet, newSet := toSet(before), toSet(after)
+
+	var details []string
+	for _, item := range unionKeys(oldSet, newSet) {
+		switch {
+		case !oldSet[item]:
+			details = append(details, fmt.Sprintf("%s added: %s", field, item))
+		case !newSet[item]:
+			details = append(details, fmt.Sprintf("%s removed: %s", field, item))
+		}
+	}
+	return details
+}
+
+// movedIDs returns the IDs present in both lists whose relative order differs
+func movedIDs(before, after []string) map[string]bool {
+	common := func(ids []string, other []string) []string {
+		set := toSet(other)
+		var result []string
+		for _, id := range ids {
+			if set[id] {
+				result = append(result, id)
+			}
+		}
+		return result
+	}
+
+	o, n := common(before, after), common(after, before)
+	moved := make(map[string]bool)
+	for i := range o {
+		if o[i] != n[i] {
+			moved[o[i]] = true
+			moved[n[i]] = true
+		}
+	}
+	return moved
+}
+
+func indexByID[T any](items []T, id func(T) string) (map[string]T, []string) {
+	byID := make(map[string]T, len(items))
+	order := make([]string, 0, len(items))
+	for _, item := range items {
+		key := id(item)
+		if _, ok := byID[key]; !ok {
+			order = append(order, key)
+		}
+		byID[key] = item
+	}
+	return byID, order
+}
+
+func selectorStrings(selectors []*regexp.Regexp) []string {
+	result := make([]string, 0, len(selectors))
+	for _, s := range selectors {
+		result = append(result, s.String())
+	}
+	return result
+}
+
+func conditionStrings(conditions []policydomain.Condition) []string {
+	result := make([]string, 0, len(conditions))
+	for _, c := range conditions {
+		result = append(result, c.String())
+	}
+	return result
+}
+
+func unifiedDiff(before, after string) string {
+	text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: "old",
+		ToFile:   "new",
+		Context:  3,
+	})
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// ownerClaim describes an owner rule by its claim, or is empty without a rule
+func ownerClaim(r *policydomain.OwnerRule) string {
+	switch {
+	case r == nil:
+		return ""
+	case r.Claim == "":
+		return "sub"
+	default:
+		return r.Claim
+	}
+}
+
+// networkChanges describes the CIDRs and countries added to or removed from a network rule
+func networkChanges(before, after *policydomain.NetworkRule) []string {
+	rule := func(r *policydomain.NetworkRule) policydomain.NetworkRule {
+		if r == nil {
+			return policydomain.NetworkRule{}
+		}
+		return *r
+	}
+	o, n := rule(before), rule(after)
+
+	details := setChanges("network.cidrs", o.CIDRs, n.CIDRs)
+	return append(details, setChanges("network.countries", o.Countries, n.Countries)...)
+}
+
+// schemaChange describes how a schema changed, empty if it did not
+func schemaChange(before, after *opa.Schema) string {
+	switch {
+	case before == nil && after == nil:
+		return ""
+	case before == nil:
+		return "added"
+	case after == nil:
+		return "removed"
+	case before.String() != after.String():
+		return "changed"
+	}
+	return ""
+}
+
+func fieldChange(field string, before, after any) string {
+	return fmt.Sprintf("%s: %s", field, changeString(fmt.Sprint(before), fmt.Sprint(after)))
+}
+
+func changeString(before, after string) string {
+	if before == "" {
+		before = `""`
+	}
+	if after == "" {
+		after = `""`
+	}
+	return before + " → " + after
+}
+
+// effectiveValue returns an annotation value as policies see it. As in the engine, strings
+// are decoded as JSON when possible, so that a v1alpha4 value such as "42" equals the v1beta1
+// value 42.
+func effectiveValue(v any) any {
+	if s, ok := v.(string); ok {
+		var decoded any
+		if err := json.Unmarshal([]byte(s), &decoded); err == nil {
+			return decoded
+		}
+		return s
+	}
+	return normalizeValue(v)
+}
+
+// normalizeValue converts native YAML values to their JSON types
+func normalizeValue(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var normalized any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return v
+	}
+	return normalized
+}
+
+// formatValue renders an annotation value compactly
+func formatValue(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// unionKeys returns the keys of both maps in sorted order
+func unionKeys[V any](a, b map[string]V) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		seen[k] = true
+	}
+	for k := range b {
+		seen[k] = true
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
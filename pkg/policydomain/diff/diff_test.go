@@ -0,0 +1,653 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const baseDomain = `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policy-libraries:
+    - mrn: mrn:iam:library:utils
+      name: utils
+      rego: |
+        package utils
+  policies:
+    - mrn: mrn:iam:policy:allow
+      name: allow
+      rego: |
+        package authz
+        default allow = true
+    - mrn: mrn:iam:policy:deny
+      name: deny
+      dependencies:
+        - mrn:iam:library:utils
+      rego: |
+        package authz
+        default allow = false
+  roles:
+    - mrn: mrn:iam:role:admin
+      name: admin
+      policy: mrn:iam:policy:allow
+      annotations:
+        - name: level
+          value: "1"
+  groups:
+    - mrn: mrn:iam:group:admins
+      name: admins
+      roles:
+        - mrn:iam:role:admin
+  resource-groups:
+    - mrn: mrn:iam:resource-group:default
+      name: default
+      default: true
+      policy: mrn:iam:policy:allow
+  operations:
+    - name: read
+      selector:
+        - "api:.*:read"
+      policy: mrn:iam:policy:allow
+    - name: all
+      selector:
+        - ".*"
+      policy: mrn:iam:policy:deny
+  resources:
+    - name: docs
+      selector:
+        - "mrn:docs:.*"
+      group: mrn:iam:resource-group:default
+`
+
+func load(t *testing.T, yaml string) *policydomain.IntermediateModel {
+	t.Helper()
+	model, err := parsers.LoadFromBytes("test.yml", []byte(yaml))
+	require.NoError(t, err)
+	return model
+}
+
+func domains(models ...*policydomain.IntermediateModel) map[string]*policydomain.IntermediateModel {
+	result := make(map[string]*policydomain.IntermediateModel)
+	for _, m := range models {
+		result[m.Name] = m
+	}
+	return result
+}
+
+func find(changes []Change, kind, id string) *Change {
+	for i := range changes {
+		if changes[i].Kind == kind && changes[i].ID == id {
+			return &changes[i]
+		}
+	}
+	return nil
+}
+
+func TestCompare_Identical(t *testing.T) {
+	assert.Empty(t, CompareDomain(load(t, baseDomain), load(t, baseDomain)))
+}
+
+func TestCompare_DomainAddedRemoved(t *testing.T) {
+	base := load(t, baseDomain)
+
+	changes := Compare(nil, domains(base))
+	require.Len(t, changes, 1)
+	assert.Equal(t, Change{Domain: "example", Kind: KindDomain, ID: "example", Type: Added}, changes[0])
+
+	changes = Compare(domains(base), nil)
+	require.Len(t, changes, 1)
+	assert.Equal(t, Removed, changes[0].Type)
+}
+
+func TestCompare_LibraryVersion(t *testing.T) {
+	base := replace(t, baseDomain, "v1alpha4", "v1beta1")
+	modified := replace(t, base, "      name: utils\n", "      name: utils\n      version: 2.0.0\n")
+	modified = replace(t, modified, "        - mrn:iam:library:utils\n", "        - mrn:iam:library:utils@^2\n")
+
+	changes := CompareDomain(load(t, base), load(t, modified))
+
+	c := find(changes, KindPolicyLibrary, "mrn:iam:library:utils")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{`version: "" → 2.0.0`}, c.Details)
+
+	c = find(changes, KindPolicy, "mrn:iam:policy:deny")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"dependencies removed: mrn:iam:library:utils", "dependencies added: mrn:iam:library:utils@^2"}, c.Details)
+}
+
+func TestCompare_PolicyChanges(t *testing.T) {
+	modified := replace(t, baseDomain,
+		"        default allow = false\n",
+		"        default allow = false\n        allow { input.principal.sub == \"root\" }\n")
+	modified = replace(t, modified, "      dependencies:\n        - mrn:iam:library:utils\n", "")
+	modified = replace(t, modified, `    - mrn: mrn:iam:policy:allow
+      name: allow
+      rego: |
+        package authz
+        default allow = true
+`, `    - mrn: mrn:iam:policy:new
+      name: new
+      rego: |
+        package authz
+        default allow = true
+`)
+
+	changes := CompareDomain(load(t, baseDomain), load(t, modified))
+
+	c := find(changes, KindPolicy, "mrn:iam:policy:deny")
+	require.NotNil(t, c)
+	assert.Equal(t, Modified, c.Type)
+	assert.Equal(t, []string{"dependencies removed: mrn:iam:library:utils", "rego changed"}, c.Details)
+	assert.Contains(t, c.RegoDiff, `+allow { input.principal.sub == "root" }`)
+
+	c = find(changes, KindPolicy, "mrn:iam:policy:new")
+	require.NotNil(t, c)
+	assert.Equal(t, Added, c.Type)
+
+	c = find(changes, KindPolicy, "mrn:iam:policy:allow")
+	require.NotNil(t, c)
+	assert.Equal(t, Removed, c.Type)
+}
+
+func TestCompare_ReferenceChanges(t *testing.T) {
+	modified := replace(t, baseDomain, `      name: admin
+      policy: mrn:iam:policy:allow
+      annotations:
+        - name: level
+          value: "1"
+`, `      name: admin
+      policy: mrn:iam:policy:deny
+      annotations:
+        - name: level
+          value: "2"
+        - name: team
+          value: "\"ops\""
+`)
+	modified = replace(t, modified, "      default: true\n", "")
+	modified = replace(t, modified, "        - mrn:iam:role:admin\n  resource-groups", "        - mrn:iam:role:ops\n  resource-groups")
+
+	changes := CompareDomain(load(t, baseDomain), load(t, modified))
+
+	c := find(changes, KindRole, "mrn:iam:role:admin")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{
+		"policy: mrn:iam:policy:allow → mrn:iam:policy:deny",
+		"annotation 'level': 1 → 2",
+		`annotation 'team' added: "ops"`,
+	}, c.Details)
+
+	c = find(changes, KindResourceGroup, "mrn:iam:resource-group:default")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"default: true → false"}, c.Details)
+
+	c = find(changes, KindGroup, "mrn:iam:group:admins")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"roles removed: mrn:iam:role:admin", "roles added: mrn:iam:role:ops"}, c.Details)
+}
+
+func TestCompare_OwnerRuleChanges(t *testing.T) {
+	base := replace(t, baseDomain, "v1alpha4", "v1beta1")
+	owned := replace(t, base, "      default: true\n", "      default: true\n      owner: {}\n")
+	email := replace(t, base, "      default: true\n", "      default: true\n      owner:\n        claim: email\n")
+
+	c := find(CompareDomain(load(t, base), load(t, owned)), KindResourceGroup, "mrn:iam:resource-group:default")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{`owner: "" → sub`}, c.Details)
+
+	c = find(CompareDomain(load(t, owned), load(t, email)), KindResourceGroup, "mrn:iam:resource-group:default")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"owner: sub → email"}, c.Details)
+}
+
+func TestCompare_NetworkRuleChanges(t *testing.T) {
+	base := replace(t, baseDomain, "v1alpha4", "v1beta1")
+	internal := replace(t, base, "      default: true\n", "      default: true\n      network:\n        cidrs: [10.0.0.0/8]\n")
+	domestic := replace(t, base, "      default: true\n", "      default: true\n      network:\n        cidrs: [10.0.0.0/8, fd00::/8]\n        countries: [US]\n")
+
+	c := find(CompareDomain(load(t, base), load(t, internal)), KindResourceGroup, "mrn:iam:resource-group:default")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"network.cidrs added: 10.0.0.0/8"}, c.Details)
+
+	c = find(CompareDomain(load(t, internal), load(t, domestic)), KindResourceGroup, "mrn:iam:resource-group:default")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"network.cidrs added: fd00::/8", "network.countries added: US"}, c.Details)
+
+	c = find(CompareDomain(load(t, domestic), load(t, base)), KindResourceGroup, "mrn:iam:resource-group:default")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"network.cidrs removed: 10.0.0.0/8", "network.cidrs removed: fd00::/8", "network.countries removed: US"}, c.Details)
+}
+
+func TestCompare_SelectorAndOrderChanges(t *testing.T) {
+	modified := replace(t, baseDomain, `    - name: read
+      selector:
+        - "api:.*:read"
+      policy: mrn:iam:policy:allow
+    - name: all
+      selector:
+        - ".*"
+      policy: mrn:iam:policy:deny
+`, `    - name: all
+      selector:
+        - ".*"
+      policy: mrn:iam:policy:deny
+    - name: read
+      selector:
+        - "api:.*:(read|list)"
+      policy: mrn:iam:policy:allow
+`)
+	modified = replace(t, modified, `"mrn:docs:.*"`, `"mrn:documents:.*"`)
+
+	changes := CompareDomain(load(t, baseDomain), load(t, modified))
+
+	c := find(changes, KindOperation, "read")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{
+		"selector added: ^api:.*:(read|list)$",
+		"selector removed: ^api:.*:read$",
+		"order changed",
+	}, c.Details)
+
+	c = find(changes, KindOperation, "all")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"order changed"}, c.Details)
+
+	c = find(changes, KindResource, "docs")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"selector removed: ^mrn:docs:.*$", "selector added: ^mrn:documents:.*$"}, c.Details)
+}
+
+func TestCompare_IgnoresFormatting(t *testing.T) {
+	// selectors are anchored when parsed, so explicit anchors change nothing
+	anchored := replace(t, baseDomain, `"api:.*:read"`, `"^api:.*:read$"`)
+	assert.Empty(t, CompareDomain(load(t, baseDomain), load(t, anchored)))
+}
+
+func TestCompare_AnnotationEncoding(t *testing.T) {
+	// the same value, JSON-encoded in v1alpha4 and native in v1beta1
+	native := replace(t, baseDomain, "v1alpha4", "v1beta1")
+	native = replace(t, native, `value: "1"`, `value: 1`)
+	assert.Empty(t, CompareDomain(load(t, baseDomain), load(t, native)))
+
+	changed := replace(t, native, `value: 1`, `value: "2"`)
+	c := find(CompareDomain(load(t, baseDomain), load(t, changed)), KindRole, "mrn:iam:role:admin")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"annotation 'level': 1 → 2"}, c.Details)
+}
+
+func TestMovedIDs(t *testing.T) {
+	assert.Empty(t, movedIDs([]string{"a", "b", "c"}, []string{"a", "b", "c"}))
+	// inserting or removing entries does not move the others
+	assert.Empty(t, movedIDs([]string{"a", "b", "c"}, []string{"x", "a", "c"}))
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, movedIDs([]string{"a", "b", "c"}, []string{"b", "a", "c"}))
+}
+
+func replace(t *testing.T, s, from, to string) string {
+	t.Helper()
+	require.Contains(t, s, from)
+	return strings.Replace(s, from, to, 1)
+}
+
+func TestCompare_BypassRuleChanges(t *testing.T) {
+	const bypassDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  system:
+    bypass:
+      - name: admin-anti-lockout
+        reason: ANTI_LOCKOUT
+        roles:
+          - mrn:iam:role:admin
+        operations:
+          - "platform:admin:.*"
+      - name: health
+        reason: PUBLIC
+        roles:
+          - mrn:iam:role:monitor
+`
+	modified := replace(t, bypassDomain, `          - mrn:iam:role:admin
+        operations:
+          - "platform:admin:.*"`, `          - mrn:iam:role:admin
+          - mrn:iam:role:operator
+        operations:
+          - "platform:.*"`)
+	modified = replace(t, modified, `      - name: health
+        reason: PUBLIC`, `      - name: status
+        reason: VISITOR`)
+
+	changes := CompareDomain(load(t, bypassDomain), load(t, modified))
+
+	c := find(changes, KindBypassRule, "admin-anti-lockout")
+	require.NotNil(t, c)
+	assert.Equal(t, Modified, c.Type)
+	assert.Equal(t, []string{
+		"roles added: mrn:iam:role:operator",
+		"operations added: ^platform:.*$",
+		"operations removed: ^platform:admin:.*$",
+	}, c.Details)
+
+	assert.Equal(t, Removed, find(changes, KindBypassRule, "health").Type)
+	assert.Equal(t, Added, find(changes, KindBypassRule, "status").Type)
+}
+
+func TestCompare_ImpersonationRuleChanges(t *testing.T) {
+	const impersonationDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  system:
+    impersonation:
+      - name: on-behalf-of
+        roles:
+          - mrn:iam:role:service
+        subjects:
+          - "glob:*@example.com"
+      - name: gateway
+        roles:
+          - mrn:iam:role:gateway
+`
+	modified := replace(t, impersonationDomain, `        subjects:
+          - "glob:*@example.com"`, `        operations:
+          - "exact:api:documents:read"`)
+	modified = replace(t, modified, `      - name: gateway`, `      - name: edge`)
+
+	changes := CompareDomain(load(t, impersonationDomain), load(t, modified))
+
+	c := find(changes, KindImpersonationRule, "on-behalf-of")
+	require.NotNil(t, c)
+	assert.Equal(t, Modified, c.Type)
+	assert.Equal(t, []string{
+		"subjects removed: ^[^:/\\n]*@example\\.com$",
+		"operations added: ^api:documents:read$",
+	}, c.Details)
+
+	assert.Equal(t, Removed, find(changes, KindImpersonationRule, "gateway").Type)
+	assert.Equal(t, Added, find(changes, KindImpersonationRule, "edge").Type)
+}
+
+func TestCompare_DefaultsChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  defaults:
+    decision: deny
+`
+	modified := replace(t, domain, "    decision: deny\n", "    decision: allow\n    combining: any\n")
+
+	changes := CompareDomain(load(t, domain), load(t, modified))
+
+	c := find(changes, KindDefaults, "defaults")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"decision: deny → allow", `combining: "" → any`}, c.Details)
+	assert.Empty(t, CompareDomain(load(t, domain), load(t, domain)))
+}
+
+func TestCompare_DataChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  data:
+    - name: countries
+      value: [CA, US]
+    - name: levels
+      value:
+        public: 0
+        secret: 2
+`
+	modified := replace(t, domain, "value: [CA, US]", "value: [CA, MX, US]")
+	modified = replace(t, modified, "    - name: levels\n      value:\n        public: 0\n        secret: 2\n", "    - name: regions\n      value: [east]\n")
+
+	changes := CompareDomain(load(t, domain), load(t, modified))
+
+	c := find(changes, KindData, "countries")
+	require.NotNil(t, c)
+	assert.Equal(t, Modified, c.Type)
+	assert.Equal(t, []string{`value: ["CA","US"] → ["CA","MX","US"]`}, c.Details)
+
+	c = find(changes, KindData, "levels")
+	require.NotNil(t, c)
+	assert.Equal(t, Removed, c.Type)
+
+	c = find(changes, KindData, "regions")
+	require.NotNil(t, c)
+	assert.Equal(t, Added, c.Type)
+
+	// equivalent values in another notation are unchanged
+	reordered := replace(t, domain, "        public: 0\n        secret: 2\n", "        {secret: 2, public: 0}\n")
+	assert.Empty(t, CompareDomain(load(t, domain), load(t, reordered)))
+}
+
+func TestCompare_FetchChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  fetch:
+    allow:
+      - https://risk.example.com/v1/
+    timeout: 2s
+`
+	modified := replace(t, domain, "      - https://risk.example.com/v1/\n", "      - https://risk.example.com/v2/\n")
+	modified = replace(t, modified, "    timeout: 2s\n", "    timeout: 2s\n    cache_ttl: 1m\n")
+
+	c := find(CompareDomain(load(t, domain), load(t, modified)), KindFetch, "fetch")
+	require.NotNil(t, c)
+	assert.Equal(t, Modified, c.Type)
+	assert.Equal(t, []string{
+		"allow removed: https://risk.example.com/v1/",
+		"allow added: https://risk.example.com/v2/",
+		`cache_ttl: "" → 1m`,
+	}, c.Details)
+}
+
+func TestCompare_ClassificationChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  classifications:
+    levels: [LOW, HIGH]
+    compartments: [CRYPTO]
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:default"
+      policy: "mrn:iam:policy:allow-all"
+  resources:
+    - name: keys
+      selector:
+        - "mrn:vault:key:.*"
+      group: "mrn:iam:resource-group:default"
+      classification: LOW
+`
+	modified := replace(t, domain, "levels: [LOW, HIGH]", "levels: [LOW, MODERATE, HIGH]")
+	modified = replace(t, modified, "compartments: [CRYPTO]", "compartments: [CRYPTO, NUCLEAR]")
+	modified = replace(t, modified, "      classification: LOW\n", "      classification: MODERATE\n      compartments: [NUCLEAR]\n")
+
+	changes := CompareDomain(load(t, domain), load(t, modified))
+	c := find(changes, KindClassifications, "classifications")
+	require.NotNil(t, c)
+	assert.Equal(t, Modified, c.Type)
+	assert.Equal(t, []string{
+		"levels: [LOW HIGH] → [LOW MODERATE HIGH]",
+		"compartments added: NUCLEAR",
+	}, c.Details)
+
+	c = find(changes, KindResource, "keys")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{
+		"classification: LOW → MODERATE",
+		"compartments added: NUCLEAR",
+	}, c.Details)
+}
+
+func TestCompare_PurposeChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:customers"
+      policy: "mrn:iam:policy:allow-all"
+      allowed-purposes: [billing]
+  resources:
+    - name: profiles
+      selector:
+        - "mrn:app:profile:.*"
+      group: "mrn:iam:resource-group:customers"
+`
+	modified := replace(t, domain, "allowed-purposes: [billing]", "allowed-purposes: [billing, support]")
+	modified = replace(t, modified, "      group: \"mrn:iam:resource-group:customers\"\n", "      group: \"mrn:iam:resource-group:customers\"\n      allowed-purposes: [support]\n")
+
+	changes := CompareDomain(load(t, domain), load(t, modified))
+	c := find(changes, KindResourceGroup, "mrn:iam:resource-group:customers")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"allowed-purposes added: support"}, c.Details)
+
+	c = find(changes, KindResource, "profiles")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"allowed-purposes added: support"}, c.Details)
+}
+
+func TestCompare_ConditionChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  resource-groups:
+    - mrn: "mrn:iam:resource-group:finance"
+      policy: "mrn:iam:policy:allow-all"
+  resources:
+    - name: finance-documents
+      group: "mrn:iam:resource-group:finance"
+      when:
+        - "annotations.department == \"finance\""
+`
+	modified := replace(t, domain, "      when:\n", "      when:\n        - \"annotations.tier >= 2\"\n")
+
+	changes := CompareDomain(load(t, domain), load(t, modified))
+	c := find(changes, KindResource, "finance-documents")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"when added: annotations.tier >= 2"}, c.Details)
+}
+
+func TestCompare_DenyPolicyChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+    - mrn: "mrn:iam:policy:trusted-network"
+      rego: |
+        package authz
+        default allow = false
+  roles:
+    - mrn: "mrn:iam:role:contractor"
+      policy: "mrn:iam:policy:allow-all"
+`
+	modified := replace(t, domain, "      policy: \"mrn:iam:policy:allow-all\"\n", "      policy: \"mrn:iam:policy:allow-all\"\n      deny-policies: [\"mrn:iam:policy:trusted-network\"]\n")
+
+	c := find(CompareDomain(load(t, domain), load(t, modified)), KindRole, "mrn:iam:role:contractor")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"deny-policies added: mrn:iam:policy:trusted-network"}, c.Details)
+}
+
+func TestCompare_RequiresApprovalChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  operations:
+    - name: admin
+      selector: ["admin:.*"]
+      policy: "mrn:iam:policy:allow-all"
+`
+	modified := replace(t, domain, "      selector: [\"admin:.*\"]\n", "      selector: [\"admin:.*\"]\n      requires-approval: 2\n")
+
+	c := find(CompareDomain(load(t, domain), load(t, modified)), KindOperation, "admin")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{`requires-approval: 0 → 2`}, c.Details)
+}
+
+func TestCompare_IdentityChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  operations:
+    - name: wire
+      selector: ["bank:wire:.*"]
+      policy: "mrn:iam:policy:allow-all"
+`
+	modified := replace(t, domain, "      selector: [\"bank:wire:.*\"]\n", "      selector: [\"bank:wire:.*\"]\n      identity:\n        combining: all\n        minimum: 2\n")
+
+	c := find(CompareDomain(load(t, domain), load(t, modified)), KindOperation, "wire")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{`identity combining: "" → all`, `identity minimum: 0 → 2`}, c.Details)
+}
+
+func TestCompare_ContextSchemaChanges(t *testing.T) {
+	const domain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = true
+  operations:
+    - name: transfer
+      selector: ["api:transfer:.*"]
+      policy: "mrn:iam:policy:allow-all"
+`
+	withSchema := replace(t, domain, "      selector: [\"api:transfer:.*\"]\n", "      selector: [\"api:transfer:.*\"]\n      context-schema:\n        type: object\n")
+	changed := replace(t, withSchema, "        type: object\n", "        type: object\n        required: [amount]\n")
+
+	c := find(CompareDomain(load(t, domain), load(t, withSchema)), KindOperation, "transfer")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"context-schema added"}, c.Details)
+
+	c = find(CompareDomain(load(t, withSchema), load(t, changed)), KindOperation, "transfer")
+	require.NotNil(t, c)
+	assert.Equal(t, []string{"context-schema changed"}, c.Details)
+
+	assert.Nil(t, find(CompareDomain(load(t, changed), load(t, changed)), KindOperation, "transfer"))
+}
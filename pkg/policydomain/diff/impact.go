@@ -0,0 +1,229 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package diff
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/policydomain"
+)
+
+// Radius classifies how many decisions a change may affect.
+type Radius string
+
+// Blast radii, widest first
+const (
+	// RadiusHigh changes may affect every principal: those to the domain's settings, mappers,
+	// bypass and impersonation rules, operations, and resource groups, or to the policies they use.
+	RadiusHigh Radius = "high"
+	// RadiusMedium changes may affect the principals holding some roles, groups, or scopes.
+	RadiusMedium Radius = "medium"
+	// RadiusLow changes may affect some resources.
+	RadiusLow Radius = "low"
+	// RadiusNone changes affect no decision, such as those to a policy nothing uses.
+	RadiusNone Radius = "none"
+)
+
+// radiusOrder ranks the radii, widest first
+var radiusOrder = map[Radius]int{RadiusHigh: 0, RadiusMedium: 1, RadiusLow: 2, RadiusNone: 3}
+
+// Impact is the blast radius of a change: the operations and roles whose decisions it may
+// affect, in either version of its domain.
+type Impact struct {
+	Change
+	Radius Radius `json:"radius"`
+
+	// Operations names the operations affected, unless the change may affect them all.
+	Operations    []string `json:"operations,omitempty"`
+	AllOperations bool     `json:"allOperations,omitempty"`
+
+	// Roles lists the MRNs of the roles affected, unless the change may affect them all.
+	Roles    []string `json:"roles,omitempty"`
+	AllRoles bool     `json:"allRoles,omitempty"`
+}
+
+// Assess returns the impact of each change from the old to the new set of domains, as
+// returned by [Compare], widest first and otherwise in the order of the changes.
+//
+// A change reaches what uses the entity changed: a policy library reaches the policies
+// depending on it, directly or through other libraries, and a policy reaches the
+// operations, roles, scopes, and resource groups referencing it. References are followed
+// in both versions, so that removing a reference is as visible as adding one.
+func Assess(changes []Change, before, after map[string]*policydomain.IntermediateModel) []Impact {
+	impacts := make([]Impact, 0, len(changes))
+	for _, c := range changes {
+		var versions []*policydomain.IntermediateModel
+		for _, domains := range []map[string]*policydomain.IntermediateModel{before, after} {
+			if d := domains[c.Domain]; d != nil {
+				versions = append(versions, d)
+			}
+		}
+		impacts = append(impacts, assess(c, versions))
+	}
+
+	slices.SortStableFunc(impacts, func(a, b Impact) int {
+		return radiusOrder[a.Radius] - radiusOrder[b.Radius]
+	})
+	return impacts
+}
+
+// assess returns the impact of a change in the versions of its domain
+func assess(c Change, versions []*policydomain.IntermediateModel) Impact {
+	impact := Impact{Change: c}
+	everyone := func(radius Radius) Impact {
+		impact.Radius, impact.AllOperations, impact.AllRoles = radius, true, true
+		return impact
+	}
+
+	switch c.Kind {
+	case KindPolicyLibrary, KindPolicy:
+		return reach(impact, versions, dependents(versions, c.ID))
+
+	case KindRole:
+		impact.Radius, impact.AllOperations, impact.Roles = RadiusMedium, true, []string{c.ID}
+
+	case KindGroup:
+		impact.Radius, impact.AllOperations, impact.Roles = RadiusMedium, true, groupRoles(versions, c.ID)
+
+	case KindScope:
+		return everyone(RadiusMedium)
+
+	case KindOperation:
+		impact.Radius, impact.AllRoles, impact.Operations = RadiusHigh, true, []string{c.ID}
+
+	case KindResource:
+		return everyone(RadiusLow)
+
+	case KindBypassRule:
+		var roles []string
+		for _, v := range versions {
+			for _, rule := range v.BypassRules {
+				if rule.Name == c.ID {
+					roles = append(roles, rule.Roles...)
+				}
+			}
+		}
+		impact.Radius, impact.AllOperations, impact.Roles = RadiusHigh, true, sortedSet(roles)
+
+	default:
+		// domains, their settings, data, resource groups, mappers, and impersonation rules, which
+		// affect the subjects that actors act for, whatever their roles
+		return everyone(RadiusHigh)
+	}
+
+	return impact
+}
+
+// reach sets the impact of a change to the policies
+func reach(impact Impact, versions []*policydomain.IntermediateModel, policies map[string]bool) Impact {
+	var operations, roles []string
+	everyRole := false
+	for _, v := range versions {
+		for _, op := range v.Operations {
+			if policies[op.Policy] {
+				operations = append(operations, op.IDSpec.ID)
+				everyRole = true
+			}
+		}
+		for id, role := range v.Roles {
+			if policies[role.Policy] {
+				roles = append(roles, id)
+			}
+		}
+		for _, refs := range []map[string]policydomain.PolicyReference{v.Scopes, v.ResourceGroups} {
+			for _, ref := range refs {
+				if policies[ref.Policy] {
+					impact.AllOperations, everyRole = true, true
+				}
+			}
+		}
+	}
+
+	impact.Operations = sortedSet(operations)
+	if impact.AllOperations {
+		impact.Operations = nil
+	}
+	impact.Roles, impact.AllRoles = sortedSet(roles), everyRole
+	if everyRole {
+		impact.Roles = nil
+	}
+
+	switch {
+	case impact.AllRoles:
+		impact.Radius = RadiusHigh
+	case len(impact.Roles) > 0:
+		impact.Radius, impact.AllOperations = RadiusMedium, true
+	default:
+		impact.Radius = RadiusNone
+	}
+	return impact
+}
+
+// dependents returns the policy or library and the policies and libraries depending on it,
+// directly or transitively
+func dependents(versions []*policydomain.IntermediateModel, mrn string) map[string]bool {
+	reached := map[string]bool{mrn: true}
+	for grew := true; grew; {
+		grew = false
+		for _, v := range versions {
+			for _, policies := range []map[string]policydomain.Policy{v.PolicyLibraries, v.Policies} {
+				for id, p := range policies {
+					if reached[id] {
+						continue
+					}
+					for _, dep := range p.Dependencies {
+						if reached[dependencyMrn(dep)] {
+							reached[id], grew = true, true
+							break
+						}
+					}
+				}
+			}
+		}
+	}
+	return reached
+}
+
+// dependencyMrn returns the MRN of a dependency, without any version constraint or domain
+func dependencyMrn(dep string) string {
+	mrn, _, _ := strings.Cut(dep, "@")
+	if i := strings.LastIndex(mrn, "/"); i >= 0 {
+		mrn = mrn[i+1:]
+	}
+	return mrn
+}
+
+// groupRoles returns the roles of a group, including those of its nested groups
+func groupRoles(versions []*policydomain.IntermediateModel, mrn string) []string {
+	var roles []string
+	seen := map[string]bool{}
+	var visit func(string)
+	visit = func(id string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		for _, v := range versions {
+			if g, ok := v.Groups[id]; ok {
+				roles = append(roles, g.Roles...)
+				for _, nested := range g.Groups {
+					visit(nested)
+				}
+			}
+		}
+	}
+	visit(mrn)
+	return sortedSet(roles)
+}
+
+func sortedSet(items []string) []string {
+	if len(items) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(items)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
@@ -0,0 +1,123 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package diff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readerDomain adds to baseDomain a policy used only by a role, nested in a group
+var readerDomain = baseDomain + `  scopes:
+    - mrn: mrn:iam:scope:api
+      name: api
+      policy: mrn:iam:policy:allow
+`
+
+func withReader(t *testing.T, domain string) string {
+	domain = replace(t, domain, "  roles:\n", `  roles:
+    - mrn: mrn:iam:role:reader
+      name: reader
+      policy: mrn:iam:policy:reader
+`)
+	domain = replace(t, domain, "  policies:\n", `  policies:
+    - mrn: mrn:iam:policy:reader
+      name: reader
+      rego: |
+        package authz
+        default allow = false
+`)
+	return replace(t, domain, "  groups:\n", `  groups:
+    - mrn: mrn:iam:group:staff
+      name: staff
+      groups:
+        - mrn:iam:group:admins
+      roles:
+        - mrn:iam:role:reader
+`)
+}
+
+func findImpact(impacts []Impact, kind, id string) *Impact {
+	for i := range impacts {
+		if impacts[i].Kind == kind && impacts[i].ID == id {
+			return &impacts[i]
+		}
+	}
+	return nil
+}
+
+func TestAssess(t *testing.T) {
+	// nested groups are declared from v1beta1
+	base := withReader(t, replace(t, readerDomain, "v1alpha4", "v1beta1"))
+	modified := replace(t, base, "        package utils\n", "        package utils\n        ready := true\n")
+	modified = replace(t, modified, "      name: reader\n      rego: |\n        package authz\n        default allow = false\n", "      name: reader\n      rego: |\n        package authz\n        default allow = true\n")
+	modified = replace(t, modified, "          value: \"1\"\n", "          value: \"2\"\n")
+	modified = replace(t, modified, "      roles:\n        - mrn:iam:role:reader\n", "      roles:\n        - mrn:iam:role:reader\n        - mrn:iam:role:auditor\n")
+	modified = replace(t, modified, "        - \"mrn:docs:.*\"\n", "        - \"mrn:documents:.*\"\n")
+	modified = replace(t, modified, "  policies:\n", `  policies:
+    - mrn: mrn:iam:policy:unused
+      name: unused
+      rego: |
+        package authz
+        default allow = true
+`)
+	modified = replace(t, modified, "      name: api\n      policy: mrn:iam:policy:allow\n", "      name: api\n      policy: mrn:iam:policy:reader\n")
+
+	impacts := Assess(CompareDomain(load(t, base), load(t, modified)), domains(load(t, base)), domains(load(t, modified)))
+
+	for _, tc := range []struct {
+		kind, id string
+		expected Impact
+	}{
+		// the library reaches the operation routed to the policy depending on it
+		{KindPolicyLibrary, "mrn:iam:library:utils", Impact{Radius: RadiusHigh, Operations: []string{"all"}, AllRoles: true}},
+		// the reader policy is used by a role, and, in the new version, by a scope
+		{KindPolicy, "mrn:iam:policy:reader", Impact{Radius: RadiusHigh, AllOperations: true, AllRoles: true}},
+		{KindPolicy, "mrn:iam:policy:unused", Impact{Radius: RadiusNone}},
+		{KindRole, "mrn:iam:role:admin", Impact{Radius: RadiusMedium, AllOperations: true, Roles: []string{"mrn:iam:role:admin"}}},
+		// the roles of nested groups are reached
+		{KindGroup, "mrn:iam:group:staff", Impact{Radius: RadiusMedium, AllOperations: true, Roles: []string{"mrn:iam:role:admin", "mrn:iam:role:auditor", "mrn:iam:role:reader"}}},
+		{KindScope, "mrn:iam:scope:api", Impact{Radius: RadiusMedium, AllOperations: true, AllRoles: true}},
+		{KindResource, "docs", Impact{Radius: RadiusLow, AllOperations: true, AllRoles: true}},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			impact := findImpact(impacts, tc.kind, tc.id)
+			require.NotNil(t, impact)
+			tc.expected.Change = impact.Change
+			assert.Equal(t, tc.expected, *impact)
+		})
+	}
+
+	for i := 1; i < len(impacts); i++ {
+		assert.LessOrEqual(t, radiusOrder[impacts[i-1].Radius], radiusOrder[impacts[i].Radius], "impacts are ordered widest first")
+	}
+}
+
+func TestAssess_RoleOnlyPolicy(t *testing.T) {
+	base := withReader(t, baseDomain)
+	modified := replace(t, base, "      name: reader\n      rego: |\n        package authz\n        default allow = false\n", "      name: reader\n      rego: |\n        package authz\n        default allow = true\n")
+
+	impacts := Assess(CompareDomain(load(t, base), load(t, modified)), domains(load(t, base)), domains(load(t, modified)))
+	require.Len(t, impacts, 1)
+	assert.Equal(t, RadiusMedium, impacts[0].Radius)
+	assert.True(t, impacts[0].AllOperations)
+	assert.Equal(t, []string{"mrn:iam:role:reader"}, impacts[0].Roles)
+}
+
+func TestAssess_Domain(t *testing.T) {
+	impacts := Assess(Compare(nil, domains(load(t, baseDomain))), nil, domains(load(t, baseDomain)))
+	require.Len(t, impacts, 1)
+	assert.Equal(t, RadiusHigh, impacts[0].Radius)
+	assert.True(t, impacts[0].AllOperations)
+	assert.True(t, impacts[0].AllRoles)
+}
+
+func TestDependencyMrn(t *testing.T) {
+	assert.Equal(t, "mrn:iam:library:utils", dependencyMrn("mrn:iam:library:utils"))
+	assert.Equal(t, "mrn:iam:library:utils", dependencyMrn("mrn:iam:library:utils@^2"))
+	assert.Equal(t, "mrn:iam:library:utils", dependencyMrn("shared/mrn:iam:library:utils@~1.2"))
+}
@@ -0,0 +1,367 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package format provides canonical formatting of PolicyDomain YAML files.
+//
+// Formatting normalizes the parts of a PolicyDomain that commonly drift between
+// authors, so that diffs stay reviewable:
+//   - Mapping keys are ordered canonically (e.g. apiVersion, kind, metadata, spec;
+//     mrn, name, description, ... rego within an entity). Unknown keys keep their
+//     relative order after the known ones. The order of sequence items, such as
+//     operations, is significant and never changed.
+//   - Indentation is normalized to two spaces.
+//   - Embedded Rego is formatted with 'opa fmt' rules and emitted as a literal block.
+//   - Regex selectors, including those of system rules, are anchored explicitly with ^ and $,
+//     matching how they are evaluated.
+//
+// Comments are preserved. Formatting is idempotent.
+//
+// # Usage
+//
+//	formatted, err := format.Format(data, format.Options{RegoVersion: ast.RegoV0})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	changed := !bytes.Equal(data, formatted)
+package format
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/open-policy-agent/opa/v1/ast"
+	opaformat "github.com/open-policy-agent/opa/v1/format"
+	"gopkg.in/yaml.v3"
+)
+
+// Options configures formatting.
+type Options struct {
+	// RegoVersion is the Rego syntax of the embedded policies. The default,
+	// ast.RegoUndefined, selects OPA's default version.
+	RegoVersion ast.RegoVersion
+}
+
+// documentKeys is the canonical order of the top-level keys of a PolicyDomain document,
+// including the bases a PolicyDomainReference includes.
+var documentKeys = []string{"apiVersion", "kind", "include", "metadata", "spec"}
+
+// specKeys is the canonical order of the sections of a PolicyDomain spec.
+var specKeys = []string{
+	"annotation-defaults",
+	"defaults",
+	"data",
+	"fetch",
+	"classifications",
+	"policy-libraries",
+	"policies",
+	"roles",
+	"groups",
+	"resource-groups",
+	"scopes",
+	"operations",
+	"mappers",
+	"resources",
+	"system",
+}
+
+// systemKeys is the canonical order of the rule lists of the system section.
+var systemKeys = []string{"bypass", "impersonation"}
+
+// entityKeys is the canonical order of the keys of an entity within a spec section.
+var entityKeys = []string{
+	"mrn",
+	"name",
+	"description",
+	"reason",
+	"version",
+	"default",
+	"selector",
+	"dependencies",
+	"roles",
+	"subjects",
+	"operations",
+	"groups",
+	"group",
+	"when",
+	"classification",
+	"compartments",
+	"allowed-purposes",
+	"policy",
+	"deny-policies",
+	"owner",
+	"network",
+	"requires-approval",
+	"context-schema",
+	"identity",
+	"annotations",
+	"rego",
+	"rego_filename",
+	"rego_sha256",
+	"value",
+	"value_filename",
+}
+
+// annotationKeys is the canonical order of the keys of an annotation.
+var annotationKeys = []string{"name", "key", "value", "merge"}
+
+// regoSections are the spec sections whose entities carry inline Rego.
+var regoSections = map[string]bool{
+	"policy-libraries": true,
+	"policies":         true,
+	"mappers":          true,
+}
+
+// selectorKeys are the keys holding the selectors of the entities of each spec section,
+// or of the rules of the system section.
+var selectorKeys = map[string][]string{
+	"operations": {"selector"},
+	"mappers":    {"selector"},
+	"resources":  {"selector"},
+	"system":     {"subjects", "operations"},
+}
+
+// Format returns the canonical formatting of PolicyDomain or PolicyDomainReference
+// YAML documents. Each document of a multi-document file is formatted, as is each item
+// of a PolicyDomainList.
+//
+// Returns an error if a document is not valid YAML, if embedded Rego cannot be parsed,
+// or if reordering keys would break YAML aliases.
+func Format(data []byte, opts Options) ([]byte, error) {
+	roots, err := decodeAll(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+
+	var docs []*yaml.Node
+	for _, root := range roots {
+		if !isEmpty(root) {
+			docs = append(docs, root)
+		}
+	}
+	if len(docs) == 0 {
+		return data, nil
+	}
+
+	for _, root := range docs {
+		doc := root.Content[0]
+		if doc.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("expected a mapping at the document root")
+		}
+
+		if err := formatDocument(doc, opts); err != nil {
+			return nil, err
+		}
+
+		if kind := mappingValue(doc, "kind"); kind != nil && kind.Value == "PolicyDomainList" {
+			if items := mappingValue(doc, "items"); items != nil && items.Kind == yaml.SequenceNode {
+				for _, item := range items.Content {
+					if item.Kind != yaml.MappingNode {
+						continue
+					}
+					if err := formatDocument(item, opts); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, root := range docs {
+		if err := enc.Encode(root); err != nil {
+			return nil, fmt.Errorf("failed to encode YAML: %w", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+
+	// reordering may move an alias ahead of its anchor
+	if _, err := decodeAll(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("canonical key order breaks YAML anchors or aliases: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeAll decodes every document of the data
+func decodeAll(data []byte) ([]*yaml.Node, error) {
+	var roots []*yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var root yaml.Node
+		err := dec.Decode(&root)
+		if errors.Is(err, io.EOF) {
+			return roots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, &root)
+	}
+}
+
+// isEmpty reports whether a document holds nothing, such as one only holding comments
+// between '---' markers
+func isEmpty(root *yaml.Node) bool {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return true
+	}
+	node := root.Content[0]
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null" && node.Value == ""
+}
+
+// formatDocument formats the mapping of a PolicyDomain or PolicyDomainReference document
+func formatDocument(doc *yaml.Node, opts Options) error {
+	sortKeys(doc, documentKeys)
+	if metadata := mappingValue(doc, "metadata"); metadata != nil {
+		sortKeys(metadata, []string{"name"})
+	}
+
+	if spec := mappingValue(doc, "spec"); spec != nil && spec.Kind == yaml.MappingNode {
+		sortKeys(spec, specKeys)
+		for i := 0; i+1 < len(spec.Content); i += 2 {
+			if err := formatSection(spec.Content[i].Value, spec.Content[i+1], opts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatSection(section string, node *yaml.Node, opts Options) error {
+	// the system section holds lists of rules, such as bypass and impersonation
+	if section == "system" && node.Kind == yaml.MappingNode {
+		sortKeys(node, systemKeys)
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := formatSection(section, node.Content[i], opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if node.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	for _, entity := range node.Content {
+		if entity.Kind != yaml.MappingNode {
+			continue
+		}
+		sortKeys(entity, entityKeys)
+
+		if annotations := mappingValue(entity, "annotations"); annotations != nil && annotations.Kind == yaml.SequenceNode {
+			for _, annotation := range annotations.Content {
+				if annotation.Kind == yaml.MappingNode {
+					sortKeys(annotation, annotationKeys)
+				}
+			}
+		}
+
+		for _, key := range selectorKeys[section] {
+			if selectors := mappingValue(entity, key); selectors != nil && selectors.Kind == yaml.SequenceNode {
+				for _, selector := range selectors.Content {
+					if selector.Kind == yaml.ScalarNode && policydomain.IsRegexSelector(selector.Value) {
+						selector.Value = anchorPattern(selector.Value)
+						selector.Style = yaml.DoubleQuotedStyle
+					}
+				}
+			}
+		}
+
+		if regoSections[section] {
+			if rego := mappingValue(entity, "rego"); rego != nil && rego.Kind == yaml.ScalarNode {
+				if err := formatRego(entityID(entity), rego, opts); err != nil {
+					return fmt.Errorf("%s '%s': %w", section, entityID(entity), err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func formatRego(id string, node *yaml.Node, opts Options) error {
+	if strings.TrimSpace(node.Value) == "" {
+		return nil
+	}
+
+	formatted, err := opaformat.SourceWithOpts(id+".rego", []byte(node.Value), opaformat.Opts{
+		RegoVersion:   opts.RegoVersion,
+		ParserOptions: &ast.ParserOptions{RegoVersion: opts.RegoVersion},
+	})
+	if err != nil {
+		return err
+	}
+
+	node.Value = string(formatted)
+	node.Style = yaml.LiteralStyle
+
+	return nil
+}
+
+// anchorPattern anchors a selector with ^ and $, matching the PolicyDomain parsers.
+func anchorPattern(pattern string) string {
+	if !strings.HasPrefix(pattern, "^") {
+		pattern = "^" + pattern
+	}
+	if !strings.HasSuffix(pattern, "$") {
+		pattern += "$"
+	}
+	return pattern
+}
+
+func entityID(entity *yaml.Node) string {
+	for _, key := range []string{"mrn", "name"} {
+		if v := mappingValue(entity, key); v != nil && v.Kind == yaml.ScalarNode {
+			return v.Value
+		}
+	}
+	return "entity"
+}
+
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sortKeys stably reorders the key/value pairs of a mapping so that the given keys come
+// first, in order, followed by any other keys in their original order.
+func sortKeys(m *yaml.Node, order []string) {
+	rank := make(map[string]int, len(order))
+	for i, key := range order {
+		rank[key] = i
+	}
+
+	type pair struct{ key, value *yaml.Node }
+	known := make([][]pair, len(order))
+	var unknown []pair
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		p := pair{m.Content[i], m.Content[i+1]}
+		if r, ok := rank[p.key.Value]; ok {
+			known[r] = append(known[r], p)
+		} else {
+			unknown = append(unknown, p)
+		}
+	}
+
+	content := make([]*yaml.Node, 0, len(m.Content))
+	for _, pairs := range append(known, unknown) {
+		for _, p := range pairs {
+			content = append(content, p.key, p.value)
+		}
+	}
+	m.Content = content
+}
@@ -0,0 +1,388 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package format
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+var v0 = Options{RegoVersion: ast.RegoV0}
+
+func TestFormat_KeyOrder(t *testing.T) {
+	input := `spec:
+  operations:
+    - policy: mrn:iam:policy:allow
+      selector:
+        - "^api:.*$"
+      name: api
+  policies:
+    - rego: |
+        package authz
+        default allow = true
+      name: allow
+      mrn: mrn:iam:policy:allow
+metadata:
+  name: example
+kind: PolicyDomain
+apiVersion: iamlite.manetu.io/v1alpha4
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	s := string(out)
+	assertOrder(t, s, "apiVersion:", "kind:", "metadata:", "spec:")
+	assertOrder(t, s, "policies:", "operations:")
+	assertOrder(t, s, "mrn: mrn:iam:policy:allow", "name: allow", "rego:")
+	assertOrder(t, s, "name: api", "selector:", "policy: mrn:iam:policy:allow")
+}
+
+func TestFormat_UnknownKeysKeepOrder(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  zeta: 1
+  name: example
+  alpha: 2
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+	assertOrder(t, string(out), "name: example", "zeta: 1", "alpha: 2")
+}
+
+func TestFormat_DataValuesKeepOrder(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: mrn:iam:policy:allow
+      rego: |
+        package authz
+        default allow = true
+  data:
+    - value:
+        secret: 2
+        public: 0
+        name: internal
+      name: levels
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	s := string(out)
+	assertOrder(t, s, "data:", "policies:")
+	assertOrder(t, s, "name: levels", "value:", "secret: 2", "public: 0", "name: internal")
+}
+
+func TestFormat_AnchorsSelectors(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  operations:
+    - name: api
+      selector:
+        - api:.*
+        - "^other:.*$"
+      policy: mrn:iam:policy:allow
+  resources:
+    - name: docs
+      selector:
+        - mrn:docs:.*
+        - glob:mrn:files:**
+      group: mrn:iam:resource-group:default
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	s := string(out)
+	assert.Contains(t, s, `- "^api:.*$"`)
+	assert.Contains(t, s, `- "^other:.*$"`)
+	assert.Contains(t, s, `- "^mrn:docs:.*$"`)
+	assert.Contains(t, s, "- glob:mrn:files:**\n")
+}
+
+func TestFormat_System(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  system:
+    impersonation:
+      - operations:
+          - api:documents:.*
+        subjects:
+          - glob:*@example.com
+          - .*@partner.com
+        roles:
+          - mrn:iam:role:service
+        name: on-behalf-of
+    bypass:
+      - operations:
+          - health:.*
+        reason: probes
+        name: health
+  operations:
+    - identity:
+        combining: all
+      policy: mrn:iam:policy:allow
+      selector:
+        - api:.*
+      name: api
+  resource-groups:
+    - network:
+        cidrs:
+          - 10.0.0.0/8
+      owner:
+        claim: sub
+      policy: mrn:iam:policy:allow
+      mrn: mrn:iam:resource-group:default
+  policies:
+    - mrn: mrn:iam:policy:allow
+      rego: |
+        package authz
+
+        default allow = 1
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	s := string(out)
+	assertOrder(t, s, "policies:", "resource-groups:", "operations:", "system:")
+	assert.Contains(t, s, `  resource-groups:
+    - mrn: mrn:iam:resource-group:default
+      policy: mrn:iam:policy:allow
+      owner:
+        claim: sub
+      network:
+`)
+	assert.Contains(t, s, `  operations:
+    - name: api
+      selector:
+        - "^api:.*$"
+      policy: mrn:iam:policy:allow
+      identity:
+        combining: all
+`)
+	assert.Contains(t, s, `  system:
+    bypass:
+      - name: health
+        reason: probes
+        operations:
+          - "^health:.*$"
+    impersonation:
+      - name: on-behalf-of
+        roles:
+          - mrn:iam:role:service
+        subjects:
+          - glob:*@example.com
+          - "^.*@partner.com$"
+        operations:
+          - "^api:documents:.*$"
+`)
+
+	// the formatted domain loads to the same model
+	before, err := parsers.LoadFromBytes("input", []byte(input))
+	require.NoError(t, err)
+	after, err := parsers.LoadFromBytes("formatted", out)
+	require.NoError(t, err)
+	// but for the fingerprint of the file
+	before.Fingerprint, after.Fingerprint = nil, nil
+	assert.Equal(t, before, after)
+
+	again, err := Format(out, v0)
+	require.NoError(t, err)
+	assert.Equal(t, s, string(again))
+}
+
+func TestFormat_Rego(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: mrn:iam:policy:allow
+      name: allow
+      rego: "package authz\ndefault allow=true\nallow {   input.principal.sub==\"admin\" }\n"
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	var doc struct {
+		Spec struct {
+			Policies []struct {
+				Rego string `yaml:"rego"`
+			} `yaml:"policies"`
+		} `yaml:"spec"`
+	}
+	require.NoError(t, yaml.Unmarshal(out, &doc))
+	require.Len(t, doc.Spec.Policies, 1)
+
+	rego := doc.Spec.Policies[0].Rego
+	assert.Contains(t, rego, "default allow = true")
+	assert.Contains(t, rego, `input.principal.sub == "admin"`)
+	assert.Contains(t, string(out), "rego: |", "rego should be emitted as a literal block")
+}
+
+func TestFormat_InvalidRego(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  policies:
+    - mrn: mrn:iam:policy:broken
+      name: broken
+      rego: |
+        package authz
+        allow {
+`
+
+	_, err := Format([]byte(input), v0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mrn:iam:policy:broken")
+}
+
+func TestFormat_InvalidYAML(t *testing.T) {
+	_, err := Format([]byte("spec: [unclosed"), v0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse YAML")
+}
+
+func TestFormat_PreservesComments(t *testing.T) {
+	input := `# leading comment
+apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example # the domain name
+spec:
+  operations:
+    # all api operations
+    - name: api
+      selector:
+        - "^api:.*$"
+      policy: mrn:iam:policy:allow
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	s := string(out)
+	assert.Contains(t, s, "# leading comment")
+	assert.Contains(t, s, "# the domain name")
+	assert.Contains(t, s, "# all api operations")
+}
+
+func TestFormat_AliasBeforeAnchor(t *testing.T) {
+	// canonical order moves 'policies' ahead of 'roles', and with it the alias
+	input := `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  roles:
+    - mrn: &policy mrn:iam:policy:allow
+      name: admin
+      policy: mrn:iam:policy:allow
+  policies:
+    - mrn: *policy
+      name: allow
+      rego: |
+        package authz
+
+        default allow = true
+`
+
+	_, err := Format([]byte(input), v0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "anchors or aliases")
+}
+
+func TestFormat_MultipleDocuments(t *testing.T) {
+	input := `metadata:
+  name: first
+kind: PolicyDomain
+apiVersion: iamlite.manetu.io/v1beta1
+---
+# empty
+---
+items:
+  - spec:
+      operations:
+        - selector: ["api:.*"]
+          name: api
+    metadata:
+      name: second
+    kind: PolicyDomain
+kind: PolicyDomainList
+apiVersion: iamlite.manetu.io/v1beta1
+`
+
+	out, err := Format([]byte(input), v0)
+	require.NoError(t, err)
+
+	docs := strings.Split(string(out), "---\n")
+	require.Len(t, docs, 2)
+	assertOrder(t, docs[0], "apiVersion:", "kind: PolicyDomain", "metadata:")
+	assertOrder(t, docs[1], "apiVersion:", "kind: PolicyDomainList", "items:", "- kind: PolicyDomain\n", "metadata:", "spec:")
+	assertOrder(t, docs[1], "name: api", "selector:")
+	assert.Contains(t, docs[1], "^api:.*$")
+
+	again, err := Format(out, v0)
+	require.NoError(t, err)
+	assert.Equal(t, string(out), string(again))
+}
+
+func TestFormat_Idempotent(t *testing.T) {
+	files, err := filepath.Glob("../../../cmd/mpe/test/*.yml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+
+		first, err := Format(data, v0)
+		if err != nil {
+			// some test fixtures are deliberately invalid
+			continue
+		}
+
+		second, err := Format(first, v0)
+		require.NoError(t, err, file)
+		assert.Equal(t, string(first), string(second), "formatting %s is not idempotent", file)
+	}
+}
+
+func assertOrder(t *testing.T, s string, items ...string) {
+	t.Helper()
+
+	last := -1
+	for _, item := range items {
+		idx := strings.Index(s, item)
+		require.GreaterOrEqual(t, idx, 0, "%q not found in:\n%s", item, s)
+		assert.Greater(t, idx, last, "%q is out of order in:\n%s", item, s)
+		last = idx
+	}
+}
@@ -0,0 +1,167 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package policydomain
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// minGroupedSelectors is the number of selectors without a literal prefix from which a
+// [SelectorIndex] first tries them together, as one regular expression
+const minGroupedSelectors = 4
+
+// SelectorIndex finds the first of an ordered list of entries, such as the operations or
+// resources of a domain, with a selector matching a string, as a scan of the entries and
+// their selectors in order would, without trying most selectors.
+//
+// The literal prefix of each selector, such as "api:users:" of "^api:users:.*$", is indexed in
+// a trie, so that only the selectors whose prefix the string starts with are tried. Selectors
+// that are entirely literal are compared rather than matched, and those with no literal prefix
+// are first tried together, as a single regular expression.
+//
+// A SelectorIndex is immutable, and safe for concurrent use.
+type SelectorIndex struct {
+	root    trieNode
+	grouped *regexp.Regexp      // alternation of the unprefixed selectors, nil if too few
+	others  []indexedSelector   // selectors without a literal prefix, in order
+	size    int                 // number of selectors
+	exact   map[string]position // first of the literal selectors matching each string
+}
+
+// position of a selector, as the index of its entry and its index among the entry's selectors
+type position struct {
+	entry    int
+	selector int
+}
+
+// before reports whether p comes before q in a scan of the entries
+func (p position) before(q position) bool {
+	return p.entry < q.entry || (p.entry == q.entry && p.selector < q.selector)
+}
+
+// indexedSelector is a selector that is not entirely literal, at its position
+type indexedSelector struct {
+	position
+	re *regexp.Regexp
+}
+
+// trieNode indexes the selectors whose literal prefix is the path to the node
+type trieNode struct {
+	children  map[byte]*trieNode
+	selectors []indexedSelector // in order
+}
+
+// NewSelectorIndex indexes the selectors of entries, given in order. An entry without
+// selectors never matches.
+func NewSelectorIndex(entries [][]*regexp.Regexp) *SelectorIndex {
+	x := &SelectorIndex{exact: map[string]position{}}
+	var others []string
+	for i, selectors := range entries {
+		for j, re := range selectors {
+			x.size++
+			p := position{entry: i, selector: j}
+			prefix, complete := selectorPrefix(re)
+			switch {
+			case complete:
+				if _, ok := x.exact[prefix]; !ok {
+					x.exact[prefix] = p
+				}
+			case prefix == "":
+				x.others = append(x.others, indexedSelector{position: p, re: re})
+				others = append(others, "(?:"+re.String()+")")
+			default:
+				node := &x.root
+				for k := 0; k < len(prefix); k++ {
+					if node.children == nil {
+						node.children = map[byte]*trieNode{}
+					}
+					child, ok := node.children[prefix[k]]
+					if !ok {
+						child = &trieNode{}
+						node.children[prefix[k]] = child
+					}
+					node = child
+				}
+				node.selectors = append(node.selectors, indexedSelector{position: p, re: re})
+			}
+		}
+	}
+
+	if len(others) >= minGroupedSelectors {
+		// the alternation only fails to compile where a selector alone would not, if ever
+		x.grouped, _ = regexp.Compile(strings.Join(others, "|"))
+	}
+	return x
+}
+
+// Len returns the number of selectors indexed.
+func (x *SelectorIndex) Len() int {
+	return x.size
+}
+
+// Match returns the index of the first entry with a selector matching s, and the index of
+// that selector among the entry's selectors, or false if no selector matches s.
+func (x *SelectorIndex) Match(s string) (entry int, selector int, ok bool) {
+	best, found := x.exact[s]
+
+	// the selectors of each node, and of others, are in order, so each list is only tried
+	// until a selector after the best match so far
+	try := func(selectors []indexedSelector) {
+		for _, candidate := range selectors {
+			if found && !candidate.before(best) {
+				return
+			}
+			if candidate.re.MatchString(s) {
+				best, found = candidate.position, true
+				return
+			}
+		}
+	}
+
+	node := &x.root
+	for i := 0; node != nil; i++ {
+		try(node.selectors)
+		if i == len(s) {
+			break
+		}
+		node = node.children[s[i]]
+	}
+	if len(x.others) > 0 && (!found || x.others[0].before(best)) {
+		if x.grouped == nil || x.grouped.MatchString(s) {
+			try(x.others)
+		}
+	}
+
+	return best.entry, best.selector, found
+}
+
+// selectorPrefix returns the literal that every string matched by an anchored selector starts
+// with, and whether the selector matches that literal and nothing else
+func selectorPrefix(re *regexp.Regexp) (string, bool) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+
+	var nodes []*syntax.Regexp
+	if parsed.Op == syntax.OpConcat {
+		nodes = parsed.Sub
+	} else {
+		nodes = []*syntax.Regexp{parsed}
+	}
+	if len(nodes) == 0 || nodes[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+
+	var prefix strings.Builder
+	i := 1
+	for ; i < len(nodes) && nodes[i].Op == syntax.OpLiteral && nodes[i].Flags&syntax.FoldCase == 0; i++ {
+		prefix.WriteString(string(nodes[i].Rune))
+	}
+	complete := i == len(nodes)-1 && nodes[i].Op == syntax.OpEndText
+	return prefix.String(), complete
+}
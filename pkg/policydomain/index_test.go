@@ -0,0 +1,168 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package policydomain
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compileEntries compiles the selectors of entries
+func compileEntries(t testing.TB, entries [][]string) [][]*regexp.Regexp {
+	compiled := make([][]*regexp.Regexp, len(entries))
+	for i, selectors := range entries {
+		for _, selector := range selectors {
+			re, err := CompileSelector(selector)
+			require.NoError(t, err)
+			compiled[i] = append(compiled[i], re)
+		}
+	}
+	return compiled
+}
+
+// scan finds the first selector matching s as the backends did before indexing
+func scan(entries [][]*regexp.Regexp, s string) (int, int, bool) {
+	for i, selectors := range entries {
+		for j, re := range selectors {
+			if re.MatchString(s) {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func TestSelectorIndex_Match(t *testing.T) {
+	entries := compileEntries(t, [][]string{
+		{"exact:api:users:read", "api:users:.*"},
+		{"^api:.*:read$"},
+		{},
+		{"glob:api:groups:*", "exact:api:users:read"},
+		{"(?i)API:ADMIN:.*", "vault:.*|secret:.*"},
+		{"^$"},
+		{".*"},
+	})
+	x := NewSelectorIndex(entries)
+	assert.Equal(t, 9, x.Len())
+
+	tests := []struct {
+		s               string
+		entry, selector int
+	}{
+		{"api:users:read", 0, 0},
+		{"api:users:list", 0, 1},
+		{"api:roles:read", 1, 0},
+		{"api:groups:read", 1, 0},
+		{"api:groups:list", 3, 0},
+		{"api:admin:list", 4, 0},
+		{"vault:read", 4, 1},
+		{"", 5, 0},
+		{"other", 6, 0},
+	}
+	for _, tt := range tests {
+		entry, selector, ok := x.Match(tt.s)
+		require.True(t, ok, tt.s)
+		assert.Equal(t, [2]int{tt.entry, tt.selector}, [2]int{entry, selector}, tt.s)
+	}
+
+	x = NewSelectorIndex(entries[:4])
+	_, _, ok := x.Match("vault:read")
+	assert.False(t, ok)
+	_, _, ok = NewSelectorIndex(nil).Match("api:users:read")
+	assert.False(t, ok)
+}
+
+func TestSelectorPrefix(t *testing.T) {
+	tests := []struct {
+		selector string
+		prefix   string
+		complete bool
+	}{
+		{"api:users:.*", "api:users:", false},
+		{"exact:api:users.read", "api:users.read", true},
+		{"glob:api:*", "api:", false},
+		{"api:(read|list)", "api:", false},
+		{"(?i)api:.*", "", false},
+		{"api:.*|vault:.*", "", false},
+		{"(?m)^api:.*", "", false},
+		{"é:.*", "é:", false},
+	}
+	for _, tt := range tests {
+		re, err := CompileSelector(tt.selector)
+		require.NoError(t, err)
+		prefix, complete := selectorPrefix(re)
+		assert.Equal(t, tt.prefix, prefix, tt.selector)
+		assert.Equal(t, tt.complete, complete, tt.selector)
+	}
+}
+
+// TestSelectorIndex_Scan checks the index against a scan of generated selectors, among which
+// many share prefixes, overlap, and are shadowed
+func TestSelectorIndex_Scan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"api", "users", "groups", "read", "list", "a", "ab", ""}
+	word := func() string { return words[r.Intn(len(words))] }
+	patterns := []func() string{
+		func() string { return "exact:" + word() + ":" + word() },
+		func() string { return word() + ":" + word() + ":.*" },
+		func() string { return word() + ":.*:" + word() },
+		func() string { return "glob:" + word() + ":*" },
+		func() string { return "glob:{" + word() + "," + word() + "}:**" },
+		func() string { return ".*:" + word() },
+		func() string { return word() + "[a-z]*" },
+	}
+
+	for round := 0; round < 50; round++ {
+		var selectors [][]string
+		for i := 0; i < 1+r.Intn(20); i++ {
+			var entry []string
+			for j := 0; j < r.Intn(4); j++ {
+				entry = append(entry, patterns[r.Intn(len(patterns))]())
+			}
+			selectors = append(selectors, entry)
+		}
+		entries := compileEntries(t, selectors)
+		x := NewSelectorIndex(entries)
+
+		for i := 0; i < 100; i++ {
+			s := word() + ":" + word()
+			if r.Intn(2) == 0 {
+				s += ":" + word()
+			}
+			entry, selector, ok := x.Match(s)
+			wentry, wselector, wok := scan(entries, s)
+			require.Equal(t, fmt.Sprint(wentry, wselector, wok), fmt.Sprint(entry, selector, ok), "%q in %v", s, selectors)
+		}
+	}
+}
+
+func BenchmarkSelectorIndex(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		var selectors [][]string
+		for i := 0; i < n; i++ {
+			selectors = append(selectors, []string{fmt.Sprintf("api:service%d:.*", i), fmt.Sprintf("exact:legacy:service%d", i)})
+		}
+		selectors = append(selectors, []string{".*"})
+		entries := compileEntries(b, selectors)
+		x := NewSelectorIndex(entries)
+		operation := fmt.Sprintf("api:service%d:read", n-1)
+
+		b.Run(fmt.Sprintf("index/operations=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				x.Match(operation)
+			}
+		})
+		b.Run(fmt.Sprintf("scan/operations=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scan(entries, operation)
+			}
+		})
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"github.com/manetu/policyengine/pkg/policydomain/validation"
 )
 
-// convertValidationErrors converts validation.Error slice (reference/cycle errors)
-// to Diagnostics. File path is looked up via domainFileMap.
+// convertValidationErrors converts validation.Error slice (reference/cycle errors and
+// ambiguity warnings) to Diagnostics. File path is looked up via domainFileMap.
 // Line/column are not available for these error types (zero = unknown).
 func convertValidationErrors(errs []*validation.Error, domainFileMap map[string]string) []Diagnostic {
 	if len(errs) == 0 {
@@ -34,6 +34,9 @@ func convertValidationErrors(errs []*validation.Error, domainFileMap map[string]
 			d.Source = SourceReference
 		case "cycle":
 			d.Source = SourceCycle
+		case "ambiguity":
+			d.Source = SourceAmbiguity
+			d.Severity = SeverityWarning
 		case "rego":
 			// Rego parse errors from the validation layer lack line info;
 			// richer diagnostics come from lintRegoAST in Phase 3.
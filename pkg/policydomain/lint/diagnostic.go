@@ -62,6 +62,12 @@ const (
 	// SourceSelector indicates an invalid regular expression in a selector field
 	// on an operation, mapper, or resource entity.
 	SourceSelector Source = "selector"
+	// SourceShadow indicates an operation selector that is shadowed by, or conflicts with,
+	// a selector of an earlier operation.
+	SourceShadow Source = "shadow"
+	// SourceAmbiguity indicates an MRN defined by more than one domain, which is resolved
+	// by domain precedence at runtime.
+	SourceAmbiguity Source = "ambiguity"
 	// SourceDuplicate indicates a duplicate MRN or name within a single domain.
 	SourceDuplicate Source = "duplicate"
 	// SourceSchema indicates a missing or empty required field (e.g. metadata.name, rego).
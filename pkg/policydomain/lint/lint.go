@@ -5,6 +5,7 @@
 package lint
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"github.com/manetu/policyengine/pkg/policydomain"
 	"github.com/manetu/policyengine/pkg/policydomain/parsers"
 	"github.com/manetu/policyengine/pkg/policydomain/registry"
+	"github.com/open-policy-agent/opa/v1/ast"
 )
 
 // LintFromStrings performs all validation phases on in-memory PolicyDomain YAML
@@ -41,6 +43,11 @@ type Options struct {
 	// RegalTimeout limits how long Regal linting may run.
 	// Zero means no timeout (not recommended for untrusted input).
 	RegalTimeout time.Duration
+
+	// Builtins declares custom built-in functions registered with the policy
+	// engine (see options.WithBuiltins) so the OPA check phase accepts calls
+	// to them. Use opa.Builtin.Declaration to obtain a declaration.
+	Builtins []*ast.Builtin
 }
 
 // DefaultOptions returns the standard Options used by the mpe lint command.
@@ -149,18 +156,24 @@ func lintCore(ctx context.Context, src DataSource, opts Options) (*Result, error
 		return &Result{Diagnostics: diagnostics, FileCount: len(keys)}, nil
 	}
 
+	// Split files holding several PolicyDomain documents into units linted as files of their own
+	units, unitData, unitFiles := splitDocuments(validKeys, rawData)
+
 	// Parse domain models and build offset maps from already-read raw bytes
 	var models []*policydomain.IntermediateModel
 	domainKeyMap := make(map[string]string) // domain-name → key
 	regoOffsets := make(map[string]map[string]int)
 
-	for _, key := range validKeys {
-		data := rawData[key]
+	for _, key := range units {
+		data := unitData[key]
 
 		// Phase 1.5: Selector regex validation (runs on raw YAML before parse so
 		// entity-aware diagnostics are produced even when LoadFromBytes would fail).
 		diagnostics = append(diagnostics, lintSelectors(data, key)...)
 
+		// Phase 1.6: Operation selector shadowing and conflicts (first match wins at runtime).
+		diagnostics = append(diagnostics, lintOperationShadowing(data, key)...)
+
 		// Phase 1.75: Structural validation — duplicate MRNs and required fields.
 		diagnostics = append(diagnostics, lintStructure(data, key)...)
 
@@ -184,10 +197,10 @@ func lintCore(ctx context.Context, src DataSource, opts Options) (*Result, error
 	}
 
 	if len(models) == 0 {
-		return &Result{Diagnostics: diagnostics, FileCount: len(keys)}, nil
+		return &Result{Diagnostics: unitLocations(diagnostics, unitFiles), FileCount: len(keys)}, nil
 	}
 
-	// Phase 2: Reference and cycle validation via registry
+	// Phase 2: Reference and cycle validation, and MRNs defined by several domains, via registry
 	reg, validationErrors, err := registry.NewRegistryPermissiveFromModels(models)
 	if err != nil {
 		diagnostics = append(diagnostics, Diagnostic{
@@ -195,11 +208,12 @@ func lintCore(ctx context.Context, src DataSource, opts Options) (*Result, error
 			Severity: SeverityError,
 			Message:  err.Error(),
 		})
-		return &Result{Diagnostics: diagnostics, FileCount: len(keys)}, nil
+		return &Result{Diagnostics: unitLocations(diagnostics, unitFiles), FileCount: len(keys)}, nil
 	}
 
 	diagnostics = append(diagnostics, convertValidationErrors(validationErrors, domainKeyMap)...)
-	diagnostics = enrichReferenceLocations(diagnostics, rawData, domainKeyMap)
+	diagnostics = append(diagnostics, convertValidationErrors(reg.GetAmbiguities(), domainKeyMap)...)
+	diagnostics = enrichReferenceLocations(diagnostics, unitData, domainKeyMap)
 
 	// Phase 3: Rego syntax validation (AST parse errors with line/col)
 	diagnostics = append(diagnostics, lintRegoAST(models, domainKeyMap, regoOffsets)...)
@@ -207,7 +221,7 @@ func lintCore(ctx context.Context, src DataSource, opts Options) (*Result, error
 	// Phase 4: Full OPA compilation check (catches type errors, undefined refs, etc.)
 	if !opts.DisableOPA && reg != nil {
 		rv := regoVersionFromFlags(opts.OPAFlags)
-		diagnostics = append(diagnostics, runOPACheck(reg, models, domainKeyMap, regoOffsets, rv)...)
+		diagnostics = append(diagnostics, runOPACheck(reg, models, domainKeyMap, regoOffsets, rv, opts.Builtins)...)
 	}
 
 	// Phase 5: Regal lint (file-system only — requires reading .rego files directly)
@@ -224,7 +238,46 @@ func lintCore(ctx context.Context, src DataSource, opts Options) (*Result, error
 		}
 	}
 
-	return &Result{Diagnostics: diagnostics, FileCount: len(keys)}, nil
+	return &Result{Diagnostics: unitLocations(diagnostics, unitFiles), FileCount: len(keys)}, nil
+}
+
+// splitDocuments splits each file into its PolicyDomain documents, returning the keys of the
+// units to lint, their data, and the file of each unit that is not a file itself. A file holding
+// a single PolicyDomain document is its own unit. The data of the other units is padded to the position of
+// their document, so that the diagnostics of every phase carry the lines of the file.
+func splitDocuments(keys []string, rawData map[string][]byte) ([]string, map[string][]byte, map[string]string) {
+	var units []string
+	unitData := make(map[string][]byte, len(keys))
+	unitFiles := make(map[string]string)
+
+	for _, key := range keys {
+		// a file that fails to split is reported as failing to load
+		docs, err := parsers.SplitDocuments(rawData[key])
+		if err != nil || len(docs) == 0 || (len(docs) == 1 && bytes.Equal(docs[0].Data, rawData[key])) {
+			units = append(units, key)
+			unitData[key] = rawData[key]
+			continue
+		}
+
+		for i, doc := range docs {
+			unit := fmt.Sprintf("%s#%d", key, i+1)
+			units = append(units, unit)
+			unitData[unit] = append(bytes.Repeat([]byte("\n"), doc.Line-1), doc.Data...)
+			unitFiles[unit] = key
+		}
+	}
+
+	return units, unitData, unitFiles
+}
+
+// unitLocations locates the diagnostics of the units split from a file in the file
+func unitLocations(diagnostics []Diagnostic, unitFiles map[string]string) []Diagnostic {
+	for i, d := range diagnostics {
+		if file, ok := unitFiles[d.Location.File]; ok {
+			diagnostics[i].Location.File = file
+		}
+	}
+	return diagnostics
 }
 
 // regoVersionFromFlags parses the OPA flags string to determine rego version.
@@ -6,6 +6,7 @@ package lint
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/manetu/policyengine/pkg/policydomain/validation"
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/ast/location"
+	"github.com/open-policy-agent/opa/v1/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -353,6 +355,242 @@ func TestLint_DisableOPA(t *testing.T) {
 	assert.Empty(t, opaErrs, "OPA check errors should be absent when DisableOPA=true")
 }
 
+// ---------------------------------------------------------------------------
+// Lint() — custom built-in declarations
+// ---------------------------------------------------------------------------
+
+const customBuiltinDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: custom-builtins
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:classified"
+      rego: |
+        package authz
+        default allow = false
+        allow { classification.compare(input.principal.mannotations.clearance, input.resource.classification) >= 0 }
+  mappers:
+    - name: envoy
+      selector:
+        - ".*"
+      rego: |
+        package mapper
+        porc := {"resource": mrn.parse(input.request.path)}
+`
+
+func TestLint_Builtins(t *testing.T) {
+	file := writeTempFile(t, customBuiltinDomain)
+
+	// Without declarations both calls are undefined
+	result, err := Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	opaErrs := filterBySource(result.Diagnostics, SourceOPACheck)
+	require.Len(t, opaErrs, 2)
+	assert.Contains(t, opaErrs[0].Message+opaErrs[1].Message, "undefined function classification.compare")
+	assert.Contains(t, opaErrs[0].Message+opaErrs[1].Message, "undefined function mrn.parse")
+
+	opts := DefaultOptions()
+	opts.Builtins = []*ast.Builtin{
+		{Name: "classification.compare", Decl: types.NewFunction(types.Args(types.A, types.A), types.N)},
+		{Name: "mrn.parse", Decl: types.NewFunction(types.Args(types.S), types.A)},
+	}
+	result, err = Lint(context.Background(), []string{file}, opts)
+	require.NoError(t, err)
+	assert.Empty(t, filterBySource(result.Diagnostics, SourceOPACheck))
+
+	// Declarations are type-checked like OPA built-ins
+	opts.Builtins[1] = &ast.Builtin{Name: "mrn.parse", Decl: types.NewFunction(types.Args(types.S, types.S), types.A)}
+	result, err = Lint(context.Background(), []string{file}, opts)
+	require.NoError(t, err)
+	opaErrs = filterBySource(result.Diagnostics, SourceOPACheck)
+	require.Len(t, opaErrs, 1)
+	assert.Equal(t, "mapper", opaErrs[0].Entity.Type)
+}
+
+const fetchDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: risk
+spec:
+%s
+  policies:
+    - mrn: "mrn:iam:policy:risk"
+      name: risk
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          response := policyengine.fetch("https://risk.example.com/v1/score")
+          response.body.score < 50
+        }
+`
+
+func TestLint_Fetch(t *testing.T) {
+	// Without a fetch section the built-in is undefined
+	file := writeTempFile(t, fmt.Sprintf(fetchDomain, ""))
+	result, err := Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	opaErrs := filterBySource(result.Diagnostics, SourceOPACheck)
+	require.Len(t, opaErrs, 1)
+	assert.Contains(t, opaErrs[0].Message, "undefined function policyengine.fetch")
+
+	file = writeTempFile(t, fmt.Sprintf(fetchDomain, "  fetch:\n    allow:\n      - https://risk.example.com/v1/"))
+	result, err = Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	assert.False(t, result.HasErrors(), "%+v", result.Diagnostics)
+}
+
+const classifiedDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: vault
+spec:
+%s
+  policies:
+    - mrn: "mrn:iam:policy:clearance"
+      name: clearance
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          clearance.dominates(input.principal.mclearance, input.resource.classification)
+        }
+`
+
+func TestLint_Classifications(t *testing.T) {
+	// Without a classification lattice the built-in is undefined
+	file := writeTempFile(t, fmt.Sprintf(classifiedDomain, ""))
+	result, err := Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	opaErrs := filterBySource(result.Diagnostics, SourceOPACheck)
+	require.Len(t, opaErrs, 1)
+	assert.Contains(t, opaErrs[0].Message, "undefined function clearance.dominates")
+
+	file = writeTempFile(t, fmt.Sprintf(classifiedDomain, "  classifications:\n    levels: [LOW, HIGH]"))
+	result, err = Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	assert.False(t, result.HasErrors(), "%+v", result.Diagnostics)
+}
+
+const networkDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: office
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:office"
+      name: office
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          net.cidr_contains_ctx(["10.0.0.0/8"])
+          geo.lookup(input.context.ip).country == "US"
+        }
+  scopes:
+    - mrn: "mrn:iam:scope:office"
+      name: office
+      policy: "mrn:iam:policy:office"
+      network:
+        cidrs: [%s]
+`
+
+func TestLint_Network(t *testing.T) {
+	// The network built-ins are always declared
+	file := writeTempFile(t, fmt.Sprintf(networkDomain, "10.0.0.0/8"))
+	result, err := Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	assert.False(t, result.HasErrors(), "%+v", result.Diagnostics)
+
+	file = writeTempFile(t, fmt.Sprintf(networkDomain, "10.0.0.0/33"))
+	result, err = Lint(context.Background(), []string{file}, DefaultOptions())
+	require.NoError(t, err)
+	assert.True(t, result.HasErrors())
+}
+
+func TestLint_Calendar(t *testing.T) {
+	// The calendar built-ins are always declared
+	domain := strings.Replace(networkDomain, `geo.lookup(input.context.ip).country == "US"`, `calendar.business_hours()
+          calendar.between("09:00", "12:00")`, 1)
+	require.Contains(t, domain, "calendar.business_hours")
+	result, err := LintFromStrings(context.Background(), map[string]string{"office.yml": fmt.Sprintf(domain, "10.0.0.0/8")}, DefaultOptions())
+	require.NoError(t, err)
+	assert.False(t, result.HasErrors(), "%+v", result.Diagnostics)
+
+	domain = strings.Replace(domain, `calendar.between("09:00", "12:00")`, `calendar.between("09:00")`, 1)
+	result, err = LintFromStrings(context.Background(), map[string]string{"office.yml": fmt.Sprintf(domain, "10.0.0.0/8")}, DefaultOptions())
+	require.NoError(t, err)
+	assert.True(t, result.HasErrors())
+}
+
+const ambiguousDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: %s
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow"
+      rego: |
+        package authz
+        default allow = true
+  roles:
+    - mrn: "mrn:iam:role:shared"
+      name: shared
+      policy: "mrn:iam:policy:allow"
+`
+
+func TestLint_Ambiguities(t *testing.T) {
+	result, err := LintFromStrings(context.Background(), map[string]string{
+		"a.yml": fmt.Sprintf(ambiguousDomain, "a"),
+		"b.yml": fmt.Sprintf(ambiguousDomain, "b"),
+	}, Options{DisableOPA: true})
+	require.NoError(t, err)
+	assert.False(t, result.HasErrors(), "%+v", result.Diagnostics)
+
+	warnings := filterBySource(result.Diagnostics, SourceAmbiguity)
+	require.Len(t, warnings, 2)
+	for _, w := range warnings {
+		assert.Equal(t, SeverityWarning, w.Severity)
+		assert.Equal(t, "role", w.Entity.Type)
+		assert.Equal(t, "mrn:iam:role:shared", w.Entity.ID)
+		assert.Equal(t, w.Entity.Domain+".yml", w.Location.File)
+		assert.Equal(t, 12, w.Location.Start.Line)
+	}
+	assert.Equal(t, "role 'mrn:iam:role:shared' is also defined in domain 'b'", warnings[0].Message)
+}
+
+func TestLint_MultipleDocuments(t *testing.T) {
+	// each document is linted as a domain of its own, located in the lines of the file
+	broken := strings.Replace(fmt.Sprintf(ambiguousDomain, "c"), "default allow = true", "default allow = ", 1)
+	bundle := fmt.Sprintf(ambiguousDomain, "a") + "---\n" + fmt.Sprintf(ambiguousDomain, "b") + "---\n" + broken
+	result, err := LintFromStrings(context.Background(), map[string]string{"bundle.yml": bundle}, Options{DisableOPA: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.FileCount)
+
+	warnings := filterBySource(result.Diagnostics, SourceAmbiguity)
+	require.NotEmpty(t, warnings)
+	lines := map[string]int{}
+	for _, w := range warnings {
+		assert.Equal(t, "bundle.yml", w.Location.File)
+		lines[w.Entity.Domain] = w.Location.Start.Line
+	}
+	assert.Equal(t, map[string]int{"a": 12, "b": 27, "c": 42}, lines)
+
+	// the third document starts on line 31
+	alone, err := LintFromStrings(context.Background(), map[string]string{"c.yml": broken}, Options{DisableOPA: true})
+	require.NoError(t, err)
+	expected := filterBySource(alone.Diagnostics, SourceRego)
+	regoErrs := filterBySource(result.Diagnostics, SourceRego)
+	require.Len(t, regoErrs, len(expected))
+	for i, d := range regoErrs {
+		assert.Equal(t, "bundle.yml", d.Location.File)
+		if line := expected[i].Location.Start.Line; line > 0 {
+			assert.Equal(t, line+30, d.Location.Start.Line)
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Helpers
 // ---------------------------------------------------------------------------
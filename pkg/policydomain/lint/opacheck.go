@@ -6,8 +6,11 @@ package lint
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 
+	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/manetu/policyengine/pkg/policydomain"
 	"github.com/manetu/policyengine/pkg/policydomain/registry"
 	"github.com/open-policy-agent/opa/v1/ast"
@@ -33,23 +36,39 @@ func (rv regoVersion) opaVersion() ast.RegoVersion {
 // the AST parser alone does not detect.
 //
 // domainKeyMap maps domain name to its logical key (file path or name), used
-// to populate Location.File on returned diagnostics.
-func runOPACheck(reg *registry.Registry, models []*policydomain.IntermediateModel, domainKeyMap map[string]string, regoOffsets map[string]map[string]int, rv regoVersion) []Diagnostic {
+// to populate Location.File on returned diagnostics. builtins declares custom
+// built-in functions that are available in addition to the OPA built-ins.
+func runOPACheck(reg *registry.Registry, models []*policydomain.IntermediateModel, domainKeyMap map[string]string, regoOffsets map[string]map[string]int, rv regoVersion, builtins []*ast.Builtin) []Diagnostic {
 	var diagnostics []Diagnostic
 
 	parserOpts := ast.ParserOptions{RegoVersion: rv.opaVersion()}
+	check := moduleChecker{regoOffsets: regoOffsets}
+	// the engine registers the network and calendar built-ins with every compiler
+	engineBuiltins := append(opa.NetworkDeclarations(), opa.CalendarDeclarations()...)
+	check.builtins = make(map[string]*ast.Builtin, len(builtins)+len(engineBuiltins))
+	for _, b := range append(engineBuiltins, builtins...) {
+		check.builtins[b.Name] = b
+	}
 
 	// Parse all libraries first (needed as dependencies for policies)
 	allLibraries := collectAllLibraries(models, domainKeyMap, parserOpts)
 
-	// Check all libraries together
-	diagnostics = append(diagnostics, checkModuleGroup(allLibraries, regoOffsets)...)
+	// Check all libraries together. Libraries may call policyengine.fetch and clearance.dominates
+	// on behalf of policies, so each is declared when any domain declares it.
+	libraryCheck := check
+	if slices.ContainsFunc(models, func(m *policydomain.IntermediateModel) bool { return !m.Fetch.IsZero() }) {
+		libraryCheck = libraryCheck.withBuiltin(opa.FetchDeclaration())
+	}
+	if slices.ContainsFunc(models, func(m *policydomain.IntermediateModel) bool { return !m.Classifications.IsZero() }) {
+		libraryCheck = libraryCheck.withBuiltin(opa.DominatesDeclaration())
+	}
+	diagnostics = append(diagnostics, libraryCheck.group(allLibraries)...)
 
 	// Check each policy with its resolved library dependencies
-	diagnostics = append(diagnostics, checkPoliciesWithDeps(models, domainKeyMap, reg, parserOpts, regoOffsets)...)
+	diagnostics = append(diagnostics, checkPoliciesWithDeps(models, domainKeyMap, reg, parserOpts, check)...)
 
 	// Check each mapper individually
-	diagnostics = append(diagnostics, checkMappers(models, domainKeyMap, parserOpts, regoOffsets)...)
+	diagnostics = append(diagnostics, checkMappers(models, domainKeyMap, parserOpts, check)...)
 
 	return diagnostics
 }
@@ -84,8 +103,22 @@ func collectAllLibraries(models []*policydomain.IntermediateModel, domainKeyMap
 	return result
 }
 
-// checkModuleGroup compiles a group of modules together and returns diagnostics.
-func checkModuleGroup(modules []parsedModule, regoOffsets map[string]map[string]int) []Diagnostic {
+// moduleChecker compiles groups of modules with a common configuration.
+type moduleChecker struct {
+	regoOffsets map[string]map[string]int
+	builtins    map[string]*ast.Builtin
+}
+
+// withBuiltin returns a copy of the checker that also declares b.
+func (mc moduleChecker) withBuiltin(b *ast.Builtin) moduleChecker {
+	builtins := make(map[string]*ast.Builtin, len(mc.builtins)+1)
+	maps.Copy(builtins, mc.builtins)
+	builtins[b.Name] = b
+	return moduleChecker{regoOffsets: mc.regoOffsets, builtins: builtins}
+}
+
+// group compiles a group of modules together and returns diagnostics.
+func (mc moduleChecker) group(modules []parsedModule) []Diagnostic {
 	if len(modules) == 0 {
 		return nil
 	}
@@ -96,22 +129,35 @@ func checkModuleGroup(modules []parsedModule, regoOffsets map[string]map[string]
 	}
 
 	compiler := ast.NewCompiler()
+	if mc.builtins != nil {
+		compiler = compiler.WithBuiltins(mc.builtins)
+	}
 	compiler.Compile(parsed)
 	if !compiler.Failed() {
 		return nil
 	}
 
-	return convertCompilerErrors(compiler.Errors, modules, regoOffsets)
+	return convertCompilerErrors(compiler.Errors, modules, mc.regoOffsets)
 }
 
 // checkPoliciesWithDeps checks each policy together with its resolved library deps.
-func checkPoliciesWithDeps(models []*policydomain.IntermediateModel, domainKeyMap map[string]string, reg *registry.Registry, opts ast.ParserOptions, regoOffsets map[string]map[string]int) []Diagnostic {
+func checkPoliciesWithDeps(models []*policydomain.IntermediateModel, domainKeyMap map[string]string, reg *registry.Registry, opts ast.ParserOptions, check moduleChecker) []Diagnostic {
 	var diagnostics []Diagnostic
 	domains := reg.GetDomains()
 
 	for _, domain := range models {
 		key := domainKeyMap[domain.Name]
 
+		// policyengine.fetch and clearance.dominates are only available to the policies of
+		// domains that allow fetching and declare a classification lattice
+		domainCheck := check
+		if !domain.Fetch.IsZero() {
+			domainCheck = domainCheck.withBuiltin(opa.FetchDeclaration())
+		}
+		if !domain.Classifications.IsZero() {
+			domainCheck = domainCheck.withBuiltin(opa.DominatesDeclaration())
+		}
+
 		for policyID, policy := range domain.Policies {
 			if strings.TrimSpace(policy.Rego) == "" {
 				continue
@@ -152,7 +198,7 @@ func checkPoliciesWithDeps(models []*policydomain.IntermediateModel, domainKeyMa
 				}
 			}
 
-			diagnostics = append(diagnostics, checkModuleGroup(group, regoOffsets)...)
+			diagnostics = append(diagnostics, domainCheck.group(group)...)
 		}
 	}
 
@@ -160,7 +206,7 @@ func checkPoliciesWithDeps(models []*policydomain.IntermediateModel, domainKeyMa
 }
 
 // checkMappers checks each mapper individually.
-func checkMappers(models []*policydomain.IntermediateModel, domainKeyMap map[string]string, opts ast.ParserOptions, regoOffsets map[string]map[string]int) []Diagnostic {
+func checkMappers(models []*policydomain.IntermediateModel, domainKeyMap map[string]string, opts ast.ParserOptions, check moduleChecker) []Diagnostic {
 	var diagnostics []Diagnostic
 
 	for _, domain := range models {
@@ -184,7 +230,7 @@ func checkMappers(models []*policydomain.IntermediateModel, domainKeyMap map[str
 				entity: Entity{Domain: domain.Name, Type: "mapper", ID: mapperID, Field: "rego"},
 				module: m,
 			}}
-			diagnostics = append(diagnostics, checkModuleGroup(group, regoOffsets)...)
+			diagnostics = append(diagnostics, check.group(group)...)
 		}
 	}
 
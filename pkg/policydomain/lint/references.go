@@ -11,7 +11,7 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-// enrichReferenceLocations post-processes reference and cycle diagnostics to
+// enrichReferenceLocations post-processes reference and ambiguity diagnostics to
 // populate line/column positions by walking the raw YAML node tree for each
 // affected file.
 //
@@ -21,7 +21,7 @@ import (
 func enrichReferenceLocations(diagnostics []Diagnostic, rawData map[string][]byte, domainKeyMap map[string]string) []Diagnostic {
 	for i := range diagnostics {
 		d := &diagnostics[i]
-		if d.Source != SourceReference {
+		if d.Source != SourceReference && d.Source != SourceAmbiguity {
 			continue
 		}
 		if d.Location.Start.Line != 0 {
@@ -0,0 +1,279 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lint
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/manetu/policyengine/pkg/policydomain"
+)
+
+// maxSelectorStates bounds the product-automaton exploration of a selector comparison.
+// Comparisons that exceed it are reported as unknown rather than risking a slow lint.
+const maxSelectorStates = 10000
+
+// selectorRelation describes how the set of strings matched by one selector relates to another.
+type selectorRelation struct {
+	Covered  bool // every string matched by the first selector is matched by the second
+	Overlaps bool // at least one string is matched by both selectors
+}
+
+// compareSelectors compares the languages of two selector patterns, as evaluated at runtime
+// with regexp.MatchString after translation to an anchored regex.
+//
+// ok is false when either pattern uses a construct the analysis does not model (case
+// folding, word boundaries, multi-line anchors) or when the comparison is too large; in that
+// case no conclusion should be drawn.
+func compareSelectors(a, b string) (rel selectorRelation, ok bool) {
+	pa, ok := compileSelectorProg(a)
+	if !ok {
+		return rel, false
+	}
+	pb, ok := compileSelectorProg(b)
+	if !ok {
+		return rel, false
+	}
+
+	return compareProgs(pa, pb)
+}
+
+// compileSelectorProg compiles an anchored selector into an NFA program, reporting whether it
+// only uses instructions supported by the analysis.
+func compileSelectorProg(pattern string) (*syntax.Prog, bool) {
+	anchored, err := policydomain.SelectorPattern(pattern)
+	if err != nil {
+		return nil, false
+	}
+	re, err := syntax.Parse(anchored, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, false
+	}
+
+	for _, inst := range prog.Inst {
+		switch inst.Op {
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^(syntax.EmptyBeginText|syntax.EmptyEndText) != 0 {
+				return nil, false
+			}
+		case syntax.InstRune:
+			if syntax.Flags(inst.Arg)&syntax.FoldCase != 0 {
+				return nil, false
+			}
+		}
+	}
+
+	return prog, true
+}
+
+// searchState is the set of NFA threads alive after consuming a prefix of the input
+// during an unanchored search, as performed by regexp.MatchString.
+type searchState struct {
+	pcs     []uint32 // sorted, deduplicated
+	matched bool     // a match has already been found, so any continuation is accepted
+}
+
+func (s searchState) key() string {
+	var sb strings.Builder
+	if s.matched {
+		sb.WriteString("M")
+	}
+	for _, pc := range s.pcs {
+		sb.WriteString(strconv.FormatUint(uint64(pc), 36))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// dead reports whether no continuation of the input can be accepted.
+func (s searchState) dead() bool {
+	return !s.matched && len(s.pcs) == 0
+}
+
+// closure adds pc and everything reachable from it without consuming input to set. EndText
+// assertions are not crossed, since the end of input is only known at acceptance time.
+// It returns true if a match instruction is reached.
+func closure(prog *syntax.Prog, pc uint32, atStart bool, atEnd bool, set map[uint32]bool) bool {
+	if set[pc] {
+		return false
+	}
+	set[pc] = true
+
+	inst := &prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstMatch:
+		return true
+	case syntax.InstAlt, syntax.InstAltMatch:
+		m := closure(prog, inst.Out, atStart, atEnd, set)
+		return closure(prog, inst.Arg, atStart, atEnd, set) || m
+	case syntax.InstCapture, syntax.InstNop:
+		return closure(prog, inst.Out, atStart, atEnd, set)
+	case syntax.InstEmptyWidth:
+		op := syntax.EmptyOp(inst.Arg)
+		if op&syntax.EmptyBeginText != 0 && !atStart {
+			return false
+		}
+		if op&syntax.EmptyEndText != 0 && !atEnd {
+			return false
+		}
+		return closure(prog, inst.Out, atStart, atEnd, set)
+	}
+
+	return false
+}
+
+// step builds the state after consuming r (or the initial state when r < 0).
+func step(prog *syntax.Prog, from searchState, r rune) searchState {
+	if from.matched {
+		return from
+	}
+
+	set := make(map[uint32]bool)
+	matched := false
+	if r >= 0 {
+		for _, pc := range from.pcs {
+			inst := &prog.Inst[pc]
+			switch inst.Op {
+			case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+				if inst.MatchRune(r) && closure(prog, inst.Out, false, false, set) {
+					matched = true
+				}
+			}
+		}
+	}
+
+	// the search may begin a new match attempt at every position
+	if closure(prog, uint32(prog.Start), r < 0, false, set) {
+		matched = true
+	}
+
+	if matched {
+		return searchState{matched: true}
+	}
+
+	pcs := make([]uint32, 0, len(set))
+	for pc := range set {
+		switch prog.Inst[pc].Op {
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL, syntax.InstEmptyWidth:
+			pcs = append(pcs, pc)
+		}
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+
+	return searchState{pcs: pcs}
+}
+
+// accepts reports whether the input consumed so far matches, given that the input ends here.
+func accepts(prog *syntax.Prog, s searchState, atStart bool) bool {
+	if s.matched {
+		return true
+	}
+
+	set := make(map[uint32]bool)
+	for _, pc := range s.pcs {
+		if prog.Inst[pc].Op == syntax.InstEmptyWidth && closure(prog, pc, atStart, true, set) {
+			return true
+		}
+	}
+
+	// an empty match attempt at the end of the input
+	return closure(prog, uint32(prog.Start), atStart, true, set)
+}
+
+// representativeRunes partitions the rune space into intervals over which every rune
+// instruction of both programs behaves identically, returning one rune per interval.
+func representativeRunes(progs ...*syntax.Prog) []rune {
+	bounds := map[rune]bool{0: true}
+	for _, prog := range progs {
+		for _, inst := range prog.Inst {
+			switch inst.Op {
+			case syntax.InstRune:
+				for i := 0; i+1 < len(inst.Rune); i += 2 {
+					bounds[inst.Rune[i]] = true
+					bounds[inst.Rune[i+1]+1] = true
+				}
+				if len(inst.Rune) == 1 {
+					bounds[inst.Rune[0]] = true
+					bounds[inst.Rune[0]+1] = true
+				}
+			case syntax.InstRune1:
+				bounds[inst.Rune[0]] = true
+				bounds[inst.Rune[0]+1] = true
+			case syntax.InstRuneAnyNotNL:
+				bounds['\n'] = true
+				bounds['\n'+1] = true
+			}
+		}
+	}
+
+	runes := make([]rune, 0, len(bounds))
+	for r := range bounds {
+		if r <= unicode.MaxRune {
+			runes = append(runes, r)
+		}
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+	return runes
+}
+
+// compareProgs explores the product of the two search automata over representative runes.
+func compareProgs(a, b *syntax.Prog) (rel selectorRelation, ok bool) {
+	type pair struct {
+		a, b    searchState
+		atStart bool
+	}
+
+	runes := representativeRunes(a, b)
+	start := pair{a: step(a, searchState{}, -1), b: step(b, searchState{}, -1), atStart: true}
+
+	rel.Covered = true
+	visited := map[string]bool{}
+	queue := []pair{start}
+	for len(queue) > 0 {
+		if len(visited) > maxSelectorStates {
+			return rel, false
+		}
+
+		p := queue[0]
+		queue = queue[1:]
+
+		key := p.a.key() + "|" + p.b.key() + "|" + strconv.FormatBool(p.atStart)
+		if visited[key] {
+			continue
+		}
+		visited[key] = true
+
+		acceptA, acceptB := accepts(a, p.a, p.atStart), accepts(b, p.b, p.atStart)
+		if acceptA && acceptB {
+			rel.Overlaps = true
+		}
+		if acceptA && !acceptB {
+			rel.Covered = false
+		}
+		if rel.Overlaps && !rel.Covered {
+			break
+		}
+
+		// nothing further can change the outcome along this path
+		if p.a.dead() || (p.a.matched && p.b.matched) {
+			continue
+		}
+
+		for _, r := range runes {
+			queue = append(queue, pair{a: step(a, p.a, r), b: step(b, p.b, r)})
+		}
+	}
+
+	return rel, true
+}
@@ -7,16 +7,18 @@ package lint
 import (
 	"fmt"
 	"regexp"
-	"strings"
+	"regexp/syntax"
 
+	"github.com/manetu/policyengine/pkg/policydomain"
 	"gopkg.in/yaml.v3"
 )
 
-// lintSelectors validates selector regex patterns on operations, mappers, and
+// lintSelectors validates selector patterns on operations, mappers, and
 // resources within a raw PolicyDomain YAML document.
 //
 // It walks the YAML node tree to find selector sequences and attempts to compile
-// each pattern, emitting a structured Diagnostic for any invalid regex. This
+// each pattern, emitting a structured Diagnostic for any invalid regex or glob, and
+// a warning for any regex with a catastrophic construct. This
 // phase runs on the raw bytes before LoadFromBytes so that entity-aware
 // diagnostics (with entity type, ID, and YAML line number) are produced even
 // when the full parse would fail due to the bad pattern.
@@ -78,23 +80,38 @@ func lintSelectors(data []byte, key string) []Diagnostic {
 				if sel.Kind != yaml.ScalarNode {
 					continue
 				}
-				pattern := selectorAnchorPattern(sel.Value)
+				diagnostic := Diagnostic{
+					Source:   SourceSelector,
+					Severity: SeverityError,
+					Location: Location{
+						File:  key,
+						Start: Position{Line: sel.Line, Column: sel.Column},
+					},
+					Entity: Entity{
+						Domain: domainName,
+						Type:   section.entityType,
+						ID:     entityID,
+						Field:  "selector",
+					},
+				}
+				pattern, err := policydomain.SelectorPattern(sel.Value)
+				if err != nil {
+					diagnostic.Message = err.Error()
+					diagnostics = append(diagnostics, diagnostic)
+					continue
+				}
 				if _, err := regexp.Compile(pattern); err != nil {
-					diagnostics = append(diagnostics, Diagnostic{
-						Source:   SourceSelector,
-						Severity: SeverityError,
-						Location: Location{
-							File:  key,
-							Start: Position{Line: sel.Line, Column: sel.Column},
-						},
-						Entity: Entity{
-							Domain: domainName,
-							Type:   section.entityType,
-							ID:     entityID,
-							Field:  "selector",
-						},
-						Message: fmt.Sprintf("invalid selector regex %q: %s", sel.Value, err.Error()),
-					})
+					diagnostic.Message = fmt.Sprintf("invalid selector regex %q: %s", sel.Value, err.Error())
+					diagnostics = append(diagnostics, diagnostic)
+					continue
+				}
+				if !policydomain.IsRegexSelector(sel.Value) {
+					continue
+				}
+				if construct := catastrophicConstruct(pattern); construct != "" {
+					diagnostic.Severity = SeverityWarning
+					diagnostic.Message = fmt.Sprintf("selector %q %s", sel.Value, construct)
+					diagnostics = append(diagnostics, diagnostic)
 				}
 			}
 		}
@@ -103,15 +120,51 @@ func lintSelectors(data []byte, key string) []Diagnostic {
 	return diagnostics
 }
 
-// selectorAnchorPattern ensures the pattern is anchored with ^ and $,
-// matching the behaviour of the v1alpha3/v1alpha4/v1beta1 parsers.
-func selectorAnchorPattern(pattern string) string {
-	result := pattern
-	if !strings.HasPrefix(result, "^") {
-		result = "^" + result
+// maxSelectorRepeat is the largest count of a counted repetition that a selector may use
+// without a warning. RE2 expands counted repetitions into copies of their operand.
+const maxSelectorRepeat = 100
+
+// catastrophicConstruct describes the first construct of an anchored selector regex that
+// backtracking regex engines evaluate in exponential time, or that inflates the compiled
+// program, or returns "" if there is none.
+//
+// The engine itself evaluates selectors with RE2 in linear time, but selectors are commonly
+// shared with other tools, and such constructs usually signal a pattern that matches more
+// than intended.
+func catastrophicConstruct(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return findCatastrophic(re, false)
+}
+
+// findCatastrophic walks re, where outer reports whether a repetition encloses it
+func findCatastrophic(re *syntax.Regexp, outer bool) string {
+	if isRepetition(re) {
+		if outer {
+			return "nests a repetition inside another repetition, which backtracking regex engines may evaluate in exponential time"
+		}
+		if n := max(re.Min, re.Max); re.Op == syntax.OpRepeat && n > maxSelectorRepeat {
+			return fmt.Sprintf("repeats a pattern %d times, more than %d, which expands into as many copies of it", n, maxSelectorRepeat)
+		}
+		outer = true
 	}
-	if !strings.HasSuffix(result, "$") {
-		result = result + "$"
+	for _, sub := range re.Sub {
+		if construct := findCatastrophic(sub, outer); construct != "" {
+			return construct
+		}
+	}
+	return ""
+}
+
+// isRepetition reports whether re may match its operand more than once
+func isRepetition(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		return true
+	case syntax.OpRepeat:
+		return re.Max == -1 || re.Max > 1
 	}
-	return result
+	return false
 }
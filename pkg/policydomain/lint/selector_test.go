@@ -262,18 +262,49 @@ func TestLintSelectors_EmptyInputReturnsNoDiagnostics(t *testing.T) {
 	assert.Empty(t, diags)
 }
 
-// ---------------------------------------------------------------------------
-// selectorAnchorPattern unit tests
-// ---------------------------------------------------------------------------
+func TestLintSelectors_GlobAndExactSelectors(t *testing.T) {
+	yaml := domainWithInvalidSelector("resource", "files", "glob:mrn:files:**")
+	assert.Empty(t, lintSelectors([]byte(yaml), "test.yml"))
+
+	yaml = domainWithInvalidSelector("operation", "read", "exact:api:(read")
+	assert.Empty(t, lintSelectors([]byte(yaml), "test.yml"))
+}
+
+func TestLintSelectors_InvalidGlobSelector(t *testing.T) {
+	yaml := domainWithInvalidSelector("operation", "my-op", "glob:api:{users,groups:*")
+	diags := lintSelectors([]byte(yaml), "test.yml")
 
-func TestSelectorAnchorPattern_AddsAnchors(t *testing.T) {
-	assert.Equal(t, "^foo$", selectorAnchorPattern("foo"))
+	require.Len(t, diags, 1)
+	assert.Equal(t, SeverityError, diags[0].Severity)
+	assert.Equal(t, "my-op", diags[0].Entity.ID)
+	assert.Contains(t, diags[0].Message, "invalid glob selector")
+	assert.Contains(t, diags[0].Message, "unmatched '{'")
 }
 
-func TestSelectorAnchorPattern_PreservesExistingAnchors(t *testing.T) {
-	assert.Equal(t, "^foo$", selectorAnchorPattern("^foo$"))
-	assert.Equal(t, "^foo$", selectorAnchorPattern("^foo"))
-	assert.Equal(t, "^foo$", selectorAnchorPattern("foo$"))
+func TestLintSelectors_CatastrophicSelector(t *testing.T) {
+	tests := []struct {
+		pattern string
+		message string
+	}{
+		{"api:(a+)+", `selector "api:(a+)+" nests a repetition inside another repetition`},
+		{"(.*:)*read", "nests a repetition"},
+		{"(?:[a-z]{2,}:)+read", "nests a repetition"},
+		{"api:[a-z]{1,500}", "repeats a pattern 500 times, more than 100"},
+	}
+
+	for _, tt := range tests {
+		yaml := domainWithInvalidSelector("operation", "op", tt.pattern)
+		diags := lintSelectors([]byte(yaml), "test.yml")
+		require.Len(t, diags, 1, tt.pattern)
+		assert.Equal(t, SourceSelector, diags[0].Source)
+		assert.Equal(t, SeverityWarning, diags[0].Severity)
+		assert.Contains(t, diags[0].Message, tt.message, tt.pattern)
+	}
+
+	for _, pattern := range []string{"api:.*:read", "(api|iam):[a-z]+", "(ab)?c*", "[0-9]{3}-[0-9]{4}"} {
+		yaml := domainWithInvalidSelector("operation", "op", pattern)
+		assert.Empty(t, lintSelectors([]byte(yaml), "test.yml"), pattern)
+	}
 }
 
 // ---------------------------------------------------------------------------
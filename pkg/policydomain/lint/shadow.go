@@ -0,0 +1,150 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lint
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// operationSelector is a single selector of an operation.
+type operationSelector struct {
+	operation string
+	policy    string // as written in the YAML
+	qualified string // policy qualified with the domain name, for comparison
+	pattern   string
+}
+
+// lintOperationShadowing detects ordering problems among the operation selectors of a raw
+// PolicyDomain YAML document.
+//
+// Operations are matched in declaration order and the first matching selector wins, so:
+//   - a selector whose every match is already matched by a selector of an earlier operation
+//     is shadowed and can never route a request (e.g. "alpha:.*" after ".*"), and
+//   - a selector that partially overlaps a selector of an earlier operation bound to a
+//     different policy routes the overlapping requests to the earlier policy, which is
+//     usually an ordering mistake.
+//
+// Both are reported as warnings. Selectors using regex features the analysis does not model
+// are skipped rather than reported.
+func lintOperationShadowing(data []byte, key string) []Diagnostic {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		// YAML syntax errors are reported by lintYAML; nothing to do here.
+		return nil
+	}
+
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+
+	doc := root.Content[0]
+
+	domainName := ""
+	if meta := findMappingValue(doc, "metadata"); meta != nil {
+		domainName = findScalarValue(meta, "name")
+	}
+
+	spec := findMappingValue(doc, "spec")
+	if spec == nil || spec.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	operations := findMappingValue(spec, "operations")
+	if operations == nil || operations.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	var diagnostics []Diagnostic
+	var earlier []operationSelector
+
+	for i, item := range operations.Content {
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		name := findScalarValue(item, "name")
+		if name == "" {
+			name = fmt.Sprintf("operation[%d]", i)
+		}
+		policy := findScalarValue(item, "policy")
+		qualified := qualifyPolicy(policy, domainName)
+
+		selectorNode := findMappingValue(item, "selector")
+		if selectorNode == nil || selectorNode.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		var current []operationSelector
+		for _, sel := range selectorNode.Content {
+			if sel.Kind != yaml.ScalarNode {
+				continue
+			}
+			s := operationSelector{operation: name, policy: policy, qualified: qualified, pattern: sel.Value}
+			current = append(current, s)
+
+			if msg := shadowingMessage(s, earlier); msg != "" {
+				diagnostics = append(diagnostics, Diagnostic{
+					Source:   SourceShadow,
+					Severity: SeverityWarning,
+					Location: Location{
+						File:  key,
+						Start: Position{Line: sel.Line, Column: sel.Column},
+					},
+					Entity: Entity{
+						Domain: domainName,
+						Type:   "operation",
+						ID:     name,
+						Field:  "selector",
+					},
+					Message: msg,
+				})
+			}
+		}
+
+		// selectors of the same operation route to the same policy, so they only compete
+		// with those of later operations
+		earlier = append(earlier, current...)
+	}
+
+	return diagnostics
+}
+
+// shadowingMessage describes how s is affected by the selectors of earlier operations, or
+// returns "" if it is not.
+func shadowingMessage(s operationSelector, earlier []operationSelector) string {
+	var overlapping *operationSelector
+	for i := range earlier {
+		e := &earlier[i]
+		rel, ok := compareSelectors(s.pattern, e.pattern)
+		if !ok {
+			continue
+		}
+		if rel.Covered {
+			return fmt.Sprintf("selector %q is shadowed by selector %q of earlier operation '%s' and will never match",
+				s.pattern, e.pattern, e.operation)
+		}
+		if rel.Overlaps && e.qualified != s.qualified && overlapping == nil {
+			overlapping = e
+		}
+	}
+
+	if overlapping != nil {
+		return fmt.Sprintf("selector %q overlaps selector %q of earlier operation '%s', which routes the overlapping operations to policy '%s' instead of '%s'",
+			s.pattern, overlapping.pattern, overlapping.operation, overlapping.policy, s.policy)
+	}
+
+	return ""
+}
+
+// qualifyPolicy converts a policy reference to its domain-qualified form so that equivalent
+// references compare equal.
+func qualifyPolicy(policy, domain string) string {
+	if policy == "" || strings.Contains(policy, "/") {
+		return policy
+	}
+	return domain + "/" + policy
+}
@@ -0,0 +1,132 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package lint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareSelectors(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		covered  bool
+		overlaps bool
+	}{
+		{"alpha:.*", ".*", true, true},
+		{".*", "alpha:.*", false, true},
+		{"alpha:read", "alpha:.*", true, true},
+		{"alpha:.*", "beta:.*", false, false},
+		{"alpha:.*", ".*:read", false, true},
+		{"api:(read|list)", "api:[a-z]+", true, true},
+		{"api:[a-z]+", "api:(read|list)", false, true},
+		{"^alpha:.*$", "alpha:.*", true, true},
+		{"alpha:.+", "alpha:.*", true, true},
+		{"alpha:.*", "alpha:.+", false, true},
+		{"(x|y)", "[xy]", true, true},
+		// anchoring binds tighter than alternation: "^x|y$" matches "xz" and "zy"
+		{"x|y", "[xy]", false, true},
+		{"x|y", "x.*|.*y", true, true},
+		{"glob:api:*:read", "glob:api:**", true, true},
+		{"glob:api:**", "glob:api:*:read", false, true},
+		{"exact:api:users:read", "glob:api:{users,groups}:*", true, true},
+		{"glob:api:users:*", "exact:api:groups:read", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			rel, ok := compareSelectors(tt.a, tt.b)
+			require.True(t, ok)
+			assert.Equal(t, tt.covered, rel.Covered, "covered")
+			assert.Equal(t, tt.overlaps, rel.Overlaps, "overlaps")
+		})
+	}
+}
+
+func TestCompareSelectors_Unsupported(t *testing.T) {
+	for _, pattern := range []string{"(?i)alpha", `\balpha`, "(?m)^alpha", "[invalid", "glob:{alpha"} {
+		_, ok := compareSelectors(pattern, ".*")
+		assert.False(t, ok, pattern)
+	}
+}
+
+const shadowedOperationsDomain = `
+apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test-domain
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      rego: |
+        package authz
+        default allow = 1
+    - mrn: "mrn:iam:policy:read-only"
+      rego: |
+        package authz
+        default allow = 0
+
+  operations:
+    - name: reads
+      selector:
+        - ".*:read"
+      policy: "mrn:iam:policy:read-only"
+    - name: everything
+      selector:
+        - ".*"
+      policy: "mrn:iam:policy:allow-all"
+    - name: alpha
+      selector:
+        - "alpha:.*"
+        - "beta:read"
+      policy: "mrn:iam:policy:allow-all"
+    - name: gamma
+      selector:
+        - "gamma:.*"
+      policy: "test-domain/mrn:iam:policy:read-only"
+`
+
+func TestLintOperationShadowing(t *testing.T) {
+	diags := lintOperationShadowing([]byte(shadowedOperationsDomain), "test.yml")
+	require.Len(t, diags, 4)
+
+	// everything overlaps the earlier, differently-bound reads operation
+	assert.Equal(t, "everything", diags[0].Entity.ID)
+	assert.Contains(t, diags[0].Message, `overlaps selector ".*:read" of earlier operation 'reads'`)
+	assert.Equal(t, SeverityWarning, diags[0].Severity)
+	assert.Equal(t, SourceShadow, diags[0].Source)
+
+	assert.Equal(t, "alpha", diags[1].Entity.ID)
+	assert.Contains(t, diags[1].Message, `selector "alpha:.*" is shadowed by selector ".*" of earlier operation 'everything'`)
+	assert.Equal(t, Location{File: "test.yml", Start: Position{Line: 28, Column: 11}}, diags[1].Location)
+
+	// shadowing is reported even where the earlier selector routes to the same policy
+	assert.Contains(t, diags[2].Message, `selector "beta:read" is shadowed by selector ".*:read"`)
+
+	assert.Equal(t, "gamma", diags[3].Entity.ID)
+	assert.Contains(t, diags[3].Message, "is shadowed")
+}
+
+func TestLintOperationShadowing_SamePolicyOverlap(t *testing.T) {
+	diags := lintOperationShadowing([]byte(validSelectorDomain), "test.yml")
+	assert.Empty(t, diags)
+}
+
+func TestLint_ReportsShadowing(t *testing.T) {
+	result, err := LintFromStrings(context.Background(), map[string]string{"test.yml": shadowedOperationsDomain}, Options{DisableOPA: true})
+	require.NoError(t, err)
+
+	var shadow []Diagnostic
+	for _, d := range result.Diagnostics {
+		if d.Source == SourceShadow {
+			shadow = append(shadow, d)
+		}
+	}
+	assert.Len(t, shadow, 4)
+	assert.False(t, result.HasErrors(), "shadowing is a warning")
+}
@@ -0,0 +1,373 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+// Package migrate converts PolicyDomain and PolicyDomainReference YAML documents to a
+// newer apiVersion.
+//
+// The supported versions, oldest first, are v1alpha3, v1alpha4, and v1beta1. Migration
+// only moves forward:
+//   - v1alpha3 to v1alpha4 changes only the apiVersion, since v1alpha4 is a superset.
+//     Operations and mappers without a selector, which v1alpha4 requires, are reported.
+//   - Migrating to v1beta1 also converts annotation values from JSON-encoded strings,
+//     such as value: "[1, 2, 3]", to native YAML values, such as value: [1, 2, 3].
+//
+// The document is edited in place, so comments, anchors, and the layout of unrelated
+// content are preserved. Anything that cannot be converted automatically is left as is
+// and reported as an [Issue].
+//
+// # Usage
+//
+//	result, err := migrate.Migrate(data, migrate.V1Beta1)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	for _, issue := range result.Issues {
+//	    log.Printf("line %d: %s", issue.Line, issue.Message)
+//	}
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apiGroup is the API group of PolicyDomain documents
+const apiGroup = "iamlite.manetu.io/"
+
+// Supported API versions
+const (
+	V1Alpha3 = apiGroup + "v1alpha3"
+	V1Alpha4 = apiGroup + "v1alpha4"
+	V1Beta1  = apiGroup + "v1beta1"
+)
+
+// versions lists the supported API versions, oldest first
+var versions = []string{V1Alpha3, V1Alpha4, V1Beta1}
+
+// annotatedSections are the spec sections whose entities may carry annotations
+var annotatedSections = []string{"roles", "groups", "resource-groups", "scopes", "resources"}
+
+// Issue describes something that could not be migrated automatically.
+type Issue struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+// Result is the outcome of a migration.
+type Result struct {
+	// Data is the migrated document.
+	Data []byte
+	// From is the apiVersion of the original document.
+	From string
+	// To is the apiVersion of the migrated document.
+	To string
+	// Issues lists the content that was left unchanged and may need manual migration.
+	Issues []Issue
+}
+
+// ParseVersion resolves an API version, given either in full ("iamlite.manetu.io/v1beta1")
+// or by its version alone ("v1beta1").
+func ParseVersion(version string) (string, error) {
+	full := version
+	if !strings.Contains(version, "/") {
+		full = apiGroup + version
+	}
+	if versionIndex(full) < 0 {
+		return "", fmt.Errorf("unsupported PolicyDomain API Version %s", version)
+	}
+	return full, nil
+}
+
+func versionIndex(version string) int {
+	for i, v := range versions {
+		if v == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// Migrate converts a PolicyDomain or PolicyDomainReference document to the given apiVersion.
+//
+// Returns an error if the document is not valid YAML, is not a PolicyDomain or
+// PolicyDomainReference, holds several documents, or if either version is unsupported or the
+// target version is older than the document's.
+func Migrate(data []byte, to string) (*Result, error) {
+	to, err := ParseVersion(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if n := documents(data); n > 1 {
+		return nil, fmt.Errorf("expected one document, found %d: migrate the documents of multi-document files separately", n)
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a mapping at the document root")
+	}
+	doc := root.Content[0]
+
+	if kind := scalarValue(doc, "kind"); kind != "PolicyDomain" && kind != "PolicyDomainReference" {
+		return nil, fmt.Errorf("expected PolicyDomain or PolicyDomainReference got %s", kind)
+	}
+
+	apiVersion := mappingValue(doc, "apiVersion")
+	if apiVersion == nil || apiVersion.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("missing apiVersion")
+	}
+	from := apiVersion.Value
+
+	fromIndex, toIndex := versionIndex(from), versionIndex(to)
+	switch {
+	case fromIndex < 0:
+		return nil, fmt.Errorf("unsupported PolicyDomain API Version %s", from)
+	case toIndex < fromIndex:
+		return nil, fmt.Errorf("cannot migrate from %s to older version %s", from, to)
+	case toIndex == fromIndex:
+		return &Result{Data: data, From: from, To: to}, nil
+	}
+
+	result := &Result{From: from, To: to}
+	apiVersion.Value = to
+
+	if spec := mappingValue(doc, "spec"); spec != nil && spec.Kind == yaml.MappingNode {
+		if fromIndex < versionIndex(V1Alpha4) {
+			result.Issues = append(result.Issues, missingSelectors(spec)...)
+		}
+		if fromIndex < versionIndex(V1Beta1) && toIndex >= versionIndex(V1Beta1) {
+			result.Issues = append(result.Issues, nativeAnnotations(spec)...)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	result.Data = buf.Bytes()
+
+	return result, nil
+}
+
+// missingSelectors reports the operations and mappers of a v1alpha3 spec without selectors,
+// which are required from v1alpha4 on. Such entries never match, so there is nothing to
+// convert them to.
+func missingSelectors(spec *yaml.Node) []Issue {
+	var issues []Issue
+	for _, section := range []string{"operations", "mappers"} {
+		entities := mappingValue(spec, section)
+		if entities == nil || entities.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		for _, entity := range entities.Content {
+			if entity.Kind != yaml.MappingNode {
+				continue
+			}
+			if selector := mappingValue(entity, "selector"); selector == nil || len(selector.Content) == 0 {
+				issues = append(issues, Issue{
+					Line:   entity.Line,
+					Column: entity.Column,
+					Message: fmt.Sprintf("%s '%s' has no selector, which is required from v1alpha4; it never matches and should be given a selector or removed",
+						strings.TrimSuffix(section, "s"), scalarValue(entity, "name")),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+// nativeAnnotations converts the JSON-encoded annotation values of a v1alpha spec to native
+// YAML values, returning the values it left unchanged.
+func nativeAnnotations(spec *yaml.Node) []Issue {
+	var issues []Issue
+	for _, section := range annotatedSections {
+		entities := mappingValue(spec, section)
+		if entities == nil || entities.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		for _, entity := range entities.Content {
+			if entity.Kind != yaml.MappingNode {
+				continue
+			}
+			annotations := mappingValue(entity, "annotations")
+			if annotations == nil || annotations.Kind != yaml.SequenceNode {
+				continue
+			}
+
+			for _, annotation := range annotations.Content {
+				if annotation.Kind != yaml.MappingNode {
+					continue
+				}
+				for i := 0; i+1 < len(annotation.Content); i += 2 {
+					if annotation.Content[i].Value != "value" {
+						continue
+					}
+					if issue := nativeValue(annotation.Content[i+1], scalarValue(annotation, "name")); issue != nil {
+						issues = append(issues, *issue)
+					}
+				}
+			}
+		}
+	}
+	return issues
+}
+
+// nativeValue replaces a JSON-encoded annotation value with its native YAML form
+func nativeValue(value *yaml.Node, name string) *Issue {
+	issue := func(format string, args ...any) *Issue {
+		return &Issue{
+			Line:    value.Line,
+			Column:  value.Column,
+			Message: fmt.Sprintf("annotation '%s': ", name) + fmt.Sprintf(format, args...),
+		}
+	}
+
+	switch {
+	case value.Kind == yaml.AliasNode:
+		// converting the anchored node would also change its other uses
+		return issue("value is an alias and must be converted manually")
+	case value.Kind != yaml.ScalarNode:
+		return issue("value is not a JSON-encoded string")
+	}
+
+	node, err := jsonToNode(value.Value)
+	if err != nil {
+		// v1alpha treats values that are not valid JSON as plain strings, as does v1beta1
+		return nil
+	}
+
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" && json.Valid([]byte(node.Value)) {
+		// v1beta1 decodes string values that are themselves valid JSON, so the string
+		// must stay JSON-encoded to keep its meaning
+		return nil
+	}
+
+	node.Anchor = value.Anchor
+	node.HeadComment = value.HeadComment
+	node.LineComment = value.LineComment
+	node.FootComment = value.FootComment
+	*value = *node
+
+	return nil
+}
+
+// jsonToNode decodes a JSON document into an equivalent YAML node, preserving the order of
+// object keys and the text of numbers
+func jsonToNode(text string) (*yaml.Node, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+
+	node, err := decodeNode(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return node, nil
+}
+
+func decodeNode(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if t == '{' {
+			node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for dec.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			child, err := decodeNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if flat(node) {
+			node.Style = yaml.FlowStyle
+		}
+		return node, nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(t.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: t.String()}, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: t}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: fmt.Sprint(t)}, nil
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+}
+
+// flat reports whether a collection holds only scalars, and so reads best in flow style
+func flat(node *yaml.Node) bool {
+	for _, child := range node.Content {
+		if child.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
+
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarValue(m *yaml.Node, key string) string {
+	if v := mappingValue(m, key); v != nil && v.Kind == yaml.ScalarNode {
+		return v.Value
+	}
+	return ""
+}
+
+// documents counts the non-empty YAML documents of the data, up to the first that fails to parse
+func documents(data []byte) int {
+	n := 0
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var root yaml.Node
+		if err := dec.Decode(&root); err != nil {
+			return n
+		}
+		if len(root.Content) > 0 && !(root.Content[0].Tag == "!!null" && root.Content[0].Value == "") {
+			n++
+		}
+	}
+}
@@ -0,0 +1,253 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package migrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alpha4Domain = `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  roles:
+    - mrn: mrn:iam:role:admin
+      name: admin
+      policy: mrn:iam:policy:allow
+      annotations:
+        # the clearance level
+        - name: level
+          value: "3" # highest
+        - name: regions
+          value: "[\"us\", \"eu\"]"
+        - name: limits
+          value: "{\"daily\": 100, \"burst\": {\"size\": 5}}"
+        - name: team
+          value: "\"ops\""
+        - name: enabled
+          value: "true"
+        - name: missing
+          value: "null"
+        - name: ratio
+          value: "0.5"
+        - name: plain
+          value: "not json"
+        - name: quoted-number
+          value: "\"42\""
+`
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("v1beta1")
+	require.NoError(t, err)
+	assert.Equal(t, V1Beta1, v)
+
+	v, err = ParseVersion("iamlite.manetu.io/v1alpha4")
+	require.NoError(t, err)
+	assert.Equal(t, V1Alpha4, v)
+
+	_, err = ParseVersion("v2")
+	require.Error(t, err)
+}
+
+func TestMigrate_ToV1Beta1(t *testing.T) {
+	result, err := Migrate([]byte(alpha4Domain), "v1beta1")
+	require.NoError(t, err)
+	assert.Equal(t, V1Alpha4, result.From)
+	assert.Equal(t, V1Beta1, result.To)
+	assert.Empty(t, result.Issues)
+
+	out := string(result.Data)
+	assert.Contains(t, out, "apiVersion: iamlite.manetu.io/v1beta1")
+	assert.Contains(t, out, "value: 3 # highest")
+	assert.Contains(t, out, "# the clearance level")
+	assert.Contains(t, out, "value: [us, eu]")
+	assert.Contains(t, out, "value: ops\n")
+	assert.Contains(t, out, "value: true\n")
+	assert.Contains(t, out, "value: null\n")
+	assert.Contains(t, out, "value: 0.5\n")
+	assert.Contains(t, out, `value: "not json"`)
+	// a string that is itself JSON must stay encoded, or v1beta1 would decode it to a number
+	assert.Contains(t, out, `value: "\"42\""`)
+
+	model, err := parsers.LoadFromBytes("migrated.yml", result.Data)
+	require.NoError(t, err)
+	limits := model.Roles["mrn:iam:role:admin"].Annotations["limits"].Value
+	assert.Equal(t, map[string]interface{}{"daily": 100, "burst": map[string]interface{}{"size": 5}}, limits)
+}
+
+func TestMigrate_MultipleDocuments(t *testing.T) {
+	_, err := Migrate([]byte(alpha4Domain+"---\n"+alpha4Domain), "v1beta1")
+	assert.ErrorContains(t, err, "expected one document, found 2")
+
+	// empty documents do not count
+	_, err = Migrate([]byte("---\n"+alpha4Domain+"---\n"), "v1beta1")
+	assert.NoError(t, err)
+}
+
+func TestMigrate_V1Alpha3ToV1Alpha4(t *testing.T) {
+	input := strings.Replace(alpha4Domain, "v1alpha4", "v1alpha3", 1)
+
+	result, err := Migrate([]byte(input), "v1alpha4")
+	require.NoError(t, err)
+	assert.Equal(t, V1Alpha3, result.From)
+
+	// annotation values remain JSON-encoded in v1alpha4
+	out := string(result.Data)
+	assert.Contains(t, out, "apiVersion: iamlite.manetu.io/v1alpha4")
+	assert.Contains(t, out, `value: "[\"us\", \"eu\"]"`)
+}
+
+func TestMigrate_MissingSelector(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1alpha3
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  operations:
+    - name: unrouted
+      policy: mrn:iam:policy:allow
+    - name: api
+      selector:
+        - ".*"
+      policy: mrn:iam:policy:allow
+`
+
+	result, err := Migrate([]byte(input), V1Alpha4)
+	require.NoError(t, err)
+	require.Len(t, result.Issues, 1)
+	assert.Equal(t, 7, result.Issues[0].Line)
+	assert.Contains(t, result.Issues[0].Message, "operation 'unrouted' has no selector")
+}
+
+func TestMigrate_PreservesEffectiveAnnotations(t *testing.T) {
+	files, err := filepath.Glob("../../../cmd/mpe/test/*.yml")
+	require.NoError(t, err)
+
+	migrated := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+
+		before, err := parsers.LoadFromBytes(file, data)
+		if err != nil || before == nil {
+			// not every fixture is a valid PolicyDomain
+			continue
+		}
+
+		result, err := Migrate(data, V1Beta1)
+		require.NoError(t, err, file)
+
+		after, err := parsers.LoadFromBytes(file, result.Data)
+		require.NoError(t, err, file)
+
+		assert.Equal(t, effectiveAnnotations(t, before), effectiveAnnotations(t, after), file)
+		migrated++
+	}
+	assert.Positive(t, migrated)
+}
+
+func TestMigrate_AliasReported(t *testing.T) {
+	input := `apiVersion: iamlite.manetu.io/v1alpha4
+kind: PolicyDomain
+metadata:
+  name: example
+spec:
+  roles:
+    - mrn: mrn:iam:role:a
+      name: a
+      policy: mrn:iam:policy:allow
+      annotations:
+        - name: level
+          value: &level "3"
+    - mrn: mrn:iam:role:b
+      name: b
+      policy: mrn:iam:policy:allow
+      annotations:
+        - name: level
+          value: *level
+`
+
+	result, err := Migrate([]byte(input), V1Beta1)
+	require.NoError(t, err)
+	require.Len(t, result.Issues, 1)
+	assert.Equal(t, 18, result.Issues[0].Line)
+	assert.Contains(t, result.Issues[0].Message, "annotation 'level': value is an alias")
+
+	// the anchored value is converted, and the alias follows it
+	assert.Contains(t, string(result.Data), "value: &level 3")
+}
+
+func TestMigrate_SameVersion(t *testing.T) {
+	result, err := Migrate([]byte(alpha4Domain), V1Alpha4)
+	require.NoError(t, err)
+	assert.Equal(t, alpha4Domain, string(result.Data))
+}
+
+func TestMigrate_Errors(t *testing.T) {
+	_, err := Migrate([]byte(alpha4Domain), "v1alpha3")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "older version")
+
+	_, err = Migrate([]byte(strings.Replace(alpha4Domain, "v1alpha4", "v0", 1)), V1Beta1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported PolicyDomain API Version")
+
+	_, err = Migrate([]byte(strings.Replace(alpha4Domain, "kind: PolicyDomain", "kind: Other", 1)), V1Beta1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected PolicyDomain")
+
+	_, err = Migrate([]byte("kind: [unclosed"), V1Beta1)
+	require.Error(t, err)
+}
+
+// effectiveAnnotations returns every annotation value of a domain as the engine sees it:
+// strings are decoded as JSON when possible, matching the local backend.
+func effectiveAnnotations(t *testing.T, model *policydomain.IntermediateModel) map[string]interface{} {
+	result := make(map[string]interface{})
+	add := func(prefix string, annotations map[string]policydomain.Annotation) {
+		for name, a := range annotations {
+			v := a.Value
+			if s, ok := v.(string); ok {
+				var decoded interface{}
+				if err := json.Unmarshal([]byte(s), &decoded); err == nil {
+					v = decoded
+				}
+			}
+			// normalize numeric types
+			data, err := json.Marshal(v)
+			require.NoError(t, err)
+			var normalized interface{}
+			require.NoError(t, json.Unmarshal(data, &normalized))
+			result[prefix+"/"+name] = normalized
+		}
+	}
+
+	for mrn, r := range model.Roles {
+		add(mrn, r.Annotations)
+	}
+	for mrn, g := range model.Groups {
+		add(mrn, g.Annotations)
+	}
+	for mrn, r := range model.ResourceGroups {
+		add(mrn, r.Annotations)
+	}
+	for mrn, s := range model.Scopes {
+		add(mrn, s.Annotations)
+	}
+	for _, r := range model.Resources {
+		add(r.IDSpec.ID, r.Annotations)
+	}
+	return result
+}
@@ -15,6 +15,12 @@
 //   - [Policy]: A policy definition with Rego source code
 //   - [PolicyReference]: Reference from roles/scopes/resource-groups to policies
 //   - [Mapper]: Principal mapper for transforming external identity claims
+//   - [BypassRule]: SYSTEM phase grant for privileged roles, such as anti-lockout
+//   - [ImpersonationRule]: Roles whose principals may act on behalf of other subjects
+//   - [DataDocument]: Static data available to policies and mappers under data.<name>
+//   - [Fetch]: Outbound URLs that policies may consult with policyengine.fetch
+//   - [Classifications]: Classification lattice compared by clearance.dominates
+//   - [Condition]: Comparison of a resource attribute assigning resources to groups
 //
 // # Usage
 //
@@ -54,37 +60,129 @@ type AnnotationDefaults struct {
 	MergeStrategy string
 }
 
+// Defaults contains the decision strategy of a policy domain, applied to
+// requests whose operation the domain routes.
+type Defaults struct {
+	// Decision is the outcome when no policy applies: "deny" or "allow".
+	// Empty string defaults to "deny".
+	Decision string
+	// Combining is how phase outcomes combine: "all" or "any".
+	// Empty string defaults to "all".
+	Combining string
+}
+
+// IsZero reports whether the domain leaves both settings at their defaults.
+func (d Defaults) IsZero() bool {
+	return d.Decision == "" && d.Combining == ""
+}
+
+// Fetch contains the settings of the policyengine.fetch built-in for the
+// policies of a domain. Policies may only call the built-in when the domain
+// declares at least one allowed URL.
+type Fetch struct {
+	// Allow lists the URL prefixes that may be fetched.
+	Allow []string
+	// Timeout is the duration limit of a single request, e.g. "2s".
+	// Empty string defaults to the built-in's default timeout.
+	Timeout string
+	// CacheTTL is how long responses are reused, e.g. "1m".
+	// Empty string disables caching.
+	CacheTTL string
+}
+
+// IsZero reports whether the domain declares no fetch settings.
+func (f Fetch) IsZero() bool {
+	return len(f.Allow) == 0 && f.Timeout == "" && f.CacheTTL == ""
+}
+
+// Classifications is the classification lattice of a domain. Policies compare
+// security labels with the clearance.dominates built-in, which is only available
+// when the domain declares at least one level.
+type Classifications struct {
+	// Levels lists the classification levels, lowest first.
+	Levels []string
+	// Compartments lists the compartments that labels may carry.
+	Compartments []string
+}
+
+// IsZero reports whether the domain declares no classification lattice.
+func (c Classifications) IsZero() bool {
+	return len(c.Levels) == 0 && len(c.Compartments) == 0
+}
+
 // Policy represents a Rego policy definition parsed from YAML.
 //
 // The Ast field is nil after parsing and populated by
 // [registry.Registry.CompileAllPolicies] after validation.
 type Policy struct {
 	IDSpec       IDSpec
-	Dependencies []string // MRNs of policy libraries this policy depends on
+	Version      string   // Semantic version of a policy library, if declared
+	Dependencies []string // MRNs of policy libraries this policy depends on, each optionally pinned as mrn@constraint
 	Rego         string   // Rego source code
 	Ast          *opa.Ast // Compiled AST (populated after compilation)
 }
 
 // PolicyReference connects roles, scopes, or resource groups to their policies.
+//
+// Roles and resource groups may also reference deny policies, whose DENY overrides
+// the GRANT of any other policy evaluated for the request. Scopes and resource groups
+// may declare a network rule, admitting only requests from some networks or countries.
 type PolicyReference struct {
-	IDSpec      IDSpec
-	Policy      string                // MRN of the referenced policy
-	Default     bool                  // True if this is a default resource group
-	Annotations map[string]Annotation // Metadata available during policy evaluation
+	IDSpec          IDSpec
+	Policy          string                // MRN of the referenced policy
+	DenyPolicies    []string              // MRNs of policies whose DENY overrides every GRANT
+	Default         bool                  // True if this is a default resource group
+	Owner           *OwnerRule            // Grants the owners of a resource group's resources
+	Network         *NetworkRule          // Admits only requests from some networks or countries
+	AllowedPurposes []string              // Purposes a resource group's resources may be accessed for
+	Annotations     map[string]Annotation // Metadata available during policy evaluation
+}
+
+// OwnerRule grants access to the owner of a resource in the RESOURCE phase, without
+// evaluating the resource group's policy.
+type OwnerRule struct {
+	Claim string // Principal claim compared to the resource owner, "sub" if empty
+}
+
+// NetworkRule admits the requests whose client address, given by the PORC's context.ip,
+// is within any of the CIDRs, if any, and is located in any of the Countries, if any. The
+// policy of a scope or resource group whose rule does not admit a request is not evaluated.
+type NetworkRule struct {
+	CIDRs     []string // Networks of the client, such as "10.0.0.0/8"
+	Countries []string // ISO 3166-1 alpha-2 codes of the client's country, such as "US"
 }
 
 // Group represents a named collection of roles.
 type Group struct {
 	IDSpec      IDSpec
 	Roles       []string              // MRNs of roles in this group
+	Groups      []string              // MRNs of groups nested in this group
 	Annotations map[string]Annotation // Metadata available during policy evaluation
 }
 
 // Operation routes authorization requests to policies based on operation MRN patterns.
 type Operation struct {
-	IDSpec    IDSpec
-	Selectors []*regexp.Regexp // Patterns matching operation MRNs
-	Policy    string           // MRN of the policy to evaluate
+	IDSpec           IDSpec
+	Selectors        []*regexp.Regexp // Patterns matching operation MRNs
+	Policy           string           // MRN of the policy to evaluate
+	RequiresApproval int              // Number of approvers a GRANT requires, zero if none
+	ContextSchema    *opa.Schema      // JSON Schema the context of requests must match, nil if any
+	Identity         Identity         // How the GRANTs of the principal's roles combine
+}
+
+// Identity contains how the GRANTs of a principal's roles combine in the identity
+// phase of the requests for an operation.
+type Identity struct {
+	// Combining is "any", where the GRANT of one role suffices, or "all", where
+	// every role must GRANT. Empty string defaults to "any".
+	Combining string
+	// Minimum is the least number of roles that must GRANT. Zero defaults to one.
+	Minimum int
+}
+
+// IsZero reports whether the operation leaves both settings at their defaults.
+func (i Identity) IsZero() bool {
+	return i.Combining == "" && i.Minimum == 0
 }
 
 // Mapper transforms external identity claims into PORC principal data.
@@ -99,11 +197,59 @@ type Mapper struct {
 }
 
 // Resource matches resource MRNs to resource groups for policy evaluation.
+//
+// A conditional resource, with Conditions, instead assigns resources to its group by their
+// attributes once they are known, whatever group their MRN matched. Its selectors, if any,
+// further restrict the resources it assigns.
 type Resource struct {
-	IDSpec      IDSpec
-	Selectors   []*regexp.Regexp      // Patterns matching resource MRNs
-	Group       string                // MRN of the resource group
-	Annotations map[string]Annotation // Metadata available during policy evaluation
+	IDSpec          IDSpec
+	Selectors       []*regexp.Regexp      // Patterns matching resource MRNs
+	Group           string                // MRN of the resource group
+	Classification  string                // Classification level of matching resources
+	Compartments    []string              // Compartments of matching resources
+	AllowedPurposes []string              // Purposes matching resources may be accessed for, replacing their group's
+	Annotations     map[string]Annotation // Metadata available during policy evaluation
+	Conditions      []Condition           // Conditions on the attributes of resources assigned to the group
+}
+
+// IsConditional reports whether the resource assigns resources to its group by their attributes.
+func (r *Resource) IsConditional() bool {
+	return len(r.Conditions) > 0
+}
+
+// MatchesID reports whether any selector matches the MRN of a resource.
+func (r *Resource) MatchesID(mrn string) bool {
+	for _, selector := range r.Selectors {
+		if selector.MatchString(mrn) {
+			return true
+		}
+	}
+	return false
+}
+
+// BypassRule grants operations in the SYSTEM phase to principals with any of
+// its roles, without evaluating the operation's policy.
+type BypassRule struct {
+	Name       string           // Unique name of the rule within its domain
+	Reason     string           // Grant reason recorded in access records: PUBLIC, VISITOR, or ANTI_LOCKOUT
+	Roles      []string         // MRNs of the roles granted the bypass
+	Operations []*regexp.Regexp // Patterns matching operation MRNs; empty matches every operation
+}
+
+// ImpersonationRule permits principals with any of its roles to act on behalf of the
+// subjects it matches, as the actor of a request's act claim.
+type ImpersonationRule struct {
+	Name       string           // Unique name of the rule within its domain
+	Roles      []string         // MRNs of the roles of the actors permitted
+	Subjects   []*regexp.Regexp // Patterns matching the subjects acted for; empty matches every subject
+	Operations []*regexp.Regexp // Patterns matching operation MRNs; empty matches every operation
+}
+
+// DataDocument is a static document loaded into the OPA data tree under
+// data.<Name> for the policies, policy libraries, and mappers of its domain.
+type DataDocument struct {
+	Name  string      // Unique name of the document within its domain, a Rego identifier
+	Value interface{} // Native decoded value (object, array, string, number, or boolean)
 }
 
 // IntermediateModel is the complete representation of a parsed policy domain.
@@ -114,6 +260,7 @@ type Resource struct {
 type IntermediateModel struct {
 	Name               string                     // Policy domain name
 	AnnotationDefaults AnnotationDefaults         // Default annotation merge settings
+	Defaults           Defaults                   // Decision strategy
 	PolicyLibraries    map[string]Policy          // Reusable Rego libraries
 	Policies           map[string]Policy          // Authorization policies
 	Roles              map[string]PolicyReference // Role-to-policy bindings
@@ -123,4 +270,10 @@ type IntermediateModel struct {
 	Operations         []Operation                // Operation routing rules
 	Mappers            []Mapper                   // Principal mappers
 	Resources          []Resource                 // Resource matching rules
+	BypassRules        []BypassRule               // SYSTEM phase bypass rules
+	ImpersonationRules []ImpersonationRule        // Actors permitted to act on behalf of subjects
+	Data               []DataDocument             // Static data documents
+	Fetch              Fetch                      // Outbound fetch allowlist
+	Classifications    Classifications            // Classification lattice
+	Fingerprint        []byte                     // SHA-256 of the source YAML
 }
@@ -5,8 +5,12 @@
 package parsers
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/manetu/policyengine/pkg/policydomain"
 	"github.com/manetu/policyengine/pkg/policydomain/parsers/v1alpha3"
@@ -22,28 +26,221 @@ type Preamble struct {
 	Kind       string `yaml:"kind"`
 }
 
+// Document kinds holding policy domains
+const (
+	// KindPolicyDomain is the kind of a document holding one policy domain.
+	KindPolicyDomain = "PolicyDomain"
+	// KindPolicyDomainList is the kind of a document holding several policy domains, as a
+	// sequence of PolicyDomain documents under its 'items' key.
+	KindPolicyDomainList = "PolicyDomainList"
+)
+
+// Document is one PolicyDomain document of a YAML file.
+type Document struct {
+	// Data is the YAML of the document.
+	Data []byte
+	// Line is the line of the file on which the document starts, counting from 1.
+	Line int
+}
+
+// separatorRegex matches a line starting a new YAML document, capturing any content following
+// the marker on the same line
+var separatorRegex = regexp.MustCompile(`^---(?:[ \t]+(.*))?\r?\n?$`)
+
+// endRegex matches a line ending a YAML document
+var endRegex = regexp.MustCompile(`^\.\.\.[ \t]*\r?\n?$`)
+
+// SplitDocuments splits YAML data into its PolicyDomain documents, in order. Documents may be
+// separated by '---' lines, and a [KindPolicyDomainList] document contributes each of its items.
+// Empty documents are skipped.
+//
+// Data holding a single PolicyDomain document is returned as is, so that its fingerprint does
+// not depend on how it was loaded. The data of the other documents is their text in the file,
+// except for the items of a list, which are re-encoded and so lose their comments.
+//
+// Returns an error if a document is not valid YAML, or a list has no sequence of items.
+func SplitDocuments(data []byte) ([]Document, error) {
+	type chunk struct {
+		data []byte
+		line int
+	}
+
+	var chunks []chunk
+	var current bytes.Buffer
+	start := 1
+	flush := func(next int) {
+		chunks = append(chunks, chunk{data: bytes.Clone(current.Bytes()), line: start})
+		current.Reset()
+		start = next
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		switch m := separatorRegex.FindStringSubmatch(line); {
+		case m != nil:
+			flush(i + 2)
+			// content may follow the marker, such as a flow mapping
+			if rest := strings.TrimSpace(m[1]); rest != "" && !strings.HasPrefix(rest, "#") {
+				current.WriteString(m[1] + "\n")
+				start = i + 1
+			}
+		case endRegex.MatchString(line):
+			flush(i + 2)
+		default:
+			current.WriteString(line)
+		}
+	}
+	flush(0)
+
+	var docs []Document
+	lists, first := 0, 0
+	for i, c := range chunks {
+		// pad the document to its position, so that errors and nodes carry the lines of the file
+		var root yaml.Node
+		if err := yaml.Unmarshal(append(bytes.Repeat([]byte("\n"), c.line-1), c.data...), &root); err != nil {
+			return nil, err
+		}
+		if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+			continue
+		}
+
+		doc := root.Content[0]
+		if scalar(doc, "kind") != KindPolicyDomainList {
+			if len(docs) == 0 {
+				first = i
+			}
+			docs = append(docs, Document{Data: c.data, Line: c.line})
+			continue
+		}
+
+		lists++
+		items := value(doc, "items")
+		if items == nil || items.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("document on line %d: expected a sequence of items in %s", c.line, KindPolicyDomainList)
+		}
+		for _, item := range items.Content {
+			var buf bytes.Buffer
+			enc := yaml.NewEncoder(&buf)
+			enc.SetIndent(2)
+			if err := enc.Encode(item); err != nil {
+				return nil, fmt.Errorf("document on line %d: %w", c.line, err)
+			}
+			if err := enc.Close(); err != nil {
+				return nil, fmt.Errorf("document on line %d: %w", c.line, err)
+			}
+			docs = append(docs, Document{Data: buf.Bytes(), Line: item.Line})
+		}
+	}
+
+	// the data of a single document is the document, unless an explicit empty document precedes it
+	if len(docs) == 1 && lists == 0 && first <= 1 {
+		return []Document{{Data: data, Line: 1}}, nil
+	}
+	return docs, nil
+}
+
+// value returns the value of a key of a mapping node, or nil if the key is absent
+func value(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalar returns the value of a scalar key of a mapping node, or "" if the key is absent
+func scalar(node *yaml.Node, key string) string {
+	if v := value(node, key); v != nil && v.Kind == yaml.ScalarNode {
+		return v.Value
+	}
+	return ""
+}
+
 // LoadFromBytes loads a policy domain from raw YAML bytes.
 // The name parameter is used only for error messages.
+//
+// Returns an error if the data holds several policy domains; load those with [LoadAllFromBytes].
 func LoadFromBytes(name string, data []byte) (*policydomain.IntermediateModel, error) {
+	docs, err := SplitDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	switch len(docs) {
+	case 0:
+		// report the kind expected
+		return loadDocument(data)
+	case 1:
+		return loadDocument(docs[0].Data)
+	default:
+		return nil, fmt.Errorf("expected one PolicyDomain, found %d", len(docs))
+	}
+}
+
+// LoadAllFromBytes loads the policy domains of raw YAML bytes holding any number of
+// PolicyDomain documents, as split by [SplitDocuments], in order.
+// The name parameter is used only for error messages.
+//
+// Returns an error if no document holds a policy domain, or any document fails to load.
+func LoadAllFromBytes(name string, data []byte) ([]*policydomain.IntermediateModel, error) {
+	docs, err := SplitDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no PolicyDomain documents found")
+	}
+
+	models := make([]*policydomain.IntermediateModel, 0, len(docs))
+	for _, doc := range docs {
+		model, err := loadDocument(doc.Data)
+		if err != nil {
+			if len(docs) > 1 {
+				return nil, fmt.Errorf("document on line %d: %w", doc.Line, err)
+			}
+			return nil, err
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// loadDocument loads the policy domain of a single PolicyDomain document
+func loadDocument(data []byte) (*policydomain.IntermediateModel, error) {
 	var preamble Preamble
 	if err := yaml.Unmarshal(data, &preamble); err != nil {
 		return nil, err
 	}
 
-	if preamble.Kind != "PolicyDomain" {
+	if preamble.Kind != KindPolicyDomain {
 		return nil, fmt.Errorf("expected PolicyDomain got %s", preamble.Kind)
 	}
 
+	var (
+		model *policydomain.IntermediateModel
+		err   error
+	)
 	switch preamble.APIVersion {
 	case "iamlite.manetu.io/v1alpha3":
-		return v1alpha3.LoadFromBytes(data)
+		model, err = v1alpha3.LoadFromBytes(data)
 	case "iamlite.manetu.io/v1alpha4":
-		return v1alpha4.LoadFromBytes(data)
+		model, err = v1alpha4.LoadFromBytes(data)
 	case "iamlite.manetu.io/v1beta1":
-		return v1beta1.LoadFromBytes(data)
+		model, err = v1beta1.LoadFromBytes(data)
+	default:
+		return nil, fmt.Errorf("unsupported PolicyDomain API Version %s", preamble.APIVersion)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(data)
+	model.Fingerprint = fingerprint[:]
 
-	return nil, fmt.Errorf("unsupported PolicyDomain API Version %s", preamble.APIVersion)
+	return model, nil
 }
 
 // Load loads a policy domain from a file path.
@@ -54,3 +251,13 @@ func Load(path string) (*policydomain.IntermediateModel, error) {
 	}
 	return LoadFromBytes(path, data)
 }
+
+// LoadAll loads the policy domains of a file holding any number of PolicyDomain documents, as
+// with [LoadAllFromBytes].
+func LoadAll(path string) ([]*policydomain.IntermediateModel, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return nil, err
+	}
+	return LoadAllFromBytes(path, data)
+}
@@ -5,8 +5,10 @@
 package parsers
 
 import (
+	"crypto/sha256"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -55,6 +57,10 @@ spec:
 	assert.Len(t, model.Roles, 1)
 	assert.Len(t, model.Groups, 1)
 	assert.Len(t, model.Operations, 1)
+
+	// the fingerprint is the sha256 of the source YAML
+	fingerprint := sha256.Sum256([]byte(content))
+	assert.Equal(t, fingerprint[:], model.Fingerprint)
 }
 
 func TestLoad_V1Alpha4(t *testing.T) {
@@ -160,3 +166,141 @@ func TestLoad_EmptyFile(t *testing.T) {
 	_, err = Load(tmpFile)
 	assert.Error(t, err)
 }
+
+// domainDoc returns a minimal v1beta1 PolicyDomain document
+func domainDoc(name string) string {
+	return `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: ` + name + `
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:allow-all"
+      name: allow-all
+      rego: |
+        package authz
+        default allow = true
+`
+}
+
+func TestSplitDocuments(t *testing.T) {
+	first, second := domainDoc("first"), domainDoc("second")
+
+	// a single document is returned as is, even when marked
+	for _, data := range []string{first, "---\n" + first, "# header\n---\n" + first + "...\n"} {
+		docs, err := SplitDocuments([]byte(data))
+		require.NoError(t, err)
+		require.Len(t, docs, 1)
+		assert.Equal(t, data, string(docs[0].Data))
+		assert.Equal(t, 1, docs[0].Line)
+	}
+
+	// unless an explicit empty document precedes it
+	docs, err := SplitDocuments([]byte("---\n# generated\n---\n" + first))
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, first, string(docs[0].Data))
+	assert.Equal(t, 4, docs[0].Line)
+
+	// separated documents keep their text and position, skipping empty documents
+	data := "---\n" + first + "---\n# nothing here\n--- # the second domain\n" + second
+	docs, err = SplitDocuments([]byte(data))
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	assert.Equal(t, first, string(docs[0].Data))
+	assert.Equal(t, 2, docs[0].Line)
+	assert.Equal(t, second, string(docs[1].Data))
+	assert.Equal(t, 16, docs[1].Line)
+
+	// the items of a list are documents of their own
+	list := "apiVersion: v1\nkind: PolicyDomainList\nitems:\n" + indentItem(first) + indentItem(second)
+	docs, err = SplitDocuments([]byte(first + "---\n" + list))
+	require.NoError(t, err)
+	require.Len(t, docs, 3)
+	assert.Equal(t, first, string(docs[0].Data))
+	assert.Equal(t, 16, docs[1].Line)
+	assert.Equal(t, 27, docs[2].Line)
+	assert.Contains(t, string(docs[2].Data), "name: second")
+
+	// a list of one item is not returned as is
+	docs, err = SplitDocuments([]byte("kind: PolicyDomainList\nitems:\n" + indentItem(first)))
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, 3, docs[0].Line)
+
+	_, err = SplitDocuments([]byte("kind: PolicyDomainList\nitems: none\n"))
+	assert.ErrorContains(t, err, "expected a sequence of items")
+
+	// errors carry the line of the file
+	_, err = SplitDocuments([]byte(first + "---\ninvalid: yaml: content:\n"))
+	assert.ErrorContains(t, err, "line 13")
+
+	docs, err = SplitDocuments(nil)
+	require.NoError(t, err)
+	assert.Empty(t, docs)
+}
+
+// indentItem nests a document as an item of a list
+func indentItem(doc string) string {
+	lines := strings.Split(strings.TrimSuffix(doc, "\n"), "\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = "  - " + line
+		} else {
+			lines[i] = "    " + line
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestLoadAll(t *testing.T) {
+	first, second, third := domainDoc("first"), domainDoc("second"), domainDoc("third")
+	data := first + "---\n" + second + "---\nkind: PolicyDomainList\nitems:\n" + indentItem(third)
+
+	tmpFile := filepath.Join(t.TempDir(), "bundle.yml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(data), 0644))
+
+	models, err := LoadAll(tmpFile)
+	require.NoError(t, err)
+	require.Len(t, models, 3)
+	assert.Equal(t, "first", models[0].Name)
+	assert.Equal(t, "second", models[1].Name)
+	assert.Equal(t, "third", models[2].Name)
+	assert.Contains(t, models[2].Policies, "mrn:iam:policy:allow-all")
+
+	// separated documents are fingerprinted as if they were files of their own
+	fingerprint := sha256.Sum256([]byte(second))
+	assert.Equal(t, fingerprint[:], models[1].Fingerprint)
+
+	// a single document loads as with Load
+	models, err = LoadAllFromBytes("first", []byte(first))
+	require.NoError(t, err)
+	require.Len(t, models, 1)
+	fingerprint = sha256.Sum256([]byte(first))
+	assert.Equal(t, fingerprint[:], models[0].Fingerprint)
+}
+
+func TestLoadAll_Errors(t *testing.T) {
+	_, err := LoadAllFromBytes("empty", []byte("---\n---\n"))
+	assert.ErrorContains(t, err, "no PolicyDomain documents")
+
+	_, err = LoadAllFromBytes("empty-list", []byte("kind: PolicyDomainList\nitems: []\n"))
+	assert.ErrorContains(t, err, "no PolicyDomain documents")
+
+	// the failing document is located in the file
+	_, err = LoadAllFromBytes("wrong-kind", []byte(domainDoc("first")+"---\nkind: NotPolicyDomain\n"))
+	assert.ErrorContains(t, err, "document on line 13: expected PolicyDomain got NotPolicyDomain")
+
+	_, err = LoadAll("/nonexistent/path/file.yml")
+	assert.Error(t, err)
+}
+
+func TestLoadFromBytes_MultipleDocuments(t *testing.T) {
+	_, err := LoadFromBytes("bundle", []byte(domainDoc("first")+"---\n"+domainDoc("second")))
+	assert.ErrorContains(t, err, "expected one PolicyDomain, found 2")
+
+	// a list of one domain holds one domain
+	model, err := LoadFromBytes("list", []byte("kind: PolicyDomainList\nitems:\n"+indentItem(domainDoc("first"))))
+	require.NoError(t, err)
+	assert.Equal(t, "first", model.Name)
+}
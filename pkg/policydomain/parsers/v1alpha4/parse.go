@@ -8,7 +8,6 @@ import (
 	"crypto/sha256"
 	"os"
 	"regexp"
-	"strings"
 
 	"github.com/manetu/policyengine/pkg/policydomain"
 
@@ -152,25 +151,10 @@ func exportGroups(defs []Group) map[string]policydomain.Group {
 	return refs
 }
 
-func anchorPattern(pattern string) string {
-	hasStartAnchor := strings.HasPrefix(pattern, "^")
-	hasEndAnchor := strings.HasSuffix(pattern, "$")
-
-	result := pattern
-	if !hasStartAnchor {
-		result = "^" + result
-	}
-	if !hasEndAnchor {
-		result = result + "$"
-	}
-	return result
-}
-
 func exportOperation(def Operation) (*policydomain.Operation, error) {
 	selectors := make([]*regexp.Regexp, 0)
 	for _, selector := range def.Selector {
-		anchoredPattern := anchorPattern(selector)
-		r, err := regexp.Compile(anchoredPattern)
+		r, err := policydomain.CompileSelector(selector)
 		if err != nil {
 			return nil, err
 		}
@@ -202,8 +186,7 @@ func exportOperations(defs []Operation) ([]policydomain.Operation, error) {
 func exportMapper(def Mapper) (*policydomain.Mapper, error) {
 	selectors := make([]*regexp.Regexp, 0)
 	for _, selector := range def.Selector {
-		anchoredPattern := anchorPattern(selector)
-		r, err := regexp.Compile(anchoredPattern)
+		r, err := policydomain.CompileSelector(selector)
 		if err != nil {
 			return nil, err
 		}
@@ -239,8 +222,7 @@ func exportMappers(defs []Mapper) ([]policydomain.Mapper, error) {
 func exportResource(def Resource) (*policydomain.Resource, error) {
 	selectors := make([]*regexp.Regexp, 0)
 	for _, selector := range def.Selector {
-		anchoredPattern := anchorPattern(selector)
-		r, err := regexp.Compile(anchoredPattern)
+		r, err := policydomain.CompileSelector(selector)
 		if err != nil {
 			return nil, err
 		}
@@ -264,47 +264,6 @@ spec:
 	assert.Error(t, err)
 }
 
-func TestAnchorPattern(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
-		{
-			name:     "no anchors",
-			input:    ".*",
-			expected: "^.*$",
-		},
-		{
-			name:     "start anchor only",
-			input:    "^test",
-			expected: "^test$",
-		},
-		{
-			name:     "end anchor only",
-			input:    "test$",
-			expected: "^test$",
-		},
-		{
-			name:     "both anchors",
-			input:    "^test$",
-			expected: "^test$",
-		},
-		{
-			name:     "complex pattern",
-			input:    "mrn:.*:read",
-			expected: "^mrn:.*:read$",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := anchorPattern(tt.input)
-			assert.Equal(t, tt.expected, result)
-		})
-	}
-}
-
 func TestExportDefinition(t *testing.T) {
 	def := PolicyDefinition{
 		Mrn:          "mrn:iam:policy:test",
@@ -6,10 +6,11 @@ package v1beta1
 
 import (
 	"crypto/sha256"
+	"fmt"
 	"os"
 	"regexp"
-	"strings"
 
+	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/manetu/policyengine/pkg/policydomain"
 
 	"gopkg.in/yaml.v3"
@@ -20,6 +21,7 @@ type PolicyDefinition struct {
 	Mrn          string   `yaml:"mrn"`
 	Name         string   `yaml:"name"`
 	Description  string   `yaml:"description"`
+	Version      string   `yaml:"version,omitempty"` // Semantic version (policy libraries only)
 	Rego         string   `yaml:"rego"`
 	Dependencies []string `yaml:"dependencies"`
 }
@@ -37,14 +39,48 @@ type AnnotationDefaults struct {
 	Merge string `yaml:"merge,omitempty"` // Default merge strategy
 }
 
+// Defaults contains the decision strategy of a domain in v1beta1 format
+type Defaults struct {
+	Decision  string `yaml:"decision,omitempty"`  // deny (default) or allow
+	Combining string `yaml:"combining,omitempty"` // all (default) or any
+}
+
+// Fetch contains the policyengine.fetch settings of a domain in v1beta1 format
+type Fetch struct {
+	Allow    []string `yaml:"allow,omitempty"`     // Allowed URL prefixes
+	Timeout  string   `yaml:"timeout,omitempty"`   // Request timeout, e.g. "2s"
+	CacheTTL string   `yaml:"cache_ttl,omitempty"` // Response cache lifetime, e.g. "1m"
+}
+
+// Classifications contains the classification lattice of a domain in v1beta1 format
+type Classifications struct {
+	Levels       []string `yaml:"levels,omitempty"`       // Classification levels, lowest first
+	Compartments []string `yaml:"compartments,omitempty"` // Compartment names
+}
+
 // PolicyReference represents a reference to a policy in v1beta1 format
 type PolicyReference struct {
-	Mrn         string       `yaml:"mrn"`
-	Name        string       `yaml:"name"`
-	Description string       `yaml:"description"`
-	Default     bool         `yaml:"default"`
-	Policy      string       `yaml:"policy"`
-	Annotations []Annotation `yaml:"annotations"`
+	Mrn             string       `yaml:"mrn"`
+	Name            string       `yaml:"name"`
+	Description     string       `yaml:"description"`
+	Default         bool         `yaml:"default"`
+	Policy          string       `yaml:"policy"`
+	DenyPolicies    []string     `yaml:"deny-policies,omitempty"`
+	Owner           *OwnerRule   `yaml:"owner,omitempty"`
+	Network         *NetworkRule `yaml:"network,omitempty"`
+	AllowedPurposes []string     `yaml:"allowed-purposes,omitempty"`
+	Annotations     []Annotation `yaml:"annotations"`
+}
+
+// OwnerRule grants the owners of a resource group's resources in v1beta1 format
+type OwnerRule struct {
+	Claim string `yaml:"claim"`
+}
+
+// NetworkRule admits only requests from some networks or countries in v1beta1 format
+type NetworkRule struct {
+	CIDRs     []string `yaml:"cidrs,omitempty"`
+	Countries []string `yaml:"countries,omitempty"`
 }
 
 // Group represents a group with roles in v1beta1 format
@@ -53,14 +89,24 @@ type Group struct {
 	Name        string       `yaml:"name"`
 	Description string       `yaml:"description"`
 	Roles       []string     `yaml:"roles"`
+	Groups      []string     `yaml:"groups,omitempty"`
 	Annotations []Annotation `yaml:"annotations"`
 }
 
 // Operation represents an operation in v1beta1 format
 type Operation struct {
-	Name     string   `yaml:"name"`
-	Selector []string `yaml:"selector"`
-	Policy   string   `yaml:"policy"`
+	Name             string                 `yaml:"name"`
+	Selector         []string               `yaml:"selector"`
+	Policy           string                 `yaml:"policy"`
+	RequiresApproval int                    `yaml:"requires-approval,omitempty"`
+	ContextSchema    map[string]interface{} `yaml:"context-schema,omitempty"` // JSON Schema of the PORC context
+	Identity         *Identity              `yaml:"identity,omitempty"`
+}
+
+// Identity represents how the GRANTs of a principal's roles combine for an operation in v1beta1 format
+type Identity struct {
+	Combining string `yaml:"combining,omitempty"` // any (default) or all
+	Minimum   int    `yaml:"minimum,omitempty"`
 }
 
 // Mapper represents a mapper in v1beta1 format
@@ -72,11 +118,39 @@ type Mapper struct {
 
 // Resource represents a resource in v1beta1 format
 type Resource struct {
-	Name        string       `yaml:"name"`
-	Description string       `yaml:"description"`
-	Selector    []string     `yaml:"selector"`
-	Group       string       `yaml:"group"`
-	Annotations []Annotation `yaml:"annotations"`
+	Name            string       `yaml:"name"`
+	Description     string       `yaml:"description"`
+	Selector        []string     `yaml:"selector"`
+	Group           string       `yaml:"group"`
+	Classification  string       `yaml:"classification,omitempty"`
+	Compartments    []string     `yaml:"compartments,omitempty"`
+	AllowedPurposes []string     `yaml:"allowed-purposes,omitempty"`
+	When            []string     `yaml:"when,omitempty"`
+	Annotations     []Annotation `yaml:"annotations"`
+}
+
+// BypassRule represents a SYSTEM phase bypass rule in v1beta1 format
+type BypassRule struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Reason      string   `yaml:"reason"`
+	Roles       []string `yaml:"roles"`
+	Operations  []string `yaml:"operations"`
+}
+
+// ImpersonationRule represents the actors permitted to act on behalf of subjects in v1beta1 format
+type ImpersonationRule struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Roles       []string `yaml:"roles"`
+	Subjects    []string `yaml:"subjects"`
+	Operations  []string `yaml:"operations"`
+}
+
+// System represents the SYSTEM phase configuration in v1beta1 format
+type System struct {
+	Bypass        []BypassRule        `yaml:"bypass"`
+	Impersonation []ImpersonationRule `yaml:"impersonation"`
 }
 
 func exportDefinition(def PolicyDefinition) policydomain.Policy {
@@ -86,6 +160,7 @@ func exportDefinition(def PolicyDefinition) policydomain.Policy {
 			ID:          def.Mrn,
 			Fingerprint: fingerprint[:],
 		},
+		Version:      def.Version,
 		Dependencies: def.Dependencies,
 		Rego:         def.Rego,
 	}
@@ -112,12 +187,30 @@ func exportReference(def PolicyReference) policydomain.PolicyReference {
 		IDSpec: policydomain.IDSpec{
 			ID: def.Mrn,
 		},
-		Policy:      def.Policy,
-		Default:     def.Default,
-		Annotations: annotations,
+		Policy:          def.Policy,
+		DenyPolicies:    def.DenyPolicies,
+		Default:         def.Default,
+		Owner:           exportOwnerRule(def.Owner),
+		Network:         exportNetworkRule(def.Network),
+		AllowedPurposes: def.AllowedPurposes,
+		Annotations:     annotations,
 	}
 }
 
+func exportOwnerRule(def *OwnerRule) *policydomain.OwnerRule {
+	if def == nil {
+		return nil
+	}
+	return &policydomain.OwnerRule{Claim: def.Claim}
+}
+
+func exportNetworkRule(def *NetworkRule) *policydomain.NetworkRule {
+	if def == nil {
+		return nil
+	}
+	return &policydomain.NetworkRule{CIDRs: def.CIDRs, Countries: def.Countries}
+}
+
 func exportReferences(defs []PolicyReference) map[string]policydomain.PolicyReference {
 	refs := make(map[string]policydomain.PolicyReference, 0)
 	for _, def := range defs {
@@ -140,6 +233,7 @@ func exportGroup(def Group) policydomain.Group {
 			ID: def.Mrn,
 		},
 		Roles:       def.Roles,
+		Groups:      def.Groups,
 		Annotations: annotations,
 	}
 }
@@ -153,37 +247,38 @@ func exportGroups(defs []Group) map[string]policydomain.Group {
 	return refs
 }
 
-func anchorPattern(pattern string) string {
-	hasStartAnchor := strings.HasPrefix(pattern, "^")
-	hasEndAnchor := strings.HasSuffix(pattern, "$")
-
-	result := pattern
-	if !hasStartAnchor {
-		result = "^" + result
-	}
-	if !hasEndAnchor {
-		result = result + "$"
-	}
-	return result
-}
-
 func exportOperation(def Operation) (*policydomain.Operation, error) {
 	selectors := make([]*regexp.Regexp, 0)
 	for _, selector := range def.Selector {
-		anchoredPattern := anchorPattern(selector)
-		r, err := regexp.Compile(anchoredPattern)
+		r, err := policydomain.CompileSelector(selector)
 		if err != nil {
 			return nil, err
 		}
 		selectors = append(selectors, r)
 	}
 
+	var schema *opa.Schema
+	if def.ContextSchema != nil {
+		var err error
+		if schema, err = opa.NewSchema(def.ContextSchema); err != nil {
+			return nil, fmt.Errorf("operation %s: context-schema: %w", def.Name, err)
+		}
+	}
+
+	var identity policydomain.Identity
+	if def.Identity != nil {
+		identity = policydomain.Identity{Combining: def.Identity.Combining, Minimum: def.Identity.Minimum}
+	}
+
 	return &policydomain.Operation{
 		IDSpec: policydomain.IDSpec{
 			ID: def.Name,
 		},
-		Selectors: selectors,
-		Policy:    def.Policy,
+		Selectors:        selectors,
+		Policy:           def.Policy,
+		RequiresApproval: def.RequiresApproval,
+		ContextSchema:    schema,
+		Identity:         identity,
 	}, nil
 }
 
@@ -203,8 +298,7 @@ func exportOperations(defs []Operation) ([]policydomain.Operation, error) {
 func exportMapper(def Mapper) (*policydomain.Mapper, error) {
 	selectors := make([]*regexp.Regexp, 0)
 	for _, selector := range def.Selector {
-		anchoredPattern := anchorPattern(selector)
-		r, err := regexp.Compile(anchoredPattern)
+		r, err := policydomain.CompileSelector(selector)
 		if err != nil {
 			return nil, err
 		}
@@ -240,8 +334,7 @@ func exportMappers(defs []Mapper) ([]policydomain.Mapper, error) {
 func exportResource(def Resource) (*policydomain.Resource, error) {
 	selectors := make([]*regexp.Regexp, 0)
 	for _, selector := range def.Selector {
-		anchoredPattern := anchorPattern(selector)
-		r, err := regexp.Compile(anchoredPattern)
+		r, err := policydomain.CompileSelector(selector)
 		if err != nil {
 			return nil, err
 		}
@@ -256,13 +349,26 @@ func exportResource(def Resource) (*policydomain.Resource, error) {
 		}
 	}
 
+	var conditions []policydomain.Condition
+	for _, when := range def.When {
+		condition, err := policydomain.ParseCondition(when)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
 	return &policydomain.Resource{
 		IDSpec: policydomain.IDSpec{
 			ID: def.Name,
 		},
-		Selectors:   selectors,
-		Group:       def.Group,
-		Annotations: annotations,
+		Selectors:       selectors,
+		Group:           def.Group,
+		Classification:  def.Classification,
+		Compartments:    def.Compartments,
+		AllowedPurposes: def.AllowedPurposes,
+		Annotations:     annotations,
+		Conditions:      conditions,
 	}, nil
 }
 
@@ -279,6 +385,94 @@ func exportResources(defs []Resource) ([]policydomain.Resource, error) {
 	return resources, nil
 }
 
+func exportBypassRule(def BypassRule) (*policydomain.BypassRule, error) {
+	operations := make([]*regexp.Regexp, 0)
+	for _, selector := range def.Operations {
+		r, err := policydomain.CompileSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, r)
+	}
+
+	reason := def.Reason
+	if reason == "" {
+		reason = "ANTI_LOCKOUT"
+	}
+
+	return &policydomain.BypassRule{
+		Name:       def.Name,
+		Reason:     reason,
+		Roles:      def.Roles,
+		Operations: operations,
+	}, nil
+}
+
+func exportBypassRules(defs []BypassRule) ([]policydomain.BypassRule, error) {
+	rules := make([]policydomain.BypassRule, 0)
+	for _, def := range defs {
+		rule, err := exportBypassRule(def)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+
+	return rules, nil
+}
+
+// compileSelectors compiles the selectors of a rule
+func compileSelectors(selectors []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(selectors))
+	for _, selector := range selectors {
+		r, err := policydomain.CompileSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, r)
+	}
+
+	return compiled, nil
+}
+
+func exportImpersonationRules(defs []ImpersonationRule) ([]policydomain.ImpersonationRule, error) {
+	rules := make([]policydomain.ImpersonationRule, 0)
+	for _, def := range defs {
+		subjects, err := compileSelectors(def.Subjects)
+		if err != nil {
+			return nil, fmt.Errorf("impersonation rule %s: subjects: %w", def.Name, err)
+		}
+		operations, err := compileSelectors(def.Operations)
+		if err != nil {
+			return nil, fmt.Errorf("impersonation rule %s: operations: %w", def.Name, err)
+		}
+		rules = append(rules, policydomain.ImpersonationRule{
+			Name:       def.Name,
+			Roles:      def.Roles,
+			Subjects:   subjects,
+			Operations: operations,
+		})
+	}
+
+	return rules, nil
+}
+
+// DataDocument represents a static data document in v1beta1 format
+type DataDocument struct {
+	Name        string      `yaml:"name"`
+	Description string      `yaml:"description"`
+	Value       interface{} `yaml:"value"` // Native YAML value
+}
+
+func exportDataDocuments(defs []DataDocument) []policydomain.DataDocument {
+	documents := make([]policydomain.DataDocument, 0, len(defs))
+	for _, def := range defs {
+		documents = append(documents, policydomain.DataDocument{Name: def.Name, Value: def.Value})
+	}
+
+	return documents
+}
+
 // IntermediateModel represents the intermediate v1beta1 YAML structure
 type IntermediateModel struct {
 	Metadata struct {
@@ -286,6 +480,10 @@ type IntermediateModel struct {
 	}
 	Spec struct {
 		AnnotationDefaults AnnotationDefaults `yaml:"annotation-defaults"`
+		Defaults           Defaults           `yaml:"defaults"`
+		Data               []DataDocument     `yaml:"data"`
+		Fetch              Fetch              `yaml:"fetch"`
+		Classifications    Classifications    `yaml:"classifications"`
 		PolicyLibraries    []PolicyDefinition `yaml:"policy-libraries"`
 		Policies           []PolicyDefinition `yaml:"policies"`
 		Roles              []PolicyReference  `yaml:"roles"`
@@ -295,6 +493,7 @@ type IntermediateModel struct {
 		Operations         []Operation        `yaml:"operations"`
 		Mappers            []Mapper           `yaml:"mappers"`
 		Resources          []Resource         `yaml:"resources"`
+		System             System             `yaml:"system"`
 	}
 }
 
@@ -321,20 +520,46 @@ func LoadFromBytes(data []byte) (*policydomain.IntermediateModel, error) {
 		return nil, err
 	}
 
+	bypassRules, err := exportBypassRules(intermediate.Spec.System.Bypass)
+	if err != nil {
+		return nil, err
+	}
+
+	impersonationRules, err := exportImpersonationRules(intermediate.Spec.System.Impersonation)
+	if err != nil {
+		return nil, err
+	}
+
 	return &policydomain.IntermediateModel{
 		Name: intermediate.Metadata.Name,
 		AnnotationDefaults: policydomain.AnnotationDefaults{
 			MergeStrategy: intermediate.Spec.AnnotationDefaults.Merge,
 		},
-		PolicyLibraries: exportDefinitions(intermediate.Spec.PolicyLibraries),
-		Policies:        exportDefinitions(intermediate.Spec.Policies),
-		Roles:           exportReferences(intermediate.Spec.Roles),
-		Groups:          exportGroups(intermediate.Spec.Groups),
-		ResourceGroups:  exportReferences(intermediate.Spec.ResourceGroups),
-		Scopes:          exportReferences(intermediate.Spec.Scopes),
-		Operations:      operations,
-		Mappers:         mappers,
-		Resources:       resources,
+		Defaults: policydomain.Defaults{
+			Decision:  intermediate.Spec.Defaults.Decision,
+			Combining: intermediate.Spec.Defaults.Combining,
+		},
+		PolicyLibraries:    exportDefinitions(intermediate.Spec.PolicyLibraries),
+		Policies:           exportDefinitions(intermediate.Spec.Policies),
+		Roles:              exportReferences(intermediate.Spec.Roles),
+		Groups:             exportGroups(intermediate.Spec.Groups),
+		ResourceGroups:     exportReferences(intermediate.Spec.ResourceGroups),
+		Scopes:             exportReferences(intermediate.Spec.Scopes),
+		Operations:         operations,
+		Mappers:            mappers,
+		Resources:          resources,
+		BypassRules:        bypassRules,
+		ImpersonationRules: impersonationRules,
+		Data:               exportDataDocuments(intermediate.Spec.Data),
+		Fetch: policydomain.Fetch{
+			Allow:    intermediate.Spec.Fetch.Allow,
+			Timeout:  intermediate.Spec.Fetch.Timeout,
+			CacheTTL: intermediate.Spec.Fetch.CacheTTL,
+		},
+		Classifications: policydomain.Classifications{
+			Levels:       intermediate.Spec.Classifications.Levels,
+			Compartments: intermediate.Spec.Classifications.Compartments,
+		},
 	}, nil
 }
 
@@ -9,6 +9,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/manetu/policyengine/pkg/policydomain"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -364,54 +366,13 @@ spec:
 	assert.Error(t, err)
 }
 
-func TestAnchorPattern(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
-		{
-			name:     "no anchors",
-			input:    ".*",
-			expected: "^.*$",
-		},
-		{
-			name:     "start anchor only",
-			input:    "^test",
-			expected: "^test$",
-		},
-		{
-			name:     "end anchor only",
-			input:    "test$",
-			expected: "^test$",
-		},
-		{
-			name:     "both anchors",
-			input:    "^test$",
-			expected: "^test$",
-		},
-		{
-			name:     "complex pattern",
-			input:    "mrn:.*:read",
-			expected: "^mrn:.*:read$",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := anchorPattern(tt.input)
-			assert.Equal(t, tt.expected, result)
-		})
-	}
-}
-
 func TestExportDefinition(t *testing.T) {
 	def := PolicyDefinition{
 		Mrn:          "mrn:iam:policy:test",
 		Name:         "test",
 		Description:  "Test policy",
 		Rego:         "package authz\ndefault allow = true",
-		Dependencies: []string{"mrn:iam:library:utils"},
+		Dependencies: []string{"mrn:iam:library:utils@^1.2"},
 	}
 
 	result := exportDefinition(def)
@@ -419,6 +380,10 @@ func TestExportDefinition(t *testing.T) {
 	assert.NotEmpty(t, result.IDSpec.Fingerprint)
 	assert.Equal(t, def.Rego, result.Rego)
 	assert.Equal(t, def.Dependencies, result.Dependencies)
+	assert.Empty(t, result.Version)
+
+	def.Version = "1.4.2"
+	assert.Equal(t, "1.4.2", exportDefinition(def).Version)
 }
 
 func TestExportDefinitions(t *testing.T) {
@@ -453,6 +418,130 @@ func TestExportReference(t *testing.T) {
 	assert.Equal(t, "replace", result.Annotations["level"].MergeStrategy)
 }
 
+func TestExportReference_Owner(t *testing.T) {
+	ref := PolicyReference{
+		Mrn:    "mrn:iam:resource-group:documents",
+		Policy: "mrn:iam:policy:deny-all",
+		Owner:  &OwnerRule{Claim: "email"},
+	}
+
+	result := exportReference(ref)
+	require.NotNil(t, result.Owner)
+	assert.Equal(t, "email", result.Owner.Claim)
+
+	ref.Owner = nil
+	assert.Nil(t, exportReference(ref).Owner)
+}
+
+func TestExportReference_Network(t *testing.T) {
+	ref := PolicyReference{
+		Mrn:     "mrn:iam:scope:office",
+		Policy:  "mrn:iam:policy:allow-all",
+		Network: &NetworkRule{CIDRs: []string{"10.0.0.0/8"}, Countries: []string{"US"}},
+	}
+
+	result := exportReference(ref)
+	require.NotNil(t, result.Network)
+	assert.Equal(t, []string{"10.0.0.0/8"}, result.Network.CIDRs)
+	assert.Equal(t, []string{"US"}, result.Network.Countries)
+
+	ref.Network = nil
+	assert.Nil(t, exportReference(ref).Network)
+}
+
+func TestExportPurposes(t *testing.T) {
+	ref := PolicyReference{
+		Mrn:             "mrn:iam:resource-group:customers",
+		Policy:          "mrn:iam:policy:allow-all",
+		AllowedPurposes: []string{"billing", "support"},
+	}
+	assert.Equal(t, []string{"billing", "support"}, exportReference(ref).AllowedPurposes)
+
+	resource := Resource{
+		Name:            "profiles",
+		Selector:        []string{"mrn:app:profile:.*"},
+		Group:           "mrn:iam:resource-group:customers",
+		AllowedPurposes: []string{"support"},
+	}
+	result, err := exportResource(resource)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"support"}, result.AllowedPurposes)
+}
+
+func TestExportDenyPolicies(t *testing.T) {
+	ref := PolicyReference{
+		Mrn:          "mrn:iam:role:contractor",
+		Policy:       "mrn:iam:policy:allow-all",
+		DenyPolicies: []string{"mrn:iam:policy:trusted-network"},
+	}
+	assert.Equal(t, []string{"mrn:iam:policy:trusted-network"}, exportReference(ref).DenyPolicies)
+}
+
+func TestExportRequiresApproval(t *testing.T) {
+	result, err := exportOperation(Operation{Name: "admin", Selector: []string{"admin:.*"}, Policy: "mrn:iam:policy:allow-all", RequiresApproval: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.RequiresApproval)
+}
+
+func TestExportIdentity(t *testing.T) {
+	result, err := exportOperation(Operation{Name: "wire", Selector: []string{"bank:wire:.*"}, Policy: "mrn:iam:policy:allow-all",
+		Identity: &Identity{Combining: "all", Minimum: 2}})
+	require.NoError(t, err)
+	assert.Equal(t, policydomain.Identity{Combining: "all", Minimum: 2}, result.Identity)
+
+	result, err = exportOperation(Operation{Name: "read", Selector: []string{"api:.*"}, Policy: "mrn:iam:policy:allow-all"})
+	require.NoError(t, err)
+	assert.True(t, result.Identity.IsZero())
+}
+
+func TestExportContextSchema(t *testing.T) {
+	result, err := exportOperation(Operation{Name: "transfer", Selector: []string{"api:transfer:.*"}, Policy: "mrn:iam:policy:allow-all",
+		ContextSchema: map[string]interface{}{"type": "object", "required": []interface{}{"amount"}}})
+	require.NoError(t, err)
+	require.NotNil(t, result.ContextSchema)
+	assert.Equal(t, `{"required":["amount"],"type":"object"}`, result.ContextSchema.String())
+
+	result, err = exportOperation(Operation{Name: "read", Selector: []string{"api:.*"}, Policy: "mrn:iam:policy:allow-all"})
+	require.NoError(t, err)
+	assert.Nil(t, result.ContextSchema)
+
+	_, err = exportOperation(Operation{Name: "transfer", Selector: []string{"api:transfer:.*"}, Policy: "mrn:iam:policy:allow-all",
+		ContextSchema: map[string]interface{}{"type": "strin"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "operation transfer: context-schema: invalid schema")
+}
+
+func TestExportConditions(t *testing.T) {
+	resource := Resource{
+		Name:  "sensitive",
+		Group: "mrn:iam:resource-group:restricted",
+		When:  []string{"classification >= HIGH", "annotations.tier<2", `owner != "system"`},
+	}
+	result, err := exportResource(resource)
+	require.NoError(t, err)
+	require.Len(t, result.Conditions, 3)
+	assert.True(t, result.IsConditional())
+	assert.Equal(t, policydomain.Condition{Attribute: "classification", Operator: ">=", Value: "HIGH", Source: "classification >= HIGH"}, result.Conditions[0])
+	assert.Equal(t, "HIGH", result.Conditions[0].Level())
+	assert.Equal(t, policydomain.Condition{Attribute: "annotations.tier", Operator: "<", Value: float64(2), Source: "annotations.tier<2"}, result.Conditions[1])
+	assert.Equal(t, "system", result.Conditions[2].Value)
+	assert.Empty(t, result.Conditions[2].Level())
+
+	for condition, msg := range map[string]string{
+		"classification":           "expected <attribute> <operator> <value>",
+		"owner ==":                 "missing value",
+		"classification == 3":      "compared with a level",
+		"owner > alice":            "only compares with == and !=",
+		"annotations.tier >= high": "ordered by numbers",
+		"annotations. == x":        "unknown attribute 'annotations.'",
+		"subject == alice":         "unknown attribute 'subject'",
+	} {
+		resource.When = []string{condition}
+		_, err := exportResource(resource)
+		assert.ErrorContains(t, err, msg, condition)
+	}
+}
+
 func TestExportReferences(t *testing.T) {
 	refs := []PolicyReference{
 		{Mrn: "mrn:role:1", Policy: "mrn:policy:1"},
@@ -786,3 +875,208 @@ spec:
 	assert.Len(t, regions, 3)
 	assert.Equal(t, "union", role.Annotations["regions"].MergeStrategy)
 }
+
+func TestLoad_SystemBypass(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  system:
+    bypass:
+      - name: admin-anti-lockout
+        description: "Administrators can always manage the platform"
+        roles:
+          - "mrn:iam:role:admin"
+        operations:
+          - "platform:admin:.*"
+      - name: health
+        reason: PUBLIC
+        roles:
+          - "mrn:iam:role:monitor"
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	require.Len(t, model.BypassRules, 2)
+
+	rule := model.BypassRules[0]
+	assert.Equal(t, "admin-anti-lockout", rule.Name)
+	assert.Equal(t, "ANTI_LOCKOUT", rule.Reason, "reason defaults to ANTI_LOCKOUT")
+	assert.Equal(t, []string{"mrn:iam:role:admin"}, rule.Roles)
+	require.Len(t, rule.Operations, 1)
+	assert.Equal(t, "^platform:admin:.*$", rule.Operations[0].String())
+
+	rule = model.BypassRules[1]
+	assert.Equal(t, "PUBLIC", rule.Reason)
+	assert.Empty(t, rule.Operations)
+}
+
+func TestExportBypassRule_InvalidOperation(t *testing.T) {
+	_, err := exportBypassRule(BypassRule{
+		Name:       "invalid",
+		Roles:      []string{"mrn:iam:role:admin"},
+		Operations: []string{"[invalid regex"},
+	})
+	assert.Error(t, err)
+}
+
+func TestLoad_SystemImpersonation(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  system:
+    impersonation:
+      - name: on-behalf-of
+        description: "Services act for users"
+        roles:
+          - "mrn:iam:role:service"
+        subjects:
+          - "glob:*@example.com"
+        operations:
+          - "api:documents:.*"
+      - name: gateway
+        roles:
+          - "mrn:iam:role:gateway"
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	require.Len(t, model.ImpersonationRules, 2)
+
+	rule := model.ImpersonationRules[0]
+	assert.Equal(t, "on-behalf-of", rule.Name)
+	assert.Equal(t, []string{"mrn:iam:role:service"}, rule.Roles)
+	require.Len(t, rule.Subjects, 1)
+	assert.True(t, rule.Subjects[0].MatchString("alice@example.com"))
+	require.Len(t, rule.Operations, 1)
+	assert.Equal(t, "^api:documents:.*$", rule.Operations[0].String())
+
+	rule = model.ImpersonationRules[1]
+	assert.Empty(t, rule.Subjects)
+	assert.Empty(t, rule.Operations)
+}
+
+func TestExportImpersonationRules_InvalidSelector(t *testing.T) {
+	_, err := exportImpersonationRules([]ImpersonationRule{{Name: "r", Subjects: []string{"glob:{a"}}})
+	assert.ErrorContains(t, err, "impersonation rule r: subjects")
+
+	_, err = exportImpersonationRules([]ImpersonationRule{{Name: "r", Operations: []string{"[invalid regex"}}})
+	assert.ErrorContains(t, err, "impersonation rule r: operations")
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  defaults:
+    decision: allow
+    combining: any
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, "allow", model.Defaults.Decision)
+	assert.Equal(t, "any", model.Defaults.Combining)
+	assert.False(t, model.Defaults.IsZero())
+
+	model, err = LoadFromBytes([]byte("apiVersion: iamlite.manetu.io/v1beta1\nkind: PolicyDomain\nmetadata:\n  name: test\n"))
+	require.NoError(t, err)
+	assert.True(t, model.Defaults.IsZero())
+}
+
+func TestLoad_Data(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  data:
+    - name: countries
+      description: Countries served
+      value: [CA, US]
+    - name: levels
+      value:
+        public: 0
+        secret: 2
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	require.Len(t, model.Data, 2)
+	assert.Equal(t, "countries", model.Data[0].Name)
+	assert.Equal(t, []interface{}{"CA", "US"}, model.Data[0].Value)
+	assert.Equal(t, "levels", model.Data[1].Name)
+	assert.Equal(t, map[string]interface{}{"public": 0, "secret": 2}, model.Data[1].Value)
+}
+
+func TestLoad_Fetch(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  fetch:
+    allow:
+      - https://risk.example.com/v1/
+    timeout: 500ms
+    cache_ttl: 1m
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://risk.example.com/v1/"}, model.Fetch.Allow)
+	assert.Equal(t, "500ms", model.Fetch.Timeout)
+	assert.Equal(t, "1m", model.Fetch.CacheTTL)
+
+	model, err = LoadFromBytes([]byte("apiVersion: iamlite.manetu.io/v1beta1\nkind: PolicyDomain\nmetadata:\n  name: test\n"))
+	require.NoError(t, err)
+	assert.True(t, model.Fetch.IsZero())
+}
+
+func TestLoad_Classifications(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  classifications:
+    levels: [LOW, MODERATE, HIGH]
+    compartments: [CRYPTO]
+  resources:
+    - name: keys
+      selector:
+        - "mrn:iam:resource:key:.*"
+      group: "mrn:iam:resource-group:default"
+      classification: HIGH
+      compartments: [CRYPTO]
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"LOW", "MODERATE", "HIGH"}, model.Classifications.Levels)
+	assert.Equal(t, []string{"CRYPTO"}, model.Classifications.Compartments)
+	require.Len(t, model.Resources, 1)
+	assert.Equal(t, "HIGH", model.Resources[0].Classification)
+	assert.Equal(t, []string{"CRYPTO"}, model.Resources[0].Compartments)
+}
+
+func TestLoad_NestedGroups(t *testing.T) {
+	content := `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: test
+spec:
+  groups:
+    - mrn: "mrn:iam:group:staff"
+      roles:
+        - "mrn:iam:role:employee"
+      groups:
+        - "mrn:iam:group:engineers"
+    - mrn: "mrn:iam:group:engineers"
+      roles:
+        - "mrn:iam:role:developer"
+`
+	model, err := LoadFromBytes([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mrn:iam:group:engineers"}, model.Groups["mrn:iam:group:staff"].Groups)
+	assert.Empty(t, model.Groups["mrn:iam:group:engineers"].Groups)
+}
@@ -0,0 +1,225 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"gopkg.in/yaml.v3"
+)
+
+// KindPolicyDomain is the document kind discovered by default by [ExpandPaths].
+const KindPolicyDomain = parsers.KindPolicyDomain
+
+// ExpandPaths resolves directories and glob patterns into the policy domain files they contain.
+//
+// Each path is handled according to its form:
+//   - A glob pattern (containing '*', '?' or '[') is matched against the filesystem.
+//     A '**' segment matches any number of directories, e.g. "policies/**/*.yml".
+//   - A directory is searched recursively for .yml and .yaml files. Hidden
+//     directories are skipped.
+//   - Any other path is passed through unchanged, so that missing files are
+//     reported by the loader.
+//
+// Discovered files are only included when the YAML 'kind' of one of their documents
+// is one of kinds ([KindPolicyDomain] if none are given), so that unrelated YAML files
+// such as test suites may live alongside the domains. A PolicyDomainList counts as a
+// [KindPolicyDomain]. The files discovered from each path are
+// sorted lexically, and the order of the paths themselves is preserved, giving a
+// deterministic load order. A file that has already been included is not repeated.
+//
+// Returns an error if a directory or pattern yields no matching files.
+func ExpandPaths(paths []string, kinds ...string) ([]string, error) {
+	if len(kinds) == 0 {
+		kinds = []string{KindPolicyDomain}
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(paths))
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			result = append(result, path)
+		}
+	}
+
+	for _, path := range paths {
+		var (
+			candidates []string
+			err        error
+		)
+
+		switch {
+		case isGlob(path):
+			candidates, err = globFiles(path)
+		case isDir(path):
+			candidates, err = dirFiles(path)
+		default:
+			add(path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, candidate := range candidates {
+			ok, err := hasKind(candidate, kinds)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				found = true
+				add(candidate)
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no %s files found in '%s'", strings.Join(kinds, " or "), path)
+		}
+	}
+
+	return result, nil
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+func isHidden(d fs.DirEntry) bool {
+	return d.IsDir() && strings.HasPrefix(d.Name(), ".") && d.Name() != "." && d.Name() != ".."
+}
+
+// dirFiles returns the YAML files beneath root in lexical order
+func dirFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isHidden(d) && path != root {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && isYAML(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search '%s': %w", root, err)
+	}
+
+	return files, nil
+}
+
+// globFiles returns the files matching pattern in lexical order
+func globFiles(pattern string) ([]string, error) {
+	segments := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+
+	// walk from the longest prefix that contains no pattern characters
+	i := 0
+	for i < len(segments) && !isGlob(segments[i]) {
+		i++
+	}
+	root := strings.Join(segments[:i], "/")
+	switch {
+	case i == 0:
+		root = "."
+	case root == "":
+		root = "/"
+	}
+
+	for _, segment := range segments {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
+
+	var files []string
+	err := filepath.WalkDir(filepath.FromSlash(root), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == filepath.FromSlash(root) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if isHidden(d) && path != filepath.FromSlash(root) {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && matchSegments(segments, strings.Split(filepath.ToSlash(path), "/")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search '%s': %w", pattern, err)
+	}
+
+	return files, nil
+}
+
+// matchSegments reports whether the path segments match the pattern segments, where a
+// '**' pattern segment matches zero or more path segments.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	ok, _ := filepath.Match(pattern[0], path[0])
+	return ok && matchSegments(pattern[1:], path[1:])
+}
+
+func hasKind(path string, kinds []string) (bool, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- CLI tool intentionally reads user-provided paths
+	if err != nil {
+		return false, err
+	}
+
+	// files that are not YAML documents cannot be policy domains
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var preamble parsers.Preamble
+		if err := decoder.Decode(&preamble); err != nil {
+			return false, nil
+		}
+
+		if preamble.Kind == parsers.KindPolicyDomainList {
+			preamble.Kind = parsers.KindPolicyDomain
+		}
+		if slices.Contains(kinds, preamble.Kind) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,164 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createPolicyTree lays out testdata domains in a directory tree alongside files that must not be discovered
+func createPolicyTree(t *testing.T) string {
+	root := t.TempDir()
+
+	files := map[string]string{
+		"b/beta.yml":          "valid-alpha.yml",
+		"a/alpha.yaml":        "valid-alpha.yml",
+		"a/nested/gamma.yml":  "consolidated.yml",
+		"a/tests.yml":         "example-decision-tests.yaml",
+		".hidden/hidden.yml":  "valid-alpha.yml",
+		"a/readme.txt":        "valid-alpha.yml",
+		"b/reference-ref.yml": "",
+	}
+	for name, testdata := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+
+		content := []byte("kind: PolicyDomainReference\n")
+		if testdata != "" {
+			var err error
+			content, err = os.ReadFile(filepath.Join("../../../cmd/mpe/test", testdata))
+			require.NoError(t, err)
+		}
+		require.NoError(t, os.WriteFile(path, content, 0600))
+	}
+
+	return root
+}
+
+func TestExpandPaths_Directory(t *testing.T) {
+	root := createPolicyTree(t)
+
+	paths, err := ExpandPaths([]string{root})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(root, "a/alpha.yaml"),
+		filepath.Join(root, "a/nested/gamma.yml"),
+		filepath.Join(root, "b/beta.yml"),
+	}, paths)
+}
+
+func TestExpandPaths_Glob(t *testing.T) {
+	root := createPolicyTree(t)
+
+	paths, err := ExpandPaths([]string{filepath.Join(root, "**/*.yml")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(root, "a/nested/gamma.yml"),
+		filepath.Join(root, "b/beta.yml"),
+	}, paths)
+
+	paths, err = ExpandPaths([]string{filepath.Join(root, "*/*.y*ml")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(root, "a/alpha.yaml"),
+		filepath.Join(root, "b/beta.yml"),
+	}, paths)
+}
+
+func TestExpandPaths_Kinds(t *testing.T) {
+	root := createPolicyTree(t)
+
+	paths, err := ExpandPaths([]string{filepath.Join(root, "b")}, KindPolicyDomain, "PolicyDomainReference")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(root, "b/beta.yml"),
+		filepath.Join(root, "b/reference-ref.yml"),
+	}, paths)
+}
+
+func TestExpandPaths_OrderAndDuplicates(t *testing.T) {
+	root := createPolicyTree(t)
+	explicit := filepath.Join(root, "b/beta.yml")
+
+	// argument order is preserved and files already included are not repeated
+	paths, err := ExpandPaths([]string{explicit, filepath.Join(root, "a"), root})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		explicit,
+		filepath.Join(root, "a/alpha.yaml"),
+		filepath.Join(root, "a/nested/gamma.yml"),
+	}, paths)
+}
+
+func TestExpandPaths_Errors(t *testing.T) {
+	root := createPolicyTree(t)
+
+	// explicit files are passed through for the loader to report
+	paths, err := ExpandPaths([]string{"missing.yml"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing.yml"}, paths)
+
+	_, err = ExpandPaths([]string{filepath.Join(root, "**/*.json")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no PolicyDomain files found")
+
+	_, err = ExpandPaths([]string{filepath.Join(root, "missing", "*.yml")})
+	require.Error(t, err)
+
+	_, err = ExpandPaths([]string{filepath.Join(root, "[.yml")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid pattern")
+}
+
+func TestNewRegistry_Directory(t *testing.T) {
+	root := createPolicyTree(t)
+
+	r, err := NewRegistry([]string{root})
+	require.NoError(t, err)
+	assert.Contains(t, r.GetDomains(), "alpha")
+	assert.Contains(t, r.GetDomains(), "consolidated")
+}
+
+func TestNewRegistry_MultipleDocuments(t *testing.T) {
+	root := t.TempDir()
+	read := func(name string) string {
+		content, err := os.ReadFile(filepath.Join("../../../cmd/mpe/test", name))
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// a PolicyDomain following an empty document, as when bundles are concatenated
+	multi := "---\n# generated\n---\n" + read("valid-alpha.yml")
+	require.NoError(t, os.WriteFile(filepath.Join(root, "multi.yml"), []byte(multi), 0600))
+
+	// a PolicyDomainList, nesting each domain under items
+	lines := strings.Split(strings.TrimSuffix(read("consolidated.yml"), "\n"), "\n")
+	for i, line := range lines {
+		prefix := "    "
+		if i == 0 {
+			prefix = "  - "
+		}
+		lines[i] = prefix + line
+	}
+	list := "kind: PolicyDomainList\nitems:\n" + strings.Join(lines, "\n") + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(root, "list.yml"), []byte(list), 0600))
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "other.yml"), []byte("kind: Notes\n---\nkind: Other\n"), 0600))
+
+	paths, err := ExpandPaths([]string{root})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "list.yml"), filepath.Join(root, "multi.yml")}, paths)
+
+	r, err := NewRegistry([]string{root})
+	require.NoError(t, err)
+	assert.Contains(t, r.GetDomains(), "alpha")
+	assert.Contains(t, r.GetDomains(), "consolidated")
+}
@@ -24,6 +24,14 @@
 //	backend := local.NewFactory(registry)
 //	pe, _ := core.NewPolicyEngine(options.WithBackend(backend))
 //
+// # Compilation
+//
+// [Registry.CompileAllPolicies] compiles policies, policy libraries, and mappers
+// concurrently; see [Registry.SetCompileWorkers] to bound the parallelism.
+//
+// Selectors repeated by many entities or domains, such as ".*", share one compiled
+// regular expression, held in a [policydomain.SelectorTable] while the domains load.
+//
 // # Validation
 //
 // The registry validates all cross-references between policy entities
@@ -32,9 +40,21 @@
 package registry
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
-
+	"hash"
+	"maps"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manetu/policyengine/pkg/core/model"
 	"github.com/manetu/policyengine/pkg/core/opa"
 	"github.com/manetu/policyengine/pkg/policydomain"
 	"github.com/manetu/policyengine/pkg/policydomain/parsers"
@@ -49,11 +69,28 @@ type DomainMap map[string]*policydomain.IntermediateModel
 // Registry is created by [NewRegistry], which loads and validates policy
 // domain YAML files. The registry can then be used with the local backend
 // to provide policy data to the engine.
+//
+// A Registry is safe for concurrent use. Domains may be replaced while the
+// registry is serving with [Registry.UpdateDomain], or all at once with
+// [Registry.Stage] and [Registry.Swap].
 type Registry struct {
-	domains   DomainMap
-	validator *validation.BundleValidator
+	mu         sync.RWMutex // guards the fields below, which are replaced together on update
+	domains    DomainMap
+	validator  *validation.BundleValidator
+	revision   uint64
+	bundleInfo *model.BundleInfo
+
+	// updateMu serializes compilation and updates
+	updateMu       sync.Mutex
+	policyCompiler *opa.Compiler
+	mapperCompiler *opa.Compiler
+	compileWorkers int
 }
 
+// revisions is shared by all registries so that a registry created by a
+// hot-reload always reports a higher revision than the one it replaces.
+var revisions atomic.Uint64
+
 func reverse[T any](list []T) []T {
 	for i, j := 0, len(list)-1; i < j; {
 		list[i], list[j] = list[j], list[i]
@@ -64,43 +101,84 @@ func reverse[T any](list []T) []T {
 }
 
 func (r *Registry) verify() error {
-	return r.validator.ValidateAll()
+	return r.getValidator().ValidateAll()
+}
+
+func (r *Registry) getValidator() *validation.BundleValidator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.validator
 }
 
 // ValidateWithSummary validates and returns a detailed summary of any errors
 func (r *Registry) ValidateWithSummary() (bool, string) {
-	return r.validator.ValidateWithSummary()
+	return r.getValidator().ValidateWithSummary()
 }
 
 // GetAllValidationErrors returns all validation errors without stopping on first error
 func (r *Registry) GetAllValidationErrors() []*validation.Error {
-	return r.validator.GetAllValidationErrors()
+	return r.getValidator().GetAllValidationErrors()
+}
+
+// GetAmbiguities returns the roles, groups, resource groups, and scopes defined by more than
+// one domain, and the default resource groups declared by more than one domain. These do not
+// fail validation, as backends resolve them by domain precedence.
+func (r *Registry) GetAmbiguities() []*validation.Error {
+	return r.getValidator().FindAmbiguities()
 }
 
 // ValidateDomain validates a specific domain and returns detailed errors
 func (r *Registry) ValidateDomain(domainName string) error {
-	return r.validator.ValidateDomain(domainName)
+	return r.getValidator().ValidateDomain(domainName)
 }
 
-// GetDomains returns the domain map for accessing domain models
+// GetDomains returns the domain map for accessing domain models.
+//
+// The returned map must not be modified. [Registry.UpdateDomain] replaces the map
+// rather than modifying it, so a caller holding the map sees a consistent snapshot.
 func (r *Registry) GetDomains() DomainMap {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.domains
 }
 
+// GetBundleInfo returns the registry revision and the fingerprint of each loaded domain
+func (r *Registry) GetBundleInfo() *model.BundleInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.bundleInfo
+}
+
+func (r *Registry) updateBundleInfo() {
+	info := &model.BundleInfo{
+		Revision: r.revision,
+		Domains:  make([]model.DomainInfo, 0, len(r.domains)),
+	}
+
+	for name, domain := range r.domains {
+		info.Domains = append(info.Domains, model.DomainInfo{Name: name, Fingerprint: domain.Fingerprint})
+	}
+	sort.Slice(info.Domains, func(i, j int) bool { return info.Domains[i].Name < info.Domains[j].Name })
+
+	r.bundleInfo = info
+}
+
 // ResolveDependencies resolves dependencies for a domain model
 func (r *Registry) ResolveDependencies(model *policydomain.IntermediateModel, dependencies []string) ([]string, error) {
 	// Create adapter for this specific model
 	modelAdapter := &DomainModelAdapter{model}
 
 	// Use common library's dependency resolution
-	return r.validator.ValidateDependencies(modelAdapter, dependencies)
+	return r.getValidator().ValidateDependencies(modelAdapter, dependencies)
 }
 
 // NewRegistry loads and validates policy domains from the specified paths.
 //
-// Each path should be a file containing a policy domain YAML file
-// (policydomain.yaml or similar). Domains are loaded in the order provided,
-// with later domains taking precedence for name collisions.
+// Each path may be a policy domain YAML file, a directory, or a glob pattern
+// such as "policies/**/*.yml"; directories and patterns are expanded with
+// [ExpandPaths]. A file may hold several domains, as '---' separated documents or
+// a PolicyDomainList (see [parsers.SplitDocuments]). Domains are loaded in the
+// resulting order, with later domains taking precedence for name collisions.
 //
 // Returns an error if any domain fails to parse or validate.
 //
@@ -111,19 +189,35 @@ func (r *Registry) ResolveDependencies(model *policydomain.IntermediateModel, de
 //	    "./policies/application",
 //	})
 func NewRegistry(domainPaths []string) (*Registry, error) {
+	domainPaths, err := ExpandPaths(domainPaths)
+	if err != nil {
+		return nil, err
+	}
+
 	domainsList := make([]*policydomain.IntermediateModel, 0)
 	for _, domainpath := range domainPaths {
-		instance, err := parsers.Load(domainpath)
+		instances, err := parsers.LoadAll(domainpath)
 		if err != nil {
 			return nil, err
 		}
-		domainsList = append(domainsList, instance)
+		domainsList = append(domainsList, instances...)
 	}
 
+	return NewRegistryFromModels(domainsList)
+}
+
+// NewRegistryFromModels constructs and validates a registry from pre-parsed
+// domain models, such as those loaded with [parsers.LoadFromBytes] from an
+// embedded filesystem.
+//
+// Models are ordered as with [NewRegistry], with later domains taking
+// precedence for name collisions. Returns an error if validation fails.
+func NewRegistryFromModels(models []*policydomain.IntermediateModel) (*Registry, error) {
 	domains := make(map[string]*policydomain.IntermediateModel)
-	for _, instance := range reverse(domainsList) {
+	for _, instance := range reverse(models) {
 		domains[instance.Name] = instance
 	}
+	shareSelectors(domains)
 
 	// Create adapter for the common validation library
 	domainMapAdapter := NewDomainMapAdapter(domains)
@@ -134,7 +228,9 @@ func NewRegistry(domainPaths []string) (*Registry, error) {
 	r := &Registry{
 		domains:   domains,
 		validator: validator, // Only need common lib validator
+		revision:  revisions.Add(1),
 	}
+	r.updateBundleInfo()
 
 	if err := r.verify(); err != nil {
 		return nil, err
@@ -142,6 +238,18 @@ func NewRegistry(domainPaths []string) (*Registry, error) {
 	return r, nil
 }
 
+// shareSelectors interns the selectors of the domains of each map, in order, in one table, so
+// that a pattern repeated by many entities and domains is compiled in memory once. The
+// selectors of domains that already share a table with those before them are only read.
+func shareSelectors(domainMaps ...DomainMap) {
+	table := policydomain.NewSelectorTable()
+	for _, domains := range domainMaps {
+		for _, name := range slices.Sorted(maps.Keys(domains)) {
+			table.InternDomain(domains[name])
+		}
+	}
+}
+
 // newRegistryPermissiveFromModels constructs a permissive registry from
 // pre-parsed domain models. This is the shared implementation used by both
 // [NewRegistryPermissive] and [NewRegistryPermissiveFromModels].
@@ -150,6 +258,7 @@ func newRegistryPermissiveFromModels(models []*policydomain.IntermediateModel) (
 	for _, instance := range reverse(models) {
 		domains[instance.Name] = instance
 	}
+	shareSelectors(domains)
 
 	domainMapAdapter := NewDomainMapAdapter(domains)
 	validator := validation.NewBundleValidator(domainMapAdapter)
@@ -157,7 +266,9 @@ func newRegistryPermissiveFromModels(models []*policydomain.IntermediateModel) (
 	r := &Registry{
 		domains:   domains,
 		validator: validator,
+		revision:  revisions.Add(1),
 	}
+	r.updateBundleInfo()
 
 	return r, r.validator.GetAllValidationErrors(), nil
 }
@@ -170,15 +281,21 @@ func newRegistryPermissiveFromModels(models []*policydomain.IntermediateModel) (
 // Structural parse failures (unreadable or non-PolicyDomain YAML) still return
 // an error.
 //
-// The second return value contains all accumulated validation errors.
+// Paths are expanded as with [NewRegistry]. The second return value contains
+// all accumulated validation errors.
 func NewRegistryPermissive(domainPaths []string) (*Registry, []*validation.Error, error) {
+	domainPaths, err := ExpandPaths(domainPaths)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	models := make([]*policydomain.IntermediateModel, 0, len(domainPaths))
 	for _, domainpath := range domainPaths {
-		instance, err := parsers.Load(domainpath)
+		instances, err := parsers.LoadAll(domainpath)
 		if err != nil {
 			return nil, nil, err
 		}
-		models = append(models, instance)
+		models = append(models, instances...)
 	}
 	return newRegistryPermissiveFromModels(models)
 }
@@ -197,50 +314,219 @@ func NewRegistryPermissiveFromModels(models []*policydomain.IntermediateModel) (
 // This should be called after registry creation with the compiler from the backend.
 // The policyCompiler is used for policies (with unsafe builtin exclusions).
 // The mapperCompiler is used for mappers (with default capabilities).
+//
+// The compilers are retained so that [Registry.UpdateDomain] can compile replacement domains.
 func (r *Registry) CompileAllPolicies(policyCompiler *opa.Compiler, mapperCompiler *opa.Compiler) error {
-	for domainName, domain := range r.domains {
-		// Compile all policies
-		if err := r.compilePoliciesInDomain(policyCompiler, domain); err != nil {
-			return fmt.Errorf("domain %s: %w", domainName, err)
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+
+	r.policyCompiler = policyCompiler
+	r.mapperCompiler = mapperCompiler
+
+	return r.compileDomains(policyCompiler, mapperCompiler, r.domains)
+}
+
+// SetCompileWorkers sets the number of policies, policy libraries, and mappers that
+// [Registry.CompileAllPolicies] and [Registry.UpdateDomain] compile concurrently.
+//
+// A value of zero or less, the default, uses one worker per available CPU
+// (runtime.GOMAXPROCS). A value of one compiles sequentially.
+func (r *Registry) SetCompileWorkers(workers int) {
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+	r.compileWorkers = workers
+}
+
+// compileTask is a single policy, policy library, or mapper to compile
+type compileTask struct {
+	domain *policydomain.IntermediateModel
+	kind   string // "policy library", "policy", or "mapper"
+	id     string
+	policy policydomain.Policy // policies and libraries, with the fingerprint updated by compilation
+	mapper int                 // index into domain.Mappers
+
+	ast *opa.Ast
+	err error
+}
+
+// compileDomains compiles the policies and mappers of the given domains that are not yet
+// compiled, resolving dependencies against all domains of r.
+//
+// Compilation is spread across a pool of workers (see [Registry.SetCompileWorkers]). The
+// compiled ASTs are only stored once every task succeeds, and a failure reports the errors
+// of all tasks, ordered by domain, kind, and ID, so the outcome does not depend on scheduling.
+func (r *Registry) compileDomains(policyCompiler *opa.Compiler, mapperCompiler *opa.Compiler, domains DomainMap) error {
+	tasks := compileTasks(domains)
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	// policies may only call policyengine.fetch and clearance.dominates in domains that declare them
+	policyCompilers, err := domainCompilers(policyCompiler, domains)
+	if err != nil {
+		return err
+	}
+
+	workers := r.compileWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(tasks))
+
+	next := make(chan *compileTask)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range next {
+				compiler, ok := policyCompilers[task.domain.Name]
+				if !ok {
+					compiler = policyCompiler
+				}
+				r.compileTask(compiler, mapperCompiler, task)
+			}
+		}()
+	}
+	for i := range tasks {
+		next <- &tasks[i]
+	}
+	close(next)
+	wg.Wait()
+
+	var errs []error
+	for i := range tasks {
+		if task := &tasks[i]; task.err != nil {
+			errs = append(errs, fmt.Errorf("domain %s: %s %s: %w", task.domain.Name, task.kind, task.id, task.err))
 		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 
-		// Compile all mappers
-		if err := r.compileMappersInDomain(mapperCompiler, domain); err != nil {
-			return fmt.Errorf("domain %s: %w", domainName, err)
+	// domain maps are not safe for concurrent writes, so store the results once all workers are done
+	for i := range tasks {
+		task := &tasks[i]
+		switch task.kind {
+		case "policy library":
+			task.policy.Ast = task.ast
+			task.domain.PolicyLibraries[task.id] = task.policy
+		case "policy":
+			task.policy.Ast = task.ast
+			task.domain.Policies[task.id] = task.policy
+		default:
+			task.domain.Mappers[task.mapper].Ast = task.ast
 		}
 	}
+
 	return nil
 }
 
-// compilePoliciesInDomain compiles all policies in a domain
-func (r *Registry) compilePoliciesInDomain(compiler *opa.Compiler, domain *policydomain.IntermediateModel) error {
-	// Compile policy libraries first (they may be dependencies)
-	for mrn, policy := range domain.PolicyLibraries {
-		if policy.Ast != nil {
-			continue // Already compiled
+// domainCompilers returns a policy compiler for each domain that declares fetch settings or a
+// classification lattice, registering policyengine.fetch and clearance.dominates built-ins bound
+// to the domain's allowlist and lattice
+func domainCompilers(policyCompiler *opa.Compiler, domains DomainMap) (map[string]*opa.Compiler, error) {
+	compilers := make(map[string]*opa.Compiler)
+	for name, domain := range domains {
+		var builtins []*opa.Builtin
+		if !domain.Fetch.IsZero() {
+			fetcher, err := newFetcher(domain)
+			if err != nil {
+				return nil, fmt.Errorf("domain %s: %w", name, err)
+			}
+			builtins = append(builtins, fetcher.Builtin())
 		}
-		ast, err := r.compilePolicyWithDeps(compiler, domain, &policy)
-		if err != nil {
-			return fmt.Errorf("policy library %s: %w", mrn, err)
+		if !domain.Classifications.IsZero() {
+			lattice, err := opa.NewLattice(domain.Classifications.Levels, domain.Classifications.Compartments)
+			if err != nil {
+				return nil, fmt.Errorf("domain %s: %w", name, err)
+			}
+			builtins = append(builtins, lattice.Builtin())
+		}
+		if len(builtins) > 0 {
+			compilers[name] = policyCompiler.Clone(opa.WithBuiltins(builtins...))
 		}
-		policy.Ast = ast
-		domain.PolicyLibraries[mrn] = policy
 	}
+	return compilers, nil
+}
 
-	// Compile policies
-	for mrn, policy := range domain.Policies {
-		if policy.Ast != nil {
-			continue // Already compiled
+// newFetcher creates the policyengine.fetch implementation of a domain
+func newFetcher(domain *policydomain.IntermediateModel) (*opa.Fetcher, error) {
+	options := opa.FetchOptions{Allow: domain.Fetch.Allow}
+	if domain.Fetch.Timeout != "" {
+		timeout, err := time.ParseDuration(domain.Fetch.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fetch timeout: %w", err)
 		}
-		ast, err := r.compilePolicyWithDeps(compiler, domain, &policy)
+		options.Timeout = timeout
+	}
+	if domain.Fetch.CacheTTL != "" {
+		ttl, err := time.ParseDuration(domain.Fetch.CacheTTL)
 		if err != nil {
-			return fmt.Errorf("policy %s: %w", mrn, err)
+			return nil, fmt.Errorf("invalid fetch cache_ttl: %w", err)
 		}
-		policy.Ast = ast
-		domain.Policies[mrn] = policy
+		options.CacheTTL = ttl
 	}
+	return opa.NewFetcher(domain.Name, options)
+}
 
-	return nil
+// compileTasks lists the uncompiled policies, policy libraries, and mappers of domains, in a
+// deterministic order
+func compileTasks(domains DomainMap) []compileTask {
+	var tasks []compileTask
+	for _, name := range slices.Sorted(maps.Keys(domains)) {
+		domain := domains[name]
+
+		for _, mrn := range slices.Sorted(maps.Keys(domain.PolicyLibraries)) {
+			if policy := domain.PolicyLibraries[mrn]; policy.Ast == nil {
+				tasks = append(tasks, compileTask{domain: domain, kind: "policy library", id: mrn, policy: policy})
+			}
+		}
+		for _, mrn := range slices.Sorted(maps.Keys(domain.Policies)) {
+			if policy := domain.Policies[mrn]; policy.Ast == nil {
+				tasks = append(tasks, compileTask{domain: domain, kind: "policy", id: mrn, policy: policy})
+			}
+		}
+		for i, mapper := range domain.Mappers {
+			if mapper.Ast == nil {
+				tasks = append(tasks, compileTask{domain: domain, kind: "mapper", id: mapper.IDSpec.ID, mapper: i})
+			}
+		}
+	}
+	return tasks
+}
+
+// compileTask compiles a single task, recording its result in the task
+func (r *Registry) compileTask(policyCompiler *opa.Compiler, mapperCompiler *opa.Compiler, task *compileTask) {
+	switch task.kind {
+	case "policy library":
+		task.ast, task.err = r.compilePolicyWithDeps(policyCompiler, task.domain, &task.policy)
+	case "policy":
+		task.ast, task.err = r.compilePolicyWithDeps(policyCompiler, task.domain, &task.policy)
+		if task.err == nil {
+			// a policy without its entrypoint would fail every decision rather than its load
+			if err := checkPolicyEntrypoint(task.ast); err != nil {
+				task.ast, task.err = nil, err
+				return
+			}
+			// prepare the decision query now, rather than on the first authorization request
+			if err := task.ast.Prepare(context.Background(), model.PolicyQuery); err != nil {
+				task.ast, task.err = nil, fmt.Errorf("query preparation failed: %w", err)
+			}
+		}
+	default:
+		task.ast, task.err = compileMapper(mapperCompiler, task.domain, &task.domain.Mappers[task.mapper])
+	}
+}
+
+// checkPolicyEntrypoint returns an error if the policy does not define model.PolicyEntrypoint,
+// such as when its package is misspelled, or if it can decide neither a boolean nor a number
+func checkPolicyEntrypoint(ast *opa.Ast) error {
+	t, err := ast.EntrypointType(model.PolicyEntrypoint)
+	if err != nil {
+		return fmt.Errorf("%w: a policy must define allow in package authz", err)
+	}
+	return model.CheckDecisionType(t, model.BooleanDecision, model.NumberDecision)
 }
 
 // compilePolicyWithDeps compiles a policy with its dependencies
@@ -265,6 +551,9 @@ func (r *Registry) compilePolicyWithDeps(compiler *opa.Compiler, sourceDomain *p
 	domainMapAdapter := NewDomainMapAdapter(r.domains)
 	resolver := validation.NewReferenceResolver(domainMapAdapter)
 
+	// libraries keep access to the data of the domain declaring them
+	dataDomains := []*policydomain.IntermediateModel{sourceDomain}
+
 	for _, dmrn := range deps {
 		targetDomainName, _, depID, resolveErr := resolver.ResolveReference(dmrn, sourceDomain.Name, "library")
 		if resolveErr != nil {
@@ -279,13 +568,22 @@ func (r *Registry) compilePolicyWithDeps(compiler *opa.Compiler, sourceDomain *p
 
 		h.Write([]byte(dep.Rego))
 		modules[dep.IDSpec.ID] = dep.Rego
+		dataDomains = append(dataDomains, targetDomain)
+	}
+
+	data, err := dataDocuments(dataDomains)
+	if err != nil {
+		return nil, err
+	}
+	if err := hashData(h, data); err != nil {
+		return nil, err
 	}
 
 	// Update fingerprint
 	policy.IDSpec.Fingerprint = h.Sum(nil)
 
 	// Compile
-	ast, err := compiler.Compile(mrn, modules)
+	ast, err := compiler.CompileWithData(mrn, modules, data)
 	if err != nil {
 		return nil, fmt.Errorf("compilation failed: %w", err)
 	}
@@ -293,24 +591,67 @@ func (r *Registry) compilePolicyWithDeps(compiler *opa.Compiler, sourceDomain *p
 	return ast, nil
 }
 
-// compileMappersInDomain compiles all mappers in a domain
-func (r *Registry) compileMappersInDomain(compiler *opa.Compiler, domain *policydomain.IntermediateModel) error {
-	for i := range domain.Mappers {
-		mapper := &domain.Mappers[i]
-		if mapper.Ast != nil {
-			continue // Already compiled
-		}
+// compileMapper compiles a mapper with the data of its domain and prepares its query
+func compileMapper(compiler *opa.Compiler, domain *policydomain.IntermediateModel, mapper *policydomain.Mapper) (*opa.Ast, error) {
+	modules := map[string]string{}
+	modules[mapper.IDSpec.ID] = mapper.Rego
 
-		modules := map[string]string{}
-		modules[mapper.IDSpec.ID] = mapper.Rego
+	data, err := dataDocuments([]*policydomain.IntermediateModel{domain})
+	if err != nil {
+		return nil, err
+	}
 
-		ast, err := compiler.Compile(mapper.IDSpec.ID, modules)
-		if err != nil {
-			return fmt.Errorf("mapper %s: compilation failed: %w", mapper.IDSpec.ID, err)
-		}
+	ast, err := compiler.CompileWithData(mapper.IDSpec.ID, modules, data)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %w", err)
+	}
+	// the output evaluated as the PORC may be selected by name, so porc is not required
+	outputs, err := ast.Documents(model.MapperPackage)
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("%s defines no outputs: a mapper must define porc, or other documents, in package mapper", model.MapperPackage)
+	}
+	if err := ast.Prepare(context.Background(), model.MapperQuery); err != nil {
+		return nil, fmt.Errorf("query preparation failed: %w", err)
+	}
 
-		mapper.Ast = ast
+	return ast, nil
+}
+
+// dataDocuments merges the data documents of domains, which may repeat. Documents of the
+// same name declared by different domains would overlap in the data tree and are rejected.
+func dataDocuments(domains []*policydomain.IntermediateModel) (opa.Data, error) {
+	var data opa.Data
+	owners := make(map[string]string)
+	for _, domain := range domains {
+		for _, document := range domain.Data {
+			if owner, ok := owners[document.Name]; ok {
+				if owner == domain.Name {
+					continue
+				}
+				return nil, fmt.Errorf("data document '%s' is declared by domains %s and %s", document.Name, owner, domain.Name)
+			}
+			if data == nil {
+				data = make(opa.Data)
+			}
+			owners[document.Name] = domain.Name
+			data[document.Name] = document.Value
+		}
 	}
+	return data, nil
+}
 
+// hashData adds the data documents to a fingerprint, in name order
+func hashData(h hash.Hash, data opa.Data) error {
+	for _, name := range slices.Sorted(maps.Keys(data)) {
+		value, err := json.Marshal(data[name])
+		if err != nil {
+			return fmt.Errorf("data document '%s': %w", name, err)
+		}
+		h.Write([]byte(name))
+		h.Write(value)
+	}
 	return nil
 }
@@ -5,12 +5,22 @@
 package registry
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/manetu/policyengine/pkg/core/model"
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
 	"github.com/manetu/policyengine/pkg/policydomain/validation"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -394,3 +404,510 @@ func TestErrorAccumulation(t *testing.T) {
 		t.Logf("  %d: [%s] %s", i+1, validationErr.Type, validationErr.Error())
 	}
 }
+
+// Test bundle identification
+func TestGetBundleInfo(t *testing.T) {
+	alphaFile := createTempFileFromTestData(t, "valid-alpha.yml")
+
+	first, err := NewRegistry([]string{alphaFile})
+	require.NoError(t, err)
+
+	info := first.GetBundleInfo()
+	require.Len(t, info.Domains, 1)
+	assert.Equal(t, first.GetDomains()[info.Domains[0].Name].Fingerprint, info.Domains[0].Fingerprint)
+	assert.Len(t, info.Domains[0].Fingerprint, 32)
+
+	// revisions increase monotonically across registries
+	second, err := NewRegistry([]string{alphaFile})
+	require.NoError(t, err)
+	assert.Greater(t, second.GetBundleInfo().Revision, info.Revision)
+	assert.Equal(t, info.Domains, second.GetBundleInfo().Domains)
+}
+
+// generatedDomain builds a domain with the given number of policies, each depending on a shared
+// library, and a mapper. Policies whose index is in broken fail to compile.
+func generatedDomain(name string, policies int, broken ...int) *policydomain.IntermediateModel {
+	domain := &policydomain.IntermediateModel{
+		Name: name,
+		PolicyLibraries: map[string]policydomain.Policy{
+			"mrn:iam:library:utils": {
+				IDSpec: policydomain.IDSpec{ID: "mrn:iam:library:utils"},
+				Rego:   "package utils\n\nis_admin { input.principal.mroles[_] == \"mrn:iam:role:admin\" }\n",
+			},
+		},
+		Policies: map[string]policydomain.Policy{},
+		Mappers: []policydomain.Mapper{{
+			IDSpec: policydomain.IDSpec{ID: name + "-mapper"},
+			Rego:   "package mapper\n\nporc := {\"principal\": input.claims}\n",
+		}},
+	}
+
+	for i := 0; i < policies; i++ {
+		mrn := fmt.Sprintf("mrn:iam:policy:p%03d", i)
+		rego := fmt.Sprintf("package authz\n\nimport data.utils\n\ndefault allow = false\n\nallow { utils.is_admin }\nallow { input.operation == \"op:%d\" }\n", i)
+		if slices.Contains(broken, i) {
+			rego = "package authz\n\ndefault allow = false\n\nallow { undefined_function(input) }\n"
+		}
+		domain.Policies[mrn] = policydomain.Policy{
+			IDSpec:       policydomain.IDSpec{ID: mrn},
+			Dependencies: []string{"mrn:iam:library:utils"},
+			Rego:         rego,
+		}
+	}
+
+	return domain
+}
+
+// compileGenerated compiles generated domains with the given number of workers
+func compileGenerated(workers int, domains ...*policydomain.IntermediateModel) (*Registry, error) {
+	r, _, err := NewRegistryPermissiveFromModels(domains)
+	if err != nil {
+		return nil, err
+	}
+	r.SetCompileWorkers(workers)
+
+	compiler := opa.NewCompiler()
+	return r, r.CompileAllPolicies(compiler, compiler)
+}
+
+func TestCompileAllPolicies_Parallel(t *testing.T) {
+	sequential, err := compileGenerated(1, generatedDomain("alpha", 40), generatedDomain("beta", 40))
+	require.NoError(t, err)
+
+	parallel, err := compileGenerated(8, generatedDomain("alpha", 40), generatedDomain("beta", 40))
+	require.NoError(t, err)
+
+	for name, domain := range parallel.GetDomains() {
+		for mrn, policy := range domain.Policies {
+			require.NotNil(t, policy.Ast, mrn)
+			assert.Equal(t, sequential.GetDomains()[name].Policies[mrn].IDSpec.Fingerprint, policy.IDSpec.Fingerprint, mrn)
+
+			result, policyErr := policy.Ast.Evaluate(context.Background(), model.PolicyQuery, map[string]interface{}{"operation": "op:7"})
+			require.Nil(t, policyErr)
+			assert.Equal(t, mrn == "mrn:iam:policy:p007", result.Bindings["x"], mrn)
+		}
+		for _, library := range domain.PolicyLibraries {
+			assert.NotNil(t, library.Ast)
+		}
+		for _, mapper := range domain.Mappers {
+			assert.NotNil(t, mapper.Ast)
+		}
+	}
+}
+
+func TestCompileAllPolicies_Shared(t *testing.T) {
+	// registries of identical domains share their compiled policies
+	first, err := compileGenerated(4, generatedDomain("gamma", 10))
+	require.NoError(t, err)
+	second, err := compileGenerated(4, generatedDomain("gamma", 10))
+	require.NoError(t, err)
+
+	for mrn, policy := range second.GetDomains()["gamma"].Policies {
+		assert.Same(t, first.GetDomains()["gamma"].Policies[mrn].Ast, policy.Ast, mrn)
+	}
+	for i, mapper := range second.GetDomains()["gamma"].Mappers {
+		assert.Same(t, first.GetDomains()["gamma"].Mappers[i].Ast, mapper.Ast)
+	}
+}
+
+func TestCompileAllPolicies_ErrorAggregation(t *testing.T) {
+	var messages []string
+	for _, workers := range []int{1, 4, 0} {
+		r, err := compileGenerated(workers, generatedDomain("beta", 20, 3), generatedDomain("alpha", 20, 11, 2))
+		require.Error(t, err)
+
+		// every failure is reported
+		lines := strings.Split(err.Error(), "\n")
+		assert.Len(t, lines, 3)
+		assert.True(t, strings.HasPrefix(lines[0], "domain alpha: policy mrn:iam:policy:p002: compilation failed"), lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "domain alpha: policy mrn:iam:policy:p011: compilation failed"), lines[1])
+		assert.True(t, strings.HasPrefix(lines[2], "domain beta: policy mrn:iam:policy:p003: compilation failed"), lines[2])
+		messages = append(messages, err.Error())
+
+		// nothing is stored when compilation fails
+		for _, domain := range r.GetDomains() {
+			for mrn, policy := range domain.Policies {
+				assert.Nil(t, policy.Ast, mrn)
+			}
+		}
+	}
+
+	// the error does not depend on the number of workers
+	assert.Equal(t, messages[0], messages[1])
+	assert.Equal(t, messages[0], messages[2])
+}
+
+func TestCompileAllPolicies_Entrypoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		rego     string
+		expected string
+	}{
+		{"misspelled package", "package authz2\n\ndefault allow = false\n", "data.authz.allow is not defined: a policy must define allow in package authz"},
+		{"string decision", "package authz\n\nallow = \"yes\"\n", "data.authz.allow is string, but must be a boolean or number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain := generatedDomain("alpha", 3)
+			policy := domain.Policies["mrn:iam:policy:p001"]
+			policy.Rego = tt.rego
+			domain.Policies["mrn:iam:policy:p001"] = policy
+
+			r, err := compileGenerated(1, domain)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "domain alpha: policy mrn:iam:policy:p001: ")
+			assert.Contains(t, err.Error(), tt.expected)
+			assert.Nil(t, r.GetDomains()["alpha"].Policies["mrn:iam:policy:p001"].Ast)
+		})
+	}
+
+	t.Run("mapper", func(t *testing.T) {
+		domain := generatedDomain("alpha", 1)
+		domain.Mappers[0].Rego = "package mappers\n\nporc := {}\n"
+
+		_, err := compileGenerated(1, domain)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "data.mapper defines no outputs: a mapper must define porc, or other documents, in package mapper")
+	})
+
+	t.Run("mapper without porc", func(t *testing.T) {
+		domain := generatedDomain("alpha", 1)
+		domain.Mappers[0].Rego = "package mapper\n\nauthz_input := {\"principal\": input.claims}\n"
+
+		r, err := compileGenerated(1, domain)
+		require.NoError(t, err)
+
+		mapper := r.GetDomains()["alpha"].Mappers[0]
+		result, perr := mapper.Ast.Evaluate(context.Background(), model.MapperOutputQuery("authz_input"), map[string]interface{}{"claims": "alice"})
+		require.Nil(t, perr)
+		assert.Equal(t, map[string]interface{}{"principal": "alice"}, result.Bindings["porc"])
+	})
+}
+
+func BenchmarkCompileAllPolicies(b *testing.B) {
+	for _, workers := range []int{1, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := compileGenerated(workers, generatedDomain("alpha", 100), generatedDomain("beta", 100)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+const dataLibraryDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: lib
+spec:
+  data:
+    - name: levels
+      value:
+        public: 0
+        secret: 2
+  policy-libraries:
+    - mrn: "mrn:iam:library:clearance"
+      rego: |
+        package clearance
+        cleared { data.levels[input.principal.mannotations.clearance] >= data.levels[input.resource.classification] }
+`
+
+const dataAppDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: app
+spec:
+  data:
+    - name: countries
+      value: [CA, US]
+  policies:
+    - mrn: "mrn:iam:policy:classified"
+      dependencies:
+        - "lib/mrn:iam:library:clearance"
+      rego: |
+        package authz
+        import data.clearance
+        default allow = false
+        allow { clearance.cleared; input.principal.mannotations.country == data.countries[_] }
+  mappers:
+    - name: envoy
+      selector:
+        - ".*"
+      rego: |
+        package mapper
+        default domestic = false
+        domestic { input.country == data.countries[_] }
+        porc := {"principal": {"domestic": domestic}}
+`
+
+func loadDataDomains(t *testing.T, app string) []*policydomain.IntermediateModel {
+	lib, err := parsers.LoadFromBytes("lib.yml", []byte(dataLibraryDomain))
+	require.NoError(t, err)
+	model, err := parsers.LoadFromBytes("app.yml", []byte(app))
+	require.NoError(t, err)
+	return []*policydomain.IntermediateModel{lib, model}
+}
+
+func TestCompileAllPolicies_Data(t *testing.T) {
+	r, err := NewRegistryFromModels(loadDataDomains(t, dataAppDomain))
+	require.NoError(t, err)
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+
+	policy := r.GetDomains()["app"].Policies["mrn:iam:policy:classified"]
+	allow := func(clearance, country string) bool {
+		input := map[string]interface{}{
+			"principal": map[string]interface{}{"mannotations": map[string]interface{}{"clearance": clearance, "country": country}},
+			"resource":  map[string]interface{}{"classification": "secret"},
+		}
+		result, perr := policy.Ast.Evaluate(context.Background(), model.PolicyQuery, input)
+		require.Nil(t, perr)
+		return result.Bindings["x"].(bool)
+	}
+
+	// the library sees the data of its own domain, the policy that of its domain
+	assert.True(t, allow("secret", "CA"))
+	assert.False(t, allow("public", "CA"))
+	assert.False(t, allow("secret", "MX"))
+
+	mapper := r.GetDomains()["app"].Mappers[0]
+	result, perr := mapper.Ast.Evaluate(context.Background(), model.MapperQuery, map[string]interface{}{"country": "US"})
+	require.Nil(t, perr)
+	assert.Equal(t, map[string]interface{}{"principal": map[string]interface{}{"domestic": true}}, result.Bindings["porc"])
+}
+
+func TestCompileAllPolicies_DataConflict(t *testing.T) {
+	r, err := NewRegistryFromModels(loadDataDomains(t, strings.Replace(dataAppDomain, "name: countries", "name: levels", 1)))
+	require.NoError(t, err)
+	compiler := opa.NewCompiler()
+	err = r.CompileAllPolicies(compiler, compiler)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data document 'levels' is declared by domains app and lib")
+}
+
+func TestUpdateDomain_Data(t *testing.T) {
+	r, err := NewRegistryFromModels(loadDataDomains(t, dataAppDomain))
+	require.NoError(t, err)
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+
+	before := r.GetDomains()["app"].Policies["mrn:iam:policy:classified"]
+
+	// changing a library domain's data recompiles the policies depending on it
+	lib, err := parsers.LoadFromBytes("lib.yml", []byte(strings.Replace(dataLibraryDomain, "secret: 2", "secret: 0", 1)))
+	require.NoError(t, err)
+	require.NoError(t, r.UpdateDomain("lib", lib))
+
+	after := r.GetDomains()["app"].Policies["mrn:iam:policy:classified"]
+	assert.NotEqual(t, before.IDSpec.Fingerprint, after.IDSpec.Fingerprint)
+
+	input := map[string]interface{}{
+		"principal": map[string]interface{}{"mannotations": map[string]interface{}{"clearance": "public", "country": "CA"}},
+		"resource":  map[string]interface{}{"classification": "secret"},
+	}
+	result, perr := after.Ast.Evaluate(context.Background(), model.PolicyQuery, input)
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+}
+
+const fetchDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: risk
+spec:
+  fetch:
+    allow:
+      - %s/v1/
+    timeout: 1s
+  policies:
+    - mrn: "mrn:iam:policy:risk"
+      name: risk
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          response := policyengine.fetch(sprintf("%%s/v1/score", [input.server]))
+          response.body.score < 50
+        }
+`
+
+func TestCompileAllPolicies_Fetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"score": 10}`))
+	}))
+	defer server.Close()
+
+	domain, err := parsers.LoadFromBytes("risk.yml", []byte(fmt.Sprintf(fetchDomain, server.URL)))
+	require.NoError(t, err)
+	r, err := NewRegistryFromModels([]*policydomain.IntermediateModel{domain})
+	require.NoError(t, err)
+	compiler := opa.NewCompiler(opa.WithUnsafeBuiltins(opa.Builtins{"http.send": {}}))
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler.Clone(opa.WithDefaultCapabilities())))
+
+	log := &opa.FetchLog{}
+	policy := r.GetDomains()["risk"].Policies["mrn:iam:policy:risk"]
+	result, perr := policy.Ast.Evaluate(opa.WithFetchLog(context.Background(), log), model.PolicyQuery, map[string]interface{}{"server": server.URL})
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+	require.Len(t, log.Calls(), 1)
+	assert.Equal(t, "risk", log.Calls()[0].Domain)
+}
+
+func TestCompileAllPolicies_FetchNotDeclared(t *testing.T) {
+	// without an allowlist, the domain's policies cannot call the built-in
+	content := strings.Replace(fmt.Sprintf(fetchDomain, "https://risk.example.com"), "  fetch:\n    allow:\n      - https://risk.example.com/v1/\n    timeout: 1s\n", "", 1)
+	domain, err := parsers.LoadFromBytes("risk.yml", []byte(content))
+	require.NoError(t, err)
+	require.True(t, domain.Fetch.IsZero())
+	r, err := NewRegistryFromModels([]*policydomain.IntermediateModel{domain})
+	require.NoError(t, err)
+	compiler := opa.NewCompiler()
+	err = r.CompileAllPolicies(compiler, compiler)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined function policyengine.fetch")
+}
+
+const classifiedDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: classified
+spec:
+  classifications:
+    levels: [LOW, MODERATE, HIGH]
+    compartments: [CRYPTO]
+  policies:
+    - mrn: "mrn:iam:policy:clearance"
+      name: clearance
+      rego: |
+        package authz
+        default allow = false
+        allow {
+          clearance.dominates(input.clearance, input.classification)
+        }
+`
+
+func TestCompileAllPolicies_Classifications(t *testing.T) {
+	domain, err := parsers.LoadFromBytes("classified.yml", []byte(classifiedDomain))
+	require.NoError(t, err)
+	r, err := NewRegistryFromModels([]*policydomain.IntermediateModel{domain})
+	require.NoError(t, err)
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+
+	policy := r.GetDomains()["classified"].Policies["mrn:iam:policy:clearance"]
+	tests := []struct {
+		clearance      interface{}
+		classification interface{}
+		allow          bool
+	}{
+		{"HIGH", "MODERATE", true},
+		{"LOW", "MODERATE", false},
+		{"SECRET", "LOW", false},
+		{map[string]interface{}{"level": "HIGH", "compartments": []string{"CRYPTO"}}, map[string]interface{}{"level": "LOW", "compartments": []string{"CRYPTO"}}, true},
+		{"HIGH", map[string]interface{}{"level": "LOW", "compartments": []string{"CRYPTO"}}, false},
+	}
+	for _, tt := range tests {
+		result, perr := policy.Ast.Evaluate(context.Background(), model.PolicyQuery, map[string]interface{}{"clearance": tt.clearance, "classification": tt.classification})
+		require.Nil(t, perr)
+		assert.Equal(t, tt.allow, result.Bindings["x"], "%v dominates %v", tt.clearance, tt.classification)
+	}
+
+	// without a lattice, the domain's policies cannot call the built-in
+	domain, err = parsers.LoadFromBytes("classified.yml", []byte(classifiedDomain))
+	require.NoError(t, err)
+	domain.Classifications = policydomain.Classifications{}
+	r, err = NewRegistryFromModels([]*policydomain.IntermediateModel{domain})
+	require.NoError(t, err)
+	err = r.CompileAllPolicies(compiler, compiler)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined function clearance.dominates")
+}
+
+const versionedLibraryDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: lib
+spec:
+  policy-libraries:
+    - mrn: "mrn:iam:library:utils"
+      version: "1.4.2"
+      rego: |
+        package utils
+        is_admin { input.principal.mroles[_] == "mrn:iam:role:admin" }
+`
+
+const pinnedPolicyDomain = `apiVersion: iamlite.manetu.io/v1beta1
+kind: PolicyDomain
+metadata:
+  name: app
+spec:
+  policies:
+    - mrn: "mrn:iam:policy:admin"
+      dependencies:
+        - "lib/mrn:iam:library:utils@^1.2"
+      rego: |
+        package authz
+        import data.utils
+        default allow = false
+        allow { utils.is_admin }
+`
+
+func TestCompileAllPolicies_LibraryVersions(t *testing.T) {
+	load := func(app string) []*policydomain.IntermediateModel {
+		lib, err := parsers.LoadFromBytes("lib.yml", []byte(versionedLibraryDomain))
+		require.NoError(t, err)
+		model, err := parsers.LoadFromBytes("app.yml", []byte(app))
+		require.NoError(t, err)
+		return []*policydomain.IntermediateModel{lib, model}
+	}
+
+	r, err := NewRegistryFromModels(load(pinnedPolicyDomain))
+	require.NoError(t, err)
+	assert.Equal(t, "1.4.2", r.GetDomains()["lib"].PolicyLibraries["mrn:iam:library:utils"].Version)
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+
+	policy := r.GetDomains()["app"].Policies["mrn:iam:policy:admin"]
+	result, perr := policy.Ast.Evaluate(context.Background(), model.PolicyQuery, map[string]interface{}{
+		"principal": map[string]interface{}{"mroles": []string{"mrn:iam:role:admin"}},
+	})
+	require.Nil(t, perr)
+	assert.Equal(t, true, result.Bindings["x"])
+
+	// a library that no longer satisfies the pinned version fails validation
+	_, err = NewRegistryFromModels(load(strings.Replace(pinnedPolicyDomain, "@^1.2", "@^2", 1)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "library 'mrn:iam:library:utils' version 1.4.2 in domain 'lib' does not satisfy '^2'")
+}
+
+func TestNewRegistry_SharesSelectors(t *testing.T) {
+	withOperations := func(name string) *policydomain.IntermediateModel {
+		domain := generatedDomain(name, 1)
+		for _, selector := range []string{"api:.*", "glob:api:*:read"} {
+			re, err := policydomain.CompileSelector(selector)
+			require.NoError(t, err)
+			domain.Operations = append(domain.Operations, policydomain.Operation{
+				IDSpec:    policydomain.IDSpec{ID: selector},
+				Selectors: []*regexp.Regexp{re},
+				Policy:    "mrn:iam:policy:p000",
+			})
+		}
+		return domain
+	}
+
+	r, err := NewRegistryFromModels([]*policydomain.IntermediateModel{withOperations("alpha"), withOperations("beta")})
+	require.NoError(t, err)
+	alpha, beta := r.GetDomains()["alpha"], r.GetDomains()["beta"]
+	for i := range alpha.Operations {
+		assert.Same(t, alpha.Operations[i].Selectors[0], beta.Operations[i].Selectors[0])
+	}
+
+	// a replacement domain shares the selectors of the domains served
+	updated := withOperations("alpha")
+	require.NoError(t, r.UpdateDomain("alpha", updated))
+	for i := range updated.Operations {
+		assert.Same(t, beta.Operations[i].Selectors[0], updated.Operations[i].Selectors[0])
+	}
+}
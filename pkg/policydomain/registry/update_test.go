@@ -0,0 +1,218 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/manetu/policyengine/pkg/core/opa"
+	"github.com/manetu/policyengine/pkg/policydomain"
+	"github.com/manetu/policyengine/pkg/policydomain/parsers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createCompiledRegistry(t *testing.T) *Registry {
+	r, err := NewRegistry([]string{
+		createTempFileFromTestData(t, "alpha.yml"),
+		createTempFileFromTestData(t, "beta-anchored.yml"),
+		createTempFileFromTestData(t, "consolidated.yml"),
+	})
+	require.NoError(t, err)
+
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+
+	return r
+}
+
+// loadAlpha parses alpha.yml after applying replace to its content
+func loadAlpha(t *testing.T, old, new string) *policydomain.IntermediateModel {
+	data, err := os.ReadFile(filepath.Join("../../../cmd/mpe/test", "alpha.yml"))
+	require.NoError(t, err)
+
+	model, err := parsers.LoadFromBytes("alpha.yml", []byte(strings.Replace(string(data), old, new, 1)))
+	require.NoError(t, err)
+
+	return model
+}
+
+func TestDependents(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	assert.Equal(t, []string{"alpha", "beta"}, dependents(r.GetDomains(), "alpha"))
+	assert.Equal(t, []string{"beta"}, dependents(r.GetDomains(), "beta"))
+	assert.Equal(t, []string{"consolidated"}, dependents(r.GetDomains(), "consolidated"))
+}
+
+func TestUpdateDomain(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	before := r.GetDomains()
+	revision := r.GetBundleInfo().Revision
+	betaPolicy := before["beta"].Policies["mrn:iam:policy:read-only"]
+	consolidatedPolicy := before["consolidated"].Policies["mrn:iam:policy:allow-all"]
+
+	updated := loadAlpha(t, "glob.match(candidates[_], [], value)", "glob.match(candidates[_], [\":\"], value)")
+	require.NoError(t, r.UpdateDomain("alpha", updated))
+
+	after := r.GetDomains()
+	assert.Same(t, updated, after["alpha"])
+	assert.Greater(t, r.GetBundleInfo().Revision, revision)
+
+	// the dependent domain is recompiled against the new library
+	recompiled := after["beta"].Policies["mrn:iam:policy:read-only"]
+	require.NotNil(t, recompiled.Ast)
+	assert.NotSame(t, betaPolicy.Ast, recompiled.Ast)
+	assert.NotEqual(t, betaPolicy.IDSpec.Fingerprint, recompiled.IDSpec.Fingerprint)
+
+	// unrelated domains are untouched
+	assert.Same(t, before["consolidated"], after["consolidated"])
+	assert.Same(t, consolidatedPolicy.Ast, after["consolidated"].Policies["mrn:iam:policy:allow-all"].Ast)
+
+	// the previous snapshot is not modified
+	assert.Same(t, betaPolicy.Ast, before["beta"].Policies["mrn:iam:policy:read-only"].Ast)
+
+	for _, policy := range after["alpha"].Policies {
+		assert.NotNil(t, policy.Ast)
+	}
+}
+
+func TestUpdateDomain_BreaksDependent(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	before := r.GetDomains()
+	revision := r.GetBundleInfo().Revision
+
+	// beta depends on alpha's helpers library
+	broken := loadAlpha(t, `"mrn:iam:library:helpers"`, `"mrn:iam:library:renamed"`)
+	err := r.UpdateDomain("alpha", broken)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "helpers")
+
+	assert.Equal(t, before, r.GetDomains())
+	assert.Equal(t, revision, r.GetBundleInfo().Revision)
+}
+
+func TestUpdateDomain_AddDomain(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	model, err := parsers.Load(createTempFileFromTestData(t, "valid-alpha.yml"))
+	require.NoError(t, err)
+	model.Name = "alpha-copy"
+
+	require.NoError(t, r.UpdateDomain("alpha-copy", model))
+	assert.Len(t, r.GetDomains(), 4)
+	assert.Len(t, r.GetBundleInfo().Domains, 4)
+}
+
+func TestUpdateDomain_InvalidArguments(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	assert.Error(t, r.UpdateDomain("alpha", nil))
+	assert.Error(t, r.UpdateDomain("beta", loadAlpha(t, "", "")))
+}
+
+func TestUpdateDomain_Uncompiled(t *testing.T) {
+	r, err := NewRegistry([]string{
+		createTempFileFromTestData(t, "alpha.yml"),
+		createTempFileFromTestData(t, "beta-anchored.yml"),
+	})
+	require.NoError(t, err)
+
+	// compilation is deferred until CompileAllPolicies
+	require.NoError(t, r.UpdateDomain("alpha", loadAlpha(t, "", "")))
+	assert.Nil(t, r.GetDomains()["beta"].Policies["mrn:iam:policy:read-only"].Ast)
+
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+	assert.NotNil(t, r.GetDomains()["beta"].Policies["mrn:iam:policy:read-only"].Ast)
+}
+
+func TestUpdateDomain_Concurrent(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, r.UpdateDomain("alpha", loadAlpha(t, "", "")))
+		}()
+		go func() {
+			defer wg.Done()
+			for _, domain := range r.GetDomains() {
+				for _, policy := range domain.Policies {
+					assert.NotNil(t, policy.Ast)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStage(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	before := r.GetDomains()
+	revision := r.GetBundleInfo().Revision
+
+	beta, err := parsers.Load(createTempFileFromTestData(t, "beta-anchored.yml"))
+	require.NoError(t, err)
+	updated := loadAlpha(t, "glob.match(candidates[_], [], value)", "glob.match(candidates[_], [\":\"], value)")
+	staged, err := r.Stage([]*policydomain.IntermediateModel{updated, beta})
+	require.NoError(t, err)
+
+	// staging compiles the domains without serving them
+	assert.Equal(t, before, r.GetDomains())
+	assert.Equal(t, revision, r.GetBundleInfo().Revision)
+
+	require.NoError(t, r.Swap(staged))
+	after := r.GetDomains()
+	assert.Len(t, after, 2, "the staged domains replace every domain")
+	assert.Same(t, updated, after["alpha"])
+	assert.Greater(t, r.GetBundleInfo().Revision, revision)
+	for _, domain := range after {
+		for _, policy := range domain.Policies {
+			assert.NotNil(t, policy.Ast)
+		}
+	}
+
+	// domains staged for another registry are rejected
+	other := createCompiledRegistry(t)
+	assert.Error(t, other.Swap(staged))
+	assert.Error(t, r.Swap(nil))
+}
+
+func TestStage_Invalid(t *testing.T) {
+	r := createCompiledRegistry(t)
+
+	// beta depends on alpha's helpers library
+	beta, err := parsers.Load(createTempFileFromTestData(t, "beta-anchored.yml"))
+	require.NoError(t, err)
+	_, err = r.Stage([]*policydomain.IntermediateModel{beta})
+	assert.Error(t, err)
+	assert.Len(t, r.GetDomains(), 3)
+}
+
+func TestStage_Uncompiled(t *testing.T) {
+	r, err := NewRegistry([]string{createTempFileFromTestData(t, "alpha.yml")})
+	require.NoError(t, err)
+
+	staged, err := r.Stage([]*policydomain.IntermediateModel{loadAlpha(t, "", "")})
+	require.NoError(t, err)
+
+	// domains staged before the registry is compiled are compiled as they are swapped in
+	compiler := opa.NewCompiler()
+	require.NoError(t, r.CompileAllPolicies(compiler, compiler))
+	require.NoError(t, r.Swap(staged))
+	for _, policy := range r.GetDomains()["alpha"].Policies {
+		assert.NotNil(t, policy.Ast)
+	}
+}
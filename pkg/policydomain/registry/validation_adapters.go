@@ -56,9 +56,17 @@ func (pa *PolicyAdapter) GetDependencies() []string {
 	return pa.Dependencies
 }
 
-// ReferenceAdapter adapts policy reference strings to validation.ReferenceEntity interface
+// GetVersion implements validation.VersionedEntity interface
+func (pa *PolicyAdapter) GetVersion() string {
+	return pa.Version
+}
+
+// ReferenceAdapter adapts policy reference strings to validation.ReferenceEntity,
+// validation.DenyPolicyEntity, and validation.NetworkEntity interfaces
 type ReferenceAdapter struct {
-	policy string
+	policy       string
+	denyPolicies []string
+	network      *policydomain.NetworkRule
 }
 
 // GetPolicy implements validation.ReferenceEntity interface
@@ -66,9 +74,41 @@ func (ra *ReferenceAdapter) GetPolicy() string {
 	return ra.policy
 }
 
-// GroupAdapter adapts role slices to validation.GroupEntity interface
+// GetDenyPolicies implements validation.DenyPolicyEntity interface
+func (ra *ReferenceAdapter) GetDenyPolicies() []string {
+	return ra.denyPolicies
+}
+
+// GetNetwork implements validation.NetworkEntity interface
+func (ra *ReferenceAdapter) GetNetwork() ([]string, []string, bool) {
+	if ra.network == nil {
+		return nil, nil, false
+	}
+	return ra.network.CIDRs, ra.network.Countries, true
+}
+
+// ResourceGroupAdapter adapts a resource group to validation.ReferenceEntity, validation.DefaultEntity,
+// and validation.PurposeEntity interfaces
+type ResourceGroupAdapter struct {
+	ReferenceAdapter
+	isDefault bool
+	purposes  []string
+}
+
+// IsDefault implements validation.DefaultEntity interface
+func (ra *ResourceGroupAdapter) IsDefault() bool {
+	return ra.isDefault
+}
+
+// GetAllowedPurposes implements validation.PurposeEntity interface
+func (ra *ResourceGroupAdapter) GetAllowedPurposes() []string {
+	return ra.purposes
+}
+
+// GroupAdapter adapts role and nested group slices to validation.GroupEntity interface
 type GroupAdapter struct {
-	roles []string
+	roles  []string
+	groups []string
 }
 
 // GetRoles implements validation.GroupEntity interface
@@ -76,6 +116,11 @@ func (ga *GroupAdapter) GetRoles() []string {
 	return ga.roles
 }
 
+// GetGroups implements validation.GroupEntity interface
+func (ga *GroupAdapter) GetGroups() []string {
+	return ga.groups
+}
+
 // OperationAdapter adapts policydomain.Operation to validation.OperationEntity interface
 type OperationAdapter struct {
 	*policydomain.Operation
@@ -91,6 +136,16 @@ func (oa *OperationAdapter) GetPolicy() string {
 	return oa.Policy
 }
 
+// GetRequiresApproval implements validation.ApprovalEntity interface
+func (oa *OperationAdapter) GetRequiresApproval() int {
+	return oa.RequiresApproval
+}
+
+// GetIdentity implements validation.IdentityEntity interface
+func (oa *OperationAdapter) GetIdentity() (combining string, minimum int) {
+	return oa.Identity.Combining, oa.Identity.Minimum
+}
+
 // MapperAdapter adapts policydomain.Mapper to validation.MapperEntity interface
 type MapperAdapter struct {
 	*policydomain.Mapper
@@ -138,7 +193,7 @@ func (dma *DomainModelAdapter) GetPolicyLibraries() map[string]validation.Policy
 func (dma *DomainModelAdapter) GetRoles() map[string]validation.ReferenceEntity {
 	result := make(map[string]validation.ReferenceEntity)
 	for id, role := range dma.Roles {
-		result[id] = &ReferenceAdapter{role.Policy}
+		result[id] = &ReferenceAdapter{role.Policy, role.DenyPolicies, role.Network}
 	}
 	return result
 }
@@ -147,7 +202,7 @@ func (dma *DomainModelAdapter) GetRoles() map[string]validation.ReferenceEntity
 func (dma *DomainModelAdapter) GetGroups() map[string]validation.GroupEntity {
 	result := make(map[string]validation.GroupEntity)
 	for id, group := range dma.Groups {
-		result[id] = &GroupAdapter{group.Roles}
+		result[id] = &GroupAdapter{group.Roles, group.Groups}
 	}
 	return result
 }
@@ -156,7 +211,7 @@ func (dma *DomainModelAdapter) GetGroups() map[string]validation.GroupEntity {
 func (dma *DomainModelAdapter) GetResourceGroups() map[string]validation.ReferenceEntity {
 	result := make(map[string]validation.ReferenceEntity)
 	for id, rg := range dma.ResourceGroups {
-		result[id] = &ReferenceAdapter{rg.Policy}
+		result[id] = &ResourceGroupAdapter{ReferenceAdapter{rg.Policy, rg.DenyPolicies, rg.Network}, rg.Default, rg.AllowedPurposes}
 	}
 	return result
 }
@@ -165,7 +220,7 @@ func (dma *DomainModelAdapter) GetResourceGroups() map[string]validation.Referen
 func (dma *DomainModelAdapter) GetScopes() map[string]validation.ReferenceEntity {
 	result := make(map[string]validation.ReferenceEntity)
 	for id, scope := range dma.Scopes {
-		result[id] = &ReferenceAdapter{scope.Policy}
+		result[id] = &ReferenceAdapter{scope.Policy, scope.DenyPolicies, scope.Network}
 	}
 	return result
 }
@@ -188,7 +243,8 @@ func (dma *DomainModelAdapter) GetMappers() []validation.MapperEntity {
 	return result
 }
 
-// ResourceAdapter adapts policydomain.Resource to validation.ResourceEntity interface
+// ResourceAdapter adapts policydomain.Resource to validation.ResourceEntity, validation.PurposeEntity,
+// and validation.ConditionalEntity interfaces
 type ResourceAdapter struct {
 	*policydomain.Resource
 }
@@ -198,6 +254,32 @@ func (ra *ResourceAdapter) GetGroup() string {
 	return ra.Group
 }
 
+// GetClassification implements validation.ResourceEntity interface
+func (ra *ResourceAdapter) GetClassification() string {
+	return ra.Classification
+}
+
+// GetCompartments implements validation.ResourceEntity interface
+func (ra *ResourceAdapter) GetCompartments() []string {
+	return ra.Compartments
+}
+
+// GetAllowedPurposes implements validation.PurposeEntity interface
+func (ra *ResourceAdapter) GetAllowedPurposes() []string {
+	return ra.AllowedPurposes
+}
+
+// GetConditionLevels implements validation.ConditionalEntity interface
+func (ra *ResourceAdapter) GetConditionLevels() []string {
+	var levels []string
+	for _, c := range ra.Conditions {
+		if level := c.Level(); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
 // GetResources implements validation.DomainModel interface
 func (dma *DomainModelAdapter) GetResources() []validation.ResourceEntity {
 	result := make([]validation.ResourceEntity, len(dma.Resources))
@@ -206,3 +288,95 @@ func (dma *DomainModelAdapter) GetResources() []validation.ResourceEntity {
 	}
 	return result
 }
+
+// BypassRuleAdapter adapts policydomain.BypassRule to validation.BypassRuleEntity interface
+type BypassRuleAdapter struct {
+	*policydomain.BypassRule
+}
+
+// GetName implements validation.BypassRuleEntity interface
+func (ba *BypassRuleAdapter) GetName() string {
+	return ba.Name
+}
+
+// GetReason implements validation.BypassRuleEntity interface
+func (ba *BypassRuleAdapter) GetReason() string {
+	return ba.Reason
+}
+
+// GetRoles implements validation.BypassRuleEntity interface
+func (ba *BypassRuleAdapter) GetRoles() []string {
+	return ba.Roles
+}
+
+// GetBypassRules implements validation.DomainModel interface
+func (dma *DomainModelAdapter) GetBypassRules() []validation.BypassRuleEntity {
+	result := make([]validation.BypassRuleEntity, len(dma.BypassRules))
+	for i, rule := range dma.BypassRules {
+		result[i] = &BypassRuleAdapter{&rule}
+	}
+	return result
+}
+
+// ImpersonationRuleAdapter adapts policydomain.ImpersonationRule to validation.ImpersonationRuleEntity interface
+type ImpersonationRuleAdapter struct {
+	*policydomain.ImpersonationRule
+}
+
+// GetName implements validation.ImpersonationRuleEntity interface
+func (ia *ImpersonationRuleAdapter) GetName() string {
+	return ia.Name
+}
+
+// GetRoles implements validation.ImpersonationRuleEntity interface
+func (ia *ImpersonationRuleAdapter) GetRoles() []string {
+	return ia.Roles
+}
+
+// GetImpersonationRules implements validation.DomainModel interface
+func (dma *DomainModelAdapter) GetImpersonationRules() []validation.ImpersonationRuleEntity {
+	result := make([]validation.ImpersonationRuleEntity, len(dma.ImpersonationRules))
+	for i, rule := range dma.ImpersonationRules {
+		result[i] = &ImpersonationRuleAdapter{&rule}
+	}
+	return result
+}
+
+// DataDocumentAdapter adapts policydomain.DataDocument to validation.DataDocumentEntity interface
+type DataDocumentAdapter struct {
+	*policydomain.DataDocument
+}
+
+// GetName implements validation.DataDocumentEntity interface
+func (da *DataDocumentAdapter) GetName() string {
+	return da.Name
+}
+
+// GetValue implements validation.DataDocumentEntity interface
+func (da *DataDocumentAdapter) GetValue() interface{} {
+	return da.Value
+}
+
+// GetDataDocuments implements validation.DomainModel interface
+func (dma *DomainModelAdapter) GetDataDocuments() []validation.DataDocumentEntity {
+	result := make([]validation.DataDocumentEntity, len(dma.Data))
+	for i, document := range dma.Data {
+		result[i] = &DataDocumentAdapter{&document}
+	}
+	return result
+}
+
+// GetDefaults implements validation.DomainModel interface
+func (dma *DomainModelAdapter) GetDefaults() (decision, combining string) {
+	return dma.Defaults.Decision, dma.Defaults.Combining
+}
+
+// GetFetch implements validation.DomainModel interface
+func (dma *DomainModelAdapter) GetFetch() (allow []string, timeout, cacheTTL string) {
+	return dma.Fetch.Allow, dma.Fetch.Timeout, dma.Fetch.CacheTTL
+}
+
+// GetClassifications implements validation.DomainModel interface
+func (dma *DomainModelAdapter) GetClassifications() (levels, compartments []string) {
+	return dma.Classifications.Levels, dma.Classifications.Compartments
+}
@@ -0,0 +1,173 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package policydomain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Prefixes of the selectors that are not regular expressions
+const (
+	SelectorGlob  = "glob:"
+	SelectorExact = "exact:"
+)
+
+// globSegment is the class of characters that the single-segment wildcards of a glob
+// selector match: all but the ':' and '/' delimiting the segments of MRNs and URLs, and, as
+// with ** and the '.' of regex selectors, newlines
+const globSegment = `[^:/\n]`
+
+// IsRegexSelector reports whether a selector is a regular expression, rather than a glob or
+// an exact match.
+func IsRegexSelector(selector string) bool {
+	return !strings.HasPrefix(selector, SelectorGlob) && !strings.HasPrefix(selector, SelectorExact)
+}
+
+// SelectorPattern returns the anchored regular expression that a selector matches with.
+//
+// A selector is one of:
+//   - "exact:<value>", matching value and nothing else
+//   - "glob:<pattern>", where * matches any characters but ':' and '/', ** matches any
+//     characters, ? matches one character but ':' and '/', {a,b} matches either a or b,
+//     and \ escapes the character that follows it. Wildcards do not match newlines.
+//   - a regular expression in RE2 syntax, anchored with ^ and $ unless it already is
+func SelectorPattern(selector string) (string, error) {
+	switch {
+	case strings.HasPrefix(selector, SelectorExact):
+		return "^" + regexp.QuoteMeta(strings.TrimPrefix(selector, SelectorExact)) + "$", nil
+	case strings.HasPrefix(selector, SelectorGlob):
+		pattern, err := globPattern(strings.TrimPrefix(selector, SelectorGlob))
+		if err != nil {
+			return "", fmt.Errorf("invalid glob selector %q: %w", selector, err)
+		}
+		return "^" + pattern + "$", nil
+	}
+
+	if !strings.HasPrefix(selector, "^") {
+		selector = "^" + selector
+	}
+	if !strings.HasSuffix(selector, "$") {
+		selector = selector + "$"
+	}
+	return selector, nil
+}
+
+// CompileSelector compiles a selector, as described by [SelectorPattern], into the regular
+// expression that matches it.
+func CompileSelector(selector string) (*regexp.Regexp, error) {
+	pattern, err := SelectorPattern(selector)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(pattern)
+}
+
+// globPattern translates a glob into an unanchored regular expression
+func globPattern(glob string) (string, error) {
+	var sb strings.Builder
+	depth := 0 // of the {} alternatives enclosing the current character
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString(globSegment + "*")
+		case c == '?':
+			sb.WriteString(globSegment)
+		case c == '{':
+			sb.WriteString("(?:")
+			depth++
+		case c == '}':
+			if depth == 0 {
+				return "", fmt.Errorf("unmatched '}' at offset %d", i)
+			}
+			sb.WriteString(")")
+			depth--
+		case c == ',' && depth > 0:
+			sb.WriteString("|")
+		case c == '\\':
+			if i+1 == len(glob) {
+				return "", fmt.Errorf("trailing '\\'")
+			}
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	if depth > 0 {
+		return "", fmt.Errorf("unmatched '{'")
+	}
+	return sb.String(), nil
+}
+
+// SelectorTable shares compiled selectors, so that a pattern repeated by many entities and
+// domains is held in memory once. A compiled [regexp.Regexp] is safe for concurrent use, so
+// entities may share it freely.
+//
+// A SelectorTable is safe for concurrent use.
+type SelectorTable struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// NewSelectorTable creates an empty [SelectorTable].
+func NewSelectorTable() *SelectorTable {
+	return &SelectorTable{patterns: map[string]*regexp.Regexp{}}
+}
+
+// Intern returns the compiled selector held by the table for the pattern of re, reading
+// through to re, which the table then holds, if it holds none.
+func (t *SelectorTable) Intern(re *regexp.Regexp) *regexp.Regexp {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if shared, ok := t.patterns[re.String()]; ok {
+		return shared
+	}
+	t.patterns[re.String()] = re
+	return re
+}
+
+// InternDomain replaces the selectors of the operations, mappers, resources, bypass rules, and
+// impersonation rules of a domain with those held by the table for the same patterns. Selectors
+// that are already held are left untouched, so interning a domain whose selectors the table
+// holds only reads it.
+func (t *SelectorTable) InternDomain(domain *IntermediateModel) {
+	intern := func(selectors []*regexp.Regexp) {
+		for i, re := range selectors {
+			if shared := t.Intern(re); shared != re {
+				selectors[i] = shared
+			}
+		}
+	}
+
+	for i := range domain.Operations {
+		intern(domain.Operations[i].Selectors)
+	}
+	for i := range domain.Mappers {
+		intern(domain.Mappers[i].Selectors)
+	}
+	for i := range domain.Resources {
+		intern(domain.Resources[i].Selectors)
+	}
+	for i := range domain.BypassRules {
+		intern(domain.BypassRules[i].Operations)
+	}
+	for i := range domain.ImpersonationRules {
+		intern(domain.ImpersonationRules[i].Subjects)
+		intern(domain.ImpersonationRules[i].Operations)
+	}
+}
+
+// Len returns the number of distinct patterns held by the table.
+func (t *SelectorTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.patterns)
+}
@@ -0,0 +1,149 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package policydomain
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectorPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"no anchors", ".*", "^.*$"},
+		{"start anchor only", "^test", "^test$"},
+		{"end anchor only", "test$", "^test$"},
+		{"both anchors", "^test$", "^test$"},
+		{"complex pattern", "mrn:.*:read", "^mrn:.*:read$"},
+		{"exact", "exact:api:users.read", `^api:users\.read$`},
+		{"exact with anchors", "exact:^a$", `^\^a\$$`},
+		{"glob", "glob:api:*:read", `^api:[^:/\n]*:read$`},
+		{"glob any depth", "glob:mrn:files:**", "^mrn:files:.*$"},
+		{"glob single character", "glob:v?", `^v[^:/\n]$`},
+		{"glob alternatives", "glob:api:{users,groups}:*", `^api:(?:users|groups):[^:/\n]*$`},
+		{"glob nested alternatives", "glob:{a,b{c,d}}", "^(?:a|b(?:c|d))$"},
+		{"glob literal comma", "glob:a,b", "^a,b$"},
+		{"glob escapes", `glob:a\*b.c`, `^a\*b\.c$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := SelectorPattern(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, pattern)
+		})
+	}
+}
+
+func TestSelectorPattern_InvalidGlob(t *testing.T) {
+	for input, message := range map[string]string{
+		"glob:{a,b":  "unmatched '{'",
+		"glob:a,b}":  "unmatched '}' at offset 3",
+		`glob:api:\`: `trailing '\'`,
+	} {
+		_, err := SelectorPattern(input)
+		assert.ErrorContains(t, err, message, input)
+		assert.ErrorContains(t, err, "invalid glob selector", input)
+	}
+}
+
+func TestCompileSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		matches  []string
+		rejects  []string
+	}{
+		{
+			selector: "glob:mrn:iam:*:read",
+			matches:  []string{"mrn:iam:users:read", "mrn:iam::read"},
+			rejects:  []string{"mrn:iam:users:groups:read", "mrn:iam:a/b:read", "xmrn:iam:users:read"},
+		},
+		{
+			selector: "glob:http://petstore/**",
+			matches:  []string{"http://petstore/pets/1", "http://petstore/"},
+			rejects:  []string{"http://petstore", "https://petstore/pets"},
+		},
+		{
+			selector: "glob:api:{users,groups}:?et",
+			matches:  []string{"api:users:get", "api:groups:set"},
+			rejects:  []string{"api:roles:get", "api:users:gett"},
+		},
+		{
+			selector: "exact:api:users:read",
+			matches:  []string{"api:users:read"},
+			rejects:  []string{"api:users:readx", "apixusers:read"},
+		},
+		{
+			selector: "api:.*",
+			matches:  []string{"api:users:read"},
+			rejects:  []string{"xapi:users"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			re, err := CompileSelector(tt.selector)
+			require.NoError(t, err)
+			for _, s := range tt.matches {
+				assert.True(t, re.MatchString(s), s)
+			}
+			for _, s := range tt.rejects {
+				assert.False(t, re.MatchString(s), s)
+			}
+		})
+	}
+
+	_, err := CompileSelector("[invalid")
+	assert.Error(t, err)
+	_, err = CompileSelector("glob:{a")
+	assert.Error(t, err)
+}
+
+func TestIsRegexSelector(t *testing.T) {
+	assert.True(t, IsRegexSelector("api:.*"))
+	assert.True(t, IsRegexSelector("globs:.*"))
+	assert.False(t, IsRegexSelector("glob:api:*"))
+	assert.False(t, IsRegexSelector("exact:api:read"))
+}
+
+func TestSelectorTable(t *testing.T) {
+	compile := func(selector string) *regexp.Regexp {
+		re, err := CompileSelector(selector)
+		require.NoError(t, err)
+		return re
+	}
+	table := NewSelectorTable()
+
+	first := compile("api:.*")
+	assert.Same(t, first, table.Intern(first))
+	assert.Same(t, first, table.Intern(compile("api:.*")))
+	assert.Same(t, first, table.Intern(compile("^api:.*$")))
+	assert.Equal(t, 1, table.Len())
+
+	domain := &IntermediateModel{
+		Operations:  []Operation{{Selectors: []*regexp.Regexp{compile("api:.*"), compile("glob:api:*")}}},
+		Mappers:     []Mapper{{Selectors: []*regexp.Regexp{compile("api:.*")}}},
+		Resources:   []Resource{{Selectors: []*regexp.Regexp{compile("glob:api:*")}}},
+		BypassRules: []BypassRule{{Operations: []*regexp.Regexp{compile("api:.*")}}},
+		ImpersonationRules: []ImpersonationRule{{
+			Subjects:   []*regexp.Regexp{compile("glob:api:*")},
+			Operations: []*regexp.Regexp{compile("api:.*")},
+		}},
+	}
+	table.InternDomain(domain)
+	assert.Equal(t, 2, table.Len())
+	assert.Same(t, first, domain.Operations[0].Selectors[0])
+	assert.Same(t, first, domain.Mappers[0].Selectors[0])
+	assert.Same(t, first, domain.BypassRules[0].Operations[0])
+	assert.Same(t, first, domain.ImpersonationRules[0].Operations[0])
+	assert.Same(t, domain.Operations[0].Selectors[1], domain.ImpersonationRules[0].Subjects[0])
+	assert.Same(t, domain.Operations[0].Selectors[1], domain.Resources[0].Selectors[0])
+}
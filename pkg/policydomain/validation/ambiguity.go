@@ -0,0 +1,110 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package validation
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// FindAmbiguities reports the roles, groups, resource groups, and scopes that are defined
+// by more than one domain, and resource groups marked as the default in more than one domain.
+// Requests refer to these entities by MRN alone, so only one of the definitions can apply,
+// chosen by the domain precedence of the backend.
+//
+// Ambiguities are not validation failures: each is reported once per defining domain, with
+// Type "ambiguity", in a deterministic order.
+func (v *DomainValidator) FindAmbiguities() []*Error {
+	allDomains := v.domains.GetAllDomains()
+	names := slices.Sorted(maps.Keys(allDomains))
+
+	// entity type -> MRN -> domains defining it, in name order
+	defined := map[string]map[string][]string{
+		"role":           {},
+		"group":          {},
+		"resource-group": {},
+		"scope":          {},
+	}
+	type defaultGroup struct {
+		domain string
+		mrn    string
+	}
+	var defaults []defaultGroup
+
+	for _, name := range names {
+		model := allDomains[name]
+		for mrn := range model.GetRoles() {
+			defined["role"][mrn] = append(defined["role"][mrn], name)
+		}
+		for mrn := range model.GetGroups() {
+			defined["group"][mrn] = append(defined["group"][mrn], name)
+		}
+		for mrn, rg := range model.GetResourceGroups() {
+			defined["resource-group"][mrn] = append(defined["resource-group"][mrn], name)
+			if d, ok := rg.(DefaultEntity); ok && d.IsDefault() {
+				defaults = append(defaults, defaultGroup{domain: name, mrn: mrn})
+			}
+		}
+		for mrn := range model.GetScopes() {
+			defined["scope"][mrn] = append(defined["scope"][mrn], name)
+		}
+	}
+
+	var ambiguities []*Error
+	for _, entityType := range []string{"role", "group", "resource-group", "scope"} {
+		byMRN := defined[entityType]
+		for _, mrn := range slices.Sorted(maps.Keys(byMRN)) {
+			domains := byMRN[mrn]
+			if len(domains) < 2 {
+				continue
+			}
+			for _, domain := range domains {
+				ambiguities = append(ambiguities, &Error{
+					Type:     "ambiguity",
+					Domain:   domain,
+					Entity:   entityType,
+					EntityID: mrn,
+					Field:    "mrn",
+					Message:  fmt.Sprintf("%s '%s' is also defined in %s", entityType, mrn, otherDomains(domains, domain)),
+				})
+			}
+		}
+	}
+
+	if len(defaults) > 1 {
+		var domains []string
+		for _, d := range defaults {
+			domains = append(domains, d.domain)
+		}
+		for _, d := range defaults {
+			ambiguities = append(ambiguities, &Error{
+				Type:     "ambiguity",
+				Domain:   d.domain,
+				Entity:   "resource-group",
+				EntityID: d.mrn,
+				Field:    "default",
+				Message:  fmt.Sprintf("a default resource group is also declared in %s", otherDomains(domains, d.domain)),
+			})
+		}
+	}
+
+	return ambiguities
+}
+
+// otherDomains lists the domains other than self, such as "domains 'a' and 'b'"
+func otherDomains(domains []string, self string) string {
+	var quoted []string
+	for _, d := range domains {
+		if d != self {
+			quoted = append(quoted, fmt.Sprintf("'%s'", d))
+		}
+	}
+	if len(quoted) == 1 {
+		return "domain " + quoted[0]
+	}
+	return "domains " + strings.Join(quoted[:len(quoted)-1], ", ") + " and " + quoted[len(quoted)-1]
+}
@@ -5,7 +5,10 @@
 package validation
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 )
 
@@ -21,19 +24,56 @@ func NewDependencyResolver(resolver *ReferenceResolver) *DependencyResolver {
 	}
 }
 
-// ResolveDependencies resolves all dependencies for a given set of input dependencies
+// DependencyConflictError reports a library that the dependencies of a policy require in
+// incompatible ways: from more than one domain, or with version constraints that its version
+// cannot all satisfy
+type DependencyConflictError struct {
+	Library string // MRN of the library
+	Message string
+}
+
+// Error implements the error interface
+func (e *DependencyConflictError) Error() string {
+	return e.Message
+}
+
+// requirement is a version constraint on a library, and the library requiring it, if any
+type requirement struct {
+	constraint string
+	requiredBy string
+}
+
+// requiredLibrary is a library reached while resolving dependencies
+type requiredLibrary struct {
+	domain       string
+	model        DomainModel
+	id           string
+	requirements []requirement
+}
+
+// ResolveDependencies resolves all dependencies for a given set of input dependencies. The
+// result holds the qualified references of the transitive dependencies, without version
+// constraints. Returns a *DependencyConflictError if they require a library in incompatible ways.
 func (dr *DependencyResolver) ResolveDependencies(model DomainModel, dependencies []string) ([]string, error) {
 	visited := make(map[string]bool)
 	path := make([]string, 0)
-	return dr.resolveDependenciesWithCycleDetection(model, dependencies, visited, path)
+	required := make(map[string]*requiredLibrary)
+	result, err := dr.resolveDependenciesWithCycleDetection(model, dependencies, visited, path, required)
+	if err != nil {
+		return nil, err
+	}
+	if err := dr.checkRequirements(required); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // resolveDependenciesWithCycleDetection performs dependency resolution with cycle detection
-func (dr *DependencyResolver) resolveDependenciesWithCycleDetection(model DomainModel, input []string, visited map[string]bool, path []string) ([]string, error) {
+func (dr *DependencyResolver) resolveDependenciesWithCycleDetection(model DomainModel, input []string, visited map[string]bool, path []string, required map[string]*requiredLibrary) ([]string, error) {
 	var result []string
 
 	for _, dependency := range input {
-		resolved, err := dr.resolveSingleDependency(model, dependency, visited, path)
+		resolved, err := dr.resolveSingleDependency(model, dependency, visited, path, required)
 		if err != nil {
 			return nil, err
 		}
@@ -44,12 +84,14 @@ func (dr *DependencyResolver) resolveDependenciesWithCycleDetection(model Domain
 }
 
 // resolveSingleDependency resolves a single dependency and its transitive dependencies
-func (dr *DependencyResolver) resolveSingleDependency(model DomainModel, dependency string, visited map[string]bool, path []string) ([]string, error) {
+func (dr *DependencyResolver) resolveSingleDependency(model DomainModel, dependency string, visited map[string]bool, path []string, required map[string]*requiredLibrary) ([]string, error) {
+	ref, constraint := SplitVersionConstraint(dependency)
+
 	var result []string
-	result = append(result, dependency)
+	result = append(result, ref)
 
 	// Create qualified reference for cycle detection
-	qualifiedRef := dr.resolver.QualifyReference(dependency, model.GetName())
+	qualifiedRef := dr.resolver.QualifyReference(ref, model.GetName())
 
 	// Check for cycles
 	if err := dr.checkForCycle(qualifiedRef, visited, path); err != nil {
@@ -72,8 +114,23 @@ func (dr *DependencyResolver) resolveSingleDependency(model DomainModel, depende
 		return nil, fmt.Errorf("failed to get library '%s' in domain '%s': %w", depID, targetDomain, err)
 	}
 
+	// Record the requirement for conflict detection
+	key := fmt.Sprintf("%s/%s", targetDomain, depID)
+	lib, ok := required[key]
+	if !ok {
+		lib = &requiredLibrary{domain: targetDomain, model: targetModel, id: depID}
+		required[key] = lib
+	}
+	if constraint != "" {
+		var requiredBy string
+		if len(path) > 0 {
+			requiredBy = path[len(path)-1]
+		}
+		lib.requirements = append(lib.requirements, requirement{constraint: constraint, requiredBy: requiredBy})
+	}
+
 	// Recursively resolve transitive dependencies
-	transitive, err := dr.resolveDependenciesWithCycleDetection(targetModel, library.GetDependencies(), visited, newPath)
+	transitive, err := dr.resolveDependenciesWithCycleDetection(targetModel, library.GetDependencies(), visited, newPath, required)
 	if err != nil {
 		return nil, err
 	}
@@ -90,6 +147,76 @@ func (dr *DependencyResolver) resolveSingleDependency(model DomainModel, depende
 	return result, nil
 }
 
+// checkRequirements checks that each library reached is required from a single domain, as the
+// Rego package of a library can be loaded only once, and that its version satisfies every
+// constraint on it
+func (dr *DependencyResolver) checkRequirements(required map[string]*requiredLibrary) error {
+	keys := slices.Sorted(maps.Keys(required))
+
+	domainsByID := make(map[string][]string)
+	for _, key := range keys {
+		lib := required[key]
+		domainsByID[lib.id] = append(domainsByID[lib.id], lib.domain)
+	}
+	for _, key := range keys {
+		lib := required[key]
+		if domains := domainsByID[lib.id]; len(domains) > 1 {
+			return &DependencyConflictError{
+				Library: lib.id,
+				Message: fmt.Sprintf("library '%s' is required from domains '%s'", lib.id, strings.Join(domains, "', '")),
+			}
+		}
+	}
+
+	for _, key := range keys {
+		lib := required[key]
+
+		var unsatisfied error
+		constraints := make(map[string]bool)
+		for _, req := range lib.requirements {
+			constraints[req.constraint] = true
+			if err := dr.resolver.CheckLibraryVersion(lib.id+"@"+req.constraint, lib.model, lib.id); err != nil && unsatisfied == nil {
+				unsatisfied = err
+			}
+		}
+		if unsatisfied == nil {
+			continue
+		}
+
+		libraryVersion := ""
+		if versioned, ok := lib.model.GetPolicyLibraries()[lib.id].(VersionedEntity); ok {
+			libraryVersion = versioned.GetVersion()
+		}
+		if len(constraints) < 2 || libraryVersion == "" {
+			return unsatisfied
+		}
+
+		var described []string
+		for _, req := range lib.requirements {
+			by := "directly"
+			if req.requiredBy != "" {
+				by = fmt.Sprintf("by '%s'", req.requiredBy)
+			}
+			if d := fmt.Sprintf("'%s' required %s", req.constraint, by); !slices.Contains(described, d) {
+				described = append(described, d)
+			}
+		}
+		return &DependencyConflictError{
+			Library: lib.id,
+			Message: fmt.Sprintf("conflicting version constraints on library '%s' version %s in domain '%s': %s",
+				lib.id, libraryVersion, lib.domain, strings.Join(described, ", ")),
+		}
+	}
+
+	return nil
+}
+
+// isDependencyConflict reports whether err is a *DependencyConflictError
+func isDependencyConflict(err error) bool {
+	var conflict *DependencyConflictError
+	return errors.As(err, &conflict)
+}
+
 // checkForCycle detects if adding a dependency would create a cycle
 func (dr *DependencyResolver) checkForCycle(qualifiedRef string, visited map[string]bool, path []string) error {
 	if !visited[qualifiedRef] {
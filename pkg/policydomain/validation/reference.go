@@ -6,6 +6,7 @@ package validation
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 )
 
@@ -41,6 +42,15 @@ func (r *ReferenceResolver) ParseReference(reference, sourceDomain string) (targ
 	return sourceDomain, reference, nil
 }
 
+// parseTypedReference parses a reference of the expected type, ignoring the version constraint
+// of a library reference
+func (r *ReferenceResolver) parseTypedReference(reference, sourceDomain, expectedType string) (targetDomain, objectID string, err error) {
+	if expectedType == "library" {
+		reference, _ = SplitVersionConstraint(reference)
+	}
+	return r.ParseReference(reference, sourceDomain)
+}
+
 // QualifyReference converts a reference to its fully qualified form
 func (r *ReferenceResolver) QualifyReference(reference, sourceDomain string) string {
 	if strings.Contains(reference, "/") {
@@ -49,13 +59,14 @@ func (r *ReferenceResolver) QualifyReference(reference, sourceDomain string) str
 	return fmt.Sprintf("%s/%s", sourceDomain, reference)
 }
 
-// ValidateReference checks if a reference exists and is of the expected type
+// ValidateReference checks if a reference exists and is of the expected type, and that a
+// library satisfies the version constraint of the reference, if any
 func (r *ReferenceResolver) ValidateReference(reference, sourceDomain, expectedType string) error {
 	if reference == "" {
 		return nil
 	}
 
-	targetDomain, objectID, err := r.ParseReference(reference, sourceDomain)
+	targetDomain, objectID, err := r.parseTypedReference(reference, sourceDomain, expectedType)
 	if err != nil {
 		return err
 	}
@@ -71,12 +82,43 @@ func (r *ReferenceResolver) ValidateReference(reference, sourceDomain, expectedT
 		return fmt.Errorf("%s reference '%s' not found in domain '%s'", expectedType, objectID, targetDomain)
 	}
 
+	if expectedType == "library" {
+		return r.CheckLibraryVersion(reference, targetModel, objectID)
+	}
+
+	return nil
+}
+
+// CheckLibraryVersion checks that the library objectID of targetModel satisfies the version
+// constraint of a library reference, if it has one
+func (r *ReferenceResolver) CheckLibraryVersion(reference string, targetModel DomainModel, objectID string) error {
+	_, constraint := SplitVersionConstraint(reference)
+	if constraint == "" {
+		return nil
+	}
+
+	var libraryVersion string
+	if versioned, ok := targetModel.GetPolicyLibraries()[objectID].(VersionedEntity); ok {
+		libraryVersion = versioned.GetVersion()
+	}
+	if libraryVersion == "" {
+		return fmt.Errorf("library '%s' in domain '%s' declares no version to satisfy '%s'", objectID, targetModel.GetName(), constraint)
+	}
+
+	ok, err := SatisfiesConstraint(libraryVersion, constraint)
+	if err != nil {
+		return fmt.Errorf("library '%s': %w", objectID, err)
+	}
+	if !ok {
+		return fmt.Errorf("library '%s' version %s in domain '%s' does not satisfy '%s'", objectID, libraryVersion, targetModel.GetName(), constraint)
+	}
 	return nil
 }
 
-// ResolveReference parses and validates a reference, returning the target domain and model
+// ResolveReference parses and validates a reference, returning the target domain and model.
+// The version constraint of a library reference is ignored; see CheckLibraryVersion.
 func (r *ReferenceResolver) ResolveReference(reference, sourceDomain, expectedType string) (targetDomain string, targetModel DomainModel, objectID string, err error) {
-	targetDomain, objectID, err = r.ParseReference(reference, sourceDomain)
+	targetDomain, objectID, err = r.parseTypedReference(reference, sourceDomain, expectedType)
 	if err != nil {
 		return "", nil, "", err
 	}
@@ -143,6 +185,7 @@ func (r *ReferenceResolver) FindObjectAcrossDomains(objectID, objectType string)
 	}
 
 	if len(foundDomains) > 1 {
+		slices.Sort(foundDomains)
 		return "", nil, fmt.Errorf("ambiguous %s '%s' found in multiple domains: %v", objectType, objectID, foundDomains)
 	}
 
@@ -0,0 +1,269 @@
+//
+//  Copyright © Manetu Inc. All rights reserved.
+//
+
+package validation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// version is a semantic version, such as 1.4.2 or 2.0.0-rc.1. Build metadata is ignored.
+type version struct {
+	major, minor, patch uint64
+	pre                 []string
+}
+
+// parseVersion parses a complete semantic version, with an optional leading "v"
+func parseVersion(s string) (version, error) {
+	v, parts, err := parsePartialVersion(s)
+	if err != nil {
+		return version{}, err
+	}
+	if parts != 3 {
+		return version{}, fmt.Errorf("invalid version '%s', expected MAJOR.MINOR.PATCH", s)
+	}
+	return v, nil
+}
+
+// parsePartialVersion parses a version of one to three numbers, such as "1" or "1.2", returning
+// how many were given. Missing numbers are zero.
+func parsePartialVersion(s string) (version, int, error) {
+	core := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(core, '+'); i >= 0 {
+		core = core[:i]
+	}
+
+	var v version
+	if i := strings.IndexByte(core, '-'); i >= 0 {
+		v.pre = strings.Split(core[i+1:], ".")
+		core = core[:i]
+		for _, id := range v.pre {
+			if id == "" {
+				return version{}, 0, fmt.Errorf("invalid version '%s': empty pre-release identifier", s)
+			}
+		}
+	}
+
+	numbers := strings.Split(core, ".")
+	if len(numbers) > 3 {
+		return version{}, 0, fmt.Errorf("invalid version '%s', expected MAJOR.MINOR.PATCH", s)
+	}
+	fields := []*uint64{&v.major, &v.minor, &v.patch}
+	for i, n := range numbers {
+		value, err := strconv.ParseUint(n, 10, 64)
+		if err != nil || (len(n) > 1 && n[0] == '0') {
+			return version{}, 0, fmt.Errorf("invalid version '%s', expected MAJOR.MINOR.PATCH", s)
+		}
+		*fields[i] = value
+	}
+	if v.pre != nil && len(numbers) != 3 {
+		return version{}, 0, fmt.Errorf("invalid version '%s': pre-release requires MAJOR.MINOR.PATCH", s)
+	}
+
+	return v, len(numbers), nil
+}
+
+func (v version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.pre != nil {
+		s += "-" + strings.Join(v.pre, ".")
+	}
+	return s
+}
+
+// compare orders versions by semantic version precedence, returning -1, 0, or 1
+func (v version) compare(o version) int {
+	for _, pair := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// a pre-release precedes its release
+	switch {
+	case v.pre == nil && o.pre == nil:
+		return 0
+	case v.pre == nil:
+		return 1
+	case o.pre == nil:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePrerelease(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// comparePrerelease orders pre-release identifiers: numeric ones numerically and before
+// alphanumeric ones, which are ordered lexically
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		if an == bn {
+			return 0
+		}
+		if an < bn {
+			return -1
+		}
+		return 1
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// comparator is a single bound of a constraint, such as ">=1.2.0"
+type comparator struct {
+	op string
+	v  version
+}
+
+func (c comparator) matches(v version) bool {
+	cmp := v.compare(c.v)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default: // "<="
+		return cmp <= 0
+	}
+}
+
+// versionConstraint is a set of comparators that a version must all satisfy
+type versionConstraint []comparator
+
+// parseConstraint parses a version constraint. A constraint is one or more comparators
+// separated by spaces or commas, each of which must be satisfied:
+//
+//   - ^1.2.3 allows changes that do not modify the left-most non-zero number (>=1.2.3 <2.0.0)
+//   - ~1.2.3 allows patch changes (>=1.2.3 <1.3.0); ~1 allows minor changes
+//   - =1.2.3 or 1.2.3 requires the exact version; a partial version such as 1.2 matches any 1.2.x
+//   - >, >=, <, and <= compare against the version, with missing numbers taken as zero
+//   - * matches any version
+func parseConstraint(s string) (versionConstraint, error) {
+	terms := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+
+	var c versionConstraint
+	for _, term := range terms {
+		if term == "*" {
+			continue
+		}
+
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(term, prefix) {
+				op = prefix
+				break
+			}
+		}
+		v, parts, err := parsePartialVersion(strings.TrimPrefix(term, op))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint '%s': %w", s, err)
+		}
+
+		switch op {
+		case ">", ">=", "<", "<=":
+			c = append(c, comparator{op, v})
+		case "^":
+			c = append(c, comparator{">=", v}, comparator{"<", caretBound(v, parts)})
+		case "~":
+			upper := version{major: v.major + 1}
+			if parts > 1 {
+				upper = version{major: v.major, minor: v.minor + 1}
+			}
+			c = append(c, comparator{">=", v}, comparator{"<", upper})
+		default: // "=" or none
+			if parts == 3 {
+				c = append(c, comparator{"=", v})
+			} else {
+				c = append(c, comparator{">=", v}, comparator{"<", partialBound(v, parts)})
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// caretBound is the exclusive upper bound of ^v, which increments the left-most non-zero
+// number given, or the last number given if all are zero
+func caretBound(v version, parts int) version {
+	switch {
+	case v.major > 0 || parts == 1:
+		return version{major: v.major + 1}
+	case v.minor > 0 || parts == 2:
+		return version{minor: v.minor + 1}
+	default:
+		return version{patch: v.patch + 1}
+	}
+}
+
+// partialBound is the exclusive upper bound of the versions matching a partial version
+func partialBound(v version, parts int) version {
+	if parts == 1 {
+		return version{major: v.major + 1}
+	}
+	return version{major: v.major, minor: v.minor + 1}
+}
+
+func (c versionConstraint) matches(v version) bool {
+	for _, cmp := range c {
+		if !cmp.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitVersionConstraint splits a library reference into the reference proper and its version
+// constraint, if any, such as "mrn:iam:library:utils@^1.2" into "mrn:iam:library:utils" and "^1.2".
+func SplitVersionConstraint(reference string) (ref, constraint string) {
+	if i := strings.LastIndexByte(reference, '@'); i >= 0 {
+		return reference[:i], reference[i+1:]
+	}
+	return reference, ""
+}
+
+// ValidateVersion checks that a library version is a complete semantic version.
+func ValidateVersion(v string) error {
+	_, err := parseVersion(v)
+	return err
+}
+
+// SatisfiesConstraint reports whether a version satisfies a version constraint.
+func SatisfiesConstraint(v, constraint string) (bool, error) {
+	parsed, err := parseVersion(v)
+	if err != nil {
+		return false, err
+	}
+	c, err := parseConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	return c.matches(parsed), nil
+}
@@ -24,6 +24,12 @@ type DomainModel interface {
 	GetOperations() []OperationEntity
 	GetMappers() []MapperEntity
 	GetResources() []ResourceEntity
+	GetBypassRules() []BypassRuleEntity
+	GetImpersonationRules() []ImpersonationRuleEntity
+	GetDefaults() (decision, combining string)
+	GetDataDocuments() []DataDocumentEntity
+	GetFetch() (allow []string, timeout, cacheTTL string)
+	GetClassifications() (levels, compartments []string)
 }
 
 // RegoEntity interface for any entity that contains Rego code
@@ -38,14 +44,46 @@ type PolicyEntity interface {
 	GetDependencies() []string
 }
 
+// VersionedEntity is optionally implemented by the PolicyEntity of a policy library that
+// declares a semantic version, against which dependencies may pin a version constraint
+type VersionedEntity interface {
+	GetVersion() string
+}
+
 // ReferenceEntity interface for entities that reference policies
 type ReferenceEntity interface {
 	GetPolicy() string
 }
 
-// GroupEntity interface for groups that reference roles
+// DenyPolicyEntity is optionally implemented by the ReferenceEntity of a role or resource group
+// that references deny policies, whose DENY overrides every GRANT
+type DenyPolicyEntity interface {
+	GetDenyPolicies() []string
+}
+
+// DefaultEntity is optionally implemented by the ReferenceEntity of a resource group that
+// can be designated as the default for resources matching no selector
+type DefaultEntity interface {
+	IsDefault() bool
+}
+
+// PurposeEntity is optionally implemented by the ReferenceEntity of a resource group, and by a
+// ResourceEntity, that restricts the purposes its resources may be accessed for
+type PurposeEntity interface {
+	GetAllowedPurposes() []string
+}
+
+// NetworkEntity is optionally implemented by the ReferenceEntity of a scope or resource group
+// that admits only requests from some networks or countries
+type NetworkEntity interface {
+	// GetNetwork returns the CIDRs and countries of the network rule, and false if none is declared
+	GetNetwork() (cidrs []string, countries []string, declared bool)
+}
+
+// GroupEntity interface for groups that reference roles and nested groups
 type GroupEntity interface {
 	GetRoles() []string
+	GetGroups() []string
 }
 
 // OperationEntity interface for operations
@@ -54,13 +92,54 @@ type OperationEntity interface {
 	GetPolicy() string
 }
 
+// ApprovalEntity is optionally implemented by an OperationEntity whose GRANTs may require the
+// approval of other principals
+type ApprovalEntity interface {
+	GetRequiresApproval() int
+}
+
+// IdentityEntity is optionally implemented by an OperationEntity that sets how the GRANTs of
+// the principal's roles combine
+type IdentityEntity interface {
+	GetIdentity() (combining string, minimum int)
+}
+
 // MapperEntity interface for mappers that have Rego and an ID
 type MapperEntity interface {
 	RegoEntity
 	GetID() string
 }
 
-// ResourceEntity interface for resources that reference resource-groups
+// ResourceEntity interface for resources that reference resource-groups and carry security labels
 type ResourceEntity interface {
 	GetGroup() string
+	GetClassification() string
+	GetCompartments() []string
+}
+
+// ConditionalEntity is optionally implemented by a ResourceEntity that may assign resources to
+// its group by their attributes, rather than label the resources its selectors match
+type ConditionalEntity interface {
+	IsConditional() bool
+	// GetConditionLevels returns the classification levels its conditions compare with
+	GetConditionLevels() []string
+}
+
+// BypassRuleEntity interface for SYSTEM phase bypass rules that reference roles
+type BypassRuleEntity interface {
+	GetName() string
+	GetReason() string
+	GetRoles() []string
+}
+
+// ImpersonationRuleEntity interface for impersonation rules that reference the roles of actors
+type ImpersonationRuleEntity interface {
+	GetName() string
+	GetRoles() []string
+}
+
+// DataDocumentEntity interface for static data documents
+type DataDocumentEntity interface {
+	GetName() string
+	GetValue() interface{}
 }
@@ -54,6 +54,11 @@ func (bv *BundleValidator) GetAllValidationErrors() []*Error {
 	return bv.validator.GetAllValidationErrors()
 }
 
+// FindAmbiguities returns the entities defined by more than one domain
+func (bv *BundleValidator) FindAmbiguities() []*Error {
+	return bv.validator.FindAmbiguities()
+}
+
 // ValidateDependencies resolves and validates dependencies for a domain model
 func (bv *BundleValidator) ValidateDependencies(model DomainModel, dependencies []string) ([]string, error) {
 	resolver := NewReferenceResolver(bv.validator.domains)
@@ -6,7 +6,15 @@ package validation
 
 import (
 	"fmt"
+	"maps"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+
+	events "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
 )
 
 // libraryNode represents a library in the dependency graph
@@ -41,6 +49,9 @@ func (v *DomainValidator) ValidateAll() error {
 	// Validate library cycles
 	v.validateAllLibraryCycles(errors)
 
+	// Validate nested group cycles
+	v.validateAllGroupCycles(errors)
+
 	// Validate rego compilation
 	v.validateAllRegoCompilation(errors)
 
@@ -121,6 +132,13 @@ func (v *DomainValidator) validateAllLibraryCycles(errors *Errors) {
 	}
 }
 
+// validateAllGroupCycles detects groups that contain themselves, accumulating errors
+func (v *DomainValidator) validateAllGroupCycles(errors *Errors) {
+	if err := v.detectGroupCycles(); err != nil {
+		errors.AddCycleError(err.Error())
+	}
+}
+
 // validateAllRegoCompilation validates rego compilation
 func (v *DomainValidator) validateAllRegoCompilation(errors *Errors) {
 	allDomains := v.domains.GetAllDomains()
@@ -140,17 +158,24 @@ func (v *DomainValidator) validateDomainReferences(domainName string, model Doma
 	v.validateScopes(domainName, model, errors)
 	v.validateOperations(domainName, model, errors)
 	v.validateResources(domainName, model, errors)
+	v.validateBypassRules(domainName, model, errors)
+	v.validateImpersonationRules(domainName, model, errors)
+	v.validateDefaults(domainName, model, errors)
+	v.validateDataDocuments(domainName, model, errors)
+	v.validateFetch(domainName, model, errors)
+	v.validateClassifications(domainName, model, errors)
 }
 
-// validatePolicyLibraries validates all policy library dependencies
+// validatePolicyLibraries validates all policy library versions and dependencies
 func (v *DomainValidator) validatePolicyLibraries(domainName string, model DomainModel, errors *Errors) {
 	libraries := model.GetPolicyLibraries()
 	for libID, library := range libraries {
-		for _, dep := range library.GetDependencies() {
-			if err := v.resolver.ValidateReference(dep, domainName, "library"); err != nil {
-				errors.AddReferenceError(domainName, "library", libID, "dependencies", err.Error())
+		if versioned, ok := library.(VersionedEntity); ok && versioned.GetVersion() != "" {
+			if err := ValidateVersion(versioned.GetVersion()); err != nil {
+				errors.AddError("structure", domainName, "library", libID, "version", err.Error())
 			}
 		}
+		v.validateDependencies(domainName, "library", libID, model, library.GetDependencies(), errors)
 	}
 }
 
@@ -158,12 +183,28 @@ func (v *DomainValidator) validatePolicyLibraries(domainName string, model Domai
 func (v *DomainValidator) validatePolicies(domainName string, model DomainModel, errors *Errors) {
 	policies := model.GetPolicies()
 	for policyID, policy := range policies {
-		for _, dep := range policy.GetDependencies() {
-			if err := v.resolver.ValidateReference(dep, domainName, "library"); err != nil {
-				errors.AddReferenceError(domainName, "policy", policyID, "dependencies", err.Error())
-			}
+		v.validateDependencies(domainName, "policy", policyID, model, policy.GetDependencies(), errors)
+	}
+}
+
+// validateDependencies validates the library references of a policy or library, and, if they
+// are valid, that its transitive dependencies do not conflict
+func (v *DomainValidator) validateDependencies(domainName, entityType, entityID string, model DomainModel, dependencies []string, errors *Errors) {
+	valid := true
+	for _, dep := range dependencies {
+		if err := v.resolver.ValidateReference(dep, domainName, "library"); err != nil {
+			errors.AddReferenceError(domainName, entityType, entityID, "dependencies", err.Error())
+			valid = false
 		}
 	}
+	if !valid {
+		return
+	}
+
+	// other failures of transitive dependencies are reported against the library declaring them
+	if _, err := NewDependencyResolver(v.resolver).ResolveDependencies(model, dependencies); isDependencyConflict(err) {
+		errors.AddReferenceError(domainName, entityType, entityID, "dependencies", err.Error())
+	}
 }
 
 // validateRoles validates all role policy references
@@ -173,10 +214,17 @@ func (v *DomainValidator) validateRoles(domainName string, model DomainModel, er
 		if err := v.resolver.ValidateReference(role.GetPolicy(), domainName, "policy"); err != nil {
 			errors.AddReferenceError(domainName, "role", roleID, "policy", err.Error())
 		}
+		v.validateDenyPolicies(domainName, "role", roleID, role, errors)
+		// network rules are only enforced for scopes and resource groups, never silently ignored
+		if n, ok := role.(NetworkEntity); ok {
+			if _, _, declared := n.GetNetwork(); declared {
+				errors.AddError("structure", domainName, "role", roleID, "network", "network rules apply to scopes and resource groups only")
+			}
+		}
 	}
 }
 
-// validateGroups validates all group role references
+// validateGroups validates all group role and nested group references
 func (v *DomainValidator) validateGroups(domainName string, model DomainModel, errors *Errors) {
 	groups := model.GetGroups()
 	for groupID, group := range groups {
@@ -185,6 +233,11 @@ func (v *DomainValidator) validateGroups(domainName string, model DomainModel, e
 				errors.AddReferenceError(domainName, "group", groupID, fmt.Sprintf("roles[%d]", i), err.Error())
 			}
 		}
+		for i, groupRef := range group.GetGroups() {
+			if err := v.resolver.ValidateReference(groupRef, domainName, "group"); err != nil {
+				errors.AddReferenceError(domainName, "group", groupID, fmt.Sprintf("groups[%d]", i), err.Error())
+			}
+		}
 	}
 }
 
@@ -195,6 +248,9 @@ func (v *DomainValidator) validateResourceGroups(domainName string, model Domain
 		if err := v.resolver.ValidateReference(rg.GetPolicy(), domainName, "policy"); err != nil {
 			errors.AddReferenceError(domainName, "resource-group", rgID, "policy", err.Error())
 		}
+		v.validateDenyPolicies(domainName, "resource-group", rgID, rg, errors)
+		validatePurposes(domainName, "resource-group", rgID, rg, errors)
+		validateNetwork(domainName, "resource-group", rgID, rg, errors)
 	}
 }
 
@@ -205,6 +261,11 @@ func (v *DomainValidator) validateScopes(domainName string, model DomainModel, e
 		if err := v.resolver.ValidateReference(scope.GetPolicy(), domainName, "policy"); err != nil {
 			errors.AddReferenceError(domainName, "scope", scopeID, "policy", err.Error())
 		}
+		// deny policies are only enforced for roles and resource groups, never silently ignored
+		if dp, ok := scope.(DenyPolicyEntity); ok && len(dp.GetDenyPolicies()) > 0 {
+			errors.AddError("structure", domainName, "scope", scopeID, "deny-policies", "deny policies apply to roles and resource groups only")
+		}
+		validateNetwork(domainName, "scope", scopeID, scope, errors)
 	}
 }
 
@@ -215,6 +276,22 @@ func (v *DomainValidator) validateOperations(domainName string, model DomainMode
 		if err := v.resolver.ValidateReference(operation.GetPolicy(), domainName, "policy"); err != nil {
 			errors.AddReferenceError(domainName, "operation", fmt.Sprintf("operation[%d]", i), "policy", err.Error())
 		}
+		if a, ok := operation.(ApprovalEntity); ok && a.GetRequiresApproval() < 0 {
+			errors.AddError("structure", domainName, "operation", fmt.Sprintf("operation[%d]", i), "requires-approval", fmt.Sprintf("requires-approval must not be negative, got %d", a.GetRequiresApproval()))
+		}
+		if id, ok := operation.(IdentityEntity); ok {
+			combining, minimum := id.GetIdentity()
+			switch combining {
+			case "", "any", "all":
+			default:
+				errors.AddError("structure", domainName, "operation", fmt.Sprintf("operation[%d]", i), "identity",
+					fmt.Sprintf("invalid identity combining '%s', expected any or all", combining))
+			}
+			if minimum < 0 {
+				errors.AddError("structure", domainName, "operation", fmt.Sprintf("operation[%d]", i), "identity",
+					fmt.Sprintf("identity minimum must not be negative, got %d", minimum))
+			}
+		}
 	}
 }
 
@@ -225,9 +302,299 @@ func (v *DomainValidator) validateResources(domainName string, model DomainModel
 		if err := v.resolver.ValidateReference(resource.GetGroup(), domainName, "resource-group"); err != nil {
 			errors.AddReferenceError(domainName, "resource", fmt.Sprintf("resource[%d]", i), "group", err.Error())
 		}
+		validatePurposes(domainName, "resource", fmt.Sprintf("resource[%d]", i), resource, errors)
+	}
+}
+
+// validateDenyPolicies validates the deny policy references of a role or resource group.
+//
+// Every deny policy must resolve, since a deny policy that cannot be found would deny every
+// request it applies to, and must be listed once.
+func (v *DomainValidator) validateDenyPolicies(domainName, entityType, entityID string, entity ReferenceEntity, errors *Errors) {
+	dp, ok := entity.(DenyPolicyEntity)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	for i, ref := range dp.GetDenyPolicies() {
+		field := fmt.Sprintf("deny-policies[%d]", i)
+		if seen[ref] {
+			errors.AddError("structure", domainName, entityType, entityID, field, fmt.Sprintf("duplicate deny policy '%s'", ref))
+			continue
+		}
+		seen[ref] = true
+		if err := v.resolver.ValidateReference(ref, domainName, "policy"); err != nil {
+			errors.AddReferenceError(domainName, entityType, entityID, field, err.Error())
+		}
+	}
+}
+
+// validatePurposes reports empty and duplicate allowed purposes of a resource or resource group
+func validatePurposes(domainName, entityType, entityID string, entity interface{}, errors *Errors) {
+	pe, ok := entity.(PurposeEntity)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, purpose := range pe.GetAllowedPurposes() {
+		switch {
+		case purpose == "":
+			errors.AddError("structure", domainName, entityType, entityID, "allowed-purposes", "purposes cannot be empty")
+		case seen[purpose]:
+			errors.AddError("structure", domainName, entityType, entityID, "allowed-purposes",
+				fmt.Sprintf("duplicate purpose '%s'", purpose))
+		}
+		seen[purpose] = true
+	}
+}
+
+// validateNetwork reports network rules of a scope or resource group that list neither CIDRs nor
+// countries, invalid CIDRs, and countries that are not ISO 3166-1 alpha-2 codes
+func validateNetwork(domainName, entityType, entityID string, entity ReferenceEntity, errors *Errors) {
+	n, ok := entity.(NetworkEntity)
+	if !ok {
+		return
+	}
+	cidrs, countries, declared := n.GetNetwork()
+	if !declared {
+		return
+	}
+	if len(cidrs) == 0 && len(countries) == 0 {
+		errors.AddError("structure", domainName, entityType, entityID, "network", "network rule must list cidrs or countries")
+	}
+	for i, cidr := range cidrs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errors.AddError("structure", domainName, entityType, entityID, fmt.Sprintf("network.cidrs[%d]", i),
+				fmt.Sprintf("invalid CIDR '%s': %v", cidr, err))
+		}
+	}
+	for i, country := range countries {
+		if !isCountryCode(country) {
+			errors.AddError("structure", domainName, entityType, entityID, fmt.Sprintf("network.countries[%d]", i),
+				fmt.Sprintf("invalid country '%s', expected an ISO 3166-1 alpha-2 code such as US", country))
+		}
+	}
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+// validateBypassRules validates the names, reasons, and role references of all bypass rules
+func (v *DomainValidator) validateBypassRules(domainName string, model DomainModel, errors *Errors) {
+	names := make(map[string]bool)
+	for i, rule := range model.GetBypassRules() {
+		ruleID := rule.GetName()
+		if ruleID == "" {
+			ruleID = fmt.Sprintf("bypass[%d]", i)
+			errors.AddError("structure", domainName, "bypass-rule", ruleID, "name", "name is required")
+		} else if names[ruleID] {
+			errors.AddError("structure", domainName, "bypass-rule", ruleID, "name", "duplicate bypass rule name")
+		}
+		names[ruleID] = true
+
+		// NOT_GRANTED is the absence of a grant, not a reason for one, and BREAK_GLASS is
+		// reserved for engine overrides
+		if reason, ok := events.AccessRecord_BypassGrantReason_value[rule.GetReason()]; !ok || reason == 0 ||
+			reason == int32(events.AccessRecord_BREAK_GLASS) {
+			errors.AddError("structure", domainName, "bypass-rule", ruleID, "reason",
+				fmt.Sprintf("invalid reason '%s', expected one of PUBLIC, VISITOR, ANTI_LOCKOUT", rule.GetReason()))
+		}
+
+		// a rule without roles would grant every principal
+		if len(rule.GetRoles()) == 0 {
+			errors.AddError("structure", domainName, "bypass-rule", ruleID, "roles", "at least one role is required")
+		}
+		for j, roleRef := range rule.GetRoles() {
+			if roleRef == "" {
+				errors.AddReferenceError(domainName, "bypass-rule", ruleID, fmt.Sprintf("roles[%d]", j), "empty reference")
+			} else if err := v.resolver.ValidateReference(roleRef, domainName, "role"); err != nil {
+				errors.AddReferenceError(domainName, "bypass-rule", ruleID, fmt.Sprintf("roles[%d]", j), err.Error())
+			}
+		}
+	}
+}
+
+// validateImpersonationRules validates the names and role references of all impersonation rules
+func (v *DomainValidator) validateImpersonationRules(domainName string, model DomainModel, errors *Errors) {
+	names := make(map[string]bool)
+	for i, rule := range model.GetImpersonationRules() {
+		ruleID := rule.GetName()
+		if ruleID == "" {
+			ruleID = fmt.Sprintf("impersonation[%d]", i)
+			errors.AddError("structure", domainName, "impersonation-rule", ruleID, "name", "name is required")
+		} else if names[ruleID] {
+			errors.AddError("structure", domainName, "impersonation-rule", ruleID, "name", "duplicate impersonation rule name")
+		}
+		names[ruleID] = true
+
+		// a rule without roles would let every actor impersonate
+		if len(rule.GetRoles()) == 0 {
+			errors.AddError("structure", domainName, "impersonation-rule", ruleID, "roles", "at least one role is required")
+		}
+		for j, roleRef := range rule.GetRoles() {
+			if roleRef == "" {
+				errors.AddReferenceError(domainName, "impersonation-rule", ruleID, fmt.Sprintf("roles[%d]", j), "empty reference")
+			} else if err := v.resolver.ValidateReference(roleRef, domainName, "role"); err != nil {
+				errors.AddReferenceError(domainName, "impersonation-rule", ruleID, fmt.Sprintf("roles[%d]", j), err.Error())
+			}
+		}
+	}
+}
+
+// validateDefaults validates the domain's decision strategy
+func (v *DomainValidator) validateDefaults(domainName string, model DomainModel, errors *Errors) {
+	decision, combining := model.GetDefaults()
+	switch decision {
+	case "", "deny", "allow":
+	default:
+		errors.AddError("structure", domainName, "defaults", "defaults", "decision",
+			fmt.Sprintf("invalid decision '%s', expected deny or allow", decision))
+	}
+	switch combining {
+	case "", "all", "any":
+	default:
+		errors.AddError("structure", domainName, "defaults", "defaults", "combining",
+			fmt.Sprintf("invalid combining '%s', expected all or any", combining))
+	}
+}
+
+// dataNamePattern matches the names of data documents, which must be usable as Rego references
+var dataNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateDataDocuments validates the names and values of all data documents
+func (v *DomainValidator) validateDataDocuments(domainName string, model DomainModel, errors *Errors) {
+	names := make(map[string]bool)
+	for i, document := range model.GetDataDocuments() {
+		documentID := document.GetName()
+		switch {
+		case documentID == "":
+			documentID = fmt.Sprintf("data[%d]", i)
+			errors.AddError("structure", domainName, "data", documentID, "name", "name is required")
+		case !dataNamePattern.MatchString(documentID):
+			errors.AddError("structure", domainName, "data", documentID, "name",
+				"invalid name, expected letters, digits, and underscores, not starting with a digit")
+		case names[documentID]:
+			errors.AddError("structure", domainName, "data", documentID, "name", "duplicate data document name")
+		}
+		names[documentID] = true
+
+		if document.GetValue() == nil {
+			errors.AddError("structure", domainName, "data", documentID, "value", "value is required")
+		}
 	}
 }
 
+// validateFetch validates the allowlist and durations of the policyengine.fetch settings
+func (v *DomainValidator) validateFetch(domainName string, model DomainModel, errors *Errors) {
+	allow, timeout, cacheTTL := model.GetFetch()
+	if len(allow) == 0 && timeout == "" && cacheTTL == "" {
+		return
+	}
+
+	if len(allow) == 0 {
+		errors.AddError("structure", domainName, "fetch", "fetch", "allow", "at least one URL is required")
+	}
+	for _, prefix := range allow {
+		u, err := url.Parse(prefix)
+		switch {
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			errors.AddError("structure", domainName, "fetch", "fetch", "allow",
+				fmt.Sprintf("invalid URL '%s', expected an absolute http or https URL", prefix))
+		case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+			errors.AddError("structure", domainName, "fetch", "fetch", "allow",
+				fmt.Sprintf("URL '%s' must not contain credentials, a query, or a fragment", prefix))
+		}
+	}
+
+	if timeout != "" {
+		if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+			errors.AddError("structure", domainName, "fetch", "fetch", "timeout",
+				fmt.Sprintf("invalid timeout '%s', expected a positive duration such as 2s", timeout))
+		}
+	}
+	if cacheTTL != "" {
+		if d, err := time.ParseDuration(cacheTTL); err != nil || d < 0 {
+			errors.AddError("structure", domainName, "fetch", "fetch", "cache_ttl",
+				fmt.Sprintf("invalid cache_ttl '%s', expected a duration such as 1m", cacheTTL))
+		}
+	}
+}
+
+// validateClassifications validates the classification lattice and the security labels of all resources
+func (v *DomainValidator) validateClassifications(domainName string, model DomainModel, errors *Errors) {
+	levels, compartments := model.GetClassifications()
+	if len(compartments) > 0 && len(levels) == 0 {
+		errors.AddError("structure", domainName, "classifications", "classifications", "levels", "at least one level is required")
+	}
+	declaredLevels := declareLabels(domainName, "levels", "level", levels, errors)
+	declaredCompartments := declareLabels(domainName, "compartments", "compartment", compartments, errors)
+
+	for i, resource := range model.GetResources() {
+		resourceID := fmt.Sprintf("resource[%d]", i)
+		if c, ok := resource.(ConditionalEntity); ok && c.IsConditional() {
+			validateConditions(domainName, resourceID, resource, c, levels, declaredLevels, errors)
+			continue
+		}
+		classification := resource.GetClassification()
+		switch {
+		case classification == "" && len(resource.GetCompartments()) > 0:
+			errors.AddError("structure", domainName, "resource", resourceID, "compartments", "compartments require a classification")
+		case classification == "":
+		case len(levels) == 0:
+			errors.AddError("structure", domainName, "resource", resourceID, "classification", "domain declares no classification levels")
+		case !declaredLevels[classification]:
+			errors.AddError("structure", domainName, "resource", resourceID, "classification",
+				fmt.Sprintf("unknown classification level '%s'", classification))
+		}
+		for _, compartment := range resource.GetCompartments() {
+			if !declaredCompartments[compartment] {
+				errors.AddError("structure", domainName, "resource", resourceID, "compartments",
+					fmt.Sprintf("unknown compartment '%s'", compartment))
+			}
+		}
+	}
+}
+
+// validateConditions validates a conditional resource, which assigns resources to its group
+// without labelling them, and whose conditions compare classifications with declared levels
+func validateConditions(domainName, resourceID string, resource ResourceEntity, c ConditionalEntity, levels []string, declaredLevels map[string]bool, errors *Errors) {
+	if resource.GetClassification() != "" {
+		errors.AddError("structure", domainName, "resource", resourceID, "classification", "conditional resources only assign a group")
+	}
+	if len(resource.GetCompartments()) > 0 {
+		errors.AddError("structure", domainName, "resource", resourceID, "compartments", "conditional resources only assign a group")
+	}
+	if pe, ok := resource.(PurposeEntity); ok && len(pe.GetAllowedPurposes()) > 0 {
+		errors.AddError("structure", domainName, "resource", resourceID, "allowed-purposes", "conditional resources only assign a group")
+	}
+	for _, level := range c.GetConditionLevels() {
+		switch {
+		case len(levels) == 0:
+			errors.AddError("structure", domainName, "resource", resourceID, "when", "domain declares no classification levels")
+		case !declaredLevels[level]:
+			errors.AddError("structure", domainName, "resource", resourceID, "when",
+				fmt.Sprintf("unknown classification level '%s'", level))
+		}
+	}
+}
+
+// declareLabels collects the names of a classification field, reporting empty and duplicate names
+func declareLabels(domainName, field, kind string, names []string, errors *Errors) map[string]bool {
+	declared := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch {
+		case name == "":
+			errors.AddError("structure", domainName, "classifications", "classifications", field, kind+" names cannot be empty")
+		case declared[name]:
+			errors.AddError("structure", domainName, "classifications", "classifications", field,
+				fmt.Sprintf("duplicate %s '%s'", kind, name))
+		}
+		declared[name] = true
+	}
+	return declared
+}
+
 // detectLibraryCycles performs DFS-based cycle detection across all domains
 func (v *DomainValidator) detectLibraryCycles() error {
 	qname := func(d, id string) string {
@@ -290,6 +657,52 @@ func (v *DomainValidator) detectLibraryCycles() error {
 	return nil
 }
 
+// detectGroupCycles performs DFS-based cycle detection of nested groups across all domains.
+// Unresolved references are skipped, as validateGroups reports them.
+func (v *DomainValidator) detectGroupCycles() error {
+	state := make(map[string]int)
+
+	var dfs func(domainName, groupID string, stack []string) error
+	dfs = func(domainName, groupID string, stack []string) error {
+		key := fmt.Sprintf("%s/%s", domainName, groupID)
+
+		if state[key] == 1 {
+			return v.buildCycleError(key, stack)
+		}
+		if state[key] == 2 {
+			return nil
+		}
+
+		state[key] = 1
+		stack = append(stack, key)
+
+		domainModel, _ := v.domains.GetDomain(domainName)
+		for _, ref := range domainModel.GetGroups()[groupID].GetGroups() {
+			targetDomain, _, nestedID, err := v.resolver.ResolveReference(ref, domainName, "group")
+			if err != nil {
+				continue
+			}
+			if err := dfs(targetDomain, nestedID, stack); err != nil {
+				return err
+			}
+		}
+
+		state[key] = 2
+		return nil
+	}
+
+	allDomains := v.domains.GetAllDomains()
+	for _, domainName := range slices.Sorted(maps.Keys(allDomains)) {
+		for _, groupID := range slices.Sorted(maps.Keys(allDomains[domainName].GetGroups())) {
+			if err := dfs(domainName, groupID, []string{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // buildCycleError creates a detailed error message for circular dependencies
 func (v *DomainValidator) buildCycleError(key string, stack []string) error {
 	// Find where the cycle starts
@@ -323,6 +736,7 @@ func (v *DomainValidator) getLibrary(domainName, libID string) (PolicyEntity, er
 
 // resolveDependencyNode resolves a dependency string to a libraryNode
 func (v *DomainValidator) resolveDependencyNode(dependency, sourceDomain string) (libraryNode, error) {
+	dependency, _ = SplitVersionConstraint(dependency)
 	targetDomain, depID, err := v.resolver.ParseReference(dependency, sourceDomain)
 	if err != nil {
 		return libraryNode{}, err
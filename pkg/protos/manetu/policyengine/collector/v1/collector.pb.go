@@ -0,0 +1,198 @@
+//
+//Copyright Manetu Inc. All Rights Reserved.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        (unknown)
+// source: manetu/policyengine/collector/v1/collector.proto
+
+package collectorv1
+
+import (
+	v1 "github.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type StreamRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	StreamId      string                 `protobuf:"bytes,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"` // identifies the client across reconnects
+	Sequence      uint64                 `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"`                // increases by one with each record of the stream
+	Record        *v1.AccessRecord       `protobuf:"bytes,3,opt,name=record,proto3" json:"record,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamRequest) Reset() {
+	*x = StreamRequest{}
+	mi := &file_manetu_policyengine_collector_v1_collector_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamRequest) ProtoMessage() {}
+
+func (x *StreamRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_collector_v1_collector_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamRequest.ProtoReflect.Descriptor instead.
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_collector_v1_collector_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *StreamRequest) GetStreamId() string {
+	if x != nil {
+		return x.StreamId
+	}
+	return ""
+}
+
+func (x *StreamRequest) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *StreamRequest) GetRecord() *v1.AccessRecord {
+	if x != nil {
+		return x.Record
+	}
+	return nil
+}
+
+type StreamResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Acknowledged  uint64                 `protobuf:"varint,1,opt,name=acknowledged,proto3" json:"acknowledged,omitempty"` // every record of the stream up to and including this sequence has been persisted
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamResponse) Reset() {
+	*x = StreamResponse{}
+	mi := &file_manetu_policyengine_collector_v1_collector_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamResponse) ProtoMessage() {}
+
+func (x *StreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_collector_v1_collector_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamResponse.ProtoReflect.Descriptor instead.
+func (*StreamResponse) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_collector_v1_collector_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StreamResponse) GetAcknowledged() uint64 {
+	if x != nil {
+		return x.Acknowledged
+	}
+	return 0
+}
+
+var File_manetu_policyengine_collector_v1_collector_proto protoreflect.FileDescriptor
+
+const file_manetu_policyengine_collector_v1_collector_proto_rawDesc = "" +
+	"\n" +
+	"0manetu/policyengine/collector/v1/collector.proto\x12 manetu.policyengine.collector.v1\x1a+manetu/policyengine/events/v1/message.proto\"\x8d\x01\n" +
+	"\rStreamRequest\x12\x1b\n" +
+	"\tstream_id\x18\x01 \x01(\tR\bstreamId\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x04R\bsequence\x12C\n" +
+	"\x06record\x18\x03 \x01(\v2+.manetu.policyengine.events.v1.AccessRecordR\x06record\"4\n" +
+	"\x0eStreamResponse\x12\"\n" +
+	"\facknowledged\x18\x01 \x01(\x04R\facknowledged2\x85\x01\n" +
+	"\x12AccessLogCollector\x12o\n" +
+	"\x06Stream\x12/.manetu.policyengine.collector.v1.StreamRequest\x1a0.manetu.policyengine.collector.v1.StreamResponse(\x010\x01B\xb1\x02\n" +
+	"$com.manetu.policyengine.collector.v1B\x0eCollectorProtoP\x01ZVgithub.com/manetu/policyengine/pkg/protos/manetu/policyengine/collector/v1;collectorv1\xa2\x02\x03MPC\xaa\x02 Manetu.Policyengine.Collector.V1\xca\x02 Manetu\\Policyengine\\Collector\\V1\xe2\x02,Manetu\\Policyengine\\Collector\\V1\\GPBMetadata\xea\x02#Manetu::Policyengine::Collector::V1b\x06proto3"
+
+var (
+	file_manetu_policyengine_collector_v1_collector_proto_rawDescOnce sync.Once
+	file_manetu_policyengine_collector_v1_collector_proto_rawDescData []byte
+)
+
+func file_manetu_policyengine_collector_v1_collector_proto_rawDescGZIP() []byte {
+	file_manetu_policyengine_collector_v1_collector_proto_rawDescOnce.Do(func() {
+		file_manetu_policyengine_collector_v1_collector_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_manetu_policyengine_collector_v1_collector_proto_rawDesc), len(file_manetu_policyengine_collector_v1_collector_proto_rawDesc)))
+	})
+	return file_manetu_policyengine_collector_v1_collector_proto_rawDescData
+}
+
+var file_manetu_policyengine_collector_v1_collector_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_manetu_policyengine_collector_v1_collector_proto_goTypes = []any{
+	(*StreamRequest)(nil),   // 0: manetu.policyengine.collector.v1.StreamRequest
+	(*StreamResponse)(nil),  // 1: manetu.policyengine.collector.v1.StreamResponse
+	(*v1.AccessRecord)(nil), // 2: manetu.policyengine.events.v1.AccessRecord
+}
+var file_manetu_policyengine_collector_v1_collector_proto_depIdxs = []int32{
+	2, // 0: manetu.policyengine.collector.v1.StreamRequest.record:type_name -> manetu.policyengine.events.v1.AccessRecord
+	0, // 1: manetu.policyengine.collector.v1.AccessLogCollector.Stream:input_type -> manetu.policyengine.collector.v1.StreamRequest
+	1, // 2: manetu.policyengine.collector.v1.AccessLogCollector.Stream:output_type -> manetu.policyengine.collector.v1.StreamResponse
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_manetu_policyengine_collector_v1_collector_proto_init() }
+func file_manetu_policyengine_collector_v1_collector_proto_init() {
+	if File_manetu_policyengine_collector_v1_collector_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_manetu_policyengine_collector_v1_collector_proto_rawDesc), len(file_manetu_policyengine_collector_v1_collector_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_manetu_policyengine_collector_v1_collector_proto_goTypes,
+		DependencyIndexes: file_manetu_policyengine_collector_v1_collector_proto_depIdxs,
+		MessageInfos:      file_manetu_policyengine_collector_v1_collector_proto_msgTypes,
+	}.Build()
+	File_manetu_policyengine_collector_v1_collector_proto = out.File
+	file_manetu_policyengine_collector_v1_collector_proto_goTypes = nil
+	file_manetu_policyengine_collector_v1_collector_proto_depIdxs = nil
+}
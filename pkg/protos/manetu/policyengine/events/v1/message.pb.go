@@ -31,6 +31,7 @@ const (
 	AccessRecord_UNSPECIFIED AccessRecord_Decision = 0
 	AccessRecord_GRANT       AccessRecord_Decision = 1
 	AccessRecord_DENY        AccessRecord_Decision = 2
+	AccessRecord_PENDING     AccessRecord_Decision = 3 // the operation requires approval that has not been given
 )
 
 // Enum value maps for AccessRecord_Decision.
@@ -39,11 +40,13 @@ var (
 		0: "UNSPECIFIED",
 		1: "GRANT",
 		2: "DENY",
+		3: "PENDING",
 	}
 	AccessRecord_Decision_value = map[string]int32{
 		"UNSPECIFIED": 0,
 		"GRANT":       1,
 		"DENY":        2,
+		"PENDING":     3,
 	}
 )
 
@@ -81,6 +84,7 @@ const (
 	AccessRecord_PUBLIC       AccessRecord_BypassGrantReason = 1
 	AccessRecord_VISITOR      AccessRecord_BypassGrantReason = 2
 	AccessRecord_ANTI_LOCKOUT AccessRecord_BypassGrantReason = 3
+	AccessRecord_BREAK_GLASS  AccessRecord_BypassGrantReason = 4
 )
 
 // Enum value maps for AccessRecord_BypassGrantReason.
@@ -90,12 +94,14 @@ var (
 		1: "PUBLIC",
 		2: "VISITOR",
 		3: "ANTI_LOCKOUT",
+		4: "BREAK_GLASS",
 	}
 	AccessRecord_BypassGrantReason_value = map[string]int32{
 		"NOT_GRANTED":  0,
 		"PUBLIC":       1,
 		"VISITOR":      2,
 		"ANTI_LOCKOUT": 3,
+		"BREAK_GLASS":  4,
 	}
 )
 
@@ -129,9 +135,12 @@ func (AccessRecord_BypassGrantReason) EnumDescriptor() ([]byte, []int) {
 type AccessRecord_BypassDenyReason int32
 
 const (
-	AccessRecord_NOT_DENIED        AccessRecord_BypassDenyReason = 0
-	AccessRecord_JWT_REQUIRED      AccessRecord_BypassDenyReason = 1
-	AccessRecord_OPERATOR_REQUIRED AccessRecord_BypassDenyReason = 2
+	AccessRecord_NOT_DENIED           AccessRecord_BypassDenyReason = 0
+	AccessRecord_JWT_REQUIRED         AccessRecord_BypassDenyReason = 1
+	AccessRecord_OPERATOR_REQUIRED    AccessRecord_BypassDenyReason = 2
+	AccessRecord_DENY_LISTED          AccessRecord_BypassDenyReason = 3
+	AccessRecord_REVOKED              AccessRecord_BypassDenyReason = 4
+	AccessRecord_IMPERSONATION_DENIED AccessRecord_BypassDenyReason = 5
 )
 
 // Enum value maps for AccessRecord_BypassDenyReason.
@@ -140,11 +149,17 @@ var (
 		0: "NOT_DENIED",
 		1: "JWT_REQUIRED",
 		2: "OPERATOR_REQUIRED",
+		3: "DENY_LISTED",
+		4: "REVOKED",
+		5: "IMPERSONATION_DENIED",
 	}
 	AccessRecord_BypassDenyReason_value = map[string]int32{
-		"NOT_DENIED":        0,
-		"JWT_REQUIRED":      1,
-		"OPERATOR_REQUIRED": 2,
+		"NOT_DENIED":           0,
+		"JWT_REQUIRED":         1,
+		"OPERATOR_REQUIRED":    2,
+		"DENY_LISTED":          3,
+		"REVOKED":              4,
+		"IMPERSONATION_DENIED": 5,
 	}
 )
 
@@ -175,6 +190,52 @@ func (AccessRecord_BypassDenyReason) EnumDescriptor() ([]byte, []int) {
 	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 2}
 }
 
+type AccessRecord_Combining int32
+
+const (
+	AccessRecord_ALL AccessRecord_Combining = 0 // the identity, resource, and scope phases must all GRANT
+	AccessRecord_ANY AccessRecord_Combining = 1 // any phase that evaluated a policy may GRANT
+)
+
+// Enum value maps for AccessRecord_Combining.
+var (
+	AccessRecord_Combining_name = map[int32]string{
+		0: "ALL",
+		1: "ANY",
+	}
+	AccessRecord_Combining_value = map[string]int32{
+		"ALL": 0,
+		"ANY": 1,
+	}
+)
+
+func (x AccessRecord_Combining) Enum() *AccessRecord_Combining {
+	p := new(AccessRecord_Combining)
+	*p = x
+	return p
+}
+
+func (x AccessRecord_Combining) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (AccessRecord_Combining) Descriptor() protoreflect.EnumDescriptor {
+	return file_manetu_policyengine_events_v1_message_proto_enumTypes[3].Descriptor()
+}
+
+func (AccessRecord_Combining) Type() protoreflect.EnumType {
+	return &file_manetu_policyengine_events_v1_message_proto_enumTypes[3]
+}
+
+func (x AccessRecord_Combining) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use AccessRecord_Combining.Descriptor instead.
+func (AccessRecord_Combining) EnumDescriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 3}
+}
+
 type AccessRecord_BundleReference_Phase int32
 
 const (
@@ -183,6 +244,7 @@ const (
 	AccessRecord_BundleReference_IDENTITY    AccessRecord_BundleReference_Phase = 2
 	AccessRecord_BundleReference_RESOURCE    AccessRecord_BundleReference_Phase = 3
 	AccessRecord_BundleReference_SCOPE       AccessRecord_BundleReference_Phase = 4
+	AccessRecord_BundleReference_EXTERNAL    AccessRecord_BundleReference_Phase = 5 // A check delegated by a policy to an external authorization service
 )
 
 // Enum value maps for AccessRecord_BundleReference_Phase.
@@ -193,6 +255,7 @@ var (
 		2: "IDENTITY",
 		3: "RESOURCE",
 		4: "SCOPE",
+		5: "EXTERNAL",
 	}
 	AccessRecord_BundleReference_Phase_value = map[string]int32{
 		"UNSPECIFIED": 0,
@@ -200,6 +263,7 @@ var (
 		"IDENTITY":    2,
 		"RESOURCE":    3,
 		"SCOPE":       4,
+		"EXTERNAL":    5,
 	}
 )
 
@@ -214,11 +278,11 @@ func (x AccessRecord_BundleReference_Phase) String() string {
 }
 
 func (AccessRecord_BundleReference_Phase) Descriptor() protoreflect.EnumDescriptor {
-	return file_manetu_policyengine_events_v1_message_proto_enumTypes[3].Descriptor()
+	return file_manetu_policyengine_events_v1_message_proto_enumTypes[4].Descriptor()
 }
 
 func (AccessRecord_BundleReference_Phase) Type() protoreflect.EnumType {
-	return &file_manetu_policyengine_events_v1_message_proto_enumTypes[3]
+	return &file_manetu_policyengine_events_v1_message_proto_enumTypes[4]
 }
 
 func (x AccessRecord_BundleReference_Phase) Number() protoreflect.EnumNumber {
@@ -239,6 +303,8 @@ const (
 	AccessRecord_BundleReference_NETWORK_ERROR     AccessRecord_BundleReference_ReasonCode = 3   // A network error prevented the resolution of policy
 	AccessRecord_BundleReference_EVALUATION_ERROR  AccessRecord_BundleReference_ReasonCode = 4   // An error reported by OPA Policy evaluator (excluding compilation error)
 	AccessRecord_BundleReference_INVALPARAM_ERROR  AccessRecord_BundleReference_ReasonCode = 5   // Invalid parameter or identifier
+	AccessRecord_BundleReference_INTERNAL_ERROR    AccessRecord_BundleReference_ReasonCode = 6   // An internal failure of the engine, such as a recovered panic
+	AccessRecord_BundleReference_EXPLICIT_DENY     AccessRecord_BundleReference_ReasonCode = 7   // A deny policy denied the request, overriding any GRANT
 	AccessRecord_BundleReference_UNKNOWN_ERROR     AccessRecord_BundleReference_ReasonCode = 100 // An unspecified error was encountered
 )
 
@@ -251,6 +317,8 @@ var (
 		3:   "NETWORK_ERROR",
 		4:   "EVALUATION_ERROR",
 		5:   "INVALPARAM_ERROR",
+		6:   "INTERNAL_ERROR",
+		7:   "EXPLICIT_DENY",
 		100: "UNKNOWN_ERROR",
 	}
 	AccessRecord_BundleReference_ReasonCode_value = map[string]int32{
@@ -260,6 +328,8 @@ var (
 		"NETWORK_ERROR":     3,
 		"EVALUATION_ERROR":  4,
 		"INVALPARAM_ERROR":  5,
+		"INTERNAL_ERROR":    6,
+		"EXPLICIT_DENY":     7,
 		"UNKNOWN_ERROR":     100,
 	}
 )
@@ -275,11 +345,11 @@ func (x AccessRecord_BundleReference_ReasonCode) String() string {
 }
 
 func (AccessRecord_BundleReference_ReasonCode) Descriptor() protoreflect.EnumDescriptor {
-	return file_manetu_policyengine_events_v1_message_proto_enumTypes[4].Descriptor()
+	return file_manetu_policyengine_events_v1_message_proto_enumTypes[5].Descriptor()
 }
 
 func (AccessRecord_BundleReference_ReasonCode) Type() protoreflect.EnumType {
-	return &file_manetu_policyengine_events_v1_message_proto_enumTypes[4]
+	return &file_manetu_policyengine_events_v1_message_proto_enumTypes[5]
 }
 
 func (x AccessRecord_BundleReference_ReasonCode) Number() protoreflect.EnumNumber {
@@ -306,7 +376,18 @@ type AccessRecord struct {
 	//	*AccessRecord_GrantReason
 	//	*AccessRecord_DenyReason
 	OverrideReason isAccessRecord_OverrideReason `protobuf_oneof:"override_reason"`
-	Duration       *AccessRecord_Duration        `protobuf:"bytes,11,opt,name=duration,proto3" json:"duration,omitempty"` // execution latency, in nanoseconds
+	Duration       *AccessRecord_Duration        `protobuf:"bytes,11,opt,name=duration,proto3" json:"duration,omitempty"`                                   // execution latency, in nanoseconds
+	Bundle         *AccessRecord_Bundle          `protobuf:"bytes,12,opt,name=bundle,proto3" json:"bundle,omitempty"`                                       // policy bundle revision and domain fingerprints
+	Defaults       *AccessRecord_Defaults        `protobuf:"bytes,13,opt,name=defaults,proto3" json:"defaults,omitempty"`                                   // set when the operation's policy domain declares defaults
+	Fetches        []*AccessRecord_Fetch         `protobuf:"bytes,14,rep,name=fetches,proto3" json:"fetches,omitempty"`                                     // outbound calls made by policies while deciding
+	Override       *AccessRecord_Override        `protobuf:"bytes,15,opt,name=override,proto3" json:"override,omitempty"`                                   // set when a deny-list or break-glass override decided the request
+	Mapper         *AccessRecord_Mapper          `protobuf:"bytes,16,opt,name=mapper,proto3" json:"mapper,omitempty"`                                       // set when a mapper produced the PORC
+	OperationMatch *AccessRecord_OperationMatch  `protobuf:"bytes,17,opt,name=operation_match,json=operationMatch,proto3" json:"operation_match,omitempty"` // set when the operation resolved to a policy
+	Purpose        *AccessRecord_Purpose         `protobuf:"bytes,18,opt,name=purpose,proto3" json:"purpose,omitempty"`                                     // set when the request declares a purpose or the resource restricts them
+	Approval       *AccessRecord_Approval        `protobuf:"bytes,19,opt,name=approval,proto3" json:"approval,omitempty"`                                   // set when the operation requires approval
+	Risk           *AccessRecord_Risk            `protobuf:"bytes,20,opt,name=risk,proto3" json:"risk,omitempty"`                                           // set when a risk provider is configured
+	Identity       *AccessRecord_Identity        `protobuf:"bytes,21,opt,name=identity,proto3" json:"identity,omitempty"`                                   // set when the operation requires more than one role to GRANT
+	Impersonation  *AccessRecord_Impersonation   `protobuf:"bytes,22,opt,name=impersonation,proto3" json:"impersonation,omitempty"`                         // set when the principal carries an act claim
 	unknownFields  protoimpl.UnknownFields
 	sizeCache      protoimpl.SizeCache
 }
@@ -429,6 +510,83 @@ func (x *AccessRecord) GetDuration() *AccessRecord_Duration {
 	return nil
 }
 
+func (x *AccessRecord) GetBundle() *AccessRecord_Bundle {
+	if x != nil {
+		return x.Bundle
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetDefaults() *AccessRecord_Defaults {
+	if x != nil {
+		return x.Defaults
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetFetches() []*AccessRecord_Fetch {
+	if x != nil {
+		return x.Fetches
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetOverride() *AccessRecord_Override {
+	if x != nil {
+		return x.Override
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetMapper() *AccessRecord_Mapper {
+	if x != nil {
+		return x.Mapper
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetOperationMatch() *AccessRecord_OperationMatch {
+	if x != nil {
+		return x.OperationMatch
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetPurpose() *AccessRecord_Purpose {
+	if x != nil {
+		return x.Purpose
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetApproval() *AccessRecord_Approval {
+	if x != nil {
+		return x.Approval
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetRisk() *AccessRecord_Risk {
+	if x != nil {
+		return x.Risk
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetIdentity() *AccessRecord_Identity {
+	if x != nil {
+		return x.Identity
+	}
+	return nil
+}
+
+func (x *AccessRecord) GetImpersonation() *AccessRecord_Impersonation {
+	if x != nil {
+		return x.Impersonation
+	}
+	return nil
+}
+
 type isAccessRecord_OverrideReason interface {
 	isAccessRecord_OverrideReason()
 }
@@ -450,6 +608,9 @@ type AccessRecord_Metadata struct {
 	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
 	Env           map[string]string      `protobuf:"bytes,2,rep,name=env,proto3" json:"env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"` // optional contextual name/value pairs e.g. "k8s-pod" = "mcp-attribute-serviec-gw-123123"
 	Id            string                 `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`                                                                             // a UUID for this record
+	CorrelationId string                 `protobuf:"bytes,4,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`                                  // optional caller-supplied identifier, e.g. an Envoy x-request-id
+	SchemaVersion uint32                 `protobuf:"varint,5,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`                                 // 2 for records carrying the fields added in v2; absent (0) in v1 records
+	EngineVersion string                 `protobuf:"bytes,6,opt,name=engine_version,json=engineVersion,proto3" json:"engine_version,omitempty"`                                  // module version of the policy engine that made the decision
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -505,6 +666,27 @@ func (x *AccessRecord_Metadata) GetId() string {
 	return ""
 }
 
+func (x *AccessRecord_Metadata) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+func (x *AccessRecord_Metadata) GetSchemaVersion() uint32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *AccessRecord_Metadata) GetEngineVersion() string {
+	if x != nil {
+		return x.EngineVersion
+	}
+	return ""
+}
+
 type AccessRecord_Principal struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
@@ -701,28 +883,29 @@ func (x *AccessRecord_BundleReference) GetDuration() uint64 {
 	return 0
 }
 
-type AccessRecord_Duration struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Overall       uint64                 `protobuf:"varint,1,opt,name=overall,proto3" json:"overall,omitempty"`
-	Phases        map[uint32]uint64      `protobuf:"bytes,2,rep,name=phases,proto3" json:"phases,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+type AccessRecord_Bundle struct {
+	state         protoimpl.MessageState        `protogen:"open.v1"`
+	Revision      uint64                        `protobuf:"varint,1,opt,name=revision,proto3" json:"revision,omitempty"` // increases monotonically each time the bundle set is (re)loaded
+	Domains       []*AccessRecord_Bundle_Domain `protobuf:"bytes,2,rep,name=domains,proto3" json:"domains,omitempty"`
+	Fingerprint   []byte                        `protobuf:"bytes,3,opt,name=fingerprint,proto3" json:"fingerprint,omitempty"` // sha256 over the name and fingerprint of every domain, identifying the bundle set as a whole
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *AccessRecord_Duration) Reset() {
-	*x = AccessRecord_Duration{}
+func (x *AccessRecord_Bundle) Reset() {
+	*x = AccessRecord_Bundle{}
 	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *AccessRecord_Duration) String() string {
+func (x *AccessRecord_Bundle) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AccessRecord_Duration) ProtoMessage() {}
+func (*AccessRecord_Bundle) ProtoMessage() {}
 
-func (x *AccessRecord_Duration) ProtoReflect() protoreflect.Message {
+func (x *AccessRecord_Bundle) ProtoReflect() protoreflect.Message {
 	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -734,105 +917,1075 @@ func (x *AccessRecord_Duration) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AccessRecord_Duration.ProtoReflect.Descriptor instead.
-func (*AccessRecord_Duration) Descriptor() ([]byte, []int) {
+// Deprecated: Use AccessRecord_Bundle.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Bundle) Descriptor() ([]byte, []int) {
 	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 4}
 }
 
-func (x *AccessRecord_Duration) GetOverall() uint64 {
+func (x *AccessRecord_Bundle) GetRevision() uint64 {
 	if x != nil {
-		return x.Overall
+		return x.Revision
 	}
 	return 0
 }
 
-func (x *AccessRecord_Duration) GetPhases() map[uint32]uint64 {
+func (x *AccessRecord_Bundle) GetDomains() []*AccessRecord_Bundle_Domain {
 	if x != nil {
-		return x.Phases
+		return x.Domains
 	}
 	return nil
 }
 
-var File_manetu_policyengine_events_v1_message_proto protoreflect.FileDescriptor
+func (x *AccessRecord_Bundle) GetFingerprint() []byte {
+	if x != nil {
+		return x.Fingerprint
+	}
+	return nil
+}
 
-const file_manetu_policyengine_events_v1_message_proto_rawDesc = "" +
-	"\n" +
-	"+manetu/policyengine/events/v1/message.proto\x12\x1dmanetu.policyengine.events.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xa7\x11\n" +
-	"\fAccessRecord\x12P\n" +
-	"\bmetadata\x18\x01 \x01(\v24.manetu.policyengine.events.v1.AccessRecord.MetadataR\bmetadata\x12S\n" +
-	"\tprincipal\x18\x02 \x01(\v25.manetu.policyengine.events.v1.AccessRecord.PrincipalR\tprincipal\x12\x1c\n" +
-	"\toperation\x18\x03 \x01(\tR\toperation\x12\x1a\n" +
-	"\bresource\x18\x04 \x01(\tR\bresource\x12P\n" +
-	"\bdecision\x18\x05 \x01(\x0e24.manetu.policyengine.events.v1.AccessRecord.DecisionR\bdecision\x12[\n" +
-	"\n" +
-	"references\x18\x06 \x03(\v2;.manetu.policyengine.events.v1.AccessRecord.BundleReferenceR\n" +
-	"references\x12\x12\n" +
-	"\x04porc\x18\a \x01(\tR\x04porc\x12'\n" +
-	"\x0fsystem_override\x18\b \x01(\bR\x0esystemOverride\x12b\n" +
-	"\fgrant_reason\x18\t \x01(\x0e2=.manetu.policyengine.events.v1.AccessRecord.BypassGrantReasonH\x00R\vgrantReason\x12_\n" +
-	"\vdeny_reason\x18\n" +
-	" \x01(\x0e2<.manetu.policyengine.events.v1.AccessRecord.BypassDenyReasonH\x00R\n" +
-	"denyReason\x12P\n" +
-	"\bduration\x18\v \x01(\v24.manetu.policyengine.events.v1.AccessRecord.DurationR\bduration\x1a\xdd\x01\n" +
-	"\bMetadata\x128\n" +
-	"\ttimestamp\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12O\n" +
-	"\x03env\x18\x02 \x03(\v2=.manetu.policyengine.events.v1.AccessRecord.Metadata.EnvEntryR\x03env\x12\x0e\n" +
-	"\x02id\x18\x03 \x01(\tR\x02id\x1a6\n" +
-	"\bEnvEntry\x12\x10\n" +
-	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1a;\n" +
-	"\tPrincipal\x12\x18\n" +
-	"\asubject\x18\x01 \x01(\tR\asubject\x12\x14\n" +
-	"\x05realm\x18\x02 \x01(\tR\x05realm\x1aE\n" +
-	"\x0fPolicyReference\x12\x10\n" +
-	"\x03mrn\x18\x01 \x01(\tR\x03mrn\x12 \n" +
-	"\vfingerprint\x18\x02 \x01(\fR\vfingerprint\x1a\xaf\x05\n" +
-	"\x0fBundleReference\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\tR\x02id\x12W\n" +
-	"\bpolicies\x18\x02 \x03(\v2;.manetu.policyengine.events.v1.AccessRecord.PolicyReferenceR\bpolicies\x12P\n" +
-	"\bdecision\x18\x03 \x01(\x0e24.manetu.policyengine.events.v1.AccessRecord.DecisionR\bdecision\x12W\n" +
-	"\x05phase\x18\x04 \x01(\x0e2A.manetu.policyengine.events.v1.AccessRecord.BundleReference.PhaseR\x05phase\x12g\n" +
-	"\vreason_code\x18\x05 \x01(\x0e2F.manetu.policyengine.events.v1.AccessRecord.BundleReference.ReasonCodeR\n" +
-	"reasonCode\x12\x16\n" +
-	"\x06reason\x18\x06 \x01(\tR\x06reason\x12\x1a\n" +
-	"\bduration\x18\a \x01(\x04R\bduration\"K\n" +
-	"\x05Phase\x12\x0f\n" +
-	"\vUNSPECIFIED\x10\x00\x12\n" +
-	"\n" +
-	"\x06SYSTEM\x10\x01\x12\f\n" +
-	"\bIDENTITY\x10\x02\x12\f\n" +
-	"\bRESOURCE\x10\x03\x12\t\n" +
-	"\x05SCOPE\x10\x04\"\x9d\x01\n" +
-	"\n" +
-	"ReasonCode\x12\x12\n" +
-	"\x0ePOLICY_OUTCOME\x10\x00\x12\x15\n" +
-	"\x11COMPILATION_ERROR\x10\x01\x12\x12\n" +
-	"\x0eNOTFOUND_ERROR\x10\x02\x12\x11\n" +
-	"\rNETWORK_ERROR\x10\x03\x12\x14\n" +
-	"\x10EVALUATION_ERROR\x10\x04\x12\x14\n" +
-	"\x10INVALPARAM_ERROR\x10\x05\x12\x11\n" +
-	"\rUNKNOWN_ERROR\x10d\x1a\xb9\x01\n" +
-	"\bDuration\x12\x18\n" +
-	"\aoverall\x18\x01 \x01(\x04R\aoverall\x12X\n" +
-	"\x06phases\x18\x02 \x03(\v2@.manetu.policyengine.events.v1.AccessRecord.Duration.PhasesEntryR\x06phases\x1a9\n" +
-	"\vPhasesEntry\x12\x10\n" +
-	"\x03key\x18\x01 \x01(\rR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"0\n" +
+type AccessRecord_Defaults struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Domain        string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	Decision      AccessRecord_Decision  `protobuf:"varint,2,opt,name=decision,proto3,enum=manetu.policyengine.events.v1.AccessRecord_Decision" json:"decision,omitempty"` // outcome when no policy applies
+	Combining     AccessRecord_Combining `protobuf:"varint,3,opt,name=combining,proto3,enum=manetu.policyengine.events.v1.AccessRecord_Combining" json:"combining,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Defaults) Reset() {
+	*x = AccessRecord_Defaults{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Defaults) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Defaults) ProtoMessage() {}
+
+func (x *AccessRecord_Defaults) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Defaults.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Defaults) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 5}
+}
+
+func (x *AccessRecord_Defaults) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *AccessRecord_Defaults) GetDecision() AccessRecord_Decision {
+	if x != nil {
+		return x.Decision
+	}
+	return AccessRecord_UNSPECIFIED
+}
+
+func (x *AccessRecord_Defaults) GetCombining() AccessRecord_Combining {
+	if x != nil {
+		return x.Combining
+	}
+	return AccessRecord_ALL
+}
+
+type AccessRecord_Fetch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Domain        string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"` // policy domain whose allowlist permitted the call
+	Url           string                 `protobuf:"bytes,2,opt,name=url,proto3" json:"url,omitempty"`
+	StatusCode    uint32                 `protobuf:"varint,3,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"` // HTTP status, zero if the request failed
+	Cached        bool                   `protobuf:"varint,4,opt,name=cached,proto3" json:"cached,omitempty"`                           // served from the response cache, without a request
+	Error         string                 `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`                              // optional reason the call failed or was refused
+	Duration      uint64                 `protobuf:"varint,6,opt,name=duration,proto3" json:"duration,omitempty"`                       // execution latency, in nanoseconds
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Fetch) Reset() {
+	*x = AccessRecord_Fetch{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Fetch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Fetch) ProtoMessage() {}
+
+func (x *AccessRecord_Fetch) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Fetch.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Fetch) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 6}
+}
+
+func (x *AccessRecord_Fetch) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *AccessRecord_Fetch) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *AccessRecord_Fetch) GetStatusCode() uint32 {
+	if x != nil {
+		return x.StatusCode
+	}
+	return 0
+}
+
+func (x *AccessRecord_Fetch) GetCached() bool {
+	if x != nil {
+		return x.Cached
+	}
+	return false
+}
+
+func (x *AccessRecord_Fetch) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *AccessRecord_Fetch) GetDuration() uint64 {
+	if x != nil {
+		return x.Duration
+	}
+	return 0
+}
+
+type AccessRecord_Override struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Justification string                 `protobuf:"bytes,2,opt,name=justification,proto3" json:"justification,omitempty"`          // required for break-glass overrides
+	CreatedBy     string                 `protobuf:"bytes,3,opt,name=created_by,json=createdBy,proto3" json:"created_by,omitempty"` // optional identity of whoever registered the override
+	Expires       *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=expires,proto3" json:"expires,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Override) Reset() {
+	*x = AccessRecord_Override{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Override) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Override) ProtoMessage() {}
+
+func (x *AccessRecord_Override) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Override.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Override) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 7}
+}
+
+func (x *AccessRecord_Override) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *AccessRecord_Override) GetJustification() string {
+	if x != nil {
+		return x.Justification
+	}
+	return ""
+}
+
+func (x *AccessRecord_Override) GetCreatedBy() string {
+	if x != nil {
+		return x.CreatedBy
+	}
+	return ""
+}
+
+func (x *AccessRecord_Override) GetExpires() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Expires
+	}
+	return nil
+}
+
+type AccessRecord_Duration struct {
+	state         protoimpl.MessageState         `protogen:"open.v1"`
+	Overall       uint64                         `protobuf:"varint,1,opt,name=overall,proto3" json:"overall,omitempty"`
+	Phases        map[uint32]uint64              `protobuf:"bytes,2,rep,name=phases,proto3" json:"phases,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"` // overall latency of each phase, keyed by BundleReference.Phase
+	Breakdown     []*AccessRecord_Duration_Phase `protobuf:"bytes,3,rep,name=breakdown,proto3" json:"breakdown,omitempty"`                                                                       // per-phase timing, in phase order
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Duration) Reset() {
+	*x = AccessRecord_Duration{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Duration) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Duration) ProtoMessage() {}
+
+func (x *AccessRecord_Duration) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Duration.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Duration) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 8}
+}
+
+func (x *AccessRecord_Duration) GetOverall() uint64 {
+	if x != nil {
+		return x.Overall
+	}
+	return 0
+}
+
+func (x *AccessRecord_Duration) GetPhases() map[uint32]uint64 {
+	if x != nil {
+		return x.Phases
+	}
+	return nil
+}
+
+func (x *AccessRecord_Duration) GetBreakdown() []*AccessRecord_Duration_Phase {
+	if x != nil {
+		return x.Breakdown
+	}
+	return nil
+}
+
+type AccessRecord_Mapper struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Domain        string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	Id            string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Mapper) Reset() {
+	*x = AccessRecord_Mapper{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Mapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Mapper) ProtoMessage() {}
+
+func (x *AccessRecord_Mapper) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Mapper.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Mapper) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 9}
+}
+
+func (x *AccessRecord_Mapper) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *AccessRecord_Mapper) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type AccessRecord_OperationMatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Domain        string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	Id            string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`             // the operation's ID within its domain
+	Selector      string                 `protobuf:"bytes,3,opt,name=selector,proto3" json:"selector,omitempty"` // the selector that matched the operation
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_OperationMatch) Reset() {
+	*x = AccessRecord_OperationMatch{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_OperationMatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_OperationMatch) ProtoMessage() {}
+
+func (x *AccessRecord_OperationMatch) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_OperationMatch.ProtoReflect.Descriptor instead.
+func (*AccessRecord_OperationMatch) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 10}
+}
+
+func (x *AccessRecord_OperationMatch) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *AccessRecord_OperationMatch) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *AccessRecord_OperationMatch) GetSelector() string {
+	if x != nil {
+		return x.Selector
+	}
+	return ""
+}
+
+type AccessRecord_Purpose struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Declared      []string               `protobuf:"bytes,1,rep,name=declared,proto3" json:"declared,omitempty"` // purposes declared by the request in context.purpose
+	Allowed       []string               `protobuf:"bytes,2,rep,name=allowed,proto3" json:"allowed,omitempty"`   // purposes the resource may be accessed for, empty if unrestricted
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Purpose) Reset() {
+	*x = AccessRecord_Purpose{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Purpose) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Purpose) ProtoMessage() {}
+
+func (x *AccessRecord_Purpose) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Purpose.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Purpose) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 11}
+}
+
+func (x *AccessRecord_Purpose) GetDeclared() []string {
+	if x != nil {
+		return x.Declared
+	}
+	return nil
+}
+
+func (x *AccessRecord_Purpose) GetAllowed() []string {
+	if x != nil {
+		return x.Allowed
+	}
+	return nil
+}
+
+type AccessRecord_Approval struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"` // identifies the approval request, presented as context.approval once approved
+	Required      uint32                 `protobuf:"varint,2,opt,name=required,proto3" json:"required,omitempty"`                   // number of approvers the operation requires
+	Approvers     []string               `protobuf:"bytes,3,rep,name=approvers,proto3" json:"approvers,omitempty"`                  // subjects who approved the request
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Approval) Reset() {
+	*x = AccessRecord_Approval{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Approval) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Approval) ProtoMessage() {}
+
+func (x *AccessRecord_Approval) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Approval.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Approval) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 12}
+}
+
+func (x *AccessRecord_Approval) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *AccessRecord_Approval) GetRequired() uint32 {
+	if x != nil {
+		return x.Required
+	}
+	return 0
+}
+
+func (x *AccessRecord_Approval) GetApprovers() []string {
+	if x != nil {
+		return x.Approvers
+	}
+	return nil
+}
+
+type AccessRecord_Risk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Score         float64                `protobuf:"fixed64,1,opt,name=score,proto3" json:"score,omitempty"`
+	Provider      string                 `protobuf:"bytes,2,opt,name=provider,proto3" json:"provider,omitempty"`    // the risk provider asked to score the request
+	Defaulted     bool                   `protobuf:"varint,3,opt,name=defaulted,proto3" json:"defaulted,omitempty"` // the configured default replaced the provider's score
+	Error         string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`          // why the default replaced the provider's score
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Risk) Reset() {
+	*x = AccessRecord_Risk{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Risk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Risk) ProtoMessage() {}
+
+func (x *AccessRecord_Risk) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Risk.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Risk) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 13}
+}
+
+func (x *AccessRecord_Risk) GetScore() float64 {
+	if x != nil {
+		return x.Score
+	}
+	return 0
+}
+
+func (x *AccessRecord_Risk) GetProvider() string {
+	if x != nil {
+		return x.Provider
+	}
+	return ""
+}
+
+func (x *AccessRecord_Risk) GetDefaulted() bool {
+	if x != nil {
+		return x.Defaulted
+	}
+	return false
+}
+
+func (x *AccessRecord_Risk) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type AccessRecord_Identity struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	All           bool                   `protobuf:"varint,1,opt,name=all,proto3" json:"all,omitempty"`         // every role of the principal must GRANT
+	Minimum       uint32                 `protobuf:"varint,2,opt,name=minimum,proto3" json:"minimum,omitempty"` // least number of roles that must GRANT
+	Roles         uint32                 `protobuf:"varint,3,opt,name=roles,proto3" json:"roles,omitempty"`     // number of roles of the principal evaluated
+	Granted       uint32                 `protobuf:"varint,4,opt,name=granted,proto3" json:"granted,omitempty"` // number of those roles that granted
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Identity) Reset() {
+	*x = AccessRecord_Identity{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Identity) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Identity) ProtoMessage() {}
+
+func (x *AccessRecord_Identity) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Identity.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Identity) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 14}
+}
+
+func (x *AccessRecord_Identity) GetAll() bool {
+	if x != nil {
+		return x.All
+	}
+	return false
+}
+
+func (x *AccessRecord_Identity) GetMinimum() uint32 {
+	if x != nil {
+		return x.Minimum
+	}
+	return 0
+}
+
+func (x *AccessRecord_Identity) GetRoles() uint32 {
+	if x != nil {
+		return x.Roles
+	}
+	return 0
+}
+
+func (x *AccessRecord_Identity) GetGranted() uint32 {
+	if x != nil {
+		return x.Granted
+	}
+	return 0
+}
+
+type AccessRecord_Impersonation struct {
+	state         protoimpl.MessageState              `protogen:"open.v1"`
+	Actors        []*AccessRecord_Impersonation_Actor `protobuf:"bytes,1,rep,name=actors,proto3" json:"actors,omitempty"`        // the current actor first, then the prior actors it acts for
+	Permitted     bool                                `protobuf:"varint,2,opt,name=permitted,proto3" json:"permitted,omitempty"` // every actor is permitted to act on behalf of the principal
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Impersonation) Reset() {
+	*x = AccessRecord_Impersonation{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Impersonation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Impersonation) ProtoMessage() {}
+
+func (x *AccessRecord_Impersonation) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Impersonation.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Impersonation) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 15}
+}
+
+func (x *AccessRecord_Impersonation) GetActors() []*AccessRecord_Impersonation_Actor {
+	if x != nil {
+		return x.Actors
+	}
+	return nil
+}
+
+func (x *AccessRecord_Impersonation) GetPermitted() bool {
+	if x != nil {
+		return x.Permitted
+	}
+	return false
+}
+
+type AccessRecord_Bundle_Domain struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Fingerprint   []byte                 `protobuf:"bytes,2,opt,name=fingerprint,proto3" json:"fingerprint,omitempty"` // sha256 of the built PolicyDomain YAML
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Bundle_Domain) Reset() {
+	*x = AccessRecord_Bundle_Domain{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Bundle_Domain) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Bundle_Domain) ProtoMessage() {}
+
+func (x *AccessRecord_Bundle_Domain) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Bundle_Domain.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Bundle_Domain) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 4, 0}
+}
+
+func (x *AccessRecord_Bundle_Domain) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *AccessRecord_Bundle_Domain) GetFingerprint() []byte {
+	if x != nil {
+		return x.Fingerprint
+	}
+	return nil
+}
+
+type AccessRecord_Duration_Phase struct {
+	state         protoimpl.MessageState             `protogen:"open.v1"`
+	Phase         AccessRecord_BundleReference_Phase `protobuf:"varint,1,opt,name=phase,proto3,enum=manetu.policyengine.events.v1.AccessRecord_BundleReference_Phase" json:"phase,omitempty"`
+	Overall       uint64                             `protobuf:"varint,2,opt,name=overall,proto3" json:"overall,omitempty"`
+	Evaluation    uint64                             `protobuf:"varint,3,opt,name=evaluation,proto3" json:"evaluation,omitempty"` // time spent evaluating the phase's policies, summed over those evaluated concurrently
+	Policies      uint32                             `protobuf:"varint,4,opt,name=policies,proto3" json:"policies,omitempty"`     // number of policies evaluated
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Duration_Phase) Reset() {
+	*x = AccessRecord_Duration_Phase{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Duration_Phase) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Duration_Phase) ProtoMessage() {}
+
+func (x *AccessRecord_Duration_Phase) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Duration_Phase.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Duration_Phase) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 8, 0}
+}
+
+func (x *AccessRecord_Duration_Phase) GetPhase() AccessRecord_BundleReference_Phase {
+	if x != nil {
+		return x.Phase
+	}
+	return AccessRecord_BundleReference_UNSPECIFIED
+}
+
+func (x *AccessRecord_Duration_Phase) GetOverall() uint64 {
+	if x != nil {
+		return x.Overall
+	}
+	return 0
+}
+
+func (x *AccessRecord_Duration_Phase) GetEvaluation() uint64 {
+	if x != nil {
+		return x.Evaluation
+	}
+	return 0
+}
+
+func (x *AccessRecord_Duration_Phase) GetPolicies() uint32 {
+	if x != nil {
+		return x.Policies
+	}
+	return 0
+}
+
+type AccessRecord_Impersonation_Actor struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
+	Realm         string                 `protobuf:"bytes,2,opt,name=realm,proto3" json:"realm,omitempty"`
+	Roles         []string               `protobuf:"bytes,3,rep,name=roles,proto3" json:"roles,omitempty"`
+	Rule          string                 `protobuf:"bytes,4,opt,name=rule,proto3" json:"rule,omitempty"` // the impersonation rule permitting the actor, as domain/name, empty if none does
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccessRecord_Impersonation_Actor) Reset() {
+	*x = AccessRecord_Impersonation_Actor{}
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccessRecord_Impersonation_Actor) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccessRecord_Impersonation_Actor) ProtoMessage() {}
+
+func (x *AccessRecord_Impersonation_Actor) ProtoReflect() protoreflect.Message {
+	mi := &file_manetu_policyengine_events_v1_message_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccessRecord_Impersonation_Actor.ProtoReflect.Descriptor instead.
+func (*AccessRecord_Impersonation_Actor) Descriptor() ([]byte, []int) {
+	return file_manetu_policyengine_events_v1_message_proto_rawDescGZIP(), []int{0, 15, 0}
+}
+
+func (x *AccessRecord_Impersonation_Actor) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *AccessRecord_Impersonation_Actor) GetRealm() string {
+	if x != nil {
+		return x.Realm
+	}
+	return ""
+}
+
+func (x *AccessRecord_Impersonation_Actor) GetRoles() []string {
+	if x != nil {
+		return x.Roles
+	}
+	return nil
+}
+
+func (x *AccessRecord_Impersonation_Actor) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+var File_manetu_policyengine_events_v1_message_proto protoreflect.FileDescriptor
+
+const file_manetu_policyengine_events_v1_message_proto_rawDesc = "" +
+	"\n" +
+	"+manetu/policyengine/events/v1/message.proto\x12\x1dmanetu.policyengine.events.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xb3(\n" +
+	"\fAccessRecord\x12P\n" +
+	"\bmetadata\x18\x01 \x01(\v24.manetu.policyengine.events.v1.AccessRecord.MetadataR\bmetadata\x12S\n" +
+	"\tprincipal\x18\x02 \x01(\v25.manetu.policyengine.events.v1.AccessRecord.PrincipalR\tprincipal\x12\x1c\n" +
+	"\toperation\x18\x03 \x01(\tR\toperation\x12\x1a\n" +
+	"\bresource\x18\x04 \x01(\tR\bresource\x12P\n" +
+	"\bdecision\x18\x05 \x01(\x0e24.manetu.policyengine.events.v1.AccessRecord.DecisionR\bdecision\x12[\n" +
+	"\n" +
+	"references\x18\x06 \x03(\v2;.manetu.policyengine.events.v1.AccessRecord.BundleReferenceR\n" +
+	"references\x12\x12\n" +
+	"\x04porc\x18\a \x01(\tR\x04porc\x12'\n" +
+	"\x0fsystem_override\x18\b \x01(\bR\x0esystemOverride\x12b\n" +
+	"\fgrant_reason\x18\t \x01(\x0e2=.manetu.policyengine.events.v1.AccessRecord.BypassGrantReasonH\x00R\vgrantReason\x12_\n" +
+	"\vdeny_reason\x18\n" +
+	" \x01(\x0e2<.manetu.policyengine.events.v1.AccessRecord.BypassDenyReasonH\x00R\n" +
+	"denyReason\x12P\n" +
+	"\bduration\x18\v \x01(\v24.manetu.policyengine.events.v1.AccessRecord.DurationR\bduration\x12J\n" +
+	"\x06bundle\x18\f \x01(\v22.manetu.policyengine.events.v1.AccessRecord.BundleR\x06bundle\x12P\n" +
+	"\bdefaults\x18\r \x01(\v24.manetu.policyengine.events.v1.AccessRecord.DefaultsR\bdefaults\x12K\n" +
+	"\afetches\x18\x0e \x03(\v21.manetu.policyengine.events.v1.AccessRecord.FetchR\afetches\x12P\n" +
+	"\boverride\x18\x0f \x01(\v24.manetu.policyengine.events.v1.AccessRecord.OverrideR\boverride\x12J\n" +
+	"\x06mapper\x18\x10 \x01(\v22.manetu.policyengine.events.v1.AccessRecord.MapperR\x06mapper\x12c\n" +
+	"\x0foperation_match\x18\x11 \x01(\v2:.manetu.policyengine.events.v1.AccessRecord.OperationMatchR\x0eoperationMatch\x12M\n" +
+	"\apurpose\x18\x12 \x01(\v23.manetu.policyengine.events.v1.AccessRecord.PurposeR\apurpose\x12P\n" +
+	"\bapproval\x18\x13 \x01(\v24.manetu.policyengine.events.v1.AccessRecord.ApprovalR\bapproval\x12D\n" +
+	"\x04risk\x18\x14 \x01(\v20.manetu.policyengine.events.v1.AccessRecord.RiskR\x04risk\x12P\n" +
+	"\bidentity\x18\x15 \x01(\v24.manetu.policyengine.events.v1.AccessRecord.IdentityR\bidentity\x12_\n" +
+	"\rimpersonation\x18\x16 \x01(\v29.manetu.policyengine.events.v1.AccessRecord.ImpersonationR\rimpersonation\x1a\xd2\x02\n" +
+	"\bMetadata\x128\n" +
+	"\ttimestamp\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12O\n" +
+	"\x03env\x18\x02 \x03(\v2=.manetu.policyengine.events.v1.AccessRecord.Metadata.EnvEntryR\x03env\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\x12%\n" +
+	"\x0ecorrelation_id\x18\x04 \x01(\tR\rcorrelationId\x12%\n" +
+	"\x0eschema_version\x18\x05 \x01(\rR\rschemaVersion\x12%\n" +
+	"\x0eengine_version\x18\x06 \x01(\tR\rengineVersion\x1a6\n" +
+	"\bEnvEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1a;\n" +
+	"\tPrincipal\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\x12\x14\n" +
+	"\x05realm\x18\x02 \x01(\tR\x05realm\x1aE\n" +
+	"\x0fPolicyReference\x12\x10\n" +
+	"\x03mrn\x18\x01 \x01(\tR\x03mrn\x12 \n" +
+	"\vfingerprint\x18\x02 \x01(\fR\vfingerprint\x1a\xe4\x05\n" +
+	"\x0fBundleReference\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12W\n" +
+	"\bpolicies\x18\x02 \x03(\v2;.manetu.policyengine.events.v1.AccessRecord.PolicyReferenceR\bpolicies\x12P\n" +
+	"\bdecision\x18\x03 \x01(\x0e24.manetu.policyengine.events.v1.AccessRecord.DecisionR\bdecision\x12W\n" +
+	"\x05phase\x18\x04 \x01(\x0e2A.manetu.policyengine.events.v1.AccessRecord.BundleReference.PhaseR\x05phase\x12g\n" +
+	"\vreason_code\x18\x05 \x01(\x0e2F.manetu.policyengine.events.v1.AccessRecord.BundleReference.ReasonCodeR\n" +
+	"reasonCode\x12\x16\n" +
+	"\x06reason\x18\x06 \x01(\tR\x06reason\x12\x1a\n" +
+	"\bduration\x18\a \x01(\x04R\bduration\"Y\n" +
+	"\x05Phase\x12\x0f\n" +
+	"\vUNSPECIFIED\x10\x00\x12\n" +
+	"\n" +
+	"\x06SYSTEM\x10\x01\x12\f\n" +
+	"\bIDENTITY\x10\x02\x12\f\n" +
+	"\bRESOURCE\x10\x03\x12\t\n" +
+	"\x05SCOPE\x10\x04\x12\f\n" +
+	"\bEXTERNAL\x10\x05\"\xc4\x01\n" +
+	"\n" +
+	"ReasonCode\x12\x12\n" +
+	"\x0ePOLICY_OUTCOME\x10\x00\x12\x15\n" +
+	"\x11COMPILATION_ERROR\x10\x01\x12\x12\n" +
+	"\x0eNOTFOUND_ERROR\x10\x02\x12\x11\n" +
+	"\rNETWORK_ERROR\x10\x03\x12\x14\n" +
+	"\x10EVALUATION_ERROR\x10\x04\x12\x14\n" +
+	"\x10INVALPARAM_ERROR\x10\x05\x12\x12\n" +
+	"\x0eINTERNAL_ERROR\x10\x06\x12\x11\n" +
+	"\rEXPLICIT_DENY\x10\a\x12\x11\n" +
+	"\rUNKNOWN_ERROR\x10d\x1a\xdb\x01\n" +
+	"\x06Bundle\x12\x1a\n" +
+	"\brevision\x18\x01 \x01(\x04R\brevision\x12S\n" +
+	"\adomains\x18\x02 \x03(\v29.manetu.policyengine.events.v1.AccessRecord.Bundle.DomainR\adomains\x12 \n" +
+	"\vfingerprint\x18\x03 \x01(\fR\vfingerprint\x1a>\n" +
+	"\x06Domain\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12 \n" +
+	"\vfingerprint\x18\x02 \x01(\fR\vfingerprint\x1a\xc9\x01\n" +
+	"\bDefaults\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\x12P\n" +
+	"\bdecision\x18\x02 \x01(\x0e24.manetu.policyengine.events.v1.AccessRecord.DecisionR\bdecision\x12S\n" +
+	"\tcombining\x18\x03 \x01(\x0e25.manetu.policyengine.events.v1.AccessRecord.CombiningR\tcombining\x1a\x9c\x01\n" +
+	"\x05Fetch\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\x12\x10\n" +
+	"\x03url\x18\x02 \x01(\tR\x03url\x12\x1f\n" +
+	"\vstatus_code\x18\x03 \x01(\rR\n" +
+	"statusCode\x12\x16\n" +
+	"\x06cached\x18\x04 \x01(\bR\x06cached\x12\x14\n" +
+	"\x05error\x18\x05 \x01(\tR\x05error\x12\x1a\n" +
+	"\bduration\x18\x06 \x01(\x04R\bduration\x1a\x95\x01\n" +
+	"\bOverride\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12$\n" +
+	"\rjustification\x18\x02 \x01(\tR\rjustification\x12\x1d\n" +
+	"\n" +
+	"created_by\x18\x03 \x01(\tR\tcreatedBy\x124\n" +
+	"\aexpires\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\aexpires\x1a\xcc\x03\n" +
+	"\bDuration\x12\x18\n" +
+	"\aoverall\x18\x01 \x01(\x04R\aoverall\x12X\n" +
+	"\x06phases\x18\x02 \x03(\v2@.manetu.policyengine.events.v1.AccessRecord.Duration.PhasesEntryR\x06phases\x12X\n" +
+	"\tbreakdown\x18\x03 \x03(\v2:.manetu.policyengine.events.v1.AccessRecord.Duration.PhaseR\tbreakdown\x1a\xb6\x01\n" +
+	"\x05Phase\x12W\n" +
+	"\x05phase\x18\x01 \x01(\x0e2A.manetu.policyengine.events.v1.AccessRecord.BundleReference.PhaseR\x05phase\x12\x18\n" +
+	"\aoverall\x18\x02 \x01(\x04R\aoverall\x12\x1e\n" +
+	"\n" +
+	"evaluation\x18\x03 \x01(\x04R\n" +
+	"evaluation\x12\x1a\n" +
+	"\bpolicies\x18\x04 \x01(\rR\bpolicies\x1a9\n" +
+	"\vPhasesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\rR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\x1a0\n" +
+	"\x06Mapper\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x1aT\n" +
+	"\x0eOperationMatch\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x12\x1a\n" +
+	"\bselector\x18\x03 \x01(\tR\bselector\x1a?\n" +
+	"\aPurpose\x12\x1a\n" +
+	"\bdeclared\x18\x01 \x03(\tR\bdeclared\x12\x18\n" +
+	"\aallowed\x18\x02 \x03(\tR\aallowed\x1ac\n" +
+	"\bApproval\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12\x1a\n" +
+	"\brequired\x18\x02 \x01(\rR\brequired\x12\x1c\n" +
+	"\tapprovers\x18\x03 \x03(\tR\tapprovers\x1al\n" +
+	"\x04Risk\x12\x14\n" +
+	"\x05score\x18\x01 \x01(\x01R\x05score\x12\x1a\n" +
+	"\bprovider\x18\x02 \x01(\tR\bprovider\x12\x1c\n" +
+	"\tdefaulted\x18\x03 \x01(\bR\tdefaulted\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\x1af\n" +
+	"\bIdentity\x12\x10\n" +
+	"\x03all\x18\x01 \x01(\bR\x03all\x12\x18\n" +
+	"\aminimum\x18\x02 \x01(\rR\aminimum\x12\x14\n" +
+	"\x05roles\x18\x03 \x01(\rR\x05roles\x12\x18\n" +
+	"\agranted\x18\x04 \x01(\rR\agranted\x1a\xe9\x01\n" +
+	"\rImpersonation\x12W\n" +
+	"\x06actors\x18\x01 \x03(\v2?.manetu.policyengine.events.v1.AccessRecord.Impersonation.ActorR\x06actors\x12\x1c\n" +
+	"\tpermitted\x18\x02 \x01(\bR\tpermitted\x1aa\n" +
+	"\x05Actor\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\x12\x14\n" +
+	"\x05realm\x18\x02 \x01(\tR\x05realm\x12\x14\n" +
+	"\x05roles\x18\x03 \x03(\tR\x05roles\x12\x12\n" +
+	"\x04rule\x18\x04 \x01(\tR\x04rule\"=\n" +
 	"\bDecision\x12\x0f\n" +
 	"\vUNSPECIFIED\x10\x00\x12\t\n" +
 	"\x05GRANT\x10\x01\x12\b\n" +
-	"\x04DENY\x10\x02\"O\n" +
+	"\x04DENY\x10\x02\x12\v\n" +
+	"\aPENDING\x10\x03\"`\n" +
 	"\x11BypassGrantReason\x12\x0f\n" +
 	"\vNOT_GRANTED\x10\x00\x12\n" +
 	"\n" +
 	"\x06PUBLIC\x10\x01\x12\v\n" +
 	"\aVISITOR\x10\x02\x12\x10\n" +
-	"\fANTI_LOCKOUT\x10\x03\"K\n" +
+	"\fANTI_LOCKOUT\x10\x03\x12\x0f\n" +
+	"\vBREAK_GLASS\x10\x04\"\x83\x01\n" +
 	"\x10BypassDenyReason\x12\x0e\n" +
 	"\n" +
 	"NOT_DENIED\x10\x00\x12\x10\n" +
 	"\fJWT_REQUIRED\x10\x01\x12\x15\n" +
-	"\x11OPERATOR_REQUIRED\x10\x02B\x11\n" +
+	"\x11OPERATOR_REQUIRED\x10\x02\x12\x0f\n" +
+	"\vDENY_LISTED\x10\x03\x12\v\n" +
+	"\aREVOKED\x10\x04\x12\x18\n" +
+	"\x14IMPERSONATION_DENIED\x10\x05\"\x1d\n" +
+	"\tCombining\x12\a\n" +
+	"\x03ALL\x10\x00\x12\a\n" +
+	"\x03ANY\x10\x01B\x11\n" +
 	"\x0foverride_reasonB\x9a\x02\n" +
 	"!com.manetu.policyengine.events.v1B\fMessageProtoP\x01ZPgithub.com/manetu/policyengine/pkg/protos/manetu/policyengine/events/v1;eventsv1\xa2\x02\x03MPE\xaa\x02\x1dManetu.Policyengine.Events.V1\xca\x02\x1dManetu\\Policyengine\\Events\\V1\xe2\x02)Manetu\\Policyengine\\Events\\V1\\GPBMetadata\xea\x02 Manetu::Policyengine::Events::V1b\x06proto3"
 
@@ -848,44 +2001,77 @@ func file_manetu_policyengine_events_v1_message_proto_rawDescGZIP() []byte {
 	return file_manetu_policyengine_events_v1_message_proto_rawDescData
 }
 
-var file_manetu_policyengine_events_v1_message_proto_enumTypes = make([]protoimpl.EnumInfo, 5)
-var file_manetu_policyengine_events_v1_message_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_manetu_policyengine_events_v1_message_proto_enumTypes = make([]protoimpl.EnumInfo, 6)
+var file_manetu_policyengine_events_v1_message_proto_msgTypes = make([]protoimpl.MessageInfo, 22)
 var file_manetu_policyengine_events_v1_message_proto_goTypes = []any{
 	(AccessRecord_Decision)(0),                   // 0: manetu.policyengine.events.v1.AccessRecord.Decision
 	(AccessRecord_BypassGrantReason)(0),          // 1: manetu.policyengine.events.v1.AccessRecord.BypassGrantReason
 	(AccessRecord_BypassDenyReason)(0),           // 2: manetu.policyengine.events.v1.AccessRecord.BypassDenyReason
-	(AccessRecord_BundleReference_Phase)(0),      // 3: manetu.policyengine.events.v1.AccessRecord.BundleReference.Phase
-	(AccessRecord_BundleReference_ReasonCode)(0), // 4: manetu.policyengine.events.v1.AccessRecord.BundleReference.ReasonCode
-	(*AccessRecord)(nil),                         // 5: manetu.policyengine.events.v1.AccessRecord
-	(*AccessRecord_Metadata)(nil),                // 6: manetu.policyengine.events.v1.AccessRecord.Metadata
-	(*AccessRecord_Principal)(nil),               // 7: manetu.policyengine.events.v1.AccessRecord.Principal
-	(*AccessRecord_PolicyReference)(nil),         // 8: manetu.policyengine.events.v1.AccessRecord.PolicyReference
-	(*AccessRecord_BundleReference)(nil),         // 9: manetu.policyengine.events.v1.AccessRecord.BundleReference
-	(*AccessRecord_Duration)(nil),                // 10: manetu.policyengine.events.v1.AccessRecord.Duration
-	nil,                                          // 11: manetu.policyengine.events.v1.AccessRecord.Metadata.EnvEntry
-	nil,                                          // 12: manetu.policyengine.events.v1.AccessRecord.Duration.PhasesEntry
-	(*timestamppb.Timestamp)(nil),                // 13: google.protobuf.Timestamp
+	(AccessRecord_Combining)(0),                  // 3: manetu.policyengine.events.v1.AccessRecord.Combining
+	(AccessRecord_BundleReference_Phase)(0),      // 4: manetu.policyengine.events.v1.AccessRecord.BundleReference.Phase
+	(AccessRecord_BundleReference_ReasonCode)(0), // 5: manetu.policyengine.events.v1.AccessRecord.BundleReference.ReasonCode
+	(*AccessRecord)(nil),                         // 6: manetu.policyengine.events.v1.AccessRecord
+	(*AccessRecord_Metadata)(nil),                // 7: manetu.policyengine.events.v1.AccessRecord.Metadata
+	(*AccessRecord_Principal)(nil),               // 8: manetu.policyengine.events.v1.AccessRecord.Principal
+	(*AccessRecord_PolicyReference)(nil),         // 9: manetu.policyengine.events.v1.AccessRecord.PolicyReference
+	(*AccessRecord_BundleReference)(nil),         // 10: manetu.policyengine.events.v1.AccessRecord.BundleReference
+	(*AccessRecord_Bundle)(nil),                  // 11: manetu.policyengine.events.v1.AccessRecord.Bundle
+	(*AccessRecord_Defaults)(nil),                // 12: manetu.policyengine.events.v1.AccessRecord.Defaults
+	(*AccessRecord_Fetch)(nil),                   // 13: manetu.policyengine.events.v1.AccessRecord.Fetch
+	(*AccessRecord_Override)(nil),                // 14: manetu.policyengine.events.v1.AccessRecord.Override
+	(*AccessRecord_Duration)(nil),                // 15: manetu.policyengine.events.v1.AccessRecord.Duration
+	(*AccessRecord_Mapper)(nil),                  // 16: manetu.policyengine.events.v1.AccessRecord.Mapper
+	(*AccessRecord_OperationMatch)(nil),          // 17: manetu.policyengine.events.v1.AccessRecord.OperationMatch
+	(*AccessRecord_Purpose)(nil),                 // 18: manetu.policyengine.events.v1.AccessRecord.Purpose
+	(*AccessRecord_Approval)(nil),                // 19: manetu.policyengine.events.v1.AccessRecord.Approval
+	(*AccessRecord_Risk)(nil),                    // 20: manetu.policyengine.events.v1.AccessRecord.Risk
+	(*AccessRecord_Identity)(nil),                // 21: manetu.policyengine.events.v1.AccessRecord.Identity
+	(*AccessRecord_Impersonation)(nil),           // 22: manetu.policyengine.events.v1.AccessRecord.Impersonation
+	nil,                                          // 23: manetu.policyengine.events.v1.AccessRecord.Metadata.EnvEntry
+	(*AccessRecord_Bundle_Domain)(nil),           // 24: manetu.policyengine.events.v1.AccessRecord.Bundle.Domain
+	(*AccessRecord_Duration_Phase)(nil),          // 25: manetu.policyengine.events.v1.AccessRecord.Duration.Phase
+	nil,                                          // 26: manetu.policyengine.events.v1.AccessRecord.Duration.PhasesEntry
+	(*AccessRecord_Impersonation_Actor)(nil),     // 27: manetu.policyengine.events.v1.AccessRecord.Impersonation.Actor
+	(*timestamppb.Timestamp)(nil),                // 28: google.protobuf.Timestamp
 }
 var file_manetu_policyengine_events_v1_message_proto_depIdxs = []int32{
-	6,  // 0: manetu.policyengine.events.v1.AccessRecord.metadata:type_name -> manetu.policyengine.events.v1.AccessRecord.Metadata
-	7,  // 1: manetu.policyengine.events.v1.AccessRecord.principal:type_name -> manetu.policyengine.events.v1.AccessRecord.Principal
+	7,  // 0: manetu.policyengine.events.v1.AccessRecord.metadata:type_name -> manetu.policyengine.events.v1.AccessRecord.Metadata
+	8,  // 1: manetu.policyengine.events.v1.AccessRecord.principal:type_name -> manetu.policyengine.events.v1.AccessRecord.Principal
 	0,  // 2: manetu.policyengine.events.v1.AccessRecord.decision:type_name -> manetu.policyengine.events.v1.AccessRecord.Decision
-	9,  // 3: manetu.policyengine.events.v1.AccessRecord.references:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference
+	10, // 3: manetu.policyengine.events.v1.AccessRecord.references:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference
 	1,  // 4: manetu.policyengine.events.v1.AccessRecord.grant_reason:type_name -> manetu.policyengine.events.v1.AccessRecord.BypassGrantReason
 	2,  // 5: manetu.policyengine.events.v1.AccessRecord.deny_reason:type_name -> manetu.policyengine.events.v1.AccessRecord.BypassDenyReason
-	10, // 6: manetu.policyengine.events.v1.AccessRecord.duration:type_name -> manetu.policyengine.events.v1.AccessRecord.Duration
-	13, // 7: manetu.policyengine.events.v1.AccessRecord.Metadata.timestamp:type_name -> google.protobuf.Timestamp
-	11, // 8: manetu.policyengine.events.v1.AccessRecord.Metadata.env:type_name -> manetu.policyengine.events.v1.AccessRecord.Metadata.EnvEntry
-	8,  // 9: manetu.policyengine.events.v1.AccessRecord.BundleReference.policies:type_name -> manetu.policyengine.events.v1.AccessRecord.PolicyReference
-	0,  // 10: manetu.policyengine.events.v1.AccessRecord.BundleReference.decision:type_name -> manetu.policyengine.events.v1.AccessRecord.Decision
-	3,  // 11: manetu.policyengine.events.v1.AccessRecord.BundleReference.phase:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference.Phase
-	4,  // 12: manetu.policyengine.events.v1.AccessRecord.BundleReference.reason_code:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference.ReasonCode
-	12, // 13: manetu.policyengine.events.v1.AccessRecord.Duration.phases:type_name -> manetu.policyengine.events.v1.AccessRecord.Duration.PhasesEntry
-	14, // [14:14] is the sub-list for method output_type
-	14, // [14:14] is the sub-list for method input_type
-	14, // [14:14] is the sub-list for extension type_name
-	14, // [14:14] is the sub-list for extension extendee
-	0,  // [0:14] is the sub-list for field type_name
+	15, // 6: manetu.policyengine.events.v1.AccessRecord.duration:type_name -> manetu.policyengine.events.v1.AccessRecord.Duration
+	11, // 7: manetu.policyengine.events.v1.AccessRecord.bundle:type_name -> manetu.policyengine.events.v1.AccessRecord.Bundle
+	12, // 8: manetu.policyengine.events.v1.AccessRecord.defaults:type_name -> manetu.policyengine.events.v1.AccessRecord.Defaults
+	13, // 9: manetu.policyengine.events.v1.AccessRecord.fetches:type_name -> manetu.policyengine.events.v1.AccessRecord.Fetch
+	14, // 10: manetu.policyengine.events.v1.AccessRecord.override:type_name -> manetu.policyengine.events.v1.AccessRecord.Override
+	16, // 11: manetu.policyengine.events.v1.AccessRecord.mapper:type_name -> manetu.policyengine.events.v1.AccessRecord.Mapper
+	17, // 12: manetu.policyengine.events.v1.AccessRecord.operation_match:type_name -> manetu.policyengine.events.v1.AccessRecord.OperationMatch
+	18, // 13: manetu.policyengine.events.v1.AccessRecord.purpose:type_name -> manetu.policyengine.events.v1.AccessRecord.Purpose
+	19, // 14: manetu.policyengine.events.v1.AccessRecord.approval:type_name -> manetu.policyengine.events.v1.AccessRecord.Approval
+	20, // 15: manetu.policyengine.events.v1.AccessRecord.risk:type_name -> manetu.policyengine.events.v1.AccessRecord.Risk
+	21, // 16: manetu.policyengine.events.v1.AccessRecord.identity:type_name -> manetu.policyengine.events.v1.AccessRecord.Identity
+	22, // 17: manetu.policyengine.events.v1.AccessRecord.impersonation:type_name -> manetu.policyengine.events.v1.AccessRecord.Impersonation
+	28, // 18: manetu.policyengine.events.v1.AccessRecord.Metadata.timestamp:type_name -> google.protobuf.Timestamp
+	23, // 19: manetu.policyengine.events.v1.AccessRecord.Metadata.env:type_name -> manetu.policyengine.events.v1.AccessRecord.Metadata.EnvEntry
+	9,  // 20: manetu.policyengine.events.v1.AccessRecord.BundleReference.policies:type_name -> manetu.policyengine.events.v1.AccessRecord.PolicyReference
+	0,  // 21: manetu.policyengine.events.v1.AccessRecord.BundleReference.decision:type_name -> manetu.policyengine.events.v1.AccessRecord.Decision
+	4,  // 22: manetu.policyengine.events.v1.AccessRecord.BundleReference.phase:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference.Phase
+	5,  // 23: manetu.policyengine.events.v1.AccessRecord.BundleReference.reason_code:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference.ReasonCode
+	24, // 24: manetu.policyengine.events.v1.AccessRecord.Bundle.domains:type_name -> manetu.policyengine.events.v1.AccessRecord.Bundle.Domain
+	0,  // 25: manetu.policyengine.events.v1.AccessRecord.Defaults.decision:type_name -> manetu.policyengine.events.v1.AccessRecord.Decision
+	3,  // 26: manetu.policyengine.events.v1.AccessRecord.Defaults.combining:type_name -> manetu.policyengine.events.v1.AccessRecord.Combining
+	28, // 27: manetu.policyengine.events.v1.AccessRecord.Override.expires:type_name -> google.protobuf.Timestamp
+	26, // 28: manetu.policyengine.events.v1.AccessRecord.Duration.phases:type_name -> manetu.policyengine.events.v1.AccessRecord.Duration.PhasesEntry
+	25, // 29: manetu.policyengine.events.v1.AccessRecord.Duration.breakdown:type_name -> manetu.policyengine.events.v1.AccessRecord.Duration.Phase
+	27, // 30: manetu.policyengine.events.v1.AccessRecord.Impersonation.actors:type_name -> manetu.policyengine.events.v1.AccessRecord.Impersonation.Actor
+	4,  // 31: manetu.policyengine.events.v1.AccessRecord.Duration.Phase.phase:type_name -> manetu.policyengine.events.v1.AccessRecord.BundleReference.Phase
+	32, // [32:32] is the sub-list for method output_type
+	32, // [32:32] is the sub-list for method input_type
+	32, // [32:32] is the sub-list for extension type_name
+	32, // [32:32] is the sub-list for extension extendee
+	0,  // [0:32] is the sub-list for field type_name
 }
 
 func init() { file_manetu_policyengine_events_v1_message_proto_init() }
@@ -902,8 +2088,8 @@ func file_manetu_policyengine_events_v1_message_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_manetu_policyengine_events_v1_message_proto_rawDesc), len(file_manetu_policyengine_events_v1_message_proto_rawDesc)),
-			NumEnums:      5,
-			NumMessages:   8,
+			NumEnums:      6,
+			NumMessages:   22,
 			NumExtensions: 0,
 			NumServices:   0,
 		},